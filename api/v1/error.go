@@ -0,0 +1,633 @@
+package log_v1
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// ErrOffsetOutOfRange is returned when reading an offset the log does not hold
+type ErrOffsetOutOfRange struct {
+	Offset uint64
+}
+
+// GRPCStatus maps the error to NotFound with a localized message for
+// clients, and an OFFSET_OUT_OF_RANGE reason with the offset in the metadata
+func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, e.Error())
+	msg := fmt.Sprintf(
+		"The requested offset is outside the log's range: %d",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	info := &errdetails.ErrorInfo{
+		Reason:   "OFFSET_OUT_OF_RANGE",
+		Domain:   "proglog",
+		Metadata: map[string]string{"offset": strconv.FormatUint(e.Offset, 10)},
+	}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOffsetOutOfRange) Error() string {
+	return fmt.Sprintf("offset out of range: %d", e.Offset)
+}
+
+// ErrNotLeader is returned when a write reaches a server that isn't the
+// cluster's leader. Leader is the leader's RPC address, empty when unknown.
+type ErrNotLeader struct {
+	Leader string
+}
+
+// GRPCStatus maps the error to FailedPrecondition with a NOT_LEADER reason
+// and the leader's address in the metadata, so clients can redirect
+func (e ErrNotLeader) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, e.Error())
+	d := &errdetails.ErrorInfo{
+		Reason:   "NOT_LEADER",
+		Domain:   "proglog",
+		Metadata: map[string]string{"leader": e.Leader},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotLeader) Error() string {
+	if e.Leader == "" {
+		return "not the leader"
+	}
+	return fmt.Sprintf("not the leader, leader is %s", e.Leader)
+}
+
+// ErrNotEnoughReplicas rejects an ACK_ALL produce while fewer replicas than
+// the configured minimum, the leader included, are in sync
+type ErrNotEnoughReplicas struct {
+	InSync   int
+	Required int
+}
+
+// GRPCStatus maps the error to Unavailable with a NOT_ENOUGH_REPLICAS reason,
+// the produce can be retried once replicas catch up
+func (e ErrNotEnoughReplicas) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, e.Error())
+	d := &errdetails.ErrorInfo{
+		Reason: "NOT_ENOUGH_REPLICAS",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"in_sync":  strconv.Itoa(e.InSync),
+			"required": strconv.Itoa(e.Required),
+		},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNotEnoughReplicas) Error() string {
+	return fmt.Sprintf("not enough replicas in sync: %d, need %d", e.InSync, e.Required)
+}
+
+// ErrOffsetNotReplicated is returned when a read waiting for its min offset
+// gives up before the serving server has the record
+type ErrOffsetNotReplicated struct {
+	Offset uint64
+}
+
+// GRPCStatus maps the error to Unavailable with an OFFSET_NOT_REPLICATED
+// reason, another server or a retry may have the record
+func (e ErrOffsetNotReplicated) GRPCStatus() *status.Status {
+	st := status.New(codes.Unavailable, e.Error())
+	msg := fmt.Sprintf(
+		"The server hasn't replicated the log up to offset %d yet",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	info := &errdetails.ErrorInfo{
+		Reason:   "OFFSET_NOT_REPLICATED",
+		Domain:   "proglog",
+		Metadata: map[string]string{"offset": strconv.FormatUint(e.Offset, 10)},
+	}
+	std, err := st.WithDetails(d, info)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrOffsetNotReplicated) Error() string {
+	return fmt.Sprintf("offset not replicated yet: %d", e.Offset)
+}
+
+// ErrPartitionNotFound is returned for a partition past the last one the log has
+type ErrPartitionNotFound struct {
+	Partition  uint32
+	Partitions int
+}
+
+// GRPCStatus maps the error to NotFound with a PARTITION_NOT_FOUND reason
+func (e ErrPartitionNotFound) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, e.Error())
+	d := &errdetails.ErrorInfo{
+		Reason: "PARTITION_NOT_FOUND",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"partition":  strconv.FormatUint(uint64(e.Partition), 10),
+			"partitions": strconv.Itoa(e.Partitions),
+		},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrPartitionNotFound) Error() string {
+	return fmt.Sprintf("partition not found: %d, the log has %d", e.Partition, e.Partitions)
+}
+
+// ErrTopicNotFound is returned for a topic the server doesn't hold
+type ErrTopicNotFound struct {
+	Topic string
+}
+
+// GRPCStatus maps the error to NotFound with a TOPIC_NOT_FOUND reason
+func (e ErrTopicNotFound) GRPCStatus() *status.Status {
+	return topicStatus(codes.NotFound, "TOPIC_NOT_FOUND", e.Topic, e.Error())
+}
+
+func (e ErrTopicNotFound) Error() string {
+	return fmt.Sprintf("topic not found: %s", e.Topic)
+}
+
+// ErrTopicExists is returned creating a topic the server already holds
+type ErrTopicExists struct {
+	Topic string
+}
+
+// GRPCStatus maps the error to AlreadyExists with a TOPIC_EXISTS reason
+func (e ErrTopicExists) GRPCStatus() *status.Status {
+	return topicStatus(codes.AlreadyExists, "TOPIC_EXISTS", e.Topic, e.Error())
+}
+
+func (e ErrTopicExists) Error() string {
+	return fmt.Sprintf("topic already exists: %s", e.Topic)
+}
+
+// ErrSubscriptionNotFound is returned for a subscription there's none of
+type ErrSubscriptionNotFound struct {
+	Subscription string
+}
+
+// GRPCStatus maps the error to NotFound with a SUBSCRIPTION_NOT_FOUND
+// reason
+func (e ErrSubscriptionNotFound) GRPCStatus() *status.Status {
+	return subscriptionStatus(codes.NotFound, "SUBSCRIPTION_NOT_FOUND", e.Subscription, e.Error())
+}
+
+func (e ErrSubscriptionNotFound) Error() string {
+	return fmt.Sprintf("subscription not found: %s", e.Subscription)
+}
+
+// ErrSubscriptionExists is returned creating a subscription there's one
+// of by the name
+type ErrSubscriptionExists struct {
+	Subscription string
+}
+
+// GRPCStatus maps the error to AlreadyExists with a SUBSCRIPTION_EXISTS
+// reason
+func (e ErrSubscriptionExists) GRPCStatus() *status.Status {
+	return subscriptionStatus(codes.AlreadyExists, "SUBSCRIPTION_EXISTS", e.Subscription, e.Error())
+}
+
+func (e ErrSubscriptionExists) Error() string {
+	return fmt.Sprintf("subscription already exists: %s", e.Subscription)
+}
+
+// ErrSchemaNotFound is returned for a version of a topic's schema there's
+// none of, Version zero for a topic without any
+type ErrSchemaNotFound struct {
+	Topic   string
+	Version uint32
+}
+
+// GRPCStatus maps the error to NotFound with a SCHEMA_NOT_FOUND reason
+// and the topic and version in the metadata
+func (e ErrSchemaNotFound) GRPCStatus() *status.Status {
+	return schemaStatus(codes.NotFound, "SCHEMA_NOT_FOUND", e.Topic, e.Version, "", e.Error())
+}
+
+func (e ErrSchemaNotFound) Error() string {
+	if e.Version == 0 {
+		return fmt.Sprintf("schema not found: topic %s has none", e.Topic)
+	}
+	return fmt.Sprintf("schema not found: topic %s has no version %d", e.Topic, e.Version)
+}
+
+// ErrIncompatibleSchema rejects registering a schema that isn't compatible
+// with the topic's latest, Version, as the topic's schema.compatibility
+// config asks
+type ErrIncompatibleSchema struct {
+	Topic   string
+	Version uint32
+	Reason  string
+}
+
+// GRPCStatus maps the error to FailedPrecondition with an
+// INCOMPATIBLE_SCHEMA reason
+func (e ErrIncompatibleSchema) GRPCStatus() *status.Status {
+	return schemaStatus(codes.FailedPrecondition, "INCOMPATIBLE_SCHEMA", e.Topic, e.Version, e.Reason, e.Error())
+}
+
+func (e ErrIncompatibleSchema) Error() string {
+	return fmt.Sprintf("incompatible schema: topic %s version %d: %s", e.Topic, e.Version, e.Reason)
+}
+
+// ErrSchemaViolation rejects a produce whose record value doesn't match
+// the topic's latest schema, Version
+type ErrSchemaViolation struct {
+	Topic   string
+	Version uint32
+	Reason  string
+}
+
+// GRPCStatus maps the error to InvalidArgument with a SCHEMA_VIOLATION
+// reason, the record won't match however often it's retried
+func (e ErrSchemaViolation) GRPCStatus() *status.Status {
+	return schemaStatus(codes.InvalidArgument, "SCHEMA_VIOLATION", e.Topic, e.Version, e.Reason, e.Error())
+}
+
+func (e ErrSchemaViolation) Error() string {
+	return fmt.Sprintf("schema violation: topic %s version %d: %s", e.Topic, e.Version, e.Reason)
+}
+
+func schemaStatus(code codes.Code, reason, topic string, version uint32, why, msg string) *status.Status {
+	st := status.New(code, msg)
+	md := map[string]string{"topic": topic, "version": strconv.FormatUint(uint64(version), 10)}
+	if why != "" {
+		md["reason"] = why
+	}
+	d := &errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   "proglog",
+		Metadata: md,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func subscriptionStatus(code codes.Code, reason, subscription, msg string) *status.Status {
+	st := status.New(code, msg)
+	d := &errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   "proglog",
+		Metadata: map[string]string{"subscription": subscription},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func topicStatus(code codes.Code, reason, topic, msg string) *status.Status {
+	st := status.New(code, msg)
+	d := &errdetails.ErrorInfo{
+		Reason:   reason,
+		Domain:   "proglog",
+		Metadata: map[string]string{"topic": topic},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+// ErrRecordTooLarge rejects a produce whose record value is larger than
+// the topic takes
+type ErrRecordTooLarge struct {
+	Size uint64
+	Max  uint64
+}
+
+// GRPCStatus maps the error to InvalidArgument with a RECORD_TOO_LARGE
+// reason, the record won't fit however often it's retried
+func (e ErrRecordTooLarge) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, e.Error())
+	d := &errdetails.ErrorInfo{
+		Reason: "RECORD_TOO_LARGE",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"size": strconv.FormatUint(e.Size, 10),
+			"max":  strconv.FormatUint(e.Max, 10),
+		},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrRecordTooLarge) Error() string {
+	return fmt.Sprintf("record too large: %d bytes, the topic takes %d", e.Size, e.Max)
+}
+
+// ErrInvalidTimestamp rejects a produce whose record's Timestamp, in Unix
+// nanoseconds, is further than MaxSkew from the server's clock
+type ErrInvalidTimestamp struct {
+	Timestamp int64
+	MaxSkew   time.Duration
+}
+
+// GRPCStatus maps the error to InvalidArgument with an INVALID_TIMESTAMP
+// reason, the record needs a timestamp closer to now
+func (e ErrInvalidTimestamp) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, e.Error())
+	d := &errdetails.ErrorInfo{
+		Reason: "INVALID_TIMESTAMP",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"timestamp":   strconv.FormatInt(e.Timestamp, 10),
+			"max_skew_ms": strconv.FormatInt(e.MaxSkew.Milliseconds(), 10),
+		},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrInvalidTimestamp) Error() string {
+	return fmt.Sprintf("invalid timestamp: %s is more than %s from the server's clock",
+		time.Unix(0, e.Timestamp).UTC().Format(time.RFC3339Nano), e.MaxSkew)
+}
+
+// ErrDiskFull rejects a produce while the server's data volume is past its
+// hard limit, Used of its Capacity bytes taken, or while the Tenant of the
+// topic holds its max bytes on the server
+type ErrDiskFull struct {
+	Used     uint64
+	Capacity uint64
+	Tenant   string
+}
+
+// GRPCStatus maps the error to ResourceExhausted with a DISK_FULL reason,
+// the produce can be retried once retention frees space
+func (e ErrDiskFull) GRPCStatus() *status.Status {
+	st := status.New(codes.ResourceExhausted, e.Error())
+	d := &errdetails.ErrorInfo{
+		Reason: "DISK_FULL",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"used":     strconv.FormatUint(e.Used, 10),
+			"capacity": strconv.FormatUint(e.Capacity, 10),
+		},
+	}
+	if e.Tenant != "" {
+		d.Metadata["tenant"] = e.Tenant
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrDiskFull) Error() string {
+	if e.Tenant != "" {
+		return fmt.Sprintf("tenant %s full: %d of %d bytes used", e.Tenant, e.Used, e.Capacity)
+	}
+	return fmt.Sprintf("disk full: %d of %d bytes used", e.Used, e.Capacity)
+}
+
+// ErrStaleMetadata rejects a produce that picked its partition by a
+// version of the topic older than the server's, the topic's partitions
+// having changed since
+type ErrStaleMetadata struct {
+	Topic   string
+	Version uint64
+}
+
+// GRPCStatus maps the error to FailedPrecondition with a STALE_METADATA
+// reason and the topic's current version
+func (e ErrStaleMetadata) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, e.Error())
+	d := &errdetails.ErrorInfo{
+		Reason: "STALE_METADATA",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"topic":   e.Topic,
+			"version": strconv.FormatUint(e.Version, 10),
+		},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrStaleMetadata) Error() string {
+	return fmt.Sprintf("stale metadata: topic %s is at version %d", e.Topic, e.Version)
+}
+
+// ErrUnknownMember rejects a heartbeat from a member its group doesn't
+// have, dropped after its session timed out or by a new coordinator. The
+// member stops consuming and joins again.
+type ErrUnknownMember struct {
+	Group  string
+	Member string
+}
+
+// GRPCStatus maps the error to NotFound with an UNKNOWN_MEMBER reason and
+// the group and member in the metadata
+func (e ErrUnknownMember) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, e.Error())
+	d := &errdetails.ErrorInfo{
+		Reason:   "UNKNOWN_MEMBER",
+		Domain:   "proglog",
+		Metadata: map[string]string{"group": e.Group, "member": e.Member},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrUnknownMember) Error() string {
+	return fmt.Sprintf("unknown member %s of group %s", e.Member, e.Group)
+}
+
+// ErrFencedInstance rejects a heartbeat from a static member whose
+// instance ID a newer member of its group joined with. The member stops
+// consuming for good.
+type ErrFencedInstance struct {
+	Group    string
+	Instance string
+}
+
+// GRPCStatus maps the error to FailedPrecondition with a FENCED_INSTANCE
+// reason and the group and instance in the metadata
+func (e ErrFencedInstance) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, e.Error())
+	d := &errdetails.ErrorInfo{
+		Reason:   "FENCED_INSTANCE",
+		Domain:   "proglog",
+		Metadata: map[string]string{"group": e.Group, "instance": e.Instance},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrFencedInstance) Error() string {
+	return fmt.Sprintf("instance %s of group %s joined again elsewhere", e.Instance, e.Group)
+}
+
+// ErrNoOffset is returned under OFFSET_RESET_ERROR for a topic partition
+// the consumer or group never committed an offset to
+type ErrNoOffset struct {
+	Topic     string
+	Partition uint32
+}
+
+// GRPCStatus maps the error to NotFound with a NO_OFFSET reason and the
+// topic partition in the metadata
+func (e ErrNoOffset) GRPCStatus() *status.Status {
+	st := status.New(codes.NotFound, e.Error())
+	d := &errdetails.ErrorInfo{
+		Reason:   "NO_OFFSET",
+		Domain:   "proglog",
+		Metadata: map[string]string{"topic": e.Topic, "partition": strconv.FormatUint(uint64(e.Partition), 10)},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrNoOffset) Error() string {
+	return fmt.Sprintf("no offset committed to topic %s partition %d", e.Topic, e.Partition)
+}
+
+// ErrQuotaExceeded rejects a request from a principal so far past its
+// quota, or its tenant's, that throttling it would take too long. It can
+// be retried after RetryAfter.
+type ErrQuotaExceeded struct {
+	Principal  string
+	RetryAfter time.Duration
+}
+
+// GRPCStatus maps the error to ResourceExhausted with a QUOTA_EXCEEDED
+// reason, and the delay to retry after
+func (e ErrQuotaExceeded) GRPCStatus() *status.Status {
+	st := status.New(codes.ResourceExhausted, e.Error())
+	std, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   "QUOTA_EXCEEDED",
+		Domain:   "proglog",
+		Metadata: map[string]string{"principal": e.Principal},
+	}, &errdetails.RetryInfo{RetryDelay: durationpb.New(e.RetryAfter)})
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("quota exceeded for %s, retry after %s", e.Principal, e.RetryAfter)
+}
+
+// ErrRecordRejected rejects a produce whose record the topic's Transform
+// turned down, for the Reason it gave
+type ErrRecordRejected struct {
+	Topic     string
+	Transform string
+	Reason    string
+}
+
+// GRPCStatus maps the error to InvalidArgument with a RECORD_REJECTED
+// reason, the record won't be taken however often it's retried
+func (e ErrRecordRejected) GRPCStatus() *status.Status {
+	st := status.New(codes.InvalidArgument, e.Error())
+	d := &errdetails.ErrorInfo{
+		Reason: "RECORD_REJECTED",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"topic":     e.Topic,
+			"transform": e.Transform,
+			"reason":    e.Reason,
+		},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrRecordRejected) Error() string {
+	return fmt.Sprintf("record rejected: topic %s transform %s: %s", e.Topic, e.Transform, e.Reason)
+}
+
+// ErrProducerFenced rejects a produce by an idempotent producer whose
+// epoch is older than its producer's, registered again since by another
+// instance
+type ErrProducerFenced struct {
+	ProducerID uint64
+	Epoch      uint32
+	Current    uint32
+}
+
+// GRPCStatus maps the error to FailedPrecondition with a PRODUCER_FENCED
+// reason, the instance fenced should stop producing
+func (e ErrProducerFenced) GRPCStatus() *status.Status {
+	st := status.New(codes.FailedPrecondition, e.Error())
+	d := &errdetails.ErrorInfo{
+		Reason: "PRODUCER_FENCED",
+		Domain: "proglog",
+		Metadata: map[string]string{
+			"producer_id": strconv.FormatUint(e.ProducerID, 10),
+			"epoch":       strconv.FormatUint(uint64(e.Epoch), 10),
+			"current":     strconv.FormatUint(uint64(e.Current), 10),
+		},
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+	return std
+}
+
+func (e ErrProducerFenced) Error() string {
+	return fmt.Sprintf("producer fenced: producer %d epoch %d, current epoch %d", e.ProducerID, e.Epoch, e.Current)
+}
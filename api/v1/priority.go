@@ -0,0 +1,19 @@
+package log_v1
+
+import "strings"
+
+// PriorityHeader is the gRPC metadata key and HTTP header carrying a
+// request's Priority, as its HeaderValue
+const PriorityHeader = "Proglog-Priority"
+
+// HeaderValue is the priority's name in PriorityHeader: its enum name's, in
+// lower case and without the prefix, e.g. "backfill"
+func (p Priority) HeaderValue() string {
+	return strings.ToLower(strings.TrimPrefix(p.String(), "PRIORITY_"))
+}
+
+// ParsePriority returns the priority a PriorityHeader names, and
+// PRIORITY_UNSPECIFIED for one it doesn't know
+func ParsePriority(v string) Priority {
+	return Priority(Priority_value["PRIORITY_"+strings.ToUpper(v)])
+}
@@ -0,0 +1,372 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"google.golang.org/grpc/status"
+)
+
+// The calls administering the log take the servers' admin permission
+
+// GetSegments lists the segments of the topic partition leader's copy of
+// the log
+func (c *Client) GetSegments(ctx context.Context, topic string, partition uint32) ([]*api.Segment, error) {
+	var res *api.GetSegmentsResponse
+	err := c.do(ctx, Call{Method: "GetSegments", Topic: topic, Partition: partition}, func(ctx context.Context) (err error) {
+		res, err = c.log().GetSegments(ctx, &api.GetSegmentsRequest{Topic: topic, Partition: partition})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Segments, nil
+}
+
+// Snapshot has the partition's leader snapshot it, returning the last raft
+// index the snapshot covers
+func (c *Client) Snapshot(ctx context.Context, partition uint32) (uint64, error) {
+	var res *api.SnapshotResponse
+	err := c.do(ctx, Call{Method: "Snapshot", Partition: partition}, func(ctx context.Context) (err error) {
+		res, err = c.admin().Snapshot(ctx, &api.SnapshotRequest{Partition: partition})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.Index, nil
+}
+
+// Backup writes a backup of a server's logs to w, a tar consistent as of
+// the call. It's retried until the server starts sending it, but a backup
+// that breaks off after is an error, w having part of it.
+func (c *Client) Backup(ctx context.Context, w io.Writer) (written int64, err error) {
+	return c.BackupTopic(ctx, "", w)
+}
+
+// BackupTopic writes a backup of just the topic's partitions on a server
+// to w, with the high watermark each was backed up to in its manifest,
+// see Backup. Extracted into another server's data directory it seeds the
+// topic there. An empty topic backs up every one.
+func (c *Client) BackupTopic(ctx context.Context, topic string, w io.Writer) (written int64, err error) {
+	err = c.do(ctx, Call{Method: "Backup", Topic: topic}, func(ctx context.Context) error {
+		stream, err := c.admin().Backup(ctx, &api.BackupRequest{Topic: topic})
+		if err != nil {
+			return err
+		}
+		for {
+			res, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil && written > 0 {
+				return fmt.Errorf("backup broke off after %d bytes: %s", written, status.Convert(err).Message())
+			}
+			if err != nil {
+				return err
+			}
+			n, err := w.Write(res.Chunk)
+			written += int64(n)
+			if err != nil {
+				return fmt.Errorf("writing backup: %w", err)
+			}
+		}
+	})
+	return written, err
+}
+
+// LinkBackup has a server back its logs up into a directory named name
+// beside its data directory, hard-linking the sealed segments, and returns
+// where. It's restored with proglog restore -link-dir on the server's
+// host. An empty name has the server stamp it with the time.
+func (c *Client) LinkBackup(ctx context.Context, name string) (*api.LinkBackupResponse, error) {
+	var res *api.LinkBackupResponse
+	err := c.do(ctx, Call{Method: "LinkBackup"}, func(ctx context.Context) (err error) {
+		res, err = c.admin().LinkBackup(ctx, &api.LinkBackupRequest{Name: name})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Reencrypt has a server rewrite its sealed segments holding records
+// encrypted under any key but its current one, returning how many it
+// rewrote. Every server encrypts its own copies, so it's called on each.
+func (c *Client) Reencrypt(ctx context.Context) (int, error) {
+	var res *api.ReencryptResponse
+	err := c.do(ctx, Call{Method: "Reencrypt"}, func(ctx context.Context) (err error) {
+		res, err = c.admin().Reencrypt(ctx, &api.ReencryptRequest{})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.Segments), nil
+}
+
+// DeleteRecords removes the topic partition's records before the offset
+// from every server, returning the lowest offset left
+func (c *Client) DeleteRecords(ctx context.Context, topic string, partition uint32, before uint64) (uint64, error) {
+	var res *api.DeleteRecordsResponse
+	err := c.do(ctx, Call{Method: "DeleteRecords", Topic: topic, Partition: partition}, func(ctx context.Context) (err error) {
+		res, err = c.admin().DeleteRecords(ctx, &api.DeleteRecordsRequest{
+			Topic:        topic,
+			Partition:    partition,
+			BeforeOffset: before,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.LowWatermark, nil
+}
+
+// CompactTopic compacts the topic's partitions on the server the call goes
+// to now, returning how compacting them went
+func (c *Client) CompactTopic(ctx context.Context, topic string) ([]*api.Compaction, error) {
+	var res *api.CompactTopicResponse
+	err := c.do(ctx, Call{Method: "CompactTopic", Topic: topic}, func(ctx context.Context) (err error) {
+		res, err = c.admin().CompactTopic(ctx, &api.CompactTopicRequest{Topic: topic})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Partitions, nil
+}
+
+// DescribeCompaction returns how compacting the topic's partitions on the
+// server the call goes to went
+func (c *Client) DescribeCompaction(ctx context.Context, topic string) ([]*api.Compaction, error) {
+	var res *api.DescribeCompactionResponse
+	err := c.do(ctx, Call{Method: "DescribeCompaction", Topic: topic}, func(ctx context.Context) (err error) {
+		res, err = c.log().DescribeCompaction(ctx, &api.DescribeCompactionRequest{Topic: topic})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Partitions, nil
+}
+
+// CreateTopic creates the described topic empty, with its partitions, at
+// least one, and its configs overriding the servers' settings
+func (c *Client) CreateTopic(ctx context.Context, topic *api.Topic) error {
+	return c.do(ctx, Call{Method: "CreateTopic"}, func(ctx context.Context) error {
+		_, err := c.log().CreateTopic(ctx, &api.CreateTopicRequest{
+			Name:       topic.Name,
+			Partitions: topic.Partitions,
+			Configs:    topic.Configs,
+		})
+		return err
+	})
+}
+
+// AlterTopicConfigs changes the topic's config overrides, an empty value
+// removing one, and returns the topic as altered. The servers go by them
+// without restarting.
+func (c *Client) AlterTopicConfigs(ctx context.Context, name string, configs map[string]string) (*api.Topic, error) {
+	var res *api.AlterTopicConfigsResponse
+	err := c.do(ctx, Call{Method: "AlterTopicConfigs"}, func(ctx context.Context) (err error) {
+		res, err = c.log().AlterTopicConfigs(ctx, &api.AlterTopicConfigsRequest{Name: name, Configs: configs})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Topic, nil
+}
+
+// CreatePartitions raises the topic's partition count to n and returns the
+// topic with its partitions added. Records with keys go by the new count
+// from then on, the Client and Producer hashing them again as they learn
+// of it.
+func (c *Client) CreatePartitions(ctx context.Context, name string, n uint32) (*api.Topic, error) {
+	var res *api.CreatePartitionsResponse
+	err := c.do(ctx, Call{Method: "CreatePartitions"}, func(ctx context.Context) (err error) {
+		res, err = c.log().CreatePartitions(ctx, &api.CreatePartitionsRequest{Name: name, Partitions: n})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Topic, nil
+}
+
+// DeleteTopic deletes the topic and its records
+func (c *Client) DeleteTopic(ctx context.Context, name string) error {
+	return c.do(ctx, Call{Method: "DeleteTopic"}, func(ctx context.Context) error {
+		_, err := c.log().DeleteTopic(ctx, &api.DeleteTopicRequest{Name: name})
+		return err
+	})
+}
+
+// CreateSubscription subscribes a webhook to a topic, the servers POSTing
+// the records appended to it from then on, or all of them with
+// FromBeginning, to the subscription's https URL. The call goes to the
+// subscriptions topic's leader, which delivers them.
+func (c *Client) CreateSubscription(ctx context.Context, sub *api.Subscription) error {
+	return c.do(ctx, Call{Method: "CreateSubscription", Topic: log.SubscriptionsTopic}, func(ctx context.Context) error {
+		_, err := c.log().CreateSubscription(ctx, &api.CreateSubscriptionRequest{Subscription: sub})
+		return err
+	})
+}
+
+// DeleteSubscription stops and deletes the subscription
+func (c *Client) DeleteSubscription(ctx context.Context, name string) error {
+	return c.do(ctx, Call{Method: "DeleteSubscription", Topic: log.SubscriptionsTopic}, func(ctx context.Context) error {
+		_, err := c.log().DeleteSubscription(ctx, &api.DeleteSubscriptionRequest{Name: name})
+		return err
+	})
+}
+
+// ListSubscriptions lists the subscriptions in name order. It takes the
+// consume permission, as ListTopics does.
+func (c *Client) ListSubscriptions(ctx context.Context) ([]*api.Subscription, error) {
+	var res *api.ListSubscriptionsResponse
+	err := c.do(ctx, Call{Method: "ListSubscriptions", Topic: log.SubscriptionsTopic}, func(ctx context.Context) (err error) {
+		res, err = c.log().ListSubscriptions(ctx, &api.ListSubscriptionsRequest{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Subscriptions, nil
+}
+
+// ListDeadLetters returns up to max, 100 when zero, of the subscription's
+// dead letters from the offset on in its dead-letter topic's partition,
+// and the offset to list on from
+func (c *Client) ListDeadLetters(ctx context.Context, subscription string, offset uint64, max uint32) ([]*api.DeadLetter, uint64, error) {
+	var res *api.ListDeadLettersResponse
+	err := c.do(ctx, Call{Method: "ListDeadLetters", Topic: log.SubscriptionsTopic}, func(ctx context.Context) (err error) {
+		res, err = c.log().ListDeadLetters(ctx, &api.ListDeadLettersRequest{Subscription: subscription, Offset: offset, Max: max})
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return res.DeadLetters, res.NextOffset, nil
+}
+
+// ReplayDeadLetters POSTs up to max, 100 when zero, of the subscription's
+// dead letters from the offset on to its webhook again, returning how many
+// it did and the offset to replay on from. A failed replay is retried, so
+// a dead letter can be POSTed more than once.
+func (c *Client) ReplayDeadLetters(ctx context.Context, subscription string, offset uint64, max uint32) (uint32, uint64, error) {
+	var res *api.ReplayDeadLettersResponse
+	err := c.do(ctx, Call{Method: "ReplayDeadLetters", Topic: log.SubscriptionsTopic}, func(ctx context.Context) (err error) {
+		res, err = c.log().ReplayDeadLetters(ctx, &api.ReplayDeadLettersRequest{Subscription: subscription, Offset: offset, Max: max})
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return res.Replayed, res.NextOffset, nil
+}
+
+// RegisterSchema adds a version of the schema's topic's schema, returning
+// its version, once it's compatible with the latest as the topic's
+// schema.compatibility config asks, or api.ErrIncompatibleSchema. The same
+// schema as the latest gets the latest's version. The call goes to the
+// schemas topic's leader.
+func (c *Client) RegisterSchema(ctx context.Context, schema *api.Schema) (uint32, error) {
+	var res *api.RegisterSchemaResponse
+	err := c.do(ctx, Call{Method: "RegisterSchema", Topic: log.SchemasTopic}, func(ctx context.Context) (err error) {
+		res, err = c.log().RegisterSchema(ctx, &api.RegisterSchemaRequest{Schema: schema})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.Version, nil
+}
+
+// GetSchema returns the version of the topic's schema, its latest for
+// zero, or api.ErrSchemaNotFound
+func (c *Client) GetSchema(ctx context.Context, topic string, version uint32) (*api.Schema, error) {
+	var res *api.GetSchemaResponse
+	err := c.do(ctx, Call{Method: "GetSchema", Topic: log.SchemasTopic}, func(ctx context.Context) (err error) {
+		res, err = c.log().GetSchema(ctx, &api.GetSchemaRequest{Topic: topic, Version: version})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Schema, nil
+}
+
+// ListSchemas lists the topic's schemas in version order
+func (c *Client) ListSchemas(ctx context.Context, topic string) ([]*api.Schema, error) {
+	var res *api.ListSchemasResponse
+	err := c.do(ctx, Call{Method: "ListSchemas", Topic: log.SchemasTopic}, func(ctx context.Context) (err error) {
+		res, err = c.log().ListSchemas(ctx, &api.ListSchemasRequest{Topic: topic})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Schemas, nil
+}
+
+// DescribeQuotas returns the quotas of the server the call goes to, sorted
+// by tenant then principal
+func (c *Client) DescribeQuotas(ctx context.Context) ([]*api.Quota, error) {
+	var res *api.DescribeQuotasResponse
+	err := c.do(ctx, Call{Method: "DescribeQuotas"}, func(ctx context.Context) (err error) {
+		res, err = c.log().DescribeQuotas(ctx, &api.DescribeQuotasRequest{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Quotas, nil
+}
+
+// DescribeTenants returns the stats of the tenant on the server the call
+// goes to, every tenant's when it's empty and the caller isn't a tenant's
+// principal, sorted by name
+func (c *Client) DescribeTenants(ctx context.Context, tenant string) ([]*api.TenantStats, error) {
+	var res *api.DescribeTenantsResponse
+	err := c.do(ctx, Call{Method: "DescribeTenants"}, func(ctx context.Context) (err error) {
+		res, err = c.log().DescribeTenants(ctx, &api.DescribeTenantsRequest{Tenant: tenant})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Tenants, nil
+}
+
+// AlterQuotas sets the quotas on the server the call goes to, those with
+// no rates removing their principal's or tenant's, and returns its quotas
+// as altered. Each server has its own, lasting until it restarts.
+func (c *Client) AlterQuotas(ctx context.Context, quotas ...*api.Quota) ([]*api.Quota, error) {
+	var res *api.AlterQuotasResponse
+	err := c.do(ctx, Call{Method: "AlterQuotas"}, func(ctx context.Context) (err error) {
+		res, err = c.admin().AlterQuotas(ctx, &api.AlterQuotasRequest{Quotas: quotas})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Quotas, nil
+}
+
+// DescribeServer returns what the server the call goes to runs: its build,
+// effective settings with secrets redacted, enabled features and the API
+// versions it serves
+func (c *Client) DescribeServer(ctx context.Context) (*api.DescribeServerResponse, error) {
+	var res *api.DescribeServerResponse
+	err := c.do(ctx, Call{Method: "DescribeServer"}, func(ctx context.Context) (err error) {
+		res, err = c.admin().DescribeServer(ctx, &api.DescribeServerRequest{})
+		return err
+	})
+	return res, err
+}
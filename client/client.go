@@ -0,0 +1,668 @@
+// Package client is the Go client for proglog. It finds the cluster's
+// servers from any one of them, sends produces to the leader and consumes
+// to the followers, retries calls that fail while the cluster recovers
+// and returns the server's errors as the api package's types. Servers
+// that aren't a partition's leader name the one that is, and the client
+// sends the partition's calls there from then on, so a failover costs a
+// redirect rather than failed calls.
+package client
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"github.com/frankie-mur/proglog/internal/loadbalance"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/proto"
+)
+
+type Config struct {
+	// Addr is the RPC address of any of the cluster's servers, the client
+	// finds the others from it, or an xDS target, see XDSScheme
+	Addr string
+	// TLSConfig dials the servers over TLS, or TLS builds it from files.
+	// With neither the client dials plaintext.
+	TLSConfig *tls.Config
+	TLS       *TLSFiles
+	// APIKey and Token authenticate the client, sent with every call in
+	// the X-Api-Key header and as a bearer token
+	APIKey string
+	Token  string
+	// AdminAddr is a server's admin address, for servers that serve the
+	// Admin service there rather than on their RPC address. The calls
+	// administering the log go to that server, dialed as Addr's are, and
+	// the rest to Addr's.
+	AdminAddr string
+	// AdminAPIKey authenticates the calls to AdminAddr, APIKey when empty
+	AdminAPIKey string
+	// Zone is the client's zone, consumes go to followers in it when
+	// there are any
+	Zone string
+	// Retry is how calls failing while the cluster recovers are retried
+	Retry RetryConfig
+	// Hedge sends consumes slow to answer to a second follower, off
+	// unless its Percentile is set
+	Hedge HedgeConfig
+	// Pool is how many connections the client opens and how calls and
+	// streams share them
+	Pool PoolConfig
+	// Hooks observe every call, each called in turn. See PrometheusHooks
+	// and OTelHooks for built in ones.
+	Hooks []Hooks
+	// DialOptions are added to the connection's
+	DialOptions []grpc.DialOption
+}
+
+// Client calls a proglog cluster. It's safe for concurrent use.
+type Client struct {
+	pool  *pool
+	retry RetryConfig
+	hooks hookList
+	meta  *metadata
+	hedge *hedger
+	// adminConn is AdminAddr's connection, nil without it
+	adminConn *grpc.ClientConn
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func New(config Config) (*Client, error) {
+	if config.Addr == "" {
+		return nil, errors.New("client: Addr is required")
+	}
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	poolConfig := config.Pool.withDefaults()
+	dialOptions := func(apiKey string) []grpc.DialOption {
+		opts := []grpc.DialOption{grpc.WithTransportCredentials(creds), poolConfig.keepalive()}
+		if apiKey != "" || config.Token != "" {
+			opts = append(opts, grpc.WithPerRPCCredentials(headers{
+				apiKey: apiKey,
+				token:  config.Token,
+			}))
+		}
+		return append(opts, config.DialOptions...)
+	}
+	opts := dialOptions(config.APIKey)
+	// the resolver asks the cluster for its servers with the same
+	// credentials. A control plane tells gRPC of xDS targets' servers
+	// instead, though not which leads, see XDSScheme
+	var resolver *loadbalance.Builder
+	target := config.Addr
+	if !isXDS(config.Addr) {
+		resolver = &loadbalance.Builder{DialOptions: opts, Zone: config.Zone}
+		target = loadbalance.Name + ":///" + config.Addr
+		opts = append(opts, grpc.WithResolvers(resolver))
+	}
+	pool, err := newPool(poolConfig.Conns, poolConfig.MaxStreams, func() (*grpc.ClientConn, error) {
+		return grpc.NewClient(target, opts...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	var adminConn *grpc.ClientConn
+	if config.AdminAddr != "" {
+		adminConn, err = grpc.NewClient(config.AdminAddr, dialOptions(cmp.Or(config.AdminAPIKey, config.APIKey))...)
+		if err != nil {
+			return nil, errors.Join(err, pool.close())
+		}
+	}
+	return &Client{
+		pool:      pool,
+		retry:     config.Retry.withDefaults(),
+		hooks:     config.Hooks,
+		meta:      &metadata{resolver: resolver},
+		hedge:     newHedger(config.Hedge),
+		adminConn: adminConn,
+	}, nil
+}
+
+// Produce appends the value to partition 0, returning its offset
+func (c *Client) Produce(ctx context.Context, value []byte) (uint64, error) {
+	res, err := c.ProduceRecord(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: value},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.Offset, nil
+}
+
+// DeleteKey deletes the key from the topic, producing a tombstone for it,
+// a record with the key and no value, to the partition the key hashes to.
+// Once the topic compacts, the key's records before it are removed, and the
+// tombstone too after the topic's delete.retention.ms.
+func (c *Client) DeleteKey(ctx context.Context, topic string, key []byte) error {
+	if len(key) == 0 {
+		return errors.New("client: DeleteKey needs a key")
+	}
+	_, err := c.ProduceRecord(ctx, &api.ProduceRequest{Topic: topic, Record: &api.Record{Key: key}})
+	return err
+}
+
+// ProduceRecord makes the produce request, retrying it while the cluster
+// can't take it. A produce the server applied but whose response was lost
+// is appended again by the retry. A record with a key goes to the
+// partition PartitionForKey hashes it to, whatever the request's partition,
+// and is hashed again if the topic has had partitions added since the
+// client learned its count.
+func (c *Client) ProduceRecord(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	for attempt := 0; ; attempt++ {
+		res, err := c.produceRecord(ctx, req)
+		if req.Record.GetKey() != nil &&
+			(errors.As(err, &api.ErrPartitionNotFound{}) || errors.As(err, &api.ErrStaleMetadata{})) {
+			c.meta.forgetPartitions(topicName(req.Topic))
+			if errors.As(err, &api.ErrStaleMetadata{}) && attempt < staleMetadataRetries {
+				continue
+			}
+		}
+		return res, err
+	}
+}
+
+// Makes the produce request once, to the partition the record goes to
+func (c *Client) produceRecord(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	p, version, err := c.partitionFor(ctx, req.Topic, req.Record, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if p != req.Partition || version != nil {
+		req = proto.Clone(req).(*api.ProduceRequest)
+		req.Partition, req.TopicVersion = p, version
+	}
+	var res *api.ProduceResponse
+	err = c.do(ctx, Call{Method: "Produce", Topic: req.Topic, Partition: req.Partition, Records: 1}, func(ctx context.Context) (err error) {
+		res, err = c.log().Produce(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+// Consume reads the record at the offset from partition 0
+func (c *Client) Consume(ctx context.Context, offset uint64) (*api.Record, error) {
+	return c.ConsumeRecord(ctx, &api.ConsumeRequest{Offset: offset})
+}
+
+// ConsumeRecord makes the consume request, retrying it while the cluster
+// can't answer it. Reading past the end of the partition fails with
+// api.ErrOffsetOutOfRange. Compressed records are returned decompressed.
+// Consumes are hedged as Config.Hedge says.
+func (c *Client) ConsumeRecord(ctx context.Context, req *api.ConsumeRequest) (*api.Record, error) {
+	var res *api.ConsumeResponse
+	err := c.do(ctx, Call{Method: "Consume", Topic: req.Topic, Partition: req.Partition}, func(ctx context.Context) (err error) {
+		res, err = c.hedge.consume(ctx, func(ctx context.Context) (*api.ConsumeResponse, error) {
+			return c.log().Consume(ctx, req)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := codec.Decompress(res.Record); err != nil {
+		return nil, err
+	}
+	return res.Record, nil
+}
+
+// Fetch makes the consume request as a fetch, returning the records the
+// server read from its offset on once they add up to MinBytes or MaxWaitMs
+// is up, none if it timed out without any. It's never hedged, since it's
+// meant to wait. Compressed records are returned decompressed.
+func (c *Client) Fetch(ctx context.Context, req *api.ConsumeRequest) ([]*api.Record, error) {
+	var res *api.ConsumeResponse
+	err := c.do(ctx, Call{Method: "Consume", Topic: req.Topic, Partition: req.Partition}, func(ctx context.Context) (err error) {
+		res, err = c.log().Consume(ctx, req)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range res.Records {
+		if err := codec.Decompress(record); err != nil {
+			return nil, err
+		}
+	}
+	return res.Records, nil
+}
+
+// ConsumeStream calls fn with every record of the partition from the
+// request's offset on, waiting for new ones at the end, until fn returns
+// an error, the server ends the stream or ctx is done. A stream that
+// breaks is reopened after the last record fn was called with, on another
+// server if its own died, attempts counting afresh once a reopened stream
+// has sent a record. It's reopened past Retry.MaxAttempts until
+// Retry.Failover has passed since the last record. Hooks see each open as
+// an attempt, and the stream acked once fn or the server ends it. fn is
+// called with compressed records decompressed.
+func (c *Client) ConsumeStream(ctx context.Context, req *api.ConsumeRequest, fn func(*api.Record) error) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	next := proto.Clone(req).(*api.ConsumeRequest)
+	call := Call{Method: "ConsumeStream", Topic: req.Topic, Partition: req.Partition, Start: time.Now()}
+	var fnErr error
+	since := call.Start
+	for attempt := 1; ; attempt++ {
+		call.Attempt++
+		c.hooks.send(call)
+		consumed, err := c.stream(ctx, next, func(record *api.Record) error {
+			fnErr = fn(record)
+			return fnErr
+		})
+		switch {
+		case fnErr != nil:
+			c.hooks.ack(call)
+			return fnErr
+		case err == io.EOF:
+			c.hooks.ack(call)
+			return nil
+		case ctx.Err() != nil:
+			c.hooks.fail(call, ctx.Err())
+			return ctx.Err()
+		}
+		if err = fromStatus(err); !Retryable(err) {
+			c.hooks.fail(call, err)
+			return err
+		}
+		if consumed {
+			attempt, since = 1, time.Now()
+		}
+		if c.retry.exhausted(attempt, true, since) {
+			c.hooks.fail(call, err)
+			return err
+		}
+		backoff := c.retry.backoff(attempt)
+		c.hooks.retry(call, err, backoff)
+		if sleep(ctx, backoff) != nil {
+			c.hooks.fail(call, err)
+			return err
+		}
+	}
+}
+
+// Opens a stream from the request's offset and calls fn with each record,
+// moving the offset past it
+func (c *Client) stream(ctx context.Context, req *api.ConsumeRequest, fn func(*api.Record) error) (
+	consumed bool, err error,
+) {
+	log, release, err := c.pool.stream(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+	stream, err := log.ConsumeStream(ctx, req)
+	if err != nil {
+		return false, err
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return consumed, err
+		}
+		if err := codec.Decompress(res.Record); err != nil {
+			return consumed, err
+		}
+		if err := fn(res.Record); err != nil {
+			return consumed, err
+		}
+		req.Offset = res.Record.Offset + 1
+		consumed = true
+	}
+}
+
+// CommitOffset records offset as the next record the consumer reads from
+// the topic's partition, for it to resume from with FetchOffset. An empty
+// topic is the default one, as it is in the calls below.
+func (c *Client) CommitOffset(ctx context.Context, consumer, topic string, partition uint32, offset uint64) error {
+	return c.do(ctx, Call{Method: "CommitOffset", Topic: topic, Partition: partition}, func(ctx context.Context) error {
+		_, err := c.log().CommitOffset(ctx, &api.CommitOffsetRequest{
+			Consumer:  consumer,
+			Topic:     topic,
+			Partition: partition,
+			Offset:    offset,
+		})
+		return err
+	})
+}
+
+// FetchOffset returns the offset the consumer last committed to the
+// topic's partition, found is false if it never has
+func (c *Client) FetchOffset(ctx context.Context, consumer, topic string, partition uint32) (
+	offset uint64, found bool, err error,
+) {
+	var res *api.FetchOffsetResponse
+	err = c.do(ctx, Call{Method: "FetchOffset", Topic: topic, Partition: partition}, func(ctx context.Context) (err error) {
+		res, err = c.log().FetchOffset(ctx, &api.FetchOffsetRequest{
+			Consumer:  consumer,
+			Topic:     topic,
+			Partition: partition,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	return res.Offset, res.Found, nil
+}
+
+// CommitGroupOffsets records the offsets as the next records the group
+// reads from their topic partitions. The servers keep them in their
+// offsets topic, so they outlive the consumers and the servers both, and
+// the call goes to that topic's leader.
+func (c *Client) CommitGroupOffsets(ctx context.Context, group string, offsets []*api.GroupOffset) error {
+	return c.do(ctx, Call{Method: "CommitGroupOffsets", Topic: log.OffsetsTopic}, func(ctx context.Context) error {
+		_, err := c.log().CommitGroupOffsets(ctx, &api.CommitGroupOffsetsRequest{Group: group, Offsets: offsets})
+		return err
+	})
+}
+
+// FetchGroupOffsets returns the offsets the group last committed to the
+// topic partitions, in their order, each found unless the group never
+// committed one
+func (c *Client) FetchGroupOffsets(ctx context.Context, group string, partitions []*api.GroupOffset) ([]*api.GroupOffset, error) {
+	var res *api.FetchGroupOffsetsResponse
+	err := c.do(ctx, Call{Method: "FetchGroupOffsets", Topic: log.OffsetsTopic}, func(ctx context.Context) (err error) {
+		res, err = c.log().FetchGroupOffsets(ctx, &api.FetchGroupOffsetsRequest{Group: group, Partitions: partitions})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Offsets, nil
+}
+
+// GetGroupLag returns how far the group is behind in each partition it
+// committed an offset to, every group's lag for an empty group
+func (c *Client) GetGroupLag(ctx context.Context, group string) ([]*api.GroupLag, error) {
+	var res *api.GetGroupLagResponse
+	err := c.do(ctx, Call{Method: "GetGroupLag", Topic: log.OffsetsTopic}, func(ctx context.Context) (err error) {
+		res, err = c.log().GetGroupLag(ctx, &api.GetGroupLagRequest{Group: group})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Lags, nil
+}
+
+// GetThroughput returns the rates and latencies of the produces and
+// consumes the server the call goes to has served for the topic's
+// partitions, every topic's when empty, over its window
+func (c *Client) GetThroughput(ctx context.Context, topic string) (*api.GetThroughputResponse, error) {
+	var res *api.GetThroughputResponse
+	err := c.do(ctx, Call{Method: "GetThroughput", Topic: topic}, func(ctx context.Context) (err error) {
+		res, err = c.log().GetThroughput(ctx, &api.GetThroughputRequest{Topic: topic})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// JoinGroup joins a consumer group, or heartbeats for a member of it, see
+// GroupConsumer. The call goes to the offsets topic's leader, which
+// coordinates the groups.
+func (c *Client) JoinGroup(ctx context.Context, req *api.JoinGroupRequest) (*api.JoinGroupResponse, error) {
+	var res *api.JoinGroupResponse
+	err := c.do(ctx, Call{Method: "JoinGroup", Topic: log.OffsetsTopic}, func(ctx context.Context) (err error) {
+		res, err = c.log().JoinGroup(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+// LeaveGroup removes the member from its group
+func (c *Client) LeaveGroup(ctx context.Context, group, member string) error {
+	return c.do(ctx, Call{Method: "LeaveGroup", Topic: log.OffsetsTopic}, func(ctx context.Context) error {
+		_, err := c.log().LeaveGroup(ctx, &api.LeaveGroupRequest{Group: group, MemberId: member})
+		return err
+	})
+}
+
+// BeginTransaction opens a transaction under the transactional ID, which
+// produces naming it in their requests append in until it's committed or
+// aborted, returning its number. Transactional produces aren't forwarded,
+// so each goes to its partition's leader, and the transaction is
+// coordinated by the server it's begun on.
+func (c *Client) BeginTransaction(ctx context.Context, transactionalID string) (uint64, error) {
+	var res *api.BeginTransactionResponse
+	err := c.do(ctx, Call{Method: "BeginTransaction"}, func(ctx context.Context) (err error) {
+		res, err = c.log().BeginTransaction(ctx, &api.BeginTransactionRequest{TransactionalId: transactionalID})
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return res.Transaction, nil
+}
+
+// CommitTransaction commits the transaction open under the transactional ID
+func (c *Client) CommitTransaction(ctx context.Context, transactionalID string) error {
+	return c.do(ctx, Call{Method: "CommitTransaction"}, func(ctx context.Context) error {
+		_, err := c.log().CommitTransaction(ctx, &api.CommitTransactionRequest{TransactionalId: transactionalID})
+		return err
+	})
+}
+
+// AbortTransaction aborts the transaction open under the transactional ID
+func (c *Client) AbortTransaction(ctx context.Context, transactionalID string) error {
+	return c.do(ctx, Call{Method: "AbortTransaction"}, func(ctx context.Context) error {
+		_, err := c.log().AbortTransaction(ctx, &api.AbortTransactionRequest{TransactionalId: transactionalID})
+		return err
+	})
+}
+
+// InitProducer registers an idempotent producer under the name, returning
+// its ID and epoch for its produces. Registering the name again fences the
+// instance registered before.
+func (c *Client) InitProducer(ctx context.Context, name string) (uint64, uint32, error) {
+	var res *api.InitProducerResponse
+	err := c.do(ctx, Call{Method: "InitProducer"}, func(ctx context.Context) (err error) {
+		res, err = c.log().InitProducer(ctx, &api.InitProducerRequest{Name: name})
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return res.ProducerId, res.Epoch, nil
+}
+
+// GetOffsets returns the range of offsets the topic partition's leader holds
+func (c *Client) GetOffsets(ctx context.Context, topic string, partition uint32) (*api.GetOffsetsResponse, error) {
+	var res *api.GetOffsetsResponse
+	err := c.do(ctx, Call{Method: "GetOffsets", Topic: topic, Partition: partition}, func(ctx context.Context) (err error) {
+		res, err = c.log().GetOffsets(ctx, &api.GetOffsetsRequest{Topic: topic, Partition: partition})
+		return err
+	})
+	return res, err
+}
+
+// OffsetForTime returns the offset of the topic partition's first record
+// with a timestamp at or after t, or the high watermark if there's none. It
+// searches the records' timestamps, which are in order but for the skew
+// the topic allows producers' timestamps, see log.OffsetForTime.
+func (c *Client) OffsetForTime(ctx context.Context, topic string, partition uint32, t time.Time) (uint64, error) {
+	offs, err := c.GetOffsets(ctx, topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	skew := time.Duration(offs.TimestampSkewMs) * time.Millisecond
+	return log.OffsetForTime(offs.LowWatermark, offs.HighWatermark, t.UnixNano(), skew, func(off uint64) (*api.Record, error) {
+		return c.ConsumeRecord(ctx, &api.ConsumeRequest{
+			Offset:    off,
+			Topic:     topic,
+			Partition: partition,
+			// the follower serving it may not have it yet
+			MinOffset: &off,
+		})
+	})
+}
+
+// Query runs a SQL-like query over a range of the topic partition's
+// records, on whichever server the call reaches, as in
+//
+//	SELECT user.id, COUNT(*) WHERE kind = 'click' GROUP BY user.id
+//
+// Its rows' values are JSON. A response truncated before the range's end
+// has the offset to query on from.
+func (c *Client) Query(ctx context.Context, req *api.QueryRequest) (*api.QueryResponse, error) {
+	var res *api.QueryResponse
+	err := c.do(ctx, Call{Method: "Query", Topic: req.Topic, Partition: req.Partition}, func(ctx context.Context) (err error) {
+		res, err = c.log().Query(ctx, req)
+		return err
+	})
+	return res, err
+}
+
+// DescribeRecord returns what the server the call reaches knows of the
+// record at the offset: where its copy of the partition stores it, whether
+// it reads back whole and the leader epoch it was appended under, with its
+// value when includeValue is set
+func (c *Client) DescribeRecord(ctx context.Context, topic string, partition uint32, offset uint64, includeValue bool) (*api.DescribeRecordResponse, error) {
+	var res *api.DescribeRecordResponse
+	err := c.do(ctx, Call{Method: "DescribeRecord", Topic: topic, Partition: partition}, func(ctx context.Context) (err error) {
+		res, err = c.log().DescribeRecord(ctx, &api.DescribeRecordRequest{
+			Topic:        topic,
+			Partition:    partition,
+			Offset:       offset,
+			IncludeValue: includeValue,
+		})
+		return err
+	})
+	return res, err
+}
+
+// ListTopics lists the topics' names, the default topic's included. Listing
+// takes the consume permission, not the admin one.
+func (c *Client) ListTopics(ctx context.Context) ([]string, error) {
+	var res *api.ListTopicsResponse
+	err := c.do(ctx, Call{Method: "ListTopics"}, func(ctx context.Context) (err error) {
+		res, err = c.log().ListTopics(ctx, &api.ListTopicsRequest{})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Topics, nil
+}
+
+// DescribeTopic returns the topic's partition count and config overrides,
+// the default topic's for an empty name. It takes the consume permission,
+// as ListTopics does.
+func (c *Client) DescribeTopic(ctx context.Context, name string) (*api.Topic, error) {
+	var res *api.DescribeTopicResponse
+	err := c.do(ctx, Call{Method: "DescribeTopic"}, func(ctx context.Context) (err error) {
+		res, err = c.log().DescribeTopic(ctx, &api.DescribeTopicRequest{Name: name})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Topic, nil
+}
+
+// GetServers lists the servers replicating the partition
+func (c *Client) GetServers(ctx context.Context, partition uint32) (*api.GetServersResponse, error) {
+	var res *api.GetServersResponse
+	err := c.do(ctx, Call{Method: "GetServers", Partition: partition}, func(ctx context.Context) (err error) {
+		res, err = c.log().GetServers(ctx, &api.GetServersRequest{Partition: partition})
+		return err
+	})
+	return res, err
+}
+
+// Close closes the client's connections, calls in flight fail
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.adminConn != nil {
+		return errors.Join(c.pool.close(), c.adminConn.Close())
+	}
+	return c.pool.close()
+}
+
+// Makes the call with the retries configured, sending it to the topic
+// partition's leader when the client has learned where that is
+func (c *Client) do(ctx context.Context, call Call, fn func(context.Context) error) error {
+	return c.call(ctx, call, false, fn)
+}
+
+// Makes the call as do does, retrying it past Retry.MaxAttempts while a
+// server fails over, see RetryConfig.Failover
+func (c *Client) doFailover(ctx context.Context, call Call, fn func(context.Context) error) error {
+	return c.call(ctx, call, true, fn)
+}
+
+func (c *Client) call(ctx context.Context, call Call, failover bool, fn func(context.Context) error) error {
+	if c.isClosed() {
+		return ErrClosed
+	}
+	return c.retry.do(ctx, call, c.hooks, failover, func() error {
+		err := fn(c.meta.route(ctx, call.Topic, call.Partition))
+		c.meta.observe(call.Topic, call.Partition, fromStatus(err))
+		return err
+	})
+}
+
+// The API client the next call goes out on
+func (c *Client) log() api.LogClient {
+	return c.pool.next().log
+}
+
+// The Admin service, on AdminAddr when it's set
+func (c *Client) admin() api.AdminClient {
+	if c.adminConn != nil {
+		return api.NewAdminClient(c.adminConn)
+	}
+	return c.pool.next().admin
+}
+
+func (c *Client) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// headers authenticates every call
+type headers struct {
+	apiKey string
+	token  string
+}
+
+func (h headers) GetRequestMetadata(context.Context, ...string) (map[string]string, error) {
+	md := make(map[string]string)
+	if h.apiKey != "" {
+		md["x-api-key"] = h.apiKey
+	}
+	if h.token != "" {
+		md["authorization"] = "Bearer " + h.token
+	}
+	return md, nil
+}
+
+// Servers decide whether credentials need TLS, the client sends them either way
+func (headers) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,394 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/agent"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClient(t *testing.T) {
+	a, err := agent.New(agent.Config{
+		RPCAddr:  "127.0.0.1:0",
+		HTTPAddr: "127.0.0.1:0",
+		DataDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	defer a.Shutdown()
+
+	c, err := New(Config{Addr: a.AdvertiseRPCAddr})
+	require.NoError(t, err)
+	defer c.Close()
+	ctx := context.Background()
+
+	for i, value := range []string{"foo", "bar", "baz"} {
+		off, err := c.Produce(ctx, []byte(value))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	record, err := c.Consume(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("bar"), record.Value)
+
+	// the server's errors come back typed
+	_, err = c.Consume(ctx, 3)
+	var outOfRange api.ErrOffsetOutOfRange
+	require.ErrorAs(t, err, &outOfRange)
+	require.Equal(t, uint64(3), outOfRange.Offset)
+	_, err = c.ConsumeRecord(ctx, &api.ConsumeRequest{Partition: 1})
+	require.ErrorAs(t, err, &api.ErrPartitionNotFound{})
+	records, err := c.Fetch(ctx, &api.ConsumeRequest{Offset: 1, MaxWaitMs: 50, MinBytes: 1 << 10})
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, []byte("baz"), records[1].Value)
+
+	offs, err := c.GetOffsets(ctx, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), offs.HighWatermark)
+	for want, at := range map[uint64]time.Time{
+		0: {},
+		1: time.Unix(0, record.Timestamp),
+		3: time.Now().Add(time.Hour),
+	} {
+		off, err := c.OffsetForTime(ctx, "", 0, at)
+		require.NoError(t, err)
+		require.Equal(t, want, off)
+	}
+
+	segments, err := c.GetSegments(ctx, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), segments[len(segments)-1].NextOffset)
+	low, err := c.DeleteRecords(ctx, "", 0, 1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), low)
+	_, err = c.Reencrypt(ctx)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// topics come and go
+	require.NoError(t, c.CreateTopic(ctx, &api.Topic{Name: "events", Partitions: 4, Configs: map[string]string{"retention.ms": "60000"}}))
+	require.ErrorAs(t, c.CreateTopic(ctx, &api.Topic{Name: "events"}), &api.ErrTopicExists{})
+	topics, err := c.ListTopics(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"default", "events"}, topics)
+	topic, err := c.DescribeTopic(ctx, "events")
+	require.NoError(t, err)
+	require.Equal(t, uint32(4), topic.Partitions)
+	require.Equal(t, "60000", topic.Configs["retention.ms"])
+	topic, err = c.AlterTopicConfigs(ctx, "events", map[string]string{"max.record.bytes": "8"})
+	require.NoError(t, err)
+	require.Equal(t, "8", topic.Configs["max.record.bytes"])
+	_, err = c.ProduceRecord(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("too large event")}, Topic: "events"})
+	require.ErrorAs(t, err, &api.ErrRecordTooLarge{})
+	res, err := c.ProduceRecord(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("event")}, Topic: "events"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+	// keyed records go to the partition their key hashes to
+	key := []byte("user-1")
+	res, err = c.ProduceRecord(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("keyed"), Key: key},
+		Topic:  "events",
+	})
+	require.NoError(t, err)
+	record, err = c.ConsumeRecord(ctx, &api.ConsumeRequest{
+		Topic:     "events",
+		Partition: PartitionForKey(key, 4),
+		Offset:    res.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "keyed", string(record.Value))
+	require.Equal(t, key, record.Key)
+	// and once partitions are added, to the one it hashes to of the new
+	// count, though the client cached the old one
+	topic, err = c.CreatePartitions(ctx, "events", 8)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), topic.Version)
+	for i := 2; PartitionForKey(key, 8) == PartitionForKey(key, 4); i++ {
+		key = []byte(fmt.Sprintf("user-%d", i))
+	}
+	res, err = c.ProduceRecord(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("rehashed"), Key: key},
+		Topic:  "events",
+	})
+	require.NoError(t, err)
+	record, err = c.ConsumeRecord(ctx, &api.ConsumeRequest{
+		Topic:     "events",
+		Partition: PartitionForKey(key, 8),
+		Offset:    res.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, "rehashed", string(record.Value))
+	require.NoError(t, c.DeleteTopic(ctx, "events"))
+	_, err = c.GetOffsets(ctx, "events", 0)
+	require.ErrorAs(t, err, &api.ErrTopicNotFound{})
+
+	var values []string
+	stop := errors.New("stop")
+	err = c.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 1}, func(record *api.Record) error {
+		values = append(values, string(record.Value))
+		if len(values) == 2 {
+			return stop
+		}
+		return nil
+	})
+	require.Equal(t, stop, err)
+	require.Equal(t, []string{"bar", "baz"}, values)
+
+	require.NoError(t, c.Close())
+	_, err = c.Produce(ctx, []byte("foo"))
+	require.Equal(t, ErrClosed, err)
+}
+
+func TestClientReencrypt(t *testing.T) {
+	keys := log.NewKeyring()
+	require.NoError(t, keys.Add(1, bytes.Repeat([]byte{1}, 32)))
+	config := agent.Config{
+		RPCAddr:  "127.0.0.1:0",
+		HTTPAddr: "127.0.0.1:0",
+		DataDir:  t.TempDir(),
+	}
+	config.Log.Keyring = keys
+	config.Log.Segment.MaxIndexBytes = 3 * 12
+	a, err := agent.New(config)
+	require.NoError(t, err)
+	defer a.Shutdown()
+
+	c, err := New(Config{Addr: a.AdvertiseRPCAddr})
+	require.NoError(t, err)
+	defer c.Close()
+	ctx := context.Background()
+	for i := range 7 {
+		_, err := c.Produce(ctx, []byte(fmt.Sprintf("record %d", i)))
+		require.NoError(t, err)
+	}
+	n, err := c.Reencrypt(ctx)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	// rotated, the two sealed segments are rewritten under the new key
+	require.NoError(t, keys.Add(2, bytes.Repeat([]byte{2}, 32)))
+	n, err = c.Reencrypt(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	n, err = c.Reencrypt(ctx)
+	require.NoError(t, err)
+	require.Zero(t, n)
+	for i := range 7 {
+		record, err := c.Consume(ctx, uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	srv := &flakyServer{}
+	c := setupFlaky(t, srv, RetryConfig{InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+	ctx := context.Background()
+
+	// unavailable servers are retried
+	srv.failures.Store(2)
+	off, err := c.Produce(ctx, []byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+	require.Equal(t, int64(3), srv.calls.Swap(0))
+
+	// until the attempts run out
+	srv.failures.Store(10)
+	_, err = c.Produce(ctx, []byte("foo"))
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, int64(5), srv.calls.Swap(0))
+
+	// but batches are resent past them while the servers fail over
+	srv.failures.Store(10)
+	p := c.NewProducer(ProducerConfig{})
+	var result Result
+	require.NoError(t, p.Send(ctx, &api.Record{Value: []byte("foo")}, func(r Result) { result = r }))
+	require.NoError(t, p.Close(ctx))
+	require.NoError(t, result.Err)
+	require.Equal(t, int64(11), srv.calls.Swap(0))
+
+	// other errors aren't
+	srv.failures.Store(0)
+	_, err = c.Consume(ctx, 0)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Equal(t, int64(1), srv.calls.Swap(0))
+
+	// a broken stream picks up after the last record
+	var offsets []uint64
+	err = c.ConsumeStream(ctx, &api.ConsumeRequest{}, func(record *api.Record) error {
+		offsets = append(offsets, record.Offset)
+		if len(offsets) == 6 {
+			return errors.New("stop")
+		}
+		return nil
+	})
+	require.EqualError(t, err, "stop")
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5}, offsets)
+	require.Equal(t, []uint64{0, 2, 4}, srv.streamOffsets)
+}
+
+func TestClientFollowsLeader(t *testing.T) {
+	// a leads partition 0 and b partition 1
+	a, b := &movedServer{}, &movedServer{}
+	lnA, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lnB, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	leaders := map[uint32]string{0: lnA.Addr().String(), 1: lnB.Addr().String()}
+	for _, s := range []struct {
+		srv *movedServer
+		ln  net.Listener
+	}{{a, lnA}, {b, lnB}} {
+		s.srv.addr, s.srv.leaders = s.ln.Addr().String(), leaders
+		gsrv := grpc.NewServer()
+		api.RegisterLogServer(gsrv, s.srv)
+		go gsrv.Serve(s.ln)
+		t.Cleanup(gsrv.Stop)
+	}
+	c, err := New(Config{
+		Addr:  lnA.Addr().String(),
+		Retry: RetryConfig{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	ctx := context.Background()
+
+	produce := func(partition uint32) string {
+		res, err := c.ProduceRecord(ctx, &api.ProduceRequest{Record: &api.Record{}, Partition: partition})
+		require.NoError(t, err)
+		return leaders[uint32(res.Offset)]
+	}
+	require.Equal(t, leaders[0], produce(0))
+	// a redirects partition 1 to b, where it's sent from then on
+	require.Equal(t, leaders[1], produce(1))
+	require.Equal(t, leaders[1], c.meta.leader("", 1))
+	a.calls.Store(0)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, leaders[1], produce(1))
+	}
+	require.Zero(t, a.calls.Load())
+	require.Equal(t, leaders[0], produce(0))
+}
+
+func TestBackoff(t *testing.T) {
+	c := RetryConfig{}.withDefaults()
+	for attempt, bound := range []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		5 * time.Second,
+	} {
+		if attempt == 3 {
+			attempt = 20
+		}
+		for i := 0; i < 100; i++ {
+			d := c.backoff(attempt + 1)
+			require.Greater(t, d, time.Duration(0))
+			require.LessOrEqual(t, d, bound)
+		}
+	}
+}
+
+func setupFlaky(t *testing.T, srv *flakyServer, retry RetryConfig) *Client {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	gsrv := grpc.NewServer()
+	api.RegisterLogServer(gsrv, srv)
+	go gsrv.Serve(ln)
+	t.Cleanup(gsrv.Stop)
+	c, err := New(Config{Addr: ln.Addr().String(), Retry: retry})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// flakyServer fails its first calls with Unavailable
+type flakyServer struct {
+	api.UnimplementedLogServer
+	failures      atomic.Int64
+	calls         atomic.Int64
+	streamOffsets []uint64
+
+	mu      sync.Mutex
+	batches []int
+}
+
+func (s *flakyServer) Produce(context.Context, *api.ProduceRequest) (*api.ProduceResponse, error) {
+	s.calls.Add(1)
+	if s.failures.Add(-1) >= 0 {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+	return &api.ProduceResponse{Offset: 7}, nil
+}
+
+// Records the size of each batch it takes
+func (s *flakyServer) ProduceBatch(_ context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	s.calls.Add(1)
+	if s.failures.Add(-1) >= 0 {
+		return nil, status.Error(codes.Unavailable, "unavailable")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.batches = append(s.batches, len(req.Records))
+	return &api.ProduceBatchResponse{Offsets: make([]uint64, len(req.Records))}, nil
+}
+
+func (s *flakyServer) batchSizes() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+func (s *flakyServer) Consume(context.Context, *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	s.calls.Add(1)
+	return nil, status.Error(codes.InvalidArgument, "invalid")
+}
+
+// Sends two records then breaks
+func (s *flakyServer) ConsumeStream(req *api.ConsumeRequest, stream grpc.ServerStreamingServer[api.ConsumeResponse]) error {
+	s.streamOffsets = append(s.streamOffsets, req.Offset)
+	for off := req.Offset; off < req.Offset+2; off++ {
+		if err := stream.Send(&api.ConsumeResponse{Record: &api.Record{Offset: off}}); err != nil {
+			return err
+		}
+	}
+	return status.Error(codes.Unavailable, "unavailable")
+}
+
+// movedServer answers produces to the partitions it leads with the
+// partition as the offset, and names the leader of the others
+type movedServer struct {
+	api.UnimplementedLogServer
+	addr    string
+	leaders map[uint32]string
+	calls   atomic.Int64
+}
+
+func (s *movedServer) Produce(_ context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	s.calls.Add(1)
+	if leader := s.leaders[req.Partition]; leader != s.addr {
+		return nil, api.ErrNotLeader{Leader: leader}
+	}
+	return &api.ProduceResponse{Offset: uint64(req.Partition)}, nil
+}
+
+func (s *movedServer) GetServers(context.Context, *api.GetServersRequest) (*api.GetServersResponse, error) {
+	var servers []*api.Server
+	for _, addr := range []string{s.leaders[0], s.leaders[1]} {
+		servers = append(servers, &api.Server{Id: addr, RpcAddr: addr, IsLeader: addr == s.leaders[0]})
+	}
+	return &api.GetServersResponse{Servers: servers, Partitions: 2}, nil
+}
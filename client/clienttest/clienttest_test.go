@@ -0,0 +1,122 @@
+package clienttest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/client"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The fake and the server behave the same
+func TestLogs(t *testing.T) {
+	for name, l := range map[string]client.Log{
+		"fake":   &Log{},
+		"server": NewServer(t).Client,
+	} {
+		t.Run(name, func(t *testing.T) { testLog(t, l) })
+	}
+}
+
+func testLog(t *testing.T, l client.Log) {
+	ctx := context.Background()
+	for i, value := range []string{"foo", "bar"} {
+		off, err := l.Produce(ctx, []byte(value))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	record, err := l.Consume(ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, "bar", string(record.Value))
+	require.NotZero(t, record.Timestamp)
+	_, err = l.Consume(ctx, 2)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+	_, err = l.ConsumeRecord(ctx, &api.ConsumeRequest{Partition: 1})
+	require.ErrorAs(t, err, &api.ErrPartitionNotFound{})
+	_, err = l.ConsumeRecord(ctx, &api.ConsumeRequest{Topic: "missing"})
+	require.ErrorAs(t, err, &api.ErrTopicNotFound{})
+	record, err = l.ConsumeRecord(ctx, &api.ConsumeRequest{Topic: "default"})
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(record.Value))
+
+	offs, err := l.GetOffsets(ctx, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), offs.HighWatermark)
+
+	_, found, err := l.FetchOffset(ctx, "group", "", 0)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.NoError(t, l.CommitOffset(ctx, "group", "", 0, 1))
+	off, found, err := l.FetchOffset(ctx, "group", "", 0)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, uint64(1), off)
+
+	// streams wait for records at the end
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		_, _ = l.Produce(ctx, []byte("baz"))
+	}()
+	var values []string
+	stop := errors.New("stop")
+	err = l.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 1}, func(record *api.Record) error {
+		values = append(values, string(record.Value))
+		if len(values) == 2 {
+			return stop
+		}
+		return nil
+	})
+	require.Equal(t, stop, err)
+	require.Equal(t, []string{"bar", "baz"}, values)
+}
+
+func TestLogFailNext(t *testing.T) {
+	l := &Log{Partitions: 2}
+	ctx := context.Background()
+	l.FailNext(status.Error(codes.Unavailable, "down"))
+	_, err := l.Produce(ctx, []byte("foo"))
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	_, err = l.ProduceRecord(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}, Partition: 1})
+	require.NoError(t, err)
+	require.Len(t, l.Records("", 1), 1)
+	require.Empty(t, l.Records("", 0))
+
+	key := []byte("key")
+	_, err = l.ProduceRecord(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("bar"), Key: key}})
+	require.NoError(t, err)
+	records := l.Records("", client.PartitionForKey(key, 2))
+	require.Equal(t, key, records[len(records)-1].Key)
+}
+
+func TestLogTopics(t *testing.T) {
+	l := &Log{Topics: []string{"events"}}
+	ctx := context.Background()
+	_, err := l.ProduceRecord(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("foo")}, Topic: "events"})
+	require.NoError(t, err)
+	require.Len(t, l.Records("events", 0), 1)
+	require.Empty(t, l.Records("", 0))
+	require.NoError(t, l.CommitOffset(ctx, "group", "events", 0, 1))
+	_, found, err := l.FetchOffset(ctx, "group", "", 0)
+	require.NoError(t, err)
+	require.False(t, found)
+}
+
+func TestServerConsumer(t *testing.T) {
+	srv := NewServer(t)
+	ctx := context.Background()
+	p := srv.Client.NewProducer(client.ProducerConfig{})
+	require.NoError(t, p.Send(ctx, &api.Record{Value: []byte("foo")}, nil))
+	require.NoError(t, p.Close(ctx))
+
+	c, err := srv.Client.NewConsumer(ctx, client.ConsumerConfig{Name: "group"})
+	require.NoError(t, err)
+	defer c.Close(ctx)
+	record := <-c.Messages()
+	require.Equal(t, "foo", string(record.Value))
+}
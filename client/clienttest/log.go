@@ -0,0 +1,206 @@
+// Package clienttest helps test applications using the client package: Log
+// keeps records in memory behind client.Log, and NewServer runs a real
+// server in process for code that needs a client.Client.
+package clienttest
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/client"
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+var _ client.Log = (*Log)(nil)
+
+// Log is an in-memory client.Log. Every produce commits at once, whatever
+// its ack, and records with a key go to the partition client.PartitionForKey
+// hashes them to, as the client sends them. The zero value is a log with the default topic and one
+// partition, ready to use, and it's safe for concurrent use.
+type Log struct {
+	// Partitions is how many partitions each topic has, 1 when unset
+	Partitions int
+	// Topics names the topics besides the default one
+	Topics []string
+
+	mu       sync.Mutex
+	records  map[partitionKey][]*api.Record
+	offsets  map[offsetKey]uint64
+	appended chan struct{}
+	fail     []error
+}
+
+type partitionKey struct {
+	topic     string
+	partition uint32
+}
+
+type offsetKey struct {
+	consumer string
+	partitionKey
+}
+
+func (l *Log) Produce(ctx context.Context, value []byte) (uint64, error) {
+	res, err := l.ProduceRecord(ctx, &api.ProduceRequest{Record: &api.Record{Value: value}})
+	if err != nil {
+		return 0, err
+	}
+	return res.Offset, nil
+}
+
+func (l *Log) ProduceRecord(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	partition := req.Partition
+	if req.Record.GetKey() != nil {
+		partition = client.PartitionForKey(req.Record.Key, uint32(max(l.Partitions, 1)))
+	}
+	key, err := l.check(ctx, req.Topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	record := &api.Record{
+		Value:     req.Record.GetValue(),
+		Key:       req.Record.GetKey(),
+		Offset:    uint64(len(l.records[key])),
+		Timestamp: req.Record.GetTimestamp(),
+	}
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
+	l.records[key] = append(l.records[key], record)
+	// wakes the streams waiting for it
+	close(l.appended)
+	l.appended = make(chan struct{})
+	return &api.ProduceResponse{Offset: record.Offset}, nil
+}
+
+func (l *Log) Consume(ctx context.Context, offset uint64) (*api.Record, error) {
+	return l.ConsumeRecord(ctx, &api.ConsumeRequest{Offset: offset})
+}
+
+func (l *Log) ConsumeRecord(ctx context.Context, req *api.ConsumeRequest) (*api.Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key, err := l.check(ctx, req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	records := l.records[key]
+	if req.Offset >= uint64(len(records)) {
+		return nil, api.ErrOffsetOutOfRange{Offset: req.Offset}
+	}
+	return records[req.Offset], nil
+}
+
+// ConsumeStream calls fn with the topic partition's records from the request's
+// offset on, waiting for new ones, until fn returns an error or ctx is
+// done
+func (l *Log) ConsumeStream(ctx context.Context, req *api.ConsumeRequest, fn func(*api.Record) error) error {
+	off := req.Offset
+	for {
+		l.mu.Lock()
+		key, err := l.check(ctx, req.Topic, req.Partition)
+		if err != nil {
+			l.mu.Unlock()
+			return err
+		}
+		records, appended := l.records[key], l.appended
+		l.mu.Unlock()
+		for ; off < uint64(len(records)); off++ {
+			if err := fn(records[off]); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-appended:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (l *Log) CommitOffset(ctx context.Context, consumer, topic string, partition uint32, offset uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key, err := l.check(ctx, topic, partition)
+	if err != nil {
+		return err
+	}
+	l.offsets[offsetKey{consumer, key}] = offset
+	return nil
+}
+
+func (l *Log) FetchOffset(ctx context.Context, consumer, topic string, partition uint32) (uint64, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key, err := l.check(ctx, topic, partition)
+	if err != nil {
+		return 0, false, err
+	}
+	off, found := l.offsets[offsetKey{consumer, key}]
+	return off, found, nil
+}
+
+func (l *Log) GetOffsets(ctx context.Context, topic string, partition uint32) (*api.GetOffsetsResponse, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key, err := l.check(ctx, topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetOffsetsResponse{HighWatermark: uint64(len(l.records[key]))}, nil
+}
+
+// Records returns the topic partition's records, for tests to check what
+// was produced
+func (l *Log) Records(topic string, partition uint32) []*api.Record {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*api.Record(nil), l.records[partitionKey{defaultTopic(topic), partition}]...)
+}
+
+// FailNext has the next call fail with err, calls after it failing with
+// errors queued before them in turn
+func (l *Log) FailNext(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fail = append(l.fail, err)
+}
+
+// Readies the zero value and fails the call if it should, returning the
+// topic partition's key otherwise. Callers must hold mu.
+func (l *Log) check(ctx context.Context, topic string, partition uint32) (partitionKey, error) {
+	key := partitionKey{defaultTopic(topic), partition}
+	if l.records == nil {
+		l.records = make(map[partitionKey][]*api.Record)
+		l.offsets = make(map[offsetKey]uint64)
+		l.appended = make(chan struct{})
+	}
+	if len(l.fail) > 0 {
+		err := l.fail[0]
+		l.fail = l.fail[1:]
+		return key, err
+	}
+	if err := ctx.Err(); err != nil {
+		return key, err
+	}
+	if key.topic != log.DefaultTopic && !slices.Contains(l.Topics, key.topic) {
+		return key, api.ErrTopicNotFound{Topic: key.topic}
+	}
+	if partitions := max(l.Partitions, 1); int(partition) >= partitions {
+		return key, api.ErrPartitionNotFound{Partition: partition, Partitions: partitions}
+	}
+	return key, nil
+}
+
+// Callers name the default topic as "" or by its name
+func defaultTopic(topic string) string {
+	if topic == "" {
+		return log.DefaultTopic
+	}
+	return topic
+}
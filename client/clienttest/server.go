@@ -0,0 +1,49 @@
+package clienttest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/frankie-mur/proglog/client"
+	"github.com/frankie-mur/proglog/internal/server"
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+// Server is a proglog server running in process, on a log in a temporary
+// directory, without authentication or replication
+type Server struct {
+	// Addr is the server's RPC address
+	Addr string
+	// Client is connected to the server with the client's defaults
+	Client *client.Client
+}
+
+// NewServer starts a server for the test, stopped when it ends, for code
+// that needs a client.Client, such as Producers and Consumers
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	clog, err := log.NewTopics(t.TempDir(), log.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, err := server.NewGRPCServer(&server.Config{CommitLog: clog})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+
+	c, err := client.New(client.Config{Addr: ln.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		c.Close()
+		srv.Stop()
+		clog.Close()
+	})
+	return &Server{Addr: ln.Addr().String(), Client: c}
+}
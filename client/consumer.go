@@ -0,0 +1,266 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+type ConsumerConfig struct {
+	// Name identifies the consumer's committed offsets, consumers sharing
+	// a name share a position. It's required.
+	Name string
+	// Topic and Partition are what the consumer reads, an empty Topic is
+	// the default one
+	Topic     string
+	Partition uint32
+	// StartOffset is where a consumer that never committed starts, unless
+	// OffsetReset says otherwise
+	StartOffset uint64
+	// OffsetReset is where the consumer starts when it never committed, or
+	// its committed offset is outside the partition's records, and where
+	// it picks up when retention truncates away the records it's reading.
+	// ResetTime is the time OFFSET_RESET_TIMESTAMP starts at. Unset, a
+	// consumer that never committed starts at StartOffset and one that
+	// falls outside the records stops with api.ErrOffsetOutOfRange. See
+	// log.ResetOffset, which servers apply to group offsets' fetches too.
+	OffsetReset api.OffsetReset
+	ResetTime   time.Time
+	// Isolation is which records the consumer reads, READ_COMMITTED
+	// skipping those of aborted transactions and waiting on open ones
+	Isolation api.Isolation
+	// AutoCommitInterval is how often the position is committed, defaults
+	// to 5 seconds. Negative disables it, leaving commits to Commit and
+	// Close.
+	AutoCommitInterval time.Duration
+	// Offsets is where the position is committed and fetched from,
+	// defaults to the servers
+	Offsets OffsetStore
+}
+
+// Consumer reads a topic's partition from the offset it last committed under its
+// name, so a restarted consumer picks up where it left off. Records count
+// as consumed once they're received from Messages, a consumer that stops
+// between commits reads the records since again.
+type Consumer struct {
+	client   *Client
+	config   ConsumerConfig
+	messages chan *api.Record
+	// deliver hands each record on, to messages unless the consumer is a
+	// GroupConsumer's
+	deliver func(ctx context.Context, record *api.Record) error
+	// done is closed once the consumer stops reading
+	done   chan struct{}
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	once   sync.Once
+
+	// commits serializes commits, so an older position never overwrites a
+	// newer one
+	commits sync.Mutex
+
+	mu          sync.Mutex
+	position    uint64
+	uncommitted bool
+	err         error
+}
+
+// NewConsumer starts a consumer from its committed offset, reading records
+// until it's closed
+func (c *Client) NewConsumer(ctx context.Context, config ConsumerConfig) (*Consumer, error) {
+	if config.Name == "" {
+		return nil, errors.New("client: consumer Name is required")
+	}
+	messages := make(chan *api.Record)
+	co, err := c.newConsumer(ctx, config, func(ctx context.Context, record *api.Record) error {
+		select {
+		case messages <- record:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	co.messages = messages
+	co.start()
+	return co, nil
+}
+
+// A consumer from its committed offset handing records to deliver, started
+// by start
+func (c *Client) newConsumer(ctx context.Context, config ConsumerConfig, deliver func(context.Context, *api.Record) error) (*Consumer, error) {
+	if config.AutoCommitInterval == 0 {
+		config.AutoCommitInterval = 5 * time.Second
+	}
+	if config.Offsets == nil {
+		config.Offsets = c
+	}
+	off, found, err := config.Offsets.FetchOffset(ctx, config.Name, config.Topic, config.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if !found && config.OffsetReset == api.OffsetReset_OFFSET_RESET_NONE {
+		off = config.StartOffset
+	}
+	if off, _, err = c.resetOffset(ctx, config, off, found); err != nil {
+		return nil, err
+	}
+	return &Consumer{
+		client:   c,
+		config:   config,
+		deliver:  deliver,
+		done:     make(chan struct{}),
+		position: off,
+	}, nil
+}
+
+// Applies the consumer's OffsetReset to its offset, see log.ResetOffset,
+// looking the partition's offsets up unless it's unset
+func (c *Client) resetOffset(ctx context.Context, config ConsumerConfig, off uint64, found bool) (uint64, bool, error) {
+	if config.OffsetReset == api.OffsetReset_OFFSET_RESET_NONE {
+		return off, false, nil
+	}
+	res, err := c.GetOffsets(ctx, config.Topic, config.Partition)
+	if err != nil {
+		return 0, false, err
+	}
+	st := log.Stats{LowWatermark: res.LowWatermark, HighWatermark: res.HighWatermark}
+	return log.ResetOffset(config.OffsetReset, topicName(config.Topic), config.Partition, off, found, st, func() (uint64, error) {
+		return c.OffsetForTime(ctx, config.Topic, config.Partition, config.ResetTime)
+	})
+}
+
+// Starts reading, and committing unless that's left to Commit and Close
+func (c *Consumer) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+	c.wg.Add(1)
+	go c.run(ctx)
+	if c.config.AutoCommitInterval > 0 {
+		c.wg.Add(1)
+		go c.autoCommit(ctx)
+	}
+}
+
+// Messages delivers the partition's records in order, waiting for new ones
+// at the end. It's closed once the consumer stops, see Err.
+func (c *Consumer) Messages() <-chan *api.Record {
+	return c.messages
+}
+
+// Position is the offset of the next record Messages delivers. It moves
+// just after a record is received, so a Commit racing the receipt may leave
+// that record to be read again; Close commits every record received.
+func (c *Consumer) Position() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.position
+}
+
+// Commit commits the position, if it moved since the last commit
+func (c *Consumer) Commit(ctx context.Context) error {
+	c.commits.Lock()
+	defer c.commits.Unlock()
+	c.mu.Lock()
+	pos, uncommitted := c.position, c.uncommitted
+	c.mu.Unlock()
+	if !uncommitted {
+		return nil
+	}
+	if err := c.config.Offsets.CommitOffset(ctx, c.config.Name, c.config.Topic, c.config.Partition, pos); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.position == pos {
+		c.uncommitted = false
+	}
+	return nil
+}
+
+// Err is why the consumer stopped before it was closed, nil while it runs
+// or if the server ended the stream
+func (c *Consumer) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close stops the consumer and commits its position. It leaves the client
+// open.
+func (c *Consumer) Close(ctx context.Context) error {
+	closed := false
+	c.once.Do(func() {
+		closed = true
+		c.cancel()
+		c.wg.Wait()
+	})
+	if !closed {
+		return nil
+	}
+	return c.Commit(ctx)
+}
+
+// Streams the partition from the position into Messages
+func (c *Consumer) run(ctx context.Context) {
+	defer c.wg.Done()
+	defer close(c.done)
+	if c.messages != nil {
+		defer close(c.messages)
+	}
+	var err error
+	for {
+		req := &api.ConsumeRequest{Offset: c.Position(), Topic: c.config.Topic, Partition: c.config.Partition, Isolation: c.config.Isolation}
+		err = c.client.ConsumeStream(ctx, req, func(record *api.Record) error {
+			if err := c.deliver(ctx, record); err != nil {
+				return err
+			}
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.position = record.Offset + 1
+			c.uncommitted = true
+			return nil
+		})
+		// records truncated away from under the consumer reset it
+		if ctx.Err() != nil || !errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			break
+		}
+		off, reset, rerr := c.client.resetOffset(ctx, c.config, c.Position(), true)
+		if rerr != nil {
+			err = rerr
+		}
+		if rerr != nil || !reset {
+			break
+		}
+		c.mu.Lock()
+		c.position, c.uncommitted = off, true
+		c.mu.Unlock()
+	}
+	if ctx.Err() == nil {
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+	}
+}
+
+// Commits the position every AutoCommitInterval. A failed commit is left
+// for the next one.
+func (c *Consumer) autoCommit(ctx context.Context) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.config.AutoCommitInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = c.Commit(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
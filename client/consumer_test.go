@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/agent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsumer(t *testing.T) {
+	a, err := agent.New(agent.Config{
+		RPCAddr:  "127.0.0.1:0",
+		HTTPAddr: "127.0.0.1:0",
+		DataDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	defer a.Shutdown()
+	c, err := New(Config{Addr: a.AdvertiseRPCAddr})
+	require.NoError(t, err)
+	defer c.Close()
+	ctx := context.Background()
+
+	for _, value := range []string{"foo", "bar", "baz"} {
+		_, err := c.Produce(ctx, []byte(value))
+		require.NoError(t, err)
+	}
+
+	_, err = c.NewConsumer(ctx, ConsumerConfig{})
+	require.Error(t, err)
+
+	config := ConsumerConfig{Name: "group", AutoCommitInterval: -1}
+	co, err := c.NewConsumer(ctx, config)
+	require.NoError(t, err)
+	var values []string
+	for record := range co.Messages() {
+		values = append(values, string(record.Value))
+		if len(values) == 2 {
+			break
+		}
+	}
+	require.Equal(t, []string{"foo", "bar"}, values)
+	require.NoError(t, co.Close(ctx))
+	require.Equal(t, uint64(2), co.Position())
+	require.NoError(t, co.Err())
+	_, ok := <-co.Messages()
+	require.False(t, ok)
+
+	// a consumer with the same name resumes after the commit
+	co, err = c.NewConsumer(ctx, config)
+	require.NoError(t, err)
+	record := <-co.Messages()
+	require.Equal(t, "baz", string(record.Value))
+	require.NoError(t, co.Close(ctx))
+
+	// one with another name starts over
+	co, err = c.NewConsumer(ctx, ConsumerConfig{Name: "other", AutoCommitInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer co.Close(ctx)
+	record = <-co.Messages()
+	require.Equal(t, "foo", string(record.Value))
+	// and commits on its own
+	require.Eventually(t, func() bool {
+		off, found, err := c.FetchOffset(ctx, "other", "", 0)
+		return err == nil && found && off == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// offsets kept elsewhere don't reach the servers
+	offsets, err := NewFileOffsets(filepath.Join(t.TempDir(), "offsets.json"))
+	require.NoError(t, err)
+	local := ConsumerConfig{Name: "local", AutoCommitInterval: -1, Offsets: offsets}
+	co, err = c.NewConsumer(ctx, local)
+	require.NoError(t, err)
+	record = <-co.Messages()
+	require.Equal(t, "foo", string(record.Value))
+	require.NoError(t, co.Close(ctx))
+	off, found, err := offsets.FetchOffset(ctx, "local", "", 0)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, uint64(1), off)
+	_, found, err = c.FetchOffset(ctx, "local", "", 0)
+	require.NoError(t, err)
+	require.False(t, found)
+	co, err = c.NewConsumer(ctx, local)
+	require.NoError(t, err)
+	record = <-co.Messages()
+	require.Equal(t, "bar", string(record.Value))
+	require.NoError(t, co.Close(ctx))
+}
+
+func TestConsumerOffsetReset(t *testing.T) {
+	a, err := agent.New(agent.Config{
+		RPCAddr:  "127.0.0.1:0",
+		HTTPAddr: "127.0.0.1:0",
+		DataDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	defer a.Shutdown()
+	c, err := New(Config{Addr: a.AdvertiseRPCAddr})
+	require.NoError(t, err)
+	defer c.Close()
+	ctx := context.Background()
+	for _, value := range []string{"foo", "bar", "baz"} {
+		_, err := c.Produce(ctx, []byte(value))
+		require.NoError(t, err)
+	}
+	start := func(config ConsumerConfig) (*Consumer, error) {
+		config.AutoCommitInterval = -1
+		co, err := c.NewConsumer(ctx, config)
+		if err == nil {
+			t.Cleanup(func() { co.Close(ctx) })
+		}
+		return co, err
+	}
+
+	// consumers that never committed start where the policy says
+	co, err := start(ConsumerConfig{Name: "new", StartOffset: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), co.Position())
+	co, err = start(ConsumerConfig{Name: "new", OffsetReset: api.OffsetReset_OFFSET_RESET_LATEST})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), co.Position())
+	co, err = start(ConsumerConfig{Name: "new", OffsetReset: api.OffsetReset_OFFSET_RESET_TIMESTAMP, ResetTime: time.Now()})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), co.Position())
+	_, err = start(ConsumerConfig{Name: "new", OffsetReset: api.OffsetReset_OFFSET_RESET_ERROR})
+	require.ErrorAs(t, err, &api.ErrNoOffset{})
+
+	// as do those whose offsets are past the records
+	offsets, err := NewFileOffsets(filepath.Join(t.TempDir(), "offsets.json"))
+	require.NoError(t, err)
+	require.NoError(t, offsets.CommitOffset(ctx, "old", "", 0, 10))
+	co, err = start(ConsumerConfig{Name: "old", Offsets: offsets, OffsetReset: api.OffsetReset_OFFSET_RESET_EARLIEST})
+	require.NoError(t, err)
+	record := <-co.Messages()
+	require.Equal(t, "foo", string(record.Value))
+	_, err = start(ConsumerConfig{Name: "old", Offsets: offsets, OffsetReset: api.OffsetReset_OFFSET_RESET_ERROR})
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+}
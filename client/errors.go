@@ -0,0 +1,113 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrClosed is returned by calls on a closed Client
+var ErrClosed = errors.New("client: closed")
+
+// Turns the error a call failed with into the api error the server
+// answered with, api.ErrNotLeader, api.ErrOffsetOutOfRange and the rest,
+// so callers can match them with errors.As. Errors without a proglog
+// reason are returned as they are, their gRPC status intact.
+func fromStatus(err error) error {
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+	for _, d := range st.Details() {
+		info, ok := d.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != "proglog" {
+			continue
+		}
+		md := info.Metadata
+		switch info.Reason {
+		case "NOT_LEADER":
+			return api.ErrNotLeader{Leader: md["leader"]}
+		case "NOT_ENOUGH_REPLICAS":
+			inSync, _ := strconv.Atoi(md["in_sync"])
+			required, _ := strconv.Atoi(md["required"])
+			return api.ErrNotEnoughReplicas{InSync: inSync, Required: required}
+		case "OFFSET_OUT_OF_RANGE":
+			off, _ := strconv.ParseUint(md["offset"], 10, 64)
+			return api.ErrOffsetOutOfRange{Offset: off}
+		case "NO_OFFSET":
+			p, _ := strconv.ParseUint(md["partition"], 10, 32)
+			return api.ErrNoOffset{Topic: md["topic"], Partition: uint32(p)}
+		case "OFFSET_NOT_REPLICATED":
+			off, _ := strconv.ParseUint(md["offset"], 10, 64)
+			return api.ErrOffsetNotReplicated{Offset: off}
+		case "PARTITION_NOT_FOUND":
+			p, _ := strconv.ParseUint(md["partition"], 10, 32)
+			n, _ := strconv.Atoi(md["partitions"])
+			return api.ErrPartitionNotFound{Partition: uint32(p), Partitions: n}
+		case "TOPIC_NOT_FOUND":
+			return api.ErrTopicNotFound{Topic: md["topic"]}
+		case "TOPIC_EXISTS":
+			return api.ErrTopicExists{Topic: md["topic"]}
+		case "RECORD_TOO_LARGE":
+			size, _ := strconv.ParseUint(md["size"], 10, 64)
+			max, _ := strconv.ParseUint(md["max"], 10, 64)
+			return api.ErrRecordTooLarge{Size: size, Max: max}
+		case "INVALID_TIMESTAMP":
+			ts, _ := strconv.ParseInt(md["timestamp"], 10, 64)
+			skew, _ := strconv.ParseInt(md["max_skew_ms"], 10, 64)
+			return api.ErrInvalidTimestamp{Timestamp: ts, MaxSkew: time.Duration(skew) * time.Millisecond}
+		case "DISK_FULL":
+			used, _ := strconv.ParseUint(md["used"], 10, 64)
+			capacity, _ := strconv.ParseUint(md["capacity"], 10, 64)
+			return api.ErrDiskFull{Used: used, Capacity: capacity, Tenant: md["tenant"]}
+		case "STALE_METADATA":
+			version, _ := strconv.ParseUint(md["version"], 10, 64)
+			return api.ErrStaleMetadata{Topic: md["topic"], Version: version}
+		case "UNKNOWN_MEMBER":
+			return api.ErrUnknownMember{Group: md["group"], Member: md["member"]}
+		case "FENCED_INSTANCE":
+			return api.ErrFencedInstance{Group: md["group"], Instance: md["instance"]}
+		case "SUBSCRIPTION_NOT_FOUND":
+			return api.ErrSubscriptionNotFound{Subscription: md["subscription"]}
+		case "SUBSCRIPTION_EXISTS":
+			return api.ErrSubscriptionExists{Subscription: md["subscription"]}
+		case "SCHEMA_NOT_FOUND":
+			version, _ := strconv.ParseUint(md["version"], 10, 32)
+			return api.ErrSchemaNotFound{Topic: md["topic"], Version: uint32(version)}
+		case "INCOMPATIBLE_SCHEMA":
+			version, _ := strconv.ParseUint(md["version"], 10, 32)
+			return api.ErrIncompatibleSchema{Topic: md["topic"], Version: uint32(version), Reason: md["reason"]}
+		case "SCHEMA_VIOLATION":
+			version, _ := strconv.ParseUint(md["version"], 10, 32)
+			return api.ErrSchemaViolation{Topic: md["topic"], Version: uint32(version), Reason: md["reason"]}
+		case "RECORD_REJECTED":
+			return api.ErrRecordRejected{Topic: md["topic"], Transform: md["transform"], Reason: md["reason"]}
+		case "PRODUCER_FENCED":
+			id, _ := strconv.ParseUint(md["producer_id"], 10, 64)
+			epoch, _ := strconv.ParseUint(md["epoch"], 10, 32)
+			current, _ := strconv.ParseUint(md["current"], 10, 32)
+			return api.ErrProducerFenced{ProducerID: id, Epoch: uint32(epoch), Current: uint32(current)}
+		}
+	}
+	return err
+}
+
+// Retryable reports whether a call that failed with err may succeed if
+// it's made again: the server was unreachable or not ready, too few
+// replicas were in sync, its disk was full, or the leader changed under it
+func Retryable(err error) bool {
+	var notLeader api.ErrNotLeader
+	if errors.As(err, &notLeader) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,339 @@
+package client
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+type GroupConfig struct {
+	// Group names the consumers sharing the topics' partitions and the
+	// offsets committed for them. It's required.
+	Group string
+	// Topics are what the group consumes, an empty one being the default
+	// topic. At least one is required.
+	Topics []string
+	// SessionTimeout is how long the coordinator waits for a heartbeat
+	// before it drops the member and hands its partitions to the others,
+	// defaults to 10 seconds. A member that can't heartbeat for as long
+	// stops consuming.
+	SessionTimeout time.Duration
+	// HeartbeatInterval is how often the member heartbeats, defaults to a
+	// third of SessionTimeout. Partitions move between members a heartbeat
+	// or two after the group changes.
+	HeartbeatInterval time.Duration
+	// StartOffset is where partitions the group never committed start, and
+	// OffsetReset and ResetTime where those it never committed or whose
+	// committed offsets are outside their records start, as ConsumerConfig's
+	StartOffset uint64
+	OffsetReset api.OffsetReset
+	ResetTime   time.Time
+	// AutoCommitInterval is how often each partition's position is
+	// committed, as ConsumerConfig's. Positions are committed too when
+	// partitions move to another member.
+	AutoCommitInterval time.Duration
+	// InstanceID makes the member static, unique to it within the group,
+	// such as its host's name. A static member restarted within
+	// SessionTimeout takes its partitions back without the group
+	// rebalancing, so Close doesn't leave the group but lets the session
+	// time out. A member whose InstanceID a newer one joined with stops
+	// with api.ErrFencedInstance.
+	InstanceID string
+}
+
+func (c GroupConfig) withDefaults() GroupConfig {
+	if c.SessionTimeout == 0 {
+		c.SessionTimeout = 10 * time.Second
+	}
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = c.SessionTimeout / 3
+	}
+	return c
+}
+
+// GroupMessage is a record a GroupConsumer read, with the topic partition
+// it read it from
+type GroupMessage struct {
+	Topic     string
+	Partition uint32
+	*api.Record
+}
+
+// A topic's partition
+type groupPartition struct {
+	topic     string
+	partition uint32
+}
+
+// GroupConsumer is a member of a consumer group. The group's coordinator
+// assigns each of the topics' partitions to one member, and the member
+// reads its partitions from the offsets the group committed to the
+// servers, see Client.GroupOffsets. As members join, leave or fail, and
+// as partitions are added, the partitions are assigned again, sticking
+// with their members as far as balance allows: a member commits and stops
+// reading the partitions taken from it before each goes to its new member,
+// and reads the rest throughout.
+type GroupConsumer struct {
+	client   *Client
+	config   GroupConfig
+	messages chan *GroupMessage
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	once     sync.Once
+
+	mu         sync.Mutex
+	member     string
+	generation uint64
+	// assigned are the partitions the last heartbeat gave the member, and
+	// consumers read the ones it's consuming
+	assigned  map[groupPartition]bool
+	consumers map[groupPartition]*Consumer
+	err       error
+}
+
+// NewGroupConsumer joins the group, consuming the partitions it's assigned
+// until it's closed
+func (c *Client) NewGroupConsumer(ctx context.Context, config GroupConfig) (*GroupConsumer, error) {
+	if config.Group == "" {
+		return nil, errors.New("client: group consumer Group is required")
+	}
+	if len(config.Topics) == 0 {
+		return nil, errors.New("client: group consumer Topics are required")
+	}
+	g := &GroupConsumer{
+		client:    c,
+		config:    config.withDefaults(),
+		messages:  make(chan *GroupMessage),
+		consumers: make(map[groupPartition]*Consumer),
+	}
+	if err := g.heartbeat(ctx); err != nil {
+		return nil, err
+	}
+	runCtx, cancel := context.WithCancel(context.Background())
+	g.cancel = cancel
+	g.wg.Add(1)
+	go g.run(runCtx)
+	return g, nil
+}
+
+// Messages delivers the records of the member's partitions, each
+// partition's in order. It's closed once the member is closed.
+func (g *GroupConsumer) Messages() <-chan *GroupMessage {
+	return g.messages
+}
+
+// Assignments returns the partitions the member consumes, each with its
+// position, in topic and partition order
+func (g *GroupConsumer) Assignments() []*api.GroupOffset {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var assignments []*api.GroupOffset
+	for p, co := range g.consumers {
+		assignments = append(assignments, &api.GroupOffset{Topic: p.topic, Partition: p.partition, Offset: co.Position()})
+	}
+	slices.SortFunc(assignments, func(a, b *api.GroupOffset) int {
+		return cmp.Or(cmp.Compare(a.Topic, b.Topic), cmp.Compare(a.Partition, b.Partition))
+	})
+	return assignments
+}
+
+// Generation is the group's generation as of the member's last heartbeat
+func (g *GroupConsumer) Generation() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.generation
+}
+
+// Err is why the member's last heartbeat failed, nil if it succeeded
+func (g *GroupConsumer) Err() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.err
+}
+
+// Commit commits the positions of the member's partitions
+func (g *GroupConsumer) Commit(ctx context.Context) error {
+	g.mu.Lock()
+	consumers := slices.Collect(maps.Values(g.consumers))
+	g.mu.Unlock()
+	var errs []error
+	for _, co := range consumers {
+		errs = append(errs, co.Commit(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops consuming, commits the member's positions and leaves the
+// group, so its partitions go to the other members straight away, unless
+// it's static and they wait for it to restart. It leaves the client open.
+func (g *GroupConsumer) Close(ctx context.Context) error {
+	closed := false
+	g.once.Do(func() {
+		closed = true
+		g.cancel()
+		g.wg.Wait()
+	})
+	if !closed {
+		return nil
+	}
+	defer close(g.messages)
+	_, err := g.stop(ctx, true)
+	g.mu.Lock()
+	member := g.member
+	g.mu.Unlock()
+	if member == "" || g.config.InstanceID != "" {
+		return err
+	}
+	return errors.Join(err, g.client.LeaveGroup(ctx, g.config.Group, member))
+}
+
+// Heartbeats every HeartbeatInterval, and straight away after giving up
+// partitions so they move on sooner. A member dropped from the group stops
+// its partitions and joins again, and a fenced one stops heartbeating.
+func (g *GroupConsumer) run(ctx context.Context) {
+	defer g.wg.Done()
+	lastHeartbeat := time.Now()
+	for {
+		wait := g.config.HeartbeatInterval
+		if g.reconcile(ctx) {
+			wait = 0
+		}
+		if sleep(ctx, wait) != nil {
+			return
+		}
+		err := g.heartbeat(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			lastHeartbeat = time.Now()
+			continue
+		}
+		if errors.As(err, &api.ErrFencedInstance{}) {
+			_, _ = g.stop(ctx, true)
+			return
+		} else if errors.As(err, &api.ErrUnknownMember{}) {
+			g.mu.Lock()
+			g.member = ""
+			g.mu.Unlock()
+			_, _ = g.stop(ctx, true)
+		} else if time.Since(lastHeartbeat) > g.config.SessionTimeout {
+			// the coordinator's dropped the member by now
+			_, _ = g.stop(ctx, true)
+		}
+	}
+}
+
+// Heartbeats, reporting the partitions the member's consuming, and keeps
+// the ones the coordinator assigns
+func (g *GroupConsumer) heartbeat(ctx context.Context) error {
+	g.mu.Lock()
+	req := &api.JoinGroupRequest{
+		Group:            g.config.Group,
+		MemberId:         g.member,
+		Topics:           g.config.Topics,
+		SessionTimeoutMs: uint32(g.config.SessionTimeout / time.Millisecond),
+		InstanceId:       g.config.InstanceID,
+	}
+	for p := range g.consumers {
+		req.Owned = append(req.Owned, &api.GroupOffset{Topic: p.topic, Partition: p.partition})
+	}
+	g.mu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, g.config.SessionTimeout)
+	defer cancel()
+	res, err := g.client.JoinGroup(ctx, req)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.err = err
+	if err != nil {
+		return err
+	}
+	g.member, g.generation = res.MemberId, res.Generation
+	g.assigned = make(map[groupPartition]bool, len(res.Assignments))
+	for _, p := range res.Assignments {
+		g.assigned[groupPartition{p.Topic, p.Partition}] = true
+	}
+	return nil
+}
+
+// Stops the partitions taken from the member and starts the ones it was
+// given, reporting whether it stopped any. Partitions that fail to start,
+// or stopped reading, are started again after the next heartbeat.
+func (g *GroupConsumer) reconcile(ctx context.Context) (revoked bool) {
+	revoked, _ = g.stop(ctx, false)
+	g.mu.Lock()
+	var starts []groupPartition
+	for p := range g.assigned {
+		if g.consumers[p] == nil {
+			starts = append(starts, p)
+		}
+	}
+	g.mu.Unlock()
+	for _, p := range starts {
+		co, err := g.client.newConsumer(ctx, ConsumerConfig{
+			Name:               g.config.Group,
+			Topic:              p.topic,
+			Partition:          p.partition,
+			StartOffset:        g.config.StartOffset,
+			OffsetReset:        g.config.OffsetReset,
+			ResetTime:          g.config.ResetTime,
+			AutoCommitInterval: g.config.AutoCommitInterval,
+			Offsets:            g.client.GroupOffsets(),
+		}, g.deliver(p))
+		if err != nil {
+			continue
+		}
+		co.start()
+		g.mu.Lock()
+		g.consumers[p] = co
+		g.mu.Unlock()
+	}
+	return revoked
+}
+
+// Stops, committing their positions, the partitions no longer assigned to
+// the member and the ones that stopped reading, or with all every one. The
+// member's assignment is forgotten with all, until its next heartbeat.
+func (g *GroupConsumer) stop(ctx context.Context, all bool) (stopped bool, err error) {
+	g.mu.Lock()
+	if all {
+		g.assigned = nil
+	}
+	var stops []*Consumer
+	for p, co := range g.consumers {
+		select {
+		case <-co.done:
+		default:
+			if g.assigned[p] {
+				continue
+			}
+		}
+		stops = append(stops, co)
+		delete(g.consumers, p)
+	}
+	g.mu.Unlock()
+	var errs []error
+	for _, co := range stops {
+		errs = append(errs, co.Close(ctx))
+	}
+	return len(stops) > 0, errors.Join(errs...)
+}
+
+// Hands the partition's records to Messages, giving up if the partition's
+// stopped first so its position stays before the record
+func (g *GroupConsumer) deliver(p groupPartition) func(context.Context, *api.Record) error {
+	return func(ctx context.Context, record *api.Record) error {
+		select {
+		case g.messages <- &GroupMessage{Topic: p.topic, Partition: p.partition, Record: record}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/agent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupConsumer(t *testing.T) {
+	a, err := agent.New(agent.Config{
+		RPCAddr:  "127.0.0.1:0",
+		HTTPAddr: "127.0.0.1:0",
+		DataDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	defer a.Shutdown()
+	c, err := New(Config{Addr: a.AdvertiseRPCAddr})
+	require.NoError(t, err)
+	defer c.Close()
+	ctx := context.Background()
+	require.NoError(t, c.CreateTopic(ctx, &api.Topic{Name: "events", Partitions: 4}))
+	produce := func(round int) {
+		for p := uint32(0); p < 4; p++ {
+			_, err := c.ProduceRecord(ctx, &api.ProduceRequest{
+				Record:    &api.Record{Value: []byte(fmt.Sprintf("%d-%d", round, p))},
+				Topic:     "events",
+				Partition: p,
+			})
+			require.NoError(t, err)
+		}
+	}
+	// the values the members read, failing on any read twice
+	seen := make(map[string]bool)
+	read := func(g *GroupConsumer, n int) {
+		for ; n > 0; n-- {
+			select {
+			case msg := <-g.Messages():
+				value := string(msg.Value)
+				require.Equal(t, "events", msg.Topic)
+				require.Equal(t, fmt.Sprint(msg.Partition), value[len(value)-1:])
+				require.False(t, seen[value], value)
+				seen[value] = true
+			case <-time.After(5 * time.Second):
+				t.Fatal("no message")
+			}
+		}
+	}
+	partitions := func(g *GroupConsumer) []uint32 {
+		var ps []uint32
+		for _, a := range g.Assignments() {
+			ps = append(ps, a.Partition)
+		}
+		return ps
+	}
+
+	_, err = c.NewGroupConsumer(ctx, GroupConfig{Topics: []string{"events"}})
+	require.Error(t, err)
+	config := GroupConfig{
+		Group:             "readers",
+		Topics:            []string{"events"},
+		SessionTimeout:    time.Second,
+		HeartbeatInterval: 20 * time.Millisecond,
+	}
+	first, err := c.NewGroupConsumer(ctx, config)
+	require.NoError(t, err)
+	produce(0)
+	read(first, 4)
+	require.Equal(t, []uint32{0, 1, 2, 3}, partitions(first))
+
+	// a second member takes half the partitions, picking up where the
+	// first left off
+	second, err := c.NewGroupConsumer(ctx, config)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(first.Assignments()) == 2 && len(second.Assignments()) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	require.ElementsMatch(t, []uint32{0, 1, 2, 3}, append(partitions(first), partitions(second)...))
+	require.Equal(t, first.Generation(), second.Generation())
+	produce(1)
+	read(first, 2)
+	read(second, 2)
+
+	// and gives them back when it leaves
+	require.NoError(t, second.Close(ctx))
+	_, ok := <-second.Messages()
+	require.False(t, ok)
+	require.Eventually(t, func() bool {
+		return len(first.Assignments()) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	produce(2)
+	read(first, 4)
+	require.Len(t, seen, 12)
+	require.NoError(t, first.Close(ctx))
+	require.NoError(t, first.Err())
+
+	// closing committed every record read, so the group's caught up
+	lags, err := c.GetGroupLag(ctx, "readers")
+	require.NoError(t, err)
+	require.Len(t, lags, 4)
+	for _, lag := range lags {
+		require.Equal(t, uint64(3), lag.Committed)
+		require.Zero(t, lag.Lag)
+	}
+
+	// a static member restarting takes its partitions back without the
+	// group rebalancing
+	static := config
+	static.Group, static.InstanceID = "statics", "host-a"
+	member, err := c.NewGroupConsumer(ctx, static)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(member.Assignments()) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	generation := member.Generation()
+	require.NoError(t, member.Close(ctx))
+	member, err = c.NewGroupConsumer(ctx, static)
+	require.NoError(t, err)
+	defer member.Close(ctx)
+	require.Eventually(t, func() bool {
+		return len(member.Assignments()) == 4
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, generation, member.Generation())
+}
@@ -0,0 +1,168 @@
+package client
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+// HedgeConfig has consumes that are slow to answer sent again, to the next
+// follower in turn, the first answer winning and the other call canceled.
+// It trades load on the servers for a shorter tail of consume latencies.
+type HedgeConfig struct {
+	// Percentile is the share of recent consumes that answered before a
+	// consume is hedged, such as 0.95 to hedge those slower than 95% of
+	// them. Zero disables hedging.
+	Percentile float64
+	// InitialDelay is how long a consume waits before it's hedged until
+	// enough have answered to measure the percentile, defaults to 10
+	// milliseconds
+	InitialDelay time.Duration
+	// MinDelay is the shortest a consume waits before it's hedged,
+	// however fast the percentile
+	MinDelay time.Duration
+	// Budget caps hedges at this share of consumes, defaults to 0.1.
+	// Consumes over budget aren't hedged, so servers that are all slow
+	// don't get twice the load.
+	Budget float64
+}
+
+const (
+	// how many of the latest consumes the percentile is measured over,
+	// and how many it needs
+	hedgeSamples    = 1000
+	hedgeMinSamples = 20
+	// how often, in consumes, the percentile is measured again
+	hedgeRemeasure = 50
+	// the most hedges the budget saves up for
+	hedgeBurst = 10
+)
+
+// hedger hedges consumes. A nil hedger makes each consume once.
+type hedger struct {
+	config HedgeConfig
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	// whether the delay was measured, and the samples since it was
+	measured bool
+	since    int
+	delay    time.Duration
+	tokens   float64
+}
+
+func newHedger(config HedgeConfig) *hedger {
+	if config.Percentile <= 0 {
+		return nil
+	}
+	if config.InitialDelay == 0 {
+		config.InitialDelay = 10 * time.Millisecond
+	}
+	if config.Budget == 0 {
+		config.Budget = 0.1
+	}
+	return &hedger{
+		config: config,
+		delay:  max(config.InitialDelay, config.MinDelay),
+		tokens: hedgeBurst,
+	}
+}
+
+// Makes the consume with fn, and again if it hasn't answered in time and
+// the budget allows, returning the first response. It fails only once
+// every consume made has.
+func (h *hedger) consume(ctx context.Context, fn func(context.Context) (*api.ConsumeResponse, error)) (
+	*api.ConsumeResponse, error,
+) {
+	if h == nil {
+		return fn(ctx)
+	}
+	delay := h.start()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		res *api.ConsumeResponse
+		err error
+	}
+	// buffered for the losing call, which finishes after the winner returns
+	results := make(chan result, 2)
+	send := func() {
+		start := time.Now()
+		res, err := fn(ctx)
+		if err == nil {
+			h.observe(time.Since(start))
+		}
+		results <- result{res, err}
+	}
+	go send()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	inFlight := 1
+	var firstErr error
+	for {
+		select {
+		case <-timer.C:
+			if h.spend() {
+				inFlight++
+				go send()
+			}
+		case r := <-results:
+			inFlight--
+			if r.err == nil {
+				return r.res, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if inFlight == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// Earns the consume's share of the budget and returns how long it waits
+// before it's hedged
+func (h *hedger) start() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.tokens = min(h.tokens+h.config.Budget, hedgeBurst)
+	return h.delay
+}
+
+// Takes a hedge out of the budget, false if it's spent
+func (h *hedger) spend() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.tokens < 1 {
+		return false
+	}
+	h.tokens--
+	return true
+}
+
+// Records how long a consume took to answer, measuring the percentile
+// again every so often
+func (h *hedger) observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.samples) < hedgeSamples {
+		h.samples = append(h.samples, d)
+	} else {
+		h.samples[h.next] = d
+		h.next = (h.next + 1) % hedgeSamples
+	}
+	h.since++
+	if len(h.samples) < hedgeMinSamples || h.measured && h.since < hedgeRemeasure {
+		return
+	}
+	h.measured, h.since = true, 0
+	sorted := slices.Clone(h.samples)
+	slices.Sort(sorted)
+	i := int(h.config.Percentile * float64(len(sorted)-1))
+	h.delay = max(sorted[min(i, len(sorted)-1)], h.config.MinDelay)
+}
@@ -0,0 +1,65 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHedge(t *testing.T) {
+	require.Nil(t, newHedger(HedgeConfig{}))
+	ctx := context.Background()
+
+	// the first call hangs until it's canceled, the hedge answers
+	var calls atomic.Int64
+	slowFirst := func(ctx context.Context) (*api.ConsumeResponse, error) {
+		if calls.Add(1) == 1 {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return &api.ConsumeResponse{Record: &api.Record{Offset: 2}}, nil
+	}
+	h := newHedger(HedgeConfig{Percentile: 0.9, InitialDelay: time.Millisecond})
+	res, err := h.consume(ctx, slowFirst)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), res.Record.Offset)
+	require.Equal(t, int64(2), calls.Load())
+
+	// errors are returned once every call has failed
+	failed := errors.New("failed")
+	res, err = h.consume(ctx, func(context.Context) (*api.ConsumeResponse, error) {
+		return nil, failed
+	})
+	require.Nil(t, res)
+	require.Equal(t, failed, err)
+
+	// hedges over budget aren't made
+	h.tokens = 0
+	calls.Store(0)
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	_, err = h.consume(timeout, slowFirst)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, int64(1), calls.Load())
+
+	// the delay follows the percentile of the consumes' latencies
+	h = newHedger(HedgeConfig{Percentile: 0.95, MinDelay: 5 * time.Millisecond})
+	require.Equal(t, 10*time.Millisecond, h.start())
+	for i := 0; i < hedgeMinSamples; i++ {
+		d := time.Millisecond
+		if i%10 == 0 {
+			d = 100 * time.Millisecond
+		}
+		h.observe(d)
+	}
+	require.Equal(t, 100*time.Millisecond, h.start())
+	for i := 0; i < hedgeSamples; i++ {
+		h.observe(time.Millisecond)
+	}
+	require.Equal(t, 5*time.Millisecond, h.start())
+}
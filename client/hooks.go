@@ -0,0 +1,68 @@
+package client
+
+import "time"
+
+// Call is a call the client makes, as hooks see it
+type Call struct {
+	// Method is the RPC's name, such as "Produce" or "ProduceBatch"
+	Method string
+	// Topic and Partition are the ones the call is for, an empty Topic
+	// the default one
+	Topic     string
+	Partition uint32
+	// Records is how many records a produce sends
+	Records int
+	// Attempt counts the call's attempts from 1, and a stream's opens
+	Attempt int
+	// Start is when the first attempt was made
+	Start time.Time
+}
+
+// Hooks observe the client's calls. Each is optional and called on the
+// goroutine making the call, so it should return quickly.
+type Hooks struct {
+	// OnSend is called before each attempt
+	OnSend func(Call)
+	// OnAck is called once the call succeeds
+	OnAck func(Call)
+	// OnRetry is called when an attempt failed with err and is retried
+	// after backoff
+	OnRetry func(call Call, err error, backoff time.Duration)
+	// OnError is called once the call failed for good
+	OnError func(call Call, err error)
+}
+
+// hookList calls every hook in turn
+type hookList []Hooks
+
+func (l hookList) send(call Call) {
+	for _, h := range l {
+		if h.OnSend != nil {
+			h.OnSend(call)
+		}
+	}
+}
+
+func (l hookList) ack(call Call) {
+	for _, h := range l {
+		if h.OnAck != nil {
+			h.OnAck(call)
+		}
+	}
+}
+
+func (l hookList) retry(call Call, err error, backoff time.Duration) {
+	for _, h := range l {
+		if h.OnRetry != nil {
+			h.OnRetry(call, err, backoff)
+		}
+	}
+}
+
+func (l hookList) fail(call Call, err error) {
+	for _, h := range l {
+		if h.OnError != nil {
+			h.OnError(call, err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestHooks(t *testing.T) {
+	var events []string
+	hooks := Hooks{
+		OnSend: func(call Call) { events = append(events, "send") },
+		OnAck:  func(call Call) { events = append(events, "ack") },
+		OnRetry: func(call Call, err error, backoff time.Duration) {
+			require.Error(t, err)
+			require.Positive(t, backoff)
+			events = append(events, "retry")
+		},
+		OnError: func(call Call, err error) { events = append(events, "error") },
+	}
+	reg := prometheus.NewRegistry()
+	promHooks, err := PrometheusHooks(reg)
+	require.NoError(t, err)
+	reader := sdkmetric.NewManualReader()
+	otelHooks, err := OTelHooks(sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	require.NoError(t, err)
+
+	srv := &flakyServer{}
+	c := setupFlaky(t, srv, RetryConfig{InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond})
+	c.hooks = hookList{hooks, promHooks, otelHooks}
+	ctx := context.Background()
+
+	srv.failures.Store(1)
+	_, err = c.Produce(ctx, []byte("foo"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"send", "retry", "send", "ack"}, events)
+
+	events = nil
+	_, err = c.Consume(ctx, 0)
+	require.Error(t, err)
+	require.Equal(t, []string{"send", "error"}, events)
+
+	require.Equal(t, 1.0, counterValue(t, reg, "proglog_client_retries_total"))
+	require.Equal(t, 1.0, counterValue(t, reg, "proglog_client_records_produced_total"))
+	require.Equal(t, 2, testutil.CollectAndCount(reg, "proglog_client_calls_total"))
+
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(ctx, &rm))
+	names := map[string]bool{}
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			names[m.Name] = true
+		}
+	}
+	require.True(t, names["proglog.client.call.duration"])
+	require.True(t, names["proglog.client.retries"])
+}
+
+// Sums the counter's series
+func counterValue(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	var sum float64
+	for _, f := range families {
+		if f.GetName() == name {
+			for _, m := range f.GetMetric() {
+				sum += m.GetCounter().GetValue()
+			}
+		}
+	}
+	return sum
+}
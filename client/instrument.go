@@ -0,0 +1,104 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"google.golang.org/grpc/status"
+)
+
+// PrometheusHooks count and time the client's calls in metrics registered
+// with reg, the default registry when nil. Clients sharing a registry can
+// share the hooks. Durations run from the first attempt to the call's end,
+// retries included.
+func PrometheusHooks(reg prometheus.Registerer) (Hooks, error) {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+	calls := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_client_calls_total",
+		Help: "Calls the client finished, by method and status code.",
+	}, []string{"method", "code"})
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proglog_client_call_duration_seconds",
+		Help:    "How long calls took, retries included.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 15),
+	}, []string{"method"})
+	retries := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_client_retries_total",
+		Help: "Attempts the client retried, by method.",
+	}, []string{"method"})
+	records := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_client_records_produced_total",
+		Help: "Records the servers acknowledged.",
+	}, []string{"method"})
+	for _, c := range []prometheus.Collector{calls, duration, retries, records} {
+		if err := reg.Register(c); err != nil {
+			return Hooks{}, err
+		}
+	}
+
+	done := func(call Call, err error) {
+		calls.WithLabelValues(call.Method, status.Code(err).String()).Inc()
+		duration.WithLabelValues(call.Method).Observe(time.Since(call.Start).Seconds())
+	}
+	return Hooks{
+		OnAck: func(call Call) {
+			done(call, nil)
+			if call.Records > 0 {
+				records.WithLabelValues(call.Method).Add(float64(call.Records))
+			}
+		},
+		OnRetry: func(call Call, _ error, _ time.Duration) {
+			retries.WithLabelValues(call.Method).Inc()
+		},
+		OnError: done,
+	}, nil
+}
+
+// OTelHooks record the same as PrometheusHooks with OpenTelemetry
+// instruments from mp, the global meter provider when nil
+func OTelHooks(mp metric.MeterProvider) (Hooks, error) {
+	if mp == nil {
+		mp = otel.GetMeterProvider()
+	}
+	meter := mp.Meter("github.com/frankie-mur/proglog/client")
+	duration, durationErr := meter.Float64Histogram("proglog.client.call.duration",
+		metric.WithUnit("s"),
+		metric.WithDescription("How long calls took, retries included."),
+	)
+	retries, retriesErr := meter.Int64Counter("proglog.client.retries",
+		metric.WithDescription("Attempts the client retried."),
+	)
+	records, recordsErr := meter.Int64Counter("proglog.client.records.produced",
+		metric.WithDescription("Records the servers acknowledged."),
+	)
+	if err := errors.Join(durationErr, retriesErr, recordsErr); err != nil {
+		return Hooks{}, err
+	}
+
+	ctx := context.Background()
+	done := func(call Call, err error) {
+		duration.Record(ctx, time.Since(call.Start).Seconds(), metric.WithAttributes(
+			attribute.String("rpc.method", call.Method),
+			attribute.String("rpc.grpc.status_code", status.Code(err).String()),
+		))
+	}
+	return Hooks{
+		OnAck: func(call Call) {
+			done(call, nil)
+			if call.Records > 0 {
+				records.Add(ctx, int64(call.Records), metric.WithAttributes(attribute.String("rpc.method", call.Method)))
+			}
+		},
+		OnRetry: func(call Call, _ error, _ time.Duration) {
+			retries.Add(ctx, 1, metric.WithAttributes(attribute.String("rpc.method", call.Method)))
+		},
+		OnError: done,
+	}, nil
+}
@@ -0,0 +1,23 @@
+package client
+
+import (
+	"context"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+// Log is the calls applications make to read and write the log, for them
+// to depend on rather than on Client, so their tests can take the fake in
+// clienttest instead
+type Log interface {
+	Produce(ctx context.Context, value []byte) (uint64, error)
+	ProduceRecord(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error)
+	Consume(ctx context.Context, offset uint64) (*api.Record, error)
+	ConsumeRecord(ctx context.Context, req *api.ConsumeRequest) (*api.Record, error)
+	ConsumeStream(ctx context.Context, req *api.ConsumeRequest, fn func(*api.Record) error) error
+	CommitOffset(ctx context.Context, consumer, topic string, partition uint32, offset uint64) error
+	FetchOffset(ctx context.Context, consumer, topic string, partition uint32) (offset uint64, found bool, err error)
+	GetOffsets(ctx context.Context, topic string, partition uint32) (*api.GetOffsetsResponse, error)
+}
+
+var _ Log = (*Client)(nil)
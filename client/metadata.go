@@ -0,0 +1,105 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/loadbalance"
+)
+
+// metadata caches which server leads each topic partition, learned from
+// the servers that answer api.ErrNotLeader, so calls after a failover, or
+// to partitions led elsewhere than partition 0, go straight to the leader.
+// It caches the topics' partition counts and versions too, for hashing
+// records' keys.
+type metadata struct {
+	// resolver is nil for xDS targets, whose leaders are learned from
+	// api.ErrNotLeader alone, see XDSScheme
+	resolver *loadbalance.Builder
+
+	mu      sync.Mutex
+	leaders map[topicPartition]string
+	topics  map[string]topicMeta
+}
+
+// A topic's partition count and the version of the topic it's from
+type topicMeta struct {
+	partitions uint32
+	version    uint64
+}
+
+// A partition of a topic, by the topic's name
+type topicPartition struct {
+	topic     string
+	partition uint32
+}
+
+// Routes the call to the topic partition's leader when it's known
+func (m *metadata) route(ctx context.Context, topic string, partition uint32) context.Context {
+	if leader := m.leader(topic, partition); leader != "" {
+		return loadbalance.WithLeader(ctx, leader)
+	}
+	return ctx
+}
+
+// The address the topic partition's leader was last seen at, empty if
+// unknown
+func (m *metadata) leader(topic string, partition uint32) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.leaders[topicPartition{topicName(topic), partition}]
+}
+
+// Learns from the error a call to the topic partition failed with. A
+// server that isn't the leader names the one it knows, or none mid
+// election, and the servers are resolved again so the rest of the client
+// catches up.
+func (m *metadata) observe(topic string, partition uint32, err error) {
+	var notLeader api.ErrNotLeader
+	if !errors.As(err, &notLeader) {
+		return
+	}
+	key := topicPartition{topicName(topic), partition}
+	m.mu.Lock()
+	if notLeader.Leader == "" {
+		delete(m.leaders, key)
+	} else {
+		if m.leaders == nil {
+			m.leaders = make(map[topicPartition]string)
+		}
+		m.leaders[key] = notLeader.Leader
+	}
+	m.mu.Unlock()
+	if m.resolver != nil {
+		m.resolver.ResolveNow()
+	}
+}
+
+// The topic's partition count and version, if they're cached
+func (m *metadata) topic(topic string) (topicMeta, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.topics[topic]
+	return t, ok
+}
+
+// Caches the listed topics' partition counts and versions, replacing those
+// cached before
+func (m *metadata) setTopics(res *api.ListTopicsResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.topics = make(map[string]topicMeta, len(res.Partitions))
+	for name, n := range res.Partitions {
+		m.topics[name] = topicMeta{partitions: n, version: res.Versions[name]}
+	}
+}
+
+// Forgets the topic's partition count, for the next keyed record to look
+// it up again after the topic changed
+func (m *metadata) forgetPartitions(topic string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.topics, topic)
+}
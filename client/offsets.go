@@ -0,0 +1,107 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sync"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+// OffsetStore keeps the offsets consumers commit, each the next record the
+// consumer reads from the topic's partition. The Client is one, committing to the
+// servers; FileOffsets keeps them in a local file, and applications can
+// keep them with their own data, committing in the same transaction. It
+// must be safe for concurrent use.
+type OffsetStore interface {
+	CommitOffset(ctx context.Context, consumer, topic string, partition uint32, offset uint64) error
+	// FetchOffset returns the offset the consumer last committed to the
+	// topic's partition, found is false if it never has
+	FetchOffset(ctx context.Context, consumer, topic string, partition uint32) (offset uint64, found bool, err error)
+}
+
+var _ OffsetStore = (*Client)(nil)
+
+// GroupOffsets commits to the servers' offsets topic, the consumer's name
+// being its group, see Client.CommitGroupOffsets
+type GroupOffsets struct {
+	client *Client
+}
+
+var _ OffsetStore = GroupOffsets{}
+
+// GroupOffsets is an OffsetStore committing to the servers by group
+func (c *Client) GroupOffsets() GroupOffsets {
+	return GroupOffsets{client: c}
+}
+
+func (g GroupOffsets) CommitOffset(ctx context.Context, group, topic string, partition uint32, offset uint64) error {
+	return g.client.CommitGroupOffsets(ctx, group, []*api.GroupOffset{{Topic: topic, Partition: partition, Offset: offset}})
+}
+
+func (g GroupOffsets) FetchOffset(ctx context.Context, group, topic string, partition uint32) (uint64, bool, error) {
+	offsets, err := g.client.FetchGroupOffsets(ctx, group, []*api.GroupOffset{{Topic: topic, Partition: partition}})
+	if err != nil {
+		return 0, false, err
+	}
+	return offsets[0].Offset, offsets[0].Found, nil
+}
+
+// FileOffsets keeps offsets in a JSON file, rewritten whole on each commit
+// so a crash leaves the old offsets or the new ones. It's for consumers on
+// one machine; processes sharing the file overwrite each other's commits.
+type FileOffsets struct {
+	path string
+
+	mu sync.Mutex
+	// by consumer, then topic, then partition
+	offsets map[string]map[string]map[uint32]uint64
+}
+
+var _ OffsetStore = (*FileOffsets)(nil)
+
+// NewFileOffsets keeps offsets in the file at path, reading the offsets
+// already in it
+func NewFileOffsets(path string) (*FileOffsets, error) {
+	f := &FileOffsets{path: path, offsets: make(map[string]map[string]map[uint32]uint64)}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &f.offsets); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileOffsets) CommitOffset(_ context.Context, consumer, topic string, partition uint32, offset uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.offsets[consumer] == nil {
+		f.offsets[consumer] = make(map[string]map[uint32]uint64)
+	}
+	if f.offsets[consumer][topic] == nil {
+		f.offsets[consumer][topic] = make(map[uint32]uint64)
+	}
+	f.offsets[consumer][topic][partition] = offset
+	b, err := json.Marshal(f.offsets)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(f.path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.path+".tmp", f.path)
+}
+
+func (f *FileOffsets) FetchOffset(_ context.Context, consumer, topic string, partition uint32) (uint64, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	offset, found := f.offsets[consumer][topic][partition]
+	return offset, found, nil
+}
@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/frankie-mur/proglog/internal/agent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileOffsets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offsets.json")
+	ctx := context.Background()
+	offsets, err := NewFileOffsets(path)
+	require.NoError(t, err)
+	_, found, err := offsets.FetchOffset(ctx, "group", "", 0)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.NoError(t, offsets.CommitOffset(ctx, "group", "", 0, 3))
+	require.NoError(t, offsets.CommitOffset(ctx, "group", "", 1, 7))
+	require.NoError(t, offsets.CommitOffset(ctx, "group", "", 0, 5))
+	require.NoError(t, offsets.CommitOffset(ctx, "group", "events", 0, 9))
+
+	// the commits outlive the process
+	offsets, err = NewFileOffsets(path)
+	require.NoError(t, err)
+	for partition, want := range map[uint32]uint64{0: 5, 1: 7} {
+		off, found, err := offsets.FetchOffset(ctx, "group", "", partition)
+		require.NoError(t, err)
+		require.True(t, found)
+		require.Equal(t, want, off)
+	}
+	off, _, err := offsets.FetchOffset(ctx, "group", "events", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(9), off)
+
+	require.NoError(t, os.WriteFile(path, []byte("not json"), 0644))
+	_, err = NewFileOffsets(path)
+	require.Error(t, err)
+}
+
+func TestGroupOffsets(t *testing.T) {
+	dir := t.TempDir()
+	start := func() *agent.Agent {
+		a, err := agent.New(agent.Config{
+			RPCAddr:  "127.0.0.1:0",
+			HTTPAddr: "127.0.0.1:0",
+			DataDir:  dir,
+			NodeName: "node",
+		})
+		require.NoError(t, err)
+		return a
+	}
+	a := start()
+	c, err := New(Config{Addr: a.AdvertiseRPCAddr})
+	require.NoError(t, err)
+	ctx := context.Background()
+	offsets := c.GroupOffsets()
+	_, found, err := offsets.FetchOffset(ctx, "group", "", 0)
+	require.NoError(t, err)
+	require.False(t, found)
+	require.NoError(t, offsets.CommitOffset(ctx, "group", "", 0, 3))
+	require.NoError(t, offsets.CommitOffset(ctx, "group", "", 0, 5))
+	require.NoError(t, c.Close())
+
+	// the commits outlive the client and the server
+	require.NoError(t, a.Shutdown())
+	a = start()
+	defer a.Shutdown()
+	c, err = New(Config{Addr: a.AdvertiseRPCAddr})
+	require.NoError(t, err)
+	defer c.Close()
+	off, found, err := c.GroupOffsets().FetchOffset(ctx, "group", "", 0)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, uint64(5), off)
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"context"
+	"hash/fnv"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+// PartitionForKey is the partition, of the topic's count, that Client and
+// Producer send records with the key to: the key's 32-bit FNV-1a hash
+// modulo the count. Other clients hashing keys the same way keep a key's
+// records in one partition with theirs.
+func PartitionForKey(key []byte, partitions uint32) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32() % max(partitions, 1)
+}
+
+// How many times a produce picks its records' partitions again after the
+// topic's partitions changed under it
+const staleMetadataRetries = 3
+
+// The partition the record goes to, the one its key hashes to when it has
+// a key and p otherwise. For a key it returns the topic's version too, for
+// the produce to fail with api.ErrStaleMetadata if the topic's since had
+// partitions added.
+func (c *Client) partitionFor(ctx context.Context, topic string, record *api.Record, p uint32) (uint32, *uint64, error) {
+	if record.GetKey() == nil {
+		return p, nil, nil
+	}
+	t, err := c.topicMeta(ctx, topic)
+	if err != nil {
+		return 0, nil, err
+	}
+	return t.partition(record, p), &t.version, nil
+}
+
+// The partition the record goes to by this version of the topic
+func (t topicMeta) partition(record *api.Record, p uint32) uint32 {
+	if record.GetKey() == nil {
+		return p
+	}
+	return PartitionForKey(record.Key, t.partitions)
+}
+
+// The topic's partition count and version, cached from the servers' list
+// of topics
+func (c *Client) topicMeta(ctx context.Context, topic string) (topicMeta, error) {
+	topic = topicName(topic)
+	if t, ok := c.meta.topic(topic); ok {
+		return t, nil
+	}
+	var res *api.ListTopicsResponse
+	err := c.do(ctx, Call{Method: "ListTopics"}, func(ctx context.Context) (err error) {
+		res, err = c.log().ListTopics(ctx, &api.ListTopicsRequest{})
+		return err
+	})
+	if err != nil {
+		return topicMeta{}, err
+	}
+	c.meta.setTopics(res)
+	t, ok := c.meta.topic(topic)
+	if !ok {
+		return topicMeta{}, api.ErrTopicNotFound{Topic: topic}
+	}
+	return t, nil
+}
+
+// The topic's name, the default topic's for an empty one
+func topicName(topic string) string {
+	if topic == "" {
+		return log.DefaultTopic
+	}
+	return topic
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/keepalive"
+)
+
+// PoolConfig is how many connections the client keeps to the servers and
+// how they're shared, so a client with many streams doesn't send them all
+// down one TCP connection to each server
+type PoolConfig struct {
+	// Conns is how many connections the client opens to each server,
+	// defaults to 1. Calls take turns across them and streams open on the
+	// one with the fewest, each stream reopened after it breaks going to
+	// whichever has the fewest then.
+	Conns int
+	// MaxStreams caps the streams open on each connection, a stream over
+	// it waits for another to end. Zero doesn't cap them.
+	MaxStreams int
+	// KeepaliveInterval is how often connections are pinged to check their
+	// server is still there, defaults to 30 seconds and can't be under 10.
+	// A connection whose ping isn't answered within KeepaliveTimeout,
+	// defaults to 10 seconds, is redialed, calls avoiding it meanwhile.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+}
+
+func (c PoolConfig) withDefaults() PoolConfig {
+	if c.Conns == 0 {
+		c.Conns = 1
+	}
+	if c.KeepaliveInterval == 0 {
+		c.KeepaliveInterval = 30 * time.Second
+	}
+	if c.KeepaliveTimeout == 0 {
+		c.KeepaliveTimeout = 10 * time.Second
+	}
+	return c
+}
+
+// The dial option pinging the connections as configured
+func (c PoolConfig) keepalive() grpc.DialOption {
+	return grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:                c.KeepaliveInterval,
+		Timeout:             c.KeepaliveTimeout,
+		PermitWithoutStream: true,
+	})
+}
+
+// pool shares calls and streams across the client's connections
+type pool struct {
+	conns      []*poolConn
+	maxStreams int
+	current    atomic.Uint64
+
+	mu sync.Mutex
+	// closed and replaced each time a stream ends, waking the streams
+	// waiting for room
+	released chan struct{}
+}
+
+type poolConn struct {
+	conn  *grpc.ClientConn
+	log   api.LogClient
+	admin api.AdminClient
+	// streams open on the connection, guarded by the pool's mu
+	streams int
+}
+
+// Dials n connections with dial, closing those made if one fails
+func newPool(n, maxStreams int, dial func() (*grpc.ClientConn, error)) (*pool, error) {
+	p := &pool{maxStreams: maxStreams, released: make(chan struct{})}
+	for i := 0; i < n; i++ {
+		conn, err := dial()
+		if err != nil {
+			return nil, errors.Join(err, p.close())
+		}
+		p.conns = append(p.conns, &poolConn{conn: conn, log: api.NewLogClient(conn), admin: api.NewAdminClient(conn)})
+	}
+	return p, nil
+}
+
+// The next connection in turn for a call, skipping those that are failing
+// unless they all are
+func (p *pool) next() *poolConn {
+	start := p.current.Add(1)
+	for i := range p.conns {
+		pc := p.conns[(start+uint64(i))%uint64(len(p.conns))]
+		if healthy(pc.conn) {
+			return pc
+		}
+	}
+	return p.conns[start%uint64(len(p.conns))]
+}
+
+// Takes room for a stream on the connection with the fewest streams,
+// failing ones last, waiting while every connection is full until ctx is
+// done. release gives the room back.
+func (p *pool) stream(ctx context.Context) (log api.LogClient, release func(), err error) {
+	for {
+		p.mu.Lock()
+		var best *poolConn
+		for _, pc := range p.conns {
+			if p.maxStreams > 0 && pc.streams >= p.maxStreams {
+				continue
+			}
+			if best == nil || healthy(pc.conn) && !healthy(best.conn) ||
+				healthy(pc.conn) == healthy(best.conn) && pc.streams < best.streams {
+				best = pc
+			}
+		}
+		if best != nil {
+			best.streams++
+			p.mu.Unlock()
+			var once sync.Once
+			return best.log, func() { once.Do(func() { p.release(best) }) }, nil
+		}
+		released := p.released
+		p.mu.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+func (p *pool) release(pc *poolConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.streams--
+	close(p.released)
+	p.released = make(chan struct{})
+}
+
+func (p *pool) close() error {
+	var errs []error
+	for _, pc := range p.conns {
+		errs = append(errs, pc.conn.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Whether the connection isn't failing, idle ones connect when called
+func healthy(conn *grpc.ClientConn) bool {
+	state := conn.GetState()
+	return state != connectivity.TransientFailure && state != connectivity.Shutdown
+}
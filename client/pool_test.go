@@ -0,0 +1,74 @@
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/agent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPool(t *testing.T) {
+	a, err := agent.New(agent.Config{
+		RPCAddr:  "127.0.0.1:0",
+		HTTPAddr: "127.0.0.1:0",
+		DataDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	defer a.Shutdown()
+	c, err := New(Config{Addr: a.AdvertiseRPCAddr, Pool: PoolConfig{Conns: 2, MaxStreams: 1}})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Len(t, c.pool.conns, 2)
+
+	// calls take turns
+	require.NotSame(t, c.pool.next(), c.pool.next())
+	_, err = c.Produce(context.Background(), []byte("hello"))
+	require.NoError(t, err)
+
+	streams := func() []int {
+		c.pool.mu.Lock()
+		defer c.pool.mu.Unlock()
+		var n []int
+		for _, pc := range c.pool.conns {
+			n = append(n, pc.streams)
+		}
+		return n
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	consume := func(ctx context.Context) error {
+		return c.ConsumeStream(ctx, &api.ConsumeRequest{}, func(*api.Record) error { return nil })
+	}
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- consume(ctx) }()
+	}
+	// a stream on each connection
+	require.Eventually(t, func() bool {
+		n := streams()
+		return n[0] == 1 && n[1] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// with both full another waits
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	require.ErrorIs(t, consume(short), context.DeadlineExceeded)
+
+	// until one ends
+	waiting := make(chan error, 1)
+	later, cancelLater := context.WithCancel(context.Background())
+	go func() { waiting <- consume(later) }()
+	cancel()
+	for i := 0; i < 2; i++ {
+		require.ErrorIs(t, <-errs, context.Canceled)
+	}
+	require.Eventually(t, func() bool {
+		n := streams()
+		return n[0]+n[1] == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	cancelLater()
+	require.ErrorIs(t, <-waiting, context.Canceled)
+	require.Equal(t, []int{0, 0}, streams())
+}
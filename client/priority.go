@@ -0,0 +1,15 @@
+package client
+
+import (
+	"context"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	grpcmetadata "google.golang.org/grpc/metadata"
+)
+
+// WithPriority returns ctx asking the server to serve the calls made with
+// it in the priority's class, which can only lower theirs, e.g. a backfill
+// of records at the tail, see api.Priority
+func WithPriority(ctx context.Context, p api.Priority) context.Context {
+	return grpcmetadata.AppendToOutgoingContext(ctx, api.PriorityHeader, p.HeaderValue())
+}
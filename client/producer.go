@@ -0,0 +1,375 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/codec"
+)
+
+type ProducerConfig struct {
+	// Topic, Partition and Ack apply to every record, see
+	// api.ProduceRequest, but for records with a key, which go to the
+	// partition PartitionForKey hashes them to
+	Topic     string
+	Partition uint32
+	Ack       api.Ack
+	// BatchRecords sends a batch once it holds this many records, defaults
+	// to 500
+	BatchRecords int
+	// BatchBytes sends a batch once its values add up to this many bytes,
+	// defaults to 1 MiB
+	BatchBytes int
+	// Linger is how long a batch waits for more records after its first,
+	// defaults to 5 milliseconds
+	Linger time.Duration
+	// MaxInFlight caps the batches sent that haven't been answered,
+	// defaults to 1. Batches in flight together may be appended in either
+	// order.
+	MaxInFlight int
+	// BufferRecords is how many records Send queues before it blocks,
+	// defaults to 10000
+	BufferRecords int
+	// Results delivers the results of records sent without a callback on
+	// the Results channel, which must then be read; otherwise they're dropped
+	Results bool
+	// Compression compresses the records' values before they're sent,
+	// consumers using the Client decompress them. Records already
+	// compressed, or that compressing wouldn't make smaller, are sent as
+	// they are.
+	Compression api.Codec
+}
+
+// Result is what became of a record sent by a Producer
+type Result struct {
+	Record *api.Record
+	// Partition is the partition the record was sent to
+	Partition uint32
+	// Offset is where the record was appended, unless Pending, Dropped or
+	// Err is set
+	Offset  uint64
+	Pending bool
+	// Dropped is set when the topic's transform dropped the record, which
+	// wasn't appended
+	Dropped bool
+	Err     error
+}
+
+// Producer sends records in batches, in the background, so callers don't
+// wait a round trip per record. Batches are sent once they're big enough
+// or have lingered long enough, and retried as the Client retries calls,
+// resent to another server while one that died is failed over from, see
+// RetryConfig.Failover. A batch a server appended but didn't answer before
+// it died is appended again.
+// It's safe for concurrent use; records sent from one goroutine are
+// appended in order unless MaxInFlight is above 1.
+type Producer struct {
+	client   *Client
+	config   ProducerConfig
+	queue    chan *queued
+	flushes  chan struct{}
+	inFlight chan struct{}
+	results  chan Result
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu          sync.Mutex
+	outstanding int
+	idle        []chan struct{}
+	closed      bool
+}
+
+type queued struct {
+	record *api.Record
+	fn     func(Result)
+}
+
+// NewProducer starts a producer sending records with the client
+func (c *Client) NewProducer(config ProducerConfig) *Producer {
+	if config.BatchRecords == 0 {
+		config.BatchRecords = 500
+	}
+	if config.BatchBytes == 0 {
+		config.BatchBytes = 1 << 20
+	}
+	if config.Linger == 0 {
+		config.Linger = 5 * time.Millisecond
+	}
+	if config.MaxInFlight == 0 {
+		config.MaxInFlight = 1
+	}
+	if config.BufferRecords == 0 {
+		config.BufferRecords = 10000
+	}
+	p := &Producer{
+		client:   c,
+		config:   config,
+		queue:    make(chan *queued, config.BufferRecords),
+		flushes:  make(chan struct{}),
+		inFlight: make(chan struct{}, config.MaxInFlight),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if config.Results {
+		p.results = make(chan Result, config.BufferRecords)
+	}
+	go p.run()
+	return p
+}
+
+// Send queues the record, blocking while the buffer is full until ctx is
+// done. fn is called with the record's result once its batch is answered,
+// from one of the producer's goroutines, so it shouldn't block; with a nil
+// fn the result goes to Results.
+func (p *Producer) Send(ctx context.Context, record *api.Record, fn func(Result)) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	p.outstanding++
+	p.mu.Unlock()
+	select {
+	case p.queue <- &queued{record: record, fn: fn}:
+		return nil
+	case <-ctx.Done():
+		p.finish(1)
+		return ctx.Err()
+	}
+}
+
+// Results delivers the results of records sent without a callback when
+// ProducerConfig.Results is set, nil otherwise. It's closed by Close.
+func (p *Producer) Results() <-chan Result {
+	return p.results
+}
+
+// Flush sends the records queued so far without waiting out the linger,
+// and waits until every record sent has its result or ctx is done
+func (p *Producer) Flush(ctx context.Context) error {
+	select {
+	case p.flushes <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.mu.Lock()
+	if p.outstanding == 0 {
+		p.mu.Unlock()
+		return nil
+	}
+	idle := make(chan struct{})
+	p.idle = append(p.idle, idle)
+	p.mu.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close flushes the producer and stops it, later sends fail with
+// ErrClosed. It leaves the client open.
+func (p *Producer) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	p.mu.Unlock()
+	err := p.Flush(ctx)
+	close(p.stop)
+	<-p.done
+	if p.results != nil {
+		close(p.results)
+	}
+	return err
+}
+
+// Collects queued records into batches and sends them
+func (p *Producer) run() {
+	defer close(p.done)
+	var (
+		batch  []*queued
+		bytes  int
+		timer  *time.Timer
+		linger <-chan time.Time
+	)
+	send := func() {
+		if timer != nil {
+			timer.Stop()
+			timer, linger = nil, nil
+		}
+		if len(batch) == 0 {
+			return
+		}
+		p.inFlight <- struct{}{}
+		go p.send(batch)
+		batch, bytes = nil, 0
+	}
+	add := func(q *queued) {
+		batch = append(batch, q)
+		bytes += len(q.record.Value)
+		if len(batch) == 1 {
+			timer = time.NewTimer(p.config.Linger)
+			linger = timer.C
+		}
+		if len(batch) >= p.config.BatchRecords || bytes >= p.config.BatchBytes {
+			send()
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case q := <-p.queue:
+				add(q)
+			default:
+				return
+			}
+		}
+	}
+	for {
+		select {
+		case q := <-p.queue:
+			add(q)
+		case <-linger:
+			send()
+		case <-p.flushes:
+			drain()
+			send()
+		case <-p.stop:
+			drain()
+			send()
+			// the batches in flight finish before Close returns
+			for i := 0; i < cap(p.inFlight); i++ {
+				p.inFlight <- struct{}{}
+			}
+			return
+		}
+	}
+}
+
+// Sends the batch, see sendBatch
+func (p *Producer) send(batch []*queued) {
+	defer func() { <-p.inFlight }()
+	p.sendBatch(context.Background(), batch, 0)
+}
+
+// Splits the batch by the partitions its records go to, keeping their
+// order within each, and sends each partition's records in turn. Records
+// with keys are all hashed by one version of the topic, and those of the
+// partitions that fail with api.ErrStaleMetadata are split and sent again
+// by the topic's new version, so the records switch partitions at one
+// point in the order they were sent.
+func (p *Producer) sendBatch(ctx context.Context, batch []*queued, attempt int) {
+	var (
+		partitions []uint32
+		batches    = make(map[uint32][]*queued)
+		keyed      = make(map[uint32]bool)
+		topic      *topicMeta
+	)
+	for i, q := range batch {
+		partition := p.config.Partition
+		if q.record.GetKey() != nil {
+			if topic == nil {
+				t, err := p.client.topicMeta(ctx, p.config.Topic)
+				if err != nil {
+					p.deliver(batch[i:], 0, nil, err)
+					break
+				}
+				topic = &t
+			}
+			partition = topic.partition(q.record, partition)
+			keyed[partition] = true
+		}
+		if _, ok := batches[partition]; !ok {
+			partitions = append(partitions, partition)
+		}
+		batches[partition] = append(batches[partition], q)
+	}
+	var stale []*queued
+	for _, partition := range partitions {
+		var version *uint64
+		if keyed[partition] {
+			version = &topic.version
+		}
+		res, err := p.sendPartition(ctx, partition, batches[partition], version)
+		if errors.As(err, &api.ErrPartitionNotFound{}) || errors.As(err, &api.ErrStaleMetadata{}) {
+			p.client.meta.forgetPartitions(topicName(p.config.Topic))
+		}
+		if errors.As(err, &api.ErrStaleMetadata{}) && attempt < staleMetadataRetries {
+			stale = append(stale, batches[partition]...)
+			continue
+		}
+		p.deliver(batches[partition], partition, res, err)
+	}
+	if len(stale) > 0 {
+		p.sendBatch(ctx, stale, attempt+1)
+	}
+}
+
+// Sends the partition's batch, by the topic's version when its records'
+// keys picked the partition
+func (p *Producer) sendPartition(ctx context.Context, partition uint32, batch []*queued, version *uint64) (*api.ProduceBatchResponse, error) {
+	req := &api.ProduceBatchRequest{
+		Records:      make([]*api.Record, len(batch)),
+		Ack:          p.config.Ack,
+		Topic:        p.config.Topic,
+		Partition:    partition,
+		TopicVersion: version,
+	}
+	var err error
+	for i, q := range batch {
+		if req.Records[i], err = codec.Compress(p.config.Compression, q.record); err != nil {
+			break
+		}
+	}
+	var res *api.ProduceBatchResponse
+	if err == nil {
+		call := Call{Method: "ProduceBatch", Topic: p.config.Topic, Partition: partition, Records: len(batch)}
+		err = p.client.doFailover(ctx, call, func(ctx context.Context) (err error) {
+			res, err = p.client.log().ProduceBatch(ctx, req)
+			return err
+		})
+	}
+	return res, err
+}
+
+// Hands out the results of the partition's batch's records, answered with
+// res or failed with err
+func (p *Producer) deliver(batch []*queued, partition uint32, res *api.ProduceBatchResponse, err error) {
+	for i, q := range batch {
+		result := Result{Record: q.record, Partition: partition, Err: err}
+		if err == nil {
+			result.Pending = res.Pending
+			if i < len(res.Offsets) {
+				result.Offset = res.Offsets[i]
+			}
+			result.Dropped = i < len(res.Dropped) && res.Dropped[i]
+		}
+		switch {
+		case q.fn != nil:
+			q.fn(result)
+		case p.results != nil:
+			p.results <- result
+		}
+	}
+	p.finish(len(batch))
+}
+
+// Counts n records as done, waking flushes once none are left
+func (p *Producer) finish(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.outstanding -= n
+	if p.outstanding == 0 {
+		for _, idle := range p.idle {
+			close(idle)
+		}
+		p.idle = nil
+	}
+}
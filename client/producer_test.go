@@ -0,0 +1,227 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/agent"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProducer(t *testing.T) {
+	a, err := agent.New(agent.Config{
+		RPCAddr:  "127.0.0.1:0",
+		HTTPAddr: "127.0.0.1:0",
+		DataDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	defer a.Shutdown()
+	c, err := New(Config{Addr: a.AdvertiseRPCAddr})
+	require.NoError(t, err)
+	defer c.Close()
+	ctx := context.Background()
+
+	p := c.NewProducer(ProducerConfig{BatchRecords: 10, Results: true})
+	const n = 95
+	for i := 0; i < n; i++ {
+		require.NoError(t, p.Send(ctx, &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}, nil))
+	}
+	for i := 0; i < n; i++ {
+		res := <-p.Results()
+		require.NoError(t, res.Err)
+		require.Equal(t, uint64(i), res.Offset)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(res.Record.Value))
+	}
+
+	// callbacks get the result instead
+	var mu sync.Mutex
+	var offsets []uint64
+	for i := 0; i < 5; i++ {
+		require.NoError(t, p.Send(ctx, &api.Record{Value: []byte("callback")}, func(res Result) {
+			mu.Lock()
+			defer mu.Unlock()
+			require.NoError(t, res.Err)
+			offsets = append(offsets, res.Offset)
+		}))
+	}
+	require.NoError(t, p.Flush(ctx))
+	require.Equal(t, []uint64{95, 96, 97, 98, 99}, offsets)
+
+	record, err := c.Consume(ctx, 99)
+	require.NoError(t, err)
+	require.Equal(t, []byte("callback"), record.Value)
+
+	require.NoError(t, p.Close(ctx))
+	_, ok := <-p.Results()
+	require.False(t, ok)
+	require.Equal(t, ErrClosed, p.Send(ctx, &api.Record{}, nil))
+}
+
+func TestProducerBatches(t *testing.T) {
+	srv := &flakyServer{}
+	c := setupFlaky(t, srv, RetryConfig{InitialBackoff: time.Millisecond})
+	ctx := context.Background()
+
+	// records wait for a full batch, or a flush
+	p := c.NewProducer(ProducerConfig{BatchRecords: 10, Linger: time.Hour})
+	srv.failures.Store(1)
+	var results []Result
+	for i := 0; i < 25; i++ {
+		require.NoError(t, p.Send(ctx, &api.Record{}, func(res Result) {
+			results = append(results, res)
+		}))
+	}
+	require.NoError(t, p.Flush(ctx))
+	require.Equal(t, []int{10, 10, 5}, srv.batchSizes())
+	// the first batch was retried
+	require.Len(t, results, 25)
+	for _, res := range results {
+		require.NoError(t, res.Err)
+	}
+
+	// a lingering batch goes by itself
+	p = c.NewProducer(ProducerConfig{Linger: 10 * time.Millisecond})
+	defer p.Close(ctx)
+	sent := make(chan Result, 1)
+	require.NoError(t, p.Send(ctx, &api.Record{}, func(res Result) { sent <- res }))
+	select {
+	case res := <-sent:
+		require.NoError(t, res.Err)
+	case <-time.After(time.Second):
+		t.Fatal("batch didn't linger out")
+	}
+}
+
+func TestProducerCompression(t *testing.T) {
+	a, err := agent.New(agent.Config{
+		RPCAddr:  "127.0.0.1:0",
+		HTTPAddr: "127.0.0.1:0",
+		DataDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	defer a.Shutdown()
+	c, err := New(Config{Addr: a.AdvertiseRPCAddr})
+	require.NoError(t, err)
+	defer c.Close()
+	ctx := context.Background()
+
+	value := []byte(strings.Repeat("compressible ", 100))
+	for _, codec := range []api.Codec{api.Codec_CODEC_SNAPPY, api.Codec_CODEC_ZSTD} {
+		p := c.NewProducer(ProducerConfig{Compression: codec})
+		results := make(chan Result, 2)
+		send := func(v []byte) {
+			require.NoError(t, p.Send(ctx, &api.Record{Value: v}, func(res Result) { results <- res }))
+		}
+		send(value)
+		// too small to be worth it
+		send([]byte("x"))
+		require.NoError(t, p.Close(ctx))
+		big, small := <-results, <-results
+		require.NoError(t, big.Err)
+		require.NoError(t, small.Err)
+		// the caller's record is left as it was
+		require.Equal(t, value, big.Record.Value)
+		require.Equal(t, api.Codec_CODEC_NONE, big.Record.Codec)
+
+		// the log holds what was sent
+		raw, err := c.log().Consume(ctx, &api.ConsumeRequest{Offset: big.Offset})
+		require.NoError(t, err)
+		require.Equal(t, codec, raw.Record.Codec)
+		require.Less(t, len(raw.Record.Value), len(value))
+		raw, err = c.log().Consume(ctx, &api.ConsumeRequest{Offset: small.Offset})
+		require.NoError(t, err)
+		require.Equal(t, api.Codec_CODEC_NONE, raw.Record.Codec)
+
+		// consumers get it back decompressed
+		record, err := c.Consume(ctx, big.Offset)
+		require.NoError(t, err)
+		require.Equal(t, value, record.Value)
+		require.Equal(t, api.Codec_CODEC_NONE, record.Codec)
+		streamed := make(chan *api.Record, 1)
+		err = c.ConsumeStream(ctx, &api.ConsumeRequest{Offset: big.Offset}, func(record *api.Record) error {
+			streamed <- record
+			return io.EOF
+		})
+		require.Equal(t, io.EOF, err)
+		require.Equal(t, value, (<-streamed).Value)
+	}
+
+	res, err := c.ProduceRecord(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("not zstd"), Codec: api.Codec_CODEC_ZSTD},
+	})
+	require.NoError(t, err)
+	_, err = c.Consume(ctx, res.Offset)
+	require.Error(t, err)
+}
+
+func TestProducerKeys(t *testing.T) {
+	a, err := agent.New(agent.Config{
+		RPCAddr:  "127.0.0.1:0",
+		HTTPAddr: "127.0.0.1:0",
+		DataDir:  t.TempDir(),
+	})
+	require.NoError(t, err)
+	defer a.Shutdown()
+	c, err := New(Config{Addr: a.AdvertiseRPCAddr})
+	require.NoError(t, err)
+	defer c.Close()
+	ctx := context.Background()
+	require.NoError(t, c.CreateTopic(ctx, &api.Topic{Name: "users", Partitions: 3}))
+
+	p := c.NewProducer(ProducerConfig{Topic: "users", Results: true})
+	const n = 30
+	for i := 0; i < n; i++ {
+		record := &api.Record{Key: []byte(fmt.Sprintf("user %d", i%10)), Value: []byte(fmt.Sprintf("%d", i))}
+		require.NoError(t, p.Send(ctx, record, nil))
+	}
+	require.NoError(t, p.Close(ctx))
+	next := make(map[uint32]uint64)
+	for res := range p.Results() {
+		require.NoError(t, res.Err)
+		require.Equal(t, PartitionForKey(res.Record.Key, 3), res.Partition)
+		// the partitions' offsets count up on their own
+		require.Equal(t, next[res.Partition], res.Offset)
+		next[res.Partition]++
+	}
+	require.Len(t, next, 3)
+
+	// a key's records stay in order in its partition
+	key := []byte("user 4")
+	var values []string
+	for off := uint64(0); off < next[PartitionForKey(key, 3)]; off++ {
+		record, err := c.ConsumeRecord(ctx, &api.ConsumeRequest{Topic: "users", Partition: PartitionForKey(key, 3), Offset: off})
+		require.NoError(t, err)
+		if string(record.Key) == string(key) {
+			values = append(values, string(record.Value))
+		}
+	}
+	require.Equal(t, []string{"4", "14", "24"}, values)
+
+	// once partitions are added, the next records hash by the new count
+	// though the producer cached the old one
+	_, err = c.CreatePartitions(ctx, "users", 6)
+	require.NoError(t, err)
+	p = c.NewProducer(ProducerConfig{Topic: "users", Results: true})
+	for i := 0; i < 10; i++ {
+		record := &api.Record{Key: []byte(fmt.Sprintf("user %d", i)), Value: []byte("after")}
+		require.NoError(t, p.Send(ctx, record, nil))
+	}
+	require.NoError(t, p.Close(ctx))
+	for res := range p.Results() {
+		require.NoError(t, res.Err)
+		require.Equal(t, PartitionForKey(res.Record.Key, 6), res.Partition)
+	}
+
+	// keys need the topic to exist
+	p = c.NewProducer(ProducerConfig{Topic: "missing", Results: true})
+	require.NoError(t, p.Send(ctx, &api.Record{Key: key}, nil))
+	require.NoError(t, p.Close(ctx))
+	res := <-p.Results()
+	require.ErrorAs(t, res.Err, &api.ErrTopicNotFound{})
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+// RetryConfig is how the client retries calls that fail with a Retryable
+// error. Waits between attempts grow exponentially from InitialBackoff to
+// MaxBackoff, each picked at random up to its bound, so clients failing
+// together don't retry together.
+type RetryConfig struct {
+	// MaxAttempts is how many times a call is made, defaults to 5. One
+	// disables retries.
+	MaxAttempts int
+	// InitialBackoff defaults to 100 milliseconds
+	InitialBackoff time.Duration
+	// MaxBackoff defaults to 5 seconds
+	MaxBackoff time.Duration
+	// Failover is how long ConsumeStream and the Producer's batches keep
+	// being retried past MaxAttempts, while a server that died is failed
+	// over from, so they carry on from another server without an error.
+	// It counts from a stream's open, or its last record, and a batch's
+	// first send. Defaults to 30 seconds, negative leaves them to
+	// MaxAttempts as other calls are.
+	Failover time.Duration
+}
+
+func (c RetryConfig) withDefaults() RetryConfig {
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = 5
+	}
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = 100 * time.Millisecond
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = 5 * time.Second
+	}
+	if c.Failover == 0 {
+		c.Failover = 30 * time.Second
+	}
+	return c
+}
+
+// Whether a call whose attempt failed is out of attempts, for calls that
+// ride out failovers once Failover has passed since since as well
+func (c RetryConfig) exhausted(attempt int, failover bool, since time.Time) bool {
+	if attempt < c.MaxAttempts {
+		return false
+	}
+	return !failover || c.Failover < 0 || time.Since(since) >= c.Failover
+}
+
+// The wait before retry attempt, the first retry being attempt 1
+func (c RetryConfig) backoff(attempt int) time.Duration {
+	bound := c.InitialBackoff
+	for i := 1; i < attempt && bound < c.MaxBackoff; i++ {
+		bound *= 2
+	}
+	bound = min(bound, c.MaxBackoff)
+	return rand.N(bound) + 1
+}
+
+// Makes the call until it succeeds, fails with an error that isn't
+// retryable, runs out of attempts, past Failover too if failover is set,
+// or ctx is done, telling the hooks
+func (c RetryConfig) do(ctx context.Context, call Call, hooks hookList, failover bool, fn func() error) error {
+	call.Start = time.Now()
+	var err error
+	for call.Attempt = 1; ; call.Attempt++ {
+		hooks.send(call)
+		if err = fromStatus(fn()); err == nil {
+			hooks.ack(call)
+			return nil
+		}
+		if !Retryable(err) || c.exhausted(call.Attempt, failover, call.Start) {
+			break
+		}
+		backoff := c.backoff(call.Attempt)
+		// a server that named the leader is retried against it straight
+		// away, once
+		var notLeader api.ErrNotLeader
+		if call.Attempt == 1 && errors.As(err, &notLeader) && notLeader.Leader != "" {
+			backoff = 0
+		}
+		hooks.retry(call, err, backoff)
+		if sleep(ctx, backoff) != nil {
+			break
+		}
+	}
+	hooks.fail(call, err)
+	return err
+}
+
+// Waits for d, or until ctx is done and returns its error
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/frankie-mur/proglog/internal/agent"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := writeCert(t, dir, "ca", nil, nil)
+	writeCert(t, dir, "server", ca, caKey)
+	writeCert(t, dir, "client", ca, caKey)
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.pem"), filepath.Join(dir, "server-key.pem"))
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	adminAddr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+	a, err := agent.New(agent.Config{
+		RPCAddr:         "127.0.0.1:0",
+		HTTPAddr:        "127.0.0.1:0",
+		AdminAddr:       adminAddr,
+		DataDir:         t.TempDir(),
+		ServerTLSConfig: serverTLS,
+		AdminTLSConfig:  serverTLS,
+	})
+	require.NoError(t, err)
+	defer a.Shutdown()
+
+	files := TLSFiles{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "client.pem"),
+		KeyFile:  filepath.Join(dir, "client-key.pem"),
+	}
+	produce := func(files TLSFiles) error {
+		c, err := New(Config{Addr: a.AdvertiseRPCAddr, TLS: &files, Retry: RetryConfig{MaxAttempts: 1}})
+		require.NoError(t, err)
+		defer c.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = c.Produce(ctx, []byte("hello"))
+		return err
+	}
+	require.NoError(t, produce(files))
+
+	// mutual TLS needs the client certificate
+	noCert := files
+	noCert.CertFile, noCert.KeyFile = "", ""
+	require.Error(t, produce(noCert))
+	// the server's certificate is checked against the name
+	otherName := files
+	otherName.ServerName = "other"
+	require.Error(t, produce(otherName))
+	// unless verification is off
+	otherName.InsecureSkipVerify = true
+	require.NoError(t, produce(otherName))
+
+	_, err = New(Config{Addr: a.AdvertiseRPCAddr, TLS: &files, TLSConfig: &tls.Config{}})
+	require.Error(t, err)
+
+	// admin calls go to the admin address, dialed the same way, as the
+	// RPC address doesn't serve them
+	describe := func(config Config) error {
+		config.Addr, config.TLS, config.Retry = a.AdvertiseRPCAddr, &files, RetryConfig{MaxAttempts: 1}
+		c, err := New(config)
+		require.NoError(t, err)
+		defer c.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = c.DescribeServer(ctx)
+		return err
+	}
+	require.NoError(t, describe(Config{AdminAddr: adminAddr}))
+	require.Equal(t, codes.Unimplemented, status.Code(describe(Config{})))
+
+	// the HTTP client dials the same way
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.Header.Get("X-Api-Key"))
+	}))
+	srv.TLS = serverTLS
+	srv.StartTLS()
+	defer srv.Close()
+	hc, err := Config{TLS: &files, APIKey: "key"}.HTTPClient()
+	require.NoError(t, err)
+	res, err := hc.Get(srv.URL)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, "key", string(body))
+}
+
+// Writes name.pem and name-key.pem to dir, signed by the parent or self
+// signed as a CA without one
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (
+	*x509.Certificate, *ecdsa.PrivateKey,
+) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+"-key.pem"),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return cert, key
+}
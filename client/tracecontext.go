@@ -0,0 +1,51 @@
+package client
+
+import (
+	"context"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RecordContext returns ctx carrying the W3C trace context in the record's
+// traceparent and tracestate headers, which servers set with
+// TraceRecordHeaders, so spans started from it continue the produce's
+// trace. ctx is returned as it is for records without one.
+func RecordContext(ctx context.Context, record *api.Record) context.Context {
+	return propagation.TraceContext{}.Extract(ctx, recordCarrier{record})
+}
+
+// RecordLink links a span to the span that produced the record, for spans
+// handling records of many traces, as a batch's. The link is empty for
+// records without a trace context.
+func RecordLink(record *api.Record) trace.Link {
+	ctx := RecordContext(context.Background(), record)
+	return trace.Link{SpanContext: trace.SpanContextFromContext(ctx)}
+}
+
+// Reads a record's headers as a propagation.TextMapCarrier, the last of a
+// key winning
+type recordCarrier struct {
+	record *api.Record
+}
+
+func (c recordCarrier) Get(key string) string {
+	for i := len(c.record.Headers) - 1; i >= 0; i-- {
+		if h := c.record.Headers[i]; h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Set is a no-op, the record's headers are the server's to set
+func (c recordCarrier) Set(string, string) {}
+
+func (c recordCarrier) Keys() []string {
+	keys := make([]string, len(c.record.Headers))
+	for i, h := range c.record.Headers {
+		keys[i] = h.Key
+	}
+	return keys
+}
@@ -0,0 +1,37 @@
+package client
+
+import (
+	"strings"
+
+	"github.com/frankie-mur/proglog/internal/loadbalance"
+	// registers gRPC's xds resolver and balancers
+	_ "google.golang.org/grpc/xds"
+)
+
+// XDSScheme starts the Addr of clients whose servers an xDS control plane
+// manages, as in xds:///proglog.example.com. gRPC reads where the control
+// plane is from the bootstrap file GRPC_XDS_BOOTSTRAP names, and the
+// control plane's clusters decide the endpoints, their weights and
+// outlier detection in place of GetServers.
+//
+// Calls go to the servers the cluster's load balancing policy picks. For
+// produces to go to partitions' leaders, the cluster selects the client's
+// policy, a TypedStruct of type XDSPolicyTypeURL in its
+// load_balancing_policy, and names the servers by the RPC addresses they
+// advertise. Produces then go to the servers in turn, and followers
+// forward them to the leader. Once a server answers api.ErrNotLeader
+// naming the leader instead, as servers that don't forward do, the
+// partition's produces go straight to it.
+// Consumes go to the servers in turn, as the control plane's localities
+// take the place of Config.Zone. Under any other policy calls go where it
+// picks, and produces reaching followers are forwarded or retried.
+const XDSScheme = "xds"
+
+// XDSPolicyTypeURL is the type URL of the TypedStruct an xDS cluster's
+// load_balancing_policy selects the client's policy by, see XDSScheme
+const XDSPolicyTypeURL = "type.googleapis.com/" + loadbalance.Name
+
+// Whether the address is an xDS target
+func isXDS(addr string) bool {
+	return strings.HasPrefix(addr, XDSScheme+":")
+}
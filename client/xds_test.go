@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	xdstypev3 "github.com/cncf/xds/go/xds/type/v3"
+	clusterv3 "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpointv3 "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	listenerv3 "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	routev3 "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	routerv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
+	hcmv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	discoveryv3 "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	cachev3 "github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
+	serverv3 "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/xds"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestClientXDS(t *testing.T) {
+	// a leads partition 0 and b partition 1, and a control plane names
+	// them both
+	a, b := &movedServer{}, &movedServer{}
+	lnA, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	lnB, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	leaders := map[uint32]string{0: lnA.Addr().String(), 1: lnB.Addr().String()}
+	for _, s := range []struct {
+		srv *movedServer
+		ln  net.Listener
+	}{{a, lnA}, {b, lnB}} {
+		s.srv.addr, s.srv.leaders = s.ln.Addr().String(), leaders
+		gsrv := grpc.NewServer()
+		api.RegisterLogServer(gsrv, s.srv)
+		go gsrv.Serve(s.ln)
+		t.Cleanup(gsrv.Stop)
+	}
+	c, err := New(Config{
+		Addr:        XDSScheme + ":///proglog",
+		Retry:       RetryConfig{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 10 * time.Millisecond},
+		DialOptions: []grpc.DialOption{setupControlPlane(t, "proglog", lnA, lnB)},
+	})
+	require.NoError(t, err)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	produce := func(partition uint32) string {
+		res, err := c.ProduceRecord(ctx, &api.ProduceRequest{Record: &api.Record{}, Partition: partition})
+		require.NoError(t, err)
+		return leaders[uint32(res.Offset)]
+	}
+	// produces go to the servers in turn until one names the leader,
+	// where the partition's produces go from then on
+	for _, p := range []uint32{0, 1} {
+		for i := 0; i < 2; i++ {
+			require.Equal(t, leaders[p], produce(p))
+		}
+		require.Equal(t, leaders[p], c.meta.leader("", p))
+	}
+	a.calls.Store(0)
+	b.calls.Store(0)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, leaders[1], produce(1))
+	}
+	require.Zero(t, a.calls.Load())
+	require.Equal(t, leaders[0], produce(0))
+	require.Equal(t, int64(3), b.calls.Load())
+}
+
+// Serves an xDS control plane naming the listeners' servers as the
+// service's endpoints, in a cluster selecting the client's policy, and
+// returns the option resolving xDS targets through it
+func setupControlPlane(t *testing.T, service string, lns ...net.Listener) grpc.DialOption {
+	t.Helper()
+	const node = "proglog-client"
+	router, err := anypb.New(&routerv3.Router{})
+	require.NoError(t, err)
+	manager, err := anypb.New(&hcmv3.HttpConnectionManager{
+		RouteSpecifier: &hcmv3.HttpConnectionManager_RouteConfig{
+			RouteConfig: &routev3.RouteConfiguration{
+				Name: service,
+				VirtualHosts: []*routev3.VirtualHost{{
+					Name:    service,
+					Domains: []string{service},
+					Routes: []*routev3.Route{{
+						Match: &routev3.RouteMatch{PathSpecifier: &routev3.RouteMatch_Prefix{Prefix: "/"}},
+						Action: &routev3.Route_Route{Route: &routev3.RouteAction{
+							ClusterSpecifier: &routev3.RouteAction_Cluster{Cluster: service},
+						}},
+					}},
+				}},
+			},
+		},
+		HttpFilters: []*hcmv3.HttpFilter{{
+			Name:       "router",
+			ConfigType: &hcmv3.HttpFilter_TypedConfig{TypedConfig: router},
+		}},
+	})
+	require.NoError(t, err)
+	policy, err := anypb.New(&xdstypev3.TypedStruct{
+		TypeUrl: XDSPolicyTypeURL,
+		Value:   &structpb.Struct{},
+	})
+	require.NoError(t, err)
+	var endpoints []*endpointv3.LbEndpoint
+	for _, ln := range lns {
+		addr := ln.Addr().(*net.TCPAddr)
+		endpoints = append(endpoints, &endpointv3.LbEndpoint{
+			HostIdentifier: &endpointv3.LbEndpoint_Endpoint{Endpoint: &endpointv3.Endpoint{
+				Address: &corev3.Address{Address: &corev3.Address_SocketAddress{
+					SocketAddress: &corev3.SocketAddress{
+						Address:       addr.IP.String(),
+						PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: uint32(addr.Port)},
+					},
+				}},
+			}},
+		})
+	}
+	snapshot, err := cachev3.NewSnapshot("1", map[resource.Type][]types.Resource{
+		resource.ListenerType: {&listenerv3.Listener{
+			Name:        service,
+			ApiListener: &listenerv3.ApiListener{ApiListener: manager},
+		}},
+		resource.ClusterType: {&clusterv3.Cluster{
+			Name:                 service,
+			ClusterDiscoveryType: &clusterv3.Cluster_Type{Type: clusterv3.Cluster_EDS},
+			EdsClusterConfig: &clusterv3.Cluster_EdsClusterConfig{
+				EdsConfig: &corev3.ConfigSource{
+					ConfigSourceSpecifier: &corev3.ConfigSource_Ads{Ads: &corev3.AggregatedConfigSource{}},
+				},
+			},
+			LoadBalancingPolicy: &clusterv3.LoadBalancingPolicy{
+				Policies: []*clusterv3.LoadBalancingPolicy_Policy{{
+					TypedExtensionConfig: &corev3.TypedExtensionConfig{Name: "proglog", TypedConfig: policy},
+				}},
+			},
+		}},
+		resource.EndpointType: {&endpointv3.ClusterLoadAssignment{
+			ClusterName: service,
+			Endpoints: []*endpointv3.LocalityLbEndpoints{{
+				Locality:            &corev3.Locality{Zone: "a"},
+				LoadBalancingWeight: wrapperspb.UInt32(1),
+				LbEndpoints:         endpoints,
+			}},
+		}},
+	})
+	require.NoError(t, err)
+	cache := cachev3.NewSnapshotCache(true, cachev3.IDHash{}, nil)
+	require.NoError(t, cache.SetSnapshot(context.Background(), node, snapshot))
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	gsrv := grpc.NewServer()
+	discoveryv3.RegisterAggregatedDiscoveryServiceServer(gsrv, serverv3.NewServer(context.Background(), cache, nil))
+	go gsrv.Serve(ln)
+	t.Cleanup(gsrv.Stop)
+	resolver, err := xds.NewXDSResolverWithConfigForTesting(fmt.Appendf(nil, `{
+		"xds_servers": [{
+			"server_uri": %q,
+			"channel_creds": [{"type": "insecure"}],
+			"server_features": ["xds_v3"]
+		}],
+		"node": {"id": %q}
+	}`, ln.Addr().String(), node))
+	require.NoError(t, err)
+	return grpc.WithResolvers(resolver)
+}
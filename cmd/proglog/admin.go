@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/client"
+)
+
+const adminUsage = `usage: proglog admin <command> [command flags]
+
+Commands:
+  segments        print the partition's segments and their sizes
+  members         print the partition's servers and which one leads
+  snapshot        snapshot the partition, compacting its raft log
+  delete-records  delete the records before an offset, a segment at a time
+  compaction      print how compacting a topic's partitions went, or with -now compact them
+  reencrypt       rewrite the server's sealed segments under its current encryption key
+  quotas          print the server's quotas, or set a principal's or tenant's
+  tenants         print the tenants' use of the server's storage
+  server          print the server's build, features, API versions and settings
+`
+
+var adminCommands = map[string]command{
+	"segments":       adminSegments,
+	"members":        adminMembers,
+	"snapshot":       adminSnapshot,
+	"delete-records": adminDeleteRecords,
+	"compaction":     adminCompaction,
+	"reencrypt":      adminReencrypt,
+	"quotas":         adminQuotas,
+	"tenants":        adminTenants,
+	"server":         adminServer,
+}
+
+// Runs the admin subcommand, which needs the admin permission on the servers
+func admin(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, adminUsage)
+		os.Exit(2)
+	}
+	cmd, ok := adminCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "proglog: unknown admin command %q\n", args[0])
+		fmt.Fprint(os.Stderr, adminUsage)
+		os.Exit(2)
+	}
+	return cmd(ctx, c, args[1:])
+}
+
+func adminSegments(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("segments", flag.ExitOnError)
+	topic := flags.String("topic", "", "topic to list, the default one by default")
+	partition := flags.Uint("partition", 0, "partition to list")
+	_ = flags.Parse(args)
+	segments, err := c.GetSegments(ctx, *topic, uint32(*partition))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "BASE\tNEXT\tSTORE BYTES\tINDEX BYTES")
+	for _, seg := range segments {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\n", seg.BaseOffset, seg.NextOffset, seg.StoreBytes, seg.IndexBytes)
+	}
+	return w.Flush()
+}
+
+func adminMembers(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("members", flag.ExitOnError)
+	partition := flags.Uint("partition", 0, "partition whose servers to list")
+	_ = flags.Parse(args)
+	res, err := c.GetServers(ctx, uint32(*partition))
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tRPC ADDR\tROLE\tVOTER\tIN SYNC\tLAG\tZONE\tVERSION")
+	for _, srv := range res.Servers {
+		role := "follower"
+		if srv.IsLeader {
+			role = "leader"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%t\t%d\t%s\t%s\n",
+			srv.Id, srv.RpcAddr, role, srv.Voter, srv.IsLeader || srv.InSync, srv.LagOffsets, srv.Zone, srv.Version)
+	}
+	return w.Flush()
+}
+
+func adminSnapshot(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	partition := flags.Uint("partition", 0, "partition to snapshot")
+	_ = flags.Parse(args)
+	index, err := c.Snapshot(ctx, uint32(*partition))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("snapshot at raft index %d\n", index)
+	return nil
+}
+
+func adminDeleteRecords(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("delete-records", flag.ExitOnError)
+	topic := flags.String("topic", "", "topic to delete from, the default one by default")
+	partition := flags.Uint("partition", 0, "partition to delete from")
+	before := flags.Uint64("before", 0, "offset to delete the records before")
+	yes := flags.Bool("yes", false, "delete without asking")
+	_ = flags.Parse(args)
+	if *before == 0 {
+		return errors.New("delete-records needs -before")
+	}
+	if !*yes && !confirm(fmt.Sprintf("Delete the records before offset %d from partition %d on every server?", *before, *partition)) {
+		return errors.New("not confirmed")
+	}
+	low, err := c.DeleteRecords(ctx, *topic, uint32(*partition), *before)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("lowest offset is now %d\n", low)
+	return nil
+}
+
+// Prints how compacting the topic's partitions on the server went,
+// compacting them first with -now
+func adminCompaction(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("compaction", flag.ExitOnError)
+	topic := flags.String("topic", "", "topic to compact or describe, the default one by default")
+	now := flags.Bool("now", false, "compact the partitions now, whatever their dirty ratio")
+	_ = flags.Parse(args)
+	var partitions []*api.Compaction
+	var err error
+	if *now {
+		partitions, err = c.CompactTopic(ctx, *topic)
+	} else {
+		partitions, err = c.DescribeCompaction(ctx, *topic)
+	}
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PARTITION	PROGRESS	DIRTY	MIN DIRTY	RUNS	LAST RUN	RECORDS REMOVED	BYTES RECLAIMED	TOMBSTONES REMOVED")
+	for _, p := range partitions {
+		progress := "idle"
+		if p.Running {
+			progress = fmt.Sprintf("%d/%d", p.SegmentsDone, p.Segments)
+		}
+		lastRun := "-"
+		if p.LastRun != 0 {
+			lastRun = fmt.Sprintf("%s (%.0fms)", time.Unix(0, p.LastRun).Format(time.RFC3339), p.LastDurationMs)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%.2f\t%.2f\t%d\t%s\t%d\t%d\t%d\n",
+			p.Partition, progress, p.DirtyRatio, p.MinCleanableDirtyRatio, p.Runs, lastRun,
+			p.RecordsRemoved, p.BytesReclaimed, p.TombstonesRemoved)
+	}
+	return w.Flush()
+}
+
+// Re-encrypts the server's sealed segments under its current key, so the
+// keys rotated out can be retired once every server has
+func adminReencrypt(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	_ = flags.Parse(args)
+	n, err := c.Reencrypt(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("re-encrypted %d segments\n", n)
+	return nil
+}
+
+// Sets the principal's or tenant's rates, no rates removing its quota, or
+// prints every quota without either
+func adminQuotas(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("quotas", flag.ExitOnError)
+	quota := &api.Quota{}
+	flags.StringVar(&quota.Principal, "principal", "", "principal whose quota to set, * for those without their own")
+	flags.StringVar(&quota.Tenant, "tenant", "", "tenant whose quota to set, its principals' names start with it and a slash")
+	flags.Float64Var(&quota.ProduceBytesPerSecond, "produce-bytes", 0, "bytes produced a second at most, unlimited by default")
+	flags.Float64Var(&quota.ConsumeBytesPerSecond, "consume-bytes", 0, "bytes consumed a second at most, unlimited by default")
+	flags.Float64Var(&quota.RequestsPerSecond, "requests", 0, "requests a second at most, unlimited by default")
+	_ = flags.Parse(args)
+	var quotas []*api.Quota
+	var err error
+	if quota.Principal == "" && quota.Tenant == "" {
+		quotas, err = c.DescribeQuotas(ctx)
+	} else {
+		quotas, err = c.AlterQuotas(ctx, quota)
+	}
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TENANT\tPRINCIPAL\tPRODUCE BYTES/S\tCONSUME BYTES/S\tREQUESTS/S")
+	rate := func(r float64) string {
+		if r == 0 {
+			return "-"
+		}
+		return strconv.FormatFloat(r, 'f', -1, 64)
+	}
+	for _, q := range quotas {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", cmp.Or(q.Tenant, "-"), cmp.Or(q.Principal, "-"),
+			rate(q.ProduceBytesPerSecond), rate(q.ConsumeBytesPerSecond), rate(q.RequestsPerSecond))
+	}
+	return w.Flush()
+}
+
+// Prints the tenant's stats, or every tenant's without one
+func adminTenants(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("tenants", flag.ExitOnError)
+	tenant := flags.String("tenant", "", "tenant to print, yours or every one by default")
+	_ = flags.Parse(args)
+	tenants, err := c.DescribeTenants(ctx, *tenant)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TENANT\tTOPICS\tBYTES\tMAX BYTES\tDIR")
+	for _, t := range tenants {
+		maxBytes := "-"
+		if t.MaxBytes > 0 {
+			maxBytes = strconv.FormatUint(t.MaxBytes, 10)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\n", t.Name, t.Topics, t.Bytes, maxBytes, t.Dir)
+	}
+	return w.Flush()
+}
+
+// Asks on stderr and reads the answer from stdin, anything but yes is no
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// Prints what the server runs, its settings only with -settings
+func adminServer(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("server", flag.ExitOnError)
+	settings := flags.Bool("settings", false, "print the effective settings too, secrets redacted")
+	_ = flags.Parse(args)
+	res, err := c.DescribeServer(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "VERSION\t%s\n", res.Version)
+	var on []string
+	for _, name := range slices.Sorted(maps.Keys(res.Features)) {
+		if res.Features[name] {
+			on = append(on, name)
+		}
+	}
+	fmt.Fprintf(w, "FEATURES\t%s\n", strings.Join(on, ", "))
+	for _, v := range res.ApiVersions {
+		if v.Api == "kafka" {
+			fmt.Fprintf(w, "KAFKA\t%s v%d-v%d\n", v.Name, v.MinVersion, v.MaxVersion)
+		} else {
+			fmt.Fprintf(w, "%s\t%s\n", strings.ToUpper(v.Api), v.Name)
+		}
+	}
+	if *settings {
+		fmt.Fprintln(w, "\nSETTING\tVALUE\tSOURCE")
+		for _, s := range res.Settings {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", s.Key, s.Value, s.Source)
+		}
+	}
+	return w.Flush()
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/frankie-mur/proglog/client"
+	"github.com/frankie-mur/proglog/internal/objstore"
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+// Writes a backup of a server's logs, or one topic's, see
+// client.Client.BackupTopic, to a file, stdout or an S3 bucket. A file is
+// written beside its name then renamed, so a backup that fails doesn't
+// leave one that looks whole. With -link the server backs its logs up
+// beside its data directory instead, see client.Client.LinkBackup.
+func backup(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := flags.String("out", "", "file to write, stdout by default")
+	topic := flags.String("topic", "", "topic to back up, every one by default")
+	link := flags.Bool("link", false, "have the server hard-link its sealed segments into a directory beside its data directory")
+	name := flags.String("link-name", "", "directory of the -link backup, proglog-backup-<time> by default")
+	bucket, key, s3 := s3Flags(flags, "upload to rather than write a file", "proglog-backup-<time>.tar by default")
+	_ = flags.Parse(args)
+	if *bucket != "" && *out != "" {
+		return fmt.Errorf("-out and -s3-bucket can't both be set")
+	}
+	if *link && (*bucket != "" || *out != "" || *topic != "") {
+		return fmt.Errorf("-link backs up every topic on the server, without -out or -s3-bucket")
+	}
+	start := time.Now()
+
+	switch {
+	case *link:
+		res, err := c.LinkBackup(ctx, *name)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "backed up %d files, %d bytes, to %s on the server in %s\n", res.Files, res.Bytes, res.Dir, time.Since(start).Round(time.Millisecond))
+	case *bucket != "":
+		// S3 needs the size up front, so the backup is spooled first
+		f, err := os.CreateTemp("", "proglog-backup-*.tar")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		size, err := c.BackupTopic(ctx, *topic, f)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if *key == "" {
+			*key = "proglog-backup-" + start.UTC().Format("20060102T150405Z") + ".tar"
+		}
+		if err := s3().Put(ctx, *key, f, size); err != nil {
+			return fmt.Errorf("uploading backup: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "backed up %d bytes to s3://%s/%s in %s\n", size, *bucket, *key, time.Since(start).Round(time.Millisecond))
+	case *out != "":
+		f, err := os.Create(*out + ".tmp")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+		size, err := c.BackupTopic(ctx, *topic, f)
+		if err != nil {
+			return err
+		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		// Windows won't rename an open file
+		if err := f.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(f.Name(), *out); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "backed up %d bytes to %s in %s\n", size, *out, time.Since(start).Round(time.Millisecond))
+	default:
+		size, err := c.BackupTopic(ctx, *topic, os.Stdout)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "backed up %d bytes in %s\n", size, time.Since(start).Round(time.Millisecond))
+	}
+	return nil
+}
+
+// Restores a backup proglog backup wrote into a data directory, from a
+// file, stdin or an S3 bucket, see log.Restore, or from the directory of
+// one proglog backup -link made, see log.RestoreLinked. It runs with the
+// server stopped, or before it first starts, and doesn't need one to talk
+// to.
+func restore(ctx context.Context, _ *client.Client, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	var (
+		in      = flags.String("in", "", "backup to restore, stdin by default")
+		linkDir = flags.String("link-dir", "", "directory of a proglog backup -link backup to restore rather than a tar")
+		dir     = flags.String("dir", "", "data directory to restore into, empty or missing unless -force")
+		force   = flags.Bool("force", false, "empty the data directory first when it isn't")
+	)
+	bucket, key, s3 := s3Flags(flags, "download from rather than read a file", "required with -s3-bucket")
+	_ = flags.Parse(args)
+	if *dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+	if *bucket != "" && *in != "" {
+		return fmt.Errorf("-in and -s3-bucket can't both be set")
+	}
+	if *linkDir != "" && (*bucket != "" || *in != "") {
+		return fmt.Errorf("-link-dir can't be set with -in or -s3-bucket")
+	}
+	start := time.Now()
+
+	r := io.Reader(os.Stdin)
+	switch {
+	case *bucket != "":
+		if *key == "" {
+			return fmt.Errorf("-s3-key is required with -s3-bucket")
+		}
+		rc, err := s3().Get(ctx, *key)
+		if err != nil {
+			return fmt.Errorf("downloading backup: %w", err)
+		}
+		defer rc.Close()
+		r = rc
+	case *in != "":
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	var (
+		report *log.RestoreReport
+		err    error
+	)
+	if *linkDir != "" {
+		report, err = log.RestoreLinked(*linkDir, *dir, log.RestoreOptions{Force: *force})
+	} else {
+		report, err = log.Restore(r, *dir, log.RestoreOptions{Force: *force})
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "restored %d files, %d bytes, of %d logs backed up at %s into %s in %s\n",
+		report.Files, report.Bytes, len(report.Manifest.Logs), report.Manifest.Time.Format(time.RFC3339),
+		*dir, time.Since(start).Round(time.Millisecond))
+	for _, name := range report.RebuiltIndexes {
+		fmt.Fprintf(os.Stderr, "rebuilt %s from its store\n", name)
+	}
+	return nil
+}
+
+// Adds the flags naming an S3 object, returning the bucket and key and
+// the store they're in once parsed. Credentials are AWS_*'s.
+func s3Flags(flags *flag.FlagSet, bucketUsage, keyUsage string) (bucket, key *string, store func() *objstore.S3) {
+	bucket = flags.String("s3-bucket", "", "S3 bucket to "+bucketUsage+", with AWS_* credentials")
+	key = flags.String("s3-key", "", "object in the bucket, "+keyUsage)
+	var (
+		region    = flags.String("s3-region", getenv("AWS_REGION", "us-east-1"), "the bucket's region")
+		endpoint  = flags.String("s3-endpoint", "", "S3 endpoint, the region's AWS one by default")
+		pathStyle = flags.Bool("s3-path-style", false, "put the bucket in the path rather than the host name")
+	)
+	return bucket, key, func() *objstore.S3 {
+		if *endpoint == "" {
+			*endpoint = "https://s3." + *region + ".amazonaws.com"
+		}
+		s3 := objstore.NewS3(*endpoint, *bucket, *region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+		s3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		s3.PathStyle = *pathStyle
+		return s3
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var acks = map[string]api.Ack{
+	"":       api.Ack_ACK_DEFAULT,
+	"all":    api.Ack_ACK_ALL,
+	"leader": api.Ack_ACK_LEADER,
+	"none":   api.Ack_ACK_NONE,
+}
+
+var codecs = map[string]api.Codec{
+	"":       api.Codec_CODEC_NONE,
+	"none":   api.Codec_CODEC_NONE,
+	"snappy": api.Codec_CODEC_SNAPPY,
+	"zstd":   api.Codec_CODEC_ZSTD,
+}
+
+// Appends each argument as a record, or each line of stdin without any,
+// printing the records' offsets as they're acknowledged
+func produce(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("produce", flag.ExitOnError)
+	topic := flags.String("topic", "", "topic to append to, the default one by default")
+	partition := flags.Uint("partition", 0, "partition to append to")
+	key := flags.String("key", "", "key to give the records, sending them to the partition it hashes to instead")
+	ack := flags.String("ack", "", "how far records get before they're acknowledged: all, leader or none")
+	compression := flags.String("compression", "", "compress the records with snappy or zstd")
+	_ = flags.Parse(args)
+	level, ok := acks[*ack]
+	if !ok {
+		return fmt.Errorf("unknown ack %q", *ack)
+	}
+	codec, ok := codecs[*compression]
+	if !ok {
+		return fmt.Errorf("unknown compression %q", *compression)
+	}
+
+	p := c.NewProducer(client.ProducerConfig{
+		Topic:       *topic,
+		Partition:   uint32(*partition),
+		Ack:         level,
+		Results:     true,
+		Compression: codec,
+	})
+	printed := make(chan error)
+	go func() {
+		var err error
+		for res := range p.Results() {
+			switch {
+			case err != nil:
+			case res.Err != nil:
+				err = res.Err
+			case res.Pending:
+				fmt.Println("pending")
+			default:
+				fmt.Println(res.Offset)
+			}
+		}
+		printed <- err
+	}()
+
+	send := func(value []byte) error {
+		record := &api.Record{Value: value}
+		if *key != "" {
+			record.Key = []byte(*key)
+		}
+		return p.Send(ctx, record, nil)
+	}
+	var err error
+	if flags.NArg() > 0 {
+		for _, arg := range flags.Args() {
+			if err = send([]byte(arg)); err != nil {
+				break
+			}
+		}
+	} else {
+		scanner := bufio.NewScanner(os.Stdin)
+		// records up to the servers' default 4 MiB message size
+		scanner.Buffer(nil, 4<<20)
+		for scanner.Scan() {
+			if err = send(append([]byte(nil), scanner.Bytes()...)); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = scanner.Err()
+		}
+	}
+	closeErr := p.Close(ctx)
+	return errors.Join(err, closeErr, <-printed)
+}
+
+// Prints the records from an offset, or the first appended at or after a
+// time, up to the end of the partition as it was when the command started
+func consume(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("consume", flag.ExitOnError)
+	var (
+		topic     = flags.String("topic", "", "topic to read, the default one by default")
+		partition = flags.Uint("partition", 0, "partition to read")
+		offset    = flags.Int64("offset", -1, "offset to start from, the partition's lowest by default")
+		count     = flags.Uint64("n", 0, "most records to print, all of them by default")
+	)
+	from := timeFlags(flags)
+	out := outputFlags(flags)
+	_ = flags.Parse(args)
+	show, err := out.printer()
+	if err != nil {
+		return err
+	}
+
+	p := uint32(*partition)
+	offs, err := c.GetOffsets(ctx, *topic, p)
+	if err != nil {
+		return err
+	}
+	start, end := offs.LowWatermark, offs.HighWatermark
+	if *offset >= 0 {
+		start = uint64(*offset)
+	} else if t, ok, err := from.time(); err != nil {
+		return err
+	} else if ok {
+		if start, err = c.OffsetForTime(ctx, *topic, p, t); err != nil {
+			return err
+		}
+	}
+	if *count > 0 && start+*count < end {
+		end = start + *count
+	}
+	if start >= end {
+		return nil
+	}
+	return stream(ctx, c, *topic, p, start, end, show)
+}
+
+// Prints the partition's last records, or those since a time, and with
+// -follow the records appended after them until interrupted
+func tail(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("tail", flag.ExitOnError)
+	var (
+		topic     = flags.String("topic", "", "topic to read, the default one by default")
+		partition = flags.Uint("partition", 0, "partition to read")
+		count     = flags.Uint64("n", 10, "how many of the last records to print, unless -since or -time is set")
+		follow    = flags.Bool("follow", false, "keep printing records as they're appended")
+	)
+	flags.BoolVar(follow, "f", false, "shorthand for -follow")
+	from := timeFlags(flags)
+	out := outputFlags(flags)
+	_ = flags.Parse(args)
+	show, err := out.printer()
+	if err != nil {
+		return err
+	}
+
+	p := uint32(*partition)
+	offs, err := c.GetOffsets(ctx, *topic, p)
+	if err != nil {
+		return err
+	}
+	start, end := offs.LowWatermark, offs.HighWatermark
+	if t, ok, err := from.time(); err != nil {
+		return err
+	} else if ok {
+		if start, err = c.OffsetForTime(ctx, *topic, p, t); err != nil {
+			return err
+		}
+	} else if end-start > *count {
+		start = end - *count
+	}
+	if *follow {
+		return stream(ctx, c, *topic, p, start, 0, show)
+	}
+	if start >= end {
+		return nil
+	}
+	return stream(ctx, c, *topic, p, start, end, show)
+}
+
+// Streams the records from start up to end, or on as they're appended
+// when end is 0
+func stream(ctx context.Context, c *client.Client, topic string, p uint32, start, end uint64, show func(*api.Record) error) error {
+	done := errors.New("done")
+	req := &api.ConsumeRequest{Offset: start, Topic: topic, Partition: p}
+	err := c.ConsumeStream(ctx, req, func(record *api.Record) error {
+		if err := show(record); err != nil {
+			return err
+		}
+		if end != 0 && record.Offset+1 >= end {
+			return done
+		}
+		return nil
+	})
+	if err == done {
+		return nil
+	}
+	return err
+}
+
+// Prints the range of offsets each partition holds, and with -consumer the
+// offset it committed and how many records it has left to read
+func offsets(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("offsets", flag.ExitOnError)
+	topic := flags.String("topic", "", "topic to print, the default one by default")
+	partition := flags.Int("partition", -1, "partition to print, all of them by default")
+	consumer := flags.String("consumer", "", "consumer whose committed offsets to print")
+	_ = flags.Parse(args)
+	partitions, err := partitionList(ctx, c, *partition)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	header := "PARTITION\tLOW\tHIGH"
+	if *consumer != "" {
+		header += "\tCOMMITTED\tLAG"
+	}
+	fmt.Fprintln(w, header)
+	for _, p := range partitions {
+		offs, err := c.GetOffsets(ctx, *topic, p)
+		if err != nil {
+			return err
+		}
+		line := fmt.Sprintf("%d\t%d\t%d", p, offs.LowWatermark, offs.HighWatermark)
+		if *consumer != "" {
+			off, found, err := c.FetchOffset(ctx, *consumer, *topic, p)
+			if err != nil {
+				return err
+			}
+			if found {
+				line += fmt.Sprintf("\t%d\t%d", off, offs.HighWatermark-min(off, offs.HighWatermark))
+			} else {
+				line += "\t-\t-"
+			}
+		}
+		fmt.Fprintln(w, line)
+	}
+	return w.Flush()
+}
+
+// Prints how far each group, or just -group, is behind in the partitions
+// it committed offsets to
+func lag(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("lag", flag.ExitOnError)
+	group := flags.String("group", "", "group to print, all of them by default")
+	_ = flags.Parse(args)
+	lags, err := c.GetGroupLag(ctx, *group)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tTOPIC\tPARTITION\tCOMMITTED\tHIGH\tLAG")
+	for _, l := range lags {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\n", l.Group, l.Topic, l.Partition, l.Committed, l.HighWatermark, l.Lag)
+	}
+	return w.Flush()
+}
+
+// Prints the rates and p99 latencies of the produces and consumes the
+// server the call goes to served each partition at, of -topic or every
+// topic
+func throughput(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("throughput", flag.ExitOnError)
+	topic := flags.String("topic", "", "topic to print, all of them by default")
+	_ = flags.Parse(args)
+	res, err := c.GetThroughput(ctx, *topic)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("over the last %ds\n", res.WindowSeconds)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "TOPIC\tPARTITION\tPRODUCE REC/S\tPRODUCE B/S\tPRODUCE P99\tCONSUME REC/S\tCONSUME B/S\tCONSUME P99")
+	for _, p := range res.Partitions {
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%.0f\t%.1fms\t%.1f\t%.0f\t%.1fms\n", p.Topic, p.Partition,
+			p.ProduceRecordsPerSecond, p.ProduceBytesPerSecond, p.ProduceP99Ms,
+			p.ConsumeRecordsPerSecond, p.ConsumeBytesPerSecond, p.ConsumeP99Ms)
+	}
+	return w.Flush()
+}
+
+// Runs the query given as the arguments over a range of the partition's
+// records, printing its rows as a table
+func queryCmd(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	var (
+		topic     = flags.String("topic", "", "topic to query, the default one by default")
+		partition = flags.Uint("partition", 0, "partition to query")
+		offset    = flags.Uint64("offset", 0, "offset to start from, the partition's lowest by default")
+		end       = flags.Uint64("end", 0, "offset to stop before, the partition's high watermark by default")
+		until     = flags.String("until", "", "stop before the first record appended at this RFC 3339 time")
+	)
+	from := timeFlags(flags)
+	_ = flags.Parse(args)
+	if flags.NArg() == 0 {
+		return errors.New("usage: proglog query [flags] SELECT <columns> [WHERE <predicate>] [GROUP BY <field>] [LIMIT <n>]")
+	}
+	req := &api.QueryRequest{
+		Topic:      *topic,
+		Partition:  uint32(*partition),
+		Query:      strings.Join(flags.Args(), " "),
+		FromOffset: *offset,
+		ToOffset:   *end,
+	}
+	if t, ok, err := from.time(); err != nil {
+		return err
+	} else if ok {
+		req.Since = t.UnixNano()
+	}
+	if *until != "" {
+		t, err := time.Parse(time.RFC3339, *until)
+		if err != nil {
+			return err
+		}
+		req.Until = t.UnixNano()
+	}
+	res, err := c.Query(ctx, req)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, strings.ToUpper(strings.Join(res.Columns, "\t")))
+	for _, row := range res.Rows {
+		fmt.Fprintln(w, strings.Join(row.Values, "\t"))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if res.Truncated {
+		fmt.Fprintf(os.Stderr, "scanned %d records, stopping before offset %d\n", res.Scanned, res.NextOffset)
+	}
+	return nil
+}
+
+// Lists the topics, or with create, describe, alter, add-partitions or
+// delete and a name creates, describes, alters the configs of, adds
+// partitions to or deletes the topic
+func topics(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("topics", flag.ExitOnError)
+	partitions := flags.Uint("partitions", 1, "how many partitions a created topic has, or a topic has once add-partitions adds to it")
+	configs := make(map[string]string)
+	flags.Func("config", "a created or altered topic's config override as name=value, an empty value removes it, repeatable", func(s string) error {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok {
+			return fmt.Errorf("config %q isn't name=value", s)
+		}
+		configs[name] = value
+		return nil
+	})
+	yes := flags.Bool("yes", false, "delete without asking")
+	_ = flags.Parse(args)
+	switch flags.Arg(0) {
+	case "":
+		names, err := c.ListTopics(ctx)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return nil
+	case "create", "describe", "alter", "add-partitions", "delete":
+	default:
+		return fmt.Errorf("unknown topics command %q, want create, describe, alter, add-partitions or delete", flags.Arg(0))
+	}
+	if flags.NArg() != 2 {
+		return fmt.Errorf("topics %s needs a topic name", flags.Arg(0))
+	}
+	name := flags.Arg(1)
+	switch flags.Arg(0) {
+	case "create":
+		return c.CreateTopic(ctx, &api.Topic{Name: name, Partitions: uint32(*partitions), Configs: configs})
+	case "describe", "alter", "add-partitions":
+		var topic *api.Topic
+		var err error
+		switch flags.Arg(0) {
+		case "alter":
+			topic, err = c.AlterTopicConfigs(ctx, name, configs)
+		case "add-partitions":
+			topic, err = c.CreatePartitions(ctx, name, uint32(*partitions))
+		default:
+			topic, err = c.DescribeTopic(ctx, name)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("name\t%s\npartitions\t%d\nversion\t%d\n", topic.Name, topic.Partitions, topic.Version)
+		for _, key := range slices.Sorted(maps.Keys(topic.Configs)) {
+			fmt.Printf("%s\t%s\n", key, topic.Configs[key])
+		}
+		return nil
+	}
+	if !*yes && !confirm(fmt.Sprintf("Delete topic %s and its records?", name)) {
+		return errors.New("not confirmed")
+	}
+	return c.DeleteTopic(ctx, name)
+}
+
+// Prints each partition's servers
+func partitionsCmd(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("partitions", flag.ExitOnError)
+	_ = flags.Parse(args)
+	partitions, err := partitionList(ctx, c, -1)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "PARTITION\tLEADER\tREPLICAS\tIN SYNC")
+	for _, p := range partitions {
+		res, err := c.GetServers(ctx, p)
+		if status.Code(err) == codes.Unimplemented {
+			fmt.Fprintf(w, "%d\t-\t-\t-\n", p)
+			continue
+		} else if err != nil {
+			return err
+		}
+		var leader string
+		var replicas, inSync []string
+		for _, srv := range res.Servers {
+			replicas = append(replicas, srv.Id)
+			if srv.IsLeader {
+				leader = srv.Id
+			}
+			// the leader reports the others
+			if srv.IsLeader || srv.InSync {
+				inSync = append(inSync, srv.Id)
+			}
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", p, leader, strings.Join(replicas, ","), strings.Join(inSync, ","))
+	}
+	return w.Flush()
+}
+
+// The partition, or all of them when it's negative. A server that isn't
+// clustered only has partition 0.
+func partitionList(ctx context.Context, c *client.Client, partition int) ([]uint32, error) {
+	if partition >= 0 {
+		return []uint32{uint32(partition)}, nil
+	}
+	res, err := c.GetServers(ctx, 0)
+	if status.Code(err) == codes.Unimplemented {
+		return []uint32{0}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	partitions := make([]uint32, max(res.Partitions, 1))
+	for i := range partitions {
+		partitions[i] = uint32(i)
+	}
+	return partitions, nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/frankie-mur/proglog/client"
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+// inspectRecord is a record as -format json prints it
+type inspectRecord struct {
+	Position uint64 `json:"position"`
+	Size     uint64 `json:"size"`
+	Status   string `json:"status"`
+	// the record, when it reads, with its offset. The offset of one that
+	// doesn't is its index entry's.
+	jsonRecord
+	Key       *string `json:"key,omitempty"`
+	KeyBase64 string  `json:"key_base64,omitempty"`
+}
+
+// Prints a segment's files and records, see log.InspectSegment. It reads
+// the files directly, and doesn't need a server.
+func inspect(ctx context.Context, _ *client.Client, args []string) error {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: proglog inspect [flags] <segment>, its .store or .index file")
+		flags.PrintDefaults()
+	}
+	var (
+		from   = flags.Int64("from", -1, "only records from this offset on")
+		to     = flags.Int64("to", -1, "only records before this offset")
+		key    = flags.String("key", "", "only records with this key")
+		status = flags.String("status", "", "only records with these comma separated statuses: ok, unindexed, misindexed, sealed or corrupt")
+		limit  = flags.Int("limit", 0, "print at most this many records, all of them by default")
+		format = flags.String("format", "text", "output format: text, json, or hex to dump each record's stored bytes")
+		values = flags.Bool("values", false, "print values too with -format text")
+	)
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	var statuses []string
+	if *status != "" {
+		statuses = strings.Split(*status, ",")
+	}
+	match := func(sr log.SegmentRecord) bool {
+		switch {
+		case *from >= 0 && sr.Offset < uint64(*from),
+			*to >= 0 && sr.Offset >= uint64(*to),
+			*key != "" && (sr.Record == nil || string(sr.Record.Key) != *key),
+			statuses != nil && !slices.Contains(statuses, sr.Status):
+			return false
+		}
+		return true
+	}
+
+	var print func(log.SegmentRecord) error
+	var records []inspectRecord
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	switch *format {
+	case "text":
+		header := "OFFSET\tPOSITION\tTIMESTAMP\tSIZE\tKEY\tSTATUS"
+		if *values {
+			header += "\tVALUE"
+		}
+		fmt.Fprintln(w, header)
+		print = func(sr log.SegmentRecord) error {
+			timestamp, key := "-", "-"
+			if sr.Record != nil {
+				timestamp = time.Unix(0, sr.Record.Timestamp).UTC().Format(time.RFC3339Nano)
+				if sr.Record.Key != nil {
+					key = fmt.Sprintf("%q", sr.Record.Key)
+				}
+			}
+			line := fmt.Sprintf("%d\t%d\t%s\t%d\t%s\t%s", sr.Offset, sr.Position, timestamp, sr.Size, key, sr.Status)
+			if *values && sr.Record != nil {
+				line += fmt.Sprintf("\t%q", sr.Record.Value)
+			}
+			_, err := fmt.Fprintln(w, line)
+			return err
+		}
+	case "json":
+		print = func(sr log.SegmentRecord) error {
+			r := inspectRecord{Position: sr.Position, Size: sr.Size, Status: sr.Status}
+			r.Offset = sr.Offset
+			if sr.Record != nil {
+				r.jsonRecord = newJSONRecord(sr.Record)
+				if sr.Record.Key != nil {
+					r.Key, r.KeyBase64 = textOrBase64(sr.Record.Key)
+				}
+			}
+			records = append(records, r)
+			return nil
+		}
+	case "hex":
+		print = func(sr log.SegmentRecord) error {
+			_, err := fmt.Printf("offset %d at %d, %d bytes, %s\n%s", sr.Offset, sr.Position, sr.Size, sr.Status, hex.Dump(sr.Stored))
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	printed := 0
+	info, err := log.InspectSegment(flags.Arg(0), nil, func(sr log.SegmentRecord) error {
+		if !match(sr) {
+			return nil
+		}
+		// the rest are still read, for the segment's totals
+		if *limit > 0 && printed == *limit {
+			return nil
+		}
+		printed++
+		return print(sr)
+	})
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(struct {
+			Segment *log.SegmentInfo `json:"segment"`
+			Records []inspectRecord  `json:"records"`
+		}{info, records})
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	// what's said of the whole segment goes after the records, it's only
+	// known once they're read, and to stderr so the records can be piped
+	fmt.Fprintf(os.Stderr, "segment %d: next offset %d, store %d bytes, index %d bytes with %d entries, %d records",
+		info.BaseOffset, info.NextOffset, info.StoreBytes, info.IndexBytes, info.IndexEntries, info.Records)
+	for _, s := range []string{log.RecordUnindexed, log.RecordMisindexed, log.RecordSealed, log.RecordCorrupt} {
+		if n := info.Statuses[s]; n > 0 {
+			fmt.Fprintf(os.Stderr, ", %d %s", n, s)
+		}
+	}
+	if info.TornBytes > 0 {
+		fmt.Fprintf(os.Stderr, ", %d torn bytes at the end", info.TornBytes)
+	}
+	fmt.Fprintln(os.Stderr)
+	return nil
+}
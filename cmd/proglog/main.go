@@ -0,0 +1,133 @@
+// Command proglog produces to and consumes from a proglog cluster over its
+// gRPC API, for poking at a cluster without writing a client.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/frankie-mur/proglog/client"
+)
+
+const usage = `usage: proglog [flags] <command> [command flags]
+
+Commands:
+  produce      append the arguments, or stdin's lines, as records
+  consume      print records from an offset or time to the end of the partition
+  query        run a SQL-like query, SELECT ... WHERE ..., over a partition's JSON records
+  tail         print the partition's last records, and with -follow new ones
+  offsets      print the partitions' offsets and a consumer's committed ones
+  export       write a topic's records to a file as JSON lines or length-prefixed frames
+  import       append the records proglog export wrote to a topic
+  backup       write a tar of a server's logs, or a topic's, consistent as of the call, to a file or S3,
+               or with -link hard-link them into a directory beside the server's data directory
+  restore      unpack and check a backup in a stopped server's data directory
+  verify       check a stopped server's data directory, and with -repair fix what it can
+  inspect      print a segment's files and decode its records
+  migrate      upgrade a stopped server's data directory to a newer format version
+  lag          print how far consumer groups are behind in each partition
+  throughput   print the rates and p99 latencies a server served each partition at
+  topics       list the topics, or create, describe, alter, add partitions to or delete one
+  partitions   print the partitions and the servers replicating them
+  admin        inspect and administer the log, see proglog admin
+
+Flags:
+`
+
+// command runs a subcommand with the arguments after its name
+type command func(ctx context.Context, c *client.Client, args []string) error
+
+var commands = map[string]command{
+	"produce":    produce,
+	"consume":    consume,
+	"query":      queryCmd,
+	"tail":       tail,
+	"offsets":    offsets,
+	"export":     exportCmd,
+	"import":     importCmd,
+	"backup":     backup,
+	"restore":    restore,
+	"verify":     verify,
+	"inspect":    inspect,
+	"migrate":    migrate,
+	"lag":        lag,
+	"throughput": throughput,
+	"topics":     topics,
+	"partitions": partitionsCmd,
+	"admin":      admin,
+}
+
+func main() {
+	flags := flag.NewFlagSet("proglog", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	var (
+		addr       = flags.String("addr", getenv("PROGLOG_ADDR", "localhost:8400"), "RPC address of any of the cluster's servers")
+		useTLS     = flags.Bool("tls", false, "dial the servers over TLS")
+		caFile     = flags.String("ca-file", "", "CA certificate to verify the servers with, implies -tls")
+		certFile   = flags.String("cert-file", "", "client certificate, implies -tls")
+		keyFile    = flags.String("key-file", "", "client certificate's key")
+		serverName = flags.String("server-name", "", "name to verify the servers' certificates against, implies -tls")
+		skipVerify = flags.Bool("insecure-skip-verify", false, "accept any server certificate, for testing only, implies -tls")
+		apiKey     = flags.String("api-key", os.Getenv("PROGLOG_API_KEY"), "API key to authenticate with")
+		token      = flags.String("token", os.Getenv("PROGLOG_TOKEN"), "bearer token to authenticate with")
+		adminAddr  = flags.String("admin-addr", os.Getenv("PROGLOG_ADMIN_ADDR"), "admin address of the server to administer, for servers serving admin calls off their RPC address")
+		adminKey   = flags.String("admin-api-key", os.Getenv("PROGLOG_ADMIN_API_KEY"), "API key to authenticate admin calls with, -api-key's when empty")
+	)
+	_ = flags.Parse(os.Args[1:])
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "proglog: unknown command %q\n", flags.Arg(0))
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config := client.Config{Addr: *addr, APIKey: *apiKey, Token: *token, AdminAddr: *adminAddr, AdminAPIKey: *adminKey}
+	if *useTLS || *caFile != "" || *certFile != "" || *serverName != "" || *skipVerify {
+		config.TLS = &client.TLSFiles{
+			CAFile:             *caFile,
+			CertFile:           *certFile,
+			KeyFile:            *keyFile,
+			ServerName:         *serverName,
+			InsecureSkipVerify: *skipVerify,
+		}
+		if *skipVerify {
+			fmt.Fprintln(os.Stderr, "proglog: warning: not verifying the servers' certificates")
+		}
+	}
+	c, err := client.New(config)
+	if err != nil {
+		fatal(err)
+	}
+	defer c.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := cmd(ctx, c, flags.Args()[1:]); err != nil && !errors.Is(err, context.Canceled) {
+		c.Close()
+		fatal(err)
+	}
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "proglog:", err)
+	os.Exit(1)
+}
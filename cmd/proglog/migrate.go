@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/frankie-mur/proglog/client"
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+// Upgrades a stopped server's data directory to a newer format version,
+// see log.Migrate, or lists the versions this build knows
+func migrate(ctx context.Context, _ *client.Client, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	var (
+		dir  = flags.String("dir", "", "data directory to migrate")
+		out  = flags.String("out", "", "empty directory to migrate a copy into, leaving -dir as it is")
+		to   = flags.Int("to", log.FormatVersion, "format version to migrate to")
+		list = flags.Bool("list", false, "list the format versions this build knows and exit")
+	)
+	_ = flags.Parse(args)
+	if *list {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tOPENS\tDESCRIPTION")
+		for _, f := range log.Formats() {
+			opens := "no, migrate it"
+			if f.Open {
+				opens = "yes"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", f.Version, opens, f.Description)
+		}
+		return w.Flush()
+	}
+	if *dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+	migrated, err := log.Migrate(*dir, log.MigrateOptions{To: *to, Out: *out})
+	if err != nil {
+		return err
+	}
+	upgraded := 0
+	for _, m := range migrated {
+		if m.From == m.To {
+			continue
+		}
+		upgraded++
+		fmt.Printf("%s: format version %d to %d\n", m.Dir, m.From, m.To)
+	}
+	fmt.Printf("migrated %d of %d logs to format version %d\n", upgraded, len(migrated), *to)
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+// fromFlags pick where reading starts by time
+type fromFlags struct {
+	since *time.Duration
+	at    *string
+}
+
+func timeFlags(flags *flag.FlagSet) fromFlags {
+	return fromFlags{
+		since: flags.Duration("since", 0, "start from the first record appended this long ago"),
+		at:    flags.String("time", "", "start from the first record appended at this RFC 3339 time"),
+	}
+}
+
+// The time reading starts from, ok is false when neither flag is set
+func (f fromFlags) time() (t time.Time, ok bool, err error) {
+	if *f.at != "" {
+		t, err = time.Parse(time.RFC3339, *f.at)
+		return t, err == nil, err
+	}
+	if *f.since != 0 {
+		return time.Now().Add(-*f.since), true, nil
+	}
+	return time.Time{}, false, nil
+}
+
+// printFlags pick how records are printed
+type printFlags struct {
+	format   *string
+	template *string
+}
+
+func outputFlags(flags *flag.FlagSet) printFlags {
+	return printFlags{
+		format: flags.String("format", "raw", "output format: raw prints values a line each, json records as objects"),
+		template: flags.String("template", "", "Go template printing each record, e.g. '{{.Offset}} {{.Value}}', "+
+			"given .Offset, .Timestamp and .Value and a json function"),
+	}
+}
+
+func (f printFlags) printer() (func(*api.Record) error, error) {
+	if *f.template != "" {
+		tmpl, err := template.New("record").
+			Funcs(template.FuncMap{"json": toJSON}).
+			Parse(*f.template + "\n")
+		if err != nil {
+			return nil, err
+		}
+		return func(record *api.Record) error {
+			return tmpl.Execute(os.Stdout, templateRecord{
+				Offset:    record.Offset,
+				Timestamp: time.Unix(0, record.Timestamp),
+				Value:     string(record.Value),
+			})
+		}, nil
+	}
+	switch *f.format {
+	case "raw":
+		return printRaw, nil
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		return func(record *api.Record) error { return enc.Encode(newJSONRecord(record)) }, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", *f.format)
+}
+
+func printRaw(record *api.Record) error {
+	_, err := fmt.Printf("%s\n", record.Value)
+	return err
+}
+
+// templateRecord is a record as -template sees it
+type templateRecord struct {
+	Offset    uint64
+	Timestamp time.Time
+	Value     string
+}
+
+// jsonRecord is a record as -format json prints it, the value as a string
+// when it's UTF-8 and base64 encoded otherwise
+type jsonRecord struct {
+	Offset      uint64    `json:"offset"`
+	Timestamp   time.Time `json:"timestamp"`
+	Value       *string   `json:"value,omitempty"`
+	ValueBase64 string    `json:"value_base64,omitempty"`
+}
+
+func newJSONRecord(record *api.Record) jsonRecord {
+	r := jsonRecord{Offset: record.Offset, Timestamp: time.Unix(0, record.Timestamp).UTC()}
+	if utf8.Valid(record.Value) {
+		v := string(record.Value)
+		r.Value = &v
+	} else {
+		r.ValueBase64 = base64.StdEncoding.EncodeToString(record.Value)
+	}
+	return r
+}
+
+func toJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	return string(b), err
+}
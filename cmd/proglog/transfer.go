@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/client"
+	"google.golang.org/protobuf/proto"
+)
+
+// How many records are exported or imported between checkpoints
+const checkpointEvery = 1000
+
+// Frames of the binary format are at most this big
+const maxFrame = 64 << 20
+
+// dumpRecord is a record as the jsonl format writes it, with the
+// partition it was read from. Keys and values are strings when they're
+// UTF-8 and base64 encoded otherwise.
+type dumpRecord struct {
+	Partition   uint32       `json:"partition"`
+	Offset      uint64       `json:"offset"`
+	Timestamp   time.Time    `json:"timestamp"`
+	Key         *string      `json:"key,omitempty"`
+	KeyBase64   string       `json:"key_base64,omitempty"`
+	Value       *string      `json:"value,omitempty"`
+	ValueBase64 string       `json:"value_base64,omitempty"`
+	Headers     []dumpHeader `json:"headers,omitempty"`
+}
+
+type dumpHeader struct {
+	Key         string  `json:"key"`
+	Value       *string `json:"value,omitempty"`
+	ValueBase64 string  `json:"value_base64,omitempty"`
+}
+
+func newDumpRecord(partition uint32, record *api.Record) dumpRecord {
+	r := dumpRecord{Partition: partition, Offset: record.Offset, Timestamp: time.Unix(0, record.Timestamp).UTC()}
+	if record.Key != nil {
+		r.Key, r.KeyBase64 = textOrBase64(record.Key)
+	}
+	r.Value, r.ValueBase64 = textOrBase64(record.Value)
+	for _, h := range record.Headers {
+		dh := dumpHeader{Key: h.Key}
+		dh.Value, dh.ValueBase64 = textOrBase64(h.Value)
+		r.Headers = append(r.Headers, dh)
+	}
+	return r
+}
+
+func (r dumpRecord) record() (*api.Record, error) {
+	record := &api.Record{Timestamp: r.Timestamp.UnixNano()}
+	var err error
+	if record.Key, err = fromTextOrBase64(r.Key, r.KeyBase64); err != nil {
+		return nil, fmt.Errorf("key: %w", err)
+	}
+	if record.Value, err = fromTextOrBase64(r.Value, r.ValueBase64); err != nil {
+		return nil, fmt.Errorf("value: %w", err)
+	}
+	for _, dh := range r.Headers {
+		h := &api.Header{Key: dh.Key}
+		if h.Value, err = fromTextOrBase64(dh.Value, dh.ValueBase64); err != nil {
+			return nil, fmt.Errorf("header %s: %w", dh.Key, err)
+		}
+		record.Headers = append(record.Headers, h)
+	}
+	return record, nil
+}
+
+func textOrBase64(b []byte) (*string, string) {
+	if utf8.Valid(b) {
+		s := string(b)
+		return &s, ""
+	}
+	return nil, base64.StdEncoding.EncodeToString(b)
+}
+
+func fromTextOrBase64(s *string, b64 string) ([]byte, error) {
+	if s != nil {
+		return []byte(*s), nil
+	}
+	if b64 == "" {
+		return nil, nil
+	}
+	return base64.StdEncoding.DecodeString(b64)
+}
+
+// dumpWriter writes records in a format: jsonl, a JSON object a line, or
+// binary, each record framed as a 4 byte big-endian length and a
+// ProduceRequest holding it and its partition
+type dumpWriter struct {
+	w      *bufio.Writer
+	binary bool
+}
+
+func newDumpWriter(w io.Writer, format string) (*dumpWriter, error) {
+	switch format {
+	case "jsonl", "binary":
+		return &dumpWriter{w: bufio.NewWriter(w), binary: format == "binary"}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, want jsonl or binary", format)
+}
+
+func (d *dumpWriter) write(partition uint32, record *api.Record) error {
+	if !d.binary {
+		b, err := json.Marshal(newDumpRecord(partition, record))
+		if err != nil {
+			return err
+		}
+		d.w.Write(b)
+		return d.w.WriteByte('\n')
+	}
+	b, err := proto.Marshal(&api.ProduceRequest{Partition: partition, Record: record})
+	if err != nil {
+		return err
+	}
+	d.w.Write(binary.BigEndian.AppendUint32(nil, uint32(len(b))))
+	_, err = d.w.Write(b)
+	return err
+}
+
+// dumpReader reads the records a dumpWriter wrote
+type dumpReader struct {
+	r      *bufio.Reader
+	binary bool
+}
+
+func newDumpReader(r io.Reader, format string) (*dumpReader, error) {
+	switch format {
+	case "jsonl", "binary":
+		return &dumpReader{r: bufio.NewReader(r), binary: format == "binary"}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q, want jsonl or binary", format)
+}
+
+// Reads the next record and its partition, io.EOF once there are none
+func (d *dumpReader) read() (uint32, *api.Record, error) {
+	if d.binary {
+		var n [4]byte
+		if _, err := io.ReadFull(d.r, n[:]); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return 0, nil, errors.New("truncated frame")
+			}
+			return 0, nil, err
+		}
+		size := binary.BigEndian.Uint32(n[:])
+		if size > maxFrame {
+			return 0, nil, fmt.Errorf("frame of %d bytes", size)
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(d.r, b); err != nil {
+			return 0, nil, errors.New("truncated frame")
+		}
+		req := &api.ProduceRequest{}
+		if err := proto.Unmarshal(b, req); err != nil {
+			return 0, nil, err
+		}
+		if req.Record == nil {
+			return 0, nil, errors.New("frame without a record")
+		}
+		// the offset and the rest are the log's to set
+		r := req.Record
+		return req.Partition, &api.Record{Value: r.Value, Timestamp: r.Timestamp, Key: r.Key, Headers: r.Headers}, nil
+	}
+	for {
+		line, err := d.r.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			return 0, nil, err
+		}
+		if len(line) == 0 || len(line) == 1 && line[0] == '\n' {
+			continue
+		}
+		var r dumpRecord
+		if err := json.Unmarshal(line, &r); err != nil {
+			return 0, nil, err
+		}
+		record, err := r.record()
+		return r.Partition, record, err
+	}
+}
+
+// exportCheckpoint is where an export resumes: each partition's next
+// offset and how long the output was when they were written
+type exportCheckpoint struct {
+	Topic   string            `json:"topic"`
+	Offsets map[uint32]uint64 `json:"offsets"`
+	Size    int64             `json:"size"`
+}
+
+// importCheckpoint is how many of the input's records were appended
+type importCheckpoint struct {
+	Records uint64 `json:"records"`
+}
+
+// Reads the checkpoint at path into v, reporting whether there was one
+func readCheckpoint(path string, v any) (bool, error) {
+	if path == "" {
+		return false, nil
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("checkpoint %s: %w", path, err)
+	}
+	return true, nil
+}
+
+func writeCheckpoint(path string, v any) error {
+	if path == "" {
+		return nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Writes the topic's records, from an offset or time up to another or the
+// end of each partition as it was when the command started, to -out or
+// stdout. With -checkpoint it picks up where a run that stopped left off.
+func exportCmd(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	var (
+		topic      = flags.String("topic", "", "topic to export, the default one by default")
+		partition  = flags.Int("partition", -1, "partition to export, all of them by default")
+		offset     = flags.Int64("offset", -1, "offset to start each partition from, the lowest by default")
+		endOffset  = flags.Int64("end", -1, "offset to stop each partition before, the end by default")
+		until      = flags.String("until", "", "stop before the first record appended at this RFC 3339 time")
+		format     = flags.String("format", "jsonl", "output format: jsonl or binary, see proglog import")
+		out        = flags.String("out", "", "file to write, stdout by default")
+		checkpoint = flags.String("checkpoint", "", "file keeping how far the export got, to resume it from")
+	)
+	from := timeFlags(flags)
+	_ = flags.Parse(args)
+	var untilTime time.Time
+	if *until != "" {
+		var err error
+		if untilTime, err = time.Parse(time.RFC3339, *until); err != nil {
+			return err
+		}
+	}
+
+	cp := exportCheckpoint{Topic: *topic, Offsets: make(map[uint32]uint64)}
+	resumed, err := readCheckpoint(*checkpoint, &cp)
+	if err != nil {
+		return err
+	}
+	if resumed && cp.Topic != *topic {
+		return fmt.Errorf("checkpoint %s is of topic %q", *checkpoint, cp.Topic)
+	}
+	w := io.Writer(os.Stdout)
+	var f *os.File
+	if *out != "" {
+		if f, err = os.OpenFile(*out, os.O_WRONLY|os.O_CREATE, 0644); err != nil {
+			return err
+		}
+		defer f.Close()
+		// what was written after the checkpoint is written again
+		if err := f.Truncate(cp.Size); err != nil {
+			return err
+		}
+		if _, err := f.Seek(cp.Size, io.SeekStart); err != nil {
+			return err
+		}
+		w = f
+	}
+	dw, err := newDumpWriter(w, *format)
+	if err != nil {
+		return err
+	}
+	save := func() error {
+		if err := dw.w.Flush(); err != nil {
+			return err
+		}
+		if f != nil {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+			if cp.Size, err = f.Seek(0, io.SeekCurrent); err != nil {
+				return err
+			}
+		}
+		return writeCheckpoint(*checkpoint, cp)
+	}
+
+	partitions := []uint32{uint32(*partition)}
+	if *partition < 0 {
+		t, err := c.DescribeTopic(ctx, *topic)
+		if err != nil {
+			return err
+		}
+		partitions = partitions[:0]
+		for p := range max(t.Partitions, 1) {
+			partitions = append(partitions, p)
+		}
+	}
+	for _, p := range partitions {
+		start, end, err := exportRange(ctx, c, *topic, p, *offset, *endOffset, from, untilTime)
+		if err != nil {
+			return err
+		}
+		if next, ok := cp.Offsets[p]; ok {
+			start = next
+		}
+		if start >= end {
+			continue
+		}
+		var n int
+		err = stream(ctx, c, *topic, p, start, end, func(record *api.Record) error {
+			if err := dw.write(p, record); err != nil {
+				return err
+			}
+			cp.Offsets[p] = record.Offset + 1
+			if n++; n%checkpointEvery == 0 {
+				return save()
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Join(err, save())
+		}
+		cp.Offsets[p] = end
+	}
+	return save()
+}
+
+// The range of the partition's offsets to export
+func exportRange(ctx context.Context, c *client.Client, topic string, p uint32, offset, endOffset int64, from fromFlags, until time.Time) (start, end uint64, err error) {
+	offs, err := c.GetOffsets(ctx, topic, p)
+	if err != nil {
+		return 0, 0, err
+	}
+	start, end = offs.LowWatermark, offs.HighWatermark
+	if offset >= 0 {
+		start = max(start, uint64(offset))
+	} else if t, ok, err := from.time(); err != nil {
+		return 0, 0, err
+	} else if ok {
+		if start, err = c.OffsetForTime(ctx, topic, p, t); err != nil {
+			return 0, 0, err
+		}
+	}
+	if endOffset >= 0 {
+		end = min(end, uint64(endOffset))
+	}
+	if !until.IsZero() {
+		off, err := c.OffsetForTime(ctx, topic, p, until)
+		if err != nil {
+			return 0, 0, err
+		}
+		end = min(end, off)
+	}
+	return start, end, nil
+}
+
+// Appends the records proglog export wrote, from the files given or
+// stdin, to the partitions they were exported from or -partition, keeping
+// their keys, headers and timestamps. With -checkpoint it skips the
+// records a run that stopped appended.
+func importCmd(ctx context.Context, c *client.Client, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	var (
+		topic       = flags.String("topic", "", "topic to append to, the default one by default")
+		partition   = flags.Int("partition", -1, "partition to append to, each record's own by default; records with a key go to the partition it hashes to")
+		ack         = flags.String("ack", "", "how far records get before they're acknowledged: all, leader or none")
+		compression = flags.String("compression", "", "compress the records with snappy or zstd")
+		format      = flags.String("format", "jsonl", "input format: jsonl or binary, see proglog export")
+		checkpoint  = flags.String("checkpoint", "", "file keeping how many records were appended, to resume from")
+	)
+	_ = flags.Parse(args)
+	level, ok := acks[*ack]
+	if !ok {
+		return fmt.Errorf("unknown ack %q", *ack)
+	}
+	codec, ok := codecs[*compression]
+	if !ok {
+		return fmt.Errorf("unknown compression %q", *compression)
+	}
+	var cp importCheckpoint
+	if _, err := readCheckpoint(*checkpoint, &cp); err != nil {
+		return err
+	}
+
+	inputs := []io.Reader{os.Stdin}
+	if flags.NArg() > 0 {
+		inputs = inputs[:0]
+		for _, name := range flags.Args() {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			inputs = append(inputs, f)
+		}
+	}
+	dr, err := newDumpReader(io.MultiReader(inputs...), *format)
+	if err != nil {
+		return err
+	}
+
+	// a producer for each partition appended to
+	producers := make(map[uint32]*client.Producer)
+	var (
+		mu      sync.Mutex
+		sendErr error
+	)
+	result := func(res client.Result) {
+		if res.Err != nil {
+			mu.Lock()
+			if sendErr == nil {
+				sendErr = res.Err
+			}
+			mu.Unlock()
+		}
+	}
+	flush := func() error {
+		for _, p := range producers {
+			if err := p.Flush(ctx); err != nil {
+				return err
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return sendErr
+	}
+	closeAll := func() error {
+		var errs []error
+		for _, p := range producers {
+			errs = append(errs, p.Close(ctx))
+		}
+		return errors.Join(errs...)
+	}
+
+	var n, sent uint64
+	for {
+		p, record, err := dr.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Join(fmt.Errorf("record %d: %w", n+1, err), closeAll())
+		}
+		if n++; n <= cp.Records {
+			continue
+		}
+		if *partition >= 0 {
+			p = uint32(*partition)
+		}
+		prod, ok := producers[p]
+		if !ok {
+			prod = c.NewProducer(client.ProducerConfig{Topic: *topic, Partition: p, Ack: level, Compression: codec})
+			producers[p] = prod
+		}
+		if err := prod.Send(ctx, record, result); err != nil {
+			return errors.Join(err, closeAll())
+		}
+		if sent++; sent%checkpointEvery == 0 {
+			if err := flush(); err != nil {
+				return errors.Join(err, closeAll())
+			}
+			cp.Records = n
+			if err := writeCheckpoint(*checkpoint, cp); err != nil {
+				return errors.Join(err, closeAll())
+			}
+		}
+	}
+	if err := errors.Join(flush(), closeAll()); err != nil {
+		return err
+	}
+	cp.Records = max(cp.Records, n)
+	return writeCheckpoint(*checkpoint, cp)
+}
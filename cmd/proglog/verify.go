@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/frankie-mur/proglog/client"
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+// Checks a stopped server's data directory, see log.Verify, printing what's
+// wrong and failing if anything is left unrepaired
+func verify(ctx context.Context, _ *client.Client, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	var (
+		dir    = flags.String("dir", "", "data directory to verify")
+		repair = flags.Bool("repair", false, "repair what can be without losing records")
+		asJSON = flags.Bool("json", false, "print the report as JSON")
+	)
+	_ = flags.Parse(args)
+	if *dir == "" {
+		return fmt.Errorf("-dir is required")
+	}
+	report, err := log.Verify(*dir, log.VerifyOptions{Repair: *repair})
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		for _, p := range report.Problems {
+			status := ""
+			if p.Repaired {
+				status = " (repaired)"
+			}
+			fmt.Printf("%s: %s%s\n", p.Path, p.Problem, status)
+		}
+		fmt.Printf("checked %d logs, %d segments, %d records", report.Logs, report.Segments, report.Records)
+		if report.Sealed > 0 {
+			fmt.Printf(", %d segments sealed", report.Sealed)
+		}
+		fmt.Println()
+	}
+	unrepaired := 0
+	for _, p := range report.Problems {
+		if !p.Repaired {
+			unrepaired++
+		}
+	}
+	if unrepaired > 0 {
+		return fmt.Errorf("%s has %d problems left unrepaired", *dir, unrepaired)
+	}
+	return nil
+}
@@ -1,12 +1,965 @@
 package main
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/agent"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/config"
+	"github.com/frankie-mur/proglog/internal/discovery"
+	"github.com/frankie-mur/proglog/internal/objstore"
 	"github.com/frankie-mur/proglog/internal/server"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/frankie-mur/proglog/internal/systemd"
+	"github.com/frankie-mur/proglog/internal/telemetry"
+	"github.com/frankie-mur/proglog/internal/transform"
+	"github.com/frankie-mur/proglog/internal/vault"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 )
 
+// version is the build, set with -ldflags "-X main.version=..."
+var version = "dev"
+
+// conf is the settings, from the config file, the environment and the
+// flags, each overriding those before it
+var conf *config.Config
+
 func main() {
-	srv := server.NewHTTPServer(":8080")
-	log.Fatal(srv.ListenAndServe())
+	var err error
+	conf, err = config.Load("proglog-server", settings, os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "configuring server:\n%v\n", err)
+		os.Exit(2)
+	}
+	logger, level, err := newLogger(conf.Get("PROGLOG_LOG_LEVEL"), conf.Get("PROGLOG_LOG_FORMAT"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer logger.Sync()
+	zap.ReplaceGlobals(logger)
+	if conf.File != "" {
+		logger.Info("loaded config", zap.String("path", conf.File))
+	}
+
+	tconfig, err := telemetryConfig()
+	if err != nil {
+		logger.Fatal("configuring telemetry", zap.Error(err))
+	}
+	shutdownTracing, err := telemetry.SetupTracing(context.Background(), tconfig)
+	if err != nil {
+		logger.Fatal("setting up tracing", zap.Error(err))
+	}
+	defer shutdownTracing(context.Background())
+	shutdownMetrics, err := telemetry.SetupMetrics(context.Background(), tconfig)
+	if err != nil {
+		logger.Fatal("setting up metrics", zap.Error(err))
+	}
+	defer shutdownMetrics(context.Background())
+
+	authn, err := authenticator()
+	if err != nil {
+		logger.Fatal("configuring authentication", zap.Error(err))
+	}
+
+	// With Vault configured, its token's renewed for as long as the server
+	// runs, or issuing certificates and loading keys fail once it expires
+	var vaultClient *vault.Client
+	if addr := conf.Get("VAULT_ADDR"); addr != "" {
+		vaultClient = vault.NewClient(addr, conf.Get("VAULT_TOKEN"))
+		ctx, stopVault := context.WithCancel(context.Background())
+		defer stopVault()
+		go vaultClient.KeepTokenAlive(ctx, func(err error) {
+			logger.Error("renewing vault token", zap.Error(err))
+		})
+	}
+
+	// With PROGLOG_VAULT_PKI_ROLE set too, the server certificate is issued
+	// from Vault's PKI and only ever held in memory. The same certificate
+	// authenticates this node to its peers, and peers' certificates are
+	// verified against the CAs Vault issued the latest one with.
+	var serverTLS, peerTLS *tls.Config
+	var certs *vault.CertProvider
+	if role := conf.Get("PROGLOG_VAULT_PKI_ROLE"); vaultClient != nil && role != "" {
+		certs = vault.NewCertProvider(
+			vaultClient,
+			conf.Get("PROGLOG_VAULT_PKI_MOUNT"),
+			role,
+			setting("PROGLOG_VAULT_COMMON_NAME", hostname()),
+			0,
+		)
+		ctx, stopCerts := context.WithCancel(context.Background())
+		defer stopCerts()
+		if err := certs.Issue(ctx); err != nil {
+			logger.Fatal("issuing certificate from vault", zap.Error(err))
+		}
+		go certs.Renew(ctx, func(err error) {
+			logger.Error("renewing certificate from vault", zap.Error(err))
+		})
+		serverTLS = certs.ServerTLSConfig()
+		peerTLS = certs.ClientTLSConfig()
+	}
+
+	filter, err := server.NewIPFilter(
+		strings.Split(conf.Get("PROGLOG_ALLOW_CIDRS"), ","),
+		strings.Split(conf.Get("PROGLOG_DENY_CIDRS"), ","),
+	)
+	if err != nil {
+		logger.Fatal("configuring IP filter", zap.Error(err))
+	}
+	lconfig, err := logConfig(logger, vaultClient)
+	if err != nil {
+		logger.Fatal("configuring commit log", zap.Error(err))
+	}
+
+	config := agent.Config{
+		ServerTLSConfig: serverTLS,
+		PeerTLSConfig:   peerTLS,
+		DataDir:         conf.Get("PROGLOG_DATA_DIR"),
+		// With PROGLOG_BIND_ADDR set the node joins a cluster, replicating
+		// with Raft over the RPC port
+		BindAddr:         conf.Get("PROGLOG_BIND_ADDR"),
+		RPCAddr:          conf.Get("PROGLOG_RPC_ADDR"),
+		AdvertiseRPCAddr: conf.Get("PROGLOG_ADVERTISE_RPC_ADDR"),
+		HTTPAddr:         conf.Get("PROGLOG_HTTP_ADDR"),
+		// e.g. PROGLOG_KAFKA_ADDR=:9092 lets Kafka clients and kcat produce and fetch
+		KafkaAddr:          conf.Get("PROGLOG_KAFKA_ADDR"),
+		AdvertiseKafkaAddr: conf.Get("PROGLOG_ADVERTISE_KAFKA_ADDR"),
+		// e.g. PROGLOG_SYSLOG_ADDR=:514 takes syslog over UDP and TCP
+		SyslogAddr:  conf.Get("PROGLOG_SYSLOG_ADDR"),
+		SyslogTopic: conf.Get("PROGLOG_SYSLOG_TOPIC"),
+		// e.g. PROGLOG_FLUENT_ADDR=:24224 takes Fluentd and Fluent Bit's forward output
+		FluentAddr: conf.Get("PROGLOG_FLUENT_ADDR"),
+		// e.g. PROGLOG_MQTT_ADDR=:1883 bridges MQTT devices to the topics
+		MQTTAddr: conf.Get("PROGLOG_MQTT_ADDR"),
+		// e.g. PROGLOG_DEBUG_ADDR=localhost:6060, unauthenticated so keep it private
+		DebugAddr: conf.Get("PROGLOG_DEBUG_ADDR"),
+		NodeName:  setting("PROGLOG_NODE_NAME", hostname()),
+		Zone:      conf.Get("PROGLOG_ZONE"),
+		Version:   version,
+		Log:       lconfig,
+		Server:    server.Config{Authenticator: authn, Logger: logger.Named("server")},
+		IPFilter:  filter,
+
+		// e.g. PROGLOG_ADMIN_ADDR=10.0.0.5:8081 and PROGLOG_METRICS_ADDR=10.0.0.5:9090
+		// keep the admin routes, Admin service and metrics off the public
+		// HTTP and RPC addresses
+		AdminAddr:   conf.Get("PROGLOG_ADMIN_ADDR"),
+		MetricsAddr: conf.Get("PROGLOG_METRICS_ADDR"),
+	}
+	if config.AdminTLSConfig, err = listenerTLS("PROGLOG_ADMIN"); err != nil {
+		logger.Fatal("configuring admin TLS", zap.Error(err))
+	}
+	if config.MetricsTLSConfig, err = listenerTLS("PROGLOG_METRICS"); err != nil {
+		logger.Fatal("configuring metrics TLS", zap.Error(err))
+	}
+	if config.AdminAuthenticator, err = apiKeys("PROGLOG_ADMIN_API_KEYS"); err != nil {
+		logger.Fatal("configuring admin authentication", zap.Error(err))
+	}
+	if config.MetricsAuthenticator, err = apiKeys("PROGLOG_METRICS_API_KEYS"); err != nil {
+		logger.Fatal("configuring metrics authentication", zap.Error(err))
+	}
+	// PROGLOG_FLUENT_TAG_TOPICS=app.*=apps,*=logs maps tags to topics,
+	// tags without a pattern go to the topic they name
+	if v := conf.Get("PROGLOG_FLUENT_TAG_TOPICS"); v != "" {
+		if config.FluentTagTopics, err = parseTagTopics(v); err != nil {
+			logger.Fatal("parsing PROGLOG_FLUENT_TAG_TOPICS", zap.Error(err))
+		}
+	}
+	// PROGLOG_START_JOIN_ADDRS lists bind addresses of existing members
+	if v := conf.Get("PROGLOG_START_JOIN_ADDRS"); v != "" {
+		config.StartJoinAddrs = strings.Split(v, ",")
+	}
+	// Without gossip, PROGLOG_PEERS=name1=addr1,name2=addr2 lists the cluster's
+	// nodes, or PROGLOG_DNS_NAME names the SRV record, or with
+	// PROGLOG_DNS_PORT the A records, to find them in
+	if v := conf.Get("PROGLOG_PEERS"); v != "" {
+		if config.StaticPeers, err = parsePeers(v); err != nil {
+			logger.Fatal("parsing PROGLOG_PEERS", zap.Error(err))
+		}
+	}
+	if config.DNSName = conf.Get("PROGLOG_DNS_NAME"); config.DNSName != "" {
+		// DNS names peers by their RPC address
+		config.NodeName = conf.Get("PROGLOG_NODE_NAME")
+	}
+	if v := conf.Get("PROGLOG_DNS_PORT"); v != "" {
+		if config.DNSPort, err = strconv.Atoi(v); err != nil {
+			logger.Fatal("parsing PROGLOG_DNS_PORT", zap.Error(err))
+		}
+	}
+	// In a StatefulSet, PROGLOG_K8S_SERVICE names the headless service. The
+	// node is named after its pod, advertises its stable DNS name and the
+	// first pod bootstraps the cluster.
+	if config.KubernetesService = conf.Get("PROGLOG_K8S_SERVICE"); config.KubernetesService != "" {
+		if err := kubernetesDefaults(&config); err != nil {
+			logger.Fatal("configuring kubernetes discovery", zap.Error(err))
+		}
+	}
+	if v := conf.Get("PROGLOG_DISCOVERY_INTERVAL"); v != "" {
+		if config.DiscoveryInterval, err = time.ParseDuration(v); err != nil {
+			logger.Fatal("parsing PROGLOG_DISCOVERY_INTERVAL", zap.Error(err))
+		}
+	}
+	if v := conf.Get("PROGLOG_BOOTSTRAP"); v != "" {
+		if config.Bootstrap, err = strconv.ParseBool(v); err != nil {
+			logger.Fatal("parsing PROGLOG_BOOTSTRAP", zap.Error(err))
+		}
+	}
+	if v := conf.Get("PROGLOG_SLOW_REQUEST_THRESHOLD"); v != "" {
+		if config.Server.SlowRequestThreshold, err = time.ParseDuration(v); err != nil {
+			logger.Fatal("parsing PROGLOG_SLOW_REQUEST_THRESHOLD", zap.Error(err))
+		}
+	}
+	// Followers proxy produces to the leader unless PROGLOG_DISABLE_FORWARDING is set
+	if v := conf.Get("PROGLOG_DISABLE_FORWARDING"); v != "" {
+		if config.Server.DisableForwarding, err = strconv.ParseBool(v); err != nil {
+			logger.Fatal("parsing PROGLOG_DISABLE_FORWARDING", zap.Error(err))
+		}
+	}
+	// With PROGLOG_AUTO_CREATE_TOPICS set, producing to a topic there's none of creates it
+	if v := conf.Get("PROGLOG_AUTO_CREATE_TOPICS"); v != "" {
+		if config.Server.AutoCreateTopics, err = strconv.ParseBool(v); err != nil {
+			logger.Fatal("parsing PROGLOG_AUTO_CREATE_TOPICS", zap.Error(err))
+		}
+	}
+	// e.g. PROGLOG_OTLP_LOGS_TOPIC=logs takes OpenTelemetry log exports over
+	// OTLP, on the RPC port and the HTTP server's /v1/logs
+	config.Server.OTLPLogsTopic = conf.Get("PROGLOG_OTLP_LOGS_TOPIC")
+	// Link backups hard link the data directory's files, so PROGLOG_LINK_BACKUP_DIR
+	// must be on its filesystem
+	config.Server.LinkBackupDir = conf.Get("PROGLOG_LINK_BACKUP_DIR")
+	if v := conf.Get("PROGLOG_MIN_OFFSET_TIMEOUT"); v != "" {
+		if config.Server.MinOffsetTimeout, err = time.ParseDuration(v); err != nil {
+			logger.Fatal("parsing PROGLOG_MIN_OFFSET_TIMEOUT", zap.Error(err))
+		}
+	}
+	// e.g. PROGLOG_APPEND_BATCH_WINDOW=2ms appends concurrent produces to a
+	// partition in batches, waiting up to 2ms for a batch to fill
+	if v := conf.Get("PROGLOG_APPEND_BATCH_WINDOW"); v != "" {
+		if config.Server.AppendBatchWindow, err = time.ParseDuration(v); err != nil {
+			logger.Fatal("parsing PROGLOG_APPEND_BATCH_WINDOW", zap.Error(err))
+		}
+	}
+	if v := conf.Get("PROGLOG_APPEND_BATCH_MAX_RECORDS"); v != "" {
+		if config.Server.AppendBatchMaxRecords, err = strconv.Atoi(v); err != nil {
+			logger.Fatal("parsing PROGLOG_APPEND_BATCH_MAX_RECORDS", zap.Error(err))
+		}
+	}
+	// PROGLOG_MAX_CONSUME_WAIT bounds how long fetches wait for records
+	if v := conf.Get("PROGLOG_MAX_CONSUME_WAIT"); v != "" {
+		if config.Server.MaxConsumeWait, err = time.ParseDuration(v); err != nil {
+			logger.Fatal("parsing PROGLOG_MAX_CONSUME_WAIT", zap.Error(err))
+		}
+	}
+	// PROGLOG_TRANSACTION_TIMEOUT aborts transactions open longer
+	if v := conf.Get("PROGLOG_TRANSACTION_TIMEOUT"); v != "" {
+		if config.Server.TransactionTimeout, err = time.ParseDuration(v); err != nil {
+			logger.Fatal("parsing PROGLOG_TRANSACTION_TIMEOUT", zap.Error(err))
+		}
+	}
+	// With PROGLOG_TRACE_RECORD_HEADERS set, traced produces' records carry
+	// the trace context in traceparent and tracestate headers
+	if v := conf.Get("PROGLOG_TRACE_RECORD_HEADERS"); v != "" {
+		if config.Server.TraceRecordHeaders, err = strconv.ParseBool(v); err != nil {
+			logger.Fatal("parsing PROGLOG_TRACE_RECORD_HEADERS", zap.Error(err))
+		}
+	}
+	// PROGLOG_DRAIN_TIMEOUT bounds how long shutdown waits to hand off leaderships
+	if v := conf.Get("PROGLOG_DRAIN_TIMEOUT"); v != "" {
+		if config.DrainTimeout, err = time.ParseDuration(v); err != nil {
+			logger.Fatal("parsing PROGLOG_DRAIN_TIMEOUT", zap.Error(err))
+		}
+	}
+	// e.g. PROGLOG_REPAIR_INTERVAL=10m has followers check their log against the leader's
+	if v := conf.Get("PROGLOG_REPAIR_INTERVAL"); v != "" {
+		if config.RepairInterval, err = time.ParseDuration(v); err != nil {
+			logger.Fatal("parsing PROGLOG_REPAIR_INTERVAL", zap.Error(err))
+		}
+	}
+	var acl *auth.ACL
+	if path := conf.Get("PROGLOG_ACL_POLICY"); path != "" {
+		if acl, err = auth.LoadACL(path); err != nil {
+			logger.Fatal("loading ACL policy", zap.String("path", path), zap.Error(err))
+		}
+		config.Server.Authorizer = acl
+	}
+	// e.g. PROGLOG_NATS_BRIDGE=nats.json mirrors subjects and topics, see server.NATSBridgeConfig
+	if path := conf.Get("PROGLOG_NATS_BRIDGE"); path != "" {
+		if config.NATS, err = server.LoadNATSBridge(path); err != nil {
+			logger.Fatal("loading NATS bridge", zap.String("path", path), zap.Error(err))
+		}
+	}
+	// e.g. PROGLOG_KAFKA_MIRROR=kafka.json mirrors a Kafka cluster's topics, see server.KafkaMirrorConfig
+	if path := conf.Get("PROGLOG_KAFKA_MIRROR"); path != "" {
+		if config.KafkaMirror, err = server.LoadKafkaMirror(path); err != nil {
+			logger.Fatal("loading Kafka mirror", zap.String("path", path), zap.Error(err))
+		}
+	}
+	if config.Parquet, err = parquetConfig(); err != nil {
+		logger.Fatal("configuring parquet exports", zap.Error(err))
+	}
+	if config.DiskQuota, err = diskQuotaConfig(); err != nil {
+		logger.Fatal("configuring disk quota", zap.Error(err))
+	}
+	if config.Server.Quotas, err = quotas(); err != nil {
+		logger.Fatal("configuring quotas", zap.Error(err))
+	}
+	if config.Server.ScanThrottle, err = scanThrottle(); err != nil {
+		logger.Fatal("configuring scan throttle", zap.Error(err))
+	}
+	if config.Server.Transforms, err = transforms(); err != nil {
+		logger.Fatal("loading transforms", zap.Error(err))
+	}
+	// e.g. PROGLOG_ROUTES=routes.json routes records produced to @ingest, see server.RoutesConfig
+	if path := conf.Get("PROGLOG_ROUTES"); path != "" {
+		if config.Server.Routes, err = server.LoadRoutes(path); err != nil {
+			logger.Fatal("loading routes", zap.String("path", path), zap.Error(err))
+		}
+	}
+	// PROGLOG_STORE_SLOTS bounds the requests at the store at once,
+	// scheduling those waiting by priority
+	if v := conf.Get("PROGLOG_STORE_SLOTS"); v != "" {
+		slots, err := strconv.Atoi(v)
+		if err != nil {
+			logger.Fatal("parsing PROGLOG_STORE_SLOTS", zap.Error(err))
+		}
+		if slots > 0 {
+			config.Server.Scheduler = server.NewScheduler(slots)
+		}
+	}
+
+	// SIGHUP and POST /admin/reload re-read what can change while running
+	r := &reloader{logger: logger, level: level, acl: acl, certs: certs, transforms: config.Server.Transforms, routes: config.Server.Routes}
+	config.Server.Reload = r.reload
+	config.Server.Settings = r.settings
+
+	a, err := agent.New(config)
+	if err != nil {
+		logger.Fatal("starting agent", zap.Error(err))
+	}
+	r.setAgent(a)
+	// under systemd with Type=notify, the log's recovered and the listeners
+	// are up by now
+	notify(logger, systemd.Ready)
+	if interval := systemd.WatchdogInterval(); interval > 0 {
+		stop := systemd.Watch(interval, func() error { return a.Live(interval / 4) }, func(err error) {
+			logger.Error("not pinging the watchdog", zap.Error(err))
+		})
+		defer stop()
+	}
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case sig := <-sigc:
+			if sig == syscall.SIGHUP {
+				notify(logger, systemd.Reloading)
+				if err := r.reload(context.Background()); err != nil {
+					logger.Error("reloading config", zap.Error(err))
+				} else {
+					logger.Info("reloaded config")
+				}
+				notify(logger, systemd.Ready)
+				continue
+			}
+			logger.Info("shutting down", zap.Stringer("signal", sig))
+			notify(logger, systemd.Stopping)
+			if err := a.Shutdown(); err != nil {
+				logger.Error("shutting down", zap.Error(err))
+			}
+		case <-a.Done():
+		}
+		return
+	}
+}
+
+// Tells systemd the server's state, if it's running under it
+func notify(logger *zap.Logger, state string) {
+	if _, err := systemd.Notify(state); err != nil {
+		logger.Warn("notifying systemd", zap.String("state", state), zap.Error(err))
+	}
+}
+
+// Builds the process logger, format is either json or console, and the
+// level it logs at, which can change
+func newLogger(level, format string) (*zap.Logger, zap.AtomicLevel, error) {
+	lvl, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return nil, zap.AtomicLevel{}, err
+	}
+	var config zap.Config
+	switch format {
+	case "json":
+		config = zap.NewProductionConfig()
+	case "console":
+		config = zap.NewDevelopmentConfig()
+	default:
+		return nil, zap.AtomicLevel{}, fmt.Errorf("unknown log format %q", format)
+	}
+	config.Level = zap.NewAtomicLevelAt(lvl)
+	logger, err := config.Build()
+	return logger, config.Level, err
+}
+
+// Fills in what the pod's name and the headless service imply, leaving
+// anything set explicitly
+func kubernetesDefaults(config *agent.Config) error {
+	if config.AdvertiseRPCAddr == "" {
+		_, port, err := net.SplitHostPort(config.RPCAddr)
+		if err != nil {
+			return err
+		}
+		config.AdvertiseRPCAddr = net.JoinHostPort(config.NodeName+"."+config.KubernetesService, port)
+	}
+	if conf.Get("PROGLOG_BOOTSTRAP") == "" {
+		ordinal, err := discovery.Ordinal(config.NodeName)
+		if err != nil {
+			return err
+		}
+		config.Bootstrap = ordinal == 0
+	}
+	return nil
+}
+
+// Parses name=rpc_addr pairs separated by commas
+func parsePeers(v string) ([]discovery.Peer, error) {
+	var peers []discovery.Peer
+	for _, kv := range strings.Split(v, ",") {
+		name, addr, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid peer %q", kv)
+		}
+		peers = append(peers, discovery.Peer{Name: name, RPCAddr: addr})
+	}
+	return peers, nil
+}
+
+func parseTagTopics(v string) (map[string]string, error) {
+	tagTopics := make(map[string]string)
+	for _, kv := range strings.Split(v, ",") {
+		tag, topic, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid tag topic %q", kv)
+		}
+		tagTopics[tag] = topic
+	}
+	return tagTopics, nil
+}
+
+// The setting, else the fallback
+func setting(key, fallback string) string {
+	if v := conf.Get(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "localhost"
+	}
+	return name
+}
+
+// PROGLOG_OTLP_* override the OTEL_* variables the exporters read otherwise
+func telemetryConfig() (telemetry.Config, error) {
+	c := telemetry.Config{
+		TracesExporter:  conf.Get("PROGLOG_TRACES_EXPORTER"),
+		MetricsExporter: conf.Get("PROGLOG_METRICS_EXPORTER"),
+		Protocol:        conf.Get("PROGLOG_OTLP_PROTOCOL"),
+		Endpoint:        conf.Get("PROGLOG_OTLP_ENDPOINT"),
+	}
+	if v := conf.Get("PROGLOG_OTLP_HEADERS"); v != "" {
+		c.Headers = telemetry.ParseHeaders(v)
+	}
+	var err error
+	if v := conf.Get("PROGLOG_OTLP_INSECURE"); v != "" {
+		if c.Insecure, err = strconv.ParseBool(v); err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_OTLP_INSECURE: %w", err)
+		}
+	}
+	if v := conf.Get("PROGLOG_TRACE_SAMPLE_RATIO"); v != "" {
+		if c.SampleRatio, err = strconv.ParseFloat(v, 64); err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_TRACE_SAMPLE_RATIO: %w", err)
+		}
+	}
+	if v := conf.Get("PROGLOG_METRICS_INTERVAL"); v != "" {
+		if c.MetricsInterval, err = time.ParseDuration(v); err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_METRICS_INTERVAL: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// Log settings from the environment. With a Vault client and
+// PROGLOG_VAULT_KEYS_PATH set, records are encrypted with keys from Vault's
+// KV store, polled so rotated keys are picked up.
+func logConfig(logger *zap.Logger, client *vault.Client) (log.Config, error) {
+	c := log.Config{Logger: logger.Named("log")}
+	c.Segment.MaxStoreBytes = 16 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	if v := conf.Get("PROGLOG_SYNC_ON_APPEND"); v != "" {
+		sync, err := strconv.ParseBool(v)
+		if err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_SYNC_ON_APPEND: %w", err)
+		}
+		c.SyncOnAppend = sync
+	}
+	// e.g. PROGLOG_SYNC_WINDOW=1ms has synced appends wait for others to share an fsync with
+	if v := conf.Get("PROGLOG_SYNC_WINDOW"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_SYNC_WINDOW: %w", err)
+		}
+		c.SyncWindow = window
+	}
+	if v := conf.Get("PROGLOG_BATCH"); v != "" {
+		batch, err := strconv.ParseBool(v)
+		if err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_BATCH: %w", err)
+		}
+		c.Batch.Enabled = batch
+	}
+	if v := conf.Get("PROGLOG_BATCH_CODEC"); v != "" {
+		codec, ok := api.Codec_value["CODEC_"+strings.ToUpper(v)]
+		if !ok {
+			return c, fmt.Errorf("unknown PROGLOG_BATCH_CODEC %q", v)
+		}
+		c.Batch.Codec = api.Codec(codec)
+	}
+	if v := conf.Get("PROGLOG_IO_URING"); v != "" {
+		uring, err := strconv.ParseBool(v)
+		if err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_IO_URING: %w", err)
+		}
+		c.IOUring = uring
+	}
+	// PROGLOG_ACK is all, leader or none, for produces that leave it to the server
+	if v := conf.Get("PROGLOG_ACK"); v != "" {
+		ack, ok := api.Ack_value["ACK_"+strings.ToUpper(v)]
+		if !ok {
+			return c, fmt.Errorf("unknown PROGLOG_ACK %q", v)
+		}
+		c.Raft.Ack = api.Ack(ack)
+	}
+	if v := conf.Get("PROGLOG_MIN_INSYNC_REPLICAS"); v != "" {
+		min, err := strconv.Atoi(v)
+		if err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_MIN_INSYNC_REPLICAS: %w", err)
+		}
+		c.Raft.MinInSyncReplicas = min
+	}
+	if v := conf.Get("PROGLOG_MAX_REPLICATION_LAG"); v != "" {
+		lag, err := time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_MAX_REPLICATION_LAG: %w", err)
+		}
+		c.Raft.MaxReplicationLag = lag
+	}
+	if v := conf.Get("PROGLOG_PARTITIONS"); v != "" {
+		partitions, err := strconv.Atoi(v)
+		if err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_PARTITIONS: %w", err)
+		}
+		c.Raft.Partitions = partitions
+	}
+	if v := conf.Get("PROGLOG_MAX_VOTERS"); v != "" {
+		voters, err := strconv.Atoi(v)
+		if err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_MAX_VOTERS: %w", err)
+		}
+		c.Raft.MaxVoters = voters
+	}
+	topic, err := topicDefaults(conf)
+	if err != nil {
+		return c, err
+	}
+	c.Topic = topic
+	if v := conf.Get("PROGLOG_CLEANUP_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_CLEANUP_INTERVAL: %w", err)
+		}
+		c.CleanupInterval = interval
+	}
+	// e.g. PROGLOG_READ_AHEAD=1048576 reads stores a megabyte ahead of
+	// consumers reading in order, holding 64 of them unless
+	// PROGLOG_READ_AHEAD_MAX_BYTES says otherwise
+	if v := conf.Get("PROGLOG_READ_AHEAD"); v != "" {
+		chunk, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_READ_AHEAD: %w", err)
+		}
+		maxBytes := 64 * chunk
+		if v := conf.Get("PROGLOG_READ_AHEAD_MAX_BYTES"); v != "" {
+			if maxBytes, err = strconv.ParseUint(v, 10, 64); err != nil {
+				return c, fmt.Errorf("parsing PROGLOG_READ_AHEAD_MAX_BYTES: %w", err)
+			}
+		}
+		c.ReadAhead = log.NewReadAhead(chunk, maxBytes)
+	}
+	// e.g. PROGLOG_INDEX_CACHE=1024 keeps at most 1024 sealed segments'
+	// indexes mapped, opening the rest as they're read
+	if v := conf.Get("PROGLOG_INDEX_CACHE"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_INDEX_CACHE: %w", err)
+		}
+		c.IndexCache = log.NewIndexCache(size)
+	}
+	// e.g. PROGLOG_TENANTS=tenants.json of {"acme": {"dir": "/mnt/acme",
+	// "max_bytes": 1073741824}} keeps acme's topics, acme.*, on their own
+	// volume, see log.Tenant
+	if path := conf.Get("PROGLOG_TENANTS"); path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		if err := json.Unmarshal(b, &c.Tenants); err != nil {
+			return c, fmt.Errorf("parsing PROGLOG_TENANTS: %w", err)
+		}
+	}
+	if err := tierConfig(&c); err != nil {
+		return c, err
+	}
+	// e.g. PROGLOG_FAULTS="op=sync files=*.store fault=error nth=100 count=1"
+	// fails the hundredth sync of each store, see log.ParseFaultRule
+	if v := conf.Get("PROGLOG_FAULTS"); v != "" {
+		var rules []log.FaultRule
+		for _, s := range strings.Split(v, ",") {
+			rule, err := log.ParseFaultRule(s)
+			if err != nil {
+				return c, fmt.Errorf("parsing PROGLOG_FAULTS: %w", err)
+			}
+			rules = append(rules, rule)
+		}
+		faults, err := log.NewFaults(rules...)
+		if err != nil {
+			return c, err
+		}
+		logger.Warn("injecting faults into segment file I/O", zap.Int("rules", len(rules)))
+		c.Faults = faults
+	}
+	if path := conf.Get("PROGLOG_VAULT_KEYS_PATH"); client != nil && path != "" {
+		mount := conf.Get("PROGLOG_VAULT_KV_MOUNT")
+		keys := log.NewKeyring()
+		if err := client.LoadKeys(context.Background(), mount, path, keys); err != nil {
+			return c, err
+		}
+		go client.WatchKeys(context.Background(), mount, path, keys, time.Minute, func(err error) {
+			logger.Error("loading keys from vault", zap.Error(err))
+		})
+		c.Keyring = keys
+	}
+	return c, nil
+}
+
+// PROGLOG_TOPIC_CONFIGS are the settings of topics that don't override
+// them, name=value pairs as topics take, e.g. retention.ms=604800000
+func topicDefaults(conf *config.Config) (log.TopicConfig, error) {
+	v := conf.Get("PROGLOG_TOPIC_CONFIGS")
+	if v == "" {
+		return log.TopicConfig{}, nil
+	}
+	configs := make(map[string]string)
+	for _, pair := range strings.Split(v, ",") {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return log.TopicConfig{}, fmt.Errorf("PROGLOG_TOPIC_CONFIGS entry %q isn't name=value", pair)
+		}
+		configs[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	topic, err := log.TopicConfig{}.With(configs)
+	if err != nil {
+		return log.TopicConfig{}, fmt.Errorf("parsing PROGLOG_TOPIC_CONFIGS: %w", err)
+	}
+	return topic, nil
+}
+
+// Archives sealed segments to PROGLOG_TIER_S3_BUCKET, or to the
+// PROGLOG_TIER_DIR directory, when either is set
+func tierConfig(c *log.Config) error {
+	store, err := objectStore("PROGLOG_TIER")
+	if err != nil {
+		return err
+	}
+	c.Tier.Store = store
+	c.Tier.Prefix = conf.Get("PROGLOG_TIER_PREFIX")
+	for _, env := range []struct {
+		key string
+		n   *int
+	}{
+		{"PROGLOG_TIER_LOCAL_SEGMENTS", &c.Tier.LocalSegments},
+		{"PROGLOG_TIER_CACHE_SEGMENTS", &c.Tier.CacheSegments},
+	} {
+		if v := os.Getenv(env.key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("parsing %s: %w", env.key, err)
+			}
+			*env.n = n
+		}
+	}
+	return nil
+}
+
+// The object store the prefix's _S3_BUCKET, or its _DIR directory, names,
+// nil when neither is set. GCS buckets are reached through their S3
+// compatible API, with an _S3_ENDPOINT of https://storage.googleapis.com
+// and HMAC keys.
+func objectStore(prefix string) (log.ObjectStore, error) {
+	if bucket := conf.Get(prefix + "_S3_BUCKET"); bucket != "" {
+		region := setting(prefix+"_S3_REGION", getenv("AWS_REGION", "us-east-1"))
+		s3 := objstore.NewS3(
+			setting(prefix+"_S3_ENDPOINT", "https://s3."+region+".amazonaws.com"),
+			bucket,
+			region,
+			os.Getenv("AWS_ACCESS_KEY_ID"),
+			os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		)
+		s3.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		if v := conf.Get(prefix + "_S3_PATH_STYLE"); v != "" {
+			pathStyle, err := strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s_S3_PATH_STYLE: %w", prefix, err)
+			}
+			s3.PathStyle = pathStyle
+		}
+		return s3, nil
+	}
+	if dir := conf.Get(prefix + "_DIR"); dir != "" {
+		return objstore.NewDir(dir), nil
+	}
+	return nil, nil
+}
+
+// Exports PROGLOG_PARQUET_TOPICS to PROGLOG_PARQUET_S3_BUCKET, or to the
+// PROGLOG_PARQUET_DIR directory, nil without topics
+func parquetConfig() (*server.ParquetExportConfig, error) {
+	v := conf.Get("PROGLOG_PARQUET_TOPICS")
+	if v == "" {
+		return nil, nil
+	}
+	store, err := objectStore("PROGLOG_PARQUET")
+	if err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, errors.New("PROGLOG_PARQUET_TOPICS needs PROGLOG_PARQUET_S3_BUCKET or PROGLOG_PARQUET_DIR")
+	}
+	c := &server.ParquetExportConfig{
+		Store:  store,
+		Prefix: conf.Get("PROGLOG_PARQUET_PREFIX"),
+		Topics: strings.Split(v, ","),
+	}
+	// e.g. PROGLOG_PARQUET_INTERVAL=1h
+	if v := conf.Get("PROGLOG_PARQUET_INTERVAL"); v != "" {
+		if c.Interval, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("parsing PROGLOG_PARQUET_INTERVAL: %w", err)
+		}
+	}
+	if v := conf.Get("PROGLOG_PARQUET_MAX_RECORDS"); v != "" {
+		if c.MaxRecords, err = strconv.Atoi(v); err != nil {
+			return nil, fmt.Errorf("parsing PROGLOG_PARQUET_MAX_RECORDS: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// Rejects produces past PROGLOG_DISK_HARD_LIMIT, e.g. 0.95, nil when
+// neither limit is set
+func diskQuotaConfig() (*server.DiskQuotaConfig, error) {
+	soft, hard := conf.Get("PROGLOG_DISK_SOFT_LIMIT"), conf.Get("PROGLOG_DISK_HARD_LIMIT")
+	if soft == "" && hard == "" {
+		return nil, nil
+	}
+	c := &server.DiskQuotaConfig{}
+	var err error
+	if soft != "" {
+		if c.SoftLimit, err = strconv.ParseFloat(soft, 64); err != nil {
+			return nil, fmt.Errorf("parsing PROGLOG_DISK_SOFT_LIMIT: %w", err)
+		}
+	}
+	if hard != "" {
+		if c.HardLimit, err = strconv.ParseFloat(hard, 64); err != nil {
+			return nil, fmt.Errorf("parsing PROGLOG_DISK_HARD_LIMIT: %w", err)
+		}
+	}
+	if c.SoftLimit < 0 || c.HardLimit < 0 || c.HardLimit > 1 || (c.HardLimit != 0 && c.SoftLimit > c.HardLimit) {
+		return nil, errors.New("PROGLOG_DISK_SOFT_LIMIT and PROGLOG_DISK_HARD_LIMIT must be between 0 and 1, the soft limit at most the hard")
+	}
+	if v := conf.Get("PROGLOG_DISK_CHECK_INTERVAL"); v != "" {
+		if c.Interval, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("parsing PROGLOG_DISK_CHECK_INTERVAL: %w", err)
+		}
+	}
+	return c, nil
+}
+
+// Throttles principals past the PROGLOG_QUOTA_* rates, e.g.
+// PROGLOG_QUOTA_PRODUCE_BYTES_PER_SECOND=1048576, those without quotas of
+// their own set through the admin APIs
+func quotas() (*server.Quotas, error) {
+	q := server.NewQuotas()
+	defaults := &api.Quota{Principal: "*"}
+	for env, rate := range map[string]*float64{
+		"PROGLOG_QUOTA_PRODUCE_BYTES_PER_SECOND": &defaults.ProduceBytesPerSecond,
+		"PROGLOG_QUOTA_CONSUME_BYTES_PER_SECOND": &defaults.ConsumeBytesPerSecond,
+		"PROGLOG_QUOTA_REQUESTS_PER_SECOND":      &defaults.RequestsPerSecond,
+	} {
+		v := conf.Get(env)
+		if v == "" {
+			continue
+		}
+		var err error
+		if *rate, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", env, err)
+		}
+	}
+	if _, err := q.Alter([]*api.Quota{defaults}); err != nil {
+		return nil, err
+	}
+	if v := conf.Get("PROGLOG_QUOTA_MAX_THROTTLE"); v != "" {
+		var err error
+		if q.MaxThrottle, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("parsing PROGLOG_QUOTA_MAX_THROTTLE: %w", err)
+		}
+	}
+	return q, nil
+}
+
+// Throttles reads of partitions' history to PROGLOG_SCAN_BYTES_PER_SECOND
+// and each connection's to PROGLOG_SCAN_CONNECTION_BYTES_PER_SECOND, nil
+// when neither is set
+func scanThrottle() (*server.ScanThrottle, error) {
+	var rates [2]float64
+	for i, env := range []string{"PROGLOG_SCAN_BYTES_PER_SECOND", "PROGLOG_SCAN_CONNECTION_BYTES_PER_SECOND"} {
+		v := conf.Get(env)
+		if v == "" {
+			continue
+		}
+		var err error
+		if rates[i], err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", env, err)
+		}
+	}
+	if rates[0] <= 0 && rates[1] <= 0 {
+		return nil, nil
+	}
+	return server.NewScanThrottle(rates[0], rates[1]), nil
+}
+
+// Loads the WebAssembly transforms of PROGLOG_TRANSFORMS_DIR, limited by
+// PROGLOG_TRANSFORM_MAX_MEMORY and PROGLOG_TRANSFORM_TIMEOUT, nil when it's
+// not set
+func transforms() (*transform.Transforms, error) {
+	dir := conf.Get("PROGLOG_TRANSFORMS_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	var limits transform.Limits
+	if v := conf.Get("PROGLOG_TRANSFORM_MAX_MEMORY"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing PROGLOG_TRANSFORM_MAX_MEMORY: %w", err)
+		}
+		limits.MemoryBytes = n
+	}
+	if v := conf.Get("PROGLOG_TRANSFORM_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("parsing PROGLOG_TRANSFORM_TIMEOUT: %w", err)
+		}
+		limits.Timeout = d
+	}
+	t := transform.New(limits)
+	if err := t.LoadDir(dir); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("loading %s: %w", dir, err)
+	}
+	return t, nil
+}
+
+// Builds the authenticator chain from the environment, nil when no scheme is configured
+func authenticator() (auth.Authenticator, error) {
+	var auths []auth.Authenticator
+	// clients' certificates are only verified with Vault's PKI
+	if conf.Get("VAULT_ADDR") != "" && conf.Get("PROGLOG_VAULT_PKI_ROLE") != "" {
+		auths = append(auths, auth.TLSAuthenticator{})
+	}
+	if secret := conf.Get("PROGLOG_JWT_SECRET"); secret != "" {
+		auths = append(auths, auth.JWTAuthenticator{
+			Secret: []byte(secret),
+			Issuer: conf.Get("PROGLOG_JWT_ISSUER"),
+		})
+	}
+	// PROGLOG_API_KEYS=key1=alice,key2=bob
+	keys, err := apiKeys("PROGLOG_API_KEYS")
+	if err != nil {
+		return nil, err
+	}
+	if keys != nil {
+		auths = append(auths, keys)
+	}
+	if len(auths) == 0 {
+		return nil, nil
+	}
+	return auth.Chain(auths...), nil
+}
+
+// Authenticates the API keys the environment variable maps to principals,
+// nil when it's unset
+func apiKeys(env string) (auth.Authenticator, error) {
+	v := conf.Get(env)
+	if v == "" {
+		return nil, nil
+	}
+	keys := make(map[string]string)
+	for _, kv := range strings.Split(v, ",") {
+		key, principal, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid %s entry %q", env, kv)
+		}
+		keys[key] = principal
+	}
+	return auth.APIKeyAuthenticator{Keys: keys}, nil
+}
+
+// Serves a listener with the certificate in prefix's _TLS_CERT_FILE and
+// _TLS_KEY_FILE, nil for plaintext when they're unset
+func listenerTLS(prefix string) (*tls.Config, error) {
+	certFile, keyFile := conf.Get(prefix+"_TLS_CERT_FILE"), conf.Get(prefix+"_TLS_KEY_FILE")
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/agent"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/config"
+	"github.com/frankie-mur/proglog/internal/server"
+	"github.com/frankie-mur/proglog/internal/transform"
+	"github.com/frankie-mur/proglog/internal/vault"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// The settings a reload applies. The others only change with a restart.
+var reloadable = []string{
+	"PROGLOG_LOG_LEVEL",
+	"PROGLOG_TOPIC_CONFIGS",
+	"PROGLOG_ACL_POLICY",
+	"PROGLOG_TRANSFORMS_DIR",
+	"PROGLOG_ROUTES",
+}
+
+// Applies the settings that can change while the server runs, re-read
+// from the config file, without closing its listeners or connections. The
+// certificate from Vault is issued afresh.
+type reloader struct {
+	mu     sync.Mutex
+	logger *zap.Logger
+	level  zap.AtomicLevel
+	// acl is nil without a policy, which a reload can't add
+	acl   *auth.ACL
+	certs *vault.CertProvider
+	// transforms is nil without a directory, which a reload can't add
+	transforms *transform.Transforms
+	// routes is nil without rules, which a reload can't add
+	routes *server.Routes
+	agent  *agent.Agent
+	// reloaded is the config reloaded last, nil until a reload
+	reloaded *config.Config
+}
+
+func (r *reloader) setAgent(a *agent.Agent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.agent = a
+}
+
+// Reloads the settings, all of them or, when any is invalid, none
+func (r *reloader) reload(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.agent == nil {
+		return errors.New("the server is starting")
+	}
+	next, err := config.Load("proglog-server", settings, os.Args[1:], os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	level, err := zapcore.ParseLevel(next.Get("PROGLOG_LOG_LEVEL"))
+	if err != nil {
+		return fmt.Errorf("parsing PROGLOG_LOG_LEVEL: %w", err)
+	}
+	topic, err := topicDefaults(next)
+	if err != nil {
+		return err
+	}
+	path := next.Get("PROGLOG_ACL_POLICY")
+	if (r.acl == nil) != (path == "") {
+		return errors.New("an ACL policy can't be added or removed without a restart")
+	}
+	dir := next.Get("PROGLOG_TRANSFORMS_DIR")
+	if (r.transforms == nil) != (dir == "") {
+		return errors.New("transforms can't be added or removed without a restart")
+	}
+	routes := next.Get("PROGLOG_ROUTES")
+	if (r.routes == nil) != (routes == "") {
+		return errors.New("routes can't be added or removed without a restart")
+	}
+	if r.certs != nil {
+		if err := r.certs.Issue(ctx); err != nil {
+			return fmt.Errorf("issuing certificate from vault: %w", err)
+		}
+	}
+	if r.acl != nil {
+		if err := r.acl.Reload(path); err != nil {
+			return fmt.Errorf("loading ACL policy %s: %w", path, err)
+		}
+	}
+	if r.transforms != nil {
+		if err := r.transforms.LoadDir(dir); err != nil {
+			return fmt.Errorf("loading transforms %s: %w", dir, err)
+		}
+	}
+	if r.routes != nil {
+		if err := r.routes.Reload(routes); err != nil {
+			return err
+		}
+	}
+	r.level.SetLevel(level)
+	r.agent.SetTopicDefaults(topic)
+	r.reloaded = next
+
+	var restart []string
+	for _, env := range conf.Changed(next) {
+		if !slices.Contains(reloadable, env) {
+			restart = append(restart, env)
+		}
+	}
+	if len(restart) > 0 {
+		r.logger.Warn("settings changed that need a restart", zap.Strings("settings", restart))
+	}
+	return nil
+}
+
+// The effective settings, secrets redacted: those a reload applies as
+// reloaded last, the others as the server started with
+func (r *reloader) settings() []*api.ServerSetting {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	values := conf.Effective()
+	if r.reloaded != nil {
+		for i, v := range r.reloaded.Effective() {
+			if slices.Contains(reloadable, v.Env) {
+				values[i] = v
+			}
+		}
+	}
+	settings := make([]*api.ServerSetting, len(values))
+	for i, v := range values {
+		settings[i] = &api.ServerSetting{Key: v.Key, Value: v.Value, Source: v.Source, Secret: v.Secret}
+	}
+	return settings
+}
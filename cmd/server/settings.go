@@ -0,0 +1,133 @@
+package main
+
+import "github.com/frankie-mur/proglog/internal/config"
+
+// The server's settings, by section. Each is a key of the config file, an
+// environment variable and a flag, e.g. cluster.bind_addr,
+// PROGLOG_BIND_ADDR and -cluster.bind-addr.
+var settings = []config.Setting{
+	// server
+	{Key: "server.data_dir", Env: "PROGLOG_DATA_DIR", Default: "data", Usage: "directory of the commit log and raft state"},
+	{Key: "server.rpc_addr", Env: "PROGLOG_RPC_ADDR", Default: ":8400", Usage: "address of the gRPC and raft listener"},
+	{Key: "server.advertise_rpc_addr", Env: "PROGLOG_ADVERTISE_RPC_ADDR", Usage: "RPC address peers and clients are told"},
+	{Key: "server.http_addr", Env: "PROGLOG_HTTP_ADDR", Default: ":8080", Usage: "address of the HTTP API"},
+	{Key: "server.kafka_addr", Env: "PROGLOG_KAFKA_ADDR", Usage: "address of the Kafka protocol listener"},
+	{Key: "server.advertise_kafka_addr", Env: "PROGLOG_ADVERTISE_KAFKA_ADDR", Usage: "Kafka address clients are told"},
+	{Key: "server.syslog_addr", Env: "PROGLOG_SYSLOG_ADDR", Usage: "address taking syslog over UDP and TCP"},
+	{Key: "server.syslog_topic", Env: "PROGLOG_SYSLOG_TOPIC", Usage: "topic of syslog messages"},
+	{Key: "server.fluent_addr", Env: "PROGLOG_FLUENT_ADDR", Usage: "address taking Fluentd's forward protocol"},
+	{Key: "server.fluent_tag_topics", Env: "PROGLOG_FLUENT_TAG_TOPICS", Kind: config.Pairs, Usage: "topics of Fluentd tag patterns"},
+	{Key: "server.mqtt_addr", Env: "PROGLOG_MQTT_ADDR", Usage: "address of the MQTT bridge"},
+	{Key: "server.otlp_logs_topic", Env: "PROGLOG_OTLP_LOGS_TOPIC", Usage: "topic of OTLP log exports"},
+	{Key: "server.link_backup_dir", Env: "PROGLOG_LINK_BACKUP_DIR", Usage: "directory of link backups, on the data directory's filesystem"},
+	{Key: "server.debug_addr", Env: "PROGLOG_DEBUG_ADDR", Usage: "address of the unauthenticated pprof listener"},
+	{Key: "server.admin_addr", Env: "PROGLOG_ADMIN_ADDR", Usage: "address of the admin routes and Admin service, off the HTTP API's and RPC's"},
+	{Key: "server.admin_tls_cert_file", Env: "PROGLOG_ADMIN_TLS_CERT_FILE", Usage: "certificate of the admin listener"},
+	{Key: "server.admin_tls_key_file", Env: "PROGLOG_ADMIN_TLS_KEY_FILE", Usage: "key of the admin listener's certificate"},
+	{Key: "server.metrics_addr", Env: "PROGLOG_METRICS_ADDR", Usage: "address of /metrics, off the HTTP API's"},
+	{Key: "server.metrics_tls_cert_file", Env: "PROGLOG_METRICS_TLS_CERT_FILE", Usage: "certificate of the metrics listener"},
+	{Key: "server.metrics_tls_key_file", Env: "PROGLOG_METRICS_TLS_KEY_FILE", Usage: "key of the metrics listener's certificate"},
+	{Key: "server.log_level", Env: "PROGLOG_LOG_LEVEL", Default: "info", Usage: "level of the process log, reloaded on SIGHUP"},
+	{Key: "server.log_format", Env: "PROGLOG_LOG_FORMAT", Default: "json", Usage: "format of the process log, json or console"},
+	{Key: "server.slow_request_threshold", Env: "PROGLOG_SLOW_REQUEST_THRESHOLD", Kind: config.Duration, Usage: "requests slower than this are logged"},
+	{Key: "server.disable_forwarding", Env: "PROGLOG_DISABLE_FORWARDING", Kind: config.Bool, Usage: "reject produces to followers rather than forward them"},
+	{Key: "server.auto_create_topics", Env: "PROGLOG_AUTO_CREATE_TOPICS", Kind: config.Bool, Usage: "create topics produced to"},
+	{Key: "server.min_offset_timeout", Env: "PROGLOG_MIN_OFFSET_TIMEOUT", Kind: config.Duration, Usage: "how long reads wait for a minimum offset"},
+	{Key: "server.append_batch_window", Env: "PROGLOG_APPEND_BATCH_WINDOW", Kind: config.Duration, Usage: "how long concurrent produces wait to be appended in a batch together, zero appends each alone"},
+	{Key: "server.append_batch_max_records", Env: "PROGLOG_APPEND_BATCH_MAX_RECORDS", Kind: config.Int, Usage: "records of concurrent produces batched together at most"},
+	{Key: "server.max_consume_wait", Env: "PROGLOG_MAX_CONSUME_WAIT", Kind: config.Duration, Usage: "how long fetches wait for records at most"},
+	{Key: "server.transaction_timeout", Env: "PROGLOG_TRANSACTION_TIMEOUT", Kind: config.Duration, Usage: "how long a transaction stays open before it's aborted"},
+	{Key: "server.disk_soft_limit", Env: "PROGLOG_DISK_SOFT_LIMIT", Kind: config.Float, Usage: "share of the data volume used past which the server warns"},
+	{Key: "server.disk_hard_limit", Env: "PROGLOG_DISK_HARD_LIMIT", Kind: config.Float, Usage: "share of the data volume used past which produces are rejected"},
+	{Key: "server.disk_check_interval", Env: "PROGLOG_DISK_CHECK_INTERVAL", Kind: config.Duration, Usage: "how often the data volume's use is checked"},
+	{Key: "server.quota.produce_bytes_per_second", Env: "PROGLOG_QUOTA_PRODUCE_BYTES_PER_SECOND", Kind: config.Float, Usage: "bytes a principal without a quota of its own produces a second at most"},
+	{Key: "server.quota.consume_bytes_per_second", Env: "PROGLOG_QUOTA_CONSUME_BYTES_PER_SECOND", Kind: config.Float, Usage: "bytes a principal without a quota of its own consumes a second at most"},
+	{Key: "server.quota.requests_per_second", Env: "PROGLOG_QUOTA_REQUESTS_PER_SECOND", Kind: config.Float, Usage: "requests a principal without a quota of its own makes a second at most"},
+	{Key: "server.quota.max_throttle", Env: "PROGLOG_QUOTA_MAX_THROTTLE", Kind: config.Duration, Usage: "longest a request past its quota is delayed before it's rejected"},
+	{Key: "server.scan.bytes_per_second", Env: "PROGLOG_SCAN_BYTES_PER_SECOND", Kind: config.Float, Usage: "bytes consumers read from partitions' history a second at most"},
+	{Key: "server.scan.connection_bytes_per_second", Env: "PROGLOG_SCAN_CONNECTION_BYTES_PER_SECOND", Kind: config.Float, Usage: "bytes each connection reads from partitions' history a second at most"},
+	{Key: "server.transforms.dir", Env: "PROGLOG_TRANSFORMS_DIR", Usage: "directory of the WebAssembly transforms topics name, <name>.wasm, reloaded on SIGHUP"},
+	{Key: "server.transforms.max_memory", Env: "PROGLOG_TRANSFORM_MAX_MEMORY", Kind: config.Int, Usage: "bytes of memory each transform instance uses at most"},
+	{Key: "server.transforms.timeout", Env: "PROGLOG_TRANSFORM_TIMEOUT", Kind: config.Duration, Usage: "how long a transform runs over a record at most"},
+	{Key: "server.routes", Env: "PROGLOG_ROUTES", Usage: "file of the rules routing records ingested to topics, reloaded on SIGHUP"},
+	{Key: "server.nats_bridge", Env: "PROGLOG_NATS_BRIDGE", Usage: "file of the NATS bridge"},
+	{Key: "server.kafka_mirror", Env: "PROGLOG_KAFKA_MIRROR", Usage: "file of the Kafka mirror"},
+	{Key: "server.parquet.topics", Env: "PROGLOG_PARQUET_TOPICS", Kind: config.List, Usage: "topics exported to Parquet"},
+	{Key: "server.parquet.dir", Env: "PROGLOG_PARQUET_DIR", Usage: "directory Parquet files are exported to"},
+	{Key: "server.parquet.s3_bucket", Env: "PROGLOG_PARQUET_S3_BUCKET", Usage: "bucket Parquet files are exported to"},
+	{Key: "server.parquet.s3_region", Env: "PROGLOG_PARQUET_S3_REGION", Usage: "region of the Parquet bucket"},
+	{Key: "server.parquet.s3_endpoint", Env: "PROGLOG_PARQUET_S3_ENDPOINT", Usage: "endpoint of the Parquet bucket"},
+	{Key: "server.parquet.s3_path_style", Env: "PROGLOG_PARQUET_S3_PATH_STYLE", Kind: config.Bool, Usage: "address the Parquet bucket by path"},
+	{Key: "server.parquet.prefix", Env: "PROGLOG_PARQUET_PREFIX", Usage: "prefix of Parquet objects"},
+	{Key: "server.parquet.interval", Env: "PROGLOG_PARQUET_INTERVAL", Kind: config.Duration, Usage: "how often topics are exported"},
+	{Key: "server.parquet.max_records", Env: "PROGLOG_PARQUET_MAX_RECORDS", Kind: config.Int, Usage: "records of a Parquet file at most"},
+
+	// log
+	{Key: "log.sync_on_append", Env: "PROGLOG_SYNC_ON_APPEND", Kind: config.Bool, Usage: "fsync every append"},
+	{Key: "log.sync_window", Env: "PROGLOG_SYNC_WINDOW", Kind: config.Duration, Usage: "how long synced appends wait to share an fsync"},
+	{Key: "log.batch", Env: "PROGLOG_BATCH", Kind: config.Bool, Usage: "store records appended together as one batch"},
+	{Key: "log.batch_codec", Env: "PROGLOG_BATCH_CODEC", Usage: "codec batches are compressed with, none, snappy or zstd"},
+	{Key: "log.io_uring", Env: "PROGLOG_IO_URING", Kind: config.Bool, Usage: "read, write and sync stores through io_uring, on Linux"},
+	{Key: "log.ack", Env: "PROGLOG_ACK", Usage: "acks of produces that don't say, all, leader or none"},
+	{Key: "log.min_insync_replicas", Env: "PROGLOG_MIN_INSYNC_REPLICAS", Kind: config.Int, Usage: "replicas an all-acked produce needs"},
+	{Key: "log.max_replication_lag", Env: "PROGLOG_MAX_REPLICATION_LAG", Kind: config.Duration, Usage: "lag of replicas counted in sync"},
+	{Key: "log.partitions", Env: "PROGLOG_PARTITIONS", Kind: config.Int, Usage: "partitions of topics that don't say"},
+	{Key: "log.topic_configs", Env: "PROGLOG_TOPIC_CONFIGS", Kind: config.Pairs, Usage: "settings of topics that don't override them, reloaded on SIGHUP"},
+	{Key: "log.read_ahead", Env: "PROGLOG_READ_AHEAD", Kind: config.Int, Usage: "bytes of stores read ahead of consumers reading in order"},
+	{Key: "log.read_ahead_max_bytes", Env: "PROGLOG_READ_AHEAD_MAX_BYTES", Kind: config.Int, Usage: "bytes read ahead held in memory at most"},
+	{Key: "log.index_cache", Env: "PROGLOG_INDEX_CACHE", Kind: config.Int, Usage: "sealed segment indexes kept memory mapped at most, all when unset"},
+	{Key: "log.cleanup_interval", Env: "PROGLOG_CLEANUP_INTERVAL", Kind: config.Duration, Usage: "how often retention and compaction run"},
+	{Key: "log.tenants", Env: "PROGLOG_TENANTS", Usage: "JSON file of the tenants' directories, quotas and topic configs, by name"},
+	{Key: "log.tier.dir", Env: "PROGLOG_TIER_DIR", Usage: "directory sealed segments are archived to"},
+	{Key: "log.tier.s3_bucket", Env: "PROGLOG_TIER_S3_BUCKET", Usage: "bucket sealed segments are archived to"},
+	{Key: "log.tier.s3_region", Env: "PROGLOG_TIER_S3_REGION", Usage: "region of the tier bucket"},
+	{Key: "log.tier.s3_endpoint", Env: "PROGLOG_TIER_S3_ENDPOINT", Usage: "endpoint of the tier bucket"},
+	{Key: "log.tier.s3_path_style", Env: "PROGLOG_TIER_S3_PATH_STYLE", Kind: config.Bool, Usage: "address the tier bucket by path"},
+	{Key: "log.tier.prefix", Env: "PROGLOG_TIER_PREFIX", Usage: "prefix of archived segments"},
+	{Key: "log.tier.local_segments", Env: "PROGLOG_TIER_LOCAL_SEGMENTS", Kind: config.Int, Usage: "sealed segments kept on disk"},
+	{Key: "log.tier.cache_segments", Env: "PROGLOG_TIER_CACHE_SEGMENTS", Kind: config.Int, Usage: "archived segments cached on disk"},
+	{Key: "log.faults", Env: "PROGLOG_FAULTS", Kind: config.List, Usage: "faults injected into segment file I/O, for chaos testing"},
+
+	// security
+	{Key: "security.vault.addr", Env: "VAULT_ADDR", Usage: "address of Vault, which issues the certificates and keeps the keys"},
+	{Key: "security.vault.token", Env: "VAULT_TOKEN", Usage: "token of Vault", Secret: true},
+	{Key: "security.vault.pki_mount", Env: "PROGLOG_VAULT_PKI_MOUNT", Default: "pki", Usage: "mount of Vault's PKI"},
+	{Key: "security.vault.pki_role", Env: "PROGLOG_VAULT_PKI_ROLE", Usage: "role certificates are issued for, unset to not issue them from Vault"},
+	{Key: "security.vault.common_name", Env: "PROGLOG_VAULT_COMMON_NAME", Usage: "common name of the certificate, the hostname by default"},
+	{Key: "security.vault.kv_mount", Env: "PROGLOG_VAULT_KV_MOUNT", Default: "secret", Usage: "mount of Vault's KV store"},
+	{Key: "security.vault.keys_path", Env: "PROGLOG_VAULT_KEYS_PATH", Usage: "path of the keys records are encrypted with, unset to not encrypt them"},
+	{Key: "security.jwt_secret", Env: "PROGLOG_JWT_SECRET", Usage: "secret JWTs are signed with", Secret: true},
+	{Key: "security.jwt_issuer", Env: "PROGLOG_JWT_ISSUER", Usage: "issuer JWTs must name"},
+	{Key: "security.api_keys", Env: "PROGLOG_API_KEYS", Kind: config.Pairs, Usage: "principals of API keys", Secret: true},
+	{Key: "security.admin_api_keys", Env: "PROGLOG_ADMIN_API_KEYS", Kind: config.Pairs, Usage: "principals of API keys of the admin listener, in place of the API's authentication", Secret: true},
+	{Key: "security.metrics_api_keys", Env: "PROGLOG_METRICS_API_KEYS", Kind: config.Pairs, Usage: "principals of API keys of the metrics listener, unauthenticated without", Secret: true},
+	{Key: "security.acl_policy", Env: "PROGLOG_ACL_POLICY", Usage: "file of the ACL policy, reloaded on SIGHUP"},
+	{Key: "security.allow_cidrs", Env: "PROGLOG_ALLOW_CIDRS", Kind: config.List, Usage: "networks clients may connect from"},
+	{Key: "security.deny_cidrs", Env: "PROGLOG_DENY_CIDRS", Kind: config.List, Usage: "networks clients may not connect from"},
+
+	// cluster
+	{Key: "cluster.node_name", Env: "PROGLOG_NODE_NAME", Usage: "name of the node, the hostname by default"},
+	{Key: "cluster.zone", Env: "PROGLOG_ZONE", Usage: "zone replicas are spread across"},
+	{Key: "cluster.bind_addr", Env: "PROGLOG_BIND_ADDR", Usage: "gossip address, joining a cluster"},
+	{Key: "cluster.start_join_addrs", Env: "PROGLOG_START_JOIN_ADDRS", Kind: config.List, Usage: "gossip addresses of members to join"},
+	{Key: "cluster.peers", Env: "PROGLOG_PEERS", Kind: config.Pairs, Usage: "RPC addresses of the cluster's nodes by name"},
+	{Key: "cluster.dns_name", Env: "PROGLOG_DNS_NAME", Usage: "DNS name of the cluster's nodes"},
+	{Key: "cluster.dns_port", Env: "PROGLOG_DNS_PORT", Kind: config.Int, Usage: "RPC port of nodes found in A records"},
+	{Key: "cluster.k8s_service", Env: "PROGLOG_K8S_SERVICE", Usage: "headless service of the StatefulSet"},
+	{Key: "cluster.discovery_interval", Env: "PROGLOG_DISCOVERY_INTERVAL", Kind: config.Duration, Usage: "how often peers are looked up"},
+	{Key: "cluster.bootstrap", Env: "PROGLOG_BOOTSTRAP", Kind: config.Bool, Usage: "bootstrap the cluster"},
+	{Key: "cluster.max_voters", Env: "PROGLOG_MAX_VOTERS", Kind: config.Int, Usage: "voters of raft at most, the others are non-voters"},
+	{Key: "cluster.drain_timeout", Env: "PROGLOG_DRAIN_TIMEOUT", Kind: config.Duration, Usage: "how long shutdown waits to hand off leaderships"},
+	{Key: "cluster.repair_interval", Env: "PROGLOG_REPAIR_INTERVAL", Kind: config.Duration, Usage: "how often followers check their log against the leader's"},
+
+	// telemetry
+	{Key: "telemetry.traces_exporter", Env: "PROGLOG_TRACES_EXPORTER", Usage: "otlp, console or none"},
+	{Key: "telemetry.metrics_exporter", Env: "PROGLOG_METRICS_EXPORTER", Usage: "otlp or none"},
+	{Key: "telemetry.otlp_protocol", Env: "PROGLOG_OTLP_PROTOCOL", Usage: "grpc or http/protobuf"},
+	{Key: "telemetry.otlp_endpoint", Env: "PROGLOG_OTLP_ENDPOINT", Usage: "collector's host:port or URL"},
+	{Key: "telemetry.otlp_headers", Env: "PROGLOG_OTLP_HEADERS", Kind: config.Pairs, Usage: "headers of exports", Secret: true},
+	{Key: "telemetry.otlp_insecure", Env: "PROGLOG_OTLP_INSECURE", Kind: config.Bool, Usage: "export without TLS"},
+	{Key: "telemetry.trace_record_headers", Env: "PROGLOG_TRACE_RECORD_HEADERS", Kind: config.Bool, Usage: "stamp traced produces' records with the trace context"},
+	{Key: "telemetry.trace_sample_ratio", Env: "PROGLOG_TRACE_SAMPLE_RATIO", Kind: config.Float, Usage: "fraction of new traces kept"},
+	{Key: "telemetry.metrics_interval", Env: "PROGLOG_METRICS_INTERVAL", Kind: config.Duration, Usage: "how often metrics are pushed"},
+}
@@ -0,0 +1,184 @@
+// Package embedded runs proglog inside the process that uses it, as a
+// durable local queue for tests, edge devices and applications that don't
+// want a server to run. Produces and consumes are function calls into the
+// same code a server runs, with nothing listening on the network.
+//
+// By default only the log runs. With Config.Agent set the whole agent
+// does, webhooks, group lag and the rest, serving gRPC and HTTP in memory,
+// which Dial reaches for the calls that stream.
+package embedded
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/client"
+	"github.com/frankie-mur/proglog/internal/agent"
+	"github.com/frankie-mur/proglog/internal/server"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type Config struct {
+	// Dir is the directory the log keeps its topics in, created if it
+	// doesn't exist
+	Dir string
+	// Agent runs the whole agent rather than just the log
+	Agent bool
+	// MaxStoreBytes and MaxIndexBytes bound segments' files, the log's
+	// defaults when zero
+	MaxStoreBytes uint64
+	MaxIndexBytes uint64
+	// ProduceInterceptors see each record produced before it's appended,
+	// in order
+	ProduceInterceptors []ProduceInterceptor
+}
+
+// ProduceInterceptor and Produce are the server's, see
+// server.ProduceInterceptor
+type (
+	ProduceInterceptor = server.ProduceInterceptor
+	Produce            = server.Produce
+)
+
+// Log is a log running in process. It's safe for concurrent use.
+type Log struct {
+	srv   api.LogServer
+	agent *agent.Agent
+	close func() error
+}
+
+// Open opens the log in the config's directory, or starts the agent on it
+func Open(config Config) (*Log, error) {
+	if config.Dir == "" {
+		return nil, errors.New("embedded: Dir is required")
+	}
+	var c log.Config
+	c.Segment.MaxStoreBytes = config.MaxStoreBytes
+	c.Segment.MaxIndexBytes = config.MaxIndexBytes
+	if config.Agent {
+		a, err := agent.New(agent.Config{
+			DataDir:  config.Dir,
+			Log:      c,
+			Server:   server.Config{ProduceInterceptors: config.ProduceInterceptors},
+			Embedded: true,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &Log{srv: a.LogServer(), agent: a, close: a.Shutdown}, nil
+	}
+	lock, err := log.LockDir(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	clog, err := log.NewTopics(config.Dir, c)
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return &Log{
+		srv: server.NewLogServer(&server.Config{
+			CommitLog:           clog,
+			ProduceInterceptors: config.ProduceInterceptors,
+		}),
+		close: func() error {
+			return errors.Join(clog.Close(), lock.Unlock())
+		},
+	}, nil
+}
+
+// Server is the Log service, for the calls Log has no method for, see
+// server.NewLogServer. Its errors are the api package's types, as the
+// client returns them.
+func (l *Log) Server() api.LogServer {
+	return l.srv
+}
+
+// Produce appends the value with the key to the topic, the default one
+// when empty, returning its partition and offset. Records with a key go
+// to the partition it hashes to, as the client sends them, others to
+// partition 0.
+func (l *Log) Produce(ctx context.Context, topic string, key, value []byte) (partition uint32, offset uint64, err error) {
+	req := &api.ProduceRequest{Topic: topic, Record: &api.Record{Key: key, Value: value}}
+	if key != nil {
+		res, err := l.srv.DescribeTopic(ctx, &api.DescribeTopicRequest{Name: topic})
+		if err != nil {
+			return 0, 0, err
+		}
+		req.Partition = client.PartitionForKey(key, res.Topic.Partitions)
+	}
+	res, err := l.srv.Produce(ctx, req)
+	if err != nil {
+		return 0, 0, err
+	}
+	return req.Partition, res.Offset, nil
+}
+
+// DeleteKey produces a tombstone for the key to the topic, deleting it as
+// client.Client.DeleteKey does, and returns the tombstone's partition and
+// offset
+func (l *Log) DeleteKey(ctx context.Context, topic string, key []byte) (partition uint32, offset uint64, err error) {
+	if len(key) == 0 {
+		return 0, 0, errors.New("embedded: DeleteKey needs a key")
+	}
+	return l.Produce(ctx, topic, key, nil)
+}
+
+// Consume reads the record at the offset in the topic's partition,
+// decompressing its value
+func (l *Log) Consume(ctx context.Context, topic string, partition uint32, offset uint64) (*api.Record, error) {
+	res, err := l.srv.Consume(ctx, &api.ConsumeRequest{Topic: topic, Partition: partition, Offset: offset})
+	if err != nil {
+		return nil, err
+	}
+	return decode(res.Record)
+}
+
+// Fetch reads the records from the offset in the topic's partition on,
+// waiting up to maxWait for one at the end of the partition, none if it
+// times out
+func (l *Log) Fetch(ctx context.Context, topic string, partition uint32, offset uint64, maxWait time.Duration) ([]*api.Record, error) {
+	res, err := l.srv.Consume(ctx, &api.ConsumeRequest{
+		Topic:     topic,
+		Partition: partition,
+		Offset:    offset,
+		MaxWaitMs: uint32(maxWait.Milliseconds()),
+		MinBytes:  1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, record := range res.Records {
+		if res.Records[i], err = decode(record); err != nil {
+			return nil, err
+		}
+	}
+	return res.Records, nil
+}
+
+// CreateTopic creates the topic with the partitions, 1 when zero
+func (l *Log) CreateTopic(ctx context.Context, name string, partitions uint32) error {
+	_, err := l.srv.CreateTopic(ctx, &api.CreateTopicRequest{Name: name, Partitions: partitions})
+	return err
+}
+
+// Dial connects to the agent's gRPC server in memory, for the calls that
+// stream, only when the agent runs
+func (l *Log) Dial() (*grpc.ClientConn, error) {
+	if l.agent == nil {
+		return nil, errors.New("embedded: only the agent is dialed")
+	}
+	return grpc.NewClient("passthrough:///embedded",
+		grpc.WithContextDialer(l.agent.DialContext),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+}
+
+// Close closes the log, syncing it to disk, or shuts the agent down
+func (l *Log) Close() error {
+	return l.close()
+}
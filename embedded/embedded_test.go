@@ -0,0 +1,121 @@
+package embedded
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLog(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	l, err := Open(Config{Dir: dir})
+	require.NoError(t, err)
+
+	// another process can't open the directory meanwhile
+	_, err = Open(Config{Dir: dir})
+	require.Error(t, err)
+
+	for i, value := range []string{"foo", "bar"} {
+		p, off, err := l.Produce(ctx, "", nil, []byte(value))
+		require.NoError(t, err)
+		require.Equal(t, uint32(0), p)
+		require.Equal(t, uint64(i), off)
+	}
+	record, err := l.Consume(ctx, "", 0, 1)
+	require.NoError(t, err)
+	require.Equal(t, "bar", string(record.Value))
+	_, err = l.Consume(ctx, "", 0, 2)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+
+	require.NoError(t, l.CreateTopic(ctx, "events", 4))
+	p, _, err := l.Produce(ctx, "events", []byte("user-1"), []byte("baz"))
+	require.NoError(t, err)
+	record, err = l.Consume(ctx, "events", p, 0)
+	require.NoError(t, err)
+	require.Equal(t, "user-1", string(record.Key))
+	// the key's tombstone goes to its partition
+	tp, off, err := l.DeleteKey(ctx, "events", []byte("user-1"))
+	require.NoError(t, err)
+	require.Equal(t, p, tp)
+	record, err = l.Consume(ctx, "events", p, off)
+	require.NoError(t, err)
+	require.Empty(t, record.Value)
+
+	// a fetch at the end waits for the next record
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		_, _, _ = l.Produce(ctx, "", nil, []byte("qux"))
+	}()
+	records, err := l.Fetch(ctx, "", 0, 2, 5*time.Second)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, "qux", string(records[0].Value))
+
+	_, err = l.Dial()
+	require.Error(t, err)
+	require.NoError(t, l.Close())
+
+	// the records outlast the process that wrote them
+	l, err = Open(Config{Dir: dir})
+	require.NoError(t, err)
+	defer l.Close()
+	record, err = l.Consume(ctx, "", 0, 2)
+	require.NoError(t, err)
+	require.Equal(t, "qux", string(record.Value))
+}
+
+func TestAgent(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	l, err := Open(Config{Dir: t.TempDir(), Agent: true})
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, off, err := l.Produce(ctx, "", nil, []byte("foo"))
+	require.NoError(t, err)
+
+	// streams go over the agent's in-memory listener
+	conn, err := l.Dial()
+	require.NoError(t, err)
+	defer conn.Close()
+	stream, err := api.NewLogClient(conn).ConsumeStream(ctx, &api.ConsumeRequest{Offset: off})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, "foo", string(res.Record.Value))
+}
+
+func TestSubscribe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	l, err := Open(Config{Dir: t.TempDir()})
+	require.NoError(t, err)
+	defer l.Close()
+
+	for _, value := range []string{"foo", "bar"} {
+		_, _, err := l.Produce(ctx, "", nil, []byte(value))
+		require.NoError(t, err)
+	}
+	_, err = l.Subscribe(ctx, 0, SubscribeOptions{Partition: 1})
+	require.ErrorAs(t, err, &api.ErrPartitionNotFound{})
+
+	// the history from the offset, then the tail
+	records, err := l.Subscribe(ctx, 1, SubscribeOptions{Buffer: 1, MaxWait: 50 * time.Millisecond})
+	require.NoError(t, err)
+	require.Equal(t, "bar", string((<-records).Value))
+	_, _, err = l.Produce(ctx, "", nil, []byte("baz"))
+	require.NoError(t, err)
+	record := <-records
+	require.Equal(t, uint64(2), record.Offset)
+	require.Equal(t, "baz", string(record.Value))
+
+	cancel()
+	require.Eventually(t, func() bool {
+		_, ok := <-records
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
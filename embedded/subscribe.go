@@ -0,0 +1,83 @@
+package embedded
+
+import (
+	"context"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"google.golang.org/protobuf/proto"
+)
+
+// SubscribeOptions are where a subscription reads and how it buffers
+type SubscribeOptions struct {
+	// Topic is empty for the default topic
+	Topic     string
+	Partition uint32
+	// Buffer is how many records the subscription reads ahead of the
+	// receiver, 64 when zero. Once it's full reading waits for the
+	// receiver to catch up.
+	Buffer int
+	// MaxWait is how long each read waits at the tail for a record, 1
+	// second when zero; it bounds how long cancelling the context takes to
+	// close the channel
+	MaxWait time.Duration
+	// OnError is called with the error a read fails with, but for the
+	// context's, before the channel closes
+	OnError func(error)
+}
+
+// Subscribe replays the partition's records from the offset on, then
+// follows its tail, sending them to the channel in order. The channel
+// closes when the context is done or a read fails. Subscribe fails at
+// once for a partition that doesn't exist or an offset before its oldest
+// record.
+func (l *Log) Subscribe(ctx context.Context, fromOffset uint64, opts SubscribeOptions) (<-chan *api.Record, error) {
+	if opts.Buffer <= 0 {
+		opts.Buffer = 64
+	}
+	if opts.MaxWait <= 0 {
+		opts.MaxWait = time.Second
+	}
+	// the first read, not waiting, finds what the subscription can't start
+	// from
+	records, err := l.Fetch(ctx, opts.Topic, opts.Partition, fromOffset, time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *api.Record, opts.Buffer)
+	go func() {
+		defer close(ch)
+		off := fromOffset
+		for {
+			for _, record := range records {
+				select {
+				case ch <- record:
+				case <-ctx.Done():
+					return
+				}
+				off = record.Offset + 1
+			}
+			if ctx.Err() != nil {
+				return
+			}
+			records, err = l.Fetch(ctx, opts.Topic, opts.Partition, off, opts.MaxWait)
+			if err != nil {
+				if ctx.Err() == nil && opts.OnError != nil {
+					opts.OnError(err)
+				}
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Decompresses the record, a copy as it may be the one the log caches
+func decode(record *api.Record) (*api.Record, error) {
+	if record.Codec == api.Codec_CODEC_NONE {
+		return record, nil
+	}
+	record = proto.Clone(record).(*api.Record)
+	return record, codec.Decompress(record)
+}
@@ -0,0 +1,980 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/discovery"
+	"github.com/frankie-mur/proglog/internal/server"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/hashicorp/raft"
+	"github.com/soheilhy/cmux"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// How long Shutdown lets in-flight requests finish before cutting them off
+var shutdownTimeout = 5 * time.Second
+
+// How many bytes an embedded agent's in-memory connections buffer each way
+const embeddedBufSize = 1 << 20
+
+// Agent runs one node: the log, the gRPC and HTTP servers and, when it's
+// part of a cluster, Raft replication and discovery of the other nodes
+type Agent struct {
+	Config
+
+	mux         cmux.CMux
+	log         commitLog
+	server      *grpc.Server
+	httpServer  *http.Server
+	kafkaServer *server.KafkaServer
+	syslog      *server.SyslogServer
+	fluent      *server.FluentServer
+	mqtt        *server.MQTTServer
+	debugServer *http.Server
+	// adminServer and metricsServer serve the HTTP API's admin and metrics
+	// routes on their own addresses, nil without them, adminServer with
+	// adminGRPC's Admin service
+	adminServer   *http.Server
+	adminGRPC     *grpc.Server
+	metricsServer *http.Server
+	membership    discovery.Discovery
+	logger        *zap.Logger
+	nodeID        string
+
+	rpcLn   net.Listener
+	httpLn  net.Listener
+	kafkaLn net.Listener
+	// syslogLn and syslogPC take syslog messages over TCP and UDP
+	syslogLn  net.Listener
+	syslogPC  net.PacketConn
+	fluentLn  net.Listener
+	mqttLn    net.Listener
+	adminLn   net.Listener
+	metricsLn net.Listener
+
+	stopRepair context.CancelFunc
+	repairDone chan struct{}
+	// stopGroupLag stops the groups' lag being scraped from the log
+	stopGroupLag func()
+	// stopWebhooks stops the subscriptions' records being delivered
+	stopWebhooks func()
+	// stopNATS stops the NATS bridge, nil without one
+	stopNATS func()
+	// stopKafkaMirror stops the Kafka mirror, nil without one
+	stopKafkaMirror func()
+	// stopParquet stops the Parquet exports, nil without them
+	stopParquet func()
+	// stopDiskQuota stops the data volume being watched, nil without a quota
+	stopDiskQuota func()
+
+	// dirLock keeps other processes out of the data directory
+	dirLock *log.DirLock
+	// auditLog keeps the audit trail under the data directory, nil when
+	// Server.Audit was given
+	auditLog *log.Log
+
+	shutdown     bool
+	shutdowns    chan struct{}
+	shutdownLock sync.Mutex
+}
+
+type commitLog interface {
+	server.CommitLog
+	io.Closer
+}
+
+type Config struct {
+	// ServerTLSConfig serves both RPC and HTTP, nil serves plaintext
+	ServerTLSConfig *tls.Config
+	// PeerTLSConfig dials other nodes, for Raft and forwarded produces
+	PeerTLSConfig *tls.Config
+	DataDir       string
+	// BindAddr is the address Serf gossips on to discover the other nodes.
+	// With it and the other discovery options all empty the node runs
+	// standalone, with a local log and no replication.
+	BindAddr string
+	// StaticPeers lists the cluster's nodes, discovering them without gossip
+	StaticPeers []discovery.Peer
+	// DNSName is polled for the cluster's nodes instead of gossiping, as an
+	// SRV record or, with DNSPort set, as A and AAAA records. Peers found
+	// this way are named by their RPC address, as NodeName defaults to.
+	DNSName string
+	DNSPort int
+	// KubernetesService is the headless service of the StatefulSet the node
+	// runs in, polled for the other pods instead of gossiping. NodeName
+	// must be the pod's name.
+	KubernetesService string
+	// DiscoveryInterval is how often static, DNS and Kubernetes discovery
+	// poll, defaults to 10 seconds
+	DiscoveryInterval time.Duration
+	// RPCAddr serves gRPC, and Raft when clustered
+	RPCAddr string
+	// AdvertiseRPCAddr is the RPC address other nodes and clients dial,
+	// defaults to the RPC listener's address
+	AdvertiseRPCAddr string
+	HTTPAddr         string
+	// KafkaAddr serves the Kafka protocol, see server.KafkaServer, empty
+	// disables it
+	KafkaAddr string
+	// AdvertiseKafkaAddr is the address Kafka clients are told to connect
+	// to, defaults to the Kafka listener's address
+	AdvertiseKafkaAddr string
+	// SyslogAddr takes syslog messages over UDP and TCP, both on this
+	// address, see server.SyslogServer; empty disables it
+	SyslogAddr string
+	// SyslogTopic is the topic syslog messages are appended to, defaults
+	// to the default topic
+	SyslogTopic string
+	// FluentAddr takes events over Fluentd's forward protocol, see
+	// server.FluentServer; empty disables it
+	FluentAddr string
+	// FluentTagTopics maps event tags to the topics they're appended to,
+	// see server.NewFluentServer
+	FluentTagTopics map[string]string
+	// MQTTAddr bridges MQTT clients to the topics, see server.MQTTServer;
+	// empty disables it
+	MQTTAddr string
+	// NATS bridges NATS subjects and topics, see server.BridgeNATS; nil
+	// disables it
+	NATS *server.NATSBridgeConfig
+	// KafkaMirror mirrors an external Kafka cluster's topics into topics,
+	// see server.MirrorKafka; nil disables it
+	KafkaMirror *server.KafkaMirrorConfig
+	// Parquet exports topics to Parquet files in an object store, see
+	// server.ExportParquet; nil disables it
+	Parquet *server.ParquetExportConfig
+	// DiskQuota rejects produces before the data volume fills, see
+	// server.WatchDiskQuota; nil disables it. Its Dir defaults to DataDir.
+	DiskQuota *server.DiskQuotaConfig
+	// DebugAddr serves expvar and debug stats unauthenticated, empty disables it
+	DebugAddr string
+	// AdminAddr moves the HTTP API's admin routes, under /admin with
+	// /audit and /debug/stats, off HTTPAddr, and the gRPC Admin service off
+	// RPCAddr, onto their own listener, so they can be kept to an
+	// internal-only interface. Empty leaves them where they are.
+	AdminAddr string
+	// AdminTLSConfig serves AdminAddr, nil serves plaintext
+	AdminTLSConfig *tls.Config
+	// AdminAuthenticator authenticates admin callers in place of
+	// Server.Authenticator, nil authenticates them as the API does
+	AdminAuthenticator auth.Authenticator
+	// MetricsAddr moves /metrics off HTTPAddr onto its own listener, empty
+	// leaves it on HTTPAddr
+	MetricsAddr string
+	// MetricsTLSConfig serves MetricsAddr, nil serves plaintext
+	MetricsTLSConfig *tls.Config
+	// MetricsAuthenticator authenticates scrapers, nil serves metrics
+	// unauthenticated
+	MetricsAuthenticator auth.Authenticator
+	// NodeName is the node's Raft server ID, defaults to AdvertiseRPCAddr.
+	// The data directory keeps the name it was first used with and won't
+	// start under another, see NodeID.
+	NodeName string
+	// Version is the build the node runs, registered with the cluster
+	Version string
+	// Zone is the rack or availability zone the node runs in. It's gossiped
+	// to the other nodes, which spread voters across zones when Log caps
+	// them with MaxVoters.
+	Zone string
+	// StartJoinAddrs are Serf bind addresses of nodes already in the cluster
+	StartJoinAddrs []string
+	Bootstrap      bool
+	// Log configures segments, encryption and syncing, the agent fills in Raft
+	Log log.Config
+	// Server configures authentication, authorization, logging and
+	// forwarding; the agent fills in the commit log and peer dial options
+	Server server.Config
+	// IPFilter screens connections to the RPC, HTTP, admin, metrics,
+	// Kafka, Fluent and MQTT ports and syslog senders, nil accepts all
+	IPFilter *server.IPFilter
+	// Embedded serves RPC and HTTP on in-memory listeners rather than the
+	// network, for agents run inside the process that uses them, see
+	// LogServer and DialContext. It can't be clustered.
+	Embedded bool
+	// RepairInterval is how often a follower compares its log with the
+	// leader's and rewrites ranges that differ, zero disables it
+	RepairInterval time.Duration
+	// DrainTimeout bounds how long Shutdown waits for a caught up voter to
+	// take over each partition the node leads, defaults to 10 seconds
+	DrainTimeout time.Duration
+}
+
+func New(config Config) (*Agent, error) {
+	a := &Agent{
+		Config:    config,
+		logger:    zap.L().Named("agent"),
+		shutdowns: make(chan struct{}),
+	}
+	if a.discoveryBackends() > 1 {
+		return nil, errors.New("agent: set only one of BindAddr, StaticPeers, DNSName and KubernetesService")
+	}
+	if a.Embedded && a.clustered() {
+		return nil, errors.New("agent: an embedded agent can't be clustered")
+	}
+	setup := []func() error{
+		a.setupDirLock,
+		a.setupListeners,
+		a.setupNode,
+		a.setupLog,
+		a.setupServer,
+		a.setupHTTPServer,
+		a.setupAdminServer,
+		a.setupMetricsServer,
+		a.setupKafkaServer,
+		a.setupSyslogServer,
+		a.setupFluentServer,
+		a.setupMQTTServer,
+		a.setupDebugServer,
+		a.setupMembership,
+		a.setupRepair,
+	}
+	for _, fn := range setup {
+		if err := fn(); err != nil {
+			a.close()
+			return nil, err
+		}
+	}
+	go a.serve()
+	return a, nil
+}
+
+func (a *Agent) setupListeners() error {
+	rpcLn, err := a.listen(a.Config.RPCAddr)
+	if err != nil {
+		return err
+	}
+	a.rpcLn = a.filter(rpcLn)
+	httpLn, err := a.listen(a.Config.HTTPAddr)
+	if err != nil {
+		return err
+	}
+	a.httpLn = a.filter(httpLn)
+	if a.KafkaAddr != "" {
+		kafkaLn, err := net.Listen("tcp", a.KafkaAddr)
+		if err != nil {
+			return err
+		}
+		a.kafkaLn = a.filter(kafkaLn)
+		if a.AdvertiseKafkaAddr == "" {
+			a.AdvertiseKafkaAddr = kafkaLn.Addr().String()
+		}
+	}
+	if a.SyslogAddr != "" {
+		syslogLn, err := net.Listen("tcp", a.SyslogAddr)
+		if err != nil {
+			return err
+		}
+		a.syslogLn = a.filter(syslogLn)
+		// on the port TCP got, when it's left to the system
+		syslogPC, err := net.ListenPacket("udp", syslogLn.Addr().String())
+		if err != nil {
+			return err
+		}
+		a.syslogPC = syslogPC
+		if a.IPFilter != nil {
+			a.syslogPC = a.IPFilter.PacketConn(syslogPC)
+		}
+	}
+	if a.FluentAddr != "" {
+		fluentLn, err := net.Listen("tcp", a.FluentAddr)
+		if err != nil {
+			return err
+		}
+		a.fluentLn = a.filter(fluentLn)
+	}
+	if a.MQTTAddr != "" {
+		mqttLn, err := net.Listen("tcp", a.MQTTAddr)
+		if err != nil {
+			return err
+		}
+		a.mqttLn = a.filter(mqttLn)
+	}
+	if a.AdminAddr != "" {
+		adminLn, err := net.Listen("tcp", a.AdminAddr)
+		if err != nil {
+			return err
+		}
+		a.adminLn = a.filter(adminLn)
+	}
+	if a.MetricsAddr != "" {
+		metricsLn, err := net.Listen("tcp", a.MetricsAddr)
+		if err != nil {
+			return err
+		}
+		a.metricsLn = a.filter(metricsLn)
+	}
+	if a.AdvertiseRPCAddr == "" {
+		a.AdvertiseRPCAddr = rpcLn.Addr().String()
+	}
+	if a.NodeName == "" {
+		a.NodeName = a.AdvertiseRPCAddr
+	}
+	if a.DrainTimeout == 0 {
+		a.DrainTimeout = 10 * time.Second
+	}
+	if a.clustered() {
+		a.mux = cmux.New(a.rpcLn)
+	}
+	return nil
+}
+
+// Listens on the TCP address, or in memory when the agent's embedded
+func (a *Agent) listen(addr string) (net.Listener, error) {
+	if a.Embedded {
+		return bufconn.Listen(embeddedBufSize), nil
+	}
+	return net.Listen("tcp", addr)
+}
+
+func (a *Agent) filter(ln net.Listener) net.Listener {
+	// in-memory connections have no address to screen
+	if a.IPFilter == nil || a.Embedded {
+		return ln
+	}
+	return a.IPFilter.Listener(ln)
+}
+
+func (a *Agent) clustered() bool {
+	return a.discoveryBackends() > 0
+}
+
+func (a *Agent) discoveryBackends() int {
+	n := 0
+	for _, set := range []bool{
+		a.BindAddr != "",
+		len(a.StaticPeers) > 0,
+		a.DNSName != "",
+		a.KubernetesService != "",
+	} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+func (a *Agent) setupLog() error {
+	// the log logs through the server's logger unless it's given its own
+	if a.Config.Log.Logger == nil && a.Server.Logger != nil {
+		a.Config.Log.Logger = a.Server.Logger.Named("log")
+	}
+	// nodes sharing a bucket archive under their own names
+	if a.Config.Log.Tier.Store != nil && a.Config.Log.Tier.Prefix == "" {
+		a.Config.Log.Tier.Prefix = a.NodeName + "/"
+	}
+	if !a.clustered() {
+		var err error
+		a.log, err = log.NewTopics(a.DataDir, a.Config.Log)
+		return err
+	}
+	// Raft connections start with the RaftRPC byte, or RaftPartitionRPC
+	// for partitions but the first, everything else is gRPC
+	raftLn := a.mux.Match(func(reader io.Reader) bool {
+		b := make([]byte, 1)
+		if _, err := reader.Read(b); err != nil {
+			return false
+		}
+		return bytes.Equal(b, []byte{byte(log.RaftRPC)}) ||
+			bytes.Equal(b, []byte{byte(log.RaftPartitionRPC)})
+	})
+	c := a.Config.Log
+	c.Raft.StreamLayer = log.NewStreamLayer(
+		raftLn,
+		a.ServerTLSConfig,
+		a.PeerTLSConfig,
+	)
+	c.Raft.LocalID = raft.ServerID(a.NodeName)
+	c.Raft.BindAddr = a.AdvertiseRPCAddr
+	c.Raft.Bootstrap = a.Bootstrap
+	c.Raft.Zone = a.Zone
+	c.Raft.NodeID = a.nodeID
+	c.Raft.Version = a.Version
+	c.Raft.HTTPAddr = a.httpLn.Addr().String()
+	plog, err := log.NewPartitionedLog(a.DataDir, c)
+	if err != nil {
+		return err
+	}
+	a.log = plog
+	if a.Bootstrap {
+		return plog.WaitForLeader(3 * time.Second)
+	}
+	return nil
+}
+
+func (a *Agent) setupServer() error {
+	a.Server.CommitLog = a.log
+	if a.Server.Audit == nil {
+		c := log.Config{SyncOnAppend: true, Logger: a.Config.Log.Logger}
+		c.Segment.MaxStoreBytes = a.Config.Log.Segment.MaxStoreBytes
+		c.Segment.MaxIndexBytes = a.Config.Log.Segment.MaxIndexBytes
+		var err error
+		a.auditLog, err = log.NewLog(filepath.Join(a.DataDir, "audit"), c)
+		if err != nil {
+			return err
+		}
+		a.Server.Audit = server.NewLogAuditor(a.auditLog)
+	}
+	if a.Server.Version == "" {
+		a.Server.Version = a.Version
+	}
+	if a.Server.Features == nil {
+		a.Server.Features = make(map[string]bool)
+	}
+	maps.Copy(a.Server.Features, map[string]bool{
+		"tls":            a.ServerTLSConfig != nil,
+		"peer_tls":       a.PeerTLSConfig != nil,
+		"tiered_storage": a.Log.Tier.Store != nil,
+		"encryption":     a.Log.Keyring != nil,
+		"kafka":          a.KafkaAddr != "",
+		"syslog":         a.SyslogAddr != "",
+		"fluent":         a.FluentAddr != "",
+		"mqtt":           a.MQTTAddr != "",
+		"nats":           a.NATS != nil,
+		"kafka_mirror":   a.KafkaMirror != nil,
+		"parquet":        a.Parquet != nil,
+		"disk_quota":     a.DiskQuota != nil,
+		"ip_filter":      a.IPFilter != nil,
+	})
+	if a.PeerTLSConfig != nil {
+		a.Server.PeerDialOptions = append(a.Server.PeerDialOptions,
+			grpc.WithTransportCredentials(credentials.NewTLS(a.PeerTLSConfig)),
+		)
+	}
+	var opts []grpc.ServerOption
+	if a.ServerTLSConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(a.ServerTLSConfig)))
+	}
+	services := server.AllServices
+	if a.adminLn != nil {
+		services &^= server.AdminService
+	}
+	var err error
+	a.server, err = server.NewGRPCServerServices(&a.Server, services, nil, opts...)
+	if err != nil {
+		return err
+	}
+	a.stopGroupLag = server.ReportGroupLag(&a.Server)
+	a.stopWebhooks = server.DeliverWebhooks(&a.Server)
+	if a.NATS != nil {
+		a.stopNATS = server.BridgeNATS(a.NATS, &a.Server)
+	}
+	if a.KafkaMirror != nil {
+		a.stopKafkaMirror = server.MirrorKafka(a.KafkaMirror, &a.Server)
+	}
+	if a.Parquet != nil {
+		a.stopParquet = server.ExportParquet(a.Parquet, &a.Server)
+	}
+	if a.DiskQuota != nil {
+		quota := *a.DiskQuota
+		if quota.Dir == "" {
+			quota.Dir = a.DataDir
+		}
+		a.stopDiskQuota = server.WatchDiskQuota(&quota, &a.Server)
+	}
+	grpcLn := a.rpcLn
+	if a.clustered() {
+		grpcLn = a.mux.Match(cmux.Any())
+	}
+	go func() {
+		a.logger.Info("serving rpc",
+			zap.String("addr", a.rpcLn.Addr().String()),
+			zap.Bool("tls", a.ServerTLSConfig != nil),
+		)
+		if err := a.server.Serve(grpcLn); err != nil {
+			a.fail("rpc server stopped", err)
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) setupHTTPServer() error {
+	routes := server.AllRoutes
+	if a.adminLn != nil {
+		routes &^= server.AdminRoutes
+	}
+	if a.metricsLn != nil {
+		routes &^= server.MetricsRoutes
+	}
+	a.httpServer = server.NewHTTPServerRoutes(a.httpLn.Addr().String(), &a.Server, routes, nil)
+	a.serveHTTP("http", a.httpServer, a.httpLn, a.ServerTLSConfig)
+	return nil
+}
+
+func (a *Agent) setupAdminServer() error {
+	if a.adminLn == nil {
+		return nil
+	}
+	var err error
+	a.adminGRPC, err = server.NewGRPCServerServices(&a.Server, server.AdminService, a.AdminAuthenticator)
+	if err != nil {
+		return err
+	}
+	a.adminServer = server.NewHTTPServerRoutes(a.adminLn.Addr().String(), &a.Server, server.AdminRoutes, a.AdminAuthenticator)
+	// the Admin service shares the listener, its clients dial HTTP/2
+	// without TLS when it's served plaintext
+	a.adminServer.Handler = withGRPC(a.adminGRPC, a.adminServer.Handler)
+	a.adminServer.Protocols = new(http.Protocols)
+	a.adminServer.Protocols.SetHTTP1(true)
+	a.adminServer.Protocols.SetHTTP2(true)
+	a.adminServer.Protocols.SetUnencryptedHTTP2(true)
+	a.serveHTTP("admin", a.adminServer, a.adminLn, a.AdminTLSConfig)
+	return nil
+}
+
+// Hands gRPC calls to srv and the rest of the requests to h
+func withGRPC(srv *grpc.Server, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+			srv.ServeHTTP(w, r)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (a *Agent) setupMetricsServer() error {
+	if a.metricsLn == nil {
+		return nil
+	}
+	authenticator := a.MetricsAuthenticator
+	if authenticator == nil {
+		authenticator = auth.AuthenticatorFunc(func(context.Context, auth.Credentials) (string, error) {
+			return auth.Anonymous, nil
+		})
+	}
+	a.metricsServer = server.NewHTTPServerRoutes(a.metricsLn.Addr().String(), &a.Server, server.MetricsRoutes, authenticator)
+	a.serveHTTP("metrics", a.metricsServer, a.metricsLn, a.MetricsTLSConfig)
+	return nil
+}
+
+// Serves srv on ln in the background, over TLS when tlsConfig's set,
+// failing the agent if it stops before it's shut down
+func (a *Agent) serveHTTP(name string, srv *http.Server, ln net.Listener, tlsConfig *tls.Config) {
+	srv.TLSConfig = tlsConfig
+	go func() {
+		a.logger.Info("serving "+name,
+			zap.String("addr", ln.Addr().String()),
+			zap.Bool("tls", tlsConfig != nil),
+		)
+		var err error
+		if tlsConfig != nil {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			a.fail(name+" server stopped", err)
+		}
+	}()
+}
+
+func (a *Agent) setupKafkaServer() error {
+	if a.kafkaLn == nil {
+		return nil
+	}
+	var err error
+	a.kafkaServer, err = server.NewKafkaServer(a.AdvertiseKafkaAddr, &a.Server)
+	if err != nil {
+		return err
+	}
+	ln := a.kafkaLn
+	if a.ServerTLSConfig != nil {
+		ln = tls.NewListener(ln, a.ServerTLSConfig)
+	}
+	go func() {
+		a.logger.Info("serving kafka",
+			zap.String("addr", a.kafkaLn.Addr().String()),
+			zap.Bool("tls", a.ServerTLSConfig != nil),
+		)
+		if err := a.kafkaServer.Serve(ln); !errors.Is(err, server.ErrKafkaServerClosed) {
+			a.fail("kafka server stopped", err)
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) setupSyslogServer() error {
+	if a.syslogLn == nil {
+		return nil
+	}
+	a.syslog = server.NewSyslogServer(a.SyslogTopic, &a.Server)
+	a.logger.Info("serving syslog", zap.String("addr", a.syslogLn.Addr().String()))
+	go func() {
+		if err := a.syslog.ServeTCP(a.syslogLn); !errors.Is(err, server.ErrSyslogServerClosed) {
+			a.fail("syslog tcp server stopped", err)
+		}
+	}()
+	go func() {
+		if err := a.syslog.ServeUDP(a.syslogPC); !errors.Is(err, server.ErrSyslogServerClosed) {
+			a.fail("syslog udp server stopped", err)
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) setupFluentServer() error {
+	if a.fluentLn == nil {
+		return nil
+	}
+	a.fluent = server.NewFluentServer(a.FluentTagTopics, &a.Server)
+	ln := a.fluentLn
+	if a.ServerTLSConfig != nil {
+		ln = tls.NewListener(ln, a.ServerTLSConfig)
+	}
+	go func() {
+		a.logger.Info("serving fluent forward",
+			zap.String("addr", a.fluentLn.Addr().String()),
+			zap.Bool("tls", a.ServerTLSConfig != nil),
+		)
+		if err := a.fluent.Serve(ln); !errors.Is(err, server.ErrFluentServerClosed) {
+			a.fail("fluent server stopped", err)
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) setupMQTTServer() error {
+	if a.mqttLn == nil {
+		return nil
+	}
+	a.mqtt = server.NewMQTTServer(&a.Server)
+	ln := a.mqttLn
+	if a.ServerTLSConfig != nil {
+		ln = tls.NewListener(ln, a.ServerTLSConfig)
+	}
+	go func() {
+		a.logger.Info("serving mqtt",
+			zap.String("addr", a.mqttLn.Addr().String()),
+			zap.Bool("tls", a.ServerTLSConfig != nil),
+		)
+		if err := a.mqtt.Serve(ln); !errors.Is(err, server.ErrMQTTServerClosed) {
+			a.fail("mqtt server stopped", err)
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) setupDebugServer() error {
+	if a.DebugAddr == "" {
+		return nil
+	}
+	ln, err := net.Listen("tcp", a.DebugAddr)
+	if err != nil {
+		return err
+	}
+	a.debugServer = server.NewDebugServer(a.DebugAddr)
+	go func() {
+		a.logger.Info("serving debug", zap.String("addr", ln.Addr().String()))
+		if err := a.debugServer.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			a.logger.Error("debug server stopped", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) setupMembership() error {
+	if !a.clustered() {
+		return nil
+	}
+	handler := a.log.(*log.PartitionedLog)
+	switch {
+	case len(a.StaticPeers) > 0:
+		a.membership = discovery.NewStatic(handler, discovery.StaticConfig{
+			NodeName: a.NodeName,
+			RPCAddr:  a.AdvertiseRPCAddr,
+			Peers:    a.StaticPeers,
+			Interval: a.DiscoveryInterval,
+		})
+	case a.DNSName != "":
+		a.membership = discovery.NewDNS(handler, discovery.DNSConfig{
+			NodeName: a.NodeName,
+			RPCAddr:  a.AdvertiseRPCAddr,
+			Name:     a.DNSName,
+			Port:     a.DNSPort,
+			Interval: a.DiscoveryInterval,
+		})
+	case a.KubernetesService != "":
+		a.membership = discovery.NewKubernetes(handler, discovery.KubernetesConfig{
+			PodName:  a.NodeName,
+			Service:  a.KubernetesService,
+			Interval: a.DiscoveryInterval,
+		})
+	default:
+		membership, err := discovery.New(handler, discovery.Config{
+			NodeName: a.NodeName,
+			BindAddr: a.BindAddr,
+			Tags: map[string]string{
+				"rpc_addr":  a.AdvertiseRPCAddr,
+				"zone":      a.Zone,
+				"node_id":   a.nodeID,
+				"version":   a.Version,
+				"http_addr": a.httpLn.Addr().String(),
+			},
+			StartJoinAddrs: a.StartJoinAddrs,
+		})
+		if err != nil {
+			return err
+		}
+		a.membership = membership
+	}
+	return nil
+}
+
+func (a *Agent) serve() {
+	if a.mux == nil {
+		return
+	}
+	if err := a.mux.Serve(); err != nil {
+		a.fail("rpc listener stopped", err)
+	}
+}
+
+// Shuts the agent down after one of its servers stops unexpectedly
+func (a *Agent) fail(msg string, err error) {
+	a.shutdownLock.Lock()
+	shutdown := a.shutdown
+	a.shutdownLock.Unlock()
+	if shutdown {
+		return
+	}
+	a.logger.Error(msg, zap.Error(err))
+	if err := a.Shutdown(); err != nil {
+		a.logger.Error("shutting down", zap.Error(err))
+	}
+}
+
+// Done is closed once the agent has shut down
+func (a *Agent) Done() <-chan struct{} {
+	return a.shutdowns
+}
+
+// Live returns an error if the agent has shut down, or if its log doesn't
+// answer a read within timeout, as it wouldn't with its lock held by a hung
+// goroutine. A node draining is still live.
+func (a *Agent) Live(timeout time.Duration) error {
+	// not the lock, Shutdown holds it as it drains
+	select {
+	case <-a.shutdowns:
+		return errors.New("agent has shut down")
+	default:
+	}
+	read := make(chan struct{})
+	go func() {
+		// the record doesn't matter, only that the read gets the log's lock
+		_, _ = a.log.Read(0)
+		close(read)
+	}()
+	select {
+	case <-read:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("log didn't answer a read in %s", timeout)
+	}
+}
+
+// LogServer is the node's Log service, for callers in the same process to
+// call directly, see server.NewLogServer
+func (a *Agent) LogServer() api.LogServer {
+	return server.NewLogServer(&a.Server)
+}
+
+// DialContext connects to the embedded agent's RPC listener, as a gRPC
+// dialer: grpc.WithContextDialer(a.DialContext) with the passthrough
+// scheme reaches the agent over memory, streams included
+func (a *Agent) DialContext(ctx context.Context, _ string) (net.Conn, error) {
+	ln, ok := a.rpcLn.(*bufconn.Listener)
+	if !ok {
+		return nil, errors.New("agent: only an embedded agent is dialed in memory")
+	}
+	return ln.DialContext(ctx)
+}
+
+// SetTopicDefaults changes the settings of topics that don't override them,
+// on this node only, without reopening the log
+func (a *Agent) SetTopicDefaults(c log.TopicConfig) {
+	a.log.(interface{ SetTopicDefaults(log.TopicConfig) }).SetTopicDefaults(c)
+}
+
+// Shutdown drains the node, handing off the partitions it leads, and
+// leaves the cluster, then drains the servers and closes the log, syncing
+// it to disk. Produces reaching this node meanwhile are forwarded to the
+// new leaders. It's safe to call more than once.
+func (a *Agent) Shutdown() error {
+	a.shutdownLock.Lock()
+	defer a.shutdownLock.Unlock()
+	if a.shutdown {
+		return nil
+	}
+	a.shutdown = true
+	defer close(a.shutdowns)
+
+	var errs []error
+	if a.stopRepair != nil {
+		a.stopRepair()
+		<-a.repairDone
+	}
+	if plog, ok := a.log.(*log.PartitionedLog); ok {
+		// with Serf the new leaders remove this node from Raft once it's
+		// reported left, static and DNS peers stay members until dropped
+		// from the list
+		ctx, cancel := context.WithTimeout(context.Background(), a.DrainTimeout)
+		if err := plog.Drain(ctx); err != nil {
+			a.logger.Error("draining partitions", zap.Error(err))
+		}
+		cancel()
+	}
+	if a.membership != nil {
+		errs = append(errs, a.membership.Leave())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	errs = append(errs, a.httpServer.Shutdown(ctx))
+	if a.adminServer != nil {
+		errs = append(errs, a.adminServer.Shutdown(ctx))
+		// cancels the admin calls still going
+		a.adminGRPC.Stop()
+	}
+	if a.metricsServer != nil {
+		errs = append(errs, a.metricsServer.Shutdown(ctx))
+	}
+	if a.kafkaServer != nil {
+		errs = append(errs, a.kafkaServer.Close())
+	}
+	if a.syslog != nil {
+		errs = append(errs, a.syslog.Close())
+	}
+	if a.fluent != nil {
+		errs = append(errs, a.fluent.Close())
+	}
+	if a.mqtt != nil {
+		errs = append(errs, a.mqtt.Close())
+	}
+	if a.debugServer != nil {
+		errs = append(errs, a.debugServer.Shutdown(ctx))
+	}
+	a.stopServer(ctx)
+	a.stopGroupLag()
+	a.stopWebhooks()
+	if a.stopNATS != nil {
+		a.stopNATS()
+	}
+	if a.stopKafkaMirror != nil {
+		a.stopKafkaMirror()
+	}
+	if a.stopParquet != nil {
+		a.stopParquet()
+	}
+	if a.stopDiskQuota != nil {
+		a.stopDiskQuota()
+	}
+	errs = append(errs, a.log.Close())
+	if a.auditLog != nil {
+		errs = append(errs, a.auditLog.Close())
+	}
+	if a.mux != nil {
+		// cmux leaves the listener it shares open
+		a.mux.Close()
+		a.rpcLn.Close()
+	}
+	errs = append(errs, a.dirLock.Unlock())
+	return errors.Join(errs...)
+}
+
+// Lets in-flight RPCs finish until ctx is done, then cancels the rest,
+// such as consumers waiting at the end of the log
+func (a *Agent) stopServer(ctx context.Context) {
+	stopped := make(chan struct{})
+	go func() {
+		a.server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		a.server.Stop()
+	}
+}
+
+// Releases whatever New set up before it failed
+func (a *Agent) close() {
+	if a.server != nil {
+		a.server.Stop()
+	}
+	if a.stopGroupLag != nil {
+		a.stopGroupLag()
+	}
+	if a.stopWebhooks != nil {
+		a.stopWebhooks()
+	}
+	if a.stopNATS != nil {
+		a.stopNATS()
+	}
+	if a.stopKafkaMirror != nil {
+		a.stopKafkaMirror()
+	}
+	if a.stopParquet != nil {
+		a.stopParquet()
+	}
+	if a.stopDiskQuota != nil {
+		a.stopDiskQuota()
+	}
+	if a.httpServer != nil {
+		a.httpServer.Close()
+	}
+	if a.adminServer != nil {
+		a.adminServer.Close()
+		a.adminGRPC.Stop()
+	}
+	if a.metricsServer != nil {
+		a.metricsServer.Close()
+	}
+	if a.kafkaServer != nil {
+		a.kafkaServer.Close()
+	}
+	if a.syslog != nil {
+		a.syslog.Close()
+	}
+	if a.fluent != nil {
+		a.fluent.Close()
+	}
+	if a.mqtt != nil {
+		a.mqtt.Close()
+	}
+	if a.debugServer != nil {
+		a.debugServer.Close()
+	}
+	if a.log != nil {
+		a.log.Close()
+	}
+	if a.auditLog != nil {
+		a.auditLog.Close()
+	}
+	for _, ln := range []net.Listener{a.rpcLn, a.httpLn, a.kafkaLn, a.syslogLn, a.fluentLn, a.mqttLn, a.adminLn, a.metricsLn} {
+		if ln != nil {
+			ln.Close()
+		}
+	}
+	if a.syslogPC != nil {
+		a.syslogPC.Close()
+	}
+	if a.dirLock != nil {
+		a.dirLock.Unlock()
+	}
+}
@@ -0,0 +1,511 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/discovery"
+	_ "github.com/frankie-mur/proglog/internal/loadbalance"
+	"github.com/frankie-mur/proglog/internal/server"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestAgent(t *testing.T) {
+	var agents []*Agent
+	for i := 0; i < 3; i++ {
+		dataDir, err := os.MkdirTemp("", "agent-test-log")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		var startJoinAddrs []string
+		if i != 0 {
+			startJoinAddrs = append(startJoinAddrs, agents[0].BindAddr)
+		}
+		config := Config{
+			NodeName:       fmt.Sprintf("%d", i),
+			StartJoinAddrs: startJoinAddrs,
+			BindAddr:       fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+			RPCAddr:        "127.0.0.1:0",
+			HTTPAddr:       "127.0.0.1:0",
+			DataDir:        dataDir,
+			Bootstrap:      i == 0,
+			RepairInterval: 50 * time.Millisecond,
+			Version:        "test",
+		}
+		config.Log.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Log.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Log.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Log.Raft.CommitTimeout = 5 * time.Millisecond
+		agent, err := New(config)
+		require.NoError(t, err)
+		agents = append(agents, agent)
+	}
+	defer func() {
+		for _, agent := range agents {
+			require.NoError(t, agent.Shutdown())
+		}
+	}()
+	// wait until the followers have joined
+	leaderClient := client(t, "proglog:///"+agents[0].AdvertiseRPCAddr)
+	require.Eventually(t, func() bool {
+		res, err := leaderClient.GetServers(context.Background(), &api.GetServersRequest{})
+		return err == nil && len(res.Servers) == 3
+	}, 3*time.Second, 50*time.Millisecond)
+	// each registered its node ID as it joined
+	servers, err := leaderClient.GetServers(context.Background(), &api.GetServersRequest{})
+	require.NoError(t, err)
+	for _, server := range servers.Servers {
+		var agent *Agent
+		for _, a := range agents {
+			if a.NodeName == server.Id {
+				agent = a
+			}
+		}
+		require.NotEmpty(t, server.NodeId)
+		require.Equal(t, agent.NodeID(), server.NodeId)
+		require.Equal(t, "test", server.Version)
+		require.Equal(t, agent.httpLn.Addr().String(), server.HttpAddr)
+	}
+
+	produceResponse, err := leaderClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("foo"),
+			},
+		},
+	)
+	require.NoError(t, err)
+
+	// a produce to a follower is forwarded to the leader
+	followerClient := client(t, agents[1].AdvertiseRPCAddr)
+	forwarded, err := followerClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("bar"),
+			},
+		},
+	)
+	require.NoError(t, err)
+	require.Equal(t, produceResponse.Offset+1, forwarded.Offset)
+
+	for _, agent := range agents {
+		c := client(t, agent.AdvertiseRPCAddr)
+		require.Eventually(t, func() bool {
+			res, err := c.Consume(
+				context.Background(),
+				&api.ConsumeRequest{Offset: forwarded.Offset},
+			)
+			return err == nil && string(res.Record.Value) == "bar"
+		}, time.Second, 10*time.Millisecond)
+		res, err := c.Consume(
+			context.Background(),
+			&api.ConsumeRequest{Offset: produceResponse.Offset},
+		)
+		require.NoError(t, err)
+		require.Equal(t, []byte("foo"), res.Record.Value)
+	}
+
+	// topics reach every server, each partition replicated by its own group
+	_, err = leaderClient.CreateTopic(context.Background(), &api.CreateTopicRequest{Name: "events", Partitions: 2})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		_, err := followerClient.Produce(context.Background(), &api.ProduceRequest{
+			Record:    &api.Record{Value: []byte("event")},
+			Topic:     "events",
+			Partition: 1,
+		})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	for _, agent := range agents {
+		c := client(t, agent.AdvertiseRPCAddr)
+		require.Eventually(t, func() bool {
+			res, err := c.Consume(context.Background(), &api.ConsumeRequest{Topic: "events", Partition: 1})
+			return err == nil && string(res.Record.Value) == "event"
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// group offsets committed to a follower reach every server
+	require.Eventually(t, func() bool {
+		_, err := followerClient.CommitGroupOffsets(context.Background(), &api.CommitGroupOffsetsRequest{
+			Group:   "readers",
+			Offsets: []*api.GroupOffset{{Topic: "events", Partition: 1, Offset: 1}},
+		})
+		return err == nil
+	}, 3*time.Second, 50*time.Millisecond)
+	for _, agent := range agents {
+		c := client(t, agent.AdvertiseRPCAddr)
+		require.Eventually(t, func() bool {
+			res, err := c.FetchGroupOffsets(context.Background(), &api.FetchGroupOffsetsRequest{
+				Group:      "readers",
+				Partitions: []*api.GroupOffset{{Topic: "events", Partition: 1}},
+			})
+			return err == nil && res.Offsets[0].Found && res.Offsets[0].Offset == 1
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// the offsets topic's leader coordinates the groups, the others name it
+	join := &api.JoinGroupRequest{Group: "readers", Topics: []string{"events"}, SessionTimeoutMs: 200}
+	var coordinator api.LogClient
+	for _, agent := range agents {
+		c := client(t, agent.AdvertiseRPCAddr)
+		res, err := c.JoinGroup(context.Background(), join)
+		if err == nil {
+			require.Nil(t, coordinator)
+			coordinator, join.MemberId = c, res.MemberId
+			continue
+		}
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	}
+	require.NotNil(t, coordinator)
+	require.Eventually(t, func() bool {
+		res, err := coordinator.JoinGroup(context.Background(), join)
+		require.NoError(t, err)
+		return len(res.Assignments) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+
+	// the leader hands off leadership as it shuts down and the new leader
+	// removes it from the cluster
+	require.NoError(t, agents[0].Shutdown())
+	followerClient = client(t, "proglog:///"+agents[1].AdvertiseRPCAddr)
+	require.Eventually(t, func() bool {
+		res, err := followerClient.GetServers(context.Background(), &api.GetServersRequest{})
+		return err == nil && len(res.Servers) == 2
+	}, 3*time.Second, 50*time.Millisecond)
+	res, err := followerClient.Produce(
+		context.Background(),
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("baz")}},
+	)
+	require.NoError(t, err)
+	require.Equal(t, forwarded.Offset+1, res.Offset)
+}
+
+func TestAgentStaticPeers(t *testing.T) {
+	var peers []discovery.Peer
+	for i := 0; i < 3; i++ {
+		peers = append(peers, discovery.Peer{
+			Name:    fmt.Sprintf("%d", i),
+			RPCAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+		})
+	}
+	for i, peer := range peers {
+		dataDir, err := os.MkdirTemp("", "agent-test-log")
+		require.NoError(t, err)
+		defer os.RemoveAll(dataDir)
+
+		config := Config{
+			NodeName:          peer.Name,
+			RPCAddr:           peer.RPCAddr,
+			HTTPAddr:          "127.0.0.1:0",
+			DataDir:           dataDir,
+			Bootstrap:         i == 0,
+			StaticPeers:       peers,
+			DiscoveryInterval: 50 * time.Millisecond,
+		}
+		config.Log.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Log.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Log.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Log.Raft.CommitTimeout = 5 * time.Millisecond
+		agent, err := New(config)
+		require.NoError(t, err)
+		defer agent.Shutdown()
+	}
+
+	c := client(t, peers[2].RPCAddr)
+	require.Eventually(t, func() bool {
+		res, err := c.GetServers(context.Background(), &api.GetServersRequest{})
+		return err == nil && len(res.Servers) == 3
+	}, 3*time.Second, 50*time.Millisecond)
+	res, err := c.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("foo")},
+	})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		consumed, err := c.Consume(context.Background(), &api.ConsumeRequest{Offset: res.Offset})
+		return err == nil && string(consumed.Record.Value) == "foo"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestAgentPartitions(t *testing.T) {
+	var peers []discovery.Peer
+	for i := 0; i < 3; i++ {
+		peers = append(peers, discovery.Peer{
+			Name:    fmt.Sprintf("%d", i),
+			RPCAddr: fmt.Sprintf("127.0.0.1:%d", freePort(t)),
+		})
+	}
+	for i, peer := range peers {
+		config := Config{
+			NodeName:          peer.Name,
+			RPCAddr:           peer.RPCAddr,
+			HTTPAddr:          "127.0.0.1:0",
+			DataDir:           t.TempDir(),
+			Bootstrap:         i == 0,
+			StaticPeers:       peers,
+			DiscoveryInterval: 50 * time.Millisecond,
+		}
+		config.Log.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Log.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Log.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Log.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Log.Raft.Partitions = 2
+		agent, err := New(config)
+		require.NoError(t, err)
+		defer agent.Shutdown()
+	}
+
+	// every partition replicates to every node and numbers its own records
+	c := client(t, peers[2].RPCAddr)
+	for p := uint32(0); p < 2; p++ {
+		require.Eventually(t, func() bool {
+			res, err := c.GetServers(context.Background(), &api.GetServersRequest{Partition: p})
+			return err == nil && len(res.Servers) == 3 && res.Partitions == 2
+		}, 3*time.Second, 50*time.Millisecond)
+		value := []byte(fmt.Sprintf("partition %d", p))
+		res, err := c.Produce(context.Background(), &api.ProduceRequest{
+			Record:    &api.Record{Value: value},
+			Partition: p,
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), res.Offset)
+		require.Eventually(t, func() bool {
+			consumed, err := c.Consume(context.Background(), &api.ConsumeRequest{Offset: 0, Partition: p})
+			return err == nil && bytes.Equal(value, consumed.Record.Value)
+		}, time.Second, 10*time.Millisecond)
+	}
+	_, err := c.Consume(context.Background(), &api.ConsumeRequest{Partition: 2})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestAgentStandalone(t *testing.T) {
+	dataDir, err := os.MkdirTemp("", "agent-test-log")
+	require.NoError(t, err)
+	defer os.RemoveAll(dataDir)
+
+	agent, err := New(Config{
+		RPCAddr:    "127.0.0.1:0",
+		HTTPAddr:   "127.0.0.1:0",
+		KafkaAddr:  "127.0.0.1:0",
+		SyslogAddr: "127.0.0.1:0",
+		FluentAddr: "127.0.0.1:0",
+		MQTTAddr:   "127.0.0.1:0",
+		DataDir:    dataDir,
+	})
+	require.NoError(t, err)
+
+	// the Kafka listener answers an ApiVersions v0, correlation ID 7
+	conn, err := net.Dial("tcp", agent.AdvertiseKafkaAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte{0, 0, 0, 10, 0, 18, 0, 0, 0, 0, 0, 7, 0, 0})
+	require.NoError(t, err)
+	header := make([]byte, 10)
+	_, err = io.ReadFull(conn, header)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, 7, 0, 0}, header[4:])
+
+	c := client(t, "proglog:///"+agent.AdvertiseRPCAddr)
+	res, err := c.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("foo")},
+	})
+	require.NoError(t, err)
+	consumed, err := c.Consume(context.Background(), &api.ConsumeRequest{Offset: res.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("foo"), consumed.Record.Value)
+
+	// syslog messages are appended after it
+	syslog, err := net.Dial("udp", agent.syslogPC.LocalAddr().String())
+	require.NoError(t, err)
+	defer syslog.Close()
+	_, err = syslog.Write([]byte("<14>1 - web-1 app - - - bar"))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		consumed, err = c.Consume(context.Background(), &api.ConsumeRequest{Offset: res.Offset + 1})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, []byte("bar"), consumed.Record.Value)
+	require.Equal(t, []byte("web-1"), consumed.Record.Key)
+
+	// and forwarded events, acked once they are: ["default", 1, {"log":
+	// "baz"}, {"chunk": "x"}] in msgpack
+	fluent, err := net.Dial("tcp", agent.fluentLn.Addr().String())
+	require.NoError(t, err)
+	defer fluent.Close()
+	_, err = fluent.Write(append([]byte{0x94, 0xa7}, "default\x01\x81\xa3log\xa3baz\x81\xa5chunk\xa1x"...))
+	require.NoError(t, err)
+	ack := make([]byte, 7)
+	_, err = io.ReadFull(fluent, ack)
+	require.NoError(t, err)
+	require.Equal(t, append([]byte{0x81, 0xa3}, "ack\xa1x"...), ack)
+	consumed, err = c.Consume(context.Background(), &api.ConsumeRequest{Offset: res.Offset + 2})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"log": "baz"}`, string(consumed.Record.Value))
+
+	// and MQTT publishes, a clean CONNECT and then a QoS 1 PUBLISH to
+	// default/dev acked as packet 1
+	mqtt, err := net.Dial("tcp", agent.mqttLn.Addr().String())
+	require.NoError(t, err)
+	defer mqtt.Close()
+	_, err = mqtt.Write(append([]byte{0x10, 12, 0, 4}, "MQTT\x04\x02\x00\x00\x00\x00"...))
+	require.NoError(t, err)
+	_, err = mqtt.Write(append([]byte{0x32, 18, 0, 11}, "default/dev\x00\x01qux"...))
+	require.NoError(t, err)
+	acks := make([]byte, 8)
+	_, err = io.ReadFull(mqtt, acks)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x20, 2, 0, 0, 0x40, 2, 0, 1}, acks)
+	consumed, err = c.Consume(context.Background(), &api.ConsumeRequest{Offset: res.Offset + 3})
+	require.NoError(t, err)
+	require.Equal(t, []byte("qux"), consumed.Record.Value)
+	require.Equal(t, []byte("default/dev"), consumed.Record.Key)
+
+	// the topics' defaults change on a running agent
+	agent.SetTopicDefaults(log.TopicConfig{MaxRecordBytes: 2})
+	_, err = c.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("too long")},
+	})
+	require.Error(t, err)
+
+	require.NoError(t, agent.Live(time.Second))
+	require.NoError(t, agent.Shutdown())
+	select {
+	case <-agent.Done():
+	default:
+		t.Fatal("agent isn't done after shutdown")
+	}
+	require.Error(t, agent.Live(time.Second))
+}
+
+func TestAgentListeners(t *testing.T) {
+	agent, err := New(Config{
+		RPCAddr:            "127.0.0.1:0",
+		HTTPAddr:           "127.0.0.1:0",
+		AdminAddr:          "127.0.0.1:0",
+		AdminAuthenticator: auth.APIKeyAuthenticator{Keys: map[string]string{"admin-key": "ops"}},
+		MetricsAddr:        "127.0.0.1:0",
+		DataDir:            t.TempDir(),
+		Server: server.Config{
+			Authenticator: auth.APIKeyAuthenticator{Keys: map[string]string{"api-key": "app"}},
+		},
+	})
+	require.NoError(t, err)
+	defer agent.Shutdown()
+
+	get := func(ln net.Listener, path, key string) int {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, "http://"+ln.Addr().String()+path, nil)
+		require.NoError(t, err)
+		if key != "" {
+			req.Header.Set(auth.APIKeyHeader, key)
+		}
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	// the admin routes and metrics are only on their own listeners, on the
+	// API's they fall through to consuming
+	require.Equal(t, http.StatusOK, get(agent.httpLn, "/topics", "api-key"))
+	require.Equal(t, http.StatusBadRequest, get(agent.httpLn, "/admin/server", "api-key"))
+	require.Equal(t, http.StatusBadRequest, get(agent.httpLn, "/metrics", "api-key"))
+	require.Equal(t, http.StatusNotFound, get(agent.adminLn, "/topics", "admin-key"))
+	require.Equal(t, http.StatusNotFound, get(agent.metricsLn, "/topics", ""))
+
+	// each with its own authentication
+	require.Equal(t, http.StatusOK, get(agent.adminLn, "/admin/server", "admin-key"))
+	require.Equal(t, http.StatusUnauthorized, get(agent.adminLn, "/admin/server", "api-key"))
+	require.Equal(t, http.StatusOK, get(agent.metricsLn, "/metrics", ""))
+
+	// the Admin service is only on the admin listener too, with its
+	// authentication
+	conn := func(ln net.Listener) *grpc.ClientConn {
+		t.Helper()
+		conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	apiCtx := metadata.AppendToOutgoingContext(context.Background(), auth.APIKeyHeader, "api-key")
+	adminCtx := metadata.AppendToOutgoingContext(context.Background(), auth.APIKeyHeader, "admin-key")
+	rpc, admin := conn(agent.rpcLn), conn(agent.adminLn)
+	_, err = api.NewLogClient(rpc).ListTopics(apiCtx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	var methods []string
+	for _, m := range api.Admin_ServiceDesc.Methods {
+		methods = append(methods, m.MethodName)
+	}
+	for _, s := range api.Admin_ServiceDesc.Streams {
+		methods = append(methods, s.StreamName)
+	}
+	for _, method := range methods {
+		err := rpc.Invoke(apiCtx, "/"+api.Admin_ServiceDesc.ServiceName+"/"+method, &api.DescribeServerRequest{}, &api.DescribeServerResponse{})
+		require.Equal(t, codes.Unimplemented, status.Code(err), method)
+	}
+	_, err = api.NewAdminClient(admin).DescribeServer(adminCtx, &api.DescribeServerRequest{})
+	require.NoError(t, err)
+	_, err = api.NewAdminClient(admin).DescribeServer(apiCtx, &api.DescribeServerRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = api.NewLogClient(admin).ListTopics(adminCtx, &api.ListTopicsRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestAgentNodeID(t *testing.T) {
+	dataDir := t.TempDir()
+	start := func(name string) (*Agent, error) {
+		return New(Config{
+			NodeName: name,
+			RPCAddr:  "127.0.0.1:0",
+			HTTPAddr: "127.0.0.1:0",
+			DataDir:  dataDir,
+		})
+	}
+	agent, err := start("0")
+	require.NoError(t, err)
+	id := agent.NodeID()
+	require.NotEmpty(t, id)
+	// a second node can't use the directory while the first does
+	_, err = start("0")
+	require.ErrorIs(t, err, log.ErrLocked)
+	require.NoError(t, agent.Shutdown())
+
+	// the data directory keeps the ID across restarts
+	agent, err = start("0")
+	require.NoError(t, err)
+	require.Equal(t, id, agent.NodeID())
+	require.NoError(t, agent.Shutdown())
+
+	// and won't start as another node
+	_, err = start("1")
+	require.Error(t, err)
+}
+
+func client(t *testing.T, target string) api.LogClient {
+	t.Helper()
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return api.NewLogClient(conn)
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
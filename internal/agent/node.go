@@ -0,0 +1,87 @@
+package agent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+// The file in the data directory naming the node the data belongs to
+const nodeFile = "node.json"
+
+// node is the identity a data directory keeps, written the first time a
+// node starts with it
+type node struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Locks the data directory, so a second node started with it by mistake
+// fails rather than writing the same log
+func (a *Agent) setupDirLock() error {
+	if err := os.MkdirAll(a.DataDir, 0755); err != nil {
+		return err
+	}
+	lock, err := log.LockDir(a.DataDir)
+	if err != nil {
+		return fmt.Errorf("agent: %w", err)
+	}
+	a.dirLock = lock
+	return nil
+}
+
+// Reads the node's ID from the data directory, generating one on first
+// start. A directory another node wrote is refused, its data is that
+// node's and joining with it under another name would replicate it twice.
+func (a *Agent) setupNode() error {
+	if err := os.MkdirAll(a.DataDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(a.DataDir, nodeFile)
+	b, err := os.ReadFile(path)
+	if err == nil {
+		var n node
+		if err := json.Unmarshal(b, &n); err != nil {
+			return fmt.Errorf("agent: %s: %w", path, err)
+		}
+		if n.Name != a.NodeName {
+			return fmt.Errorf("agent: data directory %s belongs to node %s, not %s", a.DataDir, n.Name, a.NodeName)
+		}
+		a.nodeID = n.ID
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	n := node{ID: hex.EncodeToString(id), Name: a.NodeName}
+	if b, err = json.Marshal(n); err != nil {
+		return err
+	}
+	// written whole or not at all, a torn file would lose the ID
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	a.nodeID = n.ID
+	return nil
+}
+
+// NodeID is the ID the node keeps in its data directory, registered with
+// the cluster as it joins
+func (a *Agent) NodeID() string {
+	return a.nodeID
+}
@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"context"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Compares each partition with its leader's copy every RepairInterval
+// while the node follows, see log.DistributedLog.Repair. The leader
+// authorizes the node to consume by its peer certificate.
+func (a *Agent) setupRepair() error {
+	if a.RepairInterval == 0 || !a.clustered() {
+		return nil
+	}
+	plog := a.log.(*log.PartitionedLog)
+	ctx, cancel := context.WithCancel(context.Background())
+	a.stopRepair = cancel
+	a.repairDone = make(chan struct{})
+	go func() {
+		defer close(a.repairDone)
+		ticker := time.NewTicker(a.RepairInterval)
+		defer ticker.Stop()
+		// each partition's leader sends only the checksums that changed
+		// since the last repair
+		sessions := make([]log.ChecksumSession, plog.Partitions())
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for p := range sessions {
+					dlog, _ := plog.Partition(uint32(p))
+					a.repair(ctx, dlog, uint32(p), &sessions[p])
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func (a *Agent) repair(ctx context.Context, dlog *log.DistributedLog, partition uint32, session *log.ChecksumSession) {
+	leader := dlog.Leader()
+	if leader == "" || leader == a.AdvertiseRPCAddr {
+		return
+	}
+	opts := a.Server.PeerDialOptions
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	conn, err := grpc.NewClient(leader, opts...)
+	if err != nil {
+		a.logger.Error("dialing leader to repair", zap.String("leader", leader), zap.Error(err))
+		return
+	}
+	defer conn.Close()
+	n, err := dlog.Repair(ctx, leaderReplica{
+		client:    api.NewLogClient(conn),
+		partition: partition,
+		session:   session,
+	})
+	if n > 0 {
+		a.logger.Warn("repaired records that differed from the leader's",
+			zap.String("leader", leader),
+			zap.Uint32("partition", partition),
+			zap.Int("records", n),
+		)
+	}
+	if err != nil && ctx.Err() == nil {
+		a.logger.Error("repairing log",
+			zap.String("leader", leader),
+			zap.Uint32("partition", partition),
+			zap.Error(err),
+		)
+	}
+}
+
+// leaderReplica reads the leader's copy of the partition over RPC
+type leaderReplica struct {
+	client    api.LogClient
+	partition uint32
+	session   *log.ChecksumSession
+}
+
+func (r leaderReplica) Checksums(ctx context.Context, rangeSize uint64) ([]*api.RangeChecksum, error) {
+	res, err := r.client.GetChecksums(ctx, &api.GetChecksumsRequest{
+		RangeSize:    rangeSize,
+		Partition:    r.partition,
+		OpenSession:  true,
+		SessionId:    r.session.ID,
+		SessionEpoch: r.session.Epoch,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.session.Apply(res), nil
+}
+
+func (r leaderReplica) Read(ctx context.Context, off, end uint64) ([]*api.Record, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := r.client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: off, Partition: r.partition})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*api.Record, 0, end-off)
+	for uint64(len(records)) < end-off {
+		res, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, res.Record)
+	}
+	return records, nil
+}
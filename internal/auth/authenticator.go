@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	// ErrNoCredentials means the request carries nothing this authenticator understands,
+	// so the next one in a chain gets a go
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrUnauthenticated means credentials were presented but are not valid
+	ErrUnauthenticated = errors.New("unauthenticated")
+)
+
+const Anonymous = "anonymous"
+
+// Credentials is what a request or connection presents to prove who it is,
+// independent of the transport it arrived on
+type Credentials struct {
+	TLS        *tls.ConnectionState
+	Header     http.Header
+	RemoteAddr string
+}
+
+func FromHTTP(r *http.Request) Credentials {
+	return Credentials{TLS: r.TLS, Header: r.Header, RemoteAddr: r.RemoteAddr}
+}
+
+// Authenticator extracts the principal from a request's credentials.
+// Implement it to plug in LDAP, OIDC or any other scheme.
+type Authenticator interface {
+	Authenticate(ctx context.Context, creds Credentials) (string, error)
+}
+
+// AuthenticatorFunc adapts a function to the Authenticator interface
+type AuthenticatorFunc func(ctx context.Context, creds Credentials) (string, error)
+
+func (f AuthenticatorFunc) Authenticate(ctx context.Context, creds Credentials) (string, error) {
+	return f(ctx, creds)
+}
+
+// Chain tries each authenticator in order, the first one that finds
+// credentials it understands decides the outcome
+func Chain(auths ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(ctx context.Context, creds Credentials) (string, error) {
+		for _, a := range auths {
+			principal, err := a.Authenticate(ctx, creds)
+			if errors.Is(err, ErrNoCredentials) {
+				continue
+			}
+			return principal, err
+		}
+		return "", ErrNoCredentials
+	})
+}
+
+// TLSAuthenticator uses the common name of a verified client certificate
+type TLSAuthenticator struct{}
+
+func (TLSAuthenticator) Authenticate(_ context.Context, creds Credentials) (string, error) {
+	if creds.TLS == nil || len(creds.TLS.VerifiedChains) == 0 || len(creds.TLS.VerifiedChains[0]) == 0 {
+		return "", ErrNoCredentials
+	}
+	return creds.TLS.VerifiedChains[0][0].Subject.CommonName, nil
+}
+
+const APIKeyHeader = "X-Api-Key"
+
+// APIKeyAuthenticator maps static API keys to principals
+type APIKeyAuthenticator struct {
+	Keys map[string]string
+}
+
+func (a APIKeyAuthenticator) Authenticate(_ context.Context, creds Credentials) (string, error) {
+	key := creds.Header.Get(APIKeyHeader)
+	if key == "" {
+		return "", ErrNoCredentials
+	}
+	for k, principal := range a.Keys {
+		if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+			return principal, nil
+		}
+	}
+	return "", ErrUnauthenticated
+}
+
+// JWTAuthenticator accepts HMAC signed bearer tokens and uses their subject as the principal
+type JWTAuthenticator struct {
+	Secret []byte
+	// Issuer, when set, must match the token's iss claim
+	Issuer string
+}
+
+func (a JWTAuthenticator) Authenticate(_ context.Context, creds Credentials) (string, error) {
+	raw, ok := strings.CutPrefix(creds.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return "", ErrNoCredentials
+	}
+	opts := []jwt.ParserOption{jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"})}
+	if a.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(a.Issuer))
+	}
+	token, err := jwt.Parse(raw, func(*jwt.Token) (any, error) { return a.Secret, nil }, opts...)
+	if err != nil {
+		return "", errors.Join(ErrUnauthenticated, err)
+	}
+	sub, err := token.Claims.GetSubject()
+	if err != nil || sub == "" {
+		return "", ErrUnauthenticated
+	}
+	return sub, nil
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying the authenticated principal
+func WithPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// Principal returns the principal stored in ctx, or Anonymous
+func Principal(ctx context.Context) string {
+	if p, ok := ctx.Value(principalKey{}).(string); ok {
+		return p
+	}
+	return Anonymous
+}
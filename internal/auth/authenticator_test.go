@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/require"
+)
+
+var secret = []byte("test-secret")
+
+func TestAuthenticators(t *testing.T) {
+	ctx := context.Background()
+	chain := Chain(
+		TLSAuthenticator{},
+		JWTAuthenticator{Secret: secret, Issuer: "proglog"},
+		APIKeyAuthenticator{Keys: map[string]string{"k1": "alice"}},
+	)
+
+	for scenario, fn := range map[string]func(t *testing.T, a Authenticator){
+		"api key":             testAPIKey,
+		"jwt":                 testJWT,
+		"no credentials":      testNoCredentials,
+		"invalid credentials": testInvalidCredentials,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			fn(t, chain)
+		})
+	}
+
+	require.Equal(t, Anonymous, Principal(ctx))
+	require.Equal(t, "alice", Principal(WithPrincipal(ctx, "alice")))
+}
+
+func testAPIKey(t *testing.T, a Authenticator) {
+	principal, err := a.Authenticate(context.Background(), creds(APIKeyHeader, "k1"))
+	require.NoError(t, err)
+	require.Equal(t, "alice", principal)
+}
+
+func testJWT(t *testing.T, a Authenticator) {
+	token := sign(t, jwt.MapClaims{"sub": "bob", "iss": "proglog", "exp": time.Now().Add(time.Minute).Unix()})
+	principal, err := a.Authenticate(context.Background(), creds("Authorization", "Bearer "+token))
+	require.NoError(t, err)
+	require.Equal(t, "bob", principal)
+}
+
+func testNoCredentials(t *testing.T, a Authenticator) {
+	_, err := a.Authenticate(context.Background(), Credentials{Header: http.Header{}})
+	require.ErrorIs(t, err, ErrNoCredentials)
+}
+
+func testInvalidCredentials(t *testing.T, a Authenticator) {
+	_, err := a.Authenticate(context.Background(), creds(APIKeyHeader, "nope"))
+	require.ErrorIs(t, err, ErrUnauthenticated)
+
+	expired := sign(t, jwt.MapClaims{"sub": "bob", "iss": "proglog", "exp": time.Now().Add(-time.Minute).Unix()})
+	_, err = a.Authenticate(context.Background(), creds("Authorization", "Bearer "+expired))
+	require.ErrorIs(t, err, ErrUnauthenticated)
+
+	wrongIssuer := sign(t, jwt.MapClaims{"sub": "bob", "iss": "someone-else"})
+	_, err = a.Authenticate(context.Background(), creds("Authorization", "Bearer "+wrongIssuer))
+	require.ErrorIs(t, err, ErrUnauthenticated)
+}
+
+func creds(key, value string) Credentials {
+	h := http.Header{}
+	h.Set(key, value)
+	return Credentials{Header: h}
+}
+
+func sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+	require.NoError(t, err)
+	return token
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Wildcard matches any principal, resource or action in a policy
+const Wildcard = "*"
+
+// Authorizer decides whether a principal may perform an action on a resource.
+// Implement it to plug in OPA or any other policy engine.
+type Authorizer interface {
+	Authorize(ctx context.Context, principal, action, resource string) error
+}
+
+// AuthorizerFunc adapts a function to the Authorizer interface
+type AuthorizerFunc func(ctx context.Context, principal, action, resource string) error
+
+func (f AuthorizerFunc) Authorize(ctx context.Context, principal, action, resource string) error {
+	return f(ctx, principal, action, resource)
+}
+
+// Rule grants Principal the Action on Resource
+type Rule struct {
+	Principal string
+	Resource  string
+	Action    string
+}
+
+func (r Rule) matches(principal, action, resource string) bool {
+	return match(r.Principal, principal) && match(r.Resource, resource) && match(r.Action, action)
+}
+
+func match(pattern, value string) bool {
+	return pattern == Wildcard || pattern == value
+}
+
+// ACL is a default-deny authorizer over a list of allow rules, which
+// Reload replaces
+type ACL struct {
+	mu    sync.RWMutex
+	rules []Rule
+}
+
+func NewACL(rules ...Rule) *ACL {
+	return &ACL{rules: rules}
+}
+
+// LoadACL reads a policy file with one "p, principal, resource, action" rule
+// per line, the same layout as a Casbin CSV policy for the basic ACL model
+func LoadACL(path string) (*ACL, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseACL(f)
+}
+
+// Reload replaces the rules with the policy file's, keeping them if it
+// can't be read
+func (a *ACL) Reload(path string) error {
+	acl, err := LoadACL(path)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = acl.rules
+	return nil
+}
+
+func ParseACL(r io.Reader) (*ACL, error) {
+	acl := &ACL{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		if len(fields) != 4 || fields[0] != "p" {
+			return nil, fmt.Errorf("policy line %d: want \"p, principal, resource, action\", got %q", n, line)
+		}
+		acl.rules = append(acl.rules, Rule{Principal: fields[1], Resource: fields[2], Action: fields[3]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func (a *ACL) Authorize(_ context.Context, principal, action, resource string) error {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	for _, r := range a.rules {
+		if r.matches(principal, action, resource) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s may not %s %s", ErrPermissionDenied, principal, action, resource)
+}
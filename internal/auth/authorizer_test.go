@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestACL(t *testing.T) {
+	acl, err := ParseACL(strings.NewReader(`
+# root can do anything, everyone may consume
+p, root, *, *
+p, *, *, consume
+p, writer, *, produce
+`))
+	require.NoError(t, err)
+	ctx := context.Background()
+	require.NoError(t, acl.Authorize(ctx, "root", "audit.export", "audit"))
+	require.NoError(t, acl.Authorize(ctx, "nobody", "consume", "*"))
+	require.NoError(t, acl.Authorize(ctx, "writer", "produce", "*"))
+	require.ErrorIs(t, acl.Authorize(ctx, "nobody", "produce", "*"), ErrPermissionDenied)
+
+	_, err = ParseACL(strings.NewReader("g, alice, admin"))
+	require.Error(t, err)
+
+	// reloaded, the file's rules replace the old, unless it doesn't parse
+	path := filepath.Join(t.TempDir(), "policy.csv")
+	require.NoError(t, os.WriteFile(path, []byte("p, nobody, *, produce\n"), 0o600))
+	require.NoError(t, acl.Reload(path))
+	require.NoError(t, acl.Authorize(ctx, "nobody", "produce", "*"))
+	require.ErrorIs(t, acl.Authorize(ctx, "root", "consume", "*"), ErrPermissionDenied)
+	require.NoError(t, os.WriteFile(path, []byte("g, alice, admin\n"), 0o600))
+	require.Error(t, acl.Reload(path))
+	require.NoError(t, acl.Authorize(ctx, "nobody", "produce", "*"))
+}
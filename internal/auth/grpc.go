@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// FromGRPC gathers the credentials of the call in ctx: the TLS state and
+// remote address of the connection, and the request metadata as headers
+func FromGRPC(ctx context.Context) Credentials {
+	var creds Credentials
+	if p, ok := peer.FromContext(ctx); ok {
+		if p.Addr != nil {
+			creds.RemoteAddr = p.Addr.String()
+		}
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			creds.TLS = &info.State
+		}
+	}
+	creds.Header = make(http.Header)
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		for k, vs := range md {
+			for _, v := range vs {
+				creds.Header.Add(k, v)
+			}
+		}
+	}
+	return creds
+}
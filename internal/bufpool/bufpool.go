@@ -0,0 +1,59 @@
+// Package bufpool reuses the byte buffers serving records goes through,
+// from reading them off the store to encoding responses, so a consume
+// doesn't allocate a buffer per record. Buffers are pooled by size, a
+// power of two from 64 bytes to 4 MiB; bigger ones are allocated and
+// dropped as usual.
+package bufpool
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	minShift = 6
+	maxShift = 22
+)
+
+// pools[i] holds buffers with a capacity of 1<<(minShift+i)
+var pools [maxShift - minShift + 1]sync.Pool
+
+// The pool of buffers big enough for n bytes, or -1 when none is
+func class(n int) int {
+	if n <= 1<<minShift {
+		return 0
+	}
+	shift := bits.Len(uint(n - 1))
+	if shift > maxShift {
+		return -1
+	}
+	return shift - minShift
+}
+
+// Get returns a buffer of n bytes, one an earlier Put handed back when
+// there is one, holding whatever it held then
+func Get(n int) *[]byte {
+	c := class(n)
+	if c < 0 {
+		b := make([]byte, n)
+		return &b
+	}
+	if p, ok := pools[c].Get().(*[]byte); ok {
+		*p = (*p)[:n]
+		return p
+	}
+	b := make([]byte, n, 1<<(minShift+c))
+	return &b
+}
+
+// Put hands the buffer back for Get to reuse. Putting a buffer is always
+// optional: a caller that keeps it, or any slice of it, mustn't, and it's
+// left to the garbage collector.
+func Put(p *[]byte) {
+	c := class(cap(*p))
+	if c < 0 || cap(*p) != 1<<(minShift+c) {
+		// not one of Get's
+		return
+	}
+	pools[c].Put(p)
+}
@@ -0,0 +1,27 @@
+package bufpool
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufpool(t *testing.T) {
+	for _, n := range []int{0, 1, 64, 65, 1000, 1 << 22} {
+		b := Get(n)
+		require.Len(t, *b, n)
+		require.GreaterOrEqual(t, cap(*b), n)
+		Put(b)
+	}
+
+	// bigger than the biggest pool, allocated as they're asked for
+	b := Get(1<<22 + 1)
+	require.Len(t, *b, 1<<22+1)
+	require.Equal(t, 1<<22+1, cap(*b))
+	Put(b)
+
+	// buffers Get didn't make aren't pooled
+	odd := make([]byte, 100)
+	Put(&odd)
+	require.Equal(t, 128, cap(*Get(100)))
+}
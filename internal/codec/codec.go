@@ -0,0 +1,151 @@
+// Package codec compresses and decompresses record values, for producers
+// and for servers compressing as a topic asks
+package codec
+
+import (
+	"fmt"
+	"sync"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"google.golang.org/protobuf/proto"
+)
+
+// The zstd coders are safe for concurrent use with EncodeAll and DecodeAll
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+	// zstdLevels are the encoders of the levels asked for, by
+	// zstd.EncoderLevel
+	zstdLevels sync.Map
+)
+
+// MaxLevel is the highest compression level, zstd's
+const MaxLevel = 22
+
+// Compress returns the record with its value compressed with the codec, or
+// the record itself when it's already compressed or compressing doesn't
+// make it smaller. Records the caller holds aren't changed.
+func Compress(codec api.Codec, record *api.Record) (*api.Record, error) {
+	return CompressLevel(codec, 0, record)
+}
+
+// CompressLevel is Compress at the compression level, zstd's from 1 to
+// MaxLevel, see zstd.EncoderLevelFromZstd. Zero is the codec's default,
+// and snappy has no other.
+func CompressLevel(codec api.Codec, level int, record *api.Record) (*api.Record, error) {
+	if codec == api.Codec_CODEC_NONE || record.Codec != api.Codec_CODEC_NONE {
+		return record, nil
+	}
+	value, err := EncodeLevel(codec, level, record.Value)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) >= len(record.Value) {
+		return record, nil
+	}
+	compressed := proto.Clone(record).(*api.Record)
+	compressed.Value = value
+	compressed.Codec = codec
+	return compressed, nil
+}
+
+// Recompress is CompressLevel, but for a record compressed with another
+// codec, which it decompresses to compress again, returning it decompressed
+// for api.Codec_CODEC_NONE. Records compressed with the codec already are
+// returned as they are, whatever their level. Records the caller holds
+// aren't changed.
+func Recompress(codec api.Codec, level int, record *api.Record) (*api.Record, error) {
+	if record.Codec == api.Codec_CODEC_NONE || record.Codec == codec {
+		return CompressLevel(codec, level, record)
+	}
+	decompressed := proto.Clone(record).(*api.Record)
+	if err := Decompress(decompressed); err != nil {
+		return nil, err
+	}
+	if codec == api.Codec_CODEC_NONE {
+		return decompressed, nil
+	}
+	value, err := EncodeLevel(codec, level, decompressed.Value)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) >= len(record.Value) {
+		// the producer's codec did better
+		return record, nil
+	}
+	decompressed.Value = value
+	decompressed.Codec = codec
+	return decompressed, nil
+}
+
+// Decompress decompresses the record's value in place, clearing its codec
+func Decompress(record *api.Record) error {
+	if record.Codec == api.Codec_CODEC_NONE {
+		return nil
+	}
+	value, err := Decode(record.Codec, record.Value)
+	if err != nil {
+		return fmt.Errorf("decompressing record %d: %w", record.Offset, err)
+	}
+	record.Value = value
+	record.Codec = api.Codec_CODEC_NONE
+	return nil
+}
+
+// Encode returns src compressed with the codec, src itself for
+// api.Codec_CODEC_NONE
+func Encode(codec api.Codec, src []byte) ([]byte, error) {
+	return EncodeLevel(codec, 0, src)
+}
+
+// EncodeLevel is Encode at the compression level, see CompressLevel
+func EncodeLevel(codec api.Codec, level int, src []byte) ([]byte, error) {
+	switch codec {
+	case api.Codec_CODEC_NONE:
+		return src, nil
+	case api.Codec_CODEC_SNAPPY:
+		return snappy.Encode(nil, src), nil
+	case api.Codec_CODEC_ZSTD:
+		enc, err := zstdLevel(level)
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncodeAll(src, nil), nil
+	}
+	return nil, fmt.Errorf("unknown codec %v", codec)
+}
+
+// The zstd encoder of the level, the default's for zero
+func zstdLevel(level int) (*zstd.Encoder, error) {
+	if level == 0 {
+		return zstdEncoder, nil
+	}
+	if level < 0 || level > MaxLevel {
+		return nil, fmt.Errorf("compression level %d isn't from 1 to %d", level, MaxLevel)
+	}
+	l := zstd.EncoderLevelFromZstd(level)
+	if enc, ok := zstdLevels.Load(l); ok {
+		return enc.(*zstd.Encoder), nil
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(l))
+	if err != nil {
+		return nil, err
+	}
+	actual, _ := zstdLevels.LoadOrStore(l, enc)
+	return actual.(*zstd.Encoder), nil
+}
+
+// Decode returns src decompressed, compressed with the codec
+func Decode(codec api.Codec, src []byte) ([]byte, error) {
+	switch codec {
+	case api.Codec_CODEC_NONE:
+		return src, nil
+	case api.Codec_CODEC_SNAPPY:
+		return snappy.Decode(nil, src)
+	case api.Codec_CODEC_ZSTD:
+		return zstdDecoder.DecodeAll(src, nil)
+	}
+	return nil, fmt.Errorf("unknown codec %v", codec)
+}
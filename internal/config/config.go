@@ -0,0 +1,346 @@
+// Package config layers settings from a YAML or TOML file, the environment
+// and command-line flags, each overriding those before it.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"go.yaml.in/yaml/v3"
+)
+
+// ConfigEnv names the config file when the -config flag doesn't
+const ConfigEnv = "PROGLOG_CONFIG"
+
+// Kind is the type of a setting's value, checked when the settings are loaded
+type Kind int
+
+const (
+	String Kind = iota
+	Bool
+	Int
+	Float
+	Duration
+	// List is comma separated, or a list in files
+	List
+	// Pairs are comma separated name=value pairs, or a table in files
+	Pairs
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Bool:
+		return "bool"
+	case Int:
+		return "int"
+	case Float:
+		return "float"
+	case Duration:
+		return "duration"
+	case List:
+		return "list"
+	case Pairs:
+		return "name=value pairs"
+	}
+	return "string"
+}
+
+// Setting is one value of the configuration, named by its key in files, its
+// environment variable and its flag
+type Setting struct {
+	// Key is dotted by section, e.g. cluster.bind_addr
+	Key     string
+	Env     string
+	Kind    Kind
+	Default string
+	Usage   string
+	// Secret values are redacted from Effective
+	Secret bool
+}
+
+// Flag is the key with dashes for underscores, e.g. -cluster.bind-addr
+func (s Setting) Flag() string {
+	return strings.ReplaceAll(s.Key, "_", "-")
+}
+
+type value struct {
+	v string
+	// where the value came from, for errors
+	from string
+}
+
+// Config holds the settings loaded, by their environment variable
+type Config struct {
+	// File is the path of the config file read, if any
+	File     string
+	settings map[string]Setting
+	values   map[string]value
+}
+
+// Load reads the settings from the config file, lookupEnv and the flags
+// in args, in that order, checking every value given against its kind.
+// Flags that aren't settings, keys of the file that aren't and values that
+// don't parse are errors, all of them reported together. With -h it returns
+// flag.ErrHelp, having printed the flags.
+func Load(name string, settings []Setting, args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	c := &Config{
+		settings: make(map[string]Setting, len(settings)),
+		values:   make(map[string]value),
+	}
+	byKey := make(map[string]Setting, len(settings))
+	for _, s := range settings {
+		c.settings[s.Env] = s
+		byKey[s.Key] = s
+	}
+
+	flags := make(map[string]value)
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	// errors are returned, and printed by the caller
+	fs.SetOutput(io.Discard)
+	file := fs.String("config", "", "YAML or TOML file of settings, also $"+ConfigEnv)
+	for _, s := range settings {
+		usage := s.Usage + " ($" + s.Env + ")"
+		if s.Default != "" {
+			usage += fmt.Sprintf(" (default %q)", s.Default)
+		}
+		set := func(v string) error {
+			flags[s.Env] = value{v: v, from: "flag -" + s.Flag()}
+			return nil
+		}
+		if s.Kind == Bool {
+			fs.BoolFunc(s.Flag(), usage, set)
+		} else {
+			fs.Func(s.Flag(), usage, set)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			fs.SetOutput(os.Stderr)
+			fs.Usage()
+		}
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	c.File = *file
+	if c.File == "" {
+		c.File, _ = lookupEnv(ConfigEnv)
+	}
+	if c.File != "" {
+		values, err := readFile(c.File, byKey)
+		if err != nil {
+			return nil, err
+		}
+		for env, v := range values {
+			c.values[env] = v
+		}
+	}
+	for _, s := range settings {
+		if v, ok := lookupEnv(s.Env); ok && v != "" {
+			c.values[s.Env] = value{v: v, from: "$" + s.Env}
+		}
+	}
+	for env, v := range flags {
+		c.values[env] = v
+	}
+
+	var errs []error
+	for _, s := range settings {
+		v, ok := c.values[s.Env]
+		if !ok {
+			continue
+		}
+		if err := check(v.v, s.Kind); err != nil {
+			errs = append(errs, fmt.Errorf("%s from %s: %w", s.Key, v.from, err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Get is the setting's value, its default when it's not set anywhere. It
+// panics for variables that aren't settings.
+func (c *Config) Get(env string) string {
+	s, ok := c.settings[env]
+	if !ok {
+		panic("config: no setting for " + env)
+	}
+	if v, ok := c.values[env]; ok {
+		return v.v
+	}
+	return s.Default
+}
+
+// Changed lists the settings, by their variables, whose values differ in
+// next, e.g. a reload of the config file
+func (c *Config) Changed(next *Config) []string {
+	var changed []string
+	for env := range c.settings {
+		if c.Get(env) != next.Get(env) {
+			changed = append(changed, env)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// Redacted stands for secrets' values in Effective
+const Redacted = "REDACTED"
+
+// Value is a setting's effective value and where it came from
+type Value struct {
+	Setting
+	// Value is Redacted for a secret that's set
+	Value string
+	// Source is the file, $VARIABLE or -flag the value came from, or
+	// "default"
+	Source string
+}
+
+// Effective lists the settings' values in key order, secrets redacted
+func (c *Config) Effective() []Value {
+	values := make([]Value, 0, len(c.settings))
+	for env, s := range c.settings {
+		v := Value{Setting: s, Value: s.Default, Source: "default"}
+		if set, ok := c.values[env]; ok {
+			v.Value, v.Source = set.v, set.from
+		}
+		if s.Secret && v.Value != "" {
+			v.Value = Redacted
+		}
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i].Key < values[j].Key })
+	return values
+}
+
+// Reads the file's settings by their variables, YAML or TOML by its extension
+func readFile(path string, byKey map[string]Setting) (map[string]value, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &doc)
+	case ".toml":
+		err = toml.Unmarshal(b, &doc)
+	default:
+		return nil, fmt.Errorf("config file %s isn't .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	values := make(map[string]value)
+	var errs []error
+	flatten(path, "", doc, byKey, values, &errs)
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// Walks the sections of the document down to its settings
+func flatten(path, prefix string, section map[string]any, byKey map[string]Setting, values map[string]value, errs *[]error) {
+	for k, v := range section {
+		key := prefix + k
+		if v == nil {
+			continue
+		}
+		if s, ok := byKey[key]; ok {
+			str, err := render(v, s.Kind)
+			if err != nil {
+				*errs = append(*errs, fmt.Errorf("%s in %s: %w", key, path, err))
+				continue
+			}
+			values[s.Env] = value{v: str, from: path}
+			continue
+		}
+		if sub, ok := v.(map[string]any); ok {
+			flatten(path, key+".", sub, byKey, values, errs)
+			continue
+		}
+		*errs = append(*errs, fmt.Errorf("unknown setting %s in %s", key, path))
+	}
+}
+
+// The value of a file as the string the setting's variable would hold
+func render(v any, kind Kind) (string, error) {
+	switch v := v.(type) {
+	case []any:
+		if kind != List {
+			return "", fmt.Errorf("want %s, not a list", kind)
+		}
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := render(item, String)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	case map[string]any:
+		if kind != Pairs {
+			return "", fmt.Errorf("want %s, not a table", kind)
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		pairs := make([]string, len(names))
+		for i, name := range names {
+			s, err := render(v[name], String)
+			if err != nil {
+				return "", err
+			}
+			pairs[i] = name + "=" + s
+		}
+		return strings.Join(pairs, ","), nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// Checks the value parses as the kind
+func check(v string, kind Kind) error {
+	var err error
+	switch kind {
+	case Bool:
+		_, err = strconv.ParseBool(v)
+	case Int:
+		_, err = strconv.Atoi(v)
+	case Float:
+		_, err = strconv.ParseFloat(v, 64)
+	case Duration:
+		_, err = time.ParseDuration(v)
+	case Pairs:
+		for _, pair := range strings.Split(v, ",") {
+			if !strings.Contains(pair, "=") {
+				return fmt.Errorf("%q isn't name=value", pair)
+			}
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%q isn't a valid %s", v, kind)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testSettings = []Setting{
+	{Key: "server.rpc_addr", Env: "TEST_RPC_ADDR", Default: ":8400"},
+	{Key: "server.http_addr", Env: "TEST_HTTP_ADDR", Default: ":8080"},
+	{Key: "log.partitions", Env: "TEST_PARTITIONS", Kind: Int},
+	{Key: "log.tier.prefix", Env: "TEST_TIER_PREFIX"},
+	{Key: "cluster.bootstrap", Env: "TEST_BOOTSTRAP", Kind: Bool},
+	{Key: "cluster.start_join_addrs", Env: "TEST_START_JOIN_ADDRS", Kind: List},
+	{Key: "cluster.drain_timeout", Env: "TEST_DRAIN_TIMEOUT", Kind: Duration},
+	{Key: "security.api_keys", Env: "TEST_API_KEYS", Kind: Pairs, Secret: true},
+}
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		v, ok := vars[key]
+		return v, ok
+	}
+}
+
+func writeFile(t *testing.T, name, body string) string {
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(body), 0o600))
+	return path
+}
+
+func TestLoadLayers(t *testing.T) {
+	path := writeFile(t, "proglog.yaml", `
+server:
+  rpc_addr: ":9400"
+  http_addr: ":9080"
+log:
+  partitions: 3
+  tier:
+    prefix: segments/
+cluster:
+  start_join_addrs: ["a:8401", "b:8401"]
+  drain_timeout: 30s
+security:
+  api_keys:
+    key1: alice
+    key2: bob
+`)
+	c, err := Load("test", testSettings, []string{"-config", path, "-server.http-addr", ":7080", "-cluster.bootstrap"}, env(map[string]string{
+		"TEST_RPC_ADDR":   ":6400",
+		"TEST_HTTP_ADDR":  ":6080",
+		"TEST_PARTITIONS": "",
+	}))
+	require.NoError(t, err)
+	require.Equal(t, path, c.File)
+	// flags override the environment, which overrides the file
+	require.Equal(t, ":7080", c.Get("TEST_HTTP_ADDR"))
+	require.Equal(t, ":6400", c.Get("TEST_RPC_ADDR"))
+	require.Equal(t, "3", c.Get("TEST_PARTITIONS"))
+	require.Equal(t, "segments/", c.Get("TEST_TIER_PREFIX"))
+	require.Equal(t, "true", c.Get("TEST_BOOTSTRAP"))
+	require.Equal(t, "a:8401,b:8401", c.Get("TEST_START_JOIN_ADDRS"))
+	require.Equal(t, "30s", c.Get("TEST_DRAIN_TIMEOUT"))
+	require.Equal(t, "key1=alice,key2=bob", c.Get("TEST_API_KEYS"))
+	require.Panics(t, func() { c.Get("TEST_NOPE") })
+
+	// without a file, or anything set, settings are their defaults
+	c, err = Load("test", testSettings, nil, env(nil))
+	require.NoError(t, err)
+	require.Equal(t, ":8400", c.Get("TEST_RPC_ADDR"))
+	require.Equal(t, "", c.Get("TEST_PARTITIONS"))
+
+	// a reload reports what changed since
+	next, err := Load("test", testSettings, []string{"-log.partitions", "3", "-server.rpc-addr", ":8400"}, env(map[string]string{
+		"TEST_BOOTSTRAP": "true",
+	}))
+	require.NoError(t, err)
+	require.Equal(t, []string{"TEST_BOOTSTRAP", "TEST_PARTITIONS"}, c.Changed(next))
+}
+
+func TestEffective(t *testing.T) {
+	path := writeFile(t, "proglog.yaml", `
+security:
+  api_keys:
+    key1: alice
+`)
+	c, err := Load("test", testSettings, []string{"-config", path, "-log.partitions", "3"}, env(map[string]string{
+		"TEST_HTTP_ADDR": ":6080",
+	}))
+	require.NoError(t, err)
+	values := c.Effective()
+	require.Len(t, values, len(testSettings))
+	byKey := make(map[string]Value)
+	for i, v := range values {
+		if i > 0 {
+			require.Less(t, values[i-1].Key, v.Key)
+		}
+		byKey[v.Key] = v
+	}
+	require.Equal(t, Value{Setting: testSettings[0], Value: ":8400", Source: "default"}, byKey["server.rpc_addr"])
+	require.Equal(t, ":6080", byKey["server.http_addr"].Value)
+	require.Equal(t, "$TEST_HTTP_ADDR", byKey["server.http_addr"].Source)
+	require.Equal(t, "flag -log.partitions", byKey["log.partitions"].Source)
+	// secrets that are set are redacted
+	require.Equal(t, Redacted, byKey["security.api_keys"].Value)
+	require.Equal(t, path, byKey["security.api_keys"].Source)
+	require.Equal(t, "", byKey["log.tier.prefix"].Value)
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeFile(t, "proglog.toml", `
+[server]
+rpc_addr = ":9400"
+
+[log.tier]
+prefix = "segments/"
+
+[cluster]
+bootstrap = true
+drain_timeout = "1m"
+
+[security.api_keys]
+key1 = "alice"
+`)
+	// the environment names the file when the flag doesn't
+	c, err := Load("test", testSettings, nil, env(map[string]string{ConfigEnv: path}))
+	require.NoError(t, err)
+	require.Equal(t, ":9400", c.Get("TEST_RPC_ADDR"))
+	require.Equal(t, "segments/", c.Get("TEST_TIER_PREFIX"))
+	require.Equal(t, "true", c.Get("TEST_BOOTSTRAP"))
+	require.Equal(t, "1m", c.Get("TEST_DRAIN_TIMEOUT"))
+	require.Equal(t, "key1=alice", c.Get("TEST_API_KEYS"))
+}
+
+func TestLoadErrors(t *testing.T) {
+	_, err := Load("test", testSettings, []string{"-h"}, env(nil))
+	require.ErrorIs(t, err, flag.ErrHelp)
+	_, err = Load("test", testSettings, []string{"-server.nope", "x"}, env(nil))
+	require.Error(t, err)
+	_, err = Load("test", testSettings, []string{"extra"}, env(nil))
+	require.Error(t, err)
+	_, err = Load("test", testSettings, []string{"-config", writeFile(t, "proglog.json", "{}")}, env(nil))
+	require.Error(t, err)
+
+	_, err = Load("test", testSettings, []string{"-config", writeFile(t, "proglog.yaml", `
+server:
+  rpc_adr: ":9400"
+security:
+  api_keys: [key1]
+`)}, env(nil))
+	require.ErrorContains(t, err, "unknown setting server.rpc_adr")
+	require.ErrorContains(t, err, "security.api_keys")
+
+	// every value that doesn't parse is reported, with where it came from
+	_, err = Load("test", testSettings, []string{
+		"-config", writeFile(t, "proglog.yaml", "log:\n  partitions: many\n"),
+		"-cluster.drain-timeout", "5",
+	}, env(map[string]string{"TEST_BOOTSTRAP": "maybe", "TEST_API_KEYS": "key1"}))
+	require.ErrorContains(t, err, `log.partitions from `)
+	require.ErrorContains(t, err, `"many" isn't a valid int`)
+	require.ErrorContains(t, err, `cluster.drain_timeout from flag -cluster.drain-timeout`)
+	require.ErrorContains(t, err, `cluster.bootstrap from $TEST_BOOTSTRAP`)
+	require.ErrorContains(t, err, `"key1" isn't name=value`)
+}
@@ -0,0 +1,76 @@
+package discovery
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DNSConfig finds peers by polling DNS, such as a Kubernetes headless
+// service. Each peer is named by its RPC address, so servers discovered
+// this way must use their advertised RPC address as their node name.
+type DNSConfig struct {
+	// NodeName and RPCAddr identify the local server, which DNS returns too
+	NodeName string
+	RPCAddr  string
+	// Name is looked up as an SRV record, each target and port being a
+	// peer's RPC address. With Port set, Name's A and AAAA records are
+	// looked up instead and each address dialed on Port.
+	Name string
+	Port int
+	// Interval is how often DNS is polled, defaults to 10 seconds
+	Interval time.Duration
+	// Resolver defaults to net.DefaultResolver
+	Resolver *net.Resolver
+}
+
+// NewDNS tells the handler about the peers DNS returns, polling for changes
+func NewDNS(handler Handler, config DNSConfig) *Poller {
+	resolver := config.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	lookup := func(ctx context.Context) ([]Peer, error) {
+		if config.Port != 0 {
+			return lookupHost(ctx, resolver, config.Name, config.Port)
+		}
+		return lookupSRV(ctx, resolver, config.Name)
+	}
+	p := newPoller(handler, Peer{Name: config.NodeName, RPCAddr: config.RPCAddr}, config.Interval, lookup)
+	p.logger = zap.L().Named("dns-discovery")
+	go p.run()
+	return p
+}
+
+func lookupSRV(ctx context.Context, resolver *net.Resolver, name string) ([]Peer, error) {
+	_, records, err := resolver.LookupSRV(ctx, "", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var peers []Peer
+	for _, srv := range records {
+		addr := net.JoinHostPort(
+			strings.TrimSuffix(srv.Target, "."),
+			strconv.Itoa(int(srv.Port)),
+		)
+		peers = append(peers, Peer{Name: addr, RPCAddr: addr})
+	}
+	return peers, nil
+}
+
+func lookupHost(ctx context.Context, resolver *net.Resolver, name string, port int) ([]Peer, error) {
+	addrs, err := resolver.LookupHost(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var peers []Peer
+	for _, host := range addrs {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		peers = append(peers, Peer{Name: addr, RPCAddr: addr})
+	}
+	return peers, nil
+}
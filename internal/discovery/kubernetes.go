@@ -0,0 +1,82 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// KubernetesConfig finds the pods of a StatefulSet through its headless
+// service. Pods only turn ready once they've joined the cluster, so the
+// service must set publishNotReadyAddresses for them to find each other.
+type KubernetesConfig struct {
+	// PodName is the local pod's name, <statefulset>-<ordinal>, which is
+	// also its node name
+	PodName string
+	// Service is the headless service's DNS name, such as
+	// proglog.default.svc.cluster.local
+	Service string
+	// PortName names the service's RPC port, defaults to "rpc"
+	PortName string
+	// Interval is how often the service is polled, defaults to 10 seconds
+	Interval time.Duration
+	// Resolver defaults to net.DefaultResolver
+	Resolver *net.Resolver
+}
+
+// NewKubernetes tells the handler about the pods behind the service, each
+// named by its pod name and dialed on its stable DNS name,
+// <pod>.<service>, so a rescheduled pod keeps its identity
+func NewKubernetes(handler Handler, config KubernetesConfig) *Poller {
+	resolver := config.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	portName := config.PortName
+	if portName == "" {
+		portName = "rpc"
+	}
+	lookup := func(ctx context.Context) ([]Peer, error) {
+		_, records, err := resolver.LookupSRV(ctx, portName, "tcp", config.Service)
+		if err != nil {
+			return nil, err
+		}
+		return podPeers(records), nil
+	}
+	p := newPoller(handler, Peer{Name: config.PodName}, config.Interval, lookup)
+	p.logger = zap.L().Named("kubernetes-discovery")
+	go p.run()
+	return p
+}
+
+// Names each SRV target by its first label, the pod name
+func podPeers(records []*net.SRV) []Peer {
+	var peers []Peer
+	for _, srv := range records {
+		host := strings.TrimSuffix(srv.Target, ".")
+		pod, _, _ := strings.Cut(host, ".")
+		peers = append(peers, Peer{
+			Name:    pod,
+			RPCAddr: net.JoinHostPort(host, strconv.Itoa(int(srv.Port))),
+		})
+	}
+	return peers
+}
+
+// Ordinal returns the StatefulSet ordinal ending a pod's name
+func Ordinal(podName string) (int, error) {
+	i := strings.LastIndex(podName, "-")
+	if i < 0 {
+		return 0, fmt.Errorf("pod name %q has no ordinal", podName)
+	}
+	ordinal, err := strconv.Atoi(podName[i+1:])
+	if err != nil {
+		return 0, fmt.Errorf("pod name %q has no ordinal", podName)
+	}
+	return ordinal, nil
+}
@@ -0,0 +1,30 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPodPeers(t *testing.T) {
+	peers := podPeers([]*net.SRV{
+		{Target: "proglog-0.proglog.default.svc.cluster.local.", Port: 8400},
+		{Target: "proglog-1.proglog.default.svc.cluster.local.", Port: 8400},
+	})
+	require.Equal(t, []Peer{
+		{Name: "proglog-0", RPCAddr: "proglog-0.proglog.default.svc.cluster.local:8400"},
+		{Name: "proglog-1", RPCAddr: "proglog-1.proglog.default.svc.cluster.local:8400"},
+	}, peers)
+}
+
+func TestOrdinal(t *testing.T) {
+	ordinal, err := Ordinal("proglog-12")
+	require.NoError(t, err)
+	require.Equal(t, 12, ordinal)
+
+	for _, name := range []string{"proglog", "proglog-a"} {
+		_, err = Ordinal(name)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,179 @@
+package discovery
+
+import (
+	"net"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// Membership wraps Serf to tell the handler as servers join and leave the cluster
+type Membership struct {
+	Config
+	handler Handler
+	serf    *serf.Serf
+	events  chan serf.Event
+	logger  *zap.Logger
+}
+
+func New(handler Handler, config Config) (*Membership, error) {
+	c := &Membership{
+		Config:  config,
+		handler: handler,
+		logger:  zap.L().Named("membership"),
+	}
+	if err := c.setupSerf(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+type Config struct {
+	NodeName string
+	// BindAddr is the host:port Serf gossips on, over both UDP and TCP
+	BindAddr string
+	// Tags travel with the node, the "rpc_addr" tag is passed to the
+	// handler and the "zone" tag to a ZoneHandler. A RegistrationHandler
+	// is passed those and the "node_id", "version" and "http_addr" tags.
+	Tags map[string]string
+	// StartJoinAddrs are the bind addresses of nodes already in the cluster
+	StartJoinAddrs []string
+}
+
+func (m *Membership) setupSerf() (err error) {
+	addr, err := net.ResolveTCPAddr("tcp", m.BindAddr)
+	if err != nil {
+		return err
+	}
+	config := serf.DefaultConfig()
+	config.Init()
+	config.MemberlistConfig.BindAddr = addr.IP.String()
+	config.MemberlistConfig.BindPort = addr.Port
+	m.events = make(chan serf.Event)
+	config.EventCh = m.events
+	config.Tags = m.Tags
+	config.NodeName = m.Config.NodeName
+	m.serf, err = serf.Create(config)
+	if err != nil {
+		return err
+	}
+	go m.eventHandler()
+	if m.StartJoinAddrs != nil {
+		_, err = m.serf.Join(m.StartJoinAddrs, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler is told about other servers, never the local one
+type Handler interface {
+	Join(name, addr string) error
+	Leave(name string) error
+}
+
+// ZoneHandler is a Handler that places servers by zone, it's told each
+// member's zone before the member joins
+type ZoneHandler interface {
+	Handler
+	SetZone(name, zone string)
+}
+
+// RegistrationHandler is a Handler that keeps track of what servers
+// register, it's told each member's registration before the member joins.
+// A member it fails to register isn't joined.
+type RegistrationHandler interface {
+	Handler
+	Register(name string, reg *api.Registration) error
+}
+
+// Discovery finds the cluster's other servers and tells a Handler about
+// them. Membership gossips with Serf; a Poller reads a static list, DNS or
+// a Kubernetes headless service.
+type Discovery interface {
+	// Leave stops discovery, announcing the departure if the backend can
+	Leave() error
+}
+
+var (
+	_ Discovery = (*Membership)(nil)
+	_ Discovery = (*Poller)(nil)
+)
+
+func (m *Membership) eventHandler() {
+	for e := range m.events {
+		switch e.EventType() {
+		case serf.EventMemberJoin:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleJoin(member)
+			}
+		case serf.EventMemberLeave, serf.EventMemberFailed:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					return
+				}
+				m.handleLeave(member)
+			}
+		}
+	}
+}
+
+func (m *Membership) handleJoin(member serf.Member) {
+	if h, ok := m.handler.(RegistrationHandler); ok {
+		if err := h.Register(member.Name, &api.Registration{
+			NodeId:   member.Tags["node_id"],
+			Version:  member.Tags["version"],
+			RpcAddr:  member.Tags["rpc_addr"],
+			HttpAddr: member.Tags["http_addr"],
+			Zone:     member.Tags["zone"],
+		}); err != nil {
+			m.logError(err, "failed to register", member)
+			return
+		}
+	}
+	if h, ok := m.handler.(ZoneHandler); ok {
+		h.SetZone(member.Name, member.Tags["zone"])
+	}
+	if err := m.handler.Join(
+		member.Name,
+		member.Tags["rpc_addr"],
+	); err != nil {
+		m.logError(err, "failed to join", member)
+	}
+}
+
+func (m *Membership) handleLeave(member serf.Member) {
+	if err := m.handler.Leave(
+		member.Name,
+	); err != nil {
+		m.logError(err, "failed to leave", member)
+	}
+}
+
+func (m *Membership) isLocal(member serf.Member) bool {
+	return m.serf.LocalMember().Name == member.Name
+}
+
+// Members returns a point in time view of the cluster, the local node included
+func (m *Membership) Members() []serf.Member {
+	return m.serf.Members()
+}
+
+// Leave tells the cluster this node is leaving
+func (m *Membership) Leave() error {
+	return m.serf.Leave()
+}
+
+func (m *Membership) logError(err error, msg string, member serf.Member) {
+	m.logger.Error(
+		msg,
+		zap.Error(err),
+		zap.String("name", member.Name),
+		zap.String("rpc_addr", member.Tags["rpc_addr"]),
+	)
+}
@@ -0,0 +1,157 @@
+package discovery
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The default for how often a Poller looks up the peers
+const defaultPollInterval = 10 * time.Second
+
+// Peer is a server found without gossip. Name is its Raft server ID, the
+// node name, and RPCAddr the address it serves RPC and Raft on.
+type Peer struct {
+	Name    string
+	RPCAddr string
+}
+
+// Poller tells the handler about the peers a lookup returns, looking them
+// up again on an interval to pick up changes. Only the leader can apply a
+// join or leave, so one that fails is retried on the next poll, and every
+// server keeps polling in case it becomes the leader.
+type Poller struct {
+	handler  Handler
+	lookup   func(context.Context) ([]Peer, error)
+	local    Peer
+	interval time.Duration
+	logger   *zap.Logger
+
+	mu     sync.Mutex
+	joined map[string]Peer
+	done   chan struct{}
+	closed bool
+}
+
+// StaticConfig lists the peers of a cluster that doesn't gossip
+type StaticConfig struct {
+	// NodeName and RPCAddr identify the local server, which Peers may include
+	NodeName string
+	RPCAddr  string
+	Peers    []Peer
+	// Interval is how often failed joins are retried, defaults to 10 seconds
+	Interval time.Duration
+}
+
+// NewStatic tells the handler about a fixed list of peers
+func NewStatic(handler Handler, config StaticConfig) *Poller {
+	peers := config.Peers
+	p := newPoller(handler, Peer{Name: config.NodeName, RPCAddr: config.RPCAddr}, config.Interval,
+		func(context.Context) ([]Peer, error) { return peers, nil },
+	)
+	p.logger = zap.L().Named("static-discovery")
+	go p.run()
+	return p
+}
+
+func newPoller(
+	handler Handler,
+	local Peer,
+	interval time.Duration,
+	lookup func(context.Context) ([]Peer, error),
+) *Poller {
+	if interval == 0 {
+		interval = defaultPollInterval
+	}
+	return &Poller{
+		handler:  handler,
+		lookup:   lookup,
+		local:    local,
+		interval: interval,
+		joined:   make(map[string]Peer),
+		done:     make(chan struct{}),
+	}
+}
+
+func (p *Poller) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.poll()
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Joins peers the lookup returned that haven't joined yet and removes
+// those that have but weren't returned
+func (p *Poller) poll() {
+	ctx, cancel := context.WithTimeout(context.Background(), p.interval)
+	defer cancel()
+	peers, err := p.lookup(ctx)
+	if err != nil {
+		p.logger.Error("failed to look up peers", zap.Error(err))
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	found := make(map[string]bool)
+	for _, peer := range peers {
+		if p.isLocal(peer) {
+			continue
+		}
+		found[peer.Name] = true
+		if joined, ok := p.joined[peer.Name]; ok && joined == peer {
+			continue
+		}
+		if err := p.handler.Join(peer.Name, peer.RPCAddr); err != nil {
+			p.logError(err, "failed to join", peer)
+			continue
+		}
+		p.joined[peer.Name] = peer
+	}
+	for name, peer := range p.joined {
+		if found[name] {
+			continue
+		}
+		if err := p.handler.Leave(name); err != nil {
+			p.logError(err, "failed to leave", peer)
+			continue
+		}
+		delete(p.joined, name)
+	}
+}
+
+func (p *Poller) isLocal(peer Peer) bool {
+	return peer.Name == p.local.Name || peer.RPCAddr == p.local.RPCAddr
+}
+
+// Leave stops polling, the peers learn this server left once it's dropped
+// from the lookup
+func (p *Poller) Leave() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.closed {
+		p.closed = true
+		close(p.done)
+	}
+	return nil
+}
+
+// Followers fail every join and leave, so failures are only worth a debug line
+func (p *Poller) logError(err error, msg string, peer Peer) {
+	p.logger.Debug(
+		msg,
+		zap.Error(err),
+		zap.String("name", peer.Name),
+		zap.String("rpc_addr", peer.RPCAddr),
+	)
+}
@@ -0,0 +1,121 @@
+package discovery
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestStatic(t *testing.T) {
+	h := &recordingHandler{fail: map[string]int{"2": 1}}
+	p := NewStatic(h, StaticConfig{
+		NodeName: "0",
+		RPCAddr:  "127.0.0.1:8400",
+		Peers: []Peer{
+			{Name: "0", RPCAddr: "127.0.0.1:8400"},
+			{Name: "1", RPCAddr: "127.0.0.1:8401"},
+			{Name: "2", RPCAddr: "127.0.0.1:8402"},
+		},
+		Interval: 10 * time.Millisecond,
+	})
+	defer p.Leave()
+
+	// the failed join is retried, the local server is skipped
+	require.Eventually(t, func() bool {
+		return h.joined() == "1,2"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPollerLeaves(t *testing.T) {
+	var mu sync.Mutex
+	peers := []Peer{
+		{Name: "1", RPCAddr: "127.0.0.1:8401"},
+		{Name: "2", RPCAddr: "127.0.0.1:8402"},
+	}
+	h := &recordingHandler{}
+	p := newPoller(h, Peer{Name: "0"}, 10*time.Millisecond, func(context.Context) ([]Peer, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		return peers, nil
+	})
+	p.logger = zap.NewNop()
+	go p.run()
+	defer p.Leave()
+
+	require.Eventually(t, func() bool {
+		return h.joined() == "1,2"
+	}, time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	peers = peers[:1]
+	mu.Unlock()
+	require.Eventually(t, func() bool {
+		return h.joined() == "1"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDNS(t *testing.T) {
+	h := &recordingHandler{}
+	p := NewDNS(h, DNSConfig{
+		NodeName: "127.0.0.1:8400",
+		RPCAddr:  "127.0.0.1:8400",
+		Name:     "localhost",
+		Port:     8401,
+		Interval: 10 * time.Millisecond,
+	})
+	defer p.Leave()
+
+	require.Eventually(t, func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.servers["127.0.0.1:8401"] == "127.0.0.1:8401"
+	}, time.Second, 10*time.Millisecond)
+}
+
+// recordingHandler tracks joined servers, failing a server's first joins
+// as many times as fail says
+type recordingHandler struct {
+	mu      sync.Mutex
+	fail    map[string]int
+	servers map[string]string
+}
+
+func (h *recordingHandler) Join(name, addr string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.fail[name] > 0 {
+		h.fail[name]--
+		return errors.New("not the leader")
+	}
+	if h.servers == nil {
+		h.servers = make(map[string]string)
+	}
+	h.servers[name] = addr
+	return nil
+}
+
+func (h *recordingHandler) Leave(name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.servers, name)
+	return nil
+}
+
+// Names of the joined servers, sorted and comma separated
+func (h *recordingHandler) joined() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var names []string
+	for name := range h.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
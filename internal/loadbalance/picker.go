@@ -0,0 +1,133 @@
+package loadbalance
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+var _ base.PickerBuilder = (*Picker)(nil)
+
+// Picker sends consumes to the followers in turn, those in the client's
+// zone when there are any, and everything else to the leader, consumes too
+// when there are no followers. Followers draining to shut down are
+// skipped. A call whose context names its leader, with WithLeader, goes to
+// that server instead of the one the resolver marked. With no leader
+// marked, as with servers an xDS control plane names, calls go to the
+// servers in turn until one names the leader. gRPC builds a new one from
+// the ready connections whenever they change.
+type Picker struct {
+	leader    balancer.SubConn
+	followers []balancer.SubConn
+	byAddr    map[string]balancer.SubConn
+	current   atomic.Uint64
+}
+
+type leaderKey struct{}
+
+// WithLeader tells the picker the call's leader is the server at addr, for
+// calls to partitions led by a server other than the one the resolver
+// marked, or when the leader changed since it last resolved. Calls go to
+// the marked leader while the client isn't connected to addr.
+func WithLeader(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, leaderKey{}, addr)
+}
+
+func (*Picker) Build(buildInfo base.PickerBuildInfo) balancer.Picker {
+	p := &Picker{byAddr: make(map[string]balancer.SubConn, len(buildInfo.ReadySCs))}
+	var local, remote []balancer.SubConn
+	for sc, scInfo := range buildInfo.ReadySCs {
+		p.byAddr[scInfo.Address.Addr] = sc
+		attrs := scInfo.Address.Attributes
+		isLeader, _ := attrs.Value("is_leader").(bool)
+		if isLeader {
+			p.leader = sc
+			continue
+		}
+		if draining, _ := attrs.Value("draining").(bool); draining {
+			continue
+		}
+		if sameZone, _ := attrs.Value("same_zone").(bool); sameZone {
+			local = append(local, sc)
+			continue
+		}
+		remote = append(remote, sc)
+	}
+	p.followers = remote
+	if len(local) > 0 {
+		p.followers = local
+	}
+	return p
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+func (p *Picker) Pick(info balancer.PickInfo) (
+	balancer.PickResult, error,
+) {
+	var result balancer.PickResult
+	if strings.Contains(info.FullMethodName, "Consume") &&
+		len(p.followers) > 0 {
+		result.SubConn = p.nextFollower()
+	} else {
+		result.SubConn = p.leaderFor(info.Ctx)
+	}
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+	return result, nil
+}
+
+func (p *Picker) leaderFor(ctx context.Context) balancer.SubConn {
+	if ctx != nil {
+		if addr, ok := ctx.Value(leaderKey{}).(string); ok {
+			if sc, ok := p.byAddr[addr]; ok {
+				return sc
+			}
+		}
+	}
+	if p.leader == nil && len(p.followers) > 0 {
+		return p.nextFollower()
+	}
+	return p.leader
+}
+
+func (p *Picker) nextFollower() balancer.SubConn {
+	cur := p.current.Add(1)
+	idx := int(cur % uint64(len(p.followers)))
+	return p.followers[idx]
+}
+
+func init() {
+	balancer.Register(builder{
+		base.NewBalancerBuilder(Name, &Picker{}, base.Config{}),
+	})
+}
+
+// builder builds the balancer the Picker picks for, which xDS clusters
+// select as a custom policy too
+type builder struct {
+	balancer.Builder
+}
+
+func (b builder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	return endpointsBalancer{b.Builder.Build(cc, opts)}
+}
+
+// endpointsBalancer connects to the endpoints' addresses when the state
+// names endpoints alone, as xDS's does
+type endpointsBalancer struct {
+	balancer.Balancer
+}
+
+func (b endpointsBalancer) UpdateClientConnState(s balancer.ClientConnState) error {
+	if len(s.ResolverState.Addresses) == 0 {
+		for _, e := range s.ResolverState.Endpoints {
+			s.ResolverState.Addresses = append(s.ResolverState.Addresses, e.Addresses...)
+		}
+	}
+	return b.Balancer.UpdateClientConnState(s)
+}
@@ -0,0 +1,210 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestPickerNoSubConnAvailable(t *testing.T) {
+	picker := (&Picker{}).Build(base.PickerBuildInfo{})
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/Consume",
+	} {
+		info := balancer.PickInfo{
+			FullMethodName: method,
+		}
+		result, err := picker.Pick(info)
+		require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+		require.Nil(t, result.SubConn)
+	}
+}
+
+func TestPickerProducesToLeader(t *testing.T) {
+	picker, subConns := setupPickerTest(3)
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/ProduceStream",
+		"/log.v1.Log/GetServers",
+	} {
+		info := balancer.PickInfo{
+			FullMethodName: method,
+		}
+		for i := 0; i < 5; i++ {
+			gotPick, err := picker.Pick(info)
+			require.NoError(t, err)
+			require.Equal(t, subConns[0], gotPick.SubConn)
+		}
+	}
+}
+
+func TestPickerConsumesFromFollowers(t *testing.T) {
+	picker, subConns := setupPickerTest(3)
+	info := balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/Consume",
+	}
+	picks := make(map[balancer.SubConn]int)
+	for i := 0; i < 4; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		picks[pick.SubConn]++
+	}
+	// each follower in turn, never the leader
+	require.Equal(t, map[balancer.SubConn]int{subConns[1]: 2, subConns[2]: 2}, picks)
+}
+
+func TestPickerConsumesFromSameZone(t *testing.T) {
+	picker, subConns := setupPickerTest(4, 2)
+	info := balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/Consume",
+	}
+	// only the follower in the client's zone while it's ready
+	for i := 0; i < 3; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[2], pick.SubConn)
+	}
+}
+
+func TestPickerSkipsDrainingFollowers(t *testing.T) {
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	var subConns []*subConn
+	for i := 0; i < 3; i++ {
+		sc := &subConn{}
+		attrs := attributes.New("is_leader", i == 0)
+		if i == 1 {
+			attrs = attrs.WithValue("draining", true)
+		}
+		addr := resolver.Address{Attributes: attrs}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	picker := (&Picker{}).Build(buildInfo)
+	info := balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/Consume",
+	}
+	for i := 0; i < 3; i++ {
+		pick, err := picker.Pick(info)
+		require.NoError(t, err)
+		require.Equal(t, subConns[2], pick.SubConn)
+	}
+}
+
+func TestPickerConsumesFromLeaderAlone(t *testing.T) {
+	picker, subConns := setupPickerTest(1)
+	info := balancer.PickInfo{
+		FullMethodName: "/log.v1.Log/ConsumeStream",
+	}
+	pick, err := picker.Pick(info)
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], pick.SubConn)
+}
+
+// The first of n subconns is the leader, those at sameZone are in the
+// client's zone
+func setupPickerTest(n int, sameZone ...int) (balancer.Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	for i := 0; i < n; i++ {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Attributes: attributes.New("is_leader", i == 0).
+				WithValue("same_zone", slices.Contains(sameZone, i)),
+		}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	picker := (&Picker{}).Build(buildInfo)
+	return picker, subConns
+}
+
+// subConn implements balancer.SubConn
+type subConn struct {
+	balancer.SubConn
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func TestPickerWithLeader(t *testing.T) {
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	var subConns []*subConn
+	for i := 0; i < 3; i++ {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Addr:       fmt.Sprintf("server-%d", i),
+			Attributes: attributes.New("is_leader", i == 0),
+		}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	picker := (&Picker{}).Build(buildInfo)
+
+	pick := func(method, leader string) balancer.SubConn {
+		ctx := context.Background()
+		if leader != "" {
+			ctx = WithLeader(ctx, leader)
+		}
+		result, err := picker.Pick(balancer.PickInfo{FullMethodName: method, Ctx: ctx})
+		require.NoError(t, err)
+		return result.SubConn
+	}
+	require.Equal(t, subConns[2], pick("/log.v1.Log/Produce", "server-2"))
+	// servers the client isn't connected to fall back to the marked leader
+	require.Equal(t, subConns[0], pick("/log.v1.Log/Produce", "server-3"))
+	require.Equal(t, subConns[0], pick("/log.v1.Log/Produce", ""))
+	// consumes still go to the followers
+	require.NotEqual(t, subConns[0], pick("/log.v1.Log/Consume", "server-0"))
+}
+
+func TestPickerWithoutLeader(t *testing.T) {
+	// servers an xDS control plane names carry no attributes
+	buildInfo := base.PickerBuildInfo{
+		ReadySCs: make(map[balancer.SubConn]base.SubConnInfo),
+	}
+	var subConns []*subConn
+	for i := 0; i < 2; i++ {
+		sc := &subConn{}
+		addr := resolver.Address{Addr: fmt.Sprintf("server-%d", i)}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+	picker := (&Picker{}).Build(buildInfo)
+
+	picks := make(map[balancer.SubConn]int)
+	for i := 0; i < 4; i++ {
+		result, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/Produce", Ctx: context.Background()})
+		require.NoError(t, err)
+		picks[result.SubConn]++
+	}
+	// each server in turn until one names the leader
+	require.Equal(t, map[balancer.SubConn]int{subConns[0]: 2, subConns[1]: 2}, picks)
+	for i := 0; i < 3; i++ {
+		result, err := picker.Pick(balancer.PickInfo{
+			FullMethodName: "/log.v1.Log/Produce",
+			Ctx:            WithLeader(context.Background(), "server-1"),
+		})
+		require.NoError(t, err)
+		require.Equal(t, subConns[1], result.SubConn)
+	}
+}
@@ -0,0 +1,260 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+)
+
+// Name is the resolver's scheme, dial proglog://<any server's RPC address>,
+// and the name of the balancer the resolver configures
+const Name = "proglog"
+
+// How often the resolver asks for the server list when gRPC doesn't ask first
+var refreshInterval = 10 * time.Second
+
+// Builder builds a Resolver for each proglog:// target. One is registered
+// for the scheme; pass another with grpc.WithResolvers when the cluster
+// needs credentials, such as an API key, to answer GetServers.
+type Builder struct {
+	// DialOptions are added to the connection that asks for the servers
+	DialOptions []grpc.DialOption
+	// Zone is the client's zone, consumes go to followers in it when
+	// there are any
+	Zone string
+
+	mu        sync.Mutex
+	resolvers map[*Resolver]struct{}
+}
+
+var _ resolver.Builder = (*Builder)(nil)
+
+func (b *Builder) Build(
+	target resolver.Target,
+	cc resolver.ClientConn,
+	opts resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	r := &Resolver{
+		clientConn: cc,
+		serviceConfig: cc.ParseServiceConfig(
+			fmt.Sprintf(`{"loadBalancingConfig":[{"%s":{}}]}`, Name),
+		),
+		target:  target.Endpoint(),
+		zone:    b.Zone,
+		logger:  zap.L().Named("resolver"),
+		done:    make(chan struct{}),
+		builder: b,
+	}
+	var dialOpts []grpc.DialOption
+	if opts.DialCreds != nil {
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(opts.DialCreds))
+	}
+	if opts.Dialer != nil {
+		dialOpts = append(dialOpts, grpc.WithContextDialer(opts.Dialer))
+	}
+	dialOpts = append(dialOpts, b.DialOptions...)
+	r.dialOpts = dialOpts
+	r.resolverAddr = r.target
+	var err error
+	r.resolverConn, err = grpc.NewClient(r.target, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	r.ResolveNow(resolver.ResolveNowOptions{})
+	go r.refresh()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.resolvers == nil {
+		b.resolvers = make(map[*Resolver]struct{})
+	}
+	b.resolvers[r] = struct{}{}
+	return r, nil
+}
+
+func (b *Builder) Scheme() string {
+	return Name
+}
+
+// ResolveNow has the builder's resolvers ask for the servers again without
+// waiting for their next poll, for clients told the leader has moved
+func (b *Builder) ResolveNow() {
+	b.mu.Lock()
+	resolvers := make([]*Resolver, 0, len(b.resolvers))
+	for r := range b.resolvers {
+		resolvers = append(resolvers, r)
+	}
+	b.mu.Unlock()
+	for _, r := range resolvers {
+		go r.ResolveNow(resolver.ResolveNowOptions{})
+	}
+}
+
+func init() {
+	resolver.Register(&Builder{})
+}
+
+// Resolver turns a proglog:// target into the cluster's servers by calling
+// GetServers on the target, each address carrying an "is_leader" attribute,
+// when the client has a zone a "same_zone" one, and "draining" for a
+// server shutting down. Once the target's down it asks the servers it
+// last listed instead, so the client outlives the server it was given.
+type Resolver struct {
+	mu         sync.Mutex
+	clientConn resolver.ClientConn
+	// resolverConn is to the server asked for the others, at resolverAddr
+	resolverConn *grpc.ClientConn
+	resolverAddr string
+	dialOpts     []grpc.DialOption
+	// picks the leader/follower balancer
+	serviceConfig *serviceconfig.ParseResult
+	target        string
+	zone          string
+	logger        *zap.Logger
+	servers       []*api.Server
+	done          chan struct{}
+	builder       *Builder
+}
+
+var _ resolver.Resolver = (*Resolver)(nil)
+
+func (r *Resolver) ResolveNow(resolver.ResolveNowOptions) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+	res, err := r.getServers()
+	if status.Code(err) == codes.Unimplemented {
+		// a server that isn't clustered is the whole cluster
+		res, err = &api.GetServersResponse{Servers: []*api.Server{{
+			Id:       r.target,
+			RpcAddr:  r.target,
+			IsLeader: true,
+		}}}, nil
+	}
+	if err != nil {
+		r.logger.Error("failed to resolve server", zap.Error(err))
+		r.clientConn.ReportError(err)
+		return
+	}
+	// the list only reaches gRPC when the cluster changed
+	if r.servers != nil && sameServers(r.servers, res.Servers) {
+		return
+	}
+	var addrs []resolver.Address
+	for _, server := range res.Servers {
+		attrs := attributes.New(
+			"is_leader",
+			server.IsLeader,
+		)
+		if r.zone != "" {
+			attrs = attrs.WithValue("same_zone", server.Zone == r.zone)
+		}
+		if server.Draining {
+			attrs = attrs.WithValue("draining", true)
+		}
+		addrs = append(addrs, resolver.Address{
+			Addr:       server.RpcAddr,
+			Attributes: attrs,
+		})
+	}
+	if err := r.clientConn.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	}); err != nil {
+		r.logger.Error("failed to update state", zap.Error(err))
+		return
+	}
+	r.servers = res.Servers
+}
+
+// Asks the server resolved from for the cluster's servers and, when it
+// fails, the others last listed in turn, resolving from the first that
+// answers from then on
+func (r *Resolver) getServers() (*api.GetServersResponse, error) {
+	res, err := askServers(r.resolverConn)
+	if err == nil || status.Code(err) == codes.Unimplemented {
+		return res, err
+	}
+	for _, server := range r.servers {
+		if server.RpcAddr == r.resolverAddr {
+			continue
+		}
+		conn, cerr := grpc.NewClient(server.RpcAddr, r.dialOpts...)
+		if cerr != nil {
+			continue
+		}
+		other, oerr := askServers(conn)
+		if oerr != nil {
+			conn.Close()
+			continue
+		}
+		r.logger.Info("resolving from another server",
+			zap.String("failed", r.resolverAddr),
+			zap.String("server", server.RpcAddr),
+			zap.Error(err),
+		)
+		r.resolverConn.Close()
+		r.resolverConn, r.resolverAddr = conn, server.RpcAddr
+		return other, nil
+	}
+	return nil, err
+}
+
+func askServers(conn *grpc.ClientConn) (*api.GetServersResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return api.NewLogClient(conn).GetServers(ctx, &api.GetServersRequest{})
+}
+
+// Polls the cluster so joins, leaves and leader changes are picked up
+func (r *Resolver) refresh() {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-ticker.C:
+			r.ResolveNow(resolver.ResolveNowOptions{})
+		}
+	}
+}
+
+func (r *Resolver) Close() {
+	r.builder.mu.Lock()
+	delete(r.builder.resolvers, r)
+	r.builder.mu.Unlock()
+	close(r.done)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.resolverConn.Close(); err != nil {
+		r.logger.Error("failed to close conn", zap.Error(err))
+	}
+}
+
+func sameServers(a, b []*api.Server) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Id != b[i].Id || a[i].RpcAddr != b[i].RpcAddr ||
+			a[i].IsLeader != b[i].IsLeader || a[i].Zone != b[i].Zone ||
+			a[i].Draining != b[i].Draining {
+			return false
+		}
+	}
+	return true
+}
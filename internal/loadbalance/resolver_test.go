@@ -0,0 +1,195 @@
+package loadbalance
+
+import (
+	"net"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+func TestResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	clog := &getServers{Log: server.NewLog()}
+	clog.set([]*api.Server{{
+		Id:       "leader",
+		RpcAddr:  "localhost:9001",
+		IsLeader: true,
+	}, {
+		Id:      "follower",
+		RpcAddr: "localhost:9002",
+	}})
+	srv, err := server.NewGRPCServer(&server.Config{CommitLog: clog})
+	require.NoError(t, err)
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	refreshInterval = 10 * time.Millisecond
+
+	conn := &clientConn{}
+	opts := resolver.BuildOptions{
+		DialCreds: insecure.NewCredentials(),
+	}
+	r := &Builder{}
+	res, err := r.Build(
+		resolver.Target{URL: *mustParse(t, "proglog:///"+l.Addr().String())},
+		conn,
+		opts,
+	)
+	require.NoError(t, err)
+	defer res.Close()
+
+	wantState := resolver.State{
+		Addresses: []resolver.Address{{
+			Addr:       "localhost:9001",
+			Attributes: attributes.New("is_leader", true),
+		}, {
+			Addr:       "localhost:9002",
+			Attributes: attributes.New("is_leader", false),
+		}},
+	}
+	require.Equal(t, wantState, conn.last())
+
+	// a leader change reaches gRPC on the next refresh
+	clog.set([]*api.Server{{
+		Id:      "leader",
+		RpcAddr: "localhost:9001",
+	}, {
+		Id:       "follower",
+		RpcAddr:  "localhost:9002",
+		IsLeader: true,
+	}})
+	wantState = resolver.State{
+		Addresses: []resolver.Address{{
+			Addr:       "localhost:9001",
+			Attributes: attributes.New("is_leader", false),
+		}, {
+			Addr:       "localhost:9002",
+			Attributes: attributes.New("is_leader", true),
+		}},
+	}
+	require.Eventually(t, func() bool {
+		return reflect.DeepEqual(wantState, conn.last())
+	}, time.Second, 10*time.Millisecond)
+	// unchanged lists aren't reported again
+	time.Sleep(5 * refreshInterval)
+	require.Equal(t, 2, conn.updates())
+}
+
+func TestResolverFailover(t *testing.T) {
+	refreshInterval = 10 * time.Millisecond
+	clog := &getServers{Log: server.NewLog()}
+	var (
+		addrs []string
+		srvs  []*grpc.Server
+	)
+	for range 2 {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		srv, err := server.NewGRPCServer(&server.Config{CommitLog: clog})
+		require.NoError(t, err)
+		go srv.Serve(l)
+		defer srv.Stop()
+		addrs = append(addrs, l.Addr().String())
+		srvs = append(srvs, srv)
+	}
+	clog.set([]*api.Server{
+		{Id: "a", RpcAddr: addrs[0], IsLeader: true},
+		{Id: "b", RpcAddr: addrs[1]},
+	})
+
+	conn := &clientConn{}
+	res, err := (&Builder{}).Build(
+		resolver.Target{URL: *mustParse(t, "proglog:///"+addrs[0])},
+		conn,
+		resolver.BuildOptions{DialCreds: insecure.NewCredentials()},
+	)
+	require.NoError(t, err)
+	defer res.Close()
+	require.Len(t, conn.last().Addresses, 2)
+
+	// with the target gone the list comes from the server left
+	srvs[0].Stop()
+	clog.set([]*api.Server{{Id: "b", RpcAddr: addrs[1], IsLeader: true}})
+	want := resolver.State{Addresses: []resolver.Address{{
+		Addr:       addrs[1],
+		Attributes: attributes.New("is_leader", true),
+	}}}
+	require.Eventually(t, func() bool {
+		return reflect.DeepEqual(want, conn.last())
+	}, 3*time.Second, 10*time.Millisecond)
+}
+
+func mustParse(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	require.NoError(t, err)
+	return u
+}
+
+type getServers struct {
+	*server.Log
+	mu      sync.Mutex
+	servers []*api.Server
+}
+
+func (s *getServers) set(servers []*api.Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.servers = servers
+}
+
+func (s *getServers) GetServers() ([]*api.Server, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.servers, nil
+}
+
+// clientConn records the states the resolver reports
+type clientConn struct {
+	resolver.ClientConn
+	mu     sync.Mutex
+	states []resolver.State
+}
+
+func (c *clientConn) UpdateState(state resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.states = append(c.states, state)
+	return nil
+}
+
+func (c *clientConn) ReportError(err error) {}
+
+func (c *clientConn) NewAddress(addrs []resolver.Address) {}
+
+func (c *clientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
+	return nil
+}
+
+func (c *clientConn) last() resolver.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.states) == 0 {
+		return resolver.State{}
+	}
+	return c.states[len(c.states)-1]
+}
+
+func (c *clientConn) updates() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.states)
+}
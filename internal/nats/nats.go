@@ -0,0 +1,517 @@
+// Package nats is a client of NATS's core protocol, as much of it as the
+// servers' bridge takes: publishes with headers, subscriptions in queue
+// groups, and flushes that learn the server has what was published
+// before them. A Conn is one connection, it doesn't reconnect.
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPort is NATS's client port, dialed when a URL has none
+const DefaultPort = "4222"
+
+// Lines longer than this close the connection
+const maxLine = 32 << 10
+
+var (
+	// ErrClosed is returned by calls on a connection that's closed
+	ErrClosed = errors.New("nats: connection closed")
+	// ErrHeadersNotSupported is returned publishing headers to a server
+	// that doesn't take them
+	ErrHeadersNotSupported = errors.New("nats: server doesn't support headers")
+	// ErrMaxPayload is returned publishing a message bigger than the
+	// server takes
+	ErrMaxPayload = errors.New("nats: message over the server's max payload")
+	// ErrPermissionViolation is returned by Flush when the server refused
+	// a publish or subscription since the last flush
+	ErrPermissionViolation = errors.New("nats: permissions violation")
+
+	errMalformed = errors.New("nats: malformed protocol line")
+)
+
+// Header is a message's headers. Keys are kept as they're given, NATS
+// doesn't fold their case.
+type Header map[string][]string
+
+// Msg is a message published to a subject
+type Msg struct {
+	Subject string
+	// Reply is the subject to answer to, empty if it takes no answer
+	Reply  string
+	Header Header
+	Data   []byte
+}
+
+// The INFO the server sends on connecting
+type serverInfo struct {
+	Headers      bool  `json:"headers"`
+	MaxPayload   int64 `json:"max_payload"`
+	TLSRequired  bool  `json:"tls_required"`
+	AuthRequired bool  `json:"auth_required"`
+}
+
+// The CONNECT the client answers with
+type connectInfo struct {
+	Verbose     bool   `json:"verbose"`
+	Pedantic    bool   `json:"pedantic"`
+	TLSRequired bool   `json:"tls_required"`
+	Name        string `json:"name,omitempty"`
+	Lang        string `json:"lang"`
+	Version     string `json:"version"`
+	Protocol    int    `json:"protocol"`
+	Headers     bool   `json:"headers"`
+	User        string `json:"user,omitempty"`
+	Pass        string `json:"pass,omitempty"`
+	AuthToken   string `json:"auth_token,omitempty"`
+}
+
+// Conn is a connection to a NATS server, safe for concurrent use
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	info serverInfo
+
+	// wmu orders writes, and keeps the PONGs awaited in the order their
+	// PINGs are sent
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu      sync.Mutex
+	subs    map[uint64]func(*Msg)
+	nextSID uint64
+	pongs   []chan struct{}
+	// violation is the permissions violation reported since the last
+	// flush, err what ended the connection
+	violation error
+	err       error
+	done      chan struct{}
+}
+
+// Dial connects to the NATS server at the URL, nats:// or tls://, and
+// authenticates with its user and password, or its user as a token when
+// it has no password. tlsConfig secures tls:// URLs and servers requiring
+// TLS, nil uses the system roots. name is the client's name for the
+// server's monitoring.
+func Dial(ctx context.Context, rawURL, name string, tlsConfig *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("nats: %w", err)
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("nats: unsupported url scheme %q", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), DefaultPort)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c := &Conn{
+		conn: conn,
+		r:    bufio.NewReaderSize(conn, maxLine),
+		w:    bufio.NewWriter(conn),
+		subs: make(map[uint64]func(*Msg)),
+		done: make(chan struct{}),
+	}
+	if err := c.handshake(ctx, u, name, tlsConfig); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.conn.SetDeadline(time.Time{})
+	go c.read()
+	return c, nil
+}
+
+// Reads the INFO, upgrading to TLS if it's wanted, and answers it,
+// waiting for the PONG to its PING that says the server took the CONNECT
+func (c *Conn) handshake(ctx context.Context, u *url.URL, name string, tlsConfig *tls.Config) error {
+	op, args, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if op != "INFO" {
+		return fmt.Errorf("nats: want INFO, got %s", op)
+	}
+	if err := json.Unmarshal([]byte(args), &c.info); err != nil {
+		return fmt.Errorf("nats: %w", err)
+	}
+	secure := u.Scheme == "tls" || c.info.TLSRequired
+	if secure {
+		config := &tls.Config{}
+		if tlsConfig != nil {
+			config = tlsConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tc := tls.Client(c.conn, config)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			return err
+		}
+		c.conn = tc
+		c.r.Reset(tc)
+		c.w.Reset(tc)
+	}
+	connect := connectInfo{
+		TLSRequired: secure,
+		Name:        name,
+		Lang:        "go",
+		Version:     "1",
+		Protocol:    1,
+		Headers:     c.info.Headers,
+	}
+	if pass, ok := u.User.Password(); ok {
+		connect.User, connect.Pass = u.User.Username(), pass
+	} else if u.User != nil {
+		connect.AuthToken = u.User.Username()
+	}
+	b, err := json.Marshal(connect)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.w, "CONNECT %s\r\nPING\r\n", b)
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	for {
+		op, args, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case "PONG":
+			return nil
+		case "-ERR":
+			return fmt.Errorf("nats: %s", strings.Trim(args, "' "))
+		}
+	}
+}
+
+// Reads a protocol line, its operation in upper case and what follows
+func (c *Conn) readLine() (op, args string, err error) {
+	line, err := c.r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", "", errMalformed
+	}
+	if err != nil {
+		return "", "", err
+	}
+	s := strings.TrimRight(string(line), "\r\n")
+	op, args, _ = strings.Cut(s, " ")
+	return strings.ToUpper(op), strings.TrimSpace(args), nil
+}
+
+func (c *Conn) read() {
+	err := c.readLoop()
+	if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+		err = ErrClosed
+	}
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.conn.Close()
+	close(c.done)
+}
+
+// Dispatches what the server sends. Subscriptions' handlers are called
+// one message at a time, in order, as they're read.
+func (c *Conn) readLoop() error {
+	for {
+		op, args, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case "MSG", "HMSG":
+			msg, sid, err := c.readMsg(op == "HMSG", strings.Fields(args))
+			if err != nil {
+				return err
+			}
+			c.mu.Lock()
+			fn := c.subs[sid]
+			c.mu.Unlock()
+			if fn != nil {
+				fn(msg)
+			}
+		case "PING":
+			c.wmu.Lock()
+			c.w.WriteString("PONG\r\n")
+			err := c.w.Flush()
+			c.wmu.Unlock()
+			if err != nil {
+				return err
+			}
+		case "PONG":
+			c.mu.Lock()
+			if len(c.pongs) > 0 {
+				close(c.pongs[0])
+				c.pongs = c.pongs[1:]
+			}
+			c.mu.Unlock()
+		case "-ERR":
+			msg := strings.Trim(args, "' ")
+			// the server goes on after refusing a subject, ends otherwise
+			if !strings.HasPrefix(strings.ToLower(msg), "permissions violation") {
+				return fmt.Errorf("nats: %s", msg)
+			}
+			c.mu.Lock()
+			c.violation = fmt.Errorf("%w: %s", ErrPermissionViolation, msg)
+			c.mu.Unlock()
+		case "INFO", "+OK":
+		default:
+			return errMalformed
+		}
+	}
+}
+
+// Reads a message: subject, sid, an optional reply subject, then the
+// header and total sizes for an HMSG or the payload's size for a MSG
+func (c *Conn) readMsg(headers bool, args []string) (*Msg, uint64, error) {
+	sizes := 1
+	if headers {
+		sizes = 2
+	}
+	if len(args) != 2+sizes && len(args) != 3+sizes {
+		return nil, 0, errMalformed
+	}
+	msg := &Msg{Subject: args[0]}
+	sid, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return nil, 0, errMalformed
+	}
+	if len(args) == 3+sizes {
+		msg.Reply = args[2]
+	}
+	total, err := strconv.Atoi(args[len(args)-1])
+	if err != nil || total < 0 {
+		return nil, 0, errMalformed
+	}
+	hdr := 0
+	if headers {
+		if hdr, err = strconv.Atoi(args[len(args)-2]); err != nil || hdr < 0 || hdr > total {
+			return nil, 0, errMalformed
+		}
+	}
+	b := make([]byte, total+2)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, 0, err
+	}
+	if !bytes.HasSuffix(b, []byte("\r\n")) {
+		return nil, 0, errMalformed
+	}
+	if headers {
+		if msg.Header, err = parseHeader(b[:hdr]); err != nil {
+			return nil, 0, err
+		}
+	}
+	msg.Data = b[hdr:total]
+	return msg, sid, nil
+}
+
+// Parses a header block, "NATS/1.0" and a status on its first line and
+// then "Key: Value" lines up to a blank one
+func parseHeader(b []byte) (Header, error) {
+	lines := strings.Split(string(b), "\r\n")
+	if !strings.HasPrefix(lines[0], "NATS/1.0") {
+		return nil, errMalformed
+	}
+	h := make(Header)
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, errMalformed
+		}
+		k = strings.TrimSpace(k)
+		h[k] = append(h[k], strings.TrimSpace(v))
+	}
+	return h, nil
+}
+
+func appendHeader(b []byte, h Header) []byte {
+	b = append(b, "NATS/1.0\r\n"...)
+	for k, vs := range h {
+		for _, v := range vs {
+			b = append(b, k...)
+			b = append(b, ": "...)
+			b = append(b, v...)
+			b = append(b, "\r\n"...)
+		}
+	}
+	return append(b, "\r\n"...)
+}
+
+// Publish sends the message to the subject. It's buffered until Flush
+// sends it, or the buffer fills.
+func (c *Conn) Publish(subject string, header Header, data []byte) error {
+	if !ValidSubject(subject, false) {
+		return fmt.Errorf("nats: invalid subject %q", subject)
+	}
+	var h []byte
+	if len(header) > 0 {
+		if !c.info.Headers {
+			return ErrHeadersNotSupported
+		}
+		for k, vs := range header {
+			for _, v := range vs {
+				if !ValidHeader(k, v) {
+					return fmt.Errorf("nats: invalid header %q", k)
+				}
+			}
+		}
+		h = appendHeader(nil, header)
+	}
+	if c.info.MaxPayload > 0 && int64(len(h)+len(data)) > c.info.MaxPayload {
+		return ErrMaxPayload
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.Err(); err != nil {
+		return err
+	}
+	if h != nil {
+		fmt.Fprintf(c.w, "HPUB %s %d %d\r\n", subject, len(h), len(h)+len(data))
+		c.w.Write(h)
+	} else {
+		fmt.Fprintf(c.w, "PUB %s %d\r\n", subject, len(data))
+	}
+	c.w.Write(data)
+	_, err := c.w.WriteString("\r\n")
+	return err
+}
+
+// Subscribe calls fn with the messages published to the subject, which
+// may have wildcards, from the read loop, so fn holds up the messages
+// after it and mustn't Flush. Subscribers in the same non-empty queue
+// group share the subject's messages, each going to one of them.
+func (c *Conn) Subscribe(subject, queue string, fn func(*Msg)) error {
+	if !ValidSubject(subject, true) || strings.ContainsAny(queue, " \t\r\n") {
+		return fmt.Errorf("nats: invalid subject %q or queue %q", subject, queue)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.Err(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.nextSID++
+	sid := c.nextSID
+	c.subs[sid] = fn
+	c.mu.Unlock()
+	if queue != "" {
+		fmt.Fprintf(c.w, "SUB %s %s %d\r\n", subject, queue, sid)
+	} else {
+		fmt.Fprintf(c.w, "SUB %s %d\r\n", subject, sid)
+	}
+	return c.w.Flush()
+}
+
+// Flush sends what's buffered and waits for the server to have processed
+// it, failing with ErrPermissionViolation if the server refused a publish
+// or subscription since the last flush
+func (c *Conn) Flush(ctx context.Context) error {
+	pong := make(chan struct{})
+	c.wmu.Lock()
+	if err := c.Err(); err != nil {
+		c.wmu.Unlock()
+		return err
+	}
+	c.mu.Lock()
+	c.pongs = append(c.pongs, pong)
+	c.mu.Unlock()
+	c.w.WriteString("PING\r\n")
+	err := c.w.Flush()
+	c.wmu.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case <-pong:
+	case <-c.done:
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err, c.violation = c.violation, nil
+	return err
+}
+
+// Done is closed when the connection ends, Err saying why
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err is what ended the connection, nil while it's open
+func (c *Conn) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close ends the connection and waits for its read loop to
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = ErrClosed
+	}
+	c.mu.Unlock()
+	err := c.conn.Close()
+	<-c.done
+	return err
+}
+
+// ValidHeader reports whether the header fits a message's header block:
+// a key without whitespace or colons, and a value on one line
+func ValidHeader(key, value string) bool {
+	return key != "" && !strings.ContainsAny(key, " \t\r\n:") && !strings.ContainsAny(value, "\r\n")
+}
+
+// ValidSubject reports whether the subject is one NATS takes: tokens
+// separated by dots, with no whitespace, and with wildcards, * for a
+// token and > for the ones left, only when they're allowed
+func ValidSubject(subject string, wildcards bool) bool {
+	if subject == "" {
+		return false
+	}
+	tokens := strings.Split(subject, ".")
+	for i, token := range tokens {
+		if token == "" || strings.ContainsAny(token, " \t\r\n") {
+			return false
+		}
+		if !wildcards && (token == "*" || token == ">") {
+			return false
+		}
+		if token == ">" && i != len(tokens)-1 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,120 @@
+package nats
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/frankie-mur/proglog/internal/nats/natstest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConn(t *testing.T) {
+	srv := natstest.NewServer(t)
+	ctx := context.Background()
+	sub, err := Dial(ctx, srv.URL, "sub", nil)
+	require.NoError(t, err)
+	defer sub.Close()
+	msgs := make(chan *Msg, 10)
+	require.NoError(t, sub.Subscribe("sensors.>", "", func(m *Msg) { msgs <- m }))
+	require.NoError(t, sub.Flush(ctx))
+
+	pub, err := Dial(ctx, srv.URL, "pub", nil)
+	require.NoError(t, err)
+	defer pub.Close()
+	require.NoError(t, pub.Publish("sensors.room1.temp", nil, []byte("21")))
+	require.NoError(t, pub.Publish("sensors.room1.humidity", Header{"Unit": {"%"}, "Tag": {"a", "b"}}, []byte("40")))
+	require.NoError(t, pub.Publish("other", nil, []byte("skipped")))
+	require.NoError(t, pub.Flush(ctx))
+
+	m := <-msgs
+	require.Equal(t, "sensors.room1.temp", m.Subject)
+	require.Equal(t, "21", string(m.Data))
+	require.Nil(t, m.Header)
+	m = <-msgs
+	require.Equal(t, "sensors.room1.humidity", m.Subject)
+	require.Equal(t, "40", string(m.Data))
+	require.Equal(t, Header{"Unit": {"%"}, "Tag": {"a", "b"}}, m.Header)
+
+	// the server's limits and refusals
+	require.ErrorIs(t, pub.Publish("big", nil, make([]byte, natstest.MaxPayload+1)), ErrMaxPayload)
+	require.Error(t, pub.Publish("sensors.*", nil, nil))
+	require.Error(t, pub.Publish("sensors.x", Header{"Unit": {"a\r\nb"}}, nil))
+	srv.Deny("denied")
+	require.NoError(t, pub.Publish("denied", nil, []byte("no")))
+	require.ErrorIs(t, pub.Flush(ctx), ErrPermissionViolation)
+	require.NoError(t, pub.Flush(ctx))
+
+	require.NoError(t, pub.Close())
+	require.ErrorIs(t, pub.Publish("sensors.x", nil, nil), ErrClosed)
+	require.ErrorIs(t, pub.Flush(ctx), ErrClosed)
+}
+
+func TestConnQueue(t *testing.T) {
+	srv := natstest.NewServer(t)
+	ctx := context.Background()
+	got := make(chan string, 10)
+	for _, name := range []string{"a", "b"} {
+		c, err := Dial(ctx, srv.URL, name, nil)
+		require.NoError(t, err)
+		defer c.Close()
+		require.NoError(t, c.Subscribe("jobs", "workers", func(m *Msg) { got <- name }))
+		require.NoError(t, c.Flush(ctx))
+	}
+	pub, err := Dial(ctx, srv.URL, "pub", nil)
+	require.NoError(t, err)
+	defer pub.Close()
+	for range 4 {
+		require.NoError(t, pub.Publish("jobs", nil, nil))
+	}
+	require.NoError(t, pub.Flush(ctx))
+	// each message goes to one of the group
+	var names []string
+	for range 4 {
+		select {
+		case name := <-got:
+			names = append(names, name)
+		case <-time.After(5 * time.Second):
+			t.Fatal("missing message")
+		}
+	}
+	require.ElementsMatch(t, []string{"a", "a", "b", "b"}, names)
+	select {
+	case name := <-got:
+		t.Fatalf("message delivered twice, to %s", name)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestConnEnds(t *testing.T) {
+	srv := natstest.NewServer(t)
+	c, err := Dial(context.Background(), srv.URL, "c", nil)
+	require.NoError(t, err)
+	srv.Close()
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection isn't done after the server closed")
+	}
+	require.Error(t, c.Err())
+
+	_, err = Dial(context.Background(), "http://localhost", "c", nil)
+	require.ErrorContains(t, err, "scheme")
+}
+
+func TestValidSubject(t *testing.T) {
+	for subject, want := range map[string][2]bool{
+		"sensors.room1":  {true, true},
+		"sensors.*.temp": {false, true},
+		"sensors.>":      {false, true},
+		"sensors.>.temp": {false, false},
+		"sensors..temp":  {false, false},
+		"":               {false, false},
+		"has space":      {false, false},
+	} {
+		require.Equal(t, want[0], ValidSubject(subject, false), subject)
+		require.Equal(t, want[1], ValidSubject(subject, true), subject)
+	}
+	require.True(t, strings.HasPrefix(DefaultPort, "42"))
+}
@@ -0,0 +1,249 @@
+// Package natstest runs a NATS server in process for tests: core publish
+// and subscribe with headers and queue groups, without clustering,
+// JetStream, TLS or authentication.
+package natstest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// MaxPayload is the biggest message the server takes
+const MaxPayload = 1 << 20
+
+// Server is a NATS server listening on a loopback port
+type Server struct {
+	// URL is the nats:// URL clients dial
+	URL string
+
+	ln net.Listener
+	wg sync.WaitGroup
+
+	mu    sync.Mutex
+	conns map[*conn]struct{}
+	// deny are subjects publishing to is refused
+	deny map[string]bool
+	// next spreads a queue group's messages over its members
+	next int
+}
+
+type conn struct {
+	net.Conn
+	wmu  sync.Mutex
+	subs map[string]*sub
+}
+
+type sub struct {
+	subject, queue, sid string
+}
+
+// NewServer starts a server, closed when the test ends
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		URL:   "nats://" + ln.Addr().String(),
+		ln:    ln,
+		conns: make(map[*conn]struct{}),
+		deny:  make(map[string]bool),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Deny refuses publishes to the subject with a permissions violation
+func (s *Server) Deny(subject string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deny[subject] = true
+}
+
+// Close closes the listener and every connection and waits for them
+func (s *Server) Close() {
+	s.ln.Close()
+	s.mu.Lock()
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{Conn: nc, subs: make(map[string]*sub)}
+		s.mu.Lock()
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		s.wg.Add(1)
+		go s.serveConn(c)
+	}
+}
+
+func (s *Server) serveConn(c *conn) {
+	defer s.wg.Done()
+	defer func() {
+		c.Close()
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+	c.write(fmt.Sprintf("INFO {\"server_id\":\"natstest\",\"headers\":true,\"max_payload\":%d,\"proto\":1}\r\n", MaxPayload))
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		op, args, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		fields := strings.Fields(args)
+		switch strings.ToUpper(op) {
+		case "CONNECT":
+		case "PING":
+			c.write("PONG\r\n")
+		case "PONG":
+		case "SUB":
+			if len(fields) < 2 || len(fields) > 3 {
+				c.write("-ERR 'Invalid Subscription'\r\n")
+				return
+			}
+			sb := &sub{subject: fields[0], sid: fields[len(fields)-1]}
+			if len(fields) == 3 {
+				sb.queue = fields[1]
+			}
+			s.mu.Lock()
+			c.subs[sb.sid] = sb
+			s.mu.Unlock()
+		case "UNSUB":
+			if len(fields) > 0 {
+				s.mu.Lock()
+				delete(c.subs, fields[0])
+				s.mu.Unlock()
+			}
+		case "PUB", "HPUB":
+			headers := strings.ToUpper(op) == "HPUB"
+			subject, hdr, total, ok := parsePub(fields, headers)
+			if !ok || total > MaxPayload {
+				c.write("-ERR 'Maximum Payload Violation'\r\n")
+				return
+			}
+			b := make([]byte, total+2)
+			if _, err := io.ReadFull(r, b); err != nil {
+				return
+			}
+			s.mu.Lock()
+			denied := s.deny[subject]
+			s.mu.Unlock()
+			if denied {
+				c.write(fmt.Sprintf("-ERR 'Permissions Violation for Publish to %s'\r\n", subject))
+				continue
+			}
+			s.publish(subject, hdr, b[:total])
+		default:
+			c.write("-ERR 'Unknown Protocol Operation'\r\n")
+			return
+		}
+	}
+}
+
+// Parses a PUB's subject, optional reply and size, or an HPUB's with its
+// header size before
+func parsePub(fields []string, headers bool) (subject string, hdr, total int, ok bool) {
+	sizes := 1
+	if headers {
+		sizes = 2
+	}
+	if len(fields) != 1+sizes && len(fields) != 2+sizes {
+		return "", 0, 0, false
+	}
+	total, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil {
+		return "", 0, 0, false
+	}
+	if headers {
+		if hdr, err = strconv.Atoi(fields[len(fields)-2]); err != nil || hdr > total {
+			return "", 0, 0, false
+		}
+	} else {
+		hdr = -1
+	}
+	return fields[0], hdr, total, true
+}
+
+// Delivers the message to every plain subscription it matches and one
+// member of each queue group
+func (s *Server) publish(subject string, hdr int, b []byte) {
+	type target struct {
+		c  *conn
+		sb *sub
+	}
+	var plain []target
+	queues := make(map[string][]target)
+	s.mu.Lock()
+	for c := range s.conns {
+		for _, sb := range c.subs {
+			if !Match(sb.subject, subject) {
+				continue
+			}
+			if sb.queue == "" {
+				plain = append(plain, target{c, sb})
+			} else {
+				queues[sb.subject+" "+sb.queue] = append(queues[sb.subject+" "+sb.queue], target{c, sb})
+			}
+		}
+	}
+	for _, members := range queues {
+		// conns are a map, so order the members to take turns
+		sort.Slice(members, func(i, j int) bool {
+			return members[i].c.RemoteAddr().String() < members[j].c.RemoteAddr().String()
+		})
+		plain = append(plain, members[s.next%len(members)])
+	}
+	s.next++
+	s.mu.Unlock()
+	for _, t := range plain {
+		if hdr >= 0 {
+			t.c.write(fmt.Sprintf("HMSG %s %s %d %d\r\n%s\r\n", subject, t.sb.sid, hdr, len(b), b))
+		} else {
+			t.c.write(fmt.Sprintf("MSG %s %s %d\r\n%s\r\n", subject, t.sb.sid, len(b), b))
+		}
+	}
+}
+
+func (c *conn) write(s string) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	io.WriteString(c, s)
+}
+
+// Match reports whether the subject matches the filter, whose * matches a
+// token and > the tokens left
+func Match(filter, subject string) bool {
+	fs, ss := strings.Split(filter, "."), strings.Split(subject, ".")
+	for i, f := range fs {
+		if f == ">" {
+			return len(ss) > i
+		}
+		if i >= len(ss) || (f != "*" && f != ss[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ss)
+}
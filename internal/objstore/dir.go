@@ -0,0 +1,69 @@
+package objstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Dir keeps objects as files under a directory, such as a mounted network
+// volume. Keys may hold slashes, which become subdirectories.
+type Dir struct {
+	Path string
+}
+
+func NewDir(path string) *Dir {
+	return &Dir{Path: path}
+}
+
+// Put writes the object beside its final name and renames it into place,
+// so Get never sees part of one
+func (d *Dir) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	name := filepath.Join(d.Path, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), ".put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = fmt.Errorf("objstore: put %s: wrote %d of %d bytes", key, n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func (d *Dir) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(filepath.Join(d.Path, filepath.FromSlash(key)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Delete removes the object, doing nothing if there isn't one
+func (d *Dir) Delete(ctx context.Context, key string) error {
+	err := os.Remove(filepath.Join(d.Path, filepath.FromSlash(key)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
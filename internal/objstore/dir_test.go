@@ -0,0 +1,34 @@
+package objstore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDir(t *testing.T) {
+	ctx := context.Background()
+	d := NewDir(t.TempDir())
+
+	require.NoError(t, d.Put(ctx, "node/0.store", strings.NewReader("hello"), 5))
+	r, err := d.Get(ctx, "node/0.store")
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, "hello", string(b))
+
+	// a short body isn't stored
+	err = d.Put(ctx, "node/1.store", strings.NewReader("hi"), 5)
+	require.Error(t, err)
+	_, err = d.Get(ctx, "node/1.store")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	require.NoError(t, d.Delete(ctx, "node/0.store"))
+	require.NoError(t, d.Delete(ctx, "node/0.store"))
+	_, err = d.Get(ctx, "node/0.store")
+	require.ErrorIs(t, err, ErrNotFound)
+}
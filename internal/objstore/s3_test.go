@@ -0,0 +1,81 @@
+package objstore
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3(t *testing.T) {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=key-id/") ||
+			!strings.Contains(auth, "/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, "<Error><Code>AccessDenied</Code><Message>bad signature</Message></Error>")
+			return
+		}
+		require.Equal(t, unsignedPayload, r.Header.Get("X-Amz-Content-Sha256"))
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			require.Equal(t, int64(5), r.ContentLength)
+			b, err := io.ReadAll(r.Body)
+			require.NoError(t, err)
+			objects[r.URL.Path] = b
+		case http.MethodGet:
+			b, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(b)
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	s := NewS3(srv.URL, "logs", "us-east-1", "key-id", "secret")
+	s.PathStyle = true
+
+	require.NoError(t, s.Put(ctx, "node/0.store", strings.NewReader("hello"), 5))
+	require.Contains(t, objects, "/logs/node/0.store")
+	r, err := s.Get(ctx, "node/0.store")
+	require.NoError(t, err)
+	b, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, r.Close())
+	require.Equal(t, "hello", string(b))
+
+	require.NoError(t, s.Delete(ctx, "node/0.store"))
+	_, err = s.Get(ctx, "node/0.store")
+	require.ErrorIs(t, err, ErrNotFound)
+
+	s.AccessKeyID = "other"
+	err = s.Put(ctx, "node/0.store", strings.NewReader("hello"), 5)
+	require.ErrorContains(t, err, "403 AccessDenied bad signature")
+}
+
+func TestS3URL(t *testing.T) {
+	s := NewS3("https://s3.us-east-1.amazonaws.com/", "logs", "us-east-1", "", "")
+	u, err := s.objectURL("node/0.store")
+	require.NoError(t, err)
+	require.Equal(t, "https://logs.s3.us-east-1.amazonaws.com/node/0.store", u.String())
+
+	s.PathStyle = true
+	u, err = s.objectURL("node/0.store")
+	require.NoError(t, err)
+	require.Equal(t, "https://s3.us-east-1.amazonaws.com/logs/node/0.store", u.String())
+}
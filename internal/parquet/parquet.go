@@ -0,0 +1,380 @@
+// Package parquet writes Parquet files of flat rows, as much of the format
+// as the servers' exports take: columns of 32 and 64 bit integers and byte
+// arrays, optional or required, PLAIN encoded in one row group with a
+// Snappy compressed page a column.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// Type is a column's physical type
+type Type int32
+
+const (
+	Int32     Type = 1
+	Int64     Type = 2
+	ByteArray Type = 6
+)
+
+// Column describes one of a file's columns
+type Column struct {
+	Name string
+	Type Type
+	// Optional columns take nil values
+	Optional bool
+	// UTF8 annotates a byte array column as strings, Timestamp an int64
+	// one as microseconds since the Unix epoch in UTC
+	UTF8      bool
+	Timestamp bool
+}
+
+// Values of the format's enums the writer uses
+const (
+	repetitionRequired = 0
+	repetitionOptional = 1
+
+	convertedUTF8            = 0
+	convertedTimestampMicros = 10
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecSnappy = 1
+
+	pageData = 0
+)
+
+var magic = []byte("PAR1")
+
+// Writer buffers rows and writes them as a file
+type Writer struct {
+	columns []*column
+	rows    int
+}
+
+type column struct {
+	Column
+	// defs are the definition levels of an optional column's values, 1
+	// for those that are set
+	defs []byte
+	// data is the PLAIN encoded values that are set
+	data       []byte
+	set, nulls int64
+	// the integer columns' smallest and largest values
+	min, max int64
+}
+
+// NewWriter returns a writer of files with the columns
+func NewWriter(columns []Column) *Writer {
+	w := &Writer{}
+	for _, c := range columns {
+		w.columns = append(w.columns, &column{Column: c})
+	}
+	return w
+}
+
+// Rows is how many rows were appended
+func (w *Writer) Rows() int {
+	return w.rows
+}
+
+// Append adds a row, a value for each column: an int32 or int64 for the
+// integer columns, a []byte or string for byte arrays, and nil for unset
+// values of optional columns
+func (w *Writer) Append(values ...any) error {
+	if len(values) != len(w.columns) {
+		return fmt.Errorf("parquet: %d values for %d columns", len(values), len(w.columns))
+	}
+	// check them all before any's added, so a bad row leaves no trace
+	for i, c := range w.columns {
+		if err := c.check(values[i]); err != nil {
+			return err
+		}
+	}
+	for i, c := range w.columns {
+		c.add(values[i])
+	}
+	w.rows++
+	return nil
+}
+
+func (c *column) check(v any) error {
+	ok := false
+	switch v.(type) {
+	case nil:
+		ok = c.Optional
+	case int32:
+		ok = c.Type == Int32
+	case int64:
+		ok = c.Type == Int64
+	case []byte, string:
+		ok = c.Type == ByteArray
+	}
+	if !ok {
+		return fmt.Errorf("parquet: column %s can't take a %T", c.Name, v)
+	}
+	return nil
+}
+
+func (c *column) add(v any) {
+	if c.Optional {
+		if v == nil {
+			c.defs = append(c.defs, 0)
+			c.nulls++
+			return
+		}
+		c.defs = append(c.defs, 1)
+	}
+	c.set++
+	var n int64
+	switch v := v.(type) {
+	case int32:
+		c.data = binary.LittleEndian.AppendUint32(c.data, uint32(v))
+		n = int64(v)
+	case int64:
+		c.data = binary.LittleEndian.AppendUint64(c.data, uint64(v))
+		n = v
+	case []byte:
+		c.data = binary.LittleEndian.AppendUint32(c.data, uint32(len(v)))
+		c.data = append(c.data, v...)
+		return
+	case string:
+		c.data = binary.LittleEndian.AppendUint32(c.data, uint32(len(v)))
+		c.data = append(c.data, v...)
+		return
+	}
+	if c.set == 1 || n < c.min {
+		c.min = n
+	}
+	if c.set == 1 || n > c.max {
+		c.max = n
+	}
+}
+
+// WriteTo writes the rows appended as a file of one row group
+func (w *Writer) WriteTo(out io.Writer) (int64, error) {
+	var file bytes.Buffer
+	file.Write(magic)
+	type chunk struct {
+		offset, uncompressed, compressed int64
+	}
+	chunks := make([]chunk, len(w.columns))
+	var rowGroupSize int64
+	for i, c := range w.columns {
+		page := c.page()
+		compressed := snappy.Encode(nil, page)
+		header := &thrift{}
+		header.i32(1, pageData)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(compressed)))
+		header.structBegin(5)
+		header.i32(1, int32(w.rows))
+		header.i32(2, encodingPlain)
+		header.i32(3, encodingRLE)
+		header.i32(4, encodingRLE)
+		header.structEnd()
+		header.stop()
+		chunks[i] = chunk{
+			offset:       int64(file.Len()),
+			uncompressed: int64(len(header.b) + len(page)),
+			compressed:   int64(len(header.b) + len(compressed)),
+		}
+		rowGroupSize += chunks[i].uncompressed
+		file.Write(header.b)
+		file.Write(compressed)
+	}
+
+	meta := &thrift{}
+	meta.i32(1, 1)
+	meta.listBegin(2, thriftStruct, len(w.columns)+1)
+	meta.elemBegin()
+	meta.binary(4, []byte("schema"))
+	meta.i32(5, int32(len(w.columns)))
+	meta.structEnd()
+	for _, c := range w.columns {
+		meta.elemBegin()
+		meta.i32(1, int32(c.Type))
+		meta.i32(3, c.repetition())
+		meta.binary(4, []byte(c.Name))
+		if c.UTF8 {
+			meta.i32(6, convertedUTF8)
+		} else if c.Timestamp {
+			meta.i32(6, convertedTimestampMicros)
+		}
+		meta.structEnd()
+	}
+	meta.i64(3, int64(w.rows))
+	meta.listBegin(4, thriftStruct, 1)
+	meta.elemBegin()
+	meta.listBegin(1, thriftStruct, len(w.columns))
+	for i, c := range w.columns {
+		meta.elemBegin()
+		meta.i64(2, chunks[i].offset)
+		meta.structBegin(3)
+		meta.i32(1, int32(c.Type))
+		meta.listBegin(2, thriftI32, 2)
+		meta.elemI32(encodingPlain)
+		meta.elemI32(encodingRLE)
+		meta.listBegin(3, thriftBinary, 1)
+		meta.elemBinary([]byte(c.Name))
+		meta.i32(4, codecSnappy)
+		meta.i64(5, int64(w.rows))
+		meta.i64(6, chunks[i].uncompressed)
+		meta.i64(7, chunks[i].compressed)
+		meta.i64(9, chunks[i].offset)
+		meta.structBegin(12)
+		meta.i64(3, c.nulls)
+		if c.Type != ByteArray && c.set > 0 {
+			meta.binary(5, c.plain(c.max))
+			meta.binary(6, c.plain(c.min))
+		}
+		meta.structEnd()
+		meta.structEnd()
+		meta.structEnd()
+	}
+	meta.i64(2, rowGroupSize)
+	meta.i64(3, int64(w.rows))
+	meta.structEnd()
+	meta.binary(6, []byte("proglog"))
+	// the statistics' min and max are in the types' own order
+	meta.listBegin(7, thriftStruct, len(w.columns))
+	for range w.columns {
+		meta.elemBegin()
+		meta.structBegin(1)
+		meta.structEnd()
+		meta.structEnd()
+	}
+	meta.stop()
+
+	file.Write(meta.b)
+	file.Write(binary.LittleEndian.AppendUint32(nil, uint32(len(meta.b))))
+	file.Write(magic)
+	return file.WriteTo(out)
+}
+
+func (c *column) repetition() int32 {
+	if c.Optional {
+		return repetitionOptional
+	}
+	return repetitionRequired
+}
+
+// The column's data page before compression, its definition levels run
+// length encoded ahead of its values
+func (c *column) page() []byte {
+	if !c.Optional {
+		return c.data
+	}
+	var levels []byte
+	for i := 0; i < len(c.defs); {
+		j := i
+		for j < len(c.defs) && c.defs[j] == c.defs[i] {
+			j++
+		}
+		levels = binary.AppendUvarint(levels, uint64(j-i)<<1)
+		levels = append(levels, c.defs[i])
+		i = j
+	}
+	page := binary.LittleEndian.AppendUint32(nil, uint32(len(levels)))
+	page = append(page, levels...)
+	return append(page, c.data...)
+}
+
+// An integer PLAIN encoded as the column's type, for its statistics
+func (c *column) plain(n int64) []byte {
+	if c.Type == Int32 {
+		return binary.LittleEndian.AppendUint32(nil, uint32(n))
+	}
+	return binary.LittleEndian.AppendUint64(nil, uint64(n))
+}
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thrift encodes structs in Thrift's compact protocol, which the file's
+// metadata is in
+type thrift struct {
+	b []byte
+	// last is the id of each open struct's last field
+	last []int16
+}
+
+func (t *thrift) field(id int16, typ byte) {
+	if len(t.last) == 0 {
+		t.last = append(t.last, 0)
+	}
+	last := &t.last[len(t.last)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.b = append(t.b, byte(delta)<<4|typ)
+	} else {
+		t.b = append(t.b, typ)
+		t.b = binary.AppendVarint(t.b, int64(id))
+	}
+	*last = id
+}
+
+func (t *thrift) i32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.b = binary.AppendVarint(t.b, int64(v))
+}
+
+func (t *thrift) i64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.b = binary.AppendVarint(t.b, v)
+}
+
+func (t *thrift) binary(id int16, v []byte) {
+	t.field(id, thriftBinary)
+	t.elemBinary(v)
+}
+
+func (t *thrift) structBegin(id int16) {
+	t.field(id, thriftStruct)
+	t.last = append(t.last, 0)
+}
+
+// Starts a struct that's an element of a list
+func (t *thrift) elemBegin() {
+	t.last = append(t.last, 0)
+}
+
+func (t *thrift) structEnd() {
+	t.b = append(t.b, 0)
+	t.last = t.last[:len(t.last)-1]
+}
+
+// Ends the outermost struct
+func (t *thrift) stop() {
+	t.b = append(t.b, 0)
+}
+
+func (t *thrift) listBegin(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.b = append(t.b, byte(n)<<4|elem)
+	} else {
+		t.b = append(t.b, 0xf0|elem)
+		t.b = binary.AppendUvarint(t.b, uint64(n))
+	}
+}
+
+func (t *thrift) elemI32(v int32) {
+	t.b = binary.AppendVarint(t.b, int64(v))
+}
+
+func (t *thrift) elemBinary(v []byte) {
+	t.b = binary.AppendUvarint(t.b, uint64(len(v)))
+	t.b = append(t.b, v...)
+}
@@ -0,0 +1,175 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriter(t *testing.T) {
+	w := NewWriter([]Column{
+		{Name: "offset", Type: Int64},
+		{Name: "key", Type: ByteArray, Optional: true},
+		{Name: "value", Type: ByteArray, UTF8: true},
+	})
+	require.NoError(t, w.Append(int64(7), []byte("a"), "first"))
+	require.NoError(t, w.Append(int64(5), nil, "second"))
+	require.NoError(t, w.Append(int64(9), nil, "third"))
+	require.Error(t, w.Append(int32(1), nil, "wrong type"))
+	require.Error(t, w.Append(int64(1), nil, nil))
+	require.Error(t, w.Append(int64(1)))
+	require.Equal(t, 3, w.Rows())
+
+	var buf bytes.Buffer
+	_, err := w.WriteTo(&buf)
+	require.NoError(t, err)
+	b := buf.Bytes()
+	require.Equal(t, "PAR1", string(b[:4]))
+	require.Equal(t, "PAR1", string(b[len(b)-4:]))
+	size := binary.LittleEndian.Uint32(b[len(b)-8:])
+	r := &thriftReader{b: b[len(b)-8-int(size) : len(b)-8]}
+	meta := r.structure()
+	require.NoError(t, r.err)
+
+	require.Equal(t, int64(3), meta[3])
+	schema := meta[2].([]any)
+	require.Len(t, schema, 4)
+	require.Equal(t, int64(3), schema[0].(map[int16]any)[5])
+	var names []string
+	for _, el := range schema[1:] {
+		names = append(names, string(el.(map[int16]any)[4].([]byte)))
+	}
+	require.Equal(t, []string{"offset", "key", "value"}, names)
+	require.Equal(t, int64(repetitionOptional), schema[2].(map[int16]any)[3])
+	require.Equal(t, int64(convertedUTF8), schema[3].(map[int16]any)[6])
+
+	rowGroup := meta[4].([]any)[0].(map[int16]any)
+	require.Equal(t, int64(3), rowGroup[3])
+	chunks := rowGroup[1].([]any)
+	require.Len(t, chunks, 3)
+	read := func(i int) (meta map[int16]any, page []byte) {
+		meta = chunks[i].(map[int16]any)[3].(map[int16]any)
+		off := meta[9].(int64)
+		r := &thriftReader{b: b[off:]}
+		header := r.structure()
+		require.NoError(t, r.err)
+		require.Equal(t, int64(3), header[5].(map[int16]any)[1])
+		data := b[int(off)+r.off : int(off)+r.off+int(header[3].(int64))]
+		page, err := snappy.Decode(nil, data)
+		require.NoError(t, err)
+		require.Len(t, page, int(header[2].(int64)))
+		return meta, page
+	}
+
+	// a required integer column is its values, with their range
+	offsets, page := read(0)
+	require.Equal(t, []byte{7, 0, 0, 0, 0, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0, 9, 0, 0, 0, 0, 0, 0, 0}, page)
+	stats := offsets[12].(map[int16]any)
+	require.Equal(t, int64(0), stats[3])
+	require.Equal(t, []byte{9, 0, 0, 0, 0, 0, 0, 0}, stats[5])
+	require.Equal(t, []byte{5, 0, 0, 0, 0, 0, 0, 0}, stats[6])
+
+	// an optional one leads with its definition levels, runs of one set
+	// value and two unset
+	keys, page := read(1)
+	require.Equal(t, []byte{4, 0, 0, 0, 1 << 1, 1, 2 << 1, 0, 1, 0, 0, 0, 'a'}, page)
+	require.Equal(t, int64(2), keys[12].(map[int16]any)[3])
+
+	_, page = read(2)
+	require.Equal(t, append(append(
+		[]byte{5, 0, 0, 0, 'f', 'i', 'r', 's', 't'},
+		6, 0, 0, 0, 's', 'e', 'c', 'o', 'n', 'd'),
+		5, 0, 0, 0, 't', 'h', 'i', 'r', 'd'), page)
+}
+
+// thriftReader decodes Thrift's compact protocol into maps of field ids
+// to int64s, []bytes, lists and maps, as much of it as the writer uses
+type thriftReader struct {
+	b   []byte
+	off int
+	err error
+}
+
+func (r *thriftReader) structure() map[int16]any {
+	fields := make(map[int16]any)
+	var last int16
+	for r.err == nil {
+		h := r.byte()
+		if h == 0 {
+			return fields
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(r.varint())
+		}
+		last = id
+		fields[id] = r.value(h & 0x0f)
+	}
+	return fields
+}
+
+func (r *thriftReader) value(typ byte) any {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.varint()
+	case thriftBinary:
+		n := int(r.uvarint())
+		if r.off+n > len(r.b) {
+			r.err = errTruncated
+			return nil
+		}
+		v := r.b[r.off : r.off+n]
+		r.off += n
+		return v
+	case thriftList:
+		h := r.byte()
+		n := int(h >> 4)
+		if n == 15 {
+			n = int(r.uvarint())
+		}
+		var list []any
+		for range n {
+			list = append(list, r.value(h&0x0f))
+		}
+		return list
+	case thriftStruct:
+		return r.structure()
+	}
+	r.err = errTruncated
+	return nil
+}
+
+func (r *thriftReader) byte() byte {
+	if r.off >= len(r.b) {
+		r.err = errTruncated
+		return 0
+	}
+	r.off++
+	return r.b[r.off-1]
+}
+
+func (r *thriftReader) varint() int64 {
+	v, n := binary.Varint(r.b[r.off:])
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.off += n
+	return v
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b[r.off:])
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.off += n
+	return v
+}
+
+var errTruncated = errors.New("truncated thrift")
@@ -0,0 +1,408 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The kinds of tokens queries are made of
+const (
+	tokEOF = iota
+	// a name: a keyword, or a field unless it's one
+	tokName
+	// a "quoted" field
+	tokQuoted
+	tokString
+	tokNumber
+	// an operator or punctuation
+	tokSymbol
+)
+
+type token struct {
+	kind int
+	text string
+	pos  int
+}
+
+// Whether the token is the keyword, in any case
+func (t token) is(keyword string) bool {
+	return t.kind == tokName && strings.EqualFold(t.text, keyword)
+}
+
+// The keywords, which fields named so must be quoted
+var keywords = map[string]bool{
+	"SELECT": true, "WHERE": true, "GROUP": true, "BY": true, "LIMIT": true,
+	"AND": true, "OR": true, "NOT": true, "IS": true, "NULL": true,
+	"LIKE": true, "TRUE": true, "FALSE": true, "COUNT": true,
+}
+
+func lex(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		start := i
+		switch {
+		case unicode.IsSpace(c):
+			i++
+			continue
+		case c == '\'' || c == '"':
+			var b strings.Builder
+			for i++; ; i++ {
+				if i >= len(s) {
+					return nil, fmt.Errorf("query: unterminated %c at %d", c, start)
+				}
+				if rune(s[i]) == c {
+					// a doubled quote is one quote
+					if i+1 < len(s) && rune(s[i+1]) == c {
+						i++
+					} else {
+						break
+					}
+				}
+				b.WriteByte(s[i])
+			}
+			i++
+			kind := tokString
+			if c == '"' {
+				kind = tokQuoted
+			}
+			toks = append(toks, token{kind, b.String(), start})
+			continue
+		case c == '-' || c >= '0' && c <= '9':
+			for i++; i < len(s) && strings.ContainsRune("0123456789.eE+-", rune(s[i])); i++ {
+				if (s[i] == '+' || s[i] == '-') && s[i-1] != 'e' && s[i-1] != 'E' {
+					break
+				}
+			}
+			toks = append(toks, token{tokNumber, s[start:i], start})
+			continue
+		case c == '_' || unicode.IsLetter(c):
+			for i < len(s) && (s[i] == '_' || s[i] == '.' || unicode.IsLetter(rune(s[i])) || unicode.IsDigit(rune(s[i]))) {
+				i++
+			}
+			toks = append(toks, token{tokName, s[start:i], start})
+			continue
+		}
+		for _, sym := range []string{"!=", "<>", "<=", ">=", "=", "<", ">", "(", ")", ",", "*"} {
+			if strings.HasPrefix(s[i:], sym) {
+				toks = append(toks, token{tokSymbol, sym, start})
+				i += len(sym)
+				break
+			}
+		}
+		if i == start {
+			return nil, fmt.Errorf("query: unexpected %q at %d", c, start)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(s)}), nil
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// Consumes the keyword or symbol if it's next
+func (p *parser) accept(text string) bool {
+	t := p.peek()
+	if t.is(text) || t.kind == tokSymbol && t.text == text {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected("want " + text)
+	}
+	return nil
+}
+
+func (p *parser) unexpected(want string) error {
+	t := p.peek()
+	if t.kind == tokEOF {
+		return fmt.Errorf("%s at the end", want)
+	}
+	return fmt.Errorf("%s at %d, not %q", want, t.pos, t.text)
+}
+
+func (p *parser) query() (*Query, error) {
+	if err := p.expect("SELECT"); err != nil {
+		return nil, err
+	}
+	q := &Query{limit: DefaultLimit}
+	if p.accept("*") {
+		q.columns = []column{{name: "*"}}
+	} else {
+		for {
+			c, err := p.column()
+			if err != nil {
+				return nil, err
+			}
+			q.columns = append(q.columns, c)
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if p.accept("WHERE") {
+		var err error
+		if q.where, err = p.or(); err != nil {
+			return nil, err
+		}
+	}
+	if p.accept("GROUP") {
+		if err := p.expect("BY"); err != nil {
+			return nil, err
+		}
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		q.groupBy = f
+	}
+	if p.accept("LIMIT") {
+		t := p.next()
+		n, err := strconv.Atoi(t.text)
+		if t.kind != tokNumber || err != nil || n < 1 || n > MaxLimit {
+			return nil, fmt.Errorf("LIMIT %s isn't from 1 to %d", t.text, MaxLimit)
+		}
+		q.limit = n
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.unexpected("want the end")
+	}
+	return q, q.check()
+}
+
+// Checks the columns can be returned together
+func (q *Query) check() error {
+	for _, c := range q.columns {
+		switch {
+		case q.groupBy != nil && !c.count && (c.field == nil || c.field.name != q.groupBy.name):
+			return fmt.Errorf("%s isn't COUNT(*) or the GROUP BY field", c.name)
+		case q.groupBy == nil && c.count && len(q.columns) > 1:
+			return errors.New("COUNT(*) without GROUP BY is the only column")
+		}
+	}
+	return nil
+}
+
+func (p *parser) column() (column, error) {
+	if p.accept("COUNT") {
+		for _, s := range []string{"(", "*", ")"} {
+			if err := p.expect(s); err != nil {
+				return column{}, err
+			}
+		}
+		return column{name: "count", count: true}, nil
+	}
+	f, err := p.field()
+	if err != nil {
+		return column{}, err
+	}
+	return column{name: f.name, field: f}, nil
+}
+
+func (p *parser) field() (*field, error) {
+	t := p.peek()
+	switch {
+	case t.kind == tokQuoted:
+		p.next()
+		return &field{name: t.text, path: []string{t.text}}, nil
+	case t.kind == tokName && !keywords[strings.ToUpper(t.text)]:
+		p.next()
+		path := strings.Split(t.text, ".")
+		if slices.Contains(path, "") {
+			return nil, fmt.Errorf("field %q at %d has an empty name", t.text, t.pos)
+		}
+		return &field{name: t.text, path: path}, nil
+	}
+	return nil, p.unexpected("want a field")
+}
+
+// A predicate over records
+type predicate interface {
+	match(d *doc) bool
+}
+
+type orPredicate []predicate
+
+func (ps orPredicate) match(d *doc) bool {
+	for _, p := range ps {
+		if p.match(d) {
+			return true
+		}
+	}
+	return false
+}
+
+type andPredicate []predicate
+
+func (ps andPredicate) match(d *doc) bool {
+	for _, p := range ps {
+		if !p.match(d) {
+			return false
+		}
+	}
+	return true
+}
+
+type notPredicate struct {
+	p predicate
+}
+
+func (n notPredicate) match(d *doc) bool {
+	return !n.p.match(d)
+}
+
+// Compares a field to a literal
+type comparison struct {
+	field *field
+	op    string
+	value any
+}
+
+func (c comparison) match(d *doc) bool {
+	v, ok := d.lookup(c.field)
+	return ok && compare(v, c.value, c.op)
+}
+
+// Tests whether a field is null, or one the record doesn't have
+type isNull struct {
+	field *field
+	not   bool
+}
+
+func (n isNull) match(d *doc) bool {
+	v, ok := d.lookup(n.field)
+	return (!ok || v == nil) != n.not
+}
+
+func (p *parser) or() (predicate, error) {
+	var ps orPredicate
+	for {
+		and, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, and)
+		if !p.accept("OR") {
+			break
+		}
+	}
+	if len(ps) == 1 {
+		return ps[0], nil
+	}
+	return ps, nil
+}
+
+func (p *parser) and() (predicate, error) {
+	var ps andPredicate
+	for {
+		not, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, not)
+		if !p.accept("AND") {
+			break
+		}
+	}
+	if len(ps) == 1 {
+		return ps[0], nil
+	}
+	return ps, nil
+}
+
+func (p *parser) not() (predicate, error) {
+	if p.accept("NOT") {
+		inner, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notPredicate{inner}, nil
+	}
+	if p.accept("(") {
+		inner, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	}
+	f, err := p.field()
+	if err != nil {
+		return nil, err
+	}
+	if p.accept("IS") {
+		not := p.accept("NOT")
+		return isNull{field: f, not: not}, p.expect("NULL")
+	}
+	if op := p.peek(); op.is("LIKE") {
+		p.next()
+		t := p.next()
+		if t.kind != tokString {
+			return nil, fmt.Errorf("LIKE at %d takes a string", op.pos)
+		}
+		return comparison{field: f, op: "LIKE", value: t.text}, nil
+	}
+	op := p.peek()
+	if op.kind != tokSymbol {
+		return nil, p.unexpected("want a comparison")
+	}
+	switch op.text {
+	case "=", "!=", "<", "<=", ">", ">=":
+	case "<>":
+		op.text = "!="
+	default:
+		return nil, p.unexpected("want a comparison")
+	}
+	p.next()
+	v, err := p.literal()
+	if err != nil {
+		return nil, err
+	}
+	return comparison{field: f, op: op.text, value: v}, nil
+}
+
+func (p *parser) literal() (any, error) {
+	t := p.peek()
+	var v any
+	switch {
+	case t.kind == tokString:
+		v = t.text
+	case t.kind == tokNumber:
+		if _, err := strconv.ParseFloat(t.text, 64); err != nil {
+			return nil, fmt.Errorf("bad number %q at %d", t.text, t.pos)
+		}
+		v = json.Number(t.text)
+	case t.is("TRUE"):
+		v = true
+	case t.is("FALSE"):
+		v = false
+	case t.is("NULL"):
+		// nothing compares equal to null, see IS NULL
+	default:
+		return nil, p.unexpected("want a literal")
+	}
+	p.next()
+	return v, nil
+}
@@ -0,0 +1,343 @@
+// Package query parses and runs the SQL-like queries servers answer over a
+// topic partition's records, for looking into them without exporting them:
+//
+//	SELECT <columns> [WHERE <predicate>] [GROUP BY <field>] [LIMIT <n>]
+//
+// Columns are *, the record's value as it is, fields, or COUNT(*). Fields
+// are paths into records' values as JSON objects, as in user.id, quoted
+// like "user id" when they aren't plain names, or the pseudo-fields
+// _offset, _timestamp, in Unix nanoseconds, and _key. A predicate compares
+// fields to literals, strings quoted like 'x', numbers, true, false and
+// null, with =, != or <>, <, <=, >, >= and LIKE, tests them with IS [NOT]
+// NULL, and combines those with AND, OR, NOT and parentheses. Fields a
+// record doesn't have, as any of a value that isn't JSON, are null, and
+// compare false.
+//
+// Without GROUP BY, a query selecting COUNT(*) counts the records matching
+// it, and one selecting fields returns a row for each up to the limit.
+// With it, a row for each of the field's values, in the order they're
+// first met, counts its records.
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The LIMIT of queries without one, and the largest a query may have
+const (
+	DefaultLimit = 100
+	MaxLimit     = 10_000
+)
+
+// Query is a parsed query
+type Query struct {
+	columns []column
+	where   predicate
+	groupBy *field
+	limit   int
+}
+
+// A selected column: the value, a field or the count
+type column struct {
+	name  string
+	field *field
+	count bool
+}
+
+// A path into a record
+type field struct {
+	name string
+	path []string
+}
+
+// Parse parses the query, failing on syntax it doesn't take
+func Parse(s string) (*Query, error) {
+	toks, err := lex(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	q, err := p.query()
+	if err != nil {
+		return nil, fmt.Errorf("query: %w", err)
+	}
+	return q, nil
+}
+
+// Columns are the names of the query's columns, in order
+func (q *Query) Columns() []string {
+	names := make([]string, len(q.columns))
+	for i, c := range q.columns {
+		names[i] = c.name
+	}
+	return names
+}
+
+// Limit is how many rows the query returns at most
+func (q *Query) Limit() int {
+	return q.limit
+}
+
+// Record is a record a query runs over
+type Record struct {
+	Offset    uint64
+	Timestamp int64
+	Key       []byte
+	Value     []byte
+}
+
+// A record with its value decoded, doc nil when it isn't JSON
+type doc struct {
+	record Record
+	doc    any
+	isJSON bool
+}
+
+func decode(r Record) *doc {
+	d := &doc{record: r}
+	dec := json.NewDecoder(bytes.NewReader(r.Value))
+	dec.UseNumber()
+	if err := dec.Decode(&d.doc); err == nil && !dec.More() {
+		d.isJSON = true
+	} else {
+		d.doc = nil
+	}
+	return d
+}
+
+// The value at the field, ok false when the record doesn't have it
+func (d *doc) lookup(f *field) (any, bool) {
+	switch f.name {
+	case "_offset":
+		return json.Number(strconv.FormatUint(d.record.Offset, 10)), true
+	case "_timestamp":
+		return json.Number(strconv.FormatInt(d.record.Timestamp, 10)), true
+	case "_key":
+		if d.record.Key == nil {
+			return nil, false
+		}
+		return string(d.record.Key), true
+	}
+	v := d.doc
+	for _, name := range f.path {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// The column's value for the record, as JSON
+func (d *doc) value(c column) json.RawMessage {
+	if c.field == nil {
+		if d.isJSON {
+			return bytes.TrimSpace(d.record.Value)
+		}
+		return marshal(string(d.record.Value))
+	}
+	v, ok := d.lookup(c.field)
+	if !ok {
+		return json.RawMessage("null")
+	}
+	return marshal(v)
+}
+
+func marshal(v any) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return json.RawMessage("null")
+	}
+	return b
+}
+
+// Row is a row of a query's results, its values JSON
+type Row struct {
+	// Offset is the record's the row is of, zero for counts
+	Offset uint64
+	Values []json.RawMessage
+}
+
+// Results gathers a query's results from the records it's run over, in
+// order
+type Results struct {
+	q     *Query
+	count bool
+	rows  []Row
+	// groups are the rows' indexes by their GROUP BY values, as JSON, and
+	// counts the records of each, or of all of them without GROUP BY
+	groups map[string]int
+	counts []uint64
+}
+
+// Run starts the query's results
+func (q *Query) Run() *Results {
+	r := &Results{q: q, groups: make(map[string]int)}
+	for _, c := range q.columns {
+		r.count = r.count || c.count
+	}
+	return r
+}
+
+// Add runs the query over the record, reporting whether its results are
+// full: returning more records it can't change them
+func (r *Results) Add(record Record) (full bool) {
+	if r.full() {
+		return true
+	}
+	d := decode(record)
+	if r.q.where != nil && !r.q.where.match(d) {
+		return false
+	}
+	switch {
+	case r.q.groupBy != nil:
+		key := string(d.value(column{field: r.q.groupBy}))
+		i, ok := r.groups[key]
+		if !ok {
+			if len(r.rows) == r.q.limit {
+				// the groups past the limit aren't returned
+				return false
+			}
+			i = len(r.rows)
+			r.groups[key] = i
+			row := Row{Values: make([]json.RawMessage, len(r.q.columns))}
+			for j, c := range r.q.columns {
+				if !c.count {
+					row.Values[j] = d.value(c)
+				}
+			}
+			r.rows = append(r.rows, row)
+			r.counts = append(r.counts, 0)
+		}
+		r.counts[i]++
+	case r.count:
+		if len(r.counts) == 0 {
+			r.counts = append(r.counts, 0)
+		}
+		r.counts[0]++
+	default:
+		row := Row{Offset: record.Offset, Values: make([]json.RawMessage, len(r.q.columns))}
+		for j, c := range r.q.columns {
+			row.Values[j] = d.value(c)
+		}
+		r.rows = append(r.rows, row)
+	}
+	return r.full()
+}
+
+func (r *Results) full() bool {
+	return !r.count && r.q.groupBy == nil && len(r.rows) >= r.q.limit
+}
+
+// Rows are the results gathered
+func (r *Results) Rows() []Row {
+	switch {
+	case r.q.groupBy != nil:
+		for i, row := range r.rows {
+			for j, c := range r.q.columns {
+				if c.count {
+					row.Values[j] = marshal(r.counts[i])
+				}
+			}
+		}
+	case r.count:
+		var n uint64
+		if len(r.counts) > 0 {
+			n = r.counts[0]
+		}
+		return []Row{{Values: []json.RawMessage{marshal(n)}}}
+	}
+	return r.rows
+}
+
+// Compares the values as the operator does, false for ones of different
+// types, or that don't order
+func compare(a, b any, op string) bool {
+	var c int
+	switch a := a.(type) {
+	case json.Number:
+		bn, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, err1 := a.Float64()
+		y, err2 := bn.Float64()
+		if err1 != nil || err2 != nil {
+			return false
+		}
+		switch {
+		case x < y:
+			c = -1
+		case x > y:
+			c = 1
+		}
+	case string:
+		bs, ok := b.(string)
+		if !ok {
+			return false
+		}
+		if op == "LIKE" {
+			return like(a, bs)
+		}
+		c = strings.Compare(a, bs)
+	case bool:
+		bb, ok := b.(bool)
+		if !ok || op != "=" && op != "!=" {
+			return false
+		}
+		if a != bb {
+			c = 1
+		}
+	default:
+		return false
+	}
+	switch op {
+	case "=":
+		return c == 0
+	case "!=":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+// Whether s matches the LIKE pattern, % matching any run of characters and
+// _ any one
+func like(s, pattern string) bool {
+	str, pat := []rune(s), []rune(pattern)
+	// star is the pattern's last % and mark where in str it matches up to,
+	// to go back to when what follows it doesn't match
+	i, j, star, mark := 0, 0, -1, 0
+	for i < len(str) {
+		switch {
+		case j < len(pat) && (pat[j] == '_' || pat[j] == str[i]) && pat[j] != '%':
+			i, j = i+1, j+1
+		case j < len(pat) && pat[j] == '%':
+			star, mark = j, i
+			j++
+		case star >= 0:
+			mark++
+			i, j = mark, star+1
+		default:
+			return false
+		}
+	}
+	for j < len(pat) && pat[j] == '%' {
+		j++
+	}
+	return j == len(pat)
+}
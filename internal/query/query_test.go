@@ -0,0 +1,123 @@
+package query
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var testRecords = []Record{
+	{Offset: 0, Timestamp: 10, Key: []byte("a"), Value: []byte(`{"user": {"id": 1, "name": "ann"}, "kind": "click", "ok": true}`)},
+	{Offset: 1, Timestamp: 20, Key: []byte("b"), Value: []byte(`{"user": {"id": 2, "name": "bob"}, "kind": "view"}`)},
+	{Offset: 2, Timestamp: 30, Value: []byte(`not json`)},
+	{Offset: 3, Timestamp: 40, Key: []byte("a"), Value: []byte(`{"user": {"id": 3, "name": "anna"}, "kind": "click", "ok": false}`)},
+	{Offset: 4, Timestamp: 50, Value: []byte(`{"user id": 7, "kind": null}`)},
+}
+
+// Runs the query over the test records, returning its rows as JSON arrays
+func run(t *testing.T, s string) []string {
+	t.Helper()
+	q, err := Parse(s)
+	require.NoError(t, err)
+	r := q.Run()
+	for _, record := range testRecords {
+		if r.Add(record) {
+			break
+		}
+	}
+	var rows []string
+	for _, row := range r.Rows() {
+		b, err := json.Marshal(row.Values)
+		require.NoError(t, err)
+		rows = append(rows, string(b))
+	}
+	return rows
+}
+
+func TestQuery(t *testing.T) {
+	for s, want := range map[string][]string{
+		"SELECT user.id, kind WHERE kind = 'click'": {
+			`[1,"click"]`, `[3,"click"]`,
+		},
+		"select _offset, _key where user.id >= 2 and user.id < 10": {
+			`[1,"b"]`, `[3,"a"]`,
+		},
+		"SELECT user.name WHERE user.name LIKE 'an%' AND NOT ok = true": {
+			`["anna"]`,
+		},
+		"SELECT _offset WHERE kind IS NULL": {
+			`[2]`, `[4]`,
+		},
+		`SELECT "user id" WHERE "user id" IS NOT NULL`: {
+			`[7]`,
+		},
+		"SELECT _offset WHERE (kind = 'view' OR ok = true) AND _timestamp > 10": {
+			`[1]`,
+		},
+		"SELECT * WHERE _offset <> 0 LIMIT 2": {
+			`[{"user": {"id": 2, "name": "bob"}, "kind": "view"}]`, `["not json"]`,
+		},
+		"SELECT COUNT(*) WHERE kind != 'view'": {
+			`[2]`,
+		},
+		"SELECT kind, COUNT(*) GROUP BY kind": {
+			`["click",2]`, `["view",1]`, `[null,2]`,
+		},
+		"SELECT COUNT(*), _key GROUP BY _key LIMIT 1": {
+			`[2,"a"]`,
+		},
+	} {
+		t.Run(s, func(t *testing.T) {
+			rows := run(t, s)
+			// compare the JSON as values, whatever its spacing
+			require.Len(t, rows, len(want))
+			for i := range want {
+				require.JSONEq(t, want[i], rows[i])
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"user.id",
+		"SELECT",
+		"SELECT a WHERE",
+		"SELECT a WHERE b",
+		"SELECT a WHERE b = c",
+		"SELECT a WHERE b LIKE 1",
+		"SELECT a WHERE 'b",
+		"SELECT a LIMIT 0",
+		"SELECT a LIMIT 10001",
+		"SELECT a, COUNT(*)",
+		"SELECT a, COUNT(*) GROUP BY b",
+		"SELECT a. WHERE a = 1",
+		"SELECT where",
+		"SELECT a; DROP",
+	} {
+		_, err := Parse(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestLike(t *testing.T) {
+	for _, tc := range []struct {
+		s, pattern string
+		want       bool
+	}{
+		{"abc", "abc", true},
+		{"abc", "a_c", true},
+		{"abc", "a%", true},
+		{"abc", "%c", true},
+		{"abc", "%b%", true},
+		{"abcbc", "%bc", true},
+		{"", "%", true},
+		{"abc", "ab", false},
+		{"abc", "%d%", false},
+		{"abc", "a_", false},
+	} {
+		require.Equal(t, tc.want, like(tc.s, tc.pattern), "%q LIKE %q", tc.s, tc.pattern)
+	}
+}
@@ -0,0 +1,181 @@
+// Package redact removes personal data from records' values before
+// they're stored, for topics whose producers can't be trusted to leave it
+// out. Fields name what to remove from JSON values, paths of object keys
+// like user.email, and patterns find it in any text: every string in a
+// JSON value, or the whole value when it isn't JSON. Either way what's
+// removed is replaced with Replacement.
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Replacement stands for what's redacted
+const Replacement = "REDACTED"
+
+// The patterns by name, with a check of what they match, nil for none
+var patterns = map[string]struct {
+	re    *regexp.Regexp
+	check func(string) bool
+}{
+	"email":       {re: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`)},
+	"credit_card": {re: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`), check: luhn},
+	"ssn":         {re: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`)},
+	// E.164 numbers, with their +
+	"phone": {re: regexp.MustCompile(`\+[1-9]\d{7,14}\b`)},
+	"ipv4":  {re: regexp.MustCompile(`\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`)},
+}
+
+// Patterns are the names of the patterns there are, in order
+func Patterns() []string {
+	return slices.Sorted(maps.Keys(patterns))
+}
+
+// Rules are what to redact
+type Rules struct {
+	// Fields are paths of object keys separated by dots
+	Fields []string
+	// Patterns are names of Patterns
+	Patterns []string
+}
+
+// Empty is whether the rules redact nothing
+func (r Rules) Empty() bool {
+	return len(r.Fields) == 0 && len(r.Patterns) == 0
+}
+
+// Validate checks the rules' fields are paths and their patterns exist
+func (r Rules) Validate() error {
+	for _, f := range r.Fields {
+		if slices.Contains(strings.Split(f, "."), "") {
+			return fmt.Errorf("field %q has an empty name", f)
+		}
+	}
+	for _, p := range r.Patterns {
+		if _, ok := patterns[p]; !ok {
+			return fmt.Errorf("unknown pattern %q, want one of %s", p, strings.Join(Patterns(), ", "))
+		}
+	}
+	return nil
+}
+
+// Value returns the value redacted, and whether anything was. A JSON
+// value redacted is marshaled again, its objects' keys sorted.
+func (r Rules) Value(value []byte) ([]byte, bool) {
+	var doc any
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil || dec.More() {
+		s, changed := r.text(string(value))
+		return []byte(s), changed
+	}
+	changed := false
+	for _, f := range r.Fields {
+		changed = redactField(doc, strings.Split(f, ".")) || changed
+	}
+	if len(r.Patterns) > 0 {
+		var textChanged bool
+		doc, textChanged = r.redactStrings(doc)
+		changed = changed || textChanged
+	}
+	if !changed {
+		return value, false
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return value, false
+	}
+	return b, true
+}
+
+// Replaces the value at the path in objects, and in arrays of them
+func redactField(v any, path []string) bool {
+	switch v := v.(type) {
+	case map[string]any:
+		child, ok := v[path[0]]
+		if !ok {
+			return false
+		}
+		if len(path) == 1 {
+			v[path[0]] = Replacement
+			return true
+		}
+		return redactField(child, path[1:])
+	case []any:
+		changed := false
+		for _, item := range v {
+			changed = redactField(item, path) || changed
+		}
+		return changed
+	}
+	return false
+}
+
+// Redacts the patterns from the strings in the value, keys as they are
+func (r Rules) redactStrings(v any) (any, bool) {
+	changed := false
+	switch v := v.(type) {
+	case string:
+		return r.text(v)
+	case map[string]any:
+		for k, child := range v {
+			var c bool
+			if v[k], c = r.redactStrings(child); c {
+				changed = true
+			}
+		}
+	case []any:
+		for i, child := range v {
+			var c bool
+			if v[i], c = r.redactStrings(child); c {
+				changed = true
+			}
+		}
+	}
+	return v, changed
+}
+
+// Redacts the patterns from the text
+func (r Rules) text(s string) (string, bool) {
+	changed := false
+	for _, name := range r.Patterns {
+		p, ok := patterns[name]
+		if !ok {
+			continue
+		}
+		s = p.re.ReplaceAllStringFunc(s, func(match string) string {
+			if p.check != nil && !p.check(match) {
+				return match
+			}
+			changed = true
+			return Replacement
+		})
+	}
+	return s, changed
+}
+
+// Whether the digits in s pass the Luhn check card numbers carry
+func luhn(s string) bool {
+	sum, double := 0, false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
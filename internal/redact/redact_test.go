@@ -0,0 +1,48 @@
+package redact
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValue(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		rules Rules
+		value string
+		want  string
+	}{{
+		name:  "fields",
+		rules: Rules{Fields: []string{"user.email", "cards.number", "missing.field"}},
+		value: `{"user": {"email": "ann@example.com", "id": 1}, "cards": [{"number": 4111111111111111}, {"kind": "none"}]}`,
+		want:  `{"cards":[{"number":"REDACTED"},{"kind":"none"}],"user":{"email":"REDACTED","id":1}}`,
+	}, {
+		name:  "patterns in JSON strings",
+		rules: Rules{Patterns: []string{"email", "credit_card"}},
+		value: `{"note": "mail ann@example.com, card 4111 1111 1111 1111, order 1234567890123"}`,
+		want:  `{"note":"mail REDACTED, card REDACTED, order 1234567890123"}`,
+	}, {
+		name:  "patterns in text",
+		rules: Rules{Patterns: []string{"ssn", "phone", "ipv4"}},
+		value: "ssn 123-45-6789 from 10.0.0.1 called +14155550123",
+		want:  "ssn REDACTED from REDACTED called REDACTED",
+	}, {
+		name:  "nothing to redact",
+		rules: Rules{Fields: []string{"email"}, Patterns: []string{"email"}},
+		value: `{"id":  1}`,
+		want:  `{"id":  1}`,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, changed := tc.rules.Value([]byte(tc.value))
+			require.Equal(t, tc.want, string(got))
+			require.Equal(t, tc.want != tc.value, changed)
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	require.NoError(t, Rules{Fields: []string{"user.email"}, Patterns: Patterns()}.Validate())
+	require.Error(t, Rules{Fields: []string{"user."}}.Validate())
+	require.Error(t, Rules{Patterns: []string{"passport"}}.Validate())
+}
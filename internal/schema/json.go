@@ -0,0 +1,474 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// jsonSchema is a compiled JSON Schema, or one of its subschemas
+type jsonSchema struct {
+	// never is the false schema, which takes no value
+	never bool
+	types []string
+	enum  []any
+	// properties are of objects, additional of the properties they don't
+	// name, any value when it's nil
+	properties map[string]*jsonSchema
+	required   []string
+	additional *jsonSchema
+	items      *jsonSchema
+
+	minimum, maximum     *bound
+	minLength, maxLength *int
+	minItems, maxItems   *int
+	pattern              *regexp.Regexp
+}
+
+// bound is a numeric lower or upper bound
+type bound struct {
+	n         float64
+	exclusive bool
+}
+
+var jsonTypes = []string{"null", "boolean", "object", "array", "number", "integer", "string"}
+
+// Keywords that don't constrain values
+var jsonAnnotations = []string{
+	"$schema", "$id", "$comment", "title", "description", "default", "examples",
+	"format", "deprecated", "readOnly", "writeOnly",
+}
+
+// Decodes a JSON value keeping its numbers exact, failing on anything
+// after it
+func decodeJSON(b []byte) (any, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var v any
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON: data after the value")
+	}
+	return v, nil
+}
+
+func compileJSON(definition []byte) (*jsonSchema, error) {
+	doc, err := decodeJSON(definition)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+	return compileJSONValue(doc, "")
+}
+
+func compileJSONValue(doc any, path string) (*jsonSchema, error) {
+	fail := func(format string, args ...any) (*jsonSchema, error) {
+		return nil, fmt.Errorf("invalid JSON schema at %s: %s", pointer(path), fmt.Sprintf(format, args...))
+	}
+	switch doc := doc.(type) {
+	case bool:
+		return &jsonSchema{never: !doc}, nil
+	case map[string]any:
+		s := &jsonSchema{}
+		for key, v := range doc {
+			var err error
+			switch key {
+			case "type":
+				switch v := v.(type) {
+				case string:
+					s.types = []string{v}
+				case []any:
+					for _, t := range v {
+						t, ok := t.(string)
+						if !ok {
+							return fail("type isn't a string")
+						}
+						s.types = append(s.types, t)
+					}
+				default:
+					return fail("type isn't a string or array")
+				}
+				for _, t := range s.types {
+					if !slices.Contains(jsonTypes, t) {
+						return fail("unknown type %q", t)
+					}
+				}
+			case "enum":
+				enum, ok := v.([]any)
+				if !ok {
+					return fail("enum isn't an array")
+				}
+				s.enum = enum
+			case "const":
+				s.enum = []any{v}
+			case "properties":
+				props, ok := v.(map[string]any)
+				if !ok {
+					return fail("properties isn't an object")
+				}
+				s.properties = make(map[string]*jsonSchema, len(props))
+				for name, prop := range props {
+					if s.properties[name], err = compileJSONValue(prop, path+"/properties/"+escape(name)); err != nil {
+						return nil, err
+					}
+				}
+			case "required":
+				required, ok := v.([]any)
+				if !ok {
+					return fail("required isn't an array")
+				}
+				for _, name := range required {
+					name, ok := name.(string)
+					if !ok {
+						return fail("required isn't an array of strings")
+					}
+					s.required = append(s.required, name)
+				}
+			case "additionalProperties":
+				s.additional, err = compileJSONValue(v, path+"/additionalProperties")
+			case "items":
+				s.items, err = compileJSONValue(v, path+"/items")
+			case "minimum", "exclusiveMinimum", "maximum", "exclusiveMaximum":
+				n, ok := jsonNumber(v)
+				if !ok {
+					return fail("%s isn't a number", key)
+				}
+				b := &bound{n: n, exclusive: key[0] == 'e'}
+				if key == "minimum" || key == "exclusiveMinimum" {
+					s.minimum = tighter(s.minimum, b, 1)
+				} else {
+					s.maximum = tighter(s.maximum, b, -1)
+				}
+			case "minLength", "maxLength", "minItems", "maxItems":
+				n, ok := jsonNumber(v)
+				if !ok || n < 0 || n != math.Trunc(n) || n > math.MaxInt32 {
+					return fail("%s isn't a non-negative integer", key)
+				}
+				i := int(n)
+				switch key {
+				case "minLength":
+					s.minLength = &i
+				case "maxLength":
+					s.maxLength = &i
+				case "minItems":
+					s.minItems = &i
+				case "maxItems":
+					s.maxItems = &i
+				}
+			case "pattern":
+				p, ok := v.(string)
+				if !ok {
+					return fail("pattern isn't a string")
+				}
+				if s.pattern, err = regexp.Compile(p); err != nil {
+					return fail("pattern: %v", err)
+				}
+			default:
+				if !slices.Contains(jsonAnnotations, key) {
+					return fail("unsupported keyword %q", key)
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return s, nil
+	}
+	return fail("a schema is an object or a boolean")
+}
+
+// The tighter of two lower bounds, dir 1, or upper bounds, dir -1
+func tighter(a, b *bound, dir float64) *bound {
+	if a == nil {
+		return b
+	}
+	if b.n*dir > a.n*dir || (b.n == a.n && b.exclusive) {
+		return b
+	}
+	return a
+}
+
+func validateJSON(s *jsonSchema, value []byte) error {
+	v, err := decodeJSON(value)
+	if err != nil {
+		return err
+	}
+	return s.validate(v, "")
+}
+
+func (s *jsonSchema) validate(v any, path string) error {
+	fail := func(format string, args ...any) error {
+		return fmt.Errorf("at %s: %s", pointer(path), fmt.Sprintf(format, args...))
+	}
+	if s.never {
+		return fail("no value is allowed")
+	}
+	typ := jsonType(v)
+	if len(s.types) > 0 && !slices.ContainsFunc(s.types, func(t string) bool { return isType(typ, t) }) {
+		return fail("want %s, got %s", typeList(s.types), typ)
+	}
+	if s.enum != nil && !slices.ContainsFunc(s.enum, func(e any) bool { return jsonEqual(e, v) }) {
+		return fail("value isn't one of the enum's")
+	}
+	switch v := v.(type) {
+	case json.Number:
+		n, _ := jsonNumber(v)
+		if b := s.minimum; b != nil && (n < b.n || (b.exclusive && n == b.n)) {
+			return fail("%v is below the minimum %v", v, b.n)
+		}
+		if b := s.maximum; b != nil && (n > b.n || (b.exclusive && n == b.n)) {
+			return fail("%v is above the maximum %v", v, b.n)
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.minLength != nil && n < *s.minLength {
+			return fail("shorter than %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && n > *s.maxLength {
+			return fail("longer than %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(v) {
+			return fail("doesn't match the pattern %s", s.pattern)
+		}
+	case []any:
+		if s.minItems != nil && len(v) < *s.minItems {
+			return fail("fewer than %d items", *s.minItems)
+		}
+		if s.maxItems != nil && len(v) > *s.maxItems {
+			return fail("more than %d items", *s.maxItems)
+		}
+		if s.items != nil {
+			for i, item := range v {
+				if err := s.items.validate(item, path+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]any:
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return fail("missing required property %q", name)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(v)) {
+			prop := v[name]
+			ps := s.properties[name]
+			if ps == nil {
+				ps = s.additional
+			}
+			if ps == nil {
+				continue
+			}
+			if err := ps.validate(prop, path+"/"+escape(name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Checks reader takes every value writer does, see Compatible
+func compatibleJSON(r, w *jsonSchema, path string) error {
+	fail := func(format string, args ...any) error {
+		return fmt.Errorf("at %s: %s", pointer(path), fmt.Sprintf(format, args...))
+	}
+	if w.never {
+		return nil
+	}
+	if r.never {
+		return fail("no value is allowed")
+	}
+	if len(r.types) > 0 {
+		if len(w.types) == 0 {
+			return fail("type narrowed to %s", typeList(r.types))
+		}
+		for _, t := range w.types {
+			if !slices.Contains(r.types, t) && !(t == "integer" && slices.Contains(r.types, "number")) {
+				return fail("type %s no longer allowed", t)
+			}
+		}
+	}
+	if r.enum != nil {
+		if w.enum == nil {
+			return fail("enum added")
+		}
+		for _, e := range w.enum {
+			if !slices.ContainsFunc(r.enum, func(re any) bool { return jsonEqual(re, e) }) {
+				return fail("enum value %v removed", e)
+			}
+		}
+	}
+	if r.minimum != nil && (w.minimum == nil || !covers(r.minimum, w.minimum, 1)) {
+		return fail("minimum raised")
+	}
+	if r.maximum != nil && (w.maximum == nil || !covers(r.maximum, w.maximum, -1)) {
+		return fail("maximum lowered")
+	}
+	for _, l := range []struct {
+		name string
+		r, w *int
+		min  bool
+	}{
+		{"minLength", r.minLength, w.minLength, true},
+		{"maxLength", r.maxLength, w.maxLength, false},
+		{"minItems", r.minItems, w.minItems, true},
+		{"maxItems", r.maxItems, w.maxItems, false},
+	} {
+		if l.r == nil {
+			continue
+		}
+		if l.min && (l.w == nil || *l.w < *l.r) && *l.r > 0 {
+			return fail("%s raised", l.name)
+		}
+		if !l.min && (l.w == nil || *l.w > *l.r) {
+			return fail("%s lowered", l.name)
+		}
+	}
+	if r.pattern != nil && (w.pattern == nil || w.pattern.String() != r.pattern.String()) {
+		return fail("pattern changed")
+	}
+	for _, name := range r.required {
+		if !slices.Contains(w.required, name) {
+			return fail("property %q made required", name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(r.properties)) {
+		rp := r.properties[name]
+		wp := w.properties[name]
+		if wp == nil {
+			wp = w.additional
+		}
+		if wp == nil {
+			continue
+		}
+		if err := compatibleJSON(rp, wp, path+"/"+escape(name)); err != nil {
+			return err
+		}
+	}
+	if r.additional != nil {
+		for _, name := range slices.Sorted(maps.Keys(w.properties)) {
+			if _, ok := r.properties[name]; ok {
+				continue
+			}
+			if err := compatibleJSON(r.additional, w.properties[name], path+"/"+escape(name)); err != nil {
+				return err
+			}
+		}
+		if w.additional == nil {
+			if r.additional.never {
+				return fail("additional properties no longer allowed")
+			}
+		} else if err := compatibleJSON(r.additional, w.additional, path); err != nil {
+			return err
+		}
+	}
+	if r.items != nil {
+		if w.items == nil {
+			return fail("items constrained")
+		}
+		if err := compatibleJSON(r.items, w.items, path+"/items"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether writer's bound keeps values within reader's, lower bounds dir 1
+// and upper -1
+func covers(r, w *bound, dir float64) bool {
+	if w.n*dir != r.n*dir {
+		return w.n*dir > r.n*dir
+	}
+	return w.exclusive || !r.exclusive
+}
+
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if n, _ := jsonNumber(v); n == math.Trunc(n) {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func isType(typ, want string) bool {
+	return typ == want || (want == "number" && typ == "integer")
+}
+
+func typeList(types []string) string {
+	if len(types) == 1 {
+		return types[0]
+	}
+	return fmt.Sprint(types)
+}
+
+func jsonNumber(v any) (float64, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, false
+	}
+	f, err := n.Float64()
+	return f, err == nil
+}
+
+// Whether two decoded values are the same JSON, numbers equal by value
+func jsonEqual(a, b any) bool {
+	switch a := a.(type) {
+	case json.Number:
+		an, _ := jsonNumber(a)
+		bn, ok := jsonNumber(b)
+		return ok && an == bn
+	case []any:
+		b, ok := b.([]any)
+		return ok && slices.EqualFunc(a, b, jsonEqual)
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, av := range a {
+			bv, ok := b[k]
+			if !ok || !jsonEqual(av, bv) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
+
+// The JSON pointer to a location, "/" for the root
+func pointer(path string) string {
+	if path == "" {
+		return "/"
+	}
+	return path
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+func escape(name string) string {
+	return pointerEscaper.Replace(name)
+}
@@ -0,0 +1,114 @@
+package schema
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Compiles the message from the serialized FileDescriptorSet holding it
+// and its imports
+func compileProto(definition []byte, message string) (protoreflect.MessageDescriptor, error) {
+	if message == "" {
+		return nil, errors.New("invalid protobuf schema: missing message")
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(definition, &set); err != nil {
+		return nil, fmt.Errorf("invalid protobuf schema: %w", err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid protobuf schema: %w", err)
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		return nil, fmt.Errorf("invalid protobuf schema: message %s: %w", message, err)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("invalid protobuf schema: %s isn't a message", message)
+	}
+	return md, nil
+}
+
+func validateProto(md protoreflect.MessageDescriptor, value []byte) error {
+	if err := proto.Unmarshal(value, dynamicpb.NewMessage(md)); err != nil {
+		return fmt.Errorf("not a %s: %w", md.FullName(), err)
+	}
+	return nil
+}
+
+// The kinds encoded alike on the wire, and so decoding as each other
+var protoWireKinds = map[protoreflect.Kind]int{
+	protoreflect.BoolKind:     1,
+	protoreflect.EnumKind:     1,
+	protoreflect.Int32Kind:    1,
+	protoreflect.Int64Kind:    1,
+	protoreflect.Uint32Kind:   1,
+	protoreflect.Uint64Kind:   1,
+	protoreflect.Sint32Kind:   2,
+	protoreflect.Sint64Kind:   2,
+	protoreflect.Fixed32Kind:  3,
+	protoreflect.Sfixed32Kind: 3,
+	protoreflect.Fixed64Kind:  4,
+	protoreflect.Sfixed64Kind: 4,
+	protoreflect.FloatKind:    5,
+	protoreflect.DoubleKind:   6,
+	protoreflect.StringKind:   7,
+	protoreflect.BytesKind:    7,
+	protoreflect.MessageKind:  8,
+	protoreflect.GroupKind:    9,
+}
+
+// Checks reader's message decodes writer's, see Compatible. seen holds
+// the pairs of messages checked or being checked, for recursive ones.
+func compatibleProto(r, w protoreflect.MessageDescriptor, path string, seen map[[2]protoreflect.FullName]bool) error {
+	pair := [2]protoreflect.FullName{r.FullName(), w.FullName()}
+	if seen[pair] {
+		return nil
+	}
+	seen[pair] = true
+	fields := r.Fields()
+	for i := range fields.Len() {
+		rf := fields.Get(i)
+		fpath := path + "." + string(rf.Name())
+		wf := w.Fields().ByNumber(rf.Number())
+		if wf == nil {
+			if rf.Cardinality() == protoreflect.Required {
+				return fmt.Errorf("at %s: required field %d added", fpath, rf.Number())
+			}
+			continue
+		}
+		if rf.Cardinality() == protoreflect.Required && wf.Cardinality() != protoreflect.Required {
+			return fmt.Errorf("at %s: field %d made required", fpath, rf.Number())
+		}
+		if rf.IsList() != wf.IsList() || rf.IsMap() != wf.IsMap() {
+			return fmt.Errorf("at %s: field %d changed between repeated and not", fpath, rf.Number())
+		}
+		if rf.IsMap() {
+			if err := compatibleProtoField(rf.MapKey(), wf.MapKey(), fpath, seen); err != nil {
+				return err
+			}
+			rf, wf = rf.MapValue(), wf.MapValue()
+		}
+		if err := compatibleProtoField(rf, wf, fpath, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func compatibleProtoField(rf, wf protoreflect.FieldDescriptor, path string, seen map[[2]protoreflect.FullName]bool) error {
+	if protoWireKinds[rf.Kind()] != protoWireKinds[wf.Kind()] {
+		return fmt.Errorf("at %s: field %d changed from %s to %s", path, rf.Number(), wf.Kind(), rf.Kind())
+	}
+	if rf.Message() != nil && wf.Message() != nil {
+		return compatibleProto(rf.Message(), wf.Message(), path, seen)
+	}
+	return nil
+}
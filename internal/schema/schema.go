@@ -0,0 +1,71 @@
+// Package schema checks record values against topics' schemas, JSON
+// Schema documents or protobuf messages, and new versions of a schema
+// against the old.
+//
+// Of JSON Schema it takes the keywords that constrain flat values,
+// objects and arrays: type, enum, const, properties, required,
+// additionalProperties, items, the numeric bounds, minLength, maxLength,
+// pattern, minItems and maxItems, ignoring annotations such as title and
+// format. Documents with others, $ref and the combinators among them,
+// don't compile.
+package schema
+
+import (
+	"errors"
+	"fmt"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Schema is a compiled schema, safe for concurrent use
+type Schema struct {
+	typ     api.SchemaType
+	json    *jsonSchema
+	message protoreflect.MessageDescriptor
+}
+
+// Compile checks the schema's definition and compiles it
+func Compile(s *api.Schema) (*Schema, error) {
+	switch s.Type {
+	case api.SchemaType_SCHEMA_JSON:
+		js, err := compileJSON(s.Definition)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{typ: s.Type, json: js}, nil
+	case api.SchemaType_SCHEMA_PROTOBUF:
+		md, err := compileProto(s.Definition, s.Message)
+		if err != nil {
+			return nil, err
+		}
+		return &Schema{typ: s.Type, message: md}, nil
+	}
+	return nil, fmt.Errorf("unknown schema type %v", s.Type)
+}
+
+// Validate checks the value matches the schema, the error saying where it
+// doesn't
+func (s *Schema) Validate(value []byte) error {
+	if s.typ == api.SchemaType_SCHEMA_PROTOBUF {
+		return validateProto(s.message, value)
+	}
+	return validateJSON(s.json, value)
+}
+
+// Compatible checks values written against writer can be read against
+// reader: that reader takes every JSON value writer does, as far as their
+// keywords tell, or that reader's message decodes writer's, its fields
+// of the same numbers having compatible types and the fields it requires
+// required by writer too. Properties an open JSON schema doesn't name are
+// taken to be ones its writers don't set, so adding an optional property
+// is compatible both ways.
+func Compatible(reader, writer *Schema) error {
+	if reader.typ != writer.typ {
+		return errors.New("schema type changed")
+	}
+	if reader.typ == api.SchemaType_SCHEMA_PROTOBUF {
+		return compatibleProto(reader.message, writer.message, string(reader.message.FullName()), make(map[[2]protoreflect.FullName]bool))
+	}
+	return compatibleJSON(reader.json, writer.json, "")
+}
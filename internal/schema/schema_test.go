@@ -0,0 +1,212 @@
+package schema
+
+import (
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func compileJSONSchema(t *testing.T, definition string) *Schema {
+	t.Helper()
+	s, err := Compile(&api.Schema{Type: api.SchemaType_SCHEMA_JSON, Definition: []byte(definition)})
+	require.NoError(t, err)
+	return s
+}
+
+func TestJSONValidate(t *testing.T) {
+	s := compileJSONSchema(t, `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title": "order",
+		"type": "object",
+		"required": ["id", "total"],
+		"properties": {
+			"id": {"type": "string", "pattern": "^o-[0-9]+$"},
+			"total": {"type": "number", "minimum": 0},
+			"items": {"type": "array", "maxItems": 2, "items": {"type": "integer"}},
+			"status": {"enum": ["open", "paid"]},
+			"a/b": {"type": "string", "minLength": 2}
+		},
+		"additionalProperties": false
+	}`)
+	require.NoError(t, s.Validate([]byte(`{"id": "o-1", "total": 9.5, "items": [1, 2.0], "status": "paid"}`)))
+	for value, want := range map[string]string{
+		`{"id": "o-1"}`:                               `at /: missing required property "total"`,
+		`{"id": "x", "total": 1}`:                     `at /id: doesn't match the pattern ^o-[0-9]+$`,
+		`{"id": "o-1", "total": -1}`:                  `at /total: -1 is below the minimum 0`,
+		`{"id": "o-1", "total": 1, "items": [1.5]}`:   `at /items/0: want integer, got number`,
+		`{"id": "o-1", "total": 1, "items": [1,2,3]}`: `at /items: more than 2 items`,
+		`{"id": "o-1", "total": 1, "status": "new"}`:  `at /status: value isn't one of the enum's`,
+		`{"id": "o-1", "total": 1, "a/b": "x"}`:       `at /a~1b: shorter than 2 characters`,
+		`{"id": "o-1", "total": 1, "note": ""}`:       `at /note: no value is allowed`,
+		`[]`:                                          `at /: want object, got array`,
+	} {
+		require.EqualError(t, s.Validate([]byte(value)), want, value)
+	}
+	require.Error(t, s.Validate([]byte(`{"id": "o-1"`)))
+	require.Error(t, s.Validate([]byte(`{"id": "o-1", "total": 1} {}`)))
+
+	for _, definition := range []string{
+		`[]`,
+		`{"type": "float"}`,
+		`{"$ref": "#/$defs/order"}`,
+		`{"anyOf": [{"type": "string"}]}`,
+		`{"properties": {"id": {"pattern": "("}}}`,
+		`{"minLength": -1}`,
+	} {
+		_, err := Compile(&api.Schema{Type: api.SchemaType_SCHEMA_JSON, Definition: []byte(definition)})
+		require.Error(t, err, definition)
+	}
+}
+
+func TestJSONCompatible(t *testing.T) {
+	v1 := compileJSONSchema(t, `{
+		"type": "object",
+		"required": ["id"],
+		"properties": {
+			"id": {"type": "string"},
+			"total": {"type": "integer", "minimum": 0},
+			"status": {"enum": ["open", "paid"]}
+		}
+	}`)
+	for _, tc := range []struct {
+		definition        string
+		backward, forward string
+	}{{
+		// an optional property added
+		definition: `{"type": "object", "required": ["id"], "properties": {
+			"id": {"type": "string"}, "total": {"type": "integer", "minimum": 0},
+			"status": {"enum": ["open", "paid"]}, "note": {"type": "string"}}}`,
+	}, {
+		definition: `{"type": "object", "required": ["id", "total"], "properties": {
+			"id": {"type": "string"}, "total": {"type": "integer", "minimum": 0},
+			"status": {"enum": ["open", "paid"]}}}`,
+		backward: `at /: property "total" made required`,
+	}, {
+		// integers are numbers, but not the other way round
+		definition: `{"type": "object", "required": ["id"], "properties": {
+			"id": {"type": "string"}, "total": {"type": "number", "minimum": 0},
+			"status": {"enum": ["open", "paid", "refunded"]}}}`,
+		forward: `at /status: enum value refunded removed`,
+	}, {
+		definition: `{"type": "object", "required": ["id"], "properties": {
+			"id": {"type": "string"}, "total": {"type": "integer", "minimum": 1},
+			"status": {"enum": ["open", "paid"]}}}`,
+		backward: `at /total: minimum raised`,
+	}, {
+		definition: `{"type": "object", "required": ["id"], "additionalProperties": false, "properties": {
+			"id": {"type": "string"}, "total": {"type": "integer", "minimum": 0},
+			"status": {"enum": ["open", "paid"]}}}`,
+		backward: `at /: additional properties no longer allowed`,
+	}} {
+		v2 := compileJSONSchema(t, tc.definition)
+		for _, c := range []struct {
+			err            string
+			reader, writer *Schema
+		}{{tc.backward, v2, v1}, {tc.forward, v1, v2}} {
+			err := Compatible(c.reader, c.writer)
+			if c.err == "" {
+				require.NoError(t, err, tc.definition)
+			} else {
+				require.EqualError(t, err, c.err, tc.definition)
+			}
+		}
+	}
+}
+
+// A schema of a message in a file of its own, with fields of the numbers,
+// types and labels given
+func protoSchema(t *testing.T, fields ...*descriptorpb.FieldDescriptorProto) *Schema {
+	t.Helper()
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("order.proto"),
+		Package: proto.String("shop"),
+		Syntax:  proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name:  proto.String("Order"),
+			Field: fields,
+		}},
+	}}}
+	b, err := proto.Marshal(set)
+	require.NoError(t, err)
+	s, err := Compile(&api.Schema{Type: api.SchemaType_SCHEMA_PROTOBUF, Definition: b, Message: "shop.Order"})
+	require.NoError(t, err)
+	return s
+}
+
+func protoField(name string, number int32, typ descriptorpb.FieldDescriptorProto_Type, label descriptorpb.FieldDescriptorProto_Label) *descriptorpb.FieldDescriptorProto {
+	return &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(number), Type: typ.Enum(), Label: label.Enum()}
+}
+
+func TestProto(t *testing.T) {
+	optional, required, repeated := descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL, descriptorpb.FieldDescriptorProto_LABEL_REQUIRED, descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+	v1 := protoSchema(t,
+		protoField("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, required),
+		protoField("total", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, optional),
+	)
+	require.NoError(t, v1.Validate([]byte{0x0a, 0x01, 'a', 0x10, 0x07}))
+	// a value without its required field, and one that isn't protobuf
+	require.Error(t, v1.Validate([]byte{0x10, 0x07}))
+	require.Error(t, v1.Validate([]byte(`{"id": "a"}`)))
+
+	// the message's own types decode as it does, the schema naming it
+	fds := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{protodesc.ToFileDescriptorProto(api.File_api_v1_log_proto)}}
+	b, err := proto.Marshal(fds)
+	require.NoError(t, err)
+	record, err := Compile(&api.Schema{Type: api.SchemaType_SCHEMA_PROTOBUF, Definition: b, Message: "log.v1.Record"})
+	require.NoError(t, err)
+	value, err := proto.Marshal(&api.Record{Value: []byte("hello"), Offset: 3})
+	require.NoError(t, err)
+	require.NoError(t, record.Validate(value))
+	_, err = Compile(&api.Schema{Type: api.SchemaType_SCHEMA_PROTOBUF, Definition: b, Message: "log.v1.Missing"})
+	require.Error(t, err)
+
+	for _, tc := range []struct {
+		fields            []*descriptorpb.FieldDescriptorProto
+		backward, forward string
+	}{{
+		// fields added and their names or wire compatible types changed
+		fields: []*descriptorpb.FieldDescriptorProto{
+			protoField("id", 1, descriptorpb.FieldDescriptorProto_TYPE_BYTES, required),
+			protoField("amount", 2, descriptorpb.FieldDescriptorProto_TYPE_UINT64, optional),
+			protoField("tags", 3, descriptorpb.FieldDescriptorProto_TYPE_STRING, repeated),
+		},
+	}, {
+		fields: []*descriptorpb.FieldDescriptorProto{
+			protoField("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, required),
+			protoField("total", 2, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE, optional),
+		},
+		backward: "at shop.Order.total: field 2 changed from int64 to double",
+		forward:  "at shop.Order.total: field 2 changed from double to int64",
+	}, {
+		fields: []*descriptorpb.FieldDescriptorProto{
+			protoField("id", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING, required),
+			protoField("total", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, optional),
+			protoField("at", 3, descriptorpb.FieldDescriptorProto_TYPE_INT64, required),
+		},
+		backward: "at shop.Order.at: required field 3 added",
+	}, {
+		fields: []*descriptorpb.FieldDescriptorProto{
+			protoField("total", 2, descriptorpb.FieldDescriptorProto_TYPE_INT64, repeated),
+		},
+		backward: "at shop.Order.total: field 2 changed between repeated and not",
+		forward:  "at shop.Order.id: required field 1 added",
+	}} {
+		v2 := protoSchema(t, tc.fields...)
+		for _, c := range []struct {
+			err            string
+			reader, writer *Schema
+		}{{tc.backward, v2, v1}, {tc.forward, v1, v2}} {
+			err := Compatible(c.reader, c.writer)
+			if c.err == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, c.err)
+			}
+		}
+	}
+	require.EqualError(t, Compatible(v1, compileJSONSchema(t, `{}`)), "schema type changed")
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Audit actions
+const (
+	AuditAuthenticate = "authenticate"
+	AuditExport       = "audit.export"
+	AuditReload       = "config.reload"
+	AuditBackup       = "log.backup"
+)
+
+// Audit results
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+	AuditDenied  = "denied"
+)
+
+// AuditEvent is a single entry in the audit trail
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal"`
+	Action    string    `json:"action"`
+	Resource  string    `json:"resource"`
+	Result    string    `json:"result"`
+}
+
+// Auditor keeps the audit trail in its own append-only log, separate from user data
+type Auditor struct {
+	log CommitLog
+}
+
+// NewAuditor keeps the trail in memory, so it's lost on restart
+func NewAuditor() *Auditor {
+	return NewLogAuditor(NewLog())
+}
+
+// NewLogAuditor keeps the trail in l, such as a log.Log of its own under
+// the data directory that outlives restarts
+func NewLogAuditor(l CommitLog) *Auditor {
+	return &Auditor{log: l}
+}
+
+// Record appends the event to the trail, stamping it with the current time if unset
+func (a *Auditor) Record(e AuditEvent) (uint64, error) {
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	value, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	return a.log.Append(&api.Record{Value: value})
+}
+
+// Export writes every event from the given offset onwards to w as newline delimited JSON
+func (a *Auditor) Export(w io.Writer, from uint64) error {
+	for off := from; ; {
+		record, next, err := readFrom(a.log, off)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		off = next
+		// appending to the value could write into the stored record's array
+		line := make([]byte, len(record.Value)+1)
+		copy(line, record.Value)
+		line[len(line)-1] = '\n'
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+	}
+}
+
+// The Log service's methods audited as the Admin service's are, those
+// administering topics
+var auditedLogMethods = map[string]bool{
+	api.Log_CreateTopic_FullMethodName:       true,
+	api.Log_DeleteTopic_FullMethodName:       true,
+	api.Log_AlterTopicConfigs_FullMethodName: true,
+	api.Log_CreatePartitions_FullMethodName:  true,
+}
+
+// Whether calls to the method are audited, those to the Admin service's
+// and auditedLogMethods
+func audited(method string) bool {
+	return strings.HasPrefix(method, "/"+api.Admin_ServiceDesc.ServiceName+"/") || auditedLogMethods[method]
+}
+
+// The resource an audited call is recorded against, what its method
+// authorizes it as
+func auditedResource(req any) string {
+	switch req := req.(type) {
+	case *api.BackupRequest:
+		return backupResource(req.Topic)
+	case *api.AlterQuotasRequest:
+		return quotaResource
+	case *api.DescribeServerRequest:
+		return configResource
+	case *api.CreateTopicRequest:
+		return topicResource(req.Name)
+	case *api.DeleteTopicRequest:
+		return topicResource(req.Name)
+	case *api.AlterTopicConfigsRequest:
+		return topicResource(req.Name)
+	case *api.CreatePartitionsRequest:
+		return topicResource(req.Name)
+	case interface{ GetTopic() string }:
+		return topicResource(req.GetTopic())
+	}
+	return objectWildcard
+}
+
+// Records the audited call in the trail, whether or not it worked, failing
+// it when it can't be. Denied calls were recorded when they were denied, see
+// grpcServer.authorize.
+func (s *grpcServer) audit(ctx context.Context, method string, req any, err error) error {
+	if status.Code(err) == codes.PermissionDenied {
+		return err
+	}
+	result := AuditSuccess
+	if err != nil {
+		result = AuditFailure
+	}
+	if _, aerr := s.Audit.Record(AuditEvent{
+		Principal: auth.Principal(ctx),
+		Action:    method,
+		Resource:  auditedResource(req),
+		Result:    result,
+	}); aerr != nil && err == nil {
+		return aerr
+	}
+	return err
+}
+
+func (s *grpcServer) auditUnary(
+	ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+) (any, error) {
+	if !audited(info.FullMethod) {
+		return handler(ctx, req)
+	}
+	res, err := handler(ctx, req)
+	if err = s.audit(ctx, info.FullMethod, req, err); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *grpcServer) auditStream(
+	srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+) error {
+	if !audited(info.FullMethod) {
+		return handler(srv, stream)
+	}
+	as := &auditedStream{ServerStream: stream}
+	err := handler(srv, as)
+	return s.audit(stream.Context(), info.FullMethod, as.req, err)
+}
+
+// auditedStream keeps the stream's request, the first message it receives,
+// for the call to be audited against
+type auditedStream struct {
+	grpc.ServerStream
+	req any
+}
+
+func (s *auditedStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil && s.req == nil {
+		s.req = m
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditorRecordExport(t *testing.T) {
+	a := NewAuditor()
+	events := []AuditEvent{
+		{Principal: "alice", Action: AuditAuthenticate, Resource: "*", Result: AuditFailure},
+		{Principal: "bob", Action: produceAction, Resource: objectWildcard, Result: AuditDenied},
+		{Principal: "root", Action: AuditExport, Resource: "audit", Result: AuditSuccess},
+	}
+	for i, e := range events {
+		off, err := a.Record(e)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+
+	var buf bytes.Buffer
+	err := a.Export(&buf, 1)
+	require.NoError(t, err)
+
+	scanner := bufio.NewScanner(&buf)
+	var got []AuditEvent
+	for scanner.Scan() {
+		var e AuditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+		require.False(t, e.Time.IsZero())
+		got = append(got, e)
+	}
+	require.Len(t, got, 2)
+	require.Equal(t, "bob", got[0].Principal)
+	require.Equal(t, AuditDenied, got[0].Result)
+	require.Equal(t, AuditExport, got[1].Action)
+}
+
+func TestLogAuditorSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	_, err = NewLogAuditor(l).Record(AuditEvent{Principal: "alice", Action: AuditBackup, Result: AuditSuccess})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	l, err = log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	a := NewLogAuditor(l)
+	off, err := a.Record(AuditEvent{Principal: "bob", Action: AuditExport, Result: AuditSuccess})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	var buf bytes.Buffer
+	require.NoError(t, a.Export(&buf, 0))
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], `"principal":"alice"`)
+	require.Contains(t, lines[1], `"principal":"bob"`)
+}
+
+func TestAdminCallsAudited(t *testing.T) {
+	client, config, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "events"})
+	require.NoError(t, err)
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "events"})
+	require.Error(t, err)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "events", Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+	_, err = client.DeleteRecords(ctx, &api.DeleteRecordsRequest{Topic: "events", BeforeOffset: 1})
+	require.NoError(t, err)
+	stream, err := client.Backup(ctx, &api.BackupRequest{Topic: "events"})
+	require.NoError(t, err)
+	for err == nil {
+		_, err = stream.Recv()
+	}
+	require.ErrorIs(t, err, io.EOF)
+	// denied calls are recorded once, when they're denied
+	_, err = client.DeleteTopic(asPrincipal(context.Background(), "nobody-key"), &api.DeleteTopicRequest{Name: "events"})
+	require.Error(t, err)
+
+	var trail bytes.Buffer
+	require.NoError(t, config.Audit.Export(&trail, 0))
+	var got []AuditEvent
+	for _, line := range bytes.Split(bytes.TrimSpace(trail.Bytes()), []byte("\n")) {
+		var event AuditEvent
+		require.NoError(t, json.Unmarshal(line, &event))
+		event.Time = time.Time{}
+		got = append(got, event)
+	}
+	require.Equal(t, []AuditEvent{
+		{Principal: "root", Action: api.Log_CreateTopic_FullMethodName, Resource: "events", Result: AuditSuccess},
+		{Principal: "root", Action: api.Log_CreateTopic_FullMethodName, Resource: "events", Result: AuditFailure},
+		{Principal: "root", Action: api.Admin_DeleteRecords_FullMethodName, Resource: "events", Result: AuditSuccess},
+		{Principal: "root", Action: api.Admin_Backup_FullMethodName, Resource: "events", Result: AuditSuccess},
+		{Principal: "nobody", Action: adminAction, Resource: "events", Result: AuditDenied},
+	}, got)
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The most of a backup a Backup response carries, well under gRPC's
+// message limit
+const backupChunkSize = 1 << 20
+
+// The commit log's backups, of just the topic unless it's empty, or
+// Unimplemented when it doesn't have them
+func (c *Config) backupLog(topic string) (backupLog, error) {
+	if topic != "" {
+		// a missing topic fails before the backup's started
+		if _, err := c.describeTopic(topic); err != nil {
+			return nil, err
+		}
+		tl, ok := c.CommitLog.(topicBackupLog)
+		if !ok {
+			return nil, status.Error(codes.Unimplemented, "log can't back up a topic")
+		}
+		return topicBackup{topicBackupLog: tl, topic: topic}, nil
+	}
+	bl, ok := c.CommitLog.(backupLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log can't be backed up")
+	}
+	return bl, nil
+}
+
+// A backup of just the topic
+type topicBackup struct {
+	topicBackupLog
+	topic string
+}
+
+func (b topicBackup) Backup(w io.Writer) (*log.BackupManifest, error) {
+	return b.BackupTopic(b.topic, w)
+}
+
+// What a backup of the topic, every one when it's empty, is of, to
+// authorize and audit
+func backupResource(topic string) string {
+	if topic == "" {
+		return objectWildcard
+	}
+	return topic
+}
+
+// Backs the commit log up into the directory name in LinkBackupDir and
+// returns the directory
+func (c *Config) linkBackup(name string) (string, *log.BackupManifest, error) {
+	if c.LinkBackupDir == "" {
+		return "", nil, status.Error(codes.FailedPrecondition, "link backups aren't configured")
+	}
+	lb, ok := c.CommitLog.(linkBackupLog)
+	if !ok {
+		return "", nil, status.Error(codes.Unimplemented, "log can't be link backed up")
+	}
+	if name == "" {
+		name = "proglog-backup-" + time.Now().UTC().Format("20060102T150405.000Z")
+	}
+	if !filepath.IsLocal(name) || filepath.Base(name) != name || strings.HasSuffix(name, ".tmp") {
+		return "", nil, status.Errorf(codes.InvalidArgument, "backup name %q isn't a directory name", name)
+	}
+	dir := filepath.Join(c.LinkBackupDir, name)
+	manifest, err := lb.LinkBackup(dir)
+	if errors.Is(err, fs.ErrExist) {
+		return "", nil, status.Errorf(codes.AlreadyExists, "backup %s already exists", name)
+	}
+	return dir, manifest, err
+}
+
+// The files of a link backup and their bytes
+func linkBackupSize(manifest *log.BackupManifest) (files uint32, bytes uint64) {
+	for _, size := range manifest.Files {
+		files++
+		bytes += uint64(size)
+	}
+	return files, bytes
+}
+
+// Sends what's written to it as Backup responses of at most
+// backupChunkSize
+type backupWriter struct {
+	stream api.Admin_BackupServer
+}
+
+func (w backupWriter) Write(p []byte) (int, error) {
+	for n := 0; n < len(p); n += backupChunkSize {
+		chunk := p[n:min(n+backupChunkSize, len(p))]
+		if err := w.stream.Send(&api.BackupResponse{Chunk: chunk}); err != nil {
+			return n, err
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+// A batch holds this many records at most when AppendBatchMaxRecords is unset
+const defaultAppendBatchMaxRecords = 512
+
+// appendBatcher coalesces the records of concurrent produces to a partition
+// into batch appends, answering each produce with its own offset. Produces
+// arriving while a partition's batch appends make up its next batch, led by
+// the first of them. The leader appends it once the last batch has, at
+// once unless the last batch was shared: then produces are concurrent and
+// it waits up to the window for others to join, so a lone producer never
+// waits.
+type appendBatcher struct {
+	mu         sync.Mutex
+	partitions map[batchKey]*partitionBatches
+}
+
+// Records are batched with those to the same commit log at the same ack level
+type batchKey struct {
+	cl  CommitLog
+	ack api.Ack
+}
+
+type partitionBatches struct {
+	cond *sync.Cond
+	// open is the batch produces join, nil until one does
+	open *appendBatch
+	// appending is set while a batch appends
+	appending bool
+	// shared is set when the last batch held more than one record
+	shared bool
+	// leaders waiting to append their batches
+	leaders int
+}
+
+type appendBatch struct {
+	records []*api.Record
+	// full is closed once the batch holds the most records it can
+	full chan struct{}
+	done chan struct{}
+	offs []uint64
+	// pending and err are every record's
+	pending bool
+	err     error
+}
+
+// Appends the record to l in a batch with those produced alongside it, the
+// batch's leader appending it in the Scheduler slot it takes
+func (b *appendBatcher) append(cl CommitLog, l batchLog, record *api.Record, ack api.Ack, window time.Duration, maxRecords int, slot func() (release func())) (
+	off uint64, pending bool, err error,
+) {
+	if maxRecords <= 0 {
+		maxRecords = defaultAppendBatchMaxRecords
+	}
+	key := batchKey{cl: cl, ack: ack}
+	b.mu.Lock()
+	if b.partitions == nil {
+		b.partitions = make(map[batchKey]*partitionBatches)
+	}
+	p, ok := b.partitions[key]
+	if !ok {
+		p = &partitionBatches{cond: sync.NewCond(&b.mu)}
+		b.partitions[key] = p
+	}
+	batch, leader := p.open, p.open == nil
+	if leader {
+		batch = &appendBatch{full: make(chan struct{}), done: make(chan struct{})}
+		p.open = batch
+	}
+	i := len(batch.records)
+	batch.records = append(batch.records, record)
+	if len(batch.records) == maxRecords {
+		// the next produce starts another
+		close(batch.full)
+		p.open = nil
+	}
+	if !leader {
+		b.mu.Unlock()
+		<-batch.done
+		return batch.result(i)
+	}
+
+	p.leaders++
+	for p.appending {
+		p.cond.Wait()
+	}
+	shared := p.shared
+	p.appending = true
+	b.mu.Unlock()
+	if shared && window > 0 {
+		timer := time.NewTimer(window)
+		select {
+		case <-batch.full:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+	b.mu.Lock()
+	if p.open == batch {
+		p.open = nil
+	}
+	records := batch.records
+	b.mu.Unlock()
+
+	appendBatchRecords.Observe(float64(len(records)))
+	release := slot()
+	batch.offs, batch.pending, batch.err = l.AppendBatch(records, ack)
+	release()
+	close(batch.done)
+
+	b.mu.Lock()
+	p.appending, p.shared = false, len(records) > 1
+	p.leaders--
+	p.cond.Broadcast()
+	if p.open == nil && p.leaders == 0 {
+		delete(b.partitions, key)
+	}
+	b.mu.Unlock()
+	return batch.result(i)
+}
+
+// The i'th record's offset once the batch has appended
+func (b *appendBatch) result(i int) (uint64, bool, error) {
+	if b.err != nil {
+		return 0, false, b.err
+	}
+	if i >= len(b.offs) {
+		return 0, b.pending, nil
+	}
+	return b.offs[i], b.pending, nil
+}
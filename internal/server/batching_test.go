@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// A commit log counting the batches it appends, each taking a while
+type batchCountingLog struct {
+	mu      sync.Mutex
+	records []*api.Record
+	batches int
+	err     error
+}
+
+func (l *batchCountingLog) Append(record *api.Record) (uint64, error) {
+	offs, _, err := l.AppendBatch([]*api.Record{record}, api.Ack_ACK_ALL)
+	if err != nil {
+		return 0, err
+	}
+	return offs[0], nil
+}
+
+func (l *batchCountingLog) AppendBatch(records []*api.Record, ack api.Ack) ([]uint64, bool, error) {
+	time.Sleep(5 * time.Millisecond)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.err != nil {
+		return nil, false, l.err
+	}
+	l.batches++
+	var offs []uint64
+	for _, record := range records {
+		offs = append(offs, uint64(len(l.records)))
+		l.records = append(l.records, record)
+	}
+	return offs, false, nil
+}
+
+func (l *batchCountingLog) Read(off uint64) (*api.Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if off >= uint64(len(l.records)) {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return l.records[off], nil
+}
+
+func TestAppendBatcher(t *testing.T) {
+	cl := &batchCountingLog{}
+	b := &appendBatcher{}
+	window := 50 * time.Millisecond
+	slot := func() func() { return func() {} }
+
+	// a lone producer appends without waiting out the window
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		off, _, err := b.append(cl, cl, &api.Record{Value: []byte("lone")}, api.Ack_ACK_ALL, window, 0, slot)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	require.Less(t, time.Since(start), window)
+	require.Equal(t, 3, cl.batches)
+
+	// concurrent produces share batches, each answered with its own offset
+	const producers = 100
+	var wg sync.WaitGroup
+	offs := make([]uint64, producers)
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			off, _, err := b.append(cl, cl, &api.Record{Offset: uint64(i)}, api.Ack_ACK_ALL, window, 16, slot)
+			require.NoError(t, err)
+			offs[i] = off
+		}()
+	}
+	wg.Wait()
+	for i, off := range offs {
+		record, err := cl.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), record.Offset)
+	}
+	require.Less(t, cl.batches-3, producers/4)
+	require.Empty(t, b.partitions)
+
+	// a failed batch fails every produce in it
+	cl.err = errors.New("disk on fire")
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := b.append(cl, cl, &api.Record{}, api.Ack_ACK_ALL, window, 0, slot)
+			require.ErrorIs(t, err, cl.err)
+		}()
+	}
+	wg.Wait()
+}
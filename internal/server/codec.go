@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/binary"
+
+	"github.com/frankie-mur/proglog/internal/bufpool"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/mem"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// consumeCodec is the proto codec, only consume streams' responses of
+// records as they're stored go onto the wire as they are, see
+// marshaledConsumeResponse
+type consumeCodec struct {
+	encoding.CodecV2
+}
+
+func (c consumeCodec) Marshal(v any) (mem.BufferSlice, error) {
+	if res, ok := v.(*marshaledConsumeResponse); ok {
+		return res.buffers(), nil
+	}
+	return c.CodecV2.Marshal(v)
+}
+
+// A consume response of a record as it's stored, sent without decoding it
+// and marshaling it again: a ConsumeResponse is its record, marshaled, after
+// the field's tag and length. The record's buffer is bufpool's, put back
+// once the transport's written it.
+type marshaledConsumeResponse struct {
+	record *[]byte
+	// the record field's tag and length
+	header [1 + binary.MaxVarintLen64]byte
+}
+
+// ConsumeResponse's record field's number
+const consumeResponseRecordField = 2
+
+func (r *marshaledConsumeResponse) buffers() mem.BufferSlice {
+	header := protowire.AppendTag(r.header[:0], consumeResponseRecordField, protowire.BytesType)
+	header = protowire.AppendVarint(header, uint64(len(*r.record)))
+	return mem.BufferSlice{mem.SliceBuffer(header), mem.NewBuffer(r.record, recordBuffers{})}
+}
+
+// Gives the transport's written buffers back to bufpool
+type recordBuffers struct{}
+
+func (recordBuffers) Get(n int) *[]byte {
+	return bufpool.Get(n)
+}
+
+func (recordBuffers) Put(p *[]byte) {
+	bufpool.Put(p)
+}
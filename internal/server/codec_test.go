@@ -0,0 +1,35 @@
+package server
+
+import (
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/bufpool"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+	gproto "google.golang.org/protobuf/proto"
+)
+
+func TestConsumeCodec(t *testing.T) {
+	c := consumeCodec{CodecV2: encoding.GetCodecV2(proto.Name)}
+	record := &api.Record{Value: make([]byte, 300), Offset: 7}
+	b, err := gproto.Marshal(record)
+	require.NoError(t, err)
+	p := bufpool.Get(len(b))
+	*p = append((*p)[:0], b...)
+
+	// a record as it's stored is sent as if its response had been marshaled
+	got, err := c.Marshal(&marshaledConsumeResponse{record: p})
+	require.NoError(t, err)
+	want, err := gproto.Marshal(&api.ConsumeResponse{Record: record})
+	require.NoError(t, err)
+	require.Equal(t, want, got.Materialize())
+	got.Free()
+
+	// other messages are marshaled by the proto codec
+	got, err = c.Marshal(&api.ConsumeResponse{Record: record})
+	require.NoError(t, err)
+	require.Equal(t, want, got.Materialize())
+	got.Free()
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// compactLog is implemented by commit logs compacted on demand, see
+// log.Log.Compact
+type compactLog interface {
+	Compact(deleteRetention time.Duration) (removed int, err error)
+	CompactionStats() log.CompactionStats
+}
+
+// The topic's partitions' logs on this server, to compact or describe
+func (c *Config) compactLogs(topic string) ([]compactLog, error) {
+	desc, err := c.describeTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]compactLog, 0, desc.Partitions)
+	for p := range desc.Partitions {
+		l, err := c.partition(topic, p)
+		if err != nil {
+			return nil, err
+		}
+		cl, ok := l.(compactLog)
+		if !ok {
+			return nil, status.Error(codes.Unimplemented, "log can't be compacted")
+		}
+		logs = append(logs, cl)
+	}
+	return logs, nil
+}
+
+// Describes the partitions' compactions, which the topic's config says
+// when they run by themselves
+func (c *Config) describeCompaction(topic string) ([]*api.Compaction, error) {
+	logs, err := c.compactLogs(topic)
+	if err != nil {
+		return nil, err
+	}
+	tc, err := c.topicConfig(topic)
+	if err != nil {
+		return nil, err
+	}
+	compactions := make([]*api.Compaction, 0, len(logs))
+	for p, l := range logs {
+		stats := l.CompactionStats()
+		compaction := &api.Compaction{
+			Topic:                  topicResource(topic),
+			Partition:              uint32(p),
+			Running:                stats.Running,
+			SegmentsDone:           uint32(stats.SegmentsDone),
+			Segments:               uint32(stats.Segments),
+			DirtyRatio:             stats.DirtyRatio,
+			MinCleanableDirtyRatio: tc.MinCleanableDirtyRatio,
+			Runs:                   stats.Runs,
+			LastDurationMs:         milliseconds(stats.LastDuration),
+			RecordsRemoved:         stats.RecordsRemoved,
+			BytesReclaimed:         stats.BytesReclaimed,
+			TombstonesRemoved:      stats.TombstonesRemoved,
+		}
+		if !stats.LastRun.IsZero() {
+			compaction.LastRun = stats.LastRun.UnixNano()
+		}
+		compactions = append(compactions, compaction)
+	}
+	return compactions, nil
+}
+
+// Compacts the topic's partitions one after another, failing unless the
+// topic is compacted so superseded records of others aren't lost
+func (c *Config) compactTopic(ctx context.Context, topic string) ([]*api.Compaction, error) {
+	tc, err := c.topicConfig(topic)
+	if err != nil {
+		return nil, err
+	}
+	if !tc.Compact {
+		return nil, status.Errorf(codes.FailedPrecondition, "topic %s isn't compacted, see %s", topicResource(topic), log.CleanupPolicyConfig)
+	}
+	logs, err := c.compactLogs(topic)
+	if err != nil {
+		return nil, err
+	}
+	for p, l := range logs {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		removed, err := l.Compact(tc.DeleteRetention)
+		if err != nil {
+			return nil, err
+		}
+		c.Logger.Info("compacted topic partition",
+			zap.String("topic", topicResource(topic)),
+			zap.Int("partition", p),
+			zap.Int("removed", removed),
+			zap.Duration("took", time.Since(start)),
+		)
+	}
+	return c.describeCompaction(topic)
+}
+
+func (s *grpcServer) CompactTopic(ctx context.Context, req *api.CompactTopicRequest) (*api.CompactTopicResponse, error) {
+	if err := s.authorize(ctx, adminAction, topicResource(req.Topic)); err != nil {
+		return nil, err
+	}
+	partitions, err := s.compactTopic(ctx, req.Topic)
+	if err != nil {
+		s.logger(ctx).Error("compact topic failed", zap.String("topic", req.Topic), zap.Error(err))
+		return nil, err
+	}
+	return &api.CompactTopicResponse{Partitions: partitions}, nil
+}
+
+func (s *grpcServer) DescribeCompaction(ctx context.Context, req *api.DescribeCompactionRequest) (*api.DescribeCompactionResponse, error) {
+	if err := s.authorize(ctx, adminAction, topicResource(req.Topic)); err != nil {
+		return nil, err
+	}
+	partitions, err := s.describeCompaction(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+	return &api.DescribeCompactionResponse{Partitions: partitions}, nil
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCompactTopic(t *testing.T) {
+	client, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "users", Configs: map[string]string{
+		log.MinCleanableDirtyRatioConfig: "2",
+	}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "users", Partitions: 2, Configs: map[string]string{
+		log.CleanupPolicyConfig:          "compact",
+		log.MinCleanableDirtyRatioConfig: "0.5",
+	}})
+	require.NoError(t, err)
+	// enough records to seal a few segments, each key's written many times
+	for i := range 200 {
+		key := []byte(fmt.Sprintf("user-%d", i%5))
+		_, err := client.Produce(ctx, &api.ProduceRequest{Topic: "users", Record: &api.Record{Key: key, Value: key}})
+		require.NoError(t, err)
+	}
+
+	desc, err := client.DescribeCompaction(ctx, &api.DescribeCompactionRequest{Topic: "users"})
+	require.NoError(t, err)
+	require.Len(t, desc.Partitions, 2)
+	p := desc.Partitions[0]
+	require.Equal(t, "users", p.Topic)
+	require.Equal(t, 1.0, p.DirtyRatio)
+	require.Equal(t, 0.5, p.MinCleanableDirtyRatio)
+	require.Zero(t, p.Runs)
+
+	res, err := client.CompactTopic(ctx, &api.CompactTopicRequest{Topic: "users"})
+	require.NoError(t, err)
+	require.Len(t, res.Partitions, 2)
+	p = res.Partitions[0]
+	require.Equal(t, uint64(1), p.Runs)
+	require.NotZero(t, p.LastRun)
+	require.NotZero(t, p.RecordsRemoved)
+	require.NotZero(t, p.BytesReclaimed)
+	require.Zero(t, p.DirtyRatio)
+	require.Equal(t, uint32(1), res.Partitions[1].Partition)
+
+	// the default topic isn't compacted, so its superseded records stay
+	_, err = client.CompactTopic(ctx, &api.CompactTopicRequest{})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	_, err = client.CompactTopic(ctx, &api.CompactTopicRequest{Topic: "missing"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	events := asPrincipal(context.Background(), "events-key")
+	_, err = client.DescribeCompaction(events, &api.DescribeCompactionRequest{Topic: "users"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
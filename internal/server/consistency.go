@@ -0,0 +1,31 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+// Waits until the commit log holds the record at off, for at most
+// MinOffsetTimeout, so a read after it sees the caller's earlier writes
+func (c *Config) waitForOffset(ctx context.Context, cl CommitLog, off uint64) error {
+	ctx, span := tracer.Start(ctx, "Log.WaitForOffset")
+	ctx, cancel := context.WithTimeout(ctx, c.MinOffsetTimeout)
+	defer cancel()
+	for {
+		_, err := cl.Read(off)
+		if !errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			endSpan(span, err)
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			err = api.ErrOffsetNotReplicated{Offset: off}
+			endSpan(span, err)
+			return err
+		case <-time.After(consumePollInterval):
+		}
+	}
+}
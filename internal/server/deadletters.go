@@ -0,0 +1,194 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// A batch is POSTed this many times before it's dead-lettered, when its
+// subscription doesn't say
+const defaultWebhookMaxAttempts = 10
+
+// The dead letters listed or replayed at a time when the request doesn't
+// say, and the records of the dead-letter topic a request reads at most
+// looking for its subscription's
+const (
+	defaultDeadLetterBatch = 100
+	maxDeadLetterScan      = 10000
+)
+
+// The headers a dead letter starts with, in this order, ahead of its
+// record's own
+const (
+	deadLetterSubscriptionHeader = "dead_letter.subscription"
+	deadLetterTopicHeader        = "dead_letter.topic"
+	deadLetterPartitionHeader    = "dead_letter.partition"
+	deadLetterOffsetHeader       = "dead_letter.offset"
+	deadLetterTimestampHeader    = "dead_letter.timestamp"
+	deadLetterAttemptsHeader     = "dead_letter.attempts"
+	deadLetterErrorHeader        = "dead_letter.error"
+)
+
+var deadLetterHeaders = []string{
+	deadLetterSubscriptionHeader,
+	deadLetterTopicHeader,
+	deadLetterPartitionHeader,
+	deadLetterOffsetHeader,
+	deadLetterTimestampHeader,
+	deadLetterAttemptsHeader,
+	deadLetterErrorHeader,
+}
+
+func maxAttempts(sub *api.Subscription) uint32 {
+	if sub.MaxAttempts == 0 {
+		return defaultWebhookMaxAttempts
+	}
+	return sub.MaxAttempts
+}
+
+// The partition of the topic the subscription's dead letters go to
+func (c *Config) deadLetterPartition(sub *api.Subscription) (uint32, error) {
+	topic, err := c.describeTopic(sub.DeadLetterTopic)
+	if err != nil {
+		return 0, err
+	}
+	return partitionForKey([]byte(sub.Name), topic.Partitions), nil
+}
+
+// Appends the records of the partition the subscription failed to deliver
+// to its dead-letter topic, with where they came from and why. They're
+// stamped as they're appended, their own timestamps kept in a header.
+func (c *Config) deadLetter(ctx context.Context, sub *api.Subscription, partition uint32, records []*api.Record, attempts uint32, cause error) error {
+	p, err := c.deadLetterPartition(sub)
+	if err != nil {
+		return err
+	}
+	letters := make([]*api.Record, len(records))
+	for i, record := range records {
+		headers := []*api.Header{
+			{Key: deadLetterSubscriptionHeader, Value: []byte(sub.Name)},
+			{Key: deadLetterTopicHeader, Value: []byte(sub.Topic)},
+			{Key: deadLetterPartitionHeader, Value: strconv.AppendUint(nil, uint64(partition), 10)},
+			{Key: deadLetterOffsetHeader, Value: strconv.AppendUint(nil, record.Offset, 10)},
+			{Key: deadLetterTimestampHeader, Value: strconv.AppendInt(nil, record.Timestamp, 10)},
+			{Key: deadLetterAttemptsHeader, Value: strconv.AppendUint(nil, uint64(attempts), 10)},
+			{Key: deadLetterErrorHeader, Value: []byte(cause.Error())},
+		}
+		letters[i] = &api.Record{Key: record.Key, Value: record.Value, Headers: append(headers, record.Headers...)}
+	}
+	_, _, err = c.appendBatch(ctx, letters, api.Ack_ACK_ALL, sub.DeadLetterTopic, p, nil)
+	return err
+}
+
+// Reads a dead letter back from its record, reporting false for records
+// that aren't the subscription's dead letters
+func readDeadLetter(sub string, record *api.Record) (*api.DeadLetter, bool) {
+	if len(record.Headers) < len(deadLetterHeaders) {
+		return nil, false
+	}
+	values := make(map[string]string, len(deadLetterHeaders))
+	for i, key := range deadLetterHeaders {
+		if record.Headers[i].Key != key {
+			return nil, false
+		}
+		values[key] = string(record.Headers[i].Value)
+	}
+	if values[deadLetterSubscriptionHeader] != sub {
+		return nil, false
+	}
+	partition, perr := strconv.ParseUint(values[deadLetterPartitionHeader], 10, 32)
+	off, oerr := strconv.ParseUint(values[deadLetterOffsetHeader], 10, 64)
+	timestamp, terr := strconv.ParseInt(values[deadLetterTimestampHeader], 10, 64)
+	attempts, aerr := strconv.ParseUint(values[deadLetterAttemptsHeader], 10, 32)
+	if perr != nil || oerr != nil || terr != nil || aerr != nil {
+		return nil, false
+	}
+	return &api.DeadLetter{
+		Record: &api.Record{
+			Key:       record.Key,
+			Value:     record.Value,
+			Offset:    off,
+			Timestamp: timestamp,
+			Headers:   record.Headers[len(deadLetterHeaders):],
+		},
+		Topic:     values[deadLetterTopicHeader],
+		Partition: uint32(partition),
+		Offset:    record.Offset,
+		Attempts:  uint32(attempts),
+		Error:     values[deadLetterErrorHeader],
+	}, true
+}
+
+// The subscription by its name, failing unless it has a dead-letter topic
+func (c *Config) deadLetterSubscription(name string) (*api.Subscription, error) {
+	sub, err := c.subscription(name)
+	if err != nil {
+		return nil, err
+	}
+	if sub.DeadLetterTopic == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "subscription %s has no dead-letter topic", name)
+	}
+	return sub, nil
+}
+
+// Up to max of the subscription's dead letters from off on, in its
+// dead-letter topic's partition, with the partition and the offset to read
+// on from. Other subscriptions' are passed over, up to maxDeadLetterScan
+// records of them.
+func (c *Config) deadLetters(sub *api.Subscription, off uint64, max int) (letters []*api.DeadLetter, partition uint32, next uint64, err error) {
+	if max == 0 {
+		max = defaultDeadLetterBatch
+	}
+	if partition, err = c.deadLetterPartition(sub); err != nil {
+		return nil, 0, 0, err
+	}
+	next = off
+	for scanned := 0; len(letters) < max && scanned < maxDeadLetterScan; {
+		records, err := c.readBatch(sub.DeadLetterTopic, partition, next, min(max-len(letters), maxDeadLetterScan-scanned))
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		if len(records) == 0 {
+			break
+		}
+		for _, record := range records {
+			if letter, ok := readDeadLetter(sub.Name, record); ok {
+				letters = append(letters, letter)
+			}
+		}
+		scanned += len(records)
+		next = records[len(records)-1].Offset + 1
+	}
+	return letters, partition, next, nil
+}
+
+// POSTs the dead letters to the subscription's webhook again, each run of
+// them from one partition in a POST of its own, returning how many were
+// delivered before a POST failed
+func (c *Config) replayDeadLetters(ctx context.Context, sub *api.Subscription, letters []*api.DeadLetter) (int, error) {
+	replayed := 0
+	for i := 0; i < len(letters); {
+		j := i + 1
+		for j < len(letters) && letters[j].Topic == letters[i].Topic && letters[j].Partition == letters[i].Partition {
+			j++
+		}
+		records := make([]*api.Record, 0, j-i)
+		for _, letter := range letters[i:j] {
+			records = append(records, letter.Record)
+		}
+		// the subscription's topic may have changed since, the records
+		// are POSTed as the topic they came from
+		replay := &api.Subscription{Name: sub.Name, Topic: letters[i].Topic, Url: sub.Url, Headers: sub.Headers}
+		if err := c.postWebhook(ctx, replay, letters[i].Partition, records, true); err != nil {
+			return replayed, fmt.Errorf("replaying dead letters from offset %d: %w", letters[i].Offset, err)
+		}
+		replayed += len(records)
+		i = j
+	}
+	return replayed, nil
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"runtime"
+
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+const debugAction = "debug"
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+}
+
+// DebugStats is the /debug/stats snapshot of the server's internal state
+type DebugStats struct {
+	Goroutines int        `json:"goroutines"`
+	Logs       []LogDebug `json:"logs"`
+}
+
+type LogDebug struct {
+	Dir      string             `json:"dir"`
+	Stats    log.Stats          `json:"stats"`
+	Segments []log.SegmentStats `json:"segments"`
+}
+
+func debugStats() DebugStats {
+	st := DebugStats{
+		Goroutines: runtime.NumGoroutine(),
+		Logs:       []LogDebug{},
+	}
+	for _, l := range log.OpenLogs() {
+		st.Logs = append(st.Logs, LogDebug{
+			Dir:      l.Dir,
+			Stats:    l.Stats(),
+			Segments: l.SegmentStats(),
+		})
+	}
+	return st
+}
+
+func (s *httpsServer) handleDebugStats(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, debugAction, objectWildcard) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(debugStats()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// NewDebugServer serves /debug/vars (expvar) and /debug/stats without
+// authentication, so it belongs on a loopback or otherwise private address
+func NewDebugServer(addr string) *http.Server {
+	r := http.NewServeMux()
+	r.Handle("GET /debug/vars", expvar.Handler())
+	r.HandleFunc("GET /debug/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(debugStats()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	return &http.Server{Addr: addr, Handler: r}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+// A dedup window bounded only by time holds at most this many hashes, the
+// oldest falling out first
+const dedupMaxHashes = 1 << 20
+
+// dedups are the dedup windows of the topics that ask for one, by topic,
+// see log.DedupWindowMsConfig. They're kept in memory by the server
+// appending the records, so a new leader starts its windows empty, and a
+// copy produced while its original is still being appended may be
+// appended too.
+type dedups struct {
+	mu      sync.Mutex
+	windows map[string]*dedupWindow
+}
+
+// The hashes of the records appended to a topic within its window, each
+// with the number of the latest record appended with it
+type dedupWindow struct {
+	mu    sync.Mutex
+	seen  map[[sha256.Size]byte]uint64
+	order []dedupEntry
+	// n is how many records have been added
+	n uint64
+}
+
+type dedupEntry struct {
+	sum [sha256.Size]byte
+	n   uint64
+	at  time.Time
+}
+
+// The topic's dedup window
+func (d *dedups) window(topic string) *dedupWindow {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	w, ok := d.windows[topic]
+	if !ok {
+		if d.windows == nil {
+			d.windows = make(map[string]*dedupWindow)
+		}
+		w = &dedupWindow{seen: make(map[[sha256.Size]byte]uint64)}
+		d.windows[topic] = w
+	}
+	return w
+}
+
+// Drops the hashes that have fallen out of the window
+func (w *dedupWindow) expire(tc log.TopicConfig, now time.Time) {
+	i := 0
+	for ; i < len(w.order); i++ {
+		e := w.order[i]
+		if (tc.DedupWindow == 0 || now.Sub(e.at) <= tc.DedupWindow) &&
+			(tc.DedupRecords == 0 || w.n-e.n < tc.DedupRecords) &&
+			len(w.order)-i <= dedupMaxHashes {
+			break
+		}
+		if w.seen[e.sum] == e.n {
+			delete(w.seen, e.sum)
+		}
+	}
+	w.order = w.order[i:]
+}
+
+// The hash records are compared by, of their values and, when the topic
+// asks, their keys
+func dedupSum(tc log.TopicConfig, record *api.Record) [sha256.Size]byte {
+	h := sha256.New()
+	if tc.DedupKey {
+		h.Write(binary.AppendUvarint(nil, uint64(len(record.Key))))
+		h.Write(record.Key)
+	}
+	h.Write(binary.AppendUvarint(nil, uint64(record.Codec)))
+	h.Write(record.Value)
+	var sum [sha256.Size]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// Which of the records produced to the topic copy one appended within its
+// dedup window, or one before them in the records
+func (c *Config) duplicates(tc log.TopicConfig, topic string, records []*api.Record) []bool {
+	dups := make([]bool, len(records))
+	if !tc.Dedup() {
+		return dups
+	}
+	w := c.dedups.window(topic)
+	sums := make(map[[sha256.Size]byte]bool, len(records))
+	w.mu.Lock()
+	w.expire(tc, time.Now())
+	for i, record := range records {
+		sum := dedupSum(tc, record)
+		_, seen := w.seen[sum]
+		dups[i] = seen || sums[sum]
+		sums[sum] = true
+	}
+	w.mu.Unlock()
+	for _, dup := range dups {
+		if dup {
+			dedupRecords.WithLabelValues(topic, "duplicate").Inc()
+		}
+	}
+	return dups
+}
+
+// Adds the records appended to the topic to its dedup window
+func (c *Config) remember(tc log.TopicConfig, topic string, records ...*api.Record) {
+	if !tc.Dedup() || len(records) == 0 {
+		return
+	}
+	w := c.dedups.window(topic)
+	now := time.Now()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, record := range records {
+		sum := dedupSum(tc, record)
+		w.n++
+		w.seen[sum] = w.n
+		w.order = append(w.order, dedupEntry{sum: sum, n: w.n, at: now})
+	}
+	w.expire(tc, now)
+	dedupRecords.WithLabelValues(topic, "unique").Add(float64(len(records)))
+}
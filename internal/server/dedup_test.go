@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupWindow(t *testing.T) {
+	client, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "events", Configs: map[string]string{
+		log.DedupWindowRecordsConfig: "3",
+	}})
+	require.NoError(t, err)
+	produce := func(key, value string) *api.ProduceResponse {
+		t.Helper()
+		res, err := client.Produce(ctx, &api.ProduceRequest{Topic: "events", Record: &api.Record{Key: []byte(key), Value: []byte(value)}})
+		require.NoError(t, err)
+		return res
+	}
+
+	// copies of a record appended are dropped, whatever their keys
+	require.False(t, produce("1", "a").Dropped)
+	require.True(t, produce("1", "a").Dropped)
+	require.True(t, produce("2", "a").Dropped)
+
+	// as are copies within a batch
+	res, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Topic: "events", Records: []*api.Record{
+		{Value: []byte("b")}, {Value: []byte("b")}, {Value: []byte("c")},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, true, false}, res.Dropped)
+	require.Equal(t, []uint64{1, 0, 2}, res.Offsets)
+
+	// until the record's fallen out of the window
+	require.Equal(t, uint64(3), produce("", "d").Offset)
+	again := produce("1", "a")
+	require.False(t, again.Dropped)
+	require.Equal(t, uint64(4), again.Offset)
+
+	// topics comparing keys keep copies under other keys
+	_, err = client.AlterTopicConfigs(ctx, &api.AlterTopicConfigsRequest{Name: "events", Configs: map[string]string{
+		log.DedupKeyConfig: "true",
+	}})
+	require.NoError(t, err)
+	require.False(t, produce("2", "a").Dropped)
+	require.True(t, produce("2", "a").Dropped)
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+// Describes the record at the offset of the server's copy of the
+// partition, as its log finds it stored. Logs that don't keep segments
+// describe it as they read it.
+func (c *Config) describeRecord(req *api.DescribeRecordRequest) (*api.DescribeRecordResponse, error) {
+	cl, err := c.partition(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	var info *log.RecordInfo
+	if dl, ok := cl.(describeLog); ok {
+		if info, err = dl.DescribeRecord(req.Offset); err != nil {
+			return nil, err
+		}
+	} else {
+		record, err := cl.Read(req.Offset)
+		if err != nil {
+			return nil, err
+		}
+		info = &log.RecordInfo{Record: record, Offset: record.Offset, Status: log.RecordOK}
+	}
+	res := &api.DescribeRecordResponse{
+		Offset:   info.Offset,
+		Segment:  info.Segment,
+		Archived: info.Archived,
+		Position: info.Position,
+		Size:     info.Size,
+		Batched:  info.Batched,
+		Status:   info.Status,
+	}
+	if record := info.Record; record != nil {
+		res.Timestamp = record.Timestamp
+		res.Key = record.Key
+		res.Headers = record.Headers
+		res.LeaderEpoch = record.Term
+		res.Codec = record.Codec
+		res.Transaction = record.Transaction
+		res.Control = record.Control
+		res.ValueSize = uint64(len(record.Value))
+		if req.IncludeValue {
+			res.Value = record.Value
+		}
+	}
+	return res, nil
+}
+
+// Describes the record, to anyone who may consume its topic
+func (s *grpcServer) DescribeRecord(ctx context.Context, req *api.DescribeRecordRequest) (*api.DescribeRecordResponse, error) {
+	if err := s.authorize(ctx, consumeAction, topicResource(req.Topic)); err != nil {
+		return nil, err
+	}
+	return s.describeRecord(req)
+}
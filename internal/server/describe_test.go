@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDescribeRecord(t *testing.T) {
+	client, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	for _, v := range []string{"first", "second"} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{
+			Key:     []byte("k"),
+			Value:   []byte(v),
+			Headers: []*api.Header{{Key: "source", Value: []byte("test")}},
+		}})
+		require.NoError(t, err)
+	}
+
+	res, err := client.DescribeRecord(ctx, &api.DescribeRecordRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+	require.Equal(t, log.RecordOK, res.Status)
+	require.NotEmpty(t, res.Segment)
+	require.NotZero(t, res.Position)
+	require.NotZero(t, res.Timestamp)
+	require.Equal(t, []byte("k"), res.Key)
+	require.Equal(t, "source", res.Headers[0].Key)
+	require.Equal(t, uint64(len("second")), res.ValueSize)
+	require.Nil(t, res.Value)
+
+	res, err = client.DescribeRecord(ctx, &api.DescribeRecordRequest{Offset: 0, IncludeValue: true})
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), res.Value)
+
+	_, err = client.DescribeRecord(ctx, &api.DescribeRecordRequest{Offset: 2})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	nobody := asPrincipal(context.Background(), "nobody-key")
+	_, err = client.DescribeRecord(nobody, &api.DescribeRecordRequest{Offset: 0})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
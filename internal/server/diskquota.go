@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+// DiskQuotaConfig has the server stop taking produces before its data
+// volume fills, so an append never fails halfway through a record
+type DiskQuotaConfig struct {
+	// Dir is on the volume watched, the data directory
+	Dir string
+	// SoftLimit and HardLimit are shares of the volume used, between 0 and
+	// 1. Past the soft limit the server warns, past the hard limit produces
+	// fail with api.ErrDiskFull, and once retention has freed enough space
+	// for the use to be back under the soft limit they're taken again.
+	// HardLimit defaults to 0.95 and SoftLimit to 0.05 under it.
+	SoftLimit float64
+	HardLimit float64
+	// Interval is how often the volume is looked at, defaults to 5 seconds
+	Interval time.Duration
+}
+
+// What the latest look at the data volume found, nil while produces are
+// taken
+type diskQuota struct {
+	full atomic.Pointer[api.ErrDiskFull]
+}
+
+// Fails with api.ErrDiskFull while the data volume is past its hard limit
+func (q *diskQuota) check() error {
+	if full := q.full.Load(); full != nil {
+		produceDiskFull.Inc()
+		return *full
+	}
+	return nil
+}
+
+// WatchDiskQuota looks at the data volume's use every interval, rejecting
+// the config's servers' produces past the quota's hard limit, until stop
+// is called
+func WatchDiskQuota(quota *DiskQuotaConfig, config *Config) (stop func()) {
+	w := &diskWatcher{quota: *quota, config: withDefaults(config)}
+	if w.quota.HardLimit == 0 {
+		w.quota.HardLimit = 0.95
+	}
+	if w.quota.SoftLimit == 0 {
+		w.quota.SoftLimit = w.quota.HardLimit - 0.05
+	}
+	if w.quota.Interval == 0 {
+		w.quota.Interval = 5 * time.Second
+	}
+	diskSoftLimit.Set(w.quota.SoftLimit)
+	diskHardLimit.Set(w.quota.HardLimit)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			w.check()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(w.quota.Interval):
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+type diskWatcher struct {
+	quota  DiskQuotaConfig
+	config *Config
+	// soft is whether the use was past the soft limit last time
+	soft bool
+	// usage returns the volume's size and the bytes used, diskUsage but in tests
+	usage func(dir string) (capacity, used uint64, err error)
+}
+
+// Looks at the volume's use, and starts or stops rejecting produces
+func (w *diskWatcher) check() {
+	usage := w.usage
+	if usage == nil {
+		usage = diskUsage
+	}
+	capacity, used, err := usage(w.quota.Dir)
+	if err != nil {
+		w.config.Logger.Error("checking disk usage", zap.String("dir", w.quota.Dir), zap.Error(err))
+		return
+	}
+	if capacity == 0 {
+		return
+	}
+	share := float64(used) / float64(capacity)
+	diskUsed.Set(share)
+	fields := []zap.Field{
+		zap.String("dir", w.quota.Dir),
+		zap.String("used", fmt.Sprintf("%.1f%%", share*100)),
+	}
+	q := w.config.disk
+	switch {
+	case share >= w.quota.HardLimit:
+		if q.full.Swap(&api.ErrDiskFull{Used: used, Capacity: capacity}) == nil {
+			w.config.Logger.Error("disk past its hard limit, rejecting produces", fields...)
+			diskFull.Set(1)
+		}
+		w.soft = true
+	case share >= w.quota.SoftLimit:
+		if q.full.Load() != nil {
+			// still full until retention brings it under the soft limit
+			q.full.Store(&api.ErrDiskFull{Used: used, Capacity: capacity})
+		} else if !w.soft {
+			w.config.Logger.Warn("disk past its soft limit", fields...)
+		}
+		w.soft = true
+	default:
+		if q.full.Swap(nil) != nil {
+			w.config.Logger.Info("disk back under its soft limit, taking produces", fields...)
+			diskFull.Set(0)
+		}
+		w.soft = false
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDiskQuota(t *testing.T) {
+	client, config, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	var used uint64
+	w := &diskWatcher{
+		quota:  DiskQuotaConfig{SoftLimit: 0.8, HardLimit: 0.9},
+		config: config,
+		usage: func(string) (uint64, uint64, error) {
+			return 100, used, nil
+		},
+	}
+	produce := func() error {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("record")}})
+		return err
+	}
+
+	// past the soft limit produces are still taken
+	for _, used = range []uint64{50, 85} {
+		w.check()
+		require.NoError(t, produce())
+	}
+	// past the hard limit they aren't, until retention brings the use back
+	// under the soft limit
+	for _, used = range []uint64{90, 85} {
+		w.check()
+		err := produce()
+		require.Equal(t, codes.ResourceExhausted, status.Code(err))
+		require.Contains(t, err.Error(), "disk full: ")
+	}
+	used = 79
+	w.check()
+	require.NoError(t, produce())
+
+	capacity, used, err := diskUsage(t.TempDir())
+	require.NoError(t, err)
+	require.NotZero(t, capacity)
+	require.LessOrEqual(t, used, capacity)
+}
@@ -0,0 +1,17 @@
+//go:build unix
+
+package server
+
+import "golang.org/x/sys/unix"
+
+// The size of the volume dir is on and the bytes used, counting those
+// reserved for root as used since the server can't write them
+func diskUsage(dir string) (capacity, used uint64, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	bsize := uint64(st.Bsize)
+	capacity = st.Blocks * bsize
+	return capacity, capacity - st.Bavail*bsize, nil
+}
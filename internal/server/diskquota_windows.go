@@ -0,0 +1,19 @@
+//go:build windows
+
+package server
+
+import "golang.org/x/sys/windows"
+
+// The size of the volume dir is on and the bytes used, counting those
+// over the process's quota as used since the server can't write them
+func diskUsage(dir string) (capacity, used uint64, err error) {
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var avail, total, free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &avail, &total, &free); err != nil {
+		return 0, 0, err
+	}
+	return total, total - avail, nil
+}
@@ -0,0 +1,400 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"go.uber.org/zap"
+)
+
+// ErrFluentServerClosed is returned by FluentServer.Serve once it's closed
+var ErrFluentServerClosed = errors.New("server: fluent server closed")
+
+// Forward messages bigger than this close their connection, and chunks
+// decompressing to more are refused
+const fluentMaxMessage = 64 << 20
+
+// FluentServer takes events over the forward protocol Fluentd and Fluent
+// Bit ship logs with, in each of its modes: one event to a message,
+// arrays of them, and packed streams of them, gzipped or not. Each event
+// is appended to the topic its tag maps to as a record: its fields as a
+// JSON object, its time, the tag as the key, so a tag's events keep their
+// order in one partition, and a "tag" header.
+//
+// Chunks asking for an ack are acked once they're appended at the topic's
+// ack level; a chunk that fails isn't, and its connection is closed so
+// the sender retries it. Connections are authenticated by their TLS
+// client certificate and appends authorized as the gRPC ones are. There's
+// no shared key handshake.
+type FluentServer struct {
+	srv       *grpcServer
+	tagTopics map[string]string
+	// ctx is canceled on close, ending appends in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	closed bool
+	lns    map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// NewFluentServer appends events to the topics their tags map to in
+// tagTopics. A tag maps by its longest pattern: the tag itself, or a
+// prefix of it ending in ".*", or "*" for every tag. Tags no pattern
+// matches are their own topic's name.
+func NewFluentServer(tagTopics map[string]string, config *Config) *FluentServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &FluentServer{
+		srv:       newgrpcServer(config),
+		tagTopics: tagTopics,
+		ctx:       ctx,
+		cancel:    cancel,
+		lns:       make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve takes events from the connections the listener accepts until the
+// server's closed, returning ErrFluentServerClosed
+func (s *FluentServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrFluentServerClosed
+	}
+	s.lns[ln] = struct{}{}
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return ErrFluentServerClosed
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close closes the listeners and connections, canceling appends in
+// flight, and waits for them to end
+func (s *FluentServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	var errs []error
+	for ln := range s.lns {
+		errs = append(errs, ln.Close())
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (s *FluentServer) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	ctx, err := s.authenticate(s.ctx, conn)
+	if err != nil {
+		return
+	}
+	d := newMsgpackDecoder(conn, fluentMaxMessage)
+	for {
+		msg, err := d.decode()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && s.ctx.Err() == nil {
+				s.srv.logger(ctx).Info("fluent connection closed", zap.Error(err))
+			}
+			return
+		}
+		chunk, err := s.handle(ctx, msg)
+		if err != nil {
+			s.srv.logger(ctx).Info("fluent message failed", zap.Error(err))
+			return
+		}
+		if chunk == "" {
+			continue
+		}
+		if _, err := conn.Write(appendMsgpack(nil, map[string]any{"ack": chunk})); err != nil {
+			return
+		}
+	}
+}
+
+// Resolves the connection's principal from its client certificate,
+// auditing failures
+func (s *FluentServer) authenticate(ctx context.Context, conn net.Conn) (context.Context, error) {
+	logger := s.srv.Logger.With(zap.String("remote_addr", conn.RemoteAddr().String()))
+	if s.srv.Authenticator == nil {
+		return withLogger(ctx, logger), nil
+	}
+	creds := auth.Credentials{RemoteAddr: conn.RemoteAddr().String()}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.HandshakeContext(ctx); err != nil {
+			logger.Info("fluent tls handshake failed", zap.Error(err))
+			return ctx, err
+		}
+		state := tc.ConnectionState()
+		creds.TLS = &state
+	}
+	principal, err := s.srv.Authenticator.Authenticate(ctx, creds)
+	if err != nil {
+		logger.Info("authentication failed", zap.Error(err))
+		s.srv.Audit.Record(AuditEvent{
+			Principal: creds.RemoteAddr,
+			Action:    AuditAuthenticate,
+			Resource:  "fluent",
+			Result:    AuditFailure,
+		})
+		return ctx, auth.ErrUnauthenticated
+	}
+	ctx = auth.WithPrincipal(ctx, principal)
+	return withLogger(ctx, logger.With(zap.String("principal", principal))), nil
+}
+
+// Appends a message's events, returning the chunk to ack if it asks for
+// one
+func (s *FluentServer) handle(ctx context.Context, msg any) (chunk string, err error) {
+	arr, ok := msg.([]any)
+	if !ok || len(arr) < 2 {
+		return "", errors.New("malformed forward message")
+	}
+	tag, ok := arr[0].(string)
+	if !ok {
+		return "", errors.New("malformed forward message tag")
+	}
+	var option map[string]any
+	var events []*api.Record
+	switch entries := arr[1].(type) {
+	case []any:
+		// forward mode: [tag, [[time, record], ...], option]
+		if len(arr) > 2 {
+			option, _ = arr[2].(map[string]any)
+		}
+		for _, entry := range entries {
+			record, err := fluentEvent(tag, entry)
+			if err != nil {
+				return "", err
+			}
+			events = append(events, record)
+		}
+	case string, []byte:
+		// packed forward mode: [tag, entries, option], the entries a
+		// stream of [time, record], gzipped with the option's compressed
+		if len(arr) > 2 {
+			option, _ = arr[2].(map[string]any)
+		}
+		if events, err = fluentPackedEvents(tag, entries, option["compressed"]); err != nil {
+			return "", err
+		}
+	default:
+		// message mode: [tag, time, record, option]
+		if len(arr) < 3 {
+			return "", errors.New("malformed forward message")
+		}
+		if len(arr) > 3 {
+			option, _ = arr[3].(map[string]any)
+		}
+		record, err := fluentEvent(tag, arr[1:3])
+		if err != nil {
+			return "", err
+		}
+		events = append(events, record)
+	}
+	chunk, _ = option["chunk"].(string)
+	fluentEvents.Add(float64(len(events)))
+	if err := s.append(ctx, tag, events); err != nil {
+		fluentEventsDropped.Add(float64(len(events)))
+		if chunk != "" {
+			return "", fmt.Errorf("appending chunk %s: %w", chunk, err)
+		}
+		s.srv.logger(ctx).Error("appending fluent events",
+			zap.String("tag", tag),
+			zap.Int("events", len(events)),
+			zap.Error(err),
+		)
+	}
+	return chunk, nil
+}
+
+// Appends the events to the topic the tag maps to, in the partition the
+// tag hashes to
+func (s *FluentServer) append(ctx context.Context, tag string, events []*api.Record) error {
+	if len(events) == 0 {
+		return nil
+	}
+	topic := s.topic(tag)
+	partitions := uint32(1)
+	if desc, err := s.srv.describeTopic(topic); err == nil {
+		partitions = desc.Partitions
+	}
+	_, err := s.srv.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records:   events,
+		Topic:     topic,
+		Partition: partitionForKey([]byte(tag), partitions),
+	})
+	return err
+}
+
+// The topic of the tag's longest pattern, see NewFluentServer
+func (s *FluentServer) topic(tag string) string {
+	if topic, ok := s.tagTopics[tag]; ok {
+		return topic
+	}
+	for prefix := tag; ; {
+		i := strings.LastIndexByte(prefix, '.')
+		if i < 0 {
+			break
+		}
+		prefix = prefix[:i]
+		if topic, ok := s.tagTopics[prefix+".*"]; ok {
+			return topic
+		}
+	}
+	if topic, ok := s.tagTopics["*"]; ok {
+		return topic
+	}
+	return tag
+}
+
+// Decodes a packed stream of [time, record] entries
+func fluentPackedEvents(tag string, entries, compressed any) ([]*api.Record, error) {
+	var b []byte
+	switch entries := entries.(type) {
+	case string:
+		b = []byte(entries)
+	case []byte:
+		b = entries
+	}
+	var r io.Reader = bytes.NewReader(b)
+	switch compressed {
+	case nil, "text":
+	case "gzip":
+		// a chunk can be several gzip members back to back, which the
+		// reader reads on through
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("decompressing forward entries: %w", err)
+		}
+		r = io.LimitReader(zr, fluentMaxMessage+1)
+	default:
+		return nil, fmt.Errorf("unsupported forward compression %v", compressed)
+	}
+	d := newMsgpackDecoder(r, fluentMaxMessage)
+	var events []*api.Record
+	for {
+		entry, err := d.decode()
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decoding forward entries: %w", err)
+		}
+		record, err := fluentEvent(tag, entry)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, record)
+	}
+}
+
+// Converts a [time, record] entry to a record. Events without a time are
+// stamped on append.
+func fluentEvent(tag string, entry any) (*api.Record, error) {
+	e, ok := entry.([]any)
+	if !ok || len(e) < 2 {
+		return nil, errors.New("malformed forward entry")
+	}
+	fields, ok := e[1].(map[string]any)
+	if !ok {
+		return nil, errors.New("malformed forward record")
+	}
+	value, err := json.Marshal(fluentJSON(fields))
+	if err != nil {
+		return nil, err
+	}
+	record := &api.Record{
+		Key:     []byte(tag),
+		Value:   value,
+		Headers: []*api.Header{{Key: "tag", Value: []byte(tag)}},
+	}
+	switch t := e[0].(type) {
+	case fluentEventTime:
+		record.Timestamp = time.Time(t).UnixNano()
+	case int64:
+		record.Timestamp = (time.Duration(t) * time.Second).Nanoseconds()
+	case uint64:
+		record.Timestamp = (time.Duration(t) * time.Second).Nanoseconds()
+	case float64:
+		record.Timestamp = int64(t * float64(time.Second))
+	}
+	if record.Timestamp < 0 {
+		record.Timestamp = 0
+	}
+	return record, nil
+}
+
+// Converts decoded values to ones that marshal to JSON as they read:
+// binary strings, as Fluent Bit sends its fields, to strings when they're
+// UTF-8 and times to RFC 3339
+func fluentJSON(v any) any {
+	switch v := v.(type) {
+	case []byte:
+		if utf8.Valid(v) {
+			return string(v)
+		}
+	case fluentEventTime:
+		return time.Time(v).UTC().Format(time.RFC3339Nano)
+	case []any:
+		for i, e := range v {
+			v[i] = fluentJSON(e)
+		}
+	case map[string]any:
+		for k, e := range v {
+			v[k] = fluentJSON(e)
+		}
+	case float64:
+		// JSON has no NaN or infinities
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil
+		}
+	}
+	return v
+}
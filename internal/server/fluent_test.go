@@ -0,0 +1,157 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMsgpack(t *testing.T) {
+	at := fluentEventTime(time.Unix(1700000000, 123456789))
+	for _, v := range []any{
+		nil, true, false, int64(-1), int64(-1 << 40), int64(7), uint64(1 << 40), 1.5,
+		"", "tag", string(make([]byte, 300)), string(make([]byte, 70000)), []byte{0, 1}, []any{"a", int64(1)}, map[string]any{"log": "line", "n": []any{}}, at,
+	} {
+		d := newMsgpackDecoder(bytes.NewReader(appendMsgpack(nil, v)), 1<<20)
+		got, err := d.decode()
+		require.NoError(t, err)
+		if want, ok := v.(fluentEventTime); ok {
+			require.True(t, time.Time(want).Equal(time.Time(got.(fluentEventTime))))
+			continue
+		}
+		require.Equal(t, v, got)
+	}
+
+	// the compact encodings senders use
+	d := newMsgpackDecoder(bytes.NewReader([]byte{
+		0x93, 0x05, 0xff, 0xd0, 0x80, // [5, -1, -128]
+		0x81, 0xa1, 'k', 0xcc, 0xc8, // {"k": 200}
+	}), 1<<10)
+	got, err := d.decode()
+	require.NoError(t, err)
+	require.Equal(t, []any{int64(5), int64(-1), int64(-128)}, got)
+	got, err = d.decode()
+	require.NoError(t, err)
+	require.Equal(t, map[string]any{"k": uint64(200)}, got)
+	_, err = d.decode()
+	require.ErrorIs(t, err, io.EOF)
+
+	// lengths past the limit are refused before they're allocated
+	_, err = newMsgpackDecoder(bytes.NewReader([]byte{0xdd, 0xff, 0xff, 0xff, 0xff}), 1<<10).decode()
+	require.ErrorIs(t, err, errMsgpackMalformed)
+	_, err = newMsgpackDecoder(bytes.NewReader([]byte{0xc6, 0, 0, 0x10, 0}), 1<<10).decode()
+	require.ErrorIs(t, err, errMsgpackMalformed)
+}
+
+func TestFluentTopic(t *testing.T) {
+	s := NewFluentServer(map[string]string{
+		"app":       "apps",
+		"app.*":     "app-events",
+		"app.web.*": "web",
+	}, &Config{})
+	for tag, topic := range map[string]string{
+		"app":            "apps",
+		"app.db":         "app-events",
+		"app.web.access": "web",
+		"app.web":        "app-events",
+		"nginx.access":   "nginx.access",
+	} {
+		require.Equal(t, topic, s.topic(tag), tag)
+	}
+	s.tagTopics["*"] = "other"
+	require.Equal(t, "other", s.topic("nginx.access"))
+}
+
+func setupFluent(t *testing.T, principal string) (net.Conn, *Config) {
+	t.Helper()
+	_, config, teardown := setupTest(t, func(c *Config) {
+		c.Authenticator = auth.AuthenticatorFunc(func(ctx context.Context, creds auth.Credentials) (string, error) {
+			return principal, nil
+		})
+	})
+	t.Cleanup(teardown)
+	require.NoError(t, config.CommitLog.(topicLog).CreateTopic(&api.Topic{Name: "events", Partitions: 2}))
+	srv := NewFluentServer(map[string]string{"app.*": "events"}, config)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn, config
+}
+
+func TestFluentServer(t *testing.T) {
+	conn, config := setupFluent(t, "root")
+	at := time.Unix(1700000000, 500)
+	entry := func(log string) []any {
+		return []any{fluentEventTime(at), map[string]any{"log": []byte(log)}}
+	}
+	var packed []byte
+	packed = appendMsgpack(packed, entry("packed 1"))
+	packed = appendMsgpack(packed, entry("packed 2"))
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	_, err := zw.Write(appendMsgpack(nil, entry("gzipped")))
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	ack := newMsgpackDecoder(conn, 1<<10)
+	for chunk, msg := range map[string][]any{
+		// message, forward, packed forward and compressed packed forward
+		"c1": {"app.web", uint64(at.Unix()), map[string]any{"log": "message"}, map[string]any{"chunk": "c1"}},
+		"c2": {"app.web", []any{entry("forward")}, map[string]any{"chunk": "c2"}},
+		"c3": {"app.web", packed, map[string]any{"chunk": "c3"}},
+		"c4": {"app.web", gzipped.Bytes(), map[string]any{"chunk": "c4", "compressed": "gzip"}},
+	} {
+		_, err := conn.Write(appendMsgpack(nil, msg))
+		require.NoError(t, err)
+		got, err := ack.decode()
+		require.NoError(t, err)
+		require.Equal(t, map[string]any{"ack": chunk}, got)
+	}
+
+	// the tag keys every event to one partition
+	cl, err := config.partition("events", partitionForKey([]byte("app.web"), 2))
+	require.NoError(t, err)
+	var logs []string
+	for off := uint64(0); off < 5; off++ {
+		record, err := cl.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, "app.web", string(record.Key))
+		require.Len(t, record.Headers, 1)
+		require.Equal(t, "tag", record.Headers[0].Key)
+		require.Equal(t, []byte("app.web"), record.Headers[0].Value)
+		var fields map[string]string
+		require.NoError(t, json.Unmarshal(record.Value, &fields))
+		logs = append(logs, fields["log"])
+		if fields["log"] == "message" {
+			require.Equal(t, time.Unix(at.Unix(), 0).UnixNano(), record.Timestamp)
+		} else {
+			require.Equal(t, at.UnixNano(), record.Timestamp)
+		}
+	}
+	require.ElementsMatch(t, []string{"message", "forward", "packed 1", "packed 2", "gzipped"}, logs)
+}
+
+func TestFluentServerUnauthorized(t *testing.T) {
+	conn, _ := setupFluent(t, "nobody")
+	_, err := conn.Write(appendMsgpack(nil, []any{
+		"app.web", uint64(1), map[string]any{"log": "denied"}, map[string]any{"chunk": "c1"},
+	}))
+	require.NoError(t, err)
+	// the chunk isn't acked, its connection's closed for the sender to retry
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = newMsgpackDecoder(conn, 1<<10).decode()
+	require.ErrorIs(t, err, io.EOF)
+}
@@ -0,0 +1,405 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Set on forwarded produce requests, so a server that turns out not to be
+// the leader either answers api.ErrNotLeader rather than forwarding again
+const forwardedHeader = "Proglog-Forwarded"
+
+// Headers carrying the caller's credentials, passed on to the leader
+var forwardedCredentials = []string{"Authorization", auth.APIKeyHeader}
+
+// Appends the record to the topic's partition at the ack level, forwarding it to
+// the partition's leader when the commit log reports this server isn't
+// the leader, unless it's in a transaction. header holds the caller's
+// request headers.
+func (c *Config) append(ctx context.Context, record *api.Record, ack api.Ack, topic string, partition uint32, header http.Header) (
+	off uint64, pending bool, err error,
+) {
+	cl, err := c.producePartition(topic, partition)
+	if err == nil {
+		off, pending, err = c.appendTo(ctx, cl, record, ack, topic, partition)
+	}
+	var notLeader api.ErrNotLeader
+	if !errors.As(err, &notLeader) || notLeader.Leader == "" || c.DisableForwarding ||
+		header.Get(forwardedHeader) != "" || transactionFrom(ctx) != 0 {
+		return off, pending, err
+	}
+	ctx, span := tracer.Start(ctx, "Log.Forward")
+	res, err := c.forwarder.produce(ctx, notLeader.Leader, &api.ProduceRequest{Record: record, Ack: ack, Topic: topic, Partition: partition}, header)
+	endSpan(span, err,
+		attribute.String("proglog.leader", notLeader.Leader),
+		attribute.Int64("proglog.offset", int64(res.GetOffset())),
+	)
+	if err != nil {
+		return 0, false, err
+	}
+	producesForwarded.Inc()
+	if res.Dropped {
+		return droppedOffset, false, nil
+	}
+	return res.Offset, res.Pending, nil
+}
+
+// Appends the record to the partition the topic's settings check and
+// compress it for, at their ack level when the request leaves it, its value
+// run through the topic's transform and validated against the topic's
+// schema when the topic asks. It fails with api.ErrDiskFull while the disk
+// quota rejects produces, or the topic's tenant's. A record the transform
+// drops, or a copy of one in the topic's dedup window, is answered with
+// droppedOffset.
+func (c *Config) appendTo(ctx context.Context, cl CommitLog, record *api.Record, ack api.Ack, topic string, partition uint32) (
+	off uint64, pending bool, err error,
+) {
+	produced := record
+	record, tc, err := c.prepare(ctx, record, topic, partition)
+	if err != nil {
+		return 0, false, err
+	}
+	if record == nil {
+		return droppedOffset, false, nil
+	}
+	defer func() {
+		if err == nil {
+			c.remember(tc, topic, produced)
+		}
+	}()
+	ack = tc.AckLevel(ack)
+	class := producePriority(ctx)
+	start := time.Now()
+	_, span := tracer.Start(ctx, "Log.Append")
+	if l, ok := cl.(batchLog); ok && c.AppendBatchWindow > 0 {
+		// the batch's leader takes a slot for every produce in it, which
+		// appends the batch however its own produce is canceled
+		slot := func() (release func()) {
+			release, _ = c.Scheduler.acquire(context.WithoutCancel(ctx), class)
+			return release
+		}
+		off, pending, err = c.appends.append(cl, l, record, ack, c.AppendBatchWindow, c.AppendBatchMaxRecords, slot)
+	} else {
+		var release func()
+		if release, err = c.Scheduler.acquire(ctx, class); err != nil {
+			endSpan(span, err)
+			return 0, false, err
+		}
+		if l, ok := cl.(ackLog); ok {
+			off, pending, err = l.AppendAck(record, ack)
+		} else {
+			off, err = cl.Append(record)
+		}
+		release()
+	}
+	endSpan(span, err,
+		attribute.Int64("proglog.offset", int64(off)),
+		attribute.String("proglog.ack", ack.String()),
+		attribute.Int64("proglog.partition", int64(partition)),
+	)
+	if err == nil {
+		c.throughput.produced(cl, 1, recordsSize([]*api.Record{record}), time.Since(start))
+	}
+	return off, pending, err
+}
+
+// Checks the record for the topic's partition, and prepares it, as appendTo
+// does before appending it. The record is nil if the transform or an
+// interceptor dropped it, or it copies one in the topic's dedup window.
+func (c *Config) prepare(ctx context.Context, record *api.Record, topic string, partition uint32) (*api.Record, log.TopicConfig, error) {
+	if err := c.disk.check(); err != nil {
+		return nil, log.TopicConfig{}, err
+	}
+	if err := c.checkTenant(topic); err != nil {
+		return nil, log.TopicConfig{}, err
+	}
+	tc, err := c.topicConfig(topic)
+	if err != nil {
+		return nil, tc, err
+	}
+	if c.duplicates(tc, topic, []*api.Record{record})[0] {
+		return nil, tc, nil
+	}
+	if record, err = c.transform(ctx, tc, topic, record); err != nil || record == nil {
+		return nil, tc, err
+	}
+	if record, err = c.intercept(ctx, tc, topic, partition, record); err != nil || record == nil {
+		return nil, tc, err
+	}
+	if record, err = tc.Prepare(record); err != nil {
+		return nil, tc, err
+	}
+	return c.stampTraceContext(ctx, stampTransaction(ctx, record)), tc, nil
+}
+
+// Appends the record to the topic's partition as appendTo does at
+// api.Ack_ACK_ALL, but returns once the leader's written it and calls
+// durable once the leader's synced it, see log.Log.AppendDurable. It's
+// never forwarded, and commit logs that can't tell when appends are synced
+// fail with Unimplemented. A record the transform drops, or a copy, is
+// answered with droppedOffset, and durable isn't called.
+func (c *Config) appendDurable(ctx context.Context, record *api.Record, topic string, partition uint32, durable func(error)) (uint64, error) {
+	cl, err := c.producePartition(topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	l, ok := cl.(durabilityLog)
+	if !ok {
+		return 0, status.Error(codes.Unimplemented, "log doesn't notify when appends are durable")
+	}
+	produced := record
+	record, tc, err := c.prepare(ctx, record, topic, partition)
+	if err != nil {
+		return 0, err
+	}
+	if record == nil {
+		return droppedOffset, nil
+	}
+	start := time.Now()
+	release, err := c.Scheduler.acquire(ctx, producePriority(ctx))
+	if err != nil {
+		return 0, err
+	}
+	_, span := tracer.Start(ctx, "Log.AppendDurable")
+	off, err := l.AppendDurable(record, durable)
+	release()
+	if err == nil {
+		c.remember(tc, topic, produced)
+		c.throughput.produced(cl, 1, recordsSize([]*api.Record{record}), time.Since(start))
+	}
+	endSpan(span, err,
+		attribute.Int64("proglog.offset", int64(off)),
+		attribute.Int64("proglog.partition", int64(partition)),
+	)
+	return off, err
+}
+
+// Appends the records to the partition in order as append does, one at a
+// time on commit logs that don't take batches
+func (c *Config) appendBatch(ctx context.Context, records []*api.Record, ack api.Ack, topic string, partition uint32, header http.Header) (
+	offs []uint64, pending bool, err error,
+) {
+	cl, err := c.producePartition(topic, partition)
+	if err == nil {
+		offs, pending, err = c.appendBatchTo(ctx, cl, records, ack, topic, partition)
+	}
+	var notLeader api.ErrNotLeader
+	if !errors.As(err, &notLeader) || notLeader.Leader == "" || c.DisableForwarding ||
+		header.Get(forwardedHeader) != "" || transactionFrom(ctx) != 0 {
+		return offs, pending, err
+	}
+	ctx, span := tracer.Start(ctx, "Log.Forward")
+	res, err := c.forwarder.produceBatch(ctx, notLeader.Leader, &api.ProduceBatchRequest{
+		Records: records, Ack: ack, Topic: topic, Partition: partition,
+	}, header)
+	endSpan(span, err,
+		attribute.String("proglog.leader", notLeader.Leader),
+		attribute.Int("proglog.records", len(records)),
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	producesForwarded.Inc()
+	return batchOffsets(res), res.Pending, nil
+}
+
+// Appends the records to the partition as appendTo does, those the
+// transform drops, and copies, answered with droppedOffset
+func (c *Config) appendBatchTo(ctx context.Context, cl CommitLog, records []*api.Record, ack api.Ack, topic string, partition uint32) (
+	offs []uint64, pending bool, err error,
+) {
+	if err := c.disk.check(); err != nil {
+		return nil, false, err
+	}
+	if err := c.checkTenant(topic); err != nil {
+		return nil, false, err
+	}
+	tc, err := c.topicConfig(topic)
+	if err != nil {
+		return nil, false, err
+	}
+	dups := c.duplicates(tc, topic, records)
+	// unique are the records that aren't copies, added to the dedup window
+	// once they're appended
+	unique := make([]*api.Record, 0, len(records))
+	for i, record := range records {
+		if !dups[i] {
+			unique = append(unique, record)
+		}
+	}
+	defer func() {
+		if err == nil {
+			c.remember(tc, topic, unique...)
+		}
+	}()
+	// kept are the indexes of the records the transform and interceptors
+	// kept
+	kept := make([]int, 0, len(records))
+	transformed := make([]*api.Record, 0, len(records))
+	for i, record := range records {
+		if dups[i] {
+			continue
+		}
+		if record, err = c.transform(ctx, tc, topic, record); err != nil {
+			return nil, false, err
+		}
+		if record != nil {
+			if record, err = c.intercept(ctx, tc, topic, partition, record); err != nil {
+				var violation api.ErrSchemaViolation
+				if errors.As(err, &violation) && len(records) > 1 {
+					violation.Reason = fmt.Sprintf("record %d: %s", i, violation.Reason)
+					err = violation
+				}
+				return nil, false, err
+			}
+		}
+		if record != nil {
+			kept, transformed = append(kept, i), append(transformed, record)
+		}
+	}
+	if n := len(records); len(kept) < n {
+		defer func() {
+			if err == nil {
+				offs = withDropped(offs, kept, n)
+			}
+		}()
+		if len(kept) == 0 {
+			return nil, false, nil
+		}
+	}
+	prepared := make([]*api.Record, len(transformed))
+	for i, record := range transformed {
+		if prepared[i], err = tc.Prepare(record); err != nil {
+			return nil, false, err
+		}
+		prepared[i] = c.stampTraceContext(ctx, stampTransaction(ctx, prepared[i]))
+	}
+	records, ack = prepared, tc.AckLevel(ack)
+	start := time.Now()
+	release, err := c.Scheduler.acquire(ctx, producePriority(ctx))
+	if err != nil {
+		return nil, false, err
+	}
+	defer release()
+	_, span := tracer.Start(ctx, "Log.AppendBatch")
+	if l, ok := cl.(batchLog); ok {
+		offs, pending, err = l.AppendBatch(records, ack)
+	} else {
+		for _, record := range records {
+			var off uint64
+			if off, err = cl.Append(record); err != nil {
+				break
+			}
+			offs = append(offs, off)
+		}
+	}
+	endSpan(span, err,
+		attribute.Int("proglog.records", len(records)),
+		attribute.String("proglog.ack", ack.String()),
+		attribute.Int64("proglog.partition", int64(partition)),
+	)
+	if err == nil {
+		c.throughput.produced(cl, len(records), recordsSize(records), time.Since(start))
+	}
+	return offs, pending, err
+}
+
+// The partition a produce appends to. With AutoCreateTopics set, a topic
+// there's none of yet is created first, with one partition and the
+// servers' settings.
+func (c *Config) producePartition(topic string, p uint32) (CommitLog, error) {
+	cl, err := c.partition(topic, p)
+	tl, ok := c.CommitLog.(topicLog)
+	if !c.AutoCreateTopics || !ok || !errors.As(err, &api.ErrTopicNotFound{}) || log.ValidateTopic(topic) != nil {
+		return cl, err
+	}
+	err = tl.CreateTopic(&api.Topic{Name: topic, Partitions: 1})
+	if err != nil && !errors.As(err, &api.ErrTopicExists{}) {
+		return nil, err
+	}
+	if err == nil {
+		c.Logger.Info("created topic on produce", zap.String("topic", topic))
+		topicsAutoCreated.Inc()
+	}
+	return c.partition(topic, p)
+}
+
+// forwarder proxies produce requests and group offset commits to the leader, keeping one connection per leader address
+type forwarder struct {
+	mu    sync.Mutex
+	opts  []grpc.DialOption
+	conns map[string]*grpc.ClientConn
+}
+
+func newForwarder(opts []grpc.DialOption) *forwarder {
+	if len(opts) == 0 {
+		opts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	opts = append(opts, grpc.WithStatsHandler(otelgrpc.NewClientHandler()))
+	return &forwarder{opts: opts, conns: make(map[string]*grpc.ClientConn)}
+}
+
+func (f *forwarder) produce(ctx context.Context, leader string, req *api.ProduceRequest, header http.Header) (*api.ProduceResponse, error) {
+	conn, err := f.conn(leader)
+	if err != nil {
+		return nil, err
+	}
+	return api.NewLogClient(conn).Produce(f.outgoing(ctx, header), req)
+}
+
+// Marks the call forwarded and passes on the caller's credentials
+func (f *forwarder) outgoing(ctx context.Context, header http.Header) context.Context {
+	md := metadata.Pairs(forwardedHeader, "true")
+	for _, k := range forwardedCredentials {
+		if v := header.Values(k); len(v) > 0 {
+			md.Append(k, v...)
+		}
+	}
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+func (f *forwarder) produceBatch(ctx context.Context, leader string, req *api.ProduceBatchRequest, header http.Header) (*api.ProduceBatchResponse, error) {
+	conn, err := f.conn(leader)
+	if err != nil {
+		return nil, err
+	}
+	return api.NewLogClient(conn).ProduceBatch(f.outgoing(ctx, header), req)
+}
+
+func (f *forwarder) commitGroupOffsets(ctx context.Context, leader string, req *api.CommitGroupOffsetsRequest, header http.Header) (*api.CommitGroupOffsetsResponse, error) {
+	conn, err := f.conn(leader)
+	if err != nil {
+		return nil, err
+	}
+	return api.NewLogClient(conn).CommitGroupOffsets(f.outgoing(ctx, header), req)
+}
+
+func (f *forwarder) conn(addr string) (*grpc.ClientConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if conn, ok := f.conns[addr]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.NewClient(addr, f.opts...)
+	if err != nil {
+		return nil, err
+	}
+	f.conns[addr] = conn
+	return conn, nil
+}
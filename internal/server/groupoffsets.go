@@ -0,0 +1,232 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// The offsets topic's configs, whatever the servers' settings: compacted
+// to each group's latest offsets and never expired
+var offsetsTopicConfigs = map[string]string{
+	log.CleanupPolicyConfig:   "compact",
+	log.RetentionMsConfig:     "0",
+	log.RetentionBytesConfig:  "0",
+	log.MaxRecordBytesConfig:  "0",
+	log.CompressionTypeConfig: "none",
+}
+
+// A group's offset in a topic partition, by the group's and topic's names
+type groupPartition struct {
+	group     string
+	topic     string
+	partition uint32
+}
+
+// groupOffsets are the offsets consumer groups committed, read from the
+// offsets topic's partition as far as this server has it. Each record
+// holds a log.OffsetsTopic commit of one offset, keyed by its group and
+// topic partition so compaction keeps the latest.
+type groupOffsets struct {
+	mu sync.Mutex
+	// the partition the offsets were read from, they're read again if the
+	// topic's recreated
+	partition CommitLog
+	next      uint64
+	offsets   map[groupPartition]uint64
+}
+
+// Reads the offsets committed to cl since the last read
+func (g *groupOffsets) catchUp(cl CommitLog) error {
+	if cl != g.partition {
+		g.partition, g.next, g.offsets = cl, 0, make(map[groupPartition]uint64)
+		if sl, ok := cl.(statsLog); ok {
+			g.next = sl.Stats().LowWatermark
+		}
+	}
+	if cl == nil {
+		return nil
+	}
+	for {
+		record, next, err := readFrom(cl, g.next)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		g.next = next
+		// records produced to the topic that aren't commits are skipped
+		var commit api.CommitGroupOffsetsRequest
+		if codec.Decompress(record) == nil && proto.Unmarshal(record.Value, &commit) == nil {
+			for _, o := range commit.Offsets {
+				g.offsets[groupPartition{commit.Group, o.Topic, o.Partition}] = o.Offset
+			}
+		}
+	}
+}
+
+// Appends the group's offsets to the offsets topic, creating the topic on
+// the first commit, and forwards them to the topic's leader as append
+// forwards produces
+func (c *Config) commitGroupOffsets(ctx context.Context, req *api.CommitGroupOffsetsRequest, header http.Header) error {
+	records := make([]*api.Record, len(req.Offsets))
+	for i, o := range req.Offsets {
+		o := &api.GroupOffset{Topic: topicResource(o.Topic), Partition: o.Partition, Offset: o.Offset}
+		value, err := proto.Marshal(&api.CommitGroupOffsetsRequest{Group: req.Group, Offsets: []*api.GroupOffset{o}})
+		if err != nil {
+			return err
+		}
+		key := req.Group + "\x00" + o.Topic + "\x00" + strconv.FormatUint(uint64(o.Partition), 10)
+		records[i] = &api.Record{Key: []byte(key), Value: value}
+	}
+	cl, err := c.offsetsPartition(true)
+	if err == nil {
+		_, _, err = c.appendBatchTo(ctx, cl, records, api.Ack_ACK_ALL, log.OffsetsTopic, 0)
+	}
+	var notLeader api.ErrNotLeader
+	if !errors.As(err, &notLeader) || notLeader.Leader == "" ||
+		c.DisableForwarding || header.Get(forwardedHeader) != "" {
+		return err
+	}
+	ctx, span := tracer.Start(ctx, "Log.Forward")
+	_, err = c.forwarder.commitGroupOffsets(ctx, notLeader.Leader, req, header)
+	endSpan(span, err)
+	return err
+}
+
+// The group's offsets in the partitions, as far as this server has read
+// them. A follower answers with the commits it has replicated.
+func (c *Config) fetchGroupOffsets(req *api.FetchGroupOffsetsRequest) ([]*api.GroupOffset, error) {
+	cl, err := c.offsetsPartition(false)
+	if errors.As(err, &api.ErrTopicNotFound{}) {
+		// nothing's been committed
+		cl, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.groups.mu.Lock()
+	if err := c.groups.catchUp(cl); err != nil {
+		c.groups.mu.Unlock()
+		return nil, err
+	}
+	offsets := make([]*api.GroupOffset, len(req.Partitions))
+	for i, p := range req.Partitions {
+		off, found := c.groups.offsets[groupPartition{req.Group, topicResource(p.Topic), p.Partition}]
+		offsets[i] = &api.GroupOffset{Topic: p.Topic, Partition: p.Partition, Offset: off, Found: found}
+	}
+	c.groups.mu.Unlock()
+	if req.OffsetReset == api.OffsetReset_OFFSET_RESET_NONE {
+		return offsets, nil
+	}
+	for _, o := range offsets {
+		if err := c.resetGroupOffset(o, req.OffsetReset, req.ResetTimestamp); err != nil {
+			return nil, err
+		}
+	}
+	return offsets, nil
+}
+
+// Applies the reset policy to the fetched offset, as the client's
+// consumers do, against the partition as far as this server has it. See
+// log.ResetOffset.
+func (c *Config) resetGroupOffset(o *api.GroupOffset, policy api.OffsetReset, timestamp int64) error {
+	cl, err := c.partition(o.Topic, o.Partition)
+	if err != nil {
+		return err
+	}
+	sl, ok := cl.(statsLog)
+	if !ok {
+		return status.Error(codes.Unimplemented, "log doesn't report its offsets")
+	}
+	st := sl.Stats()
+	o.Offset, o.WasReset, err = log.ResetOffset(policy, topicResource(o.Topic), o.Partition, o.Offset, o.Found, st, func() (uint64, error) {
+		return c.offsetForTime(o.Topic, cl, st, timestamp)
+	})
+	return err
+}
+
+// How far the group's committed offsets, every group's for an empty one,
+// are behind their partitions' high watermarks, in group, topic and
+// partition order. Partitions since deleted, and those of logs that don't
+// report their offsets, are left out.
+func (c *Config) groupLag(group string) ([]*api.GroupLag, error) {
+	cl, err := c.offsetsPartition(false)
+	if errors.As(err, &api.ErrTopicNotFound{}) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.groups.mu.Lock()
+	if err := c.groups.catchUp(cl); err != nil {
+		c.groups.mu.Unlock()
+		return nil, err
+	}
+	var lags []*api.GroupLag
+	for gp, off := range c.groups.offsets {
+		if group == "" || gp.group == group {
+			lags = append(lags, &api.GroupLag{Group: gp.group, Topic: gp.topic, Partition: gp.partition, Committed: off})
+		}
+	}
+	c.groups.mu.Unlock()
+	slices.SortFunc(lags, func(a, b *api.GroupLag) int {
+		return cmp.Or(
+			cmp.Compare(a.Group, b.Group),
+			cmp.Compare(a.Topic, b.Topic),
+			cmp.Compare(a.Partition, b.Partition),
+		)
+	})
+	reported := lags[:0]
+	for _, lag := range lags {
+		part, err := c.partition(lag.Topic, lag.Partition)
+		if errors.As(err, &api.ErrTopicNotFound{}) || errors.As(err, &api.ErrPartitionNotFound{}) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		sl, ok := part.(statsLog)
+		if !ok {
+			continue
+		}
+		lag.HighWatermark = sl.Stats().HighWatermark
+		lag.Lag = lag.HighWatermark - min(lag.Committed, lag.HighWatermark)
+		reported = append(reported, lag)
+	}
+	return reported, nil
+}
+
+// The offsets topic's partition, created first with create if there's
+// none
+func (c *Config) offsetsPartition(create bool) (CommitLog, error) {
+	tl, ok := c.CommitLog.(topicLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log can't keep group offsets")
+	}
+	cl, err := c.partition(log.OffsetsTopic, 0)
+	if !create || !errors.As(err, &api.ErrTopicNotFound{}) {
+		return cl, err
+	}
+	err = tl.CreateTopic(&api.Topic{Name: log.OffsetsTopic, Partitions: 1, Configs: offsetsTopicConfigs})
+	if err != nil && !errors.As(err, &api.ErrTopicExists{}) {
+		return nil, err
+	}
+	if err == nil {
+		c.Logger.Info("created offsets topic", zap.String("topic", log.OffsetsTopic))
+	}
+	return c.partition(log.OffsetsTopic, 0)
+}
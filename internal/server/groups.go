@@ -0,0 +1,359 @@
+package server
+
+import (
+	"cmp"
+	"crypto/rand"
+	"errors"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"go.uber.org/zap"
+)
+
+// How long a member goes without a heartbeat before it's dropped, when
+// its join doesn't say
+const defaultSessionTimeout = 10 * time.Second
+
+// A topic's partition
+type topicPartition struct {
+	topic     string
+	partition uint32
+}
+
+// groupCoordinator keeps the consumer groups' members and hands each of
+// their topics' partitions to one of them. It runs on the offsets topic's
+// leader, and the groups are kept in memory: a new leader starts without
+// them and members join it again.
+//
+// Rebalances are incremental: partitions stick with their members as far
+// as balance allows, so only those that have to move do, and a partition
+// goes to its next member only once the member consuming it has stopped,
+// reporting it among its owned partitions no more or being dropped, while
+// the rest are consumed throughout. Static members, joining with an
+// instance ID, take their place back when they restart within their
+// session timeout, without a rebalance at all. A new coordinator can't know what members of the last one are
+// still consuming, so it hands out no partitions until one session timeout
+// after it took over.
+type groupCoordinator struct {
+	mu sync.Mutex
+	// term is the offsets partition leader's Raft term, and since when this
+	// server has coordinated the groups
+	term   uint64
+	since  time.Time
+	groups map[string]*consumerGroup
+}
+
+func newGroupCoordinator() *groupCoordinator {
+	return &groupCoordinator{since: time.Now(), groups: make(map[string]*consumerGroup)}
+}
+
+type consumerGroup struct {
+	generation uint64
+	members    map[string]*groupMember
+	// the member each partition's assigned to
+	owners map[topicPartition]string
+}
+
+type groupMember struct {
+	// instance is the static member's instance ID, empty for others
+	instance string
+	topics   []string
+	// owned are the partitions the member reported consuming, and granted
+	// the ones it was last assigned, which it may have started on since
+	owned    map[topicPartition]bool
+	granted  map[topicPartition]bool
+	timeout  time.Duration
+	deadline time.Time
+}
+
+// Joins the member to its group, or heartbeats for one that joined,
+// returning the partitions it consumes
+func (c *Config) joinGroup(req *api.JoinGroupRequest) (*api.JoinGroupResponse, error) {
+	// no member can be consuming from groups before the offsets topic is
+	// created, so there's nothing to wait out
+	_, err := c.partition(log.OffsetsTopic, 0)
+	fresh := errors.As(err, &api.ErrTopicNotFound{})
+	cl, err := c.offsetsPartition(true)
+	if err != nil {
+		return nil, err
+	}
+	g := c.coordinator
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.lead(cl, fresh); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	g.expire(now, c.Logger)
+	group := g.groups[req.Group]
+	id := req.MemberId
+	if id != "" && (group == nil || group.members[id] == nil) {
+		if group != nil && group.instance(req.InstanceId) != "" {
+			return nil, api.ErrFencedInstance{Group: req.Group, Instance: req.InstanceId}
+		}
+		return nil, api.ErrUnknownMember{Group: req.Group, Member: id}
+	}
+	if group == nil {
+		group = &consumerGroup{members: make(map[string]*groupMember)}
+		g.groups[req.Group] = group
+	}
+	if id == "" {
+		id = rand.Text()
+		if prev := group.instance(req.InstanceId); prev != "" {
+			group.replace(prev, id)
+			c.Logger.Info("static member rejoined group",
+				zap.String("group", req.Group),
+				zap.String("instance", req.InstanceId),
+				zap.String("member", id),
+			)
+		} else {
+			group.members[id] = &groupMember{instance: req.InstanceId}
+			c.Logger.Info("member joined group", zap.String("group", req.Group), zap.String("member", id))
+		}
+	}
+	m := group.members[id]
+	m.topics = nil
+	for _, topic := range req.Topics {
+		m.topics = append(m.topics, topicResource(topic))
+	}
+	m.topics = slices.Compact(slices.Sorted(slices.Values(m.topics)))
+	m.owned = make(map[topicPartition]bool, len(req.Owned))
+	for _, p := range req.Owned {
+		m.owned[topicPartition{topicResource(p.Topic), p.Partition}] = true
+	}
+	m.timeout = defaultSessionTimeout
+	if req.SessionTimeoutMs > 0 {
+		m.timeout = time.Duration(req.SessionTimeoutMs) * time.Millisecond
+	}
+	m.deadline = now.Add(m.timeout)
+	if err := c.rebalance(req.Group, group); err != nil {
+		return nil, err
+	}
+
+	res := &api.JoinGroupResponse{MemberId: id, Generation: group.generation}
+	m.granted = make(map[topicPartition]bool)
+	if !g.ready(group, now) {
+		return res, nil
+	}
+	for p, owner := range group.owners {
+		if owner == id && !group.heldByOther(id, p) {
+			m.granted[p] = true
+			res.Assignments = append(res.Assignments, &api.GroupOffset{Topic: p.topic, Partition: p.partition})
+		}
+	}
+	sort.Slice(res.Assignments, func(i, j int) bool {
+		a, b := res.Assignments[i], res.Assignments[j]
+		return a.Topic < b.Topic || a.Topic == b.Topic && a.Partition < b.Partition
+	})
+	return res, nil
+}
+
+// Removes the member from its group, its partitions going to the others
+// on their next heartbeats
+func (c *Config) leaveGroup(req *api.LeaveGroupRequest) error {
+	cl, err := c.offsetsPartition(false)
+	if errors.As(err, &api.ErrTopicNotFound{}) {
+		return api.ErrUnknownMember{Group: req.Group, Member: req.MemberId}
+	}
+	if err != nil {
+		return err
+	}
+	g := c.coordinator
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.lead(cl, false); err != nil {
+		return err
+	}
+	group := g.groups[req.Group]
+	if group == nil || group.members[req.MemberId] == nil {
+		return api.ErrUnknownMember{Group: req.Group, Member: req.MemberId}
+	}
+	delete(group.members, req.MemberId)
+	c.Logger.Info("member left group", zap.String("group", req.Group), zap.String("member", req.MemberId))
+	if len(group.members) == 0 {
+		delete(g.groups, req.Group)
+		return nil
+	}
+	return c.rebalance(req.Group, group)
+}
+
+// Fails with api.ErrNotLeader unless this server leads the offsets
+// partition, and forgets the groups when it's started leading since they
+// were joined
+func (g *groupCoordinator) lead(cl CommitLog, fresh bool) error {
+	if ll, ok := cl.(leaderLog); ok {
+		term, leader := ll.LeaderTerm()
+		if !leader {
+			g.term, g.groups = 0, make(map[string]*consumerGroup)
+			return api.ErrNotLeader{Leader: ll.Leader()}
+		}
+		if term != g.term {
+			g.term, g.since, g.groups = term, time.Now(), make(map[string]*consumerGroup)
+		}
+	}
+	if fresh {
+		g.since = time.Time{}
+	}
+	return nil
+}
+
+// Drops the members whose sessions timed out, and the groups left without
+// any. The groups rebalance on their members' next heartbeats.
+func (g *groupCoordinator) expire(now time.Time, logger *zap.Logger) {
+	for name, group := range g.groups {
+		for id, m := range group.members {
+			if now.After(m.deadline) {
+				delete(group.members, id)
+				logger.Info("member session timed out", zap.String("group", name), zap.String("member", id))
+			}
+		}
+		if len(group.members) == 0 {
+			delete(g.groups, name)
+		}
+	}
+}
+
+// Whether the coordinator has waited out its members' session timeouts
+// since it took over
+func (g *groupCoordinator) ready(group *consumerGroup, now time.Time) bool {
+	for _, m := range group.members {
+		if now.Sub(g.since) < m.timeout {
+			return false
+		}
+	}
+	return true
+}
+
+// Assigns the partitions of the topics the group's members consume, each
+// topic's by stickyAssign. A new generation starts when the assignment
+// changes.
+func (c *Config) rebalance(name string, group *consumerGroup) error {
+	subscribers := make(map[string][]string)
+	for _, id := range slices.Sorted(maps.Keys(group.members)) {
+		for _, topic := range group.members[id].topics {
+			subscribers[topic] = append(subscribers[topic], id)
+		}
+	}
+	owners := make(map[topicPartition]string)
+	for topic, ids := range subscribers {
+		desc, err := c.describeTopic(topic)
+		if errors.As(err, &api.ErrTopicNotFound{}) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		topic = topicResource(topic)
+		current := make(map[uint32]string)
+		for p, owner := range group.owners {
+			if p.topic == topic {
+				current[p.partition] = owner
+			}
+		}
+		for p, id := range stickyAssign(desc.Partitions, ids, current) {
+			owners[topicPartition{topic, p}] = id
+		}
+	}
+	if !maps.Equal(owners, group.owners) {
+		group.owners = owners
+		group.generation++
+		groupRebalances.Inc()
+		c.Logger.Info("group rebalanced",
+			zap.String("group", name),
+			zap.Uint64("generation", group.generation),
+			zap.Int("members", len(group.members)),
+		)
+	}
+	return nil
+}
+
+// Whether a member other than id may still be consuming the partition
+func (group *consumerGroup) heldByOther(id string, p topicPartition) bool {
+	for other, m := range group.members {
+		if other != id && (m.owned[p] || m.granted[p]) {
+			return true
+		}
+	}
+	return false
+}
+
+// The ID of the member that joined with the instance ID, empty if none
+// did or the instance ID is
+func (group *consumerGroup) instance(instance string) string {
+	if instance == "" {
+		return ""
+	}
+	for id, m := range group.members {
+		if m.instance == instance {
+			return id
+		}
+	}
+	return ""
+}
+
+// Moves the member and the partitions it's assigned to a new ID, for a
+// static member that restarted
+func (group *consumerGroup) replace(prev, id string) {
+	group.members[id] = group.members[prev]
+	delete(group.members, prev)
+	for p, owner := range group.owners {
+		if owner == prev {
+			group.owners[p] = id
+		}
+	}
+}
+
+// Assigns the topic's n partitions to the members, given in ID order,
+// keeping each with its current owner as far as balance allows. Every
+// member gets n/len(members) partitions and some one more, the members
+// holding the most keeping the extra ones, so the only partitions that
+// move are those over their owner's share and those whose owner's gone.
+func stickyAssign(n uint32, members []string, current map[uint32]string) map[uint32]string {
+	held := make(map[string][]uint32, len(members))
+	for _, id := range members {
+		held[id] = nil
+	}
+	var free []uint32
+	for p := range n {
+		if owner, ok := current[p]; ok {
+			if _, member := held[owner]; member {
+				held[owner] = append(held[owner], p)
+				continue
+			}
+		}
+		free = append(free, p)
+	}
+	base, extra := int(n)/len(members), int(n)%len(members)
+	quotas := make(map[string]int, len(members))
+	byHeld := slices.Clone(members)
+	slices.SortStableFunc(byHeld, func(a, b string) int { return cmp.Compare(len(held[b]), len(held[a])) })
+	for _, id := range byHeld {
+		quotas[id] = base
+		if extra > 0 {
+			quotas[id]++
+			extra--
+		}
+	}
+	assigned := make(map[uint32]string, n)
+	for _, id := range members {
+		keep := min(len(held[id]), quotas[id])
+		for _, p := range held[id][:keep] {
+			assigned[p] = id
+		}
+		free = append(free, held[id][keep:]...)
+		quotas[id] -= keep
+	}
+	slices.Sort(free)
+	for _, id := range members {
+		for ; quotas[id] > 0; quotas[id]-- {
+			assigned[free[0]] = id
+			free = free[1:]
+		}
+	}
+	return assigned
+}
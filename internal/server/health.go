@@ -0,0 +1,26 @@
+package server
+
+import (
+	"net/http"
+)
+
+// Adds unauthenticated liveness and readiness probes in front of next, for
+// orchestrators such as Kubernetes
+func withProbes(config *Config, next http.Handler) http.Handler {
+	r := http.NewServeMux()
+	r.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		// a replica only takes traffic once it's caught up with the cluster
+		if l, ok := config.CommitLog.(readyLog); ok {
+			if err := l.Ready(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Handle("/", next)
+	return r
+}
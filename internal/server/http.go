@@ -1,46 +1,590 @@
 package server
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/frankie-mur/proglog/internal/transform"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	grpccodes "google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
-type httpsServer struct {
-	Log *Log
+var tracer = otel.Tracer("github.com/frankie-mur/proglog/internal/server")
+
+type Config struct {
+	// CommitLog holds the records, defaults to an in-memory log
+	CommitLog CommitLog
+	// Authenticator identifies callers, nil lets every request through as auth.Anonymous
+	Authenticator auth.Authenticator
+	// Authorizer checks what callers may do, nil allows everything
+	Authorizer auth.Authorizer
+	// Logger defaults to a no-op logger
+	Logger *zap.Logger
+	// SlowRequestThreshold logs requests taking at least this long in full, zero disables it
+	SlowRequestThreshold time.Duration
+	// Audit receives security events, defaults to a new in-memory trail;
+	// agents keep theirs under the data directory. Share one Config
+	// between servers to share the trail.
+	Audit *Auditor
+	// DisableForwarding answers produces that reach a follower with
+	// api.ErrNotLeader instead of proxying them to the leader
+	DisableForwarding bool
+	// AutoCreateTopics creates the topic a produce names when there's none,
+	// with one partition and the servers' settings, rather than answering
+	// api.ErrTopicNotFound
+	AutoCreateTopics bool
+	// AppendBatchWindow coalesces the records of concurrent produces to a
+	// partition into batch appends, on commit logs that take batches. While
+	// produces are concurrent a batch waits up to this long for others to
+	// join it. Zero appends each produce's record on its own.
+	AppendBatchWindow time.Duration
+	// AppendBatchMaxRecords caps the records coalesced into a batch, 512
+	// when unset
+	AppendBatchMaxRecords int
+	// MinOffsetTimeout bounds how long a consume waits for its min offset
+	// to replicate, defaults to five seconds
+	MinOffsetTimeout time.Duration
+	// MaxConsumeWait bounds how long a fetch waits for records, whatever
+	// its max_wait_ms, defaults to 30 seconds
+	MaxConsumeWait time.Duration
+	// TransactionTimeout is how long a transaction begun on the server may
+	// stay open before it's aborted, defaults to a minute. READ_COMMITTED
+	// consumes skip the records of one open twice as long, its coordinator
+	// gone.
+	TransactionTimeout time.Duration
+	// TraceRecordHeaders stamps the records of traced produces with the W3C
+	// trace context, in traceparent and tracestate headers, for consumers'
+	// spans to link to the produce's, see client.RecordContext
+	TraceRecordHeaders bool
+	// PeerDialOptions are used to dial the leader when forwarding, plaintext
+	// by default. The leader authenticates the caller's Authorization and API
+	// key headers, or this server's client certificate if it has neither.
+	PeerDialOptions []grpc.DialOption
+	// WebhookClient POSTs subscriptions' records, defaults to a client
+	// timing out after 30 seconds
+	WebhookClient *http.Client
+	// OTLPLogsTopic is the topic the OTLP logs service, over gRPC and on
+	// the HTTP server's /v1/logs, appends exported log records to, unless
+	// their resource names another with a proglog.topic attribute. Empty
+	// disables the service.
+	OTLPLogsTopic string
+	// Quotas throttles the gRPC and HTTP APIs' callers past the rates of
+	// their principals' and tenants' quotas. Nil throttles no one and
+	// answers the admin APIs that quotas aren't configured.
+	Quotas *Quotas
+	// ScanThrottle caps how fast consumers of the gRPC, HTTP and Kafka
+	// APIs read partitions' history, nil not at all
+	ScanThrottle *ScanThrottle
+	// Scheduler bounds the requests of the gRPC, HTTP and Kafka APIs
+	// appending and reading records at once, serving those waiting by
+	// their api.Priority. Nil lets them all through.
+	Scheduler *Scheduler
+	// Transforms holds the WebAssembly modules topics name in their
+	// transform config, which records produced to them go through. Nil
+	// fails produces to topics naming one.
+	Transforms *transform.Transforms
+	// ProduceInterceptors see each record produced, in order, after the
+	// topic's transform and before its schema validation and redaction,
+	// which are interceptors too
+	ProduceInterceptors []ProduceInterceptor
+	// Routes picks the topics of records ingested, by Ingest and POST
+	// /ingest or from syslog and OTLP inputs set to IngestTopic. Nil fails
+	// them.
+	Routes *Routes
+	// Version is the build the server runs, and Settings its effective
+	// settings with secrets redacted, which DescribeServer and the HTTP
+	// server's GET /admin/server answer with. Nil Settings describes none.
+	Version  string
+	Settings func() []*api.ServerSetting
+	// Features are those the process enabled that the server can't tell
+	// itself, e.g. tls and tiered_storage, described with its own
+	Features map[string]bool
+	// Reload re-reads the settings that can change while the server runs,
+	// on a POST to the HTTP server's /admin/reload. Nil answers that it's
+	// not implemented.
+	Reload func(ctx context.Context) error
+	// LinkBackupDir is the directory LinkBackup and the HTTP server's POST
+	// /admin/backup/link back the commit log up into, each backup a
+	// directory in it. It must be on the data directory's filesystem, for
+	// the segments to be hard linked. Empty answers that they're not
+	// configured.
+	LinkBackupDir string
+
+	// disk rejects produces while the data volume is full, see WatchDiskQuota
+	disk          *diskQuota
+	forwarder     *forwarder
+	groups        *groupOffsets
+	coordinator   *groupCoordinator
+	subscriptions *subscriptions
+	schemas       *schemas
+	appends       *appendBatcher
+	transactions  *transactions
+	producers     *producers
+	dedups        *dedups
+	// throughput measures the load each partition serves, see GetThroughput
+	throughput *throughput
 }
 
-func newHTTPServer() *httpsServer {
-	return &httpsServer{
-		Log: NewLog(),
+// Fills in the defaults in place, so servers built from one Config share them
+func withDefaults(config *Config) *Config {
+	if config == nil {
+		config = &Config{}
+	}
+	if config.Logger == nil {
+		config.Logger = zap.NewNop()
+	}
+	if config.CommitLog == nil {
+		config.CommitLog = NewLog()
+	}
+	if config.Audit == nil {
+		config.Audit = NewAuditor()
+	}
+	if config.MinOffsetTimeout == 0 {
+		config.MinOffsetTimeout = 5 * time.Second
+	}
+	if config.MaxConsumeWait == 0 {
+		config.MaxConsumeWait = 30 * time.Second
+	}
+	if config.disk == nil {
+		config.disk = &diskQuota{}
+	}
+	if config.forwarder == nil {
+		config.forwarder = newForwarder(config.PeerDialOptions)
+	}
+	if config.groups == nil {
+		config.groups = &groupOffsets{}
+	}
+	if config.coordinator == nil {
+		config.coordinator = newGroupCoordinator()
+	}
+	if config.subscriptions == nil {
+		config.subscriptions = &subscriptions{}
+	}
+	if config.schemas == nil {
+		config.schemas = &schemas{}
+	}
+	if config.appends == nil {
+		config.appends = &appendBatcher{}
 	}
+	if config.WebhookClient == nil {
+		config.WebhookClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	if config.TransactionTimeout == 0 {
+		config.TransactionTimeout = time.Minute
+	}
+	if config.transactions == nil {
+		config.transactions = &transactions{
+			open:       make(map[string]*transaction),
+			partitions: make(map[CommitLog]*partitionTransactions),
+		}
+	}
+	if config.dedups == nil {
+		config.dedups = &dedups{}
+	}
+	if config.throughput == nil {
+		config.throughput = &throughput{now: time.Now}
+	}
+	if config.producers == nil {
+		config.producers = &producers{byName: make(map[string]*producer), byID: make(map[uint64]*producer)}
+	}
+	return config
+}
+
+const (
+	objectWildcard = "*"
+	produceAction  = "produce"
+	consumeAction  = "consume"
+	// rebalanceAction moves voters between servers, an operator's job
+	rebalanceAction = "rebalance"
+	// adminAction inspects segments, takes snapshots and deletes records
+	adminAction   = "admin"
+	auditResource = "audit"
+	// configResource is the server's settings, reloaded by operators
+	configResource = "config"
+	// quotaResource is the server's quotas, altered by operators
+	quotaResource = "quotas"
+)
+
+type httpsServer struct {
+	*Config
+	// authenticator overrides Config.Authenticator for this listener
+	authenticator auth.Authenticator
+}
+
+func newHTTPServer(config *Config) *httpsServer {
+	return &httpsServer{Config: withDefaults(config)}
 }
 
 type ProduceRequest struct {
-	Record Record `json:"record"`
+	Record *api.Record `json:"record"`
+	// Ack is "all", "leader" or "none", empty leaves it to the server
+	Ack string `json:"ack,omitempty"`
+	// Topic is empty for the default topic
+	Topic     string `json:"topic,omitempty"`
+	Partition uint32 `json:"partition,omitempty"`
+	// TopicVersion is the topic's version the partition was picked by, a
+	// produce by an older one than the server's fails with 409
+	TopicVersion *uint64 `json:"topic_version,omitempty"`
 }
 
 type ProudctResponse struct {
 	Offset uint64 `json:"offset"`
+	// Pending is set when the record was acknowledged before it committed,
+	// Offset isn't known yet
+	Pending bool `json:"pending,omitempty"`
+	// Dropped is set when the topic's transform dropped the record, which
+	// wasn't appended and has no offset
+	Dropped bool `json:"dropped,omitempty"`
+}
+
+type IngestRequest struct {
+	Records []*api.Record `json:"records"`
+	// Ack is "all", "leader" or "none", empty leaves it to the server
+	Ack string `json:"ack,omitempty"`
+}
+
+type IngestResponse struct {
+	// Results are the records', in the order they were sent
+	Results []*api.IngestResult `json:"results"`
+	Pending bool                `json:"pending,omitempty"`
+}
+
+func parseAck(s string) (api.Ack, error) {
+	if s == "" {
+		return api.Ack_ACK_DEFAULT, nil
+	}
+	ack, ok := api.Ack_value["ACK_"+strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown ack %q", s)
+	}
+	return api.Ack(ack), nil
 }
 
 type ConsumeRequest struct {
 	Offset uint64 `json:"offset"`
+	// MinOffset, when set, waits until this server has the record at
+	// MinOffset, to read your own writes
+	MinOffset *uint64 `json:"min_offset,omitempty"`
+	Topic     string  `json:"topic,omitempty"`
+	Partition uint32  `json:"partition,omitempty"`
 }
 
 type ConsumeResponse struct {
-	Record Record `json:"record"`
+	Record *api.Record `json:"record"`
+}
+
+type ListTopicsResponse struct {
+	Topics []*api.Topic `json:"topics"`
+}
+
+// LinkBackupResponse is where POST /admin/backup/link backed the logs up
+// on the server
+type LinkBackupResponse struct {
+	Dir   string `json:"dir"`
+	Files uint32 `json:"files"`
+	Bytes uint64 `json:"bytes"`
+}
+
+type GroupLagResponse struct {
+	Lags []*api.GroupLag `json:"lags"`
+}
+
+type ThroughputResponse struct {
+	WindowSeconds uint32                     `json:"window_seconds"`
+	Partitions    []*api.PartitionThroughput `json:"partitions"`
+}
+
+type CompactionResponse struct {
+	Partitions []*api.Compaction `json:"partitions"`
+}
+
+type ListSubscriptionsResponse struct {
+	Subscriptions []*api.Subscription `json:"subscriptions"`
+}
+
+type ListDeadLettersResponse struct {
+	DeadLetters []*api.DeadLetter `json:"dead_letters"`
+	Partition   uint32            `json:"partition"`
+	NextOffset  uint64            `json:"next_offset"`
+}
+
+type ReplayDeadLettersResponse struct {
+	Replayed   uint32 `json:"replayed"`
+	NextOffset uint64 `json:"next_offset"`
+}
+
+// Schema is a version of a topic's schema, a JSON Schema document as it
+// is or a protobuf message's serialized FileDescriptorSet base64 encoded
+type Schema struct {
+	Topic   string `json:"topic"`
+	Version uint32 `json:"version,omitempty"`
+	// Type is json, the default, or protobuf
+	Type       string          `json:"type,omitempty"`
+	Schema     json.RawMessage `json:"schema,omitempty"`
+	Descriptor []byte          `json:"descriptor,omitempty"`
+	Message    string          `json:"message,omitempty"`
+}
+
+type ListSchemasResponse struct {
+	Schemas []Schema `json:"schemas"`
+}
+
+func httpSchema(sch *api.Schema) Schema {
+	s := Schema{Topic: sch.Topic, Version: sch.Version, Type: "json"}
+	if sch.Type == api.SchemaType_SCHEMA_PROTOBUF {
+		s.Type, s.Descriptor, s.Message = "protobuf", sch.Definition, sch.Message
+	} else {
+		s.Schema = sch.Definition
+	}
+	return s
+}
+
+func (s Schema) proto() (*api.Schema, error) {
+	switch s.Type {
+	case "", "json":
+		return &api.Schema{Topic: s.Topic, Type: api.SchemaType_SCHEMA_JSON, Definition: s.Schema}, nil
+	case "protobuf":
+		return &api.Schema{Topic: s.Topic, Type: api.SchemaType_SCHEMA_PROTOBUF, Definition: s.Descriptor, Message: s.Message}, nil
+	}
+	return nil, fmt.Errorf("unknown schema type %q", s.Type)
+}
+
+type AlterTopicConfigsRequest struct {
+	// Configs set the topic's overrides by name, an empty value removes one
+	Configs map[string]string `json:"configs"`
+}
+
+type AlterQuotasRequest struct {
+	// Quotas set principals' and tenants' rates, see api.Quota
+	Quotas []*api.Quota `json:"quotas"`
+}
+
+type QuotasResponse struct {
+	Quotas []*api.Quota `json:"quotas"`
+}
+
+type TenantsResponse struct {
+	Tenants []*api.TenantStats `json:"tenants"`
+}
+
+type CreatePartitionsRequest struct {
+	// Partitions is the topic's new partition count
+	Partitions uint32 `json:"partitions"`
+}
+
+// QueryRequest runs a query over a range of one of the topic's partitions,
+// see api.QueryRequest
+type QueryRequest struct {
+	Partition  uint32 `json:"partition"`
+	Query      string `json:"query"`
+	FromOffset uint64 `json:"from_offset,omitempty"`
+	ToOffset   uint64 `json:"to_offset,omitempty"`
+	Since      int64  `json:"since,omitempty"`
+	Until      int64  `json:"until,omitempty"`
+}
+
+type QueryResponse struct {
+	Columns    []string   `json:"columns"`
+	Rows       []QueryRow `json:"rows"`
+	Scanned    uint64     `json:"scanned"`
+	NextOffset uint64     `json:"next_offset"`
+	Truncated  bool       `json:"truncated"`
+}
+
+// QueryRow is a row of a query's results, its values as they are in JSON
+type QueryRow struct {
+	Offset uint64            `json:"offset"`
+	Values []json.RawMessage `json:"values"`
+}
+
+// HTTPRoutes picks which of the HTTP API's routes a listener serves, so the
+// admin and metrics routes can be kept to an internal-only address
+type HTTPRoutes uint8
+
+const (
+	// APIRoutes produce, consume and manage topics, groups and subscriptions
+	APIRoutes HTTPRoutes = 1 << iota
+	// AdminRoutes are under /admin, with /audit and /debug/stats
+	AdminRoutes
+	// MetricsRoutes is /metrics, for Prometheus to scrape
+	MetricsRoutes
+
+	AllRoutes = APIRoutes | AdminRoutes | MetricsRoutes
+)
+
+func NewHTTPServer(addr string, config *Config) *http.Server {
+	return NewHTTPServerRoutes(addr, config, AllRoutes, nil)
 }
 
-func NewHTTPServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
+// NewHTTPServerRoutes is NewHTTPServer serving only routes, authenticating
+// callers with authenticator rather than config's when it's set
+func NewHTTPServerRoutes(addr string, config *Config, routes HTTPRoutes, authenticator auth.Authenticator) *http.Server {
+	httpsrv := newHTTPServer(config)
+	httpsrv.authenticator = authenticator
 	r := http.NewServeMux()
-	r.HandleFunc("POST /", httpsrv.handleProduce)
-	r.HandleFunc("GET /", httpsrv.handleConsume)
+	if routes&APIRoutes != 0 {
+		httpsrv.apiRoutes(r)
+	}
+	if routes&AdminRoutes != 0 {
+		httpsrv.adminRoutes(r)
+	}
+	if routes&MetricsRoutes != 0 {
+		r.Handle("GET /metrics", promhttp.Handler())
+	}
 
 	return &http.Server{
-		Addr:    addr,
-		Handler: r,
+		Addr: addr,
+		// otelhttp continues any W3C trace context the caller sent
+		Handler: otelhttp.NewHandler(httpsrv.logRequests(withProbes(httpsrv.Config, httpsrv.authenticate(httpsrv.throttleRequests(prioritize(r))))), "proglog.http"),
+	}
+}
+
+func (s *httpsServer) apiRoutes(r *http.ServeMux) {
+	r.HandleFunc("POST /", withRoute(s.handleProduce))
+	r.HandleFunc("GET /", withRoute(s.handleConsume))
+	r.HandleFunc("POST /ingest", withRoute(s.handleIngest))
+	r.HandleFunc("GET /topics", withRoute(s.handleListTopics))
+	r.HandleFunc("POST /topics", withRoute(s.handleCreateTopic))
+	r.HandleFunc("GET /topics/{name}", withRoute(s.handleDescribeTopic))
+	r.HandleFunc("DELETE /topics/{name}", withRoute(s.handleDeleteTopic))
+	r.HandleFunc("PATCH /topics/{name}", withRoute(s.handleAlterTopicConfigs))
+	r.HandleFunc("POST /topics/{name}/partitions", withRoute(s.handleCreatePartitions))
+	r.HandleFunc("GET /topics/{name}/schemas", withRoute(s.handleListSchemas))
+	r.HandleFunc("POST /topics/{name}/schemas", withRoute(s.handleRegisterSchema))
+	r.HandleFunc("GET /topics/{name}/schemas/{version}", withRoute(s.handleGetSchema))
+	r.HandleFunc("POST /topics/{name}/query", withRoute(s.handleQuery))
+	r.HandleFunc("GET /topics/{name}/records/{offset}", withRoute(s.handleDescribeRecord))
+	r.HandleFunc("GET /topics/{name}/compaction", withRoute(s.handleDescribeCompaction))
+	r.HandleFunc("POST /topics/{name}/compaction", withRoute(s.handleCompactTopic))
+	r.HandleFunc("GET /groups/lag", withRoute(s.handleGroupLag))
+	r.HandleFunc("GET /throughput", withRoute(s.handleThroughput))
+	r.HandleFunc("GET /subscriptions", withRoute(s.handleListSubscriptions))
+	r.HandleFunc("POST /subscriptions", withRoute(s.handleCreateSubscription))
+	r.HandleFunc("DELETE /subscriptions/{name}", withRoute(s.handleDeleteSubscription))
+	r.HandleFunc("GET /subscriptions/{name}/dead-letters", withRoute(s.handleListDeadLetters))
+	r.HandleFunc("POST /subscriptions/{name}/dead-letters/replay", withRoute(s.handleReplayDeadLetters))
+	r.HandleFunc("POST /v1/logs", withRoute(s.handleOTLPLogs))
+}
+
+func (s *httpsServer) adminRoutes(r *http.ServeMux) {
+	r.HandleFunc("GET /audit", withRoute(s.handleAuditExport))
+	r.HandleFunc("POST /admin/reload", withRoute(s.handleReload))
+	r.HandleFunc("GET /admin/server", withRoute(s.handleDescribeServer))
+	r.HandleFunc("GET /admin/backup", withRoute(s.handleBackup))
+	r.HandleFunc("POST /admin/backup/link", withRoute(s.handleLinkBackup))
+	r.HandleFunc("GET /admin/quotas", withRoute(s.handleDescribeQuotas))
+	r.HandleFunc("PUT /admin/quotas", withRoute(s.handleAlterQuotas))
+	r.HandleFunc("GET /admin/tenants", withRoute(s.handleDescribeTenants))
+	r.HandleFunc("GET /debug/stats", withRoute(s.handleDebugStats))
+}
+
+// Resolves the caller's principal before any handler runs, rejecting and auditing failures
+func (s *httpsServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authenticator := s.Authenticator
+		if s.authenticator != nil {
+			authenticator = s.authenticator
+		}
+		if authenticator == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		principal, err := authenticator.Authenticate(r.Context(), auth.FromHTTP(r))
+		if err != nil {
+			s.logger(r.Context()).Info("authentication failed", zap.Error(err))
+			s.Audit.Record(AuditEvent{
+				Principal: r.RemoteAddr,
+				Action:    AuditAuthenticate,
+				Resource:  r.URL.Path,
+				Result:    AuditFailure,
+			})
+			http.Error(w, auth.ErrUnauthenticated.Error(), http.StatusUnauthorized)
+			return
+		}
+		reqInfo(r.Context()).principal = principal
+		ctx := auth.WithPrincipal(r.Context(), principal)
+		ctx = withLogger(ctx, s.logger(ctx).With(zap.String("principal", principal)))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Ends span, marking it failed if err is set
+func endSpan(span trace.Span, err error, attrs ...attribute.KeyValue) {
+	span.SetAttributes(attrs...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Checks the caller may perform action on resource, answering 403 and auditing the denial if not
+// Throttles requests past their caller's quota, see Quotas
+func (s *httpsServer) throttleRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := s.Quotas.throttle(r.Context(), requestsRate, 1, true); err != nil {
+			throttleError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Answers a request Quotas failed, with 429 and when to retry for an
+// api.ErrQuotaExceeded
+func throttleError(w http.ResponseWriter, err error) {
+	var exceeded api.ErrQuotaExceeded
+	if !errors.As(err, &exceeded) {
+		// the caller gave up waiting
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
 	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(exceeded.RetryAfter.Seconds()))))
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+func (s *httpsServer) authorize(w http.ResponseWriter, r *http.Request, action, resource string) bool {
+	principal := auth.Principal(r.Context())
+	err := s.confine(principal, resource)
+	if err == nil && s.Authorizer != nil {
+		err = s.Authorizer.Authorize(r.Context(), principal, action, resource)
+	}
+	if err != nil {
+		s.logger(r.Context()).Info("permission denied",
+			zap.String("action", action),
+			zap.String("resource", resource),
+		)
+		s.Audit.Record(AuditEvent{
+			Principal: principal,
+			Action:    action,
+			Resource:  resource,
+			Result:    AuditDenied,
+		})
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
 }
 
 func (s *httpsServer) handleProduce(w http.ResponseWriter, r *http.Request) {
@@ -50,14 +594,46 @@ func (s *httpsServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !s.authorize(w, r, produceAction, topicResource(req.Topic)) {
+		return
+	}
+	if req.Record == nil {
+		http.Error(w, "missing record", http.StatusBadRequest)
+		return
+	}
 
-	off, err := s.Log.Append(req.Record)
+	ack, err := parseAck(req.Ack)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	res := ProudctResponse{Offset: off}
+	if err := s.Quotas.produce(r.Context(), []*api.Record{req.Record}, true); err != nil {
+		throttleError(w, err)
+		return
+	}
+	err = s.checkTopicVersion(req.Topic, req.TopicVersion)
+	var off uint64
+	var pending bool
+	if err == nil {
+		off, pending, err = s.append(r.Context(), req.Record, ack, req.Topic, req.Partition, r.Header)
+	}
+	if s.produceError(w, r, err) {
+		return
+	}
+	res := ProudctResponse{Offset: off, Pending: pending}
+	if off == droppedOffset {
+		res = ProudctResponse{Dropped: true}
+	} else {
+		info := reqInfo(r.Context())
+		if !pending {
+			info.addRecord(off, len(req.Record.Value))
+		}
+		if d, ok := s.CommitLog.(durableLog); ok {
+			info.fsync = d.SyncOnAppend()
+		}
+		s.logger(r.Context()).Debug("produced record", zap.Uint64("offset", off))
+	}
 	err = json.NewEncoder(w).Encode(res)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -65,6 +641,98 @@ func (s *httpsServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Appends the records to the topics the routing rules pick, as Ingest does
+func (s *httpsServer) handleIngest(w http.ResponseWriter, r *http.Request) {
+	var req IngestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Records) == 0 || slices.Contains(req.Records, nil) {
+		http.Error(w, "missing record", http.StatusBadRequest)
+		return
+	}
+	ack, err := parseAck(req.Ack)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	routes, err := s.route(req.Records)
+	if status.Code(err) == grpccodes.Unimplemented {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	authorized := make(map[string]bool)
+	for _, route := range routes {
+		if authorized[route.Topic] {
+			continue
+		}
+		if !s.authorize(w, r, produceAction, topicResource(route.Topic)) {
+			return
+		}
+		authorized[route.Topic] = true
+	}
+	if err := s.Quotas.produce(r.Context(), req.Records, true); err != nil {
+		throttleError(w, err)
+		return
+	}
+	res, err := s.ingest(r.Context(), req.Records, routes, ack, r.Header)
+	if s.produceError(w, r, err) {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(IngestResponse{Results: res.Results, Pending: res.Pending}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Answers a failed produce's error with its status, reporting whether
+// there was one
+func (s *httpsServer) produceError(w http.ResponseWriter, r *http.Request, err error) bool {
+	var notLeader api.ErrNotLeader
+	if errors.As(err, &notLeader) {
+		if notLeader.Leader != "" {
+			w.Header().Set("Proglog-Leader", notLeader.Leader)
+		}
+		http.Error(w, err.Error(), http.StatusMisdirectedRequest)
+		return true
+	}
+	if errors.As(err, &api.ErrNotEnoughReplicas{}) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return true
+	}
+	if errors.As(err, &api.ErrPartitionNotFound{}) || errors.As(err, &api.ErrTopicNotFound{}) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return true
+	}
+	if errors.As(err, &api.ErrRecordTooLarge{}) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return true
+	}
+	if errors.As(err, &api.ErrSchemaViolation{}) || errors.As(err, &api.ErrRecordRejected{}) ||
+		errors.As(err, &api.ErrInvalidTimestamp{}) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return true
+	}
+	if errors.As(err, &api.ErrDiskFull{}) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return true
+	}
+	if errors.As(err, &api.ErrStaleMetadata{}) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return true
+	}
+	if err != nil {
+		s.logger(r.Context()).Error("append failed", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return true
+	}
+	return false
+}
+
 func (s *httpsServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 	var req ConsumeRequest
 	err := json.NewDecoder(r.Body).Decode(&req)
@@ -72,19 +740,819 @@ func (s *httpsServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if !s.authorize(w, r, consumeAction, topicResource(req.Topic)) {
+		return
+	}
+
+	cl, err := s.partition(req.Topic, req.Partition)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if req.MinOffset != nil {
+		err = s.waitForOffset(r.Context(), cl, *req.MinOffset)
+		if errors.As(err, &api.ErrOffsetNotReplicated{}) {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			s.logger(r.Context()).Error("read failed", zap.Uint64("offset", *req.MinOffset), zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 
-	record, err := s.Log.Read(req.Offset)
-	if err == ErrOffsetNotFound {
+	class := readPriority(r.Context(), cl, req.Offset)
+	release, err := s.Scheduler.acquire(r.Context(), class)
+	if err != nil {
+		// the caller's gone
+		return
+	}
+	_, span := tracer.Start(r.Context(), "Log.Read")
+	record, err := cl.Read(req.Offset)
+	release()
+	endSpan(span, err, attribute.Int64("proglog.offset", int64(req.Offset)))
+	if errors.As(err, &api.ErrOffsetOutOfRange{}) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
 	if err != nil {
+		s.logger(r.Context()).Error("read failed", zap.Uint64("offset", req.Offset), zap.Error(err))
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.ScanThrottle.read(withScanConn(r.Context(), "http "+r.RemoteAddr), class, recordsSize([]*api.Record{record}))
+	if err := s.Quotas.consume(r.Context(), []*api.Record{record}, true); err != nil {
+		throttleError(w, err)
+		return
 	}
+	s.logger(r.Context()).Debug("consumed record", zap.Uint64("offset", req.Offset))
+	reqInfo(r.Context()).addRecord(req.Offset, len(record.Value))
 	res := ConsumeResponse{Record: record}
-	err = json.NewEncoder(w).Encode(res)
+	buf := responseBuffers.Get().(*bytes.Buffer)
+	defer putResponseBuffer(buf)
+	if err := json.NewEncoder(buf).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// The buffers consumed records are encoded into, reused between responses
+var responseBuffers = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// Buffers grown past this by a large record aren't kept, so one doesn't
+// pin its memory
+const maxResponseBuffer = 1 << 20
+
+func putResponseBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxResponseBuffer {
+		return
+	}
+	buf.Reset()
+	responseBuffers.Put(buf)
+}
+
+// Streams the audit trail as newline delimited JSON, optionally starting at ?from=<offset>
+func (s *httpsServer) handleAuditExport(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, AuditExport, auditResource) {
+		return
+	}
+	var from uint64
+	if v := r.URL.Query().Get("from"); v != "" {
+		off, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		from = off
+	}
+
+	// Exporting the trail is itself an admin operation
+	_, err := s.Audit.Record(AuditEvent{
+		Principal: auth.Principal(r.Context()),
+		Action:    AuditExport,
+		Resource:  auditResource,
+		Result:    AuditSuccess,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := s.Audit.Export(w, from); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
+
+// Reloads the server's settings, answering 500 with why they weren't when
+// they can't be, e.g. a config file that doesn't parse
+func (s *httpsServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, AuditReload, configResource) {
+		return
+	}
+	if s.Reload == nil {
+		http.Error(w, "reloading isn't configured", http.StatusNotImplemented)
+		return
+	}
+	err := s.Reload(r.Context())
+	result := AuditSuccess
+	if err != nil {
+		result = AuditFailure
+	}
+	if _, aerr := s.Audit.Record(AuditEvent{
+		Principal: auth.Principal(r.Context()),
+		Action:    AuditReload,
+		Resource:  configResource,
+		Result:    result,
+	}); aerr != nil {
+		s.logger(r.Context()).Error("auditing reload", zap.Error(aerr))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.logger(r.Context()).Info("reloaded config")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *httpsServer) handleDescribeServer(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, adminAction, configResource) {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(s.describeServer()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *httpsServer) handleDescribeQuotas(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, adminAction, quotaResource) {
+		return
+	}
+	if s.Quotas == nil {
+		http.Error(w, "quotas aren't configured", http.StatusNotImplemented)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(QuotasResponse{Quotas: s.Quotas.Describe()}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Reports the stats of the tenant in the tenant query parameter, every
+// tenant's without one, as DescribeTenants
+func (s *httpsServer) handleDescribeTenants(w http.ResponseWriter, r *http.Request) {
+	tenant, resource := s.describedTenant(auth.Principal(r.Context()), r.URL.Query().Get("tenant"))
+	if !s.authorize(w, r, adminAction, resource) {
+		return
+	}
+	tl, ok := s.CommitLog.(tenantLog)
+	if !ok {
+		http.Error(w, "the log has no tenants", http.StatusNotImplemented)
+		return
+	}
+	stats, ok := tenantStats(tl, tenant)
+	if !ok {
+		http.Error(w, fmt.Sprintf("tenant %s not found", tenant), http.StatusNotFound)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(TenantsResponse{Tenants: stats}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Sets or removes the body's quotas, answering with every quota
+func (s *httpsServer) handleAlterQuotas(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, adminAction, quotaResource) {
+		return
+	}
+	var req AlterQuotasRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.Quotas == nil {
+		http.Error(w, "quotas aren't configured", http.StatusNotImplemented)
+		return
+	}
+	quotas, err := s.Quotas.Alter(req.Quotas)
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.logger(r.Context()).Info("altered quotas", zap.Any("quotas", req.Quotas))
+	if err := json.NewEncoder(w).Encode(QuotasResponse{Quotas: quotas}); err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Streams a backup of the server's logs as a tar. A backup that fails
+// once it's started aborts the response, so it can't pass for a whole one.
+// Streams a backup of every topic, or of the one in the topic query
+// parameter
+func (s *httpsServer) handleBackup(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	if !s.authorize(w, r, adminAction, backupResource(topic)) {
+		return
+	}
+	bl, err := s.backupLog(topic)
+	if err != nil {
+		s.topicError(w, r, err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="proglog-backup.tar"`)
+	manifest, err := bl.Backup(w)
+	if err = s.audit(r, AuditBackup, backupResource(topic), err); err != nil {
+		s.logger(r.Context()).Error("backup failed", zap.String("topic", topic), zap.Error(err))
+		panic(http.ErrAbortHandler)
+	}
+	s.logger(r.Context()).Info("backed up logs", zap.String("topic", manifest.Topic), zap.Int("logs", len(manifest.Logs)))
+}
+
+// Records the admin request in the audit trail, whether or not it worked,
+// failing it when it can't be
+func (s *httpsServer) audit(r *http.Request, action, resource string, err error) error {
+	result := AuditSuccess
+	if err != nil {
+		result = AuditFailure
+	}
+	if _, aerr := s.Audit.Record(AuditEvent{
+		Principal: auth.Principal(r.Context()),
+		Action:    action,
+		Resource:  resource,
+		Result:    result,
+	}); aerr != nil && err == nil {
+		return aerr
+	}
+	return err
+}
+
+// Backs the logs up into the directory the name query parameter names in
+// LinkBackupDir, a time stamped one without it
+func (s *httpsServer) handleLinkBackup(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, adminAction, objectWildcard) {
+		return
+	}
+	dir, manifest, err := s.linkBackup(r.URL.Query().Get("name"))
+	if err = s.audit(r, AuditBackup, objectWildcard, err); err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	files, bytes := linkBackupSize(manifest)
+	s.logger(r.Context()).Info("link backed up logs", zap.String("dir", dir), zap.Int("logs", len(manifest.Logs)))
+	if err := json.NewEncoder(w).Encode(LinkBackupResponse{Dir: dir, Files: files, Bytes: bytes}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *httpsServer) handleListTopics(w http.ResponseWriter, r *http.Request) {
+	resource, topics := s.listedTopics(auth.Principal(r.Context()))
+	if !s.authorize(w, r, consumeAction, resource) {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(ListTopicsResponse{Topics: topics}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Reports how far the group in the group query parameter is behind, every
+// group without one
+func (s *httpsServer) handleGroupLag(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, consumeAction, objectWildcard) {
+		return
+	}
+	lags, err := s.groupLag(r.URL.Query().Get("group"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(GroupLagResponse{Lags: lags}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Reports the partitions' throughput, of every topic or just the topic
+// parameter's
+func (s *httpsServer) handleThroughput(w http.ResponseWriter, r *http.Request) {
+	topic := r.URL.Query().Get("topic")
+	resource := objectWildcard
+	if topic != "" {
+		resource = topic
+	}
+	if !s.authorize(w, r, consumeAction, resource) {
+		return
+	}
+	res, err := s.getThroughput(topic)
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(ThroughputResponse{
+		WindowSeconds: res.WindowSeconds,
+		Partitions:    res.Partitions,
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Reports how compacting the topic's partitions on this server went
+func (s *httpsServer) handleDescribeCompaction(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.authorize(w, r, adminAction, topicResource(name)) {
+		return
+	}
+	partitions, err := s.describeCompaction(name)
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(CompactionResponse{Partitions: partitions}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Compacts the topic's partitions on this server now, answering once
+// they're done
+func (s *httpsServer) handleCompactTopic(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.authorize(w, r, adminAction, topicResource(name)) {
+		return
+	}
+	partitions, err := s.compactTopic(r.Context(), name)
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(CompactionResponse{Partitions: partitions}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Creates the topic the body describes, its name, partitions and configs
+func (s *httpsServer) handleCreateTopic(w http.ResponseWriter, r *http.Request) {
+	var topic api.Topic
+	if err := json.NewDecoder(r.Body).Decode(&topic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.authorize(w, r, adminAction, topicResource(topic.Name)) {
+		return
+	}
+	tl, ok := s.CommitLog.(topicLog)
+	if !ok {
+		http.Error(w, "log doesn't hold topics", http.StatusNotImplemented)
+		return
+	}
+	if err := log.ValidateTopic(topic.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.validateTopicConfigs(topic.Configs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	topic.Partitions = max(topic.Partitions, 1)
+	if err := tl.CreateTopic(&topic); err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	s.logger(r.Context()).Info("created topic", zap.String("topic", topic.Name), zap.Uint32("partitions", topic.Partitions))
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(&topic); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *httpsServer) handleDescribeTopic(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.authorize(w, r, consumeAction, topicResource(name)) {
+		return
+	}
+	topic, err := s.describeTopic(name)
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(topic); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *httpsServer) handleDeleteTopic(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.authorize(w, r, adminAction, topicResource(name)) {
+		return
+	}
+	tl, ok := s.CommitLog.(topicLog)
+	if !ok {
+		http.Error(w, "log doesn't hold topics", http.StatusNotImplemented)
+		return
+	}
+	if name == log.DefaultTopic {
+		http.Error(w, "the default topic can't be deleted", http.StatusBadRequest)
+		return
+	}
+	if err := tl.DeleteTopic(name); err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	s.logger(r.Context()).Info("deleted topic", zap.String("topic", name))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Changes the topic's config overrides to the body's, answering with the
+// topic as altered
+func (s *httpsServer) handleAlterTopicConfigs(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.authorize(w, r, adminAction, topicResource(name)) {
+		return
+	}
+	var req AlterTopicConfigsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tl, ok := s.CommitLog.(topicLog)
+	if !ok {
+		http.Error(w, "log doesn't hold topics", http.StatusNotImplemented)
+		return
+	}
+	if name == log.DefaultTopic {
+		http.Error(w, "the default topic's configs are the servers' settings", http.StatusBadRequest)
+		return
+	}
+	if err := s.validateTopicConfigs(req.Configs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	topic, err := tl.AlterTopicConfigs(name, req.Configs)
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	s.logger(r.Context()).Info("altered topic configs", zap.String("topic", name), zap.Any("configs", topic.Configs))
+	if err := json.NewEncoder(w).Encode(topic); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Raises the topic's partition count to the body's
+func (s *httpsServer) handleCreatePartitions(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.authorize(w, r, adminAction, topicResource(name)) {
+		return
+	}
+	var req CreatePartitionsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tl, ok := s.CommitLog.(topicLog)
+	if !ok {
+		http.Error(w, "log doesn't hold topics", http.StatusNotImplemented)
+		return
+	}
+	if name == log.DefaultTopic {
+		http.Error(w, "the default topic's partitions are the servers' settings", http.StatusBadRequest)
+		return
+	}
+	desc, err := tl.DescribeTopic(name)
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	if req.Partitions <= desc.Partitions {
+		http.Error(w, fmt.Sprintf("topic %s has %d partitions, can't have %d", name, desc.Partitions, req.Partitions), http.StatusBadRequest)
+		return
+	}
+	topic, err := tl.CreatePartitions(name, req.Partitions)
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	s.logger(r.Context()).Info("created partitions",
+		zap.String("topic", name),
+		zap.Uint32("partitions", topic.Partitions),
+		zap.Uint64("version", topic.Version),
+	)
+	if err := json.NewEncoder(w).Encode(topic); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *httpsServer) handleListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r, consumeAction, objectWildcard) {
+		return
+	}
+	subs, err := s.listSubscriptions()
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(ListSubscriptionsResponse{Subscriptions: subs}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Subscribes the webhook the body describes, answering with the
+// subscription as created
+func (s *httpsServer) handleCreateSubscription(w http.ResponseWriter, r *http.Request) {
+	var sub api.Subscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.authorize(w, r, adminAction, topicResource(sub.Topic)) {
+		return
+	}
+	if err := s.createSubscription(r.Context(), &sub, r.Header); err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	s.logger(r.Context()).Info("created subscription", zap.String("subscription", sub.Name), zap.String("topic", sub.Topic))
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(&sub); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *httpsServer) handleDeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	sub, err := s.subscription(name)
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	if !s.authorize(w, r, adminAction, sub.Topic) {
+		return
+	}
+	if err := s.deleteSubscription(r.Context(), name); err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	s.logger(r.Context()).Info("deleted subscription", zap.String("subscription", name))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Parses the ?offset=<offset>&max=<n> dead letters are listed and
+// replayed from, answering a bad request if they're malformed
+func deadLettersQuery(w http.ResponseWriter, r *http.Request) (off uint64, max int, ok bool) {
+	q := r.URL.Query()
+	if v := q.Get("offset"); v != "" {
+		var err error
+		if off, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, fmt.Sprintf("invalid offset %q", v), http.StatusBadRequest)
+			return 0, 0, false
+		}
+	}
+	if v := q.Get("max"); v != "" {
+		n, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid max %q", v), http.StatusBadRequest)
+			return 0, 0, false
+		}
+		max = int(n)
+	}
+	return off, max, true
+}
+
+// Describes the record at the offset, of partition 0 unless the partition
+// parameter says, its value included when the value parameter's true
+func (s *httpsServer) handleDescribeRecord(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.authorize(w, r, consumeAction, topicResource(name)) {
+		return
+	}
+	req := &api.DescribeRecordRequest{Topic: name}
+	var err error
+	if req.Offset, err = strconv.ParseUint(r.PathValue("offset"), 10, 64); err != nil {
+		http.Error(w, fmt.Sprintf("invalid offset %q", r.PathValue("offset")), http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	if v := q.Get("partition"); v != "" {
+		p, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid partition %q", v), http.StatusBadRequest)
+			return
+		}
+		req.Partition = uint32(p)
+	}
+	if v := q.Get("value"); v != "" {
+		if req.IncludeValue, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid value %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	res, err := s.describeRecord(req)
+	if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *httpsServer) handleQuery(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.authorize(w, r, consumeAction, topicResource(name)) {
+		return
+	}
+	var req QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := s.query(r.Context(), &api.QueryRequest{
+		Topic:      name,
+		Partition:  req.Partition,
+		Query:      req.Query,
+		FromOffset: req.FromOffset,
+		ToOffset:   req.ToOffset,
+		Since:      req.Since,
+		Until:      req.Until,
+	})
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	out := QueryResponse{
+		Columns:    res.Columns,
+		Rows:       make([]QueryRow, len(res.Rows)),
+		Scanned:    res.Scanned,
+		NextOffset: res.NextOffset,
+		Truncated:  res.Truncated,
+	}
+	for i, row := range res.Rows {
+		out.Rows[i] = QueryRow{Offset: row.Offset, Values: make([]json.RawMessage, len(row.Values))}
+		for j, v := range row.Values {
+			out.Rows[i].Values[j] = json.RawMessage(v)
+		}
+	}
+	if err := json.NewEncoder(w).Encode(out); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *httpsServer) handleListDeadLetters(w http.ResponseWriter, r *http.Request) {
+	sub, err := s.deadLetterSubscription(r.PathValue("name"))
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	if !s.authorize(w, r, consumeAction, topicResource(sub.DeadLetterTopic)) {
+		return
+	}
+	off, max, ok := deadLettersQuery(w, r)
+	if !ok {
+		return
+	}
+	letters, partition, next, err := s.deadLetters(sub, off, max)
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	res := ListDeadLettersResponse{DeadLetters: letters, Partition: partition, NextOffset: next}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Replays the subscription's dead letters, answering a bad gateway when
+// its webhook fails them again
+func (s *httpsServer) handleReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	sub, err := s.deadLetterSubscription(r.PathValue("name"))
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	if !s.authorize(w, r, adminAction, sub.Topic) {
+		return
+	}
+	off, max, ok := deadLettersQuery(w, r)
+	if !ok {
+		return
+	}
+	letters, _, next, err := s.deadLetters(sub, off, max)
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	replayed, err := s.replayDeadLetters(r.Context(), sub, letters)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%d dead letters replayed: %v", replayed, err), http.StatusBadGateway)
+		return
+	}
+	s.logger(r.Context()).Info("replayed dead letters", zap.String("subscription", sub.Name), zap.Uint64("offset", off), zap.Int("replayed", replayed))
+	res := ReplayDeadLettersResponse{Replayed: uint32(replayed), NextOffset: next}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *httpsServer) handleListSchemas(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.authorize(w, r, consumeAction, name) {
+		return
+	}
+	versions, err := s.topicSchemas(name)
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	res := ListSchemasResponse{Schemas: []Schema{}}
+	for _, ts := range versions {
+		res.Schemas = append(res.Schemas, httpSchema(ts.Schema))
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Registers the schema the body describes as the topic's next version,
+// answering with it and its version
+func (s *httpsServer) handleRegisterSchema(w http.ResponseWriter, r *http.Request) {
+	var req Schema
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Topic = r.PathValue("name")
+	if !s.authorize(w, r, adminAction, req.Topic) {
+		return
+	}
+	sch, err := req.proto()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if sch.Version, err = s.registerSchema(r.Context(), sch); err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	s.logger(r.Context()).Info("registered schema", zap.String("topic", sch.Topic), zap.Uint32("version", sch.Version))
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(httpSchema(sch)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Answers with a version of the topic's schema, "latest" for its latest
+func (s *httpsServer) handleGetSchema(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.authorize(w, r, consumeAction, name) {
+		return
+	}
+	var version uint64
+	if v := r.PathValue("version"); v != "latest" {
+		var err error
+		if version, err = strconv.ParseUint(v, 10, 32); err != nil || version == 0 {
+			http.Error(w, fmt.Sprintf("invalid schema version %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	ts, err := s.schema(name, uint32(version))
+	if err != nil {
+		s.topicError(w, r, err)
+		return
+	}
+	if err := json.NewEncoder(w).Encode(httpSchema(ts.Schema)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Answers a failed topic operation, naming the leader to send it to when
+// this server isn't partition 0's
+func (s *httpsServer) topicError(w http.ResponseWriter, r *http.Request, err error) {
+	var notLeader api.ErrNotLeader
+	switch {
+	case errors.As(err, &notLeader):
+		if notLeader.Leader != "" {
+			w.Header().Set("Proglog-Leader", notLeader.Leader)
+		}
+		http.Error(w, err.Error(), http.StatusMisdirectedRequest)
+	case errors.As(err, &api.ErrTopicNotFound{}), errors.As(err, &api.ErrSubscriptionNotFound{}),
+		errors.As(err, &api.ErrSchemaNotFound{}):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.As(err, &api.ErrTopicExists{}), errors.As(err, &api.ErrSubscriptionExists{}),
+		errors.As(err, &api.ErrIncompatibleSchema{}):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case status.Code(err) == grpccodes.InvalidArgument:
+		http.Error(w, status.Convert(err).Message(), http.StatusBadRequest)
+	case status.Code(err) == grpccodes.FailedPrecondition, status.Code(err) == grpccodes.AlreadyExists:
+		http.Error(w, status.Convert(err).Message(), http.StatusConflict)
+	case status.Code(err) == grpccodes.Unimplemented:
+		http.Error(w, status.Convert(err).Message(), http.StatusNotImplemented)
+	default:
+		s.logger(r.Context()).Error("topic operation failed", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
 }
@@ -0,0 +1,470 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestHTTPTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer tp.Shutdown(t.Context())
+
+	srv := httptest.NewServer(NewHTTPServer("", nil).Handler)
+	defer srv.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req, err := http.NewRequest(http.MethodPost, srv.URL, bytes.NewBufferString(`{"record":{"value":"aGVsbG8="}}`))
+	require.NoError(t, err)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	spans := recorder.Ended()
+	names := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		names[s.Name()] = s
+	}
+	require.Contains(t, names, http.MethodPost)
+	require.Contains(t, names, "Log.Append")
+	// the whole request joins the caller's trace
+	require.Equal(t, traceID, names["Log.Append"].SpanContext().TraceID().String())
+	require.Equal(t, names[http.MethodPost].SpanContext().SpanID(), names["Log.Append"].Parent().SpanID())
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	dir, err := os.MkdirTemp("", "http-metrics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+
+	srv := httptest.NewServer(NewHTTPServer("", &Config{CommitLog: clog}).Handler)
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL, "application/json", bytes.NewBufferString(`{"record":{"value":"aGVsbG8="}}`))
+	require.NoError(t, err)
+	res.Body.Close()
+	req, err := http.NewRequest(http.MethodGet, srv.URL, bytes.NewBufferString(`{"offset":10}`))
+	require.NoError(t, err)
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, err = http.Get(srv.URL + "/metrics")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	name := dir
+	for _, want := range []string{
+		"proglog_log_append_duration_seconds_count",
+		`proglog_log_read_errors_total{type="offset_out_of_range"}`,
+		`proglog_log_segments{log="` + name + `"} 1`,
+		`proglog_log_high_watermark{log="` + name + `"} 1`,
+		`proglog_log_oldest_record_timestamp_seconds{log="` + name + `"}`,
+	} {
+		require.Contains(t, string(body), want)
+	}
+}
+
+func TestHTTPSlowRequestLog(t *testing.T) {
+	dir, err := os.MkdirTemp("", "http-slow-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := log.Config{SyncOnAppend: true}
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer clog.Close()
+
+	core, logs := observer.New(zap.WarnLevel)
+	srv := httptest.NewServer(NewHTTPServer("", &Config{
+		CommitLog:            clog,
+		Logger:               zap.New(core),
+		SlowRequestThreshold: time.Nanosecond,
+	}).Handler)
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL, "application/json", bytes.NewBufferString(`{"record":{"value":"aGVsbG8="}}`))
+	require.NoError(t, err)
+	res.Body.Close()
+
+	entries := logs.FilterMessage("slow request").All()
+	require.Len(t, entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal(t, "POST /", fields["route"])
+	require.Equal(t, int64(5), fields["bytes"])
+	require.Equal(t, true, fields["fsync"])
+	require.Equal(t, uint64(0), fields["first_offset"])
+	require.Equal(t, uint64(0), fields["last_offset"])
+}
+
+func TestHTTPDebugStats(t *testing.T) {
+	dir, err := os.MkdirTemp("", "http-debug-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+
+	srv := httptest.NewServer(NewHTTPServer("", &Config{CommitLog: clog}).Handler)
+	defer srv.Close()
+
+	res, err := http.Post(srv.URL, "application/json", bytes.NewBufferString(`{"record":{"value":"aGVsbG8="}}`))
+	require.NoError(t, err)
+	res.Body.Close()
+
+	res, err = http.Get(srv.URL + "/debug/stats")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var st DebugStats
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&st))
+	var got *LogDebug
+	for i := range st.Logs {
+		if st.Logs[i].Dir == dir {
+			got = &st.Logs[i]
+		}
+	}
+	require.NotNil(t, got)
+	require.Equal(t, uint64(1), got.Stats.HighWatermark)
+	require.Len(t, got.Segments, 1)
+	require.Equal(t, uint64(1), got.Segments[0].NextOffset)
+	require.NotZero(t, got.Segments[0].StoreBytes)
+}
+
+func TestHTTPReload(t *testing.T) {
+	var reloadErr error
+	reloads := 0
+	config := &Config{
+		Authenticator: auth.APIKeyAuthenticator{Keys: map[string]string{"root-key": "root", "nobody-key": "nobody"}},
+		Authorizer:    auth.NewACL(auth.Rule{Principal: "root", Resource: configResource, Action: AuditReload}),
+	}
+	srv := httptest.NewServer(NewHTTPServer("", config).Handler)
+	defer srv.Close()
+	post := func(key string) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/admin/reload", nil)
+		require.NoError(t, err)
+		req.Header.Set(auth.APIKeyHeader, key)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		res.Body.Close()
+		return res
+	}
+	require.Equal(t, http.StatusNotImplemented, post("root-key").StatusCode)
+
+	config.Reload = func(context.Context) error {
+		reloads++
+		return reloadErr
+	}
+	require.Equal(t, http.StatusForbidden, post("nobody-key").StatusCode)
+	require.Equal(t, http.StatusNoContent, post("root-key").StatusCode)
+	reloadErr = errors.New("config doesn't parse")
+	require.Equal(t, http.StatusInternalServerError, post("root-key").StatusCode)
+	require.Equal(t, 2, reloads)
+
+	// reloads are audited, whether they worked or not
+	var trail bytes.Buffer
+	require.NoError(t, config.Audit.Export(&trail, 0))
+	var results []string
+	for _, line := range bytes.Split(bytes.TrimSpace(trail.Bytes()), []byte("\n")) {
+		var event AuditEvent
+		require.NoError(t, json.Unmarshal(line, &event))
+		if event.Action == AuditReload {
+			results = append(results, event.Result)
+		}
+	}
+	require.Equal(t, []string{AuditDenied, AuditSuccess, AuditFailure}, results)
+}
+
+func TestHTTPBackup(t *testing.T) {
+	clog, err := log.NewTopics(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	_, err = clog.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+	config := &Config{
+		CommitLog:     NewLog(),
+		Authenticator: auth.APIKeyAuthenticator{Keys: map[string]string{"root-key": "root", "nobody-key": "nobody"}},
+		Authorizer:    auth.NewACL(auth.Rule{Principal: "root", Resource: objectWildcard, Action: adminAction}),
+	}
+	srv := httptest.NewServer(NewHTTPServer("", config).Handler)
+	defer srv.Close()
+	get := func(key string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/admin/backup", nil)
+		require.NoError(t, err)
+		req.Header.Set(auth.APIKeyHeader, key)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		require.NoError(t, err)
+		return res, body
+	}
+	// the in-memory log has nothing to back up
+	res, _ := get("root-key")
+	require.Equal(t, http.StatusNotImplemented, res.StatusCode)
+
+	config.CommitLog = clog
+	res, _ = get("nobody-key")
+	require.Equal(t, http.StatusForbidden, res.StatusCode)
+	res, body := get("root-key")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/x-tar", res.Header.Get("Content-Type"))
+	hdr, err := tar.NewReader(bytes.NewReader(body)).Next()
+	require.NoError(t, err)
+	require.Equal(t, log.BackupManifestName, hdr.Name)
+}
+
+func TestDebugServerExpvar(t *testing.T) {
+	dir, err := os.MkdirTemp("", "debug-expvar-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	_, err = clog.Append(&api.Record{Value: []byte("hello")})
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewDebugServer("").Handler)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/debug/vars")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	vars := make(map[string]any)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&vars))
+	require.NotZero(t, vars["proglog_log_appends"])
+	require.Contains(t, vars, "proglog_store_lock_holders")
+	require.Contains(t, vars, "goroutines")
+}
+
+func TestHTTPProbes(t *testing.T) {
+	clog := &notReadyLog{CommitLog: NewLog(), err: errors.New("no leader")}
+	srv := httptest.NewServer(NewHTTPServer("", &Config{
+		CommitLog: clog,
+		// probes skip authentication
+		Authenticator: auth.APIKeyAuthenticator{Keys: map[string]string{}},
+	}).Handler)
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL + "/healthz")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	res, err = http.Get(srv.URL + "/readyz")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+	clog.err = nil
+	res, err = http.Get(srv.URL + "/readyz")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+type notReadyLog struct {
+	CommitLog
+	err error
+}
+
+func (l *notReadyLog) Ready() error {
+	return l.err
+}
+
+func TestHTTPTopics(t *testing.T) {
+	clog, err := log.NewTopics(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := httptest.NewServer(NewHTTPServer("", &Config{CommitLog: clog}).Handler)
+	defer srv.Close()
+
+	do := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	res := do(http.MethodPost, "/topics", `{"name":"events","partitions":3,"configs":{"retention.ms":"60000"}}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	res = do(http.MethodPost, "/topics", `{"name":"events"}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusConflict, res.StatusCode)
+	res = do(http.MethodPost, "/topics", `{"name":"no/slashes"}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = do(http.MethodGet, "/topics", "")
+	var list ListTopicsResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+	res.Body.Close()
+	require.Len(t, list.Topics, 2)
+	require.Equal(t, log.DefaultTopic, list.Topics[0].Name)
+	require.Equal(t, "events", list.Topics[1].Name)
+
+	res = do(http.MethodGet, "/topics/events", "")
+	var topic api.Topic
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&topic))
+	res.Body.Close()
+	require.Equal(t, uint32(3), topic.Partitions)
+	require.Equal(t, "60000", topic.Configs["retention.ms"])
+
+	// produces reach the topic's partitions
+	res = do(http.MethodPost, "/", `{"record":{"value":"aGVsbG8="},"topic":"events","partition":2}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	// and go by the topic's configs once altered
+	res = do(http.MethodPatch, "/topics/events", `{"configs":{"max.record.bytes":"4"}}`)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&topic))
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, map[string]string{"retention.ms": "60000", "max.record.bytes": "4"}, topic.Configs)
+	res = do(http.MethodPost, "/", `{"record":{"value":"aGVsbG8="},"topic":"events"}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusRequestEntityTooLarge, res.StatusCode)
+	res = do(http.MethodPatch, "/topics/events", `{"configs":{"max.record.bytes":"four"}}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = do(http.MethodPatch, "/topics/missing", `{"configs":{}}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	// partitions are added, and produces by the topic's old version refused
+	res = do(http.MethodPost, "/topics/events/partitions", `{"partitions":4}`)
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&topic))
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, uint32(4), topic.Partitions)
+	require.Equal(t, uint64(1), topic.Version)
+	res = do(http.MethodPost, "/", `{"record":{"value":"aGk="},"topic":"events","partition":3,"topic_version":0}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusConflict, res.StatusCode)
+	res = do(http.MethodPost, "/", `{"record":{"value":"aGk="},"topic":"events","partition":3,"topic_version":1}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	res = do(http.MethodPost, "/topics/events/partitions", `{"partitions":4}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = do(http.MethodPost, "/topics/missing/partitions", `{"partitions":4}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res = do(http.MethodDelete, "/topics/"+log.DefaultTopic, "")
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = do(http.MethodDelete, "/topics/events", "")
+	res.Body.Close()
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	res = do(http.MethodGet, "/topics/events", "")
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res = do(http.MethodDelete, "/topics/events", "")
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestHTTPGroupLag(t *testing.T) {
+	clog, err := log.NewTopics(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	config := &Config{CommitLog: clog}
+	srv := httptest.NewServer(NewHTTPServer("", config).Handler)
+	defer srv.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := clog.Append(&api.Record{Value: []byte("hello")})
+		require.NoError(t, err)
+	}
+	for _, group := range []string{"readers", "writers"} {
+		err := config.commitGroupOffsets(t.Context(), &api.CommitGroupOffsetsRequest{
+			Group:   group,
+			Offsets: []*api.GroupOffset{{Offset: 1}},
+		}, http.Header{})
+		require.NoError(t, err)
+	}
+	res, err := http.Get(srv.URL + "/groups/lag?group=readers")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	var lag GroupLagResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&lag))
+	require.Len(t, lag.Lags, 1)
+	require.Equal(t, "readers", lag.Lags[0].Group)
+	require.Equal(t, log.DefaultTopic, lag.Lags[0].Topic)
+	require.Equal(t, uint64(2), lag.Lags[0].Lag)
+}
+
+func TestHTTPSubscriptions(t *testing.T) {
+	clog, err := log.NewTopics(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	srv := httptest.NewServer(NewHTTPServer("", &Config{CommitLog: clog}).Handler)
+	defer srv.Close()
+
+	do := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewBufferString(body))
+		require.NoError(t, err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		return res
+	}
+	res := do(http.MethodPost, "/subscriptions", `{"name":"hook","topic":"events","url":"https://example.com/hook"}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	require.NoError(t, clog.CreateTopic(&api.Topic{Name: "events", Partitions: 1}))
+	res = do(http.MethodPost, "/subscriptions", `{"name":"hook","topic":"events","url":"https://example.com/hook","max_batch":10}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	res = do(http.MethodPost, "/subscriptions", `{"name":"hook","topic":"events","url":"https://example.com/hook"}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusConflict, res.StatusCode)
+	res = do(http.MethodPost, "/subscriptions", `{"name":"plain","topic":"events","url":"http://example.com/hook"}`)
+	res.Body.Close()
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = do(http.MethodGet, "/subscriptions", "")
+	var list ListSubscriptionsResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+	res.Body.Close()
+	require.Len(t, list.Subscriptions, 1)
+	require.Equal(t, "hook", list.Subscriptions[0].Name)
+	require.Equal(t, uint32(10), list.Subscriptions[0].MaxBatch)
+
+	res = do(http.MethodDelete, "/subscriptions/hook", "")
+	res.Body.Close()
+	require.Equal(t, http.StatusNoContent, res.StatusCode)
+	res = do(http.MethodDelete, "/subscriptions/hook", "")
+	res.Body.Close()
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// ProduceInterceptor sees each record produced to any topic before it's
+// appended, see Config.ProduceInterceptors. It returns the record to
+// append: the one it was given, a changed copy, such as one with headers
+// added, or nil to drop it as a transform would. An error rejects the
+// produce, as the api package's errors say, or otherwise as
+// api.ErrRecordRejected for the reason it gives. Interceptors are called
+// concurrently, by every produce's goroutine.
+type ProduceInterceptor interface {
+	// Name names the interceptor in rejections and metrics
+	Name() string
+	InterceptProduce(ctx context.Context, p Produce) (*api.Record, error)
+}
+
+// Produce is a record produced, as an interceptor sees it
+type Produce struct {
+	Topic     string
+	Partition uint32
+	// Principal is the producer's, empty when the server doesn't
+	// authenticate
+	Principal string
+	// Record is the record, which the interceptor mustn't change but copy.
+	// Its value is compressed if its codec says so, see Value.
+	Record *api.Record
+	// Config is the topic's
+	Config log.TopicConfig
+}
+
+// Value is the record's value decompressed
+func (p Produce) Value() ([]byte, error) {
+	if p.Record.Codec == api.Codec_CODEC_NONE {
+		return p.Record.Value, nil
+	}
+	return codec.Decode(p.Record.Codec, p.Record.Value)
+}
+
+// Runs the record through the interceptors, the server's then the built in
+// ones, returning the record to append, nil if one dropped it
+func (c *Config) intercept(ctx context.Context, tc log.TopicConfig, topic string, partition uint32, record *api.Record) (*api.Record, error) {
+	p := Produce{
+		Topic:     topicResource(topic),
+		Partition: partition,
+		Principal: auth.Principal(ctx),
+		Config:    tc,
+	}
+	for _, i := range c.interceptors(tc) {
+		p.Record = record
+		out, err := i.InterceptProduce(ctx, p)
+		var st interface{ GRPCStatus() *status.Status }
+		switch {
+		case err != nil && !errors.As(err, &st):
+			interceptorRecords.WithLabelValues(i.Name(), "rejected").Inc()
+			return nil, api.ErrRecordRejected{Topic: p.Topic, Transform: i.Name(), Reason: err.Error()}
+		case err != nil:
+			interceptorRecords.WithLabelValues(i.Name(), "rejected").Inc()
+			return nil, err
+		case out == nil:
+			interceptorRecords.WithLabelValues(i.Name(), "dropped").Inc()
+			return nil, nil
+		case out != record:
+			interceptorRecords.WithLabelValues(i.Name(), "changed").Inc()
+		}
+		record = out
+	}
+	return record, nil
+}
+
+// The interceptors records produced to a topic with the config go
+// through, the built in ones only when the topic asks for them
+func (c *Config) interceptors(tc log.TopicConfig) []ProduceInterceptor {
+	is := c.ProduceInterceptors
+	if tc.ValidateSchema {
+		is = append(is[:len(is):len(is)], schemaInterceptor{c})
+	}
+	if !tc.Redact.Empty() {
+		is = append(is[:len(is):len(is)], redactInterceptor{})
+	}
+	return is
+}
+
+// schemaInterceptor rejects records whose values don't match their
+// topic's latest schema, see log.SchemaValidationConfig
+type schemaInterceptor struct {
+	c *Config
+}
+
+func (schemaInterceptor) Name() string {
+	return "schema"
+}
+
+func (i schemaInterceptor) InterceptProduce(_ context.Context, p Produce) (*api.Record, error) {
+	return p.Record, i.c.validateRecords(p.Topic, p.Record)
+}
+
+// redactInterceptor replaces the personal data their topic says in
+// records' values, see log.RedactFieldsConfig. Redacted records are
+// appended uncompressed, unless the topic compresses them.
+type redactInterceptor struct{}
+
+func (redactInterceptor) Name() string {
+	return "redact"
+}
+
+func (redactInterceptor) InterceptProduce(_ context.Context, p Produce) (*api.Record, error) {
+	value, err := p.Value()
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	value, changed := p.Config.Redact.Value(value)
+	if !changed {
+		return p.Record, nil
+	}
+	record := proto.Clone(p.Record).(*api.Record)
+	record.Value, record.Codec = value, api.Codec_CODEC_NONE
+	return record, nil
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Stamps records with their producer, and rejects or drops some by value
+type stampInterceptor struct{}
+
+func (stampInterceptor) Name() string {
+	return "stamp"
+}
+
+func (stampInterceptor) InterceptProduce(_ context.Context, p Produce) (*api.Record, error) {
+	switch string(p.Record.Value) {
+	case "bad":
+		return nil, errors.New("bad value")
+	case "drop":
+		return nil, nil
+	}
+	record := proto.Clone(p.Record).(*api.Record)
+	record.Headers = append(record.Headers, &api.Header{Key: "producer", Value: []byte(p.Principal + "@" + p.Topic)})
+	return record, nil
+}
+
+func TestProduceInterceptors(t *testing.T) {
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.ProduceInterceptors = []ProduceInterceptor{stampInterceptor{}}
+	})
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	res, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("good")}})
+	require.NoError(t, err)
+	consumed, err := client.Consume(ctx, &api.ConsumeRequest{Offset: res.Offset})
+	require.NoError(t, err)
+	require.Equal(t, "producer", consumed.Record.Headers[0].Key)
+	require.Equal(t, "root@"+log.DefaultTopic, string(consumed.Record.Headers[0].Value))
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("bad")}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.ErrorContains(t, err, "transform stamp: bad value")
+
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: []*api.Record{
+		{Value: []byte("drop")},
+		{Value: []byte("good")},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false}, batch.Dropped)
+	require.Equal(t, res.Offset+1, batch.Offsets[1])
+}
+
+func TestRedaction(t *testing.T) {
+	client, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "users", Configs: map[string]string{
+		log.RedactPatternsConfig: "passport",
+	}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "users", Configs: map[string]string{
+		log.RedactFieldsConfig:   "user.ssn",
+		log.RedactPatternsConfig: "email",
+	}})
+	require.NoError(t, err)
+
+	// compressed values are redacted as they decompress
+	compressed, err := codec.Compress(api.Codec_CODEC_ZSTD, &api.Record{Value: []byte(`{"note": "reach me at ann@example.com, ann@example.com, ann@example.com, ann@example.com"}`)})
+	require.NoError(t, err)
+	require.Equal(t, api.Codec_CODEC_ZSTD, compressed.Codec)
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Topic: "users", Records: []*api.Record{
+		{Value: []byte(`{"user": {"name": "ann", "ssn": "123-45-6789"}}`)},
+		compressed,
+	}})
+	require.NoError(t, err)
+	for off, want := range map[uint64]string{
+		batch.Offsets[0]: `{"user": {"name": "ann", "ssn": "REDACTED"}}`,
+		batch.Offsets[1]: `{"note": "reach me at REDACTED, REDACTED, REDACTED, REDACTED"}`,
+	} {
+		res, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "users", Offset: off})
+		require.NoError(t, err)
+		require.NoError(t, codec.Decompress(res.Record))
+		require.JSONEq(t, want, string(res.Record.Value))
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// IPFilter decides which remote addresses may connect.
+// A deny match always wins; with a non-empty allow list only matching addresses get through.
+type IPFilter struct {
+	allow    []*net.IPNet
+	deny     []*net.IPNet
+	rejected atomic.Uint64
+}
+
+func NewIPFilter(allow, deny []string) (*IPFilter, error) {
+	f := &IPFilter{}
+	var err error
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Accepts CIDRs as well as bare addresses, which are treated as a single host
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			if ip := net.ParseIP(c); ip != nil && ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func (f *IPFilter) Allowed(ip net.IP) bool {
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rejected returns how many connections the filter has turned away
+func (f *IPFilter) Rejected() uint64 {
+	return f.rejected.Load()
+}
+
+// Listener wraps l so connections from disallowed addresses are closed on accept
+func (f *IPFilter) Listener(l net.Listener) net.Listener {
+	return &filterListener{Listener: l, filter: f}
+}
+
+type filterListener struct {
+	net.Listener
+	filter *IPFilter
+}
+
+func (l *filterListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err == nil && l.filter.Allowed(net.ParseIP(host)) {
+			return conn, nil
+		}
+		l.filter.rejected.Add(1)
+		connectionsRejected.Inc()
+		conn.Close()
+	}
+}
+
+// PacketConn wraps c so packets from disallowed addresses are dropped on
+// read, each counting as a rejected connection
+func (f *IPFilter) PacketConn(c net.PacketConn) net.PacketConn {
+	return &filterPacketConn{PacketConn: c, filter: f}
+}
+
+type filterPacketConn struct {
+	net.PacketConn
+	filter *IPFilter
+}
+
+func (c *filterPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+		host, _, err := net.SplitHostPort(addr.String())
+		if err == nil && c.filter.Allowed(net.ParseIP(host)) {
+			return n, addr, nil
+		}
+		c.filter.rejected.Add(1)
+		connectionsRejected.Inc()
+	}
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPFilterAllowed(t *testing.T) {
+	f, err := NewIPFilter([]string{"10.0.0.0/8", "192.168.1.7"}, []string{"10.1.0.0/16"})
+	require.NoError(t, err)
+	for ip, want := range map[string]bool{
+		"10.0.0.1":    true,
+		"10.1.2.3":    false,
+		"192.168.1.7": true,
+		"192.168.1.8": false,
+		"8.8.8.8":     false,
+	} {
+		require.Equal(t, want, f.Allowed(net.ParseIP(ip)), ip)
+	}
+
+	f, err = NewIPFilter(nil, []string{"::1"})
+	require.NoError(t, err)
+	require.True(t, f.Allowed(net.ParseIP("127.0.0.1")))
+	require.False(t, f.Allowed(net.ParseIP("::1")))
+
+	_, err = NewIPFilter([]string{"not-a-cidr"}, nil)
+	require.Error(t, err)
+}
+
+func TestIPFilterListener(t *testing.T) {
+	f, err := NewIPFilter(nil, []string{"127.0.0.0/8"})
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln = f.Listener(ln)
+	defer ln.Close()
+	go ln.Accept()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	// the server side closes rejected connections straight away
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.Eventually(t, func() bool { return f.Rejected() == 1 }, time.Second, 10*time.Millisecond)
+}
+
+func TestIPFilterPacketConn(t *testing.T) {
+	f, err := NewIPFilter([]string{"10.0.0.0/8"}, nil)
+	require.NoError(t, err)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	pc = f.PacketConn(pc)
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("dropped"))
+	require.NoError(t, err)
+	// the read skips the packet, waiting for one that's allowed
+	pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = pc.ReadFrom(make([]byte, 16))
+	require.Error(t, err)
+	require.Equal(t, uint64(1), f.Rejected())
+}
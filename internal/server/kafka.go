@@ -0,0 +1,864 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ErrKafkaServerClosed is returned by KafkaServer.Serve once it's closed
+var ErrKafkaServerClosed = errors.New("server: kafka server closed")
+
+// The Kafka APIs the listener answers, with the versions of each it
+// speaks: those from the first with v2 record batches up to the last
+// before flexible versions
+const (
+	kafkaProduce     = 0
+	kafkaFetch       = 1
+	kafkaListOffsets = 2
+	kafkaMetadata    = 3
+	kafkaAPIVersions = 18
+)
+
+var kafkaAPIs = []struct{ key, min, max int16 }{
+	{kafkaProduce, 3, 7},
+	{kafkaFetch, 4, 10},
+	{kafkaListOffsets, 1, 5},
+	{kafkaMetadata, 0, 5},
+	{kafkaAPIVersions, 0, 2},
+}
+
+func kafkaAPIName(key int16) string {
+	switch key {
+	case kafkaProduce:
+		return "Produce"
+	case kafkaFetch:
+		return "Fetch"
+	case kafkaListOffsets:
+		return "ListOffsets"
+	case kafkaMetadata:
+		return "Metadata"
+	case kafkaAPIVersions:
+		return "ApiVersions"
+	}
+	return "unknown"
+}
+
+// Kafka's error codes the listener answers with
+const (
+	kafkaNone                       int16 = 0
+	kafkaUnknownServerError         int16 = -1
+	kafkaOffsetOutOfRange           int16 = 1
+	kafkaCorruptMessage             int16 = 2
+	kafkaUnknownTopicOrPartition    int16 = 3
+	kafkaLeaderNotAvailable         int16 = 5
+	kafkaNotLeaderOrFollower        int16 = 6
+	kafkaMessageTooLarge            int16 = 10
+	kafkaNotEnoughReplicas          int16 = 19
+	kafkaTopicAuthorizationFailed   int16 = 29
+	kafkaInvalidTimestamp           int16 = 32
+	kafkaUnsupportedVersion         int16 = 35
+	kafkaStorageError               int16 = 56
+	kafkaInvalidRequest             int16 = 42
+	kafkaUnsupportedCompressionType int16 = 76
+	kafkaInvalidRecord              int16 = 87
+)
+
+func kafkaErrorCode(err error) int16 {
+	switch {
+	case err == nil:
+		return kafkaNone
+	case errors.As(err, &api.ErrOffsetOutOfRange{}):
+		return kafkaOffsetOutOfRange
+	case errors.As(err, &api.ErrTopicNotFound{}), errors.As(err, &api.ErrPartitionNotFound{}):
+		return kafkaUnknownTopicOrPartition
+	case errors.As(err, &api.ErrNotLeader{}):
+		return kafkaNotLeaderOrFollower
+	case errors.As(err, &api.ErrNotEnoughReplicas{}):
+		return kafkaNotEnoughReplicas
+	case errors.As(err, &api.ErrRecordTooLarge{}):
+		return kafkaMessageTooLarge
+	case errors.As(err, &api.ErrSchemaViolation{}), errors.As(err, &api.ErrRecordRejected{}):
+		return kafkaInvalidRecord
+	case errors.As(err, &api.ErrInvalidTimestamp{}):
+		return kafkaInvalidTimestamp
+	case errors.As(err, &api.ErrDiskFull{}):
+		return kafkaStorageError
+	case errors.Is(err, errKafkaCorrupt):
+		return kafkaCorruptMessage
+	case errors.Is(err, errKafkaCompression):
+		return kafkaUnsupportedCompressionType
+	}
+	switch status.Code(err) {
+	case codes.PermissionDenied:
+		return kafkaTopicAuthorizationFailed
+	case codes.InvalidArgument:
+		return kafkaInvalidRequest
+	case codes.Unavailable:
+		return kafkaLeaderNotAvailable
+	}
+	return kafkaUnknownServerError
+}
+
+// The broker the listener presents itself as, the only one of its cluster
+const (
+	kafkaNodeID    = 0
+	kafkaClusterID = "proglog"
+)
+
+// KafkaServer speaks the core of Kafka's protocol, enough for kcat and
+// Kafka's clients to produce to and fetch from the topics: ApiVersions,
+// Metadata, Produce, Fetch and ListOffsets, in their versions from before
+// flexible ones. It presents the node as a cluster of one broker leading
+// every partition, forwarding produces to the partitions' leaders as the
+// gRPC server does and fetching from the node's replicas.
+//
+// Connections are authenticated once, by their TLS client certificate;
+// there's no SASL. Produces and fetches are authorized as the gRPC ones
+// are, and a topic's metadata takes either. Transactions, idempotent
+// producers and Kafka's consumer groups aren't supported, and fetches read
+// as READ_UNCOMMITTED consumes do.
+type KafkaServer struct {
+	srv  *grpcServer
+	host string
+	port int32
+	// ctx is canceled on close, ending fetches waiting for records
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	closed bool
+	lns    map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// NewKafkaServer serves the Kafka protocol from the Config, telling
+// clients to connect to advertiseAddr
+func NewKafkaServer(advertiseAddr string, config *Config) (*KafkaServer, error) {
+	host, port, err := net.SplitHostPort(advertiseAddr)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("kafka port %q: %w", port, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &KafkaServer{
+		srv:    newgrpcServer(config),
+		host:   host,
+		port:   int32(p),
+		ctx:    ctx,
+		cancel: cancel,
+		lns:    make(map[net.Listener]struct{}),
+		conns:  make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Serve answers the connections the listener accepts until the server is
+// closed, returning ErrKafkaServerClosed
+func (s *KafkaServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrKafkaServerClosed
+	}
+	s.lns[ln] = struct{}{}
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return ErrKafkaServerClosed
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close closes the listeners and connections, canceling requests in
+// flight, and waits for them to end
+func (s *KafkaServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	var errs []error
+	for ln := range s.lns {
+		errs = append(errs, ln.Close())
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Answers the connection's requests in the order they come, as Kafka's
+// clients expect, closing it on a request the listener can't answer
+func (s *KafkaServer) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	ctx, err := s.authenticate(s.ctx, conn)
+	if err != nil {
+		return
+	}
+	ctx = withScanConn(ctx, "kafka "+conn.RemoteAddr().String())
+	r := bufio.NewReader(conn)
+	for {
+		req, err := readKafkaRequest(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && s.ctx.Err() == nil {
+				s.srv.logger(ctx).Info("kafka connection closed", zap.Error(err))
+			}
+			return
+		}
+		kafkaRequests.WithLabelValues(kafkaAPIName(req.apiKey)).Inc()
+		res, err := s.handle(ctx, req)
+		if err != nil {
+			s.srv.logger(ctx).Info("kafka request failed",
+				zap.String("api", kafkaAPIName(req.apiKey)),
+				zap.Int16("version", req.version),
+				zap.String("client_id", req.clientID),
+				zap.Error(err),
+			)
+			return
+		}
+		if res == nil {
+			continue
+		}
+		if _, err := conn.Write(res); err != nil {
+			return
+		}
+	}
+}
+
+// Resolves the connection's principal from its client certificate,
+// auditing failures
+func (s *KafkaServer) authenticate(ctx context.Context, conn net.Conn) (context.Context, error) {
+	logger := s.srv.Logger.With(zap.String("remote_addr", conn.RemoteAddr().String()))
+	if s.srv.Authenticator == nil {
+		return withLogger(ctx, logger), nil
+	}
+	creds := auth.Credentials{RemoteAddr: conn.RemoteAddr().String()}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.HandshakeContext(ctx); err != nil {
+			logger.Info("kafka tls handshake failed", zap.Error(err))
+			return ctx, err
+		}
+		state := tc.ConnectionState()
+		creds.TLS = &state
+	}
+	principal, err := s.srv.Authenticator.Authenticate(ctx, creds)
+	if err != nil {
+		logger.Info("authentication failed", zap.Error(err))
+		s.srv.Audit.Record(AuditEvent{
+			Principal: creds.RemoteAddr,
+			Action:    AuditAuthenticate,
+			Resource:  "kafka",
+			Result:    AuditFailure,
+		})
+		return ctx, auth.ErrUnauthenticated
+	}
+	ctx = auth.WithPrincipal(ctx, principal)
+	return withLogger(ctx, logger.With(zap.String("principal", principal))), nil
+}
+
+type kafkaRequest struct {
+	apiKey        int16
+	version       int16
+	correlationID int32
+	clientID      string
+	body          *kafkaDecoder
+}
+
+// Reads a request and its v1 header. ApiVersions requests newer than the
+// listener speaks have a v2 header, which is left in the body unread.
+func readKafkaRequest(r io.Reader) (*kafkaRequest, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := int32(binary.BigEndian.Uint32(size[:]))
+	if n < 8 || n > kafkaMaxRequestSize {
+		return nil, errKafkaMalformed
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	d := &kafkaDecoder{b: b}
+	req := &kafkaRequest{
+		apiKey:        d.int16(),
+		version:       d.int16(),
+		correlationID: d.int32(),
+		clientID:      d.string(),
+		body:          d,
+	}
+	return req, d.err
+}
+
+// Answers the request, with its size and v0 header in front, or with nil
+// when it takes no answer
+func (s *KafkaServer) handle(ctx context.Context, req *kafkaRequest) ([]byte, error) {
+	e := &kafkaEncoder{}
+	e.int32(0) // size, filled in once it's known
+	e.int32(req.correlationID)
+	if req.apiKey == kafkaAPIVersions {
+		s.apiVersions(req.version, e)
+	} else {
+		if !kafkaSupports(req.apiKey, req.version) {
+			return nil, fmt.Errorf("unsupported version %d", req.version)
+		}
+		var err error
+		respond := true
+		switch req.apiKey {
+		case kafkaMetadata:
+			err = s.metadata(ctx, req.version, req.body, e)
+		case kafkaProduce:
+			respond, err = s.produce(ctx, req.version, req.body, e)
+		case kafkaFetch:
+			err = s.fetch(ctx, req.version, req.body, e)
+		case kafkaListOffsets:
+			err = s.listOffsets(ctx, req.version, req.body, e)
+		}
+		if err != nil || !respond {
+			return nil, err
+		}
+	}
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+	return e.b, nil
+}
+
+func kafkaSupports(key, version int16) bool {
+	for _, a := range kafkaAPIs {
+		if a.key == key {
+			return version >= a.min && version <= a.max
+		}
+	}
+	return false
+}
+
+// Lists the APIs and versions the listener speaks. Clients ask with the
+// newest version they know first, and are answered in v0 with
+// UNSUPPORTED_VERSION, the list telling them which to ask with instead.
+func (s *KafkaServer) apiVersions(version int16, e *kafkaEncoder) {
+	code := kafkaNone
+	if !kafkaSupports(kafkaAPIVersions, version) {
+		code, version = kafkaUnsupportedVersion, 0
+	}
+	e.int16(code)
+	e.arrayLen(len(kafkaAPIs))
+	for _, a := range kafkaAPIs {
+		e.int16(a.key)
+		e.int16(a.min)
+		e.int16(a.max)
+	}
+	if version >= 1 {
+		e.int32(0) // throttle time
+	}
+}
+
+type kafkaTopicMetadata struct {
+	name       string
+	code       int16
+	partitions uint32
+}
+
+// Describes the topics asked for, or every topic the caller may see when
+// it asks for none in v0 or for null after. Asking for a topic there's
+// none of creates it as a produce would, with AutoCreateTopics set.
+func (s *KafkaServer) metadata(ctx context.Context, version int16, d *kafkaDecoder, e *kafkaEncoder) error {
+	n := d.arrayLen()
+	names := make([]string, max(n, 0))
+	for i := range names {
+		names[i] = d.string()
+	}
+	autoCreate := true
+	if version >= 4 {
+		autoCreate = d.bool()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	var topics []kafkaTopicMetadata
+	if n < 0 || version == 0 && n == 0 {
+		for _, t := range s.srv.topics() {
+			if s.maySee(ctx, t.Name) {
+				topics = append(topics, kafkaTopicMetadata{name: t.Name, partitions: t.Partitions})
+			}
+		}
+	} else {
+		for _, name := range names {
+			topics = append(topics, s.describe(ctx, name, autoCreate))
+		}
+	}
+
+	if version >= 3 {
+		e.int32(0) // throttle time
+	}
+	e.arrayLen(1)
+	e.int32(kafkaNodeID)
+	e.string(s.host)
+	e.int32(s.port)
+	if version >= 1 {
+		e.int16(-1) // rack
+	}
+	if version >= 2 {
+		e.string(kafkaClusterID)
+	}
+	if version >= 1 {
+		e.int32(kafkaNodeID) // controller
+	}
+	e.arrayLen(len(topics))
+	for _, t := range topics {
+		e.int16(t.code)
+		e.string(t.name)
+		if version >= 1 {
+			e.bool(t.name == log.OffsetsTopic)
+		}
+		e.arrayLen(int(t.partitions))
+		for p := range t.partitions {
+			e.int16(kafkaNone)
+			e.int32(int32(p))
+			e.int32(kafkaNodeID) // leader
+			e.arrayLen(1)        // replicas
+			e.int32(kafkaNodeID)
+			e.arrayLen(1) // in sync replicas
+			e.int32(kafkaNodeID)
+			if version >= 5 {
+				e.arrayLen(0) // offline replicas
+			}
+		}
+	}
+	return nil
+}
+
+// Whether the caller may produce to or consume from the topic, either
+// letting it see the topic's metadata
+func (s *KafkaServer) maySee(ctx context.Context, topic string) bool {
+	return s.may(ctx, consumeAction, topic) || s.may(ctx, produceAction, topic)
+}
+
+// Whether the caller may act on the topic, without auditing a denial
+func (s *KafkaServer) may(ctx context.Context, action, topic string) bool {
+	return s.srv.Authorizer == nil ||
+		s.srv.Authorizer.Authorize(ctx, auth.Principal(ctx), action, topicResource(topic)) == nil
+}
+
+func (s *KafkaServer) describe(ctx context.Context, name string, autoCreate bool) kafkaTopicMetadata {
+	if !s.maySee(ctx, name) {
+		// audits the denial
+		err := s.srv.authorize(ctx, consumeAction, topicResource(name))
+		return kafkaTopicMetadata{name: name, code: kafkaErrorCode(err)}
+	}
+	topic, err := s.srv.describeTopic(name)
+	if errors.As(err, &api.ErrTopicNotFound{}) && autoCreate && s.may(ctx, produceAction, name) {
+		if _, err = s.srv.producePartition(name, 0); err == nil {
+			topic, err = s.srv.describeTopic(name)
+		}
+	}
+	if err != nil {
+		return kafkaTopicMetadata{name: name, code: kafkaErrorCode(err)}
+	}
+	return kafkaTopicMetadata{name: name, partitions: topic.Partitions}
+}
+
+type kafkaProducePartition struct {
+	index   int32
+	records []byte
+	code    int16
+	offset  int64
+}
+
+// Appends each partition's batches, acknowledged as the request's acks
+// say: -1 waits for them to commit, 1 for the leader and 0 for nothing,
+// not even an answer. Partitions answer with their first record's offset,
+// or -1 when it's pending.
+func (s *KafkaServer) produce(ctx context.Context, version int16, d *kafkaDecoder, e *kafkaEncoder) (respond bool, err error) {
+	d.string() // transactional ID
+	acks := d.int16()
+	d.int32() // timeout
+	topics := make([]string, max(d.arrayLen(), 0))
+	partitions := make([][]kafkaProducePartition, len(topics))
+	for i := range topics {
+		topics[i] = d.string()
+		partitions[i] = make([]kafkaProducePartition, max(d.arrayLen(), 0))
+		for j := range partitions[i] {
+			partitions[i][j] = kafkaProducePartition{index: d.int32(), records: d.bytes()}
+		}
+	}
+	if d.err != nil {
+		return false, d.err
+	}
+	ack := api.Ack_ACK_ALL
+	switch acks {
+	case 0:
+		ack = api.Ack_ACK_NONE
+	case 1:
+		ack = api.Ack_ACK_LEADER
+	}
+	for i, topic := range topics {
+		for j := range partitions[i] {
+			p := &partitions[i][j]
+			p.offset = -1
+			records, err := decodeRecordBatches(p.records)
+			if err == nil && len(records) == 0 {
+				err = errKafkaCorrupt
+			}
+			if err == nil && p.index < 0 {
+				err = api.ErrPartitionNotFound{Partition: uint32(p.index)}
+			}
+			var res *api.ProduceBatchResponse
+			if err == nil {
+				res, err = s.srv.ProduceBatch(ctx, &api.ProduceBatchRequest{
+					Records:   records,
+					Ack:       ack,
+					Topic:     topic,
+					Partition: uint32(p.index),
+				})
+			}
+			p.code = kafkaErrorCode(err)
+			if err == nil && !res.Pending {
+				// the base offset is the first record's the transform kept
+				for k, off := range res.Offsets {
+					if k >= len(res.Dropped) || !res.Dropped[k] {
+						p.offset = int64(off)
+						break
+					}
+				}
+			}
+		}
+	}
+	if acks == 0 {
+		return false, nil
+	}
+
+	e.arrayLen(len(topics))
+	for i, topic := range topics {
+		e.string(topic)
+		e.arrayLen(len(partitions[i]))
+		for _, p := range partitions[i] {
+			e.int32(p.index)
+			e.int16(p.code)
+			e.int64(p.offset)
+			e.int64(-1) // log append time, records keep their create time
+			if version >= 5 {
+				e.int64(-1) // log start offset
+			}
+		}
+	}
+	e.int32(0) // throttle time
+	return true, nil
+}
+
+type kafkaFetchPartition struct {
+	index    int32
+	offset   int64
+	maxBytes int32
+	code     int16
+	high     int64
+	low      int64
+	// next is the offset to read on from, and records what's been read
+	next    uint64
+	records []*api.Record
+	size    int
+}
+
+// Reads each partition from its fetch offset, holding the request until
+// the records add up to its min bytes or its max wait, bounded by
+// MaxConsumeWait, is up. Each partition reads up to its max bytes and the
+// request up to its own, but the first record read always is, so
+// consumers get past records bigger than their limits. A partition that
+// fails answers straight away.
+func (s *KafkaServer) fetch(ctx context.Context, version int16, d *kafkaDecoder, e *kafkaEncoder) error {
+	d.int32() // replica ID
+	maxWait := d.int32()
+	minBytes := d.int32()
+	maxBytes := d.int32()
+	d.int8() // isolation level, every record read is committed
+	if version >= 7 {
+		d.int32() // session ID
+		d.int32() // session epoch
+	}
+	topics := make([]string, max(d.arrayLen(), 0))
+	partitions := make([][]kafkaFetchPartition, len(topics))
+	for i := range topics {
+		topics[i] = d.string()
+		partitions[i] = make([]kafkaFetchPartition, max(d.arrayLen(), 0))
+		for j := range partitions[i] {
+			p := &partitions[i][j]
+			p.index = d.int32()
+			if version >= 9 {
+				d.int32() // current leader epoch
+			}
+			p.offset = d.int64()
+			if version >= 5 {
+				d.int64() // log start offset
+			}
+			p.maxBytes = d.int32()
+		}
+	}
+	if version >= 7 {
+		// forgotten topics, always none without sessions
+		for range max(d.arrayLen(), 0) {
+			d.string()
+			for range max(d.arrayLen(), 0) {
+				d.int32()
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	wait := min(time.Duration(maxWait)*time.Millisecond, s.srv.MaxConsumeWait)
+	// reads aren't cut short by it, the scan throttle may delay them past it
+	deadline, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	for i, topic := range topics {
+		err := s.srv.authorize(ctx, consumeAction, topicResource(topic))
+		for j := range partitions[i] {
+			p := &partitions[i][j]
+			p.code, p.high, p.low = kafkaErrorCode(err), -1, -1
+			p.next = uint64(p.offset)
+			if err == nil && p.offset < 0 {
+				p.code = kafkaOffsetOutOfRange
+			}
+		}
+	}
+	fetched := 0
+poll:
+	for {
+		failed := false
+		for i, topic := range topics {
+			for j := range partitions[i] {
+				p := &partitions[i][j]
+				if p.code == kafkaNone {
+					fetched += s.read(ctx, topic, p, int(maxBytes)-fetched, fetched == 0)
+				}
+				failed = failed || p.code != kafkaNone
+			}
+		}
+		if fetched >= int(minBytes) || failed {
+			break
+		}
+		select {
+		case <-deadline.Done():
+			break poll
+		case <-time.After(consumePollInterval):
+		}
+	}
+
+	e.int32(0) // throttle time
+	if version >= 7 {
+		e.int16(kafkaNone)
+		e.int32(0) // session ID, there are no sessions
+	}
+	e.arrayLen(len(topics))
+	for i, topic := range topics {
+		e.string(topic)
+		e.arrayLen(len(partitions[i]))
+		for _, p := range partitions[i] {
+			e.int32(p.index)
+			e.int16(p.code)
+			e.int64(p.high)
+			e.int64(p.high) // last stable offset
+			if version >= 5 {
+				e.int64(p.low)
+			}
+			e.arrayLen(-1) // aborted transactions
+			if len(p.records) == 0 {
+				e.bytes(nil)
+			} else {
+				e.bytes(encodeRecordBatch(p.records))
+			}
+		}
+	}
+	return nil
+}
+
+// Reads the partition's records on from where it got to, up to its max
+// bytes and the request's budget left or, when first, at least one,
+// returning the size of the records read
+func (s *KafkaServer) read(ctx context.Context, topic string, p *kafkaFetchPartition, budget int, first bool) int {
+	cl, err := s.srv.partition(topic, uint32(p.index))
+	if err == nil && p.index < 0 {
+		err = api.ErrPartitionNotFound{Partition: uint32(p.index)}
+	}
+	if err != nil {
+		p.code = kafkaErrorCode(err)
+		return 0
+	}
+	if sl, ok := cl.(statsLog); ok {
+		st := sl.Stats()
+		p.high, p.low = int64(st.HighWatermark), int64(st.LowWatermark)
+		if p.offset < p.low || p.offset > p.high {
+			p.code = kafkaOffsetOutOfRange
+			return 0
+		}
+	}
+	limit := min(int(p.maxBytes), budget)
+	read := 0
+	for {
+		res, next, err := s.srv.consume(ctx, cl, p.next)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return read
+		}
+		if err == nil {
+			err = codec.Decompress(res.Record)
+		}
+		if err != nil {
+			p.code = kafkaErrorCode(err)
+			return read
+		}
+		record := res.Record
+		size := len(record.Key) + len(record.Value)
+		if p.size+size > limit && !(first && len(p.records) == 0) {
+			return read
+		}
+		p.records = append(p.records, record)
+		p.size += size
+		read += size
+		p.next = next
+	}
+}
+
+type kafkaListOffsetsPartition struct {
+	index     int32
+	timestamp int64
+	code      int16
+	offset    int64
+}
+
+// Answers each partition's offset for its timestamp: -1 asks for its high
+// watermark, -2 for its low one, and any other timestamp, in milliseconds,
+// for the first record stamped at or after it, -1 if there's none
+func (s *KafkaServer) listOffsets(ctx context.Context, version int16, d *kafkaDecoder, e *kafkaEncoder) error {
+	d.int32() // replica ID
+	if version >= 2 {
+		d.int8() // isolation level
+	}
+	topics := make([]string, max(d.arrayLen(), 0))
+	partitions := make([][]kafkaListOffsetsPartition, len(topics))
+	for i := range topics {
+		topics[i] = d.string()
+		partitions[i] = make([]kafkaListOffsetsPartition, max(d.arrayLen(), 0))
+		for j := range partitions[i] {
+			p := &partitions[i][j]
+			p.index = d.int32()
+			if version >= 4 {
+				d.int32() // current leader epoch
+			}
+			p.timestamp = d.int64()
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	for i, topic := range topics {
+		authErr := s.srv.authorize(ctx, consumeAction, topicResource(topic))
+		for j := range partitions[i] {
+			p := &partitions[i][j]
+			err := authErr
+			if err == nil {
+				p.offset, p.timestamp, err = s.listOffset(topic, p.index, p.timestamp)
+			}
+			if p.code = kafkaErrorCode(err); err != nil {
+				p.offset, p.timestamp = -1, -1
+			}
+		}
+	}
+
+	if version >= 2 {
+		e.int32(0) // throttle time
+	}
+	e.arrayLen(len(topics))
+	for i, topic := range topics {
+		e.string(topic)
+		e.arrayLen(len(partitions[i]))
+		for _, p := range partitions[i] {
+			e.int32(p.index)
+			e.int16(p.code)
+			e.int64(p.timestamp)
+			e.int64(p.offset)
+			if version >= 4 {
+				e.int32(-1) // leader epoch
+			}
+		}
+	}
+	return nil
+}
+
+// Searches the partition's records for the offset the timestamp asks for,
+// as the client's OffsetForTime does, returning it with its record's
+// timestamp
+func (s *KafkaServer) listOffset(topic string, partition int32, timestamp int64) (off, at int64, err error) {
+	if partition < 0 {
+		return 0, 0, api.ErrPartitionNotFound{Partition: uint32(partition)}
+	}
+	cl, err := s.srv.partition(topic, uint32(partition))
+	if err != nil {
+		return 0, 0, err
+	}
+	sl, ok := cl.(statsLog)
+	if !ok {
+		return 0, 0, status.Error(codes.Unimplemented, "log doesn't report its offsets")
+	}
+	st := sl.Stats()
+	switch timestamp {
+	case -1:
+		return int64(st.HighWatermark), -1, nil
+	case -2:
+		return int64(st.LowWatermark), -1, nil
+	}
+	t := (time.Duration(timestamp) * time.Millisecond).Nanoseconds()
+	lo, err := s.srv.offsetForTime(topic, cl, st, t)
+	if err != nil {
+		return 0, 0, err
+	}
+	if lo == st.HighWatermark {
+		return -1, -1, nil
+	}
+	record, err := cl.Read(lo)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(record.Offset), time.Duration(record.Timestamp).Milliseconds(), nil
+}
@@ -0,0 +1,356 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/stretchr/testify/require"
+)
+
+// A Kafka client speaking just enough to test the listener
+type kafkaTestConn struct {
+	t             *testing.T
+	conn          net.Conn
+	correlationID int32
+}
+
+func setupKafka(t *testing.T, fn func(*Config)) (*kafkaTestConn, *Config) {
+	t.Helper()
+	_, config, teardown := setupTest(t, func(c *Config) {
+		// connections are authenticated by their certificates, which the
+		// test's plaintext ones have none of
+		c.Authenticator = auth.AuthenticatorFunc(func(ctx context.Context, creds auth.Credentials) (string, error) {
+			return "root", nil
+		})
+		if fn != nil {
+			fn(c)
+		}
+	})
+	t.Cleanup(teardown)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := NewKafkaServer(ln.Addr().String(), config)
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	return &kafkaTestConn{t: t, conn: conn}, config
+}
+
+// Sends the request, with the v1 header
+func (c *kafkaTestConn) send(key, version int16, body func(e *kafkaEncoder)) {
+	c.t.Helper()
+	e := &kafkaEncoder{}
+	c.correlationID++
+	e.int32(0)
+	e.int16(key)
+	e.int16(version)
+	e.int32(c.correlationID)
+	e.string("test")
+	body(e)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+	_, err := c.conn.Write(e.b)
+	require.NoError(c.t, err)
+}
+
+// Sends the request and reads its answer's body
+func (c *kafkaTestConn) call(key, version int16, body func(e *kafkaEncoder)) *kafkaDecoder {
+	c.t.Helper()
+	c.send(key, version, body)
+	var size [4]byte
+	_, err := io.ReadFull(c.conn, size[:])
+	require.NoError(c.t, err)
+	b := make([]byte, binary.BigEndian.Uint32(size[:]))
+	_, err = io.ReadFull(c.conn, b)
+	require.NoError(c.t, err)
+	d := &kafkaDecoder{b: b}
+	require.Equal(c.t, c.correlationID, d.int32())
+	return d
+}
+
+func (c *kafkaTestConn) metadata(topics ...string) map[string]kafkaTopicMetadata {
+	c.t.Helper()
+	d := c.call(kafkaMetadata, 5, func(e *kafkaEncoder) {
+		if topics == nil {
+			e.arrayLen(-1)
+		} else {
+			e.arrayLen(len(topics))
+			for _, topic := range topics {
+				e.string(topic)
+			}
+		}
+		e.bool(false)
+	})
+	d.int32() // throttle time
+	require.Equal(c.t, 1, d.arrayLen())
+	require.Equal(c.t, int32(kafkaNodeID), d.int32())
+	host, port := d.string(), d.int32()
+	require.Equal(c.t, c.conn.RemoteAddr().String(), net.JoinHostPort(host, strconv.Itoa(int(port))))
+	d.string() // rack
+	require.Equal(c.t, kafkaClusterID, d.string())
+	require.Equal(c.t, int32(kafkaNodeID), d.int32())
+	res := make(map[string]kafkaTopicMetadata)
+	for range d.arrayLen() {
+		t := kafkaTopicMetadata{code: d.int16(), name: d.string()}
+		d.bool()
+		t.partitions = uint32(d.arrayLen())
+		for range t.partitions {
+			require.Equal(c.t, kafkaNone, d.int16())
+			d.int32()
+			require.Equal(c.t, int32(kafkaNodeID), d.int32())
+			for range 3 {
+				for range d.arrayLen() {
+					d.int32()
+				}
+			}
+		}
+		res[t.name] = t
+	}
+	require.NoError(c.t, d.err)
+	return res
+}
+
+// Produces the batch, returning the partition's error code and base offset
+func (c *kafkaTestConn) produce(topic string, partition int32, acks int16, batch []byte) (int16, int64) {
+	c.t.Helper()
+	body := func(e *kafkaEncoder) {
+		e.int16(-1) // transactional ID
+		e.int16(acks)
+		e.int32(1000)
+		e.arrayLen(1)
+		e.string(topic)
+		e.arrayLen(1)
+		e.int32(partition)
+		e.bytes(batch)
+	}
+	if acks == 0 {
+		c.send(kafkaProduce, 7, body)
+		return kafkaNone, -1
+	}
+	d := c.call(kafkaProduce, 7, body)
+	require.Equal(c.t, 1, d.arrayLen())
+	require.Equal(c.t, topic, d.string())
+	require.Equal(c.t, 1, d.arrayLen())
+	require.Equal(c.t, partition, d.int32())
+	code, offset := d.int16(), d.int64()
+	d.int64() // log append time
+	d.int64() // log start offset
+	d.int32() // throttle time
+	require.NoError(c.t, d.err)
+	return code, offset
+}
+
+type kafkaTestFetch struct {
+	code      int16
+	high, low int64
+	records   []byte
+}
+
+func (c *kafkaTestConn) fetch(topic string, partition int32, offset int64, maxWait, minBytes int32) kafkaTestFetch {
+	c.t.Helper()
+	d := c.call(kafkaFetch, 10, func(e *kafkaEncoder) {
+		e.int32(-1) // replica ID
+		e.int32(maxWait)
+		e.int32(minBytes)
+		e.int32(1 << 20)
+		e.int8(0)
+		e.int32(0)  // session ID
+		e.int32(-1) // session epoch
+		e.arrayLen(1)
+		e.string(topic)
+		e.arrayLen(1)
+		e.int32(partition)
+		e.int32(-1) // leader epoch
+		e.int64(offset)
+		e.int64(-1)
+		e.int32(1 << 20)
+		e.arrayLen(0) // forgotten topics
+	})
+	d.int32() // throttle time
+	require.Equal(c.t, kafkaNone, d.int16())
+	d.int32() // session ID
+	require.Equal(c.t, 1, d.arrayLen())
+	require.Equal(c.t, topic, d.string())
+	require.Equal(c.t, 1, d.arrayLen())
+	require.Equal(c.t, partition, d.int32())
+	f := kafkaTestFetch{code: d.int16(), high: d.int64()}
+	d.int64() // last stable offset
+	f.low = d.int64()
+	require.Equal(c.t, -1, d.arrayLen())
+	f.records = d.bytes()
+	require.NoError(c.t, d.err)
+	return f
+}
+
+func (c *kafkaTestConn) listOffset(topic string, partition int32, timestamp int64) (int16, int64) {
+	c.t.Helper()
+	d := c.call(kafkaListOffsets, 5, func(e *kafkaEncoder) {
+		e.int32(-1) // replica ID
+		e.int8(0)
+		e.arrayLen(1)
+		e.string(topic)
+		e.arrayLen(1)
+		e.int32(partition)
+		e.int32(-1) // leader epoch
+		e.int64(timestamp)
+	})
+	d.int32() // throttle time
+	require.Equal(c.t, 1, d.arrayLen())
+	require.Equal(c.t, topic, d.string())
+	require.Equal(c.t, 1, d.arrayLen())
+	require.Equal(c.t, partition, d.int32())
+	code := d.int16()
+	d.int64() // timestamp
+	offset := d.int64()
+	d.int32() // leader epoch
+	require.NoError(c.t, d.err)
+	return code, offset
+}
+
+// Gzips the batch's records, as a producer compressing them would
+func gzipBatch(t *testing.T, batch []byte) []byte {
+	const recordsAt = 12 + kafkaBatchOverhead
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(batch[recordsAt:])
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	b := append(bytes.Clone(batch[:recordsAt]), buf.Bytes()...)
+	// attributes follow the offset, length, leader epoch, magic and CRC
+	b[22] |= kafkaCompressionGzip
+	binary.BigEndian.PutUint32(b[8:], uint32(len(b)-12))
+	binary.BigEndian.PutUint32(b[17:], crc32.Checksum(b[21:], kafkaCRCTable))
+	return b
+}
+
+func TestKafkaAPIVersions(t *testing.T) {
+	c, _ := setupKafka(t, nil)
+	for version, code := range map[int16]int16{3: kafkaUnsupportedVersion, 2: kafkaNone} {
+		d := c.call(kafkaAPIVersions, version, func(e *kafkaEncoder) {})
+		require.Equal(t, code, d.int16())
+		versions := make(map[int16][2]int16)
+		for range d.arrayLen() {
+			versions[d.int16()] = [2]int16{d.int16(), d.int16()}
+		}
+		require.Equal(t, [2]int16{4, 10}, versions[kafkaFetch])
+		require.Equal(t, [2]int16{3, 7}, versions[kafkaProduce])
+		require.NoError(t, d.err)
+	}
+}
+
+func TestKafka(t *testing.T) {
+	c, config := setupKafka(t, nil)
+	require.NoError(t, config.CommitLog.(topicLog).CreateTopic(&api.Topic{Name: "events", Partitions: 2}))
+
+	topics := c.metadata()
+	require.Equal(t, uint32(2), topics["events"].partitions)
+	require.Contains(t, topics, "default")
+	require.Equal(t, kafkaUnknownTopicOrPartition, c.metadata("missing")["missing"].code)
+
+	start := time.UnixMilli(time.Now().UnixMilli())
+	batch := encodeRecordBatch([]*api.Record{
+		{Key: []byte("a"), Value: []byte("first"), Timestamp: start.UnixNano(), Headers: []*api.Header{{Key: "host", Value: []byte("web-1")}}},
+		{Value: []byte("second"), Offset: 1, Timestamp: start.Add(time.Second).UnixNano()},
+	})
+	code, offset := c.produce("events", 1, -1, batch)
+	require.Equal(t, kafkaNone, code)
+	require.Equal(t, int64(0), offset)
+	code, offset = c.produce("events", 1, 1, gzipBatch(t, encodeRecordBatch([]*api.Record{
+		{Value: []byte("third"), Timestamp: start.Add(2 * time.Second).UnixNano()},
+	})))
+	require.Equal(t, kafkaNone, code)
+	// acks=0 takes no answer, the next call reading its own
+	c.produce("events", 1, 0, encodeRecordBatch([]*api.Record{{Value: []byte("fourth")}}))
+
+	code, _ = c.produce("missing", 0, -1, batch)
+	require.Equal(t, kafkaUnknownTopicOrPartition, code)
+	corrupt := bytes.Clone(batch)
+	corrupt[len(corrupt)-1]++
+	code, _ = c.produce("events", 1, -1, corrupt)
+	require.Equal(t, kafkaCorruptMessage, code)
+
+	require.Eventually(t, func() bool {
+		return c.fetch("events", 1, 0, 0, 1).high == 4
+	}, time.Second, 10*time.Millisecond)
+	f := c.fetch("events", 1, 1, 0, 1)
+	require.Equal(t, kafkaNone, f.code)
+	require.Equal(t, int64(0), f.low)
+	require.Equal(t, int64(1), int64(binary.BigEndian.Uint64(f.records)))
+	records, err := decodeRecordBatches(f.records)
+	require.NoError(t, err)
+	require.Len(t, records, 3)
+	require.Equal(t, []byte("second"), records[0].Value)
+	require.Equal(t, start.Add(time.Second).UnixNano(), records[0].Timestamp)
+	require.Equal(t, []byte("fourth"), records[2].Value)
+	f = c.fetch("events", 1, 0, 0, 1)
+	records, err = decodeRecordBatches(f.records)
+	require.NoError(t, err)
+	require.Equal(t, []byte("a"), records[0].Key)
+	require.Equal(t, "host", records[0].Headers[0].Key)
+	require.Equal(t, []byte("web-1"), records[0].Headers[0].Value)
+
+	// fetches at the end wait for records
+	begin := time.Now()
+	f = c.fetch("events", 1, 4, 100, 1)
+	require.Equal(t, kafkaNone, f.code)
+	require.Empty(t, f.records)
+	require.GreaterOrEqual(t, time.Since(begin), 100*time.Millisecond)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cl, _ := config.partition("events", 1)
+		cl.Append(&api.Record{Value: []byte("fifth")})
+	}()
+	f = c.fetch("events", 1, 4, 5000, 1)
+	records, err = decodeRecordBatches(f.records)
+	require.NoError(t, err)
+	require.Equal(t, []byte("fifth"), records[0].Value)
+	require.Equal(t, kafkaOffsetOutOfRange, c.fetch("events", 1, 100, 0, 1).code)
+	require.Equal(t, kafkaUnknownTopicOrPartition, c.fetch("events", 2, 0, 0, 1).code)
+
+	for timestamp, want := range map[int64]int64{
+		-2:                                      0,
+		-1:                                      5,
+		start.UnixMilli():                       0,
+		start.Add(time.Second).UnixMilli():      1,
+		start.Add(time.Millisecond).UnixMilli(): 1,
+		start.Add(time.Hour).UnixMilli():        -1,
+	} {
+		code, offset := c.listOffset("events", 1, timestamp)
+		require.Equal(t, kafkaNone, code)
+		require.Equal(t, want, offset, timestamp)
+	}
+}
+
+func TestKafkaAuthorization(t *testing.T) {
+	c, config := setupKafka(t, func(c *Config) {
+		c.Authenticator = auth.AuthenticatorFunc(func(ctx context.Context, creds auth.Credentials) (string, error) {
+			return "events", nil
+		})
+	})
+	require.NoError(t, config.CommitLog.(topicLog).CreateTopic(&api.Topic{Name: "events", Partitions: 1}))
+
+	// only what the caller may produce to or consume from is listed
+	topics := c.metadata()
+	require.Equal(t, []string{"events"}, []string{topics["events"].name})
+	require.Len(t, topics, 1)
+	require.Equal(t, kafkaTopicAuthorizationFailed, c.metadata("default")["default"].code)
+
+	code, _ := c.produce("events", 0, -1, encodeRecordBatch([]*api.Record{{Value: []byte("first")}}))
+	require.Equal(t, kafkaNone, code)
+	code, _ = c.produce("default", 0, -1, encodeRecordBatch([]*api.Record{{Value: []byte("first")}}))
+	require.Equal(t, kafkaTopicAuthorizationFailed, code)
+	require.Equal(t, kafkaTopicAuthorizationFailed, c.fetch("events", 0, 0, 0, 1).code)
+	code, _ = c.listOffset("events", 0, -1)
+	require.Equal(t, kafkaTopicAuthorizationFailed, code)
+}
@@ -0,0 +1,846 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"go.uber.org/zap"
+)
+
+// How long a mirror that's caught up waits to fetch again, and how long a
+// request to a broker may take
+var (
+	kafkaMirrorPollInterval   = 200 * time.Millisecond
+	kafkaMirrorRequestTimeout = 30 * time.Second
+)
+
+// A mirror redials the cluster after a backoff doubling from the first up
+// to the last, and rereads its metadata this often
+const (
+	kafkaMirrorMinBackoff       = time.Second
+	kafkaMirrorMaxBackoff       = time.Minute
+	kafkaMirrorMetadataInterval = 30 * time.Second
+)
+
+// How much a fetch takes from each partition, and in all
+const (
+	kafkaMirrorPartitionBytes = 1 << 20
+	kafkaMirrorFetchBytes     = 16 << 20
+)
+
+// The versions of the Kafka APIs a mirror asks with, each broker from
+// Kafka 1.0 on speaking them
+const (
+	kafkaMirrorMetadataVersion    = 4
+	kafkaMirrorListOffsetsVersion = 1
+	kafkaMirrorFetchVersion       = 4
+)
+
+// KafkaMirrorConfig mirrors topics of an external Kafka cluster into
+// topics, so producers and consumers can move over a few at a time
+type KafkaMirrorConfig struct {
+	// Brokers are the host:port addresses of some of the cluster's
+	// brokers, the mirror learns the rest from them
+	Brokers []string `json:"brokers"`
+	// TLS dials the brokers over TLS, verified with TLSConfig or, when
+	// it's nil, the system roots. There's no SASL.
+	TLS       bool        `json:"tls,omitempty"`
+	TLSConfig *tls.Config `json:"-"`
+	// ClientID names the mirror to the brokers, "proglog" if it's empty
+	ClientID string        `json:"client_id,omitempty"`
+	Mirrors  []KafkaMirror `json:"mirrors"`
+}
+
+// KafkaMirror appends the records of the cluster's Topics, and of the
+// topics whose whole names match Pattern, to Topic or, when it's empty, to
+// the topic of the same name, which must exist. A source partition's
+// records go in order to the destination partition of its index modulo
+// the destination's partitions, keeping their keys, timestamps and
+// headers.
+//
+// Each destination partition's leader mirrors the source partitions going
+// to it, at least once, from a cursor of their offsets kept under Name.
+// Partitions without one start at the earliest record the cluster has, or
+// at its latest with Start "latest". Records of aborted transactions are
+// mirrored as any others.
+type KafkaMirror struct {
+	Name    string   `json:"name"`
+	Topics  []string `json:"topics,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+	Topic   string   `json:"topic,omitempty"`
+	Start   string   `json:"start,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// LoadKafkaMirror reads a mirror's config from the JSON file at path
+func LoadKafkaMirror(path string) (*KafkaMirrorConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mirror := &KafkaMirrorConfig{}
+	if err := json.Unmarshal(b, mirror); err != nil {
+		return nil, fmt.Errorf("kafka mirror %s: %w", path, err)
+	}
+	if err := mirror.validate(); err != nil {
+		return nil, fmt.Errorf("kafka mirror %s: %w", path, err)
+	}
+	return mirror, nil
+}
+
+func (m *KafkaMirrorConfig) validate() error {
+	if len(m.Brokers) == 0 {
+		return errors.New("no brokers")
+	}
+	for _, addr := range m.Brokers {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("broker %q: %w", addr, err)
+		}
+	}
+	names := make(map[string]bool)
+	for i := range m.Mirrors {
+		mir := &m.Mirrors[i]
+		if mir.Name == "" || names[mir.Name] {
+			return fmt.Errorf("missing or repeated mirror name %q", mir.Name)
+		}
+		names[mir.Name] = true
+		if len(mir.Topics) == 0 && mir.Pattern == "" {
+			return fmt.Errorf("mirror %s: no topics or pattern", mir.Name)
+		}
+		if mir.Pattern != "" {
+			var err error
+			if mir.pattern, err = regexp.Compile("^(?:" + mir.Pattern + ")$"); err != nil {
+				return fmt.Errorf("mirror %s: %w", mir.Name, err)
+			}
+		}
+		if mir.Topic != "" {
+			if err := log.ValidateTopic(mir.Topic); err != nil {
+				return fmt.Errorf("mirror %s: %w", mir.Name, err)
+			}
+		}
+		for _, topic := range mir.Topics {
+			if topic == "" {
+				return fmt.Errorf("mirror %s: empty topic", mir.Name)
+			}
+		}
+		if mir.Start != "" && mir.Start != "earliest" && mir.Start != "latest" {
+			return fmt.Errorf("mirror %s: start %q isn't earliest or latest", mir.Name, mir.Start)
+		}
+	}
+	return nil
+}
+
+// Whether the mirror takes the cluster's topic
+func (mir *KafkaMirror) takes(topic string) bool {
+	return slices.Contains(mir.Topics, topic) || mir.pattern != nil && mir.pattern.MatchString(topic)
+}
+
+// MirrorKafka runs the mirrors for the server config serves, redialing the
+// cluster whenever a session with it fails, until stop is called. Call
+// stop before closing the commit log.
+func MirrorKafka(mirror *KafkaMirrorConfig, config *Config) (stop func()) {
+	m := &kafkaMirror{mirror: mirror, config: withDefaults(config)}
+	if mirror.ClientID == "" {
+		m.clientID = "proglog"
+	} else {
+		m.clientID = mirror.ClientID
+	}
+	m.logger = m.config.Logger.With(zap.Strings("kafka", mirror.Brokers))
+	// configs not loaded by LoadKafkaMirror have their patterns compiled
+	if err := mirror.validate(); err != nil {
+		m.logger.Error("invalid kafka mirror", zap.Error(err))
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		m.run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+type kafkaMirror struct {
+	mirror   *KafkaMirrorConfig
+	config   *Config
+	clientID string
+	logger   *zap.Logger
+}
+
+// A source partition a mirror takes, and the partition it goes to
+type kafkaMirrorSource struct {
+	mirror    *KafkaMirror
+	topic     string
+	partition int32
+	// leader is the node ID of the broker leading the partition
+	leader        int32
+	dest          string
+	destPartition uint32
+}
+
+// Identifies a source across metadata reads, keying its cursor
+type kafkaSourceKey struct {
+	mirror    string
+	topic     string
+	partition int32
+}
+
+func (src *kafkaMirrorSource) key() kafkaSourceKey {
+	return kafkaSourceKey{src.mirror.Name, src.topic, src.partition}
+}
+
+func (src *kafkaMirrorSource) group() string {
+	return "__kafka-mirror." + src.mirror.Name
+}
+
+// The topic the source's cursor is committed for, named so it can't be a
+// topic's and get its lag reported against one
+func (src *kafkaMirrorSource) cursorTopic() string {
+	return "kafka/" + src.topic
+}
+
+func (m *kafkaMirror) run(ctx context.Context) {
+	var backoff time.Duration
+	for {
+		connected, err := m.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = 0
+		}
+		backoff = min(max(2*backoff, kafkaMirrorMinBackoff), kafkaMirrorMaxBackoff)
+		m.logger.Warn("kafka mirror session ended", zap.Duration("retry_in", backoff), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// Reads the cluster's metadata and mirrors its partitions until a request
+// fails or ctx is done, reporting whether it got the metadata
+func (m *kafkaMirror) session(ctx context.Context) (connected bool, err error) {
+	c := &kafkaCluster{mirror: m, conns: make(map[int32]*kafkaBrokerConn)}
+	defer c.close()
+	sources, err := m.refresh(ctx, c)
+	if err != nil {
+		return false, err
+	}
+	m.logger.Info("kafka mirror connected", zap.Int("brokers", len(c.brokers)), zap.Int("partitions", len(sources)))
+	// the cursors of the partitions this server's mirroring, read from
+	// the groups' commits when it starts to
+	cursors := make(map[kafkaSourceKey]int64)
+	refreshed := time.Now()
+	for {
+		if c.stale || time.Since(refreshed) >= kafkaMirrorMetadataInterval {
+			if sources, err = m.refresh(ctx, c); err != nil {
+				return true, err
+			}
+			refreshed, c.stale = time.Now(), false
+		}
+		mirrored, err := m.round(ctx, c, sources, cursors)
+		if err != nil {
+			return true, err
+		}
+		wait := kafkaMirrorPollInterval
+		if mirrored {
+			wait = 0
+		}
+		select {
+		case <-ctx.Done():
+			return true, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Rereads the cluster's metadata, returning the partitions the mirrors
+// take in topic and partition order. Topics whose destination is missing
+// are logged and left out until the next read.
+func (m *kafkaMirror) refresh(ctx context.Context, c *kafkaCluster) ([]*kafkaMirrorSource, error) {
+	topics, err := c.metadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(topics))
+	for name := range topics {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var sources []*kafkaMirrorSource
+	for i := range m.mirror.Mirrors {
+		mir := &m.mirror.Mirrors[i]
+		for _, name := range names {
+			if !mir.takes(name) {
+				continue
+			}
+			dest := mir.Topic
+			if dest == "" {
+				dest = name
+			}
+			topic, err := m.config.describeTopic(dest)
+			if err != nil {
+				m.logger.Warn("kafka mirror can't append to its topic",
+					zap.String("mirror", mir.Name), zap.String("source", name), zap.String("topic", dest), zap.Error(err))
+				continue
+			}
+			for p, leader := range topics[name] {
+				sources = append(sources, &kafkaMirrorSource{
+					mirror:        mir,
+					topic:         name,
+					partition:     int32(p),
+					leader:        leader,
+					dest:          dest,
+					destPartition: uint32(p) % topic.Partitions,
+				})
+			}
+		}
+	}
+	return sources, nil
+}
+
+// Fetches once from each broker leading partitions of sources whose
+// destinations this server leads, appending what's fetched, and reports
+// whether anything was
+func (m *kafkaMirror) round(ctx context.Context, c *kafkaCluster, sources []*kafkaMirrorSource, cursors map[kafkaSourceKey]int64) (mirrored bool, err error) {
+	byLeader := make(map[int32][]*kafkaMirrorSource)
+	var leaders []int32
+	for _, src := range sources {
+		cl, err := m.config.partition(src.dest, src.destPartition)
+		if err != nil || notLeading(cl) != nil {
+			// another server mirrors it, or the topic's gone and the
+			// next metadata read leaves it out
+			delete(cursors, src.key())
+			continue
+		}
+		if src.leader < 0 {
+			continue
+		}
+		if _, ok := cursors[src.key()]; !ok {
+			off, err := m.cursor(ctx, c, src)
+			if err != nil {
+				return mirrored, err
+			}
+			cursors[src.key()] = off
+		}
+		if _, ok := byLeader[src.leader]; !ok {
+			leaders = append(leaders, src.leader)
+		}
+		byLeader[src.leader] = append(byLeader[src.leader], src)
+	}
+	for _, leader := range leaders {
+		fetched, err := c.fetch(ctx, leader, byLeader[leader], cursors)
+		if err != nil {
+			return mirrored, err
+		}
+		for _, f := range fetched {
+			mirroredOne, err := m.mirrorFetched(ctx, c, f, cursors)
+			if err != nil {
+				return mirrored, err
+			}
+			mirrored = mirrored || mirroredOne
+		}
+	}
+	return mirrored, nil
+}
+
+// The source's cursor, committed at the mirror's start when it has none
+func (m *kafkaMirror) cursor(ctx context.Context, c *kafkaCluster, src *kafkaMirrorSource) (int64, error) {
+	offsets, err := m.config.fetchGroupOffsets(&api.FetchGroupOffsetsRequest{
+		Group:      src.group(),
+		Partitions: []*api.GroupOffset{{Topic: src.cursorTopic(), Partition: uint32(src.partition)}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if offsets[0].Found {
+		return int64(offsets[0].Offset), nil
+	}
+	timestamp := int64(-2)
+	if src.mirror.Start == "latest" {
+		timestamp = -1
+	}
+	off, err := c.listOffset(ctx, src, timestamp)
+	if err != nil {
+		return 0, err
+	}
+	if err := m.commit(ctx, src, off); err != nil {
+		return 0, err
+	}
+	return off, nil
+}
+
+// A partition's answer to a fetch
+type kafkaFetched struct {
+	src  *kafkaMirrorSource
+	code int16
+	high int64
+	// records are the partition's records from the fetch offset on, and
+	// next the offset after the last batch fetched, -1 if there's none
+	records []*api.Record
+	next    int64
+}
+
+// Appends the records a partition was fetched, committing its cursor past
+// them, and reports whether there were any
+func (m *kafkaMirror) mirrorFetched(ctx context.Context, c *kafkaCluster, f kafkaFetched, cursors map[kafkaSourceKey]int64) (bool, error) {
+	src := f.src
+	logger := m.logger.With(zap.String("mirror", src.mirror.Name), zap.String("source", src.topic), zap.Int32("partition", src.partition))
+	switch f.code {
+	case kafkaNone:
+	case kafkaOffsetOutOfRange:
+		// the cluster's removed the records past the cursor, so the
+		// mirror picks up from its earliest
+		off, err := c.listOffset(ctx, src, -2)
+		if err != nil {
+			return false, err
+		}
+		logger.Warn("kafka mirror's cursor out of range, starting over from the earliest record",
+			zap.Int64("cursor", cursors[src.key()]), zap.Int64("earliest", off))
+		if err := m.commit(ctx, src, off); err != nil {
+			return false, err
+		}
+		cursors[src.key()] = off
+		return false, nil
+	default:
+		// the partition's moved or gone, which the metadata tells
+		logger.Info("kafka mirror fetch failed", zap.Int16("error_code", f.code))
+		c.stale = true
+		return false, nil
+	}
+	cursor := cursors[src.key()]
+	kafkaMirrorLag.WithLabelValues(src.mirror.Name, src.topic, strconv.Itoa(int(src.partition))).Set(float64(max(f.high-cursor, 0)))
+	if f.next < 0 {
+		return false, nil
+	}
+	// batches start before the cursor when it's in one of them
+	records := slices.DeleteFunc(f.records, func(r *api.Record) bool { return int64(r.Offset) < cursor })
+	for _, record := range records {
+		record.Offset = 0
+	}
+	if len(records) > 0 {
+		if err := m.append(ctx, src, records, logger); err != nil {
+			return false, err
+		}
+	}
+	next := max(f.next, cursor)
+	if next == cursor {
+		return false, nil
+	}
+	if err := m.commit(ctx, src, next); err != nil {
+		return false, err
+	}
+	cursors[src.key()] = next
+	kafkaMirrorLag.WithLabelValues(src.mirror.Name, src.topic, strconv.Itoa(int(src.partition))).Set(float64(max(f.high-next, 0)))
+	return true, nil
+}
+
+// Appends the records to the source's destination. Records the topic
+// refuses, too large or not its schema's, are dropped rather than holding
+// up the rest.
+func (m *kafkaMirror) append(ctx context.Context, src *kafkaMirrorSource, records []*api.Record, logger *zap.Logger) error {
+	cl, err := m.config.partition(src.dest, src.destPartition)
+	if err != nil {
+		return err
+	}
+	_, _, err = m.config.appendBatchTo(ctx, cl, records, api.Ack_ACK_ALL, src.dest, src.destPartition)
+	if !refusedRecord(err) {
+		if err == nil {
+			kafkaMirrorRecords.WithLabelValues(src.mirror.Name).Add(float64(len(records)))
+		}
+		return err
+	}
+	for _, record := range records {
+		_, _, err := m.config.appendTo(ctx, cl, record, api.Ack_ACK_ALL, src.dest, src.destPartition)
+		if refusedRecord(err) {
+			kafkaMirrorRecordsDropped.WithLabelValues(src.mirror.Name).Inc()
+			logger.Warn("kafka mirror dropped a record the topic refused", zap.String("topic", src.dest), zap.Error(err))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		kafkaMirrorRecords.WithLabelValues(src.mirror.Name).Inc()
+	}
+	return nil
+}
+
+// Whether the error is a topic refusing a record for what it holds
+func refusedRecord(err error) bool {
+	return errors.As(err, &api.ErrRecordTooLarge{}) || errors.As(err, &api.ErrSchemaViolation{}) ||
+		errors.As(err, &api.ErrRecordRejected{}) || errors.As(err, &api.ErrInvalidTimestamp{})
+}
+
+func (m *kafkaMirror) commit(ctx context.Context, src *kafkaMirrorSource, off int64) error {
+	err := m.config.commitGroupOffsets(ctx, &api.CommitGroupOffsetsRequest{
+		Group:   src.group(),
+		Offsets: []*api.GroupOffset{{Topic: src.cursorTopic(), Partition: uint32(src.partition), Offset: uint64(off)}},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("committing cursor: %w", err)
+	}
+	return nil
+}
+
+// kafkaError is a Kafka error code a broker answered with
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	return fmt.Sprintf("kafka error code %d", int16(e))
+}
+
+// A session's view of the cluster, and its connections to the brokers
+type kafkaCluster struct {
+	mirror *kafkaMirror
+	// brokers are the brokers' addresses by node ID
+	brokers map[int32]string
+	conns   map[int32]*kafkaBrokerConn
+	// stale has the metadata read again before the next round
+	stale bool
+}
+
+func (c *kafkaCluster) close() {
+	for _, conn := range c.conns {
+		conn.conn.Close()
+	}
+}
+
+// The connection to the broker with the node ID, dialed if there's none
+func (c *kafkaCluster) conn(ctx context.Context, node int32) (*kafkaBrokerConn, error) {
+	if conn, ok := c.conns[node]; ok {
+		return conn, nil
+	}
+	addr, ok := c.brokers[node]
+	if !ok {
+		return nil, fmt.Errorf("kafka broker %d isn't in the metadata", node)
+	}
+	conn, err := c.mirror.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[node] = conn
+	return conn, nil
+}
+
+// Reads the metadata of every topic from the first of the configured
+// brokers that answers, returning the leaders of each topic's partitions
+// in partition order, -1 for those without one. Kafka's internal topics
+// are left out.
+func (c *kafkaCluster) metadata(ctx context.Context) (map[string][]int32, error) {
+	var errs []error
+	for _, addr := range c.mirror.mirror.Brokers {
+		conn, err := c.mirror.dial(ctx, addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		e := &kafkaEncoder{}
+		e.arrayLen(-1) // every topic
+		e.bool(false)  // allow auto topic creation
+		d, err := conn.call(ctx, kafkaMetadata, kafkaMirrorMetadataVersion, e)
+		conn.conn.Close()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		return c.readMetadata(d)
+	}
+	return nil, errors.Join(errs...)
+}
+
+func (c *kafkaCluster) readMetadata(d *kafkaDecoder) (map[string][]int32, error) {
+	d.int32() // throttle time
+	brokers := make(map[int32]string)
+	for range max(d.arrayLen(), 0) {
+		node := d.int32()
+		host := d.string()
+		port := d.int32()
+		d.string() // rack
+		brokers[node] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster ID
+	d.int32()  // controller
+	topics := make(map[string][]int32)
+	for range max(d.arrayLen(), 0) {
+		code := d.int16()
+		name := d.string()
+		internal := d.bool()
+		var leaders []int32
+		for range max(d.arrayLen(), 0) {
+			pcode := d.int16()
+			p := d.int32()
+			leader := d.int32()
+			for range max(d.arrayLen(), 0) {
+				d.int32() // replicas
+			}
+			for range max(d.arrayLen(), 0) {
+				d.int32() // in sync replicas
+			}
+			if pcode != kafkaNone && pcode != kafkaLeaderNotAvailable {
+				leader = -1
+			}
+			if p >= 0 && int(p) < 1<<16 {
+				if int(p) >= len(leaders) {
+					leaders = append(leaders, make([]int32, int(p)+1-len(leaders))...)
+				}
+				leaders[p] = leader
+			}
+		}
+		if code == kafkaNone && !internal {
+			topics[name] = leaders
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	// connections to brokers that moved are dialed afresh
+	for node, conn := range c.conns {
+		if brokers[node] != c.brokers[node] {
+			conn.conn.Close()
+			delete(c.conns, node)
+		}
+	}
+	c.brokers = brokers
+	return topics, nil
+}
+
+// The offset of the source's partition for the timestamp, -1 for its high
+// watermark and -2 for its low one
+func (c *kafkaCluster) listOffset(ctx context.Context, src *kafkaMirrorSource, timestamp int64) (int64, error) {
+	conn, err := c.conn(ctx, src.leader)
+	if err != nil {
+		return 0, err
+	}
+	e := &kafkaEncoder{}
+	e.int32(-1) // replica ID
+	e.arrayLen(1)
+	e.string(src.topic)
+	e.arrayLen(1)
+	e.int32(src.partition)
+	e.int64(timestamp)
+	d, err := conn.call(ctx, kafkaListOffsets, kafkaMirrorListOffsetsVersion, e)
+	if err != nil {
+		return 0, err
+	}
+	off, code := int64(-1), kafkaUnknownServerError
+	for range max(d.arrayLen(), 0) {
+		topic := d.string()
+		for range max(d.arrayLen(), 0) {
+			p := d.int32()
+			pcode := d.int16()
+			d.int64() // timestamp
+			poff := d.int64()
+			if topic == src.topic && p == src.partition {
+				off, code = poff, pcode
+			}
+		}
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	if code != kafkaNone {
+		c.stale = true
+		return 0, fmt.Errorf("listing %s/%d's offsets: %w", src.topic, src.partition, kafkaError(code))
+	}
+	return off, nil
+}
+
+// Fetches the sources' partitions, which the broker leads, from their
+// cursors, without waiting for records
+func (c *kafkaCluster) fetch(ctx context.Context, leader int32, sources []*kafkaMirrorSource, cursors map[kafkaSourceKey]int64) ([]kafkaFetched, error) {
+	conn, err := c.conn(ctx, leader)
+	if err != nil {
+		return nil, err
+	}
+	type partitionKey struct {
+		topic     string
+		partition int32
+	}
+	// a partition more than one mirror takes is fetched for each
+	byPartition := make(map[partitionKey][]*kafkaMirrorSource)
+	var topics []string
+	byTopic := make(map[string][]int32)
+	for _, src := range sources {
+		key := partitionKey{src.topic, src.partition}
+		if len(byPartition[key]) == 0 {
+			if _, ok := byTopic[src.topic]; !ok {
+				topics = append(topics, src.topic)
+			}
+			byTopic[src.topic] = append(byTopic[src.topic], src.partition)
+		}
+		byPartition[key] = append(byPartition[key], src)
+	}
+	// each partition's fetched from the cursor furthest behind, the
+	// others skipping what they're past
+	from := func(key partitionKey) int64 {
+		off := int64(-1)
+		for _, src := range byPartition[key] {
+			if off < 0 || cursors[src.key()] < off {
+				off = cursors[src.key()]
+			}
+		}
+		return off
+	}
+	e := &kafkaEncoder{}
+	e.int32(-1) // replica ID
+	e.int32(0)  // max wait
+	e.int32(0)  // min bytes
+	e.int32(kafkaMirrorFetchBytes)
+	e.int8(0) // isolation level, read uncommitted
+	e.arrayLen(len(topics))
+	for _, topic := range topics {
+		e.string(topic)
+		e.arrayLen(len(byTopic[topic]))
+		for _, p := range byTopic[topic] {
+			e.int32(p)
+			e.int64(from(partitionKey{topic, p}))
+			e.int32(kafkaMirrorPartitionBytes)
+		}
+	}
+	d, err := conn.call(ctx, kafkaFetch, kafkaMirrorFetchVersion, e)
+	if err != nil {
+		return nil, err
+	}
+	d.int32() // throttle time
+	var fetched []kafkaFetched
+	for range max(d.arrayLen(), 0) {
+		topic := d.string()
+		for range max(d.arrayLen(), 0) {
+			p := d.int32()
+			code := d.int16()
+			high := d.int64()
+			d.int64() // last stable offset
+			for range max(d.arrayLen(), 0) {
+				d.int64() // aborted transaction's producer ID
+				d.int64() // and first offset
+			}
+			b := d.bytes()
+			if d.err != nil {
+				return nil, d.err
+			}
+			var records []*api.Record
+			next := int64(-1)
+			if code == kafkaNone {
+				if records, next, err = decodeFetchedBatches(b); err != nil {
+					return nil, fmt.Errorf("fetching %s/%d: %w", topic, p, err)
+				}
+			}
+			for i, src := range byPartition[partitionKey{topic, p}] {
+				f := kafkaFetched{src: src, code: code, high: high, records: records, next: next}
+				if i > 0 {
+					// each mirror's records are its own to change
+					f.records = cloneRecords(records)
+				}
+				fetched = append(fetched, f)
+			}
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return fetched, nil
+}
+
+func cloneRecords(records []*api.Record) []*api.Record {
+	clones := make([]*api.Record, len(records))
+	for i, r := range records {
+		clones[i] = &api.Record{Key: r.Key, Value: r.Value, Headers: r.Headers, Timestamp: r.Timestamp, Offset: r.Offset}
+	}
+	return clones
+}
+
+// A connection to one of the cluster's brokers, sending one request at a
+// time
+type kafkaBrokerConn struct {
+	conn          net.Conn
+	r             *bufio.Reader
+	clientID      string
+	correlationID int32
+}
+
+func (m *kafkaMirror) dial(ctx context.Context, addr string) (*kafkaBrokerConn, error) {
+	ctx, cancel := context.WithTimeout(ctx, kafkaMirrorRequestTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if m.mirror.TLS {
+		config := &tls.Config{}
+		if m.mirror.TLSConfig != nil {
+			config = m.mirror.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		tc := tls.Client(conn, config)
+		if err := tc.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+	return &kafkaBrokerConn{conn: conn, r: bufio.NewReader(conn), clientID: m.clientID}, nil
+}
+
+// Sends the request, with the v1 header, and reads its answer's body past
+// the v0 header. The request's abandoned once ctx is done.
+func (c *kafkaBrokerConn) call(ctx context.Context, key, version int16, body *kafkaEncoder) (*kafkaDecoder, error) {
+	ctx, cancel := context.WithTimeout(ctx, kafkaMirrorRequestTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	c.conn.SetDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() { c.conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	c.correlationID++
+	e := &kafkaEncoder{}
+	e.int32(0) // size, filled in once it's known
+	e.int16(key)
+	e.int16(version)
+	e.int32(c.correlationID)
+	e.string(c.clientID)
+	e.b = append(e.b, body.b...)
+	binary.BigEndian.PutUint32(e.b, uint32(len(e.b)-4))
+	if _, err := c.conn.Write(e.b); err != nil {
+		return nil, err
+	}
+	var size [4]byte
+	if _, err := io.ReadFull(c.r, size[:]); err != nil {
+		return nil, err
+	}
+	n := int32(binary.BigEndian.Uint32(size[:]))
+	if n < 4 || n > kafkaMaxRequestSize {
+		return nil, errKafkaMalformed
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, err
+	}
+	d := &kafkaDecoder{b: b}
+	if id := d.int32(); id != c.correlationID {
+		return nil, fmt.Errorf("kafka %s answer %d to request %d", kafkaAPIName(key), id, c.correlationID)
+	}
+	return d, nil
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadKafkaMirror(t *testing.T) {
+	dir := t.TempDir()
+	load := func(body string) (*KafkaMirrorConfig, error) {
+		path := filepath.Join(dir, "mirror.json")
+		require.NoError(t, os.WriteFile(path, []byte(body), 0o600))
+		return LoadKafkaMirror(path)
+	}
+	mirror, err := load(`{
+		"brokers": ["kafka-1:9092", "kafka-2:9092"],
+		"mirrors": [
+			{"name": "orders", "topics": ["orders"]},
+			{"name": "audit", "pattern": "audit\\..*", "topic": "audit", "start": "latest"}
+		]
+	}`)
+	require.NoError(t, err)
+	require.Len(t, mirror.Mirrors, 2)
+	require.True(t, mirror.Mirrors[0].takes("orders"))
+	require.True(t, mirror.Mirrors[1].takes("audit.eu"))
+	// patterns match whole names
+	require.False(t, mirror.Mirrors[1].takes("old.audit.eu"))
+
+	for _, body := range []string{
+		`{"mirrors": [{"name": "orders", "topics": ["orders"]}]}`,
+		`{"brokers": ["kafka-1"], "mirrors": [{"name": "orders", "topics": ["orders"]}]}`,
+		`{"brokers": ["kafka-1:9092"], "mirrors": [{"topics": ["orders"]}]}`,
+		`{"brokers": ["kafka-1:9092"], "mirrors": [{"name": "orders"}]}`,
+		`{"brokers": ["kafka-1:9092"], "mirrors": [{"name": "a", "pattern": "("}]}`,
+		`{"brokers": ["kafka-1:9092"], "mirrors": [{"name": "a", "topics": ["a"], "topic": "a/b"}]}`,
+		`{"brokers": ["kafka-1:9092"], "mirrors": [{"name": "a", "topics": ["a"], "start": "now"}]}`,
+		`{"brokers": ["kafka-1:9092"], "mirrors": [{"name": "a", "topics": ["a"]}, {"name": "a", "topics": ["b"]}]}`,
+	} {
+		_, err := load(body)
+		require.Error(t, err, body)
+	}
+}
+
+func TestMirrorKafka(t *testing.T) {
+	// the source cluster is another server's Kafka listener
+	_, source, teardown := setupTest(t, func(c *Config) {
+		c.Authenticator = auth.AuthenticatorFunc(func(ctx context.Context, creds auth.Credentials) (string, error) {
+			return "root", nil
+		})
+	})
+	defer teardown()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	kafka, err := NewKafkaServer(ln.Addr().String(), source)
+	require.NoError(t, err)
+	go kafka.Serve(ln)
+	defer kafka.Close()
+	stl := source.CommitLog.(topicLog)
+	require.NoError(t, stl.CreateTopic(&api.Topic{Name: "orders", Partitions: 2}))
+	require.NoError(t, stl.CreateTopic(&api.Topic{Name: "audit.eu", Partitions: 1}))
+	require.NoError(t, stl.CreateTopic(&api.Topic{Name: "other", Partitions: 1}))
+	appendTo := func(topic string, p uint32, record *api.Record) {
+		cl, err := source.partition(topic, p)
+		require.NoError(t, err)
+		_, err = cl.Append(record)
+		require.NoError(t, err)
+	}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC).UnixNano()
+	appendTo("orders", 0, &api.Record{Key: []byte("o-1"), Value: []byte("one"), Timestamp: at, Headers: []*api.Header{{Key: "source", Value: []byte("web")}}})
+	appendTo("orders", 1, &api.Record{Key: []byte("o-2"), Value: []byte("two"), Timestamp: at})
+	appendTo("orders", 0, &api.Record{Key: []byte("o-3"), Value: []byte("three"), Timestamp: at})
+	// a mirror starting at the latest records leaves this one
+	appendTo("audit.eu", 0, &api.Record{Value: []byte("old")})
+	appendTo("other", 0, &api.Record{Value: []byte("other")})
+
+	_, dest, teardown := setupTest(t, nil)
+	defer teardown()
+	dtl := dest.CommitLog.(topicLog)
+	require.NoError(t, dtl.CreateTopic(&api.Topic{Name: "orders", Partitions: 1}))
+	require.NoError(t, dtl.CreateTopic(&api.Topic{Name: "audit", Partitions: 1}))
+	config := &KafkaMirrorConfig{
+		Brokers: []string{ln.Addr().String()},
+		Mirrors: []KafkaMirror{
+			{Name: "orders", Topics: []string{"orders"}},
+			{Name: "audit", Pattern: `audit\..*`, Topic: "audit", Start: "latest"},
+		},
+	}
+	stop := MirrorKafka(config, dest)
+	read := func(topic string, n int) []*api.Record {
+		var records []*api.Record
+		require.Eventually(t, func() bool {
+			var err error
+			records, err = dest.readBatch(topic, 0, 0, 10)
+			require.NoError(t, err)
+			return len(records) >= n
+		}, 5*time.Second, 10*time.Millisecond)
+		return records
+	}
+	records := read("orders", 3)
+	require.Len(t, records, 3)
+	byKey := make(map[string]*api.Record)
+	for _, record := range records {
+		byKey[string(record.Key)] = record
+	}
+	require.Equal(t, "one", string(byKey["o-1"].Value))
+	require.Equal(t, at, byKey["o-1"].Timestamp)
+	require.Equal(t, []*api.Header{{Key: "source", Value: []byte("web")}}, byKey["o-1"].Headers)
+	require.Equal(t, "two", string(byKey["o-2"].Value))
+	// a source partition's records keep their order
+	require.Less(t, byKey["o-1"].Offset, byKey["o-3"].Offset)
+
+	require.Eventually(t, func() bool {
+		offsets, err := dest.fetchGroupOffsets(&api.FetchGroupOffsetsRequest{
+			Group:      "__kafka-mirror.audit",
+			Partitions: []*api.GroupOffset{{Topic: "kafka/audit.eu", Partition: 0}},
+		})
+		return err == nil && offsets[0].Found
+	}, 5*time.Second, 10*time.Millisecond)
+	appendTo("audit.eu", 0, &api.Record{Value: []byte("new")})
+	records = read("audit", 1)
+	require.Len(t, records, 1)
+	require.Equal(t, "new", string(records[0].Value))
+
+	// a mirror restarted picks up from its cursors
+	stop()
+	appendTo("orders", 1, &api.Record{Key: []byte("o-4"), Value: []byte("four")})
+	stop = MirrorKafka(config, dest)
+	defer stop()
+	records = read("orders", 4)
+	require.Equal(t, "o-4", string(records[3].Key))
+	time.Sleep(3 * kafkaMirrorPollInterval)
+	records = read("orders", 4)
+	require.Len(t, records, 4)
+}
@@ -0,0 +1,421 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Kafka's wire encoding for the versions the Kafka listener speaks, the
+// ones from before flexible versions: big-endian integers, strings with an
+// int16 length, bytes and arrays with an int32 one, and the zigzag varints
+// of v2 record batches. A null string, bytes or array has a length of -1.
+
+// Requests bigger than this close their connection, and batches
+// decompressing to more are refused
+const kafkaMaxRequestSize = 100 << 20
+
+var (
+	errKafkaMalformed   = errors.New("malformed kafka request")
+	errKafkaCorrupt     = errors.New("corrupt kafka record batch")
+	errKafkaCompression = errors.New("unsupported kafka compression type")
+)
+
+// Decodes a request, failing every read after the first that runs past
+// the end
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err, d.b = errKafkaMalformed, nil
+		return nil
+	}
+	b := d.b[:n:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.take(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) bool() bool {
+	return d.int8() != 0
+}
+
+// A string, empty when it's null
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+// Bytes, nil when they're null
+func (d *kafkaDecoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.take(int(n))
+}
+
+// An array's length, -1 when it's null. Every element takes a byte at
+// least, so a longer array than what's left is malformed.
+func (d *kafkaDecoder) arrayLen() int {
+	n := d.int32()
+	if d.err == nil && (n < -1 || int(n) > len(d.b)) {
+		d.err, d.b = errKafkaMalformed, nil
+		return 0
+	}
+	return int(n)
+}
+
+func (d *kafkaDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err, d.b = errKafkaMalformed, nil
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+// Bytes with a varint length, nil when they're null
+func (d *kafkaDecoder) varbytes() []byte {
+	n := d.varint()
+	if n < 0 {
+		return nil
+	}
+	if n > int64(len(d.b)) {
+		d.err, d.b = errKafkaMalformed, nil
+		return nil
+	}
+	return d.take(int(n))
+}
+
+type kafkaEncoder struct {
+	b []byte
+}
+
+func (e *kafkaEncoder) int8(v int8) {
+	e.b = append(e.b, byte(v))
+}
+
+func (e *kafkaEncoder) int16(v int16) {
+	e.b = binary.BigEndian.AppendUint16(e.b, uint16(v))
+}
+
+func (e *kafkaEncoder) int32(v int32) {
+	e.b = binary.BigEndian.AppendUint32(e.b, uint32(v))
+}
+
+func (e *kafkaEncoder) int64(v int64) {
+	e.b = binary.BigEndian.AppendUint64(e.b, uint64(v))
+}
+
+func (e *kafkaEncoder) bool(v bool) {
+	if v {
+		e.int8(1)
+	} else {
+		e.int8(0)
+	}
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.b = append(e.b, s...)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.b = append(e.b, b...)
+}
+
+func (e *kafkaEncoder) arrayLen(n int) {
+	e.int32(int32(n))
+}
+
+func (e *kafkaEncoder) varint(v int64) {
+	e.b = binary.AppendVarint(e.b, v)
+}
+
+// Record batch attributes: the low three bits are the compression type,
+// batches stamped by their broker carry their append time as their max
+// timestamp, and control batches carry transaction markers rather than
+// records
+const (
+	kafkaCompressionMask   = 0x07
+	kafkaCompressionNone   = 0
+	kafkaCompressionGzip   = 1
+	kafkaCompressionSnappy = 2
+	kafkaCompressionZstd   = 4
+	kafkaLogAppendTime     = 0x08
+	kafkaControlBatch      = 0x20
+)
+
+// A batch's length counts everything after it: the partition leader
+// epoch, magic, CRC, attributes, last offset delta, first and max
+// timestamps, producer ID, epoch, base sequence and record count
+const kafkaBatchOverhead = 49
+
+var kafkaCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+var kafkaZstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(kafkaMaxRequestSize))
+
+// Decodes the records of the v2 record batches a produce sends, keeping
+// their keys, values, headers and timestamps. Control batches are skipped.
+func decodeRecordBatches(b []byte) ([]*api.Record, error) {
+	records, _, err := readRecordBatches(b, false)
+	return records, err
+}
+
+// Decodes the records of the batches a fetch answers with as
+// decodeRecordBatches does, with their offsets in the partition, and
+// returns the offset after the last batch, -1 if there's none. Brokers cut
+// the last batch short at the fetch's max bytes, so one cut short is left
+// for the next fetch to take whole.
+func decodeFetchedBatches(b []byte) (records []*api.Record, next int64, err error) {
+	return readRecordBatches(b, true)
+}
+
+func readRecordBatches(b []byte, partial bool) (records []*api.Record, next int64, err error) {
+	next = -1
+	for len(b) > 0 {
+		if len(b) < 12 {
+			if partial {
+				break
+			}
+			return nil, 0, errKafkaCorrupt
+		}
+		baseOffset := int64(binary.BigEndian.Uint64(b))
+		length := int(int32(binary.BigEndian.Uint32(b[8:12])))
+		if length < kafkaBatchOverhead {
+			return nil, 0, errKafkaCorrupt
+		}
+		if length > len(b)-12 {
+			if partial {
+				break
+			}
+			return nil, 0, errKafkaCorrupt
+		}
+		d := &kafkaDecoder{b: b[12 : 12+length]}
+		b = b[12+length:]
+		d.int32() // partition leader epoch
+		if magic := d.int8(); magic != 2 {
+			return nil, 0, errKafkaCorrupt
+		}
+		if crc := uint32(d.int32()); crc32.Checksum(d.b, kafkaCRCTable) != crc {
+			return nil, 0, errKafkaCorrupt
+		}
+		attributes := d.int16()
+		lastOffsetDelta := d.int32()
+		firstTimestamp := d.int64()
+		maxTimestamp := d.int64()
+		d.int64() // producer ID
+		d.int16() // producer epoch
+		d.int32() // base sequence
+		n := int(d.int32())
+		next = baseOffset + int64(lastOffsetDelta) + 1
+		if attributes&kafkaControlBatch != 0 {
+			continue
+		}
+		body, err := decompressKafka(attributes&kafkaCompressionMask, d.b)
+		if err != nil {
+			return nil, 0, err
+		}
+		d = &kafkaDecoder{b: body}
+		for range n {
+			rd := &kafkaDecoder{b: d.varbytes()}
+			rd.int8() // attributes
+			timestamp := firstTimestamp + rd.varint()
+			if attributes&kafkaLogAppendTime != 0 {
+				timestamp = maxTimestamp
+			}
+			record := &api.Record{Offset: uint64(baseOffset + rd.varint())}
+			record.Key, record.Value = rd.varbytes(), rd.varbytes()
+			headers := rd.varint()
+			if headers > int64(len(rd.b)) {
+				return nil, 0, errKafkaCorrupt
+			}
+			for range headers {
+				key := rd.varbytes()
+				record.Headers = append(record.Headers, &api.Header{Key: string(key), Value: rd.varbytes()})
+			}
+			if d.err != nil || rd.err != nil {
+				return nil, 0, errKafkaCorrupt
+			}
+			// records without a timestamp are stamped on append
+			if timestamp > 0 {
+				record.Timestamp = (time.Duration(timestamp) * time.Millisecond).Nanoseconds()
+			}
+			records = append(records, record)
+		}
+	}
+	return records, next, nil
+}
+
+// Encodes the records, read in offset order, as one uncompressed v2 batch.
+// Their offsets are relative to the first's, so the gaps compaction leaves
+// are kept.
+func encodeRecordBatch(records []*api.Record) []byte {
+	first, last := records[0], records[len(records)-1]
+	firstTimestamp := time.Duration(first.Timestamp).Milliseconds()
+	maxTimestamp := firstTimestamp
+	var body kafkaEncoder
+	for _, record := range records {
+		timestamp := time.Duration(record.Timestamp).Milliseconds()
+		maxTimestamp = max(maxTimestamp, timestamp)
+		var re kafkaEncoder
+		re.int8(0) // attributes
+		re.varint(timestamp - firstTimestamp)
+		re.varint(int64(record.Offset - first.Offset))
+		if len(record.Key) == 0 {
+			re.varint(-1)
+		} else {
+			re.varint(int64(len(record.Key)))
+			re.b = append(re.b, record.Key...)
+		}
+		re.varint(int64(len(record.Value)))
+		re.b = append(re.b, record.Value...)
+		re.varint(int64(len(record.Headers)))
+		for _, h := range record.Headers {
+			re.varint(int64(len(h.Key)))
+			re.b = append(re.b, h.Key...)
+			re.varint(int64(len(h.Value)))
+			re.b = append(re.b, h.Value...)
+		}
+		body.varint(int64(len(re.b)))
+		body.b = append(body.b, re.b...)
+	}
+	var e kafkaEncoder
+	e.int64(int64(first.Offset))
+	e.int32(int32(kafkaBatchOverhead + len(body.b)))
+	e.int32(-1) // partition leader epoch
+	e.int8(2)   // magic
+	crcAt := len(e.b)
+	e.int32(0)
+	e.int16(kafkaCompressionNone)
+	e.int32(int32(last.Offset - first.Offset))
+	e.int64(firstTimestamp)
+	e.int64(maxTimestamp)
+	e.int64(-1) // producer ID
+	e.int16(-1) // producer epoch
+	e.int32(-1) // base sequence
+	e.int32(int32(len(records)))
+	e.b = append(e.b, body.b...)
+	binary.BigEndian.PutUint32(e.b[crcAt:], crc32.Checksum(e.b[crcAt+4:], kafkaCRCTable))
+	return e.b
+}
+
+func decompressKafka(compression int16, b []byte) ([]byte, error) {
+	switch compression {
+	case kafkaCompressionNone:
+		return b, nil
+	case kafkaCompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, errKafkaCorrupt
+		}
+		body, err := io.ReadAll(io.LimitReader(r, kafkaMaxRequestSize+1))
+		if err != nil || len(body) > kafkaMaxRequestSize {
+			return nil, errKafkaCorrupt
+		}
+		return body, nil
+	case kafkaCompressionSnappy:
+		return decodeKafkaSnappy(b)
+	case kafkaCompressionZstd:
+		body, err := kafkaZstdDecoder.DecodeAll(b, nil)
+		if err != nil {
+			return nil, errKafkaCorrupt
+		}
+		return body, nil
+	}
+	return nil, errKafkaCompression
+}
+
+// Java's clients frame snappy as xerial's snappy-java does: a magic header
+// and two versions, then blocks each after its int32 length
+var xerialHeader = []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0}
+
+func decodeKafkaSnappy(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, xerialHeader) {
+		return decodeSnappyBlock(nil, b)
+	}
+	if len(b) < 16 {
+		return nil, errKafkaCorrupt
+	}
+	b = b[16:]
+	var body []byte
+	for len(b) > 0 {
+		if len(b) < 4 {
+			return nil, errKafkaCorrupt
+		}
+		n := int(binary.BigEndian.Uint32(b))
+		if n > len(b)-4 {
+			return nil, errKafkaCorrupt
+		}
+		var err error
+		if body, err = decodeSnappyBlock(body, b[4:4+n]); err != nil {
+			return nil, err
+		}
+		b = b[4+n:]
+	}
+	return body, nil
+}
+
+// Appends the decoded block to dst, refusing blocks that would take it
+// past the request size limit
+func decodeSnappyBlock(dst, block []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(block)
+	if err != nil || len(dst)+n > kafkaMaxRequestSize {
+		return nil, errKafkaCorrupt
+	}
+	decoded, err := snappy.Decode(nil, block)
+	if err != nil {
+		return nil, errKafkaCorrupt
+	}
+	return append(dst, decoded...), nil
+}
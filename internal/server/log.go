@@ -1,25 +1,284 @@
 package server
 
 import (
-	"fmt"
+	"io"
 	"sync"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
 )
 
-type Record struct {
-	Value  []byte `json:"value"`
-	Offset uint64 `json:"offset"`
+// CommitLog is what the server needs from a log, implemented by the
+// persistent log in internal/server/log and by the in-memory Log here
+type CommitLog interface {
+	Append(*api.Record) (uint64, error)
+	Read(uint64) (*api.Record, error)
+}
+
+// Reads the commit log's record at off and returns it with the offset to
+// read next. Compaction leaves gaps in a log, and a compacted log answers a
+// read in one with the next record it kept, so the record may be past off
+// and the next read starts after it. Readers stepping through a log read
+// with this, so none reads into a gap again.
+func readFrom(cl CommitLog, off uint64) (*api.Record, uint64, error) {
+	record, err := cl.Read(off)
+	if err != nil {
+		return nil, off, err
+	}
+	return record, max(off, record.Offset) + 1, nil
+}
+
+// durableLog is implemented by commit logs that can fsync appends before acknowledging them
+type durableLog interface {
+	SyncOnAppend() bool
+}
+
+// ackLog is implemented by commit logs that can acknowledge appends before
+// they commit. pending reports the offset isn't known yet.
+type ackLog interface {
+	AppendAck(record *api.Record, ack api.Ack) (off uint64, pending bool, err error)
+}
+
+// batchLog is implemented by commit logs that append batches of records
+// in one go, see log.DistributedLog.AppendBatch
+type batchLog interface {
+	AppendBatch(records []*api.Record, ack api.Ack) (offs []uint64, pending bool, err error)
+}
+
+// durabilityLog is implemented by commit logs that acknowledge appends
+// before they're synced and tell when they are, see log.Log.AppendDurable
+type durabilityLog interface {
+	AppendDurable(record *api.Record, durable func(error)) (uint64, error)
+}
+
+// marshaledLog is implemented by commit logs that read records as they're
+// stored, which consume streams send without decoding, see
+// log.Log.ReadMarshaled
+type marshaledLog interface {
+	ReadMarshaled(off uint64) (record *[]byte, recordOff uint64, err error)
+}
+
+// tailLog is implemented by commit logs that tell reads at their tail from
+// those of their history, which ScanThrottle throttles, see log.Log.Tail
+type tailLog interface {
+	Tail(off uint64) bool
+}
+
+// offsetLog is implemented by commit logs that keep the offsets consumers
+// commit, see log.DistributedLog.CommitOffset
+type offsetLog interface {
+	CommitOffset(consumer string, offset uint64) error
+	FetchOffset(consumer string) (uint64, bool)
+}
+
+// statsLog is implemented by commit logs that report their size and
+// offsets, see log.Stats
+type statsLog interface {
+	Stats() log.Stats
 }
 
+// adminLog is implemented by commit logs that list their segments and
+// delete their oldest records, see log.Log.DeleteRecords
+type adminLog interface {
+	SegmentStats() []log.SegmentStats
+	DeleteRecords(before uint64) (low uint64, err error)
+}
+
+// describeLog is implemented by commit logs that describe where they keep
+// records, see log.Log.DescribeRecord
+type describeLog interface {
+	DescribeRecord(off uint64) (*log.RecordInfo, error)
+}
+
+// snapshotLog is implemented by commit logs that snapshot on demand, see
+// log.DistributedLog.Snapshot
+type snapshotLog interface {
+	Snapshot() (index uint64, err error)
+}
+
+// backupLog is implemented by commit logs that back up their files while
+// they serve, see log.Topics.Backup
+type backupLog interface {
+	Backup(w io.Writer) (*log.BackupManifest, error)
+}
+
+// linkBackupLog is implemented by commit logs that back up into a
+// directory by hard-linking their segments, see log.Topics.LinkBackup
+type linkBackupLog interface {
+	LinkBackup(dir string) (*log.BackupManifest, error)
+}
+
+// topicBackupLog is implemented by commit logs that back up a topic at a
+// time, see log.Topics.BackupTopic
+type topicBackupLog interface {
+	BackupTopic(name string, w io.Writer) (*log.BackupManifest, error)
+}
+
+// clusterLog is implemented by commit logs replicated across a cluster
+type clusterLog interface {
+	GetServers() ([]*api.Server, error)
+}
+
+// leaderLog is implemented by commit logs a leader writes, see
+// log.DistributedLog.LeaderTerm
+type leaderLog interface {
+	Leader() string
+	LeaderTerm() (term uint64, leader bool)
+}
+
+// checksumLog is implemented by commit logs replicas can compare, see log.RangeSize
+type checksumLog interface {
+	Checksums(rangeSize uint64) ([]*api.RangeChecksum, error)
+}
+
+// sessionChecksumLog is implemented by commit logs that answer checksum
+// sessions, see log.Log.SessionChecksums
+type sessionChecksumLog interface {
+	SessionChecksums(rangeSize, id, epoch uint64) (*api.GetChecksumsResponse, error)
+}
+
+// rebalanceLog is implemented by commit logs that place their voters, see
+// log.DistributedLog.Rebalance
+type rebalanceLog interface {
+	Rebalance(dryRun bool) ([]*api.VoterChange, error)
+}
+
+// partitionedLog is implemented by commit logs split into partitions, each
+// replicated by its own Raft group, see log.PartitionedLog
+type partitionedLog interface {
+	Partitions() int
+	Partition(p uint32) (*log.DistributedLog, error)
+}
+
+// topicLog is implemented by commit logs holding named topics besides
+// the default one, see log.Topics and log.PartitionedLog
+type topicLog interface {
+	TopicPartition(name string, p uint32) (log.Partition, error)
+	CreateTopic(topic *api.Topic) error
+	DeleteTopic(name string) error
+	DescribeTopic(name string) (*api.Topic, error)
+	ListTopics() []*api.Topic
+	TopicConfig(name string) (log.TopicConfig, error)
+	AlterTopicConfigs(name string, configs map[string]string) (*api.Topic, error)
+	CreatePartitions(name string, n uint32) (*api.Topic, error)
+}
+
+// tenantLog is implemented by commit logs keeping tenants' topics apart, see
+// log.Config.Tenants
+type tenantLog interface {
+	TenantOf(topic string) string
+	TenantStats() []log.TenantStats
+	CheckTenant(topic string) error
+}
+
+// The commit log holding the topic's partition p. The default topic is the
+// commit log itself, which holds only partition 0 unless it's partitioned;
+// other topics are api.ErrTopicNotFound on logs without topics.
+func (c *Config) partition(topic string, p uint32) (CommitLog, error) {
+	if topic != "" && topic != log.DefaultTopic {
+		tl, ok := c.CommitLog.(topicLog)
+		if !ok {
+			return nil, api.ErrTopicNotFound{Topic: topic}
+		}
+		l, err := tl.TopicPartition(topic, p)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	}
+	pl, ok := c.CommitLog.(partitionedLog)
+	if !ok {
+		if p != 0 {
+			return nil, api.ErrPartitionNotFound{Partition: p, Partitions: 1}
+		}
+		return c.CommitLog, nil
+	}
+	dlog, err := pl.Partition(p)
+	if err != nil {
+		return nil, err
+	}
+	return dlog, nil
+}
+
+// The resource topics are authorized as, the topic's name
+func topicResource(topic string) string {
+	if topic == "" {
+		return log.DefaultTopic
+	}
+	return topic
+}
+
+// The topics the commit log holds, just the default one on logs without
+// topics
+func (c *Config) topics() []*api.Topic {
+	if tl, ok := c.CommitLog.(topicLog); ok {
+		return tl.ListTopics()
+	}
+	return []*api.Topic{{Name: log.DefaultTopic, Partitions: uint32(c.partitions())}}
+}
+
+// The topic's description, the default topic's for an empty name
+func (c *Config) describeTopic(name string) (*api.Topic, error) {
+	if tl, ok := c.CommitLog.(topicLog); ok {
+		return tl.DescribeTopic(name)
+	}
+	if name != "" && name != log.DefaultTopic {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	return &api.Topic{Name: log.DefaultTopic, Partitions: uint32(c.partitions())}, nil
+}
+
+// The topic's settings, the zero ones on logs without topics, which take
+// records as they come
+func (c *Config) topicConfig(topic string) (log.TopicConfig, error) {
+	if tl, ok := c.CommitLog.(topicLog); ok {
+		return tl.TopicConfig(topic)
+	}
+	return log.TopicConfig{}, nil
+}
+
+// Fails with api.ErrStaleMetadata when a producer picked the partition by
+// an older version of the topic than this server's. A nil version didn't
+// pick by one.
+func (c *Config) checkTopicVersion(topic string, version *uint64) error {
+	if version == nil {
+		return nil
+	}
+	desc, err := c.describeTopic(topic)
+	if err != nil {
+		return err
+	}
+	if *version < desc.Version {
+		return api.ErrStaleMetadata{Topic: desc.Name, Version: desc.Version}
+	}
+	return nil
+}
+
+// How many partitions the commit log has
+func (c *Config) partitions() int {
+	if pl, ok := c.CommitLog.(partitionedLog); ok {
+		return pl.Partitions()
+	}
+	return 1
+}
+
+// readyLog is implemented by commit logs that can't serve until they've
+// caught up, such as a replica that just started
+type readyLog interface {
+	Ready() error
+}
+
+// Log keeps records in memory, for internal trails and tests
 type Log struct {
 	mu      sync.Mutex
-	records []Record
+	records []*api.Record
 }
 
 func NewLog() *Log {
 	return &Log{}
 }
 
-func (l *Log) Append(record Record) (uint64, error) {
+func (l *Log) Append(record *api.Record) (uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	record.Offset = uint64(len(l.records))
@@ -27,14 +286,12 @@ func (l *Log) Append(record Record) (uint64, error) {
 	return record.Offset, nil
 }
 
-func (l *Log) Read(offset uint64) (Record, error) {
+func (l *Log) Read(offset uint64) (*api.Record, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 	if offset >= uint64(len(l.records)) {
-		return Record{}, ErrOffsetNotFound
+		return nil, api.ErrOffsetOutOfRange{Offset: offset}
 	}
 
 	return l.records[offset], nil
 }
-
-var ErrOffsetNotFound = fmt.Errorf("offset not found")
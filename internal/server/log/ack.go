@@ -0,0 +1,180 @@
+package log
+
+import (
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/hashicorp/raft"
+)
+
+// Bytes of the ID after an AppendLeaderAckRequestType
+const ackIDWidth = 8
+
+// Stores the request with a random ID and returns once this server, the
+// leader, has written it to its raft log, or it committed first
+func (l *DistributedLog) applyLeaderAck(req *api.ProduceRequest) (off uint64, pending bool, err error) {
+	id, written := l.acks.add()
+	defer l.acks.remove(id)
+	prefix := make([]byte, ackIDWidth)
+	enc.PutUint64(prefix, id)
+	future, err := l.submit(AppendLeaderAckRequestType, req, prefix...)
+	if err != nil {
+		return 0, false, err
+	}
+	committed := make(chan error, 1)
+	go func() {
+		_, err := l.response(future)
+		committed <- err
+	}()
+	select {
+	case <-written:
+		return 0, true, nil
+	case err := <-committed:
+		if err != nil {
+			return 0, false, err
+		}
+		return future.Response().(*api.ProduceResponse).Offset, false, nil
+	}
+}
+
+// leaderAcks tracks the appends waiting for the leader to store them. IDs
+// are random so an entry from another leader doesn't answer one of ours.
+type leaderAcks struct {
+	mu      sync.Mutex
+	waiting map[uint64]chan struct{}
+}
+
+func newLeaderAcks() *leaderAcks {
+	return &leaderAcks{waiting: make(map[uint64]chan struct{})}
+}
+
+func (a *leaderAcks) add() (uint64, <-chan struct{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	id := rand.Uint64()
+	for a.waiting[id] != nil {
+		id = rand.Uint64()
+	}
+	ch := make(chan struct{})
+	a.waiting[id] = ch
+	return id, ch
+}
+
+func (a *leaderAcks) remove(id uint64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.waiting, id)
+}
+
+// Called by the raft log store after writing each entry
+func (a *leaderAcks) stored(entry *raft.Log) {
+	if entry.Type != raft.LogCommand || len(entry.Data) < 1+ackIDWidth ||
+		RequestType(entry.Data[0]) != AppendLeaderAckRequestType {
+		return
+	}
+	id := enc.Uint64(entry.Data[1:])
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ch, ok := a.waiting[id]; ok {
+		close(ch)
+		delete(a.waiting, id)
+	}
+}
+
+// isrTracker follows which voters are in sync with the leader: all of them
+// until the leader's heartbeats to one fail, and again once they resume,
+// unless the voter lags further behind than the configured maximum
+type isrTracker struct {
+	raft     *raft.Raft
+	lag      *lagTracker
+	observer *raft.Observer
+	events   chan raft.Observation
+	ticker   *time.Ticker
+	done     chan struct{}
+
+	mu        sync.Mutex
+	outOfSync map[raft.ServerID]bool
+}
+
+func newISRTracker(r *raft.Raft, lag *lagTracker) *isrTracker {
+	t := &isrTracker{
+		raft:      r,
+		lag:       lag,
+		events:    make(chan raft.Observation, 16),
+		ticker:    time.NewTicker(lagInterval),
+		done:      make(chan struct{}),
+		outOfSync: make(map[raft.ServerID]bool),
+	}
+	t.observer = raft.NewObserver(t.events, false, func(o *raft.Observation) bool {
+		switch o.Data.(type) {
+		case raft.FailedHeartbeatObservation, raft.ResumedHeartbeatObservation, raft.LeaderObservation:
+			return true
+		}
+		return false
+	})
+	r.RegisterObserver(t.observer)
+	go t.run()
+	return t
+}
+
+func (t *isrTracker) run() {
+	defer t.ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-t.ticker.C:
+			if t.raft.State() == raft.Leader {
+				t.lag.update()
+			}
+		case o := <-t.events:
+			t.mu.Lock()
+			switch e := o.Data.(type) {
+			case raft.FailedHeartbeatObservation:
+				t.outOfSync[e.PeerID] = true
+			case raft.ResumedHeartbeatObservation:
+				delete(t.outOfSync, e.PeerID)
+			case raft.LeaderObservation:
+				// a new leader starts heartbeating and measuring everyone afresh
+				clear(t.outOfSync)
+				t.lag.reset()
+			}
+			t.mu.Unlock()
+		}
+	}
+}
+
+func (t *isrTracker) inSync(id raft.ServerID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.outOfSync[id] && !t.lag.stale(id)
+}
+
+// Rejects with api.ErrNotEnoughReplicas when this server leads fewer than
+// min voters in sync, itself included. Followers leave it to the leader.
+func (t *isrTracker) check(min int) error {
+	if min <= 1 || t.raft.State() != raft.Leader {
+		return nil
+	}
+	future := t.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	inSync := 0
+	for _, server := range future.Configuration().Servers {
+		if server.Suffrage == raft.Voter && t.inSync(server.ID) {
+			inSync++
+		}
+	}
+	if inSync < min {
+		return api.ErrNotEnoughReplicas{InSync: inSync, Required: min}
+	}
+	return nil
+}
+
+func (t *isrTracker) close() {
+	t.raft.DeregisterObserver(t.observer)
+	close(t.done)
+}
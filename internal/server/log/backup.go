@@ -0,0 +1,394 @@
+package log
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BackupManifestName is the first file in a backup, its manifest, and
+// BackupChecksumsName the last, the CRC-32 of every file between
+const (
+	BackupManifestName  = "backup.json"
+	BackupChecksumsName = "checksums.json"
+)
+
+// BackupManifest describes a backup: when it was taken, the format version
+// its logs are in, the topic it's of, empty for all the server's, and the
+// logs, each as far as it had been written then. Backups from before logs
+// were versioned have no Format.
+type BackupManifest struct {
+	Time   time.Time   `json:"time"`
+	Format int         `json:"format,omitempty"`
+	Topic  string      `json:"topic,omitempty"`
+	Logs   []BackupLog `json:"logs"`
+	// Files are a link backup's files and the bytes of each backed up,
+	// which a linked index may since have grown past, see Log.LinkBackup.
+	// A tar's are its entries.
+	Files map[string]int64 `json:"files,omitempty"`
+}
+
+// BackupLog is a log in a backup. Dir is relative to the data directory.
+// NextOffset is the offset after its last record, for a replica's log
+// its high watermark, as it holds only committed records. Encrypted
+// logs' records are sealed with the server's keyring.
+type BackupLog struct {
+	Dir        string          `json:"dir"`
+	NextOffset uint64          `json:"next_offset"`
+	Encrypted  bool            `json:"encrypted,omitempty"`
+	Segments   []BackupSegment `json:"segments"`
+}
+
+type BackupSegment struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+}
+
+// A backup in the making. The files are opened while their log is locked
+// and copied after, so a segment retention removes or compaction replaces
+// meanwhile is copied as it was. A link backup links the sealed segments'
+// files into linkDir while they're locked instead.
+type backup struct {
+	root     string
+	manifest BackupManifest
+	files    []backupFile
+	linkDir  string
+}
+
+type backupFile struct {
+	name string
+	file *os.File
+	size int64
+}
+
+func newBackup(root string) *backup {
+	return &backup{root: root, manifest: BackupManifest{Time: time.Now().UTC(), Format: FormatVersion}}
+}
+
+// Adds the log's segments as far as they've been written, with the active
+// one's buffer flushed, and the offsets and tier manifest beside them.
+// Appends wait while the files are opened, not while they're copied.
+func (b *backup) addLog(l *Log) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	dir, err := b.rel(l.Dir)
+	if err != nil {
+		return err
+	}
+	bl := BackupLog{Dir: dir, Encrypted: l.Config.Keyring != nil}
+	for _, s := range l.segments {
+		if b.linkDir != "" && s != l.activeSegment && s.sealed() {
+			if err := b.linkSegment(s); err != nil {
+				return err
+			}
+			bl.Segments = append(bl.Segments, BackupSegment{BaseOffset: s.baseOffset, NextOffset: s.nextOffset})
+			bl.NextOffset = s.nextOffset
+			continue
+		}
+		s.store.lock()
+		err := s.store.flush()
+		size := s.store.size
+		s.store.unlock()
+		if err != nil {
+			return err
+		}
+		if err := b.add(s.store.Name(), int64(size)); err != nil {
+			return err
+		}
+		if err := b.add(s.index.Name(), int64(s.index.size)); err != nil {
+			return err
+		}
+		bl.Segments = append(bl.Segments, BackupSegment{BaseOffset: s.baseOffset, NextOffset: s.nextOffset})
+		bl.NextOffset = s.nextOffset
+	}
+	for _, name := range []string{formatFile, offsetsFile, startFile, manifestName} {
+		if err := b.addFile(filepath.Join(l.Dir, name)); err != nil {
+			return err
+		}
+	}
+	b.manifest.Logs = append(b.manifest.Logs, bl)
+	return nil
+}
+
+// Adds the distributed log's raft log and latest snapshot as well as its
+// log. Its stable store isn't, so a server restored from the backup starts
+// without the term it was in or the vote it cast.
+func (b *backup) addDistributed(l *DistributedLog) error {
+	if err := b.addLog(l.log); err != nil {
+		return err
+	}
+	// the raft log first, so a snapshot taken meanwhile can't leave a gap
+	if err := b.addLog(l.raftLog.Log); err != nil {
+		return err
+	}
+	snapshots := filepath.Join(filepath.Dir(l.log.Dir), "raft", "snapshots")
+	return filepath.WalkDir(snapshots, func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			return nil
+		case err != nil:
+			return err
+		case d.IsDir() && strings.HasSuffix(d.Name(), ".tmp"):
+			// a snapshot still being written
+			return filepath.SkipDir
+		case d.IsDir():
+			return nil
+		case b.linkDir != "":
+			// snapshots aren't changed once they're written
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return b.link(path, fi.Size())
+		}
+		return b.addFile(path)
+	})
+}
+
+// Adds the whole file, if it exists
+func (b *backup) addFile(path string) error {
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return b.add(path, fi.Size())
+}
+
+// Adds the file's first size bytes
+func (b *backup) add(path string, size int64) error {
+	name, err := b.rel(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	b.files = append(b.files, backupFile{name: name, file: f, size: size})
+	return nil
+}
+
+// The path relative to the data directory, as a tar entry names it
+func (b *backup) rel(path string) (string, error) {
+	rel, err := filepath.Rel(b.root, path)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// Writes the backup as a tar of the manifest, the files and their checksums
+func (b *backup) write(w io.Writer) (*BackupManifest, error) {
+	tw := tar.NewWriter(w)
+	if err := b.writeJSON(tw, BackupManifestName, b.manifest); err != nil {
+		return nil, err
+	}
+	sums := make(map[string]uint32, len(b.files))
+	for _, f := range b.files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    f.name,
+			Mode:    0644,
+			Size:    f.size,
+			ModTime: b.manifest.Time,
+		}); err != nil {
+			return nil, err
+		}
+		h := crc32.NewIEEE()
+		n, err := io.Copy(io.MultiWriter(tw, h), io.NewSectionReader(f.file, 0, f.size))
+		if err != nil {
+			return nil, err
+		}
+		if n < f.size {
+			return nil, fmt.Errorf("%s was truncated during the backup", f.name)
+		}
+		sums[f.name] = h.Sum32()
+	}
+	if err := b.writeJSON(tw, BackupChecksumsName, sums); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return &b.manifest, nil
+}
+
+func (b *backup) writeJSON(tw *tar.Writer, name string, v any) error {
+	p, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(p)),
+		ModTime: b.manifest.Time,
+	}); err != nil {
+		return err
+	}
+	_, err = tw.Write(p)
+	return err
+}
+
+func (b *backup) close() {
+	for _, f := range b.files {
+		f.file.Close()
+	}
+}
+
+// Backup writes a tar of the log's files to w, consistent as of when it's
+// called, while appends carry on. Extracted into an empty directory it's
+// the log again. Segments archived to a tier stay there, the backup's
+// tier manifest naming them, and encrypted segments stay encrypted.
+// Logs are backed up in the format version they're in, FormatVersion as
+// they open.
+func (l *Log) Backup(w io.Writer) (*BackupManifest, error) {
+	b := newBackup(l.Dir)
+	defer b.close()
+	if err := b.addLog(l); err != nil {
+		return nil, err
+	}
+	return b.write(w)
+}
+
+// Adds the topics' logs and descriptions
+func (t *Topics) addTo(b *backup) error {
+	if err := b.addLog(t.Log); err != nil {
+		return err
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	names := make([]string, 0, len(t.topics))
+	for name := range t.topics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := b.addTopic(t.topics[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Backup writes a tar of the topics' logs and descriptions, relative to the
+// data directory, see Log.Backup
+func (t *Topics) Backup(w io.Writer) (*BackupManifest, error) {
+	b := newBackup(t.dir)
+	defer b.close()
+	if err := t.addTo(b); err != nil {
+		return nil, err
+	}
+	return b.write(w)
+}
+
+// BackupTopic writes a tar of just the topic's partitions and description,
+// the default topic's for an empty name, relative to the data directory.
+// Extracted into a server's it seeds the topic there, see Topics.Backup.
+func (t *Topics) BackupTopic(name string, w io.Writer) (*BackupManifest, error) {
+	b := newBackup(t.dir)
+	defer b.close()
+	t.mu.RLock()
+	tp, err := t.topic(name)
+	if err == nil {
+		b.manifest.Topic = tp.Name
+		err = b.addTopic(tp)
+	}
+	t.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	return b.write(w)
+}
+
+// Adds the topic's description, which the default topic doesn't have,
+// and its partitions
+func (b *backup) addTopic(tp *topic) error {
+	if tp.dir != "" {
+		if err := b.addFile(filepath.Join(tp.dir, topicFile)); err != nil {
+			return err
+		}
+	}
+	for _, l := range tp.partitions {
+		if err := b.addLog(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Backup writes a tar of this server's replica of the log, its raft log
+// and latest snapshot, see Log.Backup
+func (l *DistributedLog) Backup(w io.Writer) (*BackupManifest, error) {
+	b := newBackup(filepath.Dir(l.log.Dir))
+	defer b.close()
+	if err := b.addDistributed(l); err != nil {
+		return nil, err
+	}
+	return b.write(w)
+}
+
+// Backup writes a tar of this server's replicas of the partitions and the
+// topics' groups, relative to the data directory, see DistributedLog.Backup
+func (l *PartitionedLog) Backup(w io.Writer) (*BackupManifest, error) {
+	b := newBackup(l.dataDir())
+	defer b.close()
+	if err := l.addTo(b); err != nil {
+		return nil, err
+	}
+	return b.write(w)
+}
+
+// The data directory the partitions' logs are in
+func (l *PartitionedLog) dataDir() string {
+	return filepath.Dir(l.partitions[0].log.Dir)
+}
+
+// Adds the partitions and the topics' groups
+func (l *PartitionedLog) addTo(b *backup) error {
+	groups := l.topics.groups()
+	sort.Slice(groups, func(i, j int) bool { return groups[i].log.Dir < groups[j].log.Dir })
+	logs := append(append([]*DistributedLog{}, l.partitions...), groups...)
+	for _, d := range logs {
+		if err := b.addDistributed(d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BackupTopic writes a tar of this server's replicas of just the topic's
+// partitions, the default topic's for an empty name, see
+// PartitionedLog.Backup. The topic's description is in the catalog the
+// cluster replicates, not the backup.
+func (l *PartitionedLog) BackupTopic(name string, w io.Writer) (*BackupManifest, error) {
+	logs := l.partitions
+	if name == "" {
+		name = DefaultTopic
+	}
+	if name != DefaultTopic {
+		var err error
+		if logs, err = l.topics.partitions(name); err != nil {
+			return nil, err
+		}
+	}
+	b := newBackup(l.dataDir())
+	defer b.close()
+	b.manifest.Topic = name
+	for _, d := range logs {
+		if err := b.addDistributed(d); err != nil {
+			return nil, err
+		}
+	}
+	return b.write(w)
+}
@@ -0,0 +1,164 @@
+package log
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+// Extracts the backup into dir, returning its manifest
+func extract(t *testing.T, r io.Reader, dir string) *BackupManifest {
+	t.Helper()
+	tr := tar.NewReader(r)
+	manifest := &BackupManifest{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return manifest
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		if hdr.Name == BackupManifestName {
+			require.NoError(t, json.Unmarshal(b, manifest))
+			continue
+		}
+		if hdr.Name == BackupChecksumsName {
+			continue
+		}
+		path := filepath.Join(dir, filepath.FromSlash(hdr.Name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, b, 0644))
+	}
+}
+
+func TestTopicsBackup(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	topics, err := NewTopics(t.TempDir(), c)
+	require.NoError(t, err)
+	defer topics.Close()
+	require.NoError(t, topics.CreateTopic(&api.Topic{Name: "events", Partitions: 2}))
+	for i := 0; i < 5; i++ {
+		_, err := topics.Append(&api.Record{Value: []byte(fmt.Sprintf("default %d", i))})
+		require.NoError(t, err)
+	}
+	events, err := topics.TopicPartition("events", 1)
+	require.NoError(t, err)
+	_, err = events.Append(&api.Record{Value: []byte("event")})
+	require.NoError(t, err)
+	require.NoError(t, topics.CommitOffset("reader", 3))
+
+	var buf bytes.Buffer
+	manifest, err := topics.Backup(&buf)
+	require.NoError(t, err)
+	require.Len(t, manifest.Logs, 3)
+	require.Equal(t, ".", manifest.Logs[0].Dir)
+	require.Equal(t, uint64(5), manifest.Logs[0].NextOffset)
+	require.Len(t, manifest.Logs[0].Segments, 2)
+	require.Equal(t, "topics/events/1", manifest.Logs[2].Dir)
+
+	// appends after the backup aren't in it
+	_, err = topics.Append(&api.Record{Value: []byte("later")})
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	require.Equal(t, manifest.Logs, extract(t, &buf, dir).Logs)
+	restored, err := NewTopics(dir, c)
+	require.NoError(t, err)
+	defer restored.Close()
+	high, err := restored.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), high)
+	record, err := restored.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("default 4"), record.Value)
+	off, ok := restored.FetchOffset("reader")
+	require.True(t, ok)
+	require.Equal(t, uint64(3), off)
+	desc, err := restored.DescribeTopic("events")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), desc.Partitions)
+	events, err = restored.TopicPartition("events", 1)
+	require.NoError(t, err)
+	record, err = events.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("event"), record.Value)
+
+	// a topic's backup seeds just it
+	buf.Reset()
+	manifest, err = topics.BackupTopic("events", &buf)
+	require.NoError(t, err)
+	require.Equal(t, "events", manifest.Topic)
+	require.Len(t, manifest.Logs, 2)
+	require.Equal(t, uint64(1), manifest.Logs[1].NextOffset)
+	dir = t.TempDir()
+	extract(t, &buf, dir)
+	seeded, err := NewTopics(dir, c)
+	require.NoError(t, err)
+	defer seeded.Close()
+	high, err = seeded.HighestOffset()
+	require.NoError(t, err)
+	require.Zero(t, high)
+	events, err = seeded.TopicPartition("events", 1)
+	require.NoError(t, err)
+	record, err = events.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("event"), record.Value)
+	_, err = topics.BackupTopic("missing", io.Discard)
+	require.ErrorAs(t, err, &api.ErrTopicNotFound{})
+}
+
+func TestPartitionedLogBackup(t *testing.T) {
+	l := setupPartitionedCluster(t, 1, 2)[0]
+	for p := uint32(0); p < 2; p++ {
+		part, err := l.Partition(p)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool { return part.raft.State() == raft.Leader }, 3*time.Second, 10*time.Millisecond)
+		_, err = part.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", p))})
+		require.NoError(t, err)
+	}
+	part, err := l.Partition(0)
+	require.NoError(t, err)
+	_, err = part.Snapshot()
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	manifest, err := l.Backup(&buf)
+	require.NoError(t, err)
+	var dirs []string
+	for _, bl := range manifest.Logs {
+		dirs = append(dirs, bl.Dir)
+	}
+	require.Equal(t, []string{"log", "raft/log", "partitions/1/log", "partitions/1/raft/log"}, dirs)
+	require.Equal(t, uint64(1), manifest.Logs[0].NextOffset)
+
+	topic, err := l.BackupTopic("", io.Discard)
+	require.NoError(t, err)
+	require.Equal(t, DefaultTopic, topic.Topic)
+	require.Len(t, topic.Logs, 4)
+	_, err = l.BackupTopic("missing", io.Discard)
+	require.ErrorAs(t, err, &api.ErrTopicNotFound{})
+
+	dir := t.TempDir()
+	extract(t, &buf, dir)
+	snapshots, err := filepath.Glob(filepath.Join(dir, "raft", "snapshots", "*", "state.bin"))
+	require.NoError(t, err)
+	require.Len(t, snapshots, 1)
+	log, err := NewLog(filepath.Join(dir, "partitions", "1", "log"), Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 1"), record.Value)
+}
@@ -0,0 +1,127 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// A batch is records appended together stored as one, see Config.Batch:
+// a header of the magic byte, the first record's offset, the count of
+// records, a CRC of what follows it and the codec, then the records, each
+// marshaled after its length, compressed together with the codec. Each
+// record's index entry has the batch's position.
+const (
+	// Starts a batch: field 0 of wire type 7, which no marshaled record
+	// starts with, nor, for not being zero, a sealed one
+	batchMagic = 0x07
+
+	batchBaseOff     = 1
+	batchCountOff    = batchBaseOff + 8
+	batchCRCOff      = batchCountOff + 4
+	batchCodecOff    = batchCRCOff + 4
+	batchHeaderWidth = batchCodecOff + 1
+)
+
+// ErrBatchChecksum is returned reading a batch that doesn't match its CRC
+var ErrBatchChecksum = errors.New("record batch checksum mismatch")
+
+var batchTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Reports whether the stored bytes are a batch rather than a record
+func isBatch(p []byte) bool {
+	return len(p) > 0 && p[0] == batchMagic
+}
+
+// Marshals the records, their offsets set, into a batch with the records
+// compressed with the codec, or not when that doesn't make them smaller
+func marshalBatch(records []*api.Record, c api.Codec) ([]byte, error) {
+	var body []byte
+	var err error
+	for _, record := range records {
+		body = protowire.AppendVarint(body, uint64(proto.Size(record)))
+		if body, err = (proto.MarshalOptions{}).MarshalAppend(body, record); err != nil {
+			return nil, err
+		}
+	}
+	compressed, err := codec.Encode(c, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(compressed) >= len(body) {
+		compressed, c = body, api.Codec_CODEC_NONE
+	}
+	b := make([]byte, batchHeaderWidth, batchHeaderWidth+len(compressed))
+	b[0] = batchMagic
+	enc.PutUint64(b[batchBaseOff:], records[0].Offset)
+	enc.PutUint32(b[batchCountOff:], uint32(len(records)))
+	b[batchCodecOff] = byte(c)
+	b = append(b, compressed...)
+	enc.PutUint32(b[batchCRCOff:], crc32.Checksum(b[batchCodecOff:], batchTable))
+	return b, nil
+}
+
+// A batch read back, its records marshaled and in order
+type recordBatch struct {
+	// pos is the batch's position in its store
+	pos     uint64
+	offs    []uint64
+	records [][]byte
+}
+
+// Checks the stored batch against its CRC and decompresses its records,
+// into a buffer of their own
+func unmarshalBatch(p []byte) (*recordBatch, error) {
+	if len(p) < batchHeaderWidth {
+		return nil, fmt.Errorf("record batch of %d bytes is shorter than its header", len(p))
+	}
+	if crc32.Checksum(p[batchCodecOff:], batchTable) != enc.Uint32(p[batchCRCOff:]) {
+		return nil, ErrBatchChecksum
+	}
+	c := api.Codec(p[batchCodecOff])
+	body, err := codec.Decode(c, p[batchHeaderWidth:])
+	if err != nil {
+		return nil, err
+	}
+	if c == api.Codec_CODEC_NONE {
+		// the stored bytes are the caller's
+		body = bytes.Clone(body)
+	}
+	n := enc.Uint32(p[batchCountOff:])
+	b := &recordBatch{offs: make([]uint64, 0, n), records: make([][]byte, 0, n)}
+	for len(body) > 0 {
+		size, m := protowire.ConsumeVarint(body)
+		if m < 0 || size > uint64(len(body)-m) {
+			return nil, errors.New("record batch has a torn record")
+		}
+		record := body[m : m+int(size)]
+		off, _, err := scanRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		b.offs = append(b.offs, off)
+		b.records = append(b.records, record)
+		body = body[m+int(size):]
+	}
+	if len(b.records) != int(n) {
+		return nil, fmt.Errorf("record batch has %d records, its header says %d", len(b.records), n)
+	}
+	return b, nil
+}
+
+// The batch's record at off marshaled, or the first after it compaction
+// left
+func (b *recordBatch) record(off uint64) ([]byte, error) {
+	i := sort.Search(len(b.offs), func(i int) bool { return b.offs[i] >= off })
+	if i == len(b.offs) {
+		return nil, fmt.Errorf("record batch at %d holds no record from offset %d", b.pos, off)
+	}
+	return b.records[i], nil
+}
@@ -0,0 +1,113 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/bufpool"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLogAppendBatch(t *testing.T) {
+	keys := NewKeyring()
+	require.NoError(t, keys.Add(1, make([]byte, 32)))
+	for name, keys := range map[string]*Keyring{"plaintext": nil, "sealed": keys} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			c := Config{Keyring: keys}
+			c.Segment.MaxIndexBytes = entWidth * 4
+			c.Batch.Enabled = true
+			c.Batch.Codec = api.Codec_CODEC_ZSTD
+			l, err := NewLog(dir, c)
+			require.NoError(t, err)
+			value := func(i int) []byte { return bytes.Repeat([]byte{'a' + byte(i)}, 64) }
+			var records []*api.Record
+			for i := range 6 {
+				records = append(records, &api.Record{Value: value(i)})
+			}
+
+			// a batch per segment the records span
+			offs, err := l.AppendBatch(records)
+			require.NoError(t, err)
+			require.Equal(t, []uint64{0, 1, 2, 3, 4, 5}, offs)
+			require.Len(t, l.segments, 2)
+			fi, err := os.Stat(filepath.Join(dir, "0.store"))
+			require.NoError(t, err)
+			require.Less(t, fi.Size(), int64(4*64), "the batch is compressed")
+			for i := range 6 {
+				record, err := l.Read(uint64(i))
+				require.NoError(t, err)
+				require.Equal(t, value(i), record.Value)
+				require.Equal(t, uint64(i), record.Offset)
+
+				into := &api.Record{}
+				_, err = l.ReadTo(uint64(i), nil, into)
+				require.NoError(t, err)
+				require.Equal(t, value(i), into.Value)
+
+				p, off, err := l.ReadMarshaled(uint64(i))
+				require.NoError(t, err)
+				require.Equal(t, uint64(i), off)
+				require.NoError(t, proto.Unmarshal(*p, into))
+				require.Equal(t, value(i), into.Value)
+				bufpool.Put(p)
+			}
+
+			// truncating into a batch keeps the records before it
+			require.NoError(t, l.TruncateFrom(2))
+			_, err = l.Read(2)
+			require.Error(t, err)
+			off, err := l.Append(&api.Record{Value: value(9)})
+			require.NoError(t, err)
+			require.Equal(t, uint64(2), off)
+			require.NoError(t, l.Close())
+
+			l, err = NewLog(dir, c)
+			require.NoError(t, err)
+			for i, want := range [][]byte{value(0), value(1), value(9)} {
+				record, err := l.Read(uint64(i))
+				require.NoError(t, err)
+				require.Equal(t, want, record.Value)
+			}
+			require.NoError(t, l.Close())
+			report, err := Verify(dir, VerifyOptions{Keyring: keys})
+			require.NoError(t, err)
+			require.Empty(t, report.Problems)
+			require.Equal(t, uint64(3), report.Records)
+		})
+	}
+}
+
+func TestBatchChecksum(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Batch.Enabled = true
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = l.AppendBatch([]*api.Record{{Value: []byte("hello")}, {Value: []byte("world")}})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	info, records := inspectAll(t, filepath.Join(dir, "0.store"), nil)
+	require.Equal(t, uint64(2), info.Records)
+	require.True(t, records[1].Batched)
+	require.Equal(t, RecordOK, records[1].Status)
+
+	// a bit flipped in the batch's records
+	name := filepath.Join(dir, "0.store")
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	b[len(b)-1] ^= 1
+	require.NoError(t, os.WriteFile(name, b, 0644))
+	_, records = inspectAll(t, name, nil)
+	require.Equal(t, RecordCorrupt, records[0].Status)
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	_, err = l.Read(1)
+	require.ErrorIs(t, err, ErrBatchChecksum)
+}
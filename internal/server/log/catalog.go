@@ -0,0 +1,456 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// clusterTopics are a PartitionedLog's topics besides the default one.
+// Partition 0's Raft group replicates their catalog, so every server knows
+// every topic, and each server opens a DistributedLog per topic partition
+// as it applies the topic's creation, each replicated by a Raft group of
+// its own. The groups are numbered after the default topic's partitions,
+// in the order the catalog hands them out, and keep their data under
+// groups/<group>, in the directory of their topic's tenant for a tenant's,
+// see Config.Tenants.
+type clusterTopics struct {
+	dir      string
+	config   Config
+	streams  *StreamLayer
+	registry *registry
+	logger   *zap.Logger
+
+	mu        sync.RWMutex
+	topics    map[string]*clusterTopic
+	nextGroup uint32
+	usage     *tenantUsage
+}
+
+// A topic in the catalog, its configs over the servers' settings and its
+// partitions' logs, which are missing if they failed to open
+type clusterTopic struct {
+	*api.ClusterTopic
+	config     TopicConfig
+	partitions []*DistributedLog
+}
+
+func newClusterTopics(dir string, config Config, streams *StreamLayer, registry *registry, firstGroup uint32) *clusterTopics {
+	t := &clusterTopics{
+		dir:       dir,
+		config:    config,
+		streams:   streams,
+		registry:  registry,
+		logger:    config.logger().Named("topics"),
+		topics:    make(map[string]*clusterTopic),
+		nextGroup: firstGroup,
+	}
+	t.usage = &tenantUsage{tenants: config.Tenants, dir: dir, sum: t.sumTenants}
+	return t
+}
+
+// Applies a committed change to the catalog, opening or removing the
+// topic's partitions on this server
+func (t *clusterTopics) apply(reqType RequestType, b []byte) interface{} {
+	switch reqType {
+	case CreateTopicRequestType:
+		var req api.ClusterTopic
+		if err := proto.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		if err := t.create(&req); err != nil {
+			return err
+		}
+		return &api.CreateTopicResponse{}
+	case DeleteTopicRequestType:
+		var req api.DeleteTopicRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		if err := t.delete(req.Name); err != nil {
+			return err
+		}
+		return &api.DeleteTopicResponse{}
+	case AlterTopicConfigsRequestType:
+		var req api.AlterTopicConfigsRequest
+		if err := proto.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		topic, err := t.alter(req.Name, req.Configs)
+		if err != nil {
+			return err
+		}
+		return &api.AlterTopicConfigsResponse{Topic: topic}
+	case CreatePartitionsRequestType:
+		var req api.ClusterTopic
+		if err := proto.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		topic, err := t.addPartitions(&req)
+		if err != nil {
+			return err
+		}
+		return &api.CreatePartitionsResponse{Topic: topic}
+	}
+	return nil
+}
+
+// Adds the topic, handing its partitions the next groups. The topic is in
+// the catalog even if its partitions fail to open here, every server
+// applies the same catalog.
+func (t *clusterTopics) create(ct *api.ClusterTopic) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	name := ct.Topic.GetName()
+	if _, ok := t.topics[name]; ok || name == DefaultTopic {
+		return api.ErrTopicExists{Topic: name}
+	}
+	config, err := t.config.topicConfig(name, ct.Topic.Configs)
+	if err != nil {
+		return err
+	}
+	ct.Groups = nil
+	for p := uint32(0); p < ct.Topic.Partitions; p++ {
+		ct.Groups = append(ct.Groups, t.nextGroup)
+		t.nextGroup++
+	}
+	topic := &clusterTopic{ClusterTopic: ct, config: config}
+	t.topics[name] = topic
+	return t.open(topic)
+}
+
+// Changes the topic's configs, an empty value removing one, returning the
+// topic as altered
+func (t *clusterTopics) alter(name string, configs map[string]string) (*api.Topic, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	topic, ok := t.topics[name]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	desc := proto.Clone(topic.Topic).(*api.Topic)
+	desc.Configs = alterConfigs(desc.Configs, configs)
+	config, err := t.config.topicConfig(name, desc.Configs)
+	if err != nil {
+		return nil, err
+	}
+	topic.Topic, topic.config = desc, config
+	return proto.Clone(desc).(*api.Topic), nil
+}
+
+// Raises the topic's partition count to ct's, handing the partitions added
+// the next groups, which start with ct's servers, and bumps the topic's
+// version. It returns the topic as changed.
+func (t *clusterTopics) addPartitions(ct *api.ClusterTopic) (*api.Topic, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	name := ct.Topic.GetName()
+	topic, ok := t.topics[name]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	n := ct.Topic.GetPartitions()
+	if n <= topic.Topic.Partitions {
+		return nil, fmt.Errorf("topic %s has %d partitions, can't have %d", name, topic.Topic.Partitions, n)
+	}
+	topic.Added = append(topic.Added, &api.AddedPartitions{First: topic.Topic.Partitions, Servers: ct.Servers})
+	for p := topic.Topic.Partitions; p < n; p++ {
+		topic.Groups = append(topic.Groups, t.nextGroup)
+		t.nextGroup++
+	}
+	desc := proto.Clone(topic.Topic).(*api.Topic)
+	desc.Partitions = n
+	desc.Version++
+	topic.Topic = desc
+	// the partitions are in the catalog even if they fail to open here
+	return proto.Clone(desc).(*api.Topic), t.open(topic)
+}
+
+// Takes the topic out of the catalog, removing its partitions' data
+func (t *clusterTopics) delete(name string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	topic, ok := t.topics[name]
+	if !ok {
+		return api.ErrTopicNotFound{Topic: name}
+	}
+	delete(t.topics, name)
+	return t.remove(topic)
+}
+
+// Opens the topic's partitions, bootstrapping their groups with the
+// servers the topic was created with, or the partitions added with, when
+// this is one of them
+func (t *clusterTopics) open(topic *clusterTopic) error {
+	for p := len(topic.partitions); p < len(topic.Groups); p++ {
+		group := topic.Groups[p]
+		members, bootstrap := t.members(topic.servers(uint32(p)))
+		c := t.config
+		c.Raft.Partition = group
+		c.Raft.StreamLayer = t.streams.Group(group)
+		c.Raft.Bootstrap = bootstrap
+		c.Raft.Members = members
+		c.Tier.Prefix += fmt.Sprintf("groups/%d/", group)
+		partition, err := NewDistributedLog(t.groupDir(topic.Topic.Name, group), c)
+		if err != nil {
+			c.Raft.StreamLayer.Close()
+			t.logger.Error("failed to open topic partition",
+				zap.String("topic", topic.Topic.Name),
+				zap.Int("partition", p),
+				zap.Error(err),
+			)
+			return fmt.Errorf("topic %s partition %d: %w", topic.Topic.Name, p, err)
+		}
+		partition.registry = t.registry
+		topic.partitions = append(topic.partitions, partition)
+	}
+	return nil
+}
+
+// The servers the group of the topic's partition p started with
+func (topic *clusterTopic) servers(p uint32) []*api.Server {
+	servers := topic.Servers
+	for _, added := range topic.Added {
+		if added.First <= p {
+			servers = added.Servers
+		}
+	}
+	return servers
+}
+
+// The servers as a group's members, and whether this server is one of them
+func (t *clusterTopics) members(servers []*api.Server) (members []raft.Server, local bool) {
+	for _, srv := range servers {
+		suffrage := raft.Nonvoter
+		if srv.Voter {
+			suffrage = raft.Voter
+		}
+		members = append(members, raft.Server{
+			Suffrage: suffrage,
+			ID:       raft.ServerID(srv.Id),
+			Address:  raft.ServerAddress(srv.RpcAddr),
+		})
+		local = local || raft.ServerID(srv.Id) == t.config.Raft.LocalID
+	}
+	return members, local
+}
+
+// Closes the topic's partitions and removes their data
+func (t *clusterTopics) remove(topic *clusterTopic) error {
+	var errs []error
+	for _, p := range topic.partitions {
+		errs = append(errs, p.Close(), p.config.Raft.StreamLayer.Close())
+	}
+	for _, group := range topic.Groups {
+		errs = append(errs, os.RemoveAll(t.groupDir(topic.Topic.Name, group)))
+	}
+	return errors.Join(errs...)
+}
+
+// The directory of the topic's group, in its tenant's directory unless the
+// group was opened before the tenant was declared
+func (t *clusterTopics) groupDir(topic string, group uint32) string {
+	name := strconv.FormatUint(uint64(group), 10)
+	dir := filepath.Join(t.dir, "groups", name)
+	tenant := t.config.TenantOf(topic)
+	if tenant == "" {
+		return dir
+	}
+	if _, err := os.Stat(dir); err == nil {
+		return dir
+	}
+	return filepath.Join(t.config.tenantDir(t.dir, tenant), "groups", name)
+}
+
+// The catalog for a snapshot
+func (t *clusterTopics) marshal() ([]byte, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	catalog := &api.TopicCatalog{NextGroup: t.nextGroup}
+	for _, topic := range t.topics {
+		catalog.Topics = append(catalog.Topics, topic.ClusterTopic)
+	}
+	slices.SortFunc(catalog.Topics, func(a, b *api.ClusterTopic) int {
+		return strings.Compare(a.Topic.Name, b.Topic.Name)
+	})
+	b, err := proto.Marshal(catalog)
+	if b == nil {
+		b = []byte{}
+	}
+	return b, err
+}
+
+// Replaces the catalog with a snapshot's, removing the topics it doesn't
+// have and opening those it does. An empty b is an empty catalog.
+func (t *clusterTopics) restore(b []byte) error {
+	catalog := &api.TopicCatalog{}
+	if err := proto.Unmarshal(b, catalog); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var errs []error
+	restored := make(map[string]*clusterTopic)
+	for _, ct := range catalog.Topics {
+		// a topic that only had partitions added keeps those it has open
+		topic, ok := t.topics[ct.Topic.Name]
+		if !ok || len(topic.Groups) > len(ct.Groups) ||
+			!slices.Equal(topic.Groups, ct.Groups[:len(topic.Groups)]) {
+			topic = &clusterTopic{ClusterTopic: ct}
+		}
+		// the catalog only ever took valid configs
+		topic.ClusterTopic = ct
+		topic.config, _ = t.config.topicConfig(ct.Topic.Name, ct.Topic.Configs)
+		restored[ct.Topic.Name] = topic
+	}
+	for name, topic := range t.topics {
+		if restored[name] != topic {
+			errs = append(errs, t.remove(topic))
+		}
+	}
+	for _, topic := range restored {
+		errs = append(errs, t.open(topic))
+	}
+	t.topics = restored
+	t.nextGroup = max(t.nextGroup, catalog.NextGroup)
+	return errors.Join(errs...)
+}
+
+// The log of the topic's partition p, api.ErrTopicNotFound or
+// api.ErrPartitionNotFound
+func (t *clusterTopics) partition(name string, p uint32) (*DistributedLog, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	topic, ok := t.topics[name]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	if p >= topic.Topic.Partitions {
+		return nil, api.ErrPartitionNotFound{Partition: p, Partitions: int(topic.Topic.Partitions)}
+	}
+	if p >= uint32(len(topic.partitions)) {
+		return nil, fmt.Errorf("topic %s partition %d isn't open on this server", name, p)
+	}
+	return topic.partitions[p], nil
+}
+
+// The topic's description, or api.ErrTopicNotFound
+func (t *clusterTopics) describe(name string) (*api.Topic, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	topic, ok := t.topics[name]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	return proto.Clone(topic.Topic).(*api.Topic), nil
+}
+
+// The topic's settings, or api.ErrTopicNotFound
+func (t *clusterTopics) topicConfig(name string) (TopicConfig, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	topic, ok := t.topics[name]
+	if !ok {
+		return TopicConfig{}, api.ErrTopicNotFound{Topic: name}
+	}
+	return topic.config, nil
+}
+
+// Changes the servers' settings the topics' configs override
+func (t *clusterTopics) setDefaults(c TopicConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.config.Topic = c
+	for name, topic := range t.topics {
+		// the catalog only ever took valid configs
+		topic.config, _ = t.config.topicConfig(name, topic.Topic.Configs)
+	}
+}
+
+// The topics' descriptions, in no order
+func (t *clusterTopics) list() []*api.Topic {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var topics []*api.Topic
+	for _, topic := range t.topics {
+		topics = append(topics, proto.Clone(topic.Topic).(*api.Topic))
+	}
+	return topics
+}
+
+// Every open topic partition's log
+func (t *clusterTopics) groups() []*DistributedLog {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var groups []*DistributedLog
+	for _, topic := range t.topics {
+		groups = append(groups, topic.partitions...)
+	}
+	return groups
+}
+
+// The logs of the topic's partitions open on this server, or
+// api.ErrTopicNotFound
+func (t *clusterTopics) partitions(name string) ([]*DistributedLog, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	topic, ok := t.topics[name]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	return slices.Clone(topic.partitions), nil
+}
+
+// Applies each topic's retention and compaction to its partitions on this
+// server
+func (t *clusterTopics) cleanup() {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, topic := range t.topics {
+		for p, l := range topic.partitions {
+			if err := l.cleanup(topic.config); err != nil {
+				t.logger.Error("failed to clean up topic partition",
+					zap.String("topic", topic.Topic.Name),
+					zap.Int("partition", p),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+// Adds each topic partition's bytes on this server
+func (t *clusterTopics) sumTenants(add func(topic string, bytes uint64)) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for name, topic := range t.topics {
+		add(name, 0)
+		for _, l := range topic.partitions {
+			add(name, l.log.size())
+		}
+	}
+}
+
+// Closes the topic partitions' logs, keeping their data
+func (t *clusterTopics) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var errs []error
+	for _, topic := range t.topics {
+		for _, p := range topic.partitions {
+			errs = append(errs, p.Close(), p.config.Raft.StreamLayer.Close())
+		}
+		topic.partitions = nil
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,243 @@
+package log
+
+import (
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+// How often partitions are cleaned up when Config.CleanupInterval is unset
+const defaultCleanupInterval = time.Minute
+
+func (c *Config) cleanupInterval() time.Duration {
+	if c.CleanupInterval > 0 {
+		return c.CleanupInterval
+	}
+	return defaultCleanupInterval
+}
+
+// expired returns the offset the records before which the config's
+// retention removes, zero when it removes none. A sealed segment expires
+// once its last record is older than the retention, or while the log holds
+// more bytes than the retention's without it. The active segment never
+// does.
+func (l *Log) expired(c TopicConfig, now time.Time) uint64 {
+	if c.Retention == 0 && c.RetentionBytes == 0 {
+		return 0
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var size uint64
+	for _, s := range l.segments {
+		size += s.store.size
+	}
+	var before uint64
+	for _, s := range l.segments {
+		if s == l.activeSegment || s.nextOffset == s.baseOffset {
+			break
+		}
+		expired := c.RetentionBytes > 0 && size > c.RetentionBytes
+		if c.Retention > 0 && !expired {
+			last, err := s.Read(s.nextOffset - 1)
+			expired = err == nil && last.Timestamp != 0 &&
+				now.Sub(time.Unix(0, last.Timestamp)) > c.Retention
+		}
+		if !expired {
+			break
+		}
+		size -= s.store.size
+		before = s.nextOffset
+	}
+	return before
+}
+
+// CompactionStats are how a log's compactions went since it opened
+type CompactionStats struct {
+	// Running is set while the log compacts, SegmentsDone of its Segments
+	// sealed segments gone through so far
+	Running      bool `json:"running"`
+	SegmentsDone int  `json:"segments_done"`
+	Segments     int  `json:"segments"`
+	// DirtyRatio is the share of the sealed segments' bytes written since
+	// the log last compacted, all of them until it has
+	DirtyRatio float64 `json:"dirty_ratio"`
+	// Runs counts the compactions finished, LastRun when the last started
+	// and LastDuration how long it took
+	Runs         uint64        `json:"runs"`
+	LastRun      time.Time     `json:"last_run"`
+	LastDuration time.Duration `json:"last_duration"`
+	// The records and store bytes the compactions removed, tombstones
+	// being the records with a key and no value
+	RecordsRemoved    uint64 `json:"records_removed"`
+	BytesReclaimed    uint64 `json:"bytes_reclaimed"`
+	TombstonesRemoved uint64 `json:"tombstones_removed"`
+}
+
+// compaction tracks a log's compactions apart from mu, which a compaction
+// holds throughout
+type compaction struct {
+	mu    sync.Mutex
+	stats CompactionStats
+	// cleaned is the offset the last compaction went up to, the sealed
+	// segments from it on dirty
+	cleaned uint64
+}
+
+// CompactionStats describes the log's compactions, and the one running
+func (l *Log) CompactionStats() CompactionStats {
+	l.compaction.mu.Lock()
+	defer l.compaction.mu.Unlock()
+	stats := l.compaction.stats
+	stats.DirtyRatio = l.dirtyRatio(l.compaction.cleaned)
+	return stats
+}
+
+// The share of the sealed segments' bytes from cleaned on, read from the
+// published segments so it doesn't wait for a compaction
+func (l *Log) dirtyRatio(cleaned uint64) float64 {
+	sealed := l.sealed.Load()
+	if sealed == nil {
+		return 0
+	}
+	var total, dirty uint64
+	for _, s := range *sealed {
+		total += s.store.size
+		if s.baseOffset >= cleaned {
+			dirty += s.store.size
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+	return float64(dirty) / float64(total)
+}
+
+// Tombstone is whether the record is a tombstone, with a key and no value,
+// which deletes the key from a compacted log: compaction removes the key's
+// records before it, and the tombstone itself once it's older than the
+// topic's TopicConfig.DeleteRetention.
+func Tombstone(record *api.Record) bool {
+	return len(record.Key) > 0 && len(record.Value) == 0 && record.Control == api.Control_CONTROL_NONE
+}
+
+// Compact removes the records of sealed segments that a later record with
+// the same key supersedes, so the log keeps the latest record of each key,
+// and the tombstones older than deleteRetention, none when it's zero.
+// Records without a key are kept, and so is each segment's last record so
+// the segments' offsets carry on. Reads of an offset compaction removed
+// get the next record kept. It returns how many records it removed.
+func (l *Log) Compact(deleteRetention time.Duration) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	start := time.Now()
+	sealed := len(l.segments) - 1
+	l.compaction.mu.Lock()
+	l.compaction.stats.Running = true
+	l.compaction.stats.SegmentsDone, l.compaction.stats.Segments = 0, sealed
+	l.compaction.mu.Unlock()
+	var removed, tombstones, reclaimed uint64
+	defer func() {
+		l.compaction.mu.Lock()
+		defer l.compaction.mu.Unlock()
+		stats := &l.compaction.stats
+		stats.Running = false
+		stats.Runs++
+		stats.LastRun, stats.LastDuration = start, time.Since(start)
+		stats.RecordsRemoved += removed
+		stats.TombstonesRemoved += tombstones
+		stats.BytesReclaimed += reclaimed
+		if stats.SegmentsDone == sealed {
+			l.compaction.cleaned = l.activeSegment.baseOffset
+		}
+		recordsCompacted.Add(float64(removed))
+		tombstonesRemoved.Add(float64(tombstones))
+		compactionBytesReclaimed.Add(float64(reclaimed))
+	}()
+
+	latest := make(map[string]uint64)
+	for _, s := range l.segments {
+		err := s.each(func(record *api.Record) error {
+			if record.Key != nil {
+				latest[string(record.Key)] = record.Offset
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	superseded := func(s *segment, record *api.Record) bool {
+		if record.Key == nil || record.Offset == s.nextOffset-1 {
+			return false
+		}
+		return latest[string(record.Key)] > record.Offset ||
+			deleteRetention > 0 && Tombstone(record) &&
+				start.Sub(time.Unix(0, record.Timestamp)) > deleteRetention
+	}
+	for i, s := range l.segments {
+		if s == l.activeSegment {
+			break
+		}
+		var n, tomb uint64
+		err := s.each(func(record *api.Record) error {
+			if superseded(s, record) {
+				n++
+				if Tombstone(record) {
+					tomb++
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return int(removed), err
+		}
+		if n > 0 {
+			size := s.store.size
+			err = l.rebuild(i, func(record *api.Record) *api.Record {
+				if superseded(s, record) {
+					return nil
+				}
+				return record
+			})
+			if err != nil {
+				return int(removed), err
+			}
+			removed += n
+			tombstones += tomb
+			reclaimed += size - min(l.segments[i].store.size, size)
+		}
+		l.compaction.mu.Lock()
+		l.compaction.stats.SegmentsDone++
+		l.compaction.mu.Unlock()
+	}
+	return int(removed), l.punchDeleted()
+}
+
+// Removes what the config's retention expires and compacts as it asks
+func (l *Log) cleanup(c TopicConfig) error {
+	if before := l.expired(c, time.Now()); before > 0 {
+		if _, err := l.DeleteRecords(before); err != nil {
+			return err
+		}
+	}
+	if l.cleanable(c) {
+		_, err := l.Compact(c.DeleteRetention)
+		return err
+	}
+	return nil
+}
+
+// Whether cleanups compact the log with the config, when it asks to and
+// enough of the log is dirty
+func (l *Log) cleanable(c TopicConfig) bool {
+	if !c.Compact {
+		return false
+	}
+	if c.MinCleanableDirtyRatio == 0 {
+		return true
+	}
+	l.compaction.mu.Lock()
+	defer l.compaction.mu.Unlock()
+	return l.dirtyRatio(l.compaction.cleaned) >= c.MinCleanableDirtyRatio
+}
@@ -0,0 +1,288 @@
+package log
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "a", "b", "c", "a", "a"} {
+		_, err := log.Append(&api.Record{Key: []byte(key), Value: []byte(key)})
+		require.NoError(t, err)
+	}
+
+	removed, err := log.Compact(0)
+	require.NoError(t, err)
+	// 0 and 1 are superseded, 5 is too but ends its segment
+	require.Equal(t, 2, removed)
+	offsets := func(l *Log) []uint64 {
+		var offs []uint64
+		for off := l.Stats().LowWatermark; off < l.Stats().HighWatermark; {
+			record, err := l.Read(off)
+			require.NoError(t, err)
+			offs = append(offs, record.Offset)
+			off = record.Offset + 1
+		}
+		return offs
+	}
+	require.Equal(t, []uint64{2, 3, 4, 5, 6}, offsets(log))
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), record.Offset)
+	require.Equal(t, "a", string(record.Value))
+	removed, err = log.Compact(0)
+	require.NoError(t, err)
+	require.Zero(t, removed)
+	_, err = log.Checksums(RangeSize)
+	require.NoError(t, err)
+
+	// the gaps survive a restart, and appends carry on after them
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 3, 4, 5, 6}, offsets(log))
+	off, err := log.Append(&api.Record{Key: []byte("b")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), off)
+
+	// a log restored from a compacted one keeps the offsets
+	c.Segment.InitialOffset = 2
+	restored, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	for _, off := range offsets(log) {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		_, err = restored.appendAt(record)
+		require.NoError(t, err)
+	}
+	require.Equal(t, []uint64{2, 3, 4, 5, 6, 7}, offsets(restored))
+	_, err = restored.appendAt(&api.Record{Offset: 3})
+	require.Error(t, err)
+	require.NoError(t, restored.Close())
+	require.NoError(t, log.Close())
+}
+
+func TestCompactionStats(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	appendKeys := func(keys ...string) {
+		for _, key := range keys {
+			// a's first record is a tombstone
+			var value []byte
+			if key != "a" || log.Stats().HighWatermark > 0 {
+				value = []byte(key)
+			}
+			_, err := log.Append(&api.Record{Key: []byte(key), Value: value})
+			require.NoError(t, err)
+		}
+	}
+	appendKeys("a", "b", "a", "b", "c", "a", "a")
+
+	// nothing's been compacted, so it's all dirty
+	stats := log.CompactionStats()
+	require.Equal(t, 1.0, stats.DirtyRatio)
+	require.Zero(t, stats.Runs)
+	require.True(t, stats.LastRun.IsZero())
+
+	removed, err := log.Compact(0)
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	stats = log.CompactionStats()
+	require.False(t, stats.Running)
+	require.Equal(t, 2, stats.Segments)
+	require.Equal(t, 2, stats.SegmentsDone)
+	require.Equal(t, uint64(1), stats.Runs)
+	require.False(t, stats.LastRun.IsZero())
+	require.Equal(t, uint64(2), stats.RecordsRemoved)
+	require.Equal(t, uint64(1), stats.TombstonesRemoved)
+	require.NotZero(t, stats.BytesReclaimed)
+	require.Zero(t, stats.DirtyRatio)
+
+	// a segment sealed since is dirty, and cleanups wait for enough of it
+	appendKeys("b", "c", "b")
+	dirty := log.CompactionStats().DirtyRatio
+	require.Greater(t, dirty, 0.0)
+	require.Less(t, dirty, 1.0)
+	require.NoError(t, log.cleanup(TopicConfig{Compact: true, MinCleanableDirtyRatio: 0.9}))
+	require.Equal(t, uint64(1), log.CompactionStats().Runs)
+	require.NoError(t, log.cleanup(TopicConfig{Compact: true, MinCleanableDirtyRatio: 0.1}))
+	require.Equal(t, uint64(2), log.CompactionStats().Runs)
+
+	_, err = TopicConfig{}.With(map[string]string{MinCleanableDirtyRatioConfig: "1.5"})
+	require.Error(t, err)
+	tc, err := TopicConfig{}.With(map[string]string{MinCleanableDirtyRatioConfig: "0.5"})
+	require.NoError(t, err)
+	require.Equal(t, 0.5, tc.MinCleanableDirtyRatio)
+}
+
+func TestCompactTombstones(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	old := time.Now().Add(-time.Hour).UnixNano()
+	for _, record := range []*api.Record{
+		{Key: []byte("a"), Value: []byte("a")},
+		// a's deleted an hour ago, b just now
+		{Key: []byte("a"), Timestamp: old},
+		{Key: []byte("c"), Value: []byte("c")},
+		{Key: []byte("b"), Value: []byte("b")},
+		{Key: []byte("b")},
+		{Key: []byte("d"), Value: []byte("d")},
+		{Key: []byte("e"), Value: []byte("e")},
+	} {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.True(t, Tombstone(&api.Record{Key: []byte("a")}))
+	require.False(t, Tombstone(&api.Record{Value: []byte("a")}))
+	require.False(t, Tombstone(&api.Record{Key: []byte("a"), Control: api.Control_CONTROL_COMMIT}))
+
+	// without a retention tombstones stay, only the values they delete go
+	removed, err := log.Compact(0)
+	require.NoError(t, err)
+	require.Equal(t, 2, removed)
+	record, err := log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), record.Offset)
+	require.True(t, Tombstone(record))
+
+	removed, err = log.Compact(time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, 1, removed)
+	record, err = log.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), record.Offset)
+	record, err = log.Read(4)
+	require.NoError(t, err)
+	require.True(t, Tombstone(record))
+	stats := log.CompactionStats()
+	require.Equal(t, uint64(1), stats.TombstonesRemoved)
+}
+
+func TestExpired(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		// a record an hour apart, the last one now
+		ts := now.Add(time.Duration(i-4) * time.Hour).UnixNano()
+		_, err := log.Append(&api.Record{Value: []byte("record"), Timestamp: ts})
+		require.NoError(t, err)
+	}
+	var segment uint64
+	for _, s := range log.SegmentStats()[:2] {
+		segment = max(segment, s.StoreBytes)
+	}
+
+	require.Zero(t, log.expired(TopicConfig{}, now))
+	// the first segment's last record is three hours old, the second's an hour
+	require.Equal(t, uint64(2), log.expired(TopicConfig{Retention: 2 * time.Hour}, now))
+	require.Equal(t, uint64(4), log.expired(TopicConfig{Retention: time.Minute}, now))
+	// the active segment is never expired
+	require.Equal(t, uint64(4), log.expired(TopicConfig{RetentionBytes: 1}, now))
+	require.Equal(t, uint64(2), log.expired(TopicConfig{RetentionBytes: 2 * segment}, now))
+
+	require.NoError(t, log.cleanup(TopicConfig{Retention: 2 * time.Hour}))
+	require.Equal(t, uint64(2), log.Stats().LowWatermark)
+}
+
+func TestTopicConfig(t *testing.T) {
+	defaults := TopicConfig{Retention: time.Hour, MaxRecordBytes: 100}
+	c, err := defaults.With(map[string]string{
+		RetentionMsConfig:         "1000",
+		CleanupPolicyConfig:       "compact",
+		CompressionTypeConfig:     "zstd",
+		AcksConfig:                "leader",
+		SchemaValidationConfig:    "true",
+		SchemaCompatibilityConfig: "full",
+		MaxRecordBytesConfig:      "",
+		DedupWindowMsConfig:       "60000",
+		DedupKeyConfig:            "true",
+	})
+	require.NoError(t, err)
+	require.Equal(t, TopicConfig{
+		Retention:           time.Second,
+		MaxRecordBytes:      100,
+		Compact:             true,
+		Compression:         api.Codec_CODEC_ZSTD,
+		Ack:                 api.Ack_ACK_LEADER,
+		ValidateSchema:      true,
+		SchemaCompatibility: CompatibilityFull,
+		DedupWindow:         time.Minute,
+		DedupKey:            true,
+	}, c)
+	for _, configs := range []map[string]string{
+		{"retention.hours": "1"},
+		{RetentionMsConfig: "-1"},
+		{CleanupPolicyConfig: "keep"},
+		{CompressionTypeConfig: "gzip"},
+		{AcksConfig: "default"},
+		{SchemaValidationConfig: "strict"},
+		{SchemaCompatibilityConfig: "transitive"},
+		{DedupWindowRecordsConfig: "-1"},
+		{CompressionLevelConfig: "23"},
+	} {
+		require.Error(t, ValidateTopicConfigs(configs), configs)
+	}
+
+	_, err = c.Prepare(&api.Record{Value: make([]byte, 101)})
+	require.ErrorAs(t, err, &api.ErrRecordTooLarge{})
+	record := &api.Record{Value: make([]byte, 100)}
+	prepared, err := c.Prepare(record)
+	require.NoError(t, err)
+	require.Equal(t, api.Codec_CODEC_ZSTD, prepared.Codec)
+	require.Equal(t, api.Codec_CODEC_NONE, record.Codec)
+
+	// records producers compressed with snappy are kept so, unless the topic
+	// recompresses them
+	value := bytes.Repeat([]byte("proglog "), 100)
+	snappy, err := codec.Compress(api.Codec_CODEC_SNAPPY, &api.Record{Value: value})
+	require.NoError(t, err)
+	prepared, err = c.Prepare(snappy)
+	require.NoError(t, err)
+	require.Equal(t, api.Codec_CODEC_SNAPPY, prepared.Codec)
+	cold, err := c.With(map[string]string{CompressionRecompressConfig: "true", CompressionLevelConfig: "19"})
+	require.NoError(t, err)
+	prepared, err = cold.Prepare(snappy)
+	require.NoError(t, err)
+	require.Equal(t, api.Codec_CODEC_ZSTD, prepared.Codec)
+	require.Less(t, len(prepared.Value), len(snappy.Value))
+	require.Equal(t, api.Codec_CODEC_SNAPPY, snappy.Codec)
+	require.NoError(t, codec.Decompress(prepared))
+	require.Equal(t, value, prepared.Value)
+	plain, err := cold.With(map[string]string{CompressionTypeConfig: "none"})
+	require.NoError(t, err)
+	prepared, err = plain.Prepare(snappy)
+	require.NoError(t, err)
+	require.Equal(t, api.Codec_CODEC_NONE, prepared.Codec)
+	require.Equal(t, value, prepared.Value)
+
+	require.Equal(t, api.Ack_ACK_LEADER, c.AckLevel(api.Ack_ACK_DEFAULT))
+	require.Equal(t, api.Ack_ACK_ALL, c.AckLevel(api.Ack_ACK_ALL))
+
+	require.Equal(t,
+		map[string]string{RetentionMsConfig: "1000", AcksConfig: "all"},
+		alterConfigs(
+			map[string]string{RetentionMsConfig: "1000", CleanupPolicyConfig: "compact"},
+			map[string]string{CleanupPolicyConfig: "", AcksConfig: "all"},
+		),
+	)
+}
@@ -0,0 +1,116 @@
+package log
+
+import (
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+type Config struct {
+	Raft struct {
+		raft.Config
+		// BindAddr is the address peers reach this server's raft on
+		BindAddr    string
+		StreamLayer *StreamLayer
+		// Bootstrap makes this server the first voter of a new cluster
+		Bootstrap bool
+		// Members are the servers a bootstrapped group starts with, this
+		// one alone when empty. Every member bootstraps with the same ones.
+		Members []raft.Server
+		// Ack is the level appends use when the request leaves it to the
+		// server, api.Ack_ACK_ALL when unset
+		Ack api.Ack
+		// MinInSyncReplicas rejects ACK_ALL appends while fewer voters, the
+		// leader included, are in sync. Zero never rejects.
+		MinInSyncReplicas int
+		// MaxReplicationLag takes a follower out of sync while the oldest
+		// entry it's missing is older than this. Zero only goes by heartbeats.
+		MaxReplicationLag time.Duration
+		// Zone is the zone, rack or availability zone this server runs in
+		Zone string
+		// NodeID, Version and HTTPAddr are registered with the cluster
+		// along with BindAddr and Zone, see PartitionedLog.Register
+		NodeID   string
+		Version  string
+		HTTPAddr string
+		// MaxVoters caps how many servers vote, picked evenly across zones
+		// so losing one is less likely to lose a quorum. The others
+		// replicate without voting. Zero makes every server a voter.
+		MaxVoters int
+		// Partitions splits the log into partitions, each replicated by
+		// its own Raft group with its own leader, see PartitionedLog. Zero
+		// runs one.
+		Partitions int
+		// Partition is the partition a DistributedLog replicates, or the
+		// Raft group of a topic's partition, set by PartitionedLog
+		Partition uint32
+	}
+	Segment struct {
+		MaxStoreBytes uint64
+		MaxIndexBytes uint64
+		InitialOffset uint64
+	}
+	// Tier archives sealed segments to an object store so the log can hold
+	// more than local disk does. Reads of archived offsets fetch the segment
+	// and cache it. Without a Store every segment stays on local disk.
+	Tier struct {
+		Store ObjectStore
+		// Prefix starts every key, so logs sharing a bucket keep apart
+		Prefix string
+		// LocalSegments is how many of the newest archived segments are
+		// kept on local disk too, zero evicts them once archived
+		LocalSegments int
+		// CacheSegments is how many fetched segments are kept, 4 when unset
+		CacheSegments int
+	}
+	// Batch stores the records appended together, see Log.AppendBatch, as
+	// one batch with a CRC rather than a record each, compressed with
+	// Codec. Logs read batches whether or not they write them.
+	Batch struct {
+		Enabled bool
+		Codec   api.Codec
+	}
+	// ReadAhead, when set, reads stores ahead of consumers reading them in
+	// order
+	ReadAhead *ReadAhead
+	// IndexCache, when set, caps how many sealed segments' indexes are
+	// mapped, opening them as they're read
+	IndexCache *IndexCache
+	// Keyring, when set, encrypts every segment's store at rest
+	Keyring *Keyring
+	// Faults, when set, injects faults into the I/O on segments' files, for
+	// tests and chaos experiments
+	Faults *Faults
+	// IOUring reads, writes and syncs stores through io_uring, sharing a
+	// ring between them so concurrent operations are submitted together.
+	// Stores use plain files where there's no io_uring, or with Faults.
+	IOUring bool
+	// SyncOnAppend fsyncs the active segment before Append returns.
+	// Concurrent appends share an fsync.
+	SyncOnAppend bool
+	// SyncWindow is how long an append synced on append waits for others to
+	// share its fsync with, none when zero
+	SyncWindow time.Duration
+	// Topic is the settings of topics that don't override them, see
+	// TopicConfig
+	Topic TopicConfig
+	// CleanupInterval is how often partitions remove the records their
+	// topic's retention expires and compact, a minute when unset
+	CleanupInterval time.Duration
+	// Tenants are the tenants whose topics, those named after them and a
+	// '.', are kept apart from other topics, see Tenant
+	Tenants map[string]Tenant
+	// Logger logs what the log does by itself, such as recovering segments
+	// and cleaning up, a no-op logger when unset
+	Logger *zap.Logger
+}
+
+// The Logger, or a no-op logger when it's unset
+func (c Config) logger() *zap.Logger {
+	if c.Logger == nil {
+		return zap.NewNop()
+	}
+	return c.Logger
+}
@@ -0,0 +1,137 @@
+package log
+
+import (
+	"errors"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var errRecordWireType = errors.New("record field has the wrong wire type")
+
+// Decodes the marshaled record into record as proto.Unmarshal does, only
+// its value, key and headers' values are slices of b rather than copies,
+// and its headers slice is reused. Header keys are strings, so copied.
+func unmarshalRecord(b []byte, record *api.Record) error {
+	headers := record.Headers[:0]
+	record.Reset()
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case (num == 1 || num == 7 || num == 8) && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case 1:
+				record.Value = v
+			case 7:
+				record.Key = v
+			default:
+				h := &api.Header{}
+				if err := unmarshalHeader(v, h); err != nil {
+					return err
+				}
+				headers = append(headers, h)
+			}
+		case num >= 2 && num <= 6 && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			switch num {
+			case 2:
+				record.Offset = v
+			case 3:
+				record.Timestamp = int64(v)
+			case 4:
+				record.Term = v
+			case 5:
+				record.Type = uint32(v)
+			default:
+				record.Codec = api.Codec(v)
+			}
+		case num >= 1 && num <= 8:
+			return errRecordWireType
+		default:
+			// a field this version doesn't know
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+		}
+	}
+	if len(headers) > 0 {
+		record.Headers = headers
+	}
+	return nil
+}
+
+func unmarshalHeader(b []byte, h *api.Header) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num != 1 && num != 2 || typ != protowire.BytesType {
+			n := protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num == 1 {
+			h.Key = string(v)
+		} else {
+			h.Value = v
+		}
+	}
+	return nil
+}
+
+// Scans the marshaled record for its offset and the length of its value
+func scanRecord(b []byte) (off uint64, n int, err error) {
+	for len(b) > 0 {
+		num, typ, m := protowire.ConsumeTag(b)
+		if m < 0 {
+			return 0, 0, protowire.ParseError(m)
+		}
+		b = b[m:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			v, m := protowire.ConsumeBytes(b)
+			if m < 0 {
+				return 0, 0, protowire.ParseError(m)
+			}
+			n, b = len(v), b[m:]
+		case num == 2 && typ == protowire.VarintType:
+			v, m := protowire.ConsumeVarint(b)
+			if m < 0 {
+				return 0, 0, protowire.ParseError(m)
+			}
+			off, b = v, b[m:]
+		default:
+			m := protowire.ConsumeFieldValue(num, typ, b)
+			if m < 0 {
+				return 0, 0, protowire.ParseError(m)
+			}
+			b = b[m:]
+		}
+	}
+	return off, n, nil
+}
@@ -0,0 +1,53 @@
+package log
+
+import (
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestUnmarshalRecord(t *testing.T) {
+	want := &api.Record{
+		Value:     []byte("hello world"),
+		Offset:    7,
+		Timestamp: 1700000000000000000,
+		Term:      3,
+		Type:      1,
+		Codec:     api.Codec_CODEC_ZSTD,
+		Key:       []byte("user-1"),
+		Headers: []*api.Header{
+			{Key: "source", Value: []byte("billing")},
+			{Key: "source", Value: []byte("audit")},
+		},
+	}
+	b, err := proto.Marshal(want)
+	require.NoError(t, err)
+	// a field from a later version is skipped
+	b = protowire.AppendTag(b, 99, protowire.VarintType)
+	b = protowire.AppendVarint(b, 1)
+
+	// decoded into a record that already held another
+	got := &api.Record{Value: []byte("stale"), Headers: []*api.Header{{Key: "stale"}}}
+	require.NoError(t, unmarshalRecord(b, got))
+	require.Equal(t, want.Value, got.Value)
+	require.Equal(t, want.Key, got.Key)
+	require.Equal(t, want.Offset, got.Offset)
+	require.Equal(t, want.Timestamp, got.Timestamp)
+	require.Equal(t, want.Term, got.Term)
+	require.Equal(t, want.Type, got.Type)
+	require.Equal(t, want.Codec, got.Codec)
+	require.Len(t, got.Headers, 2)
+	for i, h := range want.Headers {
+		require.Equal(t, h.Key, got.Headers[i].Key)
+		require.Equal(t, h.Value, got.Headers[i].Value)
+	}
+	// the value's a slice of what it was decoded from, field 1 marshaled
+	// first after its tag and length
+	require.Same(t, &b[2], &got.Value[0])
+
+	// cut off in the value
+	require.Error(t, unmarshalRecord(b[:5], &api.Record{}))
+}
@@ -0,0 +1,58 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The file in a data directory the process using it holds a lock on,
+// naming it by its PID
+const lockFile = "proglog.lock"
+
+// ErrLocked is returned locking a data directory another process uses
+var ErrLocked = errors.New("data directory is in use")
+
+// DirLock is a data directory's lock, see LockDir
+type DirLock struct {
+	f *os.File
+}
+
+// LockDir locks the data directory dir so a second server, or an offline
+// tool, can't use it at the same time and corrupt it. It fails with ErrLocked while another process, or another
+// lock in this one, holds it. The lock goes with the process however it
+// exits, a crash doesn't leave it held.
+func LockDir(dir string) (*DirLock, error) {
+	path := filepath.Join(dir, lockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFileHandle(f); err != nil {
+		f.Close()
+		if !errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("locking %s: %w", path, err)
+		}
+		if b, rerr := os.ReadFile(path); rerr == nil && len(b) > 0 {
+			return nil, fmt.Errorf("%s by process %s: %w", dir, strings.TrimSpace(string(b)), err)
+		}
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+	// the PID is only what an error names, the lock is what's held
+	if err := f.Truncate(0); err == nil {
+		_, _ = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &DirLock{f: f}, nil
+}
+
+// Unlock releases the lock, leaving the file for the next process to lock
+func (l *DirLock) Unlock() error {
+	if err := unlockFileHandle(l.f); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,29 @@
+package log
+
+import (
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockDir(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := LockDir(dir)
+	require.NoError(t, err)
+
+	// a second lock, as another process would take, fails naming the holder
+	_, err = LockDir(dir)
+	require.ErrorIs(t, err, ErrLocked)
+	require.ErrorContains(t, err, "by process "+strconv.Itoa(os.Getpid()))
+	_, err = Verify(dir, VerifyOptions{})
+	require.ErrorIs(t, err, ErrLocked)
+	_, err = Migrate(dir, MigrateOptions{})
+	require.ErrorIs(t, err, ErrLocked)
+
+	require.NoError(t, lock.Unlock())
+	lock, err = LockDir(dir)
+	require.NoError(t, err)
+	require.NoError(t, lock.Unlock())
+}
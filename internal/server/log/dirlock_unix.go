@@ -0,0 +1,22 @@
+//go:build unix
+
+package log
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+func lockFileHandle(f *os.File) error {
+	err := unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return ErrLocked
+	}
+	return err
+}
+
+func unlockFileHandle(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
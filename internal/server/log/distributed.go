@@ -0,0 +1,1419 @@
+package log
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// DistributedLog replicates appends with Raft. Every append goes through the
+// leader and returns once a quorum has committed it; reads are served from
+// the local copy.
+type DistributedLog struct {
+	config      Config
+	log         *Log
+	raftLog     *logStore
+	stableStore *raftboltdb.BoltStore
+	raft        *raft.Raft
+	isr         *isrTracker
+	lag         *lagTracker
+	placement   *placement
+	acks        *leaderAcks
+	// set once the log has caught up after starting
+	caughtUp atomic.Bool
+	// set once the server starts handing off leadership to shut down
+	draining atomic.Bool
+	// the members' registrations, shared by a PartitionedLog's partitions
+	registry *registry
+	// the catalog partition 0 of a PartitionedLog replicates, nil otherwise
+	topics *clusterTopics
+}
+
+func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
+	return newDistributedLog(dataDir, config, nil)
+}
+
+// Opens the log, replicating the topics' catalog too when they're set
+func newDistributedLog(dataDir string, config Config, topics *clusterTopics) (*DistributedLog, error) {
+	l := &DistributedLog{
+		config: config,
+		topics: topics,
+	}
+	if err := l.setupLog(dataDir); err != nil {
+		return nil, err
+	}
+	if err := l.setupRaft(dataDir); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *DistributedLog) setupLog(dataDir string) error {
+	logDir := filepath.Join(dataDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	var err error
+	l.log, err = NewLog(logDir, l.config)
+	return err
+}
+
+func (l *DistributedLog) setupRaft(dataDir string) error {
+	fsm := &fsm{log: l.log, topics: l.topics}
+
+	logDir := filepath.Join(dataDir, "raft", "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	logConfig := l.config
+	// raft indexes start at 1
+	logConfig.Segment.InitialOffset = 1
+	// snapshots compact the raft log, it's never archived
+	logConfig.Tier.Store = nil
+	logStore, err := newLogStore(logDir, logConfig)
+	if err != nil {
+		return err
+	}
+	l.raftLog = logStore
+
+	stableStore, err := raftboltdb.NewBoltStore(
+		filepath.Join(dataDir, "raft", "stable"),
+	)
+	if err != nil {
+		return err
+	}
+	l.stableStore = stableStore
+
+	retain := 1
+	snapshotStore, err := raft.NewFileSnapshotStore(
+		filepath.Join(dataDir, "raft"),
+		retain,
+		os.Stderr,
+	)
+	if err != nil {
+		return err
+	}
+
+	maxPool := 5
+	timeout := 10 * time.Second
+	l.lag = newLagTracker(logStore, l.config.Raft.MaxReplicationLag, l.config.Raft.Partition)
+	transport := &lagTransport{
+		NetworkTransport: raft.NewNetworkTransport(
+			l.config.Raft.StreamLayer,
+			maxPool,
+			timeout,
+			os.Stderr,
+		),
+		tracker: l.lag,
+	}
+
+	config := raft.DefaultConfig()
+	config.LocalID = l.config.Raft.LocalID
+	if l.config.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
+	}
+	if l.config.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = l.config.Raft.ElectionTimeout
+	}
+	if l.config.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
+	}
+	if l.config.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = l.config.Raft.CommitTimeout
+	}
+	if l.config.Raft.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = l.config.Raft.SnapshotThreshold
+	}
+	if l.config.Raft.SnapshotInterval != 0 {
+		config.SnapshotInterval = l.config.Raft.SnapshotInterval
+	}
+	if l.config.Raft.TrailingLogs != 0 {
+		config.TrailingLogs = l.config.Raft.TrailingLogs
+	}
+
+	l.acks = newLeaderAcks()
+	logStore.stored = l.acks.stored
+	l.raft, err = raft.NewRaft(
+		config,
+		fsm,
+		logStore,
+		stableStore,
+		snapshotStore,
+		transport,
+	)
+	if err != nil {
+		return err
+	}
+	l.isr = newISRTracker(l.raft, l.lag)
+	l.placement = newPlacement(
+		l.raft,
+		l.lag,
+		l.config.Raft.LocalID,
+		l.config.Raft.Zone,
+		l.config.Raft.MaxVoters,
+		l.config.logger(),
+	)
+	hasState, err := raft.HasExistingState(
+		logStore,
+		stableStore,
+		snapshotStore,
+	)
+	if err != nil {
+		return err
+	}
+	if l.config.Raft.Bootstrap && !hasState {
+		servers := l.config.Raft.Members
+		if len(servers) == 0 {
+			servers = []raft.Server{{
+				ID:      config.LocalID,
+				Address: raft.ServerAddress(l.config.Raft.BindAddr),
+			}}
+		}
+		err = l.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+	}
+	return err
+}
+
+// Append replicates the record at the configured ack level, returning its
+// offset if it waited for the record to commit
+func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	off, _, err := l.AppendAck(record, api.Ack_ACK_DEFAULT)
+	return off, err
+}
+
+// AppendAck replicates the record and returns once it got as far as ack
+// asks. pending reports it returned before the record committed, when the
+// offset isn't known yet.
+func (l *DistributedLog) AppendAck(record *api.Record, ack api.Ack) (off uint64, pending bool, err error) {
+	ack, err = l.ackLevel(ack)
+	if err != nil {
+		return 0, false, err
+	}
+	// stamp before replicating so every copy carries the same time
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
+	req := &api.ProduceRequest{Record: record}
+	switch ack {
+	case api.Ack_ACK_NONE:
+		// the future is dropped, nothing waits on it
+		_, err = l.submit(AppendRequestType, req)
+		return 0, true, err
+	case api.Ack_ACK_LEADER:
+		return l.applyLeaderAck(req)
+	}
+	res, err := l.apply(AppendRequestType, req)
+	if err != nil {
+		return 0, false, err
+	}
+	return res.(*api.ProduceResponse).Offset, false, nil
+}
+
+// AppendDurable replicates the record as AppendAck does at api.Ack_ACK_ALL
+// but has the leader answer once it's written it, calling durable from a
+// goroutine of its own once the leader's synced it, with the sync's error
+func (l *DistributedLog) AppendDurable(record *api.Record, durable func(error)) (uint64, error) {
+	if _, err := l.ackLevel(api.Ack_ACK_ALL); err != nil {
+		return 0, err
+	}
+	if record.Timestamp == 0 {
+		record.Timestamp = time.Now().UnixNano()
+	}
+	res, err := l.apply(AppendRequestType, &api.ProduceRequest{Record: record, NotifyDurable: true})
+	if err != nil {
+		return 0, err
+	}
+	appended := res.(*durableAppend)
+	go func() {
+		<-appended.synced.done
+		durable(appended.synced.err)
+	}()
+	return appended.off, nil
+}
+
+// AppendBatch replicates the records in order and returns once they got
+// as far as ack asks, with their offsets unless pending. Nothing is
+// appended when it fails with api.ErrNotLeader or api.ErrNotEnoughReplicas;
+// other failures may follow some of the records committing.
+func (l *DistributedLog) AppendBatch(records []*api.Record, ack api.Ack) (offs []uint64, pending bool, err error) {
+	ack, err = l.ackLevel(ack)
+	if err != nil {
+		return nil, false, err
+	}
+	now := time.Now().UnixNano()
+	futures := make([]raft.ApplyFuture, 0, len(records))
+	// the last entry written means the others are, having gone first
+	var written <-chan struct{}
+	for i, record := range records {
+		if record.Timestamp == 0 {
+			record.Timestamp = now
+		}
+		reqType, prefix := AppendRequestType, []byte(nil)
+		if ack == api.Ack_ACK_LEADER && i == len(records)-1 {
+			var id uint64
+			id, written = l.acks.add()
+			defer l.acks.remove(id)
+			reqType, prefix = AppendLeaderAckRequestType, make([]byte, ackIDWidth)
+			enc.PutUint64(prefix, id)
+		}
+		future, err := l.submit(reqType, &api.ProduceRequest{Record: record}, prefix...)
+		if err != nil {
+			if i == 0 {
+				return nil, false, err
+			}
+			return nil, false, fmt.Errorf("batch submitted up to record %d: %v", i, err)
+		}
+		futures = append(futures, future)
+	}
+	if ack == api.Ack_ACK_NONE {
+		return nil, true, nil
+	}
+	type result struct {
+		offs []uint64
+		err  error
+	}
+	committed := make(chan result, 1)
+	go func() {
+		offs := make([]uint64, 0, len(futures))
+		for i, future := range futures {
+			res, err := l.response(future)
+			if err != nil && i > 0 {
+				err = fmt.Errorf("batch committed up to record %d: %v", i, err)
+			}
+			if err != nil {
+				committed <- result{err: err}
+				return
+			}
+			offs = append(offs, res.(*api.ProduceResponse).Offset)
+		}
+		committed <- result{offs: offs}
+	}()
+	select {
+	case <-written:
+		return nil, true, nil
+	case res := <-committed:
+		return res.offs, false, res.err
+	}
+}
+
+// The ack level an append at ack gets, the configured one for
+// api.Ack_ACK_DEFAULT, failing with api.ErrNotEnoughReplicas when it waits
+// on replicas that aren't in sync
+func (l *DistributedLog) ackLevel(ack api.Ack) (api.Ack, error) {
+	if ack == api.Ack_ACK_DEFAULT {
+		ack = l.config.Raft.Ack
+	}
+	if ack == api.Ack_ACK_DEFAULT {
+		ack = api.Ack_ACK_ALL
+	}
+	if ack == api.Ack_ACK_ALL {
+		if err := l.isr.check(l.config.Raft.MinInSyncReplicas); err != nil {
+			return ack, err
+		}
+	}
+	return ack, nil
+}
+
+func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (
+	interface{},
+	error,
+) {
+	future, err := l.submit(reqType, req)
+	if err != nil {
+		return nil, err
+	}
+	return l.response(future)
+}
+
+// Hands the request to Raft without waiting for it to commit
+func (l *DistributedLog) submit(reqType RequestType, req proto.Message, prefix ...byte) (
+	raft.ApplyFuture,
+	error,
+) {
+	if l.raft.State() != raft.Leader {
+		return nil, api.ErrNotLeader{Leader: l.Leader()}
+	}
+	var buf bytes.Buffer
+	_, err := buf.Write(append([]byte{byte(reqType)}, prefix...))
+	if err != nil {
+		return nil, err
+	}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	_, err = buf.Write(b)
+	if err != nil {
+		return nil, err
+	}
+	timeout := 10 * time.Second
+	return l.raft.Apply(buf.Bytes(), timeout), nil
+}
+
+// Waits for the request to commit and returns what the FSM answered
+func (l *DistributedLog) response(future raft.ApplyFuture) (interface{}, error) {
+	if err := future.Error(); errors.Is(err, raft.ErrNotLeader) {
+		return nil, api.ErrNotLeader{Leader: l.Leader()}
+	} else if err != nil {
+		return nil, err
+	}
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Leader returns the leader's address, empty while there is none
+func (l *DistributedLog) Leader() string {
+	addr, _ := l.raft.LeaderWithID()
+	return string(addr)
+}
+
+// LeaderTerm returns the Raft term and whether this server leads it, a
+// server leading again having a later term
+func (l *DistributedLog) LeaderTerm() (term uint64, leader bool) {
+	return l.raft.CurrentTerm(), l.raft.State() == raft.Leader
+}
+
+// GetServers lists the servers in the Raft configuration, marking the
+// leader. Only the leader tracks which are in sync.
+func (l *DistributedLog) GetServers() ([]*api.Server, error) {
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	leaderAddr, _ := l.raft.LeaderWithID()
+	isLeader := l.raft.State() == raft.Leader
+	var servers []*api.Server
+	for _, server := range future.Configuration().Servers {
+		srv := &api.Server{
+			Id:       string(server.ID),
+			RpcAddr:  string(server.Address),
+			IsLeader: leaderAddr == server.Address,
+			InSync:   isLeader && l.isr.inSync(server.ID),
+			Zone:     l.placement.zone(server.ID),
+			Voter:    server.Suffrage == raft.Voter,
+			Draining: server.ID == l.config.Raft.LocalID && l.draining.Load(),
+		}
+		if reg := l.registry.get(string(server.ID)); reg != nil {
+			srv.NodeId = reg.NodeId
+			srv.Version = reg.Version
+			srv.HttpAddr = reg.HttpAddr
+		}
+		if lag, ok := l.lag.lag(server.ID); ok && isLeader {
+			srv.LagOffsets = lag.offsets
+			srv.LagSeconds = lag.seconds
+		}
+		servers = append(servers, srv)
+	}
+	return servers, nil
+}
+
+// Read serves the record from the local copy, which may trail the leader
+func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
+	return l.log.Read(offset)
+}
+
+// ReadTo reads the local copy as Log.ReadTo does
+func (l *DistributedLog) ReadTo(offset uint64, dst []byte, record *api.Record) ([]byte, error) {
+	return l.log.ReadTo(offset, dst, record)
+}
+
+// ReadMarshaled reads the local copy as Log.ReadMarshaled does
+func (l *DistributedLog) ReadMarshaled(offset uint64) (*[]byte, uint64, error) {
+	return l.log.ReadMarshaled(offset)
+}
+
+// Tail reports whether the record at off is in the local copy's active
+// segment, as Log.Tail does
+func (l *DistributedLog) Tail(off uint64) bool {
+	return l.log.Tail(off)
+}
+
+// Stats are the local copy's, which may trail the leader
+func (l *DistributedLog) Stats() Stats {
+	return l.log.Stats()
+}
+
+// SyncOnAppend reports whether appends are fsynced on each server before they apply
+func (l *DistributedLog) SyncOnAppend() bool {
+	return l.config.SyncOnAppend
+}
+
+// Join adds the server, as a voter unless MaxVoters are already placed
+// across the zones. Only the leader can, so on other servers Join fails
+// with raft.ErrNotLeader.
+func (l *DistributedLog) Join(id, addr string) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == serverID || srv.Address == serverAddr {
+			if srv.ID == serverID && srv.Address == serverAddr {
+				// server has already joined
+				return nil
+			}
+			// remove the existing server
+			removeFuture := l.raft.RemoveServer(serverID, 0, 0)
+			if err := removeFuture.Error(); err != nil {
+				return err
+			}
+		}
+	}
+	// with a cap on voters, rebalancing decides whether it becomes one
+	addFuture := l.raft.AddVoter(serverID, serverAddr, 0, 0)
+	if l.config.Raft.MaxVoters > 0 {
+		addFuture = l.raft.AddNonvoter(serverID, serverAddr, 0, 0)
+	}
+	if err := addFuture.Error(); err != nil {
+		return err
+	}
+	_, err := l.placement.rebalance(false)
+	return err
+}
+
+// Rebalance spreads the voters across zones, see Config.Raft.MaxVoters,
+// returning the changes made or, for a dry run, planned. Joins, leaves and
+// zone changes rebalance on their own; this is for operators checking or
+// forcing a rebalance. Only the leader can.
+func (l *DistributedLog) Rebalance(dryRun bool) ([]*api.VoterChange, error) {
+	if l.raft.State() != raft.Leader {
+		return nil, api.ErrNotLeader{Leader: l.Leader()}
+	}
+	return l.placement.rebalance(dryRun)
+}
+
+// SetZone records the zone the server runs in, as discovery reports it,
+// and has the leader rebalance the voters across zones if it changed
+func (l *DistributedLog) SetZone(id, zone string) {
+	if l.placement.setZone(raft.ServerID(id), zone) {
+		l.placement.rebalanceOrLog()
+	}
+}
+
+// Leave removes the server from the cluster, doing nothing if it isn't a
+// member, and has the leader place another voter in its place
+func (l *DistributedLog) Leave(id string) error {
+	l.placement.forget(raft.ServerID(id))
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+	member := false
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == raft.ServerID(id) {
+			member = true
+		}
+	}
+	if !member {
+		return nil
+	}
+	removeFuture := l.raft.RemoveServer(raft.ServerID(id), 0, 0)
+	if err := removeFuture.Error(); err != nil {
+		return err
+	}
+	_, err := l.placement.rebalance(false)
+	return err
+}
+
+// Ready reports whether the server should take traffic: the cluster has a
+// leader and, since starting, this server has once applied every entry it
+// knows to be committed
+func (l *DistributedLog) Ready() error {
+	if l.Leader() == "" {
+		return errors.New("no leader")
+	}
+	if l.caughtUp.Load() {
+		return nil
+	}
+	commit, err := strconv.ParseUint(l.raft.Stats()["commit_index"], 10, 64)
+	if err != nil {
+		return err
+	}
+	if applied := l.raft.AppliedIndex(); applied < commit {
+		return fmt.Errorf("catching up, applied %d of %d entries", applied, commit)
+	}
+	l.caughtUp.Store(true)
+	return nil
+}
+
+// TransferLeadership hands leadership to the most caught up voter, so the
+// cluster keeps accepting writes while this server leaves. It does nothing
+// on a follower or when there's no other voter to take over.
+func (l *DistributedLog) TransferLeadership() error {
+	if l.raft.State() != raft.Leader {
+		return nil
+	}
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return err
+	}
+	voters := 0
+	for _, srv := range future.Configuration().Servers {
+		if srv.Suffrage == raft.Voter {
+			voters++
+		}
+	}
+	if voters < 2 {
+		return nil
+	}
+	err := l.raft.LeadershipTransfer().Error()
+	if errors.Is(err, raft.ErrNotLeader) {
+		return nil
+	}
+	return err
+}
+
+// Hands leadership to a voter that's caught up with the log, so it takes
+// over without losing any record this server acknowledged. done reports
+// there's nothing left to hand off: this server doesn't lead or has no
+// other voter to hand off to.
+func (l *DistributedLog) handOff() (done bool, err error) {
+	if l.raft.State() != raft.Leader {
+		return true, nil
+	}
+	future := l.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return false, err
+	}
+	others := 0
+	for _, srv := range future.Configuration().Servers {
+		if srv.ID == l.config.Raft.LocalID || srv.Suffrage != raft.Voter {
+			continue
+		}
+		others++
+		lag, ok := l.lag.lag(srv.ID)
+		if !ok || lag.offsets != 0 || !l.isr.inSync(srv.ID) {
+			continue
+		}
+		err := l.raft.LeadershipTransferToServer(srv.ID, srv.Address).Error()
+		if errors.Is(err, raft.ErrNotLeader) {
+			return true, nil
+		}
+		return err == nil, err
+	}
+	return others == 0, nil
+}
+
+// CommitOffset replicates offset as the next record the consumer reads.
+// Only the leader can, so on other servers it fails with api.ErrNotLeader.
+func (l *DistributedLog) CommitOffset(consumer string, offset uint64) error {
+	_, err := l.apply(CommitOffsetRequestType, &api.CommitOffsetRequest{
+		Consumer: consumer,
+		Offset:   offset,
+	})
+	return err
+}
+
+// FetchOffset returns the offset the consumer last committed, as this
+// server has applied it
+func (l *DistributedLog) FetchOffset(consumer string) (uint64, bool) {
+	return l.log.FetchOffset(consumer)
+}
+
+// DeleteRecords removes the records before offset from every server, see
+// Log.DeleteRecords, returning the leader's lowest offset left. Only the
+// leader can, so on other servers it fails with api.ErrNotLeader.
+func (l *DistributedLog) DeleteRecords(before uint64) (uint64, error) {
+	res, err := l.apply(DeleteRecordsRequestType, &api.DeleteRecordsRequest{BeforeOffset: before})
+	if err != nil {
+		return 0, err
+	}
+	return res.(*api.DeleteRecordsResponse).LowWatermark, nil
+}
+
+// Applies the config's retention and compaction to the log. The leader
+// removes what the retention expires as DeleteRecords does; every server
+// compacts its own copy.
+func (l *DistributedLog) cleanup(c TopicConfig) error {
+	if l.raft.State() == raft.Leader {
+		if before := l.log.expired(c, time.Now()); before > 0 {
+			if _, err := l.DeleteRecords(before); err != nil {
+				return err
+			}
+		}
+	}
+	if l.log.cleanable(c) {
+		_, err := l.log.Compact(c.DeleteRetention)
+		return err
+	}
+	return nil
+}
+
+// Compact compacts the local copy, see Log.Compact. Each server compacts
+// its own.
+func (l *DistributedLog) Compact(deleteRetention time.Duration) (int, error) {
+	return l.log.Compact(deleteRetention)
+}
+
+// CompactionStats are the local copy's, see Log.CompactionStats
+func (l *DistributedLog) CompactionStats() CompactionStats {
+	return l.log.CompactionStats()
+}
+
+// Snapshot snapshots the log now, rather than once enough entries have
+// built up, so Raft compacts its log. It returns the last entry the
+// snapshot covers, the last snapshot's if nothing was applied since.
+func (l *DistributedLog) Snapshot() (uint64, error) {
+	future := l.raft.Snapshot()
+	if err := future.Error(); errors.Is(err, raft.ErrNothingNewToSnapshot) {
+		return strconv.ParseUint(l.raft.Stats()["last_snapshot_index"], 10, 64)
+	} else if err != nil {
+		return 0, err
+	}
+	meta, r, err := future.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return meta.Index, nil
+}
+
+// SegmentStats are the local copy's, see Log.SegmentStats
+func (l *DistributedLog) SegmentStats() []SegmentStats {
+	return l.log.SegmentStats()
+}
+
+// DescribeRecord describes the local copy's record, see Log.DescribeRecord
+func (l *DistributedLog) DescribeRecord(off uint64) (*RecordInfo, error) {
+	return l.log.DescribeRecord(off)
+}
+
+// WaitForLeader blocks until the cluster has elected a leader or times out
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("timed out")
+		case <-ticker.C:
+			if l := l.raft.Leader(); l != "" {
+				return nil
+			}
+		}
+	}
+}
+
+func (l *DistributedLog) Close() error {
+	l.isr.close()
+	l.placement.close()
+	f := l.raft.Shutdown()
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if err := l.raftLog.Close(); err != nil {
+		return err
+	}
+	if err := l.stableStore.Close(); err != nil {
+		return err
+	}
+	return l.log.Close()
+}
+
+var _ raft.FSM = (*fsm)(nil)
+
+// fsm applies committed appends to the local log, and the topics'
+// changes to their catalog when it's partition 0's of a PartitionedLog
+type fsm struct {
+	log    *Log
+	topics *clusterTopics
+}
+
+type RequestType uint8
+
+const (
+	AppendRequestType RequestType = 0
+	// An append carrying an ack ID, so the leader can tell when it stored it
+	AppendLeaderAckRequestType RequestType = 1
+	// A consumer's committed offset, see DistributedLog.CommitOffset
+	CommitOffsetRequestType RequestType = 2
+	// Removes the oldest records, see DistributedLog.DeleteRecords
+	DeleteRecordsRequestType RequestType = 3
+	// Adds a topic to the catalog, see PartitionedLog.CreateTopic
+	CreateTopicRequestType RequestType = 4
+	// Takes a topic out of the catalog, see PartitionedLog.DeleteTopic
+	DeleteTopicRequestType RequestType = 5
+	// Changes a topic's configs, see PartitionedLog.AlterTopicConfigs
+	AlterTopicConfigsRequestType RequestType = 6
+	// Adds partitions to a topic, see PartitionedLog.CreatePartitions
+	CreatePartitionsRequestType RequestType = 7
+)
+
+func (l *fsm) Apply(record *raft.Log) interface{} {
+	buf := record.Data
+	reqType := RequestType(buf[0])
+	switch reqType {
+	case AppendRequestType:
+		return l.applyAppend(buf[1:], record.Term)
+	case AppendLeaderAckRequestType:
+		return l.applyAppend(buf[1+ackIDWidth:], record.Term)
+	case CommitOffsetRequestType:
+		return l.applyCommitOffset(buf[1:])
+	case DeleteRecordsRequestType:
+		return l.applyDeleteRecords(buf[1:])
+	case CreateTopicRequestType, DeleteTopicRequestType, AlterTopicConfigsRequestType,
+		CreatePartitionsRequestType:
+		if l.topics == nil {
+			return errors.New("log doesn't hold topics")
+		}
+		return l.topics.apply(reqType, buf[1:])
+	}
+	return nil
+}
+
+// ApplyBatch applies the entries Raft commits together, appending the
+// records of consecutive appends in one go, see Log.AppendBatch
+func (l *fsm) ApplyBatch(logs []*raft.Log) []interface{} {
+	res := make([]interface{}, len(logs))
+	for i := 0; i < len(logs); {
+		j := i
+		for j < len(logs) && appendRequest(logs[j]) != nil {
+			j++
+		}
+		if j == i {
+			// configuration changes are raft's
+			if logs[i].Type == raft.LogCommand {
+				res[i] = l.Apply(logs[i])
+			}
+			i++
+			continue
+		}
+		l.applyAppends(logs[i:j], res[i:j])
+		i = j
+	}
+	return res
+}
+
+// The append request the entry holds, nil if it isn't one
+func appendRequest(log *raft.Log) []byte {
+	if log.Type != raft.LogCommand || len(log.Data) == 0 {
+		return nil
+	}
+	switch RequestType(log.Data[0]) {
+	case AppendRequestType:
+		return log.Data[1:]
+	case AppendLeaderAckRequestType:
+		return log.Data[1+ackIDWidth:]
+	}
+	return nil
+}
+
+// Appends the entries' records as a batch, with their responses in res.
+// A batch that fails fails every append in it.
+func (l *fsm) applyAppends(logs []*raft.Log, res []interface{}) {
+	records := make([]*api.Record, len(logs))
+	durable := make([]bool, len(logs))
+	notify := false
+	for i, log := range logs {
+		var req api.ProduceRequest
+		if err := proto.Unmarshal(appendRequest(log), &req); err != nil {
+			// applied one by one, failing the one alone
+			for i, log := range logs {
+				res[i] = l.Apply(log)
+			}
+			return
+		}
+		records[i] = req.Record
+		records[i].Term = log.Term
+		durable[i] = req.NotifyDurable
+		notify = notify || req.NotifyDurable
+	}
+	var offs []uint64
+	var synced *syncNotice
+	var err error
+	if notify {
+		// the batch is synced for every append in it
+		offs, synced, err = l.appendDurable(records)
+	} else {
+		offs, err = l.log.AppendBatch(records)
+	}
+	for i := range res {
+		if err != nil {
+			res[i] = err
+		} else if durable[i] {
+			res[i] = &durableAppend{off: offs[i], synced: synced}
+		} else {
+			res[i] = &api.ProduceResponse{Offset: offs[i]}
+		}
+	}
+}
+
+// The response to an append with notify_durable, see
+// DistributedLog.AppendDurable
+type durableAppend struct {
+	off    uint64
+	synced *syncNotice
+}
+
+// Closed once appends are synced, with the sync's error
+type syncNotice struct {
+	done chan struct{}
+	err  error
+}
+
+// Appends the records synced, as Log.AppendBatchDurable does, with a
+// notice of the sync for the responses
+func (l *fsm) appendDurable(records []*api.Record) ([]uint64, *syncNotice, error) {
+	synced := &syncNotice{done: make(chan struct{})}
+	offs, err := l.log.AppendBatchDurable(records, func(err error) {
+		synced.err = err
+		close(synced.done)
+	})
+	return offs, synced, err
+}
+
+func (l *fsm) applyDeleteRecords(b []byte) interface{} {
+	var req api.DeleteRecordsRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	low, err := l.log.DeleteRecords(req.BeforeOffset)
+	if err != nil {
+		return err
+	}
+	return &api.DeleteRecordsResponse{LowWatermark: low}
+}
+
+func (l *fsm) applyCommitOffset(b []byte) interface{} {
+	var req api.CommitOffsetRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	if err := l.log.CommitOffset(req.Consumer, req.Offset); err != nil {
+		return err
+	}
+	return &api.CommitOffsetResponse{}
+}
+
+func (l *fsm) applyAppend(b []byte, term uint64) interface{} {
+	var req api.ProduceRequest
+	err := proto.Unmarshal(b, &req)
+	if err != nil {
+		return err
+	}
+	// the record carries the leader epoch it was appended under
+	req.Record.Term = term
+	if req.NotifyDurable {
+		offs, synced, err := l.appendDurable([]*api.Record{req.Record})
+		if err != nil {
+			return err
+		}
+		return &durableAppend{off: offs[0], synced: synced}
+	}
+	offset, err := l.log.Append(req.Record)
+	if err != nil {
+		return err
+	}
+	return &api.ProduceResponse{Offset: offset}
+}
+
+// Snapshot captures the log as it is, Raft persists it while appends carry
+// on, followed by the committed offsets and the topics' catalog
+func (l *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	offsets, err := l.log.marshalOffsets()
+	if err != nil {
+		return nil, err
+	}
+	var catalog []byte
+	if l.topics != nil {
+		if catalog, err = l.topics.marshal(); err != nil {
+			return nil, err
+		}
+	}
+	r := l.log.Reader()
+	return &snapshot{reader: r, offsets: offsets, catalog: catalog}, nil
+}
+
+const (
+	// Takes the place of a record's length in a snapshot to mark the
+	// committed offsets, which follow with their own length
+	offsetsMarker = math.MaxUint64
+	// Marks the topics' catalog as offsetsMarker does the offsets
+	catalogMarker = math.MaxUint64 - 1
+)
+
+// Restore replaces the log with the snapshot's records, keeping their offsets
+func (l *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+	b := make([]byte, lenWidth)
+	var buf bytes.Buffer
+	restored, catalog := false, false
+	for {
+		_, err := io.ReadFull(r, b)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if enc.Uint64(b) == offsetsMarker {
+			if err := l.restoreOffsets(r); err != nil {
+				return err
+			}
+			continue
+		}
+		if enc.Uint64(b) == catalogMarker {
+			if err := l.restoreCatalog(r); err != nil {
+				return err
+			}
+			catalog = true
+			continue
+		}
+		size := int64(enc.Uint64(b))
+		if _, err = io.CopyN(&buf, r, size); err != nil {
+			return err
+		}
+		p := buf.Bytes()
+		if keys := l.log.Config.Keyring; keys != nil {
+			if p, err = keys.Open(p); err != nil {
+				return err
+			}
+		}
+		records, _, err := decodeStored(p)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if !restored {
+				if err = l.log.resetAt(record.Offset); err != nil {
+					return err
+				}
+				restored = true
+			}
+			// a compacted log's snapshot skips the offsets it removed
+			if _, err := l.log.appendAt(record); err != nil {
+				return err
+			}
+		}
+		buf.Reset()
+	}
+	// snapshots from before topics have none
+	if l.topics != nil && !catalog {
+		if err := l.topics.restore(nil); err != nil {
+			return err
+		}
+	}
+	if !restored {
+		return l.log.Reset()
+	}
+	return nil
+}
+
+// Reads the committed offsets following a snapshot's offsetsMarker.
+// Snapshots from before offsets were committed have none.
+func (l *fsm) restoreOffsets(r io.Reader) error {
+	b := make([]byte, lenWidth)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	offsets := make([]byte, enc.Uint64(b))
+	if _, err := io.ReadFull(r, offsets); err != nil {
+		return err
+	}
+	return l.log.restoreOffsets(offsets)
+}
+
+// Reads the topics' catalog following a snapshot's catalogMarker
+func (l *fsm) restoreCatalog(r io.Reader) error {
+	b := make([]byte, lenWidth)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	catalog := make([]byte, enc.Uint64(b))
+	if _, err := io.ReadFull(r, catalog); err != nil {
+		return err
+	}
+	if l.topics == nil {
+		return nil
+	}
+	return l.topics.restore(catalog)
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+type snapshot struct {
+	reader  io.Reader
+	offsets []byte
+	// nil when the log doesn't hold topics
+	catalog []byte
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := io.Copy(sink, s.reader); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	b := make([]byte, 2*lenWidth)
+	enc.PutUint64(b, offsetsMarker)
+	enc.PutUint64(b[lenWidth:], uint64(len(s.offsets)))
+	if _, err := sink.Write(append(b, s.offsets...)); err != nil {
+		_ = sink.Cancel()
+		return err
+	}
+	if s.catalog != nil {
+		enc.PutUint64(b, catalogMarker)
+		enc.PutUint64(b[lenWidth:], uint64(len(s.catalog)))
+		if _, err := sink.Write(append(b, s.catalog...)); err != nil {
+			_ = sink.Cancel()
+			return err
+		}
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
+
+var _ raft.LogStore = (*logStore)(nil)
+
+// logStore keeps Raft's entries in a Log, the record offset is the Raft index
+type logStore struct {
+	*Log
+	// stored, when set, is told about each entry once it's written
+	stored func(*raft.Log)
+}
+
+func newLogStore(dir string, c Config) (*logStore, error) {
+	log, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{Log: log}, nil
+}
+
+func (l *logStore) FirstIndex() (uint64, error) {
+	return l.LowestOffset()
+}
+
+func (l *logStore) LastIndex() (uint64, error) {
+	off, err := l.HighestOffset()
+	return off, err
+}
+
+// GetLog reports compacted entries as raft.ErrLogNotFound, so the leader
+// sends a snapshot instead
+func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	// decoded into one buffer, the entry's data a slice of it, which raft
+	// keeps so it's not reused
+	in := &api.Record{}
+	_, err := l.ReadTo(index, nil, in)
+	if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+		return raft.ErrLogNotFound
+	}
+	if err != nil {
+		return err
+	}
+	out.Data = in.Value
+	out.Index = in.Offset
+	out.Type = raft.LogType(in.Type)
+	out.Term = in.Term
+	return nil
+}
+
+func (l *logStore) StoreLog(record *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{record})
+}
+
+// StoreLogs appends the entries, which raft hands over in order, in one go,
+// see Log.AppendBatch
+func (l *logStore) StoreLogs(records []*raft.Log) error {
+	if len(records) == 0 {
+		return nil
+	}
+	if err := l.seek(records[0].Index); err != nil {
+		return err
+	}
+	batch := make([]*api.Record, len(records))
+	for i, record := range records {
+		batch[i] = &api.Record{
+			Value: record.Data,
+			Term:  record.Term,
+			Type:  uint32(record.Type),
+		}
+	}
+	if _, err := l.AppendBatch(batch); err != nil {
+		return err
+	}
+	if l.stored != nil {
+		for _, record := range records {
+			l.stored(record)
+		}
+	}
+	return nil
+}
+
+// Lines the log up so the next append gets index. Raft overwrites
+// conflicting entries, and after installing a snapshot starts past the end.
+func (l *logStore) seek(index uint64) error {
+	l.mu.RLock()
+	next := l.activeSegment.nextOffset
+	l.mu.RUnlock()
+	switch {
+	case index == next:
+		return nil
+	case index < next:
+		return l.TruncateFrom(index)
+	default:
+		return l.resetAt(index)
+	}
+}
+
+// DeleteRange removes the records from min to max inclusive. Raft deletes
+// either the oldest records after a snapshot or the newest on a conflict.
+func (l *logStore) DeleteRange(min, max uint64) error {
+	first, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+	if min <= first {
+		return l.Truncate(max)
+	}
+	return l.TruncateFrom(min)
+}
+
+// StreamLayer carries Raft's RPCs over connections that start with the
+// RaftRPC byte, so Raft can share a listener with gRPC
+type StreamLayer struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config
+	peerTLSConfig   *tls.Config
+	// partition is the one this layer carries, or the Raft group; set on
+	// the layers split off by Group, which take connections already past
+	// the header
+	partition uint32
+	split     bool
+
+	// the groups split off, by partition
+	demuxOnce sync.Once
+	mu        sync.Mutex
+	groups    map[uint32]*partitionListener
+}
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+func NewStreamLayer(
+	ln net.Listener,
+	serverTLSConfig,
+	peerTLSConfig *tls.Config,
+) *StreamLayer {
+	return &StreamLayer{
+		ln:              ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+	}
+}
+
+const (
+	// RaftRPC starts Raft connections, to the first partition of a
+	// partitioned log
+	RaftRPC = 1
+	// RaftPartitionRPC starts Raft connections to the other partitions,
+	// followed by the partition as 4 big-endian bytes
+	RaftPartitionRPC = 2
+)
+
+// Partitions splits the stream layer into one per partition, all sharing
+// its listener, see Group
+func (s *StreamLayer) Partitions(n int) []*StreamLayer {
+	layers := make([]*StreamLayer, n)
+	for p := range layers {
+		layers[p] = s.Group(uint32(p))
+	}
+	return layers
+}
+
+// Group splits off the stream layer of a Raft group, the partition whose
+// header its connections start with. Groups can be split off and closed
+// while the layer runs, as topics' partitions come and go; connections to
+// a group that isn't open are closed, and Raft retries them. The returned
+// layer's Close leaves the listener open, it's closed with this one.
+func (s *StreamLayer) Group(id uint32) *StreamLayer {
+	s.demuxOnce.Do(func() {
+		s.groups = make(map[uint32]*partitionListener)
+		go s.demux()
+	})
+	ln := &partitionListener{
+		addr:   s.ln.Addr(),
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	ln.remove = func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.groups[id] == ln {
+			delete(s.groups, id)
+		}
+	}
+	s.mu.Lock()
+	s.groups[id] = ln
+	s.mu.Unlock()
+	return &StreamLayer{
+		ln:              ln,
+		serverTLSConfig: s.serverTLSConfig,
+		peerTLSConfig:   s.peerTLSConfig,
+		partition:       id,
+		split:           true,
+	}
+}
+
+// Hands each accepted connection to the listener of the group its header
+// names, until the listener closes
+func (s *StreamLayer) demux() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			p, err := readPartition(conn)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			s.mu.Lock()
+			ln, ok := s.groups[p]
+			s.mu.Unlock()
+			if !ok {
+				conn.Close()
+				return
+			}
+			select {
+			case ln.conns <- conn:
+			case <-ln.closed:
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// Reads the header a Raft connection starts with, returning its partition
+func readPartition(conn net.Conn) (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b[:1]); err != nil {
+		return 0, err
+	}
+	switch b[0] {
+	case RaftRPC:
+		return 0, nil
+	case RaftPartitionRPC:
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return 0, err
+		}
+		return binary.BigEndian.Uint32(b), nil
+	}
+	return 0, fmt.Errorf("not a raft rpc")
+}
+
+// The header naming the stream layer's partition
+func (s *StreamLayer) header() []byte {
+	if s.partition == 0 {
+		return []byte{byte(RaftRPC)}
+	}
+	return binary.BigEndian.AppendUint32([]byte{byte(RaftPartitionRPC)}, s.partition)
+}
+
+// partitionListener takes a partition's connections from its stream
+// layer's demux
+type partitionListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	// takes the listener out of the demux
+	remove func()
+}
+
+func (l *partitionListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *partitionListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.remove()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *partitionListener) Addr() net.Addr {
+	return l.addr
+}
+
+func (s *StreamLayer) Dial(
+	addr raft.ServerAddress,
+	timeout time.Duration,
+) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn, err = dialer.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+	// identify to mux this is a raft rpc, and for which partition
+	_, err = conn.Write(s.header())
+	if err != nil {
+		return nil, err
+	}
+	if s.peerTLSConfig != nil {
+		config := s.peerTLSConfig
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(string(addr))
+		}
+		conn = tls.Client(conn, config)
+	}
+	return conn, err
+}
+
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !s.split {
+		b := make([]byte, 1)
+		_, err = conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal([]byte{byte(RaftRPC)}, b) {
+			return nil, fmt.Errorf("not a raft rpc")
+		}
+	}
+	if s.serverTLSConfig != nil {
+		return tls.Server(conn, s.serverTLSConfig), nil
+	}
+	return conn, nil
+}
+
+func (s *StreamLayer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *StreamLayer) Addr() net.Addr {
+	return s.ln.Addr()
+}
@@ -0,0 +1,421 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultipleNodes(t *testing.T) {
+	var logs []*DistributedLog
+	nodeCount := 3
+
+	for i := 0; i < nodeCount; i++ {
+		dataDir, err := os.MkdirTemp("", "distributed-log-test")
+		require.NoError(t, err)
+		defer func(dir string) {
+			_ = os.RemoveAll(dir)
+		}(dataDir)
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+
+		if i == 0 {
+			config.Raft.Bootstrap = true
+		}
+
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		defer l.Close()
+
+		if i != 0 {
+			err = logs[0].Join(
+				fmt.Sprintf("%d", i), ln.Addr().String(),
+			)
+			require.NoError(t, err)
+		} else {
+			err = l.WaitForLeader(3 * time.Second)
+			require.NoError(t, err)
+		}
+
+		logs = append(logs, l)
+	}
+
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	}
+	for _, record := range records {
+		off, err := logs[0].Append(record)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			for j := 0; j < nodeCount; j++ {
+				got, err := logs[j].Read(off)
+				if err != nil {
+					return false
+				}
+				record.Offset = off
+				if !reflect.DeepEqual(got.Value, record.Value) ||
+					got.Timestamp != record.Timestamp {
+					return false
+				}
+			}
+			return true
+		}, 500*time.Millisecond, 50*time.Millisecond)
+	}
+
+	// every node has a leader and has caught up
+	for _, l := range logs {
+		require.Eventually(t, func() bool {
+			return l.Ready() == nil
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	servers, err := logs[0].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 3, len(servers))
+	require.True(t, servers[0].IsLeader)
+	require.False(t, servers[1].IsLeader)
+	require.False(t, servers[2].IsLeader)
+
+	// followers can't take appends
+	_, err = logs[1].Append(&api.Record{Value: []byte("follower")})
+	require.Equal(t, api.ErrNotLeader{Leader: logs[0].config.Raft.BindAddr}, err)
+
+	err = logs[0].Leave("1")
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	servers, err = logs[0].GetServers()
+	require.NoError(t, err)
+	require.Equal(t, 2, len(servers))
+
+	// leaving again is a no-op, even on a follower
+	require.NoError(t, logs[0].Leave("1"))
+	require.NoError(t, logs[2].Leave("1"))
+
+	off, err := logs[0].Append(&api.Record{
+		Value: []byte("third"),
+	})
+	require.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+
+	record, err := logs[1].Read(off)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	require.Nil(t, record)
+
+	record, err = logs[2].Read(off)
+	require.NoError(t, err)
+	require.Equal(t, []byte("third"), record.Value)
+	require.Equal(t, off, record.Offset)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	keys := NewKeyring()
+	require.NoError(t, keys.Add(1, make([]byte, 32)))
+
+	newNode := func(id string, bootstrap bool) *DistributedLog {
+		dataDir, err := os.MkdirTemp("", "distributed-log-snapshot-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = os.RemoveAll(dataDir) })
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		config := Config{Keyring: keys}
+		// small segments, so compaction can remove whole ones
+		config.Segment.MaxIndexBytes = 2 * entWidth
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(id)
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.TrailingLogs = 1
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = bootstrap
+
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+		return l
+	}
+
+	leader := newNode("0", true)
+	require.NoError(t, leader.WaitForLeader(3*time.Second))
+
+	values := []string{"first", "second", "third"}
+	for _, v := range values {
+		_, err := leader.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, leader.CommitOffset("group", 2))
+	// compacts the raft log, so a new node can only catch up from the snapshot
+	require.NoError(t, leader.raft.Snapshot().Error())
+	first, err := leader.raftLog.FirstIndex()
+	require.NoError(t, err)
+	require.Greater(t, first, uint64(1))
+
+	follower := newNode("1", false)
+	require.NoError(t, leader.Join("1", follower.config.Raft.BindAddr))
+
+	require.Eventually(t, func() bool {
+		for off, v := range values {
+			got, err := follower.Read(uint64(off))
+			if err != nil || string(got.Value) != v {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+	// the committed offsets come with it
+	off, found := follower.FetchOffset("group")
+	require.True(t, found)
+	require.Equal(t, uint64(2), off)
+
+	// appends after the snapshot follow on from the restored records
+	off, err = leader.Append(&api.Record{Value: []byte("fourth")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(values)), off)
+	require.Eventually(t, func() bool {
+		got, err := follower.Read(off)
+		return err == nil && string(got.Value) == "fourth"
+	}, time.Second, 50*time.Millisecond)
+
+	// deletes replicate, two records to a segment, the second's first too
+	low, err := leader.DeleteRecords(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), low)
+	require.Eventually(t, func() bool {
+		_, err := follower.Read(2)
+		return errors.As(err, &api.ErrOffsetOutOfRange{})
+	}, time.Second, 50*time.Millisecond)
+	_, err = follower.Read(1)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+	_, err = follower.Read(3)
+	require.NoError(t, err)
+
+	index, err := leader.Snapshot()
+	require.NoError(t, err)
+	again, err := leader.Snapshot()
+	require.NoError(t, err)
+	require.Equal(t, index, again)
+}
+
+func TestAckLevels(t *testing.T) {
+	logs := setupCluster(t, 3, func(c *Config) {
+		c.Raft.MinInSyncReplicas = 3
+	})
+	t.Cleanup(func() {
+		_ = logs[0].Close()
+		_ = logs[1].Close()
+	})
+	leader := logs[0]
+
+	off, pending, err := leader.AppendAck(&api.Record{Value: []byte("all")}, api.Ack_ACK_ALL)
+	require.NoError(t, err)
+	require.False(t, pending)
+	require.Equal(t, uint64(0), off)
+
+	for i, ack := range []api.Ack{api.Ack_ACK_LEADER, api.Ack_ACK_NONE} {
+		_, pending, err = leader.AppendAck(&api.Record{Value: []byte(ack.String())}, ack)
+		require.NoError(t, err)
+		require.True(t, pending)
+		require.Eventually(t, func() bool {
+			got, err := logs[1].Read(uint64(i + 1))
+			return err == nil && string(got.Value) == ack.String()
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// with a follower gone ACK_ALL is short of replicas, ACK_LEADER isn't
+	require.NoError(t, logs[2].Close())
+	require.Eventually(t, func() bool {
+		servers, err := leader.GetServers()
+		return err == nil && !servers[2].InSync
+	}, 3*time.Second, 10*time.Millisecond)
+	_, _, err = leader.AppendAck(&api.Record{Value: []byte("all")}, api.Ack_ACK_ALL)
+	require.Equal(t, api.ErrNotEnoughReplicas{InSync: 2, Required: 3}, err)
+	_, pending, err = leader.AppendAck(&api.Record{Value: []byte("leader")}, api.Ack_ACK_LEADER)
+	require.NoError(t, err)
+	require.True(t, pending)
+}
+
+func TestAppendBatch(t *testing.T) {
+	logs := setupCluster(t, 3, nil)
+	t.Cleanup(func() {
+		for _, l := range logs {
+			_ = l.Close()
+		}
+	})
+	leader := logs[0]
+	batch := func(values ...string) []*api.Record {
+		var records []*api.Record
+		for _, v := range values {
+			records = append(records, &api.Record{Value: []byte(v)})
+		}
+		return records
+	}
+
+	offs, pending, err := leader.AppendBatch(batch("a", "b", "c"), api.Ack_ACK_ALL)
+	require.NoError(t, err)
+	require.False(t, pending)
+	require.Equal(t, []uint64{0, 1, 2}, offs)
+
+	// the last record written stands for the batch
+	offs, pending, err = leader.AppendBatch(batch("d", "e"), api.Ack_ACK_LEADER)
+	require.NoError(t, err)
+	require.True(t, pending)
+	require.Nil(t, offs)
+	for i, v := range []string{"a", "b", "c", "d", "e"} {
+		require.Eventually(t, func() bool {
+			got, err := logs[1].Read(uint64(i))
+			return err == nil && string(got.Value) == v
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// the records carry the leader epoch they were appended under
+	term, _ := leader.LeaderTerm()
+	info, err := logs[1].DescribeRecord(4)
+	require.NoError(t, err)
+	require.Equal(t, term, info.Record.Term)
+
+	_, _, err = logs[1].AppendBatch(batch("f"), api.Ack_ACK_ALL)
+	require.ErrorAs(t, err, &api.ErrNotLeader{})
+}
+
+func TestDistributedAppendDurable(t *testing.T) {
+	logs := setupCluster(t, 3, nil)
+	t.Cleanup(func() {
+		for _, l := range logs {
+			_ = l.Close()
+		}
+	})
+	leader := logs[0]
+
+	synced := make(chan error, 1)
+	off, err := leader.AppendDurable(&api.Record{Value: []byte("durable")}, func(err error) {
+		synced <- err
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.NoError(t, <-synced)
+	require.Eventually(t, func() bool {
+		got, err := logs[1].Read(0)
+		return err == nil && string(got.Value) == "durable"
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = logs[1].AppendDurable(&api.Record{Value: []byte("follower")}, func(error) {})
+	require.ErrorAs(t, err, &api.ErrNotLeader{})
+}
+
+func TestReplicationLag(t *testing.T) {
+	lagInterval = 10 * time.Millisecond
+	t.Cleanup(func() { lagInterval = time.Second })
+	logs := setupCluster(t, 3, func(c *Config) {
+		c.Raft.MaxReplicationLag = 200 * time.Millisecond
+	})
+	t.Cleanup(func() {
+		_ = logs[0].Close()
+		_ = logs[1].Close()
+	})
+	leader := logs[0]
+
+	_, err := leader.Append(&api.Record{Value: []byte("first")})
+	require.NoError(t, err)
+	// the followers acknowledge it and show no lag
+	require.Eventually(t, func() bool {
+		lag, ok := leader.lag.lag("2")
+		return ok && lag.offsets == 0
+	}, time.Second, 10*time.Millisecond)
+	servers, err := leader.GetServers()
+	require.NoError(t, err)
+	require.True(t, servers[2].InSync)
+	require.Zero(t, servers[2].LagOffsets)
+
+	// a follower that stops taking appends falls behind and out of sync
+	require.NoError(t, logs[2].Close())
+	_, _, err = leader.AppendAck(&api.Record{Value: []byte("second")}, api.Ack_ACK_LEADER)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		servers, err := leader.GetServers()
+		return err == nil && !servers[2].InSync &&
+			servers[2].LagOffsets > 0 && servers[2].LagSeconds > 0.2
+	}, 3*time.Second, 10*time.Millisecond)
+	require.True(t, leader.isr.inSync("1"))
+	require.True(t, leader.lag.stale("2"))
+}
+
+func TestTransferLeadership(t *testing.T) {
+	logs := setupCluster(t, 3, nil)
+	for _, l := range logs {
+		defer l.Close()
+	}
+
+	// followers have nothing to hand over
+	require.NoError(t, logs[1].TransferLeadership())
+	require.Equal(t, raft.Leader, logs[0].raft.State())
+
+	require.NoError(t, logs[0].TransferLeadership())
+	require.NotEqual(t, raft.Leader, logs[0].raft.State())
+	require.Eventually(t, func() bool {
+		leader := logs[0].Leader()
+		return leader != "" && leader != logs[0].config.Raft.BindAddr
+	}, time.Second, 10*time.Millisecond)
+}
+
+// Starts n nodes with node 0 bootstrapping the cluster and the others
+// joining it, fn adjusts each node's config
+func setupCluster(t *testing.T, n int, fn func(*Config)) []*DistributedLog {
+	t.Helper()
+	var logs []*DistributedLog
+	for i := 0; i < n; i++ {
+		dataDir, err := os.MkdirTemp("", "distributed-log-test")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = os.RemoveAll(dataDir) })
+
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = i == 0
+		if fn != nil {
+			fn(&config)
+		}
+
+		l, err := NewDistributedLog(dataDir, config)
+		require.NoError(t, err)
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String()))
+		}
+		logs = append(logs, l)
+	}
+	return logs
+}
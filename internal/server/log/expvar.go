@@ -0,0 +1,14 @@
+package log
+
+import "expvar"
+
+// Plain counters for /debug/vars, for debugging without a metrics stack
+var (
+	expAppends = expvar.NewInt("proglog_log_appends")
+	expReads   = expvar.NewInt("proglog_log_reads")
+	expFlushes = expvar.NewInt("proglog_store_flushes")
+	// Failed appends, reads and flushes; offsets out of range are not errors here
+	expErrors = expvar.NewInt("proglog_log_errors")
+	// Goroutines holding or waiting on a store lock, a stuck value points at lock contention
+	expStoreLockHolders = expvar.NewInt("proglog_store_lock_holders")
+)
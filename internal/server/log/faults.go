@@ -0,0 +1,278 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInjected is the error of an operation Faults failed
+var ErrInjected = errors.New("injected fault")
+
+// The file operations faults are injected into
+const (
+	FaultRead     = "read"
+	FaultWrite    = "write"
+	FaultSync     = "sync"
+	FaultTruncate = "truncate"
+)
+
+// The faults a rule injects
+const (
+	// FaultError fails the operation with ErrInjected
+	FaultError = "error"
+	// FaultShort writes only Bytes of a write before failing it
+	FaultShort = "short"
+	// FaultLatency delays the operation by Latency, then carries it out
+	FaultLatency = "latency"
+)
+
+// FaultRule injects a fault into the operations on a segment's files it
+// matches. Operations are counted per file, and the rule fires from the
+// Nth on, Count times. A store buffers its writes, so they're the store's
+// flushes; an index is memory mapped, its entries aren't written through
+// the file but its syncs are counted.
+type FaultRule struct {
+	// Op is the operation, one of FaultRead, FaultWrite, FaultSync and
+	// FaultTruncate
+	Op string
+	// Files matches the segment files' names, as filepath.Match does, e.g.
+	// *.store; empty matches every one
+	Files string
+	// Fault is one of FaultError, FaultShort and FaultLatency
+	Fault string
+	// Nth is the first operation the rule fires on, counting from 1; zero
+	// is the first
+	Nth int
+	// Count is how many operations the rule fires on, zero every one from
+	// the Nth on
+	Count   int
+	Bytes   int
+	Latency time.Duration
+}
+
+// ParseFaultRule parses a rule from space separated name=value pairs, e.g.
+// "op=write files=*.store fault=short bytes=4 nth=3 count=1". The names
+// are FaultRule's fields in lower case.
+func ParseFaultRule(s string) (FaultRule, error) {
+	var r FaultRule
+	for _, field := range strings.Fields(s) {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return r, fmt.Errorf("fault rule field %q isn't name=value", field)
+		}
+		var err error
+		switch name {
+		case "op":
+			r.Op = value
+		case "files":
+			r.Files = value
+		case "fault":
+			r.Fault = value
+		case "nth":
+			r.Nth, err = strconv.Atoi(value)
+		case "count":
+			r.Count, err = strconv.Atoi(value)
+		case "bytes":
+			r.Bytes, err = strconv.Atoi(value)
+		case "latency":
+			r.Latency, err = time.ParseDuration(value)
+		default:
+			return r, fmt.Errorf("unknown fault rule field %q", name)
+		}
+		if err != nil {
+			return r, fmt.Errorf("fault rule field %s: %w", name, err)
+		}
+	}
+	return r, r.validate()
+}
+
+func (r FaultRule) validate() error {
+	switch r.Op {
+	case FaultRead, FaultWrite, FaultSync, FaultTruncate:
+	default:
+		return fmt.Errorf("unknown fault operation %q", r.Op)
+	}
+	switch r.Fault {
+	case FaultError, FaultLatency:
+	case FaultShort:
+		if r.Op != FaultWrite {
+			return fmt.Errorf("only writes are short, not %ss", r.Op)
+		}
+	default:
+		return fmt.Errorf("unknown fault %q", r.Fault)
+	}
+	if _, err := filepath.Match(r.Files, ""); err != nil {
+		return fmt.Errorf("fault rule files %q: %w", r.Files, err)
+	}
+	if r.Nth < 0 || r.Count < 0 || r.Bytes < 0 || r.Latency < 0 {
+		return errors.New("fault rule nth, count, bytes and latency can't be negative")
+	}
+	return nil
+}
+
+// Faults injects faults into the I/O on the segment files of logs opened
+// with it, see Config.Faults, so tests and chaos experiments can exercise
+// what happens when disks fail. It's safe for concurrent use and its rules
+// can change while the logs are open.
+type Faults struct {
+	mu    sync.Mutex
+	rules []FaultRule
+	// operations so far, by rule and file
+	ops      []map[string]int
+	injected int
+}
+
+// NewFaults returns Faults injecting the rules', failing on an invalid one
+func NewFaults(rules ...FaultRule) (*Faults, error) {
+	f := &Faults{}
+	return f, f.Set(rules...)
+}
+
+// Set replaces the rules, counting operations afresh
+func (f *Faults) Set(rules ...FaultRule) error {
+	for _, r := range rules {
+		if err := r.validate(); err != nil {
+			return err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append([]FaultRule{}, rules...)
+	f.ops = make([]map[string]int, len(rules))
+	for i := range f.ops {
+		f.ops[i] = make(map[string]int)
+	}
+	return nil
+}
+
+// Injected returns how many faults have been injected
+func (f *Faults) Injected() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.injected
+}
+
+// Counts the operation on the file named name, returning the first rule
+// that fires on it, if any does
+func (f *Faults) fire(op, name string) (FaultRule, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var fired *FaultRule
+	for i := range f.rules {
+		r := &f.rules[i]
+		if r.Op != op {
+			continue
+		}
+		if ok, _ := filepath.Match(r.Files, name); r.Files != "" && !ok {
+			continue
+		}
+		f.ops[i][name]++
+		n, nth := f.ops[i][name], max(r.Nth, 1)
+		if fired == nil && n >= nth && (r.Count == 0 || n < nth+r.Count) {
+			fired = r
+		}
+	}
+	if fired == nil {
+		return FaultRule{}, false
+	}
+	f.injected++
+	faultsInjected.WithLabelValues(op, fired.Fault).Inc()
+	return *fired, true
+}
+
+// file is a segment's store or index file, an *os.File unless faults are
+// injected into it
+type file interface {
+	io.ReaderAt
+	io.Writer
+	Name() string
+	Fd() uintptr
+	Sync() error
+	Truncate(size int64) error
+	Close() error
+}
+
+// Opens a segment's file, injecting faults into it when there are any
+func openSegmentFile(name string, flag int, faults *Faults) (file, error) {
+	f, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return nil, err
+	} else if faults == nil {
+		return f, nil
+	}
+	return &faultFile{File: f, faults: faults, base: filepath.Base(name)}, nil
+}
+
+// A file faults are injected into
+type faultFile struct {
+	*os.File
+	faults *Faults
+	base   string
+}
+
+// Applies the fault a rule fires on the operation, if one does, returning
+// the error to fail it with
+func (f *faultFile) inject(op string) (FaultRule, error) {
+	r, ok := f.faults.fire(op, f.base)
+	if !ok {
+		return r, nil
+	}
+	if r.Fault == FaultLatency {
+		time.Sleep(r.Latency)
+		return r, nil
+	}
+	return r, &os.PathError{Op: op, Path: f.Name(), Err: ErrInjected}
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if _, err := f.inject(FaultRead); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	r, err := f.inject(FaultWrite)
+	if err == nil {
+		return f.File.Write(p)
+	}
+	if r.Fault != FaultShort {
+		return 0, err
+	}
+	n, werr := f.File.Write(p[:min(r.Bytes, len(p))])
+	if werr != nil {
+		return n, werr
+	}
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	if _, err := f.inject(FaultSync); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if _, err := f.inject(FaultTruncate); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+// Injects a fault into an operation the file isn't used for, as an index
+// syncing its mapping, when it's one faults are injected into
+func injectFault(f file, op string) error {
+	if ff, ok := f.(*faultFile); ok {
+		_, err := ff.inject(op)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFaultRule(t *testing.T) {
+	r, err := ParseFaultRule("op=write files=*.store fault=short bytes=4 nth=3 count=1")
+	require.NoError(t, err)
+	require.Equal(t, FaultRule{Op: FaultWrite, Files: "*.store", Fault: FaultShort, Bytes: 4, Nth: 3, Count: 1}, r)
+	r, err = ParseFaultRule("op=sync fault=latency latency=10ms")
+	require.NoError(t, err)
+	require.Equal(t, 10*time.Millisecond, r.Latency)
+
+	for _, s := range []string{
+		"op=write",
+		"op=open fault=error",
+		"op=sync fault=short",
+		"op=read fault=error nth=two",
+		"op=read fault=error files=[",
+		"op=read fault=error size=1",
+	} {
+		_, err := ParseFaultRule(s)
+		require.Error(t, err, s)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	faults, err := NewFaults()
+	require.NoError(t, err)
+	c := Config{Faults: faults, SyncOnAppend: true}
+	c.Segment.MaxIndexBytes = 1024
+	dir := t.TempDir()
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	record := func() *api.Record { return &api.Record{Value: []byte("hello world")} }
+
+	// a failed sync fails the append, and the next one goes through
+	require.NoError(t, faults.Set(FaultRule{Op: FaultSync, Files: "*.store", Fault: FaultError, Count: 1}))
+	_, err = l.Append(record())
+	require.ErrorIs(t, err, ErrInjected)
+	_, err = l.Append(record())
+	require.NoError(t, err)
+	require.Equal(t, 1, faults.Injected())
+
+	// operations are slowed down
+	require.NoError(t, faults.Set(FaultRule{Op: FaultRead, Fault: FaultLatency, Latency: 20 * time.Millisecond}))
+	start := time.Now()
+	_, err = l.Read(1)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+
+	// the next write, offset 2's, is torn and the server crashes
+	require.NoError(t, faults.Set(FaultRule{Op: FaultWrite, Files: "*.store", Fault: FaultShort, Bytes: 3}))
+	_, err = l.Append(record())
+	require.ErrorIs(t, err, ErrInjected)
+	require.Error(t, l.Close())
+
+	// opening it again cuts the torn record off
+	l, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer l.Close()
+	_, err = l.Read(1)
+	require.NoError(t, err)
+	_, err = l.Read(2)
+	require.Error(t, err)
+	off, err := l.Append(record())
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
@@ -0,0 +1,263 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The file in the log's directory naming the version of the on-disk format
+// its files are in
+const formatFile = "format.json"
+
+// FormatVersion is the version of the on-disk format this build writes
+const FormatVersion = 3
+
+// ErrFormat is returned opening a log in a format version this build can't
+// open, one it has to be migrated from first or one it doesn't know
+var ErrFormat = errors.New("unsupported format version")
+
+// Format is a log directory's format file
+type Format struct {
+	Version int `json:"version"`
+}
+
+// FormatSupport is a row of the compatibility matrix: what this build does
+// with logs in a format version
+type FormatSupport struct {
+	Version     int
+	Description string
+	// Open is whether logs in the version open as they are
+	Open bool
+	// upgrades a log to the next version, nil for the one this build writes
+	migrate func(dir string) error
+}
+
+var formats = []FormatSupport{{
+	Version:     0,
+	Description: "unversioned, from before logs had a format file",
+	migrate:     func(string) error { return nil },
+}, {
+	Version:     1,
+	Description: "length-prefixed records, sealed or not, and 12-byte index entries",
+	// its stores are version 2's, without batches
+	migrate: func(string) error { return nil },
+}, {
+	Version:     2,
+	Description: "length-prefixed records or record batches, sealed or not, and 12-byte index entries",
+	// its stores are version 3's, without holes or a start file
+	migrate: func(string) error { return nil },
+}, {
+	Version:     3,
+	Description: "length-prefixed records or record batches, sealed or not, deleted ones punched out as holes flagged in their length, 12-byte index entries and a start file",
+	Open:        true,
+}}
+
+// Formats returns the compatibility matrix, the format versions this build
+// knows oldest first. Logs in a version it doesn't open are migrated, see
+// Migrate, each version to the next.
+func Formats() []FormatSupport {
+	return append([]FormatSupport{}, formats...)
+}
+
+// Reads the version the log in dir is in: its format file's, or 0 for one
+// with segments but no format file. A directory with neither is new, and
+// ok is false.
+func readFormat(dir string) (version int, ok bool, err error) {
+	b, err := os.ReadFile(filepath.Join(dir, formatFile))
+	if err == nil {
+		var f Format
+		if err := json.Unmarshal(b, &f); err != nil {
+			return 0, false, fmt.Errorf("%s: %w", formatFile, err)
+		}
+		return f.Version, true, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return 0, false, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, file := range files {
+		if ext := filepath.Ext(file.Name()); ext == ".store" || ext == ".index" {
+			return 0, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// Writes the format file, replacing it so a crash leaves the old version
+// or the new one
+func writeFormat(dir string, version int) error {
+	b, err := json.Marshal(Format{Version: version})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, formatFile)
+	if err := os.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Checks the log in dir is in a version this build opens, writing the
+// format file of a new one
+func (l *Log) checkFormat() error {
+	version, ok, err := readFormat(l.Dir)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return writeFormat(l.Dir, FormatVersion)
+	}
+	if version > FormatVersion || version < 0 {
+		return fmt.Errorf("log %s is in format version %d, newer than this build's %d: %w", l.Dir, version, FormatVersion, ErrFormat)
+	}
+	if !formats[version].Open {
+		return fmt.Errorf("log %s is in format version %d, migrate it to %d first: %w", l.Dir, version, FormatVersion, ErrFormat)
+	}
+	return nil
+}
+
+// MigrateOptions says how to migrate a data directory, see Migrate
+type MigrateOptions struct {
+	// To is the version to migrate to, FormatVersion if it's 0
+	To int
+	// Out, if it's set, is an empty directory the data directory is copied
+	// into and migrated there, leaving it as it was
+	Out string
+}
+
+// MigratedLog is a log Migrate found, and the versions it migrated it from
+// and to, the same if it was already in the version
+type MigratedLog struct {
+	// Dir is relative to the data directory
+	Dir  string `json:"dir"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+// Migrate upgrades the logs in the data directory dir, every directory with
+// segments or a format file in it, to the format version opts.To, with the
+// server stopped. Each log's format file is written as each version's
+// migration finishes, so an interrupted migration carries on from where it
+// was. Logs are only upgraded: one in a newer version than To fails it.
+// dir is locked meanwhile, see LockDir.
+// Raft's snapshots and stable store are raft's own and aren't migrated.
+func Migrate(dir string, opts MigrateOptions) ([]MigratedLog, error) {
+	to := opts.To
+	if to == 0 {
+		to = FormatVersion
+	}
+	if to < 0 || to > FormatVersion {
+		return nil, fmt.Errorf("this build migrates up to format version %d, not %d", FormatVersion, to)
+	}
+	lock, err := LockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	if opts.Out != "" {
+		if rel, err := filepath.Rel(dir, opts.Out); err == nil && filepath.IsLocal(rel) {
+			return nil, fmt.Errorf("%s is inside %s", opts.Out, dir)
+		}
+		if err := copyDir(dir, opts.Out); err != nil {
+			return nil, err
+		}
+		dir = opts.Out
+	}
+	var migrated []MigratedLog
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		if d.Name() == cacheDirName || d.Name() == quarantineDirName {
+			return filepath.SkipDir
+		}
+		version, ok, err := readFormat(path)
+		if err != nil || !ok {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if err := migrateLog(path, version, to); err != nil {
+			return fmt.Errorf("log %s: %w", rel, err)
+		}
+		migrated = append(migrated, MigratedLog{Dir: filepath.ToSlash(rel), From: version, To: to})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return migrated, nil
+}
+
+// Migrates the log in dir from one version to the next until it's in to
+func migrateLog(dir string, from, to int) error {
+	if from < 0 || from > to {
+		return fmt.Errorf("format version %d is newer than %d: %w", from, to, ErrFormat)
+	}
+	for v := from; v < to; v++ {
+		if err := formats[v].migrate(dir); err != nil {
+			return fmt.Errorf("migrating from format version %d: %w", v, err)
+		}
+		if err := writeFormat(dir, v+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copies the files under src into dst, which must be empty
+func copyDir(src, dst string) error {
+	if err := emptyDir(dst, false); err != nil {
+		return err
+	}
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case strings.HasSuffix(d.Name(), ".tmp"):
+			// left half written
+			return nil
+		case rel == lockFile:
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
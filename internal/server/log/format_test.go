@@ -0,0 +1,83 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat(t *testing.T) {
+	dir := testDataDir(t, Config{})
+	for _, d := range []string{dir, filepath.Join(dir, "topics", "events", "0")} {
+		version, ok, err := readFormat(d)
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.Equal(t, FormatVersion, version)
+	}
+
+	// a log from before logs were versioned has to be migrated first
+	require.NoError(t, os.Remove(filepath.Join(dir, formatFile)))
+	_, err := NewLog(dir, Config{})
+	require.ErrorIs(t, err, ErrFormat)
+	report, err := Verify(dir, VerifyOptions{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"."}, paths(report.Problems))
+	// as does one in version 2, whose builds would misread the holes this
+	// one punches
+	require.NoError(t, writeFormat(dir, 2))
+	_, err = NewLog(dir, Config{})
+	require.ErrorIs(t, err, ErrFormat)
+	require.NoError(t, migrateLog(dir, 2, FormatVersion))
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	// one from a newer build isn't opened at all
+	require.NoError(t, writeFormat(filepath.Join(dir, "topics", "events", "0"), FormatVersion+1))
+	_, err = NewLog(filepath.Join(dir, "topics", "events", "0"), Config{})
+	require.ErrorIs(t, err, ErrFormat)
+	_, err = Migrate(dir, MigrateOptions{})
+	require.ErrorIs(t, err, ErrFormat)
+}
+
+func TestMigrate(t *testing.T) {
+	dir := testDataDir(t, Config{})
+	require.NoError(t, os.Remove(filepath.Join(dir, formatFile)))
+
+	// into another directory, leaving the data directory as it was
+	out := filepath.Join(t.TempDir(), "migrated")
+	_, err := Migrate(dir, MigrateOptions{Out: filepath.Join(dir, "migrated")})
+	require.Error(t, err)
+	migrated, err := Migrate(dir, MigrateOptions{Out: out})
+	require.NoError(t, err)
+	require.Equal(t, []MigratedLog{
+		{Dir: ".", From: 0, To: FormatVersion},
+		{Dir: "topics/events/0", From: FormatVersion, To: FormatVersion},
+	}, migrated)
+	_, ok, err := readFormat(dir)
+	require.NoError(t, err)
+	require.True(t, ok)
+	_, err = os.Stat(filepath.Join(dir, formatFile))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	topics, err := NewTopics(out, Config{})
+	require.NoError(t, err)
+	record, err := topics.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 4"), record.Value)
+	off, ok := topics.FetchOffset("reader")
+	require.True(t, ok)
+	require.Equal(t, uint64(2), off)
+	require.NoError(t, topics.Close())
+
+	// and in place
+	_, err = Migrate(dir, MigrateOptions{})
+	require.NoError(t, err)
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+}
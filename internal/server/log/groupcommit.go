@@ -0,0 +1,131 @@
+package log
+
+import (
+	"sync"
+	"time"
+)
+
+// groupCommit shares fsyncs between the appends of a log synced on append.
+// Each append joins the batch open as it's made and, once the log's lock is
+// released, waits for a sync of the batch. The first to wait leads it: it
+// waits the sync window for others to join, then closes the batch and
+// syncs once for every append in it. Appends made meanwhile join the next
+// batch, led by the first of them once the sync finishes.
+type groupCommit struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// open is the batch appends join, nil until one does
+	open *commitBatch
+	// syncing is set while a batch's leader syncs
+	syncing bool
+	// syncs so far, for tests
+	syncs int
+}
+
+// A batch of appends synced together
+type commitBatch struct {
+	appends int
+	done    bool
+	err     error
+	// durable are called once the batch is synced, see notify
+	durable []func(error)
+}
+
+func newGroupCommit() *groupCommit {
+	g := &groupCommit{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// Adds an append to the open batch, callers must hold the log's lock so
+// the batch's sync covers it
+func (g *groupCommit) join() *commitBatch {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.open == nil {
+		g.open = &commitBatch{}
+	}
+	g.open.appends++
+	return g.open
+}
+
+// Closes the open batch, callers must hold the log's lock so no append
+// joins it after it's synced
+func (g *groupCommit) close() *commitBatch {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	b := g.open
+	g.open = nil
+	return b
+}
+
+// Waits until the batch has been synced, leading a sync when none is
+// running, and returns the sync's error
+func (g *groupCommit) wait(b *commitBatch, window time.Duration, sync func()) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for !b.done {
+		if g.syncing {
+			g.cond.Wait()
+			continue
+		}
+		g.syncing = true
+		g.mu.Unlock()
+		if window > 0 {
+			time.Sleep(window)
+		}
+		// with none running, the batch is the open one and the sync closes it
+		sync()
+		g.mu.Lock()
+		g.syncing = false
+		g.cond.Broadcast()
+	}
+	return b.err
+}
+
+// Calls durable from a goroutine once the batch has been synced, with the
+// sync's error, rather than waiting for it. The first to ask waits for the
+// batch, as wait does, for every append in it that asks.
+func (g *groupCommit) notify(b *commitBatch, window time.Duration, sync func(), durable func(error)) {
+	g.mu.Lock()
+	if b.done {
+		err := b.err
+		g.mu.Unlock()
+		go durable(err)
+		return
+	}
+	b.durable = append(b.durable, durable)
+	waiting := len(b.durable) > 1
+	g.mu.Unlock()
+	if waiting {
+		return
+	}
+	go func() {
+		err := g.wait(b, window, sync)
+		g.mu.Lock()
+		notify := b.durable
+		b.durable = nil
+		g.mu.Unlock()
+		for _, durable := range notify {
+			durable(err)
+		}
+	}()
+}
+
+// Closes the open batch and syncs the active segment, which holds every
+// append in it: those before them in other segments were synced as the
+// log rolled over
+func (l *Log) syncBatch() {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	b := l.commits.close()
+	if b == nil {
+		return
+	}
+	err := l.activeSegment.Sync()
+	groupCommitAppends.Observe(float64(b.appends))
+	l.commits.mu.Lock()
+	b.done, b.err = true, err
+	l.commits.syncs++
+	l.commits.mu.Unlock()
+}
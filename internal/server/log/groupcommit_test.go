@@ -0,0 +1,98 @@
+package log
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupCommit(t *testing.T) {
+	c := Config{SyncOnAppend: true, SyncWindow: 20 * time.Millisecond}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer l.Close()
+
+	// concurrent appends share fsyncs
+	const producers = 50
+	var wg sync.WaitGroup
+	offsets := make(chan uint64, producers)
+	for i := 0; i < producers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			off, err := l.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			offsets <- off
+		}()
+	}
+	wg.Wait()
+	close(offsets)
+	seen := make(map[uint64]bool)
+	for off := range offsets {
+		seen[off] = true
+	}
+	require.Len(t, seen, producers)
+	require.Less(t, l.commits.syncs, producers/2)
+
+	// a failed fsync fails every append that shared it
+	faults, err := NewFaults(FaultRule{Op: FaultSync, Files: "*.store", Fault: FaultError})
+	require.NoError(t, err)
+	c.Faults = faults
+	l, err = NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer l.Close()
+	errs := make(chan error, 4)
+	for i := 0; i < cap(errs); i++ {
+		go func() {
+			_, err := l.Append(&api.Record{Value: []byte("hello world")})
+			errs <- err
+		}()
+	}
+	for i := 0; i < cap(errs); i++ {
+		require.ErrorIs(t, <-errs, ErrInjected)
+	}
+}
+
+func TestAppendDurable(t *testing.T) {
+	l, err := NewLog(t.TempDir(), Config{SyncWindow: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer l.Close()
+
+	// the appends return before the sync they share
+	synced := make(chan error, 3)
+	for i := range cap(synced) {
+		off, err := l.AppendDurable(&api.Record{Value: []byte("hello world")}, func(err error) {
+			synced <- err
+		})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), off)
+	}
+	for range cap(synced) {
+		require.NoError(t, <-synced)
+	}
+	require.Equal(t, 1, l.commits.syncs)
+
+	offs, err := l.AppendBatchDurable([]*api.Record{{Value: []byte("a")}, {Value: []byte("b")}}, func(err error) {
+		synced <- err
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{3, 4}, offs)
+	require.NoError(t, <-synced)
+
+	// and learn when it fails
+	faults, err := NewFaults(FaultRule{Op: FaultSync, Files: "*.store", Fault: FaultError})
+	require.NoError(t, err)
+	l, err = NewLog(t.TempDir(), Config{Faults: faults})
+	require.NoError(t, err)
+	defer l.Close()
+	_, err = l.AppendDurable(&api.Record{Value: []byte("hello world")}, func(err error) {
+		synced <- err
+	})
+	require.NoError(t, err)
+	require.ErrorIs(t, <-synced, ErrInjected)
+}
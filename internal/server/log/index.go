@@ -0,0 +1,239 @@
+package log
+
+import (
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	offWidth uint64 = 4
+	posWidth uint64 = 8
+	entWidth        = offWidth + posWidth
+)
+
+// Index—maps a record's offset relative to the segment to its position in the store
+type index struct {
+	file file   // Backing file, grown to MaxIndexBytes while open
+	mmap []byte // Memory mapped view of the file, nil while evicted
+	size uint64 // Bytes of entries actually written
+
+	name     string
+	maxBytes uint64
+	faults   *Faults
+	// cache, when set, unmaps the index while it's sealed and cold, see
+	// IndexCache. mu guards mmap and cold against the cache evicting it.
+	cache *IndexCache
+	mu    sync.RWMutex
+	cold  bool
+	used  atomic.Uint64
+}
+
+func newIndex(f file, c Config) (*index, error) {
+	idx := &index{
+		file:     f,
+		name:     f.Name(),
+		maxBytes: c.Segment.MaxIndexBytes,
+		faults:   c.Faults,
+		cache:    c.IndexCache,
+	}
+	fi, err := os.Stat(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	idx.size = uint64(fi.Size())
+	if err = idx.mapFile(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Grows the file to the max size up front, it can't be resized once
+// mapped, and maps it
+func (i *index) mapFile() (err error) {
+	if err = i.file.Truncate(int64(i.maxBytes)); err != nil {
+		return err
+	}
+	i.mmap, err = mmap(i.file, int(i.maxBytes))
+	return err
+}
+
+// Read returns the relative offset and store position of the in'th entry, -1 reads the last one
+func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
+	if i.cache == nil {
+		return i.read(in)
+	}
+	for {
+		i.mu.RLock()
+		if i.mmap != nil {
+			if i.cold {
+				i.cache.hit(i)
+			}
+			out, pos, err = i.read(in)
+			i.mu.RUnlock()
+			return out, pos, err
+		}
+		i.mu.RUnlock()
+		// mapped again, but it may be evicted again before it's read
+		if err := i.remap(); err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+func (i *index) read(in int64) (out uint32, pos uint64, err error) {
+	if i.size == 0 {
+		return 0, 0, io.EOF
+	}
+	if in == -1 {
+		out = uint32((i.size / entWidth) - 1)
+	} else {
+		out = uint32(in)
+	}
+	pos = uint64(out) * entWidth
+	if i.size < pos+entWidth {
+		return 0, 0, io.EOF
+	}
+	out = enc.Uint32(i.mmap[pos : pos+offWidth])
+	pos = enc.Uint64(i.mmap[pos+offWidth : pos+entWidth])
+	return out, pos, nil
+}
+
+// Write appends an entry, failing with io.EOF once the index is full
+func (i *index) Write(off uint32, pos uint64) error {
+	if i.mmap == nil {
+		// evicted before it was unsealed
+		if err := i.remap(); err != nil {
+			return err
+		}
+	}
+	if uint64(len(i.mmap)) < i.size+entWidth {
+		return io.EOF
+	}
+	enc.PutUint32(i.mmap[i.size:i.size+offWidth], off)
+	enc.PutUint64(i.mmap[i.size+offWidth:i.size+entWidth], pos)
+	i.size += entWidth
+	return nil
+}
+
+// truncate keeps the first n entries
+func (i *index) truncate(n uint64) {
+	i.size = n * entWidth
+}
+
+// Sync commits the written entries to stable storage
+func (i *index) Sync() error {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if i.mmap == nil {
+		// synced as it was evicted
+		return nil
+	}
+	if err := injectFault(i.file, FaultSync); err != nil {
+		return err
+	}
+	return msync(i.file, i.mmap[:i.size])
+}
+
+func (i *index) Name() string {
+	return i.name
+}
+
+// seal hands the index to the cache, if there's one, to evict once it's
+// gone cold
+func (i *index) seal() {
+	if i.cache == nil {
+		return
+	}
+	i.mu.Lock()
+	i.cold = true
+	mapped := i.mmap != nil
+	i.mu.Unlock()
+	if mapped {
+		i.cache.add(i)
+	}
+}
+
+// unseal takes the index back from the cache so it's written to again
+func (i *index) unseal() {
+	if i.cache == nil {
+		return
+	}
+	i.mu.Lock()
+	i.cold = false
+	i.mu.Unlock()
+	i.cache.remove(i)
+}
+
+// Reopens and maps the evicted index, handing it back to the cache if it's
+// still cold. The cache is added to without mu held, as it evicts others.
+func (i *index) remap() error {
+	i.mu.Lock()
+	if i.mmap != nil {
+		i.mu.Unlock()
+		return nil
+	}
+	indexCacheMisses.Inc()
+	err := i.open()
+	cold := i.cold
+	i.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if cold {
+		i.cache.add(i)
+	}
+	return nil
+}
+
+func (i *index) open() (err error) {
+	if i.file, err = openSegmentFile(i.name, os.O_RDWR, i.faults); err != nil {
+		return err
+	}
+	if err = i.mapFile(); err != nil {
+		i.file.Close()
+		return err
+	}
+	return nil
+}
+
+// evict unmaps and closes the index if it's still cold, leaving it as Close
+// does until it's read again
+func (i *index) evict() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if !i.cold || i.mmap == nil {
+		return nil
+	}
+	return i.close()
+}
+
+// Close syncs the mapping and shrinks the file back to the written entries,
+// so the last entry can be found again on restart
+func (i *index) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.mmap == nil {
+		// closed as it was evicted, but it may have been truncated since
+		return os.Truncate(i.name, int64(i.size))
+	}
+	return i.close()
+}
+
+func (i *index) close() error {
+	if err := msync(i.file, i.mmap); err != nil {
+		return err
+	}
+	if err := i.file.Sync(); err != nil {
+		return err
+	}
+	if err := munmap(i.mmap); err != nil {
+		return err
+	}
+	i.mmap = nil
+	if err := i.file.Truncate(int64(i.size)); err != nil {
+		return err
+	}
+	return i.file.Close()
+}
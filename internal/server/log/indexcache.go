@@ -0,0 +1,78 @@
+package log
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// IndexCache caps how many sealed segments' indexes are memory mapped at
+// once, across every log sharing it, so logs with thousands of segments
+// don't map them all. Past the cap the least recently read indexes are
+// unmapped and closed, and opened and mapped again when they're next read.
+// Active segments' indexes are always mapped and don't count.
+type IndexCache struct {
+	size  int
+	clock atomic.Uint64
+
+	mu     sync.Mutex
+	mapped map[*index]struct{}
+}
+
+// NewIndexCache returns an IndexCache keeping at most size sealed indexes
+// mapped, at least one
+func NewIndexCache(size int) *IndexCache {
+	return &IndexCache{size: max(size, 1), mapped: make(map[*index]struct{})}
+}
+
+// Mapped returns how many sealed indexes are mapped
+func (c *IndexCache) Mapped() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.mapped)
+}
+
+// Marks the index read now, reads don't take mu
+func (c *IndexCache) hit(i *index) {
+	indexCacheHits.Inc()
+	i.used.Store(c.clock.Add(1))
+}
+
+// Counts the mapped index, then evicts the least recently read others past
+// the cap. Callers mustn't hold any index's mu.
+func (c *IndexCache) add(i *index) {
+	i.used.Store(c.clock.Add(1))
+	c.mu.Lock()
+	added := 1
+	if _, ok := c.mapped[i]; ok {
+		added = 0
+	}
+	c.mapped[i] = struct{}{}
+	var evict []*index
+	for len(c.mapped) > c.size {
+		// the cache is small enough to scan on each miss
+		var lru *index
+		for m := range c.mapped {
+			if m != i && (lru == nil || m.used.Load() < lru.used.Load()) {
+				lru = m
+			}
+		}
+		delete(c.mapped, lru)
+		evict = append(evict, lru)
+	}
+	indexCacheMapped.Add(float64(added - len(evict)))
+	c.mu.Unlock()
+	for _, m := range evict {
+		// an index that fails to close stays mapped, uncounted, until its
+		// segment closes
+		_ = m.evict()
+	}
+}
+
+func (c *IndexCache) remove(i *index) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.mapped[i]; ok {
+		delete(c.mapped, i)
+		indexCacheMapped.Dec()
+	}
+}
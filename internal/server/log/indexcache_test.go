@@ -0,0 +1,66 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexCache(t *testing.T) {
+	c := Config{IndexCache: NewIndexCache(2)}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	value := func(off uint64) []byte { return []byte(fmt.Sprintf("record %d", off)) }
+	for off := uint64(0); off < 30; off++ {
+		_, err := l.Append(&api.Record{Value: value(off)})
+		require.NoError(t, err)
+	}
+	// ten segments sealed, two of their indexes left mapped
+	require.Equal(t, 2, c.IndexCache.Mapped())
+	evicted, err := os.Stat(l.segments[0].index.Name())
+	require.NoError(t, err)
+	require.Equal(t, int64(entWidth*3), evicted.Size())
+
+	// evicted indexes are mapped again as they're read, concurrently too
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for off := uint64(0); off < 30; off++ {
+				record, err := l.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, value(off), record.Value)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, 2, c.IndexCache.Mapped())
+
+	// truncating into evicted segments appends to them again
+	require.NoError(t, l.TruncateFrom(4))
+	require.LessOrEqual(t, c.IndexCache.Mapped(), 1)
+	off, err := l.Append(&api.Record{Value: []byte("again")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	require.NoError(t, l.Close())
+	require.Zero(t, c.IndexCache.Mapped())
+
+	// and evicted or not, the indexes are found again on restart
+	l, err = NewLog(l.Dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for off := uint64(0); off < 4; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, value(off), record.Value)
+	}
+	record, err := l.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("again"), record.Value)
+}
@@ -0,0 +1,287 @@
+package log
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// What InspectSegment says of a record
+const (
+	// RecordOK reads and is indexed where it is
+	RecordOK = "ok"
+	// RecordUnindexed reads, but no index entry points at it
+	RecordUnindexed = "unindexed"
+	// RecordMisindexed reads, but its index entry has another offset
+	RecordMisindexed = "misindexed"
+	// RecordSealed is encrypted, and there's no keyring to open it with
+	RecordSealed = "sealed"
+	// RecordCorrupt doesn't read, or doesn't open with the keyring
+	RecordCorrupt = "corrupt"
+	// RecordPunched frames the deleted records punched out of the store,
+	// see Log.DeleteRecords
+	RecordPunched = "punched"
+)
+
+// SegmentInfo describes a segment's files, as InspectSegment found them
+type SegmentInfo struct {
+	BaseOffset uint64 `json:"base_offset"`
+	// NextOffset is one past the last record's offset, as far as it's known
+	NextOffset   uint64 `json:"next_offset"`
+	StoreBytes   uint64 `json:"store_bytes"`
+	IndexBytes   uint64 `json:"index_bytes"`
+	IndexEntries uint64 `json:"index_entries"`
+	Records      uint64 `json:"records"`
+	// TornBytes are at the end of the store, not a whole record
+	TornBytes uint64 `json:"torn_bytes"`
+	// Statuses counts the records by status
+	Statuses map[string]uint64 `json:"statuses"`
+}
+
+// SegmentRecord is a record of a segment's store, where it is and what it
+// holds. Record is nil unless it reads, and Offset is the index's for one
+// that doesn't.
+type SegmentRecord struct {
+	Offset   uint64
+	Position uint64
+	// Size is the bytes stored, the length prefix aside
+	Size   uint64
+	Status string
+	Record *api.Record
+	// Stored is the bytes as stored, sealed when the record is
+	Stored []byte
+	// Batched is set for a record of a batch, whose Position, Size and
+	// Stored these are
+	Batched bool
+}
+
+// InspectSegment calls fn with each record in the store of the segment at
+// path, its .store or .index file or the two's path without an extension,
+// in the order they're stored. Sealed records are opened with keys if
+// they're set. It stops at the first error fn returns.
+func InspectSegment(path string, keys *Keyring, fn func(SegmentRecord) error) (*SegmentInfo, error) {
+	if ext := filepath.Ext(path); ext == ".store" || ext == ".index" {
+		path = strings.TrimSuffix(path, ext)
+	}
+	base, err := strconv.ParseUint(filepath.Base(path), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a segment, they're named by their base offset", path)
+	}
+	info := &SegmentInfo{BaseOffset: base, NextOffset: base, Statuses: make(map[string]uint64)}
+	index, err := os.ReadFile(path + ".index")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	info.IndexBytes = uint64(len(index))
+	// the entries by position, the offsets relative to the base, a batch's
+	// in order
+	entries := make(map[uint64][]uint32)
+	for i := uint64(0); i+entWidth <= uint64(len(index)); i += entWidth {
+		pos := enc.Uint64(index[i+offWidth : i+entWidth])
+		entries[pos] = append(entries[pos], enc.Uint32(index[i:]))
+		info.IndexEntries++
+	}
+
+	f, err := os.Open(path + ".store")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info.StoreBytes = uint64(fi.Size())
+	r := bufio.NewReader(f)
+	size := make([]byte, lenWidth)
+	var pos uint64
+	for {
+		if _, err := io.ReadFull(r, size); err != nil {
+			break
+		}
+		n, hole := frameLen(size)
+		if n > info.StoreBytes-pos-lenWidth {
+			break
+		}
+		stored := make([]byte, n)
+		if _, err := io.ReadFull(r, stored); err != nil {
+			return nil, err
+		}
+		rels := entries[pos]
+		records, status, batched := openStored(stored, hole, keys)
+		if records == nil {
+			// one that doesn't read
+			records = []*api.Record{nil}
+		}
+		for i, record := range records {
+			sr := SegmentRecord{Position: pos, Size: n, Stored: stored, Status: status, Record: record, Batched: batched}
+			var rel uint32
+			indexed := i < len(rels)
+			if indexed {
+				rel = rels[i]
+			}
+			switch {
+			case sr.Record != nil:
+				sr.Offset = sr.Record.Offset
+				if !indexed {
+					sr.Status = RecordUnindexed
+				} else if sr.Offset != base+uint64(rel) {
+					sr.Status = RecordMisindexed
+				}
+			case indexed:
+				sr.Offset = base + uint64(rel)
+			}
+			if sr.Record != nil || indexed {
+				info.NextOffset = max(info.NextOffset, sr.Offset+1)
+			}
+			info.Records++
+			info.Statuses[sr.Status]++
+			if err := fn(sr); err != nil {
+				return info, err
+			}
+		}
+		pos += lenWidth + n
+	}
+	info.TornBytes = info.StoreBytes - pos
+	return info, nil
+}
+
+// Decodes the stored record, or the batch's records, opening it with keys
+// when it's sealed, and says which it was. A hole frames deleted records
+// punched out.
+func openStored(p []byte, hole bool, keys *Keyring) ([]*api.Record, string, bool) {
+	if hole {
+		return nil, RecordPunched, false
+	}
+	if records, batched, err := decodeStored(p); err == nil {
+		return records, RecordOK, batched
+	}
+	if keys == nil {
+		if looksSealed(p) {
+			return nil, RecordSealed, false
+		}
+		return nil, RecordCorrupt, false
+	}
+	opened, err := keys.Open(p)
+	if err != nil {
+		return nil, RecordCorrupt, false
+	}
+	records, batched, err := decodeStored(opened)
+	if err != nil {
+		return nil, RecordCorrupt, false
+	}
+	return records, RecordOK, batched
+}
+
+// Decodes the plaintext record or batch
+func decodeStored(p []byte) ([]*api.Record, bool, error) {
+	if !isBatch(p) {
+		record := &api.Record{}
+		if err := proto.Unmarshal(p, record); err != nil {
+			return nil, false, err
+		}
+		return []*api.Record{record}, false, nil
+	}
+	b, err := unmarshalBatch(p)
+	if err != nil {
+		return nil, true, err
+	}
+	records := make([]*api.Record, len(b.records))
+	for i, p := range b.records {
+		records[i] = &api.Record{}
+		if err := proto.Unmarshal(p, records[i]); err != nil {
+			return nil, true, err
+		}
+	}
+	return records, true, nil
+}
+
+// RecordInfo is where the log keeps a record and whether it reads back, see
+// Log.DescribeRecord
+type RecordInfo struct {
+	// Record is nil unless Status is RecordOK
+	Record *api.Record
+	// Offset is the record's, the first compaction left at or after the
+	// one asked for
+	Offset uint64
+	// Segment is the path of the store file holding the record, empty for
+	// one read from the tier's archive
+	Segment  string
+	Archived bool
+	// Position is where the store holds it, its length prefix first, and
+	// Size the bytes stored after that, sealed when the record is: a
+	// batch's, for a record of one
+	Position uint64
+	Size     uint64
+	Batched  bool
+	// Status is RecordOK; RecordCorrupt when the record doesn't read, a
+	// batch's CRC not matching or a sealed record not opening;
+	// RecordSealed when there's no keyring to open it with; or
+	// RecordMisindexed when its index entry points at another record
+	Status string
+}
+
+// DescribeRecord reads the record at off, or the first one after it
+// compaction left, from its segment's store as it's stored, checking it
+// reads back whole. A corrupt record is described, not an error.
+func (l *Log) DescribeRecord(off uint64) (*RecordInfo, error) {
+	l.mu.RLock()
+	s := l.segmentFor(off)
+	if s == nil {
+		l.mu.RUnlock()
+		if l.archive == nil {
+			return nil, api.ErrOffsetOutOfRange{Offset: off}
+		}
+		record, err := l.archive.read(off)
+		if err != nil {
+			return nil, err
+		}
+		return &RecordInfo{Record: record, Offset: record.Offset, Archived: true, Status: RecordOK}, nil
+	}
+	defer l.mu.RUnlock()
+	in, pos, err := s.entry(off - s.baseOffset)
+	if errors.Is(err, io.EOF) {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	if err != nil {
+		return nil, err
+	}
+	rel, _, err := s.index.Read(in)
+	if err != nil {
+		return nil, err
+	}
+	info := &RecordInfo{
+		Offset:   s.baseOffset + uint64(rel),
+		Segment:  filepath.Join(l.Dir, fmt.Sprintf("%d.store", s.baseOffset)),
+		Position: pos,
+	}
+	size := make([]byte, lenWidth)
+	if _, err := s.store.ReadAt(size, int64(pos)); err != nil {
+		return nil, err
+	}
+	var hole bool
+	info.Size, hole = frameLen(size)
+	stored := make([]byte, info.Size)
+	if _, err := s.store.ReadAt(stored, int64(pos+lenWidth)); err != nil {
+		return nil, err
+	}
+	var records []*api.Record
+	records, info.Status, info.Batched = openStored(stored, hole, s.store.keys)
+	for _, record := range records {
+		if record.Offset == info.Offset {
+			info.Record = record
+		}
+	}
+	if info.Status == RecordOK && info.Record == nil {
+		info.Status = RecordMisindexed
+	}
+	return info, nil
+}
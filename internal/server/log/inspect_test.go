@@ -0,0 +1,116 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func inspectAll(t *testing.T, path string, keys *Keyring) (*SegmentInfo, []SegmentRecord) {
+	t.Helper()
+	var records []SegmentRecord
+	info, err := InspectSegment(path, keys, func(sr SegmentRecord) error {
+		records = append(records, sr)
+		return nil
+	})
+	require.NoError(t, err)
+	return info, records
+}
+
+func TestInspectSegment(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := l.Append(&api.Record{Key: []byte(key), Value: []byte("value " + key)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	info, records := inspectAll(t, filepath.Join(dir, "0.store"), nil)
+	require.Equal(t, uint64(3), info.NextOffset)
+	require.Equal(t, uint64(3), info.IndexEntries)
+	require.Equal(t, map[string]uint64{RecordOK: 3}, info.Statuses)
+	require.Len(t, records, 3)
+	require.Equal(t, []byte("b"), records[1].Record.Key)
+	require.Equal(t, records[0].Size+lenWidth, records[1].Position)
+
+	// the last entry lost, a torn record after the last, and one corrupted
+	require.NoError(t, os.Truncate(filepath.Join(dir, "0.index"), int64(2*entWidth)))
+	b, err := os.ReadFile(filepath.Join(dir, "0.store"))
+	require.NoError(t, err)
+	b[lenWidth] = 0xff
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0.store"), append(b, 0, 0, 1), 0644))
+	info, records = inspectAll(t, filepath.Join(dir, "0"), nil)
+	require.Equal(t, uint64(3), info.TornBytes)
+	require.Equal(t, RecordCorrupt, records[0].Status)
+	require.Equal(t, uint64(0), records[0].Offset)
+	require.Equal(t, RecordOK, records[1].Status)
+	require.Equal(t, RecordUnindexed, records[2].Status)
+
+	_, err = InspectSegment(filepath.Join(dir, "segment.store"), nil, nil)
+	require.Error(t, err)
+}
+
+func TestInspectSealedSegment(t *testing.T) {
+	keys := NewKeyring()
+	require.NoError(t, keys.Add(1, make([]byte, 32)))
+	dir := t.TempDir()
+	l, err := NewLog(dir, Config{Keyring: keys})
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("secret")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	_, records := inspectAll(t, filepath.Join(dir, "0.index"), nil)
+	require.Equal(t, RecordSealed, records[0].Status)
+	require.Nil(t, records[0].Record)
+	_, records = inspectAll(t, filepath.Join(dir, "0.index"), keys)
+	require.Equal(t, RecordOK, records[0].Status)
+	require.Equal(t, []byte("secret"), records[0].Record.Value)
+}
+
+func TestDescribeRecord(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Batch.Enabled = true
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	_, err = l.AppendBatch([]*api.Record{{Key: []byte("a"), Value: []byte("value a")}})
+	require.NoError(t, err)
+	_, err = l.AppendBatch([]*api.Record{{Value: []byte("b")}, {Value: []byte("c")}})
+	require.NoError(t, err)
+
+	info, err := l.DescribeRecord(0)
+	require.NoError(t, err)
+	require.Equal(t, RecordOK, info.Status)
+	require.Equal(t, filepath.Join(dir, "0.store"), info.Segment)
+	require.Equal(t, uint64(0), info.Position)
+	require.Equal(t, []byte("a"), info.Record.Key)
+	first := info
+	info, err = l.DescribeRecord(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), info.Offset)
+	require.True(t, info.Batched)
+	require.Equal(t, []byte("c"), info.Record.Value)
+	require.Equal(t, first.Size+lenWidth, info.Position)
+	_, err = l.DescribeRecord(3)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+
+	// a record that doesn't read back is described, not an error
+	require.NoError(t, l.Close())
+	b, err := os.ReadFile(filepath.Join(dir, "0.store"))
+	require.NoError(t, err)
+	b[lenWidth] = 0xff
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0.store"), b, 0644))
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	info, err = l.DescribeRecord(0)
+	require.NoError(t, err)
+	require.Equal(t, RecordCorrupt, info.Status)
+	require.Nil(t, info.Record)
+}
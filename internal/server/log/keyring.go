@@ -0,0 +1,199 @@
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+const (
+	keyIDWidth = 4
+)
+
+var (
+	ErrNoKeys       = errors.New("keyring has no keys")
+	ErrUnknownKeyID = errors.New("unknown encryption key id")
+	ErrCiphertext   = errors.New("ciphertext too short")
+)
+
+// Keyring holds the at-rest encryption keys by ID.
+// New data is always sealed with the newest (highest ID) key, old data
+// is opened with whichever key ID it was written under.
+type Keyring struct {
+	mu      sync.RWMutex
+	keys    map[uint32]cipher.AEAD
+	current uint32
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[uint32]cipher.AEAD)}
+}
+
+// Add registers an AES-128/192/256 key under the given ID
+func (k *Keyring) Add(id uint32, key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; ok {
+		return fmt.Errorf("key id %d already registered", id)
+	}
+	k.keys[id] = aead
+	if len(k.keys) == 1 || id > k.current {
+		k.current = id
+	}
+	return nil
+}
+
+// Has reports whether a key is registered under id
+func (k *Keyring) Has(id uint32) bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	_, ok := k.keys[id]
+	return ok
+}
+
+// Current returns the ID new data is encrypted with
+func (k *Keyring) Current() uint32 {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current
+}
+
+// Seal encrypts p with the current key: key id | nonce | ciphertext
+func (k *Keyring) Seal(p []byte) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	aead, ok := k.keys[k.current]
+	if !ok {
+		return nil, ErrNoKeys
+	}
+	out := make([]byte, keyIDWidth+aead.NonceSize(), keyIDWidth+aead.NonceSize()+len(p)+aead.Overhead())
+	enc.PutUint32(out, k.current)
+	nonce := out[keyIDWidth:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(out, nonce, p, out[:keyIDWidth]), nil
+}
+
+// Open decrypts data produced by Seal using the key ID stored in it
+func (k *Keyring) Open(p []byte) ([]byte, error) {
+	return k.openTo(nil, p)
+}
+
+// Opens the sealed data, appending the plaintext to dst
+func (k *Keyring) openTo(dst, p []byte) ([]byte, error) {
+	id, err := KeyID(p)
+	if err != nil {
+		return nil, err
+	}
+	k.mu.RLock()
+	aead, ok := k.keys[id]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownKeyID, id)
+	}
+	if len(p) < keyIDWidth+aead.NonceSize() {
+		return nil, ErrCiphertext
+	}
+	nonce := p[keyIDWidth : keyIDWidth+aead.NonceSize()]
+	return aead.Open(dst, nonce, p[keyIDWidth+aead.NonceSize():], p[:keyIDWidth])
+}
+
+// KeyID returns the ID of the key the sealed data was written under
+func KeyID(p []byte) (uint32, error) {
+	if len(p) < keyIDWidth {
+		return 0, ErrCiphertext
+	}
+	return enc.Uint32(p), nil
+}
+
+// ReencryptStore rewrites the sealed store file at path so every record is
+// encrypted with the keyring's current key. The rewrite goes to a temporary
+// file which then replaces the original, so a failure leaves the old file intact.
+func ReencryptStore(path string, keys *Keyring) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	// the stores' errors are returned, leaving them nothing to log
+	src, err := newEncryptedStore(f, keys, zap.NewNop())
+	if err != nil {
+		f.Close()
+		return err
+	}
+	// src is only read, so its file is closed as it is, syncing it as the
+	// store's Close does would fail on Windows
+	defer f.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".reencrypt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	dst, err := newEncryptedStore(tmp, keys, zap.NewNop())
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := copyStore(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	// the segment's index keeps the records' positions, which only hold
+	// while the new key seals records into as many bytes as the old
+	if dst.size != src.size {
+		dst.Close()
+		return fmt.Errorf("re-encrypted %s is %d bytes, not %d", path, dst.size, src.size)
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	// Windows won't rename over an open file
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Appends every record of src to dst and syncs dst to disk
+func copyStore(dst, src *store) error {
+	size := make([]byte, lenWidth)
+	for pos := uint64(0); pos < src.size; {
+		if _, err := src.ReadAt(size, int64(pos)); err != nil {
+			return err
+		}
+		n, hole := frameLen(size)
+		if hole {
+			// copied as zeros, until the next records deleted punch them
+			if err := dst.appendHole(n); err != nil {
+				return err
+			}
+			pos += lenWidth + n
+			continue
+		}
+		record, err := src.Read(pos)
+		if err != nil {
+			return err
+		}
+		if _, _, err := dst.Append(record); err != nil {
+			return err
+		}
+		pos += lenWidth + n
+	}
+	return dst.Sync()
+}
@@ -0,0 +1,133 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/bufpool"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+var (
+	key1 = bytes.Repeat([]byte{1}, 32)
+	key2 = bytes.Repeat([]byte{2}, 32)
+)
+
+func TestKeyringRotation(t *testing.T) {
+	f, err := os.CreateTemp("", "keyring_rotation_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	keys := NewKeyring()
+	require.NoError(t, keys.Add(1, key1))
+	s, err := newEncryptedStore(f, keys, zap.NewNop())
+	require.NoError(t, err)
+	_, pos1, err := s.Append(write)
+	require.NoError(t, err)
+
+	// rotate, old records must still be readable
+	require.NoError(t, keys.Add(2, key2))
+	require.Equal(t, uint32(2), keys.Current())
+	_, pos2, err := s.Append(write)
+	require.NoError(t, err)
+
+	for _, pos := range []uint64{pos1, pos2} {
+		read, err := s.Read(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+		pooled, err := s.readPooled(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, *pooled)
+		bufpool.Put(pooled)
+	}
+	require.Equal(t, []uint32{1, 2}, frameKeyIDs(t, s))
+	require.NoError(t, s.Close())
+
+	err = ReencryptStore(f.Name(), keys)
+	require.NoError(t, err)
+
+	// only the newest key is needed after re-encryption
+	newKeys := NewKeyring()
+	require.NoError(t, newKeys.Add(2, key2))
+	f, err = os.Open(f.Name())
+	require.NoError(t, err)
+	s, err = newEncryptedStore(f, newKeys, zap.NewNop())
+	require.NoError(t, err)
+	defer s.Close()
+	require.Equal(t, []uint32{2, 2}, frameKeyIDs(t, s))
+}
+
+func TestKeyringKeyIDNotHole(t *testing.T) {
+	// sealed records start with their key ID, this one's first byte once
+	// marked deleted records punched out
+	keys := NewKeyring()
+	require.NoError(t, keys.Add(0x06000001, key1))
+	c := Config{Keyring: keys}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	for range 5 {
+		_, err := l.Append(&api.Record{Value: write})
+		require.NoError(t, err)
+	}
+	info, err := InspectSegment(filepath.Join(l.Dir, "0.store"), keys, func(SegmentRecord) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), info.Statuses[RecordOK])
+	require.Zero(t, info.Statuses[RecordPunched])
+	require.NoError(t, l.Close())
+
+	// a crash has the store scanned, which finds them all
+	require.NoError(t, os.Truncate(filepath.Join(l.Dir, "0.index"), int64(c.Segment.MaxIndexBytes)))
+	l, err = NewLog(l.Dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for off := uint64(0); off < 5; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, write, record.Value)
+	}
+
+	// and rotating the key has them re-encrypted
+	require.NoError(t, keys.Add(0x06000002, key2))
+	n, err := l.Reencrypt()
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+}
+
+func TestKeyringUnknownKey(t *testing.T) {
+	keys := NewKeyring()
+	_, err := keys.Seal(write)
+	require.ErrorIs(t, err, ErrNoKeys)
+
+	require.NoError(t, keys.Add(1, key1))
+	sealed, err := keys.Seal(write)
+	require.NoError(t, err)
+
+	other := NewKeyring()
+	require.NoError(t, other.Add(2, key2))
+	_, err = other.Open(sealed)
+	require.ErrorIs(t, err, ErrUnknownKeyID)
+}
+
+// Reads the key ID out of every raw frame in the store
+func frameKeyIDs(t *testing.T, s *store) []uint32 {
+	t.Helper()
+	var ids []uint32
+	size := make([]byte, lenWidth)
+	for off := int64(0); off < int64(s.size); {
+		_, err := s.ReadAt(size, off)
+		require.NoError(t, err)
+		frame := make([]byte, enc.Uint64(size))
+		_, err = s.ReadAt(frame, off+lenWidth)
+		require.NoError(t, err)
+		id, err := KeyID(frame)
+		require.NoError(t, err)
+		ids = append(ids, id)
+		off += lenWidth + int64(len(frame))
+	}
+	return ids
+}
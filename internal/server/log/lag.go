@@ -0,0 +1,247 @@
+package log
+
+import (
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// How often the leader works out how far behind each follower is
+var lagInterval = time.Second
+
+// replicaLag is how far a follower is behind the leader's log, in entries
+// and in the age of the oldest entry it's missing
+type replicaLag struct {
+	offsets uint64
+	seconds float64
+}
+
+// lagTracker follows the highest log index each follower acknowledged,
+// which the leader's transport reports, and works out every follower's lag
+// from it
+type lagTracker struct {
+	log    *logStore
+	maxLag time.Duration
+	// labels the gauges, which the partitions' trackers share
+	partition string
+
+	mu    sync.Mutex
+	match map[raft.ServerID]uint64
+	lags  map[raft.ServerID]replicaLag
+}
+
+func newLagTracker(log *logStore, maxLag time.Duration, partition uint32) *lagTracker {
+	return &lagTracker{
+		log:       log,
+		maxLag:    maxLag,
+		partition: strconv.FormatUint(uint64(partition), 10),
+		match:     make(map[raft.ServerID]uint64),
+		lags:      make(map[raft.ServerID]replicaLag),
+	}
+}
+
+// Records that the follower holds the log up to index
+func (t *lagTracker) acked(id raft.ServerID, index uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.match[id] = max(t.match[id], index)
+}
+
+// Forgets every follower, a new leader measures them afresh
+func (t *lagTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	clear(t.match)
+	clear(t.lags)
+	t.resetGauges()
+}
+
+// Drops this partition's gauges. Callers must hold mu.
+func (t *lagTracker) resetGauges() {
+	labels := prometheus.Labels{"partition": t.partition}
+	replicationLagOffsets.DeletePartialMatch(labels)
+	replicationLagSeconds.DeletePartialMatch(labels)
+	replicationStale.DeletePartialMatch(labels)
+}
+
+// Works out the lag of every follower that has acknowledged an append.
+// Entries are stamped when stored, so a missing entry's age is how long
+// the follower has been without it.
+func (t *lagTracker) update() {
+	last, err := t.log.LastIndex()
+	if err != nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.resetGauges()
+	now := time.Now()
+	for id, match := range t.match {
+		lag := replicaLag{}
+		if match < last {
+			lag.offsets = last - match
+			lag.seconds = now.Sub(t.appendedAt(match + 1)).Seconds()
+		}
+		t.lags[id] = lag
+		replicationLagOffsets.WithLabelValues(t.partition, string(id)).Set(float64(lag.offsets))
+		replicationLagSeconds.WithLabelValues(t.partition, string(id)).Set(lag.seconds)
+		stale := 0.0
+		if t.maxLag != 0 && lag.seconds > t.maxLag.Seconds() {
+			stale = 1
+		}
+		replicationStale.WithLabelValues(t.partition, string(id)).Set(stale)
+	}
+}
+
+// When the entry at index was stored, or the oldest one still held if
+// it's been compacted. Callers must hold mu.
+func (t *lagTracker) appendedAt(index uint64) time.Time {
+	record, err := t.log.Read(index)
+	if err != nil {
+		first, ferr := t.log.FirstIndex()
+		if ferr != nil {
+			return time.Now()
+		}
+		if record, err = t.log.Read(first); err != nil {
+			return time.Now()
+		}
+	}
+	return time.Unix(0, record.Timestamp)
+}
+
+// The follower's lag, ok is false until it has acknowledged an append
+func (t *lagTracker) lag(id raft.ServerID) (lag replicaLag, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	lag, ok = t.lags[id]
+	return lag, ok
+}
+
+// Whether the follower has fallen further behind than the configured
+// maximum. Followers that haven't been measured yet aren't stale.
+func (t *lagTracker) stale(id raft.ServerID) bool {
+	if t.maxLag == 0 {
+		return false
+	}
+	lag, ok := t.lag(id)
+	return ok && lag.seconds > t.maxLag.Seconds()
+}
+
+// Whether the follower holds all the leader's log or, with a maximum lag
+// configured, is within it
+func (t *lagTracker) caughtUp(id raft.ServerID) bool {
+	lag, ok := t.lag(id)
+	if !ok {
+		return false
+	}
+	if t.maxLag == 0 {
+		return lag.offsets == 0
+	}
+	return lag.seconds <= t.maxLag.Seconds()
+}
+
+var (
+	_ raft.Transport   = (*lagTransport)(nil)
+	_ raft.WithClose   = (*lagTransport)(nil)
+	_ raft.WithPreVote = (*lagTransport)(nil)
+)
+
+// lagTransport reports to the tracker the index each successful append or
+// snapshot brings a follower up to
+type lagTransport struct {
+	*raft.NetworkTransport
+	tracker *lagTracker
+}
+
+func (t *lagTransport) AppendEntries(
+	id raft.ServerID,
+	target raft.ServerAddress,
+	args *raft.AppendEntriesRequest,
+	resp *raft.AppendEntriesResponse,
+) error {
+	err := t.NetworkTransport.AppendEntries(id, target, args, resp)
+	if err == nil {
+		t.appended(id, args, resp)
+	}
+	return err
+}
+
+func (t *lagTransport) appended(id raft.ServerID, args *raft.AppendEntriesRequest, resp *raft.AppendEntriesResponse) {
+	// heartbeats carry no entries and no previous index, so they say
+	// nothing about how far the follower is
+	if !resp.Success || (args.PrevLogEntry == 0 && len(args.Entries) == 0) {
+		return
+	}
+	t.tracker.acked(id, args.PrevLogEntry+uint64(len(args.Entries)))
+}
+
+func (t *lagTransport) InstallSnapshot(
+	id raft.ServerID,
+	target raft.ServerAddress,
+	args *raft.InstallSnapshotRequest,
+	resp *raft.InstallSnapshotResponse,
+	data io.Reader,
+) error {
+	err := t.NetworkTransport.InstallSnapshot(id, target, args, resp, data)
+	if err == nil && resp.Success {
+		t.tracker.acked(id, args.LastLogIndex)
+	}
+	return err
+}
+
+func (t *lagTransport) AppendEntriesPipeline(id raft.ServerID, target raft.ServerAddress) (raft.AppendPipeline, error) {
+	p, err := t.NetworkTransport.AppendEntriesPipeline(id, target)
+	if err != nil {
+		return nil, err
+	}
+	lp := &lagPipeline{
+		AppendPipeline: p,
+		transport:      t,
+		id:             id,
+		responses:      make(chan raft.AppendFuture),
+		done:           make(chan struct{}),
+	}
+	go lp.run()
+	return lp, nil
+}
+
+// lagPipeline passes on the pipeline's responses, reporting the successful ones
+type lagPipeline struct {
+	raft.AppendPipeline
+	transport *lagTransport
+	id        raft.ServerID
+	responses chan raft.AppendFuture
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (p *lagPipeline) run() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case f := <-p.AppendPipeline.Consumer():
+			if f.Error() == nil {
+				p.transport.appended(p.id, f.Request(), f.Response())
+			}
+			select {
+			case p.responses <- f:
+			case <-p.done:
+				return
+			}
+		}
+	}
+}
+
+func (p *lagPipeline) Consumer() <-chan raft.AppendFuture {
+	return p.responses
+}
+
+func (p *lagPipeline) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	return p.AppendPipeline.Close()
+}
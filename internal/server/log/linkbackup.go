@@ -0,0 +1,265 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// LinkBackup backs the log up into dir, a new directory on the log's
+// filesystem, consistent as of when it's called. The sealed segments'
+// files are hard linked rather than copied, only the active segment and
+// the files beside the segments are, so it takes about as long however
+// much the log holds. A segment changed in place later, truncated say, is
+// copied over itself first, leaving the backup's link as it was, and
+// records deleted meanwhile aren't punched out of its store while one
+// shares it. The backup's made beside dir then renamed, so one that fails
+// doesn't look whole, and its manifest is BackupManifestName in it. It's
+// restored with RestoreLinked.
+func (l *Log) LinkBackup(dir string) (*BackupManifest, error) {
+	return linkBackup(l.Dir, dir, func(b *backup) error { return b.addLog(l) })
+}
+
+// LinkBackup backs the topics' logs and descriptions up into dir, relative
+// to the data directory, see Log.LinkBackup
+func (t *Topics) LinkBackup(dir string) (*BackupManifest, error) {
+	return linkBackup(t.dir, dir, t.addTo)
+}
+
+// LinkBackup backs this server's replica of the log, its raft log and
+// latest snapshot up into dir, see Log.LinkBackup
+func (l *DistributedLog) LinkBackup(dir string) (*BackupManifest, error) {
+	return linkBackup(filepath.Dir(l.log.Dir), dir, func(b *backup) error { return b.addDistributed(l) })
+}
+
+// LinkBackup backs this server's replicas of the partitions and the
+// topics' groups up into dir, relative to the data directory, see
+// DistributedLog.LinkBackup
+func (l *PartitionedLog) LinkBackup(dir string) (*BackupManifest, error) {
+	return linkBackup(l.dataDir(), dir, l.addTo)
+}
+
+// Backs the files add adds, relative to root, up into dir
+func linkBackup(root, dir string, add func(*backup) error) (*BackupManifest, error) {
+	if _, err := os.Stat(dir); err == nil {
+		return nil, fmt.Errorf("link backup %s: %w", dir, fs.ErrExist)
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	tmp := dir + ".tmp"
+	if err := os.RemoveAll(tmp); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return nil, err
+	}
+	b := newBackup(root)
+	b.linkDir = tmp
+	b.manifest.Files = make(map[string]int64)
+	defer b.close()
+	manifest, err := func() (*BackupManifest, error) {
+		if err := add(b); err != nil {
+			return nil, err
+		}
+		return b.writeDir()
+	}()
+	if err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	return manifest, syncDir(filepath.Dir(dir))
+}
+
+// Links the sealed segment's files into the backup, synced first so the
+// links hold what the manifest says after a crash. Callers must hold the
+// segment's log's lock, so it isn't changed meanwhile.
+func (b *backup) linkSegment(s *segment) error {
+	if err := s.Sync(); err != nil {
+		return err
+	}
+	if err := b.link(s.store.Name(), int64(s.store.size)); err != nil {
+		return err
+	}
+	return b.link(s.index.Name(), int64(s.index.size))
+}
+
+// Links the file, of which size bytes are backed up, into the backup
+func (b *backup) link(path string, size int64) error {
+	name, err := b.rel(path)
+	if err != nil {
+		return err
+	}
+	dst := filepath.Join(b.linkDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(path, dst); err != nil {
+		return err
+	}
+	b.manifest.Files[name] = size
+	return nil
+}
+
+// Copies the files that weren't linked into the backup's directory and
+// writes its manifest, syncing them all
+func (b *backup) writeDir() (*BackupManifest, error) {
+	for _, f := range b.files {
+		dst := filepath.Join(b.linkDir, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return nil, err
+		}
+		if err := writeFileFrom(dst, io.NewSectionReader(f.file, 0, f.size), f.size); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.name, err)
+		}
+		b.manifest.Files[f.name] = f.size
+	}
+	p, err := json.MarshalIndent(b.manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileFrom(filepath.Join(b.linkDir, BackupManifestName), bytes.NewReader(p), int64(len(p))); err != nil {
+		return nil, err
+	}
+	// the links and copies are entries of the directories they're in
+	err = filepath.WalkDir(b.linkDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+		return syncDir(path)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &b.manifest, nil
+}
+
+// Writes size bytes from r to a new file at path and syncs it, failing if
+// r has fewer
+func writeFileFrom(path string, r io.Reader, size int64) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, size))
+	if err == nil && n < size {
+		err = fmt.Errorf("truncated at %d of %d bytes", n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Syncs the directory's entries, where the filesystem can
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Windows can't sync a directory
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) && !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+	return nil
+}
+
+// RestoreLinked restores the backup LinkBackup made in src into dir, as
+// Restore does a tar's. The files are copied as far as they were backed
+// up, so the restored log shares none with the backup, which can be
+// restored again.
+func RestoreLinked(src, dir string, opts RestoreOptions) (*RestoreReport, error) {
+	return restore(dir, opts, func() (*RestoreReport, error) {
+		return copyLinked(src, dir)
+	})
+}
+
+// Copies the link backup's files into dir
+func copyLinked(src, dir string) (*RestoreReport, error) {
+	b, err := os.ReadFile(filepath.Join(src, BackupManifestName))
+	if err != nil {
+		return nil, err
+	}
+	report := &RestoreReport{Manifest: &BackupManifest{}}
+	if err := json.Unmarshal(b, report.Manifest); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", BackupManifestName, err)
+	}
+	if report.Manifest.Format > FormatVersion {
+		return nil, fmt.Errorf("backup is in format version %d, newer than this build's %d: %w", report.Manifest.Format, FormatVersion, ErrFormat)
+	}
+	if report.Manifest.Files == nil {
+		return nil, fmt.Errorf("%s isn't a link backup's", BackupManifestName)
+	}
+	for name, size := range report.Manifest.Files {
+		path := filepath.FromSlash(name)
+		if !filepath.IsLocal(path) || name == BackupManifestName {
+			return nil, fmt.Errorf("backup has an unexpected file %q", name)
+		}
+		f, err := os.Open(filepath.Join(src, path))
+		if err != nil {
+			return nil, err
+		}
+		dst := filepath.Join(dir, path)
+		err = os.MkdirAll(filepath.Dir(dst), 0755)
+		if err == nil {
+			err = writeFileFrom(dst, f, size)
+		}
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		report.Files++
+		report.Bytes += size
+	}
+	return report, nil
+}
+
+// shared reports whether a link backup shares the segment's files
+func (s *segment) shared() (bool, error) {
+	for _, name := range []string{s.store.Name(), s.index.Name()} {
+		n, err := links(name)
+		if err != nil || n > 1 {
+			return n > 1, err
+		}
+	}
+	return false, nil
+}
+
+// Copies the segment's files over themselves when a link backup shares
+// them, before they're changed in place, and reopens it. Callers must
+// hold mu.
+func (l *Log) unshare(i int) error {
+	s := l.segments[i]
+	if shared, err := s.shared(); err != nil || !shared {
+		return err
+	}
+	dir := filepath.Join(l.Dir, "rewrite")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	return l.reopenSegment(i, func(s *segment) error {
+		for _, name := range []string{s.store.Name(), s.index.Name()} {
+			tmp := filepath.Join(dir, filepath.Base(name))
+			if err := copyFile(name, tmp); err != nil {
+				return err
+			}
+			if err := os.Rename(tmp, name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,133 @@
+package log
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkBackup(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := range 8 {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "backup")
+	manifest, err := l.LinkBackup(dir)
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), manifest.Logs[0].NextOffset)
+	require.Len(t, manifest.Logs[0].Segments, 3)
+	// the sealed segments are linked, the active one copied
+	for name, want := range map[string]uint64{"0.store": 2, "3.index": 2, "6.store": 1} {
+		n, err := links(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, want, n, name)
+	}
+	_, err = l.LinkBackup(dir)
+	require.ErrorIs(t, err, fs.ErrExist)
+	stored, err := os.ReadFile(filepath.Join(dir, "3.store"))
+	require.NoError(t, err)
+
+	// truncating a linked segment copies it first, leaving the backup's
+	_, err = l.Append(&api.Record{Value: []byte("record 8")})
+	require.NoError(t, err)
+	require.NoError(t, l.TruncateFrom(4))
+	n, err := links(filepath.Join(dir, "3.store"))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), n)
+	b, err := os.ReadFile(filepath.Join(dir, "3.store"))
+	require.NoError(t, err)
+	require.Equal(t, stored, b)
+	_, err = l.Read(4)
+	require.Error(t, err)
+
+	restored := t.TempDir()
+	report, err := RestoreLinked(dir, restored, RestoreOptions{})
+	require.NoError(t, err)
+	require.Equal(t, len(manifest.Files), report.Files)
+	rl, err := NewLog(restored, Config{})
+	require.NoError(t, err)
+	defer rl.Close()
+	for off := range uint64(8) {
+		record, err := rl.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(record.Value))
+	}
+	_, err = rl.Read(8)
+	require.Error(t, err)
+
+	// an empty directory is no link backup
+	_, err = RestoreLinked(t.TempDir(), t.TempDir(), RestoreOptions{})
+	require.Error(t, err)
+}
+
+func TestLinkBackupRepair(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	dir := t.TempDir()
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := range 4 {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+	store := filepath.Join(dir, "0.store")
+	fi, err := os.Stat(store)
+	require.NoError(t, err)
+	// links the sealed segment's store to a backup and tears a record
+	// after its last, in both
+	tear := func() string {
+		l, err := NewLog(dir, c)
+		require.NoError(t, err)
+		backup := filepath.Join(t.TempDir(), "backup")
+		_, err = l.LinkBackup(backup)
+		require.NoError(t, err)
+		require.NoError(t, l.Close())
+		f, err := os.OpenFile(store, os.O_WRONLY|os.O_APPEND, 0)
+		require.NoError(t, err)
+		_, err = f.Write([]byte{0, 0, 0})
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+		return filepath.Join(backup, "0.store")
+	}
+	// the repaired store is a copy cut off, the backup's is left as it was
+	requireRepaired := func(linked string) {
+		n, err := links(store)
+		require.NoError(t, err)
+		require.Equal(t, uint64(1), n)
+		repaired, err := os.Stat(store)
+		require.NoError(t, err)
+		require.Equal(t, fi.Size(), repaired.Size())
+		backedUp, err := os.Stat(linked)
+		require.NoError(t, err)
+		require.Equal(t, fi.Size()+3, backedUp.Size())
+	}
+
+	linked := tear()
+	report, err := Verify(dir, VerifyOptions{Repair: true})
+	require.NoError(t, err)
+	require.Len(t, report.Problems, 1)
+	requireRepaired(linked)
+
+	linked = tear()
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	requireRepaired(linked)
+	for off := uint64(0); off < 4; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(record.Value))
+	}
+}
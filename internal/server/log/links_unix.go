@@ -0,0 +1,14 @@
+//go:build unix
+
+package log
+
+import "golang.org/x/sys/unix"
+
+// The names the file has, more than one once a link backup shares it
+func links(name string) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(name, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Nlink), nil
+}
@@ -0,0 +1,771 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/bufpool"
+	"google.golang.org/protobuf/proto"
+)
+
+// Log—an ordered list of segments, appends go to the last (active) one
+type Log struct {
+	mu sync.RWMutex
+
+	Dir    string
+	Config Config
+
+	activeSegment *segment
+	segments      []*segment
+	// sealed are the sealed segments, by base offset, read without mu
+	sealed atomic.Pointer[[]*segment]
+	// holds the sealed segments archived to the tier, nil without one
+	archive *archive
+	// start is the offset the records before were deleted, though the
+	// first segment holds some of them, see DeleteRecords
+	start uint64
+
+	// checksums of whole ranges, which appends leave alone
+	sumsMu sync.Mutex
+	sums   map[sumRange]uint32
+	// sessions answers Checksums callers with what changed since they last asked
+	sessions checksumSessions
+	// offsets are what consumers committed, see CommitOffset
+	offsets consumerOffsets
+	// commits shares fsyncs between appends synced on append
+	commits *groupCommit
+	// compaction is how the log's compactions went, see CompactionStats
+	compaction compaction
+}
+
+func NewLog(dir string, c Config) (*Log, error) {
+	if c.Segment.MaxStoreBytes == 0 {
+		c.Segment.MaxStoreBytes = 1024
+	}
+	if c.Segment.MaxIndexBytes == 0 {
+		c.Segment.MaxIndexBytes = 1024
+	}
+	l := &Log{
+		Dir:     dir,
+		Config:  c,
+		commits: newGroupCommit(),
+	}
+	if err := l.setup(); err != nil {
+		return nil, err
+	}
+	if err := l.loadOffsets(); err != nil {
+		return nil, err
+	}
+	openLogs.add(l)
+	return l, nil
+}
+
+// Recreates the segments already on disk, or the first one for a new log
+func (l *Log) setup() error {
+	if err := os.MkdirAll(l.Dir, 0755); err != nil {
+		return err
+	}
+	if err := l.checkFormat(); err != nil {
+		return err
+	}
+	files, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return err
+	}
+	var baseOffsets []uint64
+	for _, file := range files {
+		ext := filepath.Ext(file.Name())
+		if ext != ".store" && ext != ".index" {
+			continue
+		}
+		off, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ext), 10, 0)
+		if err != nil {
+			continue
+		}
+		baseOffsets = append(baseOffsets, off)
+	}
+	sort.Slice(baseOffsets, func(i, j int) bool {
+		return baseOffsets[i] < baseOffsets[j]
+	})
+	// baseOffsets holds each offset twice, once for the index and once for the store
+	baseOffsets = slices.Compact(baseOffsets)
+	baseOffsets, next, err := l.recoverSegments(baseOffsets)
+	if err != nil {
+		return err
+	}
+	for _, off := range baseOffsets {
+		if err = l.newSegment(off); err != nil {
+			return err
+		}
+	}
+	if l.segments == nil {
+		if err = l.newSegment(max(next, l.Config.Segment.InitialOffset)); err != nil {
+			return err
+		}
+	}
+	if err = l.loadStart(); err != nil {
+		return err
+	}
+	if l.Config.Tier.Store != nil {
+		if l.archive, err = newArchive(l.Dir, l.Config); err != nil {
+			return err
+		}
+		go l.runArchive(l.archive)
+	}
+	return nil
+}
+
+// Append adds the record to the log, stamping it with the append time if it has none
+func (l *Log) Append(record *api.Record) (uint64, error) {
+	start := time.Now()
+	l.mu.Lock()
+	off, batch, err := l.append(record, start, l.Config.SyncOnAppend)
+	l.mu.Unlock()
+	return l.commit(off, batch, err, start)
+}
+
+// AppendDurable appends the record as Append does but returns once it's
+// written, whether or not the log syncs on append, and calls durable from
+// a goroutine of its own once it's synced, with the sync's error
+func (l *Log) AppendDurable(record *api.Record, durable func(error)) (uint64, error) {
+	offs, err := l.AppendBatchDurable([]*api.Record{record}, durable)
+	if err != nil {
+		return 0, err
+	}
+	return offs[0], nil
+}
+
+// AppendBatchDurable appends the records as AppendBatch does, and calls
+// durable once they're synced as AppendDurable does. durable isn't called
+// when it fails.
+func (l *Log) AppendBatchDurable(records []*api.Record, durable func(error)) ([]uint64, error) {
+	start := time.Now()
+	offs, batch, err := l.appendRecords(records, start, true)
+	if err != nil {
+		return nil, err
+	}
+	appendDuration.Observe(time.Since(start).Seconds())
+	if batch == nil {
+		// synced as the log rolled over
+		go durable(nil)
+		return offs, nil
+	}
+	l.commits.notify(batch, l.Config.SyncWindow, l.syncBatch, durable)
+	return offs, nil
+}
+
+// Appends to the active segment, callers must hold mu. An append synced
+// returns the batch it's synced with, see commit.
+func (l *Log) append(record *api.Record, start time.Time, sync bool) (uint64, *commitBatch, error) {
+	if record.Timestamp == 0 {
+		record.Timestamp = start.UnixNano()
+	}
+	off, err := l.activeSegment.Append(record)
+	if err != nil {
+		expErrors.Add(1)
+		return 0, nil, err
+	}
+	batch, err := l.appended(off, sync)
+	recordsAppended.Inc()
+	bytesAppended.Add(float64(len(record.Value)))
+	expAppends.Add(1)
+	return off, batch, err
+}
+
+// AppendBatch appends the records in order, stamping those with no append
+// time, and returns their offsets. A log that batches, see Config.Batch,
+// stores them as one batch, or one per segment they span.
+func (l *Log) AppendBatch(records []*api.Record) ([]uint64, error) {
+	start := time.Now()
+	offs, batch, err := l.appendRecords(records, start, l.Config.SyncOnAppend)
+	// the last batch's sync covers the appends before it, those in other
+	// segments were synced as the log rolled over
+	if _, err := l.commit(0, batch, err, start); err != nil {
+		return nil, err
+	}
+	return offs, nil
+}
+
+// Appends the records in order, returning their offsets and, synced, the
+// commit batch the last of them is synced with
+func (l *Log) appendRecords(records []*api.Record, start time.Time, sync bool) ([]uint64, *commitBatch, error) {
+	offs := make([]uint64, 0, len(records))
+	var batch *commitBatch
+	var err error
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(records) > 0 && err == nil {
+		n, off := 1, uint64(0)
+		if l.Config.Batch.Enabled {
+			n, off, batch, err = l.appendBatch(records, start, sync)
+		} else {
+			off, batch, err = l.append(records[0], start, sync)
+		}
+		if err == nil {
+			for i := range n {
+				offs = append(offs, off-uint64(n-1-i))
+			}
+		}
+		records = records[n:]
+	}
+	return offs, batch, err
+}
+
+// Appends as many of the records as the active segment's index has room
+// for as a batch, callers must hold mu. Returns how many it appended, the
+// last's offset and the batch they're synced with, as append does.
+func (l *Log) appendBatch(records []*api.Record, start time.Time, sync bool) (int, uint64, *commitBatch, error) {
+	records = records[:max(min(len(records), l.activeSegment.room()), 1)]
+	bytes := 0
+	for _, record := range records {
+		if record.Timestamp == 0 {
+			record.Timestamp = start.UnixNano()
+		}
+		bytes += len(record.Value)
+	}
+	off, err := l.activeSegment.appendBatch(records, l.Config.Batch.Codec)
+	if err != nil {
+		expErrors.Add(1)
+		return 0, 0, nil, err
+	}
+	batch, err := l.appended(off, sync)
+	recordsAppended.Add(float64(len(records)))
+	bytesAppended.Add(float64(bytes))
+	expAppends.Add(int64(len(records)))
+	return len(records), off, batch, err
+}
+
+// Syncs or joins the commit batch after an append to the active segment
+// up to off if it's synced, and rolls the log over once the segment's
+// full, callers must hold mu
+func (l *Log) appended(off uint64, sync bool) (*commitBatch, error) {
+	var batch *commitBatch
+	var err error
+	if sync && l.activeSegment.IsMaxed() {
+		// left behind by the batch's sync, which only syncs the active segment
+		if err = l.activeSegment.Sync(); err != nil {
+			expErrors.Add(1)
+			return nil, err
+		}
+	} else if sync {
+		batch = l.commits.join()
+	}
+	if l.activeSegment.IsMaxed() {
+		if err = l.newSegment(off + 1); err != nil {
+			expErrors.Add(1)
+		} else if l.archive != nil {
+			l.archive.notify()
+		}
+	}
+	return batch, err
+}
+
+// Waits, without mu, for the append's batch to be synced if it has one,
+// sharing the fsync with the appends made alongside it, see groupCommit
+func (l *Log) commit(off uint64, batch *commitBatch, err error, start time.Time) (uint64, error) {
+	if err != nil {
+		return off, err
+	}
+	if batch != nil {
+		if err := l.commits.wait(batch, l.Config.SyncWindow, l.syncBatch); err != nil {
+			expErrors.Add(1)
+			return 0, err
+		}
+	}
+	appendDuration.Observe(time.Since(start).Seconds())
+	return off, nil
+}
+
+// Appends the record at its own offset, which may skip the offsets a
+// compacted log no longer holds but can't go back
+func (l *Log) appendAt(record *api.Record) (uint64, error) {
+	start := time.Now()
+	l.mu.Lock()
+	if next := l.activeSegment.nextOffset; record.Offset < next {
+		l.mu.Unlock()
+		return 0, fmt.Errorf("appending record at offset %d, the log is at %d", record.Offset, next)
+	}
+	l.activeSegment.nextOffset = record.Offset
+	off, batch, err := l.append(record, start, l.Config.SyncOnAppend)
+	l.mu.Unlock()
+	return l.commit(off, batch, err, start)
+}
+
+// Read returns the record at off, from the local segments or, for one
+// they no longer hold, from the archive
+func (l *Log) Read(off uint64) (*api.Record, error) {
+	var record *api.Record
+	err := l.read(off, func(s *segment) (int, error) {
+		var err error
+		record, err = s.Read(off)
+		return len(record.GetValue()), err
+	}, func(fetched *api.Record) error {
+		record = fetched
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// ReadTo is Read's without the garbage, for consumers reading many records:
+// it reads the record at off into record, its value, key and headers'
+// values slices of dst, which is grown only if it's too short and returned
+// as sliced. The two are overwritten by the next ReadTo into them, callers
+// that keep the record copy it.
+func (l *Log) ReadTo(off uint64, dst []byte, record *api.Record) ([]byte, error) {
+	err := l.read(off, func(s *segment) (int, error) {
+		var err error
+		dst, err = s.readTo(off, dst, record)
+		return len(record.Value), err
+	}, func(fetched *api.Record) error {
+		proto.Reset(record)
+		proto.Merge(record, fetched)
+		return nil
+	})
+	return dst, err
+}
+
+// ReadMarshaled returns the record at off marshaled, as it's stored, with
+// its offset, for servers sending records on without decoding them. The
+// buffer is from bufpool, the caller's to Put once it's done with it.
+func (l *Log) ReadMarshaled(off uint64) (*[]byte, uint64, error) {
+	var p *[]byte
+	var at uint64
+	err := l.read(off, func(s *segment) (int, error) {
+		var err error
+		var n int
+		if p, err = s.readMarshaled(off); err != nil {
+			return 0, err
+		}
+		if at, n, err = scanRecord(*p); err != nil {
+			bufpool.Put(p)
+		}
+		return n, err
+	}, func(fetched *api.Record) error {
+		p, at = bufpool.Get(proto.Size(fetched)), fetched.Offset
+		var err error
+		if *p, err = (proto.MarshalOptions{}).MarshalAppend((*p)[:0], fetched); err != nil {
+			bufpool.Put(p)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return p, at, nil
+}
+
+// Reads the record at off either with read, from the segment holding it,
+// which returns the bytes of its value, or from the archive, calling
+// fetched with what it fetched
+func (l *Log) read(off uint64, read func(*segment) (int, error), fetched func(*api.Record) error) error {
+	n, ok, err := l.readSealed(off, read)
+	if !ok {
+		n, err = l.readActive(off, read, fetched)
+	}
+	// checked only on errors, As's target is allocated
+	if err != nil && errors.As(err, &api.ErrOffsetOutOfRange{}) {
+		readErrors.WithLabelValues(readErrorOutOfRange).Inc()
+		return err
+	}
+	if err != nil {
+		readErrors.WithLabelValues(readErrorOther).Inc()
+		expErrors.Add(1)
+		return err
+	}
+	recordsRead.Inc()
+	expReads.Add(1)
+	bytesRead.Add(float64(n))
+	return nil
+}
+
+// Reads the record at off from a sealed segment, without locks, reporting
+// whether one holds it
+func (l *Log) readSealed(off uint64, read func(*segment) (int, error)) (int, bool, error) {
+	sealed := l.sealed.Load()
+	if sealed == nil {
+		return 0, false, nil
+	}
+	segments := *sealed
+	i := sort.Search(len(segments), func(i int) bool {
+		return segments[i].nextOffset > off
+	})
+	if i == len(segments) || segments[i].baseOffset > off {
+		return 0, false, nil
+	}
+	s := segments[i]
+	// unsealed since, it's read under mu
+	if !s.acquire() {
+		return 0, false, nil
+	}
+	defer s.release()
+	n, err := read(s)
+	return n, true, err
+}
+
+// Reads the record at off under mu, from the active segment or one sealed
+// since readSealed looked, or from the archive
+func (l *Log) readActive(off uint64, read func(*segment) (int, error), fetched func(*api.Record) error) (int, error) {
+	l.mu.RLock()
+	s := l.segmentFor(off)
+	var n int
+	var err error
+	if s != nil {
+		n, err = read(s)
+	}
+	l.mu.RUnlock()
+	if s == nil && l.archive != nil {
+		// fetched without the log's lock, appends carry on meanwhile
+		var record *api.Record
+		if record, err = l.archive.read(off); err == nil {
+			err, n = fetched(record), len(record.Value)
+		}
+	} else if s == nil {
+		err = api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return n, err
+}
+
+// Publishes the sealed segments for readSealed, callers must hold mu
+func (l *Log) publishSealed() {
+	var sealed []*segment
+	for _, s := range l.segments {
+		if s.sealed() {
+			sealed = append(sealed, s)
+		}
+	}
+	l.sealed.Store(&sealed)
+}
+
+// Tail reports whether the record at off is in the active segment, which
+// the latest appends went to, rather than one sealed before it or archived
+func (l *Log) Tail(off uint64) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.activeSegment != nil && off >= l.activeSegment.baseOffset
+}
+
+// SyncOnAppend reports whether appends are fsynced before they return
+func (l *Log) SyncOnAppend() bool {
+	return l.Config.SyncOnAppend
+}
+
+func (l *Log) Close() error {
+	// the archiving loop takes the lock, so it's stopped first
+	if l.archive != nil {
+		l.archive.close()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	openLogs.remove(l)
+	for _, segment := range l.segments {
+		if err := segment.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove closes the log and deletes its data, archived segments included
+func (l *Log) Remove() error {
+	if err := l.Close(); err != nil {
+		return err
+	}
+	if l.archive != nil {
+		if err := l.archive.removeAll(context.Background()); err != nil {
+			return err
+		}
+	}
+	return os.RemoveAll(l.Dir)
+}
+
+// Reset removes the log and starts a new empty one in its place
+func (l *Log) Reset() error {
+	if err := l.Remove(); err != nil {
+		return err
+	}
+	l.segments, l.activeSegment, l.archive = nil, nil, nil
+	l.forgetSums(0, math.MaxUint64)
+	if err := l.setup(); err != nil {
+		return err
+	}
+	if err := l.keepOffsets(); err != nil {
+		return err
+	}
+	openLogs.add(l)
+	return nil
+}
+
+func (l *Log) LowestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return max(l.segments[0].baseOffset, l.start), nil
+}
+
+func (l *Log) HighestOffset() (uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	off := l.segments[len(l.segments)-1].nextOffset
+	if off == 0 {
+		return 0, nil
+	}
+	return off - 1, nil
+}
+
+// Truncate removes every segment whose records are all at or below lowest
+func (l *Log) Truncate(lowest uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var segments []*segment
+	for _, s := range l.segments {
+		if s.nextOffset <= lowest+1 && s != l.activeSegment {
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			continue
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	if l.start > segments[0].baseOffset {
+		segments[0].deleteBefore(l.start)
+	}
+	l.publishSealed()
+	l.forgetSums(0, segments[0].baseOffset)
+	return nil
+}
+
+// DeleteRecords removes the records before offset, returning the lowest
+// offset left. The segments holding only those are removed, and the rest
+// of them in the first segment left are no longer read, their bytes
+// punched out of its store where the filesystem can, so the disk's
+// reclaimed before the whole segment can be removed. The active segment
+// keeps its records.
+func (l *Log) DeleteRecords(before uint64) (uint64, error) {
+	if before > 0 {
+		if err := l.Truncate(before - 1); err != nil {
+			return 0, err
+		}
+		if err := l.deleteBefore(before); err != nil {
+			return 0, err
+		}
+	}
+	return l.Stats().LowWatermark, nil
+}
+
+// TruncateFrom removes the record at off and every one after it, so the
+// next append gets off again. Raft uses it to drop conflicting entries.
+func (l *Log) TruncateFrom(off uint64) error {
+	l.mu.RLock()
+	deleted := off > l.segments[0].baseOffset && off <= l.start
+	l.mu.RUnlock()
+	if deleted {
+		// the records before off were deleted and the rest go, the log's
+		// empty from off
+		return l.resetAt(off)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// the segments truncated, or appended to again, stop sharing their
+	// files with link backups first
+	for i, s := range l.segments {
+		if s.nextOffset >= off && (s.baseOffset < off || i == 0) {
+			if err := l.unshare(i); err != nil {
+				return err
+			}
+		}
+	}
+	var segments []*segment
+	for _, s := range l.segments {
+		if s.baseOffset >= off && s.baseOffset > l.segments[0].baseOffset {
+			if err := s.Remove(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.truncateFrom(off); err != nil {
+			return err
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	l.activeSegment = segments[len(segments)-1]
+	// appended to again
+	l.activeSegment.unseal()
+	l.publishSealed()
+	l.forgetSums(off, math.MaxUint64)
+	if l.activeSegment.IsMaxed() {
+		return l.newSegment(l.activeSegment.nextOffset)
+	}
+	return nil
+}
+
+// Reader returns the stores' contents, oldest first, as they are now: each
+// record length prefixed, and sealed if the log is encrypted. The first
+// store's deleted records are left out where it can.
+func (l *Log) Reader() io.Reader {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	readers := make([]io.Reader, len(l.segments))
+	for i, segment := range l.segments {
+		var from uint64
+		if i == 0 {
+			// punched out or not, the records read as they were
+			from, _ = segment.livePos()
+		}
+		readers[i] = io.NewSectionReader(segment.store, int64(from), int64(segment.store.size-from))
+	}
+	return io.MultiReader(readers...)
+}
+
+// resetAt empties the log so the next append gets off
+func (l *Log) resetAt(off uint64) error {
+	l.Config.Segment.InitialOffset = off
+	return l.Reset()
+}
+
+// Rolls the log over to a new active segment at off, sealing the last
+func (l *Log) newSegment(off uint64) error {
+	if l.activeSegment != nil {
+		if err := l.activeSegment.seal(); err != nil {
+			return err
+		}
+	}
+	s, err := newSegment(l.Dir, off, l.Config)
+	if err != nil {
+		return err
+	}
+	l.segments = append(l.segments, s)
+	l.activeSegment = s
+	l.publishSealed()
+	return nil
+}
+
+// Stats is a point in time view of the log's size and offsets
+type Stats struct {
+	// Bytes written to the stores and indexes
+	Bytes    uint64 `json:"bytes"`
+	Segments int    `json:"segments"`
+	// ActiveSegmentFill is how full the active segment is, from 0 to 1
+	ActiveSegmentFill float64 `json:"active_segment_fill"`
+	// LowWatermark is the lowest offset held, HighWatermark the offset the next record gets
+	LowWatermark  uint64 `json:"low_watermark"`
+	HighWatermark uint64 `json:"high_watermark"`
+	// OldestRecord is the append time of the record at LowWatermark, zero for an empty log
+	OldestRecord time.Time `json:"oldest_record"`
+	// ArchivedSegments are held in the tier, some may be on local disk too
+	ArchivedSegments int `json:"archived_segments"`
+}
+
+// Closes the i'th segment for rewrite to change its files, then reopens it
+// as it was, sealed or active, even when rewrite fails. Callers must hold
+// mu.
+func (l *Log) reopenSegment(i int, rewrite func(s *segment) error) error {
+	s := l.segments[i]
+	sealed := s.sealed()
+	if err := s.Close(); err != nil {
+		return err
+	}
+	err := rewrite(s)
+	reopened, oerr := newSegment(l.Dir, s.baseOffset, l.Config)
+	if oerr != nil {
+		return errors.Join(err, oerr)
+	}
+	reopened.start.Store(s.start.Load())
+	if sealed {
+		if oerr := reopened.seal(); oerr != nil {
+			return errors.Join(err, oerr)
+		}
+	}
+	if s == l.activeSegment {
+		l.activeSegment = reopened
+	}
+	l.segments[i] = reopened
+	l.publishSealed()
+	return err
+}
+
+func (l *Log) Stats() Stats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	st := Stats{
+		Segments:      len(l.segments),
+		LowWatermark:  max(l.segments[0].baseOffset, l.start),
+		HighWatermark: l.activeSegment.nextOffset,
+	}
+	for _, s := range l.segments {
+		st.Bytes += s.store.size + s.index.size
+	}
+	c := l.Config.Segment
+	st.ActiveSegmentFill = max(
+		float64(l.activeSegment.store.size)/float64(c.MaxStoreBytes),
+		float64(l.activeSegment.index.size)/float64(c.MaxIndexBytes),
+	)
+	if l.archive != nil {
+		st.ArchivedSegments = l.archive.count()
+	}
+	if first := l.segments[0]; first.nextOffset > st.LowWatermark {
+		if record, err := first.Read(st.LowWatermark); err == nil && record.Timestamp != 0 {
+			st.OldestRecord = time.Unix(0, record.Timestamp)
+		}
+	}
+	return st
+}
+
+// The bytes written to the log's stores and indexes, Stats' Bytes
+func (l *Log) size() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	var n uint64
+	for _, s := range l.segments {
+		n += s.store.size + s.index.size
+	}
+	return n
+}
+
+// SegmentStats describes one segment and its store's write buffer
+type SegmentStats struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+	StoreBytes uint64 `json:"store_bytes"`
+	IndexBytes uint64 `json:"index_bytes"`
+	// Buffered bytes are appended but not yet flushed to the store file
+	Buffered  int       `json:"buffered"`
+	Flushes   uint64    `json:"flushes"`
+	LastFlush time.Time `json:"last_flush"`
+}
+
+// SegmentStats lists the log's segments, oldest first
+func (l *Log) SegmentStats() []SegmentStats {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	stats := make([]SegmentStats, 0, len(l.segments))
+	for _, s := range l.segments {
+		buffered, flushes, lastFlush := s.store.bufferStats()
+		stats = append(stats, SegmentStats{
+			BaseOffset: s.baseOffset,
+			NextOffset: s.nextOffset,
+			StoreBytes: s.store.size,
+			IndexBytes: s.index.size,
+			Buffered:   buffered,
+			Flushes:    flushes,
+			LastFlush:  lastFlush,
+		})
+	}
+	return stats
+}
@@ -0,0 +1,301 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLog(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T, log *Log,
+	){
+		"append and read a record succeeds": testAppendRead,
+		"offset out of range error":         testOutOfRangeErr,
+		"init with existing segments":       testInitExisting,
+		"reader":                            testReader,
+		"truncate":                          testTruncate,
+		"reset":                             testReset,
+		"stats":                             testStats,
+		"committed offsets":                 testOffsets,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, err := os.MkdirTemp("", "store-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 32
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			fn(t, log)
+		})
+	}
+}
+
+func testAppendRead(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	read, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+	require.NotZero(t, read.Timestamp)
+	require.NoError(t, log.Close())
+}
+
+func testOutOfRangeErr(t *testing.T, log *Log) {
+	read, err := log.Read(1)
+	require.Nil(t, read)
+	apiErr := err.(api.ErrOffsetOutOfRange)
+	require.Equal(t, uint64(1), apiErr.Offset)
+	require.NoError(t, log.Close())
+}
+
+func testInitExisting(t *testing.T, o *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := o.Append(append)
+		require.NoError(t, err)
+	}
+	require.NoError(t, o.Close())
+
+	off, err := o.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	off, err = o.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	n, err := NewLog(o.Dir, o.Config)
+	require.NoError(t, err)
+
+	off, err = n.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	off, err = n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.NoError(t, n.Close())
+}
+
+func testReader(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	reader := log.Reader()
+	b, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	read := &api.Record{}
+	err = proto.Unmarshal(b[lenWidth:], read)
+	require.NoError(t, err)
+	require.Equal(t, append.Value, read.Value)
+	require.NoError(t, log.Close())
+}
+
+func testTruncate(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+
+	err := log.Truncate(1)
+	require.NoError(t, err)
+
+	_, err = log.Read(0)
+	require.Error(t, err)
+	require.NoError(t, log.Close())
+}
+
+func testReset(t *testing.T, log *Log) {
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, log.resetAt(5))
+	_, err := log.Read(0)
+	require.Error(t, err)
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.NoError(t, log.Close())
+}
+
+func testOffsets(t *testing.T, log *Log) {
+	_, found := log.FetchOffset("group")
+	require.False(t, found)
+	require.NoError(t, log.CommitOffset("group", 3))
+
+	// they outlive resets and are there when the log reopens
+	require.NoError(t, log.Reset())
+	require.NoError(t, log.Close())
+	log, err := NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	off, found := log.FetchOffset("group")
+	require.True(t, found)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, log.Close())
+}
+
+func testStats(t *testing.T, log *Log) {
+	st := log.Stats()
+	require.Equal(t, 1, st.Segments)
+	require.Zero(t, st.Bytes)
+	require.True(t, st.OldestRecord.IsZero())
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	st = log.Stats()
+	// the 32 byte stores roll over well before three records
+	require.Greater(t, st.Segments, 1)
+	require.Equal(t, uint64(0), st.LowWatermark)
+	require.Equal(t, uint64(3), st.HighWatermark)
+	require.NotZero(t, st.Bytes)
+	require.GreaterOrEqual(t, st.ActiveSegmentFill, 0.0)
+	require.Less(t, st.ActiveSegmentFill, 1.0)
+	require.False(t, st.OldestRecord.IsZero())
+	require.NoError(t, log.Close())
+}
+
+func TestLogTruncateFrom(t *testing.T) {
+	dir, err := os.MkdirTemp("", "truncate-from-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 6; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.TruncateFrom(2))
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	_, err = log.Read(2)
+	require.Error(t, err)
+
+	off, err = log.Append(&api.Record{Value: []byte("again")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	record, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("again"), record.Value)
+	record, err = log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+}
+
+func TestLogReadSealed(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	// two records to a segment, the last in the active one
+	for i := 0; i < 11; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	sealed := *log.sealed.Load()
+	require.Len(t, sealed, len(log.segments)-1)
+
+	// sealed segments are read while the log's held, the active one isn't
+	var record *api.Record
+	read := func(off uint64) func(*segment) (int, error) {
+		return func(s *segment) (int, error) {
+			var err error
+			record, err = s.Read(off)
+			return len(record.GetValue()), err
+		}
+	}
+	log.mu.Lock()
+	_, ok, err := log.readSealed(0, read(0))
+	_, active, _ := log.readSealed(10, read(10))
+	log.mu.Unlock()
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), record.Offset)
+	require.False(t, active)
+
+	// reads of the segments truncated away don't race their closing
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for i := 0; i < 1000; i++ {
+			_, err := log.Read(uint64(i % 11))
+			if err != nil && !errors.As(err, &api.ErrOffsetOutOfRange{}) {
+				errs <- err
+				return
+			}
+		}
+	}()
+	require.NoError(t, log.TruncateFrom(4))
+	require.NoError(t, log.Truncate(1))
+	require.NoError(t, <-errs)
+	for _, s := range sealed {
+		require.Equal(t, s.baseOffset == 2, s.sealed(), s.baseOffset)
+	}
+	record, err = log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), record.Offset)
+}
+
+func TestLogReadTo(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world"), Key: []byte{byte(i)}})
+		require.NoError(t, err)
+	}
+
+	record := &api.Record{}
+	buf, err := log.ReadTo(0, nil, record)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), record.Value)
+	require.Equal(t, uint64(0), record.Offset)
+
+	// reading into the buffer again doesn't allocate, sealed or active
+	for _, off := range []uint64{1, 2} {
+		allocs := testing.AllocsPerRun(100, func() {
+			buf, err = log.ReadTo(off, buf, record)
+		})
+		require.NoError(t, err)
+		require.Zero(t, allocs)
+		require.Equal(t, []byte{byte(off)}, record.Key)
+		require.Equal(t, off, record.Offset)
+	}
+
+	_, err = log.ReadTo(3, buf, record)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+}
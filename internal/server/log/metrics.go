@@ -0,0 +1,252 @@
+package log
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	appendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proglog_log_append_duration_seconds",
+		Help:    "Time taken to append a record to the log.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	})
+	recordsAppended = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_log_records_appended_total",
+		Help: "Records appended to the log.",
+	})
+	bytesAppended = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_log_bytes_appended_total",
+		Help: "Record value bytes appended to the log.",
+	})
+	recordsRead = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_log_records_read_total",
+		Help: "Records read from the log.",
+	})
+	bytesRead = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_log_bytes_read_total",
+		Help: "Record value bytes read from the log.",
+	})
+	readErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_log_read_errors_total",
+		Help: "Failed reads from the log by error type.",
+	}, []string{"type"})
+	replicationLagOffsets = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proglog_replication_lag_offsets",
+		Help: "Entries each follower is behind the leader's log, exported by the leader.",
+	}, []string{"partition", "follower"})
+	replicationLagSeconds = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proglog_replication_lag_seconds",
+		Help: "Age of the oldest entry each follower is missing, exported by the leader.",
+	}, []string{"partition", "follower"})
+	replicationStale = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proglog_replication_stale",
+		Help: "1 while a follower lags further than the configured maximum and is out of sync.",
+	}, []string{"partition", "follower"})
+	tenantBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proglog_tenant_bytes",
+		Help: "Bytes each tenant's topic partitions hold on this server, as last summed.",
+	}, []string{"tenant"})
+	tenantMaxBytes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proglog_tenant_max_bytes",
+		Help: "Bytes each tenant's topic partitions may hold on this server, zero for no cap.",
+	}, []string{"tenant"})
+	voterChanges = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_voter_changes_total",
+		Help: "Servers the leader promoted to or demoted from voting while rebalancing across zones.",
+	}, []string{"change"})
+	segmentsQuarantined = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_log_segments_quarantined_total",
+		Help: "Segments moved aside on open, that couldn't be repaired or came before one that couldn't.",
+	})
+	faultsInjected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_log_faults_injected_total",
+		Help: "Faults injected into segment file I/O, by operation and fault.",
+	}, []string{"op", "fault"})
+	tierSegmentsArchived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_tier_segments_archived_total",
+		Help: "Sealed segments uploaded to the object store.",
+	})
+	tierSegmentsEvicted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_tier_segments_evicted_total",
+		Help: "Archived segments removed from local disk.",
+	})
+	tierFetches = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_tier_fetches_total",
+		Help: "Archived segments fetched from the object store for reads.",
+	})
+	checksumSessionsOpened = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_checksum_sessions_opened_total",
+		Help: "Checksum sessions opened for replicas comparing their logs, including ones started over.",
+	})
+	checksumRangesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_checksum_ranges_sent_total",
+		Help: "Range checksums sent to replicas comparing their logs, by full or incremental response.",
+	}, []string{"response"})
+	recordsRepaired = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_log_records_repaired_total",
+		Help: "Records rewritten with another replica's copy after their checksums differed.",
+	})
+	recordsCompacted = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_log_records_compacted_total",
+		Help: "Records compaction removed because a later record has the same key.",
+	})
+	compactionBytesReclaimed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_log_compaction_bytes_reclaimed_total",
+		Help: "Store bytes compaction freed rewriting segments without superseded records.",
+	})
+	tombstonesRemoved = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_log_tombstones_removed_total",
+		Help: "Tombstones, records with a key and no value, compaction removed as superseded or past their retention.",
+	})
+
+	flushDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proglog_store_flush_duration_seconds",
+		Help:    "Time taken to flush the store's write buffer to the file.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	})
+	syncDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proglog_store_sync_duration_seconds",
+		Help:    "Time taken to fsync the store file.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	})
+	groupCommitAppends = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proglog_log_group_commit_appends",
+		Help:    "Appends synced on append that shared each fsync.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	uringSubmitted = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proglog_store_uring_submitted",
+		Help:    "Store operations submitted to io_uring together.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 9),
+	})
+	readAheadHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_store_read_ahead_hits_total",
+		Help: "Records read from what was read ahead of them.",
+	})
+	readAheadBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proglog_store_read_ahead_bytes",
+		Help: "Bytes of stores read ahead and held in memory.",
+	})
+	indexCacheHits = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_index_cache_hits_total",
+		Help: "Reads of sealed indexes that were mapped.",
+	})
+	indexCacheMisses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_index_cache_misses_total",
+		Help: "Reads of sealed indexes that were evicted and had to be opened and mapped again.",
+	})
+	indexCacheMapped = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proglog_index_cache_mapped",
+		Help: "Sealed indexes held mapped by index caches.",
+	})
+	bytesPunched = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_log_bytes_punched_total",
+		Help: "Store bytes of deleted records punched out of segments' files before the segments could be removed.",
+	})
+	storeBytesWritten = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_store_bytes_written_total",
+		Help: "Bytes, including length prefixes, appended to stores.",
+	})
+	storeBytesRead = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_store_bytes_read_total",
+		Help: "Bytes, including length prefixes, read from stores.",
+	})
+	storeReadErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_store_read_errors_total",
+		Help: "Failed store reads by error type.",
+	}, []string{"type"})
+)
+
+// Read error types
+const (
+	readErrorOutOfRange = "offset_out_of_range"
+	readErrorOther      = "other"
+	readErrorIO         = "io"
+	readErrorDecrypt    = "decrypt"
+)
+
+var (
+	// logs are labelled by directory, unique per open log
+	logLabels     = []string{"log"}
+	diskBytesDesc = prometheus.NewDesc("proglog_log_disk_bytes",
+		"Bytes held in the log's stores and indexes.", logLabels, nil)
+	segmentsDesc = prometheus.NewDesc("proglog_log_segments",
+		"Number of segments in the log.", logLabels, nil)
+	activeFillDesc = prometheus.NewDesc("proglog_log_active_segment_fill_ratio",
+		"How full the active segment is, from 0 to 1.", logLabels, nil)
+	lowWatermarkDesc = prometheus.NewDesc("proglog_log_low_watermark",
+		"Lowest offset held by the log.", logLabels, nil)
+	highWatermarkDesc = prometheus.NewDesc("proglog_log_high_watermark",
+		"Offset the next appended record will get.", logLabels, nil)
+	oldestRecordDesc = prometheus.NewDesc("proglog_log_oldest_record_timestamp_seconds",
+		"Append time of the oldest record in the log.", logLabels, nil)
+)
+
+// Collects gauges from every open log at scrape time
+type logCollector struct {
+	mu   sync.Mutex
+	logs map[*Log]struct{}
+}
+
+var openLogs = &logCollector{logs: make(map[*Log]struct{})}
+
+func init() {
+	prometheus.MustRegister(openLogs)
+}
+
+func (c *logCollector) add(l *Log) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logs[l] = struct{}{}
+}
+
+func (c *logCollector) remove(l *Log) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.logs, l)
+}
+
+// OpenLogs returns every log opened in this process and not yet closed, ordered by directory
+func OpenLogs() []*Log {
+	openLogs.mu.Lock()
+	defer openLogs.mu.Unlock()
+	logs := make([]*Log, 0, len(openLogs.logs))
+	for l := range openLogs.logs {
+		logs = append(logs, l)
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].Dir < logs[j].Dir
+	})
+	return logs
+}
+
+func (c *logCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- diskBytesDesc
+	ch <- segmentsDesc
+	ch <- activeFillDesc
+	ch <- lowWatermarkDesc
+	ch <- highWatermarkDesc
+	ch <- oldestRecordDesc
+}
+
+func (c *logCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for l := range c.logs {
+		name := l.Dir
+		st := l.Stats()
+		ch <- prometheus.MustNewConstMetric(diskBytesDesc, prometheus.GaugeValue, float64(st.Bytes), name)
+		ch <- prometheus.MustNewConstMetric(segmentsDesc, prometheus.GaugeValue, float64(st.Segments), name)
+		ch <- prometheus.MustNewConstMetric(activeFillDesc, prometheus.GaugeValue, st.ActiveSegmentFill, name)
+		ch <- prometheus.MustNewConstMetric(lowWatermarkDesc, prometheus.GaugeValue, float64(st.LowWatermark), name)
+		ch <- prometheus.MustNewConstMetric(highWatermarkDesc, prometheus.GaugeValue, float64(st.HighWatermark), name)
+		if !st.OldestRecord.IsZero() {
+			ch <- prometheus.MustNewConstMetric(oldestRecordDesc, prometheus.GaugeValue,
+				float64(st.OldestRecord.UnixNano())/1e9, name)
+		}
+	}
+}
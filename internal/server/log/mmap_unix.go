@@ -0,0 +1,17 @@
+//go:build unix
+
+package log
+
+import "golang.org/x/sys/unix"
+
+func mmap(f file, size int) ([]byte, error) {
+	return unix.Mmap(int(f.Fd()), 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+}
+
+func msync(_ file, b []byte) error {
+	return unix.Msync(b, unix.MS_SYNC)
+}
+
+func munmap(b []byte) error {
+	return unix.Munmap(b)
+}
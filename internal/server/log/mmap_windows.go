@@ -0,0 +1,42 @@
+//go:build windows
+
+package log
+
+import (
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Windows can't truncate or rename a mapped file, so a mapping is unmapped
+// before its file is, as index.Close does. The mapping's handle is closed
+// once the view is mapped, the view keeps it open.
+func mmap(f file, size int) ([]byte, error) {
+	h, err := windows.CreateFileMapping(windows.Handle(f.Fd()), nil, windows.PAGE_READWRITE,
+		uint32(uint64(size)>>32), uint32(size), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(h)
+	addr, err := windows.MapViewOfFile(h, windows.FILE_MAP_WRITE, 0, 0, uintptr(size))
+	if err != nil {
+		return nil, err
+	}
+	// the view isn't Go's memory, so the address is put in a pointer as is
+	var p *byte
+	*(*uintptr)(unsafe.Pointer(&p)) = addr
+	return unsafe.Slice(p, size), nil
+}
+
+// FlushViewOfFile only starts the pages' writes, the file's Sync waits for
+// them
+func msync(f file, b []byte) error {
+	if err := windows.FlushViewOfFile(uintptr(unsafe.Pointer(unsafe.SliceData(b))), uintptr(len(b))); err != nil {
+		return err
+	}
+	return windows.FlushFileBuffers(windows.Handle(f.Fd()))
+}
+
+func munmap(b []byte) error {
+	return windows.UnmapViewOfFile(uintptr(unsafe.Pointer(unsafe.SliceData(b))))
+}
@@ -0,0 +1,44 @@
+package log
+
+import (
+	"fmt"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+// ResetOffset applies the reset policy to a consumer's offset in the topic
+// partition whose offsets st reports, found being whether it was ever
+// committed. An offset never committed, or below the low watermark or past
+// the high one, is reset to the low watermark, the high one or the offset
+// atTime searches for, and reset reports it was. OFFSET_RESET_ERROR fails
+// with api.ErrNoOffset or api.ErrOffsetOutOfRange instead, and
+// OFFSET_RESET_NONE leaves the offset as it is.
+func ResetOffset(
+	policy api.OffsetReset,
+	topic string,
+	partition uint32,
+	off uint64,
+	found bool,
+	st Stats,
+	atTime func() (uint64, error),
+) (_ uint64, reset bool, err error) {
+	if policy == api.OffsetReset_OFFSET_RESET_NONE ||
+		found && off >= st.LowWatermark && off <= st.HighWatermark {
+		return off, false, nil
+	}
+	switch policy {
+	case api.OffsetReset_OFFSET_RESET_EARLIEST:
+		return st.LowWatermark, true, nil
+	case api.OffsetReset_OFFSET_RESET_LATEST:
+		return st.HighWatermark, true, nil
+	case api.OffsetReset_OFFSET_RESET_TIMESTAMP:
+		off, err := atTime()
+		return off, err == nil, err
+	case api.OffsetReset_OFFSET_RESET_ERROR:
+		if !found {
+			return 0, false, api.ErrNoOffset{Topic: topic, Partition: partition}
+		}
+		return 0, false, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	return 0, false, fmt.Errorf("unknown offset reset policy %v", policy)
+}
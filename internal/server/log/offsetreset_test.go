@@ -0,0 +1,40 @@
+package log
+
+import (
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResetOffset(t *testing.T) {
+	st := Stats{LowWatermark: 10, HighWatermark: 20}
+	atTime := func() (uint64, error) { return 15, nil }
+	for _, tc := range []struct {
+		policy api.OffsetReset
+		off    uint64
+		found  bool
+		want   uint64
+		reset  bool
+		err    error
+	}{
+		{policy: api.OffsetReset_OFFSET_RESET_NONE, off: 3, found: true, want: 3},
+		{policy: api.OffsetReset_OFFSET_RESET_EARLIEST, off: 12, found: true, want: 12},
+		{policy: api.OffsetReset_OFFSET_RESET_EARLIEST, off: 20, found: true, want: 20},
+		{policy: api.OffsetReset_OFFSET_RESET_EARLIEST, off: 3, found: true, want: 10, reset: true},
+		{policy: api.OffsetReset_OFFSET_RESET_LATEST, want: 20, reset: true},
+		{policy: api.OffsetReset_OFFSET_RESET_LATEST, off: 30, found: true, want: 20, reset: true},
+		{policy: api.OffsetReset_OFFSET_RESET_TIMESTAMP, off: 3, found: true, want: 15, reset: true},
+		{policy: api.OffsetReset_OFFSET_RESET_ERROR, off: 3, found: true, err: api.ErrOffsetOutOfRange{Offset: 3}},
+		{policy: api.OffsetReset_OFFSET_RESET_ERROR, err: api.ErrNoOffset{Topic: "events", Partition: 1}},
+	} {
+		off, reset, err := ResetOffset(tc.policy, "events", 1, tc.off, tc.found, st, atTime)
+		if tc.err != nil {
+			require.Equal(t, tc.err, err, "%v from %d", tc.policy, tc.off)
+			continue
+		}
+		require.NoError(t, err)
+		require.Equal(t, tc.want, off, "%v from %d", tc.policy, tc.off)
+		require.Equal(t, tc.reset, reset, "%v from %d", tc.policy, tc.off)
+	}
+}
@@ -0,0 +1,94 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// The file in the log's directory holding the offsets consumers committed
+const offsetsFile = "offsets.json"
+
+// consumerOffsets are the offsets consumers committed to a log, by
+// consumer name, each the next record the consumer reads
+type consumerOffsets struct {
+	mu      sync.Mutex
+	offsets map[string]uint64
+}
+
+// Reads the offsets committed before the log last closed
+func (l *Log) loadOffsets() error {
+	l.offsets.offsets = make(map[string]uint64)
+	b, err := os.ReadFile(filepath.Join(l.Dir, offsetsFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &l.offsets.offsets)
+}
+
+// Writes the offsets whole, replacing the file so a crash leaves the old
+// or new ones. Callers must hold the offsets' mu.
+func (l *Log) saveOffsets() error {
+	b, err := json.Marshal(l.offsets.offsets)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(l.Dir, offsetsFile)
+	if err := os.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// CommitOffset records offset as the next record the consumer reads,
+// persisting it before returning
+func (l *Log) CommitOffset(consumer string, offset uint64) error {
+	l.offsets.mu.Lock()
+	defer l.offsets.mu.Unlock()
+	l.offsets.offsets[consumer] = offset
+	return l.saveOffsets()
+}
+
+// FetchOffset returns the offset the consumer last committed, found is
+// false if it never has
+func (l *Log) FetchOffset(consumer string) (offset uint64, found bool) {
+	l.offsets.mu.Lock()
+	defer l.offsets.mu.Unlock()
+	offset, found = l.offsets.offsets[consumer]
+	return offset, found
+}
+
+// The committed offsets encoded for a snapshot
+func (l *Log) marshalOffsets() ([]byte, error) {
+	l.offsets.mu.Lock()
+	defer l.offsets.mu.Unlock()
+	return json.Marshal(l.offsets.offsets)
+}
+
+// Replaces the committed offsets with a snapshot's
+func (l *Log) restoreOffsets(b []byte) error {
+	offsets := make(map[string]uint64)
+	if err := json.Unmarshal(b, &offsets); err != nil {
+		return err
+	}
+	l.offsets.mu.Lock()
+	defer l.offsets.mu.Unlock()
+	l.offsets.offsets = offsets
+	return l.saveOffsets()
+}
+
+// Writes the offsets back after the log's directory was emptied, they
+// outlive the records
+func (l *Log) keepOffsets() error {
+	l.offsets.mu.Lock()
+	defer l.offsets.mu.Unlock()
+	if len(l.offsets.offsets) == 0 {
+		return nil
+	}
+	return l.saveOffsets()
+}
@@ -0,0 +1,533 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// How often a server leading more than its share of the partitions hands
+// one of them to the server leading the fewest
+var leaderBalanceInterval = 10 * time.Second
+
+// PartitionedLog splits the log into partitions, each a DistributedLog
+// replicated by its own Raft group. Every server is a member of every
+// group, and the leaderships are spread across the servers, so writes to
+// different partitions go through different leaders. Records are ordered
+// within a partition, each has its own offsets.
+//
+// Partition 0 keeps its data in the data directory and the others under
+// partitions/<n>, so a log of one partition lays out its files as a
+// DistributedLog does. Named topics are replicated by Raft groups of their
+// own, which partition 0 keeps the catalog of, see CreateTopic.
+type PartitionedLog struct {
+	// mu guards config.Topic, which SetTopicDefaults changes
+	mu         sync.RWMutex
+	config     Config
+	partitions []*DistributedLog
+	topics     *clusterTopics
+	// the layer the partitions' and topics' layers split off
+	streams  *StreamLayer
+	registry *registry
+	logger   *zap.Logger
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+func NewPartitionedLog(dataDir string, config Config) (*PartitionedLog, error) {
+	if err := config.validateTenants(); err != nil {
+		return nil, err
+	}
+	n := max(config.Raft.Partitions, 1)
+	l := &PartitionedLog{
+		config:   config,
+		registry: newRegistry(),
+		logger:   config.logger().Named("partitions"),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	// nothing else has registered yet, so this can't conflict
+	_ = l.registry.register(string(config.Raft.LocalID), &api.Registration{
+		NodeId:   config.Raft.NodeID,
+		Version:  config.Raft.Version,
+		RpcAddr:  config.Raft.BindAddr,
+		HttpAddr: config.Raft.HTTPAddr,
+		Zone:     config.Raft.Zone,
+	})
+	l.streams = config.Raft.StreamLayer
+	streams := l.streams.Partitions(n)
+	l.topics = newClusterTopics(dataDir, config, l.streams, l.registry, uint32(n))
+	for p := 0; p < n; p++ {
+		c := config
+		c.Raft.Partition = uint32(p)
+		c.Raft.StreamLayer = streams[p]
+		dir := dataDir
+		if p > 0 {
+			dir = filepath.Join(dataDir, "partitions", strconv.Itoa(p))
+			c.Tier.Prefix += fmt.Sprintf("partitions/%d/", p)
+		}
+		var topics *clusterTopics
+		if p == 0 {
+			topics = l.topics
+		}
+		partition, err := newDistributedLog(dir, c, topics)
+		if err != nil {
+			l.closePartitions()
+			l.streams.Close()
+			return nil, fmt.Errorf("partition %d: %w", p, err)
+		}
+		partition.registry = l.registry
+		l.partitions = append(l.partitions, partition)
+	}
+	go l.run()
+	return l, nil
+}
+
+// Partitions is how many partitions the log has
+func (l *PartitionedLog) Partitions() int {
+	return len(l.partitions)
+}
+
+// Partition returns the partition's log, or api.ErrPartitionNotFound
+func (l *PartitionedLog) Partition(p uint32) (*DistributedLog, error) {
+	if p >= uint32(len(l.partitions)) {
+		return nil, api.ErrPartitionNotFound{Partition: p, Partitions: len(l.partitions)}
+	}
+	return l.partitions[p], nil
+}
+
+// Append appends to partition 0, for callers that don't pick a partition
+func (l *PartitionedLog) Append(record *api.Record) (uint64, error) {
+	return l.partitions[0].Append(record)
+}
+
+// Read reads from partition 0, for callers that don't pick a partition
+func (l *PartitionedLog) Read(offset uint64) (*api.Record, error) {
+	return l.partitions[0].Read(offset)
+}
+
+// TopicPartition returns the log of the topic's partition p, the default
+// topic's for an empty name
+func (l *PartitionedLog) TopicPartition(name string, p uint32) (Partition, error) {
+	if name == "" || name == DefaultTopic {
+		return l.Partition(p)
+	}
+	return l.topics.partition(name, p)
+}
+
+// CreateTopic adds the described topic to the catalog, with at least one
+// partition, failing with api.ErrTopicExists if there's one by the name.
+// Each partition's group starts with the servers replicating partition 0.
+// Only partition 0's leader can, so on other servers it fails with
+// api.ErrNotLeader.
+func (l *PartitionedLog) CreateTopic(desc *api.Topic) error {
+	if err := ValidateTopic(desc.Name); err != nil {
+		return err
+	}
+	if desc.Name == DefaultTopic {
+		return api.ErrTopicExists{Topic: desc.Name}
+	}
+	if err := ValidateTopicConfigs(desc.Configs); err != nil {
+		return err
+	}
+	desc = proto.Clone(desc).(*api.Topic)
+	desc.Partitions = max(desc.Partitions, 1)
+	req, err := l.clusterTopic(desc)
+	if err != nil {
+		return err
+	}
+	_, err = l.partitions[0].apply(CreateTopicRequestType, req)
+	return err
+}
+
+// The topic for the catalog, with the servers replicating partition 0 for
+// its groups to start with
+func (l *PartitionedLog) clusterTopic(desc *api.Topic) (*api.ClusterTopic, error) {
+	servers, err := l.partitions[0].GetServers()
+	if err != nil {
+		return nil, err
+	}
+	ct := &api.ClusterTopic{Topic: desc}
+	for _, srv := range servers {
+		ct.Servers = append(ct.Servers, &api.Server{Id: srv.Id, RpcAddr: srv.RpcAddr, Voter: srv.Voter})
+	}
+	return ct, nil
+}
+
+// DeleteTopic takes the topic out of the catalog, and every server removes
+// its records. The default topic can't be deleted. Only partition 0's
+// leader can, as CreateTopic.
+func (l *PartitionedLog) DeleteTopic(name string) error {
+	if name == "" || name == DefaultTopic {
+		return errors.New("the default topic can't be deleted")
+	}
+	_, err := l.partitions[0].apply(DeleteTopicRequestType, &api.DeleteTopicRequest{Name: name})
+	return err
+}
+
+// DescribeTopic returns the topic's description as this server has
+// applied the catalog, the default topic's for an empty name
+func (l *PartitionedLog) DescribeTopic(name string) (*api.Topic, error) {
+	if name == "" || name == DefaultTopic {
+		return &api.Topic{Name: DefaultTopic, Partitions: uint32(len(l.partitions))}, nil
+	}
+	return l.topics.describe(name)
+}
+
+// TopicConfig returns the topic's settings as this server has applied the
+// catalog, the servers' for the default topic
+func (l *PartitionedLog) TopicConfig(name string) (TopicConfig, error) {
+	if name == "" || name == DefaultTopic {
+		l.mu.RLock()
+		defer l.mu.RUnlock()
+		return l.config.Topic, nil
+	}
+	return l.topics.topicConfig(name)
+}
+
+// SetTopicDefaults changes the servers' settings, which the default topic
+// goes by and the other topics' configs override, on this server. The
+// partitions go by them from their next append and cleanup.
+func (l *PartitionedLog) SetTopicDefaults(c TopicConfig) {
+	l.mu.Lock()
+	l.config.Topic = c
+	l.mu.Unlock()
+	l.topics.setDefaults(c)
+}
+
+// TenantOf returns the tenant the topic is of, "" for none, see
+// Config.TenantOf
+func (l *PartitionedLog) TenantOf(topic string) string {
+	return tenantOf(l.config.Tenants, topic)
+}
+
+// TenantStats sums each tenant's use of this server's storage, in order of
+// their names
+func (l *PartitionedLog) TenantStats() []TenantStats {
+	return sortedTenantStats(l.topics.usage.get(true))
+}
+
+// CheckTenant fails with api.ErrDiskFull if the topic's tenant holds its
+// max bytes on this server, as last summed
+func (l *PartitionedLog) CheckTenant(topic string) error {
+	return l.topics.usage.check(topic)
+}
+
+// AlterTopicConfigs changes the topic's configs in the catalog, an empty
+// value removing one, and returns the topic as altered. Every server's
+// partitions go by them once it applies the change. The default topic's
+// settings are the servers' and can't be altered. Only partition 0's
+// leader can, as CreateTopic.
+func (l *PartitionedLog) AlterTopicConfigs(name string, configs map[string]string) (*api.Topic, error) {
+	if name == "" || name == DefaultTopic {
+		return nil, errors.New("the default topic's configs can't be altered")
+	}
+	desc, err := l.topics.describe(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := ValidateTopicConfigs(alterConfigs(desc.Configs, configs)); err != nil {
+		return nil, err
+	}
+	res, err := l.partitions[0].apply(AlterTopicConfigsRequestType, &api.AlterTopicConfigsRequest{
+		Name:    name,
+		Configs: configs,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.AlterTopicConfigsResponse).Topic, nil
+}
+
+// CreatePartitions raises the topic's partition count in the catalog to n
+// and bumps its version, and every server opens the partitions added once
+// it applies the change. Their groups start with the servers replicating
+// partition 0. The default topic's count is the servers' and can't be
+// raised. Only partition 0's leader can, as CreateTopic.
+func (l *PartitionedLog) CreatePartitions(name string, n uint32) (*api.Topic, error) {
+	if name == "" || name == DefaultTopic {
+		return nil, errors.New("the default topic's partitions can't be added to")
+	}
+	desc, err := l.topics.describe(name)
+	if err != nil {
+		return nil, err
+	}
+	if n <= desc.Partitions {
+		return nil, fmt.Errorf("topic %s has %d partitions, can't have %d", name, desc.Partitions, n)
+	}
+	req, err := l.clusterTopic(&api.Topic{Name: name, Partitions: n})
+	if err != nil {
+		return nil, err
+	}
+	res, err := l.partitions[0].apply(CreatePartitionsRequestType, req)
+	if err != nil {
+		return nil, err
+	}
+	return res.(*api.CreatePartitionsResponse).Topic, nil
+}
+
+// ListTopics describes the topics in order of their names, the default
+// topic included
+func (l *PartitionedLog) ListTopics() []*api.Topic {
+	def, _ := l.DescribeTopic(DefaultTopic)
+	topics := append(l.topics.list(), def)
+	slices.SortFunc(topics, func(a, b *api.Topic) int { return strings.Compare(a.Name, b.Name) })
+	return topics
+}
+
+// The Raft groups this server runs, the partitions' and then the topics'
+func (l *PartitionedLog) groups() []*DistributedLog {
+	return append(slices.Clip(l.partitions), l.topics.groups()...)
+}
+
+// SyncOnAppend reports whether appends are fsynced on each server before they apply
+func (l *PartitionedLog) SyncOnAppend() bool {
+	return l.config.SyncOnAppend
+}
+
+// Join adds the server to the partitions and topic partitions this server
+// leads. The leaders of the others add it on their own servers, so
+// raft.ErrNotLeader is only returned when this server leads none.
+func (l *PartitionedLog) Join(id, addr string) error {
+	return l.members(func(p *DistributedLog) error {
+		return p.Join(id, addr)
+	})
+}
+
+// Leave removes the server from the partitions this server leads, as Join
+// adds it, and drops its registration
+func (l *PartitionedLog) Leave(id string) error {
+	l.registry.remove(id)
+	return l.members(func(p *DistributedLog) error {
+		return p.Leave(id)
+	})
+}
+
+// Changes every partition's membership with fn, dropping the errors of
+// partitions led elsewhere unless all of them are
+func (l *PartitionedLog) members(fn func(*DistributedLog) error) error {
+	var errs []error
+	led := false
+	for _, p := range l.groups() {
+		err := fn(p)
+		if errors.Is(err, raft.ErrNotLeader) {
+			continue
+		}
+		led = true
+		if err != nil {
+			errs = append(errs, fmt.Errorf("partition %d: %w", p.config.Raft.Partition, err))
+		}
+	}
+	if !led {
+		return raft.ErrNotLeader
+	}
+	return errors.Join(errs...)
+}
+
+// Register records the registration the server joining as id made,
+// reported with it by GetServers. It fails with ErrNodeConflict, and the
+// server shouldn't be joined, when another member registered the name or
+// node ID.
+func (l *PartitionedLog) Register(id string, reg *api.Registration) error {
+	return l.registry.register(id, reg)
+}
+
+// SetZone records the zone the server runs in for every partition, see
+// DistributedLog.SetZone
+func (l *PartitionedLog) SetZone(id, zone string) {
+	for _, p := range l.groups() {
+		p.SetZone(id, zone)
+	}
+}
+
+// Ready reports whether every partition is ready to serve, see
+// DistributedLog.Ready
+func (l *PartitionedLog) Ready() error {
+	for _, p := range l.groups() {
+		if err := p.Ready(); err != nil {
+			return fmt.Errorf("partition %d: %w", p.config.Raft.Partition, err)
+		}
+	}
+	return nil
+}
+
+// TransferLeadership hands off every partition this server leads, see
+// DistributedLog.TransferLeadership
+func (l *PartitionedLog) TransferLeadership() error {
+	var errs []error
+	for _, p := range l.groups() {
+		if err := p.TransferLeadership(); err != nil {
+			errs = append(errs, fmt.Errorf("partition %d: %w", p.config.Raft.Partition, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// How often Drain checks on the partitions it's handing off
+var drainInterval = 100 * time.Millisecond
+
+// Drain hands off every partition this server leads, each to a voter that
+// has caught up with it, before the server shuts down. From then on the
+// server reports itself draining in GetServers, so clients move off it.
+// Partitions still led here once ctx is done are handed to whichever voter
+// Raft picks, and Drain returns ctx's error.
+func (l *PartitionedLog) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		leading := 0
+		for _, p := range l.groups() {
+			// topics created while draining are handed off too
+			p.draining.Store(true)
+			done, err := p.handOff()
+			if err != nil {
+				l.logger.Warn("failed to hand off partition", zap.Uint32("partition", p.config.Raft.Partition), zap.Error(err))
+			}
+			if !done {
+				leading++
+			}
+		}
+		if leading == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(ctx.Err(), l.TransferLeadership())
+		case <-ticker.C:
+		}
+	}
+}
+
+// WaitForLeader blocks until every partition and topic partition has
+// elected a leader or times out
+func (l *PartitionedLog) WaitForLeader(timeout time.Duration) error {
+	groups := l.groups()
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	for i, p := range groups {
+		wg.Go(func() {
+			if err := p.WaitForLeader(timeout); err != nil {
+				errs[i] = fmt.Errorf("partition %d: %w", p.config.Raft.Partition, err)
+			}
+		})
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Balances the leaders every leaderBalanceInterval, and cleans up the
+// partitions every Config.CleanupInterval, until the log closes
+func (l *PartitionedLog) run() {
+	defer close(l.stopped)
+	ticker := time.NewTicker(leaderBalanceInterval)
+	defer ticker.Stop()
+	cleanup := time.NewTicker(l.config.cleanupInterval())
+	defer cleanup.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			if err := l.balanceLeaders(); err != nil {
+				l.logger.Error("failed to balance leaders", zap.Error(err))
+			}
+		case <-cleanup.C:
+			l.cleanup()
+		}
+	}
+}
+
+// Applies the servers' retention and compaction to the default topic's
+// partitions, and each topic's to its own
+func (l *PartitionedLog) cleanup() {
+	l.mu.RLock()
+	defaults := l.config.Topic
+	l.mu.RUnlock()
+	for _, p := range l.partitions {
+		if err := p.cleanup(defaults); err != nil {
+			l.logger.Error("failed to clean up partition",
+				zap.Uint32("partition", p.config.Raft.Partition),
+				zap.Error(err),
+			)
+		}
+	}
+	l.topics.cleanup()
+	l.topics.usage.get(true)
+}
+
+// Hands one of the partitions this server leads to an in-sync voter
+// leading at least two fewer, so leaderships even out a partition at a
+// time. Topics' partitions count as partitions. Partitions without a
+// leader hold balancing off, they're electing one.
+func (l *PartitionedLog) balanceLeaders() error {
+	led := make(map[raft.ServerID]int)
+	var leading []*DistributedLog
+	for _, p := range l.groups() {
+		_, id := p.raft.LeaderWithID()
+		if id == "" {
+			return nil
+		}
+		led[id]++
+		if id == l.config.Raft.LocalID {
+			leading = append(leading, p)
+		}
+	}
+	local := led[l.config.Raft.LocalID]
+	for _, p := range leading {
+		future := p.raft.GetConfiguration()
+		if err := future.Error(); err != nil {
+			return err
+		}
+		var to *raft.Server
+		for _, srv := range future.Configuration().Servers {
+			if srv.ID == l.config.Raft.LocalID || srv.Suffrage != raft.Voter ||
+				!p.isr.inSync(srv.ID) || local-led[srv.ID] < 2 {
+				continue
+			}
+			if to == nil || led[srv.ID] < led[to.ID] {
+				to = &srv
+			}
+		}
+		if to == nil {
+			continue
+		}
+		l.logger.Info("handing off leadership to balance partitions",
+			zap.Uint32("partition", p.config.Raft.Partition),
+			zap.String("to", string(to.ID)),
+		)
+		return p.raft.LeadershipTransferToServer(to.ID, to.Address).Error()
+	}
+	return nil
+}
+
+func (l *PartitionedLog) Close() error {
+	close(l.done)
+	<-l.stopped
+	// partition 0 stops applying the catalog before the topics close
+	err := errors.Join(l.closePartitions(), l.topics.close())
+	// a listener shared with gRPC may have closed with the gRPC server
+	if cerr := l.streams.Close(); !errors.Is(cerr, net.ErrClosed) {
+		err = errors.Join(err, cerr)
+	}
+	return err
+}
+
+func (l *PartitionedLog) closePartitions() error {
+	var errs []error
+	for _, p := range l.partitions {
+		errs = append(errs, p.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,323 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionedLog(t *testing.T) {
+	interval := leaderBalanceInterval
+	leaderBalanceInterval = 50 * time.Millisecond
+	defer func() { leaderBalanceInterval = interval }()
+
+	const nodeCount, partitions = 3, 3
+	logs := setupPartitionedCluster(t, nodeCount, partitions)
+
+	// the bootstrapped server led every partition, it hands them off
+	// until each server leads one
+	leaders := make(map[string]*DistributedLog)
+	require.Eventually(t, func() bool {
+		clear(leaders)
+		for p := uint32(0); p < partitions; p++ {
+			for _, l := range logs {
+				dlog, _ := l.Partition(p)
+				if dlog.raft.State() == raft.Leader {
+					leaders[dlog.Leader()] = dlog
+				}
+			}
+		}
+		return len(leaders) == nodeCount
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// each partition takes appends on its own leader and numbers its
+	// records from 0
+	for p := uint32(0); p < partitions; p++ {
+		dlog, _ := logs[0].Partition(p)
+		leader := leaders[dlog.Leader()]
+		for i := 0; i < 2; i++ {
+			off, err := leader.Append(&api.Record{Value: []byte(fmt.Sprintf("%d-%d", p, i))})
+			require.NoError(t, err)
+			require.Equal(t, uint64(i), off)
+		}
+	}
+	for p := uint32(0); p < partitions; p++ {
+		for _, l := range logs {
+			dlog, _ := l.Partition(p)
+			require.Eventually(t, func() bool {
+				record, err := dlog.Read(1)
+				return err == nil && string(record.Value) == fmt.Sprintf("%d-1", p)
+			}, time.Second, 10*time.Millisecond)
+		}
+	}
+	for _, l := range logs {
+		require.Eventually(t, func() bool {
+			return l.Ready() == nil
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	_, err := logs[0].Partition(partitions)
+	require.Equal(t, api.ErrPartitionNotFound{Partition: partitions, Partitions: partitions}, err)
+}
+
+// Starts nodeCount servers each running partitions Raft groups, the first
+// bootstrapping them, and waits until every server is a voter in each
+func setupPartitionedCluster(t *testing.T, nodeCount int, partitions int) []*PartitionedLog {
+	t.Helper()
+	var logs []*PartitionedLog
+	for i := 0; i < nodeCount; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.BindAddr = ln.Addr().String()
+		config.Raft.Bootstrap = i == 0
+		config.Raft.Partitions = partitions
+
+		l, err := NewPartitionedLog(t.TempDir(), config)
+		require.NoError(t, err)
+		// closes the server in its place, tests can restart it
+		t.Cleanup(func() { logs[i].Close() })
+		require.Equal(t, partitions, l.Partitions())
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		}
+		logs = append(logs, l)
+	}
+	// discovery tells every server about the others, each leader adds them
+	// to the partitions it leads
+	require.Eventually(t, func() bool {
+		for i, l := range logs {
+			for j, other := range logs {
+				if i == j {
+					continue
+				}
+				err := other.Join(fmt.Sprintf("%d", i), l.config.Raft.BindAddr)
+				if err != nil && err != raft.ErrNotLeader {
+					return false
+				}
+			}
+		}
+		for p := uint32(0); int(p) < partitions; p++ {
+			for _, l := range logs {
+				dlog, err := l.Partition(p)
+				require.NoError(t, err)
+				servers, err := dlog.GetServers()
+				if err != nil || len(servers) != nodeCount {
+					return false
+				}
+			}
+		}
+		return true
+	}, 3*time.Second, 50*time.Millisecond)
+	return logs
+}
+
+func TestDrain(t *testing.T) {
+	lagInterval = 10 * time.Millisecond
+	t.Cleanup(func() { lagInterval = time.Second })
+
+	// leadership stays where bootstrap put it until the drain
+	const nodeCount, partitions = 3, 2
+	logs := setupPartitionedCluster(t, nodeCount, partitions)
+	for p := uint32(0); p < partitions; p++ {
+		dlog, _ := logs[0].Partition(p)
+		require.Equal(t, raft.Leader, dlog.raft.State())
+		_, err := dlog.Append(&api.Record{Value: []byte("hello")})
+		require.NoError(t, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, logs[0].Drain(ctx))
+	for p := uint32(0); p < partitions; p++ {
+		dlog, _ := logs[0].Partition(p)
+		require.NotEqual(t, raft.Leader, dlog.raft.State())
+		servers, err := dlog.GetServers()
+		require.NoError(t, err)
+		for _, server := range servers {
+			require.Equal(t, server.Id == "0", server.Draining)
+		}
+		// the new leader has every record the drained one acknowledged
+		var leader *DistributedLog
+		require.Eventually(t, func() bool {
+			for _, l := range logs[1:] {
+				if other, _ := l.Partition(p); other.raft.State() == raft.Leader {
+					leader = other
+					return true
+				}
+			}
+			return false
+		}, time.Second, 10*time.Millisecond)
+		require.Eventually(t, func() bool {
+			record, err := leader.Read(0)
+			return err == nil && string(record.Value) == "hello"
+		}, time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestPartitionedLogTopics(t *testing.T) {
+	const nodeCount = 3
+	logs := setupPartitionedCluster(t, nodeCount, 1)
+	leader, follower := logs[0], logs[1]
+
+	// partition 0's leader keeps the catalog
+	events := &api.Topic{Name: "events", Partitions: 2, Configs: map[string]string{"retention.ms": "60000"}}
+	require.ErrorAs(t, follower.CreateTopic(events), &api.ErrNotLeader{})
+	require.NoError(t, leader.CreateTopic(events))
+	require.ErrorAs(t, leader.CreateTopic(&api.Topic{Name: "events"}), &api.ErrTopicExists{})
+	require.ErrorAs(t, leader.CreateTopic(&api.Topic{Name: DefaultTopic}), &api.ErrTopicExists{})
+	require.Error(t, leader.CreateTopic(&api.Topic{Name: "no/slashes"}))
+
+	// every server opens the topic's partitions, each a group of its own
+	for _, l := range logs {
+		require.Eventually(t, func() bool {
+			desc, err := l.DescribeTopic("events")
+			return err == nil && desc.Partitions == 2 && desc.Configs["retention.ms"] == "60000"
+		}, time.Second, 10*time.Millisecond)
+		require.Equal(t, []string{DefaultTopic, "events"}, names(l.ListTopics()))
+	}
+	for p := uint32(0); p < 2; p++ {
+		var dlog *DistributedLog
+		require.Eventually(t, func() bool {
+			for _, l := range logs {
+				part, err := l.TopicPartition("events", p)
+				if err == nil && part.(*DistributedLog).raft.State() == raft.Leader {
+					dlog = part.(*DistributedLog)
+					return true
+				}
+			}
+			return false
+		}, 3*time.Second, 10*time.Millisecond)
+		require.NotEqual(t, uint32(0), dlog.config.Raft.Partition)
+		off, err := dlog.Append(&api.Record{Value: []byte(fmt.Sprintf("event %d", p))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+	}
+	_, err := leader.TopicPartition("events", 2)
+	require.ErrorAs(t, err, &api.ErrPartitionNotFound{})
+	_, err = leader.TopicPartition("missing", 0)
+	require.ErrorAs(t, err, &api.ErrTopicNotFound{})
+	read := func(l *PartitionedLog, p uint32) bool {
+		part, err := l.TopicPartition("events", p)
+		if err != nil {
+			return false
+		}
+		record, err := part.Read(0)
+		return err == nil && string(record.Value) == fmt.Sprintf("event %d", p)
+	}
+	for _, l := range logs {
+		for p := uint32(0); p < 2; p++ {
+			require.Eventually(t, func() bool { return read(l, p) }, time.Second, 10*time.Millisecond)
+		}
+	}
+
+	// configs change on every server through the catalog
+	compact := map[string]string{CleanupPolicyConfig: "compact"}
+	_, err = follower.AlterTopicConfigs("events", compact)
+	require.ErrorAs(t, err, &api.ErrNotLeader{})
+	_, err = leader.AlterTopicConfigs("events", map[string]string{CleanupPolicyConfig: "sometimes"})
+	require.Error(t, err)
+	desc, err := leader.AlterTopicConfigs("events", compact)
+	require.NoError(t, err)
+	require.Equal(t, "compact", desc.Configs[CleanupPolicyConfig])
+	compacted := func(l *PartitionedLog) bool {
+		config, err := l.TopicConfig("events")
+		return err == nil && config.Compact && config.Retention == time.Minute
+	}
+	for _, l := range logs {
+		require.Eventually(t, func() bool { return compacted(l) }, time.Second, 10*time.Millisecond)
+	}
+	// a server's own settings change under the topics' configs
+	follower.SetTopicDefaults(TopicConfig{MaxRecordBytes: 10})
+	topicConfig, err := follower.TopicConfig("events")
+	require.NoError(t, err)
+	require.True(t, topicConfig.Compact)
+	require.Equal(t, uint64(10), topicConfig.MaxRecordBytes)
+	topicConfig, err = follower.TopicConfig(DefaultTopic)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), topicConfig.MaxRecordBytes)
+	topicConfig, err = leader.TopicConfig("events")
+	require.NoError(t, err)
+	require.Zero(t, topicConfig.MaxRecordBytes)
+
+	// partitions are added on every server, each a new group
+	_, err = follower.CreatePartitions("events", 3)
+	require.ErrorAs(t, err, &api.ErrNotLeader{})
+	_, err = leader.CreatePartitions("events", 2)
+	require.Error(t, err)
+	_, err = leader.CreatePartitions(DefaultTopic, 3)
+	require.Error(t, err)
+	desc, err = leader.CreatePartitions("events", 3)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), desc.Partitions)
+	require.Equal(t, uint64(1), desc.Version)
+	require.Equal(t, "compact", desc.Configs[CleanupPolicyConfig])
+	var added *DistributedLog
+	require.Eventually(t, func() bool {
+		for _, l := range logs {
+			part, err := l.TopicPartition("events", 2)
+			if err == nil && part.(*DistributedLog).raft.State() == raft.Leader {
+				added = part.(*DistributedLog)
+				return true
+			}
+		}
+		return false
+	}, 3*time.Second, 10*time.Millisecond)
+	_, err = added.Append(&api.Record{Value: []byte("event 2")})
+	require.NoError(t, err)
+	for _, l := range logs {
+		for p := uint32(0); p < 3; p++ {
+			require.Eventually(t, func() bool { return read(l, p) }, time.Second, 10*time.Millisecond)
+		}
+	}
+
+	// a server that restarts reopens the topics, from a snapshot of the
+	// catalog too
+	restarted := logs[2]
+	_, err = restarted.partitions[0].Snapshot()
+	require.NoError(t, err)
+	dir, config := restarted.topics.dir, restarted.config
+	require.NoError(t, restarted.Close())
+	ln, err := net.Listen("tcp", config.Raft.BindAddr)
+	require.NoError(t, err)
+	config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+	restarted, err = NewPartitionedLog(dir, config)
+	require.NoError(t, err)
+	logs[2] = restarted
+	for p := uint32(0); p < 3; p++ {
+		require.Eventually(t, func() bool { return read(restarted, p) }, 3*time.Second, 10*time.Millisecond)
+	}
+	require.True(t, compacted(restarted))
+
+	// and every server removes a deleted topic
+	require.ErrorAs(t, follower.DeleteTopic("events"), &api.ErrNotLeader{})
+	require.Error(t, leader.DeleteTopic(DefaultTopic))
+	require.NoError(t, leader.DeleteTopic("events"))
+	require.ErrorAs(t, leader.DeleteTopic("events"), &api.ErrTopicNotFound{})
+	for _, l := range logs {
+		require.Eventually(t, func() bool {
+			_, err := l.TopicPartition("events", 0)
+			return errors.As(err, &api.ErrTopicNotFound{})
+		}, time.Second, 10*time.Millisecond)
+		require.Empty(t, l.topics.groups())
+		entries, err := os.ReadDir(filepath.Join(l.topics.dir, "groups"))
+		require.NoError(t, err)
+		require.Empty(t, entries)
+	}
+}
@@ -0,0 +1,263 @@
+package log
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// placement follows the zone each server runs in and, on the leader,
+// chooses the voters so they're spread across zones. Servers that aren't
+// voters still replicate the log but don't count towards a quorum.
+type placement struct {
+	raft      *raft.Raft
+	lag       *lagTracker
+	local     raft.ServerID
+	maxVoters int
+	logger    *zap.Logger
+
+	mu    sync.Mutex
+	zones map[raft.ServerID]string
+	// one rebalance at a time
+	rebalancing sync.Mutex
+	done        chan struct{}
+}
+
+func newPlacement(r *raft.Raft, lag *lagTracker, local raft.ServerID, zone string, maxVoters int, logger *zap.Logger) *placement {
+	p := &placement{
+		raft:      r,
+		lag:       lag,
+		local:     local,
+		maxVoters: maxVoters,
+		logger:    logger.Named("placement"),
+		zones:     map[raft.ServerID]string{local: zone},
+		done:      make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// How often the leader retries rebalancing, to apply changes deferred while
+// replicas caught up
+var rebalanceInterval = 10 * time.Second
+
+// Rebalances whenever this server becomes the leader, the previous one may
+// have left the voters lopsided, and every rebalanceInterval after
+func (p *placement) run() {
+	leaderCh := p.raft.LeaderCh()
+	ticker := time.NewTicker(rebalanceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case isLeader := <-leaderCh:
+			if isLeader {
+				p.rebalanceOrLog()
+			}
+		case <-ticker.C:
+			p.rebalanceOrLog()
+		}
+	}
+}
+
+// Records the server's zone, returning whether it changed
+func (p *placement) setZone(id raft.ServerID, zone string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old, ok := p.zones[id]
+	p.zones[id] = zone
+	return !ok || old != zone
+}
+
+func (p *placement) forget(id raft.ServerID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if id != p.local {
+		delete(p.zones, id)
+	}
+}
+
+func (p *placement) zone(id raft.ServerID) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.zones[id]
+}
+
+// Promotes and demotes servers until the voters are the ones placeVoters
+// picks, returning the changes. A dry run only plans them. It does nothing
+// on a follower.
+//
+// Changes go one at a time, promotions first so the cluster never has
+// fewer voters than it needs. A replica taking over from a voter is only
+// promoted once it has caught up, and the voter it replaces only demoted
+// after, so the swap never has a quorum count on a voter still copying
+// the log. Until then both changes are deferred.
+func (p *placement) rebalance(dryRun bool) ([]*api.VoterChange, error) {
+	if p.raft.State() != raft.Leader {
+		return nil, nil
+	}
+	p.rebalancing.Lock()
+	defer p.rebalancing.Unlock()
+	future := p.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+	servers := future.Configuration().Servers
+	p.mu.Lock()
+	zones := make(map[raft.ServerID]string, len(p.zones))
+	for id, zone := range p.zones {
+		zones[id] = zone
+	}
+	p.mu.Unlock()
+
+	voters := placeVoters(servers, zones, p.local, p.maxVoters)
+	var promote, demote []raft.Server
+	for _, srv := range servers {
+		switch {
+		case voters[srv.ID] && srv.Suffrage != raft.Voter:
+			promote = append(promote, srv)
+		case !voters[srv.ID] && srv.Suffrage == raft.Voter:
+			demote = append(demote, srv)
+		}
+	}
+
+	var changes []*api.VoterChange
+	// voters beyond those wanted can go straight away, the rest wait for
+	// their replacement
+	demotable := max(len(demote)-len(promote), 0)
+	swaps := len(demote) - demotable
+	for _, srv := range promote {
+		change := &api.VoterChange{Id: string(srv.ID), Zone: zones[srv.ID], Promote: true}
+		changes = append(changes, change)
+		if swaps > 0 {
+			if !p.lag.caughtUp(srv.ID) {
+				change.Deferred = true
+				continue
+			}
+			swaps--
+			demotable++
+		}
+		if dryRun {
+			continue
+		}
+		if err := p.raft.AddVoter(srv.ID, srv.Address, 0, 0).Error(); err != nil {
+			return changes, err
+		}
+		voterChanges.WithLabelValues("promote").Inc()
+	}
+	for i, srv := range demote {
+		change := &api.VoterChange{Id: string(srv.ID), Zone: zones[srv.ID]}
+		changes = append(changes, change)
+		if i >= demotable {
+			change.Deferred = true
+			continue
+		}
+		if dryRun {
+			continue
+		}
+		if err := p.raft.DemoteVoter(srv.ID, 0, 0).Error(); err != nil {
+			return changes, err
+		}
+		voterChanges.WithLabelValues("demote").Inc()
+	}
+	if zone, ok := criticalZone(voters, zones); ok && !dryRun {
+		p.logger.Warn(
+			"losing one zone would leave too few voters for a quorum",
+			zap.String("zone", zone),
+			zap.Int("voters", len(voters)),
+		)
+	}
+	return changes, nil
+}
+
+// Rebalances in the background of a membership change, which has already
+// succeeded; a failure is retried on the next change or tick
+func (p *placement) rebalanceOrLog() {
+	if _, err := p.rebalance(false); err != nil {
+		p.logger.Error("failed to rebalance voters", zap.Error(err))
+	}
+}
+
+func (p *placement) close() {
+	close(p.done)
+}
+
+// placeVoters picks up to max of the servers, all of them when max is
+// zero, taking one from each zone in turn so the voters are spread as
+// evenly as the zones allow. Servers with no zone count as one zone.
+// Within a zone the leader goes first, then the current voters, so
+// rebalancing only moves the voters it has to.
+func placeVoters(servers []raft.Server, zones map[raft.ServerID]string, leader raft.ServerID, max int) map[raft.ServerID]bool {
+	if max <= 0 || max > len(servers) {
+		max = len(servers)
+	}
+	byZone := make(map[string][]raft.Server)
+	for _, srv := range servers {
+		byZone[zones[srv.ID]] = append(byZone[zones[srv.ID]], srv)
+	}
+	rank := func(srv raft.Server) int {
+		switch {
+		case srv.ID == leader:
+			return 0
+		case srv.Suffrage == raft.Voter:
+			return 1
+		default:
+			return 2
+		}
+	}
+	var order []string
+	for zone, members := range byZone {
+		slices.SortFunc(members, func(a, b raft.Server) int {
+			if ra, rb := rank(a), rank(b); ra != rb {
+				return ra - rb
+			}
+			return cmp.Compare(a.ID, b.ID)
+		})
+		order = append(order, zone)
+	}
+	// the leader's zone first, so it's always picked
+	slices.SortFunc(order, func(a, b string) int {
+		switch zones[leader] {
+		case a:
+			return -1
+		case b:
+			return 1
+		}
+		return cmp.Compare(a, b)
+	})
+
+	voters := make(map[raft.ServerID]bool, max)
+	for round := 0; len(voters) < max; round++ {
+		for _, zone := range order {
+			if members := byZone[zone]; round < len(members) && len(voters) < max {
+				voters[members[round].ID] = true
+			}
+		}
+	}
+	return voters
+}
+
+// A zone whose loss would leave the other voters short of a quorum, if
+// the voters span more than one zone and there is one
+func criticalZone(voters map[raft.ServerID]bool, zones map[raft.ServerID]string) (string, bool) {
+	count := make(map[string]int)
+	for id := range voters {
+		count[zones[id]]++
+	}
+	if len(count) < 2 {
+		return "", false
+	}
+	quorum := len(voters)/2 + 1
+	for zone, n := range count {
+		if len(voters)-n < quorum {
+			return zone, true
+		}
+	}
+	return "", false
+}
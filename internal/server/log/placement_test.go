@@ -0,0 +1,116 @@
+package log
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlaceVoters(t *testing.T) {
+	servers := []raft.Server{
+		{ID: "a1", Suffrage: raft.Voter},
+		{ID: "a2", Suffrage: raft.Voter},
+		{ID: "a3", Suffrage: raft.Voter},
+		{ID: "b1", Suffrage: raft.Nonvoter},
+		{ID: "b2", Suffrage: raft.Nonvoter},
+		{ID: "c1", Suffrage: raft.Nonvoter},
+	}
+	zones := map[raft.ServerID]string{
+		"a1": "a", "a2": "a", "a3": "a",
+		"b1": "b", "b2": "b",
+		"c1": "c",
+	}
+
+	// one per zone in turn, the leader and current voters first
+	voters := placeVoters(servers, zones, "a2", 3)
+	require.Equal(t, map[raft.ServerID]bool{"a2": true, "b1": true, "c1": true}, voters)
+	_, critical := criticalZone(voters, zones)
+	require.False(t, critical)
+
+	voters = placeVoters(servers, zones, "a2", 5)
+	require.Equal(t, map[raft.ServerID]bool{
+		"a1": true, "a2": true, "b1": true, "b2": true, "c1": true,
+	}, voters)
+
+	// no cap makes every server a voter
+	require.Len(t, placeVoters(servers, zones, "a2", 0), len(servers))
+
+	// two zones can't survive losing the bigger one
+	zone, critical := criticalZone(
+		map[raft.ServerID]bool{"a1": true, "a2": true, "b1": true},
+		zones,
+	)
+	require.True(t, critical)
+	require.Equal(t, "a", zone)
+}
+
+func TestZonePlacement(t *testing.T) {
+	lagInterval = 10 * time.Millisecond
+	t.Cleanup(func() { lagInterval = time.Second })
+	zones := []string{"a", "a", "b", "c"}
+	logs := setupCluster(t, len(zones), func(c *Config) {
+		c.Raft.MaxVoters = 3
+		c.Raft.Zone = zones[c.Raft.LocalID[0]-'0']
+	})
+	for _, l := range logs {
+		defer l.Close()
+	}
+	leader := logs[0]
+	// with no zones known the first three to join vote
+	requireVoters(t, leader, "0", "1", "2")
+
+	// learning the zones, the server in c takes over from the second in a.
+	// Recorded without rebalancing, so a dry run shows the plan.
+	for i, l := range logs[1:] {
+		leader.placement.setZone(l.config.Raft.LocalID, zones[i+1])
+	}
+	require.Eventually(t, func() bool {
+		return leader.lag.caughtUp("3")
+	}, time.Second, 10*time.Millisecond)
+	want := []*api.VoterChange{
+		{Id: "3", Zone: "c", Promote: true},
+		{Id: "1", Zone: "a"},
+	}
+	changes, err := leader.Rebalance(true)
+	require.NoError(t, err)
+	require.Equal(t, want, changes)
+	requireVoters(t, leader, "0", "1", "2")
+
+	changes, err = leader.Rebalance(false)
+	require.NoError(t, err)
+	require.Equal(t, want, changes)
+	requireVoters(t, leader, "0", "2", "3")
+
+	// balanced, there's nothing more to do
+	changes, err = leader.Rebalance(true)
+	require.NoError(t, err)
+	require.Empty(t, changes)
+	_, err = logs[1].Rebalance(true)
+	require.Equal(t, api.ErrNotLeader{Leader: leader.config.Raft.BindAddr}, err)
+
+	// losing a voter promotes the replica in its place
+	require.NoError(t, leader.Leave("2"))
+	requireVoters(t, leader, "0", "1", "3")
+}
+
+// Waits for the leader to list exactly the given servers as voters
+func requireVoters(t *testing.T, leader *DistributedLog, ids ...string) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		servers, err := leader.GetServers()
+		if err != nil {
+			return false
+		}
+		var voters []string
+		for _, srv := range servers {
+			if srv.Voter {
+				voters = append(voters, srv.Id)
+			}
+		}
+		return slices.Equal(ids, voters)
+	}, 3*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,198 @@
+package log
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// The file in the log's directory holding the offset the records before
+// were deleted, see DeleteRecords
+const startFile = "start.json"
+
+const (
+	// Set in the length of a store's deleted records, punched out of its
+	// file and framed as one record that scans of the store skip. No
+	// record's length has it, as no store is that big, where a record's
+	// bytes can start with anything, sealed ones with any key ID.
+	holeFlag = 1 << 63
+	// Punching less than a block frees nothing
+	minHoleBytes = 4096
+)
+
+// Reads the length a store frames its records with: how many bytes follow
+// it, and whether they're deleted records punched out
+func frameLen(b []byte) (n uint64, hole bool) {
+	n = enc.Uint64(b)
+	return n &^ holeFlag, n&holeFlag != 0
+}
+
+// Reads the offset the records before were deleted, zero if none were
+func (l *Log) loadStart() error {
+	l.start = 0
+	b, err := os.ReadFile(filepath.Join(l.Dir, startFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var start struct {
+		Offset uint64 `json:"offset"`
+	}
+	if err := json.Unmarshal(b, &start); err != nil {
+		return err
+	}
+	l.start = start.Offset
+	l.segments[0].deleteBefore(l.start)
+	return nil
+}
+
+// Writes the start offset, replacing the file so a crash leaves the old or
+// new one. Callers must hold mu.
+func (l *Log) saveStart() error {
+	b := []byte(`{"offset":` + strconv.FormatUint(l.start, 10) + `}`)
+	path := filepath.Join(l.Dir, startFile)
+	if err := os.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Deletes the records before off in the first segment, which DeleteRecords
+// leaves holding some when it's sealed, persisting off first so the records punched
+// out of its store aren't read again after a restart
+func (l *Log) deleteBefore(off uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	first := l.segments[0]
+	if first == l.activeSegment {
+		// the active segment stays whole, as it's still written
+		return nil
+	}
+	if off > max(l.start, first.baseOffset) {
+		l.start = off
+		if err := l.saveStart(); err != nil {
+			return err
+		}
+		first.deleteBefore(off)
+		l.forgetSums(0, off)
+	}
+	return l.punchDeleted()
+}
+
+// Punches the first segment's deleted records out of its store, unless a
+// link backup still shares it, which would lose them too. Those left are
+// punched by the next deleteBefore or compaction once it doesn't. Callers
+// must hold mu.
+func (l *Log) punchDeleted() error {
+	first := l.segments[0]
+	if first == l.activeSegment {
+		return nil
+	}
+	if shared, err := first.shared(); err != nil || shared {
+		return err
+	}
+	return first.punch()
+}
+
+// deleteBefore stops reads of the records before off, waiting out those
+// made without the log's lock that may not have seen it
+func (s *segment) deleteBefore(off uint64) {
+	s.start.Store(off)
+	for s.readers.Load() > 0 {
+		time.Sleep(10 * time.Microsecond)
+	}
+}
+
+// deleted reports whether the record at off was deleted, though the
+// segment holds it
+func (s *segment) deleted(off uint64) bool {
+	return off < s.start.Load()
+}
+
+// Where the store's records that weren't deleted start
+func (s *segment) livePos() (uint64, error) {
+	start := s.start.Load()
+	if start <= s.baseOffset {
+		return 0, nil
+	}
+	_, pos, err := s.entry(start - s.baseOffset)
+	if errors.Is(err, io.EOF) {
+		// compaction left none after the deleted records
+		return s.store.size, nil
+	}
+	return pos, err
+}
+
+// punch frees the bytes of the store's deleted records, those before
+// the first record or batch with any that weren't, on filesystems that can
+// punch holes in files. They're framed as one record first, so scans of
+// the store skip them even if it's cut short. Callers must hold the log's
+// lock.
+func (s *segment) punch() error {
+	pos, err := s.livePos()
+	if err != nil || pos >= s.store.size || pos < lenWidth+minHoleBytes {
+		return err
+	}
+	f, err := os.OpenFile(s.store.Name(), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, lenWidth)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return err
+	}
+	var punched uint64
+	if n, hole := frameLen(header); hole {
+		punched = lenWidth + n
+	}
+	if pos <= punched {
+		return nil
+	}
+	enc.PutUint64(header, (pos-lenWidth)|holeFlag)
+	if _, err := f.WriteAt(header, 0); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	from := max(punched, lenWidth)
+	if err := punchHole(f, int64(from), int64(pos-from)); errors.Is(err, errors.ErrUnsupported) {
+		// framed, and freed when the segment's removed
+		return nil
+	} else if err != nil {
+		return err
+	}
+	bytesPunched.Add(float64(pos - from))
+	return nil
+}
+
+// Appends a frame of n bytes for deleted records, written as zeros
+func (s *store) appendHole(n uint64) error {
+	s.lock()
+	defer s.unlock()
+	header := make([]byte, lenWidth)
+	enc.PutUint64(header, n|holeFlag)
+	if _, err := s.buf.Write(header); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(s.buf, zeros{}, int64(n)); err != nil {
+		return err
+	}
+	s.size += lenWidth + n
+	storeBytesWritten.Add(float64(lenWidth + n))
+	return nil
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
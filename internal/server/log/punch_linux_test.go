@@ -0,0 +1,110 @@
+package log
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteRecordsPunches(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = entWidth * 10
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	value := func(off uint64) []byte { return bytes.Repeat([]byte{byte('a' + off)}, 2048) }
+	for off := uint64(0); off < 15; off++ {
+		_, err := l.Append(&api.Record{Value: value(off)})
+		require.NoError(t, err)
+	}
+	store := filepath.Join(l.Dir, "0.store")
+	blocks := func() int64 {
+		fi, err := os.Stat(store)
+		require.NoError(t, err)
+		return fi.Sys().(*syscall.Stat_t).Blocks
+	}
+	before := blocks()
+
+	// the deleted records of the sealed segment are read past and punched
+	low, err := l.DeleteRecords(5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), low)
+	_, err = l.Read(3)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+	require.Less(t, blocks(), before)
+	info, err := InspectSegment(store, nil, func(SegmentRecord) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), info.Statuses[RecordPunched])
+	require.Equal(t, uint64(5), info.Statuses[RecordOK])
+	require.NoError(t, l.Close())
+
+	// they stay deleted after a crash, which has the store scanned
+	require.NoError(t, os.Truncate(filepath.Join(l.Dir, "0.index"), int64(c.Segment.MaxIndexBytes)))
+	l, err = NewLog(l.Dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	require.Equal(t, uint64(5), l.Stats().LowWatermark)
+	for off := uint64(5); off < 15; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, value(off), record.Value)
+	}
+	_, err = os.Stat(filepath.Join(l.Dir, quarantineDirName))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// truncating from a deleted record leaves none
+	require.NoError(t, l.TruncateFrom(3))
+	require.Equal(t, uint64(3), l.Stats().LowWatermark)
+	off, err := l.Append(&api.Record{Value: value(3)})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+func TestDeleteRecordsPunchesOnceUnshared(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = entWidth * 10
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer l.Close()
+	for off := uint64(0); off < 15; off++ {
+		_, err := l.Append(&api.Record{Value: bytes.Repeat([]byte{byte('a' + off)}, 2048)})
+		require.NoError(t, err)
+	}
+	backup := filepath.Join(t.TempDir(), "backup")
+	_, err = l.LinkBackup(backup)
+	require.NoError(t, err)
+	punched := func() uint64 {
+		info, err := InspectSegment(filepath.Join(l.Dir, "0.store"), nil, func(SegmentRecord) error { return nil })
+		require.NoError(t, err)
+		return info.Statuses[RecordPunched]
+	}
+
+	// the backup shares the store, so its records are left in it
+	_, err = l.DeleteRecords(5)
+	require.NoError(t, err)
+	require.Zero(t, punched())
+
+	// and punched by the next delete once it doesn't
+	require.NoError(t, os.RemoveAll(backup))
+	_, err = l.DeleteRecords(5)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), punched())
+
+	// or the next compaction
+	_, err = l.LinkBackup(backup)
+	require.NoError(t, err)
+	_, err = l.DeleteRecords(7)
+	require.NoError(t, err)
+	require.NoError(t, os.RemoveAll(backup))
+	_, err = l.Compact(0)
+	require.NoError(t, err)
+	info, err := InspectSegment(filepath.Join(l.Dir, "0.store"), nil, func(SegmentRecord) error { return nil })
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), info.Statuses[RecordOK])
+}
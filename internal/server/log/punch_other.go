@@ -0,0 +1,13 @@
+//go:build !linux
+
+package log
+
+import (
+	"errors"
+	"os"
+)
+
+// Only Linux punches holes in files
+func punchHole(f *os.File, off, n int64) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,46 @@
+package log
+
+import (
+	"sync/atomic"
+)
+
+// ReadAhead reads stores ahead of consumers reading their records in
+// order, a chunk at a time, so the next records come from memory rather
+// than a read each. It caps the memory the chunks hold across every log
+// sharing it; past the cap the kernel is only advised to read ahead. A
+// store holds its chunk until it's read past or the store closes.
+type ReadAhead struct {
+	chunk, maxBytes int64
+	held            atomic.Int64
+}
+
+// NewReadAhead returns a ReadAhead reading chunk bytes ahead, holding at
+// most maxBytes read ahead
+func NewReadAhead(chunk, maxBytes uint64) *ReadAhead {
+	return &ReadAhead{chunk: int64(chunk), maxBytes: int64(maxBytes)}
+}
+
+// Held returns the bytes read ahead in memory
+func (r *ReadAhead) Held() uint64 {
+	return uint64(r.held.Load())
+}
+
+// Takes n bytes from what's left under the cap, reporting whether there
+// was that much
+func (r *ReadAhead) reserve(n int64) bool {
+	for {
+		held := r.held.Load()
+		if held+n > r.maxBytes {
+			return false
+		}
+		if r.held.CompareAndSwap(held, held+n) {
+			readAheadBytes.Add(float64(n))
+			return true
+		}
+	}
+}
+
+func (r *ReadAhead) release(n int64) {
+	r.held.Add(-n)
+	readAheadBytes.Sub(float64(n))
+}
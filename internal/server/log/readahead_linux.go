@@ -0,0 +1,8 @@
+package log
+
+import "golang.org/x/sys/unix"
+
+// Advises the kernel the file will be read from off to off+n soon
+func adviseWillNeed(f file, off, n int64) {
+	_ = unix.Fadvise(int(f.Fd()), off, n, unix.FADV_WILLNEED)
+}
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package log
+
+// Only Linux takes the advice
+func adviseWillNeed(f file, off, n int64) {}
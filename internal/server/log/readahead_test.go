@@ -0,0 +1,59 @@
+package log
+
+import (
+	"fmt"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadAhead(t *testing.T) {
+	readAhead := NewReadAhead(256, 1024)
+	c := Config{ReadAhead: readAhead}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	value := func(off uint64) []byte { return []byte(fmt.Sprintf("record %d", off)) }
+	for off := uint64(0); off < 50; off++ {
+		_, err := l.Append(&api.Record{Value: value(off)})
+		require.NoError(t, err)
+	}
+
+	// reading in order reads ahead, wherever it starts
+	for _, from := range []uint64{0, 20} {
+		for off := from; off < 50; off++ {
+			record, err := l.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, value(off), record.Value)
+		}
+		require.NotZero(t, readAhead.Held())
+	}
+	// as do records appended after the chunk was read ahead
+	_, err = l.Append(&api.Record{Value: value(50)})
+	require.NoError(t, err)
+	record, err := l.Read(50)
+	require.NoError(t, err)
+	require.Equal(t, value(50), record.Value)
+	// and reads out of order read what they read
+	for _, off := range []uint64{7, 3, 42, 3} {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, value(off), record.Value)
+	}
+	require.NoError(t, l.Close())
+	require.Zero(t, readAhead.Held())
+
+	// more than the cap isn't held, the reads carry on without
+	c.ReadAhead = NewReadAhead(256, 128)
+	l, err = NewLog(l.Dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for off := uint64(0); off < 50; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, value(off), record.Value)
+	}
+	require.LessOrEqual(t, c.ReadAhead.Held(), uint64(128))
+}
@@ -0,0 +1,245 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The directory in a log's directory that segments recovery couldn't
+// repair are moved to, each time into one named for when
+const quarantineDirName = "quarantine"
+
+// Checks the segments on disk, by base offset, before they're opened,
+// repairing what a crash leaves behind: a record torn at the end of a
+// store is cut off and an index that doesn't match its store, one still
+// grown to MaxIndexBytes say, is rebuilt from it. Segments that look as
+// Close leaves them aren't read through. A segment with a record that
+// doesn't read, or doesn't frame with records indexed after it, or with
+// offsets that don't rise can't be repaired. It's
+// moved to the quarantine directory as it is, with the segments before
+// it so the log's offsets still carry on from one segment to the next,
+// and the log starts after it. The bases left are returned, and next, the
+// offset the log carries on from when none are.
+func (l *Log) recoverSegments(bases []uint64) (kept []uint64, next uint64, err error) {
+	logger := l.Config.logger().Named("log").With(zap.String("dir", l.Dir))
+	bad := -1
+	for i, base := range bases {
+		storeName := filepath.Join(l.Dir, fmt.Sprintf("%d.store", base))
+		indexName := filepath.Join(l.Dir, fmt.Sprintf("%d.index", base))
+		if ok, err := segmentIntact(storeName, indexName); err != nil {
+			return nil, 0, err
+		} else if ok {
+			continue
+		}
+		scan, err := scanStore(storeName, base, l.Config.Keyring)
+		if errors.Is(err, ErrUnknownKeyID) {
+			return nil, 0, fmt.Errorf("%s: %w, the keyring is missing a key", storeName, err)
+		} else if errors.Is(err, os.ErrNotExist) {
+			// an index without its store, which opens as an empty segment
+			continue
+		}
+		if err != nil && scan == nil {
+			return nil, 0, err
+		} else if err != nil {
+			logger.Error("segment can't be repaired", zap.Uint64("base_offset", base), zap.Error(err))
+			bad = i
+			if next, err = offsetBound(storeName, indexName, base); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if scan.sealed {
+			return nil, 0, fmt.Errorf("%s has sealed records, the log must be opened with its keyring", storeName)
+		}
+		if indexed, err := indexedWithin(indexName, scan.end+1, scan.size); err != nil {
+			return nil, 0, err
+		} else if indexed {
+			// not torn, the records after it were written
+			logger.Error("segment can't be repaired", zap.Uint64("base_offset", base),
+				zap.Error(fmt.Errorf("record at %d doesn't frame, and records after it are indexed", scan.end)))
+			bad = i
+			if next, err = offsetBound(storeName, indexName, base); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		if scan.end < scan.size {
+			if err := truncateStore(storeName, int64(scan.end)); err != nil {
+				return nil, 0, err
+			}
+			logger.Warn("cut off a torn record",
+				zap.Uint64("base_offset", base),
+				zap.Uint64("position", scan.end),
+				zap.Uint64("bytes", scan.size-scan.end),
+			)
+		}
+		if ok, err := checkIndex(indexName, scan, math.MaxUint32+1); err != nil {
+			return nil, 0, err
+		} else if !ok {
+			if err := writeIndex(indexName, scan.entries); err != nil {
+				return nil, 0, err
+			}
+			logger.Warn("rebuilt index", zap.Uint64("base_offset", base), zap.Int("entries", len(scan.entries)))
+		}
+	}
+	if bad < 0 {
+		return bases, 0, nil
+	}
+	if err := l.quarantine(bases[:bad+1]); err != nil {
+		return nil, 0, err
+	}
+	segmentsQuarantined.Add(float64(bad + 1))
+	kept = bases[bad+1:]
+	low := next
+	if len(kept) > 0 {
+		low = kept[0]
+	}
+	logger.Error("quarantined segments that can't be repaired, and those before them",
+		zap.Uint64s("base_offsets", bases[:bad+1]),
+		zap.Uint64("low_watermark", low),
+	)
+	return kept, next, nil
+}
+
+// Moves the segments' files, by base offset, to a new directory in the
+// quarantine directory
+func (l *Log) quarantine(bases []uint64) error {
+	dir := filepath.Join(l.Dir, quarantineDirName, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, base := range bases {
+		for _, ext := range []string{".store", ".index"} {
+			name := fmt.Sprintf("%d%s", base, ext)
+			err := os.Rename(filepath.Join(l.Dir, name), filepath.Join(dir, name))
+			if err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Reports whether the segment looks as Close leaves it, without reading
+// its records: an index of whole entries at rising offsets and positions
+// from the store's start, but for a batch's sharing one, the last of them
+// at the store's last record
+func segmentIntact(storeName, indexName string) (bool, error) {
+	index, err := os.ReadFile(indexName)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	f, err := os.Open(storeName)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	size := uint64(fi.Size())
+	n := uint64(len(index)) / entWidth
+	if uint64(len(index))%entWidth != 0 {
+		return false, nil
+	}
+	if n == 0 {
+		return size == 0, nil
+	}
+	var last uint64
+	for i := uint64(0); i < n; i++ {
+		e := index[i*entWidth:]
+		rel, pos := enc.Uint32(e), enc.Uint64(e[offWidth:entWidth])
+		if i == 0 && pos != 0 || i > 0 && (pos < last || rel <= enc.Uint32(index[(i-1)*entWidth:])) {
+			return false, nil
+		}
+		last = pos
+	}
+	if last+lenWidth > size {
+		return false, nil
+	}
+	length := make([]byte, lenWidth)
+	if _, err := f.ReadAt(length, int64(last)); err != nil && err != io.EOF {
+		return false, err
+	}
+	n, _ = frameLen(length)
+	return last+lenWidth+n == size, nil
+}
+
+// An offset past every one the segment can have handed out, going by the
+// records framed in its store, each with an offset above the last, and
+// the offsets its index has before its positions start falling
+func offsetBound(storeName, indexName string, base uint64) (uint64, error) {
+	f, err := os.Open(storeName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	next := base
+	// a record's length, and what a batch's header says of its records
+	header := make([]byte, lenWidth+batchCodecOff)
+	for pos := uint64(0); pos+lenWidth <= uint64(fi.Size()); {
+		m, err := f.ReadAt(header, int64(pos))
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		n, hole := frameLen(header)
+		if n > uint64(fi.Size())-pos-lenWidth {
+			// torn, or a length that isn't one
+			break
+		}
+		if b := header[lenWidth:m]; !hole && len(b) == batchCodecOff && n >= batchHeaderWidth && isBatch(b) {
+			next = max(next+1, enc.Uint64(b[batchBaseOff:])+uint64(enc.Uint32(b[batchCountOff:])))
+		} else if !hole {
+			next++
+		}
+		pos += lenWidth + n
+	}
+	index, err := os.ReadFile(indexName)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	for i := uint64(0); i+entWidth <= uint64(len(index)); i += entWidth {
+		if i > 0 && enc.Uint64(index[i+offWidth:]) < enc.Uint64(index[i-entWidth+offWidth:]) {
+			break
+		}
+		next = max(next, base+uint64(enc.Uint32(index[i:]))+1)
+	}
+	return next, nil
+}
+
+// Reports whether the index, until its positions fall, has an entry
+// positioned from from up to to
+func indexedWithin(indexName string, from, to uint64) (bool, error) {
+	index, err := os.ReadFile(indexName)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	for i := uint64(0); i+entWidth <= uint64(len(index)); i += entWidth {
+		pos := enc.Uint64(index[i+offWidth:])
+		if i > 0 && pos < enc.Uint64(index[i-entWidth+offWidth:]) {
+			break
+		}
+		if from <= pos && pos < to {
+			return true, nil
+		}
+	}
+	return false, nil
+}
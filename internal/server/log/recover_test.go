@@ -0,0 +1,126 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// A closed log of five records over two segments, 0 to 2 and 3 to 4
+func testRecoverLog(t *testing.T, c Config) (string, Config) {
+	t.Helper()
+	dir := t.TempDir()
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+	return dir, c
+}
+
+// Overwrites the store's first record's bytes so it doesn't read
+func corruptFirstRecord(t *testing.T, name string) {
+	t.Helper()
+	b, err := os.ReadFile(name)
+	require.NoError(t, err)
+	n := enc.Uint64(b)
+	for i := uint64(0); i < n; i++ {
+		b[lenWidth+i] = 0xff
+	}
+	require.NoError(t, os.WriteFile(name, b, 0644))
+}
+
+func TestRecoverRepairsCrash(t *testing.T) {
+	dir, c := testRecoverLog(t, Config{})
+	// as a crash leaves the active segment: the index grown to its max,
+	// and a record half written
+	require.NoError(t, os.Truncate(filepath.Join(dir, "3.index"), int64(c.Segment.MaxIndexBytes)))
+	f, err := os.OpenFile(filepath.Join(dir, "3.store"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 1, 0, 'x'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	off, err := l.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	for off := uint64(0); off < 6; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", off)), record.Value)
+	}
+	_, err = os.Stat(filepath.Join(dir, quarantineDirName))
+	require.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestRecoverQuarantines(t *testing.T) {
+	dir, c := testRecoverLog(t, Config{})
+	// a record that doesn't read, found with the index lost
+	corruptFirstRecord(t, filepath.Join(dir, "0.store"))
+	require.NoError(t, os.Remove(filepath.Join(dir, "0.index")))
+	want, err := os.ReadFile(filepath.Join(dir, "0.store"))
+	require.NoError(t, err)
+
+	// the rest of the log is served, from past the quarantined segment
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), l.Stats().LowWatermark)
+	_, err = l.Read(0)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+	record, err := l.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 4"), record.Value)
+	require.NoError(t, l.Close())
+	quarantined, err := filepath.Glob(filepath.Join(dir, quarantineDirName, "*", "0.store"))
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+	got, err := os.ReadFile(quarantined[0])
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+	report, err := Verify(dir, VerifyOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+
+	// a log whose last segment can't be repaired, a record there not
+	// framing with records indexed after it, carries on past its offsets
+	b, err := os.ReadFile(filepath.Join(dir, "3.store"))
+	require.NoError(t, err)
+	enc.PutUint64(b, uint64(len(b)))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "3.store"), b, 0644))
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	off, err := l.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+func TestRecoverMissingKey(t *testing.T) {
+	keys := NewKeyring()
+	require.NoError(t, keys.Add(1, make([]byte, 32)))
+	dir, c := testRecoverLog(t, Config{Keyring: keys})
+	require.NoError(t, os.Truncate(filepath.Join(dir, "0.index"), 0))
+
+	// a key missing isn't a segment to quarantine
+	c.Keyring = NewKeyring()
+	require.NoError(t, c.Keyring.Add(2, make([]byte, 32)))
+	_, err := NewLog(dir, c)
+	require.ErrorIs(t, err, ErrUnknownKeyID)
+	c.Keyring = keys
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	record, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 0"), record.Value)
+}
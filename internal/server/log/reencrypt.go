@@ -0,0 +1,109 @@
+package log
+
+import (
+	"errors"
+)
+
+// ErrNotEncrypted is returned re-encrypting a log without a Keyring
+var ErrNotEncrypted = errors.New("log isn't encrypted at rest")
+
+// Reencrypt rewrites the sealed segments holding records sealed under any
+// key but the keyring's current one, with ReencryptStore, so keys rotated
+// out can be retired. It holds the log's lock throughout, so appends,
+// compaction and reads of the index cache wait for it, and returns how many
+// segments it rewrote. The active segment is left to be sealed under the
+// current key as it rolls.
+func (l *Log) Reencrypt() (int, error) {
+	keys := l.Config.Keyring
+	if keys == nil {
+		return 0, ErrNotEncrypted
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	current := keys.Current()
+	var n int
+	for i, s := range l.segments {
+		if s == l.activeSegment {
+			continue
+		}
+		stale, err := s.store.staleKeys(current)
+		if err != nil {
+			return n, err
+		}
+		if !stale {
+			continue
+		}
+		err = l.reopenSegment(i, func(s *segment) error {
+			return ReencryptStore(s.store.Name(), keys)
+		})
+		if err != nil {
+			return n, err
+		}
+		l.forgetSums(s.baseOffset, s.nextOffset)
+		if l.archive != nil {
+			if err := l.archive.forget(s.baseOffset); err != nil {
+				return n, err
+			}
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Reencrypt re-encrypts the sealed segments of the topics' partitions,
+// see Log.Reencrypt
+func (t *Topics) Reencrypt() (int, error) {
+	n, err := t.Log.Reencrypt()
+	if err != nil {
+		return n, err
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, tp := range t.topics {
+		for _, l := range tp.partitions {
+			m, err := l.Reencrypt()
+			n += m
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// Reencrypt re-encrypts this server's replica of the log, which every
+// server keeps under its own keys, see Log.Reencrypt
+func (l *DistributedLog) Reencrypt() (int, error) {
+	return l.log.Reencrypt()
+}
+
+// Reencrypt re-encrypts this server's replicas of the partitions and the
+// topics' groups, see Log.Reencrypt
+func (l *PartitionedLog) Reencrypt() (int, error) {
+	var n int
+	for _, d := range append(append([]*DistributedLog{}, l.partitions...), l.topics.groups()...) {
+		m, err := d.Reencrypt()
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Reports whether a record in the store is sealed under a key other than
+// current, reading just the records' key IDs
+func (s *store) staleKeys(current uint32) (bool, error) {
+	header := make([]byte, lenWidth+keyIDWidth)
+	for pos := uint64(0); pos < s.size; {
+		if _, err := s.ReadAt(header, int64(pos)); err != nil {
+			return false, err
+		}
+		n, hole := frameLen(header)
+		if !hole && enc.Uint32(header[lenWidth:]) != current {
+			return true, nil
+		}
+		pos += lenWidth + n
+	}
+	return false, nil
+}
@@ -0,0 +1,52 @@
+package log
+
+import (
+	"fmt"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogReencrypt(t *testing.T) {
+	_, err := (&Log{}).Reencrypt()
+	require.ErrorIs(t, err, ErrNotEncrypted)
+
+	keys := NewKeyring()
+	require.NoError(t, keys.Add(1, key1))
+	c := Config{Keyring: keys}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := range 7 {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, keys.Add(2, key2))
+	n, err := l.Reencrypt()
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// the sealed segments are under the new key, the active one's left
+	l.mu.RLock()
+	for _, s := range l.segments {
+		want := []uint32{2, 2, 2}
+		if s == l.activeSegment {
+			want = []uint32{1}
+		}
+		require.Equal(t, want, frameKeyIDs(t, s.store), "segment %d", s.baseOffset)
+		require.True(t, s == l.activeSegment || s.sealed())
+	}
+	l.mu.RUnlock()
+	for i := range 7 {
+		record, err := l.Read(uint64(i))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+	_, err = l.Append(&api.Record{Value: []byte("record 7")})
+	require.NoError(t, err)
+	n, err = l.Reencrypt()
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
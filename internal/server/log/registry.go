@@ -0,0 +1,64 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+// ErrNodeConflict is returned registering a server under a name or node ID
+// another member's registration has. Two servers sharing an ID are running
+// on copies of one data directory, and a member coming back under its name
+// with another ID has lost the data it replicated; the old registration
+// has to leave the cluster first.
+var ErrNodeConflict = errors.New("node registered with another ID")
+
+// registry holds the registrations of the cluster's members by server ID,
+// the node name, as discovery reports them
+type registry struct {
+	mu    sync.Mutex
+	nodes map[string]*api.Registration
+}
+
+func newRegistry() *registry {
+	return &registry{nodes: make(map[string]*api.Registration)}
+}
+
+// Records the server's registration, replacing what it registered before
+// unless the name or node ID conflicts with another's. Registrations
+// without a node ID, from servers that don't keep one, aren't checked.
+func (r *registry) register(name string, reg *api.Registration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if reg.NodeId != "" {
+		if prev, ok := r.nodes[name]; ok && prev.NodeId != "" && prev.NodeId != reg.NodeId {
+			return fmt.Errorf("%w: %s has ID %s, not %s", ErrNodeConflict, name, prev.NodeId, reg.NodeId)
+		}
+		for other, prev := range r.nodes {
+			if other != name && prev.NodeId == reg.NodeId {
+				return fmt.Errorf("%w: %s has ID %s too", ErrNodeConflict, other, reg.NodeId)
+			}
+		}
+	}
+	r.nodes[name] = reg
+	return nil
+}
+
+func (r *registry) remove(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.nodes, name)
+}
+
+// The server's registration, nil if it hasn't registered or the log
+// keeps no registry
+func (r *registry) get(name string) *api.Registration {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.nodes[name]
+}
@@ -0,0 +1,32 @@
+package log
+
+import (
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry(t *testing.T) {
+	r := newRegistry()
+	require.NoError(t, r.register("0", &api.Registration{NodeId: "a", Version: "1"}))
+	// restarting with the same data directory updates the registration
+	require.NoError(t, r.register("0", &api.Registration{NodeId: "a", Version: "2"}))
+	require.Equal(t, "2", r.get("0").Version)
+
+	// a wiped data directory under the same name
+	require.ErrorIs(t, r.register("0", &api.Registration{NodeId: "b"}), ErrNodeConflict)
+	// a copy of the data directory under another name
+	require.ErrorIs(t, r.register("1", &api.Registration{NodeId: "a"}), ErrNodeConflict)
+	require.Nil(t, r.get("1"))
+	// servers that keep no ID aren't checked
+	require.NoError(t, r.register("2", &api.Registration{}))
+
+	// once the old registration leaves, the name is free
+	r.remove("0")
+	require.NoError(t, r.register("0", &api.Registration{NodeId: "b"}))
+	require.NoError(t, r.register("1", &api.Registration{NodeId: "a"}))
+
+	var none *registry
+	require.Nil(t, none.get("0"))
+}
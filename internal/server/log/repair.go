@@ -0,0 +1,301 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"google.golang.org/protobuf/proto"
+)
+
+// RangeSize is how many offsets each checksum covers when replicas compare
+// their logs, and so the most records one repair fetches at a time
+const RangeSize = 1024
+
+// Replica is another server's copy of the log, which Repair trusts
+type Replica interface {
+	Checksums(ctx context.Context, rangeSize uint64) ([]*api.RangeChecksum, error)
+	// Read returns the records from off up to, not including, end
+	Read(ctx context.Context, off, end uint64) ([]*api.Record, error)
+}
+
+// Repair compares the local log with replica, normally the leader, and
+// rewrites each range that differs with the replica's records, healing
+// records lost or corrupted on this server's disk. Only ranges both hold
+// in full are compared, the tail still replicating is left to Raft. It
+// does nothing on the leader and returns how many records it rewrote.
+func (l *DistributedLog) Repair(ctx context.Context, replica Replica) (int, error) {
+	if l.raft.State() == raft.Leader {
+		return 0, nil
+	}
+	return repair(ctx, l.log, replica)
+}
+
+// Checksums sums the local copy of the log, see Log.Checksums
+func (l *DistributedLog) Checksums(size uint64) ([]*api.RangeChecksum, error) {
+	return l.log.Checksums(size)
+}
+
+func repair(ctx context.Context, l *Log, replica Replica) (int, error) {
+	theirs, err := replica.Checksums(ctx, RangeSize)
+	if err != nil {
+		return 0, err
+	}
+	ours, err := l.Checksums(RangeSize)
+	if err != nil {
+		return 0, err
+	}
+	repaired := 0
+	for _, r := range diverged(ours, theirs) {
+		records, err := replica.Read(ctx, r.BaseOffset, r.NextOffset)
+		if err != nil {
+			return repaired, err
+		}
+		if err := l.Rewrite(records); err != nil {
+			return repaired, err
+		}
+		repaired += len(records)
+		recordsRepaired.Add(float64(len(records)))
+	}
+	return repaired, nil
+}
+
+// Ranges of ours whose checksum differs from the range with the same
+// bounds in theirs
+func diverged(ours, theirs []*api.RangeChecksum) []*api.RangeChecksum {
+	byBase := make(map[uint64]*api.RangeChecksum, len(theirs))
+	for _, r := range theirs {
+		byBase[r.BaseOffset] = r
+	}
+	var ranges []*api.RangeChecksum
+	for _, r := range ours {
+		t, ok := byBase[r.BaseOffset]
+		if ok && t.NextOffset == r.NextOffset && t.Checksum != r.Checksum {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// Checksums sums the log in ranges starting at multiples of size, so
+// replicas holding the same records get the same checksums whatever they
+// have truncated. The first and last ranges may be short. A record that
+// can't be read sums as a marker byte, so its range differs from a healthy
+// replica's.
+func (l *Log) Checksums(size uint64) ([]*api.RangeChecksum, error) {
+	if size == 0 {
+		return nil, fmt.Errorf("range size must be positive")
+	}
+	l.mu.RLock()
+	lowest, next := l.segments[0].baseOffset, l.activeSegment.nextOffset
+	l.mu.RUnlock()
+	var ranges []*api.RangeChecksum
+	for base := lowest; base < next; {
+		end := min((base/size+1)*size, next)
+		sum, err := l.checksumRange(base, end, size)
+		if err != nil {
+			return nil, err
+		}
+		ranges = append(ranges, &api.RangeChecksum{
+			BaseOffset: base,
+			NextOffset: end,
+			Checksum:   sum,
+		})
+		base = end
+	}
+	return ranges, nil
+}
+
+// sumRange is a whole range of size offsets from base
+type sumRange struct {
+	size, base uint64
+}
+
+// Sums the range from base up to end, reusing the sum of a whole range
+// summed before. Only rewrites and truncations change those, see forgetSums.
+func (l *Log) checksumRange(base, end, size uint64) (uint32, error) {
+	key := sumRange{size: size, base: base}
+	whole := end-base == size
+	if whole {
+		l.sumsMu.Lock()
+		sum, ok := l.sums[key]
+		l.sumsMu.Unlock()
+		if ok {
+			return sum, nil
+		}
+	}
+	sum, clean, err := l.checksum(base, end)
+	if err != nil {
+		return 0, err
+	}
+	// a range with unreadable records is summed again, they may read next time
+	if whole && clean {
+		l.sumsMu.Lock()
+		if l.sums == nil {
+			l.sums = make(map[sumRange]uint32)
+		}
+		l.sums[key] = sum
+		l.sumsMu.Unlock()
+	}
+	return sum, nil
+}
+
+// Drops the sums of ranges holding any offset from off up to end
+func (l *Log) forgetSums(off, end uint64) {
+	l.sumsMu.Lock()
+	defer l.sumsMu.Unlock()
+	for key := range l.sums {
+		if key.base < end && off < key.base+key.size {
+			delete(l.sums, key)
+		}
+	}
+}
+
+// Sums the records from off up to end, holding the read lock only for the
+// range. clean reports every record read.
+func (l *Log) checksum(off, end uint64) (sum uint32, clean bool, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	h := crc32.NewIEEE()
+	opts := proto.MarshalOptions{Deterministic: true}
+	clean = true
+	for ; off < end; off++ {
+		s := l.segmentFor(off)
+		if s == nil {
+			return 0, false, api.ErrOffsetOutOfRange{Offset: off}
+		}
+		record, err := s.Read(off)
+		if err != nil {
+			h.Write([]byte{0xff})
+			clean = false
+			continue
+		}
+		if record.Offset > off {
+			// compaction removed the records before it
+			if record.Offset >= end {
+				break
+			}
+			off = record.Offset
+		}
+		b, err := opts.Marshal(record)
+		if err != nil {
+			return 0, false, err
+		}
+		h.Write(b)
+	}
+	return h.Sum32(), clean, nil
+}
+
+// The segment holding off, nil if none does. Callers must hold mu.
+func (l *Log) segmentFor(off uint64) *segment {
+	for _, s := range l.segments {
+		if s.baseOffset <= off && off < s.nextOffset {
+			return s
+		}
+	}
+	return nil
+}
+
+// Rewrite replaces records already in the log, keeping every other one.
+// records must be consecutive. Each segment they fall in is rebuilt beside
+// the log and swapped in, so the log's offsets stay as they were.
+func (l *Log) Rewrite(records []*api.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	from := records[0].Offset
+	replace := make(map[uint64]*api.Record, len(records))
+	for i, record := range records {
+		if record.Offset != from+uint64(i) {
+			return fmt.Errorf("records aren't consecutive at offset %d", record.Offset)
+		}
+		replace[record.Offset] = record
+	}
+	to := from + uint64(len(records))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if from < l.segments[0].baseOffset || to > l.activeSegment.nextOffset {
+		return api.ErrOffsetOutOfRange{Offset: from}
+	}
+	for i, s := range l.segments {
+		if s.nextOffset <= from || s.baseOffset >= to {
+			continue
+		}
+		err := l.rebuild(i, func(record *api.Record) *api.Record {
+			if r, ok := replace[record.Offset]; ok {
+				return r
+			}
+			return record
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rebuilds the i'th segment with each record swapped for what fn returns,
+// dropping those it returns nil for, and forgets what was summed or
+// archived of it. Callers must hold mu.
+func (l *Log) rebuild(i int, fn func(*api.Record) *api.Record) error {
+	s := l.segments[i]
+	rebuilt, err := l.rebuildSegment(s, fn)
+	if err != nil {
+		return err
+	}
+	if s == l.activeSegment {
+		l.activeSegment = rebuilt
+	} else if err = rebuilt.seal(); err != nil {
+		return err
+	}
+	l.segments[i] = rebuilt
+	l.publishSealed()
+	l.forgetSums(s.baseOffset, s.nextOffset)
+	if l.archive != nil {
+		return l.archive.forget(s.baseOffset)
+	}
+	return nil
+}
+
+// Writes a copy of s with its records as fn returns them, keeping their
+// offsets, then moves it over s and reopens it
+func (l *Log) rebuildSegment(s *segment, fn func(*api.Record) *api.Record) (*segment, error) {
+	dir := filepath.Join(l.Dir, "rewrite")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	rebuilt, err := newSegment(dir, s.baseOffset, l.Config)
+	if err != nil {
+		return nil, err
+	}
+	err = s.each(func(record *api.Record) error {
+		if record = fn(record); record == nil {
+			return nil
+		}
+		rebuilt.nextOffset = record.Offset
+		_, err := rebuilt.Append(record)
+		return err
+	})
+	if err != nil {
+		rebuilt.Remove()
+		return nil, err
+	}
+	if err = rebuilt.Close(); err != nil {
+		return nil, err
+	}
+	if err = s.Close(); err != nil {
+		return nil, err
+	}
+	for _, name := range []string{s.store.Name(), s.index.Name()} {
+		if err = os.Rename(filepath.Join(dir, filepath.Base(name)), name); err != nil {
+			return nil, err
+		}
+	}
+	return newSegment(l.Dir, s.baseOffset, l.Config)
+}
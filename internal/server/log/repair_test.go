@@ -0,0 +1,86 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepair(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	healthy := newRepairLog(t, c)
+	damaged := newRepairLog(t, c)
+	for i := 0; i < 10; i++ {
+		for _, l := range []*Log{healthy, damaged} {
+			_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i)), Timestamp: 1})
+			require.NoError(t, err)
+		}
+	}
+	// a record in the middle of a segment goes bad on one copy
+	require.NoError(t, damaged.Rewrite([]*api.Record{{Value: []byte("bad"), Offset: 5, Timestamp: 1}}))
+
+	ours, err := damaged.Checksums(4)
+	require.NoError(t, err)
+	theirs, err := healthy.Checksums(4)
+	require.NoError(t, err)
+	require.Len(t, ours, 3)
+	require.Equal(t, []*api.RangeChecksum{ours[1]}, diverged(ours, theirs))
+
+	n, err := repair(context.Background(), damaged, replicaLog{healthy})
+	require.NoError(t, err)
+	// the whole range the bad record is in is fetched
+	require.Equal(t, 10, n)
+	for off := uint64(0); off < 10; off++ {
+		want, err := healthy.Read(off)
+		require.NoError(t, err)
+		got, err := damaged.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want.Value, got.Value)
+	}
+
+	// appends carry on from where the log was
+	off, err := damaged.Append(&api.Record{Value: []byte("next")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+
+	n, err = repair(context.Background(), damaged, replicaLog{healthy})
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func newRepairLog(t *testing.T, c Config) *Log {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "repair-test")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// replicaLog serves another local log as a Replica
+type replicaLog struct {
+	*Log
+}
+
+func (r replicaLog) Checksums(_ context.Context, size uint64) ([]*api.RangeChecksum, error) {
+	return r.Log.Checksums(size)
+}
+
+func (r replicaLog) Read(_ context.Context, off, end uint64) ([]*api.Record, error) {
+	var records []*api.Record
+	for ; off < end; off++ {
+		record, err := r.Log.Read(off)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
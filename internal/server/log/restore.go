@@ -0,0 +1,249 @@
+package log
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ErrNotEmpty is returned restoring into a directory that already has files
+var ErrNotEmpty = errors.New("directory isn't empty")
+
+// RestoreOptions says how to restore a backup, see Restore
+type RestoreOptions struct {
+	// Force empties the directory first rather than fail with ErrNotEmpty
+	Force bool
+	// Keyring opens encrypted logs' records, see VerifyOptions.Keyring
+	Keyring *Keyring
+}
+
+// RestoreReport says what a restore restored
+type RestoreReport struct {
+	Manifest *BackupManifest
+	Files    int
+	Bytes    int64
+	// RebuiltIndexes are the index files, relative to the directory, that
+	// didn't match their stores and were rebuilt from them
+	RebuiltIndexes []string
+}
+
+// Restore extracts the backup Backup wrote into dir, a data directory the
+// server can open, checking each file against its checksum and each log's
+// segments for offsets that carry on from one record, and one segment, to
+// the next. An index that doesn't match its store is rebuilt from it, and
+// a log in an older format version migrated, see Migrate. dir is locked
+// meanwhile, see LockDir, and if it fails it's left empty.
+func Restore(r io.Reader, dir string, opts RestoreOptions) (*RestoreReport, error) {
+	return restore(dir, opts, func() (*RestoreReport, error) {
+		return extractBackup(r, dir)
+	})
+}
+
+// Restores the files extract puts in dir, see Restore
+func restore(dir string, opts RestoreOptions, extract func() (*RestoreReport, error)) (report *RestoreReport, err error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := LockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		lock.Unlock()
+		if err != nil {
+			_ = os.Remove(filepath.Join(dir, lockFile))
+		}
+	}()
+	if err := emptyDir(dir, opts.Force); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = emptyDir(dir, true)
+		}
+	}()
+	report, err = extract()
+	if err != nil {
+		return nil, err
+	}
+	for _, bl := range report.Manifest.Logs {
+		logDir, err := backupLogDir(dir, bl)
+		if err != nil {
+			return nil, err
+		}
+		rebuilt, err := checkLog(dir, logDir, bl, opts.Keyring)
+		if err != nil {
+			return nil, fmt.Errorf("log %s: %w", bl.Dir, err)
+		}
+		report.RebuiltIndexes = append(report.RebuiltIndexes, rebuilt...)
+		// a backup from before logs were versioned is migrated as it's restored
+		version, _, err := readFormat(logDir)
+		if err == nil {
+			err = migrateLog(logDir, version, FormatVersion)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("log %s: %w", bl.Dir, err)
+		}
+	}
+	return report, nil
+}
+
+// Makes dir, failing with ErrNotEmpty if it has files unless force, when
+// they're removed
+func emptyDir(dir string, force bool) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	// the lock is the restore's own
+	entries = slices.DeleteFunc(entries, func(e os.DirEntry) bool { return e.Name() == lockFile })
+	if len(entries) > 0 && !force {
+		return fmt.Errorf("restoring into %s: %w", dir, ErrNotEmpty)
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Extracts the backup's files into dir, checking each against the sum the
+// checksums trailer has for it
+func extractBackup(r io.Reader, dir string) (*RestoreReport, error) {
+	tr := tar.NewReader(r)
+	report := &RestoreReport{}
+	sums := make(map[string]uint32)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("backup ends before its %s", BackupChecksumsName)
+		} else if err != nil {
+			return nil, err
+		}
+		switch {
+		case report.Manifest == nil && hdr.Name != BackupManifestName:
+			return nil, fmt.Errorf("backup doesn't start with a %s", BackupManifestName)
+		case hdr.Name == BackupManifestName:
+			report.Manifest = &BackupManifest{}
+			if err := json.NewDecoder(tr).Decode(report.Manifest); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", BackupManifestName, err)
+			}
+			if report.Manifest.Format > FormatVersion {
+				return nil, fmt.Errorf("backup is in format version %d, newer than this build's %d: %w", report.Manifest.Format, FormatVersion, ErrFormat)
+			}
+			continue
+		case hdr.Name == BackupChecksumsName:
+			want := make(map[string]uint32)
+			if err := json.NewDecoder(tr).Decode(&want); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", BackupChecksumsName, err)
+			}
+			for name, sum := range sums {
+				if w, ok := want[name]; !ok || w != sum {
+					return nil, fmt.Errorf("%s doesn't match its checksum", name)
+				}
+			}
+			for name := range want {
+				if _, ok := sums[name]; !ok {
+					return nil, fmt.Errorf("%s is missing from the backup", name)
+				}
+			}
+			return report, nil
+		}
+		path := filepath.FromSlash(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !filepath.IsLocal(path) {
+			return nil, fmt.Errorf("backup has an unexpected entry %q", hdr.Name)
+		}
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			return nil, err
+		}
+		h := crc32.NewIEEE()
+		n, err := io.Copy(io.MultiWriter(f, h), tr)
+		if err == nil {
+			err = f.Sync()
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		sums[hdr.Name] = h.Sum32()
+		report.Files++
+		report.Bytes += n
+	}
+}
+
+// The directory the log is restored into under root, failing for one the
+// manifest names outside it
+func backupLogDir(root string, bl BackupLog) (string, error) {
+	path := filepath.FromSlash(bl.Dir)
+	if !filepath.IsLocal(path) || slices.Contains(strings.Split(bl.Dir, "/"), "..") {
+		return "", fmt.Errorf("backup has an unexpected log directory %q", bl.Dir)
+	}
+	return filepath.Join(root, path), nil
+}
+
+// Checks the segments of the log in dir, under root, hold the records the
+// manifest says they do, up to the next segment's, returning the indexes
+// it rebuilt
+func checkLog(root, dir string, bl BackupLog, keys *Keyring) (rebuilt []string, err error) {
+	for i, seg := range bl.Segments {
+		if i > 0 && bl.Segments[i-1].NextOffset != seg.BaseOffset {
+			return nil, fmt.Errorf("segment %d ends at %d, not where segment %d starts",
+				bl.Segments[i-1].BaseOffset, bl.Segments[i-1].NextOffset, seg.BaseOffset)
+		}
+		if seg.NextOffset < seg.BaseOffset {
+			return nil, fmt.Errorf("segment %d ends before it starts", seg.BaseOffset)
+		}
+		scan, err := scanStore(filepath.Join(dir, fmt.Sprintf("%d.store", seg.BaseOffset)), seg.BaseOffset, keys)
+		if err != nil {
+			return nil, err
+		}
+		if scan.end < scan.size {
+			return nil, fmt.Errorf("%d.store: record at %d is torn", seg.BaseOffset, scan.end)
+		}
+		if !scan.sealed && scan.next != seg.NextOffset {
+			return nil, fmt.Errorf("%d.store: records end at %d, the segment at %d", seg.BaseOffset, scan.next, seg.NextOffset)
+		}
+		span := seg.NextOffset - seg.BaseOffset
+		indexName := filepath.Join(dir, fmt.Sprintf("%d.index", seg.BaseOffset))
+		ok, err := checkIndex(indexName, scan, span)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			continue
+		}
+		if scan.sealed {
+			// the offsets are only known for a segment with a record for each
+			if uint64(len(scan.entries)) != span {
+				return nil, fmt.Errorf("%d.index doesn't match its store, which can't be reindexed without the keyring", seg.BaseOffset)
+			}
+			for i := range scan.entries {
+				scan.entries[i].rel = uint32(i)
+			}
+		}
+		if err := writeIndex(indexName, scan.entries); err != nil {
+			return nil, err
+		}
+		rel, _ := filepath.Rel(root, indexName)
+		rebuilt = append(rebuilt, filepath.ToSlash(rel))
+	}
+	return rebuilt, nil
+}
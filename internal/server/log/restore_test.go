@@ -0,0 +1,211 @@
+package log
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// A backup of a log of five records over two segments
+func testBackup(t *testing.T, c Config) []byte {
+	t.Helper()
+	c.Segment.MaxIndexBytes = entWidth * 3
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer l.Close()
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	var buf bytes.Buffer
+	_, err = l.Backup(&buf)
+	require.NoError(t, err)
+	return buf.Bytes()
+}
+
+// Rewrites the backup's files with fn, summing them again unless it's
+// told not to
+func rewriteBackup(t *testing.T, backup []byte, resum bool, fn func(name string, b []byte) []byte) []byte {
+	t.Helper()
+	tr := tar.NewReader(bytes.NewReader(backup))
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	sums := make(map[string]uint32)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require.NoError(t, err)
+		switch hdr.Name {
+		case BackupManifestName:
+		case BackupChecksumsName:
+			if resum {
+				b, err = json.Marshal(sums)
+				require.NoError(t, err)
+			}
+		default:
+			b = fn(hdr.Name, b)
+			sums[hdr.Name] = crc32.ChecksumIEEE(b)
+		}
+		hdr.Size = int64(len(b))
+		require.NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(b)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestRestore(t *testing.T) {
+	backup := testBackup(t, Config{})
+	dir := t.TempDir()
+	report, err := Restore(bytes.NewReader(backup), dir, RestoreOptions{})
+	require.NoError(t, err)
+	require.Equal(t, 5, report.Files)
+	require.Empty(t, report.RebuiltIndexes)
+	require.Equal(t, uint64(5), report.Manifest.Logs[0].NextOffset)
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	record, err := l.Read(4)
+	require.NoError(t, err)
+	require.Equal(t, []byte("record 4"), record.Value)
+	require.NoError(t, l.Close())
+
+	// only over a directory with files when forced
+	_, err = Restore(bytes.NewReader(backup), dir, RestoreOptions{})
+	require.ErrorIs(t, err, ErrNotEmpty)
+	_, err = Restore(bytes.NewReader(backup), dir, RestoreOptions{Force: true})
+	require.NoError(t, err)
+}
+
+func TestRestoreRebuildsIndexes(t *testing.T) {
+	keys := NewKeyring()
+	require.NoError(t, keys.Add(1, make([]byte, 32)))
+	// encrypted, the records are indexed one to an offset without the keyring
+	for _, c := range []Config{{}, {Keyring: keys}} {
+		// a lost index and one cut short are rebuilt from their stores
+		backup := rewriteBackup(t, testBackup(t, c), true, func(name string, b []byte) []byte {
+			switch name {
+			case "0.index":
+				return nil
+			case "3.index":
+				return b[:entWidth]
+			}
+			return b
+		})
+		dir := t.TempDir()
+		report, err := Restore(bytes.NewReader(backup), dir, RestoreOptions{})
+		require.NoError(t, err)
+		require.Equal(t, []string{"0.index", "3.index"}, report.RebuiltIndexes)
+		l, err := NewLog(dir, c)
+		require.NoError(t, err)
+		for off := uint64(0); off < 5; off++ {
+			record, err := l.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+		}
+		require.NoError(t, l.Close())
+	}
+}
+
+func TestRestoreErrors(t *testing.T) {
+	backup := testBackup(t, Config{})
+	restore := func(backup []byte) error {
+		dir := t.TempDir()
+		_, err := Restore(bytes.NewReader(backup), dir, RestoreOptions{})
+		// a failed restore leaves nothing behind
+		entries, rerr := os.ReadDir(dir)
+		require.NoError(t, rerr)
+		require.Empty(t, entries)
+		return err
+	}
+
+	// a file that doesn't match its checksum
+	corrupt := rewriteBackup(t, backup, false, func(name string, b []byte) []byte {
+		if name == "3.store" {
+			b[len(b)-1] ^= 0xff
+		}
+		return b
+	})
+	require.ErrorContains(t, restore(corrupt), "3.store doesn't match its checksum")
+
+	// a backup cut short
+	require.Error(t, restore(backup[:len(backup)/2]))
+
+	// a store missing its last record, checksums and all
+	short := rewriteBackup(t, backup, true, func(name string, b []byte) []byte {
+		if name == "3.store" {
+			return b[:len(b)/2+lenWidth]
+		}
+		return b
+	})
+	require.ErrorContains(t, restore(short), "is torn")
+
+	// offsets that don't carry on from one segment to the next
+	gap := rewriteBackup(t, backup, true, func(name string, b []byte) []byte {
+		if name == "0.store" {
+			records := b[:0:0]
+			for pos := 0; pos < len(b); {
+				n := lenWidth + int(enc.Uint64(b[pos:]))
+				// the last record of the first segment goes missing
+				if pos+n < len(b) {
+					records = append(records, b[pos:pos+n]...)
+				}
+				pos += n
+			}
+			return records
+		}
+		return b
+	})
+	require.ErrorContains(t, restore(gap), "records end at 2, the segment at 3")
+
+	// names that would escape the directory
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{BackupManifestName, "../escape"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 2}))
+		_, err := tw.Write([]byte("{}"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.ErrorContains(t, restore(buf.Bytes()), `unexpected entry "../escape"`)
+}
+
+func TestRestoreManifestEscapes(t *testing.T) {
+	// a log beside the data directory, which the manifest's would be
+	root := t.TempDir()
+	outside := filepath.Join(root, "escape")
+	require.NoError(t, os.Mkdir(outside, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "0.store"), nil, 0644))
+	for _, logDir := range []string{"../escape", "topics/../../escape", "/escape", "topics/.."} {
+		manifest, err := json.Marshal(BackupManifest{Logs: []BackupLog{{Dir: logDir}}})
+		require.NoError(t, err)
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for _, f := range []struct {
+			name string
+			b    []byte
+		}{{BackupManifestName, manifest}, {BackupChecksumsName, []byte("{}")}} {
+			require.NoError(t, tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0644, Size: int64(len(f.b))}))
+			_, err := tw.Write(f.b)
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		_, err = Restore(&buf, filepath.Join(root, "data"), RestoreOptions{Force: true})
+		require.ErrorContains(t, err, fmt.Sprintf("unexpected log directory %q", logDir))
+		_, err = os.Stat(filepath.Join(outside, formatFile))
+		require.ErrorIs(t, err, os.ErrNotExist)
+	}
+}
@@ -0,0 +1,407 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/bufpool"
+	"google.golang.org/protobuf/proto"
+)
+
+// Segment—a store and index pair holding the records from baseOffset onwards
+type segment struct {
+	store                  *store
+	index                  *index
+	baseOffset, nextOffset uint64
+	config                 Config
+	// reads of the sealed segment made without the log's lock, see
+	// Log.readSealed
+	readers atomic.Int64
+	// the batch read last, so reading its records in turn decodes it once
+	batch atomic.Pointer[recordBatch]
+	// start is the offset the records before were deleted, see
+	// Log.DeleteRecords
+	start atomic.Uint64
+}
+
+func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
+	s := &segment{
+		baseOffset: baseOffset,
+		config:     c,
+	}
+	storeFile, err := openStoreFile(
+		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
+		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		c,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if c.Keyring != nil {
+		s.store, err = newEncryptedStore(storeFile, c.Keyring, c.logger())
+	} else {
+		s.store, err = newStore(storeFile, c.logger())
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.store.readAhead = c.ReadAhead
+	indexFile, err := openSegmentFile(
+		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
+		os.O_RDWR|os.O_CREATE,
+		c.Faults,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if s.index, err = newIndex(indexFile, c); err != nil {
+		return nil, err
+	}
+	// Pick up where the segment left off if it already has entries
+	if off, _, err := s.index.Read(-1); err != nil {
+		s.nextOffset = baseOffset
+	} else {
+		s.nextOffset = baseOffset + uint64(off) + 1
+	}
+	return s, nil
+}
+
+// Append writes the record to the store and indexes it, returning its offset
+func (s *segment) Append(record *api.Record) (offset uint64, err error) {
+	cur := s.nextOffset
+	record.Offset = cur
+	p, err := proto.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	_, pos, err := s.store.Append(p)
+	if err != nil {
+		return 0, err
+	}
+	if err = s.index.Write(
+		// index offsets are relative to the base offset
+		uint32(s.nextOffset-s.baseOffset),
+		pos,
+	); err != nil {
+		return 0, err
+	}
+	s.nextOffset++
+	return cur, nil
+}
+
+// appendBatch writes the records to the store as a batch and indexes each
+// at its position, returning the last's offset
+func (s *segment) appendBatch(records []*api.Record, codec api.Codec) (offset uint64, err error) {
+	for i, record := range records {
+		record.Offset = s.nextOffset + uint64(i)
+	}
+	p, err := marshalBatch(records, codec)
+	if err != nil {
+		return 0, err
+	}
+	_, pos, err := s.store.Append(p)
+	if err != nil {
+		return 0, err
+	}
+	for range records {
+		if err = s.index.Write(uint32(s.nextOffset-s.baseOffset), pos); err != nil {
+			return 0, err
+		}
+		s.nextOffset++
+	}
+	return s.nextOffset - 1, nil
+}
+
+// How many more records the index has room for
+func (s *segment) room() int {
+	return int((s.config.Segment.MaxIndexBytes - s.index.size) / entWidth)
+}
+
+// Read returns the record at off, or the first one after it compaction
+// left, see Log.Compact
+func (s *segment) Read(off uint64) (*api.Record, error) {
+	if s.deleted(off) {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	_, pos, err := s.entry(off - s.baseOffset)
+	if err != nil {
+		return nil, err
+	}
+	return s.readAt(off, pos)
+}
+
+// Reads the record at off stored at pos, on its own or in a batch
+func (s *segment) readAt(off, pos uint64) (*api.Record, error) {
+	var p *[]byte
+	b, _, err := s.unbatch(off, pos, func() ([]byte, error) {
+		var err error
+		if p, err = s.store.readPooled(pos); err != nil {
+			return nil, err
+		}
+		return *p, nil
+	})
+	if p != nil {
+		// Unmarshal copies what it keeps, so the buffer goes straight back
+		defer bufpool.Put(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &api.Record{}
+	err = proto.Unmarshal(b, record)
+	return record, err
+}
+
+// readTo is Read's, into record with its bytes in dst grown if it's too
+// short, see Log.ReadTo
+func (s *segment) readTo(off uint64, dst []byte, record *api.Record) ([]byte, error) {
+	if s.deleted(off) {
+		return dst, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	_, pos, err := s.entry(off - s.baseOffset)
+	if err != nil {
+		return dst, err
+	}
+	b, batched, err := s.unbatch(off, pos, func() ([]byte, error) {
+		stored, err := s.store.ReadTo(pos, dst)
+		if err == nil {
+			dst = stored
+		}
+		return stored, err
+	})
+	if err != nil {
+		return dst, err
+	}
+	if batched {
+		b = append(dst[:0], b...)
+	}
+	return b, unmarshalRecord(b, record)
+}
+
+// readMarshaled returns the record at off as it's stored, opened if it's
+// sealed, in a buffer from bufpool
+func (s *segment) readMarshaled(off uint64) (*[]byte, error) {
+	if s.deleted(off) {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	_, pos, err := s.entry(off - s.baseOffset)
+	if err != nil {
+		return nil, err
+	}
+	var p *[]byte
+	b, batched, err := s.unbatch(off, pos, func() ([]byte, error) {
+		var err error
+		if p, err = s.store.readPooled(pos); err != nil {
+			return nil, err
+		}
+		return *p, nil
+	})
+	if err != nil {
+		if p != nil {
+			bufpool.Put(p)
+		}
+		return nil, err
+	}
+	if !batched {
+		return p, nil
+	}
+	if p != nil {
+		bufpool.Put(p)
+	}
+	// the batch decoded is shared, the record's copied out of it
+	p = bufpool.Get(len(b))
+	*p = append((*p)[:0], b...)
+	return p, nil
+}
+
+// Returns the record at off from what's stored at pos, reading it with
+// read unless it's the batch read last: what's read when it's a record, or
+// its record in the batch, a slice of the batch decoded, when it's one
+func (s *segment) unbatch(off, pos uint64, read func() ([]byte, error)) (record []byte, batched bool, err error) {
+	b := s.batch.Load()
+	if b == nil || b.pos != pos {
+		stored, err := read()
+		if err != nil || !isBatch(stored) {
+			return stored, false, err
+		}
+		if b, err = unmarshalBatch(stored); err != nil {
+			return nil, false, fmt.Errorf("record batch at %d: %w", pos, err)
+		}
+		b.pos = pos
+		s.batch.Store(b)
+	}
+	record, err = b.record(off)
+	return record, true, err
+}
+
+// The index entry of the record at the relative offset rel, or of the
+// first one after it. An uncompacted segment has an entry per offset, in a
+// compacted one the entries are still in order but skip the offsets
+// compaction removed.
+func (s *segment) entry(rel uint64) (in int64, pos uint64, err error) {
+	out, pos, err := s.index.Read(int64(rel))
+	if err == nil && uint64(out) == rel {
+		return int64(rel), pos, nil
+	}
+	n := int(s.index.size / entWidth)
+	i := sort.Search(n, func(i int) bool {
+		out, _, _ := s.index.Read(int64(i))
+		return uint64(out) >= rel
+	})
+	if i == n {
+		return 0, 0, io.EOF
+	}
+	_, pos, err = s.index.Read(int64(i))
+	return int64(i), pos, err
+}
+
+// each calls fn with the segment's records in order, those deleted aside,
+// stopping at the first error
+func (s *segment) each(fn func(*api.Record) error) error {
+	for in := int64(0); in < int64(s.index.size/entWidth); in++ {
+		rel, pos, err := s.index.Read(in)
+		if err != nil {
+			return err
+		}
+		if s.deleted(s.baseOffset + uint64(rel)) {
+			continue
+		}
+		record, err := s.readAt(s.baseOffset+uint64(rel), pos)
+		if err != nil {
+			return err
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncateFrom drops the record at off and every one after it
+func (s *segment) truncateFrom(off uint64) error {
+	if off >= s.nextOffset {
+		return nil
+	}
+	s.unseal()
+	off = max(off, s.baseOffset)
+	in, pos, err := s.entry(off - s.baseOffset)
+	if errors.Is(err, io.EOF) {
+		// compaction left no records from off on
+		s.nextOffset = off
+		return nil
+	} else if err != nil {
+		return err
+	}
+	// off's batch keeps the records before it, appended again as a batch
+	first := in
+	for first > 0 {
+		if _, prev, err := s.index.Read(first - 1); err != nil || prev != pos {
+			break
+		}
+		first--
+	}
+	var kept []*api.Record
+	for i := first; i < in; i++ {
+		rel, _, err := s.index.Read(i)
+		if err != nil {
+			return err
+		}
+		record, err := s.readAt(s.baseOffset+uint64(rel), pos)
+		if err != nil {
+			return err
+		}
+		kept = append(kept, record)
+	}
+	s.batch.Store(nil)
+	if err = s.store.Truncate(pos); err != nil {
+		return err
+	}
+	s.index.truncate(uint64(first))
+	if len(kept) > 0 {
+		s.nextOffset = kept[0].Offset
+		if _, err := s.appendBatch(kept, s.config.Batch.Codec); err != nil {
+			return err
+		}
+	}
+	s.nextOffset = off
+	return nil
+}
+
+// seal marks the segment read only, once it's rolled over, so it's read
+// without locks
+func (s *segment) seal() error {
+	if err := s.store.seal(); err != nil {
+		return err
+	}
+	s.index.seal()
+	return nil
+}
+
+func (s *segment) sealed() bool {
+	return s.store.sealed.Load()
+}
+
+// acquire starts a read without the log's lock, failing once the segment
+// is no longer sealed. release ends it.
+func (s *segment) acquire() bool {
+	s.readers.Add(1)
+	if s.sealed() {
+		return true
+	}
+	s.readers.Add(-1)
+	return false
+}
+
+func (s *segment) release() {
+	s.readers.Add(-1)
+}
+
+// unseal waits out the reads made without the log's lock before the
+// segment's changed or closed, callers must hold the log's lock
+func (s *segment) unseal() {
+	s.store.sealed.Store(false)
+	// reads are a pread or two, the wait's short
+	for s.readers.Load() > 0 {
+		time.Sleep(10 * time.Microsecond)
+	}
+	s.index.unseal()
+}
+
+// IsMaxed reports whether either the store or the index is full
+func (s *segment) IsMaxed() bool {
+	return s.store.size >= s.config.Segment.MaxStoreBytes ||
+		s.index.size+entWidth > s.config.Segment.MaxIndexBytes
+}
+
+// Sync commits the store and then the index, so an indexed record is always on disk
+func (s *segment) Sync() error {
+	if err := s.store.Sync(); err != nil {
+		return err
+	}
+	return s.index.Sync()
+}
+
+func (s *segment) Remove() error {
+	if err := s.Close(); err != nil {
+		return err
+	}
+	if err := os.Remove(s.index.Name()); err != nil {
+		return err
+	}
+	return os.Remove(s.store.Name())
+}
+
+func (s *segment) Close() error {
+	s.unseal()
+	if err := s.index.Close(); err != nil {
+		return err
+	}
+	return s.store.Close()
+}
@@ -0,0 +1,165 @@
+package log
+
+import (
+	"cmp"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+var (
+	// How long a checksum session lasts without a request
+	checksumSessionTimeout = 10 * time.Minute
+	// Most checksum sessions a log keeps, the least recently used go first
+	maxChecksumSessions = 1000
+)
+
+// checksumSession is what a replica was last sent, so the next response
+// only needs what changed
+type checksumSession struct {
+	epoch uint64
+	size  uint64
+	sent  map[uint64]*api.RangeChecksum
+	used  time.Time
+}
+
+// checksumSessions are the sessions a log answers Checksums callers in.
+// Replicas repairing against the log ask every repair interval, and once
+// they've had the full list most ranges haven't changed since.
+type checksumSessions struct {
+	mu       sync.Mutex
+	sessions map[uint64]*checksumSession
+}
+
+// Answers a request in session id at epoch with ranges, the log's current
+// checksums. The session starts over, with a new ID and a full response,
+// when the log doesn't have it or the caller missed a response.
+func (s *checksumSessions) respond(ranges []*api.RangeChecksum, size, id, epoch uint64) *api.GetChecksumsResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.sessions == nil {
+		s.sessions = make(map[uint64]*checksumSession)
+	}
+	for sid, sess := range s.sessions {
+		if now.Sub(sess.used) > checksumSessionTimeout {
+			delete(s.sessions, sid)
+		}
+	}
+	sess, ok := s.sessions[id]
+	incremental := ok && sess.epoch == epoch && sess.size == size
+	if !incremental {
+		delete(s.sessions, id)
+		id = s.newID()
+		sess = &checksumSession{size: size}
+		s.sessions[id] = sess
+		s.evict()
+		checksumSessionsOpened.Inc()
+	}
+	res := &api.GetChecksumsResponse{
+		SessionId:    id,
+		SessionEpoch: sess.epoch + 1,
+		Incremental:  incremental,
+	}
+	sent := make(map[uint64]*api.RangeChecksum, len(ranges))
+	for _, r := range ranges {
+		sent[r.BaseOffset] = r
+		prev, ok := sess.sent[r.BaseOffset]
+		if !incremental || !ok || prev.NextOffset != r.NextOffset || prev.Checksum != r.Checksum {
+			res.Ranges = append(res.Ranges, r)
+		}
+	}
+	if incremental {
+		for base := range sess.sent {
+			if _, ok := sent[base]; !ok {
+				res.Removed = append(res.Removed, base)
+			}
+		}
+		slices.Sort(res.Removed)
+	}
+	sess.epoch++
+	sess.sent = sent
+	sess.used = now
+	response := "full"
+	if incremental {
+		response = "incremental"
+	}
+	checksumRangesSent.WithLabelValues(response).Add(float64(len(res.Ranges)))
+	return res
+}
+
+// A session ID no session has, never zero. Callers must hold mu.
+func (s *checksumSessions) newID() uint64 {
+	for {
+		id := rand.Uint64()
+		if _, ok := s.sessions[id]; id != 0 && !ok {
+			return id
+		}
+	}
+}
+
+// Drops the least recently used sessions past maxChecksumSessions.
+// Callers must hold mu.
+func (s *checksumSessions) evict() {
+	for len(s.sessions) > maxChecksumSessions {
+		var oldest uint64
+		for id, sess := range s.sessions {
+			if oldest == 0 || sess.used.Before(s.sessions[oldest].used) {
+				oldest = id
+			}
+		}
+		delete(s.sessions, oldest)
+	}
+}
+
+// SessionChecksums sums the log as Checksums does, answering within the
+// checksum session id at epoch: once a caller has had every range, later
+// responses hold only what changed. Zero id and epoch start a session.
+func (l *Log) SessionChecksums(size, id, epoch uint64) (*api.GetChecksumsResponse, error) {
+	ranges, err := l.Checksums(size)
+	if err != nil {
+		return nil, err
+	}
+	return l.sessions.respond(ranges, size, id, epoch), nil
+}
+
+// SessionChecksums sums the local copy of the log within a checksum
+// session, see Log.SessionChecksums
+func (l *DistributedLog) SessionChecksums(size, id, epoch uint64) (*api.GetChecksumsResponse, error) {
+	return l.log.SessionChecksums(size, id, epoch)
+}
+
+// ChecksumSession is a replica's side of a checksum session: the other
+// server's checksums as of its last response, which later ones update
+type ChecksumSession struct {
+	ID    uint64
+	Epoch uint64
+
+	ranges map[uint64]*api.RangeChecksum
+}
+
+// Apply updates the session with the response to a request made with its
+// ID and epoch, returning every range the other server has, in order
+func (s *ChecksumSession) Apply(res *api.GetChecksumsResponse) []*api.RangeChecksum {
+	if !res.Incremental || s.ranges == nil {
+		s.ranges = make(map[uint64]*api.RangeChecksum, len(res.Ranges))
+	}
+	for _, base := range res.Removed {
+		delete(s.ranges, base)
+	}
+	for _, r := range res.Ranges {
+		s.ranges[r.BaseOffset] = r
+	}
+	s.ID, s.Epoch = res.SessionId, res.SessionEpoch
+	ranges := make([]*api.RangeChecksum, 0, len(s.ranges))
+	for _, r := range s.ranges {
+		ranges = append(ranges, r)
+	}
+	slices.SortFunc(ranges, func(a, b *api.RangeChecksum) int {
+		return cmp.Compare(a.BaseOffset, b.BaseOffset)
+	})
+	return ranges
+}
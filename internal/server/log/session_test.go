@@ -0,0 +1,70 @@
+package log
+
+import (
+	"fmt"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChecksumSessions(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	l := newRepairLog(t, c)
+	appendN := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i)), Timestamp: 1})
+			require.NoError(t, err)
+		}
+	}
+	appendN(6)
+	var session ChecksumSession
+	respond := func() *api.GetChecksumsResponse {
+		t.Helper()
+		res, err := l.SessionChecksums(4, session.ID, session.Epoch)
+		require.NoError(t, err)
+		ranges := session.Apply(res)
+		want, err := l.Checksums(4)
+		require.NoError(t, err)
+		require.Equal(t, want, ranges)
+		return res
+	}
+
+	// the first response is in full
+	res := respond()
+	require.False(t, res.Incremental)
+	require.NotZero(t, res.SessionId)
+	require.Equal(t, uint64(1), res.SessionEpoch)
+	require.Len(t, res.Ranges, 2)
+
+	// nothing changed, nothing sent
+	res = respond()
+	require.True(t, res.Incremental)
+	require.Equal(t, uint64(2), res.SessionEpoch)
+	require.Empty(t, res.Ranges)
+
+	// the short last range grew and a new one started
+	appendN(3)
+	res = respond()
+	require.True(t, res.Incremental)
+	require.Equal(t, []uint64{4, 8}, []uint64{res.Ranges[0].BaseOffset, res.Ranges[1].BaseOffset})
+
+	// a rewritten record changes its range's sum, even though it was whole
+	require.NoError(t, l.Rewrite([]*api.Record{{Value: []byte("rewritten"), Offset: 1, Timestamp: 1}}))
+	res = respond()
+	require.Len(t, res.Ranges, 1)
+	require.Equal(t, uint64(0), res.Ranges[0].BaseOffset)
+
+	// truncated ranges are removed
+	require.NoError(t, l.Truncate(3))
+	res = respond()
+	require.Equal(t, []uint64{0}, res.Removed)
+
+	// a caller that missed a response starts over
+	id := session.ID
+	res, err := l.SessionChecksums(4, id, session.Epoch-1)
+	require.NoError(t, err)
+	require.False(t, res.Incremental)
+	require.NotEqual(t, id, res.SessionId)
+}
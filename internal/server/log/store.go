@@ -3,8 +3,14 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
+	"math"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/frankie-mur/proglog/internal/bufpool"
+	"go.uber.org/zap"
 )
 
 var (
@@ -17,31 +23,75 @@ const (
 
 // Store—the file we store records in
 type store struct {
-	*os.File               // Embedded file for persistent storage
-	mu       sync.Mutex    // For thread-safe operations
-	buf      *bufio.Writer // Buffered writer for performance
-	size     uint64        // Tracks total size of the store
+	file                 // Embedded file for persistent storage
+	mu     sync.Mutex    // For thread-safe operations
+	buf    *bufio.Writer // Buffered writer for performance
+	size   uint64        // Tracks total size of the store
+	keys   *Keyring      // Optional at-rest encryption, nil stores plaintext
+	logger *zap.Logger
+
+	flushes   uint64 // Buffer flushes so far
+	lastFlush time.Time
+	// syncing has the flush Sync makes sync too, on a file that can
+	syncing bool
+
+	// sealed is set once the store's flushed for good, it's read without mu
+	// from then on, see seal
+	sealed atomic.Bool
+
+	// readAhead reads ahead of records read in order, nil doesn't
+	readAhead *ReadAhead
+	ahead     atomic.Pointer[aheadChunk]
+	lastRead  atomic.Uint64 // Where the last record read ends
+}
+
+// A chunk of the store read ahead, from pos on. It doesn't change once
+// read, so sealed reads share it without mu.
+type aheadChunk struct {
+	pos uint64
+	b   []byte
 }
 
 // Wraper around a file - with file size
-func newStore(f *os.File) (*store, error) {
+func newStore(f file, logger *zap.Logger) (*store, error) {
 	fi, err := os.Stat(f.Name())
 	if err != nil {
 		return nil, err
 	}
 	size := uint64(fi.Size())
-	return &store{
-		File: f,
-		size: size,
-		buf:  bufio.NewWriter(f),
-	}, nil
+	logger = logger.Named("store").With(zap.String("file", f.Name()))
+	logger.Debug("opened store", zap.Uint64("size", size))
+	s := &store{
+		file:   f,
+		size:   size,
+		logger: logger,
+	}
+	s.buf = bufio.NewWriter(storeWriter{s})
+	// no read yet for the next one to follow
+	s.lastRead.Store(math.MaxUint64)
+	return s, nil
+}
+
+// Same as newStore but every record is sealed with the keyring's current key
+func newEncryptedStore(f file, keys *Keyring, logger *zap.Logger) (*store, error) {
+	s, err := newStore(f, logger)
+	if err != nil {
+		return nil, err
+	}
+	s.keys = keys
+	return s, nil
 }
 
 // Persists the given bytes to the store
 func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	s.lock()
+	defer s.unlock()
 	pos = s.size
+	if s.keys != nil {
+		if p, err = s.keys.Seal(p); err != nil {
+			return 0, 0, err
+		}
+	}
 	//First write the length of the record, so when we read we kno how many bytes to read
 	if err := binary.Write(s.buf, enc, uint64(len(p))); err != nil {
 		return 0, 0, err
@@ -54,54 +104,292 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	//calc total bytes written
 	w += lenWidth
 	s.size += uint64(w)
+	storeBytesWritten.Add(float64(w))
 	return uint64(w), pos, nil
 }
 
-// Read returns the record stored at the given position
+// Read returns the record stored at the given position, in a buffer the
+// caller keeps
 func (s *store) Read(pos uint64) ([]byte, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	return s.read(pos, func(n uint64) []byte { return make([]byte, n) })
+}
 
-	// Flush the write buffer to ensure we can read the latest data
-	if err := s.buf.Flush(); err != nil {
+// readPooled is Read's, in a buffer from bufpool the caller Puts once it's
+// done with it
+func (s *store) readPooled(pos uint64) (*[]byte, error) {
+	var p *[]byte
+	b, err := s.read(pos, func(n uint64) []byte {
+		p = bufpool.Get(int(n))
+		return *p
+	})
+	if err != nil {
+		if p != nil {
+			bufpool.Put(p)
+		}
 		return nil, err
 	}
+	*p = b
+	return p, nil
+}
 
-	// Get the size of the record
-	size := make([]byte, lenWidth)
-	if _, err := s.File.ReadAt(size, int64(pos)); err != nil {
-		return nil, err
+// ReadTo is Read's, into dst grown if it's too short, returning the slice
+// of it the record's in
+func (s *store) ReadTo(pos uint64, dst []byte) ([]byte, error) {
+	return s.read(pos, func(n uint64) []byte {
+		if uint64(cap(dst)) < n {
+			dst = make([]byte, n)
+		}
+		return dst[:n]
+	})
+}
+
+// Reads the record at pos into the buffer of n bytes buf returns
+func (s *store) read(pos uint64, buf func(n uint64) []byte) ([]byte, error) {
+	if !s.sealed.Load() {
+		s.lock()
+		defer s.unlock()
+
+		// Flush the write buffer to ensure we can read the latest data
+		if err := s.flush(); err != nil {
+			return nil, err
+		}
 	}
 
-	// Convert the size bytes to uint64
-	recordSize := enc.Uint64(size)
+	// sealed records are read aside, and opened into the buffer
+	into := buf
+	var sealed *[]byte
+	if s.keys != nil {
+		into = func(n uint64) []byte {
+			sealed = bufpool.Get(int(n))
+			return *sealed
+		}
+		defer func() {
+			if sealed != nil {
+				bufpool.Put(sealed)
+			}
+		}()
+	}
+	var stored []byte
+	if ahead, ok := s.readAheadRecord(pos); ok {
+		stored = into(uint64(len(ahead)))
+		copy(stored, ahead)
+	} else {
+		// Get the size of the record
+		size := bufpool.Get(lenWidth)
+		_, err := s.file.ReadAt(*size, int64(pos))
+		// Convert the size bytes to uint64
+		recordSize := enc.Uint64(*size)
+		bufpool.Put(size)
+		if err != nil {
+			storeReadErrors.WithLabelValues(readErrorIO).Inc()
+			return nil, err
+		}
 
-	// Read the record data
-	record := make([]byte, recordSize)
-	if _, err := s.File.ReadAt(record, int64(pos+lenWidth)); err != nil {
-		return nil, err
+		// Read the record data
+		stored = into(recordSize)
+		if _, err := s.file.ReadAt(stored, int64(pos+lenWidth)); err != nil {
+			storeReadErrors.WithLabelValues(readErrorIO).Inc()
+			return nil, err
+		}
 	}
+	s.lastRead.Store(pos + lenWidth + uint64(len(stored)))
+	storeBytesRead.Add(float64(lenWidth + len(stored)))
 
+	if s.keys == nil {
+		return stored, nil
+	}
+	// the plaintext's shorter
+	record, err := s.keys.openTo(buf(uint64(len(stored)))[:0], stored)
+	if err != nil {
+		storeReadErrors.WithLabelValues(readErrorDecrypt).Inc()
+		return nil, err
+	}
 	return record, nil
 }
 
+// Returns the record at pos from what's read ahead, a slice of it, reading
+// the next chunk ahead when the read follows the last one. Callers must
+// hold mu unless the store's sealed.
+func (s *store) readAheadRecord(pos uint64) ([]byte, bool) {
+	if s.readAhead == nil || s.readAhead.chunk == 0 {
+		return nil, false
+	}
+	if record, ok := s.ahead.Load().record(pos); ok {
+		readAheadHits.Inc()
+		return record, true
+	}
+	// read past, or read elsewhere
+	s.dropAhead()
+	if pos != s.lastRead.Load() {
+		return nil, false
+	}
+	n := min(s.readAhead.chunk, int64(s.size-pos))
+	if n <= 0 {
+		return nil, false
+	}
+	if !s.readAhead.reserve(n) {
+		adviseWillNeed(s.file, int64(pos), s.readAhead.chunk)
+		return nil, false
+	}
+	ahead := make([]byte, n)
+	if _, err := s.file.ReadAt(ahead, int64(pos)); err != nil {
+		s.readAhead.release(n)
+		return nil, false
+	}
+	c := &aheadChunk{pos: pos, b: ahead}
+	// sealed reads racing to read ahead each release the chunk they replace
+	if old := s.ahead.Swap(c); old != nil {
+		s.readAhead.release(int64(len(old.b)))
+	}
+	return c.record(pos)
+}
+
+// The record at pos in the chunk, if it's all there
+func (c *aheadChunk) record(pos uint64) ([]byte, bool) {
+	if c == nil || pos < c.pos {
+		return nil, false
+	}
+	off, n := pos-c.pos, uint64(len(c.b))
+	if off+lenWidth > n {
+		return nil, false
+	}
+	size := enc.Uint64(c.b[off:])
+	if size > n-off-lenWidth {
+		return nil, false
+	}
+	return c.b[off+lenWidth : off+lenWidth+size], true
+}
+
+// Releases what's read ahead
+func (s *store) dropAhead() {
+	if c := s.ahead.Swap(nil); c != nil {
+		s.readAhead.release(int64(len(c.b)))
+	}
+}
+
 // Read len p bytes into p beginning at the off offset
 func (s *store) ReadAt(p []byte, off int64) (int, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if err := s.buf.Flush(); err != nil {
-		return 0, err
+	if !s.sealed.Load() {
+		s.lock()
+		defer s.unlock()
+		if err := s.flush(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.file.ReadAt(p, off)
+	if err != nil {
+		storeReadErrors.WithLabelValues(readErrorIO).Inc()
+	}
+	storeBytesRead.Add(float64(n))
+	return n, err
+}
+
+// Sync flushes buffered data and commits the file to stable storage
+func (s *store) Sync() error {
+	s.lock()
+	defer s.unlock()
+	start := time.Now()
+	if _, ok := s.file.(writeSyncer); ok && s.buf.Buffered() > 0 {
+		// the flush and the fsync submitted together, see storeWriter
+		s.syncing = true
+		err := s.flush()
+		s.syncing = false
+		syncDuration.Observe(time.Since(start).Seconds())
+		return err
+	}
+	if err := s.flush(); err != nil {
+		return err
+	}
+	start = time.Now()
+	err := s.file.Sync()
+	syncDuration.Observe(time.Since(start).Seconds())
+	return err
+}
+
+// Writes the buffer out to the store's file, syncing with it while the
+// store's syncing
+type storeWriter struct{ s *store }
+
+func (w storeWriter) Write(p []byte) (int, error) {
+	if ws, ok := w.s.file.(writeSyncer); ok && w.s.syncing {
+		return ws.writeSync(p)
+	}
+	return w.s.file.Write(p)
+}
+
+// Truncate drops everything from pos on
+func (s *store) Truncate(pos uint64) error {
+	s.lock()
+	defer s.unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if err := s.file.Truncate(int64(pos)); err != nil {
+		return err
 	}
-	return s.File.ReadAt(p, off)
+	s.dropAhead()
+	s.size = pos
+	return nil
 }
 
-// Close persists any buffered data before closing the file
+// Close persists any buffered data and syncs it before closing the file,
+// so a clean shutdown doesn't lose acknowledged records
 func (s *store) Close() error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	err := s.buf.Flush()
+	s.lock()
+	defer s.unlock()
+	s.dropAhead()
+	err := s.flush()
 	if err != nil {
+		s.logger.Error("flush on close failed", zap.Error(err))
 		return err
 	}
-	return s.File.Close()
+	if err := s.file.Sync(); err != nil {
+		s.logger.Error("sync on close failed", zap.Error(err))
+		return err
+	}
+	return s.file.Close()
+}
+
+// seal flushes the buffer for the last time, the store isn't appended to
+// or truncated again until it's unsealed, and reads don't take mu
+func (s *store) seal() error {
+	s.lock()
+	defer s.unlock()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	s.sealed.Store(true)
+	return nil
+}
+
+// Writes out the buffer, callers must hold mu
+func (s *store) flush() error {
+	start := time.Now()
+	err := s.buf.Flush()
+	flushDuration.Observe(time.Since(start).Seconds())
+	s.flushes++
+	s.lastFlush = start
+	expFlushes.Add(1)
+	if err != nil {
+		expErrors.Add(1)
+	}
+	return err
+}
+
+// lock and unlock track how many goroutines hold or wait on a store lock
+func (s *store) lock() {
+	expStoreLockHolders.Add(1)
+	s.mu.Lock()
+}
+
+func (s *store) unlock() {
+	s.mu.Unlock()
+	expStoreLockHolders.Add(-1)
+}
+
+// Returns the bytes waiting in the buffer and the flushes made so far
+func (s *store) bufferStats() (buffered int, flushes uint64, lastFlush time.Time) {
+	s.lock()
+	defer s.unlock()
+	return s.buf.Buffered(), s.flushes, s.lastFlush
 }
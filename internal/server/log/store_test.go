@@ -4,7 +4,9 @@ import (
 	"os"
 	"testing"
 
+	"github.com/frankie-mur/proglog/internal/bufpool"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
 )
 
 var (
@@ -16,12 +18,12 @@ func TestStoreAppendRead(t *testing.T) {
 	f, err := os.CreateTemp("", "store_append_read_test")
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
-	s, err := newStore(f)
+	s, err := newStore(f, zap.NewNop())
 	require.NoError(t, err)
 	testAppend(t, s)
 	testRead(t, s)
 	testReadAt(t, s)
-	s, err = newStore(f)
+	s, err = newStore(f, zap.NewNop())
 	require.NoError(t, err)
 	testRead(t, s)
 }
@@ -62,11 +64,27 @@ func testReadAt(t *testing.T, s *store) {
 	}
 }
 
+func TestStoreReadPooled(t *testing.T) {
+	f, err := os.CreateTemp("", "store_read_pooled_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	s, err := newStore(f, zap.NewNop())
+	require.NoError(t, err)
+	testAppend(t, s)
+	// a pooled read reads what Read does, into a buffer that goes back
+	for pos := uint64(0); pos < s.size; pos += width {
+		pooled, err := s.readPooled(pos)
+		require.NoError(t, err)
+		require.Equal(t, write, *pooled)
+		bufpool.Put(pooled)
+	}
+}
+
 func TestStoreClose(t *testing.T) {
 	f, err := os.CreateTemp("", "store_close_test")
 	require.NoError(t, err)
 	defer os.Remove(f.Name())
-	s, err := newStore(f)
+	s, err := newStore(f, zap.NewNop())
 	require.NoError(t, err)
 	_, _, err = s.Append(write)
 	require.NoError(t, err)
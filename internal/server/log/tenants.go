@@ -0,0 +1,165 @@
+package log
+
+import (
+	"cmp"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+// A tenant's bytes are summed again for checks once they're this old
+const tenantUsageTTL = time.Second
+
+// Tenant is a tenant's share of a server's storage, see Config.Tenants
+type Tenant struct {
+	// Dir holds the tenant's topics' partitions, tenants/<name> in the data
+	// directory when unset. A mount point of its own keeps the tenant's
+	// growth from filling other tenants' volumes, and theirs from filling
+	// its.
+	Dir string `json:"dir,omitempty"`
+	// MaxBytes caps the bytes the tenant's partitions hold on each server,
+	// produces to its topics past it failing with api.ErrDiskFull, zero for
+	// no cap
+	MaxBytes uint64 `json:"max_bytes,omitempty"`
+	// Configs are the tenant's topics' defaults, over the servers'
+	// settings and under each topic's configs, e.g. its retention.ms
+	Configs map[string]string `json:"configs,omitempty"`
+}
+
+// TenantStats is a tenant's use of a server's storage
+type TenantStats struct {
+	Name     string `json:"name"`
+	Dir      string `json:"dir"`
+	Topics   int    `json:"topics"`
+	Bytes    uint64 `json:"bytes"`
+	MaxBytes uint64 `json:"max_bytes"`
+}
+
+// TenantOf returns the tenant of Tenants the topic is of, that its name
+// starts with followed by a '.', e.g. acme.orders is acme's, or "" for
+// none
+func (c *Config) TenantOf(topic string) string {
+	return tenantOf(c.Tenants, topic)
+}
+
+func tenantOf(tenants map[string]Tenant, topic string) string {
+	tenant, _, ok := strings.Cut(topic, ".")
+	if _, declared := tenants[tenant]; !ok || !declared {
+		return ""
+	}
+	return tenant
+}
+
+// Checks the tenants' names can prefix topics' and their configs are valid
+func (c Config) validateTenants() error {
+	for name, tenant := range c.Tenants {
+		if ValidateTopic(name) != nil || strings.Contains(name, ".") {
+			return fmt.Errorf("invalid tenant name %q", name)
+		}
+		if err := ValidateTopicConfigs(tenant.Configs); err != nil {
+			return fmt.Errorf("tenant %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// The directory in the data directory dir of the tenant's topics, dir for
+// none
+func (c *Config) tenantDir(dir, tenant string) string {
+	return tenantDir(c.Tenants, dir, tenant)
+}
+
+func tenantDir(tenants map[string]Tenant, dir, tenant string) string {
+	if tenant == "" {
+		return dir
+	}
+	return cmp.Or(tenants[tenant].Dir, filepath.Join(dir, "tenants", tenant))
+}
+
+// The settings of the topic with the configs: the servers', its tenant's
+// configs over them, and its own over those
+func (c *Config) topicConfig(topic string, configs map[string]string) (TopicConfig, error) {
+	base := c.Topic
+	if tenant := c.TenantOf(topic); tenant != "" {
+		var err error
+		if base, err = base.With(c.Tenants[tenant].Configs); err != nil {
+			return TopicConfig{}, err
+		}
+	}
+	return base.With(configs)
+}
+
+// tenantUsage keeps the bytes each tenant's partitions held when they were
+// last summed, which produces are checked against
+type tenantUsage struct {
+	tenants map[string]Tenant
+	// dir is the data directory
+	dir string
+	// sum adds each of a topic's partitions' bytes with add
+	sum func(add func(topic string, bytes uint64))
+
+	mu     sync.Mutex
+	summed time.Time
+	stats  map[string]*TenantStats
+}
+
+// The tenants' stats, summed again unless they were less than
+// tenantUsageTTL ago and fresh isn't set
+func (u *tenantUsage) get(fresh bool) map[string]*TenantStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !fresh && u.stats != nil && time.Since(u.summed) < tenantUsageTTL {
+		return u.stats
+	}
+	stats := make(map[string]*TenantStats, len(u.tenants))
+	for name, tenant := range u.tenants {
+		stats[name] = &TenantStats{Name: name, Dir: tenantDir(u.tenants, u.dir, name), MaxBytes: tenant.MaxBytes}
+	}
+	topics := make(map[string]bool)
+	u.sum(func(topic string, bytes uint64) {
+		st, ok := stats[tenantOf(u.tenants, topic)]
+		if !ok {
+			return
+		}
+		if !topics[topic] {
+			topics[topic] = true
+			st.Topics++
+		}
+		st.Bytes += bytes
+	})
+	for name, st := range stats {
+		tenantBytes.WithLabelValues(name).Set(float64(st.Bytes))
+		tenantMaxBytes.WithLabelValues(name).Set(float64(st.MaxBytes))
+	}
+	u.stats, u.summed = stats, time.Now()
+	return stats
+}
+
+// Fails with api.ErrDiskFull for the topic's tenant if its partitions hold
+// its MaxBytes already
+func (u *tenantUsage) check(topic string) error {
+	tenant := tenantOf(u.tenants, topic)
+	if tenant == "" || u.tenants[tenant].MaxBytes == 0 {
+		return nil
+	}
+	st := u.get(false)[tenant]
+	if st.Bytes >= st.MaxBytes {
+		return api.ErrDiskFull{Used: st.Bytes, Capacity: st.MaxBytes, Tenant: tenant}
+	}
+	return nil
+}
+
+// The stats sorted by name
+func sortedTenantStats(stats map[string]*TenantStats) []TenantStats {
+	sorted := make([]TenantStats, 0, len(stats))
+	for _, st := range stats {
+		sorted = append(sorted, *st)
+	}
+	slices.SortFunc(sorted, func(a, b TenantStats) int { return strings.Compare(a.Name, b.Name) })
+	return sorted
+}
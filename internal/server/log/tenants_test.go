@@ -0,0 +1,81 @@
+package log
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenants(t *testing.T) {
+	dir, mount := t.TempDir(), t.TempDir()
+	c := Config{Tenants: map[string]Tenant{
+		"acme":   {Dir: mount, MaxBytes: 1, Configs: map[string]string{RetentionMsConfig: "60000"}},
+		"globex": {},
+	}}
+	c.Topic.Retention = time.Hour
+	topics, err := NewTopics(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, "acme", topics.TenantOf("acme.orders"))
+	require.Equal(t, "", topics.TenantOf("initech.orders"))
+	require.Equal(t, "", topics.TenantOf("acme"))
+
+	// a tenant's topics are in its directory, going by its configs
+	for _, name := range []string{"acme.orders", "acme.audit", "globex.orders", "orders"} {
+		require.NoError(t, topics.CreateTopic(&api.Topic{Name: name}))
+	}
+	require.DirExists(t, filepath.Join(mount, "topics", "acme.orders"))
+	require.DirExists(t, filepath.Join(dir, "tenants", "globex", "topics", "globex.orders"))
+	require.DirExists(t, filepath.Join(dir, "topics", "orders"))
+	config, err := topics.TopicConfig("acme.orders")
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, config.Retention)
+	_, err = topics.AlterTopicConfigs("acme.audit", map[string]string{RetentionMsConfig: "1000"})
+	require.NoError(t, err)
+	config, err = topics.TopicConfig("acme.audit")
+	require.NoError(t, err)
+	require.Equal(t, time.Second, config.Retention)
+	config, err = topics.TopicConfig("globex.orders")
+	require.NoError(t, err)
+	require.Equal(t, time.Hour, config.Retention)
+
+	// produces to a tenant past its max bytes fail, other tenants' don't
+	require.NoError(t, topics.CheckTenant("acme.orders"))
+	l, err := topics.TopicPartition("acme.orders", 0)
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("order")})
+	require.NoError(t, err)
+	stats := topics.TenantStats()
+	require.Len(t, stats, 2)
+	require.Equal(t, "acme", stats[0].Name)
+	require.Equal(t, mount, stats[0].Dir)
+	require.Equal(t, 2, stats[0].Topics)
+	require.NotZero(t, stats[0].Bytes)
+	require.Equal(t, TenantStats{Name: "globex", Dir: filepath.Join(dir, "tenants", "globex"), Topics: 1}, stats[1])
+	var full api.ErrDiskFull
+	require.ErrorAs(t, topics.CheckTenant("acme.audit"), &full)
+	require.Equal(t, "acme", full.Tenant)
+	require.NoError(t, topics.CheckTenant("globex.orders"))
+	require.NoError(t, topics.CheckTenant("orders"))
+
+	// the tenants' topics are found again where they were made
+	require.NoError(t, topics.Close())
+	topics, err = NewTopics(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []string{"acme.audit", "acme.orders", DefaultTopic, "globex.orders", "orders"}, names(topics.ListTopics()))
+	l, err = topics.TopicPartition("acme.orders", 0)
+	require.NoError(t, err)
+	record, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "order", string(record.Value))
+	require.NoError(t, topics.DeleteTopic("acme.orders"))
+	_, err = os.Stat(filepath.Join(mount, "topics", "acme.orders"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, topics.Close())
+
+	_, err = NewTopics(t.TempDir(), Config{Tenants: map[string]Tenant{"a.b": {}}})
+	require.Error(t, err)
+}
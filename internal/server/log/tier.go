@@ -0,0 +1,387 @@
+package log
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+// ObjectStore is where a log archives its sealed segments when its tier is
+// configured, such as an S3 bucket. Package objstore has implementations.
+type ObjectStore interface {
+	// Put stores size bytes from r under key, replacing any object there
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// How often the log retries archiving after a failure, sealing a segment
+// archives it straight away
+var tierInterval = 30 * time.Second
+
+const (
+	// Lists the archived segments, kept in the log's directory
+	manifestName = "archive.json"
+	// Fetched segments are cached here, under the log's directory
+	cacheDirName = "cache"
+)
+
+type archivedSegment struct {
+	BaseOffset uint64 `json:"base_offset"`
+	NextOffset uint64 `json:"next_offset"`
+}
+
+// archive follows which of the log's segments are in the object store and
+// caches the ones fetched for reads
+type archive struct {
+	store    ObjectStore
+	prefix   string
+	dir      string
+	cacheDir string
+	config   Config
+	logger   *zap.Logger
+
+	mu       sync.Mutex
+	segments []archivedSegment
+	// fetched segments, least recently read first
+	cache []*segment
+
+	wake      chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+func newArchive(dir string, c Config) (*archive, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	a := &archive{
+		store:    c.Tier.Store,
+		prefix:   c.Tier.Prefix,
+		dir:      dir,
+		cacheDir: filepath.Join(dir, cacheDirName),
+		config:   c,
+		logger:   c.logger().Named("tier").With(zap.String("dir", dir)),
+		wake:     make(chan struct{}, 1),
+		ctx:      ctx,
+		cancel:   cancel,
+		stopped:  make(chan struct{}),
+	}
+	if a.config.Tier.CacheSegments == 0 {
+		a.config.Tier.CacheSegments = 4
+	}
+	// the cache doesn't outlive the process
+	if err := os.RemoveAll(a.cacheDir); err != nil {
+		cancel()
+		return nil, err
+	}
+	b, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil && !os.IsNotExist(err) {
+		cancel()
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(b, &a.segments); err != nil {
+			cancel()
+			return nil, fmt.Errorf("reading %s: %w", manifestName, err)
+		}
+	}
+	return a, nil
+}
+
+func (a *archive) key(base uint64, ext string) string {
+	return fmt.Sprintf("%s%020d%s", a.prefix, base, ext)
+}
+
+// Asks the archiving loop to look for newly sealed segments
+func (a *archive) notify() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (a *archive) archived(base uint64) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.find(base)
+	return ok
+}
+
+// The index of the archived segment holding off. Callers must hold mu.
+func (a *archive) find(off uint64) (int, bool) {
+	i := sort.Search(len(a.segments), func(i int) bool {
+		return a.segments[i].NextOffset > off
+	})
+	if i < len(a.segments) && a.segments[i].BaseOffset <= off {
+		return i, true
+	}
+	return 0, false
+}
+
+func (a *archive) count() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.segments)
+}
+
+// Records the segment as archived
+func (a *archive) add(seg archivedSegment) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.segments = append(a.segments, seg)
+	slices.SortFunc(a.segments, func(x, y archivedSegment) int {
+		return cmp.Compare(x.BaseOffset, y.BaseOffset)
+	})
+	return a.save()
+}
+
+// Drops the segment at base from the archive, as rewriting it locally has
+// made the archived copy stale. It's archived again from the local copy.
+func (a *archive) forget(base uint64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i, ok := a.find(base)
+	if !ok {
+		return nil
+	}
+	a.segments = slices.Delete(a.segments, i, i+1)
+	a.uncache(base)
+	return a.save()
+}
+
+// Writes the manifest beside its final name and renames it into place.
+// Callers must hold mu.
+func (a *archive) save() error {
+	b, err := json.Marshal(a.segments)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(a.dir, manifestName)
+	if err = os.WriteFile(name+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// Reads the record from the archived segment holding it, fetching the
+// segment unless it's cached
+func (a *archive) read(off uint64) (*api.Record, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	i, ok := a.find(off)
+	if !ok {
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	s, err := a.cached(a.segments[i].BaseOffset)
+	if err != nil {
+		return nil, err
+	}
+	return s.Read(off)
+}
+
+// The segment at base from the cache, fetched from the store if it isn't
+// there. Callers must hold mu.
+func (a *archive) cached(base uint64) (*segment, error) {
+	for i, s := range a.cache {
+		if s.baseOffset == base {
+			a.cache = append(slices.Delete(a.cache, i, i+1), s)
+			return s, nil
+		}
+	}
+	if err := os.MkdirAll(a.cacheDir, 0755); err != nil {
+		return nil, err
+	}
+	for _, ext := range []string{".store", ".index"} {
+		if err := a.fetch(a.key(base, ext), filepath.Join(a.cacheDir, fmt.Sprintf("%d%s", base, ext))); err != nil {
+			return nil, err
+		}
+	}
+	s, err := newSegment(a.cacheDir, base, a.config)
+	if err != nil {
+		return nil, err
+	}
+	tierFetches.Inc()
+	a.cache = append(a.cache, s)
+	for len(a.cache) > a.config.Tier.CacheSegments {
+		if err := a.cache[0].Remove(); err != nil {
+			a.logger.Error("failed to remove cached segment", zap.Error(err))
+		}
+		a.cache = a.cache[1:]
+	}
+	return s, nil
+}
+
+func (a *archive) fetch(key, name string) error {
+	r, err := a.store.Get(a.ctx, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Removes the segment at base from the cache. Callers must hold mu.
+func (a *archive) uncache(base uint64) {
+	for i, s := range a.cache {
+		if s.baseOffset == base {
+			if err := s.Remove(); err != nil {
+				a.logger.Error("failed to remove cached segment", zap.Error(err))
+			}
+			a.cache = slices.Delete(a.cache, i, i+1)
+			return
+		}
+	}
+}
+
+// Deletes every archived segment from the store
+func (a *archive) removeAll(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, seg := range a.segments {
+		for _, ext := range []string{".store", ".index"} {
+			if err := a.store.Delete(ctx, a.key(seg.BaseOffset, ext)); err != nil {
+				return err
+			}
+		}
+	}
+	a.segments = nil
+	return nil
+}
+
+// Stops the archiving loop, waiting for it, and closes the cached segments
+func (a *archive) close() {
+	a.closeOnce.Do(func() {
+		a.cancel()
+		<-a.stopped
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		for _, s := range a.cache {
+			if err := s.Close(); err != nil {
+				a.logger.Error("failed to close cached segment", zap.Error(err))
+			}
+		}
+		a.cache = nil
+	})
+}
+
+// Archives sealed segments as they're sealed, retrying failures every
+// tierInterval, until the log closes
+func (l *Log) runArchive(a *archive) {
+	defer close(a.stopped)
+	ticker := time.NewTicker(tierInterval)
+	defer ticker.Stop()
+	for {
+		if err := l.archiveSealed(a); err != nil && a.ctx.Err() == nil {
+			a.logger.Error("failed to archive segments", zap.Error(err))
+		}
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-a.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Uploads every sealed segment not yet archived, then evicts the local
+// copies of all but the newest Tier.LocalSegments archived ones
+func (l *Log) archiveSealed(a *archive) error {
+	l.mu.RLock()
+	var sealed []*segment
+	for _, s := range l.segments {
+		if s != l.activeSegment && !a.archived(s.baseOffset) {
+			sealed = append(sealed, s)
+		}
+	}
+	l.mu.RUnlock()
+	for _, s := range sealed {
+		if err := l.upload(a, s); err != nil {
+			return err
+		}
+	}
+	return l.evict(a)
+}
+
+// Puts the segment's store and index in the object store. The files are
+// read through their own handles, holding the log's lock for the whole
+// upload would hold up appends.
+func (l *Log) upload(a *archive, s *segment) error {
+	l.mu.RLock()
+	err := s.Sync()
+	seg := archivedSegment{BaseOffset: s.baseOffset, NextOffset: s.nextOffset}
+	files := []struct {
+		name, ext string
+		size      uint64
+	}{
+		{s.store.Name(), ".store", s.store.size},
+		{s.index.Name(), ".index", s.index.size},
+	}
+	l.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		f, err := os.Open(file.name)
+		if err != nil {
+			return err
+		}
+		err = a.store.Put(a.ctx, a.key(seg.BaseOffset, file.ext), io.NewSectionReader(f, 0, int64(file.size)), int64(file.size))
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// a segment rewritten meanwhile is archived again from its new copy
+	if !slices.Contains(l.segments, s) {
+		return nil
+	}
+	if err := a.add(seg); err != nil {
+		return err
+	}
+	tierSegmentsArchived.Inc()
+	return nil
+}
+
+// Removes the oldest local segments that are archived, keeping
+// Tier.LocalSegments of the sealed ones, so the local segments still run
+// on from the archive without a gap
+func (l *Log) evict(a *archive) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	evictable := len(l.segments) - 1 - l.Config.Tier.LocalSegments
+	n := 0
+	for n < evictable && a.archived(l.segments[n].baseOffset) {
+		if err := l.segments[n].Remove(); err != nil {
+			l.segments = l.segments[n:]
+			l.publishSealed()
+			return err
+		}
+		tierSegmentsEvicted.Inc()
+		n++
+	}
+	l.segments = l.segments[n:]
+	l.publishSealed()
+	return nil
+}
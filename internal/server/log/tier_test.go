@@ -0,0 +1,64 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/objstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTier(t *testing.T) {
+	dir := t.TempDir()
+	bucket := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 32
+	c.Tier.Store = objstore.NewDir(bucket)
+	c.Tier.Prefix = "node-0/"
+	c.Tier.LocalSegments = 1
+	c.Tier.CacheSegments = 1
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// every two records fill a segment and seal it
+	const n = 6
+	for i := 0; i < n; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool {
+		st := log.Stats()
+		// the newest archived segment and the active one stay on disk
+		return st.ArchivedSegments == n/2 && st.Segments == 2
+	}, time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(n-2), log.Stats().LowWatermark)
+
+	requireRecords := func(log *Log) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			record, err := log.Read(uint64(i))
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+			require.Equal(t, uint64(i), record.Offset)
+		}
+		_, err := log.Read(n)
+		require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	}
+	requireRecords(log)
+
+	// the archive outlives the process
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	requireRecords(log)
+
+	// removing the log removes what it archived
+	require.NoError(t, log.Remove())
+	objects, err := os.ReadDir(filepath.Join(bucket, "node-0"))
+	require.NoError(t, err)
+	require.Empty(t, objects)
+}
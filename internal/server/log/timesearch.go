@@ -0,0 +1,48 @@
+package log
+
+import (
+	"errors"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+// OffsetForTime searches the records from lo up to hi for the offset of the
+// first with a timestamp at or after t, in Unix nanoseconds, returning hi
+// when there's none. read reads the record at an offset, or the first after
+// it compaction left. Records removed since count as before t.
+//
+// Timestamps may be out of order by their topic's TopicConfig.TimestampSkew:
+// each is within skew of when its record was appended, which is in order.
+// So records whose timestamps are before t-2*skew were appended before any
+// record at or after t could have been, and the search looks for the first
+// of those it can rule out, then reads on for the first at or after t.
+func OffsetForTime(lo, hi uint64, t int64, skew time.Duration, read func(off uint64) (*api.Record, error)) (uint64, error) {
+	end := hi
+	from := t - 2*skew.Nanoseconds()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		record, err := read(mid)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) || err == nil && record.Timestamp < from {
+			lo = mid + 1
+		} else if err != nil {
+			return 0, err
+		} else {
+			hi = mid
+		}
+	}
+	for skew > 0 && lo < end {
+		record, err := read(lo)
+		switch {
+		case errors.As(err, &api.ErrOffsetOutOfRange{}):
+			lo++
+		case err != nil:
+			return 0, err
+		case record.Timestamp >= t:
+			return lo, nil
+		default:
+			lo = record.Offset + 1
+		}
+	}
+	return lo, nil
+}
@@ -0,0 +1,78 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOffsetForTime(t *testing.T) {
+	// appended ten seconds apart, with producers' timestamps up to 3s off
+	skews := []int64{0, 3, -3, 2, -2, 0, 3, 1, -3, 0}
+	records := make([]*api.Record, len(skews))
+	for i, s := range skews {
+		records[i] = &api.Record{Offset: uint64(i), Timestamp: (int64(i)*10 + s) * int64(time.Second)}
+	}
+	records[4] = nil // removed
+	read := func(off uint64) (*api.Record, error) {
+		for ; off < uint64(len(records)); off++ {
+			if records[off] != nil {
+				return records[off], nil
+			}
+		}
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	first := func(t int64) uint64 {
+		for i, r := range records {
+			if r != nil && r.Timestamp >= t {
+				return uint64(i)
+			}
+		}
+		return uint64(len(records))
+	}
+	for ts := int64(-5); ts < 100; ts++ {
+		at := ts * int64(time.Second)
+		off, err := OffsetForTime(0, uint64(len(records)), at, 3*time.Second, read)
+		require.NoError(t, err)
+		// a removed offset reads as the next record
+		if off < uint64(len(records)) && records[off] == nil {
+			off++
+		}
+		require.Equal(t, first(at), off, "at %ds", ts)
+	}
+
+	// without a skew the search takes the timestamps to be in order
+	records[2].Timestamp = 20 * int64(time.Second)
+	off, err := OffsetForTime(0, uint64(len(records)), 20*int64(time.Second), 0, read)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func TestTimestampConfig(t *testing.T) {
+	_, err := TopicConfig{}.With(map[string]string{TimestampTypeConfig: "Now"})
+	require.Error(t, err)
+	c, err := TopicConfig{}.With(map[string]string{TimestampMaxSkewMsConfig: "60000"})
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, c.TimestampSkew())
+
+	stale := &api.Record{Value: []byte("foo"), Timestamp: time.Now().Add(-time.Hour).UnixNano()}
+	_, err = c.Prepare(stale)
+	var invalid api.ErrInvalidTimestamp
+	require.ErrorAs(t, err, &invalid)
+	require.Equal(t, time.Minute, invalid.MaxSkew)
+	recent := &api.Record{Value: []byte("foo"), Timestamp: time.Now().Add(-time.Second).UnixNano()}
+	prepared, err := c.Prepare(recent)
+	require.NoError(t, err)
+	require.Equal(t, recent.Timestamp, prepared.Timestamp)
+
+	// append times leave stamping to the log, whatever producers set
+	c, err = c.With(map[string]string{TimestampTypeConfig: TimestampLogAppendTime})
+	require.NoError(t, err)
+	require.Zero(t, c.TimestampSkew())
+	prepared, err = c.Prepare(stale)
+	require.NoError(t, err)
+	require.Zero(t, prepared.Timestamp)
+	require.NotZero(t, stale.Timestamp)
+}
@@ -0,0 +1,339 @@
+package log
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"github.com/frankie-mur/proglog/internal/redact"
+	"google.golang.org/protobuf/proto"
+)
+
+// The configs a topic can override the servers' settings with
+const (
+	// RetentionMsConfig removes records older than this many milliseconds, a
+	// whole segment at a time. Zero keeps them.
+	RetentionMsConfig = "retention.ms"
+	// RetentionBytesConfig removes the oldest segments while a partition
+	// holds more than this many bytes. Zero doesn't.
+	RetentionBytesConfig = "retention.bytes"
+	// MaxRecordBytesConfig rejects records whose value is larger. Zero
+	// takes any.
+	MaxRecordBytesConfig = "max.record.bytes"
+	// CleanupPolicyConfig is delete, removing records only as retention
+	// says, or compact, keeping only each key's latest record too
+	CleanupPolicyConfig = "cleanup.policy"
+	// MinCleanableDirtyRatioConfig holds compaction off until at least this
+	// share, from 0 to 1, of a partition's sealed bytes were written since
+	// it last compacted. Zero compacts every cleanup.
+	MinCleanableDirtyRatioConfig = "min.cleanable.dirty.ratio"
+	// DeleteRetentionMsConfig has compaction remove tombstones, once
+	// they're older than this many milliseconds, see Tombstone. Zero keeps
+	// them.
+	DeleteRetentionMsConfig = "delete.retention.ms"
+	// CompressionTypeConfig compresses the records producers send
+	// uncompressed, none, snappy or zstd
+	CompressionTypeConfig = "compression.type"
+	// CompressionLevelConfig is the level records are compressed at, for
+	// zstd from 1, fastest, to 22, smallest. Zero is the codec's default.
+	CompressionLevelConfig = "compression.level"
+	// CompressionRecompressConfig, true or false, recompresses records
+	// producers compressed with another codec than compression.type, or
+	// decompresses them for none, trading the CPU it takes on append for
+	// the disk it saves
+	CompressionRecompressConfig = "compression.recompress"
+	// AcksConfig is the ack level of produces that leave it to the server,
+	// none, leader or all
+	AcksConfig = "acks"
+	// SchemaValidationConfig, true or false, rejects produces whose values
+	// don't match the topic's latest schema
+	SchemaValidationConfig = "schema.validation"
+	// SchemaCompatibilityConfig is how the topic's new schemas must be
+	// compatible with its latest: backward, readers of the new reading
+	// records of the latest, forward, the other way round, full, both, or
+	// none
+	SchemaCompatibilityConfig = "schema.compatibility"
+	// TransformConfig names the WebAssembly module of the servers'
+	// transforms records produced to the topic go through before they're
+	// appended, none when empty
+	TransformConfig = "transform"
+	// DedupWindowMsConfig drops records produced again within this many
+	// milliseconds of an exact copy appended to the topic, answering them
+	// as dropped. Zero doesn't, unless DedupWindowRecordsConfig is set.
+	DedupWindowMsConfig = "dedup.window.ms"
+	// DedupWindowRecordsConfig drops records produced again within this
+	// many records appended to the topic since an exact copy. Zero doesn't,
+	// unless DedupWindowMsConfig is set.
+	DedupWindowRecordsConfig = "dedup.window.records"
+	// DedupKeyConfig, true or false, has records copies only when their
+	// keys match too, not just their values
+	DedupKeyConfig = "dedup.key"
+	// TimestampTypeConfig is whose clock records' timestamps are by:
+	// CreateTime keeps the timestamps producers set, stamping those without
+	// one, and LogAppendTime stamps every record as it's appended
+	TimestampTypeConfig = "message.timestamp.type"
+	// TimestampMaxSkewMsConfig rejects records whose CreateTime timestamps
+	// are further than this many milliseconds from the server's clock,
+	// ahead or behind. Zero takes any, and searches by time then take the
+	// timestamps to be in order.
+	TimestampMaxSkewMsConfig = "message.timestamp.max.skew.ms"
+	// RedactFieldsConfig lists the fields of JSON values, paths like
+	// user.email separated by commas, whose values are replaced before
+	// they're appended, see redact.Rules
+	RedactFieldsConfig = "redact.fields"
+	// RedactPatternsConfig lists the patterns, of redact.Patterns and
+	// separated by commas, replaced wherever they're found in values
+	// before they're appended
+	RedactPatternsConfig = "redact.patterns"
+)
+
+// The schema compatibility levels, see SchemaCompatibilityConfig
+const (
+	CompatibilityBackward = "backward"
+	CompatibilityForward  = "forward"
+	CompatibilityFull     = "full"
+	CompatibilityNone     = "none"
+)
+
+// The timestamp types, see TimestampTypeConfig
+const (
+	TimestampCreateTime    = "CreateTime"
+	TimestampLogAppendTime = "LogAppendTime"
+)
+
+// TopicConfig is how a topic keeps and takes its records. Topics start
+// from the servers' Config.Topic and override it with their configs.
+type TopicConfig struct {
+	Retention      time.Duration
+	RetentionBytes uint64
+	MaxRecordBytes uint64
+	// Compact keeps only the latest record of each key in sealed segments
+	Compact bool
+	// MinCleanableDirtyRatio is the dirty ratio compaction waits for, see
+	// MinCleanableDirtyRatioConfig
+	MinCleanableDirtyRatio float64
+	// DeleteRetention is how long compaction keeps tombstones, see
+	// DeleteRetentionMsConfig
+	DeleteRetention time.Duration
+	Compression     api.Codec
+	// CompressionLevel is the level Compression compresses at, see
+	// codec.CompressLevel
+	CompressionLevel int
+	// Recompress recompresses records compressed with another codec than
+	// Compression
+	Recompress bool
+	// Ack overrides Config.Raft.Ack, api.Ack_ACK_DEFAULT leaves it
+	Ack api.Ack
+	// ValidateSchema checks produced values against the topic's latest
+	// schema
+	ValidateSchema bool
+	// SchemaCompatibility is one of the compatibility levels, backward when
+	// empty
+	SchemaCompatibility string
+	// Transform is the name of the module records go through, see
+	// TransformConfig
+	Transform string
+	// DedupWindow and DedupRecords bound the window records are dropped as
+	// copies of those appended in, see DedupWindowMsConfig. Both zero keep
+	// copies.
+	DedupWindow  time.Duration
+	DedupRecords uint64
+	// DedupKey compares records' keys as well as their values
+	DedupKey bool
+	// Redact is what's redacted from values, see RedactFieldsConfig
+	Redact redact.Rules
+	// LogAppendTime stamps records as they're appended, rather than
+	// keeping the producers' timestamps
+	LogAppendTime bool
+	// MaxTimestampSkew bounds how far producers' timestamps may be from
+	// the server's clock, see TimestampMaxSkewMsConfig
+	MaxTimestampSkew time.Duration
+}
+
+// With returns the config overridden with configs, the topic's configs by
+// name. Unknown configs and values fail, so a topic can't be created or
+// altered with one. An empty value leaves the setting as it is.
+func (c TopicConfig) With(configs map[string]string) (TopicConfig, error) {
+	for name, v := range configs {
+		if v == "" {
+			continue
+		}
+		var err error
+		switch name {
+		case RetentionMsConfig:
+			var ms uint64
+			ms, err = strconv.ParseUint(v, 10, 63)
+			c.Retention = time.Duration(ms) * time.Millisecond
+		case RetentionBytesConfig:
+			c.RetentionBytes, err = strconv.ParseUint(v, 10, 64)
+		case MaxRecordBytesConfig:
+			c.MaxRecordBytes, err = strconv.ParseUint(v, 10, 64)
+		case CleanupPolicyConfig:
+			switch v {
+			case "delete":
+				c.Compact = false
+			case "compact":
+				c.Compact = true
+			default:
+				err = fmt.Errorf("want delete or compact")
+			}
+		case MinCleanableDirtyRatioConfig:
+			c.MinCleanableDirtyRatio, err = strconv.ParseFloat(v, 64)
+			if err == nil && !(c.MinCleanableDirtyRatio >= 0 && c.MinCleanableDirtyRatio <= 1) {
+				err = fmt.Errorf("want from 0 to 1")
+			}
+		case DeleteRetentionMsConfig:
+			var ms uint64
+			ms, err = strconv.ParseUint(v, 10, 63)
+			c.DeleteRetention = time.Duration(ms) * time.Millisecond
+		case CompressionTypeConfig:
+			codec, ok := api.Codec_value["CODEC_"+strings.ToUpper(v)]
+			if !ok {
+				err = fmt.Errorf("want none, snappy or zstd")
+			}
+			c.Compression = api.Codec(codec)
+		case CompressionLevelConfig:
+			var level uint64
+			if level, err = strconv.ParseUint(v, 10, 8); err == nil && level > codec.MaxLevel {
+				err = fmt.Errorf("want at most %d", codec.MaxLevel)
+			}
+			c.CompressionLevel = int(level)
+		case CompressionRecompressConfig:
+			c.Recompress, err = strconv.ParseBool(v)
+		case AcksConfig:
+			ack, ok := api.Ack_value["ACK_"+strings.ToUpper(v)]
+			if !ok || ack == int32(api.Ack_ACK_DEFAULT) {
+				err = fmt.Errorf("want none, leader or all")
+			}
+			c.Ack = api.Ack(ack)
+		case SchemaValidationConfig:
+			c.ValidateSchema, err = strconv.ParseBool(v)
+		case SchemaCompatibilityConfig:
+			switch v {
+			case CompatibilityBackward, CompatibilityForward, CompatibilityFull, CompatibilityNone:
+				c.SchemaCompatibility = v
+			default:
+				err = fmt.Errorf("want backward, forward, full or none")
+			}
+		case TransformConfig:
+			c.Transform = v
+		case DedupWindowMsConfig:
+			var ms uint64
+			ms, err = strconv.ParseUint(v, 10, 63)
+			c.DedupWindow = time.Duration(ms) * time.Millisecond
+		case DedupWindowRecordsConfig:
+			c.DedupRecords, err = strconv.ParseUint(v, 10, 64)
+		case DedupKeyConfig:
+			c.DedupKey, err = strconv.ParseBool(v)
+		case TimestampTypeConfig:
+			switch v {
+			case TimestampCreateTime:
+				c.LogAppendTime = false
+			case TimestampLogAppendTime:
+				c.LogAppendTime = true
+			default:
+				err = fmt.Errorf("want %s or %s", TimestampCreateTime, TimestampLogAppendTime)
+			}
+		case TimestampMaxSkewMsConfig:
+			var ms uint64
+			ms, err = strconv.ParseUint(v, 10, 63)
+			c.MaxTimestampSkew = time.Duration(ms) * time.Millisecond
+		case RedactFieldsConfig:
+			c.Redact.Fields = splitList(v)
+			err = c.Redact.Validate()
+		case RedactPatternsConfig:
+			c.Redact.Patterns = splitList(v)
+			err = c.Redact.Validate()
+		default:
+			return c, fmt.Errorf("unknown topic config %q", name)
+		}
+		if err != nil {
+			return c, fmt.Errorf("topic config %s=%q: %w", name, v, err)
+		}
+	}
+	return c, nil
+}
+
+// The comma separated items of the list, trimmed
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ValidateTopicConfigs checks configs are ones a topic can have
+func ValidateTopicConfigs(configs map[string]string) error {
+	_, err := TopicConfig{}.With(configs)
+	return err
+}
+
+// Prepare checks the record fits the topic and compresses it as the topic
+// asks, returning the record to append. A record's timestamp is cleared
+// for the log to stamp when the topic takes append times. Records the
+// caller holds aren't changed.
+func (c TopicConfig) Prepare(record *api.Record) (*api.Record, error) {
+	if size := uint64(len(record.Value)); c.MaxRecordBytes > 0 && size > c.MaxRecordBytes {
+		return nil, api.ErrRecordTooLarge{Size: size, Max: c.MaxRecordBytes}
+	}
+	switch {
+	case c.LogAppendTime && record.Timestamp != 0:
+		record = proto.Clone(record).(*api.Record)
+		record.Timestamp = 0
+	case !c.LogAppendTime && c.MaxTimestampSkew > 0 && record.Timestamp != 0:
+		if skew := time.Since(time.Unix(0, record.Timestamp)); skew > c.MaxTimestampSkew || -skew > c.MaxTimestampSkew {
+			return nil, api.ErrInvalidTimestamp{Timestamp: record.Timestamp, MaxSkew: c.MaxTimestampSkew}
+		}
+	}
+	if c.Recompress {
+		return codec.Recompress(c.Compression, c.CompressionLevel, record)
+	}
+	return codec.CompressLevel(c.Compression, c.CompressionLevel, record)
+}
+
+// Dedup is whether copies of records appended within the topic's dedup
+// window are dropped
+func (c TopicConfig) Dedup() bool {
+	return c.DedupWindow > 0 || c.DedupRecords > 0
+}
+
+// TimestampSkew is how far out of order the topic's timestamps may be,
+// which searches by time allow for: none when the log stamps them, and
+// when producers' aren't bounded they're taken to be in order
+func (c TopicConfig) TimestampSkew() time.Duration {
+	if c.LogAppendTime {
+		return 0
+	}
+	return c.MaxTimestampSkew
+}
+
+// AckLevel is the level a produce asking for ack appends at, the topic's
+// for api.Ack_ACK_DEFAULT
+func (c TopicConfig) AckLevel(ack api.Ack) api.Ack {
+	if ack == api.Ack_ACK_DEFAULT {
+		return c.Ack
+	}
+	return ack
+}
+
+// The configs with changes made to them, an empty value removing one
+func alterConfigs(configs, changes map[string]string) map[string]string {
+	altered := make(map[string]string, len(configs)+len(changes))
+	for name, v := range configs {
+		altered[name] = v
+	}
+	for name, v := range changes {
+		if v == "" {
+			delete(altered, name)
+		} else {
+			altered[name] = v
+		}
+	}
+	return altered
+}
@@ -0,0 +1,534 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultTopic is the topic of callers that don't name one, the log there
+// was before topics
+const DefaultTopic = "default"
+
+// OffsetsTopic is the internal topic the servers keep consumer groups'
+// committed offsets in, created on the first commit
+const OffsetsTopic = "__consumer_offsets"
+
+// SubscriptionsTopic is the internal topic the servers keep webhook
+// subscriptions in, created with the first
+const SubscriptionsTopic = "__subscriptions"
+
+// ParquetExportsTopic is the internal topic the servers keep the files
+// their Parquet exports wrote in, created with the first
+const ParquetExportsTopic = "__parquet_exports"
+
+// SchemasTopic is the internal topic the servers keep topics' schemas in,
+// created with the first
+const SchemasTopic = "__schemas"
+
+var topicName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+// ValidateTopic checks the name can be a topic's, letters, digits, '.',
+// '_' and '-' and a directory's name
+func ValidateTopic(name string) error {
+	if !topicName.MatchString(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid topic name %q", name)
+	}
+	return nil
+}
+
+// Partition is a topic partition's log, a Log on a single server and a
+// DistributedLog in a cluster
+type Partition interface {
+	Append(record *api.Record) (uint64, error)
+	Read(offset uint64) (*api.Record, error)
+}
+
+// Describes a topic in a topic directory, see Topics
+const topicFile = "topic.json"
+
+// A topic's description, its configs over the servers' settings and its
+// partitions' logs
+type topic struct {
+	*api.Topic
+	// dir holds the topic's description and partitions
+	dir        string
+	config     TopicConfig
+	partitions []*Log
+}
+
+// The topic's partition p, or api.ErrPartitionNotFound
+func (t *topic) partition(p uint32) (*Log, error) {
+	if p >= uint32(len(t.partitions)) {
+		return nil, api.ErrPartitionNotFound{Partition: p, Partitions: len(t.partitions)}
+	}
+	return t.partitions[p], nil
+}
+
+// Closes the topic's partitions, deleting their data too with remove
+func (t *topic) close(remove bool) error {
+	var errs []error
+	for _, l := range t.partitions {
+		if remove {
+			errs = append(errs, l.Remove())
+		} else {
+			errs = append(errs, l.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Topics holds the topics' logs. The default topic is a single partition
+// keeping its files in the data directory, as a Log of its own would, and
+// the other topics' partitions are under topics/<name>/<partition> beside
+// the topic's description in topics/<name>/topic.json, in the directory of
+// the topic's tenant for a tenant's, see Config.Tenants. Topics is the
+// default topic's Log to callers that don't ask for another.
+//
+// Every Config.CleanupInterval each partition removes the records its
+// topic's retention expires, and compacts if the topic asks to.
+type Topics struct {
+	*Log
+	def    *topic
+	dir    string
+	config Config
+
+	mu     sync.RWMutex
+	topics map[string]*topic
+	usage  *tenantUsage
+
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+// NewTopics opens the default topic in dir and the topics created there
+// before
+func NewTopics(dir string, c Config) (*Topics, error) {
+	if err := c.validateTenants(); err != nil {
+		return nil, err
+	}
+	def, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+	t := &Topics{
+		Log: def,
+		def: &topic{
+			Topic:      &api.Topic{Name: DefaultTopic, Partitions: 1},
+			config:     c.Topic,
+			partitions: []*Log{def},
+		},
+		dir:    dir,
+		config: c,
+		topics: make(map[string]*topic),
+		done:   make(chan struct{}),
+	}
+	t.usage = &tenantUsage{tenants: c.Tenants, dir: dir, sum: t.sumTenants}
+	// tenants' topics created before they were declared stay put
+	dirs := []string{dir}
+	for _, tenant := range slices.Sorted(maps.Keys(c.Tenants)) {
+		dirs = append(dirs, c.tenantDir(dir, tenant))
+	}
+	for _, base := range dirs {
+		entries, err := os.ReadDir(filepath.Join(base, "topics"))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, errors.Join(err, t.Close())
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || ValidateTopic(entry.Name()) != nil {
+				continue
+			}
+			if _, ok := t.topics[entry.Name()]; ok {
+				return nil, errors.Join(fmt.Errorf("topic %s is in %s and in another tenant's directory", entry.Name(), base), t.Close())
+			}
+			topicDir := filepath.Join(base, "topics", entry.Name())
+			desc, err := readTopic(topicDir, entry.Name())
+			if err == nil {
+				t.topics[desc.Name], err = t.open(topicDir, desc)
+			}
+			if err != nil {
+				return nil, errors.Join(fmt.Errorf("topic %s: %w", entry.Name(), err), t.Close())
+			}
+		}
+	}
+	t.stopped = make(chan struct{})
+	go t.runCleanup()
+	return t, nil
+}
+
+// Reads the description of the topic in dir. Topics created before
+// descriptions were kept have a partition per directory.
+func readTopic(dir, name string) (*api.Topic, error) {
+	b, err := os.ReadFile(filepath.Join(dir, topicFile))
+	if errors.Is(err, os.ErrNotExist) {
+		desc := &api.Topic{Name: name}
+		for {
+			if _, err := os.Stat(filepath.Join(dir, strconv.Itoa(int(desc.Partitions)))); err != nil {
+				break
+			}
+			desc.Partitions++
+		}
+		return desc, nil
+	} else if err != nil {
+		return nil, err
+	}
+	desc := &api.Topic{}
+	if err := protojson.Unmarshal(b, desc); err != nil {
+		return nil, err
+	}
+	desc.Name = name
+	return desc, nil
+}
+
+// Writes the description of the topic in dir, replacing the file so a
+// crash leaves the old or new one
+func writeTopic(dir string, desc *api.Topic) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	b, err := protojson.Marshal(desc)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, topicFile)
+	if err := os.WriteFile(path+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Opens the partitions of the described topic in dir, creating those that
+// don't exist
+func (t *Topics) open(dir string, desc *api.Topic) (*topic, error) {
+	config, err := t.config.topicConfig(desc.Name, desc.Configs)
+	if err != nil {
+		return nil, err
+	}
+	desc.Partitions = max(desc.Partitions, 1)
+	tp := &topic{Topic: desc, dir: dir, config: config}
+	if err := t.openPartitions(tp, desc.Partitions); err != nil {
+		return nil, errors.Join(err, tp.close(false))
+	}
+	return tp, nil
+}
+
+// Opens the topic's partitions up to n, after those it has open. On
+// failure the partitions opened stay open for the caller to close.
+func (t *Topics) openPartitions(tp *topic, n uint32) error {
+	for p := len(tp.partitions); p < int(n); p++ {
+		c := t.config
+		c.Tier.Prefix += fmt.Sprintf("topics/%s/%d/", tp.Name, p)
+		l, err := NewLog(filepath.Join(tp.dir, strconv.Itoa(p)), c)
+		if err != nil {
+			return err
+		}
+		tp.partitions = append(tp.partitions, l)
+	}
+	return nil
+}
+
+// The topic, the default topic for an empty name, or api.ErrTopicNotFound.
+// Callers must hold mu.
+func (t *Topics) topic(name string) (*topic, error) {
+	if name == "" || name == DefaultTopic {
+		return t.def, nil
+	}
+	tp, ok := t.topics[name]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	return tp, nil
+}
+
+// TopicPartition returns the log of the topic's partition p, the default
+// topic's for an empty name
+func (t *Topics) TopicPartition(name string, p uint32) (Partition, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tp, err := t.topic(name)
+	if err != nil {
+		return nil, err
+	}
+	l, err := tp.partition(p)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// CreateTopic creates the described topic empty, with at least one
+// partition, failing with api.ErrTopicExists if there's one by the name
+func (t *Topics) CreateTopic(desc *api.Topic) error {
+	if err := ValidateTopic(desc.Name); err != nil {
+		return err
+	}
+	if err := ValidateTopicConfigs(desc.Configs); err != nil {
+		return err
+	}
+	desc = proto.Clone(desc).(*api.Topic)
+	desc.Partitions = max(desc.Partitions, 1)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.topics[desc.Name]; ok || desc.Name == DefaultTopic {
+		return api.ErrTopicExists{Topic: desc.Name}
+	}
+	dir := filepath.Join(t.config.tenantDir(t.dir, t.config.TenantOf(desc.Name)), "topics", desc.Name)
+	if err := writeTopic(dir, desc); err != nil {
+		return err
+	}
+	tp, err := t.open(dir, desc)
+	if err != nil {
+		return err
+	}
+	t.topics[desc.Name] = tp
+	return nil
+}
+
+// DeleteTopic deletes the topic and its records. The default topic can't
+// be deleted.
+func (t *Topics) DeleteTopic(name string) error {
+	if name == DefaultTopic {
+		return errors.New("the default topic can't be deleted")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tp, ok := t.topics[name]
+	if !ok {
+		return api.ErrTopicNotFound{Topic: name}
+	}
+	delete(t.topics, name)
+	if err := tp.close(true); err != nil {
+		return err
+	}
+	return os.RemoveAll(tp.dir)
+}
+
+// DescribeTopic returns the topic's description, the default topic's for
+// an empty name
+func (t *Topics) DescribeTopic(name string) (*api.Topic, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tp, err := t.topic(name)
+	if err != nil {
+		return nil, err
+	}
+	return proto.Clone(tp.Topic).(*api.Topic), nil
+}
+
+// TopicConfig returns the topic's settings, the servers' with the topic's
+// configs over them
+func (t *Topics) TopicConfig(name string) (TopicConfig, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	tp, err := t.topic(name)
+	if err != nil {
+		return TopicConfig{}, err
+	}
+	return tp.config, nil
+}
+
+// SetTopicDefaults changes the servers' settings, which the default topic
+// goes by and the other topics' configs override. The partitions go by
+// them from their next append and cleanup.
+func (t *Topics) SetTopicDefaults(c TopicConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.config.Topic = c
+	t.def.config = c
+	for _, tp := range t.topics {
+		// topics were only ever created and altered with valid configs
+		tp.config, _ = t.config.topicConfig(tp.Name, tp.Topic.Configs)
+	}
+}
+
+// AlterTopicConfigs changes the topic's configs, an empty value removing
+// one, and returns the topic as altered. The partitions go by them from
+// their next append and cleanup. The default topic's settings are the
+// servers' and can't be altered.
+func (t *Topics) AlterTopicConfigs(name string, configs map[string]string) (*api.Topic, error) {
+	if name == "" || name == DefaultTopic {
+		return nil, errors.New("the default topic's configs can't be altered")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tp, ok := t.topics[name]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	desc := proto.Clone(tp.Topic).(*api.Topic)
+	desc.Configs = alterConfigs(desc.Configs, configs)
+	config, err := t.config.topicConfig(name, desc.Configs)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTopic(tp.dir, desc); err != nil {
+		return nil, err
+	}
+	tp.Topic, tp.config = desc, config
+	return proto.Clone(desc).(*api.Topic), nil
+}
+
+// CreatePartitions raises the topic's partition count to n, opening the
+// partitions added empty, and bumps its version. The topic's other
+// partitions serve meanwhile. The default topic's count is the servers'
+// and can't be raised.
+func (t *Topics) CreatePartitions(name string, n uint32) (*api.Topic, error) {
+	if name == "" || name == DefaultTopic {
+		return nil, errors.New("the default topic's partitions can't be added to")
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tp, ok := t.topics[name]
+	if !ok {
+		return nil, api.ErrTopicNotFound{Topic: name}
+	}
+	if n <= tp.Partitions {
+		return nil, fmt.Errorf("topic %s has %d partitions, can't have %d", name, tp.Partitions, n)
+	}
+	opened := len(tp.partitions)
+	desc := proto.Clone(tp.Topic).(*api.Topic)
+	desc.Partitions = n
+	desc.Version++
+	err := t.openPartitions(tp, n)
+	if err == nil {
+		err = writeTopic(tp.dir, desc)
+	}
+	if err != nil {
+		for _, l := range tp.partitions[opened:] {
+			err = errors.Join(err, l.Remove())
+		}
+		tp.partitions = tp.partitions[:opened]
+		return nil, err
+	}
+	tp.Topic = desc
+	return proto.Clone(desc).(*api.Topic), nil
+}
+
+// ListTopics describes the topics in order of their names, the default
+// topic included
+func (t *Topics) ListTopics() []*api.Topic {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	topics := []*api.Topic{proto.Clone(t.def.Topic).(*api.Topic)}
+	for _, tp := range t.topics {
+		topics = append(topics, proto.Clone(tp.Topic).(*api.Topic))
+	}
+	slices.SortFunc(topics, func(a, b *api.Topic) int { return strings.Compare(a.Name, b.Name) })
+	return topics
+}
+
+// Cleans up the topics' partitions every Config.CleanupInterval until the
+// topics close
+func (t *Topics) runCleanup() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(t.config.cleanupInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			t.cleanup()
+		}
+	}
+}
+
+// Applies each topic's retention and compaction to its partitions, holding
+// the read lock so the topics stay open meanwhile, then sums the tenants'
+// bytes
+func (t *Topics) cleanup() {
+	defer t.TenantStats()
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, tp := range append([]*topic{t.def}, slices.Collect(maps.Values(t.topics))...) {
+		for p, l := range tp.partitions {
+			if err := l.cleanup(tp.config); err != nil {
+				t.config.logger().Named("topics").Error("failed to clean up partition",
+					zap.String("topic", tp.Name),
+					zap.Int("partition", p),
+					zap.Error(err),
+				)
+			}
+		}
+	}
+}
+
+// TenantOf returns the tenant the topic is of, "" for none, see
+// Config.TenantOf
+func (t *Topics) TenantOf(topic string) string {
+	return tenantOf(t.usage.tenants, topic)
+}
+
+// TenantStats sums each tenant's use of the server's storage, in order of
+// their names
+func (t *Topics) TenantStats() []TenantStats {
+	return sortedTenantStats(t.usage.get(true))
+}
+
+// CheckTenant fails with api.ErrDiskFull if the topic's tenant holds its
+// max bytes, as last summed
+func (t *Topics) CheckTenant(topic string) error {
+	return t.usage.check(topic)
+}
+
+// Adds each topic partition's bytes
+func (t *Topics) sumTenants(add func(topic string, bytes uint64)) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for name, tp := range t.topics {
+		add(name, 0)
+		for _, l := range tp.partitions {
+			add(name, l.size())
+		}
+	}
+}
+
+// Stops the cleanup, which hasn't started if opening the topics failed
+func (t *Topics) stopCleanup() {
+	select {
+	case <-t.done:
+	default:
+		close(t.done)
+	}
+	if t.stopped != nil {
+		<-t.stopped
+	}
+}
+
+// Remove closes every topic's log and deletes their data
+func (t *Topics) Remove() error {
+	t.stopCleanup()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var errs []error
+	for name, tp := range t.topics {
+		errs = append(errs, tp.close(true))
+		delete(t.topics, name)
+	}
+	return errors.Join(append(errs, t.Log.Remove())...)
+}
+
+// Close closes every topic's log
+func (t *Topics) Close() error {
+	t.stopCleanup()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	errs := []error{t.Log.Close()}
+	for _, tp := range t.topics {
+		errs = append(errs, tp.close(false))
+	}
+	return errors.Join(errs...)
+}
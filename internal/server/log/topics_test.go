@@ -0,0 +1,179 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopics(t *testing.T) {
+	dir := t.TempDir()
+	topics, err := NewTopics(dir, Config{})
+	require.NoError(t, err)
+	require.Equal(t, []string{DefaultTopic}, names(topics.ListTopics()))
+
+	events := &api.Topic{Name: "events", Partitions: 2, Configs: map[string]string{"retention.ms": "60000"}}
+	require.NoError(t, topics.CreateTopic(events))
+	require.ErrorAs(t, topics.CreateTopic(&api.Topic{Name: "events"}), &api.ErrTopicExists{})
+	require.ErrorAs(t, topics.CreateTopic(&api.Topic{Name: DefaultTopic}), &api.ErrTopicExists{})
+	for _, name := range []string{"", ".", "..", "a/b", "héllo"} {
+		require.Error(t, topics.CreateTopic(&api.Topic{Name: name}), name)
+	}
+	require.NoError(t, topics.CreateTopic(&api.Topic{Name: "single"}))
+
+	// each topic partition has its own offsets
+	for p := uint32(0); p < 2; p++ {
+		l, err := topics.TopicPartition("events", p)
+		require.NoError(t, err)
+		off, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("event %d", p))})
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), off)
+	}
+	_, err = topics.TopicPartition("events", 2)
+	require.ErrorAs(t, err, &api.ErrPartitionNotFound{})
+	off, err := topics.Append(&api.Record{Value: []byte("default")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	l, err := topics.TopicPartition("", 0)
+	require.NoError(t, err)
+	require.Same(t, topics.Log, l)
+	_, err = topics.TopicPartition("missing", 0)
+	require.ErrorAs(t, err, &api.ErrTopicNotFound{})
+
+	desc, err := topics.DescribeTopic("events")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), desc.Partitions)
+	require.Equal(t, "60000", desc.Configs["retention.ms"])
+	desc, err = topics.DescribeTopic("single")
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), desc.Partitions)
+	desc, err = topics.DescribeTopic("")
+	require.NoError(t, err)
+	require.Equal(t, DefaultTopic, desc.Name)
+	_, err = topics.DescribeTopic("missing")
+	require.ErrorAs(t, err, &api.ErrTopicNotFound{})
+
+	// configs change while the topic's open
+	desc, err = topics.AlterTopicConfigs("events", map[string]string{CleanupPolicyConfig: "compact"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{RetentionMsConfig: "60000", CleanupPolicyConfig: "compact"}, desc.Configs)
+	config, err := topics.TopicConfig("events")
+	require.NoError(t, err)
+	require.True(t, config.Compact)
+	require.Equal(t, time.Minute, config.Retention)
+	_, err = topics.AlterTopicConfigs("events", map[string]string{AcksConfig: "some"})
+	require.Error(t, err)
+	_, err = topics.AlterTopicConfigs(DefaultTopic, map[string]string{AcksConfig: "all"})
+	require.Error(t, err)
+	_, err = topics.AlterTopicConfigs("missing", nil)
+	require.ErrorAs(t, err, &api.ErrTopicNotFound{})
+	require.Error(t, topics.CreateTopic(&api.Topic{Name: "invalid", Configs: map[string]string{"color": "blue"}}))
+
+	// partitions are added while the others serve
+	desc, err = topics.CreatePartitions("events", 3)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), desc.Partitions)
+	require.Equal(t, uint64(1), desc.Version)
+	l, err = topics.TopicPartition("events", 2)
+	require.NoError(t, err)
+	_, err = l.Append(&api.Record{Value: []byte("event 2")})
+	require.NoError(t, err)
+	_, err = topics.CreatePartitions("events", 3)
+	require.Error(t, err)
+	_, err = topics.CreatePartitions(DefaultTopic, 2)
+	require.Error(t, err)
+	_, err = topics.CreatePartitions("missing", 2)
+	require.ErrorAs(t, err, &api.ErrTopicNotFound{})
+
+	// topics outlive the process, their configs too
+	require.NoError(t, topics.Close())
+	topics, err = NewTopics(dir, Config{})
+	require.NoError(t, err)
+	require.Equal(t, []string{DefaultTopic, "events", "single"}, names(topics.ListTopics()))
+	desc, err = topics.DescribeTopic("events")
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), desc.Partitions)
+	require.Equal(t, uint64(1), desc.Version)
+	require.Equal(t, "60000", desc.Configs["retention.ms"])
+	config, err = topics.TopicConfig("events")
+	require.NoError(t, err)
+	require.True(t, config.Compact)
+	l, err = topics.TopicPartition("events", 1)
+	require.NoError(t, err)
+	record, err := l.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "event 1", string(record.Value))
+	record, err = topics.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "default", string(record.Value))
+
+	require.Error(t, topics.DeleteTopic(DefaultTopic))
+	require.NoError(t, topics.DeleteTopic("events"))
+	require.ErrorAs(t, topics.DeleteTopic("events"), &api.ErrTopicNotFound{})
+	require.Equal(t, []string{DefaultTopic, "single"}, names(topics.ListTopics()))
+	require.NoError(t, topics.Close())
+
+	// topics made before they were described keep their partitions
+	require.NoError(t, os.Remove(filepath.Join(dir, "topics", "single", topicFile)))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "topics", "single", "1"), 0755))
+	topics, err = NewTopics(dir, Config{})
+	require.NoError(t, err)
+	require.Equal(t, []string{DefaultTopic, "single"}, names(topics.ListTopics()))
+	desc, err = topics.DescribeTopic("single")
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), desc.Partitions)
+	require.NoError(t, topics.Close())
+}
+
+func TestTopicsCleanup(t *testing.T) {
+	c := Config{CleanupInterval: 10 * time.Millisecond}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	topics, err := NewTopics(t.TempDir(), c)
+	require.NoError(t, err)
+	defer topics.Close()
+	require.NoError(t, topics.CreateTopic(&api.Topic{Name: "events"}))
+	l, err := topics.TopicPartition("events", 0)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Key: []byte("key"), Value: []byte("value")})
+		require.NoError(t, err)
+	}
+	low := func() uint64 { return l.(*Log).Stats().LowWatermark }
+	time.Sleep(50 * time.Millisecond)
+	require.Zero(t, low())
+
+	// altered retention applies without reopening the topic
+	_, err = topics.AlterTopicConfigs("events", map[string]string{RetentionBytesConfig: "1"})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool { return low() == 4 }, time.Second, 10*time.Millisecond)
+
+	// so do the servers' settings, under the topics' configs
+	require.NoError(t, topics.CreateTopic(&api.Topic{Name: "logs"}))
+	logs, err := topics.TopicPartition("logs", 0)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := logs.Append(&api.Record{Value: []byte("value")})
+		require.NoError(t, err)
+	}
+	topics.SetTopicDefaults(TopicConfig{RetentionBytes: 1, MaxRecordBytes: 10})
+	require.Eventually(t, func() bool { return logs.(*Log).Stats().LowWatermark == 4 }, time.Second, 10*time.Millisecond)
+	config, err := topics.TopicConfig("events")
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), config.MaxRecordBytes)
+	config, err = topics.TopicConfig(DefaultTopic)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), config.MaxRecordBytes)
+}
+
+func names(topics []*api.Topic) []string {
+	var names []string
+	for _, topic := range topics {
+		names = append(names, topic.Name)
+	}
+	return names
+}
@@ -0,0 +1,31 @@
+package log
+
+import (
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Opens a segment's store file, on io_uring when the config asks for it
+// and the platform has it. Faults are injected into plain files only.
+func openStoreFile(name string, flag int, c Config) (file, error) {
+	if !c.IOUring || c.Faults != nil {
+		return openSegmentFile(name, flag, c.Faults)
+	}
+	return openURingFile(name, flag, c.logger())
+}
+
+// A file that writes and syncs what it wrote in one go, as a store on
+// io_uring submits the two together
+type writeSyncer interface {
+	writeSync(p []byte) (int, error)
+}
+
+var uringWarning sync.Once
+
+// Warns, once, that stores are on plain files after all
+func uringUnavailable(logger *zap.Logger, err error) {
+	uringWarning.Do(func() {
+		logger.Named("store").Warn("io_uring unavailable, stores use plain files", zap.Error(err))
+	})
+}
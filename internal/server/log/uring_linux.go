@@ -0,0 +1,378 @@
+package log
+
+import (
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// What a store on io_uring uses of its ABI, see io_uring(7)
+const (
+	uringOpFsync = 3
+	uringOpRead  = 22
+	uringOpWrite = 23
+
+	uringSQELink        = 1 << 2
+	uringEnterGetEvents = 1
+	// IORING_FEAT_RW_CUR_POS, from when IORING_OP_READ and _WRITE are there
+	uringFeatRWCurPos = 1 << 3
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringEntries = 256
+)
+
+type uringParams struct {
+	sqEntries, cqEntries, flags, sqThreadCPU, sqThreadIdle, features, wqFD uint32
+	resv                                                                   [3]uint32
+	sqOff                                                                  struct {
+		head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+		userAddr                                                        uint64
+	}
+	cqOff struct {
+		head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+		userAddr                                                        uint64
+	}
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFDIn  int32
+	addr3       uint64
+	_           uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+// An operation submitted to the ring, done once it completes with res
+type uringOp struct {
+	sqe uringSQE
+	// buf is kept for as long as the kernel reads or writes it
+	buf  []byte
+	res  int32
+	done chan struct{}
+}
+
+// uring is an io_uring the stores on it share. Operations are queued as
+// they're made and submitted together by whoever's first to submit, so
+// concurrent reads and a group commit's write and fsync go in one
+// io_uring_enter. A goroutine reaps their completions.
+type uring struct {
+	fd                     int
+	sqRing, cqRing, sqeMem []byte
+	sqTail                 *uint32
+	sqMask                 uint32
+	sqes                   []uringSQE
+	cqHead, cqTail         *uint32
+	cqMask                 uint32
+	cqes                   []uringCQE
+
+	// operations in flight, at most the submission queue's entries so
+	// neither queue overflows
+	slots chan struct{}
+
+	mu   sync.Mutex
+	tail uint32
+	// queued are the operations not submitted yet, in order
+	queued     []*uringOp
+	submitting bool
+	ops        map[uint64]*uringOp
+	next       uint64
+	// err fails every operation once submitting has
+	err error
+}
+
+// The ring the stores on io_uring share, set up the first time one's opened
+var sharedURing = sync.OnceValues(func() (*uring, error) {
+	return newURing(uringEntries)
+})
+
+func newURing(entries uint32) (*uring, error) {
+	var p uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, os.NewSyscallError("io_uring_setup", errno)
+	}
+	r := &uring{fd: int(fd), ops: make(map[uint64]*uringOp)}
+	if p.features&uringFeatRWCurPos == 0 {
+		r.close()
+		return nil, errors.New("io_uring predates IORING_OP_READ and IORING_OP_WRITE")
+	}
+	prot, flags := unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE
+	var err error
+	if r.sqRing, err = unix.Mmap(r.fd, uringOffSQRing, int(p.sqOff.array+p.sqEntries*4), prot, flags); err != nil {
+		r.close()
+		return nil, err
+	}
+	if r.cqRing, err = unix.Mmap(r.fd, uringOffCQRing, int(p.cqOff.cqes+p.cqEntries*uint32(unsafe.Sizeof(uringCQE{}))), prot, flags); err != nil {
+		r.close()
+		return nil, err
+	}
+	if r.sqeMem, err = unix.Mmap(r.fd, uringOffSQEs, int(p.sqEntries)*int(unsafe.Sizeof(uringSQE{})), prot, flags); err != nil {
+		r.close()
+		return nil, err
+	}
+	r.sqTail = (*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.tail]))
+	r.sqMask = *(*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.ringMask]))
+	r.sqes = unsafe.Slice((*uringSQE)(unsafe.Pointer(&r.sqeMem[0])), p.sqEntries)
+	// each slot of the array points at the entry of the same index
+	array := unsafe.Slice((*uint32)(unsafe.Pointer(&r.sqRing[p.sqOff.array])), p.sqEntries)
+	for i := range array {
+		array[i] = uint32(i)
+	}
+	r.tail = atomic.LoadUint32(r.sqTail)
+	r.cqHead = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.head]))
+	r.cqTail = (*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.tail]))
+	r.cqMask = *(*uint32)(unsafe.Pointer(&r.cqRing[p.cqOff.ringMask]))
+	r.cqes = unsafe.Slice((*uringCQE)(unsafe.Pointer(&r.cqRing[p.cqOff.cqes])), p.cqEntries)
+	r.slots = make(chan struct{}, p.sqEntries)
+	go r.reap()
+	return r, nil
+}
+
+// Unmaps and closes a ring that failed to set up
+func (r *uring) close() {
+	for _, b := range [][]byte{r.sqRing, r.cqRing, r.sqeMem} {
+		if b != nil {
+			unix.Munmap(b)
+		}
+	}
+	unix.Close(r.fd)
+}
+
+func (r *uring) enter(toSubmit, minComplete, flags uint32) (int, error) {
+	for {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(r.fd), uintptr(toSubmit), uintptr(minComplete), uintptr(flags), 0, 0)
+		switch errno {
+		case 0:
+			return int(n), nil
+		case unix.EINTR, unix.EAGAIN, unix.EBUSY:
+			// interrupted, or out of resources until completions are reaped
+			runtime.Gosched()
+		default:
+			return 0, os.NewSyscallError("io_uring_enter", errno)
+		}
+	}
+}
+
+// do submits the operations, in order, and waits for them to complete
+func (r *uring) do(ops ...*uringOp) error {
+	for _, op := range ops {
+		op.done = make(chan struct{})
+		r.slots <- struct{}{}
+	}
+	r.mu.Lock()
+	if r.err != nil {
+		err := r.err
+		r.mu.Unlock()
+		for range ops {
+			<-r.slots
+		}
+		return err
+	}
+	for _, op := range ops {
+		r.next++
+		op.sqe.userData = r.next
+		r.ops[r.next] = op
+		r.sqes[r.tail&r.sqMask] = op.sqe
+		r.tail++
+	}
+	atomic.StoreUint32(r.sqTail, r.tail)
+	r.queued = append(r.queued, ops...)
+	if !r.submitting {
+		r.submit()
+	}
+	r.mu.Unlock()
+	for _, op := range ops {
+		<-op.done
+	}
+	return nil
+}
+
+// Submits what's queued, along with what's queued meanwhile, callers must
+// hold mu
+func (r *uring) submit() {
+	r.submitting = true
+	for len(r.queued) > 0 && r.err == nil {
+		n := len(r.queued)
+		r.mu.Unlock()
+		submitted, err := r.enter(uint32(n), 0, 0)
+		r.mu.Lock()
+		if err != nil {
+			r.err = err
+			// never submitted, failed here instead of completing
+			for _, op := range r.queued {
+				delete(r.ops, op.sqe.userData)
+				op.res = -int32(unix.EIO)
+				close(op.done)
+				<-r.slots
+			}
+			r.queued = nil
+			break
+		}
+		uringSubmitted.Observe(float64(submitted))
+		r.queued = r.queued[submitted:]
+	}
+	r.submitting = false
+}
+
+// Reaps completions for as long as the process runs
+func (r *uring) reap() {
+	for {
+		if _, err := r.enter(0, 1, uringEnterGetEvents); err != nil {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		head, tail := atomic.LoadUint32(r.cqHead), atomic.LoadUint32(r.cqTail)
+		for ; head != tail; head++ {
+			cqe := r.cqes[head&r.cqMask]
+			r.mu.Lock()
+			op := r.ops[cqe.userData]
+			delete(r.ops, cqe.userData)
+			r.mu.Unlock()
+			if op != nil {
+				op.res = cqe.res
+				close(op.done)
+				<-r.slots
+			}
+		}
+		atomic.StoreUint32(r.cqHead, head)
+	}
+}
+
+// A store file read, written and synced through io_uring
+type uringFile struct {
+	*os.File
+	ring *uring
+}
+
+// Opens a store file on the shared ring, or as a plain file when there's no
+// ring to be had
+func openURingFile(name string, flag int, logger *zap.Logger) (file, error) {
+	f, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ring, err := sharedURing()
+	if err != nil {
+		uringUnavailable(logger, err)
+		return f, nil
+	}
+	return &uringFile{File: f, ring: ring}, nil
+}
+
+// An operation on the file, reading or writing p from off
+func (f *uringFile) op(opcode uint8, p []byte, off uint64) *uringOp {
+	op := &uringOp{buf: p}
+	op.sqe.opcode = opcode
+	op.sqe.fd = int32(f.Fd())
+	op.sqe.off = off
+	if len(p) > 0 {
+		op.sqe.addr = uint64(uintptr(unsafe.Pointer(&p[0])))
+		op.sqe.len = uint32(len(p))
+	}
+	return op
+}
+
+// Carries out the operations, returning what each completed with
+func (f *uringFile) do(ops ...*uringOp) error {
+	err := f.ring.do(ops...)
+	runtime.KeepAlive(f.File)
+	return err
+}
+
+func (f *uringFile) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		op := f.op(uringOpRead, p[n:], uint64(off)+uint64(n))
+		if err := f.do(op); err != nil {
+			return n, err
+		}
+		if op.res < 0 {
+			return n, &os.PathError{Op: "read", Path: f.Name(), Err: unix.Errno(-op.res)}
+		} else if op.res == 0 {
+			return n, io.EOF
+		}
+		n += int(op.res)
+	}
+	return n, nil
+}
+
+func (f *uringFile) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		// at the file's position, its end as stores are opened to append
+		op := f.op(uringOpWrite, p[n:], ^uint64(0))
+		if err := f.do(op); err != nil {
+			return n, err
+		}
+		if op.res < 0 {
+			return n, &os.PathError{Op: "write", Path: f.Name(), Err: unix.Errno(-op.res)}
+		} else if op.res == 0 {
+			return n, io.ErrShortWrite
+		}
+		n += int(op.res)
+	}
+	return n, nil
+}
+
+func (f *uringFile) Sync() error {
+	op := f.op(uringOpFsync, nil, 0)
+	if err := f.do(op); err != nil {
+		return err
+	}
+	if op.res < 0 {
+		return &os.PathError{Op: "fsync", Path: f.Name(), Err: unix.Errno(-op.res)}
+	}
+	return nil
+}
+
+// writeSync writes p and syncs the file, submitting the two linked so
+// they go in one submission
+func (f *uringFile) writeSync(p []byte) (int, error) {
+	write := f.op(uringOpWrite, p, ^uint64(0))
+	write.sqe.flags = uringSQELink
+	sync := f.op(uringOpFsync, nil, 0)
+	if err := f.do(write, sync); err != nil {
+		return 0, err
+	}
+	if write.res < 0 {
+		return 0, &os.PathError{Op: "write", Path: f.Name(), Err: unix.Errno(-write.res)}
+	}
+	if n := int(write.res); n < len(p) {
+		// short, and the fsync linked to it canceled
+		m, err := f.Write(p[n:])
+		if err != nil {
+			return n + m, err
+		}
+		return len(p), f.Sync()
+	}
+	if sync.res < 0 {
+		return len(p), &os.PathError{Op: "fsync", Path: f.Name(), Err: unix.Errno(-sync.res)}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,63 @@
+package log
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestURing(t *testing.T) {
+	if _, err := sharedURing(); err != nil {
+		t.Skipf("no io_uring: %v", err)
+	}
+	name := filepath.Join(t.TempDir(), "0.store")
+	f, err := openURingFile(name, os.O_RDWR|os.O_CREATE|os.O_APPEND, zap.NewNop())
+	require.NoError(t, err)
+	require.IsType(t, &uringFile{}, f)
+	n, err := f.Write([]byte("hello "))
+	require.NoError(t, err)
+	require.Equal(t, 6, n)
+	n, err = f.(writeSyncer).writeSync([]byte("world"))
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.NoError(t, f.Sync())
+	b := make([]byte, 11)
+	_, err = f.ReadAt(b, 0)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(b))
+	n, err = f.ReadAt(b, 6)
+	require.Equal(t, io.EOF, err)
+	require.Equal(t, 5, n)
+	require.NoError(t, f.Close())
+
+	// a log on io_uring, its appends synced together
+	c := Config{IOUring: true, SyncOnAppend: true}
+	dir := t.TempDir()
+	l, err := NewLog(dir, c)
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := l.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, l.Close())
+	l, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer l.Close()
+	for off := uint64(0); off < 20; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), record.Value)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package log
+
+import (
+	"errors"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+// Opens a store file as a plain file, io_uring is Linux only
+func openURingFile(name string, flag int, logger *zap.Logger) (file, error) {
+	uringUnavailable(logger, errors.New("io_uring is only on Linux"))
+	return os.OpenFile(name, flag, 0644)
+}
@@ -0,0 +1,498 @@
+package log
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// VerifyOptions says how to verify a data directory, see Verify
+type VerifyOptions struct {
+	// Repair fixes what can be fixed without losing a record: indexes that
+	// don't match their stores are rebuilt from them, torn records at the
+	// end of stores cut off, and files left half written removed
+	Repair bool
+	// Keyring opens encrypted logs' records. Without it their segments are
+	// checked as far as they can be sealed: records framed end to end and
+	// indexed where they are with offsets that rise.
+	Keyring *Keyring
+}
+
+// Problem is something wrong Verify found
+type Problem struct {
+	// Path is the file or log directory, relative to the data directory
+	Path     string `json:"path"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+// VerifyReport says what Verify checked and what it found
+type VerifyReport struct {
+	Logs     int    `json:"logs"`
+	Segments int    `json:"segments"`
+	Records  uint64 `json:"records"`
+	// Sealed is how many segments had records the keyring couldn't open
+	Sealed   int       `json:"sealed"`
+	Problems []Problem `json:"problems"`
+}
+
+// OK reports that every problem found was repaired
+func (r *VerifyReport) OK() bool {
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// Verify checks the logs in the data directory dir, every directory with
+// segments in it, with the server stopped: stores' records are framed end
+// to end with offsets that rise, indexes point at them, each segment's
+// offsets carry on from the last's and the local segments from the tier
+// manifest's. Each log must be in a format version this build opens, and
+// the offsets, topic and tier files must parse. What's wrong is reported
+// rather than returned, the error is for dir that can't be walked or is
+// locked, see LockDir.
+func Verify(dir string, opts VerifyOptions) (*VerifyReport, error) {
+	lock, err := LockDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	v := &verifier{root: dir, opts: opts, report: &VerifyReport{}}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			switch d.Name() {
+			case cacheDirName:
+				// fetched from the tier, and removed when the log opens
+				return filepath.SkipDir
+			case quarantineDirName:
+				// no longer the log's
+				return filepath.SkipDir
+			}
+			return v.verifyLog(path)
+		}
+		switch name := d.Name(); {
+		case strings.HasSuffix(name, ".tmp"):
+			v.problem(path, "left half written", func() error { return os.Remove(path) })
+		case name == offsetsFile:
+			v.parse(path, func(b []byte) error { return json.Unmarshal(b, &map[string]uint64{}) })
+		case name == startFile:
+			v.parse(path, func(b []byte) error { return json.Unmarshal(b, &struct{ Offset uint64 }{}) })
+		case name == topicFile:
+			v.parse(path, func(b []byte) error { return protojson.Unmarshal(b, &api.Topic{}) })
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.report, nil
+}
+
+type verifier struct {
+	root   string
+	opts   VerifyOptions
+	report *VerifyReport
+}
+
+// Reports the problem with the file, repairing it with repair when asked
+// to and there's one
+func (v *verifier) problem(path, problem string, repair func() error) {
+	rel, err := filepath.Rel(v.root, path)
+	if err != nil {
+		rel = path
+	}
+	p := Problem{Path: filepath.ToSlash(rel), Problem: problem}
+	if v.opts.Repair && repair != nil {
+		if err := repair(); err != nil {
+			p.Problem += fmt.Sprintf(", repairing it failed: %v", err)
+		} else {
+			p.Repaired = true
+		}
+	}
+	v.report.Problems = append(v.report.Problems, p)
+}
+
+func (v *verifier) parse(path string, fn func([]byte) error) {
+	b, err := os.ReadFile(path)
+	if err == nil {
+		err = fn(b)
+	}
+	if err != nil {
+		v.problem(path, fmt.Sprintf("doesn't parse: %v", err), nil)
+	}
+}
+
+// Verifies the log in dir, if there is one
+func (v *verifier) verifyLog(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	stores, indexes := make(map[uint64]bool), make(map[uint64]bool)
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		off, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), ext), 10, 0)
+		if err != nil || entry.IsDir() {
+			continue
+		}
+		switch ext {
+		case ".store":
+			stores[off] = true
+		case ".index":
+			indexes[off] = true
+		}
+	}
+	if len(stores) == 0 && len(indexes) == 0 {
+		return nil
+	}
+	v.report.Logs++
+	version, _, err := readFormat(dir)
+	switch {
+	case err != nil:
+		v.problem(dir, err.Error(), nil)
+	case version < 0 || version > FormatVersion:
+		v.problem(dir, fmt.Sprintf("is in format version %d, newer than this build's %d", version, FormatVersion), nil)
+	case !formats[version].Open:
+		v.problem(dir, fmt.Sprintf("is in format version %d, migrate it to %d", version, FormatVersion), nil)
+	}
+	var bases []uint64
+	for base := range stores {
+		bases = append(bases, base)
+	}
+	for base := range indexes {
+		if !stores[base] {
+			name := filepath.Join(dir, fmt.Sprintf("%d.index", base))
+			// opening the log would add an empty segment for it
+			v.problem(name, "has no store", func() error { return os.Remove(name) })
+		}
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+
+	var segments []archivedSegment
+	for i, base := range bases {
+		next, ok := v.verifySegment(dir, base)
+		if i > 0 && segments[i-1].NextOffset != math.MaxUint64 && segments[i-1].NextOffset != base {
+			v.problem(dir, fmt.Sprintf("segment %d ends at %d, not where segment %d starts", bases[i-1], segments[i-1].NextOffset, base), nil)
+		}
+		if !ok {
+			next = math.MaxUint64
+		}
+		segments = append(segments, archivedSegment{BaseOffset: base, NextOffset: next})
+	}
+	v.verifyArchive(dir, segments)
+	return nil
+}
+
+// Verifies the segment's store and index, returning its next offset if
+// it's known
+func (v *verifier) verifySegment(dir string, base uint64) (next uint64, ok bool) {
+	storeName := filepath.Join(dir, fmt.Sprintf("%d.store", base))
+	indexName := filepath.Join(dir, fmt.Sprintf("%d.index", base))
+	v.report.Segments++
+	scan, err := scanStore(storeName, base, v.opts.Keyring)
+	if err != nil {
+		v.problem(storeName, err.Error(), nil)
+		return 0, false
+	}
+	v.report.Records += uint64(len(scan.entries))
+	if scan.sealed {
+		v.report.Sealed++
+	}
+	if scan.end < scan.size {
+		v.problem(storeName, fmt.Sprintf("has a torn record at %d, %d bytes before its end", scan.end, scan.size-scan.end),
+			func() error { return truncateStore(storeName, int64(scan.end)) })
+	}
+	matches, err := checkIndex(indexName, scan, math.MaxUint32+1)
+	if err != nil {
+		v.problem(indexName, err.Error(), nil)
+		return 0, false
+	}
+	if !matches {
+		var rebuild func() error
+		if !scan.sealed {
+			rebuild = func() error { return writeIndex(indexName, scan.entries) }
+		}
+		v.problem(indexName, "doesn't match its store", rebuild)
+		if scan.sealed {
+			return 0, false
+		}
+	}
+	if scan.sealed {
+		// the index's offsets, which rise, are the records'
+		if n := len(scan.entries); n > 0 {
+			return base + uint64(scan.entries[n-1].rel) + 1, true
+		}
+		return base, true
+	}
+	return scan.next, true
+}
+
+// Verifies the log's tier manifest: the archived segments carry on from
+// each other, and the local ones from them, those in both the same
+func (v *verifier) verifyArchive(dir string, local []archivedSegment) {
+	name := filepath.Join(dir, manifestName)
+	b, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var archived []archivedSegment
+	if err == nil {
+		err = json.Unmarshal(b, &archived)
+	}
+	if err != nil {
+		v.problem(name, fmt.Sprintf("doesn't parse: %v", err), nil)
+		return
+	}
+	for i, seg := range archived {
+		if i > 0 && archived[i-1].NextOffset != seg.BaseOffset {
+			v.problem(name, fmt.Sprintf("archived segment %d ends at %d, not where segment %d starts",
+				archived[i-1].BaseOffset, archived[i-1].NextOffset, seg.BaseOffset), nil)
+		}
+	}
+	if len(archived) == 0 || len(local) == 0 {
+		return
+	}
+	if end := archived[len(archived)-1].NextOffset; local[0].BaseOffset > end {
+		v.problem(name, fmt.Sprintf("archived segments end at %d, before the local ones start at %d", end, local[0].BaseOffset), nil)
+	}
+	for _, seg := range local {
+		for _, a := range archived {
+			if a.BaseOffset == seg.BaseOffset && seg.NextOffset != math.MaxUint64 && a.NextOffset != seg.NextOffset {
+				v.problem(name, fmt.Sprintf("archived segment %d ends at %d, the local one at %d", a.BaseOffset, a.NextOffset, seg.NextOffset), nil)
+			}
+		}
+	}
+}
+
+// An index entry, the record's offset relative to its segment's base and
+// its position in the store
+type indexEntry struct {
+	rel uint32
+	pos uint64
+}
+
+// What scanStore read of a store
+type storeScan struct {
+	entries []indexEntry
+	// end is where the last whole record ends, short of the file's size
+	// when a record after it is torn
+	end, size uint64
+	// next is one past the last record's offset, the base for an empty
+	// store. It isn't known when sealed.
+	next uint64
+	// sealed records couldn't be opened, their entries have positions alone
+	sealed bool
+}
+
+// Reads the store's records in order, checking their offsets rise from
+// the segment's base. Records that don't read as records are sealed, and
+// are opened with keys when there are some. A record that fails the checks
+// fails the scan, which has the records before it.
+func scanStore(name string, base uint64, keys *Keyring) (*storeScan, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	scan := &storeScan{size: uint64(fi.Size()), next: base}
+	r := bufio.NewReader(f)
+	size := make([]byte, lenWidth)
+	for {
+		if _, err := io.ReadFull(r, size); err != nil {
+			// io.EOF at the end of the last record
+			return scan, nil
+		}
+		n, hole := frameLen(size)
+		if n > scan.size-scan.end-lenWidth {
+			return scan, nil
+		}
+		if hole {
+			// deleted records, punched out
+			if _, err := r.Discard(int(n)); err != nil {
+				return scan, err
+			}
+			scan.end += lenWidth + n
+			continue
+		}
+		p := make([]byte, n)
+		if _, err := io.ReadFull(r, p); err != nil {
+			return scan, err
+		}
+		offs, err := recordOffsets(p, keys)
+		switch {
+		case err != nil && len(scan.entries) == 0 && keys == nil && looksSealed(p):
+			scan.sealed = true
+		case scan.sealed:
+		case err != nil:
+			return scan, fmt.Errorf("record at %d doesn't read: %w", scan.end, err)
+		}
+		if scan.sealed {
+			// the entries of a sealed batch are told apart by checkIndex
+			offs = nil
+			scan.entries = append(scan.entries, indexEntry{pos: scan.end})
+		}
+		for _, off := range offs {
+			if off < scan.next || off-base > math.MaxUint32 {
+				return scan, fmt.Errorf("record at %d has offset %d, expected one from %d", scan.end, off, scan.next)
+			}
+			scan.entries = append(scan.entries, indexEntry{rel: uint32(off - base), pos: scan.end})
+			scan.next = off + 1
+		}
+		scan.end += lenWidth + n
+	}
+}
+
+// The offsets of the record, or of the records in the batch, stored,
+// opening it with keys if it's sealed. Sealed records start with their
+// key's ID, which no record or batch starts with.
+func recordOffsets(p []byte, keys *Keyring) ([]uint64, error) {
+	offs, err := storedOffsets(p)
+	if err != nil && keys != nil {
+		if p, err = keys.Open(p); err == nil {
+			offs, err = storedOffsets(p)
+		}
+	}
+	return offs, err
+}
+
+// The offsets of the plaintext record or batch
+func storedOffsets(p []byte) ([]uint64, error) {
+	if isBatch(p) {
+		b, err := unmarshalBatch(p)
+		if err != nil {
+			return nil, err
+		}
+		return b.offs, nil
+	}
+	record := &api.Record{}
+	if err := proto.Unmarshal(p, record); err != nil {
+		return nil, err
+	}
+	return []uint64{record.Offset}, nil
+}
+
+// Reports whether the stored bytes could be a sealed record, starting with
+// a key ID. One big enough not to start with a zero byte would take
+// millions of rotations.
+func looksSealed(p []byte) bool {
+	id, err := KeyID(p)
+	return err == nil && id>>24 == 0
+}
+
+// Reports whether the index has the store's entries. A sealed store's
+// entries take the index's offsets, which must rise below span.
+func checkIndex(name string, scan *storeScan, span uint64) (bool, error) {
+	b, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if scan.sealed {
+		return checkSealedIndex(b, scan, span), nil
+	}
+	if uint64(len(b)) != uint64(len(scan.entries))*entWidth {
+		return false, nil
+	}
+	for i, entry := range scan.entries {
+		e := b[uint64(i)*entWidth:]
+		rel, pos := enc.Uint32(e), enc.Uint64(e[offWidth:entWidth])
+		if pos != entry.pos || rel != entry.rel {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// checkIndex's for a sealed store, whose entries are a record's or a
+// batch's, which has an entry for each of its records at its position
+func checkSealedIndex(b []byte, scan *storeScan, span uint64) bool {
+	var entries []indexEntry
+	j := 0
+	for i := uint64(0); i+entWidth <= uint64(len(b)); i += entWidth {
+		rel, pos := enc.Uint32(b[i:]), enc.Uint64(b[i+offWidth:i+entWidth])
+		if uint64(rel) >= span || len(entries) > 0 && rel <= entries[len(entries)-1].rel {
+			return false
+		}
+		batched := len(entries) > 0 && pos == entries[len(entries)-1].pos
+		if !batched {
+			if j == len(scan.entries) || pos != scan.entries[j].pos {
+				return false
+			}
+			j++
+		}
+		entries = append(entries, indexEntry{rel: rel, pos: pos})
+	}
+	if uint64(len(b))%entWidth != 0 || j != len(scan.entries) {
+		return false
+	}
+	scan.entries = entries
+	return true
+}
+
+// Writes the entries as the index file, as Close leaves it
+func writeIndex(name string, entries []indexEntry) error {
+	b := make([]byte, uint64(len(entries))*entWidth)
+	for i, entry := range entries {
+		enc.PutUint32(b[uint64(i)*entWidth:], entry.rel)
+		enc.PutUint64(b[uint64(i)*entWidth+offWidth:], entry.pos)
+	}
+	// replaced rather than rewritten, so a link backup sharing it keeps its own
+	if err := os.WriteFile(name+".tmp", b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// Cuts the store off at size, replacing it rather than truncating it, so
+// a link backup sharing it keeps its own
+func truncateStore(name string, size int64) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(out, in, size)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	// Windows won't rename over an open file
+	if err := in.Close(); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
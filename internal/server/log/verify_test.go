@@ -0,0 +1,115 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// Fills a data directory with the default topic's five records over two
+// segments and a topic, then closes it
+func testDataDir(t *testing.T, c Config) string {
+	t.Helper()
+	dir := t.TempDir()
+	c.Segment.MaxIndexBytes = entWidth * 3
+	topics, err := NewTopics(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := topics.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, topics.CreateTopic(&api.Topic{Name: "events"}))
+	require.NoError(t, topics.CommitOffset("reader", 2))
+	require.NoError(t, topics.Close())
+	return dir
+}
+
+func paths(problems []Problem) []string {
+	var paths []string
+	for _, p := range problems {
+		paths = append(paths, p.Path)
+	}
+	return paths
+}
+
+func TestVerify(t *testing.T) {
+	dir := testDataDir(t, Config{})
+	report, err := Verify(dir, VerifyOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+	require.Equal(t, 2, report.Logs)
+	require.Equal(t, 3, report.Segments)
+	require.Equal(t, uint64(5), report.Records)
+
+	// an index cut short, a torn record, a file left half written and an
+	// index without its store
+	index := filepath.Join(dir, "0.index")
+	require.NoError(t, os.Truncate(index, int64(entWidth)))
+	f, err := os.OpenFile(filepath.Join(dir, "3.store"), os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 0, 0, 0, 1, 0, 'x'})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, offsetsFile+".tmp"), []byte("{"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "9.index"), nil, 0644))
+	report, err = Verify(dir, VerifyOptions{})
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	require.ElementsMatch(t, []string{"0.index", "3.store", "offsets.json.tmp", "9.index"}, paths(report.Problems))
+
+	report, err = Verify(dir, VerifyOptions{Repair: true})
+	require.NoError(t, err)
+	require.True(t, report.OK())
+	require.Len(t, report.Problems, 4)
+	report, err = Verify(dir, VerifyOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+	l, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	for off := uint64(0); off < 5; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	_, err = l.Read(5)
+	require.Error(t, err)
+	require.NoError(t, l.Close())
+
+	// a segment lost leaves a gap no repair fills
+	require.NoError(t, os.Remove(filepath.Join(dir, "0.store")))
+	require.NoError(t, os.Remove(filepath.Join(dir, "0.index")))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "0.store"), nil, 0644))
+	report, err = Verify(dir, VerifyOptions{Repair: true})
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	require.Contains(t, paths(report.Problems), ".")
+}
+
+func TestVerifySealed(t *testing.T) {
+	keys := NewKeyring()
+	require.NoError(t, keys.Add(1, make([]byte, 32)))
+	dir := testDataDir(t, Config{Keyring: keys})
+
+	// without the keyring the segments are checked as sealed
+	report, err := Verify(dir, VerifyOptions{})
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+	require.Equal(t, 2, report.Sealed)
+	report, err = Verify(dir, VerifyOptions{Keyring: keys})
+	require.NoError(t, err)
+	require.Empty(t, report.Problems)
+	require.Zero(t, report.Sealed)
+
+	// a sealed index that doesn't match is only rebuilt with the keyring
+	require.NoError(t, os.Truncate(filepath.Join(dir, "0.index"), int64(entWidth)))
+	report, err = Verify(dir, VerifyOptions{Repair: true})
+	require.NoError(t, err)
+	require.False(t, report.OK())
+	report, err = Verify(dir, VerifyOptions{Repair: true, Keyring: keys})
+	require.NoError(t, err)
+	require.True(t, report.OK())
+}
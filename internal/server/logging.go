@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+type loggerKey struct{}
+
+type requestInfoKey struct{}
+
+// What handlers learned about a request, reported when it turns out slow
+type requestInfo struct {
+	route     string
+	principal string
+	// first and last offsets produced or consumed, valid when hasOffsets is set
+	firstOffset, lastOffset uint64
+	hasOffsets              bool
+	// record bytes produced or consumed
+	bytes int
+	// fsync was on the critical path
+	fsync bool
+}
+
+// Returns the request's info, a throwaway value outside logRequests so callers need not check
+func reqInfo(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+func (i *requestInfo) addRecord(off uint64, bytes int) {
+	if !i.hasOffsets {
+		i.firstOffset = off
+		i.hasOffsets = true
+	}
+	i.lastOffset = off
+	i.bytes += bytes
+}
+
+// Returns the request-scoped logger, falling back to the server's logger
+func (s *httpsServer) logger(ctx context.Context) *zap.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return l
+	}
+	return s.Logger
+}
+
+func withLogger(ctx context.Context, l *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// Tags every request with an ID (the caller's if it sent one) and a logger carrying it
+func (s *httpsServer) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(requestIDHeader)
+		if id == "" {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		l := s.Logger.With(
+			zap.String("request_id", id),
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+		)
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			l = l.With(zap.String("trace_id", sc.TraceID().String()))
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		info := &requestInfo{}
+		ctx := context.WithValue(withLogger(r.Context(), l), requestInfoKey{}, info)
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		elapsed := time.Since(start)
+		l.Debug("handled request",
+			zap.Int("status", rec.status),
+			zap.Duration("duration", elapsed),
+		)
+		if s.SlowRequestThreshold > 0 && elapsed >= s.SlowRequestThreshold {
+			fields := []zap.Field{
+				zap.String("route", info.route),
+				zap.String("principal", info.principal),
+				zap.Int("status", rec.status),
+				zap.Int("bytes", info.bytes),
+				zap.Bool("fsync", info.fsync),
+				zap.Duration("duration", elapsed),
+				zap.Duration("threshold", s.SlowRequestThreshold),
+			}
+			if info.hasOffsets {
+				fields = append(fields,
+					zap.Uint64("first_offset", info.firstOffset),
+					zap.Uint64("last_offset", info.lastOffset),
+				)
+			}
+			l.Warn("slow request", fields...)
+		}
+	})
+}
+
+// Notes the mux pattern that matched, only known once routing is done
+func withRoute(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reqInfo(r.Context()).route = r.Pattern
+		h(w, r)
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Remembers the status code written so it can be logged
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var (
+	diskUsed = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proglog_disk_used_ratio",
+		Help: "Share of the data volume used, as the disk quota last saw it.",
+	})
+	diskSoftLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proglog_disk_soft_limit_ratio",
+		Help: "Share of the data volume used past which the server warns.",
+	})
+	diskHardLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proglog_disk_hard_limit_ratio",
+		Help: "Share of the data volume used past which produces are rejected.",
+	})
+	diskFull = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proglog_disk_full",
+		Help: "1 while produces are rejected for the data volume's use, else 0.",
+	})
+	produceDiskFull = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_produces_disk_full_total",
+		Help: "Produces rejected while the data volume was past its hard limit.",
+	})
+	quotaThrottled = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_quota_throttled_total",
+		Help: "Requests delayed for their principal's quota, or its tenant's, by principal and rate.",
+	}, []string{"principal", "rate"})
+	quotaThrottleSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proglog_quota_throttle_seconds",
+		Help:    "How long requests were delayed for their quotas, by rate.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	}, []string{"rate"})
+	quotaRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_quota_rejections_total",
+		Help: "Requests rejected for being too far past their quotas to throttle, by principal and rate.",
+	}, []string{"principal", "rate"})
+	scanBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_scan_bytes_total",
+		Help: "Bytes consumers read from behind their partitions' active segments.",
+	})
+	scanThrottleSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proglog_scan_throttle_seconds",
+		Help:    "How long historical reads were delayed by the scan throttle.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+	})
+	transformRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_transform_records_total",
+		Help: "Records produced through topics' transforms, by transform and result: kept, dropped, rejected or failed.",
+	}, []string{"transform", "result"})
+	interceptorRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_interceptor_records_total",
+		Help: "Records produced through interceptors that did something with them, by interceptor and result: changed, dropped or rejected.",
+	}, []string{"interceptor", "result"})
+	transformSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proglog_transform_seconds",
+		Help:    "How long topics' transforms took over each record, by transform.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"transform"})
+	routedRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_routed_records_total",
+		Help: "Records ingested, by the routing rule that matched them, unmatched when none did.",
+	}, []string{"route"})
+	transactionsOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proglog_transactions_open",
+		Help: "Transactions open on the server.",
+	})
+	transactionsEnded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_transactions_ended_total",
+		Help: "Transactions the server ended, by marker: CONTROL_COMMIT or CONTROL_ABORT.",
+	}, []string{"control"})
+	dedupRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_dedup_records_total",
+		Help: "Records produced to topics with a dedup window, by topic and result: unique, appended, or duplicate, dropped.",
+	}, []string{"topic", "result"})
+	queryRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_query_records_total",
+		Help: "Records read by queries, by topic.",
+	}, []string{"topic"})
+	idempotentProduces = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_idempotent_produces_total",
+		Help: "Idempotent producers' produces, by result: appended, duplicate, out_of_order or fenced.",
+	}, []string{"result"})
+	schedulerWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "proglog_scheduler_wait_seconds",
+		Help:    "How long requests waited for the scheduler to let them at the store, by priority.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"priority"})
+	connectionsRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_connections_rejected_total",
+		Help: "Connections closed on accept by the IP filter.",
+	})
+	activeConsumers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "proglog_active_consumers",
+		Help: "Open ConsumeStream calls.",
+	})
+	appendBatchRecords = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "proglog_append_batch_records",
+		Help:    "Records of concurrent produces coalesced into each batch append.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+	producesForwarded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_produces_forwarded_total",
+		Help: "Produce requests proxied to the leader.",
+	})
+	topicsAutoCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_topics_auto_created_total",
+		Help: "Topics created by a produce to them.",
+	})
+	kafkaRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_kafka_requests_total",
+		Help: "Requests read by the Kafka listener, by API.",
+	}, []string{"api"})
+	syslogMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_syslog_messages_total",
+		Help: "Messages read by the syslog listener, by transport.",
+	}, []string{"transport"})
+	syslogMessagesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_syslog_messages_dropped_total",
+		Help: "Syslog messages dropped for a full queue or a failed append.",
+	})
+	fluentEvents = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_fluent_events_total",
+		Help: "Events read by the Fluent forward listener.",
+	})
+	fluentEventsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_fluent_events_dropped_total",
+		Help: "Fluent events that failed to append.",
+	})
+	otlpLogRecords = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_otlp_log_records_total",
+		Help: "Log records appended by the OTLP logs service.",
+	})
+	otlpLogRecordsDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_otlp_log_records_dropped_total",
+		Help: "OTLP log records that failed to append.",
+	})
+	schemaViolations = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_schema_violations_total",
+		Help: "Produces rejected for values that don't match their topic's schema.",
+	})
+	webhookDeliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_webhook_deliveries_total",
+		Help: "Batches POSTed to subscriptions' webhooks, by result.",
+	}, []string{"result"})
+	webhookDeadLetters = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_webhook_dead_letters_total",
+		Help: "Records appended to subscriptions' dead-letter topics.",
+	})
+	mqttPublishes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_mqtt_publishes_total",
+		Help: "PUBLISH packets read by the MQTT listener.",
+	})
+	mqttPublishesDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_mqtt_publishes_dropped_total",
+		Help: "MQTT publishes that failed to append.",
+	})
+	mqttDeliveries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_mqtt_deliveries_total",
+		Help: "Records sent to MQTT subscribers.",
+	})
+	natsMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_nats_messages_total",
+		Help: "Messages bridged between NATS subjects and topics, by direction.",
+	}, []string{"direction"})
+	natsMessagesDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_nats_messages_dropped_total",
+		Help: "Messages the NATS bridge failed to append or couldn't publish, by direction.",
+	}, []string{"direction"})
+	kafkaMirrorRecords = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_kafka_mirror_records_total",
+		Help: "Records mirrored from a Kafka cluster into topics, by mirror.",
+	}, []string{"mirror"})
+	kafkaMirrorRecordsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "proglog_kafka_mirror_records_dropped_total",
+		Help: "Records mirrored from a Kafka cluster that their topic refused, by mirror.",
+	}, []string{"mirror"})
+	kafkaMirrorLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "proglog_kafka_mirror_lag",
+		Help: "Records of a Kafka partition a mirror has yet to append, as of its last fetch.",
+	}, []string{"mirror", "topic", "partition"})
+	parquetFiles = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_parquet_files_total",
+		Help: "Parquet files written to the object store by the exports.",
+	})
+	parquetRecords = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_parquet_records_total",
+		Help: "Records written to Parquet files by the exports.",
+	})
+	groupRebalances = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_group_rebalances_total",
+		Help: "Consumer group generations started by their members or partitions changing.",
+	})
+)
+
+var groupLagDesc = prometheus.NewDesc("proglog_consumer_group_lag",
+	"Records a group's committed offset is behind its partition's high watermark.",
+	[]string{"group", "topic", "partition"}, nil)
+
+// Collects the lag of the groups of every server reporting it at scrape
+// time. Processes running more than one server report each partition's
+// largest lag.
+type groupLagCollector struct {
+	mu      sync.Mutex
+	configs map[*Config]struct{}
+}
+
+var groupLags = &groupLagCollector{configs: make(map[*Config]struct{})}
+
+func init() {
+	prometheus.MustRegister(groupLags)
+}
+
+// ReportGroupLag adds the groups' lag on the server config serves to the
+// proglog_consumer_group_lag gauges, until stop is called. Call stop
+// before closing the commit log.
+func ReportGroupLag(config *Config) (stop func()) {
+	config = withDefaults(config)
+	groupLags.mu.Lock()
+	defer groupLags.mu.Unlock()
+	groupLags.configs[config] = struct{}{}
+	return func() {
+		groupLags.mu.Lock()
+		defer groupLags.mu.Unlock()
+		delete(groupLags.configs, config)
+	}
+}
+
+func (c *groupLagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- groupLagDesc
+}
+
+func (c *groupLagCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	largest := make(map[groupPartition]uint64)
+	for config := range c.configs {
+		lags, err := config.groupLag("")
+		if err != nil {
+			config.Logger.Error("collecting group lag", zap.Error(err))
+			continue
+		}
+		for _, lag := range lags {
+			gp := groupPartition{lag.Group, lag.Topic, lag.Partition}
+			largest[gp] = max(largest[gp], lag.Lag)
+		}
+	}
+	for gp, lag := range largest {
+		ch <- prometheus.MustNewConstMetric(groupLagDesc, prometheus.GaugeValue, float64(lag),
+			gp.group, gp.topic, strconv.FormatUint(uint64(gp.partition), 10))
+	}
+}
@@ -0,0 +1,639 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrMQTTServerClosed is returned by MQTTServer.Serve once it's closed
+var ErrMQTTServerClosed = errors.New("server: mqtt server closed")
+
+const (
+	// How long a connection has to send its CONNECT
+	mqttConnectTimeout = 10 * time.Second
+	// QoS 1 messages sent to a connection and waiting for its PUBACKs
+	mqttMaxInflight = 64
+	// Records a subscription reads from a partition before going on to
+	// the next
+	mqttTailBatch = 100
+)
+
+// MQTTServer bridges MQTT 3.1.1 clients, such as IoT devices that can't
+// speak gRPC, to the topics. An MQTT topic's first level names the topic:
+// a PUBLISH to sensors/room1/temp is appended to topic sensors, with the
+// MQTT topic as its key, so each MQTT topic keeps its order in one
+// partition, and the payload as its value. A SUBSCRIBE tails the topic
+// its filter's first level names from its end, sending each record whose
+// key matches the filter as a PUBLISH to that key, and records keyed
+// otherwise as ones to the topic's name. Filters with a wildcard for
+// their first level are refused.
+//
+// QoS 0 and 1 are supported. A QoS 1 PUBLISH is acked once it's appended
+// at the topic's ack level; one that fails to append isn't, and its
+// connection is closed for the client to resend it. QoS 2 PUBLISHes
+// close their connection, and subscriptions asking for QoS 2 are granted
+// 1. Sessions aren't kept: every connection starts clean and its
+// subscriptions, and the QoS 1 messages they sent that it hadn't acked,
+// end with it. Retained messages aren't kept either. A will is appended
+// when its connection ends without a DISCONNECT.
+//
+// Connections are authenticated by their TLS client certificate or
+// CONNECT's password, taken as a bearer token when the user name is
+// "bearer" and as an API key otherwise, and publishes and subscriptions
+// authorized as the gRPC produces and consumes are.
+type MQTTServer struct {
+	srv *grpcServer
+	// ctx is canceled on close, ending appends in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu     sync.Mutex
+	closed bool
+	lns    map[net.Listener]struct{}
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+}
+
+// NewMQTTServer bridges MQTT clients to the topics of config's commit log
+func NewMQTTServer(config *Config) *MQTTServer {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &MQTTServer{
+		srv:    newgrpcServer(config),
+		ctx:    ctx,
+		cancel: cancel,
+		lns:    make(map[net.Listener]struct{}),
+		conns:  make(map[net.Conn]struct{}),
+	}
+}
+
+// Serve bridges the connections the listener accepts until the server's
+// closed, returning ErrMQTTServerClosed
+func (s *MQTTServer) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrMQTTServerClosed
+	}
+	s.lns[ln] = struct{}{}
+	s.mu.Unlock()
+	for {
+		conn, err := ln.Accept()
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return ErrMQTTServerClosed
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close closes the listeners and connections, canceling appends in
+// flight, and waits for them to end
+func (s *MQTTServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	s.cancel()
+	var errs []error
+	for ln := range s.lns {
+		errs = append(errs, ln.Close())
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+// mqttConn is a connection's session, from its CONNECT on
+type mqttConn struct {
+	s    *MQTTServer
+	conn net.Conn
+	r    *bufio.Reader
+	// ctx holds the connection's principal and logger
+	ctx       context.Context
+	keepAlive time.Duration
+	// will is appended if the connection ends without a DISCONNECT
+	will *api.Record
+
+	wmu sync.Mutex
+
+	mu   sync.Mutex
+	subs map[string]*mqttSubscription
+	// inflight are the packet IDs of QoS 1 messages sent and not acked,
+	// window holds a token for each
+	inflight map[uint16]struct{}
+	nextID   uint16
+	window   chan struct{}
+}
+
+// mqttSubscription tails a topic for the records matching its filter
+type mqttSubscription struct {
+	filter string
+	topic  string
+	qos    byte
+	// cursors are the offsets read up to in each of the topic's
+	// partitions
+	cursors []uint64
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func (s *MQTTServer) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+	c := &mqttConn{
+		s:        s,
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		subs:     make(map[string]*mqttSubscription),
+		inflight: make(map[uint16]struct{}),
+		window:   make(chan struct{}, mqttMaxInflight),
+	}
+	conn.SetReadDeadline(time.Now().Add(mqttConnectTimeout))
+	p, err := readMQTTPacket(c.r)
+	if err != nil || p.typ != mqttConnect {
+		return
+	}
+	if err := c.connect(p); err != nil {
+		s.srv.Logger.Info("mqtt connect failed",
+			zap.String("remote_addr", conn.RemoteAddr().String()),
+			zap.Error(err),
+		)
+		return
+	}
+	defer c.end()
+	for {
+		deadline := time.Time{}
+		if c.keepAlive > 0 {
+			// a client that's quiet for one and a half keep alives is gone
+			deadline = time.Now().Add(c.keepAlive * 3 / 2)
+		}
+		conn.SetReadDeadline(deadline)
+		p, err := readMQTTPacket(c.r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && s.ctx.Err() == nil {
+				s.srv.logger(c.ctx).Info("mqtt connection closed", zap.Error(err))
+			}
+			return
+		}
+		if p.typ == mqttDisconnect {
+			c.will = nil
+			return
+		}
+		if err := c.handle(p); err != nil {
+			s.srv.logger(c.ctx).Info("mqtt packet failed", zap.Error(err))
+			return
+		}
+	}
+}
+
+// Reads the CONNECT, answering its CONNACK
+func (c *mqttConn) connect(p *mqttPacket) error {
+	d := &mqttDecoder{b: p.body}
+	protocol, level, flags := d.string(), d.byte(), d.byte()
+	c.keepAlive = time.Duration(d.uint16()) * time.Second
+	clientID := d.string()
+	var will *api.Record
+	if flags&0x04 != 0 {
+		topic := d.string()
+		will = &api.Record{Key: []byte(topic), Value: d.bytes()}
+	}
+	var user string
+	var password []byte
+	if flags&0x80 != 0 {
+		user = d.string()
+	}
+	if flags&0x40 != 0 {
+		password = d.bytes()
+	}
+	if d.err != nil || protocol != "MQTT" || flags&0x01 != 0 {
+		return errMQTTMalformed
+	}
+	if level != 4 {
+		c.connack(mqttBadProtocol)
+		return fmt.Errorf("unsupported mqtt protocol level %d", level)
+	}
+	// without a client ID there's no session to keep, so it must be clean
+	if clientID == "" && flags&0x02 == 0 {
+		c.connack(mqttIdentifierRejected)
+		return errors.New("mqtt client without an id asked for a session")
+	}
+	if will != nil {
+		if _, err := mqttTopic(string(will.Key), false); err != nil {
+			return fmt.Errorf("mqtt will topic: %w", err)
+		}
+	}
+	ctx, err := c.s.authenticate(c.conn, user, password)
+	if err != nil {
+		if password != nil {
+			c.connack(mqttBadCredentials)
+		} else {
+			c.connack(mqttNotAuthorized)
+		}
+		return err
+	}
+	c.ctx = withLogger(ctx, c.s.srv.logger(ctx).With(zap.String("client_id", clientID)))
+	c.will = will
+	return c.connack(mqttAccepted)
+}
+
+// Sessions aren't kept, so there's never one present
+func (c *mqttConn) connack(code byte) error {
+	return c.write(mqttConnack, 0, []byte{0, code})
+}
+
+// Resolves the connection's principal from its client certificate or
+// CONNECT's credentials, auditing failures
+func (s *MQTTServer) authenticate(conn net.Conn, user string, password []byte) (context.Context, error) {
+	ctx := s.ctx
+	logger := s.srv.Logger.With(zap.String("remote_addr", conn.RemoteAddr().String()))
+	if s.srv.Authenticator == nil {
+		return withLogger(ctx, logger), nil
+	}
+	creds := auth.Credentials{RemoteAddr: conn.RemoteAddr().String(), Header: http.Header{}}
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.HandshakeContext(ctx); err != nil {
+			logger.Info("mqtt tls handshake failed", zap.Error(err))
+			return ctx, err
+		}
+		state := tc.ConnectionState()
+		creds.TLS = &state
+	}
+	if password != nil {
+		if strings.EqualFold(user, "bearer") {
+			creds.Header.Set("Authorization", "Bearer "+string(password))
+		} else {
+			creds.Header.Set(auth.APIKeyHeader, string(password))
+		}
+	}
+	principal, err := s.srv.Authenticator.Authenticate(ctx, creds)
+	if err != nil {
+		logger.Info("authentication failed", zap.Error(err))
+		s.srv.Audit.Record(AuditEvent{
+			Principal: creds.RemoteAddr,
+			Action:    AuditAuthenticate,
+			Resource:  "mqtt",
+			Result:    AuditFailure,
+		})
+		return ctx, auth.ErrUnauthenticated
+	}
+	ctx = auth.WithPrincipal(ctx, principal)
+	return withLogger(ctx, logger.With(zap.String("principal", principal))), nil
+}
+
+func (c *mqttConn) handle(p *mqttPacket) error {
+	switch p.typ {
+	case mqttPublish:
+		return c.publish(p)
+	case mqttPuback:
+		d := &mqttDecoder{b: p.body}
+		id := d.uint16()
+		if d.err != nil {
+			return d.err
+		}
+		c.acked(id)
+		return nil
+	case mqttSubscribe:
+		return c.subscribe(p)
+	case mqttUnsubscribe:
+		return c.unsubscribe(p)
+	case mqttPingreq:
+		return c.write(mqttPingresp, 0, nil)
+	}
+	return fmt.Errorf("unexpected mqtt packet type %d", p.typ)
+}
+
+// Appends the PUBLISH's payload, acking it at QoS 1
+func (c *mqttConn) publish(p *mqttPacket) error {
+	qos := p.flags >> 1 & 0x3
+	d := &mqttDecoder{b: p.body}
+	name := d.string()
+	var id uint16
+	if qos > 0 {
+		id = d.uint16()
+	}
+	if d.err != nil {
+		return d.err
+	}
+	if qos > 1 {
+		return fmt.Errorf("mqtt qos %d isn't supported", qos)
+	}
+	topic, err := mqttTopic(name, false)
+	if err != nil {
+		return err
+	}
+	mqttPublishes.Inc()
+	err = c.s.append(c.ctx, topic, &api.Record{Key: []byte(name), Value: d.b})
+	switch {
+	case status.Code(err) == codes.PermissionDenied:
+		// MQTT 3.1.1 can't refuse a PUBLISH, so it's dropped
+		mqttPublishesDropped.Inc()
+	case err != nil:
+		mqttPublishesDropped.Inc()
+		if qos > 0 {
+			return fmt.Errorf("appending publish to %s: %w", name, err)
+		}
+		c.s.srv.logger(c.ctx).Error("appending mqtt publish", zap.String("topic", name), zap.Error(err))
+	}
+	if qos == 0 {
+		return nil
+	}
+	return c.write(mqttPuback, 0, binary.BigEndian.AppendUint16(nil, id))
+}
+
+// Appends the record to the topic, in the partition its key hashes to
+func (s *MQTTServer) append(ctx context.Context, topic string, record *api.Record) error {
+	partitions := uint32(1)
+	if desc, err := s.srv.describeTopic(topic); err == nil {
+		partitions = desc.Partitions
+	}
+	_, err := s.srv.Produce(ctx, &api.ProduceRequest{
+		Record:    record,
+		Topic:     topic,
+		Partition: partitionForKey(record.Key, partitions),
+	})
+	return err
+}
+
+// Subscribes to the filters, starting their subscriptions once they're
+// acked
+func (c *mqttConn) subscribe(p *mqttPacket) error {
+	if p.flags != 0x2 {
+		return errMQTTMalformed
+	}
+	d := &mqttDecoder{b: p.body}
+	ack := binary.BigEndian.AppendUint16(nil, d.uint16())
+	var subs []*mqttSubscription
+	for d.err == nil && len(d.b) > 0 {
+		filter, qos := d.string(), d.byte()
+		if d.err == nil && qos > 2 {
+			return errMQTTMalformed
+		}
+		sub, err := c.prepare(filter, min(qos, 1))
+		if err != nil {
+			c.s.srv.logger(c.ctx).Info("mqtt subscribe refused", zap.String("filter", filter), zap.Error(err))
+			ack = append(ack, mqttSubscribeFailure)
+			continue
+		}
+		ack = append(ack, sub.qos)
+		subs = append(subs, sub)
+	}
+	if d.err != nil || len(ack) == 2 {
+		return errMQTTMalformed
+	}
+	if err := c.write(mqttSuback, 0, ack); err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		c.start(sub)
+	}
+	return nil
+}
+
+// Readies the filter's subscription to tail its topic from the end
+func (c *mqttConn) prepare(filter string, qos byte) (*mqttSubscription, error) {
+	topic, err := mqttTopic(filter, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.s.srv.authorize(c.ctx, consumeAction, topicResource(topic)); err != nil {
+		return nil, err
+	}
+	desc, err := c.s.srv.describeTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+	sub := &mqttSubscription{filter: filter, topic: topic, qos: qos, cursors: make([]uint64, desc.Partitions)}
+	for p := range sub.cursors {
+		cl, err := c.s.srv.partition(topic, uint32(p))
+		if err != nil {
+			return nil, err
+		}
+		if sl, ok := cl.(statsLog); ok {
+			sub.cursors[p] = sl.Stats().HighWatermark
+		}
+	}
+	return sub, nil
+}
+
+// Starts tailing for the subscription, replacing the filter's one before
+func (c *mqttConn) start(sub *mqttSubscription) {
+	ctx, cancel := context.WithCancel(c.ctx)
+	sub.cancel, sub.done = cancel, make(chan struct{})
+	c.mu.Lock()
+	old := c.subs[sub.filter]
+	c.subs[sub.filter] = sub
+	c.mu.Unlock()
+	if old != nil {
+		old.stop()
+	}
+	go func() {
+		defer close(sub.done)
+		if err := c.tail(ctx, sub); err != nil && ctx.Err() == nil {
+			// there's no telling the client, so it's disconnected
+			c.s.srv.logger(c.ctx).Error("mqtt subscription failed", zap.String("filter", sub.filter), zap.Error(err))
+			c.conn.Close()
+		}
+	}()
+}
+
+func (sub *mqttSubscription) stop() {
+	sub.cancel()
+	<-sub.done
+}
+
+func (c *mqttConn) unsubscribe(p *mqttPacket) error {
+	if p.flags != 0x2 {
+		return errMQTTMalformed
+	}
+	d := &mqttDecoder{b: p.body}
+	id := d.uint16()
+	var filters []string
+	for d.err == nil && len(d.b) > 0 {
+		filters = append(filters, d.string())
+	}
+	if d.err != nil || len(filters) == 0 {
+		return errMQTTMalformed
+	}
+	for _, filter := range filters {
+		c.mu.Lock()
+		sub := c.subs[filter]
+		delete(c.subs, filter)
+		c.mu.Unlock()
+		if sub != nil {
+			sub.stop()
+		}
+	}
+	return c.write(mqttUnsuback, 0, binary.BigEndian.AppendUint16(nil, id))
+}
+
+// Sends the subscription's records as they're appended until ctx is done.
+// Partitions added to the topic are read from their start.
+func (c *mqttConn) tail(ctx context.Context, sub *mqttSubscription) error {
+	for {
+		desc, err := c.s.srv.describeTopic(sub.topic)
+		if err != nil {
+			return err
+		}
+		for len(sub.cursors) < int(desc.Partitions) {
+			sub.cursors = append(sub.cursors, 0)
+		}
+		read := false
+		for p := range sub.cursors {
+			cl, err := c.s.srv.partition(sub.topic, uint32(p))
+			if err != nil {
+				return err
+			}
+			if sl, ok := cl.(statsLog); ok {
+				sub.cursors[p] = max(sub.cursors[p], sl.Stats().LowWatermark)
+			}
+			for range mqttTailBatch {
+				res, next, err := c.s.srv.consume(ctx, cl, sub.cursors[p])
+				if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				read = true
+				sub.cursors[p] = next
+				record := proto.Clone(res.Record).(*api.Record)
+				if err := codec.Decompress(record); err != nil {
+					return err
+				}
+				name := mqttRecordTopic(sub.topic, record)
+				if !mqttMatch(sub.filter, name) {
+					continue
+				}
+				if err := c.send(ctx, name, record.Value, sub.qos); err != nil {
+					return err
+				}
+			}
+		}
+		if read {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(consumePollInterval):
+		}
+	}
+}
+
+// The MQTT topic a record of the topic is sent to: its key when that's
+// one of the topic's MQTT topics, the topic's name otherwise
+func mqttRecordTopic(topic string, record *api.Record) string {
+	name := string(record.Key)
+	if t, err := mqttTopic(name, false); err == nil && t == topic {
+		return name
+	}
+	return topic
+}
+
+// Sends a PUBLISH, waiting at QoS 1 for room in the window of messages
+// not acked
+func (c *mqttConn) send(ctx context.Context, name string, payload []byte, qos byte) error {
+	body := appendMQTTString(nil, name)
+	var flags byte
+	if qos > 0 {
+		select {
+		case c.window <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		body = binary.BigEndian.AppendUint16(body, c.packetID())
+		flags = qos << 1
+	}
+	mqttDeliveries.Inc()
+	return c.write(mqttPublish, flags, append(body, payload...))
+}
+
+// A packet ID no message in flight has, never 0
+func (c *mqttConn) packetID() uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		c.nextID++
+		if _, ok := c.inflight[c.nextID]; c.nextID != 0 && !ok {
+			c.inflight[c.nextID] = struct{}{}
+			return c.nextID
+		}
+	}
+}
+
+// Frees the window's room a message took, once it's acked
+func (c *mqttConn) acked(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.inflight[id]; ok {
+		delete(c.inflight, id)
+		<-c.window
+	}
+}
+
+func (c *mqttConn) write(typ, flags byte, body []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.conn.Write(appendMQTTPacket(nil, typ, flags, body))
+	return err
+}
+
+// Stops the subscriptions, appending the will if there's one
+func (c *mqttConn) end() {
+	c.mu.Lock()
+	subs := c.subs
+	c.subs = nil
+	c.mu.Unlock()
+	for _, sub := range subs {
+		sub.cancel()
+	}
+	for _, sub := range subs {
+		<-sub.done
+	}
+	if c.will == nil {
+		return
+	}
+	topic, _ := mqttTopic(string(c.will.Key), false)
+	if err := c.s.append(c.ctx, topic, c.will); err != nil {
+		c.s.srv.logger(c.ctx).Error("appending mqtt will", zap.String("topic", string(c.will.Key)), zap.Error(err))
+	}
+}
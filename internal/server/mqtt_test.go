@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMQTTTopic(t *testing.T) {
+	for name, topic := range map[string]string{
+		"sensors":            "sensors",
+		"sensors/room1/temp": "sensors",
+		"sensors/":           "sensors",
+		"+/temp":             "",
+		"sensors/+/temp":     "",
+		"$SYS/uptime":        "",
+		"/sensors":           "",
+	} {
+		got, err := mqttTopic(name, false)
+		if topic == "" {
+			require.Error(t, err, name)
+			continue
+		}
+		require.NoError(t, err, name)
+		require.Equal(t, topic, got, name)
+	}
+	for filter, ok := range map[string]bool{
+		"sensors/+/temp": true,
+		"sensors/#":      true,
+		"sensors/a#":     false,
+		"sensors/#/temp": false,
+		"#":              false,
+		"+/temp":         false,
+	} {
+		_, err := mqttTopic(filter, true)
+		require.Equal(t, ok, err == nil, filter)
+	}
+	for filter, names := range map[string][2][]string{
+		"sensors/+/temp": {{"sensors/a/temp"}, {"sensors/temp", "sensors/a/b/temp"}},
+		"sensors/#":      {{"sensors", "sensors/a", "sensors/a/b"}, {"other/a"}},
+		"sensors":        {{"sensors"}, {"sensors/a"}},
+	} {
+		for _, name := range names[0] {
+			require.True(t, mqttMatch(filter, name), "%s %s", filter, name)
+		}
+		for _, name := range names[1] {
+			require.False(t, mqttMatch(filter, name), "%s %s", filter, name)
+		}
+	}
+}
+
+// A client end of an MQTT connection
+type mqttTestConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *mqttTestConn) write(typ, flags byte, body []byte) {
+	c.t.Helper()
+	_, err := c.conn.Write(appendMQTTPacket(nil, typ, flags, body))
+	require.NoError(c.t, err)
+}
+
+func (c *mqttTestConn) read(typ byte) *mqttPacket {
+	c.t.Helper()
+	require.NoError(c.t, c.conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	p, err := readMQTTPacket(c.r)
+	require.NoError(c.t, err)
+	require.Equal(c.t, typ, p.typ)
+	return p
+}
+
+func (c *mqttTestConn) publish(name, payload string, qos byte, id uint16) {
+	c.t.Helper()
+	body := appendMQTTString(nil, name)
+	if qos > 0 {
+		body = binary.BigEndian.AppendUint16(body, id)
+	}
+	c.write(mqttPublish, qos<<1, append(body, payload...))
+}
+
+func (c *mqttTestConn) subscribe(id uint16, filter string, qos byte) []byte {
+	c.t.Helper()
+	body := binary.BigEndian.AppendUint16(nil, id)
+	body = append(appendMQTTString(body, filter), qos)
+	c.write(mqttSubscribe, 0x2, body)
+	p := c.read(mqttSuback)
+	require.Equal(c.t, id, binary.BigEndian.Uint16(p.body))
+	return p.body[2:]
+}
+
+func setupMQTT(t *testing.T) (dial func(password, will string) (*mqttTestConn, byte), config *Config) {
+	t.Helper()
+	_, config, teardown := setupTest(t, nil)
+	t.Cleanup(teardown)
+	require.NoError(t, config.CommitLog.(topicLog).CreateTopic(&api.Topic{Name: "sensors", Partitions: 2}))
+	srv := NewMQTTServer(config)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.Serve(ln)
+	t.Cleanup(func() { srv.Close() })
+	return func(password, will string) (*mqttTestConn, byte) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		c := &mqttTestConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+		flags := byte(0x02 | 0x80 | 0x40)
+		if will != "" {
+			flags |= 0x04
+		}
+		body := appendMQTTString(nil, "MQTT")
+		body = append(body, 4, flags, 0, 60)
+		body = appendMQTTString(body, "device-1")
+		if will != "" {
+			body = appendMQTTString(appendMQTTString(body, will), "gone")
+		}
+		body = appendMQTTString(appendMQTTString(body, "device"), password)
+		c.write(mqttConnect, 0, body)
+		p := c.read(mqttConnack)
+		require.Len(t, p.body, 2)
+		return c, p.body[1]
+	}, config
+}
+
+func TestMQTTServer(t *testing.T) {
+	dial, config := setupMQTT(t)
+	sub, code := dial("root-key", "")
+	require.Equal(t, byte(mqttAccepted), code)
+	require.Equal(t, []byte{1}, sub.subscribe(1, "sensors/+/temp", 1))
+	require.Equal(t, []byte{0}, sub.subscribe(2, "sensors", 0))
+	require.Equal(t, []byte{mqttSubscribeFailure}, sub.subscribe(3, "+/temp", 1))
+	require.Equal(t, []byte{mqttSubscribeFailure}, sub.subscribe(4, "missing/#", 1))
+
+	pub, code := dial("root-key", "")
+	require.Equal(t, byte(mqttAccepted), code)
+	pub.publish("sensors/room1/temp", "21", 1, 7)
+	p := pub.read(mqttPuback)
+	require.Equal(t, []byte{0, 7}, p.body)
+	pub.publish("sensors/room1/humidity", "40", 0, 0)
+	pub.write(mqttPingreq, 0, nil)
+	pub.read(mqttPingresp)
+
+	// the MQTT topic keys the record to its partition
+	cl, err := config.partition("sensors", partitionForKey([]byte("sensors/room1/temp"), 2))
+	require.NoError(t, err)
+	record, err := cl.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "sensors/room1/temp", string(record.Key))
+	require.Equal(t, "21", string(record.Value))
+
+	// only the temperature matches, at the QoS granted
+	p = sub.read(mqttPublish)
+	require.Equal(t, byte(1<<1), p.flags)
+	d := &mqttDecoder{b: p.body}
+	require.Equal(t, "sensors/room1/temp", d.string())
+	id := d.uint16()
+	require.NoError(t, d.err)
+	require.Equal(t, "21", string(d.b))
+	sub.write(mqttPuback, 0, binary.BigEndian.AppendUint16(nil, id))
+
+	// records produced otherwise are sent to the topic's name
+	cl, err = config.partition("sensors", 0)
+	require.NoError(t, err)
+	_, err = cl.Append(&api.Record{Value: []byte("plain")})
+	require.NoError(t, err)
+	p = sub.read(mqttPublish)
+	require.Equal(t, byte(0), p.flags)
+	d = &mqttDecoder{b: p.body}
+	require.Equal(t, "sensors", d.string())
+	require.Equal(t, "plain", string(d.b))
+}
+
+func TestMQTTServerUnauthorized(t *testing.T) {
+	dial, config := setupMQTT(t)
+	_, code := dial("wrong-key", "")
+	require.Equal(t, byte(mqttBadCredentials), code)
+
+	c, code := dial("nobody-key", "")
+	require.Equal(t, byte(mqttAccepted), code)
+	require.Equal(t, []byte{mqttSubscribeFailure}, c.subscribe(1, "sensors/#", 1))
+	// a publish can't be refused, so it's acked and dropped
+	c.publish("sensors/room1/temp", "21", 1, 1)
+	c.read(mqttPuback)
+	for p := range uint32(2) {
+		cl, err := config.partition("sensors", p)
+		require.NoError(t, err)
+		_, err = cl.Read(0)
+		require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+	}
+}
+
+func TestMQTTServerWill(t *testing.T) {
+	dial, config := setupMQTT(t)
+	c, code := dial("root-key", "sensors/device-1/status")
+	require.Equal(t, byte(mqttAccepted), code)
+	// ending without a DISCONNECT appends the will
+	c.conn.Close()
+	cl, err := config.partition("sensors", partitionForKey([]byte("sensors/device-1/status"), 2))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		record, err := cl.Read(0)
+		return err == nil && string(record.Value) == "gone"
+	}, 5*time.Second, 10*time.Millisecond)
+}
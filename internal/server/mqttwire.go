@@ -0,0 +1,196 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+// MQTT 3.1.1's wire encoding: a fixed header of the packet's type and
+// flags and the length of the rest as a varint of up to four bytes, then
+// the packet's variable header and payload, in which integers are
+// big-endian uint16s and strings and binary data have a uint16 length.
+
+// Packets with more than this after their fixed header close their
+// connection
+const mqttMaxPacket = 16 << 20
+
+var errMQTTMalformed = errors.New("malformed mqtt packet")
+
+// MQTT 3.1.1's control packet types
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// CONNACK return codes, and the SUBACK one refusing a filter
+const (
+	mqttAccepted           = 0
+	mqttBadProtocol        = 1
+	mqttIdentifierRejected = 2
+	mqttBadCredentials     = 4
+	mqttNotAuthorized      = 5
+
+	mqttSubscribeFailure = 0x80
+)
+
+type mqttPacket struct {
+	typ, flags byte
+	body       []byte
+}
+
+func readMQTTPacket(r *bufio.Reader) (*mqttPacket, error) {
+	h, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	for i := 0; ; i++ {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		n |= int(c&0x7f) << (7 * i)
+		if c&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return nil, errMQTTMalformed
+		}
+	}
+	if n > mqttMaxPacket {
+		return nil, errMQTTMalformed
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return &mqttPacket{typ: h >> 4, flags: h & 0x0f, body: body}, nil
+}
+
+// A stream that ends inside a packet ends unexpectedly
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Appends a packet, its fixed header in front of its body
+func appendMQTTPacket(b []byte, typ, flags byte, body []byte) []byte {
+	b = append(b, typ<<4|flags)
+	for n := len(body); ; {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if n == 0 {
+			b = append(b, c)
+			break
+		}
+		b = append(b, c|0x80)
+	}
+	return append(b, body...)
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// Decodes a packet's body, failing every read after the first that runs
+// past its end
+type mqttDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *mqttDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.b) {
+		d.err, d.b = errMQTTMalformed, nil
+		return nil
+	}
+	b := d.b[:n:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *mqttDecoder) byte() byte {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *mqttDecoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *mqttDecoder) bytes() []byte {
+	return d.take(int(d.uint16()))
+}
+
+// Strings are UTF-8 without NULs
+func (d *mqttDecoder) string() string {
+	b := d.bytes()
+	if d.err == nil && (!utf8.Valid(b) || strings.ContainsRune(string(b), 0)) {
+		d.err = errMQTTMalformed
+	}
+	return string(b)
+}
+
+// The topic an MQTT topic name or filter's first level names, failing for
+// names with wildcards and filters with them misplaced or in their first
+// level
+func mqttTopic(name string, filter bool) (string, error) {
+	if name == "" || len(name) > 0xffff {
+		return "", errMQTTMalformed
+	}
+	levels := strings.Split(name, "/")
+	for i, level := range levels {
+		wild := strings.ContainsAny(level, "+#")
+		if wild && !filter {
+			return "", errors.New("mqtt topic names can't have wildcards")
+		}
+		if wild && level != "+" && !(level == "#" && i == len(levels)-1) {
+			return "", errors.New("mqtt wildcards take a whole level, # the last")
+		}
+	}
+	if err := log.ValidateTopic(levels[0]); err != nil {
+		return "", err
+	}
+	return levels[0], nil
+}
+
+// Reports whether the topic name matches the filter, whose + matches a
+// level and # the ones left, the one before it included
+func mqttMatch(filter, name string) bool {
+	fs, ns := strings.Split(filter, "/"), strings.Split(name, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ns) || (f != "+" && f != ns[i]) {
+			return false
+		}
+	}
+	return len(fs) == len(ns)
+}
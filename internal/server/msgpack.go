@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// MessagePack, as Fluent's forward protocol encodes its messages with. A
+// value decodes to nil, a bool, int64, uint64, float64, string, []byte,
+// []any, map[string]any or, for Fluent's EventTime extension,
+// fluentEventTime; other extensions decode to their data.
+
+var errMsgpackMalformed = errors.New("malformed msgpack")
+
+// Values nested deeper than this are refused, before they take the stack
+const msgpackMaxDepth = 64
+
+// Fluent's EventTime, a time with nanoseconds as extension type 0
+type fluentEventTime time.Time
+
+// Decodes one value after another from a stream, each in at most limit
+// bytes
+type msgpackDecoder struct {
+	r     *bufio.Reader
+	limit int
+	// left is what's left of limit for the value being decoded
+	left int
+}
+
+func newMsgpackDecoder(r io.Reader, limit int) *msgpackDecoder {
+	return &msgpackDecoder{r: bufio.NewReader(r), limit: limit}
+}
+
+// Decodes the next value, returning io.EOF when the stream ends between
+// values
+func (d *msgpackDecoder) decode() (any, error) {
+	d.left = d.limit
+	if _, err := d.r.Peek(1); err != nil {
+		return nil, err
+	}
+	v, err := d.value(0)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+func (d *msgpackDecoder) take(n int) ([]byte, error) {
+	if n < 0 || n > d.left {
+		return nil, errMsgpackMalformed
+	}
+	d.left -= n
+	b := make([]byte, n)
+	_, err := io.ReadFull(d.r, b)
+	return b, err
+}
+
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, err := d.take(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) value(depth int) (any, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errMsgpackMalformed
+	}
+	b, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	switch c := b[0]; {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.mapOf(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return d.arrayOf(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		s, err := d.take(int(c & 0x1f))
+		return string(s), err
+	}
+	switch c := b[0]; c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.take(int(min(n, math.MaxInt32)))
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.uint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.ext(int(min(n, math.MaxInt32)))
+	case 0xca:
+		v, err := d.uint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.uint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.uint(1 << (c - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := 1 << (c - 0xd0)
+		v, err := d.uint(n)
+		// sign extend from the integer's width
+		shift := 64 - 8*n
+		return int64(v<<shift) >> shift, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.ext(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.take(int(min(n, math.MaxInt32)))
+		return string(s), err
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.arrayOf(int(min(n, math.MaxInt32)), depth)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapOf(int(min(n, math.MaxInt32)), depth)
+	}
+	return nil, errMsgpackMalformed
+}
+
+// Every element takes a byte at least, so a longer array or map than
+// what's left of the limit is malformed
+func (d *msgpackDecoder) arrayOf(n, depth int) (any, error) {
+	if n > d.left {
+		return nil, errMsgpackMalformed
+	}
+	a := make([]any, n)
+	for i := range a {
+		var err error
+		if a[i], err = d.value(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Keys that aren't strings are formatted as they'd print
+func (d *msgpackDecoder) mapOf(n, depth int) (any, error) {
+	if 2*n > d.left {
+		return nil, errMsgpackMalformed
+	}
+	m := make(map[string]any, n)
+	for range n {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		switch k := k.(type) {
+		case string:
+			m[k] = v
+		case []byte:
+			m[string(k)] = v
+		default:
+			m[fmt.Sprint(k)] = v
+		}
+	}
+	return m, nil
+}
+
+func (d *msgpackDecoder) ext(n int) (any, error) {
+	typ, err := d.take(1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.take(n)
+	if err != nil {
+		return nil, err
+	}
+	if typ[0] == 0 && n == 8 {
+		sec, nsec := binary.BigEndian.Uint32(data), binary.BigEndian.Uint32(data[4:])
+		return fluentEventTime(time.Unix(int64(sec), int64(nsec))), nil
+	}
+	return data, nil
+}
+
+// Appends the value's encoding, for the values decode returns and ints,
+// in the most compact form of each
+func appendMsgpack(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0)
+	case bool:
+		if v {
+			return append(b, 0xc3)
+		}
+		return append(b, 0xc2)
+	case int:
+		return appendMsgpack(b, int64(v))
+	case int64:
+		if v >= 0 {
+			return appendMsgpack(b, uint64(v))
+		}
+		if v >= -32 {
+			return append(b, byte(v))
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+	case uint64:
+		if v <= 0x7f {
+			return append(b, byte(v))
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), v)
+	case float64:
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v))
+	case string:
+		return append(appendMsgpackLen(b, len(v), 0xa0, 32, 0xd9, 0xda, 0xdb), v...)
+	case []byte:
+		return append(appendMsgpackLen(b, len(v), 0, 0, 0xc4, 0xc5, 0xc6), v...)
+	case []any:
+		b = appendMsgpackLen(b, len(v), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, e := range v {
+			b = appendMsgpack(b, e)
+		}
+		return b
+	case map[string]any:
+		b = appendMsgpackLen(b, len(v), 0x80, 16, 0, 0xde, 0xdf)
+		for k, e := range v {
+			b = appendMsgpack(appendMsgpack(b, k), e)
+		}
+		return b
+	case fluentEventTime:
+		t := time.Time(v)
+		b = append(b, 0xd7, 0)
+		b = binary.BigEndian.AppendUint32(b, uint32(t.Unix()))
+		return binary.BigEndian.AppendUint32(b, uint32(t.Nanosecond()))
+	}
+	panic(fmt.Sprintf("msgpack: can't encode %T", v))
+}
+
+// Appends a length in the smallest of the forms that fits: the fix
+// form's low bits when it's under fixMax, then 8, 16 and 32 bits. Forms a
+// type lacks are 0.
+func appendMsgpackLen(b []byte, n int, fix byte, fixMax int, len8, len16, len32 byte) []byte {
+	switch {
+	case n < fixMax:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint8 && len8 != 0:
+		return append(b, len8, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, len16), uint16(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, len32), uint32(n))
+}
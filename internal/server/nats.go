@@ -0,0 +1,367 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/nats"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"go.uber.org/zap"
+)
+
+// How long an export that's caught up waits to look for records again,
+// and how long an import's append may take
+var (
+	natsPollInterval  = 200 * time.Millisecond
+	natsAppendTimeout = 10 * time.Second
+)
+
+// The bridge redials, and retries a failed export, after a backoff
+// doubling from the first up to the last
+const (
+	natsMinBackoff = time.Second
+	natsMaxBackoff = time.Minute
+)
+
+// How many records an export publishes between flushes
+const natsExportBatch = 256
+
+// The headers an exported message carries its record's place in
+const (
+	natsTopicHeader     = "Proglog-Topic"
+	natsPartitionHeader = "Proglog-Partition"
+	natsOffsetHeader    = "Proglog-Offset"
+)
+
+// NATSBridgeConfig mirrors NATS subjects into topics and topics onto
+// subjects
+type NATSBridgeConfig struct {
+	// URL is the NATS server's, nats:// or tls://, with its credentials
+	URL string `json:"url"`
+	// TLSConfig secures tls:// URLs, nil uses the system roots
+	TLSConfig *tls.Config  `json:"-"`
+	Imports   []NATSImport `json:"imports"`
+	Exports   []NATSExport `json:"exports"`
+}
+
+// NATSImport appends the messages published to Subject, which may have
+// wildcards, to Topic, keyed by their subjects. The servers share them in
+// the Queue group, "proglog" if it's empty, so each is appended once.
+type NATSImport struct {
+	Subject string `json:"subject"`
+	Topic   string `json:"topic"`
+	Queue   string `json:"queue,omitempty"`
+}
+
+// NATSExport publishes Topic's records to Subject, or to their keys when
+// it's empty, falling back to the topic's name for keys that aren't
+// subjects. Each partition's leader publishes its records, at least once,
+// from a cursor kept under Name.
+type NATSExport struct {
+	Name    string `json:"name"`
+	Topic   string `json:"topic"`
+	Subject string `json:"subject,omitempty"`
+}
+
+// LoadNATSBridge reads a bridge's config from the JSON file at path
+func LoadNATSBridge(path string) (*NATSBridgeConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	bridge := &NATSBridgeConfig{}
+	if err := json.Unmarshal(b, bridge); err != nil {
+		return nil, fmt.Errorf("nats bridge %s: %w", path, err)
+	}
+	if err := bridge.validate(); err != nil {
+		return nil, fmt.Errorf("nats bridge %s: %w", path, err)
+	}
+	return bridge, nil
+}
+
+func (b *NATSBridgeConfig) validate() error {
+	if b.URL == "" {
+		return errors.New("no url")
+	}
+	for _, imp := range b.Imports {
+		if !nats.ValidSubject(imp.Subject, true) {
+			return fmt.Errorf("import of invalid subject %q", imp.Subject)
+		}
+		if err := log.ValidateTopic(imp.Topic); err != nil {
+			return fmt.Errorf("import of %s: %w", imp.Subject, err)
+		}
+	}
+	names := make(map[string]bool)
+	for _, exp := range b.Exports {
+		if exp.Name == "" || names[exp.Name] {
+			return fmt.Errorf("export of %s: missing or repeated name %q", exp.Topic, exp.Name)
+		}
+		names[exp.Name] = true
+		if err := log.ValidateTopic(exp.Topic); err != nil {
+			return fmt.Errorf("export %s: %w", exp.Name, err)
+		}
+		if exp.Subject != "" && !nats.ValidSubject(exp.Subject, false) {
+			return fmt.Errorf("export %s: invalid subject %q", exp.Name, exp.Subject)
+		}
+	}
+	return nil
+}
+
+// BridgeNATS runs the bridge for the server config serves, redialing NATS
+// whenever the connection ends, until stop is called. Call stop before
+// closing the commit log.
+func BridgeNATS(bridge *NATSBridgeConfig, config *Config) (stop func()) {
+	b := &natsBridge{bridge: bridge, config: withDefaults(config)}
+	// the URL's credentials are kept out of the logs
+	server := bridge.URL
+	if u, err := url.Parse(bridge.URL); err == nil {
+		server = u.Redacted()
+	}
+	b.logger = b.config.Logger.With(zap.String("nats", server))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+type natsBridge struct {
+	bridge *NATSBridgeConfig
+	config *Config
+	logger *zap.Logger
+}
+
+func (b *natsBridge) run(ctx context.Context) {
+	var backoff time.Duration
+	for {
+		connected, err := b.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if connected {
+			backoff = 0
+		}
+		backoff = min(max(2*backoff, natsMinBackoff), natsMaxBackoff)
+		b.logger.Warn("nats connection ended", zap.Duration("retry_in", backoff), zap.Error(err))
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// Connects, subscribes the imports and runs the exports until the
+// connection ends or ctx is done, reporting whether it connected
+func (b *natsBridge) session(ctx context.Context) (connected bool, err error) {
+	conn, err := nats.Dial(ctx, b.bridge.URL, "proglog", b.bridge.TLSConfig)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	for _, imp := range b.bridge.Imports {
+		queue := imp.Queue
+		if queue == "" {
+			queue = "proglog"
+		}
+		if err := conn.Subscribe(imp.Subject, queue, func(m *nats.Msg) { b.importMsg(ctx, imp, m) }); err != nil {
+			return true, err
+		}
+	}
+	if err := conn.Flush(ctx); err != nil {
+		return true, fmt.Errorf("subscribing: %w", err)
+	}
+	b.logger.Info("nats connected")
+	sctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{}, len(b.bridge.Exports))
+	for _, exp := range b.bridge.Exports {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			b.export(sctx, conn, exp)
+		}()
+	}
+	select {
+	case <-ctx.Done():
+	case <-conn.Done():
+	}
+	cancel()
+	for range b.bridge.Exports {
+		<-done
+	}
+	return true, conn.Err()
+}
+
+// Appends the message to the import's topic, unless it's one exported
+// from that topic, so a subject both exported and imported doesn't loop
+func (b *natsBridge) importMsg(ctx context.Context, imp NATSImport, m *nats.Msg) {
+	if vs := m.Header[natsTopicHeader]; len(vs) > 0 && vs[0] == imp.Topic {
+		return
+	}
+	record := &api.Record{Key: []byte(m.Subject), Value: m.Data}
+	keys := make([]string, 0, len(m.Header))
+	for k := range m.Header {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		for _, v := range m.Header[k] {
+			record.Headers = append(record.Headers, &api.Header{Key: k, Value: []byte(v)})
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, natsAppendTimeout)
+	defer cancel()
+	topic, err := b.config.describeTopic(imp.Topic)
+	if err == nil {
+		_, _, err = b.config.append(ctx, record, api.Ack_ACK_DEFAULT, imp.Topic, partitionForKey(record.Key, topic.Partitions), nil)
+	}
+	if err != nil {
+		natsMessagesDropped.WithLabelValues("import").Inc()
+		b.logger.Warn("nats import failed", zap.String("subject", m.Subject), zap.String("topic", imp.Topic), zap.Error(err))
+		return
+	}
+	natsMessages.WithLabelValues("import").Inc()
+}
+
+// Publishes the export's records until ctx is done, backing off after
+// each round that fails
+func (b *natsBridge) export(ctx context.Context, conn *nats.Conn, exp NATSExport) {
+	logger := b.logger.With(zap.String("export", exp.Name), zap.String("topic", exp.Topic))
+	var backoff time.Duration
+	for {
+		exported, err := b.exportOnce(ctx, conn, exp)
+		wait := natsPollInterval
+		switch {
+		case err != nil && ctx.Err() == nil:
+			backoff = min(max(2*backoff, natsMinBackoff), natsMaxBackoff)
+			wait = backoff
+			logger.Warn("nats export failed", zap.Duration("retry_in", backoff), zap.Error(err))
+		case exported:
+			backoff, wait = 0, 0
+		default:
+			backoff = 0
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Publishes a batch from each partition of the topic this server leads
+// with records past the export's cursor, committing the cursor past each
+// batch the server has, and reports whether any were. An export starts
+// at the partitions' ends.
+func (b *natsBridge) exportOnce(ctx context.Context, conn *nats.Conn, exp NATSExport) (exported bool, err error) {
+	topic, err := b.config.describeTopic(exp.Topic)
+	if err != nil {
+		return false, err
+	}
+	group := natsExportGroup(exp.Name)
+	req := &api.FetchGroupOffsetsRequest{Group: group}
+	for p := range topic.Partitions {
+		req.Partitions = append(req.Partitions, &api.GroupOffset{Topic: exp.Topic, Partition: p})
+	}
+	cursors, err := b.config.fetchGroupOffsets(req)
+	if err != nil {
+		return false, err
+	}
+	for _, cursor := range cursors {
+		cl, err := b.config.partition(exp.Topic, cursor.Partition)
+		if err != nil {
+			return exported, err
+		}
+		if notLeading(cl) != nil {
+			continue
+		}
+		if !cursor.Found {
+			var end uint64
+			if sl, ok := cl.(statsLog); ok {
+				end = sl.Stats().HighWatermark
+			}
+			if err := b.commit(ctx, group, exp.Topic, cursor.Partition, end); err != nil {
+				return exported, err
+			}
+			continue
+		}
+		records, err := b.config.readBatch(exp.Topic, cursor.Partition, cursor.Offset, natsExportBatch)
+		if err != nil {
+			return exported, err
+		}
+		if len(records) == 0 {
+			continue
+		}
+		for _, record := range records {
+			if err := b.publish(conn, exp, cursor.Partition, record); errors.Is(err, nats.ErrClosed) {
+				return exported, err
+			} else if err != nil {
+				natsMessagesDropped.WithLabelValues("export").Inc()
+				b.logger.Warn("nats export skipped a record", zap.String("export", exp.Name), zap.Uint64("offset", record.Offset), zap.Error(err))
+			}
+		}
+		// a refused publish won't be taken on retrying, so it's logged and passed
+		if err := conn.Flush(ctx); errors.Is(err, nats.ErrPermissionViolation) {
+			b.logger.Warn("nats refused an export's publish", zap.String("export", exp.Name))
+		} else if err != nil {
+			return exported, err
+		}
+		natsMessages.WithLabelValues("export").Add(float64(len(records)))
+		exported = true
+		if err := b.commit(ctx, group, exp.Topic, cursor.Partition, records[len(records)-1].Offset+1); err != nil {
+			return exported, err
+		}
+	}
+	return exported, nil
+}
+
+func (b *natsBridge) publish(conn *nats.Conn, exp NATSExport, partition uint32, record *api.Record) error {
+	subject := exp.Subject
+	if subject == "" {
+		subject = string(record.Key)
+		if !nats.ValidSubject(subject, false) {
+			subject = exp.Topic
+		}
+	}
+	header := nats.Header{
+		natsTopicHeader:     {exp.Topic},
+		natsPartitionHeader: {strconv.FormatUint(uint64(partition), 10)},
+		natsOffsetHeader:    {strconv.FormatUint(record.Offset, 10)},
+	}
+	for _, h := range record.Headers {
+		// headers that don't fit a message's header block are left off
+		if nats.ValidHeader(h.Key, string(h.Value)) {
+			header[h.Key] = append(header[h.Key], string(h.Value))
+		}
+	}
+	return conn.Publish(subject, header, record.Value)
+}
+
+func (b *natsBridge) commit(ctx context.Context, group, topic string, partition uint32, off uint64) error {
+	err := b.config.commitGroupOffsets(ctx, &api.CommitGroupOffsetsRequest{
+		Group:   group,
+		Offsets: []*api.GroupOffset{{Topic: topic, Partition: partition, Offset: off}},
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("committing cursor: %w", err)
+	}
+	return nil
+}
+
+// The consumer group an export's cursors are committed under
+func natsExportGroup(name string) string {
+	return "__nats." + name
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/nats"
+	"github.com/frankie-mur/proglog/internal/nats/natstest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadNATSBridge(t *testing.T) {
+	dir := t.TempDir()
+	load := func(body string) (*NATSBridgeConfig, error) {
+		path := filepath.Join(dir, "bridge.json")
+		require.NoError(t, os.WriteFile(path, []byte(body), 0o600))
+		return LoadNATSBridge(path)
+	}
+	bridge, err := load(`{
+		"url": "nats://localhost:4222",
+		"imports": [{"subject": "sensors.>", "topic": "sensors"}],
+		"exports": [{"name": "events", "topic": "events", "subject": "proglog.events"}]
+	}`)
+	require.NoError(t, err)
+	require.Equal(t, []NATSImport{{Subject: "sensors.>", Topic: "sensors"}}, bridge.Imports)
+	require.Equal(t, []NATSExport{{Name: "events", Topic: "events", Subject: "proglog.events"}}, bridge.Exports)
+
+	for _, body := range []string{
+		`{"imports": []}`,
+		`{"url": "nats://localhost", "imports": [{"subject": "a..b", "topic": "sensors"}]}`,
+		`{"url": "nats://localhost", "exports": [{"topic": "events"}]}`,
+		`{"url": "nats://localhost", "exports": [{"name": "e", "topic": "events", "subject": "events.*"}]}`,
+		`{"url": "nats://localhost", "exports": [{"name": "e", "topic": "a"}, {"name": "e", "topic": "b"}]}`,
+	} {
+		_, err := load(body)
+		require.Error(t, err, body)
+	}
+}
+
+func TestBridgeNATS(t *testing.T) {
+	_, config, teardown := setupTest(t, nil)
+	defer teardown()
+	tl := config.CommitLog.(topicLog)
+	require.NoError(t, tl.CreateTopic(&api.Topic{Name: "sensors", Partitions: 2}))
+	require.NoError(t, tl.CreateTopic(&api.Topic{Name: "events", Partitions: 1}))
+	events, err := config.partition("events", 0)
+	require.NoError(t, err)
+	// records before the export starts aren't published
+	_, err = events.Append(&api.Record{Key: []byte("events.old"), Value: []byte("old")})
+	require.NoError(t, err)
+
+	srv := natstest.NewServer(t)
+	stop := BridgeNATS(&NATSBridgeConfig{
+		URL:     srv.URL,
+		Imports: []NATSImport{{Subject: "sensors.>", Topic: "sensors"}, {Subject: "events.>", Topic: "events"}},
+		Exports: []NATSExport{{Name: "events", Topic: "events"}},
+	}, config)
+	defer stop()
+
+	ctx := context.Background()
+	conn, err := nats.Dial(ctx, srv.URL, "test", nil)
+	require.NoError(t, err)
+	defer conn.Close()
+	msgs := make(chan *nats.Msg, 10)
+	require.NoError(t, conn.Subscribe("events.>", "", func(m *nats.Msg) { msgs <- m }))
+	require.NoError(t, conn.Flush(ctx))
+
+	// imports are appended keyed by their subjects
+	cl, err := config.partition("sensors", partitionForKey([]byte("sensors.room1.temp"), 2))
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		// the bridge may not have subscribed yet
+		require.NoError(t, conn.Publish("sensors.room1.temp", nats.Header{"Unit": {"C"}}, []byte("21")))
+		require.NoError(t, conn.Flush(ctx))
+		_, err := cl.Read(0)
+		return err == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	record, err := cl.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "sensors.room1.temp", string(record.Key))
+	require.Equal(t, "21", string(record.Value))
+	require.Equal(t, []*api.Header{{Key: "Unit", Value: []byte("C")}}, record.Headers)
+
+	// exports start once their cursors are committed at the partitions' ends
+	require.Eventually(t, func() bool {
+		offsets, err := config.fetchGroupOffsets(&api.FetchGroupOffsetsRequest{
+			Group:      natsExportGroup("events"),
+			Partitions: []*api.GroupOffset{{Topic: "events", Partition: 0}},
+		})
+		return err == nil && offsets[0].Found
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = events.Append(&api.Record{
+		Key:     []byte("events.signup"),
+		Value:   []byte("new"),
+		Headers: []*api.Header{{Key: "Source", Value: []byte("web")}, {Key: "Bad", Value: []byte("a\nb")}},
+	})
+	require.NoError(t, err)
+	_, err = events.Append(&api.Record{Key: []byte("not a subject"), Value: []byte("keyless")})
+	require.NoError(t, err)
+
+	var m *nats.Msg
+	select {
+	case m = <-msgs:
+	case <-time.After(5 * time.Second):
+		t.Fatal("export wasn't published")
+	}
+	require.Equal(t, "events.signup", m.Subject)
+	require.Equal(t, "new", string(m.Data))
+	require.Equal(t, nats.Header{
+		"Proglog-Topic":     {"events"},
+		"Proglog-Partition": {"0"},
+		"Proglog-Offset":    {"1"},
+		"Source":            {"web"},
+	}, m.Header)
+
+	// and the export, imported back, isn't appended again
+	require.Eventually(t, func() bool {
+		offsets, err := config.fetchGroupOffsets(&api.FetchGroupOffsetsRequest{
+			Group:      natsExportGroup("events"),
+			Partitions: []*api.GroupOffset{{Topic: "events", Partition: 0}},
+		})
+		return err == nil && offsets[0].Offset == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	_, err = events.Read(3)
+	require.ErrorAs(t, err, &api.ErrOffsetOutOfRange{})
+}
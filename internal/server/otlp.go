@@ -0,0 +1,368 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"strconv"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Exports bigger than this, compressed or not, are refused
+const otlpMaxExport = 64 << 20
+
+// The resource attribute naming the topic a resource's logs are appended
+// to, in place of the OTLPLogsTopic
+const otlpTopicAttribute = "proglog.topic"
+
+// otlpLogsServer is the OTLP logs service OpenTelemetry collectors and
+// SDKs export to over gRPC, next to the Log service
+type otlpLogsServer struct {
+	collogspb.UnimplementedLogsServiceServer
+	srv *grpcServer
+}
+
+func (s *otlpLogsServer) Export(ctx context.Context, req *collogspb.ExportLogsServiceRequest) (*collogspb.ExportLogsServiceResponse, error) {
+	if err := s.srv.exportLogs(ctx, req); err != nil {
+		return nil, err
+	}
+	return &collogspb.ExportLogsServiceResponse{}, nil
+}
+
+// Appends the exported log records, each resource's to its topic and in
+// the partition its service.name hashes to, so a service's records keep
+// their order. A record's body is its value, as is when it's a string or
+// bytes and as JSON otherwise, and it's stamped with its time, or the time
+// it was observed. Its attributes are its headers, after its resource's,
+// prefixed "resource.", its scope's name and version, and its severity,
+// event name and trace and span ids, if it has them. Records of resources
+// whose topic is IngestTopic go to the topics the routing rules pick.
+func (s *grpcServer) exportLogs(ctx context.Context, req *collogspb.ExportLogsServiceRequest) error {
+	if s.OTLPLogsTopic == "" {
+		return status.Error(codes.Unimplemented, "OTLP logs receiver disabled")
+	}
+	type batch struct {
+		topic, key string
+	}
+	var order []batch
+	batches := make(map[batch][]*api.Record)
+	for _, rl := range req.ResourceLogs {
+		b := batch{topic: s.OTLPLogsTopic}
+		var headers []*api.Header
+		for _, kv := range rl.GetResource().GetAttributes() {
+			v := otlpString(kv.Value)
+			switch kv.Key {
+			case otlpTopicAttribute:
+				b.topic = v
+				continue
+			case "service.name":
+				b.key = v
+			}
+			headers = append(headers, &api.Header{Key: "resource." + kv.Key, Value: []byte(v)})
+		}
+		for _, sl := range rl.ScopeLogs {
+			scope := headers
+			if name := sl.GetScope().GetName(); name != "" {
+				scope = append(scope[:len(scope):len(scope)], &api.Header{Key: "scope.name", Value: []byte(name)})
+			}
+			if version := sl.GetScope().GetVersion(); version != "" {
+				scope = append(scope[:len(scope):len(scope)], &api.Header{Key: "scope.version", Value: []byte(version)})
+			}
+			for _, lr := range sl.LogRecords {
+				if _, ok := batches[b]; !ok {
+					order = append(order, b)
+				}
+				batches[b] = append(batches[b], otlpRecord(b.key, scope, lr))
+			}
+		}
+	}
+	for _, b := range order {
+		records := batches[b]
+		var err error
+		if b.topic == IngestTopic {
+			_, err = s.Ingest(ctx, &api.IngestRequest{Records: records})
+		} else {
+			partitions := uint32(1)
+			if desc, err := s.describeTopic(b.topic); err == nil {
+				partitions = desc.Partitions
+			}
+			var key []byte
+			if b.key != "" {
+				key = []byte(b.key)
+			}
+			_, err = s.ProduceBatch(ctx, &api.ProduceBatchRequest{
+				Records:   records,
+				Topic:     b.topic,
+				Partition: partitionForKey(key, partitions),
+			})
+		}
+		if err != nil {
+			otlpLogRecordsDropped.Add(float64(len(records)))
+			return err
+		}
+		otlpLogRecords.Add(float64(len(records)))
+	}
+	return nil
+}
+
+// Converts a log record to a record, see exportLogs
+func otlpRecord(key string, headers []*api.Header, lr *logspb.LogRecord) *api.Record {
+	record := &api.Record{Headers: headers[:len(headers):len(headers)]}
+	if key != "" {
+		record.Key = []byte(key)
+	}
+	switch body := lr.Body.GetValue().(type) {
+	case nil:
+	case *commonpb.AnyValue_StringValue:
+		record.Value = []byte(body.StringValue)
+	case *commonpb.AnyValue_BytesValue:
+		record.Value = body.BytesValue
+	default:
+		record.Value, _ = json.Marshal(otlpJSON(lr.Body))
+	}
+	ts := lr.TimeUnixNano
+	if ts == 0 {
+		ts = lr.ObservedTimeUnixNano
+	}
+	record.Timestamp = int64(min(ts, math.MaxInt64))
+	add := func(key string, value []byte) {
+		record.Headers = append(record.Headers, &api.Header{Key: key, Value: value})
+	}
+	for _, kv := range lr.Attributes {
+		add(kv.Key, []byte(otlpString(kv.Value)))
+	}
+	if lr.SeverityText != "" {
+		add("severity_text", []byte(lr.SeverityText))
+	}
+	if lr.SeverityNumber != logspb.SeverityNumber_SEVERITY_NUMBER_UNSPECIFIED {
+		add("severity_number", []byte(strconv.Itoa(int(lr.SeverityNumber))))
+	}
+	if lr.EventName != "" {
+		add("event_name", []byte(lr.EventName))
+	}
+	if len(lr.TraceId) > 0 {
+		add("trace_id", []byte(hex.EncodeToString(lr.TraceId)))
+	}
+	if len(lr.SpanId) > 0 {
+		add("span_id", []byte(hex.EncodeToString(lr.SpanId)))
+	}
+	return record
+}
+
+// An attribute's value as a header's: strings as they are, other scalars
+// as they print and arrays and maps as JSON
+func otlpString(v *commonpb.AnyValue) string {
+	switch v := v.GetValue().(type) {
+	case nil:
+		return ""
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *commonpb.AnyValue_IntValue:
+		return strconv.FormatInt(v.IntValue, 10)
+	case *commonpb.AnyValue_DoubleValue:
+		return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+	case *commonpb.AnyValue_BytesValue:
+		return string(v.BytesValue)
+	}
+	b, _ := json.Marshal(otlpJSON(v))
+	return string(b)
+}
+
+// Converts a value to one that marshals to JSON as it reads, maps as
+// objects and bytes base64 encoded
+func otlpJSON(v *commonpb.AnyValue) any {
+	switch v := v.GetValue().(type) {
+	case *commonpb.AnyValue_StringValue:
+		return v.StringValue
+	case *commonpb.AnyValue_BoolValue:
+		return v.BoolValue
+	case *commonpb.AnyValue_IntValue:
+		return v.IntValue
+	case *commonpb.AnyValue_DoubleValue:
+		if math.IsInf(v.DoubleValue, 0) || math.IsNaN(v.DoubleValue) {
+			return strconv.FormatFloat(v.DoubleValue, 'g', -1, 64)
+		}
+		return v.DoubleValue
+	case *commonpb.AnyValue_BytesValue:
+		return v.BytesValue
+	case *commonpb.AnyValue_ArrayValue:
+		values := make([]any, len(v.ArrayValue.GetValues()))
+		for i, el := range v.ArrayValue.GetValues() {
+			values[i] = otlpJSON(el)
+		}
+		return values
+	case *commonpb.AnyValue_KvlistValue:
+		fields := make(map[string]any, len(v.KvlistValue.GetValues()))
+		for _, kv := range v.KvlistValue.GetValues() {
+			fields[kv.Key] = otlpJSON(kv.Value)
+		}
+		return fields
+	}
+	return nil
+}
+
+// Takes OTLP log exports over HTTP, protobuf or JSON encoded and gzipped
+// or not, answering in the request's encoding
+func (s *httpsServer) handleOTLPLogs(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	encoding := mediaType
+	if encoding != "application/json" {
+		encoding = "application/x-protobuf"
+	}
+	fail := func(err error, code int) {
+		st := status.Convert(err).Proto()
+		var b []byte
+		if encoding == "application/json" {
+			b, _ = protojson.Marshal(st)
+		} else {
+			b, _ = proto.Marshal(st)
+		}
+		w.Header().Set("Content-Type", encoding)
+		w.WriteHeader(code)
+		w.Write(b)
+	}
+	if mediaType != "application/x-protobuf" && mediaType != "application/json" {
+		fail(status.Errorf(codes.InvalidArgument, "unsupported content type %q", mediaType), http.StatusUnsupportedMediaType)
+		return
+	}
+	body := io.Reader(http.MaxBytesReader(w, r.Body, otlpMaxExport))
+	switch r.Header.Get("Content-Encoding") {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			fail(status.Error(codes.InvalidArgument, err.Error()), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		fail(status.Errorf(codes.InvalidArgument, "unsupported content encoding %q", r.Header.Get("Content-Encoding")), http.StatusUnsupportedMediaType)
+		return
+	}
+	b, err := io.ReadAll(io.LimitReader(body, otlpMaxExport+1))
+	if errors.As(err, new(*http.MaxBytesError)) || len(b) > otlpMaxExport {
+		fail(status.Errorf(codes.InvalidArgument, "export exceeds %d bytes", otlpMaxExport), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		fail(status.Error(codes.InvalidArgument, err.Error()), http.StatusBadRequest)
+		return
+	}
+	req := &collogspb.ExportLogsServiceRequest{}
+	if encoding == "application/json" {
+		if b, err = otlpJSONIDs(b); err == nil {
+			err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(b, req)
+		}
+	} else {
+		err = proto.Unmarshal(b, req)
+	}
+	if err != nil {
+		fail(status.Error(codes.InvalidArgument, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	err = newgrpcServer(s.Config).exportLogs(r.Context(), req)
+	if err != nil {
+		code := http.StatusInternalServerError
+		switch {
+		case errors.As(err, &api.ErrNotLeader{}), errors.As(err, &api.ErrNotEnoughReplicas{}):
+			code = http.StatusServiceUnavailable
+		case errors.As(err, &api.ErrPartitionNotFound{}), errors.As(err, &api.ErrTopicNotFound{}):
+			code = http.StatusNotFound
+		case errors.As(err, &api.ErrRecordTooLarge{}):
+			code = http.StatusRequestEntityTooLarge
+		case errors.As(err, &api.ErrSchemaViolation{}), errors.As(err, &api.ErrRecordRejected{}),
+			errors.As(err, &api.ErrInvalidTimestamp{}):
+			code = http.StatusBadRequest
+		case errors.As(err, &api.ErrDiskFull{}):
+			code = http.StatusInsufficientStorage
+		default:
+			switch status.Code(err) {
+			case codes.Unimplemented:
+				code = http.StatusNotFound
+			case codes.PermissionDenied:
+				code = http.StatusForbidden
+			case codes.InvalidArgument:
+				code = http.StatusBadRequest
+			case codes.Unavailable:
+				code = http.StatusServiceUnavailable
+			default:
+				s.logger(r.Context()).Error("OTLP logs export failed", zap.Error(err))
+			}
+		}
+		fail(err, code)
+		return
+	}
+	var res []byte
+	if encoding == "application/json" {
+		res, err = protojson.Marshal(&collogspb.ExportLogsServiceResponse{})
+	} else {
+		res, err = proto.Marshal(&collogspb.ExportLogsServiceResponse{})
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", encoding)
+	w.Write(res)
+}
+
+// OTLP's JSON encodes trace and span ids in hex rather than the base64
+// protojson takes, so they're recoded before it's unmarshaled
+func otlpJSONIDs(b []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var export map[string]any
+	if err := d.Decode(&export); err != nil {
+		return nil, err
+	}
+	list := func(v any, keys ...string) []any {
+		m, _ := v.(map[string]any)
+		for _, key := range keys {
+			if l, ok := m[key].([]any); ok {
+				return l
+			}
+		}
+		return nil
+	}
+	for _, rl := range list(export, "resourceLogs", "resource_logs") {
+		for _, sl := range list(rl, "scopeLogs", "scope_logs") {
+			for _, lr := range list(sl, "logRecords", "log_records") {
+				m, _ := lr.(map[string]any)
+				for _, key := range []string{"traceId", "trace_id", "spanId", "span_id"} {
+					id, ok := m[key].(string)
+					if !ok {
+						continue
+					}
+					raw, err := hex.DecodeString(id)
+					if err != nil {
+						return nil, fmt.Errorf("%s: %w", key, err)
+					}
+					m[key] = base64.StdEncoding.EncodeToString(raw)
+				}
+			}
+		}
+	}
+	return json.Marshal(export)
+}
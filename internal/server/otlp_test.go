@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/stretchr/testify/require"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	logspb "go.opentelemetry.io/proto/otlp/logs/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func otlpAttr(key string, v *commonpb.AnyValue) *commonpb.KeyValue {
+	return &commonpb.KeyValue{Key: key, Value: v}
+}
+
+func otlpStr(s string) *commonpb.AnyValue {
+	return &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: s}}
+}
+
+func otlpExport(service string, resource ...*commonpb.KeyValue) *collogspb.ExportLogsServiceRequest {
+	resource = append([]*commonpb.KeyValue{otlpAttr("service.name", otlpStr(service))}, resource...)
+	return &collogspb.ExportLogsServiceRequest{ResourceLogs: []*logspb.ResourceLogs{{
+		Resource: &resourcepb.Resource{Attributes: resource},
+		ScopeLogs: []*logspb.ScopeLogs{{
+			Scope: &commonpb.InstrumentationScope{Name: "app/http", Version: "1.2"},
+			LogRecords: []*logspb.LogRecord{{
+				TimeUnixNano:   1700000000000000000,
+				SeverityNumber: logspb.SeverityNumber_SEVERITY_NUMBER_INFO,
+				SeverityText:   "INFO",
+				Body:           otlpStr("request served"),
+				Attributes:     []*commonpb.KeyValue{otlpAttr("http.status_code", &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 200}})},
+				TraceId:        []byte{0x5b, 0x8e, 0xff, 0xf7, 0x98, 0x03, 0x81, 0x03, 0xd2, 0x69, 0xb6, 0x33, 0x81, 0x3f, 0xc6, 0x0c},
+				SpanId:         []byte{0xee, 0xe1, 0x9b, 0x7e, 0xc3, 0xc1, 0xb1, 0x74},
+			}, {
+				ObservedTimeUnixNano: 1700000001000000000,
+				Body: &commonpb.AnyValue{Value: &commonpb.AnyValue_KvlistValue{KvlistValue: &commonpb.KeyValueList{Values: []*commonpb.KeyValue{
+					otlpAttr("msg", otlpStr("done")),
+					otlpAttr("n", &commonpb.AnyValue{Value: &commonpb.AnyValue_IntValue{IntValue: 3}}),
+				}}}},
+			}},
+		}},
+	}}}
+}
+
+func otlpHeaders(record *api.Record) map[string]string {
+	headers := make(map[string]string)
+	for _, h := range record.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	return headers
+}
+
+func TestOTLPLogsGRPC(t *testing.T) {
+	_, config, teardown := setupTest(t, func(c *Config) {
+		c.OTLPLogsTopic = "logs"
+	})
+	defer teardown()
+	tl := config.CommitLog.(topicLog)
+	require.NoError(t, tl.CreateTopic(&api.Topic{Name: "logs", Partitions: 4}))
+	require.NoError(t, tl.CreateTopic(&api.Topic{Name: "events"}))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	gsrv, err := NewGRPCServer(config)
+	require.NoError(t, err)
+	go gsrv.Serve(l)
+	defer gsrv.Stop()
+	cc, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+	client := collogspb.NewLogsServiceClient(cc)
+
+	ctx := asPrincipal(context.Background(), "root-key")
+	_, err = client.Export(ctx, otlpExport("checkout", otlpAttr("host.name", otlpStr("web-1"))))
+	require.NoError(t, err)
+
+	// the service's records are in the partition its name hashes to
+	cl, err := config.partition("logs", partitionForKey([]byte("checkout"), 4))
+	require.NoError(t, err)
+	record, err := cl.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "checkout", string(record.Key))
+	require.Equal(t, "request served", string(record.Value))
+	require.Equal(t, int64(1700000000000000000), record.Timestamp)
+	require.Equal(t, map[string]string{
+		"resource.service.name": "checkout",
+		"resource.host.name":    "web-1",
+		"scope.name":            "app/http",
+		"scope.version":         "1.2",
+		"http.status_code":      "200",
+		"severity_text":         "INFO",
+		"severity_number":       "9",
+		"trace_id":              "5b8efff798038103d269b633813fc60c",
+		"span_id":               "eee19b7ec3c1b174",
+	}, otlpHeaders(record))
+	record, err = cl.Read(1)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"msg": "done", "n": 3}`, string(record.Value))
+	require.Equal(t, int64(1700000001000000000), record.Timestamp)
+
+	// a resource can name its own topic, which the caller must be allowed
+	// to produce to
+	_, err = client.Export(asPrincipal(context.Background(), "events-key"), otlpExport("billing", otlpAttr(otlpTopicAttribute, otlpStr("events"))))
+	require.NoError(t, err)
+	cl, err = config.partition("events", 0)
+	require.NoError(t, err)
+	record, err = cl.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "billing", string(record.Key))
+	require.NotContains(t, otlpHeaders(record), "resource."+otlpTopicAttribute)
+	_, err = client.Export(asPrincipal(context.Background(), "events-key"), otlpExport("billing"))
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestOTLPLogsHTTP(t *testing.T) {
+	_, config, teardown := setupTest(t, func(c *Config) {
+		c.OTLPLogsTopic = "logs"
+	})
+	defer teardown()
+	require.NoError(t, config.CommitLog.(topicLog).CreateTopic(&api.Topic{Name: "logs"}))
+	srv := httptest.NewServer(NewHTTPServer("", config).Handler)
+	defer srv.Close()
+	post := func(contentType, contentEncoding string, body []byte) *http.Response {
+		req, err := http.NewRequest(http.MethodPost, srv.URL+"/v1/logs", bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set(auth.APIKeyHeader, "root-key")
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Content-Encoding", contentEncoding)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	// gzipped protobuf, as collectors send by default
+	b, err := proto.Marshal(otlpExport("checkout"))
+	require.NoError(t, err)
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write(b)
+	require.NoError(t, w.Close())
+	res := post("application/x-protobuf", "gzip", gz.Bytes())
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/x-protobuf", res.Header.Get("Content-Type"))
+
+	// JSON, with its ids in hex
+	res = post("application/json", "", []byte(`{"resourceLogs": [{
+		"resource": {"attributes": [{"key": "service.name", "value": {"stringValue": "cart"}}]},
+		"scopeLogs": [{"logRecords": [{
+			"timeUnixNano": "1700000002000000000",
+			"body": {"stringValue": "added"},
+			"traceId": "5b8efff798038103d269b633813fc60c",
+			"spanId": "eee19b7ec3c1b174"
+		}]}]
+	}]}`))
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	require.Equal(t, "application/json", res.Header.Get("Content-Type"))
+
+	cl, err := config.partition("logs", 0)
+	require.NoError(t, err)
+	record, err := cl.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, "cart", string(record.Key))
+	require.Equal(t, "added", string(record.Value))
+	require.Equal(t, int64(1700000002000000000), record.Timestamp)
+	headers := otlpHeaders(record)
+	require.Equal(t, "5b8efff798038103d269b633813fc60c", headers["trace_id"])
+	require.Equal(t, "eee19b7ec3c1b174", headers["span_id"])
+
+	res = post("application/json", "", []byte(`{"resourceLogs": [{"scopeLogs": [{"logRecords": [{"traceId": "zz"}]}]}]}`))
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+	res = post("text/plain", "", []byte("hello"))
+	require.Equal(t, http.StatusUnsupportedMediaType, res.StatusCode)
+
+	// without a topic the service is off
+	srv2 := httptest.NewServer(NewHTTPServer("", &Config{}).Handler)
+	defer srv2.Close()
+	res2, err := http.Post(srv2.URL+"/v1/logs", "application/json", strings.NewReader(`{}`))
+	require.NoError(t, err)
+	defer res2.Body.Close()
+	require.Equal(t, http.StatusNotFound, res2.StatusCode)
+}
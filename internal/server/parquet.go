@@ -0,0 +1,347 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/parquet"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// How many records a file's written from at a time
+const parquetReadBatch = 1000
+
+// The files' columns, a row a record
+var parquetColumns = []parquet.Column{
+	{Name: "partition", Type: parquet.Int32},
+	{Name: "offset", Type: parquet.Int64},
+	{Name: "timestamp", Type: parquet.Int64, Timestamp: true},
+	{Name: "key", Type: parquet.ByteArray, Optional: true},
+	{Name: "value", Type: parquet.ByteArray},
+	// a JSON array of {"key", "value"} objects, values that aren't UTF-8
+	// as "value_base64"
+	{Name: "headers", Type: parquet.ByteArray, Optional: true, UTF8: true},
+}
+
+// ParquetExportConfig writes the topics' records to Parquet files in an
+// object store. Each run closes the range of each partition's offsets up
+// to its high watermark and writes it, in files of at most MaxRecords,
+// keyed Prefix+"<topic>/partition=<p>/<start>-<end>.parquet" with the
+// offsets exclusive of end. The files each partition's leader wrote are
+// kept in the ParquetExportsTopic and listed in a manifest.json next to
+// them, readers should take the files the manifests list.
+type ParquetExportConfig struct {
+	Store  log.ObjectStore
+	Prefix string
+	Topics []string
+	// Interval is how often the exports run, defaults to 10 minutes
+	Interval time.Duration
+	// MaxRecords caps the records in a file, defaults to 100000
+	MaxRecords int
+}
+
+// ParquetFile is a file an export wrote, as its partition's manifest
+// lists it
+type ParquetFile struct {
+	Key       string `json:"key"`
+	Topic     string `json:"topic"`
+	Partition uint32 `json:"partition"`
+	// StartOffset and EndOffset are the range closed, the records in it
+	// fewer for a compacted topic
+	StartOffset  uint64    `json:"start_offset"`
+	EndOffset    uint64    `json:"end_offset"`
+	Records      int       `json:"records"`
+	Size         int64     `json:"size"`
+	MinTimestamp time.Time `json:"min_timestamp"`
+	MaxTimestamp time.Time `json:"max_timestamp"`
+	Created      time.Time `json:"created"`
+}
+
+// ParquetManifest lists a partition's files in offset order
+type ParquetManifest struct {
+	Topic     string        `json:"topic"`
+	Partition uint32        `json:"partition"`
+	Files     []ParquetFile `json:"files"`
+}
+
+// ExportParquet runs the exports for the server config serves, this
+// server writing the partitions it leads, until stop is called. Call stop
+// before closing the commit log.
+func ExportParquet(export *ParquetExportConfig, config *Config) (stop func()) {
+	e := &parquetExporter{
+		export: *export,
+		config: withDefaults(config),
+		files:  make(map[topicPartition][]ParquetFile),
+		keys:   make(map[string]bool),
+	}
+	if e.export.Interval == 0 {
+		e.export.Interval = 10 * time.Minute
+	}
+	if e.export.MaxRecords == 0 {
+		e.export.MaxRecords = 100000
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// parquetExporter keeps the files written, read from the exports topic's
+// partition as far as this server has it and added as they're written,
+// by topic and partition
+type parquetExporter struct {
+	export ParquetExportConfig
+	config *Config
+
+	partition CommitLog
+	next      uint64
+	files     map[topicPartition][]ParquetFile
+	keys      map[string]bool
+}
+
+func (e *parquetExporter) run(ctx context.Context) {
+	for {
+		for _, topic := range e.export.Topics {
+			if err := e.exportTopic(ctx, topic); err != nil && ctx.Err() == nil {
+				e.config.Logger.Error("parquet export failed", zap.String("topic", topic), zap.Error(err))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(e.export.Interval):
+		}
+	}
+}
+
+// Exports each of the topic's partitions this server leads up to its
+// high watermark
+func (e *parquetExporter) exportTopic(ctx context.Context, name string) error {
+	topic, err := e.config.describeTopic(name)
+	if err != nil {
+		return err
+	}
+	if err := e.catchUp(); err != nil {
+		return err
+	}
+	for p := range topic.Partitions {
+		cl, err := e.config.partition(name, p)
+		if err != nil {
+			return err
+		}
+		if notLeading(cl) != nil {
+			continue
+		}
+		sl, ok := cl.(statsLog)
+		if !ok {
+			return status.Error(codes.Unimplemented, "log doesn't report its offsets")
+		}
+		gp := topicPartition{name, p}
+		var start uint64
+		if files := e.files[gp]; len(files) > 0 {
+			start = files[len(files)-1].EndOffset
+		}
+		stats := sl.Stats()
+		start = max(start, stats.LowWatermark)
+		for start < stats.HighWatermark && ctx.Err() == nil {
+			end := min(stats.HighWatermark, start+uint64(e.export.MaxRecords))
+			if err := e.write(ctx, name, p, start, end); err != nil {
+				return err
+			}
+			start = end
+		}
+	}
+	return nil
+}
+
+// Writes the partition's records in [start, end) to a file, then keeps it
+// in the exports topic and rewrites the partition's manifest
+func (e *parquetExporter) write(ctx context.Context, topic string, p uint32, start, end uint64) error {
+	w := parquet.NewWriter(parquetColumns)
+	file := ParquetFile{
+		Key:         fmt.Sprintf("%s%s/partition=%d/%020d-%020d.parquet", e.export.Prefix, topic, p, start, end),
+		Topic:       topic,
+		Partition:   p,
+		StartOffset: start,
+		EndOffset:   end,
+	}
+	for off := start; off < end; {
+		records, err := e.config.readBatch(topic, p, off, min(int(end-off), parquetReadBatch))
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			break
+		}
+		for _, record := range records {
+			if record.Offset >= end {
+				break
+			}
+			if err := w.Append(parquetRow(p, record)...); err != nil {
+				return err
+			}
+			ts := time.Unix(0, record.Timestamp).UTC()
+			if file.Records == 0 || ts.Before(file.MinTimestamp) {
+				file.MinTimestamp = ts
+			}
+			if file.Records == 0 || ts.After(file.MaxTimestamp) {
+				file.MaxTimestamp = ts
+			}
+			file.Records++
+		}
+		off = records[len(records)-1].Offset + 1
+	}
+	var buf bytes.Buffer
+	if _, err := w.WriteTo(&buf); err != nil {
+		return err
+	}
+	file.Size = int64(buf.Len())
+	if err := e.export.Store.Put(ctx, file.Key, &buf, file.Size); err != nil {
+		return fmt.Errorf("putting %s: %w", file.Key, err)
+	}
+	file.Created = time.Now().UTC()
+
+	value, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	if _, err := e.config.exportsPartition(true); err != nil {
+		return err
+	}
+	_, _, err = e.config.append(ctx, &api.Record{Key: []byte(file.Key), Value: value}, api.Ack_ACK_ALL, log.ParquetExportsTopic, 0, nil)
+	if err != nil {
+		return fmt.Errorf("keeping %s: %w", file.Key, err)
+	}
+	e.add(file)
+	parquetFiles.Inc()
+	parquetRecords.Add(float64(file.Records))
+	e.config.Logger.Info("exported parquet file",
+		zap.String("key", file.Key),
+		zap.Int("records", file.Records),
+		zap.Int64("size", file.Size),
+	)
+	return e.putManifest(ctx, topic, p)
+}
+
+func parquetRow(p uint32, record *api.Record) []any {
+	row := []any{int32(p), int64(record.Offset), record.Timestamp / 1000, nil, record.Value, nil}
+	if record.Key != nil {
+		row[3] = record.Key
+	}
+	if len(record.Headers) > 0 {
+		type header struct {
+			Key         string  `json:"key"`
+			Value       *string `json:"value,omitempty"`
+			ValueBase64 []byte  `json:"value_base64,omitempty"`
+		}
+		headers := make([]header, len(record.Headers))
+		for i, h := range record.Headers {
+			headers[i].Key = h.Key
+			if utf8.Valid(h.Value) {
+				v := string(h.Value)
+				headers[i].Value = &v
+			} else {
+				headers[i].ValueBase64 = h.Value
+			}
+		}
+		b, _ := json.Marshal(headers)
+		row[5] = b
+	}
+	return row
+}
+
+func (e *parquetExporter) putManifest(ctx context.Context, topic string, p uint32) error {
+	manifest := ParquetManifest{Topic: topic, Partition: p, Files: e.files[topicPartition{topic, p}]}
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	key := e.export.Prefix + topic + "/partition=" + strconv.FormatUint(uint64(p), 10) + "/manifest.json"
+	if err := e.export.Store.Put(ctx, key, bytes.NewReader(b), int64(len(b))); err != nil {
+		return fmt.Errorf("putting %s: %w", key, err)
+	}
+	return nil
+}
+
+// Reads the files appended to the exports topic since the last read, such
+// as those another server wrote while it led a partition
+func (e *parquetExporter) catchUp() error {
+	cl, err := e.config.exportsPartition(false)
+	if errors.As(err, &api.ErrTopicNotFound{}) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if cl != e.partition {
+		e.partition, e.next = cl, 0
+	}
+	for {
+		record, next, err := readFrom(cl, e.next)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		e.next = next
+		var file ParquetFile
+		if err := json.Unmarshal(record.Value, &file); err != nil {
+			return fmt.Errorf("reading exported file at %d: %w", record.Offset, err)
+		}
+		e.add(file)
+	}
+}
+
+// Keeps the file in its partition's, in offset order
+func (e *parquetExporter) add(file ParquetFile) {
+	if e.keys[file.Key] {
+		return
+	}
+	e.keys[file.Key] = true
+	gp := topicPartition{file.Topic, file.Partition}
+	files := append(e.files[gp], file)
+	slices.SortStableFunc(files, func(a, b ParquetFile) int {
+		return cmp.Compare(a.EndOffset, b.EndOffset)
+	})
+	e.files[gp] = files
+}
+
+// The exports topic's partition, created first with create if there's
+// none. It's kept as the offsets topic is.
+func (c *Config) exportsPartition(create bool) (CommitLog, error) {
+	tl, ok := c.CommitLog.(topicLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log can't keep parquet exports")
+	}
+	cl, err := c.partition(log.ParquetExportsTopic, 0)
+	if !create || !errors.As(err, &api.ErrTopicNotFound{}) {
+		return cl, err
+	}
+	err = tl.CreateTopic(&api.Topic{Name: log.ParquetExportsTopic, Partitions: 1, Configs: offsetsTopicConfigs})
+	if err != nil && !errors.As(err, &api.ErrTopicExists{}) {
+		return nil, err
+	}
+	if err == nil {
+		c.Logger.Info("created parquet exports topic", zap.String("topic", log.ParquetExportsTopic))
+	}
+	return c.partition(log.ParquetExportsTopic, 0)
+}
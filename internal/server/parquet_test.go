@@ -0,0 +1,73 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/objstore"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportParquet(t *testing.T) {
+	_, config, teardown := setupTest(t, nil)
+	defer teardown()
+	require.NoError(t, config.CommitLog.(topicLog).CreateTopic(&api.Topic{Name: "events", Partitions: 2}))
+	cl, err := config.partition("events", 0)
+	require.NoError(t, err)
+	for _, v := range []string{"a", "b", "c"} {
+		_, err := cl.Append(&api.Record{Key: []byte("k"), Value: []byte(v), Headers: []*api.Header{{Key: "h", Value: []byte{0xff}}}})
+		require.NoError(t, err)
+	}
+
+	dir := t.TempDir()
+	export := &ParquetExportConfig{
+		Store:      objstore.NewDir(dir),
+		Prefix:     "lake/",
+		Topics:     []string{"events"},
+		Interval:   10 * time.Millisecond,
+		MaxRecords: 2,
+	}
+	manifest := func() ParquetManifest {
+		var m ParquetManifest
+		b, err := os.ReadFile(filepath.Join(dir, "lake/events/partition=0/manifest.json"))
+		if err == nil {
+			require.NoError(t, json.Unmarshal(b, &m))
+		}
+		return m
+	}
+	stop := ExportParquet(export, config)
+	// the range is closed at the high watermark, in files of two records
+	require.Eventually(t, func() bool { return len(manifest().Files) == 2 }, 5*time.Second, 10*time.Millisecond)
+	stop()
+	files := manifest().Files
+	require.Equal(t, "lake/events/partition=0/00000000000000000000-00000000000000000002.parquet", files[0].Key)
+	require.Equal(t, []uint64{0, 2, 2, 3}, []uint64{files[0].StartOffset, files[0].EndOffset, files[1].StartOffset, files[1].EndOffset})
+	require.Equal(t, []int{2, 1}, []int{files[0].Records, files[1].Records})
+	b, err := os.ReadFile(filepath.Join(dir, files[0].Key))
+	require.NoError(t, err)
+	require.Equal(t, "PAR1", string(b[:4]))
+	require.Equal(t, files[0].Size, int64(len(b)))
+	// the empty partition has no files
+	_, err = os.Stat(filepath.Join(dir, "lake/events/partition=1/manifest.json"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// the files are kept in the exports topic, so a restarted export
+	// carries on after them
+	progress, err := config.partition(log.ParquetExportsTopic, 0)
+	require.NoError(t, err)
+	record, err := progress.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, files[1].Key, string(record.Key))
+	_, err = cl.Append(&api.Record{Value: []byte("d")})
+	require.NoError(t, err)
+	stop = ExportParquet(export, config)
+	defer stop()
+	require.Eventually(t, func() bool { return len(manifest().Files) == 3 }, 5*time.Second, 10*time.Millisecond)
+	files = manifest().Files
+	require.Equal(t, []uint64{3, 4}, []uint64{files[2].StartOffset, files[2].EndOffset})
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// producers are the idempotent producers registered on the server, by name
+// and by ID. Their sequences live in memory, so a producer registers again
+// with a server restarted, or another it fails over to.
+type producers struct {
+	mu     sync.Mutex
+	last   uint64
+	byName map[string]*producer
+	byID   map[uint64]*producer
+}
+
+// An idempotent producer, its epoch bumped each time its name registers
+type producer struct {
+	id        uint64
+	name      string
+	principal string
+	// mu serializes its produces and its registrations, so none of an
+	// older epoch append after a newer one's registered
+	mu         sync.Mutex
+	epoch      uint32
+	partitions map[topicPartition]*producerSequence
+}
+
+// The sequence of a producer's records to a partition: the next it
+// expects, and the first of the last produce it appended, with that
+// produce's response, to answer its retry with
+type producerSequence struct {
+	next      uint64
+	lastFirst uint64
+	lastOffs  []uint64
+	pending   bool
+}
+
+// A produce request, idempotent when it has a producer ID
+type idempotentRequest interface {
+	GetTopic() string
+	GetPartition() uint32
+	GetProducerId() uint64
+	GetProducerEpoch() uint32
+	GetSequence() uint64
+}
+
+// Registers the idempotent producer under the name for the principal,
+// bumping its epoch if it's registered already, and aborting the
+// transaction open under it
+func (c *Config) initProducer(ctx context.Context, name, principal string) (uint64, uint32, error) {
+	if name == "" {
+		return 0, 0, status.Error(codes.InvalidArgument, "missing producer name")
+	}
+	ps := c.producers
+	ps.mu.Lock()
+	p, ok := ps.byName[name]
+	if !ok {
+		ps.last = max(ps.last+1, uint64(time.Now().UnixNano()))
+		p = &producer{id: ps.last, name: name, principal: principal, partitions: make(map[topicPartition]*producerSequence)}
+		ps.byName[name] = p
+		ps.byID[p.id] = p
+		ps.mu.Unlock()
+		return p.id, p.epoch, nil
+	}
+	ps.mu.Unlock()
+	if p.principal != principal {
+		return 0, 0, status.Errorf(codes.PermissionDenied, "producer %s is %s's", name, p.principal)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.epoch++
+	clear(p.partitions)
+	c.transactions.mu.Lock()
+	txn, open := c.transactions.open[name]
+	c.transactions.mu.Unlock()
+	if open {
+		if err := c.endTransaction(ctx, name, txn.principal, api.Control_CONTROL_ABORT); err != nil {
+			c.Logger.Error("aborting fenced producer's transaction", zap.String("producer", name), zap.Error(err))
+		}
+	}
+	return p.id, p.epoch, nil
+}
+
+// Appends n records with appendFn once per sequence of the request's
+// producer, answering a retry of its last produce as it was. Requests
+// without a producer ID append as they come.
+func (c *Config) appendIdempotent(req idempotentRequest, n int, appendFn func() ([]uint64, bool, error)) ([]uint64, bool, error) {
+	if req.GetProducerId() == 0 {
+		return appendFn()
+	}
+	ps := c.producers
+	ps.mu.Lock()
+	p, ok := ps.byID[req.GetProducerId()]
+	ps.mu.Unlock()
+	if !ok {
+		return nil, false, status.Errorf(codes.FailedPrecondition, "producer %d isn't registered", req.GetProducerId())
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch epoch := req.GetProducerEpoch(); {
+	case epoch < p.epoch:
+		idempotentProduces.WithLabelValues("fenced").Inc()
+		return nil, false, api.ErrProducerFenced{ProducerID: p.id, Epoch: epoch, Current: p.epoch}
+	case epoch > p.epoch:
+		return nil, false, status.Errorf(codes.FailedPrecondition, "producer %d has no epoch %d", p.id, epoch)
+	}
+	tp := topicPartition{topicResource(req.GetTopic()), req.GetPartition()}
+	seq, ok := p.partitions[tp]
+	if !ok {
+		seq = &producerSequence{}
+		p.partitions[tp] = seq
+	}
+	switch s := req.GetSequence(); {
+	case seq.lastOffs != nil && s == seq.lastFirst && n == len(seq.lastOffs):
+		idempotentProduces.WithLabelValues("duplicate").Inc()
+		return slices.Clone(seq.lastOffs), seq.pending, nil
+	case s < seq.next:
+		idempotentProduces.WithLabelValues("duplicate").Inc()
+		return nil, false, status.Errorf(codes.AlreadyExists, "producer %d appended sequence %d, expecting %d", p.id, s, seq.next)
+	case s > seq.next:
+		idempotentProduces.WithLabelValues("out_of_order").Inc()
+		return nil, false, status.Errorf(codes.OutOfRange, "producer %d skipped to sequence %d, expecting %d", p.id, s, seq.next)
+	}
+	offs, pending, err := appendFn()
+	if err != nil {
+		return nil, false, err
+	}
+	seq.lastFirst, seq.lastOffs, seq.pending = seq.next, slices.Clone(offs), pending
+	seq.next += uint64(n)
+	idempotentProduces.WithLabelValues("appended").Inc()
+	return offs, pending, nil
+}
+
+func (s *grpcServer) InitProducer(ctx context.Context, req *api.InitProducerRequest) (*api.InitProducerResponse, error) {
+	id, epoch, err := s.initProducer(ctx, req.Name, auth.Principal(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return &api.InitProducerResponse{ProducerId: id, Epoch: epoch}, nil
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIdempotentProducers(t *testing.T) {
+	client, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	first, err := client.InitProducer(ctx, &api.InitProducerRequest{Name: "orders"})
+	require.NoError(t, err)
+	require.NotZero(t, first.ProducerId)
+	produce := func(init *api.InitProducerResponse, value string, sequence uint64) (*api.ProduceResponse, error) {
+		return client.Produce(ctx, &api.ProduceRequest{
+			Record:        &api.Record{Value: []byte(value)},
+			ProducerId:    init.ProducerId,
+			ProducerEpoch: init.Epoch,
+			Sequence:      sequence,
+		})
+	}
+
+	// a retry of the last produce is answered as it was, without appending
+	// again
+	res, err := produce(first, "a", 0)
+	require.NoError(t, err)
+	retried, err := produce(first, "a", 0)
+	require.NoError(t, err)
+	require.Equal(t, res.Offset, retried.Offset)
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records:       []*api.Record{{Value: []byte("b")}, {Value: []byte("c")}},
+		ProducerId:    first.ProducerId,
+		ProducerEpoch: first.Epoch,
+		Sequence:      1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{1, 2}, batch.Offsets)
+	_, err = produce(first, "a", 0)
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = produce(first, "e", 4)
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 3})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// registering again fences the instance before, and aborts its
+	// transaction
+	_, err = client.BeginTransaction(ctx, &api.BeginTransactionRequest{TransactionalId: "orders"})
+	require.NoError(t, err)
+	second, err := client.InitProducer(ctx, &api.InitProducerRequest{Name: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, first.ProducerId, second.ProducerId)
+	require.Equal(t, first.Epoch+1, second.Epoch)
+	_, err = produce(first, "d", 3)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	info := status.Convert(err).Details()[0].(*errdetails.ErrorInfo)
+	require.Equal(t, "PRODUCER_FENCED", info.Reason)
+	require.Equal(t, "1", info.Metadata["current"])
+	_, err = client.CommitTransaction(ctx, &api.CommitTransactionRequest{TransactionalId: "orders"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	// the new instance's sequences start over
+	_, err = produce(second, "d", 0)
+	require.NoError(t, err)
+
+	// and another principal can't register under the name
+	events := asPrincipal(context.Background(), "events-key")
+	_, err = client.InitProducer(events, &api.InitProducerRequest{Name: "orders"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = produce(&api.InitProducerResponse{ProducerId: 1}, "f", 0)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+}
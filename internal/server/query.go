@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"github.com/frankie-mur/proglog/internal/query"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// A query reads at most this many records, answering with the offset to
+// query on from
+const maxQueryScan = 100_000
+
+// Searches the topic partition's records for the offset of the first with
+// a timestamp at or after t, in Unix nanoseconds, the high watermark when
+// there's none, allowing for the topic's timestamps being out of order
+func (c *Config) offsetForTime(topic string, cl CommitLog, st log.Stats, t int64) (uint64, error) {
+	tc, err := c.topicConfig(topic)
+	if err != nil {
+		return 0, err
+	}
+	return log.OffsetForTime(st.LowWatermark, st.HighWatermark, t, tc.TimestampSkew(), cl.Read)
+}
+
+// Runs the query over the range of the partition's records it asks for,
+// passing over control records
+func (c *Config) query(ctx context.Context, req *api.QueryRequest) (*api.QueryResponse, error) {
+	q, err := query.Parse(req.Query)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	cl, err := c.partition(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	sl, ok := cl.(statsLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log doesn't report its offsets")
+	}
+	st := sl.Stats()
+	off, end := max(req.FromOffset, st.LowWatermark), st.HighWatermark
+	if req.ToOffset != 0 {
+		end = min(end, req.ToOffset)
+	}
+	if req.Since != 0 {
+		from, err := c.offsetForTime(req.Topic, cl, st, req.Since)
+		if err != nil {
+			return nil, err
+		}
+		off = max(off, from)
+	}
+	res := &api.QueryResponse{Columns: q.Columns()}
+	results := q.Run()
+	full := false
+	for off < end && !full {
+		if res.Scanned == maxQueryScan {
+			break
+		}
+		if res.Scanned%1024 == 0 && ctx.Err() != nil {
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		record, next, err := readFrom(cl, off)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			// removed since the watermarks were read
+			off++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if req.Until != 0 && record.Timestamp >= req.Until {
+			end = off
+			break
+		}
+		res.Scanned++
+		off = next
+		if record.Control != api.Control_CONTROL_NONE {
+			continue
+		}
+		record = proto.Clone(record).(*api.Record)
+		if err := codec.Decompress(record); err != nil {
+			return nil, err
+		}
+		full = results.Add(query.Record{
+			Offset:    record.Offset,
+			Timestamp: record.Timestamp,
+			Key:       record.Key,
+			Value:     record.Value,
+		})
+	}
+	queryRecords.WithLabelValues(topicResource(req.Topic)).Add(float64(res.Scanned))
+	res.NextOffset = off
+	res.Truncated = off < end
+	for _, row := range results.Rows() {
+		r := &api.QueryRow{Offset: row.Offset, Values: make([]string, len(row.Values))}
+		for i, v := range row.Values {
+			r.Values[i] = string(v)
+		}
+		res.Rows = append(res.Rows, r)
+	}
+	return res, nil
+}
+
+// Runs the query, for anyone who may consume the topic
+func (s *grpcServer) Query(ctx context.Context, req *api.QueryRequest) (*api.QueryResponse, error) {
+	if err := s.authorize(ctx, consumeAction, topicResource(req.Topic)); err != nil {
+		return nil, err
+	}
+	return s.query(ctx, req)
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestQuery(t *testing.T) {
+	client, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	for i := range 10 {
+		kind := "view"
+		if i%3 == 0 {
+			kind = "click"
+		}
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{
+			Value:     []byte(fmt.Sprintf(`{"user": %d, "kind": %q}`, i%4, kind)),
+			Timestamp: int64(i+1) * 100,
+		}})
+		require.NoError(t, err)
+	}
+
+	res, err := client.Query(ctx, &api.QueryRequest{Query: "SELECT user WHERE kind = 'click' AND user > 0"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"user"}, res.Columns)
+	require.Len(t, res.Rows, 3)
+	require.Equal(t, uint64(3), res.Rows[0].Offset)
+	require.Equal(t, []string{"3"}, res.Rows[0].Values)
+	require.Equal(t, []string{"2"}, res.Rows[1].Values)
+	require.Equal(t, uint64(10), res.Scanned)
+	require.False(t, res.Truncated)
+
+	// the range bounds the records counted, by offset and time
+	res, err = client.Query(ctx, &api.QueryRequest{
+		Query:      "SELECT kind, COUNT(*) GROUP BY kind",
+		FromOffset: 1,
+		ToOffset:   9,
+		Until:      700,
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"kind", "count"}, res.Columns)
+	require.Len(t, res.Rows, 2)
+	require.Equal(t, []string{`"view"`, "4"}, res.Rows[0].Values)
+	require.Equal(t, []string{`"click"`, "1"}, res.Rows[1].Values)
+	require.Equal(t, uint64(6), res.NextOffset)
+	require.False(t, res.Truncated)
+
+	res, err = client.Query(ctx, &api.QueryRequest{Query: "SELECT COUNT(*)", Since: 450})
+	require.NoError(t, err)
+	require.Equal(t, []string{"6"}, res.Rows[0].Values)
+
+	// a full page of rows stops the scan where it can go on from
+	res, err = client.Query(ctx, &api.QueryRequest{Query: "SELECT _offset LIMIT 3", FromOffset: 2})
+	require.NoError(t, err)
+	require.Len(t, res.Rows, 3)
+	require.Equal(t, uint64(5), res.NextOffset)
+	require.True(t, res.Truncated)
+
+	_, err = client.Query(ctx, &api.QueryRequest{Query: "SELECT FROM records"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	events := asPrincipal(context.Background(), "events-key")
+	_, err = client.Query(events, &api.QueryRequest{Query: "SELECT COUNT(*)"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestTimestampTypes(t *testing.T) {
+	client, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "stamped", Configs: map[string]string{
+		log.TimestampTypeConfig: log.TimestampLogAppendTime,
+	}})
+	require.NoError(t, err)
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "created", Configs: map[string]string{
+		log.TimestampMaxSkewMsConfig: "60000",
+	}})
+	require.NoError(t, err)
+
+	// the producer's timestamp gives way to the append time
+	before := time.Now()
+	res, err := client.Produce(ctx, &api.ProduceRequest{Topic: "stamped", Record: &api.Record{Timestamp: 100}})
+	require.NoError(t, err)
+	consumed, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "stamped", Offset: res.Offset})
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, consumed.Record.Timestamp, before.UnixNano())
+
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "created", Record: &api.Record{
+		Timestamp: before.Add(time.Hour).UnixNano(),
+	}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.ErrorContains(t, err, "invalid timestamp")
+
+	// producers' timestamps within the skew, out of order, are searched
+	// allowing for it
+	for _, s := range []time.Duration{-10, 20, 10, 30, 25} {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Topic: "created", Record: &api.Record{
+			Value:     []byte(fmt.Sprintf(`{"s": %d}`, s)),
+			Timestamp: before.Add(s * time.Second).UnixNano(),
+		}})
+		require.NoError(t, err)
+	}
+	offs, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{Topic: "created"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(60000), offs.TimestampSkewMs)
+	rows, err := client.Query(ctx, &api.QueryRequest{Topic: "created", Query: "SELECT s", Since: before.Add(15 * time.Second).UnixNano()})
+	require.NoError(t, err)
+	// from the record at 20s, which the one at 10s follows
+	require.Equal(t, uint64(4), rows.Scanned)
+}
@@ -0,0 +1,263 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"google.golang.org/protobuf/proto"
+)
+
+// The principal whose quota is every other principal's, see api.Quota
+const defaultQuotaPrincipal = "*"
+
+// Requests are throttled for this long at most when MaxThrottle is unset
+const defaultMaxThrottle = 5 * time.Second
+
+// Quotas throttles the gRPC and HTTP APIs' callers past their quotas'
+// rates, see api.Quota. Each rate is a bucket of a second's worth, which a
+// request is charged once it's let through: the next is delayed until the
+// bucket's refilled that far, so one large request goes at once but those
+// after it wait. A request that would wait longer than MaxThrottle fails
+// with api.ErrQuotaExceeded instead, but for the records of streams, which
+// wait however long it takes. The quotas are each server's own, a
+// produce forwarded to the leader counting on both.
+type Quotas struct {
+	// MaxThrottle is the longest a request is delayed, 5 seconds when unset
+	MaxThrottle time.Duration
+
+	mu     sync.Mutex
+	quotas map[quotaEntity]*api.Quota
+	// buckets are by the principal or tenant charged, a principal with
+	// the default quota having its own
+	buckets map[quotaBucketKey]*quotaBucket
+}
+
+// A quota's principal or tenant
+type quotaEntity struct {
+	principal, tenant string
+}
+
+type quotaBucketKey struct {
+	entity quotaEntity
+	rate   quotaRate
+}
+
+// A rate of a quota
+type quotaRate int
+
+const (
+	produceBytesRate quotaRate = iota
+	consumeBytesRate
+	requestsRate
+)
+
+func (r quotaRate) String() string {
+	switch r {
+	case produceBytesRate:
+		return "produce_bytes"
+	case consumeBytesRate:
+		return "consume_bytes"
+	}
+	return "requests"
+}
+
+// The quota's limit of the rate, zero for none
+func (r quotaRate) of(q *api.Quota) float64 {
+	switch r {
+	case produceBytesRate:
+		return q.ProduceBytesPerSecond
+	case consumeBytesRate:
+		return q.ConsumeBytesPerSecond
+	}
+	return q.RequestsPerSecond
+}
+
+type quotaBucket struct {
+	// tokens are what's left of a second's worth of the rate, below zero
+	// once requests have been charged more than it had
+	tokens float64
+	rate   float64
+	last   time.Time
+}
+
+// Tops the bucket up for the time since it last was
+func (b *quotaBucket) refill(now time.Time) {
+	b.tokens = min(b.rate, b.tokens+b.rate*now.Sub(b.last).Seconds())
+	b.last = now
+}
+
+// How long until the bucket's no longer overdrawn
+func (b *quotaBucket) wait() time.Duration {
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// NewQuotas returns quotas throttling no one until some are set, see
+// Quotas.Alter
+func NewQuotas() *Quotas {
+	return &Quotas{quotas: make(map[quotaEntity]*api.Quota)}
+}
+
+// Alter sets the quotas of their principals and tenants, removing those
+// with no rates, and returns every quota as Describe does. Requests are
+// charged afresh from then on.
+func (q *Quotas) Alter(quotas []*api.Quota) ([]*api.Quota, error) {
+	for _, quota := range quotas {
+		if err := validateQuota(quota); err != nil {
+			return nil, err
+		}
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, quota := range quotas {
+		entity := quotaEntity{principal: quota.Principal, tenant: quota.Tenant}
+		if quota.ProduceBytesPerSecond == 0 && quota.ConsumeBytesPerSecond == 0 && quota.RequestsPerSecond == 0 {
+			delete(q.quotas, entity)
+		} else {
+			q.quotas[entity] = proto.Clone(quota).(*api.Quota)
+		}
+	}
+	q.buckets = nil
+	return q.describe(), nil
+}
+
+func validateQuota(quota *api.Quota) error {
+	if quota == nil {
+		return errors.New("missing quota")
+	}
+	if (quota.Principal == "") == (quota.Tenant == "") {
+		return errors.New("a quota is for a principal or a tenant")
+	}
+	if strings.Contains(quota.Tenant, "/") {
+		return fmt.Errorf("tenant %q has a slash", quota.Tenant)
+	}
+	if quota.ProduceBytesPerSecond < 0 || quota.ConsumeBytesPerSecond < 0 || quota.RequestsPerSecond < 0 {
+		return errors.New("a quota's rates can't be negative")
+	}
+	return nil
+}
+
+// Describe returns the quotas, sorted by tenant then principal
+func (q *Quotas) Describe() []*api.Quota {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.describe()
+}
+
+func (q *Quotas) describe() []*api.Quota {
+	quotas := make([]*api.Quota, 0, len(q.quotas))
+	for _, quota := range q.quotas {
+		quotas = append(quotas, proto.Clone(quota).(*api.Quota))
+	}
+	slices.SortFunc(quotas, func(a, b *api.Quota) int {
+		return cmp.Or(cmp.Compare(a.Tenant, b.Tenant), cmp.Compare(a.Principal, b.Principal))
+	})
+	return quotas
+}
+
+// Charges the caller in ctx n of the rate, once it has waited out what it
+// was charged before, see Quotas. It waits no longer than MaxThrottle
+// unless reject is unset, or until ctx is done. Nil quotas throttle no one.
+func (q *Quotas) throttle(ctx context.Context, rate quotaRate, n int, reject bool) error {
+	if q == nil {
+		return nil
+	}
+	principal := auth.Principal(ctx)
+	q.mu.Lock()
+	buckets := q.bucketsFor(principal, rate, time.Now())
+	var wait time.Duration
+	for _, b := range buckets {
+		wait = max(wait, b.wait())
+	}
+	maxThrottle := cmp.Or(q.MaxThrottle, defaultMaxThrottle)
+	if reject && wait > maxThrottle {
+		q.mu.Unlock()
+		quotaRejections.WithLabelValues(principal, rate.String()).Inc()
+		return api.ErrQuotaExceeded{Principal: principal, RetryAfter: wait - maxThrottle}
+	}
+	for _, b := range buckets {
+		b.tokens -= float64(n)
+	}
+	q.mu.Unlock()
+	if wait == 0 {
+		return nil
+	}
+	quotaThrottled.WithLabelValues(principal, rate.String()).Inc()
+	quotaThrottleSeconds.WithLabelValues(rate.String()).Observe(wait.Seconds())
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// The buckets of the principal's quota and its tenant's for the rate,
+// refilled, callers must hold mu
+func (q *Quotas) bucketsFor(principal string, rate quotaRate, now time.Time) []*quotaBucket {
+	var buckets []*quotaBucket
+	add := func(entity quotaEntity, quota *api.Quota) {
+		if quota == nil || rate.of(quota) == 0 {
+			return
+		}
+		if q.buckets == nil {
+			q.buckets = make(map[quotaBucketKey]*quotaBucket)
+		}
+		key := quotaBucketKey{entity: entity, rate: rate}
+		b, ok := q.buckets[key]
+		if !ok {
+			b = &quotaBucket{tokens: rate.of(quota), rate: rate.of(quota), last: now}
+			q.buckets[key] = b
+		}
+		b.refill(now)
+		buckets = append(buckets, b)
+	}
+	entity := quotaEntity{principal: principal}
+	quota, ok := q.quotas[entity]
+	if !ok {
+		quota = q.quotas[quotaEntity{principal: defaultQuotaPrincipal}]
+	}
+	add(entity, quota)
+	if tenant, _, ok := strings.Cut(principal, "/"); ok {
+		entity := quotaEntity{tenant: tenant}
+		add(entity, q.quotas[entity])
+	}
+	return buckets
+}
+
+// Charges the caller in ctx a produce of the records, as throttle does
+func (q *Quotas) produce(ctx context.Context, records []*api.Record, reject bool) error {
+	if q == nil {
+		return nil
+	}
+	return q.throttle(ctx, produceBytesRate, recordsSize(records), reject)
+}
+
+// Charges the caller in ctx a consume of the records, as throttle does
+func (q *Quotas) consume(ctx context.Context, records []*api.Record, reject bool) error {
+	if q == nil {
+		return nil
+	}
+	return q.throttle(ctx, consumeBytesRate, recordsSize(records), reject)
+}
+
+// The records' size marshaled
+func recordsSize(records []*api.Record) int {
+	n := 0
+	for _, record := range records {
+		n += proto.Size(record)
+	}
+	return n
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestQuotas(t *testing.T) {
+	q := NewQuotas()
+	q.MaxThrottle = 100 * time.Millisecond
+	quotas, err := q.Alter([]*api.Quota{
+		{Principal: defaultQuotaPrincipal, RequestsPerSecond: 10},
+		{Tenant: "acme", ProduceBytesPerSecond: 100},
+	})
+	require.NoError(t, err)
+	require.Len(t, quotas, 2)
+	ctx := auth.WithPrincipal(context.Background(), "acme/ingest")
+
+	// a second's worth goes at once, the request that overdraws it too, but
+	// the one after waits
+	for range 11 {
+		require.NoError(t, q.throttle(ctx, requestsRate, 1, true))
+	}
+	start := time.Now()
+	require.NoError(t, q.throttle(ctx, requestsRate, 1, true))
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// too far past the quota to throttle for is rejected, but for streams
+	require.NoError(t, q.throttle(ctx, produceBytesRate, 150, true))
+	err = q.throttle(ctx, produceBytesRate, 1, true)
+	var exceeded api.ErrQuotaExceeded
+	require.ErrorAs(t, err, &exceeded)
+	require.Equal(t, "acme/ingest", exceeded.Principal)
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	start = time.Now()
+	require.NoError(t, q.throttle(ctx, produceBytesRate, 1, false))
+	require.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+
+	// a principal of its own quota, or outside the tenant, isn't charged
+	// the tenant's
+	require.NoError(t, q.throttle(auth.WithPrincipal(context.Background(), "other"), produceBytesRate, 1000, true))
+	require.NoError(t, q.throttle(auth.WithPrincipal(context.Background(), "other"), produceBytesRate, 1000, true))
+
+	// removing a quota lifts its limits
+	quotas, err = q.Alter([]*api.Quota{{Tenant: "acme"}})
+	require.NoError(t, err)
+	require.Equal(t, []string{defaultQuotaPrincipal}, []string{quotas[0].Principal})
+	require.NoError(t, q.throttle(ctx, produceBytesRate, 1000, true))
+
+	_, err = q.Alter([]*api.Quota{{Principal: "a", Tenant: "b", RequestsPerSecond: 1}})
+	require.Error(t, err)
+	_, err = q.Alter([]*api.Quota{{Principal: "a", RequestsPerSecond: -1}})
+	require.Error(t, err)
+}
+
+func TestQuotasAPI(t *testing.T) {
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Quotas = NewQuotas()
+		c.Quotas.MaxThrottle = time.Millisecond
+	})
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	res, err := client.AlterQuotas(ctx, &api.AlterQuotasRequest{Quotas: []*api.Quota{
+		{Principal: "events", ProduceBytesPerSecond: 10},
+	}})
+	require.NoError(t, err)
+	require.Len(t, res.Quotas, 1)
+	_, err = client.AlterQuotas(asPrincipal(context.Background(), "events-key"), &api.AlterQuotasRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	events := asPrincipal(context.Background(), "events-key")
+	produce := func() error {
+		_, err := client.Produce(events, &api.ProduceRequest{
+			Topic:  "events",
+			Record: &api.Record{Value: []byte("a record past ten bytes")},
+		})
+		return err
+	}
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "events"})
+	require.NoError(t, err)
+	require.NoError(t, produce())
+	require.Equal(t, codes.ResourceExhausted, status.Code(produce()))
+
+	desc, err := client.DescribeQuotas(ctx, &api.DescribeQuotasRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "events", desc.Quotas[0].Principal)
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"errors"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// reencryptLog is implemented by commit logs that re-encrypt their sealed
+// segments under their keyring's current key, see log.Topics.Reencrypt
+type reencryptLog interface {
+	Reencrypt() (int, error)
+}
+
+// Re-encrypts the commit log's sealed segments and returns how many were
+// rewritten
+func (c *Config) reencrypt() (int, error) {
+	rl, ok := c.CommitLog.(reencryptLog)
+	if !ok {
+		return 0, status.Error(codes.Unimplemented, "log can't be re-encrypted")
+	}
+	n, err := rl.Reencrypt()
+	if errors.Is(err, log.ErrNotEncrypted) {
+		return n, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return n, err
+}
+
+func (s *grpcServer) Reencrypt(ctx context.Context, req *api.ReencryptRequest) (*api.ReencryptResponse, error) {
+	if err := s.authorize(ctx, adminAction, objectWildcard); err != nil {
+		return nil, err
+	}
+	n, err := s.reencrypt()
+	if err != nil {
+		s.logger(ctx).Error("re-encrypt failed", zap.Int("segments", n), zap.Error(err))
+		return nil, err
+	}
+	s.logger(ctx).Info("re-encrypted logs", zap.Int("segments", n))
+	return &api.ReencryptResponse{Segments: uint32(n)}, nil
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// IngestTopic is the virtual topic of records routed by the Routes'
+// rules. Syslog servers and OTLP exports set to it route their records as
+// Ingest does. No real topic has its name.
+const IngestTopic = "@ingest"
+
+// Routing rules that cost more than this to evaluate over a record fail
+const routeCostLimit = 100_000
+
+// RouteRule routes the records it matches. Its expressions are CEL's, over
+// the record's key and value, as bytes, its headers, as a map of strings,
+// the last of a name winning, and its timestamp, the time it's routed
+// when unset.
+type RouteRule struct {
+	Name string `json:"name"`
+	// If matches the records the rule routes, all of them when empty. It's
+	// a bool, and records it fails on, as on a header they don't have,
+	// don't match.
+	If string `json:"if,omitempty"`
+	// Topic is the topic the records go to, a string: quote a topic's name,
+	// as in "'logs'", or build it, as in "'logs.' + headers.app".
+	Topic string `json:"topic"`
+	// Key, a string or bytes, is hashed to the record's partition as a
+	// record's key is, the record's key when empty. The record's key isn't
+	// changed.
+	Key string `json:"key,omitempty"`
+}
+
+// RoutesConfig is the routing rules, tried in order until one matches
+type RoutesConfig struct {
+	Rules []RouteRule `json:"rules"`
+}
+
+// Routes pick the topics and partitions of records ingested. Safe for
+// concurrent use, its rules may be reloaded while records are routed.
+type Routes struct {
+	mu    sync.RWMutex
+	rules []routeRule
+}
+
+// A rule's compiled expressions, match nil when it matches all records and
+// key nil when their keys are used
+type routeRule struct {
+	name              string
+	match, topic, key cel.Program
+}
+
+// NewRoutes compiles the rules
+func NewRoutes(config RoutesConfig) (*Routes, error) {
+	rules, err := compileRoutes(config)
+	if err != nil {
+		return nil, err
+	}
+	return &Routes{rules: rules}, nil
+}
+
+// LoadRoutes reads the routing rules from the JSON file at path
+func LoadRoutes(path string) (*Routes, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config RoutesConfig
+	if err := json.Unmarshal(b, &config); err != nil {
+		return nil, fmt.Errorf("routes %s: %w", path, err)
+	}
+	routes, err := NewRoutes(config)
+	if err != nil {
+		return nil, fmt.Errorf("routes %s: %w", path, err)
+	}
+	return routes, nil
+}
+
+// Reload replaces the rules with the file's, keeping them if it can't be
+// read or its rules don't compile
+func (r *Routes) Reload(path string) error {
+	routes, err := LoadRoutes(path)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = routes.rules
+	return nil
+}
+
+func compileRoutes(config RoutesConfig) ([]routeRule, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("key", cel.BytesType),
+		cel.Variable("value", cel.BytesType),
+		cel.Variable("headers", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("timestamp", cel.TimestampType),
+		ext.Strings(),
+		ext.Encoders(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	compile := func(expr string, types ...*cel.Type) (cel.Program, error) {
+		ast, iss := env.Compile(expr)
+		if iss.Err() != nil {
+			return nil, iss.Err()
+		}
+		ok := false
+		for _, t := range types {
+			ok = ok || ast.OutputType().IsExactType(t)
+		}
+		if !ok {
+			return nil, fmt.Errorf("%q is a %s", expr, ast.OutputType())
+		}
+		return env.Program(ast, cel.CostLimit(routeCostLimit))
+	}
+	names := make(map[string]bool)
+	rules := make([]routeRule, 0, len(config.Rules))
+	for i, rule := range config.Rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("rule %d: no name", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("rule %s: named twice", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Topic == "" {
+			return nil, fmt.Errorf("rule %s: no topic", rule.Name)
+		}
+		r := routeRule{name: rule.Name}
+		if rule.If != "" {
+			if r.match, err = compile(rule.If, cel.BoolType); err != nil {
+				return nil, fmt.Errorf("rule %s: if: %w", rule.Name, err)
+			}
+		}
+		if r.topic, err = compile(rule.Topic, cel.StringType); err != nil {
+			return nil, fmt.Errorf("rule %s: topic: %w", rule.Name, err)
+		}
+		if rule.Key != "" {
+			if r.key, err = compile(rule.Key, cel.StringType, cel.BytesType); err != nil {
+				return nil, fmt.Errorf("rule %s: key: %w", rule.Name, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Route is where a rule routes a record: the topic and the key its
+// partition is hashed from
+type Route struct {
+	Rule  string
+	Topic string
+	Key   []byte
+}
+
+// Route routes the record by the first rule matching it, failing with
+// InvalidArgument when none does
+func (r *Routes) Route(record *api.Record) (Route, error) {
+	r.mu.RLock()
+	rules := r.rules
+	r.mu.RUnlock()
+	headers := make(map[string]string, len(record.Headers))
+	for _, h := range record.Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	ts := time.Now()
+	if record.Timestamp != 0 {
+		ts = time.Unix(0, record.Timestamp)
+	}
+	vars := map[string]any{
+		"key":       record.Key,
+		"value":     record.Value,
+		"headers":   headers,
+		"timestamp": ts,
+	}
+	for _, rule := range rules {
+		if rule.match != nil {
+			out, _, err := rule.match.Eval(vars)
+			if err != nil || out.Value() != true {
+				continue
+			}
+		}
+		out, _, err := rule.topic.Eval(vars)
+		if err != nil {
+			return Route{}, status.Errorf(codes.InvalidArgument, "route %s: topic: %v", rule.name, err)
+		}
+		topic, _ := out.Value().(string)
+		if err := log.ValidateTopic(topic); err != nil {
+			return Route{}, status.Errorf(codes.InvalidArgument, "route %s: %v", rule.name, err)
+		}
+		key := record.Key
+		if rule.key != nil {
+			out, _, err := rule.key.Eval(vars)
+			if err != nil {
+				return Route{}, status.Errorf(codes.InvalidArgument, "route %s: key: %v", rule.name, err)
+			}
+			switch v := out.Value().(type) {
+			case string:
+				key = []byte(v)
+			case []byte:
+				key = v
+			}
+		}
+		return Route{Rule: rule.name, Topic: topic, Key: key}, nil
+	}
+	return Route{}, status.Error(codes.InvalidArgument, "no route matches the record")
+}
+
+// Routes the records, failing when Routes isn't set or any doesn't route
+func (c *Config) route(records []*api.Record) ([]Route, error) {
+	if c.Routes == nil {
+		return nil, status.Error(codes.Unimplemented, "no routing rules")
+	}
+	routes := make([]Route, len(records))
+	for i, record := range records {
+		var err error
+		if routes[i], err = c.Routes.Route(record); err != nil {
+			routedRecords.WithLabelValues("unmatched").Inc()
+			return nil, err
+		}
+		routedRecords.WithLabelValues(routes[i].Rule).Inc()
+	}
+	return routes, nil
+}
+
+// Appends the routed records to their topics' partitions, the records of
+// each in a batch, in the order they come. Records of batches before one
+// failing stay appended.
+func (c *Config) ingest(ctx context.Context, records []*api.Record, routes []Route, ack api.Ack, header http.Header) (*api.IngestResponse, error) {
+	type partition struct {
+		topic string
+		p     uint32
+	}
+	res := &api.IngestResponse{Results: make([]*api.IngestResult, len(records))}
+	var order []partition
+	batches := make(map[partition][]int)
+	partitions := make(map[string]uint32)
+	for i, route := range routes {
+		n, ok := partitions[route.Topic]
+		if !ok {
+			n = 1
+			if desc, err := c.describeTopic(route.Topic); err == nil {
+				n = desc.Partitions
+			}
+			partitions[route.Topic] = n
+		}
+		p := partition{route.Topic, partitionForKey(route.Key, n)}
+		if _, ok := batches[p]; !ok {
+			order = append(order, p)
+		}
+		batches[p] = append(batches[p], i)
+		res.Results[i] = &api.IngestResult{Topic: p.topic, Partition: p.p, Route: route.Rule}
+	}
+	for _, p := range order {
+		batch := make([]*api.Record, len(batches[p]))
+		for j, i := range batches[p] {
+			batch[j] = records[i]
+		}
+		offs, pending, err := c.appendBatch(ctx, batch, ack, p.topic, p.p, header)
+		if err != nil {
+			return nil, err
+		}
+		res.Pending = res.Pending || pending
+		for j, i := range batches[p] {
+			if j >= len(offs) {
+				continue
+			}
+			if offs[j] == droppedOffset {
+				res.Results[i].Dropped = true
+			} else {
+				res.Results[i].Offset = offs[j]
+			}
+		}
+	}
+	return res, nil
+}
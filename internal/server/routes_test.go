@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRoutes(t *testing.T) {
+	for _, rule := range []RouteRule{
+		{Topic: "'logs'"},
+		{Name: "syntax", Topic: "'logs"},
+		{Name: "if", If: "headers.app", Topic: "'logs'"},
+		{Name: "topic", Topic: "value"},
+		{Name: "key", Topic: "'logs'", Key: "timestamp"},
+	} {
+		_, err := NewRoutes(RoutesConfig{Rules: []RouteRule{rule}})
+		require.Error(t, err, rule.Name)
+	}
+
+	routes, err := NewRoutes(RoutesConfig{Rules: []RouteRule{
+		{Name: "errors", If: "headers.severity == 'err'", Topic: "'errors'"},
+		{Name: "apps", If: "'app' in headers", Topic: "'apps.' + headers.app", Key: "headers.host"},
+	}})
+	require.NoError(t, err)
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Routes = routes
+	})
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	for name, partitions := range map[string]uint32{"errors": 1, "apps.web": 4} {
+		_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: name, Partitions: partitions})
+		require.NoError(t, err)
+	}
+
+	// each record goes to its rule's topic, in the partition its key
+	// hashes to
+	res, err := client.Ingest(ctx, &api.IngestRequest{Records: []*api.Record{
+		{Value: []byte("disk full"), Headers: []*api.Header{{Key: "severity", Value: []byte("err")}}},
+		{Value: []byte("GET /"), Headers: []*api.Header{{Key: "app", Value: []byte("web")}, {Key: "host", Value: []byte("web-1")}}},
+		{Value: []byte("GET /about"), Headers: []*api.Header{{Key: "app", Value: []byte("web")}, {Key: "host", Value: []byte("web-1")}}},
+	}})
+	require.NoError(t, err)
+	require.Len(t, res.Results, 3)
+	require.Equal(t, "errors", res.Results[0].Topic)
+	require.Equal(t, "errors", res.Results[0].Route)
+	p := partitionForKey([]byte("web-1"), 4)
+	for i, value := range []string{"GET /", "GET /about"} {
+		result := res.Results[i+1]
+		require.Equal(t, "apps.web", result.Topic)
+		require.Equal(t, "apps", result.Route)
+		require.Equal(t, p, result.Partition)
+		require.Equal(t, uint64(i), result.Offset)
+		consumed, err := client.Consume(ctx, &api.ConsumeRequest{Topic: result.Topic, Partition: result.Partition, Offset: result.Offset})
+		require.NoError(t, err)
+		require.Equal(t, []byte(value), consumed.Record.Value)
+	}
+
+	// records no rule matches, or routed to topics the caller can't produce
+	// to, fail the ingest
+	_, err = client.Ingest(ctx, &api.IngestRequest{Records: []*api.Record{{Value: []byte("hello")}}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	events := asPrincipal(context.Background(), "events-key")
+	_, err = client.Ingest(events, &api.IngestRequest{Records: []*api.Record{
+		{Value: []byte("oops"), Headers: []*api.Header{{Key: "severity", Value: []byte("err")}}},
+	}})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// reloading replaces the rules, unless the file's don't compile
+	path := filepath.Join(t.TempDir(), "routes.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"rules": [{"name": "all", "topic": "'errors'"}]}`), 0644))
+	require.NoError(t, routes.Reload(path))
+	res, err = client.Ingest(ctx, &api.IngestRequest{Records: []*api.Record{{Value: []byte("hello")}}})
+	require.NoError(t, err)
+	require.Equal(t, "all", res.Results[0].Route)
+	require.NoError(t, os.WriteFile(path, []byte(`{"rules": [{"name": "all", "topic": "1"}]}`), 0644))
+	require.Error(t, routes.Reload(path))
+	_, err = client.Ingest(ctx, &api.IngestRequest{Records: []*api.Record{{Value: []byte("hello")}}})
+	require.NoError(t, err)
+}
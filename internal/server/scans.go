@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"google.golang.org/grpc/peer"
+)
+
+// Connections' buckets are dropped once they've gone this long without a read
+const scanConnIdle = time.Minute
+
+// ScanThrottle caps how fast consumers read partitions' history, so a
+// consumer replaying from the start doesn't saturate the disk and starve
+// appends and the consumers at the tail: backfills, see api.Priority, are
+// charged to a bucket of every consumer's reads and to their connection's,
+// and the read after waits while either is overdrawn, as Quotas' do. Reads
+// of the active segment, which the latest appends are likely still cached
+// from, aren't charged unless their callers ask to be backfills, nor are
+// reads of commit logs that don't tell those reads apart.
+type ScanThrottle struct {
+	mu     sync.Mutex
+	global *quotaBucket
+	// connRate is each connection's, zero for no limit
+	connRate  float64
+	conns     map[string]*scanConn
+	lastSweep time.Time
+}
+
+type scanConn struct {
+	bucket   *quotaBucket
+	lastRead time.Time
+}
+
+// NewScanThrottle returns a throttle of historical reads to bytesPerSecond
+// across every connection and connBytesPerSecond for each, zero for either
+// not limiting them
+func NewScanThrottle(bytesPerSecond, connBytesPerSecond float64) *ScanThrottle {
+	t := &ScanThrottle{connRate: connBytesPerSecond, conns: make(map[string]*scanConn)}
+	if bytesPerSecond > 0 {
+		t.global = &quotaBucket{tokens: bytesPerSecond, rate: bytesPerSecond, last: time.Now()}
+	}
+	return t
+}
+
+type scanConnKey struct{}
+
+// Returns ctx naming the connection its reads are charged to, for servers
+// other than gRPC, whose connections are told apart by their peers'
+// addresses
+func withScanConn(ctx context.Context, conn string) context.Context {
+	return context.WithValue(ctx, scanConnKey{}, conn)
+}
+
+// The connection the reads of ctx are charged to, empty if it's unknown
+func scanConnOf(ctx context.Context) string {
+	if conn, ok := ctx.Value(scanConnKey{}).(string); ok {
+		return conn
+	}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return "grpc " + p.Addr.String()
+	}
+	return ""
+}
+
+// Charges a read of the class of n bytes to the connection of ctx once
+// that's waited out what it was charged before, if it's a backfill, see
+// ScanThrottle. A wait cut short by ctx ends early, leaving the charge for
+// the next read. Nil throttles no reads.
+func (t *ScanThrottle) read(ctx context.Context, class api.Priority, n int) {
+	if t == nil || class != api.Priority_PRIORITY_BACKFILL {
+		return
+	}
+	now := time.Now()
+	t.mu.Lock()
+	var wait time.Duration
+	charge := func(b *quotaBucket) {
+		b.refill(now)
+		wait = max(wait, b.wait())
+		b.tokens -= float64(n)
+	}
+	if t.global != nil {
+		charge(t.global)
+	}
+	if conn := scanConnOf(ctx); conn != "" && t.connRate > 0 {
+		c, ok := t.conns[conn]
+		if !ok {
+			c = &scanConn{bucket: &quotaBucket{tokens: t.connRate, rate: t.connRate, last: now}}
+			t.conns[conn] = c
+		}
+		c.lastRead = now
+		charge(c.bucket)
+	}
+	t.sweep(now)
+	t.mu.Unlock()
+	scanBytes.Add(float64(n))
+	if wait == 0 {
+		return
+	}
+	scanThrottleSeconds.Observe(wait.Seconds())
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// Drops the buckets of connections that have gone idle, at most once per
+// idle period, callers must hold mu
+func (t *ScanThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < scanConnIdle {
+		return
+	}
+	t.lastSweep = now
+	for conn, c := range t.conns {
+		if now.Sub(c.lastRead) >= scanConnIdle {
+			delete(t.conns, conn)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScanThrottle(t *testing.T) {
+	c := log.Config{}
+	// two records a segment
+	c.Segment.MaxIndexBytes = 12 * 2
+	clog, err := log.NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer clog.Close()
+	for range 5 {
+		_, err := clog.Append(&api.Record{Value: make([]byte, 100)})
+		require.NoError(t, err)
+	}
+	require.False(t, clog.Tail(0))
+	require.True(t, clog.Tail(4))
+	history := readPriority(context.Background(), clog, 0)
+	require.Equal(t, api.Priority_PRIORITY_BACKFILL, history)
+	tail := readPriority(context.Background(), clog, 4)
+	require.Equal(t, api.Priority_PRIORITY_CONSUME, tail)
+
+	timed := func(f func()) time.Duration {
+		start := time.Now()
+		f()
+		return time.Since(start)
+	}
+	throttle := NewScanThrottle(0, 1000)
+	a := withScanConn(context.Background(), "a")
+	// a second's worth of history goes at once, the read that overdraws it
+	// too, but the one after waits
+	require.Less(t, timed(func() {
+		for range 11 {
+			throttle.read(a, history, 100)
+		}
+	}), 50*time.Millisecond)
+	require.GreaterOrEqual(t, timed(func() { throttle.read(a, history, 100) }), 50*time.Millisecond)
+
+	// the tail isn't throttled, nor other connections by this one's reads
+	require.Less(t, timed(func() { throttle.read(a, tail, 1000) }), 50*time.Millisecond)
+	b := withScanConn(context.Background(), "b")
+	require.Less(t, timed(func() { throttle.read(b, history, 100) }), 50*time.Millisecond)
+
+	// every connection shares the global rate
+	throttle = NewScanThrottle(100, 0)
+	throttle.read(a, history, 200)
+	require.GreaterOrEqual(t, timed(func() { throttle.read(b, history, 100) }), 500*time.Millisecond)
+
+	// a wait is cut short by its context
+	ctx, cancel := context.WithTimeout(b, 10*time.Millisecond)
+	defer cancel()
+	require.Less(t, timed(func() { throttle.read(ctx, history, 100) }), 500*time.Millisecond)
+	var none *ScanThrottle
+	none.read(a, history, 100)
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"google.golang.org/grpc/metadata"
+)
+
+// Scheduler bounds the requests accessing the store at once, appending or
+// reading records, and hands the slots freed up to those waiting by their
+// class, see api.Priority: every replication waiting goes before any
+// produce, every produce before any consume, and every consume of the
+// tail before any backfill, each class in the order it arrived. Backfills
+// so wait out produces rather than delaying them, and their bandwidth is
+// ScanThrottle's too. The raft layer's replication doesn't go through it.
+type Scheduler struct {
+	slots int
+
+	mu    sync.Mutex
+	inUse int
+	// waiting are the requests waiting for a slot by class, each handed
+	// one by closing its channel
+	waiting [api.Priority_PRIORITY_BACKFILL + 1][]chan struct{}
+}
+
+// NewScheduler returns a scheduler letting slots requests access the store
+// at once
+func NewScheduler(slots int) *Scheduler {
+	return &Scheduler{slots: max(slots, 1)}
+}
+
+// Waits for a slot for a request of the class, in turn, returning the
+// func releasing it, or ctx's error if it's done first. Nil schedulers let
+// every request through at once.
+func (s *Scheduler) acquire(ctx context.Context, class api.Priority) (release func(), err error) {
+	if s == nil {
+		return func() {}, nil
+	}
+	s.mu.Lock()
+	if s.inUse < s.slots {
+		s.inUse++
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	granted := make(chan struct{})
+	s.waiting[class] = append(s.waiting[class], granted)
+	s.mu.Unlock()
+	start := time.Now()
+	defer func() {
+		schedulerWaitSeconds.WithLabelValues(class.HeaderValue()).Observe(time.Since(start).Seconds())
+	}()
+	select {
+	case <-granted:
+		return s.release, nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-granted:
+		// handed one meanwhile, it's handed on
+		s.handOff()
+	default:
+		waiting := s.waiting[class]
+		for i, c := range waiting {
+			if c == granted {
+				s.waiting[class] = append(waiting[:i:i], waiting[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil, ctx.Err()
+}
+
+func (s *Scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handOff()
+}
+
+// Hands a slot given up to the first request waiting of the earliest
+// class, or frees it, callers must hold mu
+func (s *Scheduler) handOff() {
+	for class, waiting := range s.waiting {
+		if len(waiting) > 0 {
+			close(waiting[0])
+			s.waiting[class] = waiting[1:]
+			return
+		}
+	}
+	s.inUse--
+}
+
+type priorityKey struct{}
+
+// Puts the priority the request's PriorityHeader asks for in its context,
+// for the HTTP server, which gRPC reads from the call's metadata
+func prioritize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p := api.ParsePriority(r.Header.Get(api.PriorityHeader)); p != api.Priority_PRIORITY_UNSPECIFIED {
+			r = r.WithContext(context.WithValue(r.Context(), priorityKey{}, p))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The class of an operation of the class for the caller in ctx: the
+// caller's if it asked for a later one, see api.Priority
+func priority(ctx context.Context, class api.Priority) api.Priority {
+	asked, ok := ctx.Value(priorityKey{}).(api.Priority)
+	if !ok {
+		if v := metadata.ValueFromIncomingContext(ctx, api.PriorityHeader); len(v) > 0 {
+			asked = api.ParsePriority(v[0])
+		}
+	}
+	return max(asked, class)
+}
+
+// The class of a produce for the caller in ctx, the replication of one a
+// follower forwards, see forwarder.outgoing
+func producePriority(ctx context.Context) api.Priority {
+	if len(metadata.ValueFromIncomingContext(ctx, forwardedHeader)) > 0 {
+		return priority(ctx, api.Priority_PRIORITY_REPLICATION)
+	}
+	return priority(ctx, api.Priority_PRIORITY_PRODUCE)
+}
+
+// The class of a read of the record at off from cl: a backfill unless the
+// log holds it in its active segment, or tells no reads apart
+func readPriority(ctx context.Context, cl CommitLog, off uint64) api.Priority {
+	if tl, ok := cl.(tailLog); ok && !tl.Tail(off) {
+		return priority(ctx, api.Priority_PRIORITY_BACKFILL)
+	}
+	return priority(ctx, api.Priority_PRIORITY_CONSUME)
+}
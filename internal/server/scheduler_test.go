@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestScheduler(t *testing.T) {
+	s := NewScheduler(1)
+	ctx := context.Background()
+	release, err := s.acquire(ctx, api.Priority_PRIORITY_CONSUME)
+	require.NoError(t, err)
+
+	// those waiting are served by class, then in the order they came
+	order := make(chan api.Priority, 3)
+	wait := func(class api.Priority) {
+		release, err := s.acquire(ctx, class)
+		require.NoError(t, err)
+		order <- class
+		release()
+	}
+	for _, class := range []api.Priority{
+		api.Priority_PRIORITY_BACKFILL,
+		api.Priority_PRIORITY_PRODUCE,
+		api.Priority_PRIORITY_REPLICATION,
+	} {
+		go wait(class)
+		require.Eventually(t, func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return len(s.waiting[class]) == 1
+		}, time.Second, time.Millisecond)
+	}
+
+	// a request done waiting gives up its place
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = s.acquire(canceled, api.Priority_PRIORITY_REPLICATION)
+	require.ErrorIs(t, err, context.Canceled)
+
+	release()
+	var got []api.Priority
+	for range 3 {
+		got = append(got, <-order)
+	}
+	require.Equal(t, []api.Priority{
+		api.Priority_PRIORITY_REPLICATION,
+		api.Priority_PRIORITY_PRODUCE,
+		api.Priority_PRIORITY_BACKFILL,
+	}, got)
+	require.Eventually(t, func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.inUse == 0
+	}, time.Second, time.Millisecond)
+}
+
+func TestPriority(t *testing.T) {
+	asking := func(p api.Priority) context.Context {
+		md := metadata.Pairs(api.PriorityHeader, p.HeaderValue())
+		return metadata.NewIncomingContext(context.Background(), md)
+	}
+	// a request can lower its class, not raise it
+	require.Equal(t, api.Priority_PRIORITY_BACKFILL, priority(asking(api.Priority_PRIORITY_BACKFILL), api.Priority_PRIORITY_CONSUME))
+	require.Equal(t, api.Priority_PRIORITY_CONSUME, priority(asking(api.Priority_PRIORITY_REPLICATION), api.Priority_PRIORITY_CONSUME))
+	require.Equal(t, api.Priority_PRIORITY_PRODUCE, producePriority(context.Background()))
+	forwarded := metadata.NewIncomingContext(context.Background(), metadata.Pairs(forwardedHeader, "true"))
+	require.Equal(t, api.Priority_PRIORITY_REPLICATION, producePriority(forwarded))
+	require.Equal(t, api.Priority_PRIORITY_UNSPECIFIED, api.ParsePriority("urgent"))
+}
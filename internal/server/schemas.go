@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"github.com/frankie-mur/proglog/internal/schema"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// schemas are the topics' schemas, read from the schemas topic's partition
+// as far as this server has it. Each record holds a version of a topic's
+// schema keyed "<topic>/<version>", so compaction keeps every version.
+// Deleting a topic leaves its schemas, for a topic created by its name.
+type schemas struct {
+	mu sync.Mutex
+	// the partition the schemas were read from, they're read again if the
+	// topic's recreated
+	partition CommitLog
+	next      uint64
+	byTopic   map[string][]*topicSchema
+	// register serializes registrations, so no two take a version
+	register sync.Mutex
+}
+
+// topicSchema is a version of a topic's schema, compiled
+type topicSchema struct {
+	*api.Schema
+	compiled *schema.Schema
+}
+
+// Reads the schemas appended to cl since the last read
+func (s *schemas) catchUp(cl CommitLog) error {
+	if cl != s.partition {
+		s.partition, s.next, s.byTopic = cl, 0, make(map[string][]*topicSchema)
+	}
+	if cl == nil {
+		return nil
+	}
+	for {
+		record, next, err := readFrom(cl, s.next)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.next = next
+		var sch api.Schema
+		if codec.Decompress(record) == nil && proto.Unmarshal(record.Value, &sch) == nil {
+			if compiled, err := schema.Compile(&sch); err == nil {
+				versions := s.byTopic[sch.Topic]
+				i, found := slices.BinarySearchFunc(versions, sch.Version, func(ts *topicSchema, v uint32) int {
+					return cmp.Compare(ts.Version, v)
+				})
+				if !found {
+					s.byTopic[sch.Topic] = slices.Insert(versions, i, &topicSchema{Schema: &sch, compiled: compiled})
+				}
+			}
+		}
+	}
+}
+
+// The topic's schemas in version order, as far as this server has read
+// them
+func (c *Config) topicSchemas(topic string) ([]*topicSchema, error) {
+	cl, err := c.schemasPartition(false)
+	if errors.As(err, &api.ErrTopicNotFound{}) {
+		cl, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.schemas.mu.Lock()
+	defer c.schemas.mu.Unlock()
+	if err := c.schemas.catchUp(cl); err != nil {
+		return nil, err
+	}
+	return slices.Clone(c.schemas.byTopic[topic]), nil
+}
+
+// The version of the topic's schema, its latest for zero
+func (c *Config) schema(topic string, version uint32) (*topicSchema, error) {
+	versions, err := c.topicSchemas(topic)
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, api.ErrSchemaNotFound{Topic: topic}
+	}
+	if version == 0 {
+		return versions[len(versions)-1], nil
+	}
+	for _, ts := range versions {
+		if ts.Version == version {
+			return ts, nil
+		}
+	}
+	return nil, api.ErrSchemaNotFound{Topic: topic, Version: version}
+}
+
+// Adds the schema as the next version of its topic's, once it's compatible
+// with the latest as the topic asks, returning its version. The same
+// schema as the latest isn't added again, its version's returned.
+func (c *Config) registerSchema(ctx context.Context, sch *api.Schema) (uint32, error) {
+	sch.Topic = topicResource(sch.Topic)
+	compiled, err := schema.Compile(sch)
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := c.describeTopic(sch.Topic); err != nil {
+		return 0, err
+	}
+	tc, err := c.topicConfig(sch.Topic)
+	if err != nil {
+		return 0, err
+	}
+	// only the leader appends, so the versions are taken in turn
+	cl, err := c.schemasPartition(true)
+	if err != nil {
+		return 0, err
+	}
+	if err := notLeading(cl); err != nil {
+		return 0, err
+	}
+	c.schemas.register.Lock()
+	defer c.schemas.register.Unlock()
+	latest, err := c.schema(sch.Topic, 0)
+	if err != nil && !errors.As(err, &api.ErrSchemaNotFound{}) {
+		return 0, err
+	}
+	sch.Version = 1
+	if latest != nil {
+		if latest.Type == sch.Type && latest.Message == sch.Message && bytes.Equal(latest.Definition, sch.Definition) {
+			return latest.Version, nil
+		}
+		if err := checkCompatibility(tc.SchemaCompatibility, compiled, latest.compiled); err != nil {
+			return 0, api.ErrIncompatibleSchema{Topic: sch.Topic, Version: latest.Version, Reason: err.Error()}
+		}
+		sch.Version = latest.Version + 1
+	}
+	value, err := proto.Marshal(sch)
+	if err != nil {
+		return 0, err
+	}
+	key := sch.Topic + "/" + strconv.FormatUint(uint64(sch.Version), 10)
+	if _, _, err := c.appendTo(ctx, cl, &api.Record{Key: []byte(key), Value: value}, api.Ack_ACK_ALL, log.SchemasTopic, 0); err != nil {
+		return 0, err
+	}
+	return sch.Version, nil
+}
+
+// Checks a new schema against the latest at the compatibility level
+func checkCompatibility(level string, next, latest *schema.Schema) error {
+	switch level {
+	case log.CompatibilityNone:
+		return nil
+	case log.CompatibilityForward:
+		return schema.Compatible(latest, next)
+	case log.CompatibilityFull:
+		if err := schema.Compatible(next, latest); err != nil {
+			return err
+		}
+		return schema.Compatible(latest, next)
+	}
+	return schema.Compatible(next, latest)
+}
+
+// Checks the records' values match the topic's latest schema, failing with
+// api.ErrSchemaViolation for the first that doesn't
+func (c *Config) validateRecords(topic string, records ...*api.Record) error {
+	latest, err := c.schema(topic, 0)
+	if errors.As(err, &api.ErrSchemaNotFound{}) {
+		return api.ErrSchemaViolation{Topic: topic, Reason: "the topic has no schema"}
+	}
+	if err != nil {
+		return err
+	}
+	for i, record := range records {
+		if log.Tombstone(record) {
+			// it has no value to validate
+			continue
+		}
+		if record.Codec != api.Codec_CODEC_NONE {
+			record = proto.Clone(record).(*api.Record)
+			if err := codec.Decompress(record); err != nil {
+				return status.Error(codes.InvalidArgument, err.Error())
+			}
+		}
+		if err := latest.compiled.Validate(record.Value); err != nil {
+			reason := err.Error()
+			if len(records) > 1 {
+				reason = fmt.Sprintf("record %d: %s", i, reason)
+			}
+			schemaViolations.Inc()
+			return api.ErrSchemaViolation{Topic: topic, Version: latest.Version, Reason: reason}
+		}
+	}
+	return nil
+}
+
+// The schemas topic's partition, created first with create if there's
+// none. It's kept as the offsets topic is.
+func (c *Config) schemasPartition(create bool) (CommitLog, error) {
+	tl, ok := c.CommitLog.(topicLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log can't keep schemas")
+	}
+	cl, err := c.partition(log.SchemasTopic, 0)
+	if !create || !errors.As(err, &api.ErrTopicNotFound{}) {
+		return cl, err
+	}
+	err = tl.CreateTopic(&api.Topic{Name: log.SchemasTopic, Partitions: 1, Configs: offsetsTopicConfigs})
+	if err != nil && !errors.As(err, &api.ErrTopicExists{}) {
+		return nil, err
+	}
+	if err == nil {
+		c.Logger.Info("created schemas topic", zap.String("topic", log.SchemasTopic))
+	}
+	return c.partition(log.SchemasTopic, 0)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const orderSchema = `{"type": "object", "required": ["id"], "properties": {"id": {"type": "string"}}}`
+
+func TestSchemas(t *testing.T) {
+	client, config, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Name:    "orders",
+		Configs: map[string]string{log.SchemaValidationConfig: "true"},
+	})
+	require.NoError(t, err)
+	produce := func(value string) error {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Topic: "orders", Record: &api.Record{Value: []byte(value)}})
+		return err
+	}
+	// a topic validating its values takes none before it has a schema
+	require.Equal(t, codes.InvalidArgument, status.Code(produce(`{"id": "o-1"}`)))
+
+	register := func(ctx context.Context, definition string) (uint32, error) {
+		res, err := client.RegisterSchema(ctx, &api.RegisterSchemaRequest{Schema: &api.Schema{
+			Topic:      "orders",
+			Definition: []byte(definition),
+		}})
+		return res.GetVersion(), err
+	}
+	_, err = register(asPrincipal(context.Background(), "events-key"), orderSchema)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = register(ctx, `{"type": "float"}`)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	version, err := register(ctx, orderSchema)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), version)
+	// the same schema's the same version
+	version, err = register(ctx, orderSchema)
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), version)
+
+	require.NoError(t, produce(`{"id": "o-1"}`))
+	err = produce(`{"total": 1}`)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), `missing required property "id"`)
+	// compressed values are checked as they decompress
+	compressed, err := codec.Compress(api.Codec_CODEC_ZSTD, &api.Record{Value: []byte(`{"id": "o-2", "note": "` + strings.Repeat("a", 100) + `"}`)})
+	require.NoError(t, err)
+	require.Equal(t, api.Codec_CODEC_ZSTD, compressed.Codec)
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{Topic: "orders", Records: []*api.Record{{Value: []byte(`{"id": "o-3"}`)}, compressed}})
+	require.NoError(t, err)
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{Topic: "orders", Records: []*api.Record{{Value: []byte(`{"id": "o-4"}`)}, {Value: []byte(`[]`)}}})
+	require.Contains(t, status.Convert(err).Message(), "record 1: at /: want object, got array")
+	// tombstones have no value to check
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "orders", Record: &api.Record{Key: []byte("o-1")}})
+	require.NoError(t, err)
+
+	// backward compatible by default, so a new required property needs a
+	// change of level
+	next := `{"type": "object", "required": ["id", "total"], "properties": {"id": {"type": "string"}, "total": {"type": "number"}}}`
+	_, err = register(ctx, next)
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.ErrorContains(t, err, `property "total" made required`)
+	_, err = client.AlterTopicConfigs(ctx, &api.AlterTopicConfigsRequest{Name: "orders", Configs: map[string]string{log.SchemaCompatibilityConfig: "forward"}})
+	require.NoError(t, err)
+	version, err = register(ctx, next)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), version)
+	require.Error(t, produce(`{"id": "o-5"}`))
+	require.NoError(t, produce(`{"id": "o-5", "total": 2}`))
+
+	list, err := client.ListSchemas(ctx, &api.ListSchemasRequest{Topic: "orders"})
+	require.NoError(t, err)
+	require.Len(t, list.Schemas, 2)
+	require.Equal(t, orderSchema, string(list.Schemas[0].Definition))
+	got, err := client.GetSchema(ctx, &api.GetSchemaRequest{Topic: "orders", Version: 1})
+	require.NoError(t, err)
+	require.Equal(t, orderSchema, string(got.Schema.Definition))
+	_, err = client.GetSchema(ctx, &api.GetSchemaRequest{Topic: "orders", Version: 3})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// the versions are kept, so a server reading the topic afresh has them
+	config.schemas = &schemas{}
+	latest, err := config.schema("orders", 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), latest.Version)
+}
+
+func TestSchemasHTTP(t *testing.T) {
+	_, config, teardown := setupTest(t, nil)
+	defer teardown()
+	require.NoError(t, config.CommitLog.(topicLog).CreateTopic(&api.Topic{Name: "orders", Partitions: 1}))
+	srv := httptest.NewServer(NewHTTPServer("", config).Handler)
+	defer srv.Close()
+	do := func(method, path, body string) *http.Response {
+		req, err := http.NewRequest(method, srv.URL+path, bytes.NewReader([]byte(body)))
+		require.NoError(t, err)
+		req.Header.Set(auth.APIKeyHeader, "root-key")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+
+	res := do(http.MethodPost, "/topics/orders/schemas", `{"schema": `+orderSchema+`}`)
+	require.Equal(t, http.StatusCreated, res.StatusCode)
+	var sch Schema
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&sch))
+	require.Equal(t, uint32(1), sch.Version)
+	res = do(http.MethodPost, "/topics/orders/schemas", `{"schema": {"type": "array"}}`)
+	require.Equal(t, http.StatusConflict, res.StatusCode)
+	res = do(http.MethodPost, "/topics/orders/schemas", `{"type": "avro"}`)
+	require.Equal(t, http.StatusBadRequest, res.StatusCode)
+
+	res = do(http.MethodGet, "/topics/orders/schemas/latest", "")
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	sch = Schema{}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&sch))
+	require.Equal(t, "json", sch.Type)
+	require.JSONEq(t, orderSchema, string(sch.Schema))
+	res = do(http.MethodGet, "/topics/orders/schemas/2", "")
+	require.Equal(t, http.StatusNotFound, res.StatusCode)
+	res = do(http.MethodGet, "/topics/orders/schemas", "")
+	var list ListSchemasResponse
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+	require.Len(t, list.Schemas, 1)
+}
@@ -0,0 +1,1279 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/proto"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+)
+
+// How long ConsumeStream waits before looking for records past the end of the log again
+var consumePollInterval = 50 * time.Millisecond
+
+type grpcServer struct {
+	api.UnimplementedLogServer
+	api.UnimplementedAdminServer
+	*Config
+	// authenticator overrides Config.Authenticator for this server
+	authenticator auth.Authenticator
+}
+
+var (
+	_ api.LogServer   = (*grpcServer)(nil)
+	_ api.AdminServer = (*grpcServer)(nil)
+)
+
+// GRPCServices picks which services a gRPC server serves, so the Admin
+// service can be kept to an internal-only address
+type GRPCServices uint8
+
+const (
+	// LogService produces, consumes and manages topics, groups and
+	// subscriptions, served with the OTLP logs service
+	LogService GRPCServices = 1 << iota
+	// AdminService snapshots, backs up, rebalances and describes the
+	// server, and deletes and compacts its records
+	AdminService
+
+	AllServices = LogService | AdminService
+)
+
+// NewGRPCServer serves the Log and Admin services, and the OTLP logs
+// service if the config has an OTLPLogsTopic. Callers are authenticated
+// and authorized by the same Config as the HTTP server.
+func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
+	return NewGRPCServerServices(config, AllServices, nil, opts...)
+}
+
+// NewGRPCServerServices is NewGRPCServer serving only services,
+// authenticating callers with authenticator rather than config's when
+// it's set
+func NewGRPCServerServices(config *Config, services GRPCServices, authenticator auth.Authenticator, opts ...grpc.ServerOption) (*grpc.Server, error) {
+	srv := newgrpcServer(config)
+	srv.authenticator = authenticator
+	// clients ping their connections to check them, as often as every 10
+	// seconds, streams open or not
+	opts = append([]grpc.ServerOption{grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+		MinTime:             10 * time.Second,
+		PermitWithoutStream: true,
+	})}, opts...)
+	opts = append(opts,
+		// responses are written from a buffer shared between connections,
+		// not one held per connection
+		grpc.SharedWriteBuffer(true),
+		grpc.ForceServerCodecV2(consumeCodec{CodecV2: encoding.GetCodecV2(proto.Name)}),
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(srv.authenticateUnary, srv.auditUnary),
+		grpc.ChainStreamInterceptor(srv.authenticateStream, srv.auditStream),
+	)
+	gsrv := grpc.NewServer(opts...)
+	if services&LogService != 0 {
+		api.RegisterLogServer(gsrv, srv)
+		collogspb.RegisterLogsServiceServer(gsrv, &otlpLogsServer{srv: srv})
+	}
+	if services&AdminService != 0 {
+		api.RegisterAdminServer(gsrv, srv)
+	}
+	return gsrv, nil
+}
+
+// NewLogServer is the Log service NewGRPCServer serves, for callers in the
+// same process to call directly. They aren't authenticated, so authorized
+// as the anonymous principal, and can't call the streaming methods.
+func NewLogServer(config *Config) api.LogServer {
+	return newgrpcServer(config)
+}
+
+func newgrpcServer(config *Config) *grpcServer {
+	return &grpcServer{Config: withDefaults(config)}
+}
+
+func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	return s.produce(ctx, req, true)
+}
+
+// Appends the request's record as Produce does, failing with
+// api.ErrQuotaExceeded rather than throttling the caller past MaxThrottle
+// if reject is set, see Quotas
+func (s *grpcServer) produce(ctx context.Context, req *api.ProduceRequest, reject bool) (*api.ProduceResponse, error) {
+	if err := s.authorize(ctx, produceAction, topicResource(req.Topic)); err != nil {
+		return nil, err
+	}
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing record")
+	}
+	if req.NotifyDurable {
+		return nil, status.Error(codes.InvalidArgument, "notify_durable is for produce streams")
+	}
+	if err := s.checkTopicVersion(req.Topic, req.TopicVersion); err != nil {
+		return nil, err
+	}
+	if err := s.Quotas.produce(ctx, []*api.Record{req.Record}, reject); err != nil {
+		return nil, err
+	}
+	offs, pending, err := s.appendIdempotent(req, 1, func() ([]uint64, bool, error) {
+		if req.TransactionalId != "" {
+			return s.appendTransactional(ctx, req.TransactionalId, auth.Principal(ctx), []*api.Record{req.Record}, req.Ack, req.Topic, req.Partition)
+		}
+		off, pending, err := s.append(ctx, req.Record, req.Ack, req.Topic, req.Partition, auth.FromGRPC(ctx).Header)
+		return []uint64{off}, pending, err
+	})
+	if errors.As(err, &api.ErrNotLeader{}) || errors.As(err, &api.ErrNotEnoughReplicas{}) ||
+		errors.As(err, &api.ErrPartitionNotFound{}) || errors.As(err, &api.ErrTopicNotFound{}) ||
+		errors.As(err, &api.ErrRecordTooLarge{}) || errors.As(err, &api.ErrSchemaViolation{}) ||
+		errors.As(err, &api.ErrRecordRejected{}) || errors.As(err, &api.ErrInvalidTimestamp{}) ||
+		errors.As(err, &api.ErrDiskFull{}) ||
+		errors.As(err, &api.ErrProducerFenced{}) {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("append failed", zap.Error(err))
+		return nil, err
+	}
+	var off uint64
+	if len(offs) > 0 {
+		off = offs[0]
+	}
+	return produceResponse(off, pending), nil
+}
+
+// Appends the batch's records in order, forwarding them to the leader as
+// Produce does
+func (s *grpcServer) ProduceBatch(ctx context.Context, req *api.ProduceBatchRequest) (*api.ProduceBatchResponse, error) {
+	if err := s.authorize(ctx, produceAction, topicResource(req.Topic)); err != nil {
+		return nil, err
+	}
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing records")
+	}
+	if slices.Contains(req.Records, nil) {
+		return nil, status.Error(codes.InvalidArgument, "missing record")
+	}
+	if err := s.checkTopicVersion(req.Topic, req.TopicVersion); err != nil {
+		return nil, err
+	}
+	if err := s.Quotas.produce(ctx, req.Records, true); err != nil {
+		return nil, err
+	}
+	offs, pending, err := s.appendIdempotent(req, len(req.Records), func() ([]uint64, bool, error) {
+		if req.TransactionalId != "" {
+			return s.appendTransactional(ctx, req.TransactionalId, auth.Principal(ctx), req.Records, req.Ack, req.Topic, req.Partition)
+		}
+		return s.appendBatch(ctx, req.Records, req.Ack, req.Topic, req.Partition, auth.FromGRPC(ctx).Header)
+	})
+	if errors.As(err, &api.ErrNotLeader{}) || errors.As(err, &api.ErrNotEnoughReplicas{}) ||
+		errors.As(err, &api.ErrPartitionNotFound{}) || errors.As(err, &api.ErrTopicNotFound{}) ||
+		errors.As(err, &api.ErrRecordTooLarge{}) || errors.As(err, &api.ErrSchemaViolation{}) ||
+		errors.As(err, &api.ErrRecordRejected{}) || errors.As(err, &api.ErrInvalidTimestamp{}) ||
+		errors.As(err, &api.ErrDiskFull{}) ||
+		errors.As(err, &api.ErrProducerFenced{}) {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("batch append failed", zap.Error(err))
+		return nil, err
+	}
+	return produceBatchResponse(offs, pending), nil
+}
+
+// Appends the records to the topics the routing rules pick, see Routes
+func (s *grpcServer) Ingest(ctx context.Context, req *api.IngestRequest) (*api.IngestResponse, error) {
+	if len(req.Records) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing records")
+	}
+	if slices.Contains(req.Records, nil) {
+		return nil, status.Error(codes.InvalidArgument, "missing record")
+	}
+	routes, err := s.route(req.Records)
+	if err != nil {
+		return nil, err
+	}
+	authorized := make(map[string]bool)
+	for _, route := range routes {
+		if authorized[route.Topic] {
+			continue
+		}
+		if err := s.authorize(ctx, produceAction, topicResource(route.Topic)); err != nil {
+			return nil, err
+		}
+		authorized[route.Topic] = true
+	}
+	if err := s.Quotas.produce(ctx, req.Records, true); err != nil {
+		return nil, err
+	}
+	res, err := s.ingest(ctx, req.Records, routes, req.Ack, auth.FromGRPC(ctx).Header)
+	if errors.As(err, &api.ErrNotLeader{}) || errors.As(err, &api.ErrNotEnoughReplicas{}) ||
+		errors.As(err, &api.ErrPartitionNotFound{}) || errors.As(err, &api.ErrTopicNotFound{}) ||
+		errors.As(err, &api.ErrRecordTooLarge{}) || errors.As(err, &api.ErrSchemaViolation{}) ||
+		errors.As(err, &api.ErrRecordRejected{}) || errors.As(err, &api.ErrInvalidTimestamp{}) ||
+		errors.As(err, &api.ErrDiskFull{}) {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("ingest failed", zap.Error(err))
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	if err := s.authorize(ctx, consumeAction, topicResource(req.Topic)); err != nil {
+		return nil, err
+	}
+	cl, err := s.partition(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	if req.MinOffset != nil {
+		if err := s.waitForOffset(ctx, cl, *req.MinOffset); err != nil {
+			return nil, err
+		}
+	}
+	var res *api.ConsumeResponse
+	if req.MaxWaitMs > 0 || req.MinBytes > 0 {
+		res, err = s.fetch(ctx, cl, req)
+	} else {
+		res, _, err = s.consumeIsolated(ctx, cl, req.Offset, req.Isolation)
+	}
+	if err != nil {
+		return nil, err
+	}
+	records := res.Records
+	if len(records) == 0 {
+		records = []*api.Record{res.Record}
+	}
+	if err := s.Quotas.consume(ctx, records, true); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Reads records from the request's offset until their values add up to
+// its min bytes, waiting at the end of the partition until they do or its
+// max wait is up
+func (s *grpcServer) fetch(ctx context.Context, cl CommitLog, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
+	wait := min(time.Duration(req.MaxWaitMs)*time.Millisecond, s.MaxConsumeWait)
+	// reads aren't cut short by it, the scan throttle may delay them past it
+	deadline, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	res := &api.ConsumeResponse{}
+	off, size := req.Offset, 0
+	for len(res.Records) == 0 || size < int(req.MinBytes) {
+		read, next, err := s.consumeIsolated(ctx, cl, off, req.Isolation)
+		if err == nil {
+			res.Records = append(res.Records, read.Record)
+			size += len(read.Record.Value)
+			off = next
+			continue
+		}
+		if !errors.As(err, &api.ErrOffsetOutOfRange{}) || belowLowWatermark(cl, off) {
+			return nil, err
+		}
+		select {
+		case <-deadline.Done():
+			// whatever was read by the deadline is the answer
+			if len(res.Records) > 0 {
+				res.Record = res.Records[0]
+			}
+			return res, nil
+		case <-time.After(consumePollInterval):
+		}
+	}
+	res.Record = res.Records[0]
+	return res, nil
+}
+
+// Whether the offset is before the records the log still holds, which a
+// fetch can't wait for
+func belowLowWatermark(cl CommitLog, off uint64) bool {
+	sl, ok := cl.(statsLog)
+	return ok && off < sl.Stats().LowWatermark
+}
+
+// Reads without authorizing, for streams that were authorized once up
+// front, and returns the offset to read next, see readFrom
+func (s *grpcServer) consume(ctx context.Context, cl CommitLog, off uint64) (*api.ConsumeResponse, uint64, error) {
+	class := readPriority(ctx, cl, off)
+	release, err := s.Scheduler.acquire(ctx, class)
+	if err != nil {
+		return nil, off, err
+	}
+	start := time.Now()
+	_, span := tracer.Start(ctx, "Log.Read")
+	record, next, err := readFrom(cl, off)
+	release()
+	endSpan(span, err, attribute.Int64("proglog.offset", int64(off)))
+	if err != nil {
+		if !errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			s.logger(ctx).Error("read failed", zap.Uint64("offset", off), zap.Error(err))
+		}
+		return nil, off, err
+	}
+	size := recordsSize([]*api.Record{record})
+	s.throughput.consumed(cl, size, time.Since(start))
+	s.ScanThrottle.read(ctx, class, size)
+	return &api.ConsumeResponse{Record: record}, next, nil
+}
+
+// The size of the record a response of streamResponse's carries
+func streamResponseSize(res any) int {
+	if res, ok := res.(*marshaledConsumeResponse); ok {
+		return len(*res.record)
+	}
+	return recordsSize([]*api.Record{res.(*api.ConsumeResponse).Record})
+}
+
+// The response a consume stream sends with the record at off, and the
+// offset to read next, see readFrom. Commit logs that read records as they're stored answer
+// READ_UNCOMMITTED streams with them as they are, see consumeCodec.
+func (s *grpcServer) streamResponse(ctx context.Context, cl CommitLog, off uint64, isolation api.Isolation) (any, uint64, error) {
+	l, ok := cl.(marshaledLog)
+	if !ok || isolation == api.Isolation_READ_COMMITTED {
+		return s.consumeIsolated(ctx, cl, off, isolation)
+	}
+	class := readPriority(ctx, cl, off)
+	release, err := s.Scheduler.acquire(ctx, class)
+	if err != nil {
+		return nil, 0, err
+	}
+	start := time.Now()
+	_, span := tracer.Start(ctx, "Log.Read")
+	record, recordOff, err := l.ReadMarshaled(off)
+	release()
+	endSpan(span, err, attribute.Int64("proglog.offset", int64(off)))
+	if err != nil {
+		if !errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			s.logger(ctx).Error("read failed", zap.Uint64("offset", off), zap.Error(err))
+		}
+		return nil, 0, err
+	}
+	s.throughput.consumed(cl, len(*record), time.Since(start))
+	s.ScanThrottle.read(ctx, class, len(*record))
+	// ReadMarshaled answers reads in compaction's gaps as Read does
+	return &marshaledConsumeResponse{record: record}, max(off, recordOff) + 1, nil
+}
+
+func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
+	// sends are made by the stream and by the durability notices, which
+	// wait for the response they follow
+	var mu sync.Mutex
+	var notices sync.WaitGroup
+	defer notices.Wait()
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		var res *api.ProduceResponse
+		if req.NotifyDurable {
+			res, err = s.produceDurable(stream.Context(), req, func(res *api.ProduceResponse, err error) {
+				defer notices.Done()
+				mu.Lock()
+				defer mu.Unlock()
+				durable := &api.ProduceResponse{Offset: res.Offset, Durable: true}
+				if err != nil {
+					durable.DurabilityError = err.Error()
+				}
+				// failing only once the stream has
+				stream.Send(durable)
+			}, &notices)
+		} else {
+			res, err = s.produce(stream.Context(), req, false)
+		}
+		if err == nil {
+			err = stream.Send(res)
+		}
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Appends a stream's record with notify_durable, answering once the leader
+// has written it and calling notice with that response once it's synced,
+// with the sync's error. Each notice is added to notices before the append.
+func (s *grpcServer) produceDurable(ctx context.Context, req *api.ProduceRequest, notice func(*api.ProduceResponse, error), notices *sync.WaitGroup) (
+	*api.ProduceResponse, error,
+) {
+	if err := s.authorize(ctx, produceAction, topicResource(req.Topic)); err != nil {
+		return nil, err
+	}
+	if req.Record == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing record")
+	}
+	if req.Ack != api.Ack_ACK_DEFAULT && req.Ack != api.Ack_ACK_ALL {
+		return nil, status.Error(codes.InvalidArgument, "notify_durable appends at ack ALL")
+	}
+	if req.TransactionalId != "" {
+		return nil, status.Error(codes.InvalidArgument, "notify_durable produces aren't transactional")
+	}
+	if req.ProducerId != 0 {
+		return nil, status.Error(codes.InvalidArgument, "notify_durable produces aren't idempotent")
+	}
+	if err := s.checkTopicVersion(req.Topic, req.TopicVersion); err != nil {
+		return nil, err
+	}
+	if err := s.Quotas.produce(ctx, []*api.Record{req.Record}, false); err != nil {
+		return nil, err
+	}
+	res := &api.ProduceResponse{}
+	notices.Add(1)
+	off, err := s.appendDurable(ctx, req.Record, req.Topic, req.Partition, func(err error) {
+		notice(res, err)
+	})
+	if err != nil || off == droppedOffset {
+		notices.Done()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if off == droppedOffset {
+		// with nothing appended there's nothing to sync
+		return produceResponse(off, false), nil
+	}
+	res.Offset = off
+	return res, nil
+}
+
+// Streams records from the requested offset on, waiting at the end of the log for new ones
+func (s *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	ctx := stream.Context()
+	if err := s.authorize(ctx, consumeAction, topicResource(req.Topic)); err != nil {
+		return err
+	}
+	cl, err := s.partition(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+	if req.MinOffset != nil {
+		if err := s.waitForOffset(ctx, cl, *req.MinOffset); err != nil {
+			return err
+		}
+	}
+	activeConsumers.Inc()
+	defer activeConsumers.Dec()
+	off := req.Offset
+	for {
+		res, next, err := s.streamResponse(ctx, cl, off, req.Isolation)
+		switch {
+		case err == nil:
+		case errors.As(err, &api.ErrOffsetOutOfRange{}):
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(consumePollInterval):
+			}
+			continue
+		default:
+			return err
+		}
+		if err := s.Quotas.throttle(ctx, consumeBytesRate, streamResponseSize(res), false); err != nil {
+			return err
+		}
+		if err = stream.SendMsg(res); err != nil {
+			return err
+		}
+		off = next
+	}
+}
+
+// Lists the partition's servers to any authenticated caller, so clients
+// can find its leader. A log that isn't clustered answers Unimplemented.
+func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
+	l, err := s.partition("", req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	cl, ok := l.(clusterLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log isn't clustered")
+	}
+	servers, err := cl.GetServers()
+	if err != nil {
+		s.logger(ctx).Error("get servers failed", zap.Error(err))
+		return nil, err
+	}
+	return &api.GetServersResponse{Servers: servers, Partitions: uint32(s.partitions())}, nil
+}
+
+// Sums the server's copy of the log for a replica comparing its own, which
+// takes permission to consume since the records could be probed through it
+func (s *grpcServer) GetChecksums(ctx context.Context, req *api.GetChecksumsRequest) (*api.GetChecksumsResponse, error) {
+	if err := s.authorize(ctx, consumeAction, objectWildcard); err != nil {
+		return nil, err
+	}
+	l, err := s.partition("", req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	cl, ok := l.(checksumLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log can't be checksummed")
+	}
+	size := req.RangeSize
+	if size == 0 {
+		size = log.RangeSize
+	}
+	if sl, ok := l.(sessionChecksumLog); ok && req.OpenSession {
+		res, err := sl.SessionChecksums(size, req.SessionId, req.SessionEpoch)
+		if err != nil {
+			s.logger(ctx).Error("checksums failed", zap.Error(err))
+			return nil, err
+		}
+		return res, nil
+	}
+	ranges, err := cl.Checksums(size)
+	if err != nil {
+		s.logger(ctx).Error("checksums failed", zap.Error(err))
+		return nil, err
+	}
+	return &api.GetChecksumsResponse{Ranges: ranges}, nil
+}
+
+// Records the next offset a consumer reads from the partition
+func (s *grpcServer) CommitOffset(ctx context.Context, req *api.CommitOffsetRequest) (*api.CommitOffsetResponse, error) {
+	if err := s.authorize(ctx, consumeAction, topicResource(req.Topic)); err != nil {
+		return nil, err
+	}
+	ol, err := s.offsetLog(req.Topic, req.Partition, req.Consumer)
+	if err != nil {
+		return nil, err
+	}
+	err = ol.CommitOffset(req.Consumer, req.Offset)
+	if errors.As(err, &api.ErrNotLeader{}) {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("offset commit failed", zap.String("consumer", req.Consumer), zap.Error(err))
+		return nil, err
+	}
+	return &api.CommitOffsetResponse{}, nil
+}
+
+func (s *grpcServer) FetchOffset(ctx context.Context, req *api.FetchOffsetRequest) (*api.FetchOffsetResponse, error) {
+	if err := s.authorize(ctx, consumeAction, topicResource(req.Topic)); err != nil {
+		return nil, err
+	}
+	ol, err := s.offsetLog(req.Topic, req.Partition, req.Consumer)
+	if err != nil {
+		return nil, err
+	}
+	off, found := ol.FetchOffset(req.Consumer)
+	return &api.FetchOffsetResponse{Offset: off, Found: found}, nil
+}
+
+// Records the next offsets the group reads from the topic partitions, in
+// the offsets topic so they survive the servers restarting
+func (s *grpcServer) CommitGroupOffsets(ctx context.Context, req *api.CommitGroupOffsetsRequest) (*api.CommitGroupOffsetsResponse, error) {
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing group")
+	}
+	for _, o := range req.Offsets {
+		if err := s.authorize(ctx, consumeAction, topicResource(o.Topic)); err != nil {
+			return nil, err
+		}
+	}
+	if len(req.Offsets) == 0 {
+		return &api.CommitGroupOffsetsResponse{}, nil
+	}
+	err := s.commitGroupOffsets(ctx, req, auth.FromGRPC(ctx).Header)
+	if errors.As(err, &api.ErrNotLeader{}) || errors.As(err, &api.ErrNotEnoughReplicas{}) || status.Code(err) == codes.Unimplemented {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("group offset commit failed", zap.String("group", req.Group), zap.Error(err))
+		return nil, err
+	}
+	return &api.CommitGroupOffsetsResponse{}, nil
+}
+
+func (s *grpcServer) FetchGroupOffsets(ctx context.Context, req *api.FetchGroupOffsetsRequest) (*api.FetchGroupOffsetsResponse, error) {
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing group")
+	}
+	if _, ok := api.OffsetReset_name[int32(req.OffsetReset)]; !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown offset reset policy %d", req.OffsetReset)
+	}
+	for _, p := range req.Partitions {
+		if err := s.authorize(ctx, consumeAction, topicResource(p.Topic)); err != nil {
+			return nil, err
+		}
+	}
+	offsets, err := s.fetchGroupOffsets(req)
+	if err != nil {
+		return nil, err
+	}
+	return &api.FetchGroupOffsetsResponse{Offsets: offsets}, nil
+}
+
+// Joins the consumer group or heartbeats for a member of it, answering with
+// the partitions the member consumes
+func (s *grpcServer) JoinGroup(ctx context.Context, req *api.JoinGroupRequest) (*api.JoinGroupResponse, error) {
+	if req.Group == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing group")
+	}
+	for _, topic := range req.Topics {
+		if err := s.authorize(ctx, consumeAction, topicResource(topic)); err != nil {
+			return nil, err
+		}
+	}
+	return s.joinGroup(req)
+}
+
+func (s *grpcServer) LeaveGroup(ctx context.Context, req *api.LeaveGroupRequest) (*api.LeaveGroupResponse, error) {
+	if req.Group == "" || req.MemberId == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing group or member")
+	}
+	if err := s.leaveGroup(req); err != nil {
+		return nil, err
+	}
+	return &api.LeaveGroupResponse{}, nil
+}
+
+// Reports how far groups are behind, to anyone who may consume every topic
+// as listing the topics is
+func (s *grpcServer) GetGroupLag(ctx context.Context, req *api.GetGroupLagRequest) (*api.GetGroupLagResponse, error) {
+	if err := s.authorize(ctx, consumeAction, objectWildcard); err != nil {
+		return nil, err
+	}
+	lags, err := s.groupLag(req.Group)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetGroupLagResponse{Lags: lags}, nil
+}
+
+// Subscribes a webhook to the topic, to anyone who may administer it
+func (s *grpcServer) CreateSubscription(ctx context.Context, req *api.CreateSubscriptionRequest) (*api.CreateSubscriptionResponse, error) {
+	sub := req.GetSubscription()
+	if sub == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing subscription")
+	}
+	if err := s.authorize(ctx, adminAction, topicResource(sub.Topic)); err != nil {
+		return nil, err
+	}
+	err := s.createSubscription(ctx, sub, auth.FromGRPC(ctx).Header)
+	if errors.As(err, &api.ErrSubscriptionExists{}) || errors.As(err, &api.ErrTopicNotFound{}) ||
+		errors.As(err, &api.ErrNotLeader{}) || status.Code(err) == codes.InvalidArgument || status.Code(err) == codes.Unimplemented {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("create subscription failed", zap.String("subscription", sub.Name), zap.Error(err))
+		return nil, err
+	}
+	s.logger(ctx).Info("created subscription",
+		zap.String("subscription", sub.Name),
+		zap.String("topic", sub.Topic),
+		zap.String("url", sub.Url),
+	)
+	return &api.CreateSubscriptionResponse{}, nil
+}
+
+func (s *grpcServer) DeleteSubscription(ctx context.Context, req *api.DeleteSubscriptionRequest) (*api.DeleteSubscriptionResponse, error) {
+	sub, err := s.subscription(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, adminAction, sub.Topic); err != nil {
+		return nil, err
+	}
+	err = s.deleteSubscription(ctx, req.Name)
+	if errors.As(err, &api.ErrSubscriptionNotFound{}) || errors.As(err, &api.ErrNotLeader{}) {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("delete subscription failed", zap.String("subscription", req.Name), zap.Error(err))
+		return nil, err
+	}
+	s.logger(ctx).Info("deleted subscription", zap.String("subscription", req.Name))
+	return &api.DeleteSubscriptionResponse{}, nil
+}
+
+// Lists the subscriptions, to anyone who may consume every topic as
+// listing the topics is
+func (s *grpcServer) ListSubscriptions(ctx context.Context, req *api.ListSubscriptionsRequest) (*api.ListSubscriptionsResponse, error) {
+	if err := s.authorize(ctx, consumeAction, objectWildcard); err != nil {
+		return nil, err
+	}
+	subs, err := s.listSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListSubscriptionsResponse{Subscriptions: subs}, nil
+}
+
+// Lists the subscription's dead letters, to anyone who may consume its
+// dead-letter topic
+func (s *grpcServer) ListDeadLetters(ctx context.Context, req *api.ListDeadLettersRequest) (*api.ListDeadLettersResponse, error) {
+	sub, err := s.deadLetterSubscription(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, consumeAction, topicResource(sub.DeadLetterTopic)); err != nil {
+		return nil, err
+	}
+	letters, partition, next, err := s.deadLetters(sub, req.Offset, int(req.Max))
+	if err != nil {
+		return nil, err
+	}
+	return &api.ListDeadLettersResponse{DeadLetters: letters, Partition: partition, NextOffset: next}, nil
+}
+
+// Replays the subscription's dead letters to its webhook, to anyone who may
+// administer its topic
+func (s *grpcServer) ReplayDeadLetters(ctx context.Context, req *api.ReplayDeadLettersRequest) (*api.ReplayDeadLettersResponse, error) {
+	sub, err := s.deadLetterSubscription(req.Subscription)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, adminAction, sub.Topic); err != nil {
+		return nil, err
+	}
+	letters, _, next, err := s.deadLetters(sub, req.Offset, int(req.Max))
+	if err != nil {
+		return nil, err
+	}
+	replayed, err := s.replayDeadLetters(ctx, sub, letters)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "%d dead letters replayed: %v", replayed, err)
+	}
+	s.logger(ctx).Info("replayed dead letters",
+		zap.String("subscription", sub.Name),
+		zap.Uint64("offset", req.Offset),
+		zap.Int("replayed", replayed),
+	)
+	return &api.ReplayDeadLettersResponse{Replayed: uint32(replayed), NextOffset: next}, nil
+}
+
+// Registers a version of the topic's schema, to anyone who may administer
+// the topic
+func (s *grpcServer) RegisterSchema(ctx context.Context, req *api.RegisterSchemaRequest) (*api.RegisterSchemaResponse, error) {
+	sch := req.GetSchema()
+	if sch == nil {
+		return nil, status.Error(codes.InvalidArgument, "missing schema")
+	}
+	if err := s.authorize(ctx, adminAction, topicResource(sch.Topic)); err != nil {
+		return nil, err
+	}
+	version, err := s.registerSchema(ctx, sch)
+	if errors.As(err, &api.ErrIncompatibleSchema{}) || errors.As(err, &api.ErrTopicNotFound{}) ||
+		errors.As(err, &api.ErrNotLeader{}) || status.Code(err) == codes.InvalidArgument || status.Code(err) == codes.Unimplemented {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("register schema failed", zap.String("topic", sch.Topic), zap.Error(err))
+		return nil, err
+	}
+	s.logger(ctx).Info("registered schema",
+		zap.String("topic", sch.Topic),
+		zap.Uint32("version", version),
+		zap.Stringer("type", sch.Type),
+	)
+	return &api.RegisterSchemaResponse{Version: version}, nil
+}
+
+// Returns a version of the topic's schema, to anyone who may consume the
+// topic as describing it is
+func (s *grpcServer) GetSchema(ctx context.Context, req *api.GetSchemaRequest) (*api.GetSchemaResponse, error) {
+	if err := s.authorize(ctx, consumeAction, topicResource(req.Topic)); err != nil {
+		return nil, err
+	}
+	ts, err := s.schema(topicResource(req.Topic), req.Version)
+	if err != nil {
+		return nil, err
+	}
+	return &api.GetSchemaResponse{Schema: ts.Schema}, nil
+}
+
+func (s *grpcServer) ListSchemas(ctx context.Context, req *api.ListSchemasRequest) (*api.ListSchemasResponse, error) {
+	if err := s.authorize(ctx, consumeAction, topicResource(req.Topic)); err != nil {
+		return nil, err
+	}
+	versions, err := s.topicSchemas(topicResource(req.Topic))
+	if err != nil {
+		return nil, err
+	}
+	res := &api.ListSchemasResponse{}
+	for _, ts := range versions {
+		res.Schemas = append(res.Schemas, ts.Schema)
+	}
+	return res, nil
+}
+
+func (s *grpcServer) GetOffsets(ctx context.Context, req *api.GetOffsetsRequest) (*api.GetOffsetsResponse, error) {
+	if err := s.authorize(ctx, consumeAction, topicResource(req.Topic)); err != nil {
+		return nil, err
+	}
+	l, err := s.partition(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	sl, ok := l.(statsLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log doesn't report its offsets")
+	}
+	tc, err := s.topicConfig(req.Topic)
+	if err != nil {
+		return nil, err
+	}
+	st := sl.Stats()
+	return &api.GetOffsetsResponse{
+		LowWatermark:    st.LowWatermark,
+		HighWatermark:   st.HighWatermark,
+		TimestampSkewMs: uint64(tc.TimestampSkew().Milliseconds()),
+	}, nil
+}
+
+func (s *grpcServer) GetSegments(ctx context.Context, req *api.GetSegmentsRequest) (*api.GetSegmentsResponse, error) {
+	al, err := s.adminLog(ctx, req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	res := &api.GetSegmentsResponse{}
+	for _, seg := range al.SegmentStats() {
+		res.Segments = append(res.Segments, &api.Segment{
+			BaseOffset: seg.BaseOffset,
+			NextOffset: seg.NextOffset,
+			StoreBytes: seg.StoreBytes,
+			IndexBytes: seg.IndexBytes,
+		})
+	}
+	return res, nil
+}
+
+func (s *grpcServer) DeleteRecords(ctx context.Context, req *api.DeleteRecordsRequest) (*api.DeleteRecordsResponse, error) {
+	al, err := s.adminLog(ctx, req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	low, err := al.DeleteRecords(req.BeforeOffset)
+	if errors.As(err, &api.ErrNotLeader{}) {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("delete records failed", zap.Uint64("before_offset", req.BeforeOffset), zap.Error(err))
+		return nil, err
+	}
+	s.logger(ctx).Info("deleted records",
+		zap.Uint32("partition", req.Partition),
+		zap.Uint64("before_offset", req.BeforeOffset),
+		zap.Uint64("low_watermark", low),
+	)
+	return &api.DeleteRecordsResponse{LowWatermark: low}, nil
+}
+
+func (s *grpcServer) Snapshot(ctx context.Context, req *api.SnapshotRequest) (*api.SnapshotResponse, error) {
+	if err := s.authorize(ctx, adminAction, objectWildcard); err != nil {
+		return nil, err
+	}
+	l, err := s.partition("", req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	sl, ok := l.(snapshotLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log isn't clustered")
+	}
+	index, err := sl.Snapshot()
+	if err != nil {
+		s.logger(ctx).Error("snapshot failed", zap.Error(err))
+		return nil, err
+	}
+	return &api.SnapshotResponse{Index: index}, nil
+}
+
+func (s *grpcServer) Backup(req *api.BackupRequest, stream api.Admin_BackupServer) error {
+	ctx := stream.Context()
+	if err := s.authorize(ctx, adminAction, backupResource(req.Topic)); err != nil {
+		return err
+	}
+	bl, err := s.backupLog(req.Topic)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(backupWriter{stream: stream}, backupChunkSize)
+	manifest, err := bl.Backup(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		s.logger(ctx).Error("backup failed", zap.String("topic", req.Topic), zap.Error(err))
+		return err
+	}
+	s.logger(ctx).Info("backed up logs", zap.String("topic", manifest.Topic), zap.Int("logs", len(manifest.Logs)))
+	return nil
+}
+
+func (s *grpcServer) LinkBackup(ctx context.Context, req *api.LinkBackupRequest) (*api.LinkBackupResponse, error) {
+	if err := s.authorize(ctx, adminAction, objectWildcard); err != nil {
+		return nil, err
+	}
+	dir, manifest, err := s.linkBackup(req.Name)
+	if err != nil {
+		s.logger(ctx).Error("link backup failed", zap.String("name", req.Name), zap.Error(err))
+		return nil, err
+	}
+	files, bytes := linkBackupSize(manifest)
+	s.logger(ctx).Info("link backed up logs", zap.String("dir", dir), zap.Int("logs", len(manifest.Logs)))
+	return &api.LinkBackupResponse{Dir: dir, Files: files, Bytes: bytes}, nil
+}
+
+func (s *grpcServer) CreateTopic(ctx context.Context, req *api.CreateTopicRequest) (*api.CreateTopicResponse, error) {
+	tl, err := s.topicLog(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := log.ValidateTopic(req.Name); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.validateTopicConfigs(req.Configs); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	topic := &api.Topic{Name: req.Name, Partitions: max(req.Partitions, 1), Configs: req.Configs}
+	err = tl.CreateTopic(topic)
+	if errors.As(err, &api.ErrTopicExists{}) || errors.As(err, &api.ErrNotLeader{}) {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("create topic failed", zap.String("topic", req.Name), zap.Error(err))
+		return nil, err
+	}
+	s.logger(ctx).Info("created topic",
+		zap.String("topic", req.Name),
+		zap.Uint32("partitions", topic.Partitions),
+		zap.Any("configs", topic.Configs),
+	)
+	return &api.CreateTopicResponse{}, nil
+}
+
+func (s *grpcServer) DeleteTopic(ctx context.Context, req *api.DeleteTopicRequest) (*api.DeleteTopicResponse, error) {
+	tl, err := s.topicLog(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if req.Name == "" || req.Name == log.DefaultTopic {
+		return nil, status.Error(codes.InvalidArgument, "the default topic can't be deleted")
+	}
+	err = tl.DeleteTopic(req.Name)
+	if errors.As(err, &api.ErrTopicNotFound{}) || errors.As(err, &api.ErrNotLeader{}) {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("delete topic failed", zap.String("topic", req.Name), zap.Error(err))
+		return nil, err
+	}
+	s.logger(ctx).Info("deleted topic", zap.String("topic", req.Name))
+	return &api.DeleteTopicResponse{}, nil
+}
+
+func (s *grpcServer) ListTopics(ctx context.Context, req *api.ListTopicsRequest) (*api.ListTopicsResponse, error) {
+	resource, topics := s.listedTopics(auth.Principal(ctx))
+	if err := s.authorize(ctx, consumeAction, resource); err != nil {
+		return nil, err
+	}
+	res := &api.ListTopicsResponse{
+		Partitions: make(map[string]uint32),
+		Versions:   make(map[string]uint64),
+	}
+	for _, topic := range topics {
+		res.Topics = append(res.Topics, topic.Name)
+		res.Partitions[topic.Name] = topic.Partitions
+		res.Versions[topic.Name] = topic.Version
+	}
+	return res, nil
+}
+
+func (s *grpcServer) DescribeTopic(ctx context.Context, req *api.DescribeTopicRequest) (*api.DescribeTopicResponse, error) {
+	if err := s.authorize(ctx, consumeAction, topicResource(req.Name)); err != nil {
+		return nil, err
+	}
+	topic, err := s.describeTopic(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	return &api.DescribeTopicResponse{Topic: topic}, nil
+}
+
+// Changes the topic's config overrides, which the servers go by without
+// restarting
+func (s *grpcServer) AlterTopicConfigs(ctx context.Context, req *api.AlterTopicConfigsRequest) (*api.AlterTopicConfigsResponse, error) {
+	tl, err := s.topicLog(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if req.Name == "" || req.Name == log.DefaultTopic {
+		return nil, status.Error(codes.InvalidArgument, "the default topic's configs are the servers' settings")
+	}
+	if err := s.validateTopicConfigs(req.Configs); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	topic, err := tl.AlterTopicConfigs(req.Name, req.Configs)
+	if errors.As(err, &api.ErrTopicNotFound{}) || errors.As(err, &api.ErrNotLeader{}) {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("alter topic configs failed", zap.String("topic", req.Name), zap.Error(err))
+		return nil, err
+	}
+	s.logger(ctx).Info("altered topic configs",
+		zap.String("topic", req.Name),
+		zap.Any("configs", topic.Configs),
+	)
+	return &api.AlterTopicConfigsResponse{Topic: topic}, nil
+}
+
+// Raises the topic's partition count while its partitions keep serving.
+// Producers hashing keys by the topic's old version are told to pick
+// again, see ProduceRequest.topic_version.
+func (s *grpcServer) CreatePartitions(ctx context.Context, req *api.CreatePartitionsRequest) (*api.CreatePartitionsResponse, error) {
+	tl, err := s.topicLog(ctx, req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if req.Name == "" || req.Name == log.DefaultTopic {
+		return nil, status.Error(codes.InvalidArgument, "the default topic's partitions are the servers' settings")
+	}
+	desc, err := tl.DescribeTopic(req.Name)
+	if err != nil {
+		return nil, err
+	}
+	if req.Partitions <= desc.Partitions {
+		return nil, status.Errorf(codes.InvalidArgument, "topic %s has %d partitions, can't have %d", req.Name, desc.Partitions, req.Partitions)
+	}
+	topic, err := tl.CreatePartitions(req.Name, req.Partitions)
+	if errors.As(err, &api.ErrTopicNotFound{}) || errors.As(err, &api.ErrNotLeader{}) {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("create partitions failed", zap.String("topic", req.Name), zap.Error(err))
+		return nil, err
+	}
+	s.logger(ctx).Info("created partitions",
+		zap.String("topic", req.Name),
+		zap.Uint32("partitions", topic.Partitions),
+		zap.Uint64("version", topic.Version),
+	)
+	return &api.CreatePartitionsResponse{Topic: topic}, nil
+}
+
+// The log holding the topics, once the caller is authorized to administer
+// the topic
+func (s *grpcServer) topicLog(ctx context.Context, topic string) (topicLog, error) {
+	if err := s.authorize(ctx, adminAction, topicResource(topic)); err != nil {
+		return nil, err
+	}
+	tl, ok := s.CommitLog.(topicLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log doesn't hold topics")
+	}
+	return tl, nil
+}
+
+// The topic partition's log, once the caller is authorized to administer it
+func (s *grpcServer) adminLog(ctx context.Context, topic string, p uint32) (adminLog, error) {
+	if err := s.authorize(ctx, adminAction, topicResource(topic)); err != nil {
+		return nil, err
+	}
+	l, err := s.partition(topic, p)
+	if err != nil {
+		return nil, err
+	}
+	al, ok := l.(adminLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log can't be administered")
+	}
+	return al, nil
+}
+
+// The log keeping the topic partition's committed offsets
+func (s *grpcServer) offsetLog(topic string, p uint32, consumer string) (offsetLog, error) {
+	if consumer == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing consumer")
+	}
+	l, err := s.partition(topic, p)
+	if err != nil {
+		return nil, err
+	}
+	ol, ok := l.(offsetLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log can't keep offsets")
+	}
+	return ol, nil
+}
+
+// Plans or applies a rebalance of the voters across zones
+func (s *grpcServer) Rebalance(ctx context.Context, req *api.RebalanceRequest) (*api.RebalanceResponse, error) {
+	if err := s.authorize(ctx, rebalanceAction, objectWildcard); err != nil {
+		return nil, err
+	}
+	l, err := s.partition("", req.Partition)
+	if err != nil {
+		return nil, err
+	}
+	rl, ok := l.(rebalanceLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log isn't clustered")
+	}
+	changes, err := rl.Rebalance(req.DryRun)
+	if errors.As(err, &api.ErrNotLeader{}) {
+		return nil, err
+	}
+	if err != nil {
+		s.logger(ctx).Error("rebalance failed", zap.Bool("dry_run", req.DryRun), zap.Error(err))
+		return nil, err
+	}
+	return &api.RebalanceResponse{Changes: changes}, nil
+}
+
+// Checks the caller may perform action on resource, auditing the denial if not
+func (s *grpcServer) DescribeQuotas(ctx context.Context, req *api.DescribeQuotasRequest) (*api.DescribeQuotasResponse, error) {
+	if err := s.authorize(ctx, adminAction, quotaResource); err != nil {
+		return nil, err
+	}
+	if s.Quotas == nil {
+		return nil, status.Error(codes.Unimplemented, "quotas aren't configured")
+	}
+	return &api.DescribeQuotasResponse{Quotas: s.Quotas.Describe()}, nil
+}
+
+func (s *grpcServer) AlterQuotas(ctx context.Context, req *api.AlterQuotasRequest) (*api.AlterQuotasResponse, error) {
+	if err := s.authorize(ctx, adminAction, quotaResource); err != nil {
+		return nil, err
+	}
+	if s.Quotas == nil {
+		return nil, status.Error(codes.Unimplemented, "quotas aren't configured")
+	}
+	quotas, err := s.Quotas.Alter(req.Quotas)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	s.logger(ctx).Info("altered quotas", zap.Any("quotas", req.Quotas))
+	return &api.AlterQuotasResponse{Quotas: quotas}, nil
+}
+
+func (s *grpcServer) DescribeTenants(ctx context.Context, req *api.DescribeTenantsRequest) (*api.DescribeTenantsResponse, error) {
+	tenant, resource := s.describedTenant(auth.Principal(ctx), req.Tenant)
+	if err := s.authorize(ctx, adminAction, resource); err != nil {
+		return nil, err
+	}
+	tl, ok := s.CommitLog.(tenantLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "the log has no tenants")
+	}
+	stats, ok := tenantStats(tl, tenant)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "tenant %s not found", tenant)
+	}
+	return &api.DescribeTenantsResponse{Tenants: stats}, nil
+}
+
+func (s *grpcServer) authorize(ctx context.Context, action, resource string) error {
+	principal := auth.Principal(ctx)
+	err := s.confine(principal, resource)
+	if err == nil && s.Authorizer != nil {
+		err = s.Authorizer.Authorize(ctx, principal, action, resource)
+	}
+	if err != nil {
+		s.logger(ctx).Info("permission denied",
+			zap.String("action", action),
+			zap.String("resource", resource),
+		)
+		s.Audit.Record(AuditEvent{
+			Principal: principal,
+			Action:    action,
+			Resource:  resource,
+			Result:    AuditDenied,
+		})
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+// Resolves the caller's principal into the context, rejecting and auditing failures
+func (s *grpcServer) authenticate(ctx context.Context, method string) (context.Context, error) {
+	logger := s.Logger.With(zap.String("method", method))
+	authenticator := s.Authenticator
+	if s.authenticator != nil {
+		authenticator = s.authenticator
+	}
+	if authenticator == nil {
+		return withLogger(ctx, logger), nil
+	}
+	creds := auth.FromGRPC(ctx)
+	principal, err := authenticator.Authenticate(ctx, creds)
+	if err != nil {
+		logger.Info("authentication failed", zap.Error(err))
+		s.Audit.Record(AuditEvent{
+			Principal: creds.RemoteAddr,
+			Action:    AuditAuthenticate,
+			Resource:  method,
+			Result:    AuditFailure,
+		})
+		return ctx, status.Error(codes.Unauthenticated, auth.ErrUnauthenticated.Error())
+	}
+	ctx = auth.WithPrincipal(ctx, principal)
+	return withLogger(ctx, logger.With(zap.String("principal", principal))), nil
+}
+
+func (s *grpcServer) authenticateUnary(
+	ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler,
+) (any, error) {
+	ctx, err := s.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Quotas.throttle(ctx, requestsRate, 1, true); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *grpcServer) authenticateStream(
+	srv any, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler,
+) error {
+	ctx, err := s.authenticate(stream.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	// a stream counts as one request, however many messages it carries
+	if err := s.Quotas.throttle(ctx, requestsRate, 1, true); err != nil {
+		return err
+	}
+	return handler(srv, &serverStream{ServerStream: stream, ctx: ctx})
+}
+
+// Carries the authenticated context into stream handlers
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
+
+// Returns the call-scoped logger, falling back to the server's logger
+func (s *grpcServer) logger(ctx context.Context) *zap.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*zap.Logger); ok {
+		return l
+	}
+	return s.Logger
+}
@@ -0,0 +1,1111 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestGRPCServer(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		client testClient,
+		config *Config,
+	){
+		"produce/consume a message to/from the log succeeds": testProduceConsume,
+		"produce/consume stream succeeds":                    testProduceConsumeStream,
+		"produce batch appends in order":                     testProduceBatch,
+		"consume past log boundary fails":                    testConsumePastBoundary,
+		"unknown partition fails":                            testUnknownPartition,
+		"unauthorized fails":                                 testUnauthorized,
+		"get checksums sums the log":                         testGetChecksums,
+		"rebalance takes a clustered log":                    testRebalance,
+		"committed offsets are fetched":                      testCommitOffset,
+		"get offsets spans the log":                          testGetOffsets,
+		"admin lists segments and deletes records":           testAdmin,
+		"topics are created, used and deleted":               testTopics,
+		"backup streams the log's files":                     testBackup,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			client, config, teardown := setupTest(t, nil)
+			defer teardown()
+			fn(t, client, config)
+		})
+	}
+}
+
+// testClient calls the Log and Admin services, which setupTest serves
+// together
+type testClient struct {
+	api.LogClient
+	api.AdminClient
+}
+
+func setupTest(t *testing.T, fn func(*Config)) (
+	client testClient,
+	cfg *Config,
+	teardown func(),
+) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "server-test")
+	require.NoError(t, err)
+
+	clog, err := log.NewTopics(dir, log.Config{})
+	require.NoError(t, err)
+
+	cfg = &Config{
+		CommitLog: clog,
+		Authenticator: auth.APIKeyAuthenticator{Keys: map[string]string{
+			"root-key":   "root",
+			"nobody-key": "nobody",
+			"events-key": "events",
+		}},
+		Authorizer: auth.NewACL(
+			auth.Rule{Principal: "root", Resource: objectWildcard, Action: produceAction},
+			auth.Rule{Principal: "root", Resource: objectWildcard, Action: consumeAction},
+			auth.Rule{Principal: "root", Resource: objectWildcard, Action: rebalanceAction},
+			auth.Rule{Principal: "root", Resource: objectWildcard, Action: adminAction},
+			auth.Rule{Principal: "events", Resource: "events", Action: produceAction},
+		),
+	}
+	if fn != nil {
+		fn(cfg)
+	}
+	server, err := NewGRPCServer(cfg)
+	require.NoError(t, err)
+
+	go func() {
+		server.Serve(l)
+	}()
+
+	cc, err := grpc.NewClient(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	client = testClient{api.NewLogClient(cc), api.NewAdminClient(cc)}
+
+	return client, cfg, func() {
+		server.Stop()
+		cc.Close()
+		l.Close()
+		clog.Remove()
+	}
+}
+
+func asPrincipal(ctx context.Context, key string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, auth.APIKeyHeader, key)
+}
+
+func testProduceConsume(t *testing.T, client testClient, config *Config) {
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	want := &api.Record{
+		Value: []byte("hello world"),
+	}
+
+	produce, err := client.Produce(
+		ctx,
+		&api.ProduceRequest{
+			Record: want,
+		},
+	)
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, want.Value, consume.Record.Value)
+	require.Equal(t, produce.Offset, consume.Record.Offset)
+}
+
+func testProduceBatch(t *testing.T, client testClient, config *Config) {
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	values := []string{"first", "second", "third"}
+	var records []*api.Record
+	for _, v := range values {
+		records = append(records, &api.Record{Value: []byte(v)})
+	}
+	res, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: records})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1, 2}, res.Offsets)
+	for i, v := range values {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: res.Offsets[i]})
+		require.NoError(t, err)
+		require.Equal(t, v, string(consume.Record.Value))
+	}
+
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func testConsumePastBoundary(t *testing.T, client testClient, config *Config) {
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{
+			Value: []byte("hello world"),
+		},
+	})
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset + 1,
+	})
+	require.Nil(t, consume)
+	got := status.Code(err)
+	want := status.Code(api.ErrOffsetOutOfRange{}.GRPCStatus().Err())
+	require.Equal(t, want, got)
+}
+
+func testUnknownPartition(t *testing.T, client testClient, config *Config) {
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	// a log that isn't partitioned only has partition 0
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record:    &api.Record{Value: []byte("hello world")},
+		Partition: 1,
+	})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Partition: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testGetChecksums(t *testing.T, client testClient, config *Config) {
+	ctx := asPrincipal(context.Background(), "root-key")
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	res, err := client.GetChecksums(ctx, &api.GetChecksumsRequest{RangeSize: 2})
+	require.NoError(t, err)
+	want, err := config.CommitLog.(checksumLog).Checksums(2)
+	require.NoError(t, err)
+	require.Len(t, res.Ranges, 2)
+	for i := range want {
+		require.True(t, proto.Equal(want[i], res.Ranges[i]))
+	}
+	require.Zero(t, res.SessionId)
+
+	// within a session, asking again only gets what changed
+	res, err = client.GetChecksums(ctx, &api.GetChecksumsRequest{RangeSize: 2, OpenSession: true})
+	require.NoError(t, err)
+	require.False(t, res.Incremental)
+	require.Len(t, res.Ranges, 2)
+	res, err = client.GetChecksums(ctx, &api.GetChecksumsRequest{
+		RangeSize:    2,
+		OpenSession:  true,
+		SessionId:    res.SessionId,
+		SessionEpoch: res.SessionEpoch,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Incremental)
+	require.Empty(t, res.Ranges)
+
+	// it takes permission to consume
+	_, err = client.GetChecksums(asPrincipal(context.Background(), "nobody-key"), &api.GetChecksumsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testRebalance(t *testing.T, client testClient, config *Config) {
+	_, err := client.Rebalance(asPrincipal(context.Background(), "root-key"), &api.RebalanceRequest{DryRun: true})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+
+	_, err = client.Rebalance(asPrincipal(context.Background(), "nobody-key"), &api.RebalanceRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testCommitOffset(t *testing.T, client testClient, config *Config) {
+	ctx := asPrincipal(context.Background(), "root-key")
+	res, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Consumer: "group"})
+	require.NoError(t, err)
+	require.False(t, res.Found)
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Consumer: "group", Offset: 4})
+	require.NoError(t, err)
+	res, err = client.FetchOffset(ctx, &api.FetchOffsetRequest{Consumer: "group"})
+	require.NoError(t, err)
+	require.True(t, res.Found)
+	require.Equal(t, uint64(4), res.Offset)
+
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Offset: 4})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.CommitOffset(asPrincipal(context.Background(), "nobody-key"), &api.CommitOffsetRequest{Consumer: "group"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testGetOffsets(t *testing.T, client testClient, config *Config) {
+	ctx := asPrincipal(context.Background(), "root-key")
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+		require.NoError(t, err)
+	}
+	res, err := client.GetOffsets(ctx, &api.GetOffsetsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.LowWatermark)
+	require.Equal(t, uint64(3), res.HighWatermark)
+
+	_, err = client.GetOffsets(ctx, &api.GetOffsetsRequest{Partition: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testAdmin(t *testing.T, client testClient, config *Config) {
+	ctx := asPrincipal(context.Background(), "root-key")
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+		require.NoError(t, err)
+	}
+	segs, err := client.GetSegments(ctx, &api.GetSegmentsRequest{})
+	require.NoError(t, err)
+	require.Len(t, segs.Segments, 1)
+	require.Equal(t, uint64(3), segs.Segments[0].NextOffset)
+	require.NotZero(t, segs.Segments[0].StoreBytes)
+
+	// the active segment stays
+	res, err := client.DeleteRecords(ctx, &api.DeleteRecordsRequest{BeforeOffset: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.LowWatermark)
+
+	_, err = client.Snapshot(ctx, &api.SnapshotRequest{})
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+	_, err = client.DeleteRecords(asPrincipal(context.Background(), "nobody-key"), &api.DeleteRecordsRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testBackup(t *testing.T, client testClient, config *Config) {
+	ctx := asPrincipal(context.Background(), "root-key")
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}})
+	require.NoError(t, err)
+	stream, err := client.Backup(ctx, &api.BackupRequest{})
+	require.NoError(t, err)
+	var backup bytes.Buffer
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		backup.Write(res.Chunk)
+	}
+	var names []string
+	tr := tar.NewReader(&backup)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+	}
+	require.Equal(t, []string{log.BackupManifestName, "0.store", "0.index", "format.json", log.BackupChecksumsName}, names)
+
+	stream, err = client.Backup(ctx, &api.BackupRequest{Topic: "missing"})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	stream, err = client.Backup(asPrincipal(context.Background(), "nobody-key"), &api.BackupRequest{})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.LinkBackup(ctx, &api.LinkBackupRequest{Name: "nightly"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	config.LinkBackupDir = t.TempDir()
+	linked, err := client.LinkBackup(ctx, &api.LinkBackupRequest{Name: "nightly"})
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(config.LinkBackupDir, "nightly"), linked.Dir)
+	require.NotZero(t, linked.Files)
+	_, err = os.Stat(filepath.Join(linked.Dir, log.BackupManifestName))
+	require.NoError(t, err)
+	_, err = client.LinkBackup(ctx, &api.LinkBackupRequest{Name: "nightly"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = client.LinkBackup(ctx, &api.LinkBackupRequest{Name: "../nightly"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.LinkBackup(asPrincipal(context.Background(), "nobody-key"), &api.LinkBackupRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func testTopics(t *testing.T, client testClient, config *Config) {
+	ctx := asPrincipal(context.Background(), "root-key")
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}, Topic: "events"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{
+		Name:       "events",
+		Partitions: 2,
+		Configs:    map[string]string{"retention.ms": "60000"},
+	})
+	require.NoError(t, err)
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "events"})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "no/slashes"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{log.DefaultTopic, "events"}, list.Topics)
+	require.Equal(t, map[string]uint32{log.DefaultTopic: 1, "events": 2}, list.Partitions)
+	desc, err := client.DescribeTopic(ctx, &api.DescribeTopicRequest{Name: "events"})
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), desc.Topic.Partitions)
+	require.Equal(t, map[string]string{"retention.ms": "60000"}, desc.Topic.Configs)
+	_, err = client.DescribeTopic(ctx, &api.DescribeTopicRequest{Name: "missing"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// topics have their own offsets
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("default")}})
+	require.NoError(t, err)
+	produce, err := client.Produce(asPrincipal(context.Background(), "events-key"), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("event")},
+		Topic:  "events",
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "events"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("event"), consume.Record.Value)
+	produce, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:    &api.Record{Value: []byte("second partition")},
+		Topic:     "events",
+		Partition: 1,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "events", Partition: 2})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.CommitOffset(ctx, &api.CommitOffsetRequest{Consumer: "group", Topic: "events", Offset: 1})
+	require.NoError(t, err)
+	fetch, err := client.FetchOffset(ctx, &api.FetchOffsetRequest{Consumer: "group"})
+	require.NoError(t, err)
+	require.False(t, fetch.Found)
+
+	// configs apply to the next produce
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "invalid", Configs: map[string]string{"color": "blue"}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	alter, err := client.AlterTopicConfigs(ctx, &api.AlterTopicConfigsRequest{
+		Name:    "events",
+		Configs: map[string]string{"max.record.bytes": "64", "compression.type": "snappy", "retention.ms": ""},
+	})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"max.record.bytes": "64", "compression.type": "snappy"}, alter.Topic.Configs)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: make([]byte, 65)}, Topic: "events"})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	produce, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: make([]byte, 64)}, Topic: "events"})
+	require.NoError(t, err)
+	consume, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "events", Offset: produce.Offset})
+	require.NoError(t, err)
+	require.Equal(t, api.Codec_CODEC_SNAPPY, consume.Record.Codec)
+	for _, req := range []*api.AlterTopicConfigsRequest{
+		{Name: "events", Configs: map[string]string{"acks": "sometimes"}},
+		{Name: log.DefaultTopic, Configs: map[string]string{"acks": "all"}},
+	} {
+		_, err = client.AlterTopicConfigs(ctx, req)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+	_, err = client.AlterTopicConfigs(ctx, &api.AlterTopicConfigsRequest{Name: "missing"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.AlterTopicConfigs(asPrincipal(context.Background(), "events-key"), &api.AlterTopicConfigsRequest{Name: "events"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// partitions are added online, and produces that picked theirs by the
+	// topic's old version are told to pick again
+	added, err := client.CreatePartitions(ctx, &api.CreatePartitionsRequest{Name: "events", Partitions: 3})
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), added.Topic.Partitions)
+	require.Equal(t, uint64(1), added.Topic.Version)
+	list, err = client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), list.Partitions["events"])
+	require.Equal(t, uint64(1), list.Versions["events"])
+	stale, current := uint64(0), uint64(1)
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:       &api.Record{Value: []byte("event")},
+		Topic:        "events",
+		TopicVersion: &stale,
+	})
+	st := status.Convert(err)
+	require.Equal(t, codes.FailedPrecondition, st.Code())
+	require.Equal(t, "STALE_METADATA", st.Details()[0].(*errdetails.ErrorInfo).Reason)
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records:      []*api.Record{{Value: []byte("event")}},
+		Topic:        "events",
+		TopicVersion: &stale,
+	})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	produce, err = client.Produce(ctx, &api.ProduceRequest{
+		Record:       &api.Record{Value: []byte("third partition")},
+		Topic:        "events",
+		Partition:    2,
+		TopicVersion: &current,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), produce.Offset)
+	for _, req := range []*api.CreatePartitionsRequest{
+		{Name: "events", Partitions: 3},
+		{Name: log.DefaultTopic, Partitions: 2},
+	} {
+		_, err = client.CreatePartitions(ctx, req)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+	_, err = client.CreatePartitions(ctx, &api.CreatePartitionsRequest{Name: "missing", Partitions: 2})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.CreatePartitions(asPrincipal(context.Background(), "events-key"), &api.CreatePartitionsRequest{Name: "events", Partitions: 4})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// permissions are per topic
+	_, err = client.Produce(asPrincipal(context.Background(), "events-key"), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("event")},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	_, err = client.DeleteTopic(asPrincipal(context.Background(), "events-key"), &api.DeleteTopicRequest{Name: "events"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Name: log.DefaultTopic})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Name: "events"})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "events"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Name: "events"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func testProduceConsumeStream(t *testing.T, client testClient, config *Config) {
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	records := []*api.Record{{
+		Value:  []byte("first message"),
+		Offset: 0,
+	}, {
+		Value:  []byte("second message"),
+		Offset: 1,
+	}}
+
+	{
+		stream, err := client.ProduceStream(ctx)
+		require.NoError(t, err)
+
+		for offset, record := range records {
+			err = stream.Send(&api.ProduceRequest{
+				Record: record,
+			})
+			require.NoError(t, err)
+			res, err := stream.Recv()
+			require.NoError(t, err)
+			require.Equal(t, uint64(offset), res.Offset)
+		}
+
+		// answered once written, then again once synced
+		err = stream.Send(&api.ProduceRequest{
+			Record:        &api.Record{Value: []byte("third message")},
+			NotifyDurable: true,
+		})
+		require.NoError(t, err)
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), res.Offset)
+		require.False(t, res.Durable)
+		res, err = stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, uint64(2), res.Offset)
+		require.True(t, res.Durable)
+		require.Empty(t, res.DurabilityError)
+
+		_, err = client.Produce(ctx, &api.ProduceRequest{
+			Record:        &api.Record{Value: []byte("unary")},
+			NotifyDurable: true,
+		})
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+
+	{
+		stream, err := client.ConsumeStream(
+			ctx,
+			&api.ConsumeRequest{Offset: 0},
+		)
+		require.NoError(t, err)
+
+		for i, record := range records {
+			res, err := stream.Recv()
+			require.NoError(t, err)
+			require.Equal(t, record.Value, res.Record.Value)
+			require.Equal(t, uint64(i), res.Record.Offset)
+		}
+	}
+}
+
+func testUnauthorized(t *testing.T, client testClient, config *Config) {
+	ctx := asPrincipal(context.Background(), "nobody-key")
+	produce, err := client.Produce(ctx,
+		&api.ProduceRequest{
+			Record: &api.Record{
+				Value: []byte("hello world"),
+			},
+		},
+	)
+	require.Nil(t, produce)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	_, err = client.Consume(context.Background(), &api.ConsumeRequest{Offset: 0})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+// notLeaderLog turns away every append, as a follower's log does
+type notLeaderLog struct {
+	CommitLog
+	leader string
+}
+
+func (l notLeaderLog) Append(*api.Record) (uint64, error) {
+	return 0, api.ErrNotLeader{Leader: l.leader}
+}
+
+// pendingLog acknowledges every append below ACK_ALL before it commits
+type pendingLog struct {
+	CommitLog
+	acks []api.Ack
+}
+
+func (l *pendingLog) AppendAck(record *api.Record, ack api.Ack) (uint64, bool, error) {
+	l.acks = append(l.acks, ack)
+	if ack == api.Ack_ACK_ALL {
+		return 7, false, nil
+	}
+	return 0, true, nil
+}
+
+func TestProduceAck(t *testing.T) {
+	clog := &pendingLog{}
+	client, _, teardown := setupTest(t, func(c *Config) {
+		clog.CommitLog = c.CommitLog
+		c.CommitLog = clog
+	})
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	res, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Ack:    api.Ack_ACK_ALL,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), res.Offset)
+	require.False(t, res.Pending)
+
+	res, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Ack:    api.Ack_ACK_NONE,
+	})
+	require.NoError(t, err)
+	require.True(t, res.Pending)
+	require.Equal(t, []api.Ack{api.Ack_ACK_ALL, api.Ack_ACK_NONE}, clog.acks)
+}
+
+func TestProduceForwarding(t *testing.T) {
+	// the leader checks the caller's credentials itself
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	leaderLog := NewLog()
+	leader, err := NewGRPCServer(&Config{
+		CommitLog: leaderLog,
+		Authenticator: auth.APIKeyAuthenticator{Keys: map[string]string{
+			"root-key": "root",
+		}},
+	})
+	require.NoError(t, err)
+	go leader.Serve(ln)
+	defer leader.Stop()
+
+	ctx := asPrincipal(context.Background(), "root-key")
+	record := &api.Record{Value: []byte("hello world")}
+
+	t.Run("forwards to the leader", func(t *testing.T) {
+		client, _, teardown := setupTest(t, func(c *Config) {
+			c.CommitLog = notLeaderLog{CommitLog: c.CommitLog, leader: ln.Addr().String()}
+		})
+		defer teardown()
+
+		res, err := client.Produce(ctx, &api.ProduceRequest{Record: record})
+		require.NoError(t, err)
+		got, err := leaderLog.Read(res.Offset)
+		require.NoError(t, err)
+		require.Equal(t, record.Value, got.Value)
+
+		batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: []*api.Record{record, record}})
+		require.NoError(t, err)
+		require.Equal(t, []uint64{res.Offset + 1, res.Offset + 2}, batch.Offsets)
+	})
+
+	t.Run("disabled answers not leader", func(t *testing.T) {
+		client, _, teardown := setupTest(t, func(c *Config) {
+			c.CommitLog = notLeaderLog{CommitLog: c.CommitLog, leader: ln.Addr().String()}
+			c.DisableForwarding = true
+		})
+		defer teardown()
+
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: record})
+		st := status.Convert(err)
+		require.Equal(t, codes.FailedPrecondition, st.Code())
+		require.Len(t, st.Details(), 1)
+		info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+		require.True(t, ok)
+		require.Equal(t, "NOT_LEADER", info.Reason)
+		require.Equal(t, ln.Addr().String(), info.Metadata["leader"])
+	})
+
+	t.Run("forwarded requests aren't forwarded again", func(t *testing.T) {
+		client, _, teardown := setupTest(t, func(c *Config) {
+			c.CommitLog = notLeaderLog{CommitLog: c.CommitLog, leader: ln.Addr().String()}
+		})
+		defer teardown()
+
+		ctx := metadata.AppendToOutgoingContext(ctx, forwardedHeader, "true")
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: record})
+		require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	})
+}
+
+func TestAutoCreateTopics(t *testing.T) {
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.AutoCreateTopics = true
+	})
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	res, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("hello")}, Topic: "events"})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{
+		Records: []*api.Record{{Value: []byte("a")}, {Value: []byte("b")}},
+		Topic:   "clicks",
+	})
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 1}, batch.Offsets)
+	list, err := client.ListTopics(ctx, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"clicks", log.DefaultTopic, "events"}, list.Topics)
+	require.Equal(t, uint32(1), list.Partitions["events"])
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: res.Offset, Topic: "events"})
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello"), consume.Record.Value)
+
+	// names that can't be topics, and partitions past the one created, still fail
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{}, Topic: "no/slashes"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{}, Topic: "views", Partition: 1})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestGroupOffsets(t *testing.T) {
+	client, config, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	fetch := func(group string) []*api.GroupOffset {
+		res, err := client.FetchGroupOffsets(ctx, &api.FetchGroupOffsetsRequest{
+			Group:      group,
+			Partitions: []*api.GroupOffset{{Partition: 0}, {Topic: "events", Partition: 1}},
+		})
+		require.NoError(t, err)
+		return res.Offsets
+	}
+	// nothing's committed before the offsets topic exists
+	for _, o := range fetch("readers") {
+		require.False(t, o.Found)
+	}
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "events", Partitions: 2})
+	require.NoError(t, err)
+	for _, off := range []uint64{3, 7} {
+		_, err = client.CommitGroupOffsets(ctx, &api.CommitGroupOffsetsRequest{
+			Group:   "readers",
+			Offsets: []*api.GroupOffset{{Offset: off}, {Topic: "events", Partition: 1, Offset: off + 1}},
+		})
+		require.NoError(t, err)
+	}
+	offsets := fetch("readers")
+	require.Equal(t, uint64(7), offsets[0].Offset)
+	require.True(t, offsets[0].Found)
+	require.Equal(t, uint64(8), offsets[1].Offset)
+	require.Equal(t, "events", offsets[1].Topic)
+	require.False(t, fetch("writers")[0].Found)
+
+	// resets move offsets past the partitions' records, and those never
+	// committed, as the fetch says
+	reset := func(group string, policy api.OffsetReset) ([]*api.GroupOffset, error) {
+		res, err := client.FetchGroupOffsets(ctx, &api.FetchGroupOffsetsRequest{
+			Group:       group,
+			Partitions:  []*api.GroupOffset{{Topic: "events", Partition: 1}},
+			OffsetReset: policy,
+		})
+		return res.GetOffsets(), err
+	}
+	offsets, err = reset("readers", api.OffsetReset_OFFSET_RESET_EARLIEST)
+	require.NoError(t, err)
+	require.Zero(t, offsets[0].Offset)
+	require.True(t, offsets[0].Found)
+	require.True(t, offsets[0].WasReset)
+	_, err = reset("readers", api.OffsetReset_OFFSET_RESET_ERROR)
+	require.Equal(t, codes.NotFound, status.Code(err))
+	require.ErrorContains(t, err, "offset out of range: 8")
+	_, err = reset("writers", api.OffsetReset_OFFSET_RESET_ERROR)
+	require.ErrorContains(t, err, "no offset committed to topic events partition 1")
+	_, err = reset("writers", 9)
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	// the offsets are in a compacted internal topic
+	desc, err := client.DescribeTopic(ctx, &api.DescribeTopicRequest{Name: log.OffsetsTopic})
+	require.NoError(t, err)
+	require.Equal(t, "compact", desc.Topic.Configs[log.CleanupPolicyConfig])
+
+	_, err = client.CommitGroupOffsets(ctx, &api.CommitGroupOffsetsRequest{Offsets: []*api.GroupOffset{{}}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.FetchGroupOffsets(asPrincipal(context.Background(), "events-key"), &api.FetchGroupOffsetsRequest{
+		Group:      "readers",
+		Partitions: []*api.GroupOffset{{Topic: "events"}},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// and outlive the server
+	topics := config.CommitLog.(*log.Topics)
+	require.NoError(t, topics.Close())
+	reopened, err := log.NewTopics(topics.Dir, log.Config{})
+	require.NoError(t, err)
+	defer reopened.Remove()
+	res, err := (&Config{CommitLog: reopened, groups: &groupOffsets{}}).fetchGroupOffsets(&api.FetchGroupOffsetsRequest{
+		Group:      "readers",
+		Partitions: []*api.GroupOffset{{Topic: "events", Partition: 1}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(8), res[0].Offset)
+	require.True(t, res[0].Found)
+}
+
+func TestGroups(t *testing.T) {
+	client, config, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "events", Partitions: 4})
+	require.NoError(t, err)
+
+	partitions := func(ps ...uint32) []*api.GroupOffset {
+		var offsets []*api.GroupOffset
+		for _, p := range ps {
+			offsets = append(offsets, &api.GroupOffset{Topic: "events", Partition: p})
+		}
+		return offsets
+	}
+	heartbeat := func(member string, owned []*api.GroupOffset) *api.JoinGroupResponse {
+		res, err := client.JoinGroup(ctx, &api.JoinGroupRequest{
+			Group:    "readers",
+			MemberId: member,
+			Topics:   []string{"events"},
+			Owned:    owned,
+		})
+		require.NoError(t, err)
+		return res
+	}
+	assigned := func(res *api.JoinGroupResponse) []uint32 {
+		var ps []uint32
+		for _, a := range res.Assignments {
+			require.Equal(t, "events", a.Topic)
+			ps = append(ps, a.Partition)
+		}
+		return ps
+	}
+
+	// the first member gets every partition, straight away since the
+	// offsets topic is new
+	a := heartbeat("", nil)
+	require.NotEmpty(t, a.MemberId)
+	require.Equal(t, []uint32{0, 1, 2, 3}, assigned(a))
+	require.Equal(t, uint64(1), a.Generation)
+
+	// a second gets its half only once the first stops consuming it, the
+	// first keeping the rest throughout
+	b := heartbeat("", nil)
+	require.Equal(t, uint64(2), b.Generation)
+	require.Empty(t, b.Assignments)
+	res := heartbeat(a.MemberId, partitions(0, 1, 2, 3))
+	require.Equal(t, []uint32{0, 1}, assigned(res))
+	require.Empty(t, heartbeat(b.MemberId, nil).Assignments)
+	heartbeat(a.MemberId, partitions(0, 1))
+	require.Equal(t, []uint32{2, 3}, assigned(heartbeat(b.MemberId, nil)))
+
+	// added partitions are shared out, in member ID order, without moving
+	// the others
+	_, err = client.CreatePartitions(ctx, &api.CreatePartitionsRequest{Name: "events", Partitions: 6})
+	require.NoError(t, err)
+	added := map[string]uint32{a.MemberId: 4, b.MemberId: 5}
+	if b.MemberId < a.MemberId {
+		added = map[string]uint32{a.MemberId: 5, b.MemberId: 4}
+	}
+	res = heartbeat(a.MemberId, partitions(0, 1))
+	require.Equal(t, uint64(3), res.Generation)
+	require.Equal(t, []uint32{0, 1, added[a.MemberId]}, assigned(res))
+	require.Equal(t, []uint32{2, 3, added[b.MemberId]}, assigned(heartbeat(b.MemberId, partitions(2, 3))))
+
+	// a member leaving hands its partitions over
+	_, err = client.LeaveGroup(ctx, &api.LeaveGroupRequest{Group: "readers", MemberId: b.MemberId})
+	require.NoError(t, err)
+	res = heartbeat(a.MemberId, partitions(0, 1, added[a.MemberId]))
+	require.Equal(t, []uint32{0, 1, 2, 3, 4, 5}, assigned(res))
+	_, err = client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "readers", MemberId: b.MemberId})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// and so does one whose session times out
+	c, err := client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "readers", Topics: []string{"events"}, SessionTimeoutMs: 50})
+	require.NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	res = heartbeat(a.MemberId, partitions(0, 1, 2, 3, 4, 5))
+	require.Len(t, res.Assignments, 6)
+	_, err = client.JoinGroup(ctx, &api.JoinGroupRequest{Group: "readers", MemberId: c.MemberId})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.JoinGroup(ctx, &api.JoinGroupRequest{Topics: []string{"events"}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.JoinGroup(asPrincipal(context.Background(), "events-key"), &api.JoinGroupRequest{
+		Group:  "readers",
+		Topics: []string{"events"},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// a new coordinator hands out nothing until the last one's members
+	// have timed out
+	restarted := &Config{CommitLog: config.CommitLog, Logger: config.Logger, coordinator: newGroupCoordinator()}
+	join := &api.JoinGroupRequest{Group: "readers", Topics: []string{"events"}, SessionTimeoutMs: 200}
+	for _, n := range []int{0, 0, 6} {
+		res, err = restarted.joinGroup(join)
+		require.NoError(t, err)
+		require.Len(t, res.Assignments, n)
+		join.MemberId = res.MemberId
+		time.Sleep(120 * time.Millisecond)
+	}
+}
+
+func TestStaticGroupMembers(t *testing.T) {
+	client, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "events", Partitions: 4})
+	require.NoError(t, err)
+	join := func(member, instance string) (*api.JoinGroupResponse, error) {
+		return client.JoinGroup(ctx, &api.JoinGroupRequest{
+			Group:      "readers",
+			MemberId:   member,
+			InstanceId: instance,
+			Topics:     []string{"events"},
+		})
+	}
+	a, err := join("", "host-a")
+	require.NoError(t, err)
+	b, err := join("", "host-b")
+	require.NoError(t, err)
+	a, err = join(a.MemberId, "host-a")
+	require.NoError(t, err)
+	b, err = join(b.MemberId, "host-b")
+	require.NoError(t, err)
+	require.Len(t, b.Assignments, 2)
+
+	// a static member restarting takes its partitions straight back,
+	// without a rebalance
+	restarted, err := join("", "host-b")
+	require.NoError(t, err)
+	require.NotEqual(t, b.MemberId, restarted.MemberId)
+	require.Equal(t, b.Generation, restarted.Generation)
+	require.Equal(t, b.Assignments, restarted.Assignments)
+	// and the one it replaced is fenced
+	_, err = join(b.MemberId, "host-b")
+	require.ErrorContains(t, err, "instance host-b of group readers joined again elsewhere")
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	a2, err := join(a.MemberId, "host-a")
+	require.NoError(t, err)
+	require.Equal(t, a.Assignments, a2.Assignments)
+}
+
+func TestStickyAssign(t *testing.T) {
+	count := func(assigned map[uint32]string) map[string]int {
+		counts := make(map[string]int)
+		for _, id := range assigned {
+			counts[id]++
+		}
+		return counts
+	}
+	// a joining member takes only its share, from the members over theirs
+	current := map[uint32]string{0: "a", 1: "a", 2: "a", 3: "b", 4: "b", 5: "b"}
+	assigned := stickyAssign(6, []string{"a", "b", "c"}, current)
+	require.Equal(t, map[string]int{"a": 2, "b": 2, "c": 2}, count(assigned))
+	moved := 0
+	for p, id := range assigned {
+		if current[p] != id {
+			moved++
+		}
+	}
+	require.Equal(t, 2, moved)
+
+	// a leaving one's partitions are all that move
+	before := assigned
+	assigned = stickyAssign(6, []string{"a", "c"}, before)
+	require.Equal(t, map[string]int{"a": 3, "c": 3}, count(assigned))
+	for p, id := range before {
+		if id != "b" {
+			require.Equal(t, id, assigned[p], "partition %d", p)
+		}
+	}
+
+	// the members holding the most keep the extra partitions
+	assigned = stickyAssign(5, []string{"a", "b"}, map[uint32]string{0: "b", 1: "b", 2: "b", 3: "a"})
+	require.Equal(t, map[string]int{"a": 2, "b": 3}, count(assigned))
+	require.Equal(t, "a", assigned[4])
+}
+
+func TestGroupLag(t *testing.T) {
+	client, config, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	// nothing's behind before any group commits
+	res, err := client.GetGroupLag(ctx, &api.GetGroupLagRequest{})
+	require.NoError(t, err)
+	require.Empty(t, res.Lags)
+
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "events", Partitions: 2})
+	require.NoError(t, err)
+	for p, n := range []int{5, 2} {
+		for i := 0; i < n; i++ {
+			_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{}, Topic: "events", Partition: uint32(p)})
+			require.NoError(t, err)
+		}
+	}
+	commit := func(group string, offsets ...uint64) {
+		req := &api.CommitGroupOffsetsRequest{Group: group}
+		for p, off := range offsets {
+			req.Offsets = append(req.Offsets, &api.GroupOffset{Topic: "events", Partition: uint32(p), Offset: off})
+		}
+		_, err := client.CommitGroupOffsets(ctx, req)
+		require.NoError(t, err)
+	}
+	commit("readers", 3, 2)
+	commit("writers", 9)
+	res, err = client.GetGroupLag(ctx, &api.GetGroupLagRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Lags, 3)
+	for i, want := range []*api.GroupLag{
+		{Group: "readers", Topic: "events", Partition: 0, Committed: 3, HighWatermark: 5, Lag: 2},
+		{Group: "readers", Topic: "events", Partition: 1, Committed: 2, HighWatermark: 2, Lag: 0},
+		// a commit past the end isn't behind
+		{Group: "writers", Topic: "events", Partition: 0, Committed: 9, HighWatermark: 5, Lag: 0},
+	} {
+		require.True(t, proto.Equal(want, res.Lags[i]), res.Lags[i])
+	}
+	res, err = client.GetGroupLag(ctx, &api.GetGroupLagRequest{Group: "writers"})
+	require.NoError(t, err)
+	require.Len(t, res.Lags, 1)
+
+	// the lag's scraped as gauges, and leaves out deleted topics
+	stop := ReportGroupLag(config)
+	defer stop()
+	require.NoError(t, testutil.CollectAndCompare(groupLags, strings.NewReader(`
+# HELP proglog_consumer_group_lag Records a group's committed offset is behind its partition's high watermark.
+# TYPE proglog_consumer_group_lag gauge
+proglog_consumer_group_lag{group="readers",partition="0",topic="events"} 2
+proglog_consumer_group_lag{group="readers",partition="1",topic="events"} 0
+proglog_consumer_group_lag{group="writers",partition="0",topic="events"} 0
+`)))
+	_, err = client.DeleteTopic(ctx, &api.DeleteTopicRequest{Name: "events"})
+	require.NoError(t, err)
+	require.Zero(t, testutil.CollectAndCount(groupLags))
+
+	_, err = client.GetGroupLag(asPrincipal(context.Background(), "events-key"), &api.GetGroupLagRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
+
+func TestConsumeMinOffset(t *testing.T) {
+	client, config, teardown := setupTest(t, func(c *Config) {
+		c.MinOffsetTimeout = 500 * time.Millisecond
+	})
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	minOffset := uint64(1)
+
+	_, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0, MinOffset: &minOffset})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// the records replicate while the consume waits
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		for _, v := range []string{"first", "second"} {
+			config.CommitLog.Append(&api.Record{Value: []byte(v)})
+		}
+	}()
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0, MinOffset: &minOffset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("first"), res.Record.Value)
+}
+
+func TestConsumeFetch(t *testing.T) {
+	client, config, teardown := setupTest(t, func(c *Config) {
+		c.MaxConsumeWait = 300 * time.Millisecond
+	})
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	// an empty partition holds the fetch until it times out
+	start := time.Now()
+	res, err := client.Consume(ctx, &api.ConsumeRequest{MaxWaitMs: 100})
+	require.NoError(t, err)
+	require.Empty(t, res.Records)
+	require.Nil(t, res.Record)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// it answers once enough records arrive
+	go func() {
+		for _, v := range []string{"first", "second", "third"} {
+			time.Sleep(20 * time.Millisecond)
+			config.CommitLog.Append(&api.Record{Value: []byte(v)})
+		}
+	}()
+	res, err = client.Consume(ctx, &api.ConsumeRequest{MaxWaitMs: 5000, MinBytes: 11})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 2)
+	require.Equal(t, []byte("first"), res.Record.Value)
+	require.Equal(t, []byte("second"), res.Records[1].Value)
+	require.Equal(t, uint64(1), res.Records[1].Offset)
+
+	// with what it has when the server's max wait is up
+	start = time.Now()
+	res, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1, MaxWaitMs: 5000, MinBytes: 1 << 20})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 2)
+	require.Less(t, time.Since(start), 2*time.Second)
+
+	// and straight away when the first records are enough
+	res, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 2, MinBytes: 1})
+	require.NoError(t, err)
+	require.Len(t, res.Records, 1)
+	require.Equal(t, []byte("third"), res.Record.Value)
+}
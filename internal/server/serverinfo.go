@@ -0,0 +1,71 @@
+package server
+
+import (
+	"context"
+	"maps"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	collogspb "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+)
+
+// The features the server enabled, with those Config.Features says the
+// process did
+func (c *Config) features() map[string]bool {
+	_, replicated := c.CommitLog.(clusterLog)
+	_, topics := c.CommitLog.(topicLog)
+	features := map[string]bool{
+		"authentication":       c.Authenticator != nil,
+		"acl":                  c.Authorizer != nil,
+		"replication":          replicated,
+		"topics":               topics,
+		"forwarding":           !c.DisableForwarding,
+		"auto_create_topics":   c.AutoCreateTopics,
+		"append_batching":      c.AppendBatchWindow > 0,
+		"quotas":               c.Quotas != nil,
+		"scan_throttle":        c.ScanThrottle != nil,
+		"scheduler":            c.Scheduler != nil,
+		"transforms":           c.Transforms != nil,
+		"routes":               c.Routes != nil,
+		"otlp_logs":            c.OTLPLogsTopic != "",
+		"trace_record_headers": c.TraceRecordHeaders,
+		"reload":               c.Reload != nil,
+	}
+	maps.Copy(features, c.Features)
+	return features
+}
+
+// Describes what the server runs: its build, settings, features and the
+// APIs it serves, the Kafka protocol's when the process enabled it
+func (c *Config) describeServer() *api.DescribeServerResponse {
+	res := &api.DescribeServerResponse{
+		Version:  c.Version,
+		Features: c.features(),
+		ApiVersions: []*api.ApiVersion{
+			{Api: "grpc", Name: api.Log_ServiceDesc.ServiceName},
+			{Api: "grpc", Name: api.Admin_ServiceDesc.ServiceName},
+			{Api: "grpc", Name: collogspb.LogsService_ServiceDesc.ServiceName},
+		},
+	}
+	if c.Settings != nil {
+		res.Settings = c.Settings()
+	}
+	if res.Features["kafka"] {
+		for _, a := range kafkaAPIs {
+			res.ApiVersions = append(res.ApiVersions, &api.ApiVersion{
+				Api:        "kafka",
+				Name:       kafkaAPIName(a.key),
+				MinVersion: int32(a.min),
+				MaxVersion: int32(a.max),
+			})
+		}
+	}
+	return res
+}
+
+// Describes the server, to anyone who may administer its config
+func (s *grpcServer) DescribeServer(ctx context.Context, req *api.DescribeServerRequest) (*api.DescribeServerResponse, error) {
+	if err := s.authorize(ctx, adminAction, configResource); err != nil {
+		return nil, err
+	}
+	return s.describeServer(), nil
+}
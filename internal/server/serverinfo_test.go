@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDescribeServer(t *testing.T) {
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Version = "v1.2.3"
+		c.Features = map[string]bool{"tls": true, "kafka": true}
+		c.Settings = func() []*api.ServerSetting {
+			return []*api.ServerSetting{{Key: "security.api_keys", Value: "REDACTED", Source: "default", Secret: true}}
+		}
+	})
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	res, err := client.DescribeServer(ctx, &api.DescribeServerRequest{})
+	require.NoError(t, err)
+	require.Equal(t, "v1.2.3", res.Version)
+	require.Equal(t, "REDACTED", res.Settings[0].Value)
+	require.True(t, res.Features["tls"])
+	require.True(t, res.Features["acl"])
+	require.True(t, res.Features["topics"])
+	require.False(t, res.Features["replication"])
+	require.Equal(t, &api.ApiVersion{Api: "grpc", Name: "log.v1.Log"}, res.ApiVersions[0])
+	var kafka []string
+	for _, v := range res.ApiVersions {
+		if v.Api == "kafka" {
+			kafka = append(kafka, v.Name)
+		}
+	}
+	require.Contains(t, kafka, "Produce")
+
+	events := asPrincipal(context.Background(), "events-key")
+	_, err = client.DescribeServer(events, &api.DescribeServerRequest{})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// The records each webhook POST carries at most, when its subscription
+// doesn't say, and at most whatever it says
+const (
+	defaultWebhookBatch = 100
+	maxWebhookBatch     = 10000
+)
+
+var subscriptionName = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,249}$`)
+
+// The consumer group keeping the subscription's cursors
+func subscriptionGroup(name string) string {
+	return "__subscription." + name
+}
+
+// subscriptions are the webhook subscriptions, read from the subscriptions
+// topic's partition as far as this server has it. Each record holds a
+// subscription keyed by its name, so compaction keeps the latest, or no
+// value for one deleted.
+type subscriptions struct {
+	mu sync.Mutex
+	// the partition the subscriptions were read from, they're read again if
+	// the topic's recreated
+	partition CommitLog
+	next      uint64
+	byName    map[string]*api.Subscription
+}
+
+// Reads the subscriptions appended to cl since the last read
+func (s *subscriptions) catchUp(cl CommitLog) error {
+	if cl != s.partition {
+		s.partition, s.next, s.byName = cl, 0, make(map[string]*api.Subscription)
+	}
+	if cl == nil {
+		return nil
+	}
+	for {
+		record, next, err := readFrom(cl, s.next)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		s.next = next
+		var sub api.Subscription
+		if codec.Decompress(record) == nil && proto.Unmarshal(record.Value, &sub) == nil {
+			if len(record.Value) == 0 {
+				delete(s.byName, string(record.Key))
+			} else {
+				s.byName[sub.Name] = &sub
+			}
+		}
+	}
+}
+
+// The subscriptions in name order, as far as this server has read them
+func (c *Config) listSubscriptions() ([]*api.Subscription, error) {
+	cl, err := c.subscriptionsPartition(false)
+	if errors.As(err, &api.ErrTopicNotFound{}) {
+		cl, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.subscriptions.mu.Lock()
+	defer c.subscriptions.mu.Unlock()
+	if err := c.subscriptions.catchUp(cl); err != nil {
+		return nil, err
+	}
+	subs := slices.Collect(maps.Values(c.subscriptions.byName))
+	slices.SortFunc(subs, func(a, b *api.Subscription) int { return strings.Compare(a.Name, b.Name) })
+	return subs, nil
+}
+
+// The subscription by its name
+func (c *Config) subscription(name string) (*api.Subscription, error) {
+	subs, err := c.listSubscriptions()
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subs {
+		if sub.Name == name {
+			return sub, nil
+		}
+	}
+	return nil, api.ErrSubscriptionNotFound{Subscription: name}
+}
+
+// Checks the subscription is one the servers can deliver
+func validateSubscription(sub *api.Subscription) error {
+	if !subscriptionName.MatchString(sub.Name) {
+		return fmt.Errorf("invalid subscription name %q", sub.Name)
+	}
+	if sub.MaxBatch > maxWebhookBatch {
+		return fmt.Errorf("max batch %d is over %d", sub.MaxBatch, maxWebhookBatch)
+	}
+	if sub.MaxAttempts > 0 && sub.DeadLetterTopic == "" {
+		return errors.New("max attempts without a dead-letter topic")
+	}
+	if sub.DeadLetterTopic != "" && topicResource(sub.DeadLetterTopic) == sub.Topic {
+		return errors.New("the dead-letter topic is the subscription's topic")
+	}
+	u, err := url.Parse(sub.Url)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("url %q isn't https", sub.Url)
+	}
+	return nil
+}
+
+// Adds the subscription, its cursors starting at the topic's high
+// watermarks unless it delivers from the beginning. header holds the
+// caller's request headers.
+func (c *Config) createSubscription(ctx context.Context, sub *api.Subscription, header http.Header) error {
+	sub.Topic = topicResource(sub.Topic)
+	if err := validateSubscription(sub); err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	topic, err := c.describeTopic(sub.Topic)
+	if err != nil {
+		return err
+	}
+	if sub.DeadLetterTopic != "" {
+		if _, err := c.describeTopic(sub.DeadLetterTopic); err != nil {
+			return err
+		}
+	}
+	// only the leader appends, so the cursors aren't committed elsewhere
+	cl, err := c.subscriptionsPartition(true)
+	if err != nil {
+		return err
+	}
+	if err := notLeading(cl); err != nil {
+		return err
+	}
+	if _, err := c.subscription(sub.Name); err == nil {
+		return api.ErrSubscriptionExists{Subscription: sub.Name}
+	} else if !errors.As(err, &api.ErrSubscriptionNotFound{}) {
+		return err
+	}
+	if !sub.FromBeginning {
+		commit := &api.CommitGroupOffsetsRequest{Group: subscriptionGroup(sub.Name)}
+		for p := range topic.Partitions {
+			part, err := c.partition(sub.Topic, p)
+			if err != nil {
+				return err
+			}
+			if sl, ok := part.(statsLog); ok {
+				commit.Offsets = append(commit.Offsets, &api.GroupOffset{Topic: sub.Topic, Partition: p, Offset: sl.Stats().HighWatermark})
+			}
+		}
+		if len(commit.Offsets) > 0 {
+			if err := c.commitGroupOffsets(ctx, commit, header); err != nil {
+				return err
+			}
+		}
+	}
+	value, err := proto.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.appendTo(ctx, cl, &api.Record{Key: []byte(sub.Name), Value: value}, api.Ack_ACK_ALL, log.SubscriptionsTopic, 0)
+	return err
+}
+
+// Deletes the subscription, its deliveries stopping once the servers read
+// it's gone
+func (c *Config) deleteSubscription(ctx context.Context, name string) error {
+	if _, err := c.subscription(name); err != nil {
+		return err
+	}
+	cl, err := c.subscriptionsPartition(false)
+	if err != nil {
+		return err
+	}
+	_, _, err = c.appendTo(ctx, cl, &api.Record{Key: []byte(name)}, api.Ack_ACK_ALL, log.SubscriptionsTopic, 0)
+	return err
+}
+
+// Fails with api.ErrNotLeader unless this server leads the partition, or
+// there's no leader to it
+func notLeading(cl CommitLog) error {
+	if ll, ok := cl.(leaderLog); ok {
+		if _, leader := ll.LeaderTerm(); !leader {
+			return api.ErrNotLeader{Leader: ll.Leader()}
+		}
+	}
+	return nil
+}
+
+// The subscriptions topic's partition, created first with create if
+// there's none. It's kept as the offsets topic is.
+func (c *Config) subscriptionsPartition(create bool) (CommitLog, error) {
+	tl, ok := c.CommitLog.(topicLog)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "log can't keep subscriptions")
+	}
+	cl, err := c.partition(log.SubscriptionsTopic, 0)
+	if !create || !errors.As(err, &api.ErrTopicNotFound{}) {
+		return cl, err
+	}
+	err = tl.CreateTopic(&api.Topic{Name: log.SubscriptionsTopic, Partitions: 1, Configs: offsetsTopicConfigs})
+	if err != nil && !errors.As(err, &api.ErrTopicExists{}) {
+		return nil, err
+	}
+	if err == nil {
+		c.Logger.Info("created subscriptions topic", zap.String("topic", log.SubscriptionsTopic))
+	}
+	return c.partition(log.SubscriptionsTopic, 0)
+}
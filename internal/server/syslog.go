@@ -0,0 +1,452 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"go.uber.org/zap"
+)
+
+// ErrSyslogServerClosed is returned by SyslogServer's Serve methods once
+// it's closed
+var ErrSyslogServerClosed = errors.New("server: syslog server closed")
+
+const (
+	// Syslog messages longer than this are cut short over UDP and close
+	// their connection over TCP
+	syslogMaxMessage = 64 << 10
+	// How many messages the syslog server queues, and appends at once
+	syslogQueueSize = 4096
+	syslogBatchSize = 512
+)
+
+// SyslogServer takes syslog messages over UDP and TCP, RFC 5424 ones or
+// the BSD ones of RFC 3164, and appends each to its topic. The message is
+// the record's value and its host the key, so each host's messages keep
+// their order in one partition, and the record has headers for the host,
+// severity and facility, and for the app, process ID, message ID and
+// structured data when the message has them.
+//
+// TCP connections frame messages by octet counting or with newlines, as
+// RFC 6587 has them. Senders aren't authenticated: screen them with the
+// agent's IPFilter. UDP messages are dropped when the server can't append
+// them as fast as they come, TCP messages wait.
+type SyslogServer struct {
+	config *Config
+	topic  string
+	queue  chan *api.Record
+	// readers are the goroutines queueing messages, and writer the one
+	// appending them
+	readers sync.WaitGroup
+	writer  sync.WaitGroup
+
+	mu     sync.Mutex
+	closed bool
+	conns  map[io.Closer]struct{}
+}
+
+// NewSyslogServer appends the syslog messages it serves to the topic, the
+// default topic when it's empty, or to those the config's Routes pick when
+// it's IngestTopic
+func NewSyslogServer(topic string, config *Config) *SyslogServer {
+	s := &SyslogServer{
+		config: withDefaults(config),
+		topic:  topic,
+		queue:  make(chan *api.Record, syslogQueueSize),
+		conns:  make(map[io.Closer]struct{}),
+	}
+	s.writer.Add(1)
+	go s.write()
+	return s
+}
+
+// ServeUDP takes a message from each packet until the server's closed,
+// returning ErrSyslogServerClosed
+func (s *SyslogServer) ServeUDP(pc net.PacketConn) error {
+	if !s.track(pc) {
+		return ErrSyslogServerClosed
+	}
+	defer s.readers.Done()
+	buf := make([]byte, syslogMaxMessage)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if s.isClosed() {
+				return ErrSyslogServerClosed
+			}
+			return err
+		}
+		syslogMessages.WithLabelValues("udp").Inc()
+		record := parseSyslog(bytes.TrimRight(buf[:n], "\r\n\x00"), remoteHost(addr), time.Now())
+		select {
+		case s.queue <- record:
+		default:
+			syslogMessagesDropped.Inc()
+		}
+	}
+}
+
+// ServeTCP takes messages from the connections the listener accepts until
+// the server's closed, returning ErrSyslogServerClosed
+func (s *SyslogServer) ServeTCP(ln net.Listener) error {
+	if !s.track(ln) {
+		return ErrSyslogServerClosed
+	}
+	defer s.readers.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrSyslogServerClosed
+			}
+			return err
+		}
+		if !s.track(conn) {
+			conn.Close()
+			return ErrSyslogServerClosed
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *SyslogServer) serveConn(conn net.Conn) {
+	defer s.readers.Done()
+	defer s.untrack(conn)
+	host := remoteHost(conn.RemoteAddr())
+	r := bufio.NewReaderSize(conn, syslogMaxMessage)
+	for {
+		msg, err := readSyslogFrame(r)
+		if len(msg) > 0 {
+			syslogMessages.WithLabelValues("tcp").Inc()
+			s.queue <- parseSyslog(msg, host, time.Now())
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !s.isClosed() {
+				s.config.Logger.Info("syslog connection closed", zap.String("remote_addr", conn.RemoteAddr().String()), zap.Error(err))
+			}
+			return
+		}
+	}
+}
+
+// Tracks the listener or connection to close with the server, as a reader
+// to wait for, unless it's closed already
+func (s *SyslogServer) track(c io.Closer) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[c] = struct{}{}
+	s.readers.Add(1)
+	return true
+}
+
+func (s *SyslogServer) untrack(c io.Closer) {
+	c.Close()
+	s.mu.Lock()
+	delete(s.conns, c)
+	s.mu.Unlock()
+}
+
+func (s *SyslogServer) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+// Close stops taking messages, closing the listeners and connections, and
+// waits for the ones taken to be appended
+func (s *SyslogServer) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.readers.Wait()
+	close(s.queue)
+	s.writer.Wait()
+	return nil
+}
+
+// Appends the queued messages, as many at once as are queued up to a
+// batch
+func (s *SyslogServer) write() {
+	defer s.writer.Done()
+	for record := range s.queue {
+		batch := []*api.Record{record}
+	fill:
+		for len(batch) < syslogBatchSize {
+			select {
+			case record, ok := <-s.queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, record)
+			default:
+				break fill
+			}
+		}
+		s.append(batch)
+	}
+}
+
+// Appends the messages to the partitions their hosts hash to
+func (s *SyslogServer) append(records []*api.Record) {
+	if s.topic == IngestTopic {
+		s.ingest(records)
+		return
+	}
+	partitions := uint32(1)
+	if topic, err := s.config.describeTopic(s.topic); err == nil {
+		partitions = topic.Partitions
+	}
+	byPartition := make(map[uint32][]*api.Record)
+	for _, record := range records {
+		p := partitionForKey(record.Key, partitions)
+		byPartition[p] = append(byPartition[p], record)
+	}
+	for p, records := range byPartition {
+		_, _, err := s.config.appendBatch(context.Background(), records, api.Ack_ACK_DEFAULT, s.topic, p, nil)
+		if err != nil {
+			s.config.Logger.Error("appending syslog messages",
+				zap.String("topic", s.topic),
+				zap.Uint32("partition", p),
+				zap.Int("messages", len(records)),
+				zap.Error(err),
+			)
+			syslogMessagesDropped.Add(float64(len(records)))
+		}
+	}
+}
+
+// Appends the messages to the topics the routing rules pick, dropping
+// those they don't route
+func (s *SyslogServer) ingest(records []*api.Record) {
+	var routed []*api.Record
+	var routes []Route
+	for _, record := range records {
+		route, err := s.config.route([]*api.Record{record})
+		if err != nil {
+			s.config.Logger.Error("routing syslog message", zap.Error(err))
+			syslogMessagesDropped.Inc()
+			continue
+		}
+		routed, routes = append(routed, record), append(routes, route[0])
+	}
+	if len(routed) == 0 {
+		return
+	}
+	if _, err := s.config.ingest(context.Background(), routed, routes, api.Ack_ACK_DEFAULT, nil); err != nil {
+		s.config.Logger.Error("ingesting syslog messages", zap.Int("messages", len(routed)), zap.Error(err))
+		syslogMessagesDropped.Add(float64(len(routed)))
+	}
+}
+
+// The partition of the count the key goes to, hashed as the client's
+// PartitionForKey does so a key's records stay in one partition whoever
+// produces them
+func partitionForKey(key []byte, partitions uint32) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32() % max(partitions, 1)
+}
+
+func remoteHost(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Reads a message framed by octet counting, its length and a space in
+// front, or else ended by a newline
+func readSyslogFrame(r *bufio.Reader) ([]byte, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] >= '1' && b[0] <= '9' {
+		prefix, err := r.ReadSlice(' ')
+		if err != nil {
+			return nil, errors.New("malformed syslog octet count")
+		}
+		n, err := strconv.Atoi(string(prefix[:len(prefix)-1]))
+		if err != nil || n > syslogMaxMessage {
+			return nil, errors.New("malformed syslog octet count")
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return nil, errors.New("syslog message too long")
+	}
+	return bytes.Clone(bytes.TrimRight(line, "\r\n")), err
+}
+
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+var syslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news",
+	"uucp", "cron", "authpriv", "ftp", "ntp", "security", "console", "solaris-cron",
+	"local0", "local1", "local2", "local3", "local4", "local5", "local6", "local7",
+}
+
+// Parses an RFC 5424 or RFC 3164 message into a record. Parts a message
+// is missing are left out, the host being the sender's address and the
+// priority user.notice. Messages that parse as neither keep all their
+// text as the value.
+func parseSyslog(msg []byte, from string, now time.Time) *api.Record {
+	pri, rest := 13, msg
+	if p, r, ok := parsePriority(msg); ok {
+		pri, rest = p, r
+	}
+	var m syslogMessage
+	if v, r, ok := bytes.Cut(rest, []byte(" ")); ok && string(v) == "1" {
+		m = parseRFC5424(r)
+	} else {
+		m = parseRFC3164(rest, now)
+	}
+	if m.host == "" {
+		m.host = from
+	}
+	record := &api.Record{Key: []byte(m.host), Value: m.msg}
+	if !m.timestamp.IsZero() {
+		record.Timestamp = m.timestamp.UnixNano()
+	}
+	header := func(key, value string) {
+		if value != "" && value != "-" {
+			record.Headers = append(record.Headers, &api.Header{Key: key, Value: []byte(value)})
+		}
+	}
+	header("host", m.host)
+	header("severity", syslogSeverities[pri%8])
+	header("facility", syslogFacilities[pri/8])
+	header("app", m.app)
+	header("procid", m.procID)
+	header("msgid", m.msgID)
+	header("structured_data", m.structuredData)
+	return record
+}
+
+type syslogMessage struct {
+	timestamp      time.Time
+	host           string
+	app            string
+	procID         string
+	msgID          string
+	structuredData string
+	msg            []byte
+}
+
+// Parses the <PRI> a message starts with, a facility and severity up to
+// local7.debug
+func parsePriority(msg []byte) (int, []byte, bool) {
+	if len(msg) < 3 || msg[0] != '<' {
+		return 0, nil, false
+	}
+	end := bytes.IndexByte(msg[:min(len(msg), 5)], '>')
+	if end < 2 {
+		return 0, nil, false
+	}
+	pri, err := strconv.Atoi(string(msg[1:end]))
+	if err != nil || pri < 0 || pri >= 8*len(syslogFacilities) {
+		return 0, nil, false
+	}
+	return pri, msg[end+1:], true
+}
+
+// Parses what follows an RFC 5424 message's version: its timestamp, host,
+// app, process ID, message ID, structured data and message, "-" standing
+// for each that's missing
+func parseRFC5424(b []byte) syslogMessage {
+	var m syslogMessage
+	field := func() string {
+		f, rest, _ := bytes.Cut(b, []byte(" "))
+		b = rest
+		return string(f)
+	}
+	if ts := field(); ts != "-" {
+		m.timestamp, _ = time.Parse(time.RFC3339Nano, ts)
+	}
+	m.host, m.app, m.procID, m.msgID = field(), field(), field(), field()
+	if m.host == "-" {
+		m.host = ""
+	}
+	if bytes.HasPrefix(b, []byte("-")) {
+		b = b[1:]
+	} else {
+		// elements are bracketed, with brackets and quotes escaped in their
+		// quoted values
+		n, quoted := 0, false
+	elements:
+		for n < len(b) {
+			switch c := b[n]; {
+			case c == '\\' && quoted:
+				n++
+			case c == '"':
+				quoted = !quoted
+			case c == ']' && !quoted && (n+1 == len(b) || b[n+1] != '['):
+				n++
+				break elements
+			}
+			n++
+		}
+		m.structuredData, b = string(b[:n]), b[n:]
+	}
+	b = bytes.TrimPrefix(b, []byte(" "))
+	m.msg = bytes.TrimPrefix(b, []byte("\xef\xbb\xbf"))
+	return m
+}
+
+// Parses a BSD message: its "Mmm dd hh:mm:ss" timestamp, in the server's
+// time zone and the year that puts it nearest now, its host and its tag,
+// the app and process ID of "app[pid]: ". A message without a timestamp
+// keeps all its text.
+func parseRFC3164(b []byte, now time.Time) syslogMessage {
+	var m syslogMessage
+	const stamp = "Jan _2 15:04:05"
+	if len(b) < len(stamp)+1 || b[len(stamp)] != ' ' {
+		m.msg = b
+		return m
+	}
+	ts, err := time.ParseInLocation(stamp, string(b[:len(stamp)]), now.Location())
+	if err != nil {
+		m.msg = b
+		return m
+	}
+	m.timestamp = ts.AddDate(now.Year(), 0, 0)
+	if m.timestamp.After(now.Add(24 * time.Hour)) {
+		m.timestamp = m.timestamp.AddDate(-1, 0, 0)
+	}
+	host, rest, _ := bytes.Cut(b[len(stamp)+1:], []byte(" "))
+	m.host, m.msg = string(host), rest
+	if tag, msg, ok := bytes.Cut(rest, []byte(": ")); ok && len(tag) <= 48 && !bytes.ContainsRune(tag, ' ') {
+		m.msg = msg
+		if app, pid, ok := bytes.Cut(tag, []byte("[")); ok && bytes.HasSuffix(pid, []byte("]")) {
+			m.app, m.procID = string(app), string(pid[:len(pid)-1])
+		} else {
+			m.app = string(tag)
+		}
+	}
+	return m
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSyslog(t *testing.T) {
+	now := time.Date(2026, time.January, 2, 12, 0, 0, 0, time.UTC)
+	for name, tc := range map[string]struct {
+		msg       string
+		key       string
+		value     string
+		timestamp time.Time
+		headers   map[string]string
+	}{
+		"rfc5424": {
+			msg:       `<165>1 2026-01-02T11:59:58.5Z web-1 nginx 42 ID47 [req@32473 id="7\"]"][x@1 a="b"] ` + "\xef\xbb\xbf" + `GET /`,
+			key:       "web-1",
+			value:     "GET /",
+			timestamp: time.Date(2026, time.January, 2, 11, 59, 58, 5e8, time.UTC),
+			headers: map[string]string{
+				"host": "web-1", "app": "nginx", "procid": "42", "msgid": "ID47",
+				"severity": "notice", "facility": "local4",
+				"structured_data": `[req@32473 id="7\"]"][x@1 a="b"]`,
+			},
+		},
+		"rfc5424 nil values": {
+			msg:     `<14>1 - - - - - - hello`,
+			key:     "10.0.0.1",
+			value:   "hello",
+			headers: map[string]string{"host": "10.0.0.1", "severity": "info", "facility": "user"},
+		},
+		"rfc3164": {
+			msg:       `<34>Jan  2 11:59:00 db-1 sshd[99]: failed login`,
+			key:       "db-1",
+			value:     "failed login",
+			timestamp: time.Date(2026, time.January, 2, 11, 59, 0, 0, time.UTC),
+			headers: map[string]string{
+				"host": "db-1", "app": "sshd", "procid": "99",
+				"severity": "crit", "facility": "auth",
+			},
+		},
+		"rfc3164 last year": {
+			msg:       `<13>Dec 31 23:00:00 db-1 cron: tick`,
+			key:       "db-1",
+			value:     "tick",
+			timestamp: time.Date(2025, time.December, 31, 23, 0, 0, 0, time.UTC),
+			headers:   map[string]string{"host": "db-1", "app": "cron", "severity": "notice", "facility": "user"},
+		},
+		"no priority or header": {
+			msg:     `just text`,
+			key:     "10.0.0.1",
+			value:   "just text",
+			headers: map[string]string{"host": "10.0.0.1", "severity": "notice", "facility": "user"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			record := parseSyslog([]byte(tc.msg), "10.0.0.1", now)
+			require.Equal(t, tc.key, string(record.Key))
+			require.Equal(t, tc.value, string(record.Value))
+			if tc.timestamp.IsZero() {
+				require.Zero(t, record.Timestamp)
+			} else {
+				require.Equal(t, tc.timestamp.UnixNano(), record.Timestamp)
+			}
+			headers := make(map[string]string)
+			for _, h := range record.Headers {
+				headers[h.Key] = string(h.Value)
+			}
+			require.Equal(t, tc.headers, headers)
+		})
+	}
+}
+
+func TestSyslogServer(t *testing.T) {
+	_, config, teardown := setupTest(t, nil)
+	defer teardown()
+	require.NoError(t, config.CommitLog.(topicLog).CreateTopic(&api.Topic{Name: "syslog", Partitions: 2}))
+	srv := NewSyslogServer("syslog", config)
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go srv.ServeUDP(pc)
+	go srv.ServeTCP(ln)
+
+	udp, err := net.Dial("udp", pc.LocalAddr().String())
+	require.NoError(t, err)
+	defer udp.Close()
+	_, err = udp.Write([]byte("<14>1 - web-1 app - - - from udp\n"))
+	require.NoError(t, err)
+
+	tcp, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	// octet counted, then newline delimited
+	msg := "<14>1 - web-1 app - - - counted\nwith a newline"
+	_, err = fmt.Fprintf(tcp, "%d %s<14>1 - web-1 app - - - delimited\n", len(msg), msg)
+	require.NoError(t, err)
+	require.NoError(t, tcp.Close())
+
+	// every message has the same host, so they're in one partition
+	cl, err := config.partition("syslog", partitionForKey([]byte("web-1"), 2))
+	require.NoError(t, err)
+	var values []string
+	require.Eventually(t, func() bool {
+		values = values[:0]
+		for off := uint64(0); ; off++ {
+			record, err := cl.Read(off)
+			if err != nil {
+				break
+			}
+			values = append(values, string(record.Value))
+		}
+		return len(values) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	require.ElementsMatch(t, []string{"from udp", "counted\nwith a newline", "delimited"}, values)
+
+	require.NoError(t, srv.Close())
+	require.ErrorIs(t, srv.ServeTCP(ln), ErrSyslogServerClosed)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"cmp"
+	"fmt"
+	"strings"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+)
+
+// The resource a tenant's stats are authorized as, e.g. tenants/acme
+func tenantResource(tenant string) string {
+	return "tenants/" + tenant
+}
+
+// The tenant of the commit log the principal is of, named before the '/'
+// in its name as for Quotas, "" if the log has no such tenant
+func (c *Config) principalTenant(principal string) string {
+	tl, ok := c.CommitLog.(tenantLog)
+	tenant, _, found := strings.Cut(principal, "/")
+	if !ok || !found {
+		return ""
+	}
+	// a declared tenant's is the tenant of its topics
+	return tl.TenantOf(tenant + ".")
+}
+
+// Fails with auth.ErrPermissionDenied for a tenant's principal acting on
+// anything but its tenant's topics and tenantResource, whatever the
+// authorizer grants it
+func (c *Config) confine(principal, resource string) error {
+	tenant := c.principalTenant(principal)
+	if tenant == "" || resource == tenantResource(tenant) || c.CommitLog.(tenantLog).TenantOf(resource) == tenant {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is confined to tenant %s", auth.ErrPermissionDenied, principal, tenant)
+}
+
+// The topics the principal lists and the resource listing them is
+// authorized as: a tenant's principal lists its tenant's
+func (c *Config) listedTopics(principal string) (resource string, topics []*api.Topic) {
+	tenant := c.principalTenant(principal)
+	if tenant == "" {
+		return objectWildcard, c.topics()
+	}
+	tl := c.CommitLog.(tenantLog)
+	for _, topic := range c.topics() {
+		if tl.TenantOf(topic.Name) == tenant {
+			topics = append(topics, topic)
+		}
+	}
+	return tenantResource(tenant), topics
+}
+
+// Fails with api.ErrDiskFull while the topic's tenant holds its max bytes
+func (c *Config) checkTenant(topic string) error {
+	tl, ok := c.CommitLog.(tenantLog)
+	if !ok {
+		return nil
+	}
+	if err := tl.CheckTenant(topic); err != nil {
+		produceDiskFull.Inc()
+		return err
+	}
+	return nil
+}
+
+// The tenant the principal describes when it asks for the tenant, its own
+// for none if it's a tenant's principal, and the resource that's
+// authorized as
+func (c *Config) describedTenant(principal, tenant string) (string, string) {
+	tenant = cmp.Or(tenant, c.principalTenant(principal))
+	if tenant == "" {
+		return "", objectWildcard
+	}
+	return tenant, tenantResource(tenant)
+}
+
+// The stats of the tenant of the log, every tenant's for "", false if it
+// has no such tenant
+func tenantStats(tl tenantLog, tenant string) ([]*api.TenantStats, bool) {
+	var stats []*api.TenantStats
+	for _, st := range tl.TenantStats() {
+		if tenant != "" && st.Name != tenant {
+			continue
+		}
+		stats = append(stats, &api.TenantStats{
+			Name:     st.Name,
+			Dir:      st.Dir,
+			Topics:   uint32(st.Topics),
+			Bytes:    st.Bytes,
+			MaxBytes: st.MaxBytes,
+		})
+	}
+	return stats, tenant == "" || len(stats) > 0
+}
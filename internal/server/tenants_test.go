@@ -0,0 +1,75 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTenants(t *testing.T) {
+	clog, err := log.NewTopics(t.TempDir(), log.Config{Tenants: map[string]log.Tenant{
+		"acme":   {MaxBytes: 1},
+		"globex": {},
+	}})
+	require.NoError(t, err)
+	defer clog.Close()
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.CommitLog = clog
+		c.Authenticator = auth.APIKeyAuthenticator{Keys: map[string]string{
+			"root-key": "root",
+			"acme-key": "acme/ingest",
+		}}
+		c.Authorizer = auth.NewACL(
+			auth.Rule{Principal: "root", Resource: objectWildcard, Action: adminAction},
+			auth.Rule{Principal: "acme/ingest", Resource: objectWildcard, Action: produceAction},
+			auth.Rule{Principal: "acme/ingest", Resource: objectWildcard, Action: consumeAction},
+			auth.Rule{Principal: "acme/ingest", Resource: objectWildcard, Action: adminAction},
+		)
+	})
+	defer teardown()
+	root := asPrincipal(context.Background(), "root-key")
+	acme := asPrincipal(context.Background(), "acme-key")
+	for _, name := range []string{"acme.orders", "globex.orders"} {
+		_, err := client.CreateTopic(root, &api.CreateTopicRequest{Name: name})
+		require.NoError(t, err)
+	}
+
+	// a tenant's principal is confined to its tenant's topics, whatever the
+	// authorizer grants it
+	produce := func(topic string) error {
+		_, err := client.Produce(acme, &api.ProduceRequest{Topic: topic, Record: &api.Record{Value: []byte("order")}})
+		return err
+	}
+	require.NoError(t, produce("acme.orders"))
+	require.Equal(t, codes.PermissionDenied, status.Code(produce("globex.orders")))
+	topics, err := client.ListTopics(acme, &api.ListTopicsRequest{})
+	require.NoError(t, err)
+	require.Equal(t, []string{"acme.orders"}, topics.Topics)
+
+	// past its max bytes, once summed, the tenant's produces fail
+	clog.TenantStats()
+	err = produce("acme.orders")
+	require.Equal(t, codes.ResourceExhausted, status.Code(err))
+	require.Contains(t, err.Error(), "tenant acme full: ")
+
+	// its principals describe their own tenant, admins any
+	res, err := client.DescribeTenants(acme, &api.DescribeTenantsRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Tenants, 1)
+	require.Equal(t, "acme", res.Tenants[0].Name)
+	require.Equal(t, uint32(1), res.Tenants[0].Topics)
+	require.NotZero(t, res.Tenants[0].Bytes)
+	_, err = client.DescribeTenants(acme, &api.DescribeTenantsRequest{Tenant: "globex"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+	res, err = client.DescribeTenants(root, &api.DescribeTenantsRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Tenants, 2)
+	_, err = client.DescribeTenants(root, &api.DescribeTenantsRequest{Tenant: "initech"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+)
+
+// How far back throughput goes, in one second slots
+const throughputWindow = 60
+
+// The latency histograms' buckets, the first up to 100µs and each after
+// twice the one before, the last taking the rest
+const (
+	latencyBuckets = 20
+	latencyBase    = 100 * time.Microsecond
+)
+
+// throughput measures the produces and consumes each partition serves,
+// over the last throughputWindow seconds. Partitions are kept by their
+// commit logs, which consumes know them by.
+type throughput struct {
+	now func() time.Time
+
+	mu    sync.Mutex
+	byLog map[CommitLog]*partitionThroughput
+}
+
+type partitionThroughput struct {
+	// first is the second the partition was first served in, which rates
+	// are averaged from until the window's passed
+	first int64
+	slots [throughputWindow]throughputSlot
+}
+
+// What a partition served in one second
+type throughputSlot struct {
+	sec                 int64
+	produce, consume    throughputCounts
+	produceLat, consLat latencyHistogram
+}
+
+type throughputCounts struct {
+	records, bytes uint64
+}
+
+type latencyHistogram [latencyBuckets]uint32
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for bound := latencyBase; d > bound && i < latencyBuckets-1; bound *= 2 {
+		i++
+	}
+	h[i]++
+}
+
+// The upper bound of the bucket the quantile falls in, zero without
+// observations
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	var total uint64
+	for _, n := range h {
+		total += uint64(n)
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(total) + 0.5)
+	var seen uint64
+	bound := latencyBase
+	for i, n := range h {
+		seen += uint64(n)
+		if seen >= rank || i == latencyBuckets-1 {
+			break
+		}
+		bound *= 2
+	}
+	return bound
+}
+
+// The slot for the current second, cleared if it was last used a window
+// ago
+func (t *throughput) slot(cl CommitLog) *throughputSlot {
+	now := t.now().Unix()
+	if t.byLog == nil {
+		t.byLog = make(map[CommitLog]*partitionThroughput)
+	}
+	p, ok := t.byLog[cl]
+	if !ok {
+		t.prune(now)
+		p = &partitionThroughput{first: now}
+		t.byLog[cl] = p
+	}
+	s := &p.slots[now%throughputWindow]
+	if s.sec != now {
+		*s = throughputSlot{sec: now}
+	}
+	return s
+}
+
+// Forgets the partitions idle for a window, as deleted topics' are
+func (t *throughput) prune(now int64) {
+	for cl, p := range t.byLog {
+		idle := true
+		for _, s := range p.slots {
+			if s.sec > now-throughputWindow {
+				idle = false
+				break
+			}
+		}
+		if idle {
+			delete(t.byLog, cl)
+		}
+	}
+}
+
+// Counts records appended to the partition, in one append that took d
+func (t *throughput) produced(cl CommitLog, records, bytes int, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.slot(cl)
+	s.produce.records += uint64(records)
+	s.produce.bytes += uint64(bytes)
+	s.produceLat.observe(d)
+}
+
+// Counts a record read from the partition, which took d
+func (t *throughput) consumed(cl CommitLog, bytes int, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.slot(cl)
+	s.consume.records++
+	s.consume.bytes += uint64(bytes)
+	s.consLat.observe(d)
+}
+
+// The partition's throughput over the window, nil if it wasn't served in it
+func (t *throughput) report(cl CommitLog) *api.PartitionThroughput {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok := t.byLog[cl]
+	if !ok {
+		return nil
+	}
+	now := t.now().Unix()
+	var produce, consume throughputCounts
+	var produceLat, consLat latencyHistogram
+	served := false
+	for _, s := range p.slots {
+		if s.sec <= now-throughputWindow || s.sec > now {
+			continue
+		}
+		served = true
+		produce.records += s.produce.records
+		produce.bytes += s.produce.bytes
+		consume.records += s.consume.records
+		consume.bytes += s.consume.bytes
+		for i := range produceLat {
+			produceLat[i] += s.produceLat[i]
+			consLat[i] += s.consLat[i]
+		}
+	}
+	if !served {
+		return nil
+	}
+	secs := float64(min(now-p.first+1, throughputWindow))
+	return &api.PartitionThroughput{
+		ProduceRecordsPerSecond: float64(produce.records) / secs,
+		ProduceBytesPerSecond:   float64(produce.bytes) / secs,
+		ConsumeRecordsPerSecond: float64(consume.records) / secs,
+		ConsumeBytesPerSecond:   float64(consume.bytes) / secs,
+		ProduceP99Ms:            milliseconds(produceLat.quantile(0.99)),
+		ConsumeP99Ms:            milliseconds(consLat.quantile(0.99)),
+	}
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// The throughput of the topic's partitions, or every topic's for an empty
+// name, that the server served in the window
+func (c *Config) getThroughput(topic string) (*api.GetThroughputResponse, error) {
+	topics := c.topics()
+	if topic != "" {
+		desc, err := c.describeTopic(topic)
+		if err != nil {
+			return nil, err
+		}
+		topics = []*api.Topic{desc}
+	}
+	slices.SortFunc(topics, func(a, b *api.Topic) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	res := &api.GetThroughputResponse{WindowSeconds: throughputWindow}
+	for _, t := range topics {
+		for p := range t.Partitions {
+			cl, err := c.partition(t.Name, p)
+			if err != nil {
+				// deleted since they were listed
+				continue
+			}
+			pt := c.throughput.report(cl)
+			if pt == nil {
+				continue
+			}
+			pt.Topic, pt.Partition = t.Name, p
+			res.Partitions = append(res.Partitions, pt)
+		}
+	}
+	return res, nil
+}
+
+// Reports the partitions' throughput, to anyone who may consume the topic,
+// or every topic when it's empty
+func (s *grpcServer) GetThroughput(ctx context.Context, req *api.GetThroughputRequest) (*api.GetThroughputResponse, error) {
+	resource := objectWildcard
+	if req.Topic != "" {
+		resource = req.Topic
+	}
+	if err := s.authorize(ctx, consumeAction, resource); err != nil {
+		return nil, err
+	}
+	return s.getThroughput(req.Topic)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestThroughputWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tp := &throughput{now: func() time.Time { return now }}
+	cl := NewLog()
+
+	require.Nil(t, tp.report(cl))
+	for i := range 100 {
+		d := time.Millisecond
+		if i == 99 {
+			d = time.Second
+		}
+		tp.produced(cl, 2, 10, d)
+	}
+	now = now.Add(time.Second)
+	tp.consumed(cl, 5, 50*time.Microsecond)
+
+	// averaged over the two seconds the partition's been served
+	pt := tp.report(cl)
+	require.Equal(t, 100.0, pt.ProduceRecordsPerSecond)
+	require.Equal(t, 500.0, pt.ProduceBytesPerSecond)
+	require.Equal(t, 0.5, pt.ConsumeRecordsPerSecond)
+	// 1ms falls in the bucket up to 1.6ms, the slow append is past the p99
+	require.Equal(t, 1.6, pt.ProduceP99Ms)
+	require.Equal(t, 0.1, pt.ConsumeP99Ms)
+
+	// then over the whole window
+	now = now.Add((throughputWindow - 2) * time.Second)
+	pt = tp.report(cl)
+	require.InDelta(t, 200.0/throughputWindow, pt.ProduceRecordsPerSecond, 0.001)
+
+	// the produces have left the window, the consume not yet
+	now = now.Add(time.Second)
+	pt = tp.report(cl)
+	require.Zero(t, pt.ProduceRecordsPerSecond)
+	require.Zero(t, pt.ProduceP99Ms)
+	require.NotZero(t, pt.ConsumeRecordsPerSecond)
+
+	// an idle partition is forgotten once another's served
+	now = now.Add(time.Second)
+	require.Nil(t, tp.report(cl))
+	tp.consumed(NewLog(), 1, time.Millisecond)
+	_, ok := tp.byLog[cl]
+	require.False(t, ok)
+	require.Len(t, tp.byLog, 1)
+}
+
+func TestGetThroughput(t *testing.T) {
+	client, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "events", Partitions: 2})
+	require.NoError(t, err)
+	for range 3 {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Topic: "events", Partition: 1, Record: &api.Record{Value: []byte("foo")}})
+		require.NoError(t, err)
+	}
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "events", Partition: 1})
+	require.NoError(t, err)
+
+	res, err := client.GetThroughput(ctx, &api.GetThroughputRequest{})
+	require.NoError(t, err)
+	require.Equal(t, uint32(throughputWindow), res.WindowSeconds)
+	// the partitions that weren't served are left out
+	require.Len(t, res.Partitions, 1)
+	pt := res.Partitions[0]
+	require.Equal(t, "events", pt.Topic)
+	require.Equal(t, uint32(1), pt.Partition)
+	require.NotZero(t, pt.ProduceRecordsPerSecond)
+	require.NotZero(t, pt.ProduceBytesPerSecond)
+	require.NotZero(t, pt.ConsumeRecordsPerSecond)
+	require.NotZero(t, pt.ProduceP99Ms)
+
+	_, err = client.GetThroughput(ctx, &api.GetThroughputRequest{Topic: "missing"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	nobody := asPrincipal(context.Background(), "nobody-key")
+	_, err = client.GetThroughput(nobody, &api.GetThroughputRequest{Topic: "events"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
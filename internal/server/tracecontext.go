@@ -0,0 +1,38 @@
+package server
+
+import (
+	"context"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/protobuf/proto"
+)
+
+// The W3C trace context's headers, as records carry them with
+// TraceRecordHeaders set
+var traceContext = propagation.TraceContext{}
+
+// Stamps the record with the W3C trace context of the produce, its
+// traceparent and tracestate headers, when TraceRecordHeaders is set and
+// the produce is traced. Records with a traceparent header already, as
+// producers propagating their own set, keep theirs.
+func (c *Config) stampTraceContext(ctx context.Context, record *api.Record) *api.Record {
+	if !c.TraceRecordHeaders || !trace.SpanContextFromContext(ctx).IsValid() {
+		return record
+	}
+	for _, h := range record.Headers {
+		if h.Key == "traceparent" {
+			return record
+		}
+	}
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(ctx, carrier)
+	record = proto.CloneOf(record)
+	for _, key := range traceContext.Fields() {
+		if v, ok := carrier[key]; ok {
+			record.Headers = append(record.Headers, &api.Header{Key: key, Value: []byte(v)})
+		}
+	}
+	return record
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestTraceRecordHeaders(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.TraceRecordHeaders = true
+	})
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	headers := func(res *api.ConsumeResponse) map[string]string {
+		m := make(map[string]string)
+		for _, h := range res.Record.Headers {
+			m[h.Key] = string(h.Value)
+		}
+		return m
+	}
+
+	// a traced produce's record carries its trace, under the span the
+	// server started for it
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	traced := metadata.AppendToOutgoingContext(ctx, "traceparent", parent)
+	_, err := client.Produce(traced, &api.ProduceRequest{Record: &api.Record{Value: []byte("traced")}})
+	require.NoError(t, err)
+	res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	sc := traceContext.Extract(context.Background(), propagation.MapCarrier(headers(res)))
+	require.NotEmpty(t, headers(res)["traceparent"])
+	require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", trace.SpanContextFromContext(sc).TraceID().String())
+
+	// a record with a trace context of its own keeps it
+	own := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	_, err = client.Produce(traced, &api.ProduceRequest{Record: &api.Record{
+		Value:   []byte("own"),
+		Headers: []*api.Header{{Key: "traceparent", Value: []byte(own)}},
+	}})
+	require.NoError(t, err)
+	res, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"traceparent": own}, headers(res))
+
+	// and an untraced one carries none
+	_, err = client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("untraced")}})
+	require.NoError(t, err)
+	res, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 2})
+	require.NoError(t, err)
+	require.Empty(t, res.Record.Headers)
+}
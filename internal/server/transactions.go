@@ -0,0 +1,321 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// transactions coordinates the transactions begun on the server, by
+// transactional ID, and tracks those of the partitions READ_COMMITTED
+// consumes read.
+//
+// A transaction's number is the Unix nanoseconds it began at, so any
+// server reading its records can tell how long it's been open. The
+// coordinator aborts it once it's open past the transaction timeout, and
+// readers take one still open past twice the timeout, its coordinator gone
+// before it could, to be aborted.
+type transactions struct {
+	mu   sync.Mutex
+	last uint64
+	open map[string]*transaction
+	// partitions are the partitions READ_COMMITTED consumes read, by log
+	partitions map[CommitLog]*partitionTransactions
+}
+
+// A transaction open under a transactional ID
+type transaction struct {
+	id        uint64
+	principal string
+	// mu serializes its produces and its commit or abort, so none append
+	// after its markers
+	mu         sync.Mutex
+	partitions []topicPartition
+	ended      bool
+}
+
+// The transactions of a partition, as its records and markers tell, read
+// up to next
+type partitionTransactions struct {
+	mu   sync.Mutex
+	next uint64
+	// open are the first offsets of the transactions open, by number
+	open    map[uint64]uint64
+	aborted map[uint64]bool
+}
+
+// Context key of the transaction a produce appends its records in
+type transactionKey struct{}
+
+// The context of a produce in the transaction numbered id
+func withTransaction(ctx context.Context, id uint64) context.Context {
+	return context.WithValue(ctx, transactionKey{}, id)
+}
+
+// The number of the transaction the produce appends in, zero outside of one
+func transactionFrom(ctx context.Context) uint64 {
+	id, _ := ctx.Value(transactionKey{}).(uint64)
+	return id
+}
+
+// Whether the transaction numbered id began longer ago than timeout
+func transactionExpired(id uint64, timeout time.Duration) bool {
+	return time.Since(time.Unix(0, int64(id))) > timeout
+}
+
+// Opens a transaction under the transactional ID for the principal,
+// aborting the one open under it if it's expired
+func (c *Config) beginTransaction(ctx context.Context, transactionalID, principal string) (uint64, error) {
+	if transactionalID == "" {
+		return 0, status.Error(codes.InvalidArgument, "missing transactional id")
+	}
+	t := c.transactions
+	t.mu.Lock()
+	txn, ok := t.open[transactionalID]
+	t.mu.Unlock()
+	if ok {
+		if !transactionExpired(txn.id, c.TransactionTimeout) {
+			return 0, status.Errorf(codes.FailedPrecondition, "transaction %s is open", transactionalID)
+		}
+		if err := c.endTransaction(ctx, transactionalID, txn.principal, api.Control_CONTROL_ABORT); err != nil {
+			return 0, err
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.open[transactionalID]; ok {
+		return 0, status.Errorf(codes.FailedPrecondition, "transaction %s is open", transactionalID)
+	}
+	t.last = max(t.last+1, uint64(time.Now().UnixNano()))
+	t.open[transactionalID] = &transaction{id: t.last, principal: principal}
+	transactionsOpen.Inc()
+	return t.last, nil
+}
+
+// The transaction open under the transactional ID for the principal,
+// aborting it if it's expired
+func (c *Config) transaction(ctx context.Context, transactionalID, principal string) (*transaction, error) {
+	t := c.transactions
+	t.mu.Lock()
+	txn, ok := t.open[transactionalID]
+	t.mu.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.FailedPrecondition, "no transaction is open under %s", transactionalID)
+	}
+	if txn.principal != principal {
+		return nil, status.Errorf(codes.PermissionDenied, "transaction %s is %s's", transactionalID, txn.principal)
+	}
+	if transactionExpired(txn.id, c.TransactionTimeout) {
+		if err := c.endTransaction(ctx, transactionalID, principal, api.Control_CONTROL_ABORT); err != nil {
+			return nil, err
+		}
+		return nil, status.Errorf(codes.FailedPrecondition, "transaction %s expired and was aborted", transactionalID)
+	}
+	return txn, nil
+}
+
+// Appends the records in the transaction open under the transactional ID
+// for the principal, as appendBatch does but without forwarding them
+func (c *Config) appendTransactional(ctx context.Context, transactionalID, principal string, records []*api.Record, ack api.Ack, topic string, partition uint32) (
+	offs []uint64, pending bool, err error,
+) {
+	txn, err := c.transaction(ctx, transactionalID, principal)
+	if err != nil {
+		return nil, false, err
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.ended {
+		return nil, false, status.Errorf(codes.FailedPrecondition, "no transaction is open under %s", transactionalID)
+	}
+	tp := topicPartition{topicResource(topic), partition}
+	offs, pending, err = c.appendBatch(withTransaction(ctx, txn.id), records, ack, topic, partition, nil)
+	if err == nil && !slices.Contains(txn.partitions, tp) {
+		txn.partitions = append(txn.partitions, tp)
+	}
+	return offs, pending, err
+}
+
+// Commits or aborts the transaction open under the transactional ID for
+// the principal, writing the control marker to each partition it produced
+// to. If a marker fails, the transaction stays open to end again.
+func (c *Config) endTransaction(ctx context.Context, transactionalID, principal string, control api.Control) error {
+	t := c.transactions
+	t.mu.Lock()
+	txn, ok := t.open[transactionalID]
+	t.mu.Unlock()
+	if !ok {
+		return status.Errorf(codes.FailedPrecondition, "no transaction is open under %s", transactionalID)
+	}
+	if txn.principal != principal {
+		return status.Errorf(codes.PermissionDenied, "transaction %s is %s's", transactionalID, txn.principal)
+	}
+	// a commit past the timeout aborts it instead
+	expired := control == api.Control_CONTROL_COMMIT && transactionExpired(txn.id, c.TransactionTimeout)
+	if expired {
+		control = api.Control_CONTROL_ABORT
+	}
+	txn.mu.Lock()
+	defer txn.mu.Unlock()
+	if txn.ended {
+		return status.Errorf(codes.FailedPrecondition, "no transaction is open under %s", transactionalID)
+	}
+	for _, tp := range txn.partitions {
+		cl, err := c.partition(tp.topic, tp.partition)
+		if err == nil {
+			marker := &api.Record{Transaction: txn.id, Control: control}
+			if l, ok := cl.(ackLog); ok {
+				_, _, err = l.AppendAck(marker, api.Ack_ACK_ALL)
+			} else {
+				_, err = cl.Append(marker)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("writing transaction %s's marker to %s/%d: %w", transactionalID, tp.topic, tp.partition, err)
+		}
+	}
+	txn.ended = true
+	t.mu.Lock()
+	delete(t.open, transactionalID)
+	t.mu.Unlock()
+	transactionsOpen.Dec()
+	transactionsEnded.WithLabelValues(control.String()).Inc()
+	if expired {
+		c.Logger.Info("aborted expired transaction", zap.String("transactional_id", transactionalID))
+		return status.Errorf(codes.FailedPrecondition, "transaction %s expired and was aborted", transactionalID)
+	}
+	return nil
+}
+
+// The transactions of the partition, read up to its end
+func (c *Config) partitionTransactions(cl CommitLog) (*partitionTransactions, error) {
+	t := c.transactions
+	t.mu.Lock()
+	pt, ok := t.partitions[cl]
+	if !ok {
+		pt = &partitionTransactions{open: make(map[uint64]uint64), aborted: make(map[uint64]bool)}
+		t.partitions[cl] = pt
+	}
+	t.mu.Unlock()
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	if sl, ok := cl.(statsLog); ok {
+		pt.next = max(pt.next, sl.Stats().LowWatermark)
+	}
+	for {
+		record, next, err := readFrom(cl, pt.next)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			return pt, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		pt.next = next
+		if record.Transaction != 0 {
+			_, open := pt.open[record.Transaction]
+			switch {
+			case record.Control == api.Control_CONTROL_NONE && !open:
+				pt.open[record.Transaction] = record.Offset
+			case record.Control == api.Control_CONTROL_ABORT:
+				pt.aborted[record.Transaction] = true
+				fallthrough
+			case record.Control == api.Control_CONTROL_COMMIT:
+				delete(pt.open, record.Transaction)
+			}
+		}
+	}
+}
+
+// The offset READ_COMMITTED consumes read up to, the first of the
+// transactions open, and whether the record is one they skip
+func (pt *partitionTransactions) stable(timeout time.Duration) (lso uint64, hidden func(*api.Record) bool) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	lso = pt.next
+	abandoned := make(map[uint64]bool)
+	for id, first := range pt.open {
+		if transactionExpired(id, 2*timeout) {
+			abandoned[id] = true
+			continue
+		}
+		lso = min(lso, first)
+	}
+	aborted := pt.aborted
+	return lso, func(record *api.Record) bool {
+		// the aborted set only grows, and the records read are below lso
+		pt.mu.Lock()
+		defer pt.mu.Unlock()
+		return record.Control != api.Control_CONTROL_NONE || aborted[record.Transaction] || abandoned[record.Transaction]
+	}
+}
+
+// Reads the record at off, or the first after it, and the offset to read
+// next, as consume does at the isolation level. READ_COMMITTED reads answer api.ErrOffsetOutOfRange at
+// the first record of a transaction still open.
+func (s *grpcServer) consumeIsolated(ctx context.Context, cl CommitLog, off uint64, isolation api.Isolation) (*api.ConsumeResponse, uint64, error) {
+	if isolation != api.Isolation_READ_COMMITTED {
+		return s.consume(ctx, cl, off)
+	}
+	pt, err := s.partitionTransactions(cl)
+	if err != nil {
+		return nil, off, err
+	}
+	lso, hidden := pt.stable(s.TransactionTimeout)
+	for off < lso {
+		res, next, err := s.consume(ctx, cl, off)
+		if err != nil {
+			return nil, off, err
+		}
+		if res.Record.Offset >= lso {
+			break
+		}
+		if !hidden(res.Record) {
+			return res, next, nil
+		}
+		off = next
+	}
+	return nil, off, api.ErrOffsetOutOfRange{Offset: off}
+}
+
+func (s *grpcServer) BeginTransaction(ctx context.Context, req *api.BeginTransactionRequest) (*api.BeginTransactionResponse, error) {
+	id, err := s.beginTransaction(ctx, req.TransactionalId, auth.Principal(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return &api.BeginTransactionResponse{Transaction: id}, nil
+}
+
+func (s *grpcServer) CommitTransaction(ctx context.Context, req *api.CommitTransactionRequest) (*api.CommitTransactionResponse, error) {
+	if err := s.endTransaction(ctx, req.TransactionalId, auth.Principal(ctx), api.Control_CONTROL_COMMIT); err != nil {
+		return nil, err
+	}
+	return &api.CommitTransactionResponse{}, nil
+}
+
+func (s *grpcServer) AbortTransaction(ctx context.Context, req *api.AbortTransactionRequest) (*api.AbortTransactionResponse, error) {
+	if err := s.endTransaction(ctx, req.TransactionalId, auth.Principal(ctx), api.Control_CONTROL_ABORT); err != nil {
+		return nil, err
+	}
+	return &api.AbortTransactionResponse{}, nil
+}
+
+// Stamps the record with the produce's transaction, if it has one
+func stampTransaction(ctx context.Context, record *api.Record) *api.Record {
+	id := transactionFrom(ctx)
+	if id == 0 {
+		return record
+	}
+	record = proto.CloneOf(record)
+	record.Transaction = id
+	return record
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTransactions(t *testing.T) {
+	client, cfg, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	produce := func(value, transactionalID string) {
+		t.Helper()
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}, TransactionalId: transactionalID})
+		require.NoError(t, err)
+	}
+	// the values READ_COMMITTED and READ_UNCOMMITTED consumes read from
+	// the start, until they reach the end or an open transaction
+	read := func(isolation api.Isolation) []string {
+		t.Helper()
+		var values []string
+		for off := uint64(0); ; {
+			res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: off, Isolation: isolation})
+			if status.Code(err) == codes.NotFound {
+				return values
+			}
+			require.NoError(t, err)
+			if res.Record.Control == api.Control_CONTROL_NONE {
+				values = append(values, string(res.Record.Value))
+			}
+			off = res.Record.Offset + 1
+		}
+	}
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("orphan")}, TransactionalId: "orders"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	begun, err := client.BeginTransaction(ctx, &api.BeginTransactionRequest{TransactionalId: "orders"})
+	require.NoError(t, err)
+	require.NotZero(t, begun.Transaction)
+	_, err = client.BeginTransaction(ctx, &api.BeginTransactionRequest{TransactionalId: "orders"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// read committed consumes stop at the open transaction's first record
+	produce("a", "")
+	produce("b", "orders")
+	produce("c", "")
+	require.Equal(t, []string{"a"}, read(api.Isolation_READ_COMMITTED))
+	require.Equal(t, []string{"a", "b", "c"}, read(api.Isolation_READ_UNCOMMITTED))
+	record, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, begun.Transaction, record.Record.Transaction)
+
+	// and read its records once it's committed, skipping its marker
+	_, err = client.CommitTransaction(ctx, &api.CommitTransactionRequest{TransactionalId: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c"}, read(api.Isolation_READ_COMMITTED))
+
+	// an aborted transaction's records are skipped
+	_, err = client.BeginTransaction(ctx, &api.BeginTransactionRequest{TransactionalId: "orders"})
+	require.NoError(t, err)
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{Records: []*api.Record{{Value: []byte("d")}, {Value: []byte("e")}}, TransactionalId: "orders"})
+	require.NoError(t, err)
+	produce("f", "")
+	_, err = client.AbortTransaction(ctx, &api.AbortTransactionRequest{TransactionalId: "orders"})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b", "c", "f"}, read(api.Isolation_READ_COMMITTED))
+	_, err = client.CommitTransaction(ctx, &api.CommitTransactionRequest{TransactionalId: "orders"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	// another principal can't use the transaction
+	_, err = client.BeginTransaction(ctx, &api.BeginTransactionRequest{TransactionalId: "orders"})
+	require.NoError(t, err)
+	events := asPrincipal(context.Background(), "events-key")
+	_, err = client.AbortTransaction(events, &api.AbortTransactionRequest{TransactionalId: "orders"})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	// and one open past the timeout is aborted rather than committed
+	produce("g", "orders")
+	cfg.TransactionTimeout = time.Millisecond
+	time.Sleep(2 * time.Millisecond)
+	_, err = client.CommitTransaction(ctx, &api.CommitTransactionRequest{TransactionalId: "orders"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+	require.Equal(t, []string{"a", "b", "c", "f"}, read(api.Isolation_READ_COMMITTED))
+}
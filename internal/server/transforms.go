@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/frankie-mur/proglog/internal/transform"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// droppedOffset is the offset appends answer with for a record the topic's
+// transform dropped, which wasn't appended. No partition gets that far.
+const droppedOffset = math.MaxUint64
+
+// Runs the topic's transform over the record, returning the record to
+// append, nil if the transform drops it. A record it rejects fails with
+// api.ErrRecordRejected. The transform sees the value decompressed.
+func (c *Config) transform(ctx context.Context, tc log.TopicConfig, topic string, record *api.Record) (*api.Record, error) {
+	if tc.Transform == "" {
+		return record, nil
+	}
+	if c.Transforms == nil || !c.Transforms.Has(tc.Transform) {
+		return nil, status.Errorf(codes.FailedPrecondition, "transform %s of topic %s isn't loaded", tc.Transform, topic)
+	}
+	if record.Codec != api.Codec_CODEC_NONE {
+		record = proto.Clone(record).(*api.Record)
+		if err := codec.Decompress(record); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	start := time.Now()
+	out, err := c.Transforms.Apply(ctx, tc.Transform, record)
+	transformSeconds.WithLabelValues(tc.Transform).Observe(time.Since(start).Seconds())
+	var rejected transform.ErrRejected
+	switch {
+	case errors.As(err, &rejected):
+		transformRecords.WithLabelValues(tc.Transform, "rejected").Inc()
+		return nil, api.ErrRecordRejected{Topic: topic, Transform: tc.Transform, Reason: rejected.Reason}
+	case err != nil:
+		transformRecords.WithLabelValues(tc.Transform, "failed").Inc()
+		return nil, status.Error(codes.Internal, err.Error())
+	case out == nil:
+		transformRecords.WithLabelValues(tc.Transform, "dropped").Inc()
+	default:
+		transformRecords.WithLabelValues(tc.Transform, "kept").Inc()
+	}
+	return out, nil
+}
+
+// Checks configs are ones a topic can have, naming a transform loaded on
+// this server if any
+func (c *Config) validateTopicConfigs(configs map[string]string) error {
+	if err := log.ValidateTopicConfigs(configs); err != nil {
+		return err
+	}
+	if name := configs[log.TransformConfig]; name != "" && (c.Transforms == nil || !c.Transforms.Has(name)) {
+		return fmt.Errorf("transform %s isn't loaded", name)
+	}
+	return nil
+}
+
+// The produce response for an append at off
+func produceResponse(off uint64, pending bool) *api.ProduceResponse {
+	if off == droppedOffset {
+		return &api.ProduceResponse{Dropped: true}
+	}
+	return &api.ProduceResponse{Offset: off, Pending: pending}
+}
+
+// The produce response for a batch appended at offs
+func produceBatchResponse(offs []uint64, pending bool) *api.ProduceBatchResponse {
+	res := &api.ProduceBatchResponse{Offsets: offs, Pending: pending}
+	for i, off := range offs {
+		if off != droppedOffset {
+			continue
+		}
+		if res.Dropped == nil {
+			res.Offsets, res.Dropped = slices.Clone(offs), make([]bool, len(offs))
+		}
+		res.Offsets[i], res.Dropped[i] = 0, true
+	}
+	return res
+}
+
+// The offsets of a batch's records from the produce response, those
+// dropped at droppedOffset
+func batchOffsets(res *api.ProduceBatchResponse) []uint64 {
+	offs := res.Offsets
+	for i, dropped := range res.Dropped {
+		if !dropped {
+			continue
+		}
+		if len(offs) < len(res.Dropped) {
+			offs = append(offs, make([]uint64, len(res.Dropped)-len(offs))...)
+		}
+		offs[i] = droppedOffset
+	}
+	return offs
+}
+
+// The offsets of n records, of which those at the kept indexes were
+// appended at offs, the others dropped. Pending appends' offsets are
+// unset.
+func withDropped(offs []uint64, kept []int, n int) []uint64 {
+	all := make([]uint64, n)
+	for i := range all {
+		all[i] = droppedOffset
+	}
+	for j, i := range kept {
+		all[i] = 0
+		if j < len(offs) {
+			all[i] = offs[j]
+		}
+	}
+	return all
+}
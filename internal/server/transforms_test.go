@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"testing"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/frankie-mur/proglog/internal/transform"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// redact is the module of internal/transform's tests: it drops records
+// whose values start with d, rejects those with r and keeps the rest with
+// their values' bytes starred
+var redact = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x0c, 0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f,
+	0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, 0x03, 0x03, 0x02, 0x00, 0x01, 0x05, 0x03, 0x01, 0x00, 0x01,
+	0x07, 0x1e, 0x03, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, 0x05, 0x61, 0x6c, 0x6c,
+	0x6f, 0x63, 0x00, 0x00, 0x09, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x66, 0x6f, 0x72, 0x6d, 0x00, 0x01,
+	0x0a, 0x9f, 0x01, 0x02, 0x05, 0x00, 0x41, 0x80, 0x08, 0x0b, 0x96, 0x01, 0x01, 0x01, 0x7f, 0x20,
+	0x00, 0x41, 0x02, 0x6a, 0x2d, 0x00, 0x00, 0x41, 0xe4, 0x00, 0x46, 0x04, 0x40, 0x41, 0x08, 0x41,
+	0x01, 0x3a, 0x00, 0x00, 0x42, 0x81, 0x80, 0x80, 0x80, 0x80, 0x01, 0x0f, 0x0b, 0x20, 0x00, 0x41,
+	0x02, 0x6a, 0x2d, 0x00, 0x00, 0x41, 0xf2, 0x00, 0x46, 0x04, 0x40, 0x42, 0x89, 0x80, 0x80, 0x80,
+	0xf0, 0x01, 0x0f, 0x0b, 0x20, 0x00, 0x41, 0x02, 0x6a, 0x2d, 0x00, 0x00, 0x41, 0xec, 0x00, 0x46,
+	0x04, 0x40, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b, 0x41, 0x80, 0x20, 0x41, 0x00, 0x3a, 0x00, 0x00,
+	0x41, 0x81, 0x20, 0x20, 0x00, 0x20, 0x01, 0xfc, 0x0a, 0x00, 0x00, 0x02, 0x40, 0x03, 0x40, 0x20,
+	0x02, 0x20, 0x00, 0x41, 0x01, 0x6a, 0x2d, 0x00, 0x00, 0x4f, 0x0d, 0x01, 0x41, 0x83, 0x20, 0x20,
+	0x02, 0x6a, 0x41, 0x2a, 0x3a, 0x00, 0x00, 0x20, 0x02, 0x41, 0x01, 0x6a, 0x21, 0x02, 0x0c, 0x00,
+	0x0b, 0x0b, 0x42, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x04, 0x20, 0x01, 0x41, 0x01, 0x6a, 0xad,
+	0x84, 0x0b, 0x0b, 0x0f, 0x01, 0x00, 0x41, 0x0f, 0x0b, 0x09, 0x02, 0x72, 0x65, 0x6a, 0x65, 0x63,
+	0x74, 0x65, 0x64,
+}
+
+func TestTransforms(t *testing.T) {
+	tr := transform.New(transform.Limits{})
+	defer tr.Close()
+	require.NoError(t, tr.Load("redact", redact))
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Transforms = tr
+	})
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	// topics only name transforms that are loaded
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "ssns", Configs: map[string]string{log.TransformConfig: "scrub"}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "ssns", Configs: map[string]string{log.TransformConfig: "redact"}})
+	require.NoError(t, err)
+
+	// kept records are appended as transformed
+	produced, err := client.Produce(ctx, &api.ProduceRequest{Topic: "ssns", Record: &api.Record{Key: []byte("alice"), Value: []byte("078-05-1120")}})
+	require.NoError(t, err)
+	require.False(t, produced.Dropped)
+	consumed, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "ssns", Offset: produced.Offset})
+	require.NoError(t, err)
+	require.Equal(t, []byte("alice"), consumed.Record.Key)
+	require.Equal(t, []byte("***********"), consumed.Record.Value)
+
+	// dropped ones aren't, and rejected ones fail the produce
+	produced, err = client.Produce(ctx, &api.ProduceRequest{Topic: "ssns", Record: &api.Record{Value: []byte("debug")}})
+	require.NoError(t, err)
+	require.True(t, produced.Dropped)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "ssns", Record: &api.Record{Value: []byte("raw")}})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Contains(t, err.Error(), "record rejected: topic ssns transform redact: rejected")
+
+	// a batch's dropped records are flagged by index, the rest appended
+	batch, err := client.ProduceBatch(ctx, &api.ProduceBatchRequest{Topic: "ssns", Records: []*api.Record{
+		{Value: []byte("drop")},
+		{Value: []byte("keep")},
+	}})
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false}, batch.Dropped)
+	consumed, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "ssns", Offset: batch.Offsets[1]})
+	require.NoError(t, err)
+	require.Equal(t, []byte("****"), consumed.Record.Value)
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/codec"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+// How often the subscriptions are read for ones added, changed or
+// deleted, and how long a subscription that's caught up waits to look for
+// records again
+var (
+	webhookSyncInterval = time.Second
+	webhookPollInterval = 200 * time.Millisecond
+)
+
+// Failed deliveries are retried after a backoff doubling from the first
+// up to the last
+const (
+	webhookMinBackoff = time.Second
+	webhookMaxBackoff = time.Minute
+)
+
+// WebhookDelivery is the body of a subscription's POSTs, records of one
+// partition in offset order
+type WebhookDelivery struct {
+	Subscription string        `json:"subscription"`
+	Topic        string        `json:"topic"`
+	Partition    uint32        `json:"partition"`
+	Records      []*api.Record `json:"records"`
+}
+
+// DeliverWebhooks POSTs the subscriptions' records while the server config
+// serves leads the subscriptions topic, until stop is called. Call stop
+// before closing the commit log.
+func DeliverWebhooks(config *Config) (stop func()) {
+	d := &webhookDispatcher{
+		config:  withDefaults(config),
+		workers: make(map[string]*webhookWorker),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		d.run(ctx)
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// webhookDispatcher runs a worker for each subscription while the server
+// leads the subscriptions topic
+type webhookDispatcher struct {
+	config  *Config
+	workers map[string]*webhookWorker
+}
+
+type webhookWorker struct {
+	sub    *api.Subscription
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (d *webhookDispatcher) run(ctx context.Context) {
+	defer d.sync(ctx, nil)
+	for {
+		subs, err := d.leading()
+		if err != nil {
+			d.config.Logger.Error("reading subscriptions", zap.Error(err))
+		} else {
+			d.sync(ctx, subs)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(webhookSyncInterval):
+		}
+	}
+}
+
+// The subscriptions to deliver, none unless this server leads the
+// subscriptions topic
+func (d *webhookDispatcher) leading() ([]*api.Subscription, error) {
+	if _, ok := d.config.CommitLog.(topicLog); !ok {
+		return nil, nil
+	}
+	cl, err := d.config.subscriptionsPartition(false)
+	if errors.As(err, &api.ErrTopicNotFound{}) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if notLeading(cl) != nil {
+		return nil, nil
+	}
+	return d.config.listSubscriptions()
+}
+
+// Starts workers for the subscriptions and stops those of the ones that
+// are gone, restarting those whose subscriptions changed
+func (d *webhookDispatcher) sync(ctx context.Context, subs []*api.Subscription) {
+	want := make(map[string]*api.Subscription, len(subs))
+	for _, sub := range subs {
+		want[sub.Name] = sub
+	}
+	for name, w := range d.workers {
+		if sub, ok := want[name]; !ok || !proto.Equal(sub, w.sub) {
+			w.cancel()
+			<-w.done
+			delete(d.workers, name)
+		}
+	}
+	for name, sub := range want {
+		if _, ok := d.workers[name]; ok {
+			continue
+		}
+		wctx, cancel := context.WithCancel(ctx)
+		w := &webhookWorker{sub: sub, cancel: cancel, done: make(chan struct{})}
+		d.workers[name] = w
+		go func() {
+			defer close(w.done)
+			d.deliver(wctx, sub)
+		}()
+	}
+}
+
+// Delivers the subscription's records until ctx is done, backing off
+// after each delivery that fails
+func (d *webhookDispatcher) deliver(ctx context.Context, sub *api.Subscription) {
+	logger := d.config.Logger.With(zap.String("subscription", sub.Name), zap.String("topic", sub.Topic))
+	var backoff time.Duration
+	// the failed POSTs of each partition's batch, for dead-lettering it
+	attempts := make(map[uint32]uint32)
+	for {
+		delivered, err := d.deliverOnce(ctx, sub, attempts)
+		wait := webhookPollInterval
+		switch {
+		case err != nil && ctx.Err() == nil:
+			backoff = min(max(2*backoff, webhookMinBackoff), webhookMaxBackoff)
+			wait = backoff
+			logger.Warn("webhook delivery failed", zap.Duration("retry_in", backoff), zap.Error(err))
+		case delivered:
+			backoff, wait = 0, 0
+		default:
+			backoff = 0
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// POSTs a batch from each of the topic's partitions with records past the
+// subscription's cursor, committing the cursor past each batch delivered
+// or dead-lettered, and reports whether any were
+func (d *webhookDispatcher) deliverOnce(ctx context.Context, sub *api.Subscription, attempts map[uint32]uint32) (delivered bool, err error) {
+	topic, err := d.config.describeTopic(sub.Topic)
+	if err != nil {
+		return false, err
+	}
+	group := subscriptionGroup(sub.Name)
+	req := &api.FetchGroupOffsetsRequest{Group: group}
+	for p := range topic.Partitions {
+		req.Partitions = append(req.Partitions, &api.GroupOffset{Topic: sub.Topic, Partition: p})
+	}
+	cursors, err := d.config.fetchGroupOffsets(req)
+	if err != nil {
+		return false, err
+	}
+	for _, cursor := range cursors {
+		records, err := d.read(sub, cursor)
+		if err != nil {
+			return delivered, err
+		}
+		if len(records) == 0 {
+			continue
+		}
+		if err := d.config.postWebhook(ctx, sub, cursor.Partition, records, false); err != nil {
+			webhookDeliveries.WithLabelValues("failure").Inc()
+			attempts[cursor.Partition]++
+			if sub.DeadLetterTopic == "" || attempts[cursor.Partition] < maxAttempts(sub) {
+				return delivered, err
+			}
+			if err := d.config.deadLetter(ctx, sub, cursor.Partition, records, attempts[cursor.Partition], err); err != nil {
+				return delivered, fmt.Errorf("dead-lettering: %w", err)
+			}
+			webhookDeadLetters.Add(float64(len(records)))
+			d.config.Logger.Warn("dead-lettered a webhook batch",
+				zap.String("subscription", sub.Name),
+				zap.Uint32("partition", cursor.Partition),
+				zap.Uint64("offset", records[0].Offset),
+				zap.Int("records", len(records)),
+				zap.Error(err),
+			)
+		} else {
+			webhookDeliveries.WithLabelValues("success").Inc()
+		}
+		delete(attempts, cursor.Partition)
+		delivered = true
+		next := records[len(records)-1].Offset + 1
+		err = d.config.commitGroupOffsets(ctx, &api.CommitGroupOffsetsRequest{
+			Group:   group,
+			Offsets: []*api.GroupOffset{{Topic: sub.Topic, Partition: cursor.Partition, Offset: next}},
+		}, nil)
+		if err != nil {
+			return delivered, fmt.Errorf("committing cursor: %w", err)
+		}
+	}
+	return delivered, nil
+}
+
+// Reads a batch of the partition's records from the cursor
+func (d *webhookDispatcher) read(sub *api.Subscription, cursor *api.GroupOffset) ([]*api.Record, error) {
+	batch := int(sub.MaxBatch)
+	if batch == 0 {
+		batch = defaultWebhookBatch
+	}
+	return d.config.readBatch(sub.Topic, cursor.Partition, cursor.Offset, batch)
+}
+
+// Reads up to batch decompressed records of the partition from off, from
+// the first the partition still holds if off is before them
+func (c *Config) readBatch(topic string, partition uint32, off uint64, batch int) ([]*api.Record, error) {
+	cl, err := c.partition(topic, partition)
+	if err != nil {
+		return nil, err
+	}
+	if sl, ok := cl.(statsLog); ok {
+		off = max(off, sl.Stats().LowWatermark)
+	}
+	var records []*api.Record
+	for len(records) < batch {
+		record, next, err := readFrom(cl, off)
+		if errors.As(err, &api.ErrOffsetOutOfRange{}) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		record = proto.Clone(record).(*api.Record)
+		if err := codec.Decompress(record); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// POSTs the partition's records to the subscription's webhook, the header
+// Proglog-Replay set on replays of dead letters
+func (c *Config) postWebhook(ctx context.Context, sub *api.Subscription, partition uint32, records []*api.Record, replay bool) error {
+	body, err := json.Marshal(WebhookDelivery{
+		Subscription: sub.Name,
+		Topic:        sub.Topic,
+		Partition:    partition,
+		Records:      records,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range sub.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Proglog-Subscription", sub.Name)
+	if replay {
+		req.Header.Set("Proglog-Replay", "true")
+	}
+	res, err := c.WebhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/frankie-mur/proglog/internal/auth"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSubscriptions(t *testing.T) {
+	client, _, teardown := setupTest(t, nil)
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+
+	res, err := client.ListSubscriptions(ctx, &api.ListSubscriptionsRequest{})
+	require.NoError(t, err)
+	require.Empty(t, res.Subscriptions)
+
+	sub := &api.Subscription{Name: "hook", Topic: "events", Url: "https://example.com/hook"}
+	_, err = client.CreateSubscription(ctx, &api.CreateSubscriptionRequest{Subscription: sub})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "events"})
+	require.NoError(t, err)
+	_, err = client.CreateSubscription(ctx, &api.CreateSubscriptionRequest{Subscription: sub})
+	require.NoError(t, err)
+	_, err = client.CreateSubscription(ctx, &api.CreateSubscriptionRequest{Subscription: sub})
+	require.Equal(t, codes.AlreadyExists, status.Code(err))
+
+	for _, bad := range []*api.Subscription{
+		{Name: "plain", Topic: "events", Url: "http://example.com/hook"},
+		{Name: "bad name", Topic: "events", Url: "https://example.com/hook"},
+		{Name: "big", Topic: "events", Url: "https://example.com/hook", MaxBatch: maxWebhookBatch + 1},
+	} {
+		_, err = client.CreateSubscription(ctx, &api.CreateSubscriptionRequest{Subscription: bad})
+		require.Equal(t, codes.InvalidArgument, status.Code(err), bad.Name)
+	}
+
+	_, err = client.CreateSubscription(asPrincipal(context.Background(), "nobody-key"), &api.CreateSubscriptionRequest{
+		Subscription: &api.Subscription{Name: "denied", Topic: "events", Url: "https://example.com/hook"},
+	})
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	res, err = client.ListSubscriptions(ctx, &api.ListSubscriptionsRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Subscriptions, 1)
+	require.Equal(t, "hook", res.Subscriptions[0].Name)
+
+	_, err = client.DeleteSubscription(ctx, &api.DeleteSubscriptionRequest{Name: "hook"})
+	require.NoError(t, err)
+	_, err = client.DeleteSubscription(ctx, &api.DeleteSubscriptionRequest{Name: "hook"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	res, err = client.ListSubscriptions(ctx, &api.ListSubscriptionsRequest{})
+	require.NoError(t, err)
+	require.Empty(t, res.Subscriptions)
+}
+
+func TestDeliverWebhooks(t *testing.T) {
+	syncEvery, poll := webhookSyncInterval, webhookPollInterval
+	webhookSyncInterval, webhookPollInterval = 10*time.Millisecond, 10*time.Millisecond
+	defer func() { webhookSyncInterval, webhookPollInterval = syncEvery, poll }()
+
+	var (
+		mu         sync.Mutex
+		values     []string
+		failNext   = true
+		subHeaders http.Header
+	)
+	hook := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		// the first delivery fails, to be retried
+		if failNext {
+			failNext = false
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var delivery WebhookDelivery
+		if err := json.NewDecoder(r.Body).Decode(&delivery); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		subHeaders = r.Header.Clone()
+		for _, record := range delivery.Records {
+			values = append(values, string(record.Value))
+		}
+	}))
+	defer hook.Close()
+
+	client, config, teardown := setupTest(t, func(c *Config) {
+		c.WebhookClient = hook.Client()
+	})
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: "events"})
+	require.NoError(t, err)
+	// records before the subscription aren't delivered
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "events", Record: &api.Record{Value: []byte("before")}})
+	require.NoError(t, err)
+
+	_, err = client.CreateSubscription(ctx, &api.CreateSubscriptionRequest{Subscription: &api.Subscription{
+		Name:     "hook",
+		Topic:    "events",
+		Url:      hook.URL,
+		MaxBatch: 2,
+		Headers:  map[string]string{"Authorization": "Bearer token"},
+	}})
+	require.NoError(t, err)
+	stop := DeliverWebhooks(config)
+	defer func() { stop() }()
+
+	for _, v := range []string{"a", "b", "c"} {
+		_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "events", Record: &api.Record{Value: []byte(v)}})
+		require.NoError(t, err)
+	}
+	// the delivery that failed is retried after the backoff
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(values) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	require.Equal(t, []string{"a", "b", "c"}, values)
+	require.Equal(t, "Bearer token", subHeaders.Get("Authorization"))
+	require.Equal(t, "hook", subHeaders.Get("Proglog-Subscription"))
+	mu.Unlock()
+
+	// the cursors are the subscription's group's offsets
+	require.Eventually(t, func() bool {
+		res, err := client.GetGroupLag(ctx, &api.GetGroupLagRequest{Group: subscriptionGroup("hook")})
+		return err == nil && len(res.Lags) == 1 && res.Lags[0].Committed == 4 && res.Lags[0].Lag == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// deleted, the subscription's no longer delivered
+	_, err = client.DeleteSubscription(ctx, &api.DeleteSubscriptionRequest{Name: "hook"})
+	require.NoError(t, err)
+	time.Sleep(5 * webhookSyncInterval)
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "events", Record: &api.Record{Value: []byte("after")}})
+	require.NoError(t, err)
+	time.Sleep(10 * webhookPollInterval)
+	mu.Lock()
+	require.Len(t, values, 3)
+	mu.Unlock()
+}
+
+func TestDeadLetters(t *testing.T) {
+	syncEvery, poll := webhookSyncInterval, webhookPollInterval
+	webhookSyncInterval, webhookPollInterval = 10*time.Millisecond, 10*time.Millisecond
+	defer func() { webhookSyncInterval, webhookPollInterval = syncEvery, poll }()
+
+	var (
+		mu       sync.Mutex
+		failing  = true
+		values   []string
+		replayed []string
+	)
+	hook := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var delivery WebhookDelivery
+		if err := json.NewDecoder(r.Body).Decode(&delivery); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, record := range delivery.Records {
+			if r.Header.Get("Proglog-Replay") == "true" {
+				replayed = append(replayed, string(record.Value))
+			} else {
+				values = append(values, string(record.Value))
+			}
+		}
+	}))
+	defer hook.Close()
+
+	client, config, teardown := setupTest(t, func(c *Config) {
+		c.WebhookClient = hook.Client()
+	})
+	defer teardown()
+	ctx := asPrincipal(context.Background(), "root-key")
+	for _, name := range []string{"events", "events.dlq"} {
+		_, err := client.CreateTopic(ctx, &api.CreateTopicRequest{Name: name})
+		require.NoError(t, err)
+	}
+	for _, bad := range []*api.Subscription{
+		{Name: "attempts", Topic: "events", Url: hook.URL, MaxAttempts: 2},
+		{Name: "loop", Topic: "events", Url: hook.URL, DeadLetterTopic: "events"},
+	} {
+		_, err := client.CreateSubscription(ctx, &api.CreateSubscriptionRequest{Subscription: bad})
+		require.Equal(t, codes.InvalidArgument, status.Code(err), bad.Name)
+	}
+	_, err := client.CreateSubscription(ctx, &api.CreateSubscriptionRequest{Subscription: &api.Subscription{
+		Name: "missing", Topic: "events", Url: hook.URL, DeadLetterTopic: "missing",
+	}})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.CreateSubscription(ctx, &api.CreateSubscriptionRequest{Subscription: &api.Subscription{
+		Name: "hook", Topic: "events", Url: hook.URL, DeadLetterTopic: "events.dlq", MaxAttempts: 2,
+	}})
+	require.NoError(t, err)
+	_, err = client.CreateSubscription(ctx, &api.CreateSubscriptionRequest{Subscription: &api.Subscription{
+		Name: "plain", Topic: "events.dlq", Url: hook.URL,
+	}})
+	require.NoError(t, err)
+	_, err = client.ListDeadLetters(ctx, &api.ListDeadLettersRequest{Subscription: "plain"})
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	stop := DeliverWebhooks(config)
+	defer func() { stop() }()
+	_, err = client.ProduceBatch(ctx, &api.ProduceBatchRequest{Topic: "events", Records: []*api.Record{
+		{Value: []byte("a"), Headers: []*api.Header{{Key: "source", Value: []byte("web")}}},
+		{Value: []byte("b")},
+	}})
+	require.NoError(t, err)
+
+	// the batch failing its attempts is dead-lettered, moving the cursor on
+	var letters *api.ListDeadLettersResponse
+	require.Eventually(t, func() bool {
+		letters, err = client.ListDeadLetters(ctx, &api.ListDeadLettersRequest{Subscription: "hook"})
+		require.NoError(t, err)
+		return len(letters.DeadLetters) == 2
+	}, 10*time.Second, 10*time.Millisecond)
+	letter := letters.DeadLetters[0]
+	require.Equal(t, "events", letter.Topic)
+	require.Equal(t, uint32(2), letter.Attempts)
+	require.Contains(t, letter.Error, "500")
+	require.Equal(t, "a", string(letter.Record.Value))
+	require.Equal(t, []*api.Header{{Key: "source", Value: []byte("web")}}, letter.Record.Headers)
+	require.Equal(t, uint64(1), letters.DeadLetters[1].Record.Offset)
+	require.Equal(t, uint64(2), letters.NextOffset)
+	require.Eventually(t, func() bool {
+		res, err := client.GetGroupLag(ctx, &api.GetGroupLagRequest{Group: subscriptionGroup("hook")})
+		return err == nil && len(res.Lags) == 1 && res.Lags[0].Committed == 2
+	}, time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	_, err = client.Produce(ctx, &api.ProduceRequest{Topic: "events", Record: &api.Record{Value: []byte("c")}})
+	require.NoError(t, err)
+	res, err := client.ReplayDeadLetters(ctx, &api.ReplayDeadLettersRequest{Subscription: "hook", Max: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), res.Replayed)
+	res, err = client.ReplayDeadLetters(ctx, &api.ReplayDeadLettersRequest{Subscription: "hook", Offset: res.NextOffset})
+	require.NoError(t, err)
+	require.Equal(t, uint32(1), res.Replayed)
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Contains(values, "c")
+	}, 5*time.Second, 10*time.Millisecond)
+	mu.Lock()
+	require.Equal(t, []string{"a", "b"}, replayed)
+	mu.Unlock()
+
+	srv := httptest.NewServer(NewHTTPServer("", config).Handler)
+	defer srv.Close()
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/subscriptions/hook/dead-letters?offset=1", nil)
+	require.NoError(t, err)
+	req.Header.Set(auth.APIKeyHeader, "root-key")
+	hres, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer hres.Body.Close()
+	require.Equal(t, http.StatusOK, hres.StatusCode)
+	var list ListDeadLettersResponse
+	require.NoError(t, json.NewDecoder(hres.Body).Decode(&list))
+	require.Len(t, list.DeadLetters, 1)
+	require.Equal(t, "b", string(list.DeadLetters[0].Record.Value))
+}
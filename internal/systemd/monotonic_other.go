@@ -0,0 +1,10 @@
+//go:build !linux
+
+package systemd
+
+import "time"
+
+// systemd only runs on Linux
+func monotonic() time.Duration {
+	return 0
+}
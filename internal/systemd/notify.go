@@ -0,0 +1,91 @@
+// Package systemd tells systemd how the process is doing, for services run
+// with Type=notify, and pings its watchdog. Outside systemd, without
+// NOTIFY_SOCKET set, it does nothing.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The states Notify sends
+const (
+	// Ready is sent once the process has started and serves
+	Ready = "READY=1"
+	// Stopping is sent as the process starts shutting down
+	Stopping = "STOPPING=1"
+	// Reloading is sent as the process starts reloading its config, and
+	// Ready once it's done
+	Reloading = "RELOADING=1"
+	// Watchdog pings the watchdog, see WatchdogInterval
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends the state to the socket systemd listens on for the service,
+// reporting whether there's one. Reloading is sent with the time it's sent
+// at, as systemd needs it.
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	if name[0] == '@' {
+		// an abstract socket
+		name = "\x00" + name[1:]
+	}
+	if state == Reloading {
+		state += "\nMONOTONIC_USEC=" + strconv.FormatInt(monotonic().Microseconds(), 10)
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns how long systemd waits for a ping before it
+// restarts the service, 0 if it isn't watching this process. Pinging at
+// half of it leaves room for a late ping.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// meant for another process
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watch pings the watchdog every half interval while live returns nil,
+// until the returned func is called. A process that stops being live stops
+// pinging, and is restarted once the interval is up.
+func Watch(interval time.Duration, live func() error, onErr func(error)) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := live(); err != nil {
+				onErr(err)
+				continue
+			}
+			if _, err := Notify(Watchdog); err != nil {
+				onErr(err)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
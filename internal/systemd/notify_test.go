@@ -0,0 +1,92 @@
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Listens where systemd would, returning what's sent to it
+func listen(t *testing.T) <-chan string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: name, Net: "unixgram"})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", name)
+	states := make(chan string, 16)
+	go func() {
+		b := make([]byte, 1024)
+		for {
+			n, err := conn.Read(b)
+			if err != nil {
+				return
+			}
+			states <- string(b[:n])
+		}
+	}()
+	return states
+}
+
+func TestNotify(t *testing.T) {
+	// outside systemd
+	t.Setenv("NOTIFY_SOCKET", "")
+	ok, err := Notify(Ready)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	states := listen(t)
+	ok, err = Notify(Ready)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, Ready, <-states)
+
+	_, err = Notify(Reloading)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(<-states, Reloading+"\nMONOTONIC_USEC="))
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	t.Setenv("WATCHDOG_USEC", "")
+	require.Zero(t, WatchdogInterval())
+	t.Setenv("WATCHDOG_USEC", "2000000")
+	require.Equal(t, 2*time.Second, WatchdogInterval())
+	t.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()+1))
+	require.Zero(t, WatchdogInterval())
+}
+
+func TestWatch(t *testing.T) {
+	states := listen(t)
+	var live atomic.Pointer[error]
+	errs := make(chan error, 16)
+	stop := Watch(20*time.Millisecond, func() error {
+		if err := live.Load(); err != nil {
+			return *err
+		}
+		return nil
+	}, func(err error) { errs <- err })
+	defer stop()
+	require.Equal(t, Watchdog, <-states)
+
+	// a process that isn't live stops pinging
+	hung := errors.New("hung")
+	live.Store(&hung)
+	require.EqualError(t, <-errs, "hung")
+	require.EqualError(t, <-errs, "hung")
+	for len(states) > 0 {
+		<-states
+	}
+	select {
+	case <-states:
+		t.Fatal("pinged the watchdog while not live")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
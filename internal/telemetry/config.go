@@ -0,0 +1,61 @@
+package telemetry
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// Config says where and how telemetry is pushed over OTLP. Empty fields fall
+// back to the standard OTEL_* variables, so either can configure the exporters.
+type Config struct {
+	// TracesExporter is "otlp", "console" or "none"
+	TracesExporter string
+	// MetricsExporter is "otlp" or "none", Prometheus scraping works either way
+	MetricsExporter string
+	// Protocol is "grpc" or "http/protobuf"
+	Protocol string
+	// Endpoint is a host:port or a URL of the collector
+	Endpoint string
+	Headers  map[string]string
+	// Insecure disables TLS to the collector
+	Insecure bool
+	// SampleRatio keeps that fraction of new traces, zero leaves sampling to
+	// OTEL_TRACES_SAMPLER. Sampling decisions made by callers are always honoured.
+	SampleRatio float64
+	// MetricsInterval is how often metrics are pushed, defaults to a minute
+	MetricsInterval time.Duration
+}
+
+// The exporter kind from the config, else the given OTEL_* variable
+func (c Config) exporter(kind, envVar string) string {
+	if kind != "" {
+		return kind
+	}
+	return os.Getenv(envVar)
+}
+
+// The configured protocol, else the signal specific variable, the generic one and the spec default
+func (c Config) protocol(signalVar string) string {
+	if c.Protocol != "" {
+		return c.Protocol
+	}
+	return otlpProtocol(signalVar)
+}
+
+// ParseHeaders parses "key1=value1,key2=value2", the OTEL_EXPORTER_OTLP_HEADERS format
+func ParseHeaders(s string) map[string]string {
+	headers := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+		headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return headers
+}
+
+func isURL(endpoint string) bool {
+	return strings.Contains(endpoint, "://")
+}
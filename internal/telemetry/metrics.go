@@ -0,0 +1,91 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	otelprom "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// SetupMetrics pushes everything registered with the default Prometheus
+// registry over OTLP every MetricsInterval, unless the metrics exporter
+// (c.MetricsExporter, else OTEL_METRICS_EXPORTER) is unset or "none".
+// /metrics keeps serving the same metrics for scraping. The returned func
+// pushes a final time and stops.
+func SetupMetrics(ctx context.Context, c Config) (shutdown func(context.Context) error, err error) {
+	var exporter sdkmetric.Exporter
+	switch kind := c.exporter(c.MetricsExporter, "OTEL_METRICS_EXPORTER"); kind {
+	case "", "none", "prometheus":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = newOTLPMetricExporter(ctx, c)
+	default:
+		return nil, fmt.Errorf("unsupported metrics exporter %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := newResource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	interval := c.MetricsInterval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	reader := sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(interval),
+		sdkmetric.WithProducer(otelprom.NewMetricProducer()),
+	)
+	mp := sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(reader),
+		sdkmetric.WithResource(res),
+	)
+	otel.SetMeterProvider(mp)
+	return mp.Shutdown, nil
+}
+
+func newOTLPMetricExporter(ctx context.Context, c Config) (sdkmetric.Exporter, error) {
+	switch protocol := c.protocol("OTEL_EXPORTER_OTLP_METRICS_PROTOCOL"); protocol {
+	case "grpc":
+		var opts []otlpmetricgrpc.Option
+		if c.Endpoint != "" {
+			if isURL(c.Endpoint) {
+				opts = append(opts, otlpmetricgrpc.WithEndpointURL(c.Endpoint))
+			} else {
+				opts = append(opts, otlpmetricgrpc.WithEndpoint(c.Endpoint))
+			}
+		}
+		if len(c.Headers) > 0 {
+			opts = append(opts, otlpmetricgrpc.WithHeaders(c.Headers))
+		}
+		if c.Insecure {
+			opts = append(opts, otlpmetricgrpc.WithInsecure())
+		}
+		return otlpmetricgrpc.New(ctx, opts...)
+	case "http/protobuf":
+		var opts []otlpmetrichttp.Option
+		if c.Endpoint != "" {
+			if isURL(c.Endpoint) {
+				opts = append(opts, otlpmetrichttp.WithEndpointURL(c.Endpoint))
+			} else {
+				opts = append(opts, otlpmetrichttp.WithEndpoint(c.Endpoint))
+			}
+		}
+		if len(c.Headers) > 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(c.Headers))
+		}
+		if c.Insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q", protocol)
+	}
+}
@@ -0,0 +1,54 @@
+package telemetry
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupMetricsPushesOTLP(t *testing.T) {
+	promauto.NewCounter(prometheus.CounterOpts{
+		Name: "proglog_test_pushed_total",
+		Help: "Test counter.",
+	}).Inc()
+
+	bodies := make(chan []byte, 10)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/metrics", r.URL.Path)
+		require.Equal(t, "secret", r.Header.Get("X-Token"))
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer collector.Close()
+
+	shutdown, err := SetupMetrics(t.Context(), Config{
+		MetricsExporter: "otlp",
+		Protocol:        "http/protobuf",
+		Endpoint:        collector.URL + "/v1/metrics",
+		Headers:         map[string]string{"X-Token": "secret"},
+		MetricsInterval: time.Hour,
+	})
+	require.NoError(t, err)
+	// shutting down pushes whatever has been collected
+	require.NoError(t, shutdown(t.Context()))
+
+	select {
+	case body := <-bodies:
+		require.Contains(t, string(body), "proglog_test_pushed_total")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no metrics pushed")
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	require.Equal(t,
+		map[string]string{"a": "1", "b": "x=y"},
+		ParseHeaders("a=1, b=x=y,bogus"),
+	)
+}
@@ -0,0 +1,123 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+)
+
+const serviceName = "proglog"
+
+// SetupTracing installs the global W3C trace context propagator and, unless
+// the traces exporter is unset or "none", a tracer provider exporting spans.
+//
+// Anything c leaves empty comes from the standard OTEL_* variables: the
+// exporter (OTEL_TRACES_EXPORTER), OTEL_EXPORTER_OTLP_PROTOCOL, the OTLP
+// endpoint and headers, OTEL_TRACES_SAMPLER, OTEL_SERVICE_NAME and
+// OTEL_RESOURCE_ATTRIBUTES. The returned func flushes pending spans.
+func SetupTracing(ctx context.Context, c Config) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	var exporter sdktrace.SpanExporter
+	switch kind := c.exporter(c.TracesExporter, "OTEL_TRACES_EXPORTER"); kind {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "console":
+		exporter, err = stdouttrace.New()
+	case "otlp":
+		exporter, err = newOTLPTraceExporter(ctx, c)
+	default:
+		return nil, fmt.Errorf("unsupported traces exporter %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := newResource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	}
+	if c.SampleRatio > 0 {
+		opts = append(opts, sdktrace.WithSampler(
+			sdktrace.ParentBased(sdktrace.TraceIDRatioBased(c.SampleRatio)),
+		))
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(tp)
+	return tp.Shutdown, nil
+}
+
+func newOTLPTraceExporter(ctx context.Context, c Config) (sdktrace.SpanExporter, error) {
+	switch protocol := c.protocol("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"); protocol {
+	case "grpc":
+		var opts []otlptracegrpc.Option
+		if c.Endpoint != "" {
+			if isURL(c.Endpoint) {
+				opts = append(opts, otlptracegrpc.WithEndpointURL(c.Endpoint))
+			} else {
+				opts = append(opts, otlptracegrpc.WithEndpoint(c.Endpoint))
+			}
+		}
+		if len(c.Headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(c.Headers))
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case "http/protobuf":
+		var opts []otlptracehttp.Option
+		if c.Endpoint != "" {
+			if isURL(c.Endpoint) {
+				opts = append(opts, otlptracehttp.WithEndpointURL(c.Endpoint))
+			} else {
+				opts = append(opts, otlptracehttp.WithEndpoint(c.Endpoint))
+			}
+		}
+		if len(c.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(c.Headers))
+		}
+		if c.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q", protocol)
+	}
+}
+
+// Signal specific protocol variable, then the generic one, then the spec default
+func otlpProtocol(signalVar string) string {
+	if p := os.Getenv(signalVar); p != "" {
+		return p
+	}
+	if p := os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"); p != "" {
+		return p
+	}
+	return "http/protobuf"
+}
+
+func newResource(ctx context.Context) (*resource.Resource, error) {
+	return resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		// env last so OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES win
+		resource.WithFromEnv(),
+		resource.WithHost(),
+	)
+}
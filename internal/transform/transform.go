@@ -0,0 +1,320 @@
+// Package transform runs WebAssembly modules over records on their way
+// into a topic, to validate, enrich, redact or drop them.
+//
+// A module exports its memory and two functions:
+//
+//	alloc(size i32) i32
+//	transform(ptr i32, len i32) i64
+//
+// The record, an api.Record in protobuf, is written to the size bytes
+// alloc returns and transform is called on them. It answers with the
+// address of its result in the upper 32 bits and its length in the lower.
+// The result's first byte is the verdict: 0 keeps the record, the rest of
+// the result being the record to append in protobuf; 1 drops it; and 2
+// rejects it, the rest being why in UTF-8.
+//
+// Modules may import WASI, as TinyGo's and Rust's wasm32-wasip1 targets
+// do, but see no files, environment or arguments. A reactor's _initialize
+// runs when an instance starts. Instances are reused across records, so a
+// module shouldn't keep anything between calls.
+package transform
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/tetratelabs/wazero"
+	wasm "github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"google.golang.org/protobuf/proto"
+)
+
+// The verdicts a module's result starts with
+const (
+	keep   = 0
+	drop   = 1
+	reject = 2
+)
+
+// Limits bound what a module's instances may use
+type Limits struct {
+	// MemoryBytes caps each instance's memory, rounded up to 64 KiB pages,
+	// 16 MiB when unset. Modules asking for more to start with don't load,
+	// and growing past it fails in the module.
+	MemoryBytes uint64
+	// Timeout caps each record's call, 100ms when unset. The instance is
+	// stopped and the record fails.
+	Timeout time.Duration
+}
+
+// ErrRejected is a module's rejection of a record
+type ErrRejected struct {
+	Module string
+	Reason string
+}
+
+func (e ErrRejected) Error() string {
+	return fmt.Sprintf("rejected by transform %s: %s", e.Module, e.Reason)
+}
+
+// Transforms holds the compiled modules by name, safe for concurrent use
+type Transforms struct {
+	limits  Limits
+	runtime wazero.Runtime
+
+	mu      sync.RWMutex
+	modules map[string]*module
+}
+
+// module is a compiled module and its idle instances
+type module struct {
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	idle     chan wasm.Module
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// New returns Transforms holding no modules, running them within limits
+func New(limits Limits) *Transforms {
+	if limits.MemoryBytes == 0 {
+		limits.MemoryBytes = 16 << 20
+	}
+	if limits.Timeout == 0 {
+		limits.Timeout = 100 * time.Millisecond
+	}
+	pages := min((limits.MemoryBytes+65535)/65536, 65536)
+	rt := wazero.NewRuntimeWithConfig(context.Background(), wazero.NewRuntimeConfig().
+		WithMemoryLimitPages(uint32(pages)).
+		WithCloseOnContextDone(true))
+	wasi_snapshot_preview1.MustInstantiate(context.Background(), rt)
+	return &Transforms{limits: limits, runtime: rt, modules: make(map[string]*module)}
+}
+
+// Load compiles the module and holds it as name, replacing the one held
+// as name before
+func (t *Transforms) Load(name string, b []byte) error {
+	m, err := t.compile(b)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	old := t.modules[name]
+	t.modules[name] = m
+	t.mu.Unlock()
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// LoadDir holds the modules of the dir's .wasm files, each by its file's
+// name without the extension, in place of those held before. If one fails
+// to compile, none are replaced.
+func (t *Transforms) LoadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	modules := make(map[string]*module)
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), ".wasm")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		var m *module
+		b, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err == nil {
+			m, err = t.compile(b)
+		}
+		if err != nil {
+			for _, m := range modules {
+				m.close()
+			}
+			return fmt.Errorf("transform %s: %w", name, err)
+		}
+		modules[name] = m
+	}
+	t.mu.Lock()
+	old := t.modules
+	t.modules = modules
+	t.mu.Unlock()
+	for _, m := range old {
+		m.close()
+	}
+	return nil
+}
+
+// Compiles the module and checks it exports what the calls need
+func (t *Transforms) compile(b []byte) (*module, error) {
+	ctx := context.Background()
+	compiled, err := t.runtime.CompileModule(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+	exports := compiled.ExportedFunctions()
+	for fn, sig := range map[string][2][]wasm.ValueType{
+		"alloc":     {{wasm.ValueTypeI32}, {wasm.ValueTypeI32}},
+		"transform": {{wasm.ValueTypeI32, wasm.ValueTypeI32}, {wasm.ValueTypeI64}},
+	} {
+		def, ok := exports[fn]
+		if !ok || !slices.Equal(def.ParamTypes(), sig[0]) || !slices.Equal(def.ResultTypes(), sig[1]) {
+			compiled.Close(ctx)
+			return nil, fmt.Errorf("module doesn't export %s with the signature transforms call", fn)
+		}
+	}
+	if len(compiled.ExportedMemories()) == 0 {
+		compiled.Close(ctx)
+		return nil, errors.New("module doesn't export its memory")
+	}
+	return &module{runtime: t.runtime, compiled: compiled, idle: make(chan wasm.Module, runtime.GOMAXPROCS(0))}, nil
+}
+
+// Has reports whether a module is held as name
+func (t *Transforms) Has(name string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.modules[name]
+	return ok
+}
+
+// Names returns the names of the modules held, sorted
+func (t *Transforms) Names() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	names := make([]string, 0, len(t.modules))
+	for name := range t.modules {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Apply runs the module held as name over the record, returning the record
+// it keeps, nil if it drops it, or ErrRejected. The record isn't changed.
+func (t *Transforms) Apply(ctx context.Context, name string, record *api.Record) (*api.Record, error) {
+	t.mu.RLock()
+	m, ok := t.modules[name]
+	t.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("transform %s isn't loaded", name)
+	}
+	in, err := proto.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, t.limits.Timeout)
+	defer cancel()
+	inst, err := m.get(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("transform %s: %w", name, err)
+	}
+	out, err := call(ctx, inst, in)
+	if err != nil {
+		// a trap or timeout leaves the instance in no state to reuse
+		inst.Close(context.Background())
+		return nil, fmt.Errorf("transform %s: %w", name, err)
+	}
+	m.put(inst)
+	if len(out) == 0 {
+		return nil, fmt.Errorf("transform %s: empty result", name)
+	}
+	switch out[0] {
+	case keep:
+		kept := &api.Record{}
+		if err := proto.Unmarshal(out[1:], kept); err != nil {
+			return nil, fmt.Errorf("transform %s: result: %w", name, err)
+		}
+		return kept, nil
+	case drop:
+		return nil, nil
+	case reject:
+		return nil, ErrRejected{Module: name, Reason: string(out[1:])}
+	}
+	return nil, fmt.Errorf("transform %s: unknown verdict %d", name, out[0])
+}
+
+// Writes in to the instance's memory and calls its transform, returning a
+// copy of the result
+func call(ctx context.Context, inst wasm.Module, in []byte) ([]byte, error) {
+	res, err := inst.ExportedFunction("alloc").Call(ctx, uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := uint32(res[0])
+	if !inst.Memory().Write(ptr, in) {
+		return nil, fmt.Errorf("alloc returned %d bytes at %d, outside memory", len(in), ptr)
+	}
+	res, err = inst.ExportedFunction("transform").Call(ctx, uint64(ptr), uint64(len(in)))
+	if err != nil {
+		return nil, err
+	}
+	ptr, size := uint32(res[0]>>32), uint32(res[0])
+	out, ok := inst.Memory().Read(ptr, size)
+	if !ok {
+		return nil, fmt.Errorf("result of %d bytes at %d is outside memory", size, ptr)
+	}
+	return slices.Clone(out), nil
+}
+
+// An idle instance of the module, or a new one
+func (m *module) get(ctx context.Context) (wasm.Module, error) {
+	select {
+	case inst := <-m.idle:
+		return inst, nil
+	default:
+	}
+	return m.runtime.InstantiateModule(ctx, m.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+}
+
+// Keeps the instance for the next call, unless the module was replaced or
+// enough are idle
+func (m *module) put(inst wasm.Module) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		select {
+		case m.idle <- inst:
+			return
+		default:
+		}
+	}
+	inst.Close(context.Background())
+}
+
+// Closes the module's idle instances and its compiled code. Calls under
+// way finish, closing their instances after.
+func (m *module) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	for {
+		select {
+		case inst := <-m.idle:
+			inst.Close(context.Background())
+		default:
+			m.compiled.Close(context.Background())
+			return
+		}
+	}
+}
+
+// Close closes the modules and the runtime running them
+func (t *Transforms) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.modules = make(map[string]*module)
+	return t.runtime.Close(context.Background())
+}
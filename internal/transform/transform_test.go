@@ -0,0 +1,125 @@
+package transform
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/frankie-mur/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// redact is this module, assembled by hand. Going by the value's first
+// byte, taking the value to be the record's first field and shorter than
+// 128 bytes, it drops records starting with d, rejects those with r, spins
+// on those with l, and keeps the rest with their values' bytes starred.
+//
+//	(module
+//	  (memory (export "memory") 1)
+//	  (data (i32.const 15) "\02rejected")
+//	  (func (export "alloc") (param i32) (result i32) (i32.const 1024))
+//	  (func (export "transform") (param $ptr i32) (param $len i32) (result i64)
+//	    (local $i i32)
+//	    (if (i32.eq (i32.load8_u (i32.add (local.get $ptr) (i32.const 2))) (i32.const 100))
+//	      (then (i32.store8 (i32.const 8) (i32.const 1)) (return (i64.const 0x800000001))))
+//	    (if (i32.eq (i32.load8_u (i32.add (local.get $ptr) (i32.const 2))) (i32.const 114))
+//	      (then (return (i64.const 0xf00000009))))
+//	    (if (i32.eq (i32.load8_u (i32.add (local.get $ptr) (i32.const 2))) (i32.const 108))
+//	      (then (loop $spin (br $spin))))
+//	    (i32.store8 (i32.const 4096) (i32.const 0))
+//	    (memory.copy (i32.const 4097) (local.get $ptr) (local.get $len))
+//	    (block $done
+//	      (loop $star
+//	        (br_if $done (i32.ge_u (local.get $i)
+//	          (i32.load8_u (i32.add (local.get $ptr) (i32.const 1)))))
+//	        (i32.store8 (i32.add (i32.const 4099) (local.get $i)) (i32.const 42))
+//	        (local.set $i (i32.add (local.get $i) (i32.const 1)))
+//	        (br $star)))
+//	    (i64.or (i64.const 0x100000000000)
+//	      (i64.extend_i32_u (i32.add (local.get $len) (i32.const 1))))))
+var redact = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00, 0x01, 0x0c, 0x02, 0x60, 0x01, 0x7f, 0x01, 0x7f,
+	0x60, 0x02, 0x7f, 0x7f, 0x01, 0x7e, 0x03, 0x03, 0x02, 0x00, 0x01, 0x05, 0x03, 0x01, 0x00, 0x01,
+	0x07, 0x1e, 0x03, 0x06, 0x6d, 0x65, 0x6d, 0x6f, 0x72, 0x79, 0x02, 0x00, 0x05, 0x61, 0x6c, 0x6c,
+	0x6f, 0x63, 0x00, 0x00, 0x09, 0x74, 0x72, 0x61, 0x6e, 0x73, 0x66, 0x6f, 0x72, 0x6d, 0x00, 0x01,
+	0x0a, 0x9f, 0x01, 0x02, 0x05, 0x00, 0x41, 0x80, 0x08, 0x0b, 0x96, 0x01, 0x01, 0x01, 0x7f, 0x20,
+	0x00, 0x41, 0x02, 0x6a, 0x2d, 0x00, 0x00, 0x41, 0xe4, 0x00, 0x46, 0x04, 0x40, 0x41, 0x08, 0x41,
+	0x01, 0x3a, 0x00, 0x00, 0x42, 0x81, 0x80, 0x80, 0x80, 0x80, 0x01, 0x0f, 0x0b, 0x20, 0x00, 0x41,
+	0x02, 0x6a, 0x2d, 0x00, 0x00, 0x41, 0xf2, 0x00, 0x46, 0x04, 0x40, 0x42, 0x89, 0x80, 0x80, 0x80,
+	0xf0, 0x01, 0x0f, 0x0b, 0x20, 0x00, 0x41, 0x02, 0x6a, 0x2d, 0x00, 0x00, 0x41, 0xec, 0x00, 0x46,
+	0x04, 0x40, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b, 0x41, 0x80, 0x20, 0x41, 0x00, 0x3a, 0x00, 0x00,
+	0x41, 0x81, 0x20, 0x20, 0x00, 0x20, 0x01, 0xfc, 0x0a, 0x00, 0x00, 0x02, 0x40, 0x03, 0x40, 0x20,
+	0x02, 0x20, 0x00, 0x41, 0x01, 0x6a, 0x2d, 0x00, 0x00, 0x4f, 0x0d, 0x01, 0x41, 0x83, 0x20, 0x20,
+	0x02, 0x6a, 0x41, 0x2a, 0x3a, 0x00, 0x00, 0x20, 0x02, 0x41, 0x01, 0x6a, 0x21, 0x02, 0x0c, 0x00,
+	0x0b, 0x0b, 0x42, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x04, 0x20, 0x01, 0x41, 0x01, 0x6a, 0xad,
+	0x84, 0x0b, 0x0b, 0x0f, 0x01, 0x00, 0x41, 0x0f, 0x0b, 0x09, 0x02, 0x72, 0x65, 0x6a, 0x65, 0x63,
+	0x74, 0x65, 0x64,
+}
+
+func TestTransforms(t *testing.T) {
+	tr := New(Limits{Timeout: 50 * time.Millisecond})
+	defer tr.Close()
+	require.NoError(t, tr.Load("redact", redact))
+	require.True(t, tr.Has("redact"))
+	ctx := context.Background()
+
+	// kept records come back as the module rewrote them
+	record := &api.Record{
+		Value:   []byte("4111-1111"),
+		Key:     []byte("card"),
+		Headers: []*api.Header{{Key: "source", Value: []byte("pos")}},
+	}
+	for range 3 {
+		kept, err := tr.Apply(ctx, "redact", record)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(&api.Record{
+			Value:   []byte("*********"),
+			Key:     record.Key,
+			Headers: record.Headers,
+		}, kept))
+	}
+	require.Equal(t, "4111-1111", string(record.Value))
+
+	dropped, err := tr.Apply(ctx, "redact", &api.Record{Value: []byte("debug")})
+	require.NoError(t, err)
+	require.Nil(t, dropped)
+	_, err = tr.Apply(ctx, "redact", &api.Record{Value: []byte("raw ssn 078-05-1120")})
+	require.Equal(t, ErrRejected{Module: "redact", Reason: "rejected"}, err)
+
+	// a call running past the timeout fails, and the next gets an instance
+	// of its own
+	start := time.Now()
+	_, err = tr.Apply(ctx, "redact", &api.Record{Value: []byte("loop")})
+	require.Error(t, err)
+	require.Less(t, time.Since(start), time.Second)
+	_, err = tr.Apply(ctx, "redact", record)
+	require.NoError(t, err)
+
+	_, err = tr.Apply(ctx, "scrub", record)
+	require.Error(t, err)
+	require.Error(t, tr.Load("scrub", []byte("not wasm")))
+	require.Error(t, tr.Load("scrub", []byte("\x00asm\x01\x00\x00\x00")))
+	require.False(t, tr.Has("scrub"))
+
+	// modules starting with more memory than the limit don't load
+	greedy := bytes.Clone(redact)
+	greedy[bytes.Index(greedy, []byte{0x05, 0x03, 0x01, 0x00, 0x01})+4] = 2
+	small := New(Limits{MemoryBytes: 64 << 10})
+	defer small.Close()
+	require.NoError(t, small.Load("redact", redact))
+	require.Error(t, small.Load("greedy", greedy))
+
+	// a directory's modules replace those held, unless one doesn't load
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "scrub.wasm"), redact, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README"), []byte("modules"), 0644))
+	require.NoError(t, tr.LoadDir(dir))
+	require.Equal(t, []string{"scrub"}, tr.Names())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.wasm"), []byte("not wasm"), 0644))
+	require.Error(t, tr.LoadDir(dir))
+	require.Equal(t, []string{"scrub"}, tr.Names())
+}
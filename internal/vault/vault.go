@@ -0,0 +1,327 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/frankie-mur/proglog/internal/server/log"
+)
+
+var ErrNoCertificate = errors.New("vault: no certificate issued yet")
+
+// Client talks to the Vault HTTP API using a token
+type Client struct {
+	Addr  string
+	Token string
+	HTTP  *http.Client
+}
+
+func NewClient(addr, token string) *Client {
+	return &Client{
+		Addr:  strings.TrimSuffix(addr, "/"),
+		Token: token,
+		HTTP:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Performs a request against /v1/<path> and decodes the JSON response into out
+func (c *Client) do(ctx context.Context, method, path string, body, out any) error {
+	var r bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&r).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.Addr+"/v1/"+path, &r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", c.Token)
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(res.Body).Decode(&e)
+		return fmt.Errorf("vault: %s %s: %d %s", method, path, res.StatusCode, strings.Join(e.Errors, "; "))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// LookupToken returns how long the client's own token has left, zero for
+// one that never expires, such as a root token
+func (c *Client) LookupToken(ctx context.Context) (time.Duration, error) {
+	var res struct {
+		Data struct {
+			TTL int `json:"ttl"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, "auth/token/lookup-self", nil, &res); err != nil {
+		return 0, err
+	}
+	return time.Duration(res.Data.TTL) * time.Second, nil
+}
+
+// RenewToken extends the lease of the client's own token, by the token's
+// own TTL for a zero increment
+func (c *Client) RenewToken(ctx context.Context, increment time.Duration) (time.Duration, error) {
+	var res struct {
+		Auth struct {
+			LeaseDuration int `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	body := map[string]string{}
+	if increment > 0 {
+		body["increment"] = increment.String()
+	}
+	if err := c.do(ctx, http.MethodPost, "auth/token/renew-self", body, &res); err != nil {
+		return 0, err
+	}
+	return time.Duration(res.Auth.LeaseDuration) * time.Second, nil
+}
+
+// KeepTokenAlive renews the client's own token halfway through each lease,
+// retrying failed renewals every minute, until ctx is done. It returns
+// at once for a token that never expires.
+func (c *Client) KeepTokenAlive(ctx context.Context, onErr func(error)) {
+	ttl, err := c.LookupToken(ctx)
+	for {
+		wait := ttl / 2
+		switch {
+		case ctx.Err() != nil, err == nil && ttl == 0:
+			return
+		case err != nil:
+			if onErr != nil {
+				onErr(err)
+			}
+			wait = time.Minute
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+			ttl, err = c.RenewToken(ctx, 0)
+		}
+	}
+}
+
+// LoadKeys reads the KV v2 secret at <mount>/data/<path>, whose fields map
+// key IDs to base64 encoded keys, and adds any IDs not yet in the keyring.
+func (c *Client) LoadKeys(ctx context.Context, mount, path string, keys *log.Keyring) error {
+	var res struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := c.do(ctx, http.MethodGet, mount+"/data/"+path, nil, &res); err != nil {
+		return err
+	}
+	for k, v := range res.Data.Data {
+		id, err := strconv.ParseUint(k, 10, 32)
+		if err != nil {
+			return fmt.Errorf("vault: key id %q: %w", k, err)
+		}
+		if keys.Has(uint32(id)) {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return fmt.Errorf("vault: key %d: %w", id, err)
+		}
+		if err := keys.Add(uint32(id), key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WatchKeys reloads the keys every interval until ctx is done, so keys
+// rotated in Vault are picked up without a restart
+func (c *Client) WatchKeys(ctx context.Context, mount, path string, keys *log.Keyring, interval time.Duration, onErr func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := c.LoadKeys(ctx, mount, path, keys); err != nil && onErr != nil {
+				onErr(err)
+			}
+		}
+	}
+}
+
+// CertProvider issues TLS certificates from a Vault PKI role and keeps them in memory only
+type CertProvider struct {
+	client     *Client
+	mount      string
+	role       string
+	commonName string
+	ttl        time.Duration
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	pool *x509.CertPool
+}
+
+func NewCertProvider(client *Client, mount, role, commonName string, ttl time.Duration) *CertProvider {
+	return &CertProvider{
+		client:     client,
+		mount:      mount,
+		role:       role,
+		commonName: commonName,
+		ttl:        ttl,
+	}
+}
+
+// Issue requests a fresh certificate and makes it the current one
+func (p *CertProvider) Issue(ctx context.Context) error {
+	var res struct {
+		Data struct {
+			Certificate string   `json:"certificate"`
+			PrivateKey  string   `json:"private_key"`
+			IssuingCA   string   `json:"issuing_ca"`
+			CAChain     []string `json:"ca_chain"`
+		} `json:"data"`
+	}
+	body := map[string]string{"common_name": p.commonName}
+	if p.ttl > 0 {
+		body["ttl"] = p.ttl.String()
+	}
+	if err := p.client.do(ctx, http.MethodPost, p.mount+"/issue/"+p.role, body, &res); err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair([]byte(res.Data.Certificate), []byte(res.Data.PrivateKey))
+	if err != nil {
+		return err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM([]byte(res.Data.IssuingCA))
+	for _, ca := range res.Data.CAChain {
+		pool.AppendCertsFromPEM([]byte(ca))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.cert = &cert
+	p.pool = pool
+	return nil
+}
+
+// GetCertificate is suitable for tls.Config.GetCertificate
+func (p *CertProvider) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.cert == nil {
+		return nil, ErrNoCertificate
+	}
+	return p.cert, nil
+}
+
+// GetClientCertificate is suitable for tls.Config.GetClientCertificate
+func (p *CertProvider) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return p.GetCertificate(nil)
+}
+
+// CAs returns the pool of CAs that issued the current certificate
+func (p *CertProvider) CAs() *x509.CertPool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.pool
+}
+
+// ServerTLSConfig serves the current certificate, verifying clients' given
+// ones against the current CAs, both read as each handshake starts so
+// reissued certificates and rotated CAs are picked up. It offers HTTP/2
+// and HTTP/1.1.
+func (p *CertProvider) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: p.GetCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return &tls.Config{
+				GetCertificate: p.GetCertificate,
+				ClientCAs:      p.CAs(),
+				ClientAuth:     tls.VerifyClientCertIfGiven,
+				NextProtos:     []string{"h2", "http/1.1"},
+			}, nil
+		},
+	}
+}
+
+// ClientTLSConfig presents the current certificate, verifying servers'
+// against the current CAs as each handshake finishes, so rotated CAs are
+// picked up
+func (p *CertProvider) ClientTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetClientCertificate: p.GetClientCertificate,
+		// verified in VerifyConnection instead, against the CAs as they are
+		InsecureSkipVerify: true,
+		VerifyConnection:   p.verifyServer,
+	}
+}
+
+// Verifies the server's certificate against the current CAs, as a config
+// with them for RootCAs would
+func (p *CertProvider) verifyServer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("vault: server sent no certificate")
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         p.CAs(),
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// Renew reissues the certificate once two thirds of its lifetime has passed,
+// retrying failed renewals every minute, until ctx is done
+func (p *CertProvider) Renew(ctx context.Context, onErr func(error)) {
+	failed := false
+	for {
+		wait := time.Minute
+		p.mu.RLock()
+		if p.cert != nil && !failed {
+			leaf := p.cert.Leaf
+			wait = time.Until(leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) * 2 / 3))
+		}
+		p.mu.RUnlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+			err := p.Issue(ctx)
+			failed = err != nil
+			if failed && onErr != nil {
+				onErr(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/frankie-mur/proglog/internal/server/log"
+	"github.com/stretchr/testify/require"
+)
+
+const token = "s.test"
+
+func TestLoadKeys(t *testing.T) {
+	secret := map[string]string{"1": base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != token {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		require.Equal(t, "/v1/secret/data/proglog", r.URL.Path)
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"data": secret}})
+	}))
+	defer srv.Close()
+
+	keys := log.NewKeyring()
+	err := NewClient(srv.URL, "wrong").LoadKeys(context.Background(), "secret", "proglog", keys)
+	require.ErrorContains(t, err, "permission denied")
+
+	c := NewClient(srv.URL, token)
+	require.NoError(t, c.LoadKeys(context.Background(), "secret", "proglog", keys))
+	require.Equal(t, uint32(1), keys.Current())
+
+	// a rotated key shows up on the next load, existing keys are kept
+	secret["2"] = base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+	require.NoError(t, c.LoadKeys(context.Background(), "secret", "proglog", keys))
+	require.Equal(t, uint32(2), keys.Current())
+	require.True(t, keys.Has(1))
+}
+
+func TestCertProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/pki/issue/server", r.URL.Path)
+		var req map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		certPEM, keyPEM := selfSigned(t, req["common_name"])
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+			"certificate": string(certPEM),
+			"private_key": string(keyPEM),
+			"issuing_ca":  string(certPEM),
+		}})
+	}))
+	defer srv.Close()
+
+	p := NewCertProvider(NewClient(srv.URL, token), "pki", "server", "127.0.0.1", time.Hour)
+	_, err := p.GetCertificate(nil)
+	require.ErrorIs(t, err, ErrNoCertificate)
+
+	require.NoError(t, p.Issue(context.Background()))
+	cert, err := p.GetCertificate(nil)
+	require.NoError(t, err)
+	require.Equal(t, "127.0.0.1", cert.Leaf.Subject.CommonName)
+	require.NotNil(t, p.CAs())
+}
+
+func TestCertProviderTLSConfigs(t *testing.T) {
+	// each certificate's issued by a CA of its own, as after rotations
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		certPEM, keyPEM := selfSigned(t, "127.0.0.1")
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+			"certificate": string(certPEM),
+			"private_key": string(keyPEM),
+			"issuing_ca":  string(certPEM),
+		}})
+	}))
+	defer srv.Close()
+
+	p := NewCertProvider(NewClient(srv.URL, token), "pki", "server", "127.0.0.1", time.Hour)
+	require.NoError(t, p.Issue(context.Background()))
+	serverTLS, clientTLS := p.ServerTLSConfig(), p.ClientTLSConfig()
+	stale := &tls.Config{GetClientCertificate: p.GetClientCertificate, RootCAs: p.CAs()}
+	require.NoError(t, p.Issue(context.Background()))
+
+	handshake := func(clientTLS *tls.Config) (tls.ConnectionState, error) {
+		clientTLS = clientTLS.Clone()
+		clientTLS.ServerName = "127.0.0.1"
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer ln.Close()
+		type result struct {
+			state tls.ConnectionState
+			err   error
+		}
+		results := make(chan result, 1)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				results <- result{err: err}
+				return
+			}
+			server := tls.Server(conn, serverTLS)
+			defer server.Close()
+			err = server.Handshake()
+			results <- result{server.ConnectionState(), err}
+		}()
+		client, err := tls.Dial("tcp", ln.Addr().String(), clientTLS)
+		if err == nil {
+			client.Close()
+		}
+		res := <-results
+		return res.state, errors.Join(err, res.err)
+	}
+	// the configs verify against the CA of the reissued certificate
+	state, err := handshake(clientTLS)
+	require.NoError(t, err)
+	require.NotEmpty(t, state.VerifiedChains)
+	// where CAs read once don't
+	_, err = handshake(stale)
+	require.Error(t, err)
+}
+
+func selfSigned(t *testing.T, cn string) (certPEM, keyPEM []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	if ip := net.ParseIP(cn); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{cn}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM
+}
+
+func TestKeepTokenAlive(t *testing.T) {
+	renewals := make(chan map[string]string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/token/lookup-self":
+			json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"ttl": 1}})
+		case "/v1/auth/token/renew-self":
+			var req map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			renewals <- req
+			json.NewEncoder(w).Encode(map[string]any{"auth": map[string]any{"lease_duration": 1}})
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewClient(srv.URL, token).KeepTokenAlive(ctx, func(err error) { t.Error(err) })
+		close(done)
+	}()
+	// renewed halfway through each one second lease, by the token's TTL
+	for range 2 {
+		select {
+		case req := <-renewals:
+			require.Empty(t, req)
+		case <-time.After(2 * time.Second):
+			t.Fatal("token wasn't renewed")
+		}
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("renewals didn't stop")
+	}
+
+	// a token that never expires isn't renewed
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/v1/auth/token/lookup-self", r.URL.Path)
+		json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{"ttl": 0}})
+	})
+	NewClient(srv.URL, token).KeepTokenAlive(context.Background(), func(err error) { t.Error(err) })
+}